@@ -47,6 +47,7 @@ if(ENABLE_CCACHE)
 endif()
 
 option(MENDER_EMBED_MENDER_AUTH "Build mender-auth into mender-update as one binary (experimental)" OFF)
+option(MENDER_DEBUG_CONSOLE "Build the interactive debug console into mender-update (Default: OFF)" OFF)
 
 include(cmake/build_mode.cmake)
 
@@ -69,6 +69,8 @@ using ExpectedAuthData = expected::expected<AuthData, error::Error>;
 
 using AuthenticatedAction = function<void(ExpectedAuthData)>;
 using ReAuthenticatedAction = function<void()>;
+using AuthorizationChangedAction = function<void(bool authorized)>;
+using AuthenticationFailedAction = function<void()>;
 
 class Authenticator {
 public:
@@ -87,6 +89,18 @@ public:
 		action_ = action;
 	}
 
+	// Register a callback to be called when the client gets a token after having none, or fails to
+	// get one after having one. Will overwrite the stored callback with the new one.
+	void RegisterAuthorizationChangedCallback(AuthorizationChangedAction action) {
+		authorization_changed_action_ = action;
+	}
+
+	// Register a callback to be called whenever an attempt to get a token fails, unlike the one
+	// above, which is only called on a change. Will overwrite the stored callback with the new one.
+	void RegisterAuthenticationFailedCallback(AuthenticationFailedAction action) {
+		authentication_failed_action_ = action;
+	}
+
 
 protected:
 	enum class NoTokenAction {
@@ -109,6 +123,9 @@ protected:
 	chrono::seconds auth_timeout_;
 	events::Timer auth_timeout_timer_;
 	ReAuthenticatedAction action_ {nullptr};
+	optional<bool> authorized_;
+	AuthorizationChangedAction authorization_changed_action_ {nullptr};
+	AuthenticationFailedAction authentication_failed_action_ {nullptr};
 };
 
 #ifdef MENDER_USE_DBUS
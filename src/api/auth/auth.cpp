@@ -85,6 +85,19 @@ error::Error Authenticator::WithToken(AuthenticatedAction action) {
 
 void Authenticator::PostPendingActions(const ExpectedAuthData &ex_auth_data) {
 	token_fetch_in_progress_ = false;
+
+	const bool authorized = ex_auth_data && ex_auth_data.value().token != "";
+	if (!authorized_ || authorized_.value() != authorized) {
+		authorized_ = authorized;
+		if (authorization_changed_action_) {
+			auto action = authorization_changed_action_;
+			loop_.Post([action, authorized]() { action(authorized); });
+		}
+	}
+	if (!authorized && authentication_failed_action_) {
+		loop_.Post(authentication_failed_action_);
+	}
+
 	for (auto action : pending_actions_) {
 		loop_.Post([action, ex_auth_data]() { action(ex_auth_data); });
 	}
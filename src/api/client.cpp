@@ -14,6 +14,8 @@
 
 #include <api/client.hpp>
 
+#include <algorithm>
+
 #include <common/error.hpp>
 #include <common/expected.hpp>
 #include <common/http.hpp>
@@ -49,8 +51,72 @@ http::ExpectedOutgoingRequestPtr APIRequest::WithAuthData(const auth::AuthData &
 	return out_req;
 }
 
+const size_t ServerAnnouncements::kMaxAnnouncements = 10;
+
+// Reduces a request path to the API it belongs to, for example "/api/devices/v1/deployments", so
+// that requests for different resources of the same API share an announcement.
+static string APIOfPath(const string &path) {
+	string api;
+	int segments = 0;
+	size_t pos = 0;
+	while (segments < 4 && pos < path.size()) {
+		auto next = path.find('/', pos + 1);
+		if (next == string::npos) {
+			next = path.size();
+		}
+		api += path.substr(pos, next - pos);
+		pos = next;
+		segments++;
+	}
+	return api;
+}
+
+void ServerAnnouncements::Record(const string &path, const http::Response &resp) {
+	vector<string> found;
+
+	// See RFC 9745 and RFC 8594.
+	auto ex_deprecation = resp.GetHeader("Deprecation");
+	if (ex_deprecation && ex_deprecation.value() != "false") {
+		string msg = "The server API " + APIOfPath(path) + " is deprecated";
+		auto ex_sunset = resp.GetHeader("Sunset");
+		if (ex_sunset) {
+			msg += " and will be removed after " + ex_sunset.value();
+		}
+		found.push_back(msg);
+	}
+
+	// Free form announcements, for example about upcoming maintenance.
+	auto ex_announcement = resp.GetHeader("X-MEN-Announcement");
+	if (ex_announcement && ex_announcement.value() != "") {
+		found.push_back(ex_announcement.value());
+	}
+
+	for (const auto &msg : found) {
+		if (find(announcements_.begin(), announcements_.end(), msg) != announcements_.end()) {
+			continue;
+		}
+		log::Warning("Announcement from the server: " + msg);
+		announcements_.push_back(msg);
+		if (announcements_.size() > kMaxAnnouncements) {
+			announcements_.erase(announcements_.begin());
+		}
+	}
+}
+
 error::Error HTTPClient::AsyncCall(
 	APIRequestPtr req, http::ResponseHandler header_handler, http::ResponseHandler body_handler) {
+	for (const auto &header : api_headers_) {
+		req->SetHeader(header.first, header.second);
+	}
+
+	header_handler = [this, path = req->GetPath(), header_handler](
+						 http::ExpectedIncomingResponsePtr ex_resp) {
+		if (ex_resp) {
+			announcements_.Record(path, *ex_resp.value());
+		}
+		header_handler(ex_resp);
+	};
+
 	// If the first request fails with 401, we need to get a new token and then
 	// try again with the new token. We should avoid using the same
 	// OutgoingRequest object for the two different requests, hence a copy and a
@@ -115,7 +181,15 @@ error::Error HTTPClient::AsyncCall(
 				[this, header_handler, reauthenticated_handler](
 					http::ExpectedIncomingResponsePtr ex_resp) {
 					if (!ex_resp) {
-						header_handler(ex_resp);
+						if (!server_failover_) {
+							header_handler(ex_resp);
+							return;
+						}
+						log::Warning(
+							"Request to the server failed, authenticating again to fail over: "
+							+ ex_resp.error().String());
+						authenticator_.ExpireToken();
+						authenticator_.WithToken(reauthenticated_handler);
 						return;
 					}
 					auto resp = ex_resp.value();
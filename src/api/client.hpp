@@ -17,6 +17,8 @@
 
 #include <memory>
 #include <string>
+#include <unordered_map>
+#include <vector>
 
 #include <api/auth.hpp>
 #include <common/error.hpp>
@@ -46,6 +48,24 @@ public:
 };
 using APIRequestPtr = shared_ptr<APIRequest>;
 
+// Keeps track of deprecation and maintenance announcements that the server sends in the headers
+// of its responses, so that they are visible from the device side too.
+class ServerAnnouncements {
+public:
+	static const size_t kMaxAnnouncements;
+
+	// Records the announcements in the response to a request for `path`, logging the ones that
+	// have not been seen before.
+	void Record(const string &path, const http::Response &resp);
+
+	const vector<string> &Get() const {
+		return announcements_;
+	}
+
+private:
+	vector<string> announcements_;
+};
+
 // Abstract class (interface) mostly needed so that we can mock this in tests
 // with a class skipping authentication.
 class Client {
@@ -55,6 +75,10 @@ public:
 		http::ResponseHandler header_handler,
 		http::ResponseHandler body_handler) = 0;
 
+	virtual vector<string> GetServerAnnouncements() const {
+		return {};
+	}
+
 	virtual ~Client() {};
 };
 
@@ -67,7 +91,8 @@ public:
 		const string &logger_name = "api_http_client") :
 		event_loop_ {event_loop},
 		http_client_ {config, event_loop, logger_name},
-		authenticator_ {authenticator} {};
+		authenticator_ {authenticator},
+		api_headers_ {config.api_headers} {};
 
 	// see http::Client::AsyncCall() for details about the handlers
 	error::Error AsyncCall(
@@ -75,14 +100,28 @@ public:
 		http::ResponseHandler header_handler,
 		http::ResponseHandler body_handler) override;
 
+	vector<string> GetServerAnnouncements() const override {
+		return announcements_.Get();
+	}
+
 	void ExpireToken() {
 		authenticator_.ExpireToken();
 	}
 
+	// When the connection to the server fails, authenticate again and repeat the request once,
+	// so that the authentication can fail over to another server. Only useful with more than one
+	// server.
+	void SetServerFailover(bool enabled) {
+		server_failover_ = enabled;
+	}
+
 private:
 	events::EventLoop &event_loop_;
 	http::Client http_client_;
 	auth::Authenticator &authenticator_;
+	unordered_map<string, string> api_headers_;
+	ServerAnnouncements announcements_;
+	bool server_failover_ {false};
 };
 
 } // namespace api
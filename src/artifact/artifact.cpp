@@ -18,6 +18,7 @@
 #include <common/expected.hpp>
 
 #include <artifact/error.hpp>
+#include <artifact/v3/header/header.hpp>
 
 
 namespace mender {
@@ -61,6 +62,60 @@ ExpectedPayloadHeaderView View(parser::Artifact &artifact, size_t index) {
 	};
 };
 
+ExpectedHeaderView HeaderViewFromJson(const string &header_json) {
+	auto exp_json = json::Load(header_json);
+	if (!exp_json) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::Code::ParseError,
+			"Failed to parse the header JSON: " + exp_json.error().message));
+	}
+	auto &header = exp_json.value();
+
+	auto exp_info_json = header.Get("header-info");
+	if (!exp_info_json) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::Code::ParseError,
+			"Missing header-info: " + exp_info_json.error().message));
+	}
+	io::StringReader info_reader {exp_info_json.value().Dump()};
+	auto exp_info = v3::header::info::Parse(info_reader);
+	if (!exp_info) {
+		return expected::unexpected(exp_info.error());
+	}
+	auto &info = exp_info.value();
+	if (info.payloads.size() == 0) {
+		return expected::unexpected(
+			parser_error::MakeError(parser_error::Code::ParseError, "No payloads in header-info"));
+	}
+
+	auto exp_type_info_json = header.Get("type-info");
+	if (!exp_type_info_json) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::Code::ParseError,
+			"Missing type-info: " + exp_type_info_json.error().message));
+	}
+	io::StringReader type_info_reader {exp_type_info_json.value().Dump()};
+	auto exp_type_info = v3::header::type_info::Parse(type_info_reader);
+	if (!exp_type_info) {
+		return expected::unexpected(exp_type_info.error());
+	}
+
+	json::Json meta_data;
+	auto exp_meta_data = header.Get("meta-data");
+	if (exp_meta_data) {
+		meta_data = exp_meta_data.value();
+	}
+
+	return HeaderView {
+		.artifact_group = info.provides.artifact_group.value_or(""),
+		.artifact_name = info.provides.artifact_name,
+		.payload_type = info.payloads.at(0).name,
+		.header_info = info,
+		.type_info = exp_type_info.value(),
+		.meta_data = meta_data,
+	};
+}
+
 unordered_map<string, string> HeaderView::GetProvides() const {
 	unordered_map<string, string> ret;
 	ret["artifact_name"] = artifact_name;
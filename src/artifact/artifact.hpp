@@ -71,6 +71,13 @@ using ExpectedPayloadHeaderView = expected::expected<PayloadHeaderView, error::E
 // which is dedicated to another payload (given by it's index).
 ExpectedPayloadHeaderView View(Artifact &artifact, size_t index);
 
+using ExpectedHeaderView = expected::expected<HeaderView, error::Error>;
+
+// Makes the view of the first payload from the `header-info` and `type-info` of an Artifact,
+// given as `{"header-info": {...}, "type-info": {...}}`, with an optional `meta-data`. For
+// checking an Artifact which is described, but not downloaded.
+ExpectedHeaderView HeaderViewFromJson(const string &header_json);
+
 } // namespace artifact
 } // namespace mender
 
@@ -15,11 +15,17 @@
 #ifndef MENDER_ARTIFACT_CONFIG_HPP
 #define MENDER_ARTIFACT_CONFIG_HPP
 
+#include <memory>
 #include <string>
 #include <vector>
 
 namespace mender {
 namespace artifact {
+
+namespace decryption {
+class Provider;
+} // namespace decryption
+
 namespace config {
 
 using namespace std;
@@ -34,6 +40,8 @@ struct ParserConfig {
 	int artifact_scripts_version;
 	vector<string> artifact_verify_keys;
 	Signature verify_signature;
+	// Without it, the payload of encrypted Artifacts can't be read.
+	shared_ptr<decryption::Provider> decryption_provider;
 };
 
 } // namespace config
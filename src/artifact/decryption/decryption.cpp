@@ -0,0 +1,94 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <artifact/decryption/decryption.hpp>
+
+#include <algorithm>
+#include <iterator>
+
+#include <artifact/error.hpp>
+
+namespace mender {
+namespace artifact {
+namespace decryption {
+
+ExpectedParameters ParametersFromMetaData(const json::Json &meta_data) {
+	if (!meta_data.IsObject()) {
+		return optional<Parameters> {};
+	}
+	auto exp_encryption = meta_data.Get(kMetaDataKey);
+	if (!exp_encryption) {
+		return optional<Parameters> {};
+	}
+
+	Parameters parameters;
+	for (auto field : {
+			 make_pair("algorithm", &parameters.algorithm),
+			 make_pair("key_id", &parameters.key_id),
+		 }) {
+		auto exp_value = exp_encryption.value().Get(field.first);
+		if (!exp_value || !exp_value.value().IsString()) {
+			return expected::unexpected(parser_error::MakeError(
+				parser_error::DecryptionError,
+				"`" + kMetaDataKey + "` in the meta-data must have `" + field.first
+					+ "` as a string"));
+		}
+		*field.second = exp_value.value().GetString().value();
+	}
+	if (parameters.algorithm != kAlgorithmAes256Gcm) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::DecryptionError,
+			"Unsupported payload encryption algorithm '" + parameters.algorithm + "', only "
+				+ kAlgorithmAes256Gcm + " is supported"));
+	}
+	return parameters;
+}
+
+int64_t PlainTextSize(const Parameters &parameters, int64_t encrypted_size) {
+	if (parameters.algorithm == kAlgorithmAes256Gcm) {
+		return max<int64_t>(encrypted_size - kAes256GcmNonceSize - kAes256GcmTagSize, 0);
+	}
+	return encrypted_size;
+}
+
+io::ExpectedReaderPtr FileKeyProvider::Decrypt(
+	const Parameters &parameters, io::ReaderPtr encrypted) {
+	auto key_file = key_files_.find(parameters.key_id);
+	if (key_file == key_files_.end()) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::DecryptionError,
+			"The payload is encrypted with the key '" + parameters.key_id
+				+ "', which is not in ArtifactDecryptionKeys"));
+	}
+
+	auto exp_stream = io::OpenIfstream(key_file->second);
+	if (!exp_stream) {
+		return expected::unexpected(
+			exp_stream.error().WithContext("While reading the decryption key"));
+	}
+	vector<uint8_t> key {
+		istreambuf_iterator<char>(exp_stream.value()), istreambuf_iterator<char>()};
+	if (key.size() != kAes256GcmKeySize) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::DecryptionError,
+			key_file->second + " must have the " + to_string(kAes256GcmKeySize)
+				+ " bytes of the key, it has " + to_string(key.size())));
+	}
+
+	return make_shared<Aes256GcmReader>(encrypted, key);
+}
+
+} // namespace decryption
+} // namespace artifact
+} // namespace mender
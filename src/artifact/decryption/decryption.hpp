@@ -0,0 +1,128 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_ARTIFACT_DECRYPTION_HPP
+#define MENDER_ARTIFACT_DECRYPTION_HPP
+
+#include <common/config.h>
+
+#include <cstdint>
+#include <memory>
+#include <string>
+#include <unordered_map>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/optional.hpp>
+
+#ifdef MENDER_CRYPTO_OPENSSL
+#include <openssl/evp.h>
+#endif
+
+namespace mender {
+namespace artifact {
+namespace decryption {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+
+// The key of the meta-data of an Artifact which tells how its payload is encrypted, see
+// Documentation/encrypted-artifacts.md.
+const string kMetaDataKey {"payload_encryption"};
+
+const string kAlgorithmAes256Gcm {"AES-256-GCM"};
+
+// Every encrypted payload file starts with the nonce, and ends with the authentication tag.
+const size_t kAes256GcmKeySize {32};
+const size_t kAes256GcmNonceSize {12};
+const size_t kAes256GcmTagSize {16};
+
+struct Parameters {
+	string algorithm;
+	// Which key the payload is encrypted with, for the provider to find it.
+	string key_id;
+};
+using ExpectedParameters = expected::expected<optional<Parameters>, error::Error>;
+
+// Nothing if the payload isn't encrypted.
+ExpectedParameters ParametersFromMetaData(const json::Json &meta_data);
+
+// The size of the decrypted file.
+int64_t PlainTextSize(const Parameters &parameters, int64_t encrypted_size);
+
+// Decrypts the payload files of encrypted Artifacts. The parser wraps every payload file, after
+// its checksum has been checked, in the reader returned by the provider.
+class Provider {
+public:
+	virtual ~Provider() {
+	}
+
+	// Fails if the key isn't available, or the algorithm isn't supported.
+	virtual io::ExpectedReaderPtr Decrypt(
+		const Parameters &parameters, io::ReaderPtr encrypted) = 0;
+};
+using ProviderPtr = shared_ptr<Provider>;
+
+// Decrypts a payload file encrypted with AES-256-GCM, as the nonce, the cipher text and the tag.
+// The tag is checked at the end of the file, so the plain text must not be trusted before the
+// end has been reached without errors.
+class Aes256GcmReader : virtual public io::Reader {
+public:
+	Aes256GcmReader(io::ReaderPtr encrypted, const vector<uint8_t> &key);
+
+	expected::ExpectedSize Read(
+		vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) override;
+
+private:
+	error::Error Initialize();
+	expected::ExpectedSize Finish();
+
+#ifdef MENDER_CRYPTO_OPENSSL
+	unique_ptr<EVP_CIPHER_CTX, void (*)(EVP_CIPHER_CTX *)> ctx_;
+#endif
+	io::ReaderPtr encrypted_;
+	vector<uint8_t> key_;
+	bool initialized_ {false};
+	bool done_ {false};
+	// The end of what has been read, which may be the tag.
+	vector<uint8_t> tail_;
+	vector<uint8_t> buffer_;
+};
+
+// The reference provider, which reads the keys from files, given by their IDs. Every file holds
+// the 32 bytes of an AES-256 key.
+class FileKeyProvider : virtual public Provider {
+public:
+	FileKeyProvider(const unordered_map<string, string> &key_files) :
+		key_files_ {key_files} {
+	}
+
+	io::ExpectedReaderPtr Decrypt(const Parameters &parameters, io::ReaderPtr encrypted) override;
+
+private:
+	unordered_map<string, string> key_files_;
+};
+
+} // namespace decryption
+} // namespace artifact
+} // namespace mender
+
+#endif // MENDER_ARTIFACT_DECRYPTION_HPP
@@ -0,0 +1,130 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <artifact/decryption/decryption.hpp>
+
+#include <openssl/evp.h>
+
+#include <artifact/error.hpp>
+
+namespace mender {
+namespace artifact {
+namespace decryption {
+
+Aes256GcmReader::Aes256GcmReader(io::ReaderPtr encrypted, const vector<uint8_t> &key) :
+	ctx_(EVP_CIPHER_CTX_new(), [](EVP_CIPHER_CTX *ctx) { EVP_CIPHER_CTX_free(ctx); }),
+	encrypted_ {encrypted},
+	key_ {key} {
+}
+
+// Reads the nonce, which the file starts with.
+error::Error Aes256GcmReader::Initialize() {
+	if (!ctx_ || key_.size() != kAes256GcmKeySize) {
+		return parser_error::MakeError(
+			parser_error::DecryptionError, "The decryption could not be initialized");
+	}
+
+	vector<uint8_t> nonce(kAes256GcmNonceSize);
+	size_t read {0};
+	while (read < nonce.size()) {
+		auto exp_read = encrypted_->Read(nonce.begin() + read, nonce.end());
+		if (!exp_read) {
+			return exp_read.error();
+		}
+		if (exp_read.value() == 0) {
+			return parser_error::MakeError(
+				parser_error::DecryptionError, "The encrypted payload file is truncated");
+		}
+		read += exp_read.value();
+	}
+
+	if (EVP_DecryptInit_ex(ctx_.get(), EVP_aes_256_gcm(), nullptr, nullptr, nullptr) != 1
+		|| EVP_CIPHER_CTX_ctrl(
+			   ctx_.get(), EVP_CTRL_GCM_SET_IVLEN, static_cast<int>(nonce.size()), nullptr)
+			   != 1
+		|| EVP_DecryptInit_ex(ctx_.get(), nullptr, nullptr, key_.data(), nonce.data()) != 1) {
+		return parser_error::MakeError(
+			parser_error::DecryptionError, "The decryption could not be initialized");
+	}
+	initialized_ = true;
+	return error::NoError;
+}
+
+expected::ExpectedSize Aes256GcmReader::Read(
+	vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) {
+	if (done_ || start == end) {
+		return 0;
+	}
+	if (!initialized_) {
+		auto err = Initialize();
+		if (err != error::NoError) {
+			return expected::unexpected(err);
+		}
+	}
+
+	// The last bytes read may be the tag, so they are only decrypted once more has been read.
+	while (true) {
+		buffer_.resize(end - start);
+		auto exp_read = encrypted_->Read(buffer_.begin(), buffer_.end());
+		if (!exp_read) {
+			return exp_read;
+		}
+		if (exp_read.value() == 0) {
+			return Finish();
+		}
+		buffer_.resize(exp_read.value());
+		tail_.insert(tail_.end(), buffer_.begin(), buffer_.end());
+		if (tail_.size() <= kAes256GcmTagSize) {
+			continue;
+		}
+
+		size_t cipher_size = tail_.size() - kAes256GcmTagSize;
+		int out_size {0};
+		if (EVP_DecryptUpdate(
+				ctx_.get(), &start[0], &out_size, tail_.data(), static_cast<int>(cipher_size))
+			!= 1) {
+			return expected::unexpected(parser_error::MakeError(
+				parser_error::DecryptionError, "Could not decrypt the payload file"));
+		}
+		tail_.erase(tail_.begin(), tail_.begin() + cipher_size);
+		if (out_size > 0) {
+			return out_size;
+		}
+	}
+}
+
+expected::ExpectedSize Aes256GcmReader::Finish() {
+	if (tail_.size() != kAes256GcmTagSize) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::DecryptionError, "The encrypted payload file is truncated"));
+	}
+
+	uint8_t out[EVP_MAX_BLOCK_LENGTH];
+	int out_size {0};
+	if (EVP_CIPHER_CTX_ctrl(
+			ctx_.get(), EVP_CTRL_GCM_SET_TAG, static_cast<int>(tail_.size()), tail_.data())
+			!= 1
+		|| EVP_DecryptFinal_ex(ctx_.get(), out, &out_size) != 1) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::DecryptionError,
+			"The payload file could not be authenticated, it is corrupt or was encrypted with "
+			"another key"));
+	}
+	done_ = true;
+	return 0;
+}
+
+} // namespace decryption
+} // namespace artifact
+} // namespace mender
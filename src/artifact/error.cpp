@@ -45,6 +45,8 @@ string ErrorCategoryClass::message(int code) const {
 		return "Signature verification Error";
 	case NoStateScriptsPathError:
 		return "Artifact has state scripts and no state scripts path has been specified";
+	case DecryptionError:
+		return "Decryption error";
 	}
 	assert(false);
 	return "Unknown";
@@ -35,6 +35,7 @@ enum Code {
 	EOFError,
 	SignatureVerificationError,
 	NoStateScriptsPathError,
+	DecryptionError,
 };
 
 class ErrorCategoryClass : public std::error_category {
@@ -190,7 +190,7 @@ ExpectedArtifact Parse(io::Reader &reader, config::ParserConfig config) {
 	auto header = expected_header.value();
 
 	// Create the object
-	auto artifact = Artifact {version, manifest, header, lexer};
+	auto artifact = Artifact {version, manifest, header, lexer, config.decryption_provider};
 	if (signature) {
 		artifact.manifest_signature = signature;
 	}
@@ -231,8 +231,30 @@ ExpectedPayload Artifact::Next() {
 			"Got unexpected token " + tok.TypeToString() + " expected 'data/0000.tar"));
 	}
 
+	optional<decryption::Parameters> decryption_parameters;
+	if (header.subHeaders.size() > 0 && header.subHeaders[0].metadata) {
+		auto exp_parameters =
+			decryption::ParametersFromMetaData(header.subHeaders[0].metadata.value());
+		if (!exp_parameters) {
+			return expected::unexpected(exp_parameters.error());
+		}
+		decryption_parameters = exp_parameters.value();
+	}
+	if (decryption_parameters && !decryption_provider_) {
+		return expected::unexpected(parser_error::MakeError(
+			parser_error::Code::DecryptionError,
+			"The payload is encrypted, but no decryption keys are configured"));
+	}
+
 	log::Trace("Parsing the payload");
 	payload_index_++;
+	if (decryption_parameters) {
+		return payload::Payload(
+			*(this->lexer_.current.value),
+			manifest,
+			decryption_provider_,
+			decryption_parameters.value());
+	}
 	return payload::Payload(*(this->lexer_.current.value), manifest);
 }
 
@@ -36,6 +36,7 @@
 #include <artifact/lexer.hpp>
 #include <artifact/token.hpp>
 #include <artifact/config.hpp>
+#include <artifact/decryption/decryption.hpp>
 
 #include <artifact/error.hpp>
 
@@ -67,6 +68,7 @@ class Artifact {
 private:
 	lexer::Lexer<token::Token, token::Type> lexer_;
 	unsigned int payload_index_ {0};
+	decryption::ProviderPtr decryption_provider_;
 
 public:
 	Version version;
@@ -80,8 +82,10 @@ public:
 		Version &version,
 		Manifest &manifest,
 		Header &header,
-		lexer::Lexer<token::Token, token::Type> lexer) :
+		lexer::Lexer<token::Token, token::Type> lexer,
+		decryption::ProviderPtr decryption_provider = nullptr) :
 		lexer_ {lexer},
+		decryption_provider_ {decryption_provider},
 		version {version},
 		manifest {manifest},
 		header {header} {
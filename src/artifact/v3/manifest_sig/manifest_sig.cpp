@@ -17,6 +17,7 @@
 #include <common/error.hpp>
 #include <artifact/error.hpp>
 #include <common/crypto.hpp>
+#include <common/log.hpp>
 
 namespace mender {
 namespace artifact {
@@ -26,6 +27,7 @@ namespace manifest_sig {
 namespace io = mender::common::io;
 namespace error = mender::common::error;
 namespace crypto = mender::common::crypto;
+namespace log = mender::common::log;
 
 ExpectedManifestSignature Parse(io::Reader &reader) {
 	stringstream ss;
@@ -47,6 +49,7 @@ expected::ExpectedBool VerifySignature(
 	for (const auto &key : artifact_verify_keys) {
 		auto e_verify_sign = crypto::VerifySign(key, shasum, signature);
 		if (e_verify_sign && e_verify_sign.value()) {
+			log::Info("Artifact signature verified with the key '" + key + "'");
 			return true;
 		}
 		if (!e_verify_sign) {
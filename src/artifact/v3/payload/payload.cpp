@@ -33,9 +33,23 @@ namespace tar = mender::tar;
 
 
 ExpectedSize Reader::Read(vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) {
+	if (decrypted_) {
+		return decrypted_->Read(start, end);
+	}
 	return reader_->Read(start, end);
 }
 
+error::Error Reader::Decrypt(
+	decryption::Provider &provider, const decryption::Parameters &decryption_parameters) {
+	auto exp_decrypted = provider.Decrypt(decryption_parameters, reader_);
+	if (!exp_decrypted) {
+		return exp_decrypted.error();
+	}
+	decryption_parameters_ = decryption_parameters;
+	decrypted_ = exp_decrypted.value();
+	return error::NoError;
+}
+
 ExpectedPayloadReader Payload::Next() {
 	auto expected_tar_entry = tar_reader_->Next();
 	if (!expected_tar_entry) {
@@ -56,7 +70,16 @@ ExpectedPayloadReader Payload::Next() {
 			parser_error::Code::ParseError,
 			"Payload contains file that is not listed in the manifest."));
 	}
-	return Reader {std::move(tar_entry), checksum};
+
+	Reader reader {std::move(tar_entry), checksum};
+	if (decryption_parameters_) {
+		auto err = reader.Decrypt(*decryption_provider_, decryption_parameters_.value());
+		if (err != error::NoError) {
+			return expected::unexpected(
+				err.WithContext("While decrypting the payload file " + tar_name));
+		}
+	}
+	return reader;
 }
 
 } // namespace payload
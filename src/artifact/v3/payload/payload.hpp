@@ -21,7 +21,9 @@
 
 #include <common/io.hpp>
 #include <common/expected.hpp>
+#include <common/optional.hpp>
 
+#include <artifact/decryption/decryption.hpp>
 #include <artifact/sha/sha.hpp>
 #include <artifact/tar/tar.hpp>
 #include <artifact/v3/manifest/manifest.hpp>
@@ -39,6 +41,7 @@ namespace tar = mender::tar;
 namespace sha = mender::sha;
 namespace expected = mender::common::expected;
 namespace manifest = mender::artifact::v3::manifest;
+namespace decryption = mender::artifact::decryption;
 
 using mender::common::expected::ExpectedSize;
 
@@ -48,6 +51,10 @@ public:
 		entry_ {make_shared<tar::Entry>(entry)},
 		reader_ {make_shared<sha::Reader>(sha::Reader {*entry_, checksum})} {};
 
+	// Decrypts what is read from now on. The checksum is of the encrypted file, so it is still
+	// checked before the decryption.
+	error::Error Decrypt(
+		decryption::Provider &provider, const decryption::Parameters &decryption_parameters);
 
 	ExpectedSize Read(vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) override;
 
@@ -55,12 +62,18 @@ public:
 		return this->entry_->Name();
 	}
 	int64_t Size() {
+		if (decryption_parameters_) {
+			return decryption::PlainTextSize(
+				decryption_parameters_.value(), this->entry_->Size());
+		}
 		return this->entry_->Size();
 	}
 
 private:
 	shared_ptr<tar::Entry> entry_;
 	shared_ptr<sha::Reader> reader_;
+	optional<decryption::Parameters> decryption_parameters_;
+	io::ReaderPtr decrypted_;
 };
 
 using ExpectedPayloadReader = expected::expected<Reader, error::Error>;
@@ -71,11 +84,23 @@ public:
 		tar_reader_ {make_shared<tar::Reader>(reader)},
 		manifest_ {manifest} {};
 
+	Payload(
+		io::Reader &reader,
+		manifest::Manifest &manifest,
+		decryption::ProviderPtr decryption_provider,
+		const decryption::Parameters &decryption_parameters) :
+		tar_reader_ {make_shared<tar::Reader>(reader)},
+		manifest_ {manifest},
+		decryption_provider_ {decryption_provider},
+		decryption_parameters_ {decryption_parameters} {};
+
 	ExpectedPayloadReader Next();
 
 private:
 	shared_ptr<tar::Reader> tar_reader_;
 	manifest::Manifest manifest_;
+	decryption::ProviderPtr decryption_provider_;
+	optional<decryption::Parameters> decryption_parameters_;
 };
 
 } // namespace payload
@@ -16,11 +16,14 @@
 
 #include <algorithm>
 #include <chrono>
+#include <fstream>
 #include <regex>
+#include <sstream>
 #include <string>
 
 #include <common/common.hpp>
 #include <common/expected.hpp>
+#include <common/json.hpp>
 #include <common/path.hpp>
 
 
@@ -36,6 +39,7 @@ using expected::ExpectedBool;
 
 namespace processes = mender::common::processes;
 namespace error = mender::common::error;
+namespace json = mender::common::json;
 namespace path = mender::common::path;
 
 
@@ -59,34 +63,43 @@ unordered_map<Action, string> action_map {
 	{Action::Error, "Error"},
 };
 
-error::Error CorrectVersionFile(const string &path) {
+// Returns the version in the version file, which is checked to be one of the supported ones.
+expected::ExpectedString ReadVersionFile(const string &path) {
 	// Missing file is OK
 	// This is because previous versions of the client wrote no
 	// version file, so no-file=v3
 	if (!path::FileExists(path)) {
-		return error::NoError;
+		return "3";
 	}
 
 	ifstream vf {path};
 
 	if (!vf) {
 		auto errnum {errno};
-		return error::Error(
-			generic_category().default_error_condition(errnum), "Failed to open the version file");
+		return expected::unexpected(error::Error(
+			generic_category().default_error_condition(errnum), "Failed to open the version file"));
 	}
 
 	string version;
 	vf >> version;
 	if (!vf) {
 		auto errnum {errno};
-		return error::Error(
+		return expected::unexpected(error::Error(
 			generic_category().default_error_condition(errnum),
-			"Error reading the version number from the version file");
+			"Error reading the version number from the version file"));
 	}
 
 	if (not common::VectorContainsString(supported_state_script_versions, version)) {
-		return executor::MakeError(
-			executor::VersionFileError, "Unexpected Artifact script version found: " + version);
+		return expected::unexpected(executor::MakeError(
+			executor::VersionFileError, "Unexpected Artifact script version found: " + version));
+	}
+	return version;
+}
+
+error::Error CorrectVersionFile(const string &path) {
+	auto exp_version = ReadVersionFile(path);
+	if (!exp_version) {
+		return exp_version.error();
 	}
 	return error::NoError;
 }
@@ -100,10 +113,16 @@ bool IsValidStateScript(const string &file, State state, Action action) {
 
 function<bool(const string &)> Matcher(State state, Action action) {
 	return [state, action](const string &file) {
+		if (common::EndsWith(file, script_timeout_file_suffix)) {
+			return false;
+		}
 		const bool is_valid {IsValidStateScript(file, state, action)};
 		if (!is_valid) {
 			return false;
 		}
+		if (common::EndsWith(file, wasm_script_suffix)) {
+			return true;
+		}
 		auto exp_executable = path::IsExecutable(file, true);
 		if (!exp_executable) {
 			log::Debug("Issue figuring the executable bits of: " + exp_executable.error().String());
@@ -165,7 +184,10 @@ ScriptRunner::ScriptRunner(
 	stderr_callback_ {stderr_callback},
 	error_script_error_ {error::NoError},
 	retry_interval_timer_ {new events::Timer(loop_)},
-	retry_timeout_timer_ {new events::Timer(loop_)} {};
+	retry_timeout_timer_ {new events::Timer(loop_)},
+	script_timeout_timer_ {new events::Timer(loop_)},
+	keepalive_received_ {make_shared<atomic<bool>>(false)},
+	retry_after_ {make_shared<atomic<int64_t>>(-1)} {};
 
 void ScriptRunner::LogErrAndExecuteNext(
 	Error err,
@@ -209,7 +231,8 @@ void ScriptRunner::HandleScriptError(Error err, HandlerFunction handler) {
 	if (err.code == processes::MakeError(processes::NonZeroExitStatusError, "").code) {
 		return handler(executor::MakeError(
 			executor::NonZeroExitStatusError,
-			"Received error code: " + to_string(this->script_.get()->GetExitStatus())));
+			"Received error code: " + to_string(this->script_.get()->GetExitStatus())
+				+ " from state script " + this->failed_script_));
 	}
 	return handler(err);
 }
@@ -218,13 +241,14 @@ void ScriptRunner::HandleScriptRetry(
 	vector<string>::iterator current_script,
 	vector<string>::iterator end,
 	bool ignore_error,
-	HandlerFunction handler) {
+	HandlerFunction handler,
+	chrono::milliseconds retry_interval) {
 	log::Info(
-		"Script returned Retry Later exit code, re-retrying in "
-		+ to_string(chrono::duration_cast<chrono::seconds>(this->retry_interval_).count()) + "s");
+		"Script asked to be retried later, re-retrying in "
+		+ to_string(chrono::duration_cast<chrono::seconds>(retry_interval).count()) + "s");
 
 	this->retry_interval_timer_->AsyncWait(
-		this->retry_interval_,
+		retry_interval,
 		[this, current_script, end, ignore_error, handler](error::Error err) {
 			if (err != error::NoError) {
 				return handler(this->error_script_error_.FollowedBy(err));
@@ -253,6 +277,224 @@ void ScriptRunner::MaybeSetupRetryTimeoutTimer() {
 	}
 }
 
+string ScriptRunner::ContextFile() const {
+	return path::Join(this->work_dir_, "state-script-context.json");
+}
+
+string ScriptRunner::ResultFile() const {
+	return path::Join(this->work_dir_, "state-script-result.json");
+}
+
+Error ScriptRunner::WriteScriptContext(const string &script) {
+	if (this->work_dir_ == "") {
+		return executor::MakeError(
+			executor::SetupError,
+			"No directory for the context of version " + json_state_script_version
+				+ " state scripts");
+	}
+
+	// Don't let a result from an earlier script be mistaken for one from this script.
+	if (path::FileExists(ResultFile())) {
+		auto err = path::FileDelete(ResultFile());
+		if (err != error::NoError) {
+			return err.WithContext("Could not remove the old state script result");
+		}
+	}
+
+	stringstream content;
+	content << R"({"api_version":)" << json_state_script_version;
+	content << R"(,"state":")" << state_map.at(this->state_) << R"(")";
+	content << R"(,"action":")" << action_map.at(this->action_) << R"(")";
+	content << R"(,"script":")" << json::EscapeString(script) << R"(")";
+	content << R"(,"result_file":")" << json::EscapeString(ResultFile()) << R"(")";
+	for (const auto &value : this->context_) {
+		content << R"(,")" << json::EscapeString(value.first) << R"(":")"
+				<< json::EscapeString(value.second) << R"(")";
+	}
+	content << "}";
+
+	const string tmp_file {ContextFile() + ".tmp"};
+	{
+		ofstream f {tmp_file, ios::trunc};
+		f << content.str();
+		if (!f) {
+			auto errnum {errno};
+			return error::Error(
+				generic_category().default_error_condition(errnum),
+				"Could not write the state script context to " + tmp_file);
+		}
+	}
+	return path::Rename(tmp_file, ContextFile());
+}
+
+optional<chrono::milliseconds> ScriptRunner::ReadScriptResult(const string &script) {
+	if (!path::FileExists(ResultFile())) {
+		return nullopt;
+	}
+
+	auto exp_result = json::LoadFromFile(ResultFile());
+	if (!exp_result) {
+		log::Warning(
+			"Ignoring invalid result from state script " + script + ": "
+			+ exp_result.error().String());
+		return nullopt;
+	}
+	const auto &result = exp_result.value();
+
+	auto exp_message = result.Get("message").and_then(json::ToString);
+	if (exp_message) {
+		// Goes into the deployment log, like everything else logged during a deployment.
+		log::Info("Message from state script " + script + ": " + exp_message.value());
+	}
+
+	auto exp_substatus = result.Get("substatus").and_then(json::ToString);
+	if (exp_substatus) {
+		this->substatus_ = exp_substatus.value();
+	}
+
+	auto exp_retry_after = result.Get("retry_after").and_then(json::ToInt64);
+	if (exp_retry_after && exp_retry_after.value() >= 0) {
+		return chrono::milliseconds {chrono::seconds {exp_retry_after.value()}};
+	}
+	return nullopt;
+}
+
+// Looks for a `# mender-timeout: <seconds>` line in the first lines of the script.
+static optional<chrono::seconds> HeaderTimeout(const string &script) {
+	if (common::EndsWith(script, wasm_script_suffix)) {
+		return nullopt;
+	}
+
+	ifstream f {script};
+	string line;
+	for (int i = 0; i < script_timeout_header_lines && getline(f, line); i++) {
+		const auto pos = line.find(script_timeout_header);
+		if (!common::StartsWith<string>(line, "#") || pos == string::npos) {
+			continue;
+		}
+		istringstream value {line.substr(pos + script_timeout_header.size())};
+		string content;
+		value >> content;
+		auto exp_seconds = common::StringTo<int>(content);
+		if (!exp_seconds || exp_seconds.value() <= 0) {
+			log::Warning("Ignoring invalid timeout in the header of " + script);
+			return nullopt;
+		}
+		return chrono::seconds {exp_seconds.value()};
+	}
+	return nullopt;
+}
+
+chrono::milliseconds ScriptRunner::ScriptTimeout(const string &script) {
+	const string timeout_file {script + script_timeout_file_suffix};
+	if (!path::FileExists(timeout_file)) {
+		auto header_timeout = HeaderTimeout(script);
+		if (header_timeout) {
+			return header_timeout.value();
+		}
+		return this->script_timeout_;
+	}
+
+	ifstream f {timeout_file};
+	string content;
+	f >> content;
+	auto exp_seconds = common::StringTo<int>(content);
+	if (!f || !exp_seconds || exp_seconds.value() <= 0) {
+		log::Warning(
+			"Ignoring invalid timeout in " + timeout_file + ", using the default of "
+			+ to_string(chrono::duration_cast<chrono::seconds>(this->script_timeout_).count())
+			+ "s");
+		return this->script_timeout_;
+	}
+	return chrono::seconds {exp_seconds.value()};
+}
+
+void ScriptRunner::ArmScriptTimeoutTimer(const string &script, chrono::milliseconds timeout) {
+	this->script_timeout_timer_->AsyncWait(timeout, [this, script, timeout](error::Error err) {
+		if (err != error::NoError) {
+			return;
+		}
+		if (this->keepalive_received_->exchange(false)) {
+			log::Debug("State script " + script + " is still alive, restarting its timeout");
+			ArmScriptTimeoutTimer(script, timeout);
+			return;
+		}
+		log::Error(
+			"State script " + script + " timed out after "
+			+ to_string(chrono::duration_cast<chrono::seconds>(timeout).count())
+			+ "s without a keep-alive");
+		this->script_timed_out_ = true;
+		this->script_->Cancel();
+	});
+}
+
+processes::OutputCallback ScriptRunner::StdoutCallbackWithMessages(
+	processes::OutputCallback callback) {
+	auto keepalive_received = this->keepalive_received_;
+	auto retry_after = this->retry_after_;
+	// The message may be split between two calls, so keep the tail of the previous output.
+	auto tail = make_shared<string>();
+	// The retry message must be a line of its own, only its beginning is kept.
+	auto line = make_shared<string>();
+	const size_t max_line {script_retry_after_prefix.size() + 20};
+	return [keepalive_received, retry_after, callback, tail, line, max_line](
+			   const char *data, size_t size) {
+		*tail += string(data, size);
+		if (tail->find(script_keepalive_message) != string::npos) {
+			keepalive_received->store(true);
+			tail->clear();
+		} else if (tail->size() > script_keepalive_message.size()) {
+			*tail = tail->substr(tail->size() - script_keepalive_message.size());
+		}
+		for (size_t i = 0; i < size; i++) {
+			if (data[i] != '\n') {
+				if (line->size() < max_line) {
+					line->push_back(data[i]);
+				}
+				continue;
+			}
+			if (common::StartsWith(*line, script_retry_after_prefix)) {
+				auto exp_seconds =
+					common::StringTo<int64_t>(line->substr(script_retry_after_prefix.size()));
+				if (exp_seconds && exp_seconds.value() >= 0) {
+					retry_after->store(exp_seconds.value());
+				} else {
+					log::Warning("Ignoring invalid retry interval from state script: " + *line);
+				}
+			}
+			line->clear();
+		}
+		if (callback) {
+			callback(data, size);
+		}
+	};
+}
+
+processes::OutputCallback ScriptRunner::LimitedOutputCallback(
+	processes::OutputCallback callback,
+	const string &script,
+	shared_ptr<atomic<size_t>> output_size) {
+	const size_t limit {this->output_limit_};
+	if (!callback || limit == 0) {
+		return callback;
+	}
+	// Shared by stdout and stderr, which are read from different threads.
+	return [callback, script, output_size, limit](const char *data, size_t size) {
+		const size_t before = output_size->fetch_add(size);
+		if (before >= limit) {
+			return;
+		}
+		if (before + size <= limit) {
+			callback(data, size);
+			return;
+		}
+		callback(data, limit - before);
+		log::Warning(
+			"Not logging more output of state script " + script + ", it exceeded "
+			+ to_string(limit) + " bytes");
+	};
+}
+
 Error ScriptRunner::Execute(
 	vector<string>::iterator current_script,
 	vector<string>::iterator end,
@@ -266,41 +508,109 @@ Error ScriptRunner::Execute(
 
 	log::Info("Running State Script: " + *current_script);
 
-	this->script_.reset(new processes::Process({*current_script}));
-	auto err {this->script_->Start(stdout_callback_, stderr_callback_)};
+	vector<string> args;
+	if (common::EndsWith(*current_script, wasm_script_suffix)) {
+		if (this->wasm_runtime_.empty()) {
+			return executor::MakeError(
+				executor::SetupError,
+				"No WebAssembly runtime configured to run " + *current_script
+					+ ", see StateScriptWasmRuntime");
+		}
+		args = this->wasm_runtime_;
+	}
+	args.push_back(*current_script);
+	if (this->version_ == json_state_script_version) {
+		auto err = WriteScriptContext(*current_script);
+		if (err != error::NoError) {
+			return err;
+		}
+		args.push_back(ContextFile());
+	}
+
+	this->keepalive_received_ = make_shared<atomic<bool>>(false);
+	this->retry_after_ = make_shared<atomic<int64_t>>(-1);
+	this->script_.reset(new processes::Process(args));
+	this->script_->SetEnvironment(this->environment_);
+	auto output_size = make_shared<atomic<size_t>>(0);
+	auto err {this->script_->Start(
+		StdoutCallbackWithMessages(
+			LimitedOutputCallback(stdout_callback_, *current_script, output_size)),
+		LimitedOutputCallback(stderr_callback_, *current_script, output_size))};
 	if (err != error::NoError) {
 		return err;
 	}
 
+	this->script_timed_out_ = false;
+	ArmScriptTimeoutTimer(*current_script, ScriptTimeout(*current_script));
+
 	return this->script_.get()->AsyncWait(
 		this->loop_,
 		[this, current_script, end, ignore_error, handler](Error err) {
+			this->script_timeout_timer_->Cancel();
+			if (this->script_timed_out_) {
+				err = error::Error(
+					make_error_condition(errc::timed_out),
+					"State script " + *current_script + " timed out");
+			}
+			const bool exited =
+				err == error::NoError
+				|| err.code == processes::MakeError(processes::NonZeroExitStatusError, "").code;
+			if (exited && this->version_ == json_state_script_version) {
+				auto retry_after = ReadScriptResult(*current_script);
+				if (retry_after) {
+					MaybeSetupRetryTimeoutTimer();
+					return HandleScriptRetry(
+						current_script, end, ignore_error, handler, retry_after.value());
+				}
+			}
 			if (err != error::NoError) {
 				const bool is_script_retry_error =
 					err.code == processes::MakeError(processes::NonZeroExitStatusError, "").code
 					&& this->script_->GetExitStatus() == state_script_retry_exit_code;
 				if (is_script_retry_error) {
 					MaybeSetupRetryTimeoutTimer();
-					return HandleScriptRetry(current_script, end, ignore_error, handler);
+					const auto retry_after = this->retry_after_->load();
+					return HandleScriptRetry(
+						current_script,
+						end,
+						ignore_error,
+						handler,
+						retry_after >= 0 ? chrono::milliseconds {chrono::seconds {retry_after}}
+										 : this->retry_interval_);
 				} else if (ignore_error) {
 					return LogErrAndExecuteNext(err, current_script, end, ignore_error, handler);
 				}
+				this->failed_script_ = path::BaseName(*current_script);
+				if (this->script_timed_out_) {
+					this->failure_ = this->failed_script_ + " timed out";
+				} else if (
+					err.code == processes::MakeError(processes::NonZeroExitStatusError, "").code) {
+					this->failure_ = this->failed_script_ + " exited with status "
+									 + to_string(this->script_->GetExitStatus());
+				} else {
+					this->failure_ = this->failed_script_ + " failed: " + err.message;
+				}
 				return HandleScriptError(err, handler);
 			}
 			return HandleScriptNext(current_script, end, ignore_error, handler);
-		},
-		this->script_timeout_);
+		});
 }
 
 Error ScriptRunner::AsyncRunScripts(
 	State state, Action action, HandlerFunction handler, OnError on_error) {
 	// Verify the version in the version file (OK if no version file present)
-	auto version_file_error {CorrectVersionFile(path::Join(
+	auto exp_version {ReadVersionFile(path::Join(
 		IsArtifactScript(state) ? this->artifact_script_path_ : this->rootfs_script_path_,
 		"version"))};
-	if (version_file_error != error::NoError) {
-		return version_file_error;
+	if (!exp_version) {
+		return exp_version.error();
 	}
+	this->version_ = exp_version.value();
+	this->state_ = state;
+	this->action_ = action;
+	this->substatus_.clear();
+	this->failed_script_.clear();
+	this->failure_.clear();
 
 	// Collect
 	const auto script_path {ScriptPath(state)};
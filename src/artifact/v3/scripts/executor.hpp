@@ -15,8 +15,11 @@
 #ifndef MENDER_ARTIFACT_V3_SCRIPT_EXECUTOR_HPP
 #define MENDER_ARTIFACT_V3_SCRIPT_EXECUTOR_HPP
 
+#include <atomic>
+#include <map>
 #include <memory>
 #include <string>
+#include <vector>
 
 #include <common/common.hpp>
 #include <common/events.hpp>
@@ -41,7 +44,33 @@ namespace processes = mender::common::processes;
 
 using Error = mender::common::error::Error;
 
-const vector<string> supported_state_script_versions {"2", "3"};
+// Scripts using this version get their context as a JSON file and can return a JSON result, see
+// Documentation/state-scripts-v4-api.md. Earlier versions only communicate through the exit code.
+const string json_state_script_version {"4"};
+
+const vector<string> supported_state_script_versions {"2", "3", json_state_script_version};
+
+// A file next to a script, with this suffix added to its name, can hold a timeout in seconds for
+// just that script, overriding the global one.
+const string script_timeout_file_suffix {".timeout"};
+
+// A comment line in the first lines of a script, followed by a timeout in seconds, does the same
+// without a file of its own. The file wins if there are both.
+const string script_timeout_header {"mender-timeout:"};
+const int script_timeout_header_lines {5};
+
+// Scripts with this suffix are WebAssembly modules, run by the configured runtime instead of being
+// executed directly. They don't need to be executable.
+const string wasm_script_suffix {".wasm"};
+
+// Long running scripts can print this line to their standard output to show that they are still
+// making progress. This restarts their timeout.
+const string script_keepalive_message {"MENDER_KEEPALIVE"};
+
+// A script which exits with the retry exit code can print a line with this prefix, followed by a
+// number of seconds, to its standard output, to be run again after that long instead of after the
+// global retry interval.
+const string script_retry_after_prefix {"MENDER_RETRY_AFTER="};
 
 enum class State {
 	Idle,
@@ -94,6 +123,40 @@ public:
 
 	Error RunScripts(State state, Action action, OnError on_error = OnError::Fail);
 
+	// Values passed to scripts using the JSON API, and the directory where the files exchanged
+	// with those scripts are kept.
+	void SetScriptContext(const string &work_dir, const map<string, string> &context) {
+		work_dir_ = work_dir;
+		context_ = context;
+	}
+
+	// Added to the environment of every script, whatever its version.
+	void SetEnvironment(const map<string, string> &environment) {
+		environment_ = environment;
+	}
+
+	// The command, with its arguments, which runs the WebAssembly scripts. The path of the script
+	// is added after it, followed by the context file for the JSON API.
+	void SetWasmRuntime(const vector<string> &runtime) {
+		wasm_runtime_ = runtime;
+	}
+
+	// The substatus returned by the last script using the JSON API, or empty if none did.
+	const string &Substatus() const {
+		return substatus_;
+	}
+
+	// At most this many bytes of the output of each script are passed to the output callbacks,
+	// and so logged by default. 0 doesn't limit it.
+	void SetOutputLimit(size_t bytes) {
+		output_limit_ = bytes;
+	}
+
+	// The name of the script which failed the last run, and how, for instance
+	// "ArtifactInstall_Enter_01 exited with status 2". Empty if none did.
+	const string &Failure() const {
+		return failure_;
+	}
 
 private:
 	Error Execute(
@@ -116,13 +179,27 @@ private:
 		vector<string>::iterator current_script,
 		vector<string>::iterator end,
 		bool ignore_error,
-		HandlerFunction handler);
+		HandlerFunction handler,
+		chrono::milliseconds retry_interval);
 	void HandleScriptNext(
 		vector<string>::iterator current_script,
 		vector<string>::iterator end,
 		bool ignore_error,
 		HandlerFunction handler);
 	void MaybeSetupRetryTimeoutTimer();
+	chrono::milliseconds ScriptTimeout(const string &script);
+	void ArmScriptTimeoutTimer(const string &script, chrono::milliseconds timeout);
+	processes::OutputCallback StdoutCallbackWithMessages(processes::OutputCallback callback);
+	processes::OutputCallback LimitedOutputCallback(
+		processes::OutputCallback callback,
+		const string &script,
+		shared_ptr<atomic<size_t>> output_size);
+
+	string ContextFile() const;
+	string ResultFile() const;
+	Error WriteScriptContext(const string &script);
+	// Returns the retry interval if the script asked to be run again.
+	optional<chrono::milliseconds> ReadScriptResult(const string &script);
 
 	string ScriptPath(State state);
 
@@ -136,9 +213,26 @@ private:
 	processes::OutputCallback stderr_callback_;
 	Error error_script_error_;
 	vector<string> collected_scripts_;
+	string version_;
+	State state_ {State::Idle};
+	Action action_ {Action::Enter};
+	string work_dir_;
+	map<string, string> context_;
+	map<string, string> environment_;
+	vector<string> wasm_runtime_;
+	string substatus_;
+	size_t output_limit_ {0};
+	string failed_script_;
+	string failure_;
 	unique_ptr<processes::Process> script_;
 	unique_ptr<events::Timer> retry_interval_timer_;
 	unique_ptr<events::Timer> retry_timeout_timer_;
+	unique_ptr<events::Timer> script_timeout_timer_;
+	bool script_timed_out_ {false};
+	// Set from the output thread of the script.
+	shared_ptr<atomic<bool>> keepalive_received_;
+	// In seconds, negative if the script didn't print it.
+	shared_ptr<atomic<int64_t>> retry_after_;
 };
 
 } // namespace executor
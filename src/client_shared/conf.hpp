@@ -15,12 +15,14 @@
 #ifndef MENDER_COMMON_CONF_HPP
 #define MENDER_COMMON_CONF_HPP
 
+#include <chrono>
 #include <iostream>
 #include <string>
 #include <unordered_set>
 #include <vector>
 
 #include <client_shared/config_parser.hpp>
+#include <client_shared/server_discovery.hpp>
 #include <common/http.hpp>
 #include <common/path.hpp>
 #include <common/optional.hpp>
@@ -35,6 +37,7 @@ namespace expected = mender::common::expected;
 namespace cfg_parser = mender::client_shared::config_parser;
 namespace path = mender::common::path;
 namespace http = mender::common::http;
+namespace server_discovery = mender::client_shared::server_discovery;
 
 extern const string kMenderVersion;
 
@@ -156,12 +159,14 @@ class Paths {
 private:
 	string path_conf_dir = conf::GetEnv("MENDER_CONF_DIR", DefaultPaths.path_conf_dir);
 	string rootfs_scripts_path = path::Join(path_conf_dir, "scripts");
+	string preflight_checks_dir = path::Join(path_conf_dir, "preflight.d");
 	string conf_file = path::Join(path_conf_dir, "mender.conf");
 
 	string path_data_dir = conf::GetEnv("MENDER_DATA_DIR", DefaultPaths.path_data_dir);
 	string modules_path = path::Join(path_data_dir, "modules/v3");
 	string identity_script = path::Join(path_data_dir, "identity", "mender-device-identity");
 	string inventory_scripts_dir = path::Join(path_data_dir, "inventory");
+	string self_test_dir = path::Join(path_data_dir, "self-test");
 
 	string data_store = conf::GetEnv("MENDER_DATASTORE_DIR", DefaultPaths.data_store);
 	string update_log_path = data_store;
@@ -180,6 +185,7 @@ public:
 		this->path_conf_dir = conf_dir;
 		this->conf_file = path::Join(path_conf_dir, "mender.conf");
 		this->rootfs_scripts_path = path::Join(path_conf_dir, "scripts");
+		this->preflight_checks_dir = path::Join(path_conf_dir, "preflight.d");
 	}
 
 	string GetPathDataDir() const {
@@ -189,6 +195,7 @@ public:
 		this->path_data_dir = path_data_dir;
 		this->identity_script = path::Join(path_data_dir, "identity", "mender-device-identity");
 		this->inventory_scripts_dir = path::Join(path_data_dir, "inventory");
+		this->self_test_dir = path::Join(path_data_dir, "self-test");
 		this->modules_path = path::Join(path_data_dir, "modules/v3");
 	}
 
@@ -263,6 +270,20 @@ public:
 		this->rootfs_scripts_path = rootfs_scripts_path;
 	}
 
+	string GetPreflightChecksDir() const {
+		return preflight_checks_dir;
+	}
+	void SetPreflightChecksDir(const string &preflight_checks_dir) {
+		this->preflight_checks_dir = preflight_checks_dir;
+	}
+
+	string GetSelfTestDir() const {
+		return self_test_dir;
+	}
+	void SetSelfTestDir(const string &self_test_dir) {
+		this->self_test_dir = self_test_dir;
+	}
+
 	string GetModulesPath() const {
 		return modules_path;
 	}
@@ -285,6 +306,29 @@ public:
 	}
 };
 
+// The configuration files, in the order they are loaded, the later ones taking precedence: the
+// fallback file, the main file, the `*.json` drop-ins in `mender.conf.d` next to the main file,
+// and then the ones next to the fallback file, each in the order of their names. The files may
+// not exist. See Documentation/configuration-drop-ins.md.
+vector<string> ConfigFiles(const Paths &paths);
+
+// The tenant token set at runtime, in the data store. It takes precedence over the TenantToken of
+// the configuration files, so that a device can be moved to another tenant without editing them.
+extern const string kTenantTokenFile;
+
+// Replaces the tenant token kept in the data store.
+error::Error SaveTenantToken(const string &data_store, const string &token);
+
+// The servers found with ServerDiscovery, and their CA certificate, in the data store.
+extern const string kServerDiscoveryFile;
+extern const string kServerDiscoveryCaFile;
+
+// Held while writing the files in the data store which more than one process writes, such as the
+// device key, the tenant token and the servers found, since `mender-auth daemon` runs alongside
+// `mender-update` and the command line tools.
+extern const string kDataStoreLockFile;
+path::ExpectedFileLock LockDataStore(const string &data_store);
+
 bool FindCmdlineHelpArg(vector<string>::const_iterator start, vector<string>::const_iterator end);
 
 void PrintCliHelp(const CliApp &cli, ostream &stream = std::cout);
@@ -305,10 +349,28 @@ public:
 		return http_client_config_;
 	}
 
+	// The keys to verify Artifact signatures with: `artifact_verify_keys`, followed by the ones
+	// in `artifact_verify_keys_dir`, as it is right now. Fails if the directory can't be read, or
+	// has no keys, rather than accepting unsigned Artifacts.
+	expected::ExpectedStringVector GetArtifactVerifyKeys() const;
+
+	// Looks for the servers with ServerDiscovery if none are configured, and the ones found
+	// earlier, which are loaded with the configuration, are missing or due for a refresh. Blocks
+	// while looking for them.
+	error::Error DiscoverServers();
+
 private:
 	error::Error LoadConfigFile_(const string &path, bool required);
+	error::Error LoadTenantToken_();
+	error::Error LoadDiscoveredServers_();
+	server_discovery::ExpectedDiscovered FindServers_() const;
 
 	http::ClientConfig http_client_config_;
+
+	// The ServerCertificate given in the configuration, not the one found with the servers.
+	string configured_server_certificate_;
+	// When the servers were found, if they come from ServerDiscovery.
+	optional<chrono::system_clock::time_point> servers_discovered_at_;
 };
 
 } // namespace conf
@@ -14,30 +14,50 @@
 
 #include <client_shared/conf.hpp>
 
+#include <algorithm>
+#include <chrono>
 #include <string>
 #include <cstdlib>
 #include <cerrno>
+#include <fstream>
+
+#include <sys/utsname.h>
 
 #include <mender-version.h>
 
+#include <common/common.hpp>
 #include <common/error.hpp>
 #include <common/expected.hpp>
+#include <common/http_diagnostics.hpp>
+#include <common/http_pac.hpp>
+#include <common/io.hpp>
 #include <common/log.hpp>
 #include <common/json.hpp>
+#include <common/path.hpp>
 
 namespace mender {
 namespace client_shared {
 namespace conf {
 
 using namespace std;
+namespace common = mender::common;
 namespace error = mender::common::error;
 namespace expected = mender::common::expected;
+namespace io = mender::common::io;
 namespace log = mender::common::log;
 namespace json = mender::common::json;
 namespace config_parser = mender::client_shared::config_parser;
 
 const string kMenderVersion = MENDER_VERSION;
 
+// Where the DHCP client hooks save the PAC file URL from option 252.
+const string kDhcpPacUrlFile = "/run/mender/wpad.url";
+
+const string kTenantTokenFile = "tenant-token";
+const string kServerDiscoveryFile = "server-discovery.json";
+const string kServerDiscoveryCaFile = "server-discovery-ca.pem";
+const string kDataStoreLockFile = "datastore.lock";
+
 const DefaultPathsType DefaultPaths;
 
 const ConfigErrorCategoryClass ConfigErrorCategory;
@@ -146,6 +166,69 @@ ExpectedOptionValue CmdlineOptionsIterator::Next() {
 	return ExpectedOptionValue({std::move(option), std::move(value)});
 }
 
+// Gives the proxy URL with the credentials from the configuration added to it, since that is where
+// the HTTP client expects them.
+static expected::ExpectedString ProxyUrlFromConfig(
+	const string &proxy, const string &username, const string &password) {
+	http::BrokenDownUrl address;
+	auto err = http::BreakDownUrl(proxy, address, true);
+	if (err != error::NoError) {
+		return expected::unexpected(err.WithContext("Invalid Proxy in the configuration"));
+	}
+	if (username == "" && password == "") {
+		return proxy;
+	}
+	if (address.username != "") {
+		return expected::unexpected(MakeError(
+			ConfigErrorCode::InvalidOptionsError,
+			"Proxy credentials cannot be given both in the Proxy URL and in ProxyUsername and"
+			" ProxyPassword"));
+	}
+
+	auto scheme_end = proxy.find("://") + 3;
+	return proxy.substr(0, scheme_end) + http::URLEncode(username) + ":"
+		   + http::URLEncode(password) + "@" + proxy.substr(scheme_end);
+}
+
+// Gives "Mender/<version> (device_type=<device type>; <kernel> <release>; <machine>)", so that
+// gateways and logs in front of the server can tell devices apart. Parts which can't be found out
+// are left out.
+static string MakeUserAgent(const string &device_type_file) {
+	vector<string> details;
+
+	ifstream device_type_stream(device_type_file);
+	string line;
+	if (getline(device_type_stream, line) && common::StartsWith<string>(line, "device_type=")) {
+		details.push_back(line);
+	}
+
+	struct utsname uts;
+	if (uname(&uts) == 0) {
+		details.push_back(string(uts.sysname) + " " + uts.release);
+		details.push_back(uts.machine);
+	}
+
+	if (details.empty()) {
+		return "Mender/" + kMenderVersion;
+	}
+
+	// Anything which can't be in a header value, or would break the structure, is replaced.
+	for (auto &detail : details) {
+		for (auto &c : detail) {
+			if (c < 0x20 || c >= 0x7f || c == '(' || c == ')' || c == ';') {
+				c = '_';
+			}
+		}
+	}
+	return "Mender/" + kMenderVersion + " (" + common::JoinStrings(details, "; ") + ")";
+}
+
+static bool HasServers(const vector<string> &servers) {
+	return any_of(servers.cbegin(), servers.cend(), [](const string &server) {
+		return server != "";
+	});
+}
+
 expected::ExpectedSize MenderConfig::ProcessCmdlineArgs(
 	vector<string>::const_iterator start, vector<string>::const_iterator end, const CliApp &app) {
 	bool explicit_config_path = false;
@@ -230,13 +313,17 @@ expected::ExpectedSize MenderConfig::ProcessCmdlineArgs(
 		SetLevel(ex_log_level.value());
 	}
 
-	auto err = LoadConfigFile_(paths.GetFallbackConfFile(), explicit_fallback_config_path);
-	if (error::NoError != err) {
-		this->Reset();
-		return expected::unexpected(err);
+	for (const auto &file : ConfigFiles(paths)) {
+		bool required = (file == paths.GetConfFile() && explicit_config_path)
+						|| (file == paths.GetFallbackConfFile() && explicit_fallback_config_path);
+		auto err = LoadConfigFile_(file, required);
+		if (error::NoError != err) {
+			this->Reset();
+			return expected::unexpected(err);
+		}
 	}
 
-	err = LoadConfigFile_(paths.GetConfFile(), explicit_config_path);
+	auto err = LoadTenantToken_();
 	if (error::NoError != err) {
 		this->Reset();
 		return expected::unexpected(err);
@@ -254,6 +341,24 @@ expected::ExpectedSize MenderConfig::ProcessCmdlineArgs(
 		SetLevel(ex_log_level.value());
 	}
 
+	if (this->log_format != "") {
+		auto ex_log_format = log::StringToLogFormat(this->log_format);
+		if (!ex_log_format) {
+			return expected::unexpected(ex_log_format.error());
+		}
+		log::SetFormat(ex_log_format.value());
+	} else {
+		log::SetFormat(log::LogFormat::Logfmt);
+	}
+
+	for (const auto &module_level : this->log_levels) {
+		err = log::SetModuleLevel(module_level.first, module_level.second);
+		if (err != error::NoError) {
+			return expected::unexpected(
+				err.WithContext("Invalid log level for module '" + module_level.first + "'"));
+		}
+	}
+
 	if (trusted_cert != "") {
 		this->server_certificate = trusted_cert;
 	}
@@ -262,12 +367,65 @@ expected::ExpectedSize MenderConfig::ProcessCmdlineArgs(
 		this->skip_verify = true;
 	}
 
+	if (security.auth_mode == cfg_parser::AuthMode::MTLS
+		&& (https_client.certificate == "" || https_client.key == "")) {
+		return expected::unexpected(MakeError(
+			ConfigErrorCode::InvalidOptionsError,
+			"Security.AuthMode 'mtls' requires both HttpsClient.Certificate and HttpsClient.Key"));
+	}
+
+	if (security.security_key != ""
+		&& (security.auth_private_key != "" || security.auth_mode == cfg_parser::AuthMode::MTLS)) {
+		return expected::unexpected(MakeError(
+			ConfigErrorCode::InvalidOptionsError,
+			"Security.SecurityKey cannot be combined with Security.AuthPrivateKey or with"
+			" Security.AuthMode 'mtls'"));
+	}
+
+	configured_server_certificate_ = server_certificate;
+	if (server_discovery.Enabled() && !HasServers(servers)) {
+		err = LoadDiscoveredServers_();
+		if (err != error::NoError) {
+			log::Warning("Could not load the servers found earlier: " + err.String());
+		}
+	}
+
 	http_client_config_.server_cert_path = server_certificate;
 	http_client_config_.client_cert_path = https_client.certificate;
 	http_client_config_.client_cert_key_path = https_client.key;
 	http_client_config_.ssl_engine = https_client.ssl_engine;
 	http_client_config_.skip_verify = skip_verify;
 	http_client_config_.retry_download_count = retry_download_count;
+	http_client_config_.user_agent = MakeUserAgent(
+		device_type_file != "" ? device_type_file
+							   : path::Join(paths.GetDataStore(), "device_type"));
+	http_client_config_.api_headers = http_headers;
+	http_client_config_.link_tuning = http::LinkTuning {
+		.tcp_max_segment_size = link_tuning.tcp_max_segment_size,
+		.tls_max_fragment_length = link_tuning.tls_max_fragment_length,
+		.read_buffer_size = static_cast<size_t>(link_tuning.read_buffer_size),
+		.stall_timeout = chrono::seconds {link_tuning.stall_timeout_seconds},
+	};
+	if (low_resource.enabled) {
+		auto &read_buffer_size = http_client_config_.link_tuning.read_buffer_size;
+		const auto buffer_size = static_cast<size_t>(low_resource.buffer_size);
+		if (read_buffer_size == 0 || read_buffer_size > buffer_size) {
+			read_buffer_size = buffer_size;
+		}
+	}
+	http_client_config_.keep_alive = http::KeepAlive {
+		.enabled = keep_alive.enabled,
+		.idle_timeout = chrono::seconds {keep_alive.idle_timeout_seconds},
+	};
+	http_client_config_.certificate_pinning.hosts = certificate_pinning.hosts;
+	http_client_config_.certificate_pinning.exceptions.clear();
+	for (const auto &exception : certificate_pinning.exceptions) {
+		http_client_config_.certificate_pinning.exceptions.push_back(http::PinningException {
+			.interfaces = exception.interfaces,
+			.ssids = exception.ssids,
+			.trusted_cert_path = exception.trusted_certificate,
+		});
+	}
 
 	auto proxy = http::GetHttpProxyStringFromEnvironment();
 	if (proxy) {
@@ -296,9 +454,112 @@ expected::ExpectedSize MenderConfig::ProcessCmdlineArgs(
 			"Unsupported syntax for NO_PROXY environment variable. Use space-separated values instead of comma-separated."));
 	}
 
+	if (this->proxy != "") {
+		auto exp_proxy =
+			ProxyUrlFromConfig(this->proxy, this->proxy_username, this->proxy_password);
+		if (!exp_proxy) {
+			return expected::unexpected(exp_proxy.error());
+		}
+		http_client_config_.http_proxy = exp_proxy.value();
+		http_client_config_.https_proxy = exp_proxy.value();
+	} else if (this->proxy_username != "" || this->proxy_password != "") {
+		return expected::unexpected(MakeError(
+			ConfigErrorCode::InvalidOptionsError,
+			"ProxyUsername and ProxyPassword have no effect without Proxy"));
+	}
+
+	if (proxy_auto_config.Enabled()) {
+		http::pac::ResolverConfig resolver_config {
+			.url = proxy_auto_config.url,
+			.dhcp_url_file = proxy_auto_config.dhcp ? kDhcpPacUrlFile : "",
+			.evaluator = proxy_auto_config.evaluator,
+			.download_path = path::Join(paths.GetDataStore(), "proxy.pac"),
+		};
+		auto resolver = make_shared<http::pac::Resolver>(resolver_config, http_client_config_);
+		http_client_config_.proxy_resolver = [resolver](const string &url) {
+			return resolver->Resolve(url);
+		};
+	}
+
+	if (connection_diagnostics.enabled) {
+		auto recorder = make_shared<http::diagnostics::Recorder>(
+			path::Join(paths.GetDataStore(), "connection-diagnostics"),
+			static_cast<size_t>(connection_diagnostics.max_records),
+			connection_diagnostics.max_records_per_minute);
+		http_client_config_.connection_recorder = [recorder](const http::ConnectionRecord &record) {
+			recorder->Add(record);
+		};
+	}
+
 	return opts_iter.GetPos();
 }
 
+expected::ExpectedStringVector MenderConfig::GetArtifactVerifyKeys() const {
+	vector<string> keys {artifact_verify_keys};
+	if (artifact_verify_keys_dir == "") {
+		return keys;
+	}
+
+	auto exp_files = path::ListFiles(artifact_verify_keys_dir, [](const string &file) {
+		return file.size() > 4 && file.substr(file.size() - 4) == ".pem";
+	});
+	if (!exp_files) {
+		return expected::unexpected(exp_files.error().WithContext(
+			"Could not read the Artifact verification keys in '" + artifact_verify_keys_dir
+			+ "'"));
+	}
+	vector<string> files {exp_files.value().begin(), exp_files.value().end()};
+	if (files.empty()) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::no_such_file_or_directory),
+			"No Artifact verification keys in '" + artifact_verify_keys_dir + "'"));
+	}
+	sort(files.begin(), files.end());
+
+	for (const auto &file : files) {
+		if (find(keys.begin(), keys.end(), file) == keys.end()) {
+			keys.push_back(file);
+		}
+	}
+	return keys;
+}
+
+// The drop-ins in `conf_file` followed by `.d`.
+static vector<string> DropInFiles(const string &conf_file) {
+	const string dir = conf_file + ".d";
+	if (!path::FileExists(dir)) {
+		return {};
+	}
+	auto exp_files = path::ListFiles(
+		dir, [](const string &file) { return common::EndsWith<string>(file, ".json"); });
+	if (!exp_files) {
+		log::Warning("Could not list the configuration files in '" + dir
+					 + "': " + exp_files.error().message);
+		return {};
+	}
+	vector<string> files {exp_files.value().begin(), exp_files.value().end()};
+	sort(files.begin(), files.end());
+	return files;
+}
+
+vector<string> ConfigFiles(const Paths &paths) {
+	vector<string> files {paths.GetFallbackConfFile(), paths.GetConfFile()};
+	for (const auto &file : DropInFiles(paths.GetConfFile())) {
+		files.push_back(file);
+	}
+	for (const auto &file : DropInFiles(paths.GetFallbackConfFile())) {
+		files.push_back(file);
+	}
+
+	vector<string> unique;
+	for (const auto &file : files) {
+		if (find(unique.begin(), unique.end(), file) == unique.end()) {
+			unique.push_back(file);
+		}
+	}
+	return unique;
+}
+
 error::Error MenderConfig::LoadConfigFile_(const string &path, bool required) {
 	auto ret = this->LoadFile(path);
 	if (!ret) {
@@ -328,6 +589,190 @@ error::Error MenderConfig::LoadConfigFile_(const string &path, bool required) {
 	return error::NoError;
 }
 
+// Replaced in one go, so that a restart never sees a partial file.
+static error::Error ReplaceFile(const string &file_path, const string &content) {
+	const string tmp_path = file_path + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, file_path);
+}
+
+error::Error MenderConfig::LoadTenantToken_() {
+	const string token_path = path::Join(paths.GetDataStore(), kTenantTokenFile);
+	if (!path::FileExists(token_path)) {
+		return error::NoError;
+	}
+
+	auto exp_ifs = io::OpenIfstream(token_path);
+	if (!exp_ifs) {
+		return exp_ifs.error();
+	}
+	string token;
+	errno = 0;
+	getline(exp_ifs.value(), token);
+	if (exp_ifs.value().bad()) {
+		int io_errno = errno;
+		return error::Error(
+			generic_category().default_error_condition(io_errno),
+			"Failed to read the tenant token from '" + token_path + "'");
+	}
+	if (token == "") {
+		log::Warning("Ignoring the empty tenant token in '" + token_path + "'");
+		return error::NoError;
+	}
+
+	log::Debug("Using the tenant token from '" + token_path + "'");
+	this->tenant_token = token;
+	return error::NoError;
+}
+
+error::Error SaveTenantToken(const string &data_store, const string &token) {
+	if (token == "" || token.find('\n') != string::npos) {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"The tenant token must be a single, non-empty line");
+	}
+
+	auto exp_lock = LockDataStore(data_store);
+	if (!exp_lock) {
+		return exp_lock.error();
+	}
+	return ReplaceFile(path::Join(data_store, kTenantTokenFile), token + "\n");
+}
+
+path::ExpectedFileLock LockDataStore(const string &data_store) {
+	auto err = path::CreateDirectories(data_store);
+	if (err != error::NoError) {
+		return expected::unexpected(err.WithContext("Could not create the data store"));
+	}
+	return path::LockFile(path::Join(data_store, kDataStoreLockFile));
+}
+
+error::Error MenderConfig::LoadDiscoveredServers_() {
+	const string discovery_path = path::Join(paths.GetDataStore(), kServerDiscoveryFile);
+	if (!path::FileExists(discovery_path)) {
+		return error::NoError;
+	}
+
+	auto exp_json = json::LoadFromFile(discovery_path);
+	if (!exp_json) {
+		return exp_json.error();
+	}
+	auto exp_servers_json = exp_json.value().Get("servers");
+	if (!exp_servers_json) {
+		return exp_servers_json.error();
+	}
+	auto exp_servers = json::ToStringVector(exp_servers_json.value());
+	if (!exp_servers) {
+		return exp_servers.error();
+	}
+	auto exp_ca = json::Get<string>(exp_json.value(), "ca_certificate", json::MissingOk::Yes);
+	if (!exp_ca) {
+		return exp_ca.error();
+	}
+	auto exp_time = json::Get<int64_t>(exp_json.value(), "time", json::MissingOk::No);
+	if (!exp_time) {
+		return exp_time.error();
+	}
+
+	servers = exp_servers.value();
+	if (configured_server_certificate_ == "" && exp_ca.value() != "") {
+		server_certificate = exp_ca.value();
+	}
+	servers_discovered_at_ = chrono::system_clock::time_point {chrono::seconds {exp_time.value()}};
+	return error::NoError;
+}
+
+server_discovery::ExpectedDiscovered MenderConfig::FindServers_() const {
+	error::Error err;
+	if (server_discovery.bootstrap_url != "") {
+		// Trusted through the configured certificates, not the one found with the servers.
+		auto fetch_config = http_client_config_;
+		fetch_config.server_cert_path = configured_server_certificate_;
+		auto exp_discovered =
+			server_discovery::FromBootstrapUrl(server_discovery.bootstrap_url, fetch_config);
+		if (exp_discovered || server_discovery.srv_record == "") {
+			return exp_discovered;
+		}
+		log::Warning(exp_discovered.error().String() + ", trying the SRV record instead");
+	}
+	return server_discovery::FromSrvRecord(server_discovery.srv_record);
+}
+
+error::Error MenderConfig::DiscoverServers() {
+	if (!server_discovery.Enabled() || (HasServers(servers) && !servers_discovered_at_)) {
+		return error::NoError;
+	}
+	const auto now = chrono::system_clock::now();
+	if (servers_discovered_at_
+		&& now < servers_discovered_at_.value()
+					 + chrono::seconds {server_discovery.refresh_interval_seconds}) {
+		return error::NoError;
+	}
+
+	log::Info("Looking for the servers");
+	auto exp_discovered = FindServers_();
+	if (!exp_discovered) {
+		if (servers_discovered_at_) {
+			log::Warning(
+				"Could not look for the servers again, keeping the ones found earlier: "
+				+ exp_discovered.error().String());
+			return error::NoError;
+		}
+		return exp_discovered.error().WithContext("Could not find the servers");
+	}
+	const auto &discovered = exp_discovered.value();
+
+	auto exp_lock = LockDataStore(paths.GetDataStore());
+	if (!exp_lock) {
+		return exp_lock.error();
+	}
+
+	string ca_path;
+	const string ca_file = path::Join(paths.GetDataStore(), kServerDiscoveryCaFile);
+	if (discovered.ca_certificate != "") {
+		auto err = ReplaceFile(ca_file, discovered.ca_certificate);
+		if (err != error::NoError) {
+			return err.WithContext("Could not save the CA certificate of the servers");
+		}
+		ca_path = ca_file;
+	} else if (path::FileExists(ca_file)) {
+		path::FileDelete(ca_file);
+	}
+
+	vector<string> quoted;
+	for (const auto &server : discovered.servers) {
+		quoted.push_back("\"" + json::EscapeString(server) + "\"");
+	}
+	const auto seconds = chrono::duration_cast<chrono::seconds>(now.time_since_epoch()).count();
+	auto err = ReplaceFile(
+		path::Join(paths.GetDataStore(), kServerDiscoveryFile),
+		R"({"servers":[)" + common::JoinStrings(quoted, ",") + R"(],"ca_certificate":")"
+			+ json::EscapeString(ca_path) + R"(","time":)" + to_string(seconds) + "}\n");
+	if (err != error::NoError) {
+		// They are still used, only looked for again next time.
+		log::Warning("Could not save the servers found: " + err.String());
+	}
+
+	log::Info("Found the servers: " + common::JoinStrings(discovered.servers, ", "));
+	servers = discovered.servers;
+	server_certificate = configured_server_certificate_;
+	if (configured_server_certificate_ == "" && ca_path != "") {
+		server_certificate = ca_path;
+	}
+	http_client_config_.server_cert_path = server_certificate;
+	servers_discovered_at_ = now;
+	return error::NoError;
+}
+
 } // namespace conf
 } // namespace client_shared
 } // namespace mender
@@ -13,6 +13,7 @@
 //    limitations under the License.
 
 #include <string>
+#include <unordered_map>
 #include <vector>
 #include <common/error.hpp>
 #include <common/expected.hpp>
@@ -40,11 +41,533 @@ struct HttpsClient {
 	string ssl_engine;
 };
 
+/** AuthMode selects the key the device authenticates with: A generated key, or AuthPrivateKey
+	(`keypair`), or the key of the HttpsClient certificate (`mtls`). */
+enum class AuthMode {
+	KeyPair,
+	MTLS,
+};
+
+/** KeyType is the algorithm of the generated device key: `ed25519`, `ecdsa-p256` or `rsa3072`. */
+enum class KeyType {
+	Ed25519,
+	EcdsaP256,
+	Rsa3072,
+};
+
 /** Security structure holds the configuration for the client Added for MEN-3924
 	in order to provide a way to specify PKI params outside HttpsClient. */
 struct ClientSecurity {
 	string auth_private_key;
 	string ssl_engine;
+	AuthMode auth_mode {AuthMode::KeyPair};
+	KeyType key_type {KeyType::Ed25519};
+	/** PKCS#11 URI of the device key in a hardware token, such as
+		`pkcs11:token=mender;object=device`. The key is generated in the token if it isn't
+		there, and never leaves it. */
+	string security_key;
+};
+
+/** PostCommitCleanup holds the cleanup steps which the daemon runs after an update has been
+	committed successfully. */
+struct PostCommitCleanup {
+	/** Remove data left in the Update Module work directory by earlier deployments, and the
+		bootstrap Artifact if it is still present. */
+	bool remove_cached_artifacts = false;
+	/** Remove the logs of all earlier deployments. */
+	bool prune_deployment_logs = false;
+	/** Mount points to run `fstrim` on, for example the one of the now inactive partition. */
+	vector<string> fstrim;
+	/** Commands to run with `/bin/sh -c`, in order. */
+	vector<string> hooks;
+};
+
+/** A file system which must have at least `min_bytes` available. */
+struct FreeSpaceCheck {
+	string path;
+	int64_t min_bytes = 0;
+};
+
+/** PreflightChecks holds the checks which the daemon runs before the download, and again before
+	the installation, of an Artifact, so that a deployment which can't succeed fails before it
+	has started, with a clear reason. */
+struct PreflightChecks {
+	/** For example the data partition, and the inactive partition if it is mounted. */
+	vector<FreeSpaceCheck> free_space;
+	/** How long the device must have been running, so that it's not updated while it is still
+		starting up, or in a reboot loop. 0 disables the check. */
+	int min_uptime_seconds = 0;
+	/** Executables to run, in addition to those in the preflight checks directory, for example
+		to check the battery level. */
+	vector<string> scripts;
+	/** How long every executable may run, after which it is killed, and the check fails. */
+	int script_timeout_seconds = 60;
+};
+
+/** CanaryMode holds the health checks which the daemon runs after an update has been installed,
+	and the device has rebooted if needed, for an observation window before the commit. The
+	update is rolled back if one of them fails during the window. */
+struct CanaryMode {
+	/** How long to observe the update. 0 disables canary mode. */
+	int window_seconds = 0;
+	/** How often to run the health checks during the window. */
+	int interval_seconds = 30;
+	/** Commands to run with `/bin/sh -c`, in order. A command fails when it exits with anything
+		but 0. */
+	vector<string> health_checks;
+	/** How long every command may run, after which it is killed, and the check fails. */
+	int health_check_timeout_seconds = 30;
+
+	bool Enabled() const {
+		return window_seconds > 0 && !health_checks.empty();
+	}
+};
+
+/** PilotMode keeps the previous software to go back to for a while after the commit, see
+	Documentation/pilot-mode.md. */
+struct PilotMode {
+	/** How long to keep watching the update after the commit. 0 disables pilot mode. */
+	int soak_seconds = 0;
+	/** How often to run the health checks during the soak period. */
+	int interval_seconds = 60;
+	/** Commands to run with `/bin/sh -c`, in order, as in CanaryMode. */
+	vector<string> health_checks;
+	int health_check_timeout_seconds = 30;
+	/** Command to run with `/bin/sh -c` to go back to the previous software, for example by
+		switching the boot slots back, when a health check fails. */
+	string revert_command;
+
+	bool Enabled() const {
+		return soak_seconds > 0 && !health_checks.empty();
+	}
+};
+
+/** UserNotifications tells the people in front of the device about updates, for human-operated
+	devices such as kiosks and medical carts. */
+struct UserNotifications {
+	/** Show desktop notifications, over org.freedesktop.Notifications, in every graphical
+		session. */
+	bool desktop = false;
+	/** Send messages to all terminals, with `wall`. */
+	bool wall = false;
+	/** How long to wait after the notification that the device is about to reboot, before
+		rebooting it. */
+	int reboot_warning_seconds = 0;
+
+	bool Enabled() const {
+		return desktop || wall;
+	}
+};
+
+/** A destination for the deployment events, see Documentation/telemetry-sinks.md. */
+struct TelemetrySink {
+	/** `exec` runs `command` with the event as its argument, `webhook` POSTs it to `url`. */
+	string type;
+	string command;
+	string url;
+	/** How long a delivery may take, after which it is given up. */
+	int timeout_seconds = 30;
+};
+
+/** An MQTT broker to announce the state transitions, deployment outcomes and authorization changes
+	to, see Documentation/mqtt-bridge.md. */
+struct Mqtt {
+	/** `mqtt://host[:port]`, or `mqtts://host[:port]` for TLS. Empty disables the bridge. */
+	string broker_url;
+	string client_id;
+	string username;
+	string password;
+	/** For TLS: a CA certificate to verify the broker with, on top of the system ones, and the
+		certificate and key to authenticate to the broker with. */
+	string server_certificate;
+	string client_certificate;
+	string client_certificate_key;
+	/** 0 or 1. */
+	int qos = 1;
+	bool retain = false;
+	/** Where each kind of event is published. An empty topic doesn't publish those events. */
+	string state_topic = "mender/state";
+	string deployment_topic = "mender/deployment";
+	string authorization_topic = "mender/authorization";
+	/** How long publishing may take, after which the events are dropped. */
+	int timeout_seconds = 30;
+
+	bool Enabled() const {
+		return broker_url != "";
+	}
+};
+
+/** Encryption of the values in the database, see Documentation/store-encryption.md. */
+struct StoreEncryption {
+	/** A file holding the secret which the encryption key is derived from. */
+	string key_file;
+	/** A TPM object, as given to `tpm2_unseal -c`, which the secret is sealed in. */
+	string tpm_sealed_object;
+
+	bool Enabled() const {
+		return key_file != "" || tpm_sealed_object != "";
+	}
+};
+
+/** Networks on which the TLS connections are intercepted, and the CA doing it, which is only
+	trusted on them. */
+struct CertificatePinningException {
+	/** Network interfaces, such as "eth1", that the connections go out on. */
+	vector<string> interfaces;
+	/** Names of Wi-Fi networks. */
+	vector<string> ssids;
+	/** File with the certificates of the intercepting CA. */
+	string trusted_certificate;
+};
+
+/** Public keys which the servers must have, see Documentation/certificate-pinning.md. */
+struct CertificatePinning {
+	/** For each host name, in lower case, the base64 encoded SHA-256 hashes of the public keys
+		one of which a certificate of its chain must have. Other hosts aren't pinned. */
+	unordered_map<string, vector<string>> hosts;
+	vector<CertificatePinningException> exceptions;
+
+	bool Enabled() const {
+		return !hosts.empty() || !exceptions.empty();
+	}
+};
+
+/** DeviceConfiguration polls the configuration of the device from the deviceconfig API of the
+	server, and applies it with scripts, without the mender-configure add-on. See
+	Documentation/device-configuration.md. */
+struct DeviceConfiguration {
+	bool enabled = false;
+	/** How often to check for a new configuration. */
+	int poll_interval_seconds = 3600;
+	/** Executables which apply the configuration, run in alphabetical order with the path of a
+		JSON file holding the whole configuration. */
+	string apply_scripts_dir = "/usr/lib/mender-configure/apply-device-config.d";
+	/** How long every script may run, after which it is killed, and the configuration fails. */
+	int apply_timeout_seconds = 600;
+};
+
+/** PushChannel keeps a WebSocket connection open to the deviceconnect API of the server, over
+	which the server can have the device check for an update or submit its inventory right away,
+	without mender-connect. See Documentation/push-channel.md. */
+struct PushChannel {
+	bool enabled = false;
+	/** How often to ping the server, to notice a connection which has silently broken. */
+	int ping_interval_seconds = 60;
+	/** The longest wait before connecting again, after the connection failed. The waits start at
+		one minute, and double. */
+	int max_retry_interval_seconds = 600;
+};
+
+/** LocalApi serves the methods of the D-Bus interfaces over HTTP on Unix sockets, for systems
+	which don't run a D-Bus daemon. See Documentation/local-api.md. */
+struct LocalApi {
+	bool enabled = false;
+	/** Where mender-update serves the io.mender.Update1 methods. */
+	string update_socket_path = "/run/mender/update.sock";
+	/** Where mender-auth serves the io.mender.Authentication1 methods. */
+	string auth_socket_path = "/run/mender/auth.sock";
+};
+
+/** Unix users and groups which may call some of the D-Bus methods. */
+struct DBusAuthorizationRule {
+	/** Methods, as "<interface>.<method>", or "<interface>.*" for all methods of an
+		interface. */
+	vector<string> methods;
+	vector<string> users;
+	/** Groups whose members may call the methods, whether it's their primary group or not. */
+	vector<string> groups;
+	/** The uids of the users and the gids of the groups, see DBusAuthorization::ResolveIds(). */
+	vector<uint32_t> uids;
+	vector<uint32_t> gids;
+};
+
+/** DBusAuthorization restricts who may call the D-Bus methods, on top of the bus policies. See
+	Documentation/dbus-authorization.md. */
+struct DBusAuthorization {
+	vector<DBusAuthorizationRule> rules;
+
+	/** Looks up the users and groups of the rules in the user database, so that the calls are
+		only checked against their IDs. Done once, when the daemon starts. Logs and returns the
+		names which aren't in it, and which no call is allowed for. */
+	vector<string> ResolveIds();
+
+	/** Whether the user with the uid, a member of the groups with the gids, may call the method,
+		given as "<interface>.<method>". root, uid 0, may call all methods, and everyone the methods
+		which no rule lists. */
+	bool Allows(const string &method, uint32_t uid, const vector<uint32_t> &gids) const;
+};
+
+/** SelfTest holds the checks which the daemon runs when the client has changed since it last
+	ran, before it goes on with its work. See Documentation/self-test.md. */
+struct SelfTest {
+	bool enabled = true;
+	/** How long every executable in the self-test directory may run, after which it is killed,
+		and the check fails. */
+	int script_timeout_seconds = 60;
+	/** How often the checks are run again while they fail. */
+	int retry_interval_seconds = 300;
+};
+
+/** StateTimeouts limits how long the states of a deployment which run the Update Module may
+	take, after which the deployment fails. 0 is no limit. See Documentation/state-timeouts.md. */
+struct StateTimeouts {
+	/** The download of the Artifact, including the Download state of the Update Module. */
+	int download_seconds = 0;
+	/** ArtifactInstall. */
+	int install_seconds = 0;
+	/** ArtifactReboot, and ArtifactVerifyReboot after the reboot, each. */
+	int reboot_seconds = 0;
+	/** ArtifactCommit. */
+	int commit_seconds = 0;
+};
+
+/** Metrics serves counters and gauges of how the daemon is doing, for Prometheus and other
+	monitoring systems. See Documentation/metrics.md. */
+struct Metrics {
+	/** "unix:" and the absolute path of a Unix socket, or a "host:port" with an IP address, such as
+		"127.0.0.1:9464". Empty disables the metrics. */
+	string listen;
+};
+
+/** ChunkedDownload holds the configuration for downloading Artifacts chunk by chunk from a
+	content-addressed chunk store, instead of as a whole. */
+struct ChunkedDownload {
+	/** Base URL of the chunk store. Empty disables chunked downloads. */
+	string store_url;
+	/** Files, usually the active root filesystem partition, to take chunks from when they
+		contain them, rather than downloading them. */
+	vector<string> seeds;
+};
+
+/** LinkTuning holds settings for links which lose large packets, such as cellular links where
+	path MTU discovery is broken, so that connections stall. 0 means the default. */
+struct LinkTuning {
+	/** Maximum TCP segment size to announce to the server. */
+	int tcp_max_segment_size = 0;
+	/** TLS maximum fragment length to negotiate: 512, 1024, 2048 or 4096. */
+	int tls_max_fragment_length = 0;
+	/** Largest part of a response body to read from the connection at a time, in bytes. */
+	int read_buffer_size = 0;
+	/** How long a TLS handshake or a read of a response body may go without receiving anything.
+		The default is no limit for the handshake, and 5 minutes for reads. */
+	int stall_timeout_seconds = 0;
+	/** When an Artifact download stalls, try again with more and more conservative settings,
+		and log which ones worked. */
+	bool adaptive = false;
+};
+
+/** ConnectionDiagnostics records what is known about each HTTP request of the client, such as
+	the timings, the byte counts, the TLS version and the TCP retransmissions, for debugging
+	network issues. */
+struct ConnectionDiagnostics {
+	bool enabled = false;
+	/** How many of the latest requests are kept. */
+	int max_records = 500;
+	/** More requests than this in a minute are only counted. */
+	int max_records_per_minute = 20;
+};
+
+/** KeepAlive keeps the connections to the servers open between requests, so that short poll
+	intervals don't pay for a new TLS handshake every time, see
+	Documentation/connection-reuse.md. */
+struct KeepAlive {
+	bool enabled = true;
+	/** How long a connection may stay unused before it is closed. */
+	int idle_timeout_seconds = 60;
+};
+
+/** DeploymentLogs limits how much space the logs of the deployments take, see
+	Documentation/deployment-logs.md. */
+struct DeploymentLogs {
+	/** Size at which the log of the ongoing deployment is rotated. Only the latest rotated part
+		is kept. 0 never rotates. */
+	int64_t rotate_size_bytes = 0;
+	/** Compress the logs of the earlier deployments with gzip. */
+	bool compress = false;
+	/** Upper bound for the logs of the earlier deployments together. 0 is no limit. */
+	int64_t max_total_size_bytes = 0;
+	/** Send the logs to the server compressed with gzip, unless it has refused that before. */
+	bool compress_upload = false;
+};
+
+/** StartupWait holds back the first contact with the server until the device is ready for it, see
+	Documentation/systemd-integration.md. */
+struct StartupWait {
+	/** Wait for the system clock to be synchronized. */
+	bool time_sync = false;
+	/** Wait for these network interfaces to be up. */
+	vector<string> interfaces;
+	/** How long to wait at most, after which the client goes on anyway. 0 waits for as long as it
+		takes. */
+	int timeout_seconds = 300;
+
+	bool Enabled() const {
+		return time_sync || !interfaces.empty();
+	}
+};
+
+/** LowResource bounds the memory and CPU the client takes on constrained devices, so that it
+	contends less with the applications of the device during updates, see
+	Documentation/low-resource-mode.md. */
+struct LowResource {
+	bool enabled = false;
+	/** Largest buffer for reading from the network and for writing the payload to the Update
+		Module, in bytes. */
+	int buffer_size = 4096;
+	/** Niceness of the Update Module while it downloads and installs the payload, as for
+		`nice(1)`. 0 leaves it as it is. */
+	int install_niceness = 0;
+	/** I/O scheduling class of the Update Module while it downloads and installs the payload,
+		"best-effort" or "idle", as for `ionice(1)`. Empty leaves it as it is. */
+	string install_io_class;
+};
+
+/** A time of day during which a different download rate limit applies. */
+struct DownloadRateLimitWindow {
+	/** Minutes since midnight, in local time. The window wraps around midnight if it ends before
+		it starts. */
+	int start_minute = 0;
+	int end_minute = 0;
+	int64_t bytes_per_second = 0;
+};
+
+/** Limits the bandwidth used for Artifact downloads, so that the connection of the device is not
+	saturated. A limit of 0 means unlimited. */
+struct DownloadRateLimit {
+	int64_t bytes_per_second = 0;
+	/** The first window that matches the time of day overrides `bytes_per_second`. */
+	vector<DownloadRateLimitWindow> windows;
+
+	bool Enabled() const {
+		return bytes_per_second > 0 || !windows.empty();
+	}
+
+	/** Returns the limit in effect at the given minute of the day. */
+	int64_t BytesPerSecondAt(int minute_of_day) const;
+};
+
+/** A weekly time range during which a deployment may go on, see UpdateWindow. */
+struct UpdateWindowRange {
+	/** Days the range starts on, bit 0 for Sunday to bit 6 for Saturday. */
+	unsigned weekdays = 0x7f;
+	/** Minutes since midnight. The range wraps around midnight if it ends before it starts, and
+		then also covers the early hours of the next day. */
+	int start_minute = 0;
+	int end_minute = 0;
+};
+
+/** UpdateWindow holds the maintenance windows which some of the states of a deployment wait for,
+	see Documentation/update-windows.md. */
+struct UpdateWindow {
+	vector<UpdateWindowRange> ranges;
+	/** Whether the ranges are in the local time of the device, or at `utc_offset_minutes` from
+		UTC. */
+	bool local_time = true;
+	int utc_offset_minutes = 0;
+	/** The states which wait for a window: Download, ArtifactInstall and ArtifactReboot. */
+	vector<string> states {"ArtifactInstall", "ArtifactReboot"};
+	/** Whether the states also go on outside of the windows once the deployment has been
+		confirmed over D-Bus, or only then if there are no windows. */
+	bool confirmation = false;
+
+	bool Enabled() const {
+		return !ranges.empty() || confirmation;
+	}
+
+	/** Whether the given state waits for a window. */
+	bool Restricts(const string &state) const;
+
+	/** Whether the given time, in the time zone of the ranges, is inside one of them. `weekday`
+		is 0 for Sunday. */
+	bool Allows(int weekday, int minute_of_day) const;
+};
+
+/** InventorySubmission controls how much of the inventory is submitted to the server. */
+struct InventorySubmission {
+	/** Keep the last submitted inventory in the database, and submit only the attributes which
+		have changed since, or nothing if none have. */
+	bool changes_only = false;
+	/** With `changes_only`, submit the complete inventory anyway when this long has passed since
+		it was last submitted completely. 0 means only after re-authentication or when forced. */
+	int full_resubmit_interval_seconds = 0;
+	/** Submit the inventory on its own schedule, with its own connection to the server, instead of
+		in the state machine, so that it neither waits for nor holds back the update checks and
+		the deployments. */
+	bool independent = false;
+};
+
+/** PollSplay makes the update checks and the inventory submissions of a device wait a random
+	extra time after each interval, from a generator seeded from the identity of the device, so
+	that the devices of a fleet don't poll the server at the same time. See
+	Documentation/poll-splay.md. Only one of the settings can be used. */
+struct PollSplay {
+	/** The longest extra wait, as a percentage of the interval, from 0 to 100. */
+	int percent = 0;
+	/** The longest extra wait, in seconds. */
+	int seconds = 0;
+};
+
+/** ProxyAutoConfig selects the proxy with a proxy auto-config (PAC) file, as with WPAD. Either
+	`url` or `dhcp` enables it. */
+struct ProxyAutoConfig {
+	/** URL of the PAC file, `http://`, `https://` or `file://`. */
+	string url;
+	/** Take the URL of the PAC file from DHCP option 252, as saved by the DHCP client hook. Only
+		used if `url` is empty. */
+	bool dhcp = false;
+	/** Program which evaluates PAC files, with the interface of `pactester` from pacparser. */
+	string evaluator = "pactester";
+
+	bool Enabled() const {
+		return url != "" || dhcp;
+	}
+};
+
+/** ServerFailover controls how the client moves between the configured `servers`. */
+struct ServerFailover {
+	/** After failing over to a server further down the list, try the earlier ones again at the
+		next authentication once this long has passed. 0 means that every authentication starts
+		with the first server. */
+	int failback_interval_seconds = 3600;
+};
+
+/** ServerDiscovery finds the servers when none are configured, see
+	Documentation/server-discovery.md. */
+struct ServerDiscovery {
+	/** URL of a JSON document listing the servers, and optionally their CA certificate. */
+	string bootstrap_url;
+	/** DNS SRV record naming the servers, for example `_mender._tcp.example.com`. Only used if
+		the bootstrap URL isn't set, or can't be fetched. */
+	string srv_record;
+	/** How long the servers found are used before looking for them again. */
+	int refresh_interval_seconds = 86400;
+
+	bool Enabled() const {
+		return bootstrap_url != "" || srv_record != "";
+	}
+};
+
+/** Retry behavior of one kind of request to the server, see Documentation/retry-policies.md. The
+	settings which aren't given keep the behavior of `retry_poll_interval_seconds` and
+	`retry_poll_count`. */
+struct RetryPolicy {
+	/** How many times to retry before giving up. 0 is `retry_poll_count`. */
+	int max_attempts = 0;
+	/** The first interval, used for the first three retries. 0 is 60 seconds, or
+		`retry_poll_interval_seconds` if that is shorter. */
+	int base_interval_seconds = 0;
+	/** What the interval is multiplied by after every three retries. */
+	double factor = 2.0;
+	/** Makes each interval randomly up to this fraction shorter or longer, from 0 to 1. */
+	double jitter = 0.0;
+	/** The longest interval. 0 is `retry_poll_interval_seconds`. */
+	int max_interval_seconds = 0;
+};
+
+struct RetryPolicies {
+	RetryPolicy deployment_polling;
+	RetryPolicy status_reporting;
+	RetryPolicy log_upload;
 };
 
 /** Connectivity parameters. This option was removed in Mender 	v4.0.0, where we don't make use
@@ -70,6 +593,14 @@ extern const ConfigParserErrorCategoryClass ConfigParserErrorCategory;
 
 error::Error MakeError(ConfigParserErrorCode code, const string &msg);
 
+// A string value in the configuration files which starts with one of these is replaced when the
+// file is loaded: `@env:NAME` by the environment variable NAME, and `@file:PATH` by the contents
+// of the file PATH, without trailing newlines, so that secrets don't need to be in the files. A
+// value which starts with `@` is written with `@@` instead. See
+// Documentation/configuration-secrets.md.
+extern const string kEnvReference;
+extern const string kFileReference;
+
 class MenderConfigFromFile {
 public:
 	/** Path to the public key used to verify signed updates.  Only one of
@@ -84,12 +615,127 @@ public:
 		Only one of artifact_verify_key/artifact_verify_keys can be specified. */
 	vector<string> artifact_verify_keys;
 
+	/** Directory with more verification keys, tried after `artifact_verify_keys`. All `*.pem`
+		files in it are used, in alphabetical order. It is read again for every Artifact, so keys
+		can be added and removed, to rotate them, without changing the configuration. */
+	string artifact_verify_keys_dir;
+
 	/** HTTPS client parameters */
 	HttpsClient https_client;
 
 	/** Security parameters */
 	ClientSecurity security;
 
+	/** Cleanup after a successful commit */
+	PostCommitCleanup post_commit_cleanup;
+
+	/** Checks before the download and the installation, see
+		Documentation/preflight-checks.md */
+	PreflightChecks preflight_checks;
+
+	/** Health checks before the commit, see Documentation/canary-mode.md */
+	CanaryMode canary_mode;
+
+	/** Health checks after the commit, which can still revert the update, see
+		Documentation/pilot-mode.md */
+	PilotMode pilot_mode;
+
+	/** Notifications to the users of the device, see Documentation/user-notifications.md */
+	UserNotifications user_notifications;
+
+	/** Where to forward the deployment events to, see Documentation/telemetry-sinks.md */
+	vector<TelemetrySink> telemetry_sinks;
+
+	/** MQTT broker to announce the events to */
+	Mqtt mqtt;
+
+	/** Encryption of the database */
+	StoreEncryption store_encryption;
+
+	/** Certificate pinning, with exceptions for intercepted networks */
+	CertificatePinning certificate_pinning;
+
+	/** Configuration of the device from the server, see Documentation/device-configuration.md */
+	DeviceConfiguration device_configuration;
+
+	/** Deployment notifications from the server, see Documentation/push-channel.md */
+	PushChannel push_channel;
+
+	/** D-Bus methods over Unix sockets, see Documentation/local-api.md */
+	LocalApi local_api;
+
+	/** Users and groups which may call the D-Bus methods, see
+		Documentation/dbus-authorization.md */
+	DBusAuthorization dbus_authorization;
+
+	/** Checks after an upgrade of the client, see Documentation/self-test.md */
+	SelfTest self_test;
+
+	/** Limits of the deployment states, see Documentation/state-timeouts.md */
+	StateTimeouts state_timeouts;
+
+	/** Counters and gauges for monitoring, see Documentation/metrics.md */
+	Metrics metrics;
+
+	/** Maintenance windows for deployments */
+	UpdateWindow update_window;
+
+	/** Bandwidth limit for Artifact downloads */
+	DownloadRateLimit download_rate_limit;
+
+	/** How much of the start of an Artifact to fetch when a deployment is offered, in order to
+		check its header before the download starts. 0 disables the pre-fetch. */
+	int64_t artifact_header_prefetch_bytes = 1024 * 1024; // 1 MiB
+
+	/** How many Artifact headers to keep in the data store, so that the header of an Artifact
+		which is offered again doesn't need to be pre-fetched. See
+		Documentation/artifact-header-cache.md. 0 keeps none. */
+	int artifact_header_cache_size = 8;
+
+	/** The shortest time between two deployment status updates carrying the progress of the
+		Artifact download. The progress is always emitted over D-Bus. 0 never sends it to the
+		server. */
+	int download_progress_interval_seconds = 60;
+
+	/** The longest time without a deployment status update while an Artifact is downloaded or
+		installed, so that an abort of the deployment on the server is noticed. See
+		Documentation/deployment-aborts.md. 0 only notices it with the other status updates. */
+	int deployment_abort_check_interval_seconds = 60;
+
+	/** Chunked, content-addressed Artifact downloads */
+	ChunkedDownload chunked_download;
+
+	/** Base URLs of local HTTP mirrors or gateway caches, which the Artifacts are downloaded from,
+		in this order, before the server. An Artifact is looked for at
+		`<URL>/<device type>/<Artifact name>.mender`. Only used with Artifact verification keys,
+		since only the signature tells that the Artifact is the one the server offered. See
+		Documentation/artifact-mirrors.md. */
+	vector<string> artifact_mirrors;
+
+	/** Only simulate the deployments: the Artifacts are downloaded and checked, and the
+		deployments reported as successful, but nothing is installed. See
+		Documentation/dry-run.md. */
+	bool simulate_deployments = false;
+
+	/** Files with the keys of encrypted Artifacts, by the key ID in the meta-data of the
+		Artifacts, for example `{"fleet-2026": "/var/lib/mender/artifact-key-2026"}`. See
+		Documentation/encrypted-artifacts.md. */
+	unordered_map<string, string> artifact_decryption_keys;
+
+	/** Connection settings for bad links */
+	LinkTuning link_tuning;
+	ConnectionDiagnostics connection_diagnostics;
+	KeepAlive keep_alive;
+
+	/** Rotation, compression and size limits of the deployment logs */
+	DeploymentLogs deployment_logs;
+
+	/** What to wait for before the first contact with the server */
+	StartupWait startup_wait;
+
+	/** Bounded memory and CPU use for constrained devices */
+	LowResource low_resource;
+
 	/** Connectivity parameters. This option was removed in Mender 	v4.0.0, where we don't make use
 		of HTTP Keep-Alive so there is no need to disable it or configure it. */
 	// ClientConnectivity connectivity;
@@ -131,6 +777,12 @@ public:
 	/** Poll interval for periodically sending inventory data */
 	int inventory_poll_interval_seconds = 28800;
 
+	/** Random extra wait after the poll intervals */
+	PollSplay poll_splay;
+
+	/** Submission of unchanged inventory attributes */
+	InventorySubmission inventory_submission;
+
 	/** Skip CA certificate validation */
 	bool skip_verify = false;
 
@@ -142,6 +794,10 @@ public:
 	/** Global max retry poll count */
 	int retry_poll_count = 0;
 
+	/** Retry behavior of deployment polling, status reporting and log upload, which otherwise
+		follows the two settings above. */
+	RetryPolicies retry_policies;
+
 	/* State script parameters */
 	int state_script_timeout_seconds = 3600;       // 1 hour
 	int state_script_retry_timeout_seconds = 1800; // 30 min
@@ -149,14 +805,114 @@ public:
 	/** Interval for rerunning state script that return "retry" error code. */
 	int state_script_retry_interval_seconds = 60;
 
+	/** How much of the output of each state script is logged, and so ends up in the deployment
+		log. 0 logs all of it. */
+	int state_script_output_limit_bytes = 65536; // 64 KiB
+
+	/** The WebAssembly runtime, with its arguments, which runs the state scripts ending in `.wasm`,
+		see Documentation/wasm-state-scripts.md. Empty doesn't run them. */
+	vector<string> state_script_wasm_runtime;
+
+	/* State listener parameters, see Documentation/io.mender.StateListener1.xml */
+	/** How long to wait for the registered listeners to answer a state transition, after which
+		the transition goes ahead. */
+	int state_listener_timeout_seconds = 60;
+	/** The longest that listeners can delay a single state transition. */
+	int state_listener_max_delay_seconds = 3600; // 1 hour
+
+	/* Artifact commit lease, see Documentation/artifact-commit-lease.md */
+	/** Local applications which must keep confirming over D-Bus that they are healthy before an
+		Artifact is committed. If one of them stops confirming, the update is rolled back. Empty
+		disables the lease. */
+	vector<string> artifact_commit_lease_applications;
+	/** How long the applications must keep confirming, after the reboot, before the commit. */
+	int artifact_commit_lease_seconds = 300; // 5 min
+	/** The longest time allowed between two confirmations of an application, and before its
+		first one. */
+	int artifact_commit_lease_renewal_seconds = 60;
+
+	/* Commit confirmation, see Documentation/commit-confirmation.md */
+	/** Only commit an Artifact once an application has called ConfirmCommit, after the reboot.
+		Otherwise the update is rolled back. */
+	bool commit_requires_confirmation = false;
+	/** How long to wait for the confirmation. */
+	int commit_confirmation_timeout_seconds = 600; // 10 min
+
+	/* Reboot grace period, see Documentation/reboot-grace.md */
+	/** How long a reboot into an update is announced before it happens. 0 reboots right away. */
+	int reboot_grace_seconds = 0;
+	/** Local applications which may each extend the grace period once, over D-Bus. */
+	vector<string> reboot_grace_applications;
+	/** How much every extension adds to the grace period. */
+	int reboot_grace_extension_seconds = 300; // 5 min
+	/** Also announce the reboot on every terminal with `wall`. */
+	bool reboot_grace_wall = false;
+	/** Program called with the deployment ID and the seconds left, every time the reboot is
+		announced. */
+	string reboot_grace_hook;
+
+	/* System reboot, see Documentation/reboot-command.md */
+	/** The command, with its arguments, which reboots the device when the Update Module leaves
+		the reboot to the client. Empty calls `reboot`. */
+	vector<string> reboot_command;
+	/** The command which reboots the device to roll back an update. Empty uses the same one as
+		`reboot_command`. */
+	vector<string> rollback_reboot_command;
+	/** How long to wait for the reboot command to restart the device, before the reboot is
+		considered to have failed. */
+	int reboot_timeout_seconds = 600; // 10 min
+
+	/** The shortest time between two intermediate deployment status updates, such as
+		"downloading" and "installing". An update which comes sooner is deferred, and dropped if a
+		newer one comes in the meantime. The final status, and the one before the commit, are
+		always sent right away. 0 disables the limit. */
+	int status_update_min_interval_seconds = 0;
+
+	/** How many of the latest deployments to keep in the deployment history in the data store,
+		see Documentation/deployment-history.md. 0 keeps none. */
+	int deployment_history_length = 20;
+
 	/* Update module parameters */
 	/** The timeout for the execution of the update module, after which it will
 		be killed. */
 	int module_timeout_seconds = 14400; // 4 hours
+	/** How long the update module gets to exit after SIGTERM, when it is stopped, before it is
+		killed with SIGKILL. See Documentation/graceful-shutdown.md. */
+	int module_termination_grace_period_seconds = 10;
+
+	/** Lock files to hold while the update module installs the payload, so that package managers
+		running on the device do not make conflicting changes at the same time. Examples are
+		`/var/lib/dpkg/lock-frontend` for dpkg and apt, and `/var/lib/rpm/.rpm.lock` for rpm. The
+		locks are taken with `fcntl(F_SETLK)`, like those package managers do. */
+	vector<string> install_locks;
+	/** How long to wait for the install locks to be released by other programs. */
+	int install_lock_timeout_seconds = 300; // 5 min
+	/** The shortest time between two deployment status updates carrying the progress which the
+		update module reports, see Documentation/update-modules-v3-file-api.md. The progress is
+		always logged, and emitted over D-Bus. 0 never sends it to the server. */
+	int module_progress_interval_seconds = 60;
+	/** The most disk space, in bytes, that the File Tree of a deployment may take up, including
+		the checkpoint of the update module. A deployment which needs more fails. 0 is no limit. */
+	int64_t module_work_dir_quota_bytes = 0;
 
 	/** Path to server SSL certificate */
 	string server_certificate;
 
+	/** Extra headers for all requests to the Mender server API, for example for gateways in front
+		of it. Only custom headers, starting with `X-` but not with `X-MEN-`, are allowed. */
+	unordered_map<string, string> http_headers;
+
+	/** Proxy for all HTTP and HTTPS requests of the client, as a URL such as
+		`http://proxy.example.com:3128`. HTTPS requests are tunneled with CONNECT. Takes precedence
+		over the HTTP_PROXY and HTTPS_PROXY environment variables, while NO_PROXY still applies. */
+	string proxy;
+	/** Credentials for the proxy, sent with Basic authentication. */
+	string proxy_username;
+	string proxy_password;
+	/** Proxy auto-config. Takes precedence over `proxy` and the environment, which are used when
+		no PAC file can be found or evaluated. */
+	ProxyAutoConfig proxy_auto_config;
+
 	/** Server URL (For single server conf). This option still exists in the config file, but we
 		are automatically "promoting" it to the `servers` list during parsing, as long as only
 		one of them is set. */
@@ -171,12 +927,26 @@ public:
 	/** Device tier classification */
 	string device_tier = device_tier::kStandard;
 
+	/** Where the identity data of the device comes from, in order: `script`, for the identity
+		script, and the built-in `mac`, `dmi-serial`, `tpm-ek` and `machine-id`. Only the script
+		if empty. See Documentation/device-identity.md. */
+	vector<string> identity_providers;
+
 	/** List of available servers, to which client can fall over */
 	vector<string> servers;
+	ServerFailover server_failover;
+	ServerDiscovery server_discovery;
 
 	/** Log level which takes effect right before daemon startup */
 	string daemon_log_level;
 
+	/** Log levels of individual modules, for example `{"http_client": "debug"}`. These override
+		the global log level for the loggers of the given modules. */
+	unordered_map<string, string> log_levels;
+
+	/** Format of the log output, `logfmt` (the default) or `json` */
+	string log_format;
+
 	/** Number of times an interrupted download continuation should be attempted */
 	static constexpr int kRetry_download_count_default = 10;
 	static constexpr int kRetry_download_count_min = 1;
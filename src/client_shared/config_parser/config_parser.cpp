@@ -17,7 +17,17 @@
 #include <string>
 #include <vector>
 #include <algorithm>
+#include <cctype>
+#include <cerrno>
+#include <cstdlib>
+#include <fstream>
+#include <optional>
+#include <sstream>
 
+#include <grp.h>
+#include <pwd.h>
+
+#include <common/common.hpp>
 #include <common/expected.hpp>
 #include <common/json.hpp>
 #include <common/log.hpp>
@@ -28,6 +38,7 @@ namespace config_parser {
 
 using namespace std;
 
+namespace common = mender::common;
 namespace expected = mender::common::expected;
 namespace json = mender::common::json;
 namespace log = mender::common::log;
@@ -54,319 +65,2914 @@ error::Error MakeError(ConfigParserErrorCode code, const string &msg) {
 	return error::Error(error_condition(code, ConfigParserErrorCategory), msg);
 }
 
-ExpectedBool MenderConfigFromFile::LoadFile(const string &path) {
-	const json::ExpectedJson e_cfg_json = json::LoadFromFile(path);
-	if (!e_cfg_json) {
-		auto err = e_cfg_json.error();
-		return expected::unexpected(err);
+// Parses "HH:MM" into minutes since midnight.
+static expected::ExpectedInt ParseTimeOfDay(const string &time, const string &setting) {
+	auto invalid = expected::unexpected(MakeError(
+		ConfigParserErrorCode::ValidationError,
+		"Invalid time of day '" + time + "' in " + setting + ", expected HH:MM"));
+	auto parts = common::SplitString(time, ":");
+	if (parts.size() != 2) {
+		return invalid;
 	}
+	auto exp_hours = common::StringTo<int>(parts[0]);
+	auto exp_minutes = common::StringTo<int>(parts[1]);
+	if (!exp_hours || !exp_minutes || exp_hours.value() < 0 || exp_hours.value() > 24
+		|| exp_minutes.value() < 0 || exp_minutes.value() > 59
+		|| exp_hours.value() * 60 + exp_minutes.value() > 24 * 60) {
+		return invalid;
+	}
+	return exp_hours.value() * 60 + exp_minutes.value();
+}
 
-	bool applied = false;
+static expected::expected<DownloadRateLimit, error::Error> ParseDownloadRateLimit(
+	const json::Json &limit_json) {
+	DownloadRateLimit limit;
 
-	const json::Json cfg_json = e_cfg_json.value();
+	json::ExpectedJson e_cfg_subval = limit_json.Get("BytesPerSecond");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int64_t>();
+		if (e_cfg_int) {
+			limit.bytes_per_second = e_cfg_int.value();
+		}
+	}
 
-	json::ExpectedJson e_cfg_value = cfg_json.Get("DeviceTypeFile");
-	if (e_cfg_value) {
-		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
-		if (e_cfg_string) {
-			this->device_type_file = e_cfg_string.value();
-			applied = true;
+	e_cfg_subval = limit_json.Get("Schedule");
+	if (!e_cfg_subval) {
+		return limit;
+	}
+	const json::Json value_array = e_cfg_subval.value();
+	const json::ExpectedSize e_n_items = value_array.GetArraySize();
+	if (!e_n_items) {
+		return limit;
+	}
+	for (size_t i = 0; i < e_n_items.value(); i++) {
+		const json::ExpectedJson e_array_item = value_array.Get(i);
+		if (!e_array_item) {
+			continue;
+		}
+		const auto &item = e_array_item.value();
+		auto exp_start = item.Get("Start").and_then(json::ToString);
+		auto exp_end = item.Get("End").and_then(json::ToString);
+		auto exp_rate = item.Get("BytesPerSecond").and_then(json::ToInt64);
+		if (!exp_start || !exp_end || !exp_rate) {
+			return expected::unexpected(MakeError(
+				ConfigParserErrorCode::ValidationError,
+				"Every DownloadRateLimit schedule window needs Start, End and BytesPerSecond"));
+		}
+
+		DownloadRateLimitWindow window;
+		auto exp_minute = ParseTimeOfDay(exp_start.value(), "DownloadRateLimit");
+		if (!exp_minute) {
+			return expected::unexpected(exp_minute.error());
 		}
+		window.start_minute = exp_minute.value();
+		exp_minute = ParseTimeOfDay(exp_end.value(), "DownloadRateLimit");
+		if (!exp_minute) {
+			return expected::unexpected(exp_minute.error());
+		}
+		window.end_minute = exp_minute.value();
+		window.bytes_per_second = exp_rate.value();
+		limit.windows.push_back(window);
 	}
+	return limit;
+}
 
-	e_cfg_value = cfg_json.Get("ServerCertificate");
-	if (e_cfg_value) {
-		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
-		if (e_cfg_string) {
-			this->server_certificate = e_cfg_string.value();
-			applied = true;
+static expected::expected<unsigned, error::Error> ParseWeekdays(const vector<string> &days) {
+	const vector<string> names {
+		"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"};
+	unsigned weekdays = 0;
+	for (const auto &day : days) {
+		auto lower_day = common::StringToLower(day);
+		auto found = find_if(names.begin(), names.end(), [&lower_day](const string &name) {
+			return lower_day == name || lower_day == name.substr(0, 3);
+		});
+		if (found == names.end()) {
+			return expected::unexpected(MakeError(
+				ConfigParserErrorCode::ValidationError,
+				"Invalid day '" + day + "' in UpdateWindow, expected for example Mon or Monday"));
 		}
+		weekdays |= 1u << (found - names.begin());
 	}
+	return weekdays;
+}
 
-	e_cfg_value = cfg_json.Get("UpdateLogPath");
-	if (e_cfg_value) {
-		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
-		if (e_cfg_string) {
-			this->update_log_path = e_cfg_string.value();
-			applied = true;
+// `Local`, `UTC`, or `UTC` followed by an offset such as `+02:00` or `-5`.
+static error::Error ParseTimeZone(const string &zone, UpdateWindow &window) {
+	auto invalid = MakeError(
+		ConfigParserErrorCode::ValidationError,
+		"Invalid TimeZone '" + zone + "' in UpdateWindow, expected Local, UTC, or UTC+HH:MM");
+	auto lower_zone = common::StringToLower(zone);
+	if (lower_zone == "local") {
+		window.local_time = true;
+		window.utc_offset_minutes = 0;
+		return error::NoError;
+	}
+	if (!common::StartsWith<string>(lower_zone, "utc")) {
+		return invalid;
+	}
+
+	window.local_time = false;
+	window.utc_offset_minutes = 0;
+	auto offset = zone.substr(3);
+	if (offset == "") {
+		return error::NoError;
+	}
+	if (offset[0] != '+' && offset[0] != '-') {
+		return invalid;
+	}
+	auto parts = common::SplitString(offset.substr(1), ":");
+	if (parts.size() > 2) {
+		return invalid;
+	}
+	auto exp_hours = common::StringTo<int>(parts[0]);
+	auto exp_minutes = common::StringTo<int>(parts.size() == 2 ? parts[1] : "0");
+	if (!exp_hours || !exp_minutes || exp_hours.value() < 0 || exp_hours.value() > 14
+		|| exp_minutes.value() < 0 || exp_minutes.value() > 59) {
+		return invalid;
+	}
+	window.utc_offset_minutes = exp_hours.value() * 60 + exp_minutes.value();
+	if (offset[0] == '-') {
+		window.utc_offset_minutes = -window.utc_offset_minutes;
+	}
+	return error::NoError;
+}
+
+static expected::expected<UpdateWindow, error::Error> ParseUpdateWindow(
+	const json::Json &window_json) {
+	UpdateWindow window;
+
+	json::ExpectedJson e_cfg_subval = window_json.Get("Windows");
+	if (e_cfg_subval) {
+		const json::Json value_array = e_cfg_subval.value();
+		const json::ExpectedSize e_n_items = value_array.GetArraySize();
+		for (size_t i = 0; e_n_items && i < e_n_items.value(); i++) {
+			const json::ExpectedJson e_array_item = value_array.Get(i);
+			if (!e_array_item) {
+				continue;
+			}
+			const auto &item = e_array_item.value();
+			auto exp_start = item.Get("Start").and_then(json::ToString);
+			auto exp_end = item.Get("End").and_then(json::ToString);
+			if (!exp_start || !exp_end) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"Every UpdateWindow window needs Start and End"));
+			}
+
+			UpdateWindowRange range;
+			auto exp_minute = ParseTimeOfDay(exp_start.value(), "UpdateWindow");
+			if (!exp_minute) {
+				return expected::unexpected(exp_minute.error());
+			}
+			range.start_minute = exp_minute.value();
+			exp_minute = ParseTimeOfDay(exp_end.value(), "UpdateWindow");
+			if (!exp_minute) {
+				return expected::unexpected(exp_minute.error());
+			}
+			range.end_minute = exp_minute.value();
+
+			auto exp_days = item.Get("Days").and_then(json::ToStringVector);
+			if (exp_days) {
+				auto exp_weekdays = ParseWeekdays(exp_days.value());
+				if (!exp_weekdays) {
+					return expected::unexpected(exp_weekdays.error());
+				}
+				range.weekdays = exp_weekdays.value();
+			}
+			window.ranges.push_back(range);
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("TenantToken");
-	if (e_cfg_value) {
-		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
-		if (e_cfg_string) {
-			this->tenant_token = e_cfg_string.value();
-			applied = true;
+	e_cfg_subval = window_json.Get("TimeZone");
+	if (e_cfg_subval) {
+		auto exp_zone = json::ToString(e_cfg_subval.value());
+		if (exp_zone) {
+			auto err = ParseTimeZone(exp_zone.value(), window);
+			if (err != error::NoError) {
+				return expected::unexpected(err);
+			}
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("DeviceTier");
-	if (e_cfg_value) {
-		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
+	e_cfg_subval = window_json.Get("States");
+	if (e_cfg_subval) {
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(e_cfg_subval.value());
+		if (e_cfg_strings) {
+			const vector<string> supported {"Download", "ArtifactInstall", "ArtifactReboot"};
+			for (const auto &state : e_cfg_strings.value()) {
+				if (find(supported.begin(), supported.end(), state) == supported.end()) {
+					return expected::unexpected(MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"Invalid state '" + state
+							+ "' in UpdateWindow, expected Download, ArtifactInstall or "
+							  "ArtifactReboot"));
+				}
+			}
+			window.states = e_cfg_strings.value();
+		}
+	}
+
+	auto exp_confirmation = window_json.Get("Confirmation").and_then(json::ToBool);
+	if (exp_confirmation) {
+		window.confirmation = exp_confirmation.value();
+	}
+
+	return window;
+}
+
+static expected::expected<PreflightChecks, error::Error> ParsePreflightChecks(
+	const json::Json &checks_json) {
+	PreflightChecks checks;
+
+	json::ExpectedJson e_cfg_subval = checks_json.Get("FreeSpace");
+	if (e_cfg_subval) {
+		const json::Json value_array = e_cfg_subval.value();
+		const json::ExpectedSize e_n_items = value_array.GetArraySize();
+		for (size_t i = 0; e_n_items && i < e_n_items.value(); i++) {
+			const json::ExpectedJson e_array_item = value_array.Get(i);
+			if (!e_array_item) {
+				continue;
+			}
+			const auto &item = e_array_item.value();
+			auto exp_path = item.Get("Path").and_then(json::ToString);
+			auto exp_min_bytes = item.Get("MinBytes").and_then(json::ToInt64);
+			if (!exp_path || !exp_min_bytes) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"Every PreflightChecks.FreeSpace check needs Path and MinBytes"));
+			}
+			if (exp_min_bytes.value() < 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PreflightChecks.FreeSpace MinBytes cannot be negative."));
+			}
+			checks.free_space.push_back({exp_path.value(), exp_min_bytes.value()});
+		}
+	}
+
+	e_cfg_subval = checks_json.Get("MinUptimeSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PreflightChecks.MinUptimeSeconds cannot be negative."));
+			}
+			checks.min_uptime_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = checks_json.Get("Scripts");
+	if (e_cfg_subval) {
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(e_cfg_subval.value());
+		if (e_cfg_strings) {
+			checks.scripts = e_cfg_strings.value();
+		}
+	}
+
+	e_cfg_subval = checks_json.Get("ScriptTimeoutSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PreflightChecks.ScriptTimeoutSeconds must be positive."));
+			}
+			checks.script_timeout_seconds = e_cfg_int.value();
+		}
+	}
+
+	return checks;
+}
+
+static expected::expected<CanaryMode, error::Error> ParseCanaryMode(const json::Json &canary_json) {
+	CanaryMode canary;
+
+	json::ExpectedJson e_cfg_subval = canary_json.Get("WindowSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"CanaryMode.WindowSeconds cannot be negative."));
+			}
+			canary.window_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = canary_json.Get("IntervalSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"CanaryMode.IntervalSeconds must be positive."));
+			}
+			canary.interval_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = canary_json.Get("HealthCheckTimeoutSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"CanaryMode.HealthCheckTimeoutSeconds must be positive."));
+			}
+			canary.health_check_timeout_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = canary_json.Get("HealthChecks");
+	if (e_cfg_subval) {
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(e_cfg_subval.value());
+		if (e_cfg_strings) {
+			canary.health_checks = e_cfg_strings.value();
+		}
+	}
+
+	return canary;
+}
+
+static expected::expected<PilotMode, error::Error> ParsePilotMode(const json::Json &pilot_json) {
+	PilotMode pilot;
+
+	json::ExpectedJson e_cfg_subval = pilot_json.Get("SoakSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PilotMode.SoakSeconds cannot be negative."));
+			}
+			pilot.soak_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = pilot_json.Get("IntervalSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PilotMode.IntervalSeconds must be positive."));
+			}
+			pilot.interval_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = pilot_json.Get("HealthCheckTimeoutSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PilotMode.HealthCheckTimeoutSeconds must be positive."));
+			}
+			pilot.health_check_timeout_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = pilot_json.Get("HealthChecks");
+	if (e_cfg_subval) {
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(e_cfg_subval.value());
+		if (e_cfg_strings) {
+			pilot.health_checks = e_cfg_strings.value();
+		}
+	}
+
+	e_cfg_subval = pilot_json.Get("RevertCommand");
+	if (e_cfg_subval) {
+		const json::ExpectedString e_cfg_string = e_cfg_subval.value().GetString();
 		if (e_cfg_string) {
-			const string &tier = e_cfg_string.value();
-			if (!device_tier::IsValid(tier)) {
-				auto err = MakeError(
-					ConfigParserErrorCode::DeviceTierError, "Invalid DeviceTier: " + tier);
-				return expected::unexpected(err);
+			pilot.revert_command = e_cfg_string.value();
+		}
+	}
+
+	if (pilot.Enabled() && pilot.revert_command == "") {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"PilotMode needs a RevertCommand to go back to the previous software."));
+	}
+
+	return pilot;
+}
+
+static expected::expected<TelemetrySink, error::Error> ParseTelemetrySink(
+	const json::Json &sink_json) {
+	TelemetrySink sink;
+
+	auto exp_type = sink_json.Get("Type").and_then(json::ToString);
+	if (!exp_type) {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError, "Every TelemetrySinks entry needs a Type"));
+	}
+	sink.type = exp_type.value();
+
+	if (sink.type == "exec") {
+		auto exp_command = sink_json.Get("Command").and_then(json::ToString);
+		if (!exp_command || exp_command.value() == "") {
+			return expected::unexpected(MakeError(
+				ConfigParserErrorCode::ValidationError,
+				"TelemetrySinks entries of type exec need a Command"));
+		}
+		sink.command = exp_command.value();
+	} else if (sink.type == "webhook") {
+		auto exp_url = sink_json.Get("URL").and_then(json::ToString);
+		if (!exp_url || exp_url.value() == "") {
+			return expected::unexpected(MakeError(
+				ConfigParserErrorCode::ValidationError,
+				"TelemetrySinks entries of type webhook need a URL"));
+		}
+		sink.url = exp_url.value();
+	} else {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"Unknown TelemetrySinks Type \"" + sink.type + "\", must be exec or webhook"));
+	}
+
+	json::ExpectedJson e_cfg_subval = sink_json.Get("TimeoutSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"TelemetrySinks TimeoutSeconds must be positive."));
+			}
+			sink.timeout_seconds = e_cfg_int.value();
+		}
+	}
+
+	return sink;
+}
+
+static expected::expected<Mqtt, error::Error> ParseMqtt(const json::Json &mqtt_json) {
+	Mqtt mqtt;
+
+	const vector<pair<string, string *>> string_settings {
+		{"BrokerURL", &mqtt.broker_url},
+		{"ClientID", &mqtt.client_id},
+		{"Username", &mqtt.username},
+		{"Password", &mqtt.password},
+		{"ServerCertificate", &mqtt.server_certificate},
+		{"ClientCertificate", &mqtt.client_certificate},
+		{"ClientCertificateKey", &mqtt.client_certificate_key},
+	};
+	for (const auto &setting : string_settings) {
+		auto exp_value = mqtt_json.Get(setting.first).and_then(json::ToString);
+		if (exp_value) {
+			*setting.second = exp_value.value();
+		}
+	}
+
+	if (mqtt.broker_url != "" && mqtt.broker_url.rfind("mqtt://", 0) != 0
+		&& mqtt.broker_url.rfind("mqtts://", 0) != 0) {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"MQTT.BrokerURL must start with mqtt:// or mqtts://."));
+	}
+	if (mqtt.password != "" && mqtt.username == "") {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError, "MQTT.Password needs a Username."));
+	}
+
+	json::ExpectedJson e_cfg_subval = mqtt_json.Get("QoS");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() != 0 && e_cfg_int.value() != 1) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError, "MQTT.QoS must be 0 or 1."));
+			}
+			mqtt.qos = e_cfg_int.value();
+		}
+	}
+
+	auto exp_retain = mqtt_json.Get("Retain").and_then(json::ToBool);
+	if (exp_retain) {
+		mqtt.retain = exp_retain.value();
+	}
+
+	e_cfg_subval = mqtt_json.Get("Topics");
+	if (e_cfg_subval) {
+		const json::Json topics_json = e_cfg_subval.value();
+		const vector<pair<string, string *>> topics {
+			{"State", &mqtt.state_topic},
+			{"Deployment", &mqtt.deployment_topic},
+			{"Authorization", &mqtt.authorization_topic},
+		};
+		for (const auto &topic : topics) {
+			auto exp_topic = topics_json.Get(topic.first).and_then(json::ToString);
+			if (exp_topic) {
+				*topic.second = exp_topic.value();
+			}
+		}
+	}
+
+	e_cfg_subval = mqtt_json.Get("TimeoutSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"MQTT.TimeoutSeconds must be positive."));
+			}
+			mqtt.timeout_seconds = e_cfg_int.value();
+		}
+	}
+
+	return mqtt;
+}
+
+static expected::expected<StoreEncryption, error::Error> ParseStoreEncryption(
+	const json::Json &encryption_json) {
+	StoreEncryption encryption;
+
+	auto exp_key_file = encryption_json.Get("KeyFile").and_then(json::ToString);
+	if (exp_key_file) {
+		encryption.key_file = exp_key_file.value();
+	}
+	auto exp_object = encryption_json.Get("TPMSealedObject").and_then(json::ToString);
+	if (exp_object) {
+		encryption.tpm_sealed_object = exp_object.value();
+	}
+
+	if (encryption.key_file != "" && encryption.tpm_sealed_object != "") {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"Only one of StoreEncryption.KeyFile and StoreEncryption.TPMSealedObject can be set."));
+	}
+
+	return encryption;
+}
+
+// A base64 encoded SHA-256 hash: 43 characters and one padding character.
+static bool IsPublicKeyPin(const string &pin) {
+	return pin.size() == 44 && pin.back() == '='
+		   && all_of(pin.begin(), pin.end() - 1, [](char c) {
+				  return isalnum(static_cast<unsigned char>(c)) || c == '+' || c == '/';
+			  });
+}
+
+static expected::expected<CertificatePinning, error::Error> ParseCertificatePinning(
+	const json::Json &pinning_json) {
+	CertificatePinning pinning;
+
+	json::ExpectedJson e_cfg_subval = pinning_json.Get("Hosts");
+	if (e_cfg_subval) {
+		auto exp_hosts = e_cfg_subval.value().GetChildren();
+		if (exp_hosts) {
+			for (const auto &host : exp_hosts.value()) {
+				auto exp_pins = json::ToStringVector(host.second);
+				if (!exp_pins || exp_pins.value().empty()) {
+					return expected::unexpected(MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"CertificatePinning.Hosts needs a list of pins for " + host.first));
+				}
+				for (const auto &pin : exp_pins.value()) {
+					if (!IsPublicKeyPin(pin)) {
+						return expected::unexpected(MakeError(
+							ConfigParserErrorCode::ValidationError,
+							"Invalid pin \"" + pin + "\" for " + host.first
+								+ ", must be a base64 encoded SHA-256 hash"));
+					}
+				}
+				pinning.hosts[common::StringToLower(host.first)] = exp_pins.value();
+			}
+		}
+	}
+
+	e_cfg_subval = pinning_json.Get("Exceptions");
+	if (e_cfg_subval) {
+		const json::Json value_array = e_cfg_subval.value();
+		const json::ExpectedSize e_n_items = value_array.GetArraySize();
+		for (size_t i = 0; e_n_items && i < e_n_items.value(); i++) {
+			const json::ExpectedJson e_array_item = value_array.Get(i);
+			if (!e_array_item) {
+				continue;
+			}
+			const auto &item = e_array_item.value();
+			CertificatePinningException exception;
+			auto exp_strings = item.Get("Interfaces").and_then(json::ToStringVector);
+			if (exp_strings) {
+				exception.interfaces = exp_strings.value();
+			}
+			exp_strings = item.Get("SSIDs").and_then(json::ToStringVector);
+			if (exp_strings) {
+				exception.ssids = exp_strings.value();
+			}
+			auto exp_certificate = item.Get("TrustedCertificate").and_then(json::ToString);
+			if (exp_certificate) {
+				exception.trusted_certificate = exp_certificate.value();
+			}
+			if (exception.trusted_certificate == ""
+				|| (exception.interfaces.empty() && exception.ssids.empty())) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"Every CertificatePinning.Exceptions entry needs a TrustedCertificate, and"
+					" Interfaces or SSIDs"));
+			}
+			pinning.exceptions.push_back(exception);
+		}
+	}
+
+	return pinning;
+}
+
+static expected::expected<DeviceConfiguration, error::Error> ParseDeviceConfiguration(
+	const json::Json &config_json) {
+	DeviceConfiguration config;
+
+	json::ExpectedJson e_cfg_subval = config_json.Get("Enabled");
+	if (e_cfg_subval) {
+		const json::ExpectedBool e_cfg_bool = e_cfg_subval.value().GetBool();
+		if (e_cfg_bool) {
+			config.enabled = e_cfg_bool.value();
+		}
+	}
+
+	e_cfg_subval = config_json.Get("PollIntervalSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"DeviceConfiguration.PollIntervalSeconds must be positive."));
+			}
+			config.poll_interval_seconds = e_cfg_int.value();
+		}
+	}
+
+	auto exp_dir = config_json.Get("ApplyScriptsDir").and_then(json::ToString);
+	if (exp_dir) {
+		if (exp_dir.value() == "") {
+			return expected::unexpected(MakeError(
+				ConfigParserErrorCode::ValidationError,
+				"DeviceConfiguration.ApplyScriptsDir cannot be empty."));
+		}
+		config.apply_scripts_dir = exp_dir.value();
+	}
+
+	e_cfg_subval = config_json.Get("ApplyTimeoutSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"DeviceConfiguration.ApplyTimeoutSeconds must be positive."));
+			}
+			config.apply_timeout_seconds = e_cfg_int.value();
+		}
+	}
+
+	return config;
+}
+
+static expected::expected<PushChannel, error::Error> ParsePushChannel(
+	const json::Json &config_json) {
+	PushChannel config;
+
+	json::ExpectedJson e_cfg_subval = config_json.Get("Enabled");
+	if (e_cfg_subval) {
+		const json::ExpectedBool e_cfg_bool = e_cfg_subval.value().GetBool();
+		if (e_cfg_bool) {
+			config.enabled = e_cfg_bool.value();
+		}
+	}
+
+	e_cfg_subval = config_json.Get("PingIntervalSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PushChannel.PingIntervalSeconds must be positive."));
+			}
+			config.ping_interval_seconds = e_cfg_int.value();
+		}
+	}
+
+	e_cfg_subval = config_json.Get("MaxRetryIntervalSeconds");
+	if (e_cfg_subval) {
+		const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"PushChannel.MaxRetryIntervalSeconds must be positive."));
+			}
+			config.max_retry_interval_seconds = e_cfg_int.value();
+		}
+	}
+
+	return config;
+}
+
+static expected::expected<LocalApi, error::Error> ParseLocalApi(const json::Json &config_json) {
+	LocalApi config;
+
+	json::ExpectedJson e_cfg_subval = config_json.Get("Enabled");
+	if (e_cfg_subval) {
+		const json::ExpectedBool e_cfg_bool = e_cfg_subval.value().GetBool();
+		if (e_cfg_bool) {
+			config.enabled = e_cfg_bool.value();
+		}
+	}
+
+	const vector<pair<string, string *>> socket_settings {
+		{"UpdateSocketPath", &config.update_socket_path},
+		{"AuthSocketPath", &config.auth_socket_path},
+	};
+	for (const auto &setting : socket_settings) {
+		auto exp_path = config_json.Get(setting.first).and_then(json::ToString);
+		if (exp_path) {
+			if (exp_path.value() == "" || exp_path.value()[0] != '/') {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"LocalApi." + setting.first + " must be an absolute path."));
+			}
+			*setting.second = exp_path.value();
+		}
+	}
+
+	if (config.update_socket_path == config.auth_socket_path) {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"LocalApi.UpdateSocketPath and LocalApi.AuthSocketPath must differ."));
+	}
+
+	return config;
+}
+
+static bool MatchesMethod(const string &pattern, const string &method) {
+	const string any_method {".*"};
+	if (pattern.size() > any_method.size()
+		&& pattern.compare(pattern.size() - any_method.size(), any_method.size(), any_method) == 0) {
+		const string prefix = pattern.substr(0, pattern.size() - 1);
+		return method.compare(0, prefix.size(), prefix) == 0
+			   && method.find('.', prefix.size()) == string::npos;
+	}
+	return pattern == method;
+}
+
+vector<string> DBusAuthorization::ResolveIds() {
+	vector<string> unknown;
+	for (auto &rule : rules) {
+		rule.uids.clear();
+		for (const auto &user : rule.users) {
+			const struct passwd *entry = getpwnam(user.c_str());
+			if (entry == nullptr) {
+				log::Warning("DBusAuthorization: No user named " + user);
+				unknown.push_back(user);
+			} else {
+				rule.uids.push_back(static_cast<uint32_t>(entry->pw_uid));
+			}
+		}
+		rule.gids.clear();
+		for (const auto &group : rule.groups) {
+			const struct group *entry = getgrnam(group.c_str());
+			if (entry == nullptr) {
+				log::Warning("DBusAuthorization: No group named " + group);
+				unknown.push_back(group);
+			} else {
+				rule.gids.push_back(static_cast<uint32_t>(entry->gr_gid));
+			}
+		}
+	}
+	return unknown;
+}
+
+bool DBusAuthorization::Allows(
+	const string &method, uint32_t uid, const vector<uint32_t> &gids) const {
+	if (uid == 0) {
+		return true;
+	}
+
+	bool listed = false;
+	for (const auto &rule : rules) {
+		auto matches = [&method](const string &pattern) { return MatchesMethod(pattern, method); };
+		if (none_of(rule.methods.begin(), rule.methods.end(), matches)) {
+			continue;
+		}
+		listed = true;
+		if (find(rule.uids.begin(), rule.uids.end(), uid) != rule.uids.end()) {
+			return true;
+		}
+		for (const auto &gid : gids) {
+			if (find(rule.gids.begin(), rule.gids.end(), gid) != rule.gids.end()) {
+				return true;
+			}
+		}
+	}
+	return !listed;
+}
+
+static expected::expected<DBusAuthorization, error::Error> ParseDBusAuthorization(
+	const json::Json &config_json) {
+	DBusAuthorization config;
+
+	json::ExpectedJson e_cfg_subval = config_json.Get("Rules");
+	if (e_cfg_subval) {
+		const json::Json value_array = e_cfg_subval.value();
+		const json::ExpectedSize e_n_items = value_array.GetArraySize();
+		for (size_t i = 0; e_n_items && i < e_n_items.value(); i++) {
+			const json::ExpectedJson e_array_item = value_array.Get(i);
+			if (!e_array_item) {
+				continue;
+			}
+			const auto &item = e_array_item.value();
+			DBusAuthorizationRule rule;
+			auto exp_strings = item.Get("Methods").and_then(json::ToStringVector);
+			if (exp_strings) {
+				rule.methods = exp_strings.value();
+			}
+			exp_strings = item.Get("Users").and_then(json::ToStringVector);
+			if (exp_strings) {
+				rule.users = exp_strings.value();
+			}
+			exp_strings = item.Get("Groups").and_then(json::ToStringVector);
+			if (exp_strings) {
+				rule.groups = exp_strings.value();
+			}
+			if (rule.methods.empty()) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"Every DBusAuthorization.Rules entry needs Methods"));
+			}
+			for (const auto &method : rule.methods) {
+				const auto dot = method.rfind('.');
+				if (dot == string::npos || dot == 0 || dot == method.size() - 1) {
+					return expected::unexpected(MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"Invalid DBusAuthorization method \"" + method
+							+ "\", must be \"<interface>.<method>\" or \"<interface>.*\""));
+				}
+			}
+			config.rules.push_back(rule);
+		}
+	}
+
+	return config;
+}
+
+static expected::expected<SelfTest, error::Error> ParseSelfTest(const json::Json &config_json) {
+	SelfTest config;
+
+	json::ExpectedJson e_cfg_subval = config_json.Get("Enabled");
+	if (e_cfg_subval) {
+		const json::ExpectedBool e_cfg_bool = e_cfg_subval.value().GetBool();
+		if (e_cfg_bool) {
+			config.enabled = e_cfg_bool.value();
+		}
+	}
+
+	const vector<pair<string, int *>> int_settings {
+		{"ScriptTimeoutSeconds", &config.script_timeout_seconds},
+		{"RetryIntervalSeconds", &config.retry_interval_seconds},
+	};
+	for (const auto &setting : int_settings) {
+		e_cfg_subval = config_json.Get(setting.first);
+		if (e_cfg_subval) {
+			const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() <= 0) {
+					return expected::unexpected(MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"SelfTest." + setting.first + " must be positive."));
+				}
+				*setting.second = e_cfg_int.value();
+			}
+		}
+	}
+
+	return config;
+}
+
+static expected::expected<StateTimeouts, error::Error> ParseStateTimeouts(
+	const json::Json &config_json) {
+	StateTimeouts config;
+
+	const vector<pair<string, int *>> int_settings {
+		{"DownloadSeconds", &config.download_seconds},
+		{"InstallSeconds", &config.install_seconds},
+		{"RebootSeconds", &config.reboot_seconds},
+		{"CommitSeconds", &config.commit_seconds},
+	};
+	for (const auto &setting : int_settings) {
+		auto e_cfg_subval = config_json.Get(setting.first);
+		if (e_cfg_subval) {
+			const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					return expected::unexpected(MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"StateTimeouts." + setting.first + " must not be negative."));
+				}
+				*setting.second = e_cfg_int.value();
+			}
+		}
+	}
+
+	return config;
+}
+
+static expected::expected<Metrics, error::Error> ParseMetrics(const json::Json &config_json) {
+	Metrics config;
+
+	auto exp_listen = config_json.Get("Listen").and_then(json::ToString);
+	if (!exp_listen || exp_listen.value() == "") {
+		return config;
+	}
+	const string &listen = exp_listen.value();
+
+	bool valid {false};
+	if (common::StartsWith<string>(listen, "unix:")) {
+		valid = listen.size() > 5 && listen[5] == '/';
+	} else {
+		auto colon = listen.rfind(':');
+		if (colon != string::npos && colon > 0) {
+			auto exp_port = common::StringTo<uint16_t>(listen.substr(colon + 1));
+			valid = exp_port && exp_port.value() != 0;
+		}
+	}
+	if (!valid) {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"Metrics.Listen must be \"unix:\" and an absolute path, or a host and a port."));
+	}
+	config.listen = listen;
+
+	return config;
+}
+
+// Only custom headers may be added, so that the configuration can't change how the requests are
+// handled. "X-MEN-" headers are part of the Mender protocol.
+static expected::expected<RetryPolicy, error::Error> ParseRetryPolicy(
+	const json::Json &policy_json, const string &name) {
+	RetryPolicy policy;
+
+	const vector<pair<string, int *>> int_settings {
+		{"MaxAttempts", &policy.max_attempts},
+		{"BaseIntervalSeconds", &policy.base_interval_seconds},
+		{"MaxIntervalSeconds", &policy.max_interval_seconds},
+	};
+	for (const auto &setting : int_settings) {
+		json::ExpectedJson e_cfg_subval = policy_json.Get(setting.first);
+		if (e_cfg_subval) {
+			const auto e_cfg_int = e_cfg_subval.value().Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					return expected::unexpected(MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"RetryPolicies." + name + "." + setting.first + " cannot be negative."));
+				}
+				*setting.second = e_cfg_int.value();
+			}
+		}
+	}
+	if (policy.base_interval_seconds > 0 && policy.max_interval_seconds > 0
+		&& policy.max_interval_seconds < policy.base_interval_seconds) {
+		return expected::unexpected(MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"RetryPolicies." + name
+				+ ".MaxIntervalSeconds cannot be shorter than BaseIntervalSeconds."));
+	}
+
+	json::ExpectedJson e_cfg_subval = policy_json.Get("Factor");
+	if (e_cfg_subval) {
+		const auto e_cfg_double = e_cfg_subval.value().Get<double>();
+		if (e_cfg_double) {
+			if (e_cfg_double.value() < 1.0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"RetryPolicies." + name + ".Factor cannot be less than 1."));
+			}
+			policy.factor = e_cfg_double.value();
+		}
+	}
+
+	e_cfg_subval = policy_json.Get("Jitter");
+	if (e_cfg_subval) {
+		const auto e_cfg_double = e_cfg_subval.value().Get<double>();
+		if (e_cfg_double) {
+			if (e_cfg_double.value() < 0.0 || e_cfg_double.value() > 1.0) {
+				return expected::unexpected(MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"RetryPolicies." + name + ".Jitter must be between 0 and 1."));
+			}
+			policy.jitter = e_cfg_double.value();
+		}
+	}
+
+	return policy;
+}
+
+static expected::expected<RetryPolicies, error::Error> ParseRetryPolicies(
+	const json::Json &policies_json) {
+	RetryPolicies policies;
+
+	const vector<pair<string, RetryPolicy *>> settings {
+		{"DeploymentPolling", &policies.deployment_polling},
+		{"StatusReporting", &policies.status_reporting},
+		{"LogUpload", &policies.log_upload},
+	};
+	for (const auto &setting : settings) {
+		json::ExpectedJson e_cfg_subval = policies_json.Get(setting.first);
+		if (e_cfg_subval && e_cfg_subval.value().IsObject()) {
+			auto exp_policy = ParseRetryPolicy(e_cfg_subval.value(), setting.first);
+			if (!exp_policy) {
+				return expected::unexpected(exp_policy.error());
+			}
+			*setting.second = exp_policy.value();
+		}
+	}
+
+	return policies;
+}
+
+static error::Error ValidateHttpHeader(const string &name, const string &value) {
+	auto lower_name = common::StringToLower(name);
+	bool valid_name = all_of(name.begin(), name.end(), [](char c) {
+		return isalnum(static_cast<unsigned char>(c)) || c == '-';
+	});
+	if (!valid_name || name.size() <= 2 || !common::StartsWith<string>(lower_name, "x-")
+		|| common::StartsWith<string>(lower_name, "x-men-")) {
+		return MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"Invalid header '" + name
+				+ "' in HttpHeaders. Only headers starting with 'X-', and not with 'X-MEN-',"
+				  " are allowed");
+	}
+	bool valid_value = all_of(value.begin(), value.end(), [](char c) {
+		return (c >= 0x20 && c < 0x7f) || c == '\t';
+	});
+	if (!valid_value) {
+		return MakeError(
+			ConfigParserErrorCode::ValidationError,
+			"Invalid value of header '" + name + "' in HttpHeaders: Only printable characters are"
+			" allowed");
+	}
+	return error::NoError;
+}
+
+int64_t DownloadRateLimit::BytesPerSecondAt(int minute_of_day) const {
+	for (const auto &window : windows) {
+		bool inside;
+		if (window.start_minute <= window.end_minute) {
+			inside = minute_of_day >= window.start_minute && minute_of_day < window.end_minute;
+		} else {
+			inside = minute_of_day >= window.start_minute || minute_of_day < window.end_minute;
+		}
+		if (inside) {
+			return window.bytes_per_second;
+		}
+	}
+	return bytes_per_second;
+}
+
+bool UpdateWindow::Restricts(const string &state) const {
+	return Enabled() && find(states.begin(), states.end(), state) != states.end();
+}
+
+bool UpdateWindow::Allows(int weekday, int minute_of_day) const {
+	for (const auto &range : ranges) {
+		bool starts_today = (range.weekdays & (1u << weekday)) != 0;
+		bool started_yesterday = (range.weekdays & (1u << ((weekday + 6) % 7))) != 0;
+		if (range.start_minute <= range.end_minute) {
+			if (starts_today && minute_of_day >= range.start_minute
+				&& minute_of_day < range.end_minute) {
+				return true;
+			}
+		} else if (
+			(starts_today && minute_of_day >= range.start_minute)
+			|| (started_yesterday && minute_of_day < range.end_minute)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+const string kEnvReference {"@env:"};
+const string kFileReference {"@file:"};
+
+static expected::ExpectedString ResolveReference(const string &value) {
+	if (common::StartsWith<string>(value, "@@")) {
+		return value.substr(1);
+	}
+
+	if (common::StartsWith(value, kEnvReference)) {
+		const string name = value.substr(kEnvReference.size());
+		const char *env_value = getenv(name.c_str());
+		if (env_value == nullptr) {
+			return expected::unexpected(MakeError(
+				ConfigParserErrorCode::ValidationError,
+				"The environment variable " + name + " is not set"));
+		}
+		return string(env_value);
+	}
+
+	if (common::StartsWith(value, kFileReference)) {
+		const string file = value.substr(kFileReference.size());
+		ifstream stream(file);
+		if (!stream) {
+			auto err = errno;
+			return expected::unexpected(error::Error(
+				generic_category().default_error_condition(err), "Could not open " + file));
+		}
+		stringstream content;
+		content << stream.rdbuf();
+		string secret = content.str();
+		// Like the trailing newline which `echo` leaves in a file.
+		while (secret != "" && (secret.back() == '\n' || secret.back() == '\r')) {
+			secret.pop_back();
+		}
+		return secret;
+	}
+
+	return value;
+}
+
+// `value` as JSON text, with the references in its strings resolved. The settings which can't be
+// resolved are left out, so that the rest of the file still applies.
+static optional<string> ResolveReferences(
+	const json::Json &value, const string &setting, bool &has_references) {
+	if (value.IsString()) {
+		auto str = value.GetString().value_or("");
+		if (!common::StartsWith<string>(str, "@")) {
+			return value.Dump(-1);
+		}
+		has_references = true;
+		auto exp_resolved = ResolveReference(str);
+		if (!exp_resolved) {
+			log::Error(
+				"Could not resolve " + setting + ", ignoring it: " + exp_resolved.error().String());
+			return nullopt;
+		}
+		return "\"" + json::EscapeString(exp_resolved.value()) + "\"";
+	}
+
+	if (value.IsObject()) {
+		auto exp_children = value.GetChildren();
+		if (!exp_children) {
+			return value.Dump(-1);
+		}
+		string text {"{"};
+		string separator;
+		for (const auto &child : exp_children.value()) {
+			const string name = setting == "" ? child.first : setting + "." + child.first;
+			auto resolved = ResolveReferences(child.second, name, has_references);
+			if (resolved) {
+				text += separator + "\"" + json::EscapeString(child.first)
+						+ "\":" + resolved.value();
+				separator = ",";
+			}
+		}
+		return text + "}";
+	}
+
+	if (value.IsArray()) {
+		auto exp_size = value.GetArraySize();
+		string text {"["};
+		string separator;
+		for (size_t i = 0; exp_size && i < exp_size.value(); i++) {
+			auto exp_item = value.Get(i);
+			if (!exp_item) {
+				continue;
+			}
+			auto resolved = ResolveReferences(
+				exp_item.value(), setting + "[" + to_string(i) + "]", has_references);
+			if (resolved) {
+				text += separator + resolved.value();
+				separator = ",";
+			}
+		}
+		return text + "]";
+	}
+
+	return value.Dump(-1);
+}
+
+ExpectedBool MenderConfigFromFile::LoadFile(const string &path) {
+	const json::ExpectedJson e_cfg_json = json::LoadFromFile(path);
+	if (!e_cfg_json) {
+		auto err = e_cfg_json.error();
+		return expected::unexpected(err);
+	}
+
+	bool applied = false;
+
+	json::Json cfg_json = e_cfg_json.value();
+	bool has_references {false};
+	auto resolved = ResolveReferences(cfg_json, "", has_references);
+	if (has_references && resolved) {
+		auto e_resolved_json = json::Load(resolved.value());
+		if (!e_resolved_json) {
+			return expected::unexpected(e_resolved_json.error());
+		}
+		cfg_json = e_resolved_json.value();
+	}
+
+	json::ExpectedJson e_cfg_value = cfg_json.Get("DeviceTypeFile");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->device_type_file = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ServerCertificate");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->server_certificate = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("Proxy");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->proxy = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ProxyUsername");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->proxy_username = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ProxyPassword");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->proxy_password = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ProxyAutoConfig");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("URL");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->proxy_auto_config.url = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("DHCP");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->proxy_auto_config.dhcp = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Evaluator");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->proxy_auto_config.evaluator = e_cfg_string.value();
+				applied = true;
+			}
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("UpdateLogPath");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->update_log_path = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("TenantToken");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->tenant_token = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("DeviceTier");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			const string &tier = e_cfg_string.value();
+			if (!device_tier::IsValid(tier)) {
+				auto err = MakeError(
+					ConfigParserErrorCode::DeviceTierError, "Invalid DeviceTier: " + tier);
+				return expected::unexpected(err);
+			}
+			this->device_tier = tier;
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("IdentityProviders");
+	if (e_cfg_value) {
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(e_cfg_value.value());
+		if (e_cfg_strings) {
+			const vector<string> supported {"script", "mac", "dmi-serial", "tpm-ek", "machine-id"};
+			for (const auto &provider : e_cfg_strings.value()) {
+				if (find(supported.begin(), supported.end(), provider) == supported.end()) {
+					return expected::unexpected(MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"Invalid identity provider '" + provider
+							+ "' in IdentityProviders, expected script, mac, dmi-serial, tpm-ek "
+							  "or machine-id"));
+				}
+			}
+			this->identity_providers = e_cfg_strings.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("DaemonLogLevel");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->daemon_log_level = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("LogLevels");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedKeyValueMap e_cfg_map = json::ToKeyValueMap(value_json);
+		if (e_cfg_map) {
+			this->log_levels = e_cfg_map.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("LogFormat");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->log_format = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("HttpHeaders");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedKeyValueMap e_cfg_map = json::ToKeyValueMap(value_json);
+		if (e_cfg_map) {
+			for (const auto &header : e_cfg_map.value()) {
+				auto err = ValidateHttpHeader(header.first, header.second);
+				if (err != error::NoError) {
+					return expected::unexpected(err);
+				}
+			}
+			this->http_headers = e_cfg_map.value();
+			applied = true;
+		}
+	}
+
+	/* Boolean values now */
+	e_cfg_value = cfg_json.Get("SkipVerify");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedBool e_cfg_bool = value_json.GetBool();
+		if (e_cfg_bool) {
+			this->skip_verify = e_cfg_bool.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("UpdatePollIntervalSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->update_poll_interval_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("InventoryPollIntervalSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->inventory_poll_interval_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("PollSplay");
+	if (e_cfg_value) {
+		// As a whole, so that a later file can switch between the two settings.
+		this->poll_splay = PollSplay {};
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("Percent");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0 || e_cfg_int.value() > 100) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"PollSplay.Percent must be between 0 and 100.");
+					return expected::unexpected(err);
+				}
+				this->poll_splay.percent = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Seconds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"PollSplay.Seconds cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->poll_splay.seconds = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		if (this->poll_splay.percent != 0 && this->poll_splay.seconds != 0) {
+			auto err = MakeError(
+				ConfigParserErrorCode::ValidationError,
+				"Only one of PollSplay.Percent and PollSplay.Seconds can be set.");
+			return expected::unexpected(err);
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("InventorySubmission");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("ChangesOnly");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->inventory_submission.changes_only = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("FullResubmitIntervalSeconds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				this->inventory_submission.full_resubmit_interval_seconds = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Independent");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->inventory_submission.independent = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RetryPollIntervalSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->retry_poll_interval_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RetryPollCount");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->retry_poll_count = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RetryPolicies");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_policies = ParseRetryPolicies(value_json);
+			if (!exp_policies) {
+				return expected::unexpected(exp_policies.error());
+			}
+			this->retry_policies = exp_policies.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateScriptTimeoutSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->state_script_timeout_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateScriptRetryTimeoutSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->state_script_retry_timeout_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateScriptRetryIntervalSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->state_script_retry_interval_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateScriptOutputLimitBytes");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->state_script_output_limit_bytes = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateScriptWasmRuntime");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(value_json);
+		if (e_cfg_strings) {
+			this->state_script_wasm_runtime = e_cfg_strings.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateListenerTimeoutSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->state_listener_timeout_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateListenerMaxDelaySeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->state_listener_max_delay_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ArtifactCommitLeaseApplications");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(value_json);
+		if (e_cfg_strings) {
+			this->artifact_commit_lease_applications = e_cfg_strings.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ArtifactCommitLeaseSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"ArtifactCommitLeaseSeconds cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->artifact_commit_lease_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ArtifactCommitLeaseRenewalSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"ArtifactCommitLeaseRenewalSeconds must be positive.");
+				return expected::unexpected(err);
+			}
+			this->artifact_commit_lease_renewal_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("CommitRequiresConfirmation");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedBool e_cfg_bool = value_json.GetBool();
+		if (e_cfg_bool) {
+			this->commit_requires_confirmation = e_cfg_bool.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("CommitConfirmationTimeoutSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"CommitConfirmationTimeoutSeconds must be positive.");
+				return expected::unexpected(err);
+			}
+			this->commit_confirmation_timeout_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RebootGraceSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"RebootGraceSeconds cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->reboot_grace_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RebootGraceApplications");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(value_json);
+		if (e_cfg_strings) {
+			this->reboot_grace_applications = e_cfg_strings.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RebootGraceExtensionSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"RebootGraceExtensionSeconds cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->reboot_grace_extension_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RebootGraceWall");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedBool e_cfg_bool = value_json.GetBool();
+		if (e_cfg_bool) {
+			this->reboot_grace_wall = e_cfg_bool.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RebootGraceHook");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->reboot_grace_hook = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RebootCommand");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(value_json);
+		if (e_cfg_strings) {
+			this->reboot_command = e_cfg_strings.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RollbackRebootCommand");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(value_json);
+		if (e_cfg_strings) {
+			this->rollback_reboot_command = e_cfg_strings.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("RebootTimeoutSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"RebootTimeoutSeconds must be positive.");
+				return expected::unexpected(err);
+			}
+			this->reboot_timeout_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StatusUpdateMinIntervalSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"StatusUpdateMinIntervalSeconds cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->status_update_min_interval_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("DeploymentHistoryLength");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"DeploymentHistoryLength cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->deployment_history_length = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ModuleTimeoutSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->module_timeout_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ModuleTerminationGracePeriodSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() <= 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"ModuleTerminationGracePeriodSeconds must be positive.");
+				return expected::unexpected(err);
+			}
+			this->module_termination_grace_period_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+
+	e_cfg_value = cfg_json.Get("InstallLockTimeoutSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			this->install_lock_timeout_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ModuleProgressIntervalSeconds");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"ModuleProgressIntervalSeconds cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->module_progress_interval_seconds = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ModuleWorkDirQuotaBytes");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const auto e_cfg_int = value_json.Get<int64_t>();
+		if (e_cfg_int) {
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"ModuleWorkDirQuotaBytes cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->module_work_dir_quota_bytes = e_cfg_int.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("InstallLocks");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(value_json);
+		if (e_cfg_strings) {
+			this->install_locks = e_cfg_strings.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ArtifactVerifyKeys");
+	if (e_cfg_value) {
+		this->artifact_verify_keys.clear();
+		const json::Json value_array = e_cfg_value.value();
+		const json::ExpectedSize e_n_items = value_array.GetArraySize();
+		if (e_n_items) {
+			for (size_t i = 0; i < e_n_items.value(); i++) {
+				const json::ExpectedJson e_array_item = value_array.Get(i);
+				if (e_array_item) {
+					const json::ExpectedString e_item_string = e_array_item.value().GetString();
+					if (e_item_string) {
+						const string item_value = e_item_string.value();
+						if (count(
+								this->artifact_verify_keys.begin(),
+								this->artifact_verify_keys.end(),
+								item_value)
+							== 0) {
+							this->artifact_verify_keys.push_back(item_value);
+							applied = true;
+						}
+					}
+				}
+			}
+		}
+		artifact_verify_keys_field_used_ = true;
+	}
+
+	e_cfg_value = cfg_json.Get("ArtifactVerifyKeysDirectory");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			this->artifact_verify_keys_dir = e_cfg_string.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ArtifactVerifyKey");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			if (artifact_verify_keys_field_used_) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"Both 'ArtifactVerifyKey' and 'ArtifactVerifyKeys' are set");
+				return expected::unexpected(err);
+			}
+			assert(artifact_verify_keys.size() <= 1);
+			this->artifact_verify_keys.clear();
+			this->artifact_verify_keys.push_back(e_cfg_string.value());
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("Servers");
+	if (e_cfg_value) {
+		this->servers.clear();
+		const json::Json value_array = e_cfg_value.value();
+		const json::ExpectedSize e_n_items = value_array.GetArraySize();
+		if (e_n_items) {
+			for (size_t i = 0; i < e_n_items.value(); i++) {
+				const json::ExpectedJson e_array_item = value_array.Get(i);
+				if (e_array_item) {
+					const json::ExpectedJson e_item_json = e_array_item.value().Get("ServerURL");
+					if (e_item_json) {
+						const json::ExpectedString e_item_string = e_item_json.value().GetString();
+						if (e_item_string) {
+							const string item_value = e_item_string.value();
+							if (count(this->servers.begin(), this->servers.end(), item_value)
+								== 0) {
+								this->servers.push_back(std::move(item_value));
+								applied = true;
+							}
+						}
+					}
+				}
+			}
+		}
+		servers_field_used_ = true;
+	}
+
+	e_cfg_value = cfg_json.Get("ServerURL");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		const json::ExpectedString e_cfg_string = value_json.GetString();
+		if (e_cfg_string) {
+			if (servers_field_used_) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"Both 'Servers' AND 'ServerURL given in the configuration. Please set only one of these fields");
+				return expected::unexpected(err);
+			}
+			assert(servers.size() <= 1);
+			this->servers.clear();
+			this->servers.push_back(e_cfg_string.value());
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ServerFailover");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("FailbackIntervalSeconds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"ServerFailover.FailbackIntervalSeconds cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->server_failover.failback_interval_seconds = e_cfg_int.value();
+				applied = true;
+			}
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("ServerDiscovery");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("BootstrapURL");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->server_discovery.bootstrap_url = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("SRVRecord");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->server_discovery.srv_record = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("RefreshIntervalSeconds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() <= 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"ServerDiscovery.RefreshIntervalSeconds must be positive.");
+					return expected::unexpected(err);
+				}
+				this->server_discovery.refresh_interval_seconds = e_cfg_int.value();
+				applied = true;
+			}
+		}
+	}
+
+	/* Last but not least, complex values */
+	e_cfg_value = cfg_json.Get("HttpsClient");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("Certificate");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->https_client.certificate = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Key");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->https_client.key = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("SSLEngine");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->https_client.ssl_engine = e_cfg_string.value();
+				applied = true;
+			}
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("Security");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("AuthPrivateKey");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->security.auth_private_key = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("SSLEngine");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->security.ssl_engine = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("AuthMode");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				if (e_cfg_string.value() == "keypair") {
+					this->security.auth_mode = AuthMode::KeyPair;
+				} else if (e_cfg_string.value() == "mtls") {
+					this->security.auth_mode = AuthMode::MTLS;
+				} else {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"Invalid Security.AuthMode '" + e_cfg_string.value()
+							+ "', expected 'keypair' or 'mtls'.");
+					return expected::unexpected(err);
+				}
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("KeyType");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				if (e_cfg_string.value() == "ed25519") {
+					this->security.key_type = KeyType::Ed25519;
+				} else if (e_cfg_string.value() == "ecdsa-p256") {
+					this->security.key_type = KeyType::EcdsaP256;
+				} else if (e_cfg_string.value() == "rsa3072") {
+					this->security.key_type = KeyType::Rsa3072;
+				} else {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"Invalid Security.KeyType '" + e_cfg_string.value()
+							+ "', expected 'ed25519', 'ecdsa-p256' or 'rsa3072'.");
+					return expected::unexpected(err);
+				}
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("SecurityKey");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				if (!common::StartsWith<string>(e_cfg_string.value(), "pkcs11:")) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"Invalid Security.SecurityKey '" + e_cfg_string.value()
+							+ "', expected a PKCS#11 URI.");
+					return expected::unexpected(err);
+				}
+				this->security.security_key = e_cfg_string.value();
+				applied = true;
+			}
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("PostCommitCleanup");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("RemoveCachedArtifacts");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->post_commit_cleanup.remove_cached_artifacts = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("PruneDeploymentLogs");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->post_commit_cleanup.prune_deployment_logs = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Fstrim");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(subval_json);
+			if (e_cfg_strings) {
+				this->post_commit_cleanup.fstrim = e_cfg_strings.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Hooks");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(subval_json);
+			if (e_cfg_strings) {
+				this->post_commit_cleanup.hooks = e_cfg_strings.value();
+				applied = true;
+			}
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("PreflightChecks");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_checks = ParsePreflightChecks(value_json);
+			if (!exp_checks) {
+				return expected::unexpected(exp_checks.error());
+			}
+			this->preflight_checks = exp_checks.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("CanaryMode");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_canary = ParseCanaryMode(value_json);
+			if (!exp_canary) {
+				return expected::unexpected(exp_canary.error());
+			}
+			this->canary_mode = exp_canary.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("PilotMode");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_pilot = ParsePilotMode(value_json);
+			if (!exp_pilot) {
+				return expected::unexpected(exp_pilot.error());
+			}
+			this->pilot_mode = exp_pilot.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("UserNotifications");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("Desktop");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->user_notifications.desktop = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Wall");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->user_notifications.wall = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("RebootWarningSeconds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"UserNotifications.RebootWarningSeconds cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->user_notifications.reboot_warning_seconds = e_cfg_int.value();
+				applied = true;
+			}
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("TelemetrySinks");
+	if (e_cfg_value) {
+		const json::Json value_array = e_cfg_value.value();
+		const json::ExpectedSize e_n_items = value_array.GetArraySize();
+		if (e_n_items) {
+			this->telemetry_sinks.clear();
+			for (size_t i = 0; i < e_n_items.value(); i++) {
+				const json::ExpectedJson e_array_item = value_array.Get(i);
+				if (!e_array_item) {
+					continue;
+				}
+				auto exp_sink = ParseTelemetrySink(e_array_item.value());
+				if (!exp_sink) {
+					return expected::unexpected(exp_sink.error());
+				}
+				this->telemetry_sinks.push_back(exp_sink.value());
+			}
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("MQTT");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_mqtt = ParseMqtt(value_json);
+			if (!exp_mqtt) {
+				return expected::unexpected(exp_mqtt.error());
+			}
+			this->mqtt = exp_mqtt.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StoreEncryption");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_encryption = ParseStoreEncryption(value_json);
+			if (!exp_encryption) {
+				return expected::unexpected(exp_encryption.error());
+			}
+			this->store_encryption = exp_encryption.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("CertificatePinning");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_pinning = ParseCertificatePinning(value_json);
+			if (!exp_pinning) {
+				return expected::unexpected(exp_pinning.error());
+			}
+			this->certificate_pinning = exp_pinning.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("DeviceConfiguration");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_config = ParseDeviceConfiguration(value_json);
+			if (!exp_config) {
+				return expected::unexpected(exp_config.error());
+			}
+			this->device_configuration = exp_config.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("PushChannel");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_config = ParsePushChannel(value_json);
+			if (!exp_config) {
+				return expected::unexpected(exp_config.error());
+			}
+			this->push_channel = exp_config.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("LocalApi");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_config = ParseLocalApi(value_json);
+			if (!exp_config) {
+				return expected::unexpected(exp_config.error());
+			}
+			this->local_api = exp_config.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("DBusAuthorization");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_config = ParseDBusAuthorization(value_json);
+			if (!exp_config) {
+				return expected::unexpected(exp_config.error());
+			}
+			this->dbus_authorization = exp_config.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("SelfTest");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_config = ParseSelfTest(value_json);
+			if (!exp_config) {
+				return expected::unexpected(exp_config.error());
+			}
+			this->self_test = exp_config.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("StateTimeouts");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_config = ParseStateTimeouts(value_json);
+			if (!exp_config) {
+				return expected::unexpected(exp_config.error());
+			}
+			this->state_timeouts = exp_config.value();
+			applied = true;
+		}
+	}
+
+	e_cfg_value = cfg_json.Get("Metrics");
+	if (e_cfg_value) {
+		const json::Json value_json = e_cfg_value.value();
+		if (value_json.IsObject()) {
+			auto exp_config = ParseMetrics(value_json);
+			if (!exp_config) {
+				return expected::unexpected(exp_config.error());
 			}
-			this->device_tier = tier;
+			this->metrics = exp_config.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("DaemonLogLevel");
+	e_cfg_value = cfg_json.Get("UpdateWindow");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
-		if (e_cfg_string) {
-			this->daemon_log_level = e_cfg_string.value();
+		if (value_json.IsObject()) {
+			auto exp_window = ParseUpdateWindow(value_json);
+			if (!exp_window) {
+				return expected::unexpected(exp_window.error());
+			}
+			this->update_window = exp_window.value();
 			applied = true;
 		}
 	}
 
-	/* Boolean values now */
-	e_cfg_value = cfg_json.Get("SkipVerify");
+	e_cfg_value = cfg_json.Get("DownloadRateLimit");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedBool e_cfg_bool = value_json.GetBool();
-		if (e_cfg_bool) {
-			this->skip_verify = e_cfg_bool.value();
+		// Either just the number of bytes per second, or an object with a schedule.
+		const auto e_cfg_int = value_json.Get<int64_t>();
+		if (e_cfg_int) {
+			this->download_rate_limit = DownloadRateLimit {};
+			this->download_rate_limit.bytes_per_second = e_cfg_int.value();
+			applied = true;
+		} else if (value_json.IsObject()) {
+			auto exp_limit = ParseDownloadRateLimit(value_json);
+			if (!exp_limit) {
+				return expected::unexpected(exp_limit.error());
+			}
+			this->download_rate_limit = exp_limit.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("UpdatePollIntervalSeconds");
+	e_cfg_value = cfg_json.Get("ArtifactHeaderPrefetchBytes");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const auto e_cfg_int = value_json.Get<int>();
+		const auto e_cfg_int = value_json.Get<int64_t>();
 		if (e_cfg_int) {
-			this->update_poll_interval_seconds = e_cfg_int.value();
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"ArtifactHeaderPrefetchBytes cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->artifact_header_prefetch_bytes = e_cfg_int.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("InventoryPollIntervalSeconds");
+	e_cfg_value = cfg_json.Get("ArtifactHeaderCacheSize");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
 		const auto e_cfg_int = value_json.Get<int>();
 		if (e_cfg_int) {
-			this->inventory_poll_interval_seconds = e_cfg_int.value();
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"ArtifactHeaderCacheSize cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->artifact_header_cache_size = e_cfg_int.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("RetryPollIntervalSeconds");
+	e_cfg_value = cfg_json.Get("DownloadProgressIntervalSeconds");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
 		const auto e_cfg_int = value_json.Get<int>();
 		if (e_cfg_int) {
-			this->retry_poll_interval_seconds = e_cfg_int.value();
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"DownloadProgressIntervalSeconds cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->download_progress_interval_seconds = e_cfg_int.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("RetryPollCount");
+	e_cfg_value = cfg_json.Get("DeploymentAbortCheckIntervalSeconds");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
 		const auto e_cfg_int = value_json.Get<int>();
 		if (e_cfg_int) {
-			this->retry_poll_count = e_cfg_int.value();
+			if (e_cfg_int.value() < 0) {
+				auto err = MakeError(
+					ConfigParserErrorCode::ValidationError,
+					"DeploymentAbortCheckIntervalSeconds cannot be negative.");
+				return expected::unexpected(err);
+			}
+			this->deployment_abort_check_interval_seconds = e_cfg_int.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("StateScriptTimeoutSeconds");
+	e_cfg_value = cfg_json.Get("ChunkedDownload");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const auto e_cfg_int = value_json.Get<int>();
-		if (e_cfg_int) {
-			this->state_script_timeout_seconds = e_cfg_int.value();
-			applied = true;
+		json::ExpectedJson e_cfg_subval = value_json.Get("StoreURL");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedString e_cfg_string = subval_json.GetString();
+			if (e_cfg_string) {
+				this->chunked_download.store_url = e_cfg_string.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Seeds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(subval_json);
+			if (e_cfg_strings) {
+				this->chunked_download.seeds = e_cfg_strings.value();
+				applied = true;
+			}
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("StateScriptRetryTimeoutSeconds");
+	e_cfg_value = cfg_json.Get("ArtifactMirrors");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const auto e_cfg_int = value_json.Get<int>();
-		if (e_cfg_int) {
-			this->state_script_retry_timeout_seconds = e_cfg_int.value();
+		const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(value_json);
+		if (e_cfg_strings) {
+			this->artifact_mirrors = e_cfg_strings.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("StateScriptRetryIntervalSeconds");
+	e_cfg_value = cfg_json.Get("SimulateDeployments");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const auto e_cfg_int = value_json.Get<int>();
-		if (e_cfg_int) {
-			this->state_script_retry_interval_seconds = e_cfg_int.value();
+		const json::ExpectedBool e_cfg_bool = value_json.GetBool();
+		if (e_cfg_bool) {
+			this->simulate_deployments = e_cfg_bool.value();
 			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("ModuleTimeoutSeconds");
+	e_cfg_value = cfg_json.Get("ArtifactDecryptionKeys");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const auto e_cfg_int = value_json.Get<int>();
-		if (e_cfg_int) {
-			this->module_timeout_seconds = e_cfg_int.value();
+		const json::ExpectedKeyValueMap e_cfg_map = json::ToKeyValueMap(value_json);
+		if (e_cfg_map) {
+			this->artifact_decryption_keys = e_cfg_map.value();
 			applied = true;
 		}
 	}
 
-
-	e_cfg_value = cfg_json.Get("ArtifactVerifyKeys");
+	e_cfg_value = cfg_json.Get("LinkTuning");
 	if (e_cfg_value) {
-		this->artifact_verify_keys.clear();
-		const json::Json value_array = e_cfg_value.value();
-		const json::ExpectedSize e_n_items = value_array.GetArraySize();
-		if (e_n_items) {
-			for (size_t i = 0; i < e_n_items.value(); i++) {
-				const json::ExpectedJson e_array_item = value_array.Get(i);
-				if (e_array_item) {
-					const json::ExpectedString e_item_string = e_array_item.value().GetString();
-					if (e_item_string) {
-						const string item_value = e_item_string.value();
-						if (count(
-								this->artifact_verify_keys.begin(),
-								this->artifact_verify_keys.end(),
-								item_value)
-							== 0) {
-							this->artifact_verify_keys.push_back(item_value);
-							applied = true;
-						}
-					}
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("TCPMaxSegmentSize");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"LinkTuning.TCPMaxSegmentSize cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->link_tuning.tcp_max_segment_size = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("TLSMaxFragmentLength");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				const int length = e_cfg_int.value();
+				if (length != 0 && length != 512 && length != 1024 && length != 2048
+					&& length != 4096) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"LinkTuning.TLSMaxFragmentLength must be 512, 1024, 2048 or 4096.");
+					return expected::unexpected(err);
 				}
+				this->link_tuning.tls_max_fragment_length = length;
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("ReadBufferSize");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"LinkTuning.ReadBufferSize cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->link_tuning.read_buffer_size = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("StallTimeoutSeconds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"LinkTuning.StallTimeoutSeconds cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->link_tuning.stall_timeout_seconds = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Adaptive");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->link_tuning.adaptive = e_cfg_bool.value();
+				applied = true;
 			}
 		}
-		artifact_verify_keys_field_used_ = true;
 	}
 
-	e_cfg_value = cfg_json.Get("ArtifactVerifyKey");
+	e_cfg_value = cfg_json.Get("ConnectionDiagnostics");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
-		if (e_cfg_string) {
-			if (artifact_verify_keys_field_used_) {
-				auto err = MakeError(
-					ConfigParserErrorCode::ValidationError,
-					"Both 'ArtifactVerifyKey' and 'ArtifactVerifyKeys' are set");
-				return expected::unexpected(err);
+		json::ExpectedJson e_cfg_subval = value_json.Get("Enabled");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->connection_diagnostics.enabled = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("MaxRecords");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 1) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"ConnectionDiagnostics.MaxRecords must be at least 1.");
+					return expected::unexpected(err);
+				}
+				this->connection_diagnostics.max_records = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("MaxRecordsPerMinute");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 1) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"ConnectionDiagnostics.MaxRecordsPerMinute must be at least 1.");
+					return expected::unexpected(err);
+				}
+				this->connection_diagnostics.max_records_per_minute = e_cfg_int.value();
+				applied = true;
 			}
-			assert(artifact_verify_keys.size() <= 1);
-			this->artifact_verify_keys.clear();
-			this->artifact_verify_keys.push_back(e_cfg_string.value());
-			applied = true;
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("Servers");
+	e_cfg_value = cfg_json.Get("KeepAlive");
 	if (e_cfg_value) {
-		this->servers.clear();
-		const json::Json value_array = e_cfg_value.value();
-		const json::ExpectedSize e_n_items = value_array.GetArraySize();
-		if (e_n_items) {
-			for (size_t i = 0; i < e_n_items.value(); i++) {
-				const json::ExpectedJson e_array_item = value_array.Get(i);
-				if (e_array_item) {
-					const json::ExpectedJson e_item_json = e_array_item.value().Get("ServerURL");
-					if (e_item_json) {
-						const json::ExpectedString e_item_string = e_item_json.value().GetString();
-						if (e_item_string) {
-							const string item_value = e_item_string.value();
-							if (count(this->servers.begin(), this->servers.end(), item_value)
-								== 0) {
-								this->servers.push_back(std::move(item_value));
-								applied = true;
-							}
-						}
-					}
+		const json::Json value_json = e_cfg_value.value();
+		json::ExpectedJson e_cfg_subval = value_json.Get("Enabled");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->keep_alive.enabled = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("IdleTimeoutSeconds");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 1) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"KeepAlive.IdleTimeoutSeconds must be at least 1.");
+					return expected::unexpected(err);
 				}
+				this->keep_alive.idle_timeout_seconds = e_cfg_int.value();
+				applied = true;
 			}
 		}
-		servers_field_used_ = true;
 	}
 
-	e_cfg_value = cfg_json.Get("ServerURL");
+	e_cfg_value = cfg_json.Get("DeploymentLogs");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		const json::ExpectedString e_cfg_string = value_json.GetString();
-		if (e_cfg_string) {
-			if (servers_field_used_) {
-				auto err = MakeError(
-					ConfigParserErrorCode::ValidationError,
-					"Both 'Servers' AND 'ServerURL given in the configuration. Please set only one of these fields");
-				return expected::unexpected(err);
+		json::ExpectedJson e_cfg_subval = value_json.Get("RotateSizeBytes");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int64_t>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"DeploymentLogs.RotateSizeBytes cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->deployment_logs.rotate_size_bytes = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("Compress");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->deployment_logs.compress = e_cfg_bool.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("MaxTotalSizeBytes");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int64_t>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"DeploymentLogs.MaxTotalSizeBytes cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->deployment_logs.max_total_size_bytes = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("CompressUpload");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->deployment_logs.compress_upload = e_cfg_bool.value();
+				applied = true;
 			}
-			assert(servers.size() <= 1);
-			this->servers.clear();
-			this->servers.push_back(e_cfg_string.value());
-			applied = true;
 		}
 	}
 
-	/* Last but not least, complex values */
-	e_cfg_value = cfg_json.Get("HttpsClient");
+	e_cfg_value = cfg_json.Get("StartupWait");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		json::ExpectedJson e_cfg_subval = value_json.Get("Certificate");
+		json::ExpectedJson e_cfg_subval = value_json.Get("TimeSync");
 		if (e_cfg_subval) {
 			const json::Json subval_json = e_cfg_subval.value();
-			const json::ExpectedString e_cfg_string = subval_json.GetString();
-			if (e_cfg_string) {
-				this->https_client.certificate = e_cfg_string.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->startup_wait.time_sync = e_cfg_bool.value();
 				applied = true;
 			}
 		}
 
-		e_cfg_subval = value_json.Get("Key");
+		e_cfg_subval = value_json.Get("Interfaces");
 		if (e_cfg_subval) {
 			const json::Json subval_json = e_cfg_subval.value();
-			const json::ExpectedString e_cfg_string = subval_json.GetString();
-			if (e_cfg_string) {
-				this->https_client.key = e_cfg_string.value();
+			const json::ExpectedStringVector e_cfg_strings = json::ToStringVector(subval_json);
+			if (e_cfg_strings) {
+				this->startup_wait.interfaces = e_cfg_strings.value();
 				applied = true;
 			}
 		}
 
-		e_cfg_subval = value_json.Get("SSLEngine");
+		e_cfg_subval = value_json.Get("TimeoutSeconds");
 		if (e_cfg_subval) {
 			const json::Json subval_json = e_cfg_subval.value();
-			const json::ExpectedString e_cfg_string = subval_json.GetString();
-			if (e_cfg_string) {
-				this->https_client.ssl_engine = e_cfg_string.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 0) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"StartupWait.TimeoutSeconds cannot be negative.");
+					return expected::unexpected(err);
+				}
+				this->startup_wait.timeout_seconds = e_cfg_int.value();
 				applied = true;
 			}
 		}
 	}
 
-	e_cfg_value = cfg_json.Get("Security");
+	e_cfg_value = cfg_json.Get("LowResource");
 	if (e_cfg_value) {
 		const json::Json value_json = e_cfg_value.value();
-		json::ExpectedJson e_cfg_subval = value_json.Get("AuthPrivateKey");
+		json::ExpectedJson e_cfg_subval = value_json.Get("Enabled");
 		if (e_cfg_subval) {
 			const json::Json subval_json = e_cfg_subval.value();
-			const json::ExpectedString e_cfg_string = subval_json.GetString();
-			if (e_cfg_string) {
-				this->security.auth_private_key = e_cfg_string.value();
+			const json::ExpectedBool e_cfg_bool = subval_json.GetBool();
+			if (e_cfg_bool) {
+				this->low_resource.enabled = e_cfg_bool.value();
 				applied = true;
 			}
 		}
 
-		e_cfg_subval = value_json.Get("SSLEngine");
+		e_cfg_subval = value_json.Get("BufferSize");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < 1024) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"LowResource.BufferSize must be at least 1024.");
+					return expected::unexpected(err);
+				}
+				this->low_resource.buffer_size = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("InstallNiceness");
+		if (e_cfg_subval) {
+			const json::Json subval_json = e_cfg_subval.value();
+			const auto e_cfg_int = subval_json.Get<int>();
+			if (e_cfg_int) {
+				if (e_cfg_int.value() < -20 || e_cfg_int.value() > 19) {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"LowResource.InstallNiceness must be between -20 and 19.");
+					return expected::unexpected(err);
+				}
+				this->low_resource.install_niceness = e_cfg_int.value();
+				applied = true;
+			}
+		}
+
+		e_cfg_subval = value_json.Get("InstallIOClass");
 		if (e_cfg_subval) {
 			const json::Json subval_json = e_cfg_subval.value();
 			const json::ExpectedString e_cfg_string = subval_json.GetString();
 			if (e_cfg_string) {
-				this->security.ssl_engine = e_cfg_string.value();
+				const string &io_class = e_cfg_string.value();
+				if (io_class != "" && io_class != "best-effort" && io_class != "idle") {
+					auto err = MakeError(
+						ConfigParserErrorCode::ValidationError,
+						"LowResource.InstallIOClass must be \"best-effort\" or \"idle\".");
+					return expected::unexpected(err);
+				}
+				this->low_resource.install_io_class = io_class;
 				applied = true;
 			}
 		}
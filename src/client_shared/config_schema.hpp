@@ -0,0 +1,73 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_CLIENT_SHARED_CONFIG_SCHEMA_HPP
+#define MENDER_CLIENT_SHARED_CONFIG_SCHEMA_HPP
+
+#include <string>
+#include <vector>
+
+#include <common/json.hpp>
+
+namespace mender {
+namespace client_shared {
+namespace config_schema {
+
+using namespace std;
+
+namespace json = mender::common::json;
+
+// The settings of `mender.conf`, both the ones of the client and the ones which the rootfs-image
+// Update Module reads from the same files, to find what the client would silently ignore. See
+// Documentation/check-config.md.
+
+enum class Severity {
+	Warning,
+	Error,
+};
+
+struct Finding {
+	Severity severity;
+	// The configuration file, empty for the findings in the merged configuration.
+	string file;
+	// Such as `MQTT.BrokerURL` or `Servers[1].ServerURL`, empty for the whole file.
+	string setting;
+	string message;
+};
+
+// As in `error: /etc/mender/mender.conf: UpdatePollIntervalSecond: Unknown setting`.
+string FormatFinding(const Finding &finding);
+
+// Unknown settings, which are most likely typos, settings of the wrong type, which the client
+// ignores, and settings which are no longer used.
+vector<Finding> CheckFile(const json::Json &config, const string &file);
+
+// Merges the configuration files the way the client reads them, the later ones taking
+// precedence. Settings replace the same settings of the earlier files, except in the sections
+// which the client reads setting by setting, such as `HttpsClient`, which are merged.
+json::ExpectedJson Merge(const vector<json::Json> &configs);
+
+// Settings of the merged configuration which conflict with each other, or with the Update Modules
+// installed in `modules_dir`.
+vector<Finding> CheckConflicts(const json::Json &merged, const string &modules_dir);
+
+// The settings as a JSON Schema, for editors and CI pipelines.
+string JsonSchema();
+
+} // namespace config_schema
+} // namespace client_shared
+} // namespace mender
+
+#endif // MENDER_CLIENT_SHARED_CONFIG_SCHEMA_HPP
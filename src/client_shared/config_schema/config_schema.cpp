@@ -0,0 +1,927 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <client_shared/config_schema.hpp>
+
+#include <algorithm>
+#include <map>
+#include <regex>
+#include <utility>
+
+#include <common/common.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace client_shared {
+namespace config_schema {
+
+namespace common = mender::common;
+namespace expected = mender::common::expected;
+namespace path = mender::common::path;
+
+enum Type : unsigned {
+	kString = 1 << 0,
+	kInteger = 1 << 1,
+	kNumber = 1 << 2,
+	kBoolean = 1 << 3,
+	kObject = 1 << 4,
+	kArray = 1 << 5,
+};
+
+enum class Use {
+	Client,
+	// Read by the rootfs-image Update Module.
+	RootfsImage,
+	// No longer read by anything, but still found in older files.
+	Obsolete,
+};
+
+enum class MergeMode {
+	// A section which the client reads setting by setting, so that a later file only overrides
+	// the settings it has.
+	BySetting,
+	Whole,
+};
+
+struct Setting {
+	string name;
+	unsigned types;
+	// The type of the items of a list, or of the values of an object without known settings.
+	unsigned items;
+	// The settings of an object, or of the objects in a list.
+	vector<Setting> settings;
+	MergeMode merge;
+	Use use;
+};
+
+static Setting Value(const string &name, unsigned types) {
+	return Setting {name, types, 0, {}, MergeMode::Whole, Use::Client};
+}
+
+static Setting String(const string &name) {
+	return Value(name, kString);
+}
+
+static Setting Integer(const string &name) {
+	return Value(name, kInteger);
+}
+
+static Setting Number(const string &name) {
+	return Value(name, kNumber);
+}
+
+static Setting Boolean(const string &name) {
+	return Value(name, kBoolean);
+}
+
+static Setting StringList(const string &name) {
+	return Setting {name, kArray, kString, {}, MergeMode::Whole, Use::Client};
+}
+
+// An object with free keys, such as `LogLevels`.
+static Setting Map(const string &name, unsigned values) {
+	return Setting {name, kObject, values, {}, MergeMode::Whole, Use::Client};
+}
+
+static Setting Section(const string &name, MergeMode merge, vector<Setting> settings) {
+	return Setting {name, kObject, 0, std::move(settings), merge, Use::Client};
+}
+
+static Setting ObjectList(const string &name, vector<Setting> settings) {
+	return Setting {name, kArray, kObject, std::move(settings), MergeMode::Whole, Use::Client};
+}
+
+static Setting WithUse(Setting setting, Use use) {
+	setting.use = use;
+	return setting;
+}
+
+static vector<Setting> RetryPolicySettings() {
+	return {
+		Integer("MaxAttempts"),
+		Integer("BaseIntervalSeconds"),
+		Integer("MaxIntervalSeconds"),
+		Number("Factor"),
+		Number("Jitter"),
+	};
+}
+
+// Mirrors `MenderConfigFromFile::LoadFile()`, and has to be kept in sync with it.
+static const vector<Setting> &Schema() {
+	static const vector<Setting> schema {
+		String("DeviceTypeFile"),
+		String("ServerCertificate"),
+		String("Proxy"),
+		String("ProxyUsername"),
+		String("ProxyPassword"),
+		Section(
+			"ProxyAutoConfig",
+			MergeMode::BySetting,
+			{
+				String("URL"),
+				Boolean("DHCP"),
+				String("Evaluator"),
+			}),
+		String("UpdateLogPath"),
+		String("TenantToken"),
+		String("DeviceTier"),
+		StringList("IdentityProviders"),
+		String("DaemonLogLevel"),
+		Map("LogLevels", kString),
+		String("LogFormat"),
+		Map("HttpHeaders", kString),
+		Boolean("SkipVerify"),
+		Integer("UpdatePollIntervalSeconds"),
+		Integer("InventoryPollIntervalSeconds"),
+		Section(
+			"PollSplay",
+			MergeMode::Whole,
+			{
+				Integer("Percent"),
+				Integer("Seconds"),
+			}),
+		Section(
+			"InventorySubmission",
+			MergeMode::BySetting,
+			{
+				Boolean("ChangesOnly"),
+				Integer("FullResubmitIntervalSeconds"),
+				Boolean("Independent"),
+			}),
+		Integer("RetryPollIntervalSeconds"),
+		Integer("RetryPollCount"),
+		Section(
+			"RetryPolicies",
+			MergeMode::Whole,
+			{
+				Section("DeploymentPolling", MergeMode::Whole, RetryPolicySettings()),
+				Section("StatusReporting", MergeMode::Whole, RetryPolicySettings()),
+				Section("LogUpload", MergeMode::Whole, RetryPolicySettings()),
+			}),
+		Integer("StateScriptTimeoutSeconds"),
+		Integer("StateScriptRetryTimeoutSeconds"),
+		Integer("StateScriptRetryIntervalSeconds"),
+		Integer("StateScriptOutputLimitBytes"),
+		StringList("StateScriptWasmRuntime"),
+		Integer("StateListenerTimeoutSeconds"),
+		Integer("StateListenerMaxDelaySeconds"),
+		StringList("ArtifactCommitLeaseApplications"),
+		Integer("ArtifactCommitLeaseSeconds"),
+		Integer("ArtifactCommitLeaseRenewalSeconds"),
+		Boolean("CommitRequiresConfirmation"),
+		Integer("CommitConfirmationTimeoutSeconds"),
+		Integer("RebootGraceSeconds"),
+		StringList("RebootGraceApplications"),
+		Integer("RebootGraceExtensionSeconds"),
+		Boolean("RebootGraceWall"),
+		String("RebootGraceHook"),
+		StringList("RebootCommand"),
+		StringList("RollbackRebootCommand"),
+		Integer("RebootTimeoutSeconds"),
+		Integer("StatusUpdateMinIntervalSeconds"),
+		Integer("DeploymentHistoryLength"),
+		Integer("ModuleTimeoutSeconds"),
+		Integer("ModuleTerminationGracePeriodSeconds"),
+		Integer("InstallLockTimeoutSeconds"),
+		Integer("ModuleProgressIntervalSeconds"),
+		Integer("ModuleWorkDirQuotaBytes"),
+		StringList("InstallLocks"),
+		StringList("ArtifactVerifyKeys"),
+		String("ArtifactVerifyKeysDirectory"),
+		String("ArtifactVerifyKey"),
+		ObjectList("Servers", {String("ServerURL")}),
+		String("ServerURL"),
+		Section("ServerFailover", MergeMode::BySetting, {Integer("FailbackIntervalSeconds")}),
+		Section(
+			"ServerDiscovery",
+			MergeMode::BySetting,
+			{
+				String("BootstrapURL"),
+				String("SRVRecord"),
+				Integer("RefreshIntervalSeconds"),
+			}),
+		Section(
+			"HttpsClient",
+			MergeMode::BySetting,
+			{
+				String("Certificate"),
+				String("Key"),
+				String("SSLEngine"),
+			}),
+		Section(
+			"Security",
+			MergeMode::BySetting,
+			{
+				String("AuthPrivateKey"),
+				String("SSLEngine"),
+				String("AuthMode"),
+				String("KeyType"),
+				String("SecurityKey"),
+			}),
+		Section(
+			"PostCommitCleanup",
+			MergeMode::BySetting,
+			{
+				Boolean("RemoveCachedArtifacts"),
+				Boolean("PruneDeploymentLogs"),
+				StringList("Fstrim"),
+				StringList("Hooks"),
+			}),
+		Section(
+			"PreflightChecks",
+			MergeMode::Whole,
+			{
+				ObjectList("FreeSpace", {String("Path"), Integer("MinBytes")}),
+				Integer("MinUptimeSeconds"),
+				StringList("Scripts"),
+				Integer("ScriptTimeoutSeconds"),
+			}),
+		Section(
+			"CanaryMode",
+			MergeMode::Whole,
+			{
+				Integer("WindowSeconds"),
+				Integer("IntervalSeconds"),
+				StringList("HealthChecks"),
+				Integer("HealthCheckTimeoutSeconds"),
+			}),
+		Section(
+			"PilotMode",
+			MergeMode::Whole,
+			{
+				Integer("SoakSeconds"),
+				Integer("IntervalSeconds"),
+				StringList("HealthChecks"),
+				Integer("HealthCheckTimeoutSeconds"),
+				String("RevertCommand"),
+			}),
+		Section(
+			"UserNotifications",
+			MergeMode::BySetting,
+			{
+				Boolean("Desktop"),
+				Boolean("Wall"),
+				Integer("RebootWarningSeconds"),
+			}),
+		ObjectList(
+			"TelemetrySinks",
+			{
+				String("Type"),
+				String("Command"),
+				String("URL"),
+				Integer("TimeoutSeconds"),
+			}),
+		Section(
+			"MQTT",
+			MergeMode::Whole,
+			{
+				String("BrokerURL"),
+				String("ClientID"),
+				String("Username"),
+				String("Password"),
+				String("ServerCertificate"),
+				String("ClientCertificate"),
+				String("ClientCertificateKey"),
+				Integer("QoS"),
+				Boolean("Retain"),
+				Section(
+					"Topics",
+					MergeMode::Whole,
+					{
+						String("State"),
+						String("Deployment"),
+						String("Authorization"),
+					}),
+				Integer("TimeoutSeconds"),
+			}),
+		Section(
+			"StoreEncryption",
+			MergeMode::Whole,
+			{
+				String("KeyFile"),
+				String("TPMSealedObject"),
+			}),
+		Section(
+			"CertificatePinning",
+			MergeMode::Whole,
+			{
+				Map("Hosts", kArray),
+				ObjectList(
+					"Exceptions",
+					{
+						StringList("Interfaces"),
+						StringList("SSIDs"),
+						String("TrustedCertificate"),
+					}),
+			}),
+		Section(
+			"DeviceConfiguration",
+			MergeMode::Whole,
+			{
+				Boolean("Enabled"),
+				Integer("PollIntervalSeconds"),
+				String("ApplyScriptsDir"),
+				Integer("ApplyTimeoutSeconds"),
+			}),
+		Section(
+			"PushChannel",
+			MergeMode::Whole,
+			{
+				Boolean("Enabled"),
+				Integer("PingIntervalSeconds"),
+				Integer("MaxRetryIntervalSeconds"),
+			}),
+		Section(
+			"LocalApi",
+			MergeMode::Whole,
+			{
+				Boolean("Enabled"),
+				String("UpdateSocketPath"),
+				String("AuthSocketPath"),
+			}),
+		Section(
+			"DBusAuthorization",
+			MergeMode::Whole,
+			{
+				ObjectList(
+					"Rules",
+					{
+						StringList("Methods"),
+						StringList("Users"),
+						StringList("Groups"),
+					}),
+			}),
+		Section(
+			"SelfTest",
+			MergeMode::Whole,
+			{
+				Boolean("Enabled"),
+				Integer("ScriptTimeoutSeconds"),
+				Integer("RetryIntervalSeconds"),
+			}),
+		Section(
+			"StateTimeouts",
+			MergeMode::Whole,
+			{
+				Integer("DownloadSeconds"),
+				Integer("InstallSeconds"),
+				Integer("RebootSeconds"),
+				Integer("CommitSeconds"),
+			}),
+		Section("Metrics", MergeMode::Whole, {String("Listen")}),
+		Section(
+			"UpdateWindow",
+			MergeMode::Whole,
+			{
+				ObjectList(
+					"Windows",
+					{
+						StringList("Days"),
+						String("Start"),
+						String("End"),
+					}),
+				String("TimeZone"),
+				StringList("States"),
+				Boolean("Confirmation"),
+			}),
+		// Either a number of bytes per second, or a section with a schedule.
+		Setting {
+			"DownloadRateLimit",
+			kInteger | kObject,
+			0,
+			{
+				Integer("BytesPerSecond"),
+				ObjectList(
+					"Schedule",
+					{
+						String("Start"),
+						String("End"),
+						Integer("BytesPerSecond"),
+					}),
+			},
+			MergeMode::Whole,
+			Use::Client,
+		},
+		Integer("ArtifactHeaderPrefetchBytes"),
+		Integer("ArtifactHeaderCacheSize"),
+		Integer("DownloadProgressIntervalSeconds"),
+		Integer("DeploymentAbortCheckIntervalSeconds"),
+		Section(
+			"ChunkedDownload",
+			MergeMode::BySetting,
+			{
+				String("StoreURL"),
+				StringList("Seeds"),
+			}),
+		StringList("ArtifactMirrors"),
+		Boolean("SimulateDeployments"),
+		Map("ArtifactDecryptionKeys", kString),
+		Section(
+			"LinkTuning",
+			MergeMode::BySetting,
+			{
+				Integer("TCPMaxSegmentSize"),
+				Integer("TLSMaxFragmentLength"),
+				Integer("ReadBufferSize"),
+				Integer("StallTimeoutSeconds"),
+				Boolean("Adaptive"),
+			}),
+		Section(
+			"ConnectionDiagnostics",
+			MergeMode::BySetting,
+			{
+				Boolean("Enabled"),
+				Integer("MaxRecords"),
+				Integer("MaxRecordsPerMinute"),
+			}),
+		Section(
+			"KeepAlive",
+			MergeMode::BySetting,
+			{
+				Boolean("Enabled"),
+				Integer("IdleTimeoutSeconds"),
+			}),
+		Section(
+			"DeploymentLogs",
+			MergeMode::BySetting,
+			{
+				Integer("RotateSizeBytes"),
+				Boolean("Compress"),
+				Integer("MaxTotalSizeBytes"),
+				Boolean("CompressUpload"),
+			}),
+		Section(
+			"StartupWait",
+			MergeMode::BySetting,
+			{
+				Boolean("TimeSync"),
+				StringList("Interfaces"),
+				Integer("TimeoutSeconds"),
+			}),
+		Section(
+			"LowResource",
+			MergeMode::BySetting,
+			{
+				Boolean("Enabled"),
+				Integer("BufferSize"),
+				Integer("InstallNiceness"),
+				String("InstallIOClass"),
+			}),
+		Integer("RetryDownloadCount"),
+
+		// See support/modules/rootfs-image.
+		WithUse(String("RootfsPartA"), Use::RootfsImage),
+		WithUse(String("RootfsPartB"), Use::RootfsImage),
+		WithUse(String("BootPartA"), Use::RootfsImage),
+		WithUse(String("BootPartB"), Use::RootfsImage),
+		WithUse(String("BootEnv"), Use::RootfsImage),
+		WithUse(String("BootEnvFile"), Use::RootfsImage),
+		WithUse(String("BootEnvEfiGuid"), Use::RootfsImage),
+		WithUse(String("BootEfiEntryA"), Use::RootfsImage),
+		WithUse(String("BootEfiEntryB"), Use::RootfsImage),
+		WithUse(Boolean("SecurityRelabel"), Use::RootfsImage),
+		WithUse(Boolean("DiscardInactivePartition"), Use::RootfsImage),
+		WithUse(Boolean("RootfsWriteDirect"), Use::RootfsImage),
+		WithUse(Integer("RootfsWriteBufferBytes"), Use::RootfsImage),
+		WithUse(Integer("RootfsWriteSyncIntervalBytes"), Use::RootfsImage),
+		WithUse(Boolean("RootfsWriteSkipIdentical"), Use::RootfsImage),
+
+		WithUse(String("BootUtilitiesSetActivePart"), Use::Obsolete),
+		WithUse(String("BootUtilitiesGetNextActivePart"), Use::Obsolete),
+		WithUse(Section("DBus", MergeMode::Whole, {Boolean("Enabled")}), Use::Obsolete),
+		WithUse(Integer("UpdateControlMapExpirationTimeSeconds"), Use::Obsolete),
+		WithUse(Integer("UpdateControlMapBootExpirationTimeSeconds"), Use::Obsolete),
+		WithUse(
+			Section(
+				"Connectivity",
+				MergeMode::Whole,
+				{
+					Boolean("DisableKeepAlive"),
+					Integer("IdleConnTimeoutSeconds"),
+				}),
+			Use::Obsolete),
+	};
+	return schema;
+}
+
+string FormatFinding(const Finding &finding) {
+	string text = finding.severity == Severity::Error ? "error: " : "warning: ";
+	if (finding.file != "") {
+		text += finding.file + ": ";
+	}
+	if (finding.setting != "") {
+		text += finding.setting + ": ";
+	}
+	return text + finding.message;
+}
+
+// Like the client, which doesn't care about the case of the settings.
+static const Setting *FindSetting(const vector<Setting> &settings, const string &name) {
+	const auto lower = common::StringToLower(name);
+	for (const auto &setting : settings) {
+		if (common::StringToLower(setting.name) == lower) {
+			return &setting;
+		}
+	}
+	return nullptr;
+}
+
+static size_t EditDistance(const string &a, const string &b) {
+	vector<size_t> row(b.size() + 1);
+	for (size_t j = 0; j < row.size(); j++) {
+		row[j] = j;
+	}
+	for (size_t i = 1; i <= a.size(); i++) {
+		size_t diagonal = row[0];
+		row[0] = i;
+		for (size_t j = 1; j <= b.size(); j++) {
+			const size_t above = row[j];
+			row[j] = min({row[j] + 1, row[j - 1] + 1, diagonal + (a[i - 1] == b[j - 1] ? 0 : 1)});
+			diagonal = above;
+		}
+	}
+	return row[b.size()];
+}
+
+// The known setting which `name` is most likely a typo of, if any.
+static string ClosestSetting(const vector<Setting> &settings, const string &name) {
+	const auto lower = common::StringToLower(name);
+	const size_t max_distance = max<size_t>(2, lower.size() / 4);
+	string closest;
+	size_t closest_distance = max_distance + 1;
+	for (const auto &setting : settings) {
+		auto distance = EditDistance(lower, common::StringToLower(setting.name));
+		if (distance < closest_distance) {
+			closest = setting.name;
+			closest_distance = distance;
+		}
+	}
+	return closest;
+}
+
+static bool HasType(const json::Json &value, unsigned types) {
+	return ((types & kString) != 0 && value.IsString())
+		   || ((types & kInteger) != 0 && value.IsInt64())
+		   || ((types & kNumber) != 0 && value.IsNumber())
+		   || ((types & kBoolean) != 0 && value.IsBool())
+		   || ((types & kObject) != 0 && value.IsObject())
+		   || ((types & kArray) != 0 && value.IsArray());
+}
+
+static string TypeNames(unsigned types) {
+	const vector<pair<Type, string>> names {
+		{kString, "a string"},
+		{kInteger, "an integer"},
+		{kNumber, "a number"},
+		{kBoolean, "true or false"},
+		{kObject, "an object"},
+		{kArray, "a list"},
+	};
+	vector<string> found;
+	for (const auto &name : names) {
+		if ((types & name.first) != 0) {
+			found.push_back(name.second);
+		}
+	}
+	return common::JoinStrings(found, " or ");
+}
+
+static void CheckSettings(
+	const json::Json &object,
+	const vector<Setting> &settings,
+	const string &prefix,
+	const string &file,
+	vector<Finding> &findings);
+
+static void CheckValue(
+	const json::Json &value,
+	const Setting &setting,
+	const string &name,
+	const string &file,
+	vector<Finding> &findings) {
+	if (setting.use == Use::Obsolete) {
+		findings.push_back({Severity::Warning, file, name, "No longer used, and ignored"});
+		return;
+	}
+	if (!HasType(value, setting.types)) {
+		findings.push_back(
+			{Severity::Error, file, name, "Must be " + TypeNames(setting.types) + ", is ignored"});
+		return;
+	}
+
+	if (value.IsObject()) {
+		if (!setting.settings.empty()) {
+			CheckSettings(value, setting.settings, name + ".", file, findings);
+			return;
+		}
+		auto exp_children = value.GetChildren();
+		if (!exp_children || setting.items == 0) {
+			return;
+		}
+		for (const auto &child : exp_children.value()) {
+			if (!HasType(child.second, setting.items)) {
+				findings.push_back(
+					{Severity::Error,
+					 file,
+					 name + "." + child.first,
+					 "Must be " + TypeNames(setting.items)});
+			}
+		}
+	} else if (value.IsArray()) {
+		auto exp_size = value.GetArraySize();
+		for (size_t i = 0; exp_size && i < exp_size.value(); i++) {
+			auto exp_item = value.Get(i);
+			if (!exp_item) {
+				continue;
+			}
+			const string item_name = name + "[" + to_string(i) + "]";
+			if (!HasType(exp_item.value(), setting.items)) {
+				findings.push_back(
+					{Severity::Error, file, item_name, "Must be " + TypeNames(setting.items)});
+			} else if (exp_item.value().IsObject()) {
+				CheckSettings(exp_item.value(), setting.settings, item_name + ".", file, findings);
+			}
+		}
+	}
+}
+
+static void CheckSettings(
+	const json::Json &object,
+	const vector<Setting> &settings,
+	const string &prefix,
+	const string &file,
+	vector<Finding> &findings) {
+	auto exp_children = object.GetChildren();
+	if (!exp_children) {
+		return;
+	}
+	for (const auto &child : exp_children.value()) {
+		const string name = prefix + child.first;
+		auto setting = FindSetting(settings, child.first);
+		if (setting == nullptr) {
+			string message = "Unknown setting, ignored";
+			auto closest = ClosestSetting(settings, child.first);
+			if (closest != "") {
+				message += ", did you mean " + prefix + closest + "?";
+			}
+			findings.push_back({Severity::Warning, file, name, message});
+			continue;
+		}
+		CheckValue(child.second, *setting, name, file, findings);
+	}
+}
+
+vector<Finding> CheckFile(const json::Json &config, const string &file) {
+	vector<Finding> findings;
+	if (!config.IsObject()) {
+		findings.push_back({Severity::Error, file, "", "Must be a JSON object"});
+		return findings;
+	}
+	CheckSettings(config, Schema(), "", file, findings);
+	return findings;
+}
+
+json::ExpectedJson Merge(const vector<json::Json> &configs) {
+	struct MergedSetting {
+		string name;
+		json::Json value;
+		// For the sections which are merged setting by setting, their settings, by their lower
+		// case names.
+		bool by_setting {false};
+		map<string, pair<string, json::Json>> settings;
+	};
+	// By their lower case names, since a later file may spell them differently.
+	map<string, MergedSetting> merged;
+
+	for (const auto &config : configs) {
+		auto exp_children = config.GetChildren();
+		if (!exp_children) {
+			return expected::unexpected(exp_children.error());
+		}
+		for (const auto &child : exp_children.value()) {
+			auto &entry = merged[common::StringToLower(child.first)];
+			entry.name = child.first;
+
+			auto setting = FindSetting(Schema(), child.first);
+			if (setting == nullptr || setting->merge != MergeMode::BySetting
+				|| !child.second.IsObject()) {
+				entry.value = child.second;
+				entry.by_setting = false;
+				entry.settings.clear();
+				continue;
+			}
+			if (!entry.by_setting) {
+				entry.by_setting = true;
+				entry.settings.clear();
+			}
+			auto exp_settings = child.second.GetChildren();
+			if (!exp_settings) {
+				return expected::unexpected(exp_settings.error());
+			}
+			for (const auto &sub : exp_settings.value()) {
+				entry.settings[common::StringToLower(sub.first)] = {sub.first, sub.second};
+			}
+		}
+	}
+
+	string text {"{"};
+	string separator;
+	for (const auto &entry : merged) {
+		text += separator + "\"" + json::EscapeString(entry.second.name) + "\":";
+		separator = ",";
+		if (!entry.second.by_setting) {
+			text += entry.second.value.Dump(-1);
+			continue;
+		}
+		text += "{";
+		string sub_separator;
+		for (const auto &sub : entry.second.settings) {
+			text += sub_separator + "\"" + json::EscapeString(sub.second.first)
+					+ "\":" + sub.second.second.Dump(-1);
+			sub_separator = ",";
+		}
+		text += "}";
+	}
+	text += "}";
+	return json::Load(text);
+}
+
+static string StringSetting(const json::Json &config, const string &name) {
+	auto exp_value = config.Get(name).and_then(json::ToString);
+	return exp_value ? exp_value.value() : "";
+}
+
+// Settings which only make sense for two partitions together.
+static void CheckPartitionPair(
+	const json::Json &merged, const string &a, const string &b, vector<Finding> &findings) {
+	const auto value_a = StringSetting(merged, a);
+	const auto value_b = StringSetting(merged, b);
+	if (value_a == "" && value_b == "") {
+		return;
+	}
+	if (value_a == "" || value_b == "") {
+		const auto &missing = value_a == "" ? a : b;
+		const auto &set = value_a == "" ? b : a;
+		findings.push_back(
+			{Severity::Error, "", missing, "Missing, " + set + " is set, and needs it as well"});
+	} else if (value_a == value_b) {
+		findings.push_back({Severity::Error, "", b, "The same partition as " + a});
+	}
+}
+
+// The boot environments without an environment of their own need the settings which tell them
+// what the firmware boots for each slot.
+static void CheckBootEnv(const json::Json &merged, vector<Finding> &findings) {
+	const auto boot_env = StringSetting(merged, "BootEnv");
+	if (boot_env == "tryboot") {
+		if (StringSetting(merged, "BootPartA") == "") {
+			findings.push_back(
+				{Severity::Error, "", "BootPartA", "Missing, BootEnv tryboot needs BootPartA/B"});
+		}
+		if (StringSetting(merged, "BootEnvFile") == "") {
+			findings.push_back(
+				{Severity::Error,
+				 "",
+				 "BootEnvFile",
+				 "Missing, BootEnv tryboot needs the path of the autoboot.txt"});
+		}
+	} else if (boot_env == "efi-bootnext") {
+		const auto entry_a = StringSetting(merged, "BootEfiEntryA");
+		const auto entry_b = StringSetting(merged, "BootEfiEntryB");
+		const regex entry_regex {"[0-9A-Fa-f]{4}"};
+		for (const auto &entry : vector<pair<string, string>> {
+				 {"BootEfiEntryA", entry_a}, {"BootEfiEntryB", entry_b}}) {
+			if (entry.second == "") {
+				findings.push_back(
+					{Severity::Error,
+					 "",
+					 entry.first,
+					 "Missing, BootEnv efi-bootnext needs BootEfiEntryA/B"});
+			} else if (!regex_match(entry.second, entry_regex)) {
+				findings.push_back(
+					{Severity::Error,
+					 "",
+					 entry.first,
+					 "Not a boot entry, it must be four hexadecimal digits, as in Boot0001"});
+			}
+		}
+		if (entry_a != "" && common::StringToLower(entry_a) == common::StringToLower(entry_b)) {
+			findings.push_back(
+				{Severity::Error, "", "BootEfiEntryB", "The same boot entry as BootEfiEntryA"});
+		}
+	}
+}
+
+vector<Finding> CheckConflicts(const json::Json &merged, const string &modules_dir) {
+	vector<Finding> findings;
+
+	CheckPartitionPair(merged, "RootfsPartA", "RootfsPartB", findings);
+	CheckPartitionPair(merged, "BootPartA", "BootPartB", findings);
+	CheckBootEnv(merged, findings);
+
+	const auto rootfs_image = path::Join(modules_dir, "rootfs-image");
+	if ((StringSetting(merged, "RootfsPartA") != "" || StringSetting(merged, "RootfsPartB") != "")
+		&& !path::FileExists(rootfs_image)) {
+		findings.push_back(
+			{Severity::Warning,
+			 "",
+			 "RootfsPartA",
+			 "Set, but there is no " + rootfs_image
+				 + " Update Module to switch between the partitions"});
+	}
+
+	// Only used without servers, see `MenderConfig::DiscoverServers()`.
+	auto exp_servers = merged.Get("Servers");
+	if (merged.Get("ServerDiscovery")
+		&& ((exp_servers && exp_servers.value().IsArray()
+			 && exp_servers.value().GetArraySize().value_or(0) > 0)
+			|| StringSetting(merged, "ServerURL") != "")) {
+		findings.push_back(
+			{Severity::Warning,
+			 "",
+			 "ServerDiscovery",
+			 "Not used, since Servers or ServerURL is set"});
+	}
+
+	return findings;
+}
+
+static string JsonTypes(unsigned types) {
+	const vector<pair<Type, string>> names {
+		{kString, "string"},
+		{kInteger, "integer"},
+		{kNumber, "number"},
+		{kBoolean, "boolean"},
+		{kObject, "object"},
+		{kArray, "array"},
+	};
+	vector<string> found;
+	for (const auto &name : names) {
+		if ((types & name.first) != 0) {
+			found.push_back("\"" + name.second + "\"");
+		}
+	}
+	if (found.size() == 1) {
+		return found[0];
+	}
+	return "[" + common::JoinStrings(found, ",") + "]";
+}
+
+static string SettingSchema(const Setting &setting);
+
+static string PropertiesSchema(const vector<Setting> &settings) {
+	string text {R"("properties":{)"};
+	string separator;
+	for (const auto &setting : settings) {
+		text += separator + "\"" + json::EscapeString(setting.name)
+				+ "\":" + SettingSchema(setting);
+		separator = ",";
+	}
+	return text + R"(},"additionalProperties":false)";
+}
+
+static string SettingSchema(const Setting &setting) {
+	string text = R"({"type":)" + JsonTypes(setting.types);
+	if (setting.use == Use::Obsolete) {
+		text += R"(,"deprecated":true)";
+	}
+	if ((setting.types & kObject) != 0) {
+		if (!setting.settings.empty()) {
+			text += "," + PropertiesSchema(setting.settings);
+		} else if (setting.items != 0) {
+			text += R"(,"additionalProperties":{"type":)" + JsonTypes(setting.items) + "}";
+		}
+	}
+	if ((setting.types & kArray) != 0) {
+		text += R"(,"items":{"type":)" + JsonTypes(setting.items);
+		if (!setting.settings.empty()) {
+			text += "," + PropertiesSchema(setting.settings);
+		}
+		text += "}";
+	}
+	return text + "}";
+}
+
+string JsonSchema() {
+	const string text = R"({"$schema":"https://json-schema.org/draft/2020-12/schema",)"
+						R"("title":"mender.conf","type":"object",)"
+						+ PropertiesSchema(Schema()) + "}";
+	auto exp_json = json::Load(text);
+	return exp_json ? exp_json.value().Dump(2) : text;
+}
+
+} // namespace config_schema
+} // namespace client_shared
+} // namespace mender
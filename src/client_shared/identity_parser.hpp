@@ -15,6 +15,9 @@
 #ifndef MENDER_COMMON_IDENTITY_PARSER_HPP
 #define MENDER_COMMON_IDENTITY_PARSER_HPP
 
+#include <string>
+#include <vector>
+
 #include <common/key_value_parser.hpp>
 
 namespace mender {
@@ -24,8 +27,36 @@ namespace identity_parser {
 using namespace std;
 namespace kvp = mender::common::key_value_parser;
 
+// The identity providers, see Documentation/device-identity.md.
+extern const string kProviderScript;
+extern const string kProviderMac;
+extern const string kProviderDmiSerial;
+extern const string kProviderTpmEk;
+extern const string kProviderMachineId;
+
+// Where the identity data comes from: the given providers, in order, or only the identity script
+// if there are none.
+struct IdentitySource {
+	IdentitySource(const string &script, const vector<string> &providers = {}) :
+		script {script},
+		providers {providers} {
+	}
+
+	string script;
+	vector<string> providers;
+
+	// Where the built-in providers read from, changed in tests.
+	string sys_dir {"/sys"};
+	string machine_id_file {"/etc/machine-id"};
+};
+
 kvp::ExpectedKeyValuesMap GetIdentityData(const string &identity_data_generator);
 
+// The identity data from all the providers of `source`. The values which several providers give
+// for the same key are kept in the order of the providers, and only once. Fails if any of the
+// providers does, since a partial identity would be another device.
+kvp::ExpectedKeyValuesMap GetIdentityData(const IdentitySource &source);
+
 string DumpIdentityData(const kvp::KeyValuesMap &identity_data);
 
 } // namespace identity_parser
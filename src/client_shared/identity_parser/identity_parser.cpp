@@ -14,10 +14,18 @@
 
 #include <client_shared/identity_parser.hpp>
 
+#include <algorithm>
+#include <cerrno>
+#include <filesystem>
+#include <limits>
+
 #include <common/common.hpp>
+#include <common/error.hpp>
 #include <common/expected.hpp>
+#include <common/io.hpp>
 #include <common/json.hpp>
 #include <common/key_value_parser.hpp>
+#include <common/path.hpp>
 #include <common/processes.hpp>
 
 namespace mender {
@@ -25,10 +33,26 @@ namespace client_shared {
 namespace identity_parser {
 
 using namespace std;
+namespace common = mender::common;
+namespace error = mender::common::error;
 namespace expected = mender::common::expected;
+namespace io = mender::common::io;
 namespace json = mender::common::json;
 namespace kvp = mender::common::key_value_parser;
+namespace path = mender::common::path;
 namespace procs = mender::common::processes;
+namespace fs = std::filesystem;
+
+const string kProviderScript {"script"};
+const string kProviderMac {"mac"};
+const string kProviderDmiSerial {"dmi-serial"};
+const string kProviderTpmEk {"tpm-ek"};
+const string kProviderMachineId {"machine-id"};
+
+// Where the endorsement key is kept, as provisioned following the TCG guidelines.
+static const string kTpmEkHandle {"0x81010001"};
+// ARPHRD_ETHER in /sys/class/net/<interface>/type.
+static const string kArphrdEther {"1"};
 
 kvp::ExpectedKeyValuesMap GetIdentityData(const string &identity_data_generator) {
 	procs::Process proc({identity_data_generator});
@@ -42,6 +66,156 @@ kvp::ExpectedKeyValuesMap GetIdentityData(const string &identity_data_generator)
 	return ex_key_values;
 }
 
+static string Trimmed(const string &str) {
+	const string whitespace {" \t\r\n"};
+	auto start = str.find_first_not_of(whitespace);
+	if (start == string::npos) {
+		return "";
+	}
+	return str.substr(start, str.find_last_not_of(whitespace) - start + 1);
+}
+
+static expected::ExpectedString ReadFirstLine(const string &file) {
+	auto exp_is = io::OpenIfstream(file);
+	if (!exp_is) {
+		return expected::unexpected(exp_is.error());
+	}
+	auto &is = exp_is.value();
+	string line;
+	errno = 0;
+	getline(is, line);
+	if (is.bad()) {
+		return expected::unexpected(error::Error(
+			generic_category().default_error_condition(errno), "Could not read " + file));
+	}
+	return Trimmed(line);
+}
+
+// Like the default identity script: the address of the Ethernet interface with the lowest index.
+static kvp::ExpectedKeyValuesMap MacIdentity(const IdentitySource &source) {
+	const string net_dir = path::Join(source.sys_dir, "class", "net");
+	string address;
+	long long lowest_index = numeric_limits<long long>::max();
+	error_code ec;
+	for (fs::directory_iterator it {net_dir, ec}, end; !ec && it != end; it.increment(ec)) {
+		const string interface = it->path().filename().string();
+		if (common::StartsWith<string>(interface, "dummy")) {
+			continue;
+		}
+		auto exp_type = ReadFirstLine(path::Join(net_dir, interface, "type"));
+		if (!exp_type || exp_type.value() != kArphrdEther) {
+			continue;
+		}
+		auto exp_index = ReadFirstLine(path::Join(net_dir, interface, "ifindex"));
+		auto exp_address = ReadFirstLine(path::Join(net_dir, interface, "address"));
+		if (!exp_index || !exp_address) {
+			continue;
+		}
+		auto exp_number = common::StringToLongLong(exp_index.value());
+		if (!exp_number || exp_number.value() >= lowest_index) {
+			continue;
+		}
+		lowest_index = exp_number.value();
+		address = exp_address.value();
+	}
+	if (ec) {
+		return expected::unexpected(error::Error(
+			ec.default_error_condition(), "Could not list the network interfaces in " + net_dir));
+	}
+	if (address == "") {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::no_such_device), "No suitable network interface found"));
+	}
+	return kvp::KeyValuesMap {{"mac", {address}}};
+}
+
+static kvp::ExpectedKeyValuesMap DmiSerialIdentity(const IdentitySource &source) {
+	const string file = path::Join(source.sys_dir, "class", "dmi", "id", "product_serial");
+	auto exp_serial = ReadFirstLine(file);
+	if (!exp_serial) {
+		return expected::unexpected(exp_serial.error());
+	}
+	if (exp_serial.value() == "") {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::no_such_device), "No serial number in " + file));
+	}
+	return kvp::KeyValuesMap {{"dmi_serial", {exp_serial.value()}}};
+}
+
+// The name of the endorsement key, which is a hash of its public part, see `tpm2_readpublic`.
+static kvp::ExpectedKeyValuesMap TpmEkIdentity() {
+	procs::Process proc({"tpm2_readpublic", "-c", kTpmEkHandle});
+	auto exp_lines = proc.GenerateLineData();
+	if (!exp_lines) {
+		return expected::unexpected(exp_lines.error().WithContext(
+			"Could not read the endorsement key " + kTpmEkHandle + " from the TPM"));
+	}
+	const string prefix {"name:"};
+	for (const auto &line : exp_lines.value()) {
+		if (common::StartsWith(line, prefix)) {
+			return kvp::KeyValuesMap {{"tpm_ek", {Trimmed(line.substr(prefix.size()))}}};
+		}
+	}
+	return expected::unexpected(error::Error(
+		make_error_condition(errc::no_such_device),
+		"No name of the endorsement key " + kTpmEkHandle + " from tpm2_readpublic"));
+}
+
+static kvp::ExpectedKeyValuesMap MachineIdIdentity(const IdentitySource &source) {
+	auto exp_id = ReadFirstLine(source.machine_id_file);
+	if (!exp_id) {
+		return expected::unexpected(exp_id.error());
+	}
+	// Before the first boot has completed, systemd only writes a placeholder.
+	if (exp_id.value() == "" || exp_id.value() == "uninitialized") {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::no_such_device),
+			"No machine ID in " + source.machine_id_file));
+	}
+	return kvp::KeyValuesMap {{"machine_id", {exp_id.value()}}};
+}
+
+static kvp::ExpectedKeyValuesMap ProviderIdentityData(
+	const string &provider, const IdentitySource &source) {
+	if (provider == kProviderScript) {
+		return GetIdentityData(source.script);
+	} else if (provider == kProviderMac) {
+		return MacIdentity(source);
+	} else if (provider == kProviderDmiSerial) {
+		return DmiSerialIdentity(source);
+	} else if (provider == kProviderTpmEk) {
+		return TpmEkIdentity();
+	} else if (provider == kProviderMachineId) {
+		return MachineIdIdentity(source);
+	}
+	return expected::unexpected(error::Error(
+		make_error_condition(errc::invalid_argument), "Unknown identity provider " + provider));
+}
+
+kvp::ExpectedKeyValuesMap GetIdentityData(const IdentitySource &source) {
+	if (source.providers.empty()) {
+		return GetIdentityData(source.script);
+	}
+
+	kvp::KeyValuesMap identity_data;
+	for (const auto &provider : source.providers) {
+		auto exp_data = ProviderIdentityData(provider, source);
+		if (!exp_data) {
+			return expected::unexpected(exp_data.error().WithContext(
+				"While getting identity data from the " + provider + " provider"));
+		}
+		for (const auto &key_values : exp_data.value()) {
+			auto &values = identity_data[key_values.first];
+			for (const auto &value : key_values.second) {
+				if (find(values.begin(), values.end(), value) == values.end()) {
+					values.push_back(value);
+				}
+			}
+		}
+	}
+	return identity_data;
+}
+
 string DumpIdentityData(const kvp::KeyValuesMap &identity_data) {
 	stringstream top_ss;
 	top_ss << "{";
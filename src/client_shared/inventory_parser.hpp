@@ -15,6 +15,12 @@
 #ifndef MENDER_COMMON_INVENTORY_PARSER_HPP
 #define MENDER_COMMON_INVENTORY_PARSER_HPP
 
+#include <chrono>
+#include <functional>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
 #include <common/key_value_parser.hpp>
 
 namespace mender {
@@ -22,10 +28,24 @@ namespace client_shared {
 namespace inventory_parser {
 
 using namespace std;
+namespace error = mender::common::error;
+namespace events = mender::common::events;
 namespace kvp = mender::common::key_value_parser;
 
 kvp::ExpectedKeyValuesMap GetInventoryData(const string &generators_dir);
 
+using InventoryDataHandler = function<void(kvp::ExpectedKeyValuesMap)>;
+
+// Like `GetInventoryData()`, but runs the scripts one after another without blocking the event
+// loop, so that a slow script doesn't hold back anything else the loop does. A script which takes
+// longer than `script_timeout` is killed, and counts as failed. The handler is always called from
+// the event loop, and isn't called if this returns an error.
+error::Error AsyncGetInventoryData(
+	const string &generators_dir,
+	events::EventLoop &loop,
+	chrono::nanoseconds script_timeout,
+	InventoryDataHandler handler);
+
 } // namespace inventory_parser
 } // namespace client_shared
 } // namespace mender
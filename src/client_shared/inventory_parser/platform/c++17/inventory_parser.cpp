@@ -14,7 +14,10 @@
 
 #include <client_shared/inventory_parser.hpp>
 
+#include <algorithm>
 #include <filesystem>
+#include <memory>
+#include <mutex>
 
 #include <common/expected.hpp>
 #include <common/key_value_parser.hpp>
@@ -33,16 +36,13 @@ namespace log = mender::common::log;
 namespace error = mender::common::error;
 namespace fs = std::filesystem;
 
-kvp::ExpectedKeyValuesMap GetInventoryData(const string &generators_dir) {
-	bool any_success = false;
-	bool any_failure = false;
-	kvp::KeyValuesMap data;
-
+// The executable inventory scripts in the directory, in the order in which they run.
+static expected::expected<vector<string>, error::Error> FindScripts(const string &generators_dir) {
 	vector<string> scripts;
 	try {
 		fs::path dir_path(generators_dir);
 		if (!fs::exists(dir_path)) {
-			return kvp::ExpectedKeyValuesMap(data);
+			return scripts;
 		}
 
 		for (const auto &entry : fs::directory_iterator {dir_path}) {
@@ -70,38 +70,175 @@ kvp::ExpectedKeyValuesMap GetInventoryData(const string &generators_dir) {
 			}
 			scripts.emplace_back(std::move(file_path_str));
 		}
-		std::sort(scripts.begin(), scripts.end());
-
-		for (const auto &script_path : scripts) {
-			procs::Process proc({script_path});
-			auto ex_line_data = proc.GenerateLineData();
-			if (!ex_line_data) {
-				log::Error("'" + script_path + "' failed: " + ex_line_data.error().message);
-				any_failure = true;
-				continue;
-			}
+	} catch (const fs::filesystem_error &e) {
+		return expected::unexpected(
+			error::Error(e.code().default_error_condition(), "Failure while parsing inventory"));
+	}
+	std::sort(scripts.begin(), scripts.end());
+	return scripts;
+}
 
-			auto err = kvp::AddParseKeyValues(data, ex_line_data.value());
-			if (error::NoError != err) {
-				log::Error("Failed to parse data from '" + script_path + "': " + err.message);
-				any_failure = true;
-			} else {
-				any_success = true;
-			}
+namespace {
+
+// What the scripts have given so far.
+struct Collection {
+	kvp::KeyValuesMap data;
+	bool any_success {false};
+	bool any_failure {false};
+
+	void Add(const string &script_path, const procs::ExpectedLineData &ex_line_data) {
+		if (!ex_line_data) {
+			log::Error("'" + script_path + "' failed: " + ex_line_data.error().message);
+			any_failure = true;
+			return;
+		}
+
+		auto err = kvp::AddParseKeyValues(data, ex_line_data.value());
+		if (error::NoError != err) {
+			log::Error("Failed to parse data from '" + script_path + "': " + err.message);
+			any_failure = true;
+		} else {
+			any_success = true;
 		}
+	}
 
+	kvp::ExpectedKeyValuesMap Result(const string &generators_dir) const {
 		if (any_success || !any_failure) {
 			return kvp::ExpectedKeyValuesMap(data);
+		}
+		error::Error error = MakeError(
+			kvp::KeyValueParserErrorCode::NoDataError,
+			"No data successfully read from inventory scripts in '" + generators_dir + "'");
+		return expected::unexpected(error);
+	}
+};
+
+} // namespace
+
+kvp::ExpectedKeyValuesMap GetInventoryData(const string &generators_dir) {
+	auto exp_scripts = FindScripts(generators_dir);
+	if (!exp_scripts) {
+		return expected::unexpected(exp_scripts.error());
+	}
+
+	Collection collection;
+	for (const auto &script_path : exp_scripts.value()) {
+		procs::Process proc({script_path});
+		collection.Add(script_path, proc.GenerateLineData());
+	}
+	return collection.Result(generators_dir);
+}
+
+namespace {
+
+class AsyncCollection : public enable_shared_from_this<AsyncCollection> {
+public:
+	AsyncCollection(
+		const string &generators_dir,
+		vector<string> scripts,
+		events::EventLoop &loop,
+		chrono::nanoseconds script_timeout,
+		InventoryDataHandler handler) :
+		generators_dir_ {generators_dir},
+		scripts_ {std::move(scripts)},
+		loop_ {loop},
+		script_timeout_ {script_timeout},
+		handler_ {handler} {
+	}
+
+	void RunNextScript() {
+		proc_.reset();
+		if (next_script_ >= scripts_.size()) {
+			handler_(collection_.Result(generators_dir_));
+			return;
+		}
+
+		const string script_path = scripts_[next_script_++];
+		output_ = make_shared<Output>();
+		auto output = output_;
+		proc_.reset(new procs::Process({script_path}));
+		auto err = proc_->Start([output](const char *data, size_t size) {
+			// Called from another thread.
+			lock_guard<mutex> lock(output->lock);
+			output->bytes.append(data, size);
+		});
+		if (err == error::NoError) {
+			auto self = shared_from_this();
+			err = proc_->AsyncWait(
+				loop_,
+				[self, script_path](error::Error err) {
+					if (err.code == make_error_condition(errc::timed_out)) {
+						self->proc_->EnsureTerminated();
+					}
+					// Don't destroy the process from within its own handler.
+					self->loop_.Post([self, script_path, err]() {
+						self->ScriptFinished(script_path, err);
+					});
+				},
+				script_timeout_);
+		}
+		if (err != error::NoError) {
+			ScriptFinished(script_path, err);
+		}
+	}
+
+private:
+	struct Output {
+		mutex lock;
+		string bytes;
+	};
+
+	void ScriptFinished(const string &script_path, error::Error err) {
+		if (err != error::NoError) {
+			collection_.Add(script_path, expected::unexpected(err));
 		} else {
-			error::Error error = MakeError(
-				kvp::KeyValueParserErrorCode::NoDataError,
-				"No data successfully read from inventory scripts in '" + generators_dir + "'");
-			return expected::unexpected(error);
+			procs::LineData lines;
+			{
+				lock_guard<mutex> lock(output_->lock);
+				size_t start = 0;
+				while (start < output_->bytes.size()) {
+					auto end = output_->bytes.find('\n', start);
+					if (end == string::npos) {
+						end = output_->bytes.size();
+					}
+					lines.push_back(output_->bytes.substr(start, end - start));
+					start = end + 1;
+				}
+			}
+			collection_.Add(script_path, lines);
 		}
-	} catch (const fs::filesystem_error &e) {
-		return expected::unexpected(
-			error::Error(e.code().default_error_condition(), "Failure while parsing inventory"));
+		RunNextScript();
 	}
+
+	const string generators_dir_;
+	const vector<string> scripts_;
+	events::EventLoop &loop_;
+	const chrono::nanoseconds script_timeout_;
+	InventoryDataHandler handler_;
+
+	size_t next_script_ {0};
+	unique_ptr<procs::Process> proc_;
+	shared_ptr<Output> output_;
+	Collection collection_;
+};
+
+} // namespace
+
+error::Error AsyncGetInventoryData(
+	const string &generators_dir,
+	events::EventLoop &loop,
+	chrono::nanoseconds script_timeout,
+	InventoryDataHandler handler) {
+	auto exp_scripts = FindScripts(generators_dir);
+	if (!exp_scripts) {
+		return exp_scripts.error();
+	}
+
+	// Keeps itself alive through the handlers of the scripts until it is done.
+	auto collection = make_shared<AsyncCollection>(
+		generators_dir, std::move(exp_scripts.value()), loop, script_timeout, handler);
+	loop.Post([collection]() { collection->RunNextScript(); });
+	return error::NoError;
 }
 
 } // namespace inventory_parser
@@ -0,0 +1,88 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_CLIENT_SHARED_SERVER_DISCOVERY_HPP
+#define MENDER_CLIENT_SHARED_SERVER_DISCOVERY_HPP
+
+#include <cstdint>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/http.hpp>
+
+namespace mender {
+namespace client_shared {
+namespace server_discovery {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+namespace http = mender::common::http;
+
+enum ServerDiscoveryErrorCode {
+	NoError = 0,
+	NotFoundError,
+	InvalidDocumentError,
+};
+
+class ServerDiscoveryErrorCategoryClass : public std::error_category {
+public:
+	const char *name() const noexcept override;
+	string message(int code) const override;
+};
+extern const ServerDiscoveryErrorCategoryClass ServerDiscoveryErrorCategory;
+
+error::Error MakeError(ServerDiscoveryErrorCode code, const string &msg);
+
+struct Discovered {
+	// In the order to try them in.
+	vector<string> servers;
+	// PEM, empty if the servers are trusted through the usual CA certificates.
+	string ca_certificate;
+};
+using ExpectedDiscovered = expected::expected<Discovered, error::Error>;
+
+// Parses the document served at the bootstrap URL:
+//
+//     {"servers": ["https://eu.example.com", "https://us.example.com"], "ca_certificate": "..."}
+//
+// `ca_certificate` is optional.
+ExpectedDiscovered ParseBootstrapDocument(const string &document);
+
+// Downloads and parses the document at `url`. Blocks until it is done, or has timed out.
+ExpectedDiscovered FromBootstrapUrl(const string &url, const http::ClientConfig &config);
+
+struct SrvRecord {
+	uint16_t priority;
+	uint16_t weight;
+	uint16_t port;
+	string target;
+};
+
+// Turns SRV records into HTTPS server URLs, ordered by priority, and by weight within the same
+// priority. A target of "." means that there is no such service, and is skipped.
+vector<string> ServersFromSrvRecords(vector<SrvRecord> records);
+
+// Looks up the SRV records of `name` with the system resolver. Blocks until it is done.
+ExpectedDiscovered FromSrvRecord(const string &name);
+
+} // namespace server_discovery
+} // namespace client_shared
+} // namespace mender
+
+#endif // MENDER_CLIENT_SHARED_SERVER_DISCOVERY_HPP
@@ -0,0 +1,246 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <client_shared/server_discovery.hpp>
+
+#include <algorithm>
+#include <chrono>
+#include <string>
+#include <vector>
+
+#include <arpa/nameser.h>
+#include <netinet/in.h>
+#include <resolv.h>
+
+#include <common/common.hpp>
+#include <common/events.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace client_shared {
+namespace server_discovery {
+
+namespace common = mender::common;
+namespace events = mender::common::events;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+
+const chrono::seconds kFetchTimeout {30};
+
+const ServerDiscoveryErrorCategoryClass ServerDiscoveryErrorCategory;
+
+const char *ServerDiscoveryErrorCategoryClass::name() const noexcept {
+	return "ServerDiscoveryErrorCategory";
+}
+
+string ServerDiscoveryErrorCategoryClass::message(int code) const {
+	switch (code) {
+	case NoError:
+		return "Success";
+	case NotFoundError:
+		return "No servers found";
+	case InvalidDocumentError:
+		return "Invalid server discovery document";
+	default:
+		return "Unknown";
+	}
+}
+
+error::Error MakeError(ServerDiscoveryErrorCode code, const string &msg) {
+	return error::Error(error_condition(code, ServerDiscoveryErrorCategory), msg);
+}
+
+ExpectedDiscovered ParseBootstrapDocument(const string &document) {
+	auto exp_json = json::Load(document);
+	if (!exp_json) {
+		return expected::unexpected(MakeError(InvalidDocumentError, exp_json.error().message));
+	}
+	auto exp_servers_json = exp_json.value().Get("servers");
+	if (!exp_servers_json) {
+		return expected::unexpected(MakeError(InvalidDocumentError, "No `servers` given"));
+	}
+	auto exp_servers = json::ToStringVector(exp_servers_json.value());
+	if (!exp_servers) {
+		return expected::unexpected(
+			MakeError(InvalidDocumentError, "`servers` must be a list of URLs"));
+	}
+
+	Discovered discovered;
+	for (const auto &server : exp_servers.value()) {
+		if (!common::StartsWith<string>(server, "https://")
+			&& !common::StartsWith<string>(server, "http://")) {
+			return expected::unexpected(
+				MakeError(InvalidDocumentError, "Not an HTTP(S) URL: " + server));
+		}
+		discovered.servers.push_back(server);
+	}
+	if (discovered.servers.empty()) {
+		return expected::unexpected(MakeError(NotFoundError, "`servers` is empty"));
+	}
+
+	auto exp_ca = json::Get<string>(exp_json.value(), "ca_certificate", json::MissingOk::Yes);
+	if (!exp_ca) {
+		return expected::unexpected(
+			MakeError(InvalidDocumentError, "`ca_certificate` must be a PEM string"));
+	}
+	discovered.ca_certificate = exp_ca.value();
+	return discovered;
+}
+
+ExpectedDiscovered FromBootstrapUrl(const string &url, const http::ClientConfig &config) {
+	events::EventLoop loop;
+	http::Client client {config, loop, "http_client:server_discovery"};
+
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	auto err = req->SetAddress(url);
+	if (err != error::NoError) {
+		return expected::unexpected(err.WithContext("Invalid bootstrap URL"));
+	}
+
+	auto body = make_shared<vector<uint8_t>>();
+	error::Error result;
+	err = client.AsyncCall(
+		req,
+		[&loop, &result, body](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp) {
+				result = exp_resp.error();
+				loop.Stop();
+				return;
+			}
+			auto resp = exp_resp.value();
+			if (resp->GetStatusCode() != http::StatusOK) {
+				result = MakeError(
+					NotFoundError,
+					"Unexpected status code: " + to_string(resp->GetStatusCode()) + " "
+						+ resp->GetStatusMessage());
+				loop.Stop();
+				return;
+			}
+			auto writer = make_shared<io::ByteWriter>(body);
+			writer->SetUnlimited(true);
+			resp->SetBodyWriter(writer);
+		},
+		[&loop, &result](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp && result == error::NoError) {
+				result = exp_resp.error();
+			}
+			loop.Stop();
+		});
+	if (err != error::NoError) {
+		return expected::unexpected(err);
+	}
+
+	events::Timer timeout {loop};
+	timeout.AsyncWait(kFetchTimeout, [&loop, &result, &client](error::Error err) {
+		if (err != error::NoError) {
+			return;
+		}
+		result = MakeError(NotFoundError, "Timed out");
+		client.Cancel();
+		loop.Stop();
+	});
+
+	loop.Run();
+	timeout.Cancel();
+	client.Cancel();
+
+	if (result != error::NoError) {
+		return expected::unexpected(result.WithContext("While fetching the servers from " + url));
+	}
+
+	auto exp_discovered = ParseBootstrapDocument(common::StringFromByteVector(*body));
+	if (!exp_discovered) {
+		return expected::unexpected(exp_discovered.error().WithContext("From " + url));
+	}
+	return exp_discovered;
+}
+
+vector<string> ServersFromSrvRecords(vector<SrvRecord> records) {
+	stable_sort(records.begin(), records.end(), [](const SrvRecord &a, const SrvRecord &b) {
+		if (a.priority != b.priority) {
+			return a.priority < b.priority;
+		}
+		return a.weight > b.weight;
+	});
+
+	vector<string> servers;
+	for (const auto &record : records) {
+		string host = record.target;
+		if (host != "" && host.back() == '.') {
+			host.pop_back();
+		}
+		if (host == "") {
+			continue;
+		}
+		servers.push_back(
+			"https://" + host + (record.port == 443 ? "" : ":" + to_string(record.port)));
+	}
+	return servers;
+}
+
+ExpectedDiscovered FromSrvRecord(const string &name) {
+	vector<unsigned char> answer(NS_MAXMSG);
+	int len = res_query(
+		name.c_str(), ns_c_in, ns_t_srv, answer.data(), static_cast<int>(answer.size()));
+	if (len < 0) {
+		return expected::unexpected(
+			MakeError(NotFoundError, "Could not resolve the SRV record " + name));
+	}
+
+	ns_msg msg;
+	if (ns_initparse(answer.data(), len, &msg) < 0) {
+		return expected::unexpected(
+			MakeError(InvalidDocumentError, "Invalid DNS answer for the SRV record " + name));
+	}
+
+	vector<SrvRecord> records;
+	const int count = ns_msg_count(msg, ns_s_an);
+	for (int i = 0; i < count; i++) {
+		ns_rr rr;
+		if (ns_parserr(&msg, ns_s_an, i, &rr) < 0 || rr.type != ns_t_srv || rr.rdlength < 7) {
+			continue;
+		}
+		const unsigned char *rdata = rr.rdata;
+		char target[NS_MAXDNAME];
+		if (dn_expand(ns_msg_base(msg), ns_msg_end(msg), rdata + 6, target, sizeof(target)) < 0) {
+			continue;
+		}
+		records.push_back(SrvRecord {
+			.priority = static_cast<uint16_t>(ns_get16(rdata)),
+			.weight = static_cast<uint16_t>(ns_get16(rdata + 2)),
+			.port = static_cast<uint16_t>(ns_get16(rdata + 4)),
+			.target = target,
+		});
+	}
+
+	Discovered discovered;
+	discovered.servers = ServersFromSrvRecords(records);
+	if (discovered.servers.empty()) {
+		return expected::unexpected(
+			MakeError(NotFoundError, "No servers in the SRV record " + name));
+	}
+	log::Debug(
+		"Servers from the SRV record " + name + ": "
+		+ common::JoinStrings(discovered.servers, ", "));
+	return discovered;
+}
+
+} // namespace server_discovery
+} // namespace client_shared
+} // namespace mender
@@ -37,6 +37,15 @@ enum CryptoErrorCode {
 	VerificationError,
 };
 
+/** KeyType is the algorithm of the keys generated by `PrivateKey::Generate()`. */
+enum class KeyType {
+	Ed25519,
+	EcdsaP256,
+	Rsa3072,
+};
+
+string KeyTypeName(KeyType key_type);
+
 struct Args {
 	string private_key_path;
 	string private_key_passphrase;
@@ -59,7 +68,10 @@ public:
 	PrivateKey &operator=(const PrivateKey &) = delete;
 
 	static ExpectedPrivateKey Load(const Args &args);
-	static ExpectedPrivateKey Generate();
+	static ExpectedPrivateKey Generate(KeyType key_type = KeyType::Ed25519);
+	// Generates the key inside the PKCS#11 token given by `uri`, where it stays. It can be loaded
+	// with `Load()` afterwards, using the same URI.
+	static ExpectedPrivateKey GenerateInToken(const string &uri);
 	error::Error SaveToPEM(const string &private_key_path);
 
 #ifdef MENDER_CRYPTO_OPENSSL
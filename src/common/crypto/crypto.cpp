@@ -14,6 +14,7 @@
 
 #include <common/crypto.hpp>
 
+#include <cassert>
 #include <string>
 
 namespace mender {
@@ -46,6 +47,21 @@ error::Error MakeError(CryptoErrorCode code, const string &msg) {
 	return error::Error(error_condition(code, CryptoErrorCategory), msg);
 }
 
+string KeyTypeName(KeyType key_type) {
+	switch (key_type) {
+	case KeyType::Ed25519:
+		return "ED25519";
+	case KeyType::EcdsaP256:
+		return "EC P-256";
+	case KeyType::Rsa3072:
+		return "RSA 3072";
+	}
+	// Don't use "default" case. This should generate a warning if we ever add any enums. But
+	// still assert here for safety.
+	assert(false);
+	return "Unknown";
+}
+
 } // namespace crypto
 } // namespace common
 } // namespace mender
@@ -23,12 +23,15 @@
 #include <memory>
 
 #include <openssl/bn.h>
+#include <openssl/ec.h>
 #include <openssl/ecdsa.h>
 #include <openssl/err.h>
 #include <openssl/engine.h>
 #include <openssl/ui.h>
 #include <openssl/ssl.h>
 #ifndef MENDER_CRYPTO_OPENSSL_LEGACY
+#include <openssl/core_names.h>
+#include <openssl/params.h>
 #include <openssl/provider.h>
 #include <openssl/store.h>
 #endif // MENDER_CRYPTO_OPENSSL_LEGACY
@@ -281,7 +284,7 @@ ExpectedPrivateKey LoadFrom(const Args &args) {
 }
 #endif // ndef MENDER_CRYPTO_OPENSSL_LEGACY
 
-ExpectedPrivateKey PrivateKey::Load(const Args &args) {
+static void InitOpenSSL() {
 	// Numerous internal OpenSSL functions call OPENSSL_init_ssl().
 	// Therefore, in order to perform nondefault initialisation,
 	// OPENSSL_init_ssl() MUST be called by application code prior to any other OpenSSL function
@@ -293,6 +296,10 @@ ExpectedPrivateKey PrivateKey::Load(const Args &args) {
 	if (CONF_modules_load_file(nullptr, nullptr, 0) != OPENSSL_SUCCESS) {
 		log::Warning("Failed to load OpenSSL configuration file: " + GetOpenSSLErrorMessage());
 	}
+}
+
+ExpectedPrivateKey PrivateKey::Load(const Args &args) {
+	InitOpenSSL();
 
 	log::Trace("Loading private key");
 	if (args.ssl_engine != "") {
@@ -315,14 +322,32 @@ ExpectedPrivateKey PrivateKey::Load(const Args &args) {
 	return LoadFrom(args);
 }
 
-ExpectedPrivateKey PrivateKey::Generate() {
+ExpectedPrivateKey PrivateKey::Generate(KeyType key_type) {
 #ifdef MENDER_CRYPTO_OPENSSL_LEGACY
+	int key_id {EVP_PKEY_ED25519};
+	if (key_type == KeyType::EcdsaP256) {
+		key_id = EVP_PKEY_EC;
+	} else if (key_type == KeyType::Rsa3072) {
+		key_id = EVP_PKEY_RSA;
+	}
 	auto pkey_gen_ctx = unique_ptr<EVP_PKEY_CTX, void (*)(EVP_PKEY_CTX *)>(
-		EVP_PKEY_CTX_new_id(EVP_PKEY_ED25519, nullptr), pkey_ctx_free_func);
+		EVP_PKEY_CTX_new_id(key_id, nullptr), pkey_ctx_free_func);
 #else
+	const char *key_name {"ED25519"};
+	if (key_type == KeyType::EcdsaP256) {
+		key_name = "EC";
+	} else if (key_type == KeyType::Rsa3072) {
+		key_name = "RSA";
+	}
 	auto pkey_gen_ctx = unique_ptr<EVP_PKEY_CTX, void (*)(EVP_PKEY_CTX *)>(
-		EVP_PKEY_CTX_new_from_name(nullptr, "ED25519", nullptr), pkey_ctx_free_func);
+		EVP_PKEY_CTX_new_from_name(nullptr, key_name, nullptr), pkey_ctx_free_func);
 #endif // MENDER_CRYPTO_OPENSSL_LEGACY
+	if (pkey_gen_ctx == nullptr) {
+		return expected::unexpected(MakeError(
+			SetupError,
+			"Failed to generate a private key. No " + KeyTypeName(key_type)
+				+ " support: " + GetOpenSSLErrorMessage()));
+	}
 
 	int ret = EVP_PKEY_keygen_init(pkey_gen_ctx.get());
 	if (ret != OPENSSL_SUCCESS) {
@@ -331,6 +356,16 @@ ExpectedPrivateKey PrivateKey::Generate() {
 			"Failed to generate a private key. Initialization failed: "
 				+ GetOpenSSLErrorMessage()));
 	}
+	if (key_type == KeyType::EcdsaP256) {
+		ret = EVP_PKEY_CTX_set_ec_paramgen_curve_nid(pkey_gen_ctx.get(), NID_X9_62_prime256v1);
+	} else if (key_type == KeyType::Rsa3072) {
+		ret = EVP_PKEY_CTX_set_rsa_keygen_bits(pkey_gen_ctx.get(), 3072);
+	}
+	if (ret <= 0) {
+		return expected::unexpected(MakeError(
+			SetupError,
+			"Failed to generate a private key. Invalid parameters: " + GetOpenSSLErrorMessage()));
+	}
 	EVP_PKEY *pkey = nullptr;
 #ifdef MENDER_CRYPTO_OPENSSL_LEGACY
 	ret = EVP_PKEY_keygen(pkey_gen_ctx.get(), &pkey);
@@ -347,6 +382,65 @@ ExpectedPrivateKey PrivateKey::Generate() {
 	return std::make_unique<PrivateKey>(std::move(private_key));
 }
 
+#ifdef MENDER_CRYPTO_OPENSSL_LEGACY
+ExpectedPrivateKey PrivateKey::GenerateInToken(const string &) {
+	return expected::unexpected(MakeError(
+		SetupError, "Generating keys in a PKCS#11 token requires OpenSSL 3 or later"));
+}
+#else
+ExpectedPrivateKey PrivateKey::GenerateInToken(const string &uri) {
+	InitOpenSSL();
+
+	// Key generation in a token is only possible through the pkcs11 provider, which must be
+	// configured in the OpenSSL configuration file. The parameters below are its own.
+	auto pkey_gen_ctx = unique_ptr<EVP_PKEY_CTX, void (*)(EVP_PKEY_CTX *)>(
+		EVP_PKEY_CTX_new_from_name(nullptr, "EC", "provider=pkcs11"), pkey_ctx_free_func);
+	if (pkey_gen_ctx == nullptr) {
+		return expected::unexpected(MakeError(
+			SetupError,
+			"Failed to generate a private key in the PKCS#11 token. Is the pkcs11 provider"
+			" configured? " + GetOpenSSLErrorMessage()));
+	}
+
+	int ret = EVP_PKEY_keygen_init(pkey_gen_ctx.get());
+	if (ret != OPENSSL_SUCCESS) {
+		return expected::unexpected(MakeError(
+			SetupError,
+			"Failed to generate a private key in the PKCS#11 token. Initialization failed: "
+				+ GetOpenSSLErrorMessage()));
+	}
+
+	string uri_param {uri};
+	string usage_param {"digitalSignature"};
+	string group_param {"P-256"};
+	OSSL_PARAM params[] {
+		OSSL_PARAM_construct_utf8_string("pkcs11_uri", uri_param.data(), 0),
+		OSSL_PARAM_construct_utf8_string("pkcs11_key_usage", usage_param.data(), 0),
+		OSSL_PARAM_construct_utf8_string(OSSL_PKEY_PARAM_GROUP_NAME, group_param.data(), 0),
+		OSSL_PARAM_construct_end(),
+	};
+	ret = EVP_PKEY_CTX_set_params(pkey_gen_ctx.get(), params);
+	if (ret != OPENSSL_SUCCESS) {
+		return expected::unexpected(MakeError(
+			SetupError,
+			"Failed to generate a private key in the PKCS#11 token. Invalid parameters: "
+				+ GetOpenSSLErrorMessage()));
+	}
+
+	EVP_PKEY *pkey = nullptr;
+	ret = EVP_PKEY_generate(pkey_gen_ctx.get(), &pkey);
+	if (ret != OPENSSL_SUCCESS) {
+		return expected::unexpected(MakeError(
+			SetupError,
+			"Failed to generate a private key in the PKCS#11 token. Generation failed: "
+				+ GetOpenSSLErrorMessage()));
+	}
+
+	auto private_key = unique_ptr<EVP_PKEY, void (*)(EVP_PKEY *)>(pkey, pkey_free_func);
+	return std::make_unique<PrivateKey>(std::move(private_key));
+}
+#endif // MENDER_CRYPTO_OPENSSL_LEGACY
+
 expected::ExpectedString EncodeBase64(vector<uint8_t> to_encode) {
 	// Predict the len of the decoded for later verification. From man page:
 	// For every 3 bytes of input provided 4 bytes of output
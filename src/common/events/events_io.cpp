@@ -14,6 +14,8 @@
 
 #include <common/events_io.hpp>
 
+#include <algorithm>
+
 namespace mender {
 namespace common {
 namespace events {
@@ -91,6 +93,145 @@ void AsyncWriterFromWriter::Cancel() {
 	}
 }
 
+RateLimitedAsyncReader::RateLimitedAsyncReader(
+	EventLoop &loop, mio::AsyncReaderPtr reader, RateFunction rate) :
+	reader_ {reader},
+	rate_ {rate},
+	timer_ {loop} {
+}
+
+RateLimitedAsyncReader::~RateLimitedAsyncReader() {
+	Cancel();
+}
+
+void RateLimitedAsyncReader::Refill(int64_t rate) {
+	auto now = chrono::steady_clock::now();
+	if (refilled_) {
+		chrono::duration<double> elapsed = now - last_refill_;
+		tokens_ += elapsed.count() * static_cast<double>(rate);
+	}
+	// Don't allow more than one second worth of burst, also when the rate has been lowered.
+	tokens_ = min(tokens_, static_cast<double>(rate));
+	last_refill_ = now;
+	refilled_ = true;
+}
+
+error::Error RateLimitedAsyncReader::AsyncRead(
+	vector<uint8_t>::iterator start, vector<uint8_t>::iterator end, mio::AsyncIoHandler handler) {
+	cancelled_ = make_shared<bool>(false);
+	auto cancelled = cancelled_;
+
+	auto rate = rate_();
+	if (rate <= 0) {
+		// Don't save up tokens while unlimited, or the limit would be exceeded when it becomes
+		// active again.
+		refilled_ = false;
+		tokens_ = 0;
+		return reader_->AsyncRead(start, end, handler);
+	}
+
+	Refill(rate);
+	if (tokens_ < 1) {
+		chrono::microseconds wait {static_cast<int64_t>((1 - tokens_) * 1000000 / rate) + 1};
+		timer_.AsyncWait(wait, [this, cancelled, start, end, handler](error::Error err) {
+			if (*cancelled) {
+				return;
+			}
+			if (err != error::NoError) {
+				handler(expected::unexpected(err));
+				return;
+			}
+			err = AsyncRead(start, end, handler);
+			if (err != error::NoError) {
+				handler(expected::unexpected(err));
+			}
+		});
+		return error::NoError;
+	}
+
+	auto allowed = min(end - start, static_cast<decltype(end - start)>(tokens_));
+	return reader_->AsyncRead(
+		start, start + allowed, [this, cancelled, handler](mio::ExpectedSize result) {
+			if (*cancelled) {
+				return;
+			}
+			if (result) {
+				tokens_ -= static_cast<double>(result.value());
+			}
+			handler(result);
+		});
+}
+
+void RateLimitedAsyncReader::Cancel() {
+	if (cancelled_) {
+		*cancelled_ = true;
+		cancelled_.reset();
+	}
+	timer_.Cancel();
+	reader_->Cancel();
+}
+
+AbortableAsyncReader::AbortableAsyncReader(mio::AsyncReaderPtr reader) :
+	reader_ {reader} {
+}
+
+AbortableAsyncReader::~AbortableAsyncReader() {
+	Cancel();
+}
+
+error::Error AbortableAsyncReader::AsyncRead(
+	vector<uint8_t>::iterator start, vector<uint8_t>::iterator end, mio::AsyncIoHandler handler) {
+	if (aborted_ != error::NoError) {
+		return aborted_;
+	}
+
+	auto pending = make_shared<mio::AsyncIoHandler>(handler);
+	pending_ = pending;
+	auto err = reader_->AsyncRead(start, end, [this, pending](mio::ExpectedSize result) {
+		if (!*pending) {
+			// Aborted or cancelled in the meantime.
+			return;
+		}
+		auto handler = std::move(*pending);
+		*pending = nullptr;
+		if (pending_ == pending) {
+			pending_.reset();
+		}
+		handler(result);
+	});
+	if (err != error::NoError) {
+		*pending = nullptr;
+		pending_.reset();
+	}
+	return err;
+}
+
+void AbortableAsyncReader::Cancel() {
+	if (pending_) {
+		*pending_ = nullptr;
+		pending_.reset();
+	}
+	reader_->Cancel();
+}
+
+void AbortableAsyncReader::Abort(error::Error err) {
+	if (aborted_ != error::NoError) {
+		return;
+	}
+	aborted_ = err;
+
+	mio::AsyncIoHandler handler;
+	if (pending_) {
+		handler = std::move(*pending_);
+		*pending_ = nullptr;
+		pending_.reset();
+	}
+	reader_->Cancel();
+	if (handler) {
+		handler(expected::unexpected(err));
+	}
+}
+
 ReaderFromAsyncReader::ReaderFromAsyncReader(EventLoop &event_loop, mio::AsyncReaderPtr reader) :
 	event_loop_(event_loop),
 	reader_(reader) {
@@ -15,6 +15,8 @@
 #ifndef MENDER_COMMON_IO_UTIL_HPP
 #define MENDER_COMMON_IO_UTIL_HPP
 
+#include <chrono>
+#include <functional>
 #include <memory>
 #include <vector>
 #include <unordered_map>
@@ -125,6 +127,57 @@ private:
 	EventLoop &loop_;
 };
 
+// Limits the rate at which data is read from the wrapped reader, using a token bucket which holds
+// up to one second worth of data. The rate, in bytes per second, is queried before every read, so
+// that it can change while reading. Zero or less means unlimited.
+class RateLimitedAsyncReader : virtual public mio::AsyncReader {
+public:
+	using RateFunction = function<int64_t()>;
+
+	RateLimitedAsyncReader(EventLoop &loop, mio::AsyncReaderPtr reader, RateFunction rate);
+	~RateLimitedAsyncReader();
+
+	error::Error AsyncRead(
+		vector<uint8_t>::iterator start,
+		vector<uint8_t>::iterator end,
+		mio::AsyncIoHandler handler) override;
+	void Cancel() override;
+
+private:
+	void Refill(int64_t rate);
+
+	mio::AsyncReaderPtr reader_;
+	RateFunction rate_;
+	Timer timer_;
+	shared_ptr<bool> cancelled_;
+	double tokens_ {0};
+	chrono::steady_clock::time_point last_refill_;
+	bool refilled_ {false};
+};
+
+// Passes reads through to the wrapped reader, until `Abort` is called. `Abort` cancels the read in
+// progress, if any, and completes it with the given error, and every read after it fails with the
+// same error. This allows stopping a transfer from the outside, for example from a timer, while
+// something else is reading from it.
+class AbortableAsyncReader : virtual public mio::AsyncReader {
+public:
+	explicit AbortableAsyncReader(mio::AsyncReaderPtr reader);
+	~AbortableAsyncReader();
+
+	error::Error AsyncRead(
+		vector<uint8_t>::iterator start,
+		vector<uint8_t>::iterator end,
+		mio::AsyncIoHandler handler) override;
+	void Cancel() override;
+
+	void Abort(error::Error err);
+
+private:
+	mio::AsyncReaderPtr reader_;
+	shared_ptr<mio::AsyncIoHandler> pending_;
+	error::Error aborted_;
+};
+
 using AsyncReaderFromEventLoopFunc = function<mio::ExpectedAsyncReaderPtr(EventLoop &loop)>;
 
 class ReaderFromAsyncReader : virtual public mio::Reader {
@@ -0,0 +1,49 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_COMMON_GZIP_HPP
+#define MENDER_COMMON_GZIP_HPP
+
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/io.hpp>
+
+namespace mender {
+namespace common {
+namespace gzip {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace io = mender::common::io;
+
+// Reads everything from `src`, and writes it to `dst` as one gzip member. Calling this several
+// times with the same `dst` gives a valid gzip file, holding the concatenation of the inputs.
+error::Error Compress(io::Reader &src, io::Writer &dst);
+
+// The reverse of `Compress()`. All the members of the input are decompressed, one after another.
+error::Error Decompress(io::Reader &src, io::Writer &dst);
+
+// Compresses the files into one gzip file at `dst`, which holds their concatenation. `dst` is
+// written as `dst.tmp` first, and renamed when it is complete.
+error::Error CompressFiles(const vector<string> &src_paths, const string &dst);
+
+} // namespace gzip
+} // namespace common
+} // namespace mender
+
+#endif // MENDER_COMMON_GZIP_HPP
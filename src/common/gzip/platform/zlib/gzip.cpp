@@ -0,0 +1,206 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <common/gzip.hpp>
+
+#include <zlib.h>
+
+#include <common/config.h>
+#include <common/path.hpp>
+
+namespace mender {
+namespace common {
+namespace gzip {
+
+namespace path = mender::common::path;
+
+// 15 bits of window, plus 16 for a gzip header and trailer rather than zlib ones.
+static const int kWindowBits = 15 + 16;
+
+static error::Error ZlibError(const z_stream &stream, int ret, const string &context) {
+	string message = context + ": ";
+	if (stream.msg != nullptr) {
+		message += stream.msg;
+	} else {
+		message += "zlib error " + to_string(ret);
+	}
+	return error::Error(make_error_condition(errc::io_error), message);
+}
+
+static error::Error WriteAll(io::Writer &dst, const vector<uint8_t> &buffer, size_t size) {
+	if (size == 0) {
+		return error::NoError;
+	}
+	auto exp_written = dst.Write(buffer.cbegin(), buffer.cbegin() + size);
+	if (!exp_written) {
+		return exp_written.error();
+	}
+	if (exp_written.value() != size) {
+		return error::Error(make_error_condition(errc::io_error), "Short write of gzip data");
+	}
+	return error::NoError;
+}
+
+// `deflateInit2` and `inflateInit2` are macros containing C style casts, which expand here, not
+// in the zlib header, so disable the warning for them.
+#ifdef __clang__
+#pragma clang diagnostic push
+#pragma clang diagnostic ignored "-Wold-style-cast"
+#else
+#pragma GCC diagnostic push
+#pragma GCC diagnostic ignored "-Wold-style-cast"
+#endif
+static int DeflateInit(z_stream &stream) {
+	return deflateInit2(
+		&stream, Z_DEFAULT_COMPRESSION, Z_DEFLATED, kWindowBits, 8, Z_DEFAULT_STRATEGY);
+}
+
+static int InflateInit(z_stream &stream) {
+	return inflateInit2(&stream, kWindowBits);
+}
+#ifdef __clang__
+#pragma clang diagnostic pop
+#else
+#pragma GCC diagnostic pop
+#endif
+
+error::Error Compress(io::Reader &src, io::Writer &dst) {
+	z_stream stream {};
+	int ret = DeflateInit(stream);
+	if (ret != Z_OK) {
+		return ZlibError(stream, ret, "Could not initialize gzip compression");
+	}
+
+	vector<uint8_t> in(MENDER_BUFSIZE);
+	vector<uint8_t> out(MENDER_BUFSIZE);
+	error::Error err;
+	int flush = Z_NO_FLUSH;
+	while (err == error::NoError && flush != Z_FINISH) {
+		auto exp_read = src.Read(in.begin(), in.end());
+		if (!exp_read) {
+			err = exp_read.error();
+			break;
+		}
+		if (exp_read.value() == 0) {
+			flush = Z_FINISH;
+		}
+		stream.next_in = in.data();
+		stream.avail_in = static_cast<uInt>(exp_read.value());
+
+		// Keep going until deflate has room left in the output, then it has taken all the input.
+		do {
+			stream.next_out = out.data();
+			stream.avail_out = static_cast<uInt>(out.size());
+			ret = deflate(&stream, flush);
+			if (ret == Z_STREAM_ERROR) {
+				err = ZlibError(stream, ret, "Could not compress");
+				break;
+			}
+			err = WriteAll(dst, out, out.size() - stream.avail_out);
+		} while (err == error::NoError && stream.avail_out == 0);
+	}
+
+	deflateEnd(&stream);
+	return err;
+}
+
+error::Error Decompress(io::Reader &src, io::Writer &dst) {
+	z_stream stream {};
+	int ret = InflateInit(stream);
+	if (ret != Z_OK) {
+		return ZlibError(stream, ret, "Could not initialize gzip decompression");
+	}
+
+	vector<uint8_t> in(MENDER_BUFSIZE);
+	vector<uint8_t> out(MENDER_BUFSIZE);
+	error::Error err;
+	bool member_complete {false};
+	while (err == error::NoError) {
+		auto exp_read = src.Read(in.begin(), in.end());
+		if (!exp_read) {
+			err = exp_read.error();
+			break;
+		}
+		if (exp_read.value() == 0) {
+			if (!member_complete) {
+				err = error::Error(
+					make_error_condition(errc::io_error), "Could not decompress: Truncated data");
+			}
+			break;
+		}
+		stream.next_in = in.data();
+		stream.avail_in = static_cast<uInt>(exp_read.value());
+
+		do {
+			stream.next_out = out.data();
+			stream.avail_out = static_cast<uInt>(out.size());
+			ret = inflate(&stream, Z_NO_FLUSH);
+			if (ret == Z_BUF_ERROR && stream.avail_in == 0) {
+				// Nothing more to do until there is more input.
+				break;
+			}
+			if (ret != Z_OK && ret != Z_STREAM_END) {
+				err = ZlibError(stream, ret, "Could not decompress");
+				break;
+			}
+			err = WriteAll(dst, out, out.size() - stream.avail_out);
+			member_complete = ret == Z_STREAM_END;
+			if (member_complete) {
+				// There may be another member after this one.
+				inflateReset(&stream);
+			}
+		} while (err == error::NoError && (stream.avail_in > 0 || stream.avail_out == 0));
+	}
+
+	inflateEnd(&stream);
+	return err;
+}
+
+error::Error CompressFiles(const vector<string> &src_paths, const string &dst) {
+	const string tmp_path = dst + ".tmp";
+	auto exp_os = io::OpenOfstream(tmp_path);
+	if (!exp_os) {
+		return exp_os.error();
+	}
+	auto &os = exp_os.value();
+
+	io::StreamWriter writer {os};
+	error::Error err;
+	for (const auto &src_path : src_paths) {
+		io::FileReader reader {src_path};
+		err = Compress(reader, writer);
+		if (err != error::NoError) {
+			err = err.WithContext("Could not compress '" + src_path + "'");
+			break;
+		}
+	}
+	if (err == error::NoError) {
+		os.close();
+		if (!os) {
+			err = error::Error(
+				make_error_condition(errc::io_error), "Could not write '" + tmp_path + "'");
+		}
+	}
+	if (err != error::NoError) {
+		path::FileDelete(tmp_path);
+		return err;
+	}
+
+	return path::Rename(tmp_path, dst);
+}
+
+} // namespace gzip
+} // namespace common
+} // namespace mender
@@ -15,6 +15,7 @@
 #ifndef MENDER_COMMON_HTTP_HPP
 #define MENDER_COMMON_HTTP_HPP
 
+#include <chrono>
 #include <functional>
 #include <string>
 #include <memory>
@@ -121,6 +122,7 @@ enum StatusCode {
 	StatusNotFound = 404,
 	StatusConflict = 409,
 	StatusRequestBodyTooLarge = 413,
+	StatusUnsupportedMediaType = 415,
 	StatusTooManyRequests = 429,
 
 	StatusInternalServerError = 500,
@@ -413,6 +415,98 @@ class BodyAsyncReader;
 
 
 
+// For links which lose large packets, such as cellular links where path MTU discovery is broken,
+// so that connections stall. Zero means the default.
+struct LinkTuning {
+	// Announced to the server when connecting, so that it sends smaller TCP segments.
+	int tcp_max_segment_size {0};
+	// TLS maximum fragment length (RFC 6066) to negotiate: 512, 1024, 2048 or 4096. The server may
+	// ignore it.
+	int tls_max_fragment_length {0};
+	// Largest part of a response body to read from the connection at a time.
+	size_t read_buffer_size {0};
+	// How long the TLS handshake and each read of a response body may go without receiving
+	// anything. By default the handshake has no limit of its own, and reads have 5 minutes.
+	chrono::seconds stall_timeout {0};
+};
+
+// For example "TCP MSS 536, TLS max fragment length 1024", or "default settings".
+string LinkTuningToString(const LinkTuning &tuning);
+
+// Keeps the connection open after a request, and uses it again for the next request to the same
+// host, port and proxy, instead of connecting and doing the TLS handshake again. The connection is
+// closed when the server asks for it, or when the response isn't read to the end.
+struct KeepAlive {
+	bool enabled {false};
+	// How long the connection may stay unused before it is closed.
+	chrono::seconds idle_timeout {60};
+};
+
+// Networks on which the TLS connections are intercepted, see `CertificatePinning`.
+struct PinningException {
+	// Network interfaces which the connections go out on.
+	vector<string> interfaces;
+	// Wi-Fi networks which the interface of the connection is connected to. Only known on Linux.
+	vector<string> ssids;
+	// PEM file with the certificates of the intercepting CA.
+	string trusted_cert_path;
+};
+
+// Public keys which the servers must have. For the hosts in `hosts`, a certificate of the verified
+// chain must have one of the keys, given as the base64 encoded SHA-256 hash of its
+// SubjectPublicKeyInfo. On the networks of an exception, its CA is trusted for all hosts, and
+// stands in for the pinned keys. Does nothing with `skip_verify`.
+struct CertificatePinning {
+	// The host names are in lower case.
+	unordered_map<string, vector<string>> hosts;
+	vector<PinningException> exceptions;
+};
+
+// What is known about one request and its connection, for `ClientConfig::connection_recorder`.
+// Only the host and port are kept of the URL, since the path and the query may hold credentials,
+// such as in pre-signed URLs.
+struct ConnectionRecord {
+	// Seconds since the epoch, when the request was started.
+	int64_t timestamp {0};
+	string method;
+	string host;
+	int port {0};
+	// Whether the connection went through a proxy. `host` and `port` are still the ones of the
+	// request.
+	bool proxy {false};
+	// The address which the connection was made to, empty if it never got that far.
+	string address;
+
+	// Milliseconds since the request was started, or -1 if it never got there.
+	int64_t resolved_ms {-1};
+	int64_t connected_ms {-1};
+	int64_t tls_handshake_ms {-1};
+	int64_t response_ms {-1};
+	int64_t total_ms {-1};
+
+	// Of the TLS connection to the server, also if it goes through an HTTPS proxy.
+	string tls_version;
+	string tls_cipher;
+
+	// On the HTTP level, headers included.
+	uint64_t bytes_sent {0};
+	uint64_t bytes_received {0};
+
+	unsigned status_code {0};
+	string error;
+
+	// From TCP_INFO when the connection is closed, on the platforms which have it.
+	bool has_tcp_info {false};
+	uint32_t rtt_us {0};
+	uint32_t rtt_var_us {0};
+	uint32_t retransmits {0};
+	uint32_t total_retransmits {0};
+	uint32_t lost {0};
+	uint32_t send_congestion_window {0};
+	uint32_t send_mss {0};
+	uint32_t path_mtu {0};
+};
+
 // Master object that connections are made from. Configure TLS options on this object before making
 // connections.
 struct ClientConfig {
@@ -428,14 +522,36 @@ struct ClientConfig {
 	string http_proxy;
 	string https_proxy;
 	string no_proxy;
+	// Chooses the proxy for each request instead of the three settings above, for example
+	// according to a PAC file. Gets the scheme, host and port of the request as a URL, and returns
+	// the URL of the proxy, or an empty string to connect directly. If it fails, the settings above
+	// are used.
+	function<expected::ExpectedString(const string &url)> proxy_resolver;
 	string ssl_engine;
 
+	// Called when a request is over, whether it succeeded or not, for diagnosing network issues.
+	// Must not make any requests with the same client.
+	function<void(const ConnectionRecord &record)> connection_recorder;
+
+	// Sent as the User-Agent of every request. "Mender/<version>" if empty.
+	string user_agent;
+	// Added to the requests to the Mender server API: by `api::HTTPClient`, to the authentication
+	// request and to the requests forwarded by mender-auth. Not added to other requests, such as
+	// Artifact downloads, which may go to third party storage.
+	unordered_map<string, string> api_headers;
+
 	// Similar to skip_verify, provide default value, while keeping ClientConfig
 	// a POD type, allowing named initalizer lists in C++11
 	common::def_value<
 		int,
 		mender::client_shared::config_parser::MenderConfigFromFile::kRetry_download_count_default>
 		retry_download_count;
+
+	LinkTuning link_tuning;
+
+	KeepAlive keep_alive;
+
+	CertificatePinning certificate_pinning;
 };
 
 enum class TransactionStatus {
@@ -501,6 +617,16 @@ public:
 		return *this;
 	};
 
+	const ClientConfig &GetConfig() const {
+		return client_config_;
+	}
+
+	// Meant to be changed between requests. The TCP and TLS settings only apply to new
+	// connections.
+	void SetLinkTuning(const LinkTuning &tuning) {
+		client_config_.link_tuning = tuning;
+	}
+
 protected:
 	events::EventLoop &event_loop_;
 	string logger_name_;
@@ -537,6 +663,9 @@ private:
 #ifdef MENDER_USE_BOOST_BEAST
 
 	bool initialized_ {false};
+	// Modification times of the certificate files when they were loaded, see
+	// `CertificateFiles()`.
+	vector<int64_t> certificate_write_times_;
 
 #define MENDER_BOOST_BEAST_SSL_CTX_COUNT 2
 
@@ -552,6 +681,14 @@ private:
 
 	asio::ip::tcp::resolver::results_type resolver_results_;
 
+	// The scheme, host and port of the request, and of the proxy it goes through, if any. The
+	// connection left open by the previous request is only used again for the same ones.
+	string connection_key_;
+	// Not empty while `stream_` is kept open after a request, see `ClientConfig::keep_alive`.
+	string idle_connection_key_;
+	SocketMode idle_socket_mode_;
+	events::Timer idle_timer_;
+
 	// The reason that these are inside a struct is a bit complicated. We need to deal with what
 	// may be a bug in Boost Beast: Parsers and serializers can access the corresponding request
 	// and response structures even after they have been cancelled. This means two things:
@@ -588,8 +725,27 @@ private:
 	// request.
 	OutgoingRequestPtr secondary_req_;
 
+	// Only while a request is ongoing, and `connection_recorder` is set.
+	unique_ptr<ConnectionRecord> connection_record_;
+	chrono::steady_clock::time_point connection_record_start_;
+
+	// For each exception of `ClientConfig::certificate_pinning`, the certificates to verify the
+	// servers with on its networks, and the pins of its CA.
+	struct PinningExceptionTrust {
+		shared_ptr<X509_STORE> store;
+		vector<string> pins;
+	};
+	vector<PinningExceptionTrust> pinning_exceptions_;
+
 	error::Error Initialize();
+	error::Error LoadPinningExceptions();
+	const PinningExceptionTrust *MatchingPinningException();
+	vector<string> CertificateFiles() const;
+	vector<int64_t> CertificateWriteTimes() const;
 	void DoCancel();
+	void FinishRequest();
+	bool ReuseIdleConnection();
+	void CloseIdleConnection();
 
 	void CallHandler(ResponseHandler handler);
 	void CallErrorHandler(
@@ -598,7 +754,10 @@ private:
 		const error::Error &err, const OutgoingRequestPtr &req, ResponseHandler handler);
 	error::Error HandleProxySetup();
 	void ResolveHandler(const error_code &ec, const asio::ip::tcp::resolver::results_type &results);
+	void ConnectWithTuning(asio::ip::tcp::resolver::results_type::const_iterator endpoint_iter);
+	void ConnectedHandler(const error_code &ec, const asio::ip::tcp::endpoint &endpoint);
 	void ConnectHandler(const error_code &ec, const asio::ip::tcp::endpoint &endpoint);
+	void WriteHeader();
 	template <typename StreamType>
 	void HandshakeHandler(
 		StreamType &stream, const error_code &ec, const asio::ip::tcp::endpoint &endpoint);
@@ -613,6 +772,9 @@ private:
 	void AsyncReadNextBodyPart(
 		vector<uint8_t>::iterator start, vector<uint8_t>::iterator end, io::AsyncIoHandler handler);
 	void ReadBodyHandler(error_code ec, size_t num_read);
+	void StartConnectionRecord(const OutgoingRequest &req);
+	int64_t ConnectionRecordElapsedMs() const;
+	void FinishConnectionRecord();
 #endif // MENDER_USE_BOOST_BEAST
 
 	friend class IncomingResponse;
@@ -831,6 +993,23 @@ public:
 		}
 	}
 
+	// What the interval is multiplied by after every three tries, at least 1.
+	double Factor() const {
+		return factor_;
+	}
+	void SetFactor(double factor) {
+		factor_ = factor < 1.0 ? 1.0 : factor;
+	}
+
+	// Fraction of the interval, from 0 to 1, by which each one is randomly made shorter or
+	// longer, so that many devices which failed at the same time don't all retry together.
+	double Jitter() const {
+		return jitter_;
+	}
+	void SetJitter(double jitter) {
+		jitter_ = jitter < 0.0 ? 0.0 : (jitter > 1.0 ? 1.0 : jitter);
+	}
+
 	using ExpectedInterval = expected::expected<chrono::milliseconds, error::Error>;
 	ExpectedInterval NextInterval();
 
@@ -847,6 +1026,8 @@ private:
 	chrono::milliseconds smallest_interval_ {chrono::minutes(1)};
 	chrono::milliseconds max_interval_;
 	int try_count_;
+	double factor_ {2.0};
+	double jitter_ {0.0};
 
 	int iteration_ {0};
 };
@@ -19,6 +19,7 @@
 #include <cstdlib>
 #include <ctime>
 #include <iomanip>
+#include <random>
 #include <string>
 
 #include <common/common.hpp>
@@ -463,14 +464,15 @@ ExponentialBackoff::ExpectedInterval ExponentialBackoff::NextInterval() {
 	}
 
 	chrono::milliseconds current_interval = smallest_interval_;
-	// Backoff algorithm: Each interval is returned three times, then it's doubled, and then
-	// that is returned three times, and so on. But if interval is ever higher than the max
-	// interval, then return the max interval instead, and once that is returned three times,
-	// produce MaxRetryError. If try_count_ is set, then that controls the total number of
-	// retries, but the rest is the same, so then it simply "gets stuck" at max interval for
-	// many iterations.
+	// Backoff algorithm: Each interval is returned three times, then it's multiplied by the
+	// factor (doubled by default), and then that is returned three times, and so on. But if
+	// interval is ever higher than the max interval, then return the max interval instead, and
+	// once that is returned three times, produce MaxRetryError. If try_count_ is set, then that
+	// controls the total number of retries, but the rest is the same, so then it simply "gets
+	// stuck" at max interval for many iterations.
 	for (int count = 3; count < iteration_; count += 3) {
-		auto new_interval = current_interval * 2;
+		auto new_interval = chrono::milliseconds(static_cast<chrono::milliseconds::rep>(
+			static_cast<double>(current_interval.count()) * factor_));
 		if (new_interval > max_interval_) {
 			new_interval = max_interval_;
 		}
@@ -480,6 +482,18 @@ ExponentialBackoff::ExpectedInterval ExponentialBackoff::NextInterval() {
 		current_interval = new_interval;
 	}
 
+	if (jitter_ > 0.0) {
+		// Only the returned interval is randomized, the backoff itself stays the same. The max
+		// interval is a hard ceiling, also for the randomized ones.
+		static mt19937 jitter_random {random_device {}()};
+		uniform_real_distribution<double> jitter_distribution(1.0 - jitter_, 1.0 + jitter_);
+		current_interval = chrono::milliseconds(static_cast<chrono::milliseconds::rep>(
+			static_cast<double>(current_interval.count()) * jitter_distribution(jitter_random)));
+		if (current_interval > max_interval_) {
+			current_interval = max_interval_;
+		}
+	}
+
 	return current_interval;
 }
 
@@ -508,6 +522,26 @@ static expected::ExpectedString GetProxyStringFromEnvironment(
 	}
 }
 
+string LinkTuningToString(const LinkTuning &tuning) {
+	vector<string> settings;
+	if (tuning.tcp_max_segment_size > 0) {
+		settings.push_back("TCP MSS " + to_string(tuning.tcp_max_segment_size));
+	}
+	if (tuning.tls_max_fragment_length > 0) {
+		settings.push_back("TLS max fragment length " + to_string(tuning.tls_max_fragment_length));
+	}
+	if (tuning.read_buffer_size > 0) {
+		settings.push_back("read buffer " + to_string(tuning.read_buffer_size));
+	}
+	if (tuning.stall_timeout.count() > 0) {
+		settings.push_back("stall timeout " + to_string(tuning.stall_timeout.count()) + "s");
+	}
+	if (settings.empty()) {
+		return "default settings";
+	}
+	return common::JoinStrings(settings, ", ");
+}
+
 // The proxy variables aren't standardized, but this page was useful for the common patterns:
 // https://superuser.com/questions/944958/are-http-proxy-https-proxy-and-no-proxy-environment-variables-standard
 expected::ExpectedString GetHttpProxyStringFromEnvironment() {
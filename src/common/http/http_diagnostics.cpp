@@ -0,0 +1,144 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/http_diagnostics.hpp>
+
+#include <deque>
+#include <fstream>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace common {
+namespace http {
+namespace diagnostics {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+static string JsonString(const string &value) {
+	return "\"" + json::EscapeString(value) + "\"";
+}
+
+string RecordJson(const http::ConnectionRecord &record, int64_t skipped) {
+	string json = R"({"timestamp":)" + to_string(record.timestamp);
+	json += R"(,"method":)" + JsonString(record.method);
+	json += R"(,"host":)" + JsonString(record.host);
+	json += R"(,"port":)" + to_string(record.port);
+	json += R"(,"proxy":)" + string(record.proxy ? "true" : "false");
+	json += R"(,"address":)" + JsonString(record.address);
+	json += R"(,"resolved_ms":)" + to_string(record.resolved_ms);
+	json += R"(,"connected_ms":)" + to_string(record.connected_ms);
+	json += R"(,"tls_handshake_ms":)" + to_string(record.tls_handshake_ms);
+	json += R"(,"response_ms":)" + to_string(record.response_ms);
+	json += R"(,"total_ms":)" + to_string(record.total_ms);
+	if (record.tls_version != "") {
+		json += R"(,"tls_version":)" + JsonString(record.tls_version);
+		json += R"(,"tls_cipher":)" + JsonString(record.tls_cipher);
+	}
+	json += R"(,"bytes_sent":)" + to_string(record.bytes_sent);
+	json += R"(,"bytes_received":)" + to_string(record.bytes_received);
+	json += R"(,"status_code":)" + to_string(record.status_code);
+	if (record.error != "") {
+		json += R"(,"error":)" + JsonString(record.error);
+	}
+	if (record.has_tcp_info) {
+		json += R"(,"tcp":{"rtt_us":)" + to_string(record.rtt_us);
+		json += R"(,"rtt_var_us":)" + to_string(record.rtt_var_us);
+		json += R"(,"retransmits":)" + to_string(record.retransmits);
+		json += R"(,"total_retransmits":)" + to_string(record.total_retransmits);
+		json += R"(,"lost":)" + to_string(record.lost);
+		json += R"(,"send_congestion_window":)" + to_string(record.send_congestion_window);
+		json += R"(,"send_mss":)" + to_string(record.send_mss);
+		json += R"(,"path_mtu":)" + to_string(record.path_mtu) + "}";
+	}
+	if (skipped > 0) {
+		json += R"(,"skipped":)" + to_string(skipped);
+	}
+	json += "}";
+	return json;
+}
+
+Recorder::Recorder(const string &path, size_t max_records, int max_records_per_minute) :
+	path_ {path},
+	max_records_ {max_records},
+	max_records_per_minute_ {max_records_per_minute},
+	window_start_ {chrono::steady_clock::now()} {
+}
+
+void Recorder::Add(const http::ConnectionRecord &record) {
+	auto now = chrono::steady_clock::now();
+	if (now - window_start_ >= chrono::minutes {1}) {
+		window_start_ = now;
+		records_in_window_ = 0;
+	}
+	if (records_in_window_ >= max_records_per_minute_) {
+		skipped_++;
+		return;
+	}
+	records_in_window_++;
+
+	auto err = Write(RecordJson(record, skipped_));
+	if (err != error::NoError) {
+		log::Warning("Could not record the connection diagnostics: " + err.String());
+		return;
+	}
+	skipped_ = 0;
+}
+
+error::Error Recorder::Write(const string &line) {
+	deque<string> lines;
+	ifstream records_file(path_);
+	string existing;
+	while (getline(records_file, existing)) {
+		if (existing != "") {
+			lines.push_back(existing);
+		}
+	}
+	records_file.close();
+
+	lines.push_back(line);
+	while (lines.size() > max_records_) {
+		lines.pop_front();
+	}
+
+	string content;
+	for (const auto &l : lines) {
+		content += l + "\n";
+	}
+
+	// Replaced in one go, so that whoever collects the file never sees a partial one.
+	const string tmp_path = path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, path_);
+}
+
+} // namespace diagnostics
+} // namespace http
+} // namespace common
+} // namespace mender
@@ -0,0 +1,266 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/http_pac.hpp>
+
+#include <fstream>
+#include <sstream>
+
+#include <unistd.h>
+
+#include <common/common.hpp>
+#include <common/events.hpp>
+#include <common/io.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+#include <common/processes.hpp>
+
+namespace mender {
+namespace common {
+namespace http {
+namespace pac {
+
+namespace common = mender::common;
+namespace events = mender::common::events;
+namespace io = mender::common::io;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+namespace processes = mender::common::processes;
+
+const string kFileUrlPrefix {"file://"};
+
+const chrono::hours kRefreshInterval {1};
+// Shorter, so that a PAC file is found soon after the network comes up.
+const chrono::minutes kRetryInterval {1};
+const chrono::seconds kDownloadTimeout {30};
+const chrono::seconds kEvaluationTimeout {10};
+
+Resolver::Resolver(const ResolverConfig &config, const http::ClientConfig &fetch_config) :
+	config_ {config},
+	fetch_config_ {fetch_config} {
+	// PAC files are served on the local network, and the proxies they name may not even be
+	// reachable before it's known which one to use.
+	fetch_config_.http_proxy = "";
+	fetch_config_.https_proxy = "";
+	fetch_config_.proxy_resolver = nullptr;
+}
+
+expected::ExpectedString Resolver::Resolve(const string &url) {
+	BrokenDownUrl address;
+	auto err = BreakDownUrl(url, address);
+	if (err != error::NoError) {
+		return expected::unexpected(err);
+	}
+	const string origin =
+		address.protocol + "://" + address.host + ":" + to_string(address.port) + "/";
+
+	err = Refresh();
+	if (err != error::NoError) {
+		return expected::unexpected(err);
+	}
+
+	auto known = proxies_.find(origin);
+	if (known != proxies_.end()) {
+		return known->second;
+	}
+
+	processes::Process proc({config_.evaluator, "-p", pac_file_, "-u", origin});
+	auto exp_lines = proc.GenerateLineData(kEvaluationTimeout);
+	if (!exp_lines) {
+		return expected::unexpected(exp_lines.error().WithContext("While evaluating the PAC file"));
+	}
+	if (exp_lines.value().size() == 0) {
+		return expected::unexpected(
+			MakeError(ProxyError, "No output from " + config_.evaluator + " for " + origin));
+	}
+
+	auto exp_proxy = ProxyFromPacResult(exp_lines.value()[0]);
+	if (!exp_proxy) {
+		return exp_proxy;
+	}
+	log::Debug(
+		"Proxy for " + origin + " according to the PAC file: "
+		+ (exp_proxy.value() == "" ? "none" : exp_proxy.value()));
+	proxies_[origin] = exp_proxy.value();
+	return exp_proxy;
+}
+
+error::Error Resolver::Refresh() {
+	auto now = chrono::steady_clock::now();
+	if (now < next_refresh_) {
+		if (pac_file_ == "") {
+			return MakeError(ProxyError, "No PAC file available");
+		}
+		return error::NoError;
+	}
+
+	auto exp_url = PacFileUrl();
+	error::Error err;
+	string pac_file;
+	if (!exp_url) {
+		err = exp_url.error();
+	} else if (common::StartsWith<string>(exp_url.value(), kFileUrlPrefix)) {
+		pac_file = exp_url.value().substr(kFileUrlPrefix.size());
+		if (!path::FileExists(pac_file)) {
+			err = MakeError(ProxyError, "PAC file " + pac_file + " does not exist");
+		}
+	} else {
+		err = Download(exp_url.value());
+		pac_file = config_.download_path;
+	}
+
+	if (err != error::NoError) {
+		next_refresh_ = now + kRetryInterval;
+		if (pac_file_ == "") {
+			return err;
+		}
+		log::Warning("Could not refresh the PAC file, keeping the old one: " + err.String());
+		return error::NoError;
+	}
+
+	pac_file_ = pac_file;
+	next_refresh_ = now + kRefreshInterval;
+	proxies_.clear();
+	return error::NoError;
+}
+
+expected::ExpectedString Resolver::PacFileUrl() const {
+	if (config_.url != "") {
+		return config_.url;
+	}
+
+	ifstream url_file(config_.dhcp_url_file);
+	string url;
+	if (!url_file.good() || !getline(url_file, url) || url == "") {
+		return expected::unexpected(MakeError(
+			ProxyError, "No PAC file URL from DHCP found in " + config_.dhcp_url_file));
+	}
+	return url;
+}
+
+error::Error Resolver::Download(const string &pac_url) {
+	events::EventLoop loop;
+	http::Client client {fetch_config_, loop, "http_client:pac"};
+
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	auto err = req->SetAddress(pac_url);
+	if (err != error::NoError) {
+		return err.WithContext("Invalid PAC file URL");
+	}
+
+	auto body = make_shared<vector<uint8_t>>();
+	error::Error result;
+	err = client.AsyncCall(
+		req,
+		[&loop, &result, body](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp) {
+				result = exp_resp.error();
+				loop.Stop();
+				return;
+			}
+			auto resp = exp_resp.value();
+			if (resp->GetStatusCode() != http::StatusOK) {
+				result = MakeError(
+					ProxyError,
+					"Unexpected status code while fetching the PAC file: "
+						+ to_string(resp->GetStatusCode()) + " " + resp->GetStatusMessage());
+				loop.Stop();
+				return;
+			}
+			auto writer = make_shared<io::ByteWriter>(body);
+			writer->SetUnlimited(true);
+			resp->SetBodyWriter(writer);
+		},
+		[&loop, &result](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp && result == error::NoError) {
+				result = exp_resp.error();
+			}
+			loop.Stop();
+		});
+	if (err != error::NoError) {
+		return err;
+	}
+
+	events::Timer timeout {loop};
+	timeout.AsyncWait(kDownloadTimeout, [&loop, &result, &client](error::Error err) {
+		if (err != error::NoError) {
+			return;
+		}
+		result = MakeError(ProxyError, "Timed out fetching the PAC file");
+		client.Cancel();
+		loop.Stop();
+	});
+
+	loop.Run();
+	timeout.Cancel();
+	client.Cancel();
+
+	if (result != error::NoError) {
+		return result.WithContext("While fetching the PAC file from " + pac_url);
+	}
+
+	// Written next to the final file and then renamed, so that the evaluator, maybe in another
+	// process, never sees a partial PAC file.
+	const string tmp_path = config_.download_path + "." + to_string(getpid());
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	err = io::WriteStringIntoOfstream(exp_stream.value(), common::StringFromByteVector(*body));
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, config_.download_path);
+}
+
+expected::ExpectedString ProxyFromPacResult(const string &result) {
+	auto entries = common::SplitString(result, ";");
+	bool any_entry = false;
+	for (const auto &entry : entries) {
+		istringstream entry_stream {entry};
+		string type;
+		string address;
+		entry_stream >> type >> address;
+		if (type == "") {
+			continue;
+		}
+		any_entry = true;
+
+		if (type == "DIRECT") {
+			return string();
+		} else if (address == "") {
+			continue;
+		} else if (type == "PROXY" || type == "HTTP") {
+			return "http://" + address;
+		} else if (type == "HTTPS") {
+			return "https://" + address;
+		}
+		// SOCKS proxies are not supported, try the next one.
+	}
+
+	// An empty result means connecting directly.
+	if (!any_entry) {
+		return string();
+	}
+	return expected::unexpected(
+		MakeError(ProxyError, "No supported proxy in the PAC file result: " + result));
+}
+
+} // namespace pac
+} // namespace http
+} // namespace common
+} // namespace mender
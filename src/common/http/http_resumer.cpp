@@ -14,6 +14,7 @@
 
 #include <common/http_resumer.hpp>
 
+#include <cassert>
 #include <regex>
 
 #include <common/common.hpp>
@@ -77,6 +78,86 @@ ExpectedRangeHeader ParseRangeHeader(string header) {
 	return range_header;
 }
 
+// Used when adaptive link tuning is enabled without a stall timeout, so that stalls are detected
+// long before the usual 5 minutes.
+const chrono::seconds kAdaptiveStallTimeout {60};
+
+// Each more conservative than the one before, the last one with the smallest TCP segments which
+// every host must accept.
+const vector<http::LinkTuning> kAdaptiveLinkTuningSteps {
+	{
+		.tcp_max_segment_size = 1200,
+		.tls_max_fragment_length = 4096,
+		.read_buffer_size = 16384,
+	},
+	{
+		.tcp_max_segment_size = 536,
+		.tls_max_fragment_length = 1024,
+		.read_buffer_size = 4096,
+	},
+};
+
+string DownloadFailureCauseToString(DownloadFailureCause cause) {
+	switch (cause) {
+	case DownloadFailureCause::Dns:
+		return "dns";
+	case DownloadFailureCause::Connect:
+		return "connect";
+	case DownloadFailureCause::Tls:
+		return "tls";
+	case DownloadFailureCause::Reset:
+		return "reset";
+	case DownloadFailureCause::Timeout:
+		return "timeout";
+	case DownloadFailureCause::ChecksumMismatch:
+		return "checksum-mismatch";
+	case DownloadFailureCause::Other:
+		return "other";
+	}
+	assert(false);
+	return "other";
+}
+
+DownloadFailureCause ClassifyDownloadError(const error::Error &err) {
+	// The HTTP implementation passes on the error conditions of the platform, so the
+	// non-generic ones can only be told apart by their categories.
+	const string category {err.code.category().name()};
+	if (category == "asio.netdb" || category == "asio.addrinfo") {
+		return DownloadFailureCause::Dns;
+	}
+	if (category == "asio.ssl.stream") {
+		// The connection was closed without a TLS shutdown.
+		return DownloadFailureCause::Reset;
+	}
+	if (category == "asio.ssl") {
+		return DownloadFailureCause::Tls;
+	}
+	if (category == "asio.misc" || category == "beast.http") {
+		// End of stream, or a partial message: closed before the whole body was received.
+		return DownloadFailureCause::Reset;
+	}
+	if (category == "boost.beast") {
+		// The only error of this category is the timeout of the stream.
+		return DownloadFailureCause::Timeout;
+	}
+
+	if (err.code == make_error_condition(errc::timed_out)) {
+		return DownloadFailureCause::Timeout;
+	}
+	if (err.code == make_error_condition(errc::connection_reset)
+		|| err.code == make_error_condition(errc::connection_aborted)
+		|| err.code == make_error_condition(errc::broken_pipe)) {
+		return DownloadFailureCause::Reset;
+	}
+	if (err.code == make_error_condition(errc::connection_refused)
+		|| err.code == make_error_condition(errc::host_unreachable)
+		|| err.code == make_error_condition(errc::network_unreachable)
+		|| err.code == make_error_condition(errc::network_down)) {
+		return DownloadFailureCause::Connect;
+	}
+	return DownloadFailureCause::Other;
+}
+
 class HeaderHandlerFunctor {
 public:
 	HeaderHandlerFunctor(weak_ptr<DownloadResumerClient> resumer) :
@@ -111,7 +192,7 @@ void HeaderHandlerFunctor::operator()(http::ExpectedIncomingResponsePtr exp_resp
 	if (resumer_client) {
 		// If an error has already occurred, schedule the next AsyncCall directly
 		if (!exp_resp) {
-			resumer_client->logger_.Warning(exp_resp.error().String());
+			resumer_client->ReportAttemptFailure(exp_resp.error());
 			auto err = resumer_client->ScheduleNextResumeRequest();
 			if (err != error::NoError) {
 				resumer_client->logger_.Error(err.String());
@@ -272,8 +353,7 @@ void BodyHandlerFunctor::operator()(http::ExpectedIncomingResponsePtr exp_resp)
 				resumer_client->CallUserHandler(exp_resp);
 				return;
 			}
-			resumer_client->logger_.Info(
-				"Will try to resume after error " + exp_resp.error().String());
+			resumer_client->ReportAttemptFailure(exp_resp.error());
 		}
 
 		auto err = resumer_client->ScheduleNextResumeRequest();
@@ -293,6 +373,12 @@ void BodyHandlerFunctor::operator()(http::ExpectedIncomingResponsePtr exp_resp)
 
 		// Finished, call the user handler \o/
 		resumer_client->logger_.Debug("Download resumed and completed successfully");
+		if (resumer_client->link_tuning_step_ > 0) {
+			resumer_client->logger_.Info(
+				"Download completed with "
+				+ http::LinkTuningToString(resumer_client->client_.GetConfig().link_tuning)
+				+ ", keeping them for the next downloads");
+		}
 		resumer_client->CallUserHandler(resumer_client->response_);
 	}
 }
@@ -373,6 +459,7 @@ DownloadResumerClient::DownloadResumerClient(
 	client_(config, event_loop, "http_resumer:client"),
 	logger_ {"http_resumer:client"},
 	cancelled_ {make_shared<bool>(true)},
+	configured_link_tuning_ {config.link_tuning},
 	retry_ {// By setting max interval to 1 minute, combined with default min interval of 1 minute,
 			// we effectively do not have exponential backoff and use fixed 1-minute intervals.
 			.backoff = http::ExponentialBackoff(chrono::minutes(1), config.retry_download_count),
@@ -525,6 +612,46 @@ void DownloadResumerClient::Cancel() {
 	resumer_reader_.reset();
 };
 
+void DownloadResumerClient::ReportAttemptFailure(const error::Error &err) {
+	DownloadAttemptFailure failure {
+		.cause = ClassifyDownloadError(err),
+		.offset = resumer_state_->offset,
+		.error = err,
+	};
+	logger_.Warning(
+		"Download attempt failed (" + DownloadFailureCauseToString(failure.cause) + ") at offset "
+		+ to_string(failure.offset) + ": " + err.String());
+	if (attempt_failure_handler_) {
+		attempt_failure_handler_(failure);
+	}
+	AdaptLinkTuning(failure.cause);
+}
+
+void DownloadResumerClient::SetAdaptiveLinkTuning(bool enabled) {
+	adaptive_link_tuning_ = enabled;
+	link_tuning_step_ = 0;
+	auto tuning = configured_link_tuning_;
+	if (enabled && tuning.stall_timeout.count() == 0) {
+		tuning.stall_timeout = kAdaptiveStallTimeout;
+	}
+	client_.SetLinkTuning(tuning);
+}
+
+void DownloadResumerClient::AdaptLinkTuning(DownloadFailureCause cause) {
+	// Only stalls are typical of links which lose large packets. Other failures have other
+	// reasons, which smaller packets won't fix.
+	if (!adaptive_link_tuning_ || cause != DownloadFailureCause::Timeout
+		|| link_tuning_step_ >= kAdaptiveLinkTuningSteps.size()) {
+		return;
+	}
+
+	auto tuning = kAdaptiveLinkTuningSteps[link_tuning_step_];
+	link_tuning_step_++;
+	tuning.stall_timeout = client_.GetConfig().link_tuning.stall_timeout;
+	client_.SetLinkTuning(tuning);
+	logger_.Info("Download stalled, trying again with " + http::LinkTuningToString(tuning));
+}
+
 void DownloadResumerClient::DoCancel() {
 	// Set cancel state and then make a new one. Those who are interested should have their own
 	// pointer to the old one.
@@ -15,6 +15,24 @@
 #include <common/http.hpp>
 
 #include <algorithm>
+#include <cstdlib>
+#include <cstring>
+
+#include <ifaddrs.h>
+#include <net/if.h>
+#include <netinet/in.h>
+#include <netinet/tcp.h>
+#include <sys/ioctl.h>
+#include <sys/socket.h>
+#include <unistd.h>
+#ifdef __linux__
+// After <net/if.h>, which it would otherwise clash with.
+#include <linux/wireless.h>
+#endif
+
+#include <openssl/evp.h>
+#include <openssl/pem.h>
+#include <openssl/x509.h>
 
 #include <boost/asio.hpp>
 #include <boost/asio/ip/tcp.hpp>
@@ -23,6 +41,7 @@
 
 #include <common/common.hpp>
 #include <common/crypto.hpp>
+#include <common/path.hpp>
 
 #include <mender-version.h>
 
@@ -32,6 +51,7 @@ namespace http {
 
 namespace common = mender::common;
 namespace crypto = mender::common::crypto;
+namespace path = mender::common::path;
 
 // At the time of writing, Beast only supports HTTP/1.1, and is unlikely to support HTTP/2
 // according to this discussion: https://github.com/boostorg/beast/issues/1302.
@@ -292,7 +312,8 @@ Client::Client(
 	no_proxy_ {client.no_proxy},
 	cancelled_ {make_shared<bool>(true)},
 	resolver_(GetAsioIoContext(event_loop)),
-	body_buffer_(HTTP_BEAST_BUFFER_SIZE) {
+	body_buffer_(HTTP_BEAST_BUFFER_SIZE),
+	idle_timer_(event_loop) {
 }
 
 Client::~Client() {
@@ -302,11 +323,189 @@ Client::~Client() {
 	DoCancel();
 }
 
+// Zero if unknown, for example for keys which are not files, but PKCS#11 URIs.
+static int64_t LastWriteTimeOrZero(const string &file) {
+	if (file == "") {
+		return 0;
+	}
+	auto exp_time = path::LastWriteTime(file);
+	return exp_time ? exp_time.value() : 0;
+}
+
+// All the certificates in a PEM file.
+static expected::expected<vector<shared_ptr<X509>>, error::Error> LoadCertificates(
+	const string &file) {
+	unique_ptr<BIO, void (*)(BIO *)> bio {BIO_new_file(file.c_str(), "r"), BIO_free_all};
+	if (!bio) {
+		return expected::unexpected(MakeError(HTTPInitError, "Could not open " + file));
+	}
+	vector<shared_ptr<X509>> certs;
+	X509 *cert;
+	while ((cert = PEM_read_bio_X509(bio.get(), nullptr, nullptr, nullptr)) != nullptr) {
+		certs.emplace_back(cert, X509_free);
+	}
+	// Reaching the end of the file leaves an error behind.
+	ERR_clear_error();
+	if (certs.empty()) {
+		return expected::unexpected(MakeError(HTTPInitError, "No certificates in " + file));
+	}
+	return certs;
+}
+
+// The base64 encoded SHA-256 hash of the SubjectPublicKeyInfo of the certificate, empty if it
+// can't be computed.
+static string PublicKeyPin(X509 *cert) {
+	auto public_key = X509_get_X509_PUBKEY(cert);
+	int length = i2d_X509_PUBKEY(public_key, nullptr);
+	if (length <= 0) {
+		return "";
+	}
+	vector<uint8_t> der(static_cast<size_t>(length));
+	auto der_end = der.data();
+	i2d_X509_PUBKEY(public_key, &der_end);
+
+	vector<uint8_t> hash(EVP_MAX_MD_SIZE);
+	unsigned hash_length = 0;
+	if (EVP_Digest(der.data(), der.size(), hash.data(), &hash_length, EVP_sha256(), nullptr)
+		!= 1) {
+		return "";
+	}
+	hash.resize(hash_length);
+	auto exp_pin = crypto::EncodeBase64(hash);
+	return exp_pin ? exp_pin.value() : "";
+}
+
+// The OpenSSL stack and control macros contain C style casts, which expand here, so the warning
+// can't be avoided.
+#ifdef __clang__
+#pragma clang diagnostic push
+#pragma clang diagnostic ignored "-Wold-style-cast"
+#else
+#pragma GCC diagnostic push
+#pragma GCC diagnostic ignored "-Wold-style-cast"
+#endif
+static bool ChainHasPinnedKey(X509_STORE_CTX *ctx, const vector<string> &pins) {
+	// Only the chain which was verified counts, not whatever else the server sent.
+	auto chain = X509_STORE_CTX_get0_chain(ctx);
+	for (int i = 0; chain != nullptr && i < sk_X509_num(chain); i++) {
+		auto pin = PublicKeyPin(sk_X509_value(chain, i));
+		if (find(pins.begin(), pins.end(), pin) != pins.end()) {
+			return true;
+		}
+	}
+	return false;
+}
+
+static void SetVerifyStore(SSL *ssl, X509_STORE *store) {
+	SSL_set1_verify_cert_store(ssl, store);
+}
+#ifdef __clang__
+#pragma clang diagnostic pop
+#else
+#pragma GCC diagnostic pop
+#endif
+
+// The network interface which has the address, empty if none has.
+static string InterfaceWithAddress(const asio::ip::address &address) {
+	struct ifaddrs *addresses;
+	if (getifaddrs(&addresses) != 0) {
+		return "";
+	}
+	string name;
+	for (auto entry = addresses; entry != nullptr && name == ""; entry = entry->ifa_next) {
+		if (entry->ifa_addr == nullptr) {
+			continue;
+		}
+		if (entry->ifa_addr->sa_family == AF_INET && address.is_v4()) {
+			auto bytes = address.to_v4().to_bytes();
+			auto in = reinterpret_cast<struct sockaddr_in *>(entry->ifa_addr);
+			if (memcmp(&in->sin_addr, bytes.data(), bytes.size()) == 0) {
+				name = entry->ifa_name;
+			}
+		} else if (entry->ifa_addr->sa_family == AF_INET6 && address.is_v6()) {
+			auto bytes = address.to_v6().to_bytes();
+			auto in6 = reinterpret_cast<struct sockaddr_in6 *>(entry->ifa_addr);
+			if (memcmp(&in6->sin6_addr, bytes.data(), bytes.size()) == 0) {
+				name = entry->ifa_name;
+			}
+		}
+	}
+	freeifaddrs(addresses);
+	return name;
+}
+
+// The SSID of the Wi-Fi network which the interface is connected to, empty if it isn't connected
+// to one, or if it isn't known.
+static string WirelessNetworkName(const string &interface) {
+#ifdef __linux__
+	int fd = socket(AF_INET, SOCK_DGRAM, 0);
+	if (fd < 0) {
+		return "";
+	}
+	char essid[IW_ESSID_MAX_SIZE + 1] {};
+	struct iwreq request {};
+	strncpy(request.ifr_name, interface.c_str(), IFNAMSIZ - 1);
+	request.u.essid.pointer = essid;
+	request.u.essid.length = IW_ESSID_MAX_SIZE;
+	int ret = ioctl(fd, SIOCGIWESSID, &request);
+	close(fd);
+	return ret == 0 ? string(essid) : "";
+#else
+	return "";
+#endif
+}
+
+static string EnvironmentOr(const char *name, const char *fallback) {
+	const char *value = getenv(name);
+	return value != nullptr ? value : fallback;
+}
+
+// Every file which goes into the SSL contexts, so that they are loaded again when one of them is
+// replaced. The CA store of the system is usually both a bundle and a directory, and the
+// modification time of the directory changes when certificates are added to or removed from it.
+vector<string> Client::CertificateFiles() const {
+	vector<string> files {
+		client_config_.client_cert_path,
+		client_config_.client_cert_key_path,
+		client_config_.server_cert_path,
+		EnvironmentOr(X509_get_default_cert_file_env(), X509_get_default_cert_file()),
+		EnvironmentOr(X509_get_default_cert_dir_env(), X509_get_default_cert_dir()),
+	};
+	for (const auto &exception : client_config_.certificate_pinning.exceptions) {
+		files.push_back(exception.trusted_cert_path);
+	}
+	return files;
+}
+
+vector<int64_t> Client::CertificateWriteTimes() const {
+	vector<int64_t> times;
+	for (const auto &file : CertificateFiles()) {
+		times.push_back(LastWriteTimeOrZero(file));
+	}
+	return times;
+}
+
 error::Error Client::Initialize() {
 	if (initialized_) {
-		return error::NoError;
+		// Certificates are rotated by replacing the files, pick up the new ones, but never in the
+		// middle of a request.
+		bool ongoing = !*cancelled_ && status_ != TransactionStatus::Done;
+		if (ongoing || CertificateWriteTimes() == certificate_write_times_) {
+			return error::NoError;
+		}
+		log::Info("Certificates have changed, reloading them");
+		initialized_ = false;
+		// It uses the contexts which are about to be replaced.
+		CloseIdleConnection();
+	}
+
+	// Start from scratch, also if an earlier attempt failed half way.
+	for (auto &ctx : ssl_ctx_) {
+		ctx = ssl::context {ssl::context::tls_client};
 	}
 
+	certificate_write_times_ = CertificateWriteTimes();
+
 	for (auto i = 0; i < MENDER_BOOST_BEAST_SSL_CTX_COUNT; i++) {
 		ssl_ctx_[i].set_verify_mode(
 			client_config_.skip_verify ? ssl::verify_none : ssl::verify_peer);
@@ -369,11 +568,91 @@ error::Error Client::Initialize() {
 		}
 	}
 
+	auto err = LoadPinningExceptions();
+	if (err != error::NoError) {
+		return err;
+	}
+
 	initialized_ = true;
 
 	return error::NoError;
 }
 
+error::Error Client::LoadPinningExceptions() {
+	pinning_exceptions_.clear();
+	for (const auto &exception : client_config_.certificate_pinning.exceptions) {
+		PinningExceptionTrust trust {shared_ptr<X509_STORE>(X509_STORE_new(), X509_STORE_free), {}};
+		if (!trust.store) {
+			return MakeError(HTTPInitError, "Could not create a certificate store");
+		}
+
+		// The usual CAs stay trusted on these networks, for the connections which aren't
+		// intercepted.
+		if (X509_STORE_set_default_paths(trust.store.get()) != 1) {
+			log::Info("Failed to load the SSL default directory for a pinning exception");
+		}
+		if (client_config_.server_cert_path != "") {
+			auto exp_certs = LoadCertificates(client_config_.server_cert_path);
+			for (size_t i = 0; exp_certs && i < exp_certs.value().size(); i++) {
+				X509_STORE_add_cert(trust.store.get(), exp_certs.value()[i].get());
+			}
+		}
+
+		auto exp_certs = LoadCertificates(exception.trusted_cert_path);
+		if (!exp_certs) {
+			return exp_certs.error().WithContext("Could not load the pinning exception CA");
+		}
+		for (const auto &cert : exp_certs.value()) {
+			X509_STORE_add_cert(trust.store.get(), cert.get());
+			trust.pins.push_back(PublicKeyPin(cert.get()));
+		}
+		pinning_exceptions_.push_back(trust);
+	}
+	return error::NoError;
+}
+
+const Client::PinningExceptionTrust *Client::MatchingPinningException() {
+	const auto &exceptions = client_config_.certificate_pinning.exceptions;
+	if (exceptions.empty()) {
+		return nullptr;
+	}
+
+	boost::system::error_code ec;
+	auto local_endpoint = stream_->lowest_layer().local_endpoint(ec);
+	if (ec) {
+		return nullptr;
+	}
+	const string interface = InterfaceWithAddress(local_endpoint.address());
+	if (interface == "") {
+		return nullptr;
+	}
+	// Only asked for when needed, since it takes a system call.
+	string ssid;
+	bool ssid_known = false;
+
+	for (size_t i = 0; i < exceptions.size(); i++) {
+		const auto &exception = exceptions[i];
+		bool matches = find(exception.interfaces.begin(), exception.interfaces.end(), interface)
+					   != exception.interfaces.end();
+		if (!matches && !exception.ssids.empty()) {
+			if (!ssid_known) {
+				ssid = WirelessNetworkName(interface);
+				ssid_known = true;
+			}
+			matches = ssid != ""
+					  && find(exception.ssids.begin(), exception.ssids.end(), ssid)
+							 != exception.ssids.end();
+		}
+		if (matches) {
+			logger_.Debug(
+				"Trusting " + exception.trusted_cert_path + " on interface " + interface
+				+ (ssid != "" ? " (" + ssid + ")" : ""));
+			return &pinning_exceptions_[i];
+		}
+	}
+	return nullptr;
+}
+
 // Create the HOST header according to:
 // https://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.23
 // In short: Add the port-number if it is non-standard HTTP
@@ -414,10 +693,23 @@ error::Error Client::AsyncCall(
 
 	request_ = req;
 
+	// Before the proxy setup, which may change the address of the request.
+	StartConnectionRecord(*req);
+	connection_key_ = req->address_.protocol + "://" + req->address_.host + ":"
+					  + to_string(req->address_.port);
+
 	err = HandleProxySetup();
 	if (err != error::NoError) {
+		connection_record_.reset();
 		return err;
 	}
+	connection_key_ += " via " + request_->address_.protocol + "://" + request_->address_.host
+					   + ":" + to_string(request_->address_.port);
+	if (connection_record_) {
+		connection_record_->proxy = secondary_req_
+									|| request_->address_.host != connection_record_->host
+									|| request_->address_.port != connection_record_->port;
+	}
 
 	// NOTE: The AWS loadbalancer requires that the HOST header always be set, in order for the
 	// request to route to our k8s cluster. Set this in all cases.
@@ -427,7 +719,16 @@ error::Error Client::AsyncCall(
 	log::Trace("Setting HOST address: " + header_url);
 
 	// Add User-Agent header for all requests
-	req->SetHeader("User-Agent", "Mender/" MENDER_VERSION);
+	if (client_config_.user_agent != "") {
+		req->SetHeader("User-Agent", client_config_.user_agent);
+	} else {
+		req->SetHeader("User-Agent", "Mender/" MENDER_VERSION);
+	}
+
+	// A request switching protocols keeps its own `Connection: Upgrade`.
+	if (!client_config_.keep_alive.enabled && !req->GetHeader("Upgrade")) {
+		req->SetHeader("Connection", "close");
+	}
 
 	header_handler_ = header_handler;
 	body_handler_ = body_handler;
@@ -435,6 +736,10 @@ error::Error Client::AsyncCall(
 
 	cancelled_ = make_shared<bool>(false);
 
+	if (ReuseIdleConnection()) {
+		return error::NoError;
+	}
+
 	auto &cancelled = cancelled_;
 
 	resolver_.async_resolve(
@@ -478,13 +783,32 @@ static inline error::Error AddProxyAuthHeader(OutgoingRequest &req, BrokenDownUr
 error::Error Client::HandleProxySetup() {
 	secondary_req_.reset();
 
+	string http_proxy = http_proxy_;
+	string https_proxy = https_proxy_;
+	string no_proxy = no_proxy_;
+	if (client_config_.proxy_resolver) {
+		auto exp_proxy = client_config_.proxy_resolver(
+			request_->address_.protocol + "://" + request_->address_.host + ":"
+			+ to_string(request_->address_.port) + "/");
+		if (exp_proxy) {
+			// The resolver has also decided which hosts to connect to directly.
+			http_proxy = exp_proxy.value();
+			https_proxy = exp_proxy.value();
+			no_proxy = "";
+		} else {
+			logger_.Warning(
+				"Could not find the proxy to use, falling back to the static proxy settings: "
+				+ exp_proxy.error().String());
+		}
+	}
+
 	if (request_->address_.protocol == "http") {
 		socket_mode_ = SocketMode::Plain;
 
-		if (http_proxy_ != "" && !HostNameMatchesNoProxy(request_->address_.host, no_proxy_)) {
+		if (http_proxy != "" && !HostNameMatchesNoProxy(request_->address_.host, no_proxy)) {
 			// Make a modified proxy request.
 			BrokenDownUrl proxy_address;
-			auto err = BreakDownUrl(http_proxy_, proxy_address, true);
+			auto err = BreakDownUrl(http_proxy, proxy_address, true);
 			if (err != error::NoError) {
 				return err.WithContext("HTTP proxy URL is invalid");
 			}
@@ -517,7 +841,7 @@ error::Error Client::HandleProxySetup() {
 	} else if (request_->address_.protocol == "https") {
 		socket_mode_ = SocketMode::Tls;
 
-		if (https_proxy_ != "" && !HostNameMatchesNoProxy(request_->address_.host, no_proxy_)) {
+		if (https_proxy != "" && !HostNameMatchesNoProxy(request_->address_.host, no_proxy)) {
 			// Save the original request for later, so that we can make a new request
 			// over the channel established by CONNECT.
 			secondary_req_ = std::move(request_);
@@ -525,7 +849,7 @@ error::Error Client::HandleProxySetup() {
 			request_ = make_shared<OutgoingRequest>();
 			request_->SetMethod(Method::CONNECT);
 			BrokenDownUrl proxy_address;
-			auto err = BreakDownUrl(https_proxy_, proxy_address, true);
+			auto err = BreakDownUrl(https_proxy, proxy_address, true);
 			if (err != error::NoError) {
 				return err.WithContext("HTTPS proxy URL is invalid");
 			}
@@ -595,6 +919,8 @@ io::ExpectedAsyncReadWriterPtr Client::SwitchProtocol(IncomingResponsePtr req) {
 	*cancelled_ = true;
 	cancelled_ = make_shared<bool>(false);
 
+	FinishConnectionRecord();
+
 	auto stream = stream_;
 	// This no longer belongs to us.
 	stream_.reset();
@@ -635,6 +961,9 @@ void Client::CallErrorHandler(
 void Client::CallErrorHandler(
 	const error::Error &err, const OutgoingRequestPtr &req, ResponseHandler handler) {
 	status_ = TransactionStatus::Done;
+	if (connection_record_ && connection_record_->error == "") {
+		connection_record_->error = err.String();
+	}
 	DoCancel();
 	handler(expected::unexpected(
 		err.WithContext(MethodToString(req->method_) + " " + req->orig_address_)));
@@ -647,6 +976,10 @@ void Client::ResolveHandler(
 		return;
 	}
 
+	if (connection_record_) {
+		connection_record_->resolved_ms = ConnectionRecordElapsedMs();
+	}
+
 	if (logger_.Level() >= log::LogLevel::Debug) {
 		string ips = "[";
 		string sep;
@@ -691,6 +1024,11 @@ void Client::ResolveHandler(
 			body_buffer_.size() - response_data_.response_buffer_->size());
 	}
 
+	if (client_config_.link_tuning.tcp_max_segment_size > 0) {
+		ConnectWithTuning(resolver_results_.begin());
+		return;
+	}
+
 	auto &cancelled = cancelled_;
 
 	asio::async_connect(
@@ -698,26 +1036,78 @@ void Client::ResolveHandler(
 		resolver_results_,
 		[this, cancelled](const error_code &ec, const asio::ip::tcp::endpoint &endpoint) {
 			if (!*cancelled) {
-				switch (socket_mode_) {
-				case SocketMode::TlsTls:
-					// Should never happen because we always need to handshake
-					// the innermost Tls first, then the outermost, but the
-					// latter doesn't happen here.
-					assert(false);
-					CallErrorHandler(
-						error::MakeError(
-							error::ProgrammingError, "TlsTls mode is invalid in ResolveHandler"),
-						request_,
-						header_handler_);
-				case SocketMode::Tls:
-					return HandshakeHandler(stream_->next_layer(), ec, endpoint);
-				case SocketMode::Plain:
-					return ConnectHandler(ec, endpoint);
-				}
+				ConnectedHandler(ec, endpoint);
 			}
 		});
 }
 
+void Client::ConnectWithTuning(
+	asio::ip::tcp::resolver::results_type::const_iterator endpoint_iter) {
+	// Like `asio::async_connect`, which tries the endpoints one by one, but that one opens the
+	// socket itself, and the maximum segment size must be set between opening and connecting.
+	auto &socket = stream_->lowest_layer();
+	const auto endpoint = endpoint_iter->endpoint();
+
+	error_code ec;
+	socket.close(ec);
+	socket.open(endpoint.protocol(), ec);
+	if (ec) {
+		CallErrorHandler(ec, request_, header_handler_);
+		return;
+	}
+#ifdef TCP_MAXSEG
+	asio::detail::socket_option::integer<IPPROTO_TCP, TCP_MAXSEG> max_segment_size {
+		client_config_.link_tuning.tcp_max_segment_size};
+	socket.set_option(max_segment_size, ec);
+	if (ec) {
+		logger_.Warning("Could not set the TCP maximum segment size: " + ec.message());
+	}
+#else
+	logger_.Warning("Setting the TCP maximum segment size is not supported on this platform");
+#endif
+
+	auto &cancelled = cancelled_;
+
+	socket.async_connect(endpoint, [this, cancelled, endpoint_iter](const error_code &ec) {
+		if (*cancelled) {
+			return;
+		}
+		auto next_iter = std::next(endpoint_iter);
+		if (ec && next_iter != resolver_results_.end()) {
+			logger_.Debug(
+				"Could not connect to " + endpoint_iter->endpoint().address().to_string()
+				+ ", trying the next address: " + ec.message());
+			ConnectWithTuning(next_iter);
+			return;
+		}
+		ConnectedHandler(ec, endpoint_iter->endpoint());
+	});
+}
+
+void Client::ConnectedHandler(const error_code &ec, const asio::ip::tcp::endpoint &endpoint) {
+	if (!ec && connection_record_) {
+		connection_record_->address = endpoint.address().to_string();
+		connection_record_->connected_ms = ConnectionRecordElapsedMs();
+	}
+
+	switch (socket_mode_) {
+	case SocketMode::TlsTls:
+		// Should never happen because we always need to handshake
+		// the innermost Tls first, then the outermost, but the
+		// latter doesn't happen here.
+		assert(false);
+		CallErrorHandler(
+			error::MakeError(error::ProgrammingError, "TlsTls mode is invalid in ResolveHandler"),
+			request_,
+			header_handler_);
+		return;
+	case SocketMode::Tls:
+		return HandshakeHandler(stream_->next_layer(), ec, endpoint);
+	case SocketMode::Plain:
+		return ConnectHandler(ec, endpoint);
+	}
+}
+
 template <typename StreamType>
 void Client::HandshakeHandler(
 	StreamType &stream, const error_code &ec, const asio::ip::tcp::endpoint &endpoint) {
@@ -753,30 +1143,103 @@ void Client::HandshakeHandler(
 		logger_.Error("Failed to set SNI host name: " + ec2.message());
 	}
 
+	const string host = common::StringToLower(request_->address_.host);
+	vector<string> pins;
+	auto pinned = client_config_.certificate_pinning.hosts.find(host);
+	if (pinned != client_config_.certificate_pinning.hosts.end()) {
+		pins = pinned->second;
+	}
+	auto exception = MatchingPinningException();
+	if (exception != nullptr) {
+		SetVerifyStore(stream.native_handle(), exception->store.get());
+		if (!pins.empty()) {
+			pins.insert(pins.end(), exception->pins.begin(), exception->pins.end());
+		}
+	}
+
 	// Enable host name verification (not done automatically and we don't have
 	// enough access to the TLS internals to use X509_VERIFY_PARAM_set1_host(),
-	// hence the callback that boost provides).
+	// hence the callback that boost provides), and check the pins once the chain
+	// has been verified.
 	boost::system::error_code b_ec;
-	stream.set_verify_callback(ssl::host_name_verification(request_->address_.host), b_ec);
+	stream.set_verify_callback(
+		[this, host, pins, host_name_verification = ssl::host_name_verification(host)](
+			bool preverified, ssl::verify_context &ctx) {
+			if (!host_name_verification(preverified, ctx)) {
+				return false;
+			}
+			// Called for each certificate, from the root down to the server's own.
+			if (pins.empty() || X509_STORE_CTX_get_error_depth(ctx.native_handle()) > 0) {
+				return true;
+			}
+			if (!ChainHasPinnedKey(ctx.native_handle(), pins)) {
+				logger_.Error("No certificate of " + host + " has any of the pinned public keys");
+				return false;
+			}
+			return true;
+		},
+		b_ec);
 	if (b_ec) {
 		logger_.Error("Failed to enable host name verification: " + b_ec.message());
 		CallErrorHandler(b_ec, request_, header_handler_);
 		return;
 	}
 
+	const auto &tuning = client_config_.link_tuning;
+	if (tuning.tls_max_fragment_length > 0) {
+#ifdef TLSEXT_max_fragment_length_512
+		uint8_t mode = TLSEXT_max_fragment_length_DISABLED;
+		switch (tuning.tls_max_fragment_length) {
+		case 512:
+			mode = TLSEXT_max_fragment_length_512;
+			break;
+		case 1024:
+			mode = TLSEXT_max_fragment_length_1024;
+			break;
+		case 2048:
+			mode = TLSEXT_max_fragment_length_2048;
+			break;
+		case 4096:
+			mode = TLSEXT_max_fragment_length_4096;
+			break;
+		}
+		if (SSL_set_tlsext_max_fragment_length(stream.native_handle(), mode) != 1) {
+			logger_.Warning(
+				"Could not set the TLS maximum fragment length to "
+				+ to_string(tuning.tls_max_fragment_length));
+		}
+#else
+		logger_.Warning("The TLS maximum fragment length is not supported by this OpenSSL");
+#endif
+	}
+
+	// Stalled handshakes are typical of links which lose large packets, since the certificates
+	// are the first large thing the server sends.
+	if (tuning.stall_timeout.count() > 0) {
+		stream_->next_layer().next_layer().expires_after(tuning.stall_timeout);
+	}
+
 	auto &cancelled = cancelled_;
 
 	stream.async_handshake(
-		ssl::stream_base::client, [this, cancelled, endpoint](const error_code &ec) {
+		ssl::stream_base::client, [this, cancelled, endpoint, &stream](const error_code &ec) {
 			if (*cancelled) {
 				return;
 			}
+			stream_->next_layer().next_layer().expires_never();
 			if (ec) {
 				logger_.Error("https: Failed to perform the SSL handshake: " + ec.message());
 				CallErrorHandler(ec, request_, header_handler_);
 				return;
 			}
 			logger_.Debug("https: Successful SSL handshake");
+			if (connection_record_) {
+				// Through an HTTPS proxy, the handshake with the server comes last, and wins.
+				connection_record_->tls_handshake_ms = ConnectionRecordElapsedMs();
+				connection_record_->tls_version = SSL_get_version(stream.native_handle());
+				connection_record_->tls_cipher =
+					SSL_CIPHER_get_name(SSL_get_current_cipher(stream.native_handle()));
+			}
 			ConnectHandler(ec, endpoint);
 		});
 }
@@ -794,6 +1257,10 @@ void Client::ConnectHandler(const error_code &ec, const asio::ip::tcp::endpoint
 
 	logger_.Debug("Connected to " + endpoint.address().to_string());
 
+	WriteHeader();
+}
+
+void Client::WriteHeader() {
 	request_data_.http_request_ = make_shared<http::request<http::buffer_body>>(
 		MethodToBeastVerb(request_->method_), request_->address_.path, BeastHttpVersion);
 
@@ -843,6 +1310,9 @@ void Client::WriteHeaderHandler(const error_code &ec, size_t num_written) {
 	if (num_written > 0) {
 		logger_.Trace("Wrote " + to_string(num_written) + " bytes of header data to stream.");
 	}
+	if (connection_record_) {
+		connection_record_->bytes_sent += num_written;
+	}
 
 	if (ec) {
 		CallErrorHandler(ec, request_, header_handler_);
@@ -891,6 +1361,9 @@ void Client::WriteBodyHandler(const error_code &ec, size_t num_written) {
 	if (num_written > 0) {
 		logger_.Trace("Wrote " + to_string(num_written) + " bytes of body data to stream.");
 	}
+	if (connection_record_) {
+		connection_record_->bytes_sent += num_written;
+	}
 
 	if (ec == http::make_error_code(http::error::need_buffer)) {
 		// Write next block of the body.
@@ -1015,6 +1488,9 @@ void Client::ReadHeaderHandler(const error_code &ec, size_t num_read) {
 	if (num_read > 0) {
 		logger_.Trace("Read " + to_string(num_read) + " bytes of header data from stream.");
 	}
+	if (connection_record_) {
+		connection_record_->bytes_received += num_read;
+	}
 
 	if (ec) {
 		CallErrorHandler(ec, request_, header_handler_);
@@ -1033,6 +1509,10 @@ void Client::ReadHeaderHandler(const error_code &ec, size_t num_read) {
 
 	response_.reset(new IncomingResponse(*this, cancelled_));
 	response_->status_code_ = response_data_.http_response_parser_->get().result_int();
+	if (connection_record_) {
+		connection_record_->response_ms = ConnectionRecordElapsedMs();
+		connection_record_->status_code = response_->status_code_;
+	}
 	response_->status_message_ = string {response_data_.http_response_parser_->get().reason()};
 
 	logger_.Debug(
@@ -1065,7 +1545,7 @@ void Client::ReadHeaderHandler(const error_code &ec, size_t num_read) {
 			if (response_->status_code_ != StatusCode::StatusSwitchingProtocols) {
 				// Make an exception for 101 Switching Protocols response, where the TCP connection
 				// is meant to be reused.
-				DoCancel();
+				FinishRequest();
 			}
 			CallHandler(body_handler_);
 		}
@@ -1158,7 +1638,7 @@ void Client::AsyncReadNextBodyPart(
 		handler(0);
 		if (!*cancelled && status_ == TransactionStatus::BodyReadingFinished) {
 			status_ = TransactionStatus::Done;
-			DoCancel();
+			FinishRequest();
 			CallHandler(body_handler_);
 		}
 		return;
@@ -1169,6 +1649,9 @@ void Client::AsyncReadNextBodyPart(
 	reader_handler_ = handler;
 	size_t read_size = end - start;
 	size_t smallest = min(body_buffer_.size(), read_size);
+	if (client_config_.link_tuning.read_buffer_size > 0) {
+		smallest = min(smallest, client_config_.link_tuning.read_buffer_size);
+	}
 
 	response_data_.http_response_parser_->get().body().data = body_buffer_.data();
 	response_data_.http_response_parser_->get().body().size = smallest;
@@ -1177,10 +1660,15 @@ void Client::AsyncReadNextBodyPart(
 	auto &cancelled = cancelled_;
 	auto &response_data = response_data_;
 
-	// Set timeout to 5 minutes to ensure we don't hang during async read
+	// Set timeout to 5 minutes, or the stall timeout, to ensure we don't hang during async read
 	// `next_layer().next_layer()` accesses the `beast::tcp_stream` from
 	// `ssl::stream<ssl::stream<beast::tcp_stream>>`
-	stream_->next_layer().next_layer().expires_after(chrono::minutes(5));
+	const auto &stall_timeout = client_config_.link_tuning.stall_timeout;
+	if (stall_timeout.count() > 0) {
+		stream_->next_layer().next_layer().expires_after(stall_timeout);
+	} else {
+		stream_->next_layer().next_layer().expires_after(chrono::minutes(5));
+	}
 
 	auto async_handler = [this, cancelled, response_data](const error_code &ec, size_t num_read) {
 		if (!*cancelled) {
@@ -1217,6 +1705,9 @@ void Client::ReadBodyHandler(error_code ec, size_t num_read) {
 	if (num_read > 0) {
 		logger_.Trace("Read " + to_string(num_read) + " bytes of body data from stream.");
 	}
+	if (connection_record_) {
+		connection_record_->bytes_received += num_read;
+	}
 
 	if (ec == http::make_error_code(http::error::need_buffer)) {
 		// This can be ignored. We always reset the buffer between reads anyway.
@@ -1292,7 +1783,156 @@ void Client::Cancel() {
 	}
 }
 
+void Client::StartConnectionRecord(const OutgoingRequest &req) {
+	// A 101 Switching Protocols response may leave the previous one unfinished.
+	FinishConnectionRecord();
+	if (!client_config_.connection_recorder) {
+		return;
+	}
+
+	connection_record_.reset(new ConnectionRecord);
+	connection_record_->timestamp =
+		chrono::duration_cast<chrono::seconds>(chrono::system_clock::now().time_since_epoch())
+			.count();
+	connection_record_->method = MethodToString(req.method_);
+	connection_record_->host = req.address_.host;
+	connection_record_->port = req.address_.port;
+	connection_record_start_ = chrono::steady_clock::now();
+}
+
+int64_t Client::ConnectionRecordElapsedMs() const {
+	return chrono::duration_cast<chrono::milliseconds>(
+			   chrono::steady_clock::now() - connection_record_start_)
+		.count();
+}
+
+void Client::FinishConnectionRecord() {
+	if (!connection_record_) {
+		return;
+	}
+	// Taken out first, so that it is only recorded once.
+	auto record = std::move(connection_record_);
+	record->total_ms = ConnectionRecordElapsedMs();
+
+	// The field names of other platforms differ, and Linux is where it matters.
+#if defined(__linux__) && defined(TCP_INFO)
+	if (stream_ && stream_->lowest_layer().is_open()) {
+		struct tcp_info info {};
+		socklen_t info_length = sizeof(info);
+		if (getsockopt(
+				stream_->lowest_layer().native_handle(),
+				IPPROTO_TCP,
+				TCP_INFO,
+				&info,
+				&info_length)
+			== 0) {
+			record->has_tcp_info = true;
+			record->rtt_us = info.tcpi_rtt;
+			record->rtt_var_us = info.tcpi_rttvar;
+			record->retransmits = info.tcpi_retransmits;
+			record->total_retransmits = info.tcpi_total_retrans;
+			record->lost = info.tcpi_lost;
+			record->send_congestion_window = info.tcpi_snd_cwnd;
+			record->send_mss = info.tcpi_snd_mss;
+			record->path_mtu = info.tcpi_pmtu;
+		}
+	}
+#endif
+
+	client_config_.connection_recorder(*record);
+}
+
+void Client::FinishRequest() {
+	auto &parser = response_data_.http_response_parser_;
+	if (!client_config_.keep_alive.enabled || !stream_ || !parser || !parser->is_done()
+		|| !parser->get().keep_alive() || response_data_.response_buffer_->size() > 0) {
+		DoCancel();
+		return;
+	}
+
+	FinishConnectionRecord();
+
+	// A timeout which is left over from the last read would otherwise hit the next request.
+	stream_->next_layer().next_layer().expires_never();
+	idle_connection_key_ = connection_key_;
+	idle_socket_mode_ = socket_mode_;
+	idle_timer_.AsyncWait(client_config_.keep_alive.idle_timeout, [this](error::Error err) {
+		if (err == error::NoError) {
+			logger_.Debug("Closing the connection, which has been idle for too long");
+			CloseIdleConnection();
+		}
+	});
+
+	logger_ = log::Logger(logger_name_);
+
+	*cancelled_ = true;
+	cancelled_ = make_shared<bool>(true);
+}
+
+bool Client::ReuseIdleConnection() {
+	if (idle_connection_key_ == "") {
+		return false;
+	}
+
+	if (idle_connection_key_ != connection_key_) {
+		CloseIdleConnection();
+		return false;
+	}
+
+	// Anything arriving on an idle connection, including the end of it, means that the server
+	// is done with it.
+	auto &socket = stream_->lowest_layer();
+	error_code ec;
+	uint8_t byte;
+	socket.non_blocking(true, ec);
+	if (!ec) {
+		socket.receive(asio::buffer(&byte, 1), asio::socket_base::message_peek, ec);
+	}
+	const bool usable = ec == asio::error::would_block;
+	socket.non_blocking(false, ec);
+	if (!usable) {
+		logger_.Debug("The server has closed the idle connection, connecting again");
+		CloseIdleConnection();
+		return false;
+	}
+	idle_connection_key_.clear();
+	idle_timer_.Cancel();
+
+	if (secondary_req_) {
+		// The tunnel through the proxy is already there.
+		request_ = std::move(secondary_req_);
+	}
+	socket_mode_ = idle_socket_mode_;
+	response_data_.response_buffer_->clear();
+
+	if (connection_record_) {
+		connection_record_->address = socket.remote_endpoint(ec).address().to_string();
+	}
+	logger_.Debug("Reusing the connection to " + request_->address_.host);
+
+	WriteHeader();
+	return true;
+}
+
+void Client::CloseIdleConnection() {
+	if (idle_connection_key_ == "") {
+		return;
+	}
+	idle_connection_key_.clear();
+	idle_timer_.Cancel();
+
+	if (stream_) {
+		beast::error_code ec;
+		stream_->lowest_layer().close(ec);
+		stream_.reset();
+	}
+}
+
 void Client::DoCancel() {
+	FinishConnectionRecord();
+
+	idle_connection_key_.clear();
+	idle_timer_.Cancel();
 	resolver_.cancel();
 	if (stream_) {
 		beast::error_code ec;
@@ -1648,6 +2288,8 @@ void Stream::ReadBodyHandler(error_code ec, size_t num_read) {
 
 void Stream::AsyncReply(ReplyFinishedHandler reply_finished_handler) {
 	SetupResponse();
+	// The connection is closed after every reply, so tell the client not to wait for it.
+	response_data_.http_response_->keep_alive(false);
 
 	reply_finished_handler_ = reply_finished_handler;
 
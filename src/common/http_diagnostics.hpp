@@ -0,0 +1,68 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_COMMON_HTTP_DIAGNOSTICS_HPP
+#define MENDER_COMMON_HTTP_DIAGNOSTICS_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/http.hpp>
+
+namespace mender {
+namespace common {
+namespace http {
+namespace diagnostics {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace http = mender::common::http;
+
+// One line in the diagnostics file. `skipped` is how many requests were left out because of the
+// rate limit, since the previous record.
+string RecordJson(const http::ConnectionRecord &record, int64_t skipped);
+
+// Keeps the latest records in a file, one JSON object per line, for use as
+// `ClientConfig::connection_recorder`. The file is rewritten for every record, so that it can be
+// copied at any time, survives restarts and can be shared by the daemon and the standalone
+// commands. That is why only `max_records_per_minute` records are written in a minute, the rest
+// are only counted.
+class Recorder {
+public:
+	Recorder(const string &path, size_t max_records, int max_records_per_minute);
+
+	// Never fails, errors are logged.
+	void Add(const http::ConnectionRecord &record);
+
+private:
+	error::Error Write(const string &line);
+
+	string path_;
+	size_t max_records_;
+	int max_records_per_minute_;
+
+	chrono::steady_clock::time_point window_start_;
+	int records_in_window_ {0};
+	int64_t skipped_ {0};
+};
+
+} // namespace diagnostics
+} // namespace http
+} // namespace common
+} // namespace mender
+
+#endif // MENDER_COMMON_HTTP_DIAGNOSTICS_HPP
@@ -0,0 +1,87 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_COMMON_HTTP_PAC_HPP
+#define MENDER_COMMON_HTTP_PAC_HPP
+
+#include <chrono>
+#include <string>
+#include <unordered_map>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/http.hpp>
+
+namespace mender {
+namespace common {
+namespace http {
+namespace pac {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+namespace http = mender::common::http;
+
+struct ResolverConfig {
+	// URL of the PAC file: http://, https:// or file://.
+	string url;
+	// File holding the PAC file URL from DHCP option 252, as written by the DHCP client. Only used
+	// if `url` is empty.
+	string dhcp_url_file;
+	// Program which evaluates the PAC file, called as `<evaluator> -p <PAC file> -u <URL>`, like
+	// `pactester` from pacparser. It prints the result of `FindProxyForURL`.
+	string evaluator;
+	// Where a downloaded PAC file is saved for the evaluator.
+	string download_path;
+};
+
+// Chooses the proxy for URLs according to a PAC file, for use as `ClientConfig::proxy_resolver`.
+// PAC files are JavaScript, so they are evaluated by an external program. The PAC file is
+// downloaded when it is first needed, and again every hour. Everything happens synchronously, which
+// is acceptable since the results are kept per host, and Mender talks to few hosts.
+class Resolver {
+public:
+	// `fetch_config` is used to download the PAC file, directly, without any proxy.
+	Resolver(const ResolverConfig &config, const http::ClientConfig &fetch_config);
+
+	// Returns the proxy URL to use for `url`, or an empty string to connect directly. Only the
+	// scheme, host and port of `url` are given to the PAC file, like browsers do for HTTPS URLs, so
+	// that for example signed Artifact URLs don't end up on the command line of the evaluator.
+	expected::ExpectedString Resolve(const string &url);
+
+private:
+	error::Error Refresh();
+	expected::ExpectedString PacFileUrl() const;
+	error::Error Download(const string &pac_url);
+
+	ResolverConfig config_;
+	http::ClientConfig fetch_config_;
+
+	// Empty until a PAC file has been found.
+	string pac_file_;
+	chrono::steady_clock::time_point next_refresh_;
+	unordered_map<string, string> proxies_;
+};
+
+// Turns the result of `FindProxyForURL`, such as "PROXY proxy.example.com:8080; DIRECT", into the
+// URL of the first proxy which Mender supports, or an empty string for "DIRECT".
+expected::ExpectedString ProxyFromPacResult(const string &result);
+
+} // namespace pac
+} // namespace http
+} // namespace common
+} // namespace mender
+
+#endif // MENDER_COMMON_HTTP_PAC_HPP
@@ -15,6 +15,7 @@
 #ifndef MENDER_COMMON_HTTP_RESUMER_HPP
 #define MENDER_COMMON_HTTP_RESUMER_HPP
 
+#include <functional>
 #include <string>
 #include <memory>
 #include <vector>
@@ -45,6 +46,32 @@ enum class DownloadResumerUserHandlersStatus {
 	BodyHandlerCalled,
 };
 
+// Why an attempt to download failed. Counted separately, so that flaky networks can be told apart
+// from broken servers or Artifacts.
+enum class DownloadFailureCause {
+	Dns,
+	Connect,
+	Tls,
+	Reset,
+	Timeout,
+	// Not detected by the resumer, but by whoever verifies the downloaded data.
+	ChecksumMismatch,
+	Other,
+};
+
+string DownloadFailureCauseToString(DownloadFailureCause cause);
+
+DownloadFailureCause ClassifyDownloadError(const error::Error &err);
+
+struct DownloadAttemptFailure {
+	DownloadFailureCause cause;
+	// Number of bytes which had been received when the attempt failed.
+	int64_t offset;
+	error::Error error;
+};
+
+using DownloadAttemptFailureHandler = function<void(const DownloadAttemptFailure &failure)>;
+
 struct DownloadResumerClientState {
 	DownloadResumerActiveStatus active_state {DownloadResumerActiveStatus::None};
 	int64_t content_length {0};
@@ -168,6 +195,16 @@ public:
 		retry_.backoff.SetMaxInterval(interval);
 	}
 
+	// Called for every attempt which fails with an error, after it has been logged, and before
+	// it is resumed or the resumer gives up. Not called for cancelled requests.
+	void SetAttemptFailureHandler(DownloadAttemptFailureHandler handler) {
+		attempt_failure_handler_ = handler;
+	}
+
+	// When an attempt stalls, make the next ones with more and more conservative link settings,
+	// see `http::LinkTuning`, and keep the ones which worked for later downloads.
+	void SetAdaptiveLinkTuning(bool enabled);
+
 private:
 	// Generate a Range request from the original user request, requesting for the missing data
 	// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Range
@@ -181,6 +218,9 @@ private:
 
 	void DoCancel();
 
+	void ReportAttemptFailure(const error::Error &err);
+	void AdaptLinkTuning(DownloadFailureCause cause);
+
 	shared_ptr<DownloadResumerClientState> resumer_state_;
 	shared_ptr<DownloadResumerAsyncReader> resumer_reader_;
 
@@ -198,6 +238,13 @@ private:
 	http::ResponseHandler user_body_handler_;
 	http::OutgoingRequestPtr user_request_;
 
+	DownloadAttemptFailureHandler attempt_failure_handler_;
+
+	bool adaptive_link_tuning_ {false};
+	http::LinkTuning configured_link_tuning_;
+	// 0 for the configured settings, otherwise the step in kAdaptiveLinkTuningSteps plus one.
+	size_t link_tuning_step_ {0};
+
 	struct {
 		http::ExponentialBackoff backoff;
 		events::Timer wait_timer;
@@ -337,6 +337,25 @@ public:
 };
 using BufferedReaderPtr = shared_ptr<BufferedReader>;
 
+// Passes reads on to another reader, and counts the bytes, for example to tell where in a stream
+// an error was found.
+class CountingReader : virtual public Reader {
+public:
+	CountingReader(ReaderPtr reader) :
+		wrapped_reader_ {reader} {};
+
+	ExpectedSize Read(vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) override;
+
+	int64_t BytesRead() const {
+		return bytes_read_;
+	}
+
+private:
+	ReaderPtr wrapped_reader_;
+	int64_t bytes_read_ {0};
+};
+using CountingReaderPtr = shared_ptr<CountingReader>;
+
 class AsyncBufferedReader : virtual public AsyncReader {
 private:
 	AsyncReader &wrapped_reader_;
@@ -385,6 +385,14 @@ void ByteReader::Rewind() {
 	bytes_read_ = 0;
 }
 
+ExpectedSize CountingReader::Read(vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) {
+	auto result = wrapped_reader_->Read(start, end);
+	if (result) {
+		bytes_read_ += result.value();
+	}
+	return result;
+}
+
 void ByteWriter::SetUnlimited(bool enabled) {
 	unlimited_ = enabled;
 }
@@ -39,6 +39,8 @@ string KeyValueDatabaseErrorCategoryClass::message(int code) const {
 		return "LMDB error";
 	case AlreadyExistsError:
 		return "Key already exists";
+	case EncryptionError:
+		return "Encryption error";
 	default:
 		return "Unknown";
 	}
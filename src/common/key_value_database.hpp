@@ -53,6 +53,9 @@ enum ErrorCode {
 
 	// When a read transaction is attempted to be used for writing.
 	TransactionError,
+
+	// When a value can't be encrypted or decrypted, see KeyValueDatabaseEncrypted.
+	EncryptionError,
 };
 using Error = mender::common::error::Error;
 
@@ -32,6 +32,24 @@ namespace key_value_database {
 
 namespace path = common::path;
 
+static error::Error SyncPath(const string &path) {
+	int fd = open(path.c_str(), O_RDONLY);
+	if (fd == -1) {
+		return error::Error(
+			generic_category().default_error_condition(errno),
+			"Failed to open '" + path + "' to sync it");
+	}
+	int ret = fsync(fd);
+	int sync_errno = errno;
+	close(fd);
+	if (ret != 0) {
+		return error::Error(
+			generic_category().default_error_condition(sync_errno),
+			"Failed to sync '" + path + "'");
+	}
+	return error::NoError;
+}
+
 error::Error FileBlobdbTransaction::SerializeDB(const DB &db) {
 	// There can be no collision because no two transactions can be serializing
 	// the DB at the same time so no random/special name needed here.
@@ -84,11 +102,25 @@ error::Error FileBlobdbTransaction::SerializeDB(const DB &db) {
 		}
 	}
 	ofs.close();
+	if (err == error::NoError && !ofs) {
+		err = error::Error(
+			generic_category().default_error_condition(errno), "Failed to write DB contents");
+	}
 
+	// All the keys of a transaction are in the one file, so they are replaced together, but only
+	// if the contents are on the disk before the rename is. Otherwise a crash right after the
+	// commit can leave an empty or truncated file, and lose all of them.
+	if (err == error::NoError) {
+		err = SyncPath(new_file_path);
+	}
 	if (err == error::NoError) {
 		if (std::rename(new_file_path.c_str(), path_or_name_.c_str()) != 0) {
 			err = error::Error(
 				generic_category().default_error_condition(errno), "Failed to replace DB contents");
+		} else {
+			// The rename itself is only durable once the directory is synced.
+			const string dir = path::DirName(path_or_name_);
+			err = SyncPath(dir == "" ? "." : dir);
 		}
 	}
 	if (err != error::NoError) {
@@ -0,0 +1,297 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/key_value_database_encrypted.hpp>
+
+#include <algorithm>
+#include <memory>
+
+#include <openssl/err.h>
+#include <openssl/evp.h>
+#include <openssl/rand.h>
+
+#include <common/common.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace common {
+namespace key_value_database {
+
+namespace common = mender::common;
+namespace log = mender::common::log;
+
+const string KeyValueDatabaseEncrypted::kMarkerKey {"store-encryption"};
+
+// What the marker holds, encrypted. Tells whether the secret is the right one.
+static const string kMarkerValue {"mender-store-encryption-v1"};
+
+// Precedes every encrypted value. Starts with a null byte, which none of the values stored in
+// cleartext by earlier clients do.
+static const vector<uint8_t> kMagic {0x00, 'M', 'E', 'N', 'C', 0x01};
+static const size_t kKeySize {32};
+static const size_t kNonceSize {12};
+static const size_t kTagSize {16};
+
+using CipherCtxPtr = unique_ptr<EVP_CIPHER_CTX, void (*)(EVP_CIPHER_CTX *)>;
+
+static Error OpenSSLError(const string &what) {
+	string message {what};
+	auto ssl_error_code = ERR_get_error();
+	while (ssl_error_code != 0) {
+		message += string(": ") + ERR_error_string(ssl_error_code, nullptr);
+		ssl_error_code = ERR_get_error();
+	}
+	return MakeError(EncryptionError, message);
+}
+
+static expected::ExpectedBytes DeriveKey(const vector<uint8_t> &secret) {
+	if (secret.size() < kKeySize) {
+		return expected::unexpected(MakeError(
+			EncryptionError,
+			"The secret must be at least " + to_string(kKeySize) + " bytes, it is "
+				+ to_string(secret.size())));
+	}
+
+	// Bind the key to its purpose, so that the same secret used elsewhere gives another key.
+	vector<uint8_t> input = common::ByteVectorFromString(kMarkerValue);
+	input.insert(input.end(), secret.begin(), secret.end());
+	vector<uint8_t> key(kKeySize);
+	unsigned int key_size {0};
+	auto ok = EVP_Digest(input.data(), input.size(), key.data(), &key_size, EVP_sha256(), nullptr);
+	fill(input.begin(), input.end(), 0);
+	if (ok != 1 || key_size != kKeySize) {
+		return expected::unexpected(OpenSSLError("Could not derive the encryption key"));
+	}
+	return key;
+}
+
+bool IsEncryptedValue(const vector<uint8_t> &value) {
+	return value.size() >= kMagic.size() + kNonceSize + kTagSize
+		   && equal(kMagic.begin(), kMagic.end(), value.begin());
+}
+
+expected::ExpectedBytes EncryptValue(
+	const vector<uint8_t> &key, const string &db_key, const vector<uint8_t> &value) {
+	vector<uint8_t> result(kMagic);
+	result.resize(kMagic.size() + kNonceSize);
+	uint8_t *nonce = result.data() + kMagic.size();
+	if (RAND_bytes(nonce, static_cast<int>(kNonceSize)) != 1) {
+		return expected::unexpected(OpenSSLError("Could not generate a nonce"));
+	}
+
+	CipherCtxPtr ctx {EVP_CIPHER_CTX_new(), EVP_CIPHER_CTX_free};
+	int len {0};
+	if (!ctx || EVP_EncryptInit_ex(ctx.get(), EVP_aes_256_gcm(), nullptr, key.data(), nonce) != 1
+		|| EVP_EncryptUpdate(
+			   ctx.get(),
+			   nullptr,
+			   &len,
+			   reinterpret_cast<const uint8_t *>(db_key.data()),
+			   static_cast<int>(db_key.size()))
+			   != 1) {
+		return expected::unexpected(OpenSSLError("Could not encrypt the value of " + db_key));
+	}
+
+	const size_t header_size = result.size();
+	result.resize(header_size + value.size() + kTagSize);
+	uint8_t *ciphertext = result.data() + header_size;
+	int ciphertext_len {0};
+	if (EVP_EncryptUpdate(
+			ctx.get(), ciphertext, &len, value.data(), static_cast<int>(value.size()))
+		!= 1) {
+		return expected::unexpected(OpenSSLError("Could not encrypt the value of " + db_key));
+	}
+	ciphertext_len = len;
+	if (EVP_EncryptFinal_ex(ctx.get(), ciphertext + ciphertext_len, &len) != 1
+		|| EVP_CIPHER_CTX_ctrl(
+			   ctx.get(),
+			   EVP_CTRL_GCM_GET_TAG,
+			   static_cast<int>(kTagSize),
+			   ciphertext + ciphertext_len + len)
+			   != 1) {
+		return expected::unexpected(OpenSSLError("Could not encrypt the value of " + db_key));
+	}
+	ciphertext_len += len;
+	result.resize(header_size + ciphertext_len + kTagSize);
+	return result;
+}
+
+expected::ExpectedBytes DecryptValue(
+	const vector<uint8_t> &key, const string &db_key, const vector<uint8_t> &value) {
+	if (!IsEncryptedValue(value)) {
+		return expected::unexpected(
+			MakeError(EncryptionError, "The value of " + db_key + " is not encrypted"));
+	}
+
+	const uint8_t *nonce = value.data() + kMagic.size();
+	const uint8_t *ciphertext = nonce + kNonceSize;
+	const size_t ciphertext_size = value.size() - kMagic.size() - kNonceSize - kTagSize;
+	// The tag is only read, but OpenSSL takes it as non-const.
+	vector<uint8_t> tag {ciphertext + ciphertext_size, value.data() + value.size()};
+
+	CipherCtxPtr ctx {EVP_CIPHER_CTX_new(), EVP_CIPHER_CTX_free};
+	int len {0};
+	if (!ctx || EVP_DecryptInit_ex(ctx.get(), EVP_aes_256_gcm(), nullptr, key.data(), nonce) != 1
+		|| EVP_DecryptUpdate(
+			   ctx.get(),
+			   nullptr,
+			   &len,
+			   reinterpret_cast<const uint8_t *>(db_key.data()),
+			   static_cast<int>(db_key.size()))
+			   != 1) {
+		return expected::unexpected(OpenSSLError("Could not decrypt the value of " + db_key));
+	}
+
+	vector<uint8_t> result(ciphertext_size);
+	int result_len {0};
+	if (EVP_DecryptUpdate(
+			ctx.get(), result.data(), &len, ciphertext, static_cast<int>(ciphertext_size))
+			!= 1
+		|| EVP_CIPHER_CTX_ctrl(
+			   ctx.get(), EVP_CTRL_GCM_SET_TAG, static_cast<int>(kTagSize), tag.data())
+			   != 1) {
+		return expected::unexpected(OpenSSLError("Could not decrypt the value of " + db_key));
+	}
+	result_len = len;
+	if (EVP_DecryptFinal_ex(ctx.get(), result.data() + result_len, &len) != 1) {
+		// Clear the queue, a failed authentication is all there is to tell.
+		ERR_clear_error();
+		return expected::unexpected(MakeError(
+			EncryptionError,
+			"The value of " + db_key + " could not be authenticated, it has been modified, or was "
+				"encrypted with another secret"));
+	}
+	result_len += len;
+	result.resize(result_len);
+	return result;
+}
+
+class EncryptedTransaction : public Transaction {
+public:
+	EncryptedTransaction(Transaction &txn, const vector<uint8_t> &key) :
+		txn_ {txn},
+		key_ {key} {
+	}
+
+	expected::ExpectedBytes Read(const string &key) override {
+		auto exp_value = txn_.Read(key);
+		if (!exp_value) {
+			return exp_value;
+		}
+		return DecryptValue(key_, key, exp_value.value());
+	}
+
+	error::Error Write(const string &key, const vector<uint8_t> &value) override {
+		auto exp_encrypted = EncryptValue(key_, key, value);
+		if (!exp_encrypted) {
+			return exp_encrypted.error();
+		}
+		return txn_.Write(key, exp_encrypted.value());
+	}
+
+	error::Error Remove(const string &key) override {
+		return txn_.Remove(key);
+	}
+
+private:
+	Transaction &txn_;
+	const vector<uint8_t> &key_;
+};
+
+KeyValueDatabaseEncrypted::KeyValueDatabaseEncrypted(KeyValueDatabase &db) :
+	db_ {db} {
+}
+
+error::Error KeyValueDatabaseEncrypted::Open(
+	const vector<uint8_t> &secret, const vector<string> &cleartext_keys) {
+	key_.clear();
+
+	auto exp_key = DeriveKey(secret);
+	if (!exp_key) {
+		return exp_key.error();
+	}
+	const auto &key = exp_key.value();
+
+	auto err = db_.WriteTransaction([&key, &cleartext_keys](Transaction &txn) {
+		auto exp_marker = txn.Read(kMarkerKey);
+		if (exp_marker) {
+			auto exp_decrypted = DecryptValue(key, kMarkerKey, exp_marker.value());
+			if (!exp_decrypted
+				|| common::StringFromByteVector(exp_decrypted.value()) != kMarkerValue) {
+				return MakeError(
+					EncryptionError, "The database was encrypted with another secret");
+			}
+			return error::NoError;
+		}
+		if (exp_marker.error().code != MakeError(KeyError, "").code) {
+			return exp_marker.error();
+		}
+
+		// Not encrypted yet. Everything is done in this transaction, so if any of it fails, the
+		// database is left as it was.
+		EncryptedTransaction encrypted_txn {txn, key};
+		int count {0};
+		for (const auto &db_key : cleartext_keys) {
+			auto exp_value = txn.Read(db_key);
+			if (!exp_value) {
+				if (exp_value.error().code == MakeError(KeyError, "").code) {
+					continue;
+				}
+				return exp_value.error();
+			}
+			auto err = encrypted_txn.Write(db_key, exp_value.value());
+			if (err != error::NoError) {
+				return err;
+			}
+			count++;
+		}
+		auto err =
+			encrypted_txn.Write(kMarkerKey, common::ByteVectorFromString(kMarkerValue));
+		if (err != error::NoError) {
+			return err;
+		}
+		log::Info("Encrypted the database, with " + to_string(count) + " existing value(s)");
+		return error::NoError;
+	});
+	if (err != error::NoError) {
+		return err.WithContext("Could not open the encrypted database");
+	}
+
+	key_ = key;
+	return error::NoError;
+}
+
+error::Error KeyValueDatabaseEncrypted::WriteTransaction(
+	function<error::Error(Transaction &)> txnFunc) {
+	AssertOrReturnError(!key_.empty());
+
+	return db_.WriteTransaction([this, &txnFunc](Transaction &txn) {
+		EncryptedTransaction encrypted_txn {txn, key_};
+		return txnFunc(encrypted_txn);
+	});
+}
+
+error::Error KeyValueDatabaseEncrypted::ReadTransaction(
+	function<error::Error(Transaction &)> txnFunc) {
+	AssertOrReturnError(!key_.empty());
+
+	return db_.ReadTransaction([this, &txnFunc](Transaction &txn) {
+		EncryptedTransaction encrypted_txn {txn, key_};
+		return txnFunc(encrypted_txn);
+	});
+}
+
+} // namespace key_value_database
+} // namespace common
+} // namespace mender
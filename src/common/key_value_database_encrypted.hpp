@@ -0,0 +1,69 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_COMMON_KEY_VALUE_DATABASE_ENCRYPTED_HPP
+#define MENDER_COMMON_KEY_VALUE_DATABASE_ENCRYPTED_HPP
+
+#include <cstdint>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/key_value_database.hpp>
+
+namespace mender {
+namespace common {
+namespace key_value_database {
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+// Encrypts the values in another database with AES-256-GCM, using the key as additional data, so
+// that values can't be moved from one key to another. The keys themselves are not encrypted.
+//
+// The database keeps a marker, which tells that it has been encrypted, and with which key. Until
+// it has one, the values are stored in cleartext, and `Open()` encrypts them.
+class KeyValueDatabaseEncrypted : public KeyValueDatabase {
+public:
+	// The database must outlive this one.
+	KeyValueDatabaseEncrypted(KeyValueDatabase &db);
+
+	// Derives the encryption key from `secret`, which must be at least 32 bytes. If the database
+	// hasn't been encrypted yet, encrypts the values under `cleartext_keys` which are there. Fails
+	// if the database was encrypted with another secret.
+	error::Error Open(const vector<uint8_t> &secret, const vector<string> &cleartext_keys);
+
+	error::Error WriteTransaction(function<error::Error(Transaction &)> txnFunc) override;
+	error::Error ReadTransaction(function<error::Error(Transaction &)> txnFunc) override;
+
+	static const string kMarkerKey;
+
+private:
+	KeyValueDatabase &db_;
+	vector<uint8_t> key_;
+};
+
+// Only here to make testing easier.
+bool IsEncryptedValue(const vector<uint8_t> &value);
+expected::ExpectedBytes EncryptValue(
+	const vector<uint8_t> &key, const string &db_key, const vector<uint8_t> &value);
+expected::ExpectedBytes DecryptValue(
+	const vector<uint8_t> &key, const string &db_key, const vector<uint8_t> &value);
+
+} // namespace key_value_database
+} // namespace common
+} // namespace mender
+
+#endif // MENDER_COMMON_KEY_VALUE_DATABASE_ENCRYPTED_HPP
@@ -0,0 +1,100 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_COMMON_LOCAL_API_HPP
+#define MENDER_COMMON_LOCAL_API_HPP
+
+#include <functional>
+#include <memory>
+#include <string>
+#include <unordered_map>
+#include <unordered_set>
+
+#include <common/config.h>
+
+#ifdef MENDER_USE_BOOST_BEAST
+#include <boost/asio.hpp>
+#include <boost/beast.hpp>
+#endif // MENDER_USE_BOOST_BEAST
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+
+namespace mender {
+namespace common {
+namespace local_api {
+
+using namespace std;
+
+#ifdef MENDER_USE_BOOST_BEAST
+namespace asio = boost::asio;
+namespace beast = boost::beast;
+#endif // MENDER_USE_BOOST_BEAST
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+
+// Takes the request body, which is the argument of the method, if it has one, and returns the
+// response body, which must be JSON.
+using MethodHandler = function<expected::ExpectedString(const string &argument)>;
+
+struct Response {
+	unsigned status;
+	string body;
+};
+
+class Connection;
+
+// Serves the methods of the D-Bus interfaces over HTTP on a Unix socket, for systems which don't
+// run a D-Bus daemon. A method is called with `POST /<interface>/<method>`, for example
+// `POST /io.mender.Update1/GetStatus`. See Documentation/local-api.md.
+class Server : public events::EventLoopObject {
+public:
+	Server(events::EventLoop &loop);
+	~Server();
+
+	void AddMethodHandler(const string &interface, const string &method, MethodHandler handler);
+
+	// Replaces a socket left behind at `socket_path`, and makes it accessible to the owner only,
+	// like the D-Bus interfaces are to root only.
+	error::Error Listen(const string &socket_path);
+	void Cancel();
+
+	// Calls the handler the request is for. Platform independent, the socket is not.
+	Response HandleRequest(const string &method, const string &target, const string &body);
+
+private:
+	unordered_map<string, MethodHandler> handlers_;
+	string socket_path_;
+
+#ifdef MENDER_USE_BOOST_BEAST
+	void AsyncAccept();
+
+	asio::local::stream_protocol::acceptor acceptor_;
+	unordered_set<shared_ptr<Connection>> connections_;
+	// Set when the server is cancelled, so that the callbacks it still gets are ignored.
+	shared_ptr<bool> cancelled_;
+
+	friend class Connection;
+#endif // MENDER_USE_BOOST_BEAST
+};
+
+} // namespace local_api
+} // namespace common
+} // namespace mender
+
+#endif // MENDER_COMMON_LOCAL_API_HPP
@@ -0,0 +1,54 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <common/local_api.hpp>
+
+#include <common/json.hpp>
+
+namespace mender {
+namespace common {
+namespace local_api {
+
+namespace json = mender::common::json;
+
+static Response ErrorResponse(unsigned status, const string &message) {
+	return Response {status, R"({"error":")" + json::EscapeString(message) + "\"}"};
+}
+
+void Server::AddMethodHandler(
+	const string &interface, const string &method, MethodHandler handler) {
+	handlers_["/" + interface + "/" + method] = handler;
+}
+
+Response Server::HandleRequest(const string &method, const string &target, const string &body) {
+	auto handler = handlers_.find(target);
+	if (handler == handlers_.end()) {
+		return ErrorResponse(404, "No such method: " + target);
+	}
+	// Methods are not idempotent, so only POST, even for those without an argument.
+	if (method != "POST") {
+		return ErrorResponse(405, "Methods must be called with POST");
+	}
+
+	auto exp_result = handler->second(body);
+	if (!exp_result) {
+		return ErrorResponse(400, exp_result.error().String());
+	}
+	return Response {200, exp_result.value()};
+}
+
+} // namespace local_api
+} // namespace common
+} // namespace mender
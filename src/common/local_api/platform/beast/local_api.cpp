@@ -0,0 +1,206 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <common/local_api.hpp>
+
+#include <unistd.h>
+
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace common {
+namespace local_api {
+
+namespace http = beast::http;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+using error_code = boost::system::error_code;
+using local = asio::local::stream_protocol;
+
+// The arguments are small, the largest are Artifact headers.
+static const size_t kMaxBodySize {1024 * 1024};
+
+static error::Error ErrorFromBoost(const error_code &ec, const string &context) {
+	return error::Error(ec.default_error_condition(), context + ": " + ec.message());
+}
+
+class Connection : public enable_shared_from_this<Connection> {
+public:
+	Connection(Server &server, local::socket socket) :
+		server_ {server},
+		cancelled_ {server.cancelled_},
+		socket_ {std::move(socket)} {
+	}
+
+	void ReadRequest() {
+		parser_ = make_shared<http::request_parser<http::string_body>>();
+		parser_->body_limit(kMaxBodySize);
+		auto self = shared_from_this();
+		http::async_read(socket_, buffer_, *parser_, [self](const error_code &ec, size_t) {
+			self->RequestRead(ec);
+		});
+	}
+
+	void Close() {
+		error_code ec;
+		socket_.close(ec);
+	}
+
+private:
+	void RequestRead(const error_code &ec) {
+		if (*cancelled_) {
+			return;
+		}
+		if (ec) {
+			if (ec != http::error::end_of_stream) {
+				log::Debug("Could not read a local API request: " + ec.message());
+			}
+			Finish();
+			return;
+		}
+
+		auto &request = parser_->get();
+		auto response = server_.HandleRequest(
+			string {request.method_string()}, string {request.target()}, request.body());
+		response_ = make_shared<http::response<http::string_body>>(
+			static_cast<http::status>(response.status), request.version());
+		response_->set(http::field::content_type, "application/json");
+		response_->keep_alive(request.keep_alive());
+		response_->body() = response.body;
+		response_->prepare_payload();
+
+		auto self = shared_from_this();
+		http::async_write(socket_, *response_, [self](const error_code &ec, size_t) {
+			self->ResponseWritten(ec);
+		});
+	}
+
+	void ResponseWritten(const error_code &ec) {
+		if (*cancelled_) {
+			return;
+		}
+		if (ec) {
+			log::Debug("Could not write a local API response: " + ec.message());
+			Finish();
+			return;
+		}
+		if (!response_->keep_alive()) {
+			Finish();
+			return;
+		}
+		ReadRequest();
+	}
+
+	void Finish() {
+		Close();
+		server_.connections_.erase(shared_from_this());
+	}
+
+	Server &server_;
+	shared_ptr<bool> cancelled_;
+	local::socket socket_;
+	beast::flat_buffer buffer_;
+	shared_ptr<http::request_parser<http::string_body>> parser_;
+	shared_ptr<http::response<http::string_body>> response_;
+};
+
+Server::Server(events::EventLoop &loop) :
+	acceptor_ {GetAsioIoContext(loop)},
+	cancelled_ {make_shared<bool>(false)} {
+}
+
+Server::~Server() {
+	Cancel();
+}
+
+error::Error Server::Listen(const string &socket_path) {
+	auto err = path::CreateDirectories(path::DirName(socket_path));
+	if (err != error::NoError) {
+		return err;
+	}
+	// Left behind if the daemon didn't exit cleanly, and binding fails as long as it is there.
+	::unlink(socket_path.c_str());
+
+	error_code ec;
+	local::endpoint endpoint {socket_path};
+	acceptor_.open(endpoint.protocol(), ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not open the local API socket");
+	}
+	acceptor_.bind(endpoint, ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not bind the local API socket to " + socket_path);
+	}
+	socket_path_ = socket_path;
+	err = path::Permissions(socket_path, {path::Perms::Owner_read, path::Perms::Owner_write});
+	if (err != error::NoError) {
+		Cancel();
+		return err;
+	}
+	acceptor_.listen(asio::socket_base::max_listen_connections, ec);
+	if (ec) {
+		Cancel();
+		return ErrorFromBoost(ec, "Could not listen on the local API socket");
+	}
+
+	*cancelled_ = false;
+	AsyncAccept();
+	return error::NoError;
+}
+
+void Server::AsyncAccept() {
+	auto cancelled = cancelled_;
+	acceptor_.async_accept([this, cancelled](const error_code &ec, local::socket socket) {
+		if (*cancelled) {
+			return;
+		}
+		if (ec) {
+			log::Error("Could not accept a local API connection: " + ec.message());
+			return;
+		}
+
+		auto connection = make_shared<Connection>(*this, std::move(socket));
+		connections_.insert(connection);
+		connection->ReadRequest();
+
+		AsyncAccept();
+	});
+}
+
+void Server::Cancel() {
+	*cancelled_ = true;
+	// A new one, so that callbacks of the cancelled connections keep seeing `true`.
+	cancelled_ = make_shared<bool>(true);
+
+	if (acceptor_.is_open()) {
+		error_code ec;
+		acceptor_.close(ec);
+	}
+	for (auto &connection : connections_) {
+		connection->Close();
+	}
+	connections_.clear();
+
+	if (socket_path_ != "") {
+		::unlink(socket_path_.c_str());
+		socket_path_ = "";
+	}
+}
+
+} // namespace local_api
+} // namespace common
+} // namespace mender
@@ -22,8 +22,10 @@
 #include <boost/log/sources/logger.hpp>
 #endif
 
-#include <string>
+#include <atomic>
 #include <cassert>
+#include <memory>
+#include <string>
 
 #include <common/error.hpp>
 #include <common/expected.hpp>
@@ -41,6 +43,7 @@ enum LogErrorCode {
 	NoError = 0,
 	InvalidLogLevelError,
 	LogFileError,
+	InvalidLogFormatError,
 };
 
 class LogErrorCategoryClass : public std::error_category {
@@ -97,6 +100,25 @@ const LogLevel kDefaultLogLevel = LogLevel::Info;
 
 ExpectedLogLevel StringToLogLevel(const string &level_str);
 
+enum class LogFormat {
+	// `key="value"` pairs, one record per line.
+	Logfmt,
+	// One JSON object per line, for log collectors.
+	Json,
+};
+
+using ExpectedLogFormat = expected::expected<LogFormat, error::Error>;
+
+ExpectedLogFormat StringToLogFormat(const string &format_str);
+
+// Level override shared by all the loggers of one module. The module of a logger is its name, up
+// to the first ':', if any. Since the override is looked up on every log call, changing it takes
+// effect immediately, also for loggers that already exist.
+struct ModuleLevel {
+	atomic<bool> overridden {false};
+	atomic<LogLevel> level {kDefaultLogLevel};
+};
+
 class Logger {
 private:
 #ifdef MENDER_LOG_BOOST
@@ -107,6 +129,8 @@ private:
 
 	LogLevel level_;
 
+	shared_ptr<ModuleLevel> module_level_;
+
 	void AddField(const LogField &field);
 
 	void Log_(LogLevel level, const string &message);
@@ -130,7 +154,7 @@ public:
 	}
 
 	void Log(LogLevel level, const string &message) {
-		if (level <= this->level_) {
+		if (level <= Level()) {
 			Log_(level, message);
 		}
 	}
@@ -175,8 +199,25 @@ extern Logger global_logger_;
 
 void SetLevel(LogLevel level);
 
+// Overrides the level of all loggers of the given module, see `ModuleLevel`.
+void SetModuleLevel(const string &module, LogLevel level);
+// Removes the override, so that loggers of the module use their own level again.
+void ClearModuleLevel(const string &module);
+// Convenience version for configuration and remote control. An empty `module` sets the global
+// level, and an empty `level_str` removes the override of the module.
+error::Error SetModuleLevel(const string &module, const string &level_str);
+
 error::Error SetupFileLogging(const string &log_file_path, bool exclusive = true);
 
+// Sets the format of all the log output, including the log file, if any.
+void SetFormat(LogFormat format);
+LogFormat Format();
+
+// Adds a field to all records of all loggers, until it is removed again. Setting a field which is
+// already set replaces its value.
+void SetGlobalField(const LogField &field);
+void RemoveGlobalField(const string &key);
+
 LogLevel Level();
 
 template <typename... Fields>
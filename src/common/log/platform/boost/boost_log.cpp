@@ -27,8 +27,13 @@
 #include <boost/log/attributes/scoped_attribute.hpp>
 #include <boost/log/support/date_time.hpp>
 
-#include <string>
+#include <atomic>
+#include <cstdio>
 #include <fstream>
+#include <mutex>
+#include <string>
+#include <unordered_map>
+
 #include <common/error.hpp>
 #include <common/expected.hpp>
 
@@ -62,6 +67,8 @@ string LogErrorCategoryClass::message(int code) const {
 		return "Invalid log level given";
 	case LogFileError:
 		return "Bad log file";
+	case InvalidLogFormatError:
+		return "Invalid log format given";
 	default:
 		return "Unknown";
 	}
@@ -90,6 +97,20 @@ ExpectedLogLevel StringToLogLevel(const string &level_str) {
 	}
 }
 
+ExpectedLogFormat StringToLogFormat(const string &format_str) {
+	if (format_str == "logfmt") {
+		return ExpectedLogFormat(LogFormat::Logfmt);
+	} else if (format_str == "json") {
+		return ExpectedLogFormat(LogFormat::Json);
+	} else {
+		return ExpectedLogFormat(expected::unexpected(MakeError(
+			LogErrorCode::InvalidLogFormatError,
+			"'" + format_str + "' is not a valid log format, expected 'logfmt' or 'json'")));
+	}
+}
+
+static atomic<LogFormat> log_format {LogFormat::Logfmt};
+
 static void LogfmtFormatter(logging::record_view const &rec, logging::formatting_ostream &strm) {
 	strm << "record_id=" << logging::extract<unsigned int>("RecordID", rec) << " ";
 
@@ -119,6 +140,79 @@ static void LogfmtFormatter(logging::record_view const &rec, logging::formatting
 	strm << "msg=\"" << rec[expr::smessage] << "\" ";
 }
 
+// The log library can't depend on the JSON library, so it has its own escaping.
+static string EscapeJsonString(const string &str) {
+	string escaped;
+	escaped.reserve(str.size());
+	for (auto c : str) {
+		switch (c) {
+		case '"':
+			escaped += "\\\"";
+			break;
+		case '\\':
+			escaped += "\\\\";
+			break;
+		case '\n':
+			escaped += "\\n";
+			break;
+		case '\r':
+			escaped += "\\r";
+			break;
+		case '\t':
+			escaped += "\\t";
+			break;
+		default:
+			if (static_cast<unsigned char>(c) < 0x20) {
+				char buf[7];
+				snprintf(buf, sizeof(buf), "\\u%04x", static_cast<unsigned int>(c));
+				escaped += buf;
+			} else {
+				escaped += c;
+			}
+		}
+	}
+	return escaped;
+}
+
+static void JsonFormatter(logging::record_view const &rec, logging::formatting_ostream &strm) {
+	strm << "{";
+
+	auto val = logging::extract<boost::posix_time::ptime>("TimeStamp", rec);
+	if (val) {
+		strm << R"("timestamp":")" << boost::posix_time::to_iso_extended_string(val.get())
+			 << "\",";
+	}
+
+	auto level = logging::extract<LogLevel>("Severity", rec);
+	if (level) {
+		strm << R"("level":")" << ToStringLogLevel(level.get()) << "\",";
+	}
+
+	auto name = logging::extract<std::string>("Name", rec);
+	if (name) {
+		strm << R"("module":")" << EscapeJsonString(name.get()) << "\",";
+	}
+
+	for (auto f : rec.attribute_values()) {
+		auto field = logging::extract<LogField>(f.first.string(), rec);
+		if (field) {
+			strm << "\"" << EscapeJsonString(field.get().key) << R"(":")"
+				 << EscapeJsonString(field.get().value) << "\",";
+		}
+	}
+
+	auto message = rec[expr::smessage];
+	strm << R"("message":")" << EscapeJsonString(message ? *message : "") << "\"}";
+}
+
+static void Formatter(logging::record_view const &rec, logging::formatting_ostream &strm) {
+	if (log_format == LogFormat::Json) {
+		JsonFormatter(rec, strm);
+	} else {
+		LogfmtFormatter(rec, strm);
+	}
+}
+
 static void SetupLoggerSinks() {
 	typedef sinks::synchronous_sink<sinks::text_ostream_backend> text_sink;
 	boost::shared_ptr<text_sink> sink(new text_sink);
@@ -129,7 +223,7 @@ static void SetupLoggerSinks() {
 		pBackend->add_stream(pStream);
 	}
 
-	sink->set_formatter(&LogfmtFormatter);
+	sink->set_formatter(&Formatter);
 
 	logging::core::get()->add_sink(sink);
 }
@@ -142,14 +236,30 @@ static void SetupLoggerAttributes() {
 	logging::core::get()->add_global_attribute("TimeStamp", TimeStamp);
 }
 
+static shared_ptr<ModuleLevel> GetModuleLevel(const string &logger_name) {
+	// Function local statics, since loggers may be constructed during static initialization.
+	static mutex module_levels_lock;
+	static unordered_map<string, shared_ptr<ModuleLevel>> module_levels;
+
+	const string module = logger_name.substr(0, logger_name.find(':'));
+
+	lock_guard<mutex> lock(module_levels_lock);
+	auto &module_level = module_levels[module];
+	if (!module_level) {
+		module_level = make_shared<ModuleLevel>();
+	}
+	return module_level;
+}
+
 Logger::Logger(const string &name) :
-	Logger {name, global_logger_.Level()} {
+	Logger {name, global_logger_.level_} {
 }
 
 Logger::Logger(const string &name, LogLevel level) :
 	logger_ {new src::severity_logger<LogLevel>},
 	name_ {name},
-	level_ {level} {
+	level_ {level},
+	module_level_ {GetModuleLevel(name)} {
 	this->logger_->add_attribute("Name", attrs::constant<std::string>(name));
 }
 
@@ -162,6 +272,9 @@ void Logger::SetLevel(LogLevel level) {
 }
 
 LogLevel Logger::Level() {
+	if (this->module_level_->overridden) {
+		return this->module_level_->level;
+	}
 	return this->level_;
 }
 
@@ -186,6 +299,34 @@ void SetLevel(LogLevel level) {
 	global_logger_.SetLevel(level);
 }
 
+void SetModuleLevel(const string &module, LogLevel level) {
+	auto module_level = GetModuleLevel(module);
+	module_level->level = level;
+	module_level->overridden = true;
+}
+
+void ClearModuleLevel(const string &module) {
+	GetModuleLevel(module)->overridden = false;
+}
+
+error::Error SetModuleLevel(const string &module, const string &level_str) {
+	if (module != "" && level_str == "") {
+		ClearModuleLevel(module);
+		return error::NoError;
+	}
+
+	auto ex_level = StringToLogLevel(level_str);
+	if (!ex_level) {
+		return ex_level.error();
+	}
+	if (module == "") {
+		SetLevel(ex_level.value());
+	} else {
+		SetModuleLevel(module, ex_level.value());
+	}
+	return error::NoError;
+}
+
 error::Error SetupFileLogging(const string &log_file_path, bool exclusive) {
 	typedef sinks::synchronous_sink<sinks::text_ostream_backend> text_sink;
 	boost::shared_ptr<text_sink> sink = boost::make_shared<text_sink>();
@@ -200,7 +341,7 @@ error::Error SetupFileLogging(const string &log_file_path, bool exclusive) {
 			LogErrorCode::LogFileError,
 			"Failed to open '" + log_file_path + "' for logging: " + strerror(io_errno));
 	}
-	sink->set_formatter(&LogfmtFormatter);
+	sink->set_formatter(&Formatter);
 
 	sink->locked_backend()->add_stream(log_stream);
 	sink->locked_backend()->auto_flush(true);
@@ -215,6 +356,42 @@ error::Error SetupFileLogging(const string &log_file_path, bool exclusive) {
 	return error::NoError;
 }
 
+void SetFormat(LogFormat format) {
+	log_format = format;
+}
+
+LogFormat Format() {
+	return log_format;
+}
+
+// The core only hands out copies of the global attributes, so the attributes added here are
+// tracked, to be able to remove them again.
+static mutex global_fields_lock;
+static unordered_map<string, logging::attribute_set::iterator> global_fields;
+
+void SetGlobalField(const LogField &field) {
+	auto core = logging::core::get();
+	lock_guard<mutex> lock(global_fields_lock);
+	auto existing = global_fields.find(field.key);
+	if (existing != global_fields.end()) {
+		core->remove_global_attribute(existing->second);
+		global_fields.erase(existing);
+	}
+	auto added = core->add_global_attribute(field.key, attrs::constant<LogField>(field));
+	if (added.second) {
+		global_fields[field.key] = added.first;
+	}
+}
+
+void RemoveGlobalField(const string &key) {
+	lock_guard<mutex> lock(global_fields_lock);
+	auto existing = global_fields.find(key);
+	if (existing != global_fields.end()) {
+		logging::core::get()->remove_global_attribute(existing->second);
+		global_fields.erase(existing);
+	}
+}
+
 LogLevel Level() {
 	return global_logger_.Level();
 }
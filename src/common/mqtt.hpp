@@ -0,0 +1,179 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_COMMON_MQTT_HPP
+#define MENDER_COMMON_MQTT_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <functional>
+#include <memory>
+#include <set>
+#include <string>
+#include <vector>
+
+#include <common/config.h>
+
+#ifdef MENDER_USE_BOOST_ASIO
+#include <boost/asio.hpp>
+#include <boost/asio/ssl.hpp>
+#endif // MENDER_USE_BOOST_ASIO
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+#include <common/optional.hpp>
+
+namespace mender {
+namespace common {
+namespace mqtt {
+
+using namespace std;
+
+#ifdef MENDER_USE_BOOST_ASIO
+namespace asio = boost::asio;
+namespace ssl = asio::ssl;
+#endif // MENDER_USE_BOOST_ASIO
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+
+enum MqttErrorCode {
+	NoError = 0,
+	InvalidUrlError,
+	ProtocolError,
+	ConnectionRefusedError,
+};
+
+class MqttErrorCategoryClass : public std::error_category {
+public:
+	const char *name() const noexcept override;
+	string message(int code) const override;
+};
+extern const MqttErrorCategoryClass MqttErrorCategory;
+
+error::Error MakeError(MqttErrorCode code, const string &msg);
+
+struct Broker {
+	bool tls;
+	string host;
+	uint16_t port;
+};
+
+// Accepts `mqtt://host[:port]`, and `mqtts://host[:port]` for TLS. The default ports are 1883 and
+// 8883.
+error::Error BreakDownBrokerUrl(const string &url, Broker &broker);
+
+struct ClientConfig {
+	string broker_url;
+	// May be empty, then the broker assigns one.
+	string client_id;
+	string username;
+	string password;
+	// For TLS: a CA certificate to verify the broker with, on top of the system ones.
+	string server_cert_path;
+	// For TLS: the certificate and key to authenticate to the broker with, if any.
+	string client_cert_path;
+	string client_cert_key_path;
+	// How long a whole session may take.
+	chrono::seconds timeout {30};
+};
+
+struct Message {
+	string topic;
+	string payload;
+	// Only 0 and 1 are supported.
+	int qos {0};
+	bool retain {false};
+};
+
+// Control packet types, as in the high nibble of the first byte.
+const uint8_t kConnackPacket {2};
+const uint8_t kPubackPacket {4};
+
+struct Packet {
+	uint8_t type;
+	uint8_t flags;
+	string body;
+};
+using ExpectedOptionalPacket = expected::expected<optional<Packet>, error::Error>;
+
+// The MQTT 3.1.1 packets which the publisher sends.
+string ConnectPacket(const ClientConfig &config);
+string PublishPacket(const Message &message, uint16_t packet_id);
+string DisconnectPacket();
+
+// Takes the first packet out of the buffer, or returns nullopt if the buffer doesn't hold a
+// whole packet yet.
+ExpectedOptionalPacket TakePacket(string &buffer);
+
+using PublishHandler = function<void(error::Error err)>;
+
+// Publishes messages to an MQTT 3.1.1 broker, over TCP or TLS. Every call to `AsyncPublish()` is
+// a separate session, in which the client connects, publishes the messages, waits until the broker
+// has acknowledged the QoS 1 ones, and disconnects. Subscribing is not supported.
+class Publisher : public events::EventLoopObject {
+public:
+	Publisher(events::EventLoop &loop, const ClientConfig &config);
+	~Publisher();
+
+	// Only one session can be ongoing at a time. The handler is not called if this returns an
+	// error, and must not destroy the publisher.
+	error::Error AsyncPublish(const vector<Message> &messages, PublishHandler handler);
+
+	void Cancel();
+
+private:
+#ifdef MENDER_USE_BOOST_ASIO
+	using Stream = ssl::stream<asio::ip::tcp::socket>;
+	using IoHandler = function<void(const boost::system::error_code &ec, size_t num_bytes)>;
+
+	error::Error InitializeTls();
+
+	void Resolved(asio::ip::tcp::resolver::results_type results);
+	void Connected();
+	void AsyncWriteOutgoing(IoHandler handler);
+	void AsyncReadIncoming();
+	void HandleIncoming();
+	void Finish(error::Error err);
+
+	events::EventLoop &loop_;
+	ClientConfig config_;
+	Broker broker_;
+
+	ssl::context ssl_ctx_ {ssl::context::tls_client};
+	bool tls_initialized_ {false};
+	asio::ip::tcp::resolver resolver_;
+	// The TLS layer is only used with `mqtts://` brokers, otherwise the socket under it is used
+	// directly.
+	shared_ptr<Stream> stream_;
+	events::Timer timer_;
+	// Set when the ongoing session is over, so that the callbacks it still gets are ignored.
+	shared_ptr<bool> cancelled_;
+	PublishHandler handler_;
+
+	string outgoing_;
+	string incoming_;
+	vector<char> read_buffer_;
+	bool connack_received_ {false};
+	set<uint16_t> unacknowledged_;
+#endif // MENDER_USE_BOOST_ASIO
+};
+
+} // namespace mqtt
+} // namespace common
+} // namespace mender
+
+#endif // MENDER_COMMON_MQTT_HPP
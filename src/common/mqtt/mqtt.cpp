@@ -0,0 +1,187 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/mqtt.hpp>
+
+#include <common/common.hpp>
+
+namespace mender {
+namespace common {
+namespace mqtt {
+
+namespace common = mender::common;
+
+const MqttErrorCategoryClass MqttErrorCategory;
+
+const char *MqttErrorCategoryClass::name() const noexcept {
+	return "MqttErrorCategory";
+}
+
+string MqttErrorCategoryClass::message(int code) const {
+	switch (code) {
+	case NoError:
+		return "Success";
+	case InvalidUrlError:
+		return "Invalid MQTT broker URL";
+	case ProtocolError:
+		return "MQTT protocol error";
+	case ConnectionRefusedError:
+		return "MQTT connection refused";
+	default:
+		return "Unknown";
+	}
+}
+
+error::Error MakeError(MqttErrorCode code, const string &msg) {
+	return error::Error(error_condition(code, MqttErrorCategory), msg);
+}
+
+error::Error BreakDownBrokerUrl(const string &url, Broker &broker) {
+	string rest;
+	if (url.rfind("mqtt://", 0) == 0) {
+		broker.tls = false;
+		broker.port = 1883;
+		rest = url.substr(string("mqtt://").size());
+	} else if (url.rfind("mqtts://", 0) == 0) {
+		broker.tls = true;
+		broker.port = 8883;
+		rest = url.substr(string("mqtts://").size());
+	} else {
+		return MakeError(InvalidUrlError, url + " must start with mqtt:// or mqtts://");
+	}
+
+	if (rest.size() > 0 && rest.back() == '/') {
+		rest.pop_back();
+	}
+	if (rest.find('/') != string::npos) {
+		return MakeError(InvalidUrlError, url + ": paths are not supported");
+	}
+
+	auto port_index = rest.rfind(':');
+	if (port_index != string::npos) {
+		auto exp_port = common::StringTo<uint16_t>(rest.substr(port_index + 1));
+		if (!exp_port || exp_port.value() == 0) {
+			return MakeError(InvalidUrlError, url + " contains an invalid port number");
+		}
+		broker.port = exp_port.value();
+		rest = rest.substr(0, port_index);
+	}
+	if (rest == "") {
+		return MakeError(InvalidUrlError, url + ": missing hostname");
+	}
+	broker.host = rest;
+
+	return error::NoError;
+}
+
+static string EncodeUint16(uint16_t value) {
+	return string {static_cast<char>(value >> 8), static_cast<char>(value & 0xff)};
+}
+
+static string EncodeString(const string &value) {
+	return EncodeUint16(static_cast<uint16_t>(value.size())) + value;
+}
+
+// The first byte, followed by the length of the rest, in 7 bit groups, least significant first.
+static string FixedHeader(uint8_t first_byte, size_t remaining_length) {
+	string header {static_cast<char>(first_byte)};
+	do {
+		uint8_t byte = static_cast<uint8_t>(remaining_length % 128);
+		remaining_length /= 128;
+		if (remaining_length > 0) {
+			byte |= 0x80;
+		}
+		header += static_cast<char>(byte);
+	} while (remaining_length > 0);
+	return header;
+}
+
+string ConnectPacket(const ClientConfig &config) {
+	// Always a clean session, nothing is kept between the sessions.
+	uint8_t flags {0x02};
+	if (config.username != "") {
+		flags |= 0x80;
+		// A password can only be given along with a username.
+		if (config.password != "") {
+			flags |= 0x40;
+		}
+	}
+
+	const uint16_t keep_alive_seconds {60};
+	string body = EncodeString("MQTT") + static_cast<char>(4) + static_cast<char>(flags)
+				  + EncodeUint16(keep_alive_seconds) + EncodeString(config.client_id);
+	if (config.username != "") {
+		body += EncodeString(config.username);
+		if (config.password != "") {
+			body += EncodeString(config.password);
+		}
+	}
+	return FixedHeader(0x10, body.size()) + body;
+}
+
+string PublishPacket(const Message &message, uint16_t packet_id) {
+	uint8_t first_byte = 0x30 | static_cast<uint8_t>(message.qos << 1);
+	if (message.retain) {
+		first_byte |= 0x01;
+	}
+
+	string body = EncodeString(message.topic);
+	if (message.qos > 0) {
+		body += EncodeUint16(packet_id);
+	}
+	body += message.payload;
+	return FixedHeader(first_byte, body.size()) + body;
+}
+
+string DisconnectPacket() {
+	return FixedHeader(0xe0, 0);
+}
+
+ExpectedOptionalPacket TakePacket(string &buffer) {
+	size_t remaining_length {0};
+	size_t multiplier {1};
+	size_t pos {1};
+	while (true) {
+		if (pos > 4) {
+			return expected::unexpected(
+				MakeError(ProtocolError, "Malformed remaining length in a packet from the broker"));
+		}
+		if (pos >= buffer.size()) {
+			return optional<Packet> {};
+		}
+		const uint8_t byte = static_cast<uint8_t>(buffer[pos++]);
+		remaining_length += (byte & 0x7f) * multiplier;
+		multiplier *= 128;
+		if ((byte & 0x80) == 0) {
+			break;
+		}
+	}
+
+	if (buffer.size() < pos + remaining_length) {
+		return optional<Packet> {};
+	}
+
+	const uint8_t first_byte = static_cast<uint8_t>(buffer[0]);
+	Packet packet {
+		static_cast<uint8_t>(first_byte >> 4),
+		static_cast<uint8_t>(first_byte & 0x0f),
+		buffer.substr(pos, remaining_length),
+	};
+	buffer.erase(0, pos + remaining_length);
+	return optional<Packet> {packet};
+}
+
+} // namespace mqtt
+} // namespace common
+} // namespace mender
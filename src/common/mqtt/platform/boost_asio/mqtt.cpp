@@ -0,0 +1,368 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/mqtt.hpp>
+
+#include <boost/asio/ssl/host_name_verification.hpp>
+
+#include <common/log.hpp>
+
+namespace mender {
+namespace common {
+namespace mqtt {
+
+namespace log = mender::common::log;
+
+using error_code = boost::system::error_code;
+
+static const size_t kReadBufferSize {4096};
+
+static error::Error ErrorFromBoost(const error_code &ec, const string &context) {
+	return error::Error(ec.default_error_condition(), context + ": " + ec.message());
+}
+
+static string ConnackReason(uint8_t return_code) {
+	switch (return_code) {
+	case 1:
+		return "Unacceptable protocol version";
+	case 2:
+		return "Client identifier rejected";
+	case 3:
+		return "Server unavailable";
+	case 4:
+		return "Bad username or password";
+	case 5:
+		return "Not authorized";
+	default:
+		return "Return code " + to_string(return_code);
+	}
+}
+
+Publisher::Publisher(events::EventLoop &loop, const ClientConfig &config) :
+	loop_ {loop},
+	config_ {config},
+	resolver_ {GetAsioIoContext(loop)},
+	timer_ {loop},
+	read_buffer_(kReadBufferSize) {
+}
+
+Publisher::~Publisher() {
+	if (cancelled_) {
+		*cancelled_ = true;
+	}
+	if (stream_) {
+		error_code ec;
+		stream_->lowest_layer().close(ec);
+	}
+}
+
+error::Error Publisher::InitializeTls() {
+	if (tls_initialized_) {
+		return error::NoError;
+	}
+
+	// Start from scratch, also if an earlier attempt failed half way.
+	ssl_ctx_ = ssl::context {ssl::context::tls_client};
+	ssl_ctx_.set_verify_mode(ssl::verify_peer);
+
+	error_code ec;
+	ssl_ctx_.set_default_verify_paths(ec);
+	if (ec) {
+		if (config_.server_cert_path == "") {
+			return ErrorFromBoost(ec, "Failed to load the SSL default directory");
+		}
+		log::Info("Failed to load the SSL default directory: " + ec.message());
+	}
+	if (config_.server_cert_path != "") {
+		ssl_ctx_.load_verify_file(config_.server_cert_path, ec);
+		if (ec) {
+			return ErrorFromBoost(
+				ec, "Could not load the server certificate " + config_.server_cert_path);
+		}
+	}
+
+	if (config_.client_cert_path != "" && config_.client_cert_key_path != "") {
+		ssl_ctx_.use_certificate_chain_file(config_.client_cert_path, ec);
+		if (ec) {
+			return ErrorFromBoost(
+				ec, "Could not load the client certificate " + config_.client_cert_path);
+		}
+		ssl_ctx_.use_private_key_file(config_.client_cert_key_path, ssl::context::pem, ec);
+		if (ec) {
+			return ErrorFromBoost(
+				ec, "Could not load the client certificate key " + config_.client_cert_key_path);
+		}
+	} else if (config_.client_cert_path != "" || config_.client_cert_key_path != "") {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"Cannot set only one of client certificate, and client certificate private key");
+	}
+
+	tls_initialized_ = true;
+	return error::NoError;
+}
+
+error::Error Publisher::AsyncPublish(const vector<Message> &messages, PublishHandler handler) {
+	if (handler_) {
+		return error::Error(
+			make_error_condition(errc::operation_in_progress),
+			"Already publishing to the MQTT broker");
+	}
+
+	auto err = BreakDownBrokerUrl(config_.broker_url, broker_);
+	if (err != error::NoError) {
+		return err;
+	}
+	if (broker_.tls) {
+		err = InitializeTls();
+		if (err != error::NoError) {
+			return err;
+		}
+	}
+
+	outgoing_ = ConnectPacket(config_);
+	unacknowledged_.clear();
+	uint16_t packet_id {0};
+	for (const auto &message : messages) {
+		if (message.qos < 0 || message.qos > 1) {
+			return error::Error(
+				make_error_condition(errc::invalid_argument),
+				"Unsupported QoS " + to_string(message.qos) + ", must be 0 or 1");
+		}
+		if (message.qos == 1) {
+			unacknowledged_.insert(++packet_id);
+		}
+		outgoing_ += PublishPacket(message, message.qos == 1 ? packet_id : 0);
+	}
+
+	incoming_.clear();
+	connack_received_ = false;
+	handler_ = handler;
+	cancelled_ = make_shared<bool>(false);
+	stream_ = make_shared<Stream>(GetAsioIoContext(loop_), ssl_ctx_);
+
+	auto cancelled = cancelled_;
+	timer_.AsyncWait(config_.timeout, [this, cancelled](error::Error err) {
+		if (*cancelled || err != error::NoError) {
+			return;
+		}
+		Finish(error::Error(
+			make_error_condition(errc::timed_out), "Timed out publishing to the MQTT broker"));
+	});
+
+	resolver_.async_resolve(
+		broker_.host,
+		to_string(broker_.port),
+		[this, cancelled](
+			const error_code &ec, const asio::ip::tcp::resolver::results_type &results) {
+			if (*cancelled) {
+				return;
+			}
+			if (ec) {
+				Finish(ErrorFromBoost(ec, "Could not resolve " + broker_.host));
+				return;
+			}
+			Resolved(results);
+		});
+
+	return error::NoError;
+}
+
+void Publisher::Resolved(asio::ip::tcp::resolver::results_type results) {
+	auto cancelled = cancelled_;
+	auto stream = stream_;
+	asio::async_connect(
+		stream->lowest_layer(),
+		results,
+		[this, cancelled, stream](const error_code &ec, const asio::ip::tcp::endpoint &endpoint) {
+			if (*cancelled) {
+				return;
+			}
+			if (ec) {
+				Finish(ErrorFromBoost(ec, "Could not connect to the MQTT broker " + broker_.host));
+				return;
+			}
+			log::Debug("Connected to the MQTT broker at " + endpoint.address().to_string());
+			Connected();
+		});
+}
+
+void Publisher::Connected() {
+	auto cancelled = cancelled_;
+	auto stream = stream_;
+
+	auto write_packets = [this, cancelled, stream]() {
+		AsyncWriteOutgoing([this, cancelled, stream](const error_code &ec, size_t) {
+			if (*cancelled) {
+				return;
+			}
+			if (ec) {
+				Finish(ErrorFromBoost(ec, "Could not send to the MQTT broker"));
+				return;
+			}
+			AsyncReadIncoming();
+		});
+	};
+
+	if (!broker_.tls) {
+		write_packets();
+		return;
+	}
+
+	// We can't avoid a C style cast on this next line. The usual method by which system headers
+	// are excluded from warnings doesn't work, because `SSL_set_tlsext_host_name` is a macro,
+	// containing a cast, which expands here, not in the original file. So just disable the
+	// warning here.
+#ifdef __clang__
+#pragma clang diagnostic push
+#pragma clang diagnostic ignored "-Wold-style-cast"
+#else
+#pragma GCC diagnostic push
+#pragma GCC diagnostic ignored "-Wold-style-cast"
+#endif
+	// Set SNI Hostname (many hosts need this to handshake successfully)
+	if (!SSL_set_tlsext_host_name(stream->native_handle(), broker_.host.c_str())) {
+#ifdef __clang__
+#pragma clang diagnostic pop
+#else
+#pragma GCC diagnostic pop
+#endif
+		error_code ec {static_cast<int>(::ERR_get_error()), asio::error::get_ssl_category()};
+		log::Warning("Failed to set SNI host name: " + ec.message());
+	}
+
+	error_code ec;
+	stream->set_verify_callback(ssl::host_name_verification(broker_.host), ec);
+	if (ec) {
+		Finish(ErrorFromBoost(ec, "Failed to enable host name verification"));
+		return;
+	}
+
+	stream->async_handshake(
+		ssl::stream_base::client, [this, cancelled, write_packets](const error_code &ec) {
+			if (*cancelled) {
+				return;
+			}
+			if (ec) {
+				Finish(ErrorFromBoost(ec, "TLS handshake with the MQTT broker failed"));
+				return;
+			}
+			write_packets();
+		});
+}
+
+void Publisher::AsyncWriteOutgoing(IoHandler handler) {
+	if (broker_.tls) {
+		asio::async_write(*stream_, asio::buffer(outgoing_), handler);
+	} else {
+		asio::async_write(stream_->next_layer(), asio::buffer(outgoing_), handler);
+	}
+}
+
+void Publisher::AsyncReadIncoming() {
+	auto cancelled = cancelled_;
+	auto stream = stream_;
+	IoHandler handler = [this, cancelled, stream](const error_code &ec, size_t num_bytes) {
+		if (*cancelled) {
+			return;
+		}
+		if (ec) {
+			Finish(ErrorFromBoost(ec, "Could not receive from the MQTT broker"));
+			return;
+		}
+		incoming_.append(read_buffer_.data(), num_bytes);
+		HandleIncoming();
+	};
+
+	if (broker_.tls) {
+		stream->async_read_some(asio::buffer(read_buffer_), handler);
+	} else {
+		stream->next_layer().async_read_some(asio::buffer(read_buffer_), handler);
+	}
+}
+
+void Publisher::HandleIncoming() {
+	while (true) {
+		auto exp_packet = TakePacket(incoming_);
+		if (!exp_packet) {
+			Finish(exp_packet.error());
+			return;
+		}
+		if (!exp_packet.value()) {
+			break;
+		}
+
+		const auto &packet = exp_packet.value().value();
+		if (!connack_received_) {
+			if (packet.type != kConnackPacket || packet.body.size() != 2) {
+				Finish(MakeError(ProtocolError, "Expected a CONNACK packet from the broker"));
+				return;
+			}
+			const uint8_t return_code = static_cast<uint8_t>(packet.body[1]);
+			if (return_code != 0) {
+				Finish(MakeError(
+					ConnectionRefusedError,
+					"The MQTT broker refused the connection: " + ConnackReason(return_code)));
+				return;
+			}
+			connack_received_ = true;
+		} else if (packet.type == kPubackPacket && packet.body.size() == 2) {
+			const uint16_t packet_id = static_cast<uint16_t>(
+				(static_cast<uint8_t>(packet.body[0]) << 8) | static_cast<uint8_t>(packet.body[1]));
+			unacknowledged_.erase(packet_id);
+		}
+	}
+
+	if (!connack_received_ || !unacknowledged_.empty()) {
+		AsyncReadIncoming();
+		return;
+	}
+
+	auto cancelled = cancelled_;
+	auto stream = stream_;
+	outgoing_ = DisconnectPacket();
+	AsyncWriteOutgoing([this, cancelled, stream](const error_code &ec, size_t) {
+		if (*cancelled) {
+			return;
+		}
+		// Everything was acknowledged already, so failing to say goodbye doesn't matter.
+		if (ec) {
+			log::Debug("Could not disconnect from the MQTT broker: " + ec.message());
+		}
+		Finish(error::NoError);
+	});
+}
+
+void Publisher::Cancel() {
+	if (handler_) {
+		Finish(error::Error(
+			make_error_condition(errc::operation_canceled), "Publishing was cancelled"));
+	}
+}
+
+void Publisher::Finish(error::Error err) {
+	*cancelled_ = true;
+	timer_.Cancel();
+	resolver_.cancel();
+	error_code ec;
+	stream_->lowest_layer().close(ec);
+
+	auto handler = handler_;
+	handler_ = nullptr;
+	handler(err);
+}
+
+} // namespace mqtt
+} // namespace common
+} // namespace mender
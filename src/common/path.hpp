@@ -16,6 +16,7 @@
 #define MENDER_COMMON_PATH_HPP
 
 #include <functional>
+#include <memory>
 #include <string>
 
 #include <common/error.hpp>
@@ -90,8 +91,32 @@ error::Error DataSyncRecursively(const string &dir);
 error::Error Rename(const string &oldname, const string &newname);
 error::Error FileCopy(const string &what, const string &where);
 
+// Only meant for comparing with an earlier value for the same file, the epoch is unspecified.
+expected::ExpectedInt64 LastWriteTime(const string &path);
+
 expected::ExpectedBool IsWithinOrEqual(const string &check_path, const string &target_dir);
 
+// An exclusive lock on a file, held until it is destroyed. Only keeps out those who take the same
+// lock, and within one process, taking it twice waits forever.
+class FileLock {
+public:
+	FileLock(int fd) :
+		fd_ {fd} {
+	}
+	~FileLock();
+
+	FileLock(const FileLock &) = delete;
+	FileLock &operator=(const FileLock &) = delete;
+
+private:
+	int fd_;
+};
+using FileLockPtr = unique_ptr<FileLock>;
+using ExpectedFileLock = expected::expected<FileLockPtr, error::Error>;
+
+// Creates the file if it doesn't exist, and waits until the lock is free.
+ExpectedFileLock LockFile(const string &path);
+
 } // namespace path
 } // namespace common
 } // namespace mender
@@ -235,6 +235,17 @@ error::Error FileCopy(const string &what, const string &where) {
 	return error::NoError;
 }
 
+expected::ExpectedInt64 LastWriteTime(const string &path) {
+	error_code ec;
+	auto time = fs::last_write_time(fs::path(path), ec);
+	if (ec) {
+		return expected::unexpected(error::Error(
+			ec.default_error_condition(),
+			"Could not get the modification time of '" + path + "'. error: " + ec.message()));
+	}
+	return static_cast<int64_t>(time.time_since_epoch().count());
+}
+
 } // namespace path
 } // namespace common
 } // namespace mender
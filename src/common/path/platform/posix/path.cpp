@@ -15,6 +15,8 @@
 #include <common/path.hpp>
 
 #include <fcntl.h>
+#include <sys/file.h>
+#include <unistd.h>
 
 #include <cerrno>
 #include <filesystem>
@@ -56,6 +58,31 @@ expected::ExpectedInt FileCreate(const string &path, vector<Perms> perms) {
 		"Failed to create file '" + path + "': " + strerror(err)));
 }
 
+FileLock::~FileLock() {
+	// Closing the descriptor releases the lock.
+	close(fd_);
+}
+
+ExpectedFileLock LockFile(const string &path) {
+	int fd = open(path.c_str(), O_RDWR | O_CREAT | O_CLOEXEC, 0600);
+	if (fd < 0) {
+		int err = errno;
+		return expected::unexpected(error::Error(
+			generic_category().default_error_condition(err), "Could not open lock " + path));
+	}
+
+	int ret;
+	while ((ret = flock(fd, LOCK_EX)) != 0 && errno == EINTR) {
+	}
+	if (ret != 0) {
+		int err = errno;
+		close(fd);
+		return expected::unexpected(error::Error(
+			generic_category().default_error_condition(err), "Could not take lock " + path));
+	}
+	return make_unique<FileLock>(fd);
+}
+
 error::Error DataSyncRecursively(const string &dir) {
 	// We need to be careful which method we use to sync data to disk. `sync()` is tempting,
 	// because it is easy, but does not provide strong enough guarantees. POSIX says that it
@@ -21,7 +21,9 @@
 #error Cannot include dbus.hpp when MENDER_USE_DBUS is disabled.
 #endif
 
+#include <cstdint>
 #include <functional>
+#include <map>
 #include <memory>
 #include <string>
 #include <unordered_map>
@@ -153,6 +155,16 @@ public:
 		const string &method,
 		DBusCallReplyHandler<ReplyType> handler);
 
+	// Calls a method taking one string argument.
+	template <typename ReplyType>
+	error::Error CallMethod(
+		const string &destination,
+		const string &path,
+		const string &iface,
+		const string &method,
+		const string &argument,
+		DBusCallReplyHandler<ReplyType> handler);
+
 	template <typename SignalValueType>
 	error::Error RegisterSignalHandler(
 		const string &iface, const string &signal, DBusSignalHandler<SignalValueType> handler);
@@ -173,6 +185,15 @@ private:
 
 	error::Error InitializeConnection() override;
 
+	template <typename ReplyType>
+	error::Error CallMethodWithArgs(
+		const string &destination,
+		const string &path,
+		const string &iface,
+		const string &method,
+		const vector<string> &args,
+		DBusCallReplyHandler<ReplyType> handler);
+
 	template <typename SignalValueType>
 	void AddSignalHandler(const SignalSpec &spec, DBusSignalHandler<SignalValueType> handler);
 
@@ -188,6 +209,36 @@ using MethodSpec = string;
 template <typename ReturnType>
 using DBusMethodHandler = function<ReturnType(void)>;
 
+// Handler for methods taking two string arguments.
+template <typename ReturnType>
+using DBusStringPairArgsMethodHandler = function<ReturnType(const StringPair &)>;
+
+// Handler for methods taking one string argument.
+template <typename ReturnType>
+using DBusStringArgMethodHandler = function<ReturnType(const string &)>;
+
+// Returns the current value of a read-only string property.
+using DBusPropertyGetter = function<string(void)>;
+
+// Property getters by interface and property name.
+using DBusProperties = unordered_map<string, map<string, DBusPropertyGetter>>;
+
+// The caller of a method.
+struct MethodCaller {
+	// The Unix user of the connection, as the bus tells it.
+	uint32_t uid;
+	// The name of the user and the gids of all its groups, from the user database. Empty if the
+	// user isn't in it.
+	string user;
+	vector<uint32_t> gids;
+};
+
+// Whether the caller may call the method.
+using DBusMethodAuthorizer = function<bool(const MethodCaller &, const MethodSpec &)>;
+
+// Standard interface for getting the properties of objects.
+const string kPropertiesInterface {"org.freedesktop.DBus.Properties"};
+
 class DBusObject {
 public:
 	explicit DBusObject(const string &path) :
@@ -201,22 +252,74 @@ public:
 	void AddMethodHandler(
 		const string &interface, const string &method, DBusMethodHandler<ReturnType> handler);
 
+	template <typename ReturnType>
+	void AddMethodHandler(
+		const string &interface,
+		const string &method,
+		DBusStringPairArgsMethodHandler<ReturnType> handler);
+
+	template <typename ReturnType>
+	void AddMethodHandler(
+		const string &interface,
+		const string &method,
+		DBusStringArgMethodHandler<ReturnType> handler);
+
+	// Makes the property readable through the Get and GetAll methods of kPropertiesInterface.
+	void AddProperty(const string &interface, const string &property, DBusPropertyGetter getter) {
+		properties_[interface][property] = getter;
+	}
+
+	const DBusProperties &GetProperties() const {
+		return properties_;
+	}
+
+	// Asks the authorizer before every method call on the object, including the ones of
+	// kPropertiesInterface, and refuses the call with DBUS_ERROR_ACCESS_DENIED unless it allows
+	// it. The caller is looked up once per connection, by its unique bus name, which the bus
+	// never gives to another connection.
+	void SetMethodAuthorizer(DBusMethodAuthorizer authorizer) {
+		authorizer_ = authorizer;
+	}
+
 	friend DBusHandlerResult HandleMethodCall(
 		DBusConnection *connection, DBusMessage *message, void *data);
 
 private:
 	const string path_;
 
+	DBusProperties properties_;
+	DBusMethodAuthorizer authorizer_;
+	// By unique bus name.
+	unordered_map<string, MethodCaller> callers_;
+
 	unordered_map<MethodSpec, DBusMethodHandler<expected::ExpectedString>> method_handlers_string_;
 	unordered_map<MethodSpec, DBusMethodHandler<ExpectedStringPair>> method_handlers_string_pair_;
 	unordered_map<MethodSpec, DBusMethodHandler<expected::ExpectedBool>> method_handlers_bool_;
+	unordered_map<MethodSpec, DBusStringPairArgsMethodHandler<expected::ExpectedBool>>
+		method_handlers_string_pair_args_bool_;
+	unordered_map<MethodSpec, DBusStringArgMethodHandler<expected::ExpectedString>>
+		method_handlers_string_arg_string_;
 
 	template <typename ReturnType>
 	optional<DBusMethodHandler<ReturnType>> GetMethodHandler(const MethodSpec &spec);
+
+	template <typename ReturnType>
+	optional<DBusStringPairArgsMethodHandler<ReturnType>> GetStringPairArgsMethodHandler(
+		const MethodSpec &spec);
+
+	template <typename ReturnType>
+	optional<DBusStringArgMethodHandler<ReturnType>> GetStringArgMethodHandler(
+		const MethodSpec &spec);
 };
 
 using DBusObjectPtr = shared_ptr<DBusObject>;
 
+// Interface for managing the running daemons, see Documentation/io.mender.Management1.xml.
+const string kManagementInterface {"io.mender.Management1"};
+
+// Adds the handlers of the management interface to the given object.
+void AddManagementMethodHandlers(DBusObject &obj);
+
 class DBusServer : public DBusPeer {
 public:
 	explicit DBusServer(events::EventLoop &loop, const string &service_name) :
@@ -237,6 +340,11 @@ public:
 	error::Error EmitSignal(
 		const string &path, const string &iface, const string &signal, SignalValueType value);
 
+	// Emits the PropertiesChanged signal of kPropertiesInterface with the current values of the
+	// given properties of an advertised object.
+	error::Error EmitPropertiesChanged(
+		const string &path, const string &iface, const vector<string> &properties);
+
 	friend DBusHandlerResult HandleMethodCall(
 		DBusConnection *connection, DBusMessage *message, void *data);
 
@@ -14,14 +14,19 @@
 
 #include <common/platform/dbus.hpp>
 
+#include <algorithm>
 #include <cassert>
 #include <functional>
 #include <memory>
 #include <string>
 #include <utility>
+#include <vector>
 
 #include <boost/asio.hpp>
 #include <dbus/dbus.h>
+#include <grp.h>
+#include <pwd.h>
+#include <sys/types.h>
 
 #include <common/error.hpp>
 #include <common/expected.hpp>
@@ -132,6 +137,28 @@ error::Error DBusClient::CallMethod(
 	const string &iface,
 	const string &method,
 	DBusCallReplyHandler<ReplyType> handler) {
+	return CallMethodWithArgs(destination, path, iface, method, {}, handler);
+}
+
+template <typename ReplyType>
+error::Error DBusClient::CallMethod(
+	const string &destination,
+	const string &path,
+	const string &iface,
+	const string &method,
+	const string &argument,
+	DBusCallReplyHandler<ReplyType> handler) {
+	return CallMethodWithArgs(destination, path, iface, method, {argument}, handler);
+}
+
+template <typename ReplyType>
+error::Error DBusClient::CallMethodWithArgs(
+	const string &destination,
+	const string &path,
+	const string &iface,
+	const string &method,
+	const vector<string> &args,
+	DBusCallReplyHandler<ReplyType> handler) {
 	if (!dbus_conn_ || !dbus_connection_get_is_connected(dbus_conn_.get())) {
 		auto err = InitializeConnection();
 		if (err != error::NoError) {
@@ -146,6 +173,13 @@ error::Error DBusClient::CallMethod(
 	if (!dbus_msg) {
 		return MakeError(MessageError, "Failed to create new message");
 	}
+	for (const auto &arg : args) {
+		const char *arg_cstr = arg.c_str();
+		if (!dbus_message_append_args(
+				dbus_msg.get(), DBUS_TYPE_STRING, &arg_cstr, DBUS_TYPE_INVALID)) {
+			return MakeError(MessageError, "Failed to add the arguments to the message");
+		}
+	}
 
 	DBusPendingCall *pending;
 	if (!dbus_connection_send_with_reply(
@@ -190,6 +224,14 @@ template error::Error DBusClient::CallMethod(
 	const string &method,
 	DBusCallReplyHandler<expected::ExpectedBool> handler);
 
+template error::Error DBusClient::CallMethod(
+	const string &destination,
+	const string &path,
+	const string &iface,
+	const string &method,
+	const string &argument,
+	DBusCallReplyHandler<expected::ExpectedString> handler);
+
 template <>
 void DBusClient::AddSignalHandler(
 	const SignalSpec &spec, DBusSignalHandler<expected::ExpectedString> handler) {
@@ -737,6 +779,46 @@ optional<DBusMethodHandler<expected::ExpectedBool>> DBusObject::GetMethodHandler
 	}
 }
 
+template <>
+void DBusObject::AddMethodHandler(
+	const string &interface,
+	const string &method,
+	DBusStringPairArgsMethodHandler<expected::ExpectedBool> handler) {
+	string spec = GetMethodSpec(interface, method);
+	method_handlers_string_pair_args_bool_[spec] = handler;
+}
+
+template <>
+optional<DBusStringPairArgsMethodHandler<expected::ExpectedBool>>
+DBusObject::GetStringPairArgsMethodHandler(const MethodSpec &spec) {
+	if (method_handlers_string_pair_args_bool_.find(spec)
+		!= method_handlers_string_pair_args_bool_.cend()) {
+		return method_handlers_string_pair_args_bool_[spec];
+	} else {
+		return nullopt;
+	}
+}
+
+template <>
+void DBusObject::AddMethodHandler(
+	const string &interface,
+	const string &method,
+	DBusStringArgMethodHandler<expected::ExpectedString> handler) {
+	string spec = GetMethodSpec(interface, method);
+	method_handlers_string_arg_string_[spec] = handler;
+}
+
+template <>
+optional<DBusStringArgMethodHandler<expected::ExpectedString>>
+DBusObject::GetStringArgMethodHandler(const MethodSpec &spec) {
+	if (method_handlers_string_arg_string_.find(spec)
+		!= method_handlers_string_arg_string_.cend()) {
+		return method_handlers_string_arg_string_[spec];
+	} else {
+		return nullopt;
+	}
+}
+
 DBusServer::~DBusServer() {
 	if (!dbus_conn_) {
 		// nothing to do without a DBus connection
@@ -786,17 +868,239 @@ bool AddReturnDataToDBusMessage(DBusMessage *message, bool data) {
 		dbus_message_append_args(message, DBUS_TYPE_BOOLEAN, &value, DBUS_TYPE_INVALID));
 }
 
+static bool AppendStringVariant(DBusMessageIter *iter, const string &value) {
+	DBusMessageIter variant;
+	if (!dbus_message_iter_open_container(
+			iter, DBUS_TYPE_VARIANT, DBUS_TYPE_STRING_AS_STRING, &variant)) {
+		return false;
+	}
+	const char *value_cstr = value.c_str();
+	if (!dbus_message_iter_append_basic(&variant, DBUS_TYPE_STRING, &value_cstr)) {
+		dbus_message_iter_abandon_container(iter, &variant);
+		return false;
+	}
+	return static_cast<bool>(dbus_message_iter_close_container(iter, &variant));
+}
+
+// Appends the values as an `a{sv}` dictionary. Failures only happen when out of memory, in which
+// case the message is not usable anyway.
+static bool AppendPropertyValues(DBusMessageIter *iter, const vector<StringPair> &values) {
+	DBusMessageIter dict;
+	if (!dbus_message_iter_open_container(iter, DBUS_TYPE_ARRAY, "{sv}", &dict)) {
+		return false;
+	}
+	for (const auto &value : values) {
+		DBusMessageIter entry;
+		if (!dbus_message_iter_open_container(&dict, DBUS_TYPE_DICT_ENTRY, nullptr, &entry)) {
+			return false;
+		}
+		const char *name_cstr = value.first.c_str();
+		if (!dbus_message_iter_append_basic(&entry, DBUS_TYPE_STRING, &name_cstr)
+			|| !AppendStringVariant(&entry, value.second)
+			|| !dbus_message_iter_close_container(&dict, &entry)) {
+			return false;
+		}
+	}
+	return static_cast<bool>(dbus_message_iter_close_container(iter, &dict));
+}
+
+// Handles the Get, GetAll and Set methods of kPropertiesInterface. All properties are read-only.
+static DBusHandlerResult HandlePropertiesCall(
+	DBusConnection *connection, DBusMessage *message, const DBusProperties &properties) {
+	const string method {dbus_message_get_member(message)};
+	const string spec = GetMethodSpec(kPropertiesInterface, method);
+
+	const char *iface;
+	const char *property = "";
+	DBusError dbus_error;
+	dbus_error_init(&dbus_error);
+	bool got_args;
+	if (method == "GetAll") {
+		got_args = dbus_message_get_args(
+			message, &dbus_error, DBUS_TYPE_STRING, &iface, DBUS_TYPE_INVALID);
+	} else if (method == "Get" || method == "Set") {
+		// The value given to Set is not extracted, it is rejected anyway.
+		got_args = dbus_message_get_args(
+			message,
+			&dbus_error,
+			DBUS_TYPE_STRING,
+			&iface,
+			DBUS_TYPE_STRING,
+			&property,
+			DBUS_TYPE_INVALID);
+	} else {
+		return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+	}
+
+	unique_ptr<DBusMessage, decltype(&dbus_message_unref)> reply_msg {nullptr, dbus_message_unref};
+	bool reply_ok {true};
+	if (!got_args) {
+		reply_msg.reset(
+			dbus_message_new_error(message, DBUS_ERROR_INVALID_ARGS, dbus_error.message));
+		dbus_error_free(&dbus_error);
+	} else {
+		auto iface_properties = properties.find(iface);
+		const string property_name = string(iface) + "." + property;
+		if (method == "GetAll") {
+			vector<StringPair> values;
+			if (iface_properties != properties.cend()) {
+				for (const auto &getter : iface_properties->second) {
+					values.push_back({getter.first, getter.second()});
+				}
+			}
+			reply_msg.reset(dbus_message_new_method_return(message));
+			if (reply_msg) {
+				DBusMessageIter iter;
+				dbus_message_iter_init_append(reply_msg.get(), &iter);
+				reply_ok = AppendPropertyValues(&iter, values);
+			}
+		} else if (
+			iface_properties == properties.cend()
+			|| iface_properties->second.find(property) == iface_properties->second.cend()) {
+			reply_msg.reset(dbus_message_new_error(
+				message,
+				DBUS_ERROR_UNKNOWN_PROPERTY,
+				("No such property: " + property_name).c_str()));
+		} else if (method == "Set") {
+			reply_msg.reset(dbus_message_new_error(
+				message,
+				DBUS_ERROR_PROPERTY_READ_ONLY,
+				("Property is read-only: " + property_name).c_str()));
+		} else {
+			auto value = iface_properties->second.at(property)();
+			reply_msg.reset(dbus_message_new_method_return(message));
+			if (reply_msg) {
+				DBusMessageIter iter;
+				dbus_message_iter_init_append(reply_msg.get(), &iter);
+				reply_ok = AppendStringVariant(&iter, value);
+			}
+		}
+	}
+
+	if (!reply_msg) {
+		log::Error("Failed to create new DBus message when handling method " + spec);
+		return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+	}
+	if (!reply_ok) {
+		log::Error("Failed to add return value to reply DBus message when handling method " + spec);
+		return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+	}
+
+	if (!dbus_connection_send(connection, reply_msg.get(), NULL)) {
+		// can only happen in case of no memory
+		log::Error("Failed to send reply DBus message when handling method " + spec);
+		return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+	}
+
+	return DBUS_HANDLER_RESULT_HANDLED;
+}
+
+const size_t kMaxCachedMethodCallers = 64;
+
+static expected::expected<MethodCaller, error::Error> GetMethodCaller(
+	DBusConnection *connection, DBusMessage *message) {
+	const char *sender = dbus_message_get_sender(message);
+	if (sender == nullptr) {
+		return expected::unexpected(MakeError(MessageError, "Method call without a sender"));
+	}
+
+	// Asks the bus daemon, since the connection itself is to the daemon, not to the caller.
+	DBusError dbus_error;
+	dbus_error_init(&dbus_error);
+	unsigned long uid = dbus_bus_get_unix_user(connection, sender, &dbus_error);
+	if (dbus_error_is_set(&dbus_error)) {
+		auto err = MakeError(
+			ReplyError,
+			string("Failed to get the user of ") + sender + ": " + dbus_error.message + " ["
+				+ dbus_error.name + "]");
+		dbus_error_free(&dbus_error);
+		return expected::unexpected(err);
+	}
+
+	MethodCaller caller {static_cast<uint32_t>(uid), "", {}};
+	const struct passwd *user = getpwuid(static_cast<uid_t>(uid));
+	if (user == nullptr) {
+		return caller;
+	}
+	caller.user = user->pw_name;
+	const gid_t primary_gid = user->pw_gid;
+
+	vector<gid_t> gids(16);
+	int n_gids = static_cast<int>(gids.size());
+	while (getgrouplist(caller.user.c_str(), primary_gid, gids.data(), &n_gids) == -1) {
+		// Where the C library tells how many there are, n_gids is that many now.
+		n_gids = max(n_gids, static_cast<int>(gids.size()) * 2);
+		gids.resize(n_gids);
+	}
+	caller.gids.assign(gids.begin(), gids.begin() + n_gids);
+	return caller;
+}
+
+static DBusHandlerResult RefuseMethodCall(
+	DBusConnection *connection, DBusMessage *message, const string &spec) {
+	unique_ptr<DBusMessage, decltype(&dbus_message_unref)> reply_msg {
+		dbus_message_new_error(
+			message, DBUS_ERROR_ACCESS_DENIED, ("Not authorized to call " + spec).c_str()),
+		dbus_message_unref};
+	if (!reply_msg || !dbus_connection_send(connection, reply_msg.get(), NULL)) {
+		log::Error("Failed to send the refusal of DBus method " + spec);
+		return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+	}
+	return DBUS_HANDLER_RESULT_HANDLED;
+}
+
 DBusHandlerResult HandleMethodCall(DBusConnection *connection, DBusMessage *message, void *data) {
 	DBusObject *obj = static_cast<DBusObject *>(data);
 
+	if (obj->authorizer_) {
+		const char *iface = dbus_message_get_interface(message);
+		const char *member = dbus_message_get_member(message);
+		if (iface == nullptr || member == nullptr) {
+			return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+		}
+		const string spec = GetMethodSpec(iface, member);
+		const char *sender = dbus_message_get_sender(message);
+		auto cached = sender != nullptr ? obj->callers_.find(sender) : obj->callers_.end();
+		if (cached == obj->callers_.end()) {
+			auto exp_caller = GetMethodCaller(connection, message);
+			if (!exp_caller) {
+				log::Error(exp_caller.error().String());
+				return RefuseMethodCall(connection, message, spec);
+			}
+			// The names of connections which are gone are never used again, so this only keeps
+			// the map from growing with them.
+			if (obj->callers_.size() >= kMaxCachedMethodCallers) {
+				obj->callers_.clear();
+			}
+			cached = obj->callers_.emplace(sender, exp_caller.value()).first;
+		}
+		const auto &caller = cached->second;
+		if (!obj->authorizer_(caller, spec)) {
+			log::Warning(
+				"Refused DBus method " + spec + " to "
+				+ (caller.user == "" ? "UID " + to_string(caller.uid) : caller.user));
+			return RefuseMethodCall(connection, message, spec);
+		}
+	}
+
+	const char *msg_iface = dbus_message_get_interface(message);
+	if (!obj->properties_.empty() && msg_iface != nullptr && msg_iface == kPropertiesInterface) {
+		return HandlePropertiesCall(connection, message, obj->properties_);
+	}
+
 	string spec =
 		GetMethodSpec(dbus_message_get_interface(message), dbus_message_get_member(message));
 
 	auto opt_string_handler = obj->GetMethodHandler<expected::ExpectedString>(spec);
 	auto opt_string_pair_handler = obj->GetMethodHandler<ExpectedStringPair>(spec);
 	auto opt_bool_handler = obj->GetMethodHandler<expected::ExpectedBool>(spec);
+	auto opt_string_pair_args_bool_handler =
+		obj->GetStringPairArgsMethodHandler<expected::ExpectedBool>(spec);
+	auto opt_string_arg_string_handler =
+		obj->GetStringArgMethodHandler<expected::ExpectedString>(spec);
 
-	if (!opt_string_handler && !opt_string_pair_handler && !opt_bool_handler) {
+	if (!opt_string_handler && !opt_string_pair_handler && !opt_bool_handler
+		&& !opt_string_pair_args_bool_handler && !opt_string_arg_string_handler) {
 		return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
 	}
 
@@ -871,6 +1175,88 @@ DBusHandlerResult HandleMethodCall(DBusConnection *connection, DBusMessage *mess
 				return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
 			}
 		}
+	} else if (opt_string_pair_args_bool_handler) {
+		const char *first;
+		const char *second;
+		DBusError dbus_error;
+		dbus_error_init(&dbus_error);
+		if (!dbus_message_get_args(
+				message,
+				&dbus_error,
+				DBUS_TYPE_STRING,
+				&first,
+				DBUS_TYPE_STRING,
+				&second,
+				DBUS_TYPE_INVALID)) {
+			reply_msg.reset(
+				dbus_message_new_error(message, DBUS_ERROR_INVALID_ARGS, dbus_error.message));
+			dbus_error_free(&dbus_error);
+			if (!reply_msg) {
+				log::Error("Failed to create new DBus message when handling method " + spec);
+				return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+			}
+		} else {
+			expected::ExpectedBool ex_return_data =
+				(*opt_string_pair_args_bool_handler)(StringPair {first, second});
+			if (!ex_return_data) {
+				auto &err = ex_return_data.error();
+				reply_msg.reset(
+					dbus_message_new_error(message, DBUS_ERROR_FAILED, err.String().c_str()));
+				if (!reply_msg) {
+					log::Error("Failed to create new DBus message when handling method " + spec);
+					return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+				}
+			} else {
+				reply_msg.reset(dbus_message_new_method_return(message));
+				if (!reply_msg) {
+					log::Error("Failed to create new DBus message when handling method " + spec);
+					return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+				}
+				if (!AddReturnDataToDBusMessage<bool>(reply_msg.get(), ex_return_data.value())) {
+					log::Error(
+						"Failed to add return value to reply DBus message when handling method "
+						+ spec);
+					return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+				}
+			}
+		}
+	} else if (opt_string_arg_string_handler) {
+		const char *arg;
+		DBusError dbus_error;
+		dbus_error_init(&dbus_error);
+		if (!dbus_message_get_args(
+				message, &dbus_error, DBUS_TYPE_STRING, &arg, DBUS_TYPE_INVALID)) {
+			reply_msg.reset(
+				dbus_message_new_error(message, DBUS_ERROR_INVALID_ARGS, dbus_error.message));
+			dbus_error_free(&dbus_error);
+			if (!reply_msg) {
+				log::Error("Failed to create new DBus message when handling method " + spec);
+				return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+			}
+		} else {
+			expected::ExpectedString ex_return_data = (*opt_string_arg_string_handler)(arg);
+			if (!ex_return_data) {
+				auto &err = ex_return_data.error();
+				reply_msg.reset(
+					dbus_message_new_error(message, DBUS_ERROR_FAILED, err.String().c_str()));
+				if (!reply_msg) {
+					log::Error("Failed to create new DBus message when handling method " + spec);
+					return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+				}
+			} else {
+				reply_msg.reset(dbus_message_new_method_return(message));
+				if (!reply_msg) {
+					log::Error("Failed to create new DBus message when handling method " + spec);
+					return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+				}
+				if (!AddReturnDataToDBusMessage<string>(reply_msg.get(), ex_return_data.value())) {
+					log::Error(
+						"Failed to add return value to reply DBus message when handling method "
+						+ spec);
+					return DBUS_HANDLER_RESULT_NOT_YET_HANDLED;
+				}
+			}
+		}
 	}
 
 	if (!dbus_connection_send(connection, reply_msg.get(), NULL)) {
@@ -965,6 +1351,65 @@ template error::Error DBusServer::EmitSignal(
 template error::Error DBusServer::EmitSignal(
 	const string &path, const string &iface, const string &signal, StringPair value);
 
+error::Error DBusServer::EmitPropertiesChanged(
+	const string &path, const string &iface, const vector<string> &properties) {
+	auto obj = find_if(objects_.cbegin(), objects_.cend(), [&path](const DBusObjectPtr &obj) {
+		return obj->GetPath() == path;
+	});
+	if (obj == objects_.cend()) {
+		return MakeError(ValueError, "No object advertised at " + path);
+	}
+	const auto &all_properties = (*obj)->GetProperties();
+	auto iface_properties = all_properties.find(iface);
+	vector<StringPair> values;
+	for (const auto &property : properties) {
+		if (iface_properties == all_properties.cend()
+			|| iface_properties->second.find(property) == iface_properties->second.cend()) {
+			return MakeError(ValueError, "No such property: " + iface + "." + property);
+		}
+		values.push_back({property, iface_properties->second.at(property)()});
+	}
+
+	if (!dbus_conn_ || !dbus_connection_get_is_connected(dbus_conn_.get())) {
+		auto err = InitializeConnection();
+		if (err != error::NoError) {
+			return err;
+		}
+	}
+
+	auto err = RegisterDBusName();
+	if (err != error::NoError) {
+		return err;
+	}
+
+	unique_ptr<DBusMessage, decltype(&dbus_message_unref)> signal_msg {
+		dbus_message_new_signal(path.c_str(), kPropertiesInterface.c_str(), "PropertiesChanged"),
+		dbus_message_unref};
+	if (!signal_msg) {
+		return MakeError(MessageError, "Failed to create signal message");
+	}
+
+	// Arguments are the interface, the changed values and the invalidated properties (none).
+	DBusMessageIter iter;
+	dbus_message_iter_init_append(signal_msg.get(), &iter);
+	const char *iface_cstr = iface.c_str();
+	DBusMessageIter invalidated;
+	if (!dbus_message_iter_append_basic(&iter, DBUS_TYPE_STRING, &iface_cstr)
+		|| !AppendPropertyValues(&iter, values)
+		|| !dbus_message_iter_open_container(
+			&iter, DBUS_TYPE_ARRAY, DBUS_TYPE_STRING_AS_STRING, &invalidated)
+		|| !dbus_message_iter_close_container(&iter, &invalidated)) {
+		return MakeError(MessageError, "Failed to add data to the signal message");
+	}
+
+	if (!dbus_connection_send(dbus_conn_.get(), signal_msg.get(), NULL)) {
+		// can only happen in case of no memory
+		return MakeError(ConnectionError, "Failed to send signal message");
+	}
+
+	return error::NoError;
+}
+
 error::Error DBusServer::RegisterDBusName() {
 	// We could also do DBUS_NAME_FLAG_ALLOW_REPLACEMENT for cases where two of
 	// processes request the same name, but it would require handling of the
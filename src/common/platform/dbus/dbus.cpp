@@ -16,12 +16,16 @@
 
 #include <string>
 
+#include <common/log.hpp>
+
 namespace mender {
 namespace common {
 namespace dbus {
 
 using namespace std;
 
+namespace log = mender::common::log;
+
 const DBusErrorCategoryClass DBusErrorCategory;
 
 const char *DBusErrorCategoryClass::name() const noexcept {
@@ -49,6 +53,26 @@ error::Error MakeError(DBusErrorCode code, const string &msg) {
 	return error::Error(error_condition(code, DBusErrorCategory), msg);
 }
 
+void AddManagementMethodHandlers(DBusObject &obj) {
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kManagementInterface, "SetLogLevel", [](const StringPair &args) -> expected::ExpectedBool {
+			const auto &module = args.first;
+			const auto &level = args.second;
+			auto err = log::SetModuleLevel(module, level);
+			if (err != error::NoError) {
+				return expected::unexpected(err);
+			}
+			if (module == "") {
+				log::Info("Global log level set to " + level + " over DBus");
+			} else if (level == "") {
+				log::Info("Log level override of module " + module + " removed over DBus");
+			} else {
+				log::Info("Log level of module " + module + " set to " + level + " over DBus");
+			}
+			return true;
+		});
+}
+
 } // namespace dbus
 } // namespace common
 } // namespace mender
@@ -16,8 +16,11 @@
 #define MENDER_COMMON_PROCESSES_HPP
 #include <common/config.h>
 #include <chrono>
+#include <functional>
 #include <future>
+#include <map>
 #include <memory>
+#include <mutex>
 #include <string>
 #include <vector>
 
@@ -74,6 +77,21 @@ using AsyncWaitHandler = function<void(error::Error err)>;
 
 using OutputCallback = function<void(const char *, size_t)>;
 
+enum class IoSchedulingClass {
+	Default,
+	BestEffort,
+	Idle,
+};
+
+// Scheduling priority of a process and of the processes it starts, see `setpriority(2)` and
+// `ioprio_set(2)`.
+struct SchedulingPriority {
+	// 0 leaves the niceness as it is.
+	int niceness {0};
+	// Best effort is at its lowest level.
+	IoSchedulingClass io_class {IoSchedulingClass::Default};
+};
+
 class OutputHandler {
 public:
 	void operator()(const char *data, size_t size);
@@ -91,6 +109,17 @@ public:
 		work_dir_ = path;
 	}
 
+	// Only takes effect at the next process launch. Failing to apply it is only logged.
+	void SetSchedulingPriority(const SchedulingPriority &priority) {
+		priority_ = priority;
+	}
+
+	// Added to the environment of the client, replacing the variables with the same names. Only
+	// takes effect at the next process launch.
+	void SetEnvironment(const map<string, string> &environment) {
+		environment_ = environment;
+	}
+
 	// Note: The callbacks will be called from a different thread.
 	error::Error Start(
 		OutputCallback stdout_callback = nullptr, OutputCallback stderr_callback = nullptr);
@@ -120,6 +149,10 @@ public:
 
 	// Terminate and make sure it is so before returning.
 	int EnsureTerminated();
+	// How long EnsureTerminated() waits for the process to exit after SIGTERM, before SIGKILL.
+	void SetMaxTerminationTime(chrono::seconds time) {
+		max_termination_time_ = time;
+	}
 
 	void Terminate();
 	void Kill();
@@ -146,6 +179,8 @@ private:
 
 	vector<string> args_;
 	string work_dir_;
+	SchedulingPriority priority_;
+	map<string, string> environment_;
 	int exit_status_ {-1};
 
 	unique_ptr<events::Timer> timeout_timer_;
@@ -153,6 +188,7 @@ private:
 	chrono::seconds max_termination_time_;
 
 	void DoCancel();
+	void ApplySchedulingPriority();
 
 	io::ExpectedAsyncReaderPtr GetProcessReader(events::EventLoop &loop, int &pipe_ref);
 
@@ -160,6 +196,48 @@ private:
 	void AsyncWaitInternalHandler(shared_ptr<AsyncWaitData> async_wait_data);
 };
 
+// Runs one command at a time with a timeout, terminating it if it doesn't exit in time. The output
+// of the command is logged, and the first line of its standard output is kept for the handler,
+// since it is usually the reason when the command fails.
+class ScriptRunner {
+public:
+	using Handler = function<void(error::Error err, const string &first_line)>;
+
+	// `output_prefix` is the start of the logged output lines, such as "Health check output".
+	ScriptRunner(const string &output_prefix);
+	~ScriptRunner();
+
+	// The handler is called from the event loop, after the process handlers are done, so it
+	// may run the next command from within it. It is not called if the command can't be
+	// started, then the error is returned, nor after Cancel() or the destruction of the runner.
+	// A zero timeout waits as long as it takes.
+	error::Error AsyncRun(
+		events::EventLoop &loop,
+		const vector<string> &args,
+		chrono::nanoseconds timeout,
+		Handler handler);
+
+	// Terminates the running command, if any.
+	void Cancel();
+
+	bool Running() const {
+		return proc_ != nullptr;
+	}
+
+private:
+	struct RunData {
+		mutex data_mutex;
+		string first_line;
+		bool first_line_done {false};
+		bool cancelled {false};
+	};
+
+	string output_prefix_;
+	unique_ptr<Process> proc_;
+	// Shared with the handlers of the running command.
+	shared_ptr<RunData> run_data_;
+};
+
 } // namespace processes
 } // namespace common
 } // namespace mender
@@ -17,11 +17,19 @@
 #include <string>
 #include <string_view>
 
+#include <sys/resource.h>
+#ifdef __linux__
+#include <sys/syscall.h>
+#include <unistd.h>
+#endif
+
 #include <common/events_io.hpp>
 #include <common/io.hpp>
 #include <common/log.hpp>
 #include <common/path.hpp>
 
+extern char **environ;
+
 using namespace std;
 
 namespace mender {
@@ -44,6 +52,22 @@ public:
 	OutputCallback callback_;
 };
 
+// Tiny-process-library replaces the environment of the process, instead of adding to it.
+static tpl::Process::environment_type FullEnvironment(const map<string, string> &added) {
+	tpl::Process::environment_type environment;
+	for (char **variable = environ; *variable != nullptr; variable++) {
+		string_view entry {*variable};
+		auto pos = entry.find('=');
+		if (pos != string_view::npos) {
+			environment[string(entry.substr(0, pos))] = string(entry.substr(pos + 1));
+		}
+	}
+	for (const auto &variable : added) {
+		environment[variable.first] = variable.second;
+	}
+	return environment;
+}
+
 Process::Process(const vector<string> &args) :
 	args_ {args},
 	max_termination_time_ {MAX_TERMINATION_TIME} {
@@ -94,8 +118,17 @@ error::Error Process::Start(OutputCallback stdout_callback, OutputCallback stder
 		maybe_stderr_callback = ProcessReaderFunctor {stderr_pipe_, stderr_callback};
 	}
 
-	proc_ =
-		make_unique<tpl::Process>(args_, work_dir_, maybe_stdout_callback, maybe_stderr_callback);
+	if (environment_.empty()) {
+		proc_ = make_unique<tpl::Process>(
+			args_, work_dir_, maybe_stdout_callback, maybe_stderr_callback);
+	} else {
+		proc_ = make_unique<tpl::Process>(
+			args_,
+			work_dir_,
+			FullEnvironment(environment_),
+			maybe_stdout_callback,
+			maybe_stderr_callback);
+	}
 
 	if (proc_->get_id() == -1) {
 		proc_.reset();
@@ -104,11 +137,45 @@ error::Error Process::Start(OutputCallback stdout_callback, OutputCallback stder
 			"Failed to spawn '" + (args_.size() >= 1 ? args_[0] : "<null>") + "'");
 	}
 
+	ApplySchedulingPriority();
+
 	SetupAsyncWait();
 
 	return error::NoError;
 }
 
+void Process::ApplySchedulingPriority() {
+	// For the whole process group, which the process is the leader of, so that it also applies
+	// to the processes it has already started.
+	const auto pid = proc_->get_id();
+	if (priority_.niceness != 0 && setpriority(PRIO_PGRP, pid, priority_.niceness) != 0) {
+		int errnum = errno;
+		log::Warning(
+			"Could not set the niceness of PID " + to_string(pid) + ": "
+			+ generic_category().message(errnum));
+	}
+
+	if (priority_.io_class == IoSchedulingClass::Default) {
+		return;
+	}
+#ifdef __linux__
+	// From linux/ioprio.h, which isn't in every libc.
+	const int ioprio_who_pgrp = 2;
+	const int ioprio_class_shift = 13;
+	const int ioprio = priority_.io_class == IoSchedulingClass::Idle
+						   ? 3 << ioprio_class_shift
+						   : (2 << ioprio_class_shift) | 7;
+	if (syscall(SYS_ioprio_set, ioprio_who_pgrp, pid, ioprio) != 0) {
+		int errnum = errno;
+		log::Warning(
+			"Could not set the I/O scheduling class of PID " + to_string(pid) + ": "
+			+ generic_category().message(errnum));
+	}
+#else
+	log::Warning("I/O scheduling classes are only supported on Linux");
+#endif
+}
+
 error::Error Process::Run() {
 	auto err = Start();
 	if (err != error::NoError) {
@@ -337,10 +404,14 @@ ExpectedLineData Process::GenerateLineData(chrono::nanoseconds timeout) {
 
 	string trailing_line;
 	vector<string> ret;
-	proc_ = make_unique<tpl::Process>(
-		args_, work_dir_, [&trailing_line, &ret](const char *bytes, size_t len) {
-			CollectLineData(trailing_line, ret, bytes, len);
-		});
+	auto collect = [&trailing_line, &ret](const char *bytes, size_t len) {
+		CollectLineData(trailing_line, ret, bytes, len);
+	};
+	if (environment_.empty()) {
+		proc_ = make_unique<tpl::Process>(args_, work_dir_, collect);
+	} else {
+		proc_ = make_unique<tpl::Process>(args_, work_dir_, FullEnvironment(environment_), collect);
+	}
 
 	if (proc_->get_id() == -1) {
 		proc_.reset();
@@ -70,6 +70,86 @@ void OutputHandler::operator()(const char *data, size_t size) {
 	}
 }
 
+ScriptRunner::ScriptRunner(const string &output_prefix) :
+	output_prefix_ {output_prefix} {
+}
+
+ScriptRunner::~ScriptRunner() {
+	Cancel();
+}
+
+error::Error ScriptRunner::AsyncRun(
+	events::EventLoop &loop,
+	const vector<string> &args,
+	chrono::nanoseconds timeout,
+	Handler handler) {
+	Cancel();
+
+	auto run_data = make_shared<RunData>();
+	auto proc = make_unique<Process>(args);
+	OutputHandler stdout_handler {output_prefix_ + " (stdout): "};
+	auto err = proc->Start(
+		[run_data, stdout_handler](const char *data, size_t size) mutable {
+			stdout_handler(data, size);
+
+			unique_lock lock(run_data->data_mutex);
+			if (run_data->first_line_done) {
+				return;
+			}
+			// The output may come in several pieces, also in the middle of the first line.
+			string output(data, size);
+			auto end = output.find('\n');
+			run_data->first_line += output.substr(0, end);
+			run_data->first_line_done = end != string::npos;
+		},
+		OutputHandler {output_prefix_ + " (stderr): "});
+	if (err != error::NoError) {
+		return err;
+	}
+
+	auto wait_handler = [this, &loop, run_data, handler](error::Error err) {
+		if (err.code == make_error_condition(errc::timed_out)) {
+			proc_->EnsureTerminated();
+		}
+		// Don't destroy the process from within its own handler.
+		loop.Post([this, run_data, handler, err]() {
+			string first_line;
+			{
+				unique_lock lock(run_data->data_mutex);
+				if (run_data->cancelled) {
+					return;
+				}
+				first_line = run_data->first_line;
+			}
+			proc_.reset();
+			run_data_.reset();
+			handler(err, first_line);
+		});
+	};
+	if (timeout > chrono::nanoseconds::zero()) {
+		err = proc->AsyncWait(loop, wait_handler, timeout);
+	} else {
+		err = proc->AsyncWait(loop, wait_handler);
+	}
+	if (err != error::NoError) {
+		return err;
+	}
+
+	proc_ = std::move(proc);
+	run_data_ = run_data;
+	return error::NoError;
+}
+
+void ScriptRunner::Cancel() {
+	if (run_data_) {
+		unique_lock lock(run_data_->data_mutex);
+		run_data_->cancelled = true;
+	}
+	run_data_.reset();
+	// Terminates the command, if it is still running.
+	proc_.reset();
+}
+
 } // namespace processes
 } // namespace common
 } // namespace mender
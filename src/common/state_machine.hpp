@@ -72,6 +72,10 @@ public:
 		state_entered_ = false;
 	}
 
+	const State<ContextType, EventType> &GetCurrentState() const {
+		return *current_state_;
+	}
+
 private:
 	struct TransitionCondition {
 		// Note: Comparing address-of states. We don't want to rely on comparison operators
@@ -163,8 +167,37 @@ public:
 		iteration_callback_ = callback;
 	}
 
+	// Called when the machines have moved to their new states, right before these are entered.
+	void SetEnterCallback(IterationCallback callback) {
+		enter_callback_ = callback;
+	}
+
+	// Stops processing of events until `Resume()` is called. States which are already running
+	// are not interrupted, but events they post are queued and only acted upon after resuming.
+	void Pause() {
+		paused_ = true;
+	}
+
+	void Resume() {
+		paused_ = false;
+		PostToEventLoop();
+	}
+
+	bool Paused() const {
+		return paused_;
+	}
+
+	// Whether there are events which haven't been handled yet, including deferred ones.
+	bool HasPendingEvents() const {
+		return !event_queue_.empty();
+	}
+
 private:
 	void RunOne() {
+		if (paused_) {
+			return;
+		}
+
 		vector<State<ContextType, EventType> *> to_run;
 
 		for (auto machine : machines_) {
@@ -221,10 +254,16 @@ private:
 		}
 
 		if (!to_run.empty()) {
+			if (enter_callback_) {
+				enter_callback_();
+			}
 			for (auto &state : to_run) {
 				log::Trace("Entering state " + common::BestAvailableTypeName(*state));
 				state->OnEnter(ctx_, *this);
 			}
+			if (iteration_callback_) {
+				iteration_callback_();
+			}
 			// Since we ran something, there may be more events waiting to
 			// execute. OTOH, if we didn't, it either means that there are no events, or
 			// it means that all events currently in the queue are deferred, and not
@@ -234,7 +273,7 @@ private:
 	}
 
 	void PostToEventLoop() {
-		if (!event_loop_) {
+		if (!event_loop_ || paused_) {
 			return;
 		}
 
@@ -258,6 +297,9 @@ private:
 	shared_ptr<events::EventLoop> event_loop_;
 
 	IterationCallback iteration_callback_;
+	IterationCallback enter_callback_;
+
+	bool paused_ {false};
 };
 
 } // namespace state_machine
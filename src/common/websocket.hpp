@@ -0,0 +1,155 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_COMMON_WEBSOCKET_HPP
+#define MENDER_COMMON_WEBSOCKET_HPP
+
+#include <cstdint>
+#include <deque>
+#include <functional>
+#include <memory>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/io.hpp>
+#include <common/optional.hpp>
+
+namespace mender {
+namespace common {
+namespace websocket {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+namespace io = mender::common::io;
+
+enum WebSocketErrorCode {
+	NoError = 0,
+	ProtocolError,
+	ConnectionClosedError,
+};
+
+class WebSocketErrorCategoryClass : public std::error_category {
+public:
+	const char *name() const noexcept override;
+	string message(int code) const override;
+};
+extern const WebSocketErrorCategoryClass WebSocketErrorCategory;
+
+error::Error MakeError(WebSocketErrorCode code, const string &msg);
+
+// The value of the `Sec-WebSocket-Version` header of the handshake.
+const string kVersion {"13"};
+
+// Opcodes, as in the low nibble of the first byte of a frame.
+const uint8_t kContinuationFrame {0x0};
+const uint8_t kTextFrame {0x1};
+const uint8_t kBinaryFrame {0x2};
+const uint8_t kCloseFrame {0x8};
+const uint8_t kPingFrame {0x9};
+const uint8_t kPongFrame {0xa};
+
+// Frames, and messages made of several frames, which are larger than this are refused.
+const size_t kMaxMessageSize {1024 * 1024};
+
+struct Frame {
+	bool fin;
+	uint8_t opcode;
+	// Unmasked.
+	string payload;
+};
+using ExpectedOptionalFrame = expected::expected<optional<Frame>, error::Error>;
+
+// A random key for the `Sec-WebSocket-Key` header of the handshake.
+string MakeKey();
+
+// A frame from the client, which is always masked. Without a mask, a random one is used.
+string ClientFrame(uint8_t opcode, const string &payload, uint32_t mask);
+string ClientFrame(uint8_t opcode, const string &payload);
+
+// Takes the first frame out of the buffer, or returns nullopt if the buffer doesn't hold a whole
+// frame yet.
+ExpectedOptionalFrame TakeFrame(string &buffer);
+
+struct Message {
+	// `kTextFrame` or `kBinaryFrame`.
+	uint8_t opcode;
+	string payload;
+};
+
+using MessageHandler = function<void(const Message &message)>;
+// NoError if the server closed the connection properly.
+using ClosedHandler = function<void(error::Error err)>;
+
+// Exchanges messages over a connection which has been switched to the WebSocket protocol, see
+// `http::IncomingResponse::SwitchProtocol()`. Fragmented messages are put together, and pings are
+// answered, before the messages are handed over.
+class Connection {
+public:
+	explicit Connection(io::AsyncReadWriterPtr socket);
+	~Connection();
+
+	// Reads messages until the connection is closed, by either side, or fails. The message handler
+	// must not destroy the connection, but the closed handler, which is called once, may. Neither
+	// handler is called after `Cancel()`.
+	error::Error AsyncStart(MessageHandler message_handler, ClosedHandler closed_handler);
+
+	// Queued, and written in order. If writing fails, the closed handler is called, possibly from
+	// within `Send()`.
+	void Send(uint8_t opcode, const string &payload);
+	// Sends a close frame. The closed handler is called once the server has answered it.
+	void Close();
+
+	// Whether anything, including a pong, has been received since the last call. For keep-alive
+	// checks, together with pings.
+	bool TakeActivity();
+
+	void Cancel();
+
+private:
+	error::Error ReadMore();
+	void HandleIncoming();
+	void HandleFrame(Frame &frame);
+	void WriteNext();
+	void Finish(error::Error err);
+
+	io::AsyncReadWriterPtr socket_;
+	// Set when the connection is over, so that the callbacks it still gets are ignored.
+	shared_ptr<bool> cancelled_;
+	MessageHandler message_handler_;
+	ClosedHandler closed_handler_;
+
+	vector<uint8_t> read_buffer_;
+	string incoming_;
+	// The message which the fragments so far belong to, if any.
+	optional<Message> fragmented_;
+
+	deque<string> outgoing_;
+	// What is left to write of the frame being written.
+	vector<uint8_t> writing_;
+	bool write_in_progress_ {false};
+	bool close_sent_ {false};
+	bool close_received_ {false};
+	bool received_ {false};
+};
+
+} // namespace websocket
+} // namespace common
+} // namespace mender
+
+#endif // MENDER_COMMON_WEBSOCKET_HPP
@@ -0,0 +1,375 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <common/websocket.hpp>
+
+#include <random>
+
+#include <common/config.h>
+
+namespace mender {
+namespace common {
+namespace websocket {
+
+const WebSocketErrorCategoryClass WebSocketErrorCategory;
+
+const char *WebSocketErrorCategoryClass::name() const noexcept {
+	return "WebSocketErrorCategory";
+}
+
+string WebSocketErrorCategoryClass::message(int code) const {
+	switch (code) {
+	case NoError:
+		return "Success";
+	case ProtocolError:
+		return "WebSocket protocol error";
+	case ConnectionClosedError:
+		return "WebSocket connection closed";
+	default:
+		return "Unknown";
+	}
+}
+
+error::Error MakeError(WebSocketErrorCode code, const string &msg) {
+	return error::Error(error_condition(code, WebSocketErrorCategory), msg);
+}
+
+static mt19937 &Random() {
+	static mt19937 random {random_device {}()};
+	return random;
+}
+
+string MakeKey() {
+	const string alphabet {"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"};
+	uniform_int_distribution<int> byte_distribution {0, 255};
+	uint8_t bytes[16];
+	for (auto &byte : bytes) {
+		byte = static_cast<uint8_t>(byte_distribution(Random()));
+	}
+
+	// Base64, 16 bytes are five full groups of three, and one byte left over.
+	string key;
+	for (size_t i = 0; i < 15; i += 3) {
+		uint32_t group = (uint32_t {bytes[i]} << 16) | (uint32_t {bytes[i + 1]} << 8) | bytes[i + 2];
+		key += alphabet[(group >> 18) & 0x3f];
+		key += alphabet[(group >> 12) & 0x3f];
+		key += alphabet[(group >> 6) & 0x3f];
+		key += alphabet[group & 0x3f];
+	}
+	key += alphabet[bytes[15] >> 2];
+	key += alphabet[(bytes[15] & 0x03) << 4];
+	key += "==";
+	return key;
+}
+
+string ClientFrame(uint8_t opcode, const string &payload, uint32_t mask) {
+	string frame;
+	frame += static_cast<char>(0x80 | opcode);
+
+	const size_t size = payload.size();
+	if (size < 126) {
+		frame += static_cast<char>(0x80 | size);
+	} else if (size <= 0xffff) {
+		frame += static_cast<char>(0x80 | 126);
+		frame += static_cast<char>((size >> 8) & 0xff);
+		frame += static_cast<char>(size & 0xff);
+	} else {
+		frame += static_cast<char>(0x80 | 127);
+		for (int shift = 56; shift >= 0; shift -= 8) {
+			frame += static_cast<char>((static_cast<uint64_t>(size) >> shift) & 0xff);
+		}
+	}
+
+	const uint8_t mask_bytes[4] {
+		static_cast<uint8_t>(mask >> 24),
+		static_cast<uint8_t>(mask >> 16),
+		static_cast<uint8_t>(mask >> 8),
+		static_cast<uint8_t>(mask),
+	};
+	frame.append(reinterpret_cast<const char *>(mask_bytes), 4);
+	for (size_t i = 0; i < size; i++) {
+		frame += static_cast<char>(static_cast<uint8_t>(payload[i]) ^ mask_bytes[i % 4]);
+	}
+	return frame;
+}
+
+string ClientFrame(uint8_t opcode, const string &payload) {
+	return ClientFrame(opcode, payload, static_cast<uint32_t>(Random()()));
+}
+
+ExpectedOptionalFrame TakeFrame(string &buffer) {
+	if (buffer.size() < 2) {
+		return optional<Frame> {};
+	}
+
+	const uint8_t first_byte = static_cast<uint8_t>(buffer[0]);
+	const uint8_t second_byte = static_cast<uint8_t>(buffer[1]);
+	if ((first_byte & 0x70) != 0) {
+		return expected::unexpected(
+			MakeError(ProtocolError, "Reserved bits set in a frame from the server"));
+	}
+
+	size_t pos {2};
+	uint64_t length = second_byte & 0x7f;
+	if (length == 126 || length == 127) {
+		const size_t length_bytes = (length == 126) ? 2 : 8;
+		if (buffer.size() < pos + length_bytes) {
+			return optional<Frame> {};
+		}
+		length = 0;
+		for (size_t i = 0; i < length_bytes; i++) {
+			length = (length << 8) | static_cast<uint8_t>(buffer[pos++]);
+		}
+	}
+	if (length > kMaxMessageSize) {
+		return expected::unexpected(MakeError(
+			ProtocolError, "Frame of " + to_string(length) + " bytes from the server is too large"));
+	}
+
+	const bool masked = (second_byte & 0x80) != 0;
+	uint8_t mask_bytes[4] {0, 0, 0, 0};
+	if (masked) {
+		if (buffer.size() < pos + 4) {
+			return optional<Frame> {};
+		}
+		for (auto &byte : mask_bytes) {
+			byte = static_cast<uint8_t>(buffer[pos++]);
+		}
+	}
+
+	const size_t payload_size = static_cast<size_t>(length);
+	if (buffer.size() < pos + payload_size) {
+		return optional<Frame> {};
+	}
+
+	Frame frame {
+		(first_byte & 0x80) != 0,
+		static_cast<uint8_t>(first_byte & 0x0f),
+		buffer.substr(pos, payload_size),
+	};
+	if (masked) {
+		for (size_t i = 0; i < frame.payload.size(); i++) {
+			frame.payload[i] =
+				static_cast<char>(static_cast<uint8_t>(frame.payload[i]) ^ mask_bytes[i % 4]);
+		}
+	}
+	buffer.erase(0, pos + payload_size);
+
+	if ((frame.opcode & 0x08) != 0 && (!frame.fin || frame.payload.size() > 125)) {
+		return expected::unexpected(
+			MakeError(ProtocolError, "Fragmented or too large control frame from the server"));
+	}
+	return optional<Frame> {frame};
+}
+
+Connection::Connection(io::AsyncReadWriterPtr socket) :
+	socket_ {socket},
+	cancelled_ {make_shared<bool>(false)},
+	read_buffer_(MENDER_BUFSIZE) {
+}
+
+Connection::~Connection() {
+	Cancel();
+}
+
+error::Error Connection::AsyncStart(MessageHandler message_handler, ClosedHandler closed_handler) {
+	message_handler_ = message_handler;
+	closed_handler_ = closed_handler;
+	return ReadMore();
+}
+
+error::Error Connection::ReadMore() {
+	auto cancelled = cancelled_;
+	return socket_->AsyncRead(
+		read_buffer_.begin(), read_buffer_.end(), [this, cancelled](io::ExpectedSize result) {
+			if (*cancelled) {
+				return;
+			}
+			if (!result) {
+				Finish(result.error());
+				return;
+			}
+			if (result.value() == 0) {
+				Finish(MakeError(
+					ConnectionClosedError,
+					"The server closed the connection without a close frame"));
+				return;
+			}
+
+			incoming_.append(
+				read_buffer_.begin(),
+				read_buffer_.begin() + static_cast<ptrdiff_t>(result.value()));
+			received_ = true;
+			HandleIncoming();
+			if (*cancelled) {
+				return;
+			}
+
+			auto err = ReadMore();
+			if (err != error::NoError) {
+				Finish(err);
+			}
+		});
+}
+
+void Connection::HandleIncoming() {
+	auto cancelled = cancelled_;
+	while (!*cancelled) {
+		auto exp_frame = TakeFrame(incoming_);
+		if (!exp_frame) {
+			Finish(exp_frame.error());
+			return;
+		}
+		if (!exp_frame.value()) {
+			return;
+		}
+		HandleFrame(exp_frame.value().value());
+	}
+}
+
+void Connection::HandleFrame(Frame &frame) {
+	switch (frame.opcode) {
+	case kPingFrame:
+		Send(kPongFrame, frame.payload);
+		return;
+	case kPongFrame:
+		return;
+	case kCloseFrame:
+		close_received_ = true;
+		if (close_sent_) {
+			Finish(error::NoError);
+			return;
+		}
+		// Echo the status code, then wait until it's written.
+		Send(kCloseFrame, frame.payload.substr(0, 2));
+		close_sent_ = true;
+		return;
+	case kTextFrame:
+	case kBinaryFrame:
+		if (fragmented_) {
+			Finish(MakeError(
+				ProtocolError, "New message from the server before the last one ended"));
+			return;
+		}
+		if (!frame.fin) {
+			fragmented_ = Message {frame.opcode, std::move(frame.payload)};
+			return;
+		}
+		message_handler_(Message {frame.opcode, std::move(frame.payload)});
+		return;
+	case kContinuationFrame:
+		if (!fragmented_) {
+			Finish(MakeError(ProtocolError, "Continuation frame from the server without a message"));
+			return;
+		}
+		if (fragmented_->payload.size() + frame.payload.size() > kMaxMessageSize) {
+			Finish(MakeError(ProtocolError, "Message from the server is too large"));
+			return;
+		}
+		fragmented_->payload += frame.payload;
+		if (frame.fin) {
+			auto message = std::move(fragmented_.value());
+			fragmented_.reset();
+			message_handler_(message);
+		}
+		return;
+	default:
+		Finish(MakeError(
+			ProtocolError, "Unknown opcode " + to_string(frame.opcode) + " from the server"));
+		return;
+	}
+}
+
+void Connection::Send(uint8_t opcode, const string &payload) {
+	if (close_sent_ || *cancelled_) {
+		return;
+	}
+	outgoing_.push_back(ClientFrame(opcode, payload));
+	if (!write_in_progress_) {
+		WriteNext();
+	}
+}
+
+void Connection::Close() {
+	if (close_sent_ || *cancelled_) {
+		return;
+	}
+	// Normal closure, 1000.
+	Send(kCloseFrame, string {"\x03\xe8", 2});
+	close_sent_ = true;
+}
+
+bool Connection::TakeActivity() {
+	bool received = received_;
+	received_ = false;
+	return received;
+}
+
+void Connection::WriteNext() {
+	if (writing_.empty()) {
+		if (outgoing_.empty()) {
+			if (close_sent_ && close_received_) {
+				Finish(error::NoError);
+			}
+			return;
+		}
+		writing_.assign(outgoing_.front().begin(), outgoing_.front().end());
+		outgoing_.pop_front();
+	}
+
+	write_in_progress_ = true;
+	auto cancelled = cancelled_;
+	auto err = socket_->AsyncWrite(
+		writing_.cbegin(), writing_.cend(), [this, cancelled](io::ExpectedSize result) {
+			if (*cancelled) {
+				return;
+			}
+			write_in_progress_ = false;
+			if (!result) {
+				Finish(result.error());
+				return;
+			}
+			writing_.erase(
+				writing_.begin(), writing_.begin() + static_cast<ptrdiff_t>(result.value()));
+			WriteNext();
+		});
+	if (err != error::NoError) {
+		write_in_progress_ = false;
+		Finish(err);
+	}
+}
+
+void Connection::Finish(error::Error err) {
+	if (*cancelled_) {
+		return;
+	}
+	Cancel();
+	if (closed_handler_) {
+		auto handler = closed_handler_;
+		handler(err);
+	}
+}
+
+void Connection::Cancel() {
+	if (*cancelled_) {
+		return;
+	}
+	*cancelled_ = true;
+	socket_->Cancel();
+}
+
+} // namespace websocket
+} // namespace common
+} // namespace mender
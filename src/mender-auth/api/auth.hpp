@@ -15,19 +15,23 @@
 #ifndef MENDER_AUTH_API_AUTH_HPP
 #define MENDER_AUTH_API_AUTH_HPP
 
+#include <chrono>
 #include <functional>
 #include <string>
+#include <unordered_map>
 #include <vector>
 
 #include <common/crypto.hpp>
 #include <common/events.hpp>
 #include <common/error.hpp>
+#include <common/expected.hpp>
 #include <common/http.hpp>
 #include <common/device_tier.hpp>
 
 #include <api/auth.hpp>
 
 #include <client_shared/conf.hpp>
+#include <client_shared/identity_parser.hpp>
 
 namespace mender {
 namespace auth {
@@ -39,10 +43,12 @@ using namespace std;
 namespace crypto = mender::common::crypto;
 namespace events = mender::common::events;
 namespace error = mender::common::error;
+namespace expected = mender::common::expected;
 namespace http = mender::common::http;
 namespace device_tier = mender::common::device_tier;
 
 namespace conf = mender::client_shared::conf;
+namespace identity_parser = mender::client_shared::identity_parser;
 
 enum AuthClientErrorCode {
 	NoError = 0,
@@ -64,15 +70,66 @@ error::Error MakeError(AuthClientErrorCode code, const string &msg);
 using APIResponse = mender::api::auth::ExpectedAuthData;
 using APIResponseHandler = function<void(APIResponse)>;
 
+// Keeps track of how the servers have been doing, so that authentication sticks to the server
+// which worked last, instead of starting with the first one every time, and tries the ones which
+// failed recently last. Once the failback interval has passed since switching to a server, the
+// servers are tried in the configured order again.
+class ServerSelector {
+public:
+	ServerSelector(const vector<string> &servers, chrono::seconds failback_interval);
+
+	// The servers in the order to try them.
+	vector<string> Candidates() const;
+
+	// The server which worked last, empty if none has yet.
+	const string &Current() const {
+		return current_;
+	}
+
+	void ReportSuccess(const string &server);
+	void ReportFailure(const string &server);
+
+private:
+	struct Health {
+		int consecutive_failures {0};
+		chrono::steady_clock::time_point last_failure;
+	};
+
+	bool Healthy(const string &server, chrono::steady_clock::time_point now) const;
+
+	vector<string> servers_;
+	chrono::seconds failback_interval_;
+	string current_;
+	chrono::steady_clock::time_point current_since_;
+	unordered_map<string, Health> health_;
+};
+
 error::Error FetchJWTToken(
 	mender::common::http::Client &client,
 	const vector<string> &servers,
 	const crypto::Args &args,
-	const string &device_identity_script_path,
+	const identity_parser::IdentitySource &identity_source,
 	APIResponseHandler api_handler,
 	const string &tenant_token = "",
 	const string &device_tier = device_tier::kStandard);
 
+// Like above, but tries the servers in the order given by `selector`, and reports to it how they
+// did. `selector` must outlive the authentication.
+error::Error FetchJWTToken(
+	mender::common::http::Client &client,
+	ServerSelector &selector,
+	const crypto::Args &args,
+	const identity_parser::IdentitySource &identity_source,
+	APIResponseHandler api_handler,
+	const string &tenant_token = "",
+	const string &device_tier = device_tier::kStandard);
+
+using ExpectedTimePoint = expected::expected<chrono::system_clock::time_point, error::Error>;
+
+// When the token expires, according to its "exp" claim. The token is not verified, only the server
+// can do that.
+ExpectedTimePoint JWTExpiry(const string &token);
+
 #ifdef MENDER_EMBED_MENDER_AUTH
 class AuthenticatorHttp : public mender::api::auth::Authenticator {
 public:
@@ -82,7 +139,9 @@ public:
 		chrono::seconds auth_timeout = chrono::minutes {1}) :
 		Authenticator {loop, auth_timeout},
 		config_ {config},
-		client_ {config.GetHttpClientConfig(), loop} {
+		client_ {config.GetHttpClientConfig(), loop},
+		server_selector_ {
+			config.servers, chrono::seconds {config.server_failover.failback_interval_seconds}} {
 	}
 
 	void SetCryptoArgs(const crypto::Args &args) {
@@ -99,6 +158,7 @@ private:
 
 	const conf::MenderConfig &config_;
 	http::Client client_;
+	ServerSelector server_selector_;
 	crypto::Args crypto_args_;
 
 	string token_;
@@ -14,6 +14,10 @@
 
 #include <mender-auth/api/auth.hpp>
 
+#include <algorithm>
+#include <memory>
+
+#include <common/common.hpp>
 #include <common/expected.hpp>
 #include <common/io.hpp>
 #include <common/json.hpp>
@@ -33,8 +37,6 @@ namespace json = mender::common::json;
 namespace key_value_parser = mender::common::key_value_parser;
 namespace mlog = mender::common::log;
 
-namespace identity_parser = mender::client_shared::identity_parser;
-
 using AuthData = mender::api::auth::AuthData;
 
 const string request_uri = "/api/devices/v1/authentication/auth_requests";
@@ -77,24 +79,75 @@ error::Error MakeHTTPResponseError(
 			+ ")");
 }
 
+ServerSelector::ServerSelector(const vector<string> &servers, chrono::seconds failback_interval) :
+	servers_ {servers},
+	failback_interval_ {failback_interval} {
+}
+
+bool ServerSelector::Healthy(const string &server, chrono::steady_clock::time_point now) const {
+	auto health = health_.find(server);
+	return health == health_.end() || health->second.consecutive_failures == 0
+		   || now - health->second.last_failure >= failback_interval_;
+}
+
+vector<string> ServerSelector::Candidates() const {
+	auto now = chrono::steady_clock::now();
+	vector<string> candidates {servers_};
+
+	if (current_ != "" && now - current_since_ < failback_interval_) {
+		auto current = find(candidates.begin(), candidates.end(), current_);
+		if (current != candidates.end()) {
+			rotate(candidates.begin(), current, std::next(current));
+		}
+	}
+
+	stable_partition(candidates.begin(), candidates.end(), [this, now](const string &server) {
+		return Healthy(server, now);
+	});
+	return candidates;
+}
+
+void ServerSelector::ReportSuccess(const string &server) {
+	health_.erase(server);
+	if (server == current_) {
+		return;
+	}
+	if (current_ != "") {
+		mlog::Warning("Switching from server '" + current_ + "' to '" + server + "'");
+	}
+	current_ = server;
+	current_since_ = chrono::steady_clock::now();
+}
+
+void ServerSelector::ReportFailure(const string &server) {
+	auto &health = health_[server];
+	health.consecutive_failures++;
+	health.last_failure = chrono::steady_clock::now();
+	mlog::Debug(
+		"Server '" + server + "' failed " + to_string(health.consecutive_failures)
+		+ " time(s) in a row");
+}
+
 static void TryAuthenticate(
-	vector<string>::const_iterator server_it,
-	vector<string>::const_iterator end,
+	shared_ptr<const vector<string>> servers,
+	size_t index,
 	mender::common::http::Client &client,
 	const string request_body,
 	const string signature,
+	ServerSelector *selector,
 	APIResponseHandler api_handler);
 
-error::Error FetchJWTToken(
+static error::Error StartAuthentication(
 	mender::common::http::Client &client,
-	const vector<string> &servers,
+	shared_ptr<const vector<string>> servers,
+	ServerSelector *selector,
 	const crypto::Args &crypto_args,
-	const string &device_identity_script_path,
+	const identity_parser::IdentitySource &identity_source,
 	APIResponseHandler api_handler,
 	const string &tenant_token,
 	const string &device_tier) {
 	key_value_parser::ExpectedKeyValuesMap expected_identity_data =
-		identity_parser::GetIdentityData(device_identity_script_path);
+		identity_parser::GetIdentityData(identity_source);
 	if (!expected_identity_data) {
 		return expected_identity_data.error();
 	}
@@ -134,24 +187,76 @@ error::Error FetchJWTToken(
 
 	// TryAuthenticate() calls the handler on any potential further errors, we
 	// are done here with no errors.
-	TryAuthenticate(servers.cbegin(), servers.cend(), client, request_body, signature, api_handler);
+	TryAuthenticate(servers, 0, client, request_body, signature, selector, api_handler);
 	return error::NoError;
 }
 
+error::Error FetchJWTToken(
+	mender::common::http::Client &client,
+	const vector<string> &servers,
+	const crypto::Args &crypto_args,
+	const identity_parser::IdentitySource &identity_source,
+	APIResponseHandler api_handler,
+	const string &tenant_token,
+	const string &device_tier) {
+	return StartAuthentication(
+		client,
+		make_shared<const vector<string>>(servers),
+		nullptr,
+		crypto_args,
+		identity_source,
+		api_handler,
+		tenant_token,
+		device_tier);
+}
+
+error::Error FetchJWTToken(
+	mender::common::http::Client &client,
+	ServerSelector &selector,
+	const crypto::Args &crypto_args,
+	const identity_parser::IdentitySource &identity_source,
+	APIResponseHandler api_handler,
+	const string &tenant_token,
+	const string &device_tier) {
+	return StartAuthentication(
+		client,
+		make_shared<const vector<string>>(selector.Candidates()),
+		&selector,
+		crypto_args,
+		identity_source,
+		api_handler,
+		tenant_token,
+		device_tier);
+}
+
 static void TryAuthenticate(
-	vector<string>::const_iterator server_it,
-	vector<string>::const_iterator end,
+	shared_ptr<const vector<string>> servers,
+	size_t index,
 	mender::common::http::Client &client,
 	const string request_body,
 	const string signature,
+	ServerSelector *selector,
 	APIResponseHandler api_handler) {
-	if (server_it == end) {
+	if (index >= servers->size()) {
 		auto err = MakeError(AuthenticationError, "No more servers to try for authentication");
 		api_handler(expected::unexpected(err));
 		return;
 	}
+	const string &server = (*servers)[index];
+
+	// Tries the next server, and, unless the server did answer, takes note of the failure.
+	auto try_next = [servers, index, &client, request_body, signature, selector, api_handler](
+						const error::Error &err, bool server_answered) {
+		const string &server = (*servers)[index];
+		mlog::Info("Authentication error trying server '" + server + "': " + err.String());
+		if (selector != nullptr && !server_answered) {
+			selector->ReportFailure(server);
+		}
+		TryAuthenticate(
+			servers, index + 1, client, request_body, signature, selector, api_handler);
+	};
 
-	auto whole_url = mender::common::http::JoinUrl(*server_it, request_uri);
+	auto whole_url = mender::common::http::JoinUrl(server, request_uri);
 	auto req = make_shared<mender::common::http::OutgoingRequest>();
 	req->SetMethod(mender::common::http::Method::POST);
 	req->SetAddress(whole_url);
@@ -160,6 +265,9 @@ static void TryAuthenticate(
 	req->SetHeader("Accept", "application/json");
 	req->SetHeader("X-MEN-Signature", signature);
 	req->SetHeader("Authorization", "API_KEY");
+	for (const auto &header : client.GetConfig().api_headers) {
+		req->SetHeader(header.first, header.second);
+	}
 
 	req->SetBodyGenerator([request_body]() -> io::ExpectedReaderPtr {
 		return make_shared<io::StringReader>(request_body);
@@ -169,14 +277,9 @@ static void TryAuthenticate(
 
 	auto err = client.AsyncCall(
 		req,
-		[received_body, server_it, end, &client, request_body, signature, api_handler](
-			mender::common::http::ExpectedIncomingResponsePtr exp_resp) {
+		[received_body, try_next](mender::common::http::ExpectedIncomingResponsePtr exp_resp) {
 			if (!exp_resp) {
-				mlog::Info(
-					"Authentication error trying server '" + *server_it
-					+ "': " + exp_resp.error().String());
-				TryAuthenticate(
-					std::next(server_it), end, client, request_body, signature, api_handler);
+				try_next(exp_resp.error(), false);
 				return;
 			}
 			auto resp = exp_resp.value();
@@ -189,49 +292,49 @@ static void TryAuthenticate(
 			mlog::Debug("Status code:" + to_string(resp->GetStatusCode()));
 			mlog::Debug("Status message: " + resp->GetStatusMessage());
 		},
-		[received_body, server_it, end, &client, request_body, signature, api_handler](
+		[received_body, servers, index, selector, try_next, api_handler](
 			mender::common::http::ExpectedIncomingResponsePtr exp_resp) {
 			if (!exp_resp) {
-				mlog::Info(
-					"Authentication error trying server '" + *server_it
-					+ "': " + exp_resp.error().String());
-				TryAuthenticate(
-					std::next(server_it), end, client, request_body, signature, api_handler);
+				try_next(exp_resp.error(), false);
 				return;
 			}
 			auto resp = exp_resp.value();
+			const string &server = (*servers)[index];
 
 			string response_body = common::StringFromByteVector(*received_body);
 
-			error::Error err;
 			switch (resp->GetStatusCode()) {
 			case mender::common::http::StatusOK:
-				api_handler(AuthData {*server_it, response_body});
+				if (selector != nullptr) {
+					selector->ReportSuccess(server);
+				}
+				api_handler(AuthData {server, response_body});
 				return;
 			case mender::common::http::StatusUnauthorized:
-				err = MakeHTTPResponseError(
-					UnauthorizedError, resp, response_body, "Failed to authorize with the server.");
-				mlog::Info(
-					"Authentication error trying server '" + *server_it + "': " + err.String());
-				TryAuthenticate(
-					std::next(server_it), end, client, request_body, signature, api_handler);
+				try_next(
+					MakeHTTPResponseError(
+						UnauthorizedError,
+						resp,
+						response_body,
+						"Failed to authorize with the server."),
+					true);
 				return;
 			case mender::common::http::StatusBadRequest:
+				try_next(
+					MakeHTTPResponseError(
+						APIError, resp, response_body, "Failed to authorize with the server."),
+					true);
+				return;
 			case mender::common::http::StatusInternalServerError:
-				err = MakeHTTPResponseError(
-					APIError, resp, response_body, "Failed to authorize with the server.");
-				mlog::Info(
-					"Authentication error trying server '" + *server_it + "': " + err.String());
-				TryAuthenticate(
-					std::next(server_it), end, client, request_body, signature, api_handler);
+				try_next(
+					MakeHTTPResponseError(
+						APIError, resp, response_body, "Failed to authorize with the server."),
+					false);
 				return;
 			default:
-				err =
-					MakeError(ResponseError, "Unexpected error code: " + resp->GetStatusMessage());
-				mlog::Info(
-					"Authentication error trying server '" + *server_it + "': " + err.String());
-				TryAuthenticate(
-					std::next(server_it), end, client, request_body, signature, api_handler);
+				try_next(
+					MakeError(ResponseError, "Unexpected error code: " + resp->GetStatusMessage()),
+					false);
 				return;
 			}
 		});
@@ -240,6 +343,36 @@ static void TryAuthenticate(
 	}
 }
 
+ExpectedTimePoint JWTExpiry(const string &token) {
+	auto parts = mender::common::SplitString(token, ".");
+	if (parts.size() != 3) {
+		return expected::unexpected(MakeError(AuthenticationError, "Not a JSON Web Token"));
+	}
+
+	// The claims are base64url encoded without padding, see RFC 7515.
+	string claims {parts[1]};
+	replace(claims.begin(), claims.end(), '-', '+');
+	replace(claims.begin(), claims.end(), '_', '/');
+	claims.append((4 - claims.size() % 4) % 4, '=');
+	auto exp_decoded = crypto::DecodeBase64(claims);
+	if (!exp_decoded) {
+		return expected::unexpected(
+			exp_decoded.error().WithContext("Could not decode the claims of the token"));
+	}
+
+	auto exp_json = json::Load(mender::common::StringFromByteVector(exp_decoded.value()));
+	if (!exp_json) {
+		return expected::unexpected(
+			exp_json.error().WithContext("Could not parse the claims of the token"));
+	}
+	auto exp_expiry = exp_json.value().Get("exp").and_then(json::ToInt64);
+	if (!exp_expiry) {
+		return expected::unexpected(
+			exp_expiry.error().WithContext("Could not get the expiry of the token"));
+	}
+	return chrono::system_clock::time_point {chrono::seconds {exp_expiry.value()}};
+}
+
 } // namespace auth
 } // namespace api
 } // namespace auth
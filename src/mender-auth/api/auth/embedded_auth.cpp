@@ -55,9 +55,10 @@ void AuthenticatorHttp::FetchJwtTokenHandler(APIResponse resp) {
 error::Error AuthenticatorHttp::FetchJwtToken() {
 	return FetchJWTToken(
 		client_,
-		config_.servers,
+		server_selector_,
 		crypto_args_,
-		config_.paths.GetIdentityScript(),
+		identity_parser::IdentitySource {
+			config_.paths.GetIdentityScript(), config_.identity_providers},
 		[this](APIResponse resp) { FetchJwtTokenHandler(resp); },
 		config_.tenant_token);
 }
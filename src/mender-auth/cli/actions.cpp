@@ -27,6 +27,7 @@
 #include <common/log.hpp>
 
 #ifdef MENDER_USE_DBUS
+#include <common/platform/dbus.hpp>
 #include <mender-auth/ipc/server.hpp>
 #endif
 
@@ -37,11 +38,14 @@ namespace cli {
 using namespace std;
 
 namespace auth_client = mender::auth::api::auth;
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace events = mender::common::events;
 namespace http = mender::common::http;
+namespace identity_parser = mender::client_shared::identity_parser;
 namespace log = mender::common::log;
 
 #ifdef MENDER_USE_DBUS
+namespace dbus = mender::common::dbus;
 namespace ipc = mender::auth::ipc;
 #endif
 
@@ -55,15 +59,46 @@ shared_ptr<MenderKeyStore> KeystoreFromConfig(
 		pem_file = config.security.auth_private_key;
 		ssl_engine = config.security.ssl_engine;
 		static_key = cli::StaticKey::Yes;
+	} else if (config.security.auth_mode == cfg_parser::AuthMode::MTLS) {
+		// The device is identified by its client certificate, so it must authenticate with
+		// the same key, which is never generated by us.
+		pem_file = config.https_client.key;
+		ssl_engine = config.https_client.ssl_engine;
+		static_key = cli::StaticKey::Yes;
+	} else if (config.security.security_key != "") {
+		// Kept in a PKCS#11 token, and generated there if it doesn't exist yet.
+		pem_file = config.security.security_key;
+		ssl_engine = config.security.ssl_engine;
+		static_key = cli::StaticKey::No;
 	} else {
 		pem_file = config.paths.GetKeyFile();
 		static_key = cli::StaticKey::No;
 	}
 
-	return make_shared<MenderKeyStore>(pem_file, ssl_engine, static_key, passphrase);
+	crypto::KeyType key_type {crypto::KeyType::Ed25519};
+	switch (config.security.key_type) {
+	case cfg_parser::KeyType::Ed25519:
+		key_type = crypto::KeyType::Ed25519;
+		break;
+	case cfg_parser::KeyType::EcdsaP256:
+		key_type = crypto::KeyType::EcdsaP256;
+		break;
+	case cfg_parser::KeyType::Rsa3072:
+		key_type = crypto::KeyType::Rsa3072;
+		break;
+	}
+
+	return make_shared<MenderKeyStore>(pem_file, ssl_engine, static_key, passphrase, key_type);
 }
 
-error::Error DoBootstrap(shared_ptr<MenderKeyStore> keystore, const bool force) {
+error::Error DoBootstrap(
+	const string &data_store, shared_ptr<MenderKeyStore> keystore, const bool force) {
+	// So that the daemon and `mender-auth bootstrap` don't both generate a key at the same time.
+	auto exp_lock = conf::LockDataStore(data_store);
+	if (!exp_lock) {
+		return exp_lock.error();
+	}
+
 	auto err = keystore->Load();
 	if (err != error::NoError && err.code != MakeError(NoKeysError, "").code) {
 		return err;
@@ -72,7 +107,11 @@ error::Error DoBootstrap(shared_ptr<MenderKeyStore> keystore, const bool force)
 		log::Error("Got error loading the private key from the keystore: " + err.String());
 	}
 	if (err.code == MakeError(NoKeysError, "").code || force) {
-		log::Info("Generating new ED25519 key");
+		if (keystore->InToken()) {
+			log::Info("Generating new EC P-256 key in the PKCS#11 token");
+		} else {
+			log::Info("Generating new " + crypto::KeyTypeName(keystore->KeyType()) + " key");
+		}
 		err = keystore->Generate();
 		if (err != error::NoError) {
 			return err;
@@ -89,17 +128,22 @@ error::Error DoAuthenticate(
 	context::MenderContext &main_context, shared_ptr<MenderKeyStore> keystore) {
 	events::EventLoop loop;
 	auto &config = main_context.GetConfig();
+	auto err = config.DiscoverServers();
+	if (err != error::NoError) {
+		return err;
+	}
 	if (config.servers.size() == 0) {
 		log::Info("No server set in the configuration, skipping authentication");
 		return error::NoError;
 	}
 	mender::common::events::Timer timer {loop};
 	http::Client client {config.GetHttpClientConfig(), loop};
-	auto err = auth_client::FetchJWTToken(
+	err = auth_client::FetchJWTToken(
 		client,
 		config.servers,
 		{keystore->KeyName(), keystore->PassPhrase(), keystore->SSLEngine()},
-		config.paths.GetIdentityScript(),
+		identity_parser::IdentitySource {
+			config.paths.GetIdentityScript(), config.identity_providers},
 		[&loop, &timer](auth_client::APIResponse resp) {
 			log::Info("Got Auth response");
 			if (resp) {
@@ -138,6 +182,11 @@ error::Error DaemonAction::Execute(context::MenderContext &main_context) {
 	log::Info("Running mender-auth " + conf::kMenderVersion);
 
 	auto &config = main_context.GetConfig();
+	auto err = config.DiscoverServers();
+	if (err != error::NoError) {
+		log::Error(err.String());
+		return error::MakeError(error::ExitWithFailureError, "");
+	}
 	if (none_of(config.servers.cbegin(), config.servers.cend(), [](const string &it) {
 			return it != "";
 		})) {
@@ -145,7 +194,7 @@ error::Error DaemonAction::Execute(context::MenderContext &main_context) {
 		return error::MakeError(error::ExitWithFailureError, "");
 	}
 
-	auto err = DoBootstrap(keystore_, force_bootstrap_);
+	err = DoBootstrap(config.paths.GetDataStore(), keystore_, force_bootstrap_);
 	if (err != error::NoError) {
 		log::Error("Failed to bootstrap: " + err.String());
 		return error::MakeError(error::ExitWithFailureError, "");
@@ -199,13 +248,55 @@ ExpectedActionPtr BootstrapAction::Create(
 }
 
 error::Error BootstrapAction::Execute(context::MenderContext &main_context) {
-	auto err = DoBootstrap(keystore_, force_bootstrap_);
+	auto err = DoBootstrap(
+		main_context.GetConfig().paths.GetDataStore(), keystore_, force_bootstrap_);
 	if (err != error::NoError) {
 		return err;
 	}
 	return DoAuthenticate(main_context, keystore_);
 }
 
+error::Error SetTenantTokenAction::Execute(context::MenderContext &main_context) {
+	auto &config = main_context.GetConfig();
+
+#ifdef MENDER_USE_DBUS
+	// The running daemon saves it, and authenticates again with it right away.
+	events::EventLoop loop;
+	dbus::DBusClient client {loop};
+	error::Error call_err;
+	auto err = client.CallMethod<expected::ExpectedString>(
+		"io.mender.AuthenticationManager",
+		"/io/mender/AuthenticationManager",
+		"io.mender.Authentication1",
+		"SetTenantToken",
+		token_,
+		[&loop, &call_err](expected::ExpectedString exp_info) {
+			if (!exp_info) {
+				call_err = exp_info.error();
+			}
+			loop.Stop();
+		});
+	if (err == error::NoError) {
+		loop.Run();
+		err = call_err;
+	}
+	if (err == error::NoError) {
+		log::Info("Tenant token replaced, the daemon is authenticating with it");
+		return error::NoError;
+	}
+	log::Info(
+		"Could not pass the tenant token to the daemon, it is used from its next start: "
+		+ err.String());
+#endif // MENDER_USE_DBUS
+
+	auto save_err = conf::SaveTenantToken(config.paths.GetDataStore(), token_);
+	if (save_err != error::NoError) {
+		return save_err.WithContext("Could not replace the tenant token");
+	}
+	log::Info("Tenant token replaced");
+	return error::NoError;
+}
+
 } // namespace cli
 } // namespace auth
 } // namespace mender
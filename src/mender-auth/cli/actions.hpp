@@ -76,6 +76,19 @@ private:
 	bool force_bootstrap_;
 };
 
+// Moves the device to another tenant, through the daemon if it is running.
+class SetTenantTokenAction : virtual public Action {
+public:
+	SetTenantTokenAction(const string &token) :
+		token_ {token} {
+	}
+
+	error::Error Execute(context::MenderContext &main_context) override;
+
+private:
+	string token_;
+};
+
 } // namespace cli
 } // namespace auth
 } // namespace mender
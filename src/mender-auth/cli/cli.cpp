@@ -69,6 +69,17 @@ const conf::CliCommand cmd_daemon {
 	.options = opts_bootstrap_daemon,
 };
 
+const conf::CliCommand cmd_set_tenant_token {
+	.name = "set-tenant-token",
+	.description =
+		"Move the device to another tenant, replacing TenantToken of the configuration. '-' reads the token from stdin",
+	.argument =
+		conf::CliArgument {
+			.name = "token",
+			.mandatory = true,
+		},
+};
+
 const conf::CliApp cli_mender_auth = {
 	.name = "mender-auth",
 	.short_description = "manage and start Mender Auth",
@@ -79,13 +90,15 @@ const conf::CliApp cli_mender_auth = {
 		{
 			cmd_bootstrap,
 			cmd_daemon,
+			cmd_set_tenant_token,
 		},
 };
 
-static expected::ExpectedString GetPassphraseFromFile(const string &filepath) {
-	string passphrase = "";
+// Reads the first line, of a passphrase or a token.
+static expected::ExpectedString ReadLineFromFile(const string &filepath) {
+	string line = "";
 	if (filepath == "") {
-		return passphrase;
+		return line;
 	}
 
 	auto ex_ifs = io::OpenIfstream(filepath == "-" ? io::paths::Stdin : filepath);
@@ -95,16 +108,16 @@ static expected::ExpectedString GetPassphraseFromFile(const string &filepath) {
 	auto &ifs = ex_ifs.value();
 
 	errno = 0;
-	getline(ifs, passphrase);
+	getline(ifs, line);
 	if (ifs.bad()) {
 		int io_errno = errno;
 		error::Error err {
 			generic_category().default_error_condition(io_errno),
-			"Failed to read passphrase from '" + filepath + "'"};
+			"Failed to read from '" + filepath + "'"};
 		return expected::unexpected(err);
 	}
 
-	return passphrase;
+	return line;
 }
 
 static ExpectedActionPtr ParseAuthArguments(
@@ -131,7 +144,7 @@ static ExpectedActionPtr ParseAuthArguments(
 			   && ((ex_opt_val.value().option != "") || (ex_opt_val.value().value != ""))) {
 			auto opt_val = ex_opt_val.value();
 			if ((opt_val.option == "--passphrase-file")) {
-				auto ex_passphrase = GetPassphraseFromFile(opt_val.value);
+				auto ex_passphrase = ReadLineFromFile(opt_val.value);
 				if (!ex_passphrase) {
 					return expected::unexpected(ex_passphrase.error());
 				}
@@ -148,6 +161,44 @@ static ExpectedActionPtr ParseAuthArguments(
 		}
 	}
 
+	if (start[0] == "set-tenant-token") {
+		conf::CmdlineOptionsIterator opts_iter(start + 1, end, cmd_set_tenant_token.options);
+		opts_iter.SetArgumentsMode(conf::ArgumentsMode::AcceptBareArguments);
+		string token;
+		while (true) {
+			auto ex_opt_val = opts_iter.Next();
+			if (!ex_opt_val) {
+				return expected::unexpected(ex_opt_val.error());
+			}
+			auto opt_val = ex_opt_val.value();
+			if (opt_val.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + opt_val.option));
+			}
+			if (opt_val.value == "") {
+				break;
+			}
+			if (token != "") {
+				return expected::unexpected(conf::MakeError(
+					conf::InvalidOptionsError, "Too many arguments: " + opt_val.value));
+			}
+			token = opt_val.value;
+		}
+		if (token == "-") {
+			// Keeps the token out of the process list.
+			auto ex_token = ReadLineFromFile("-");
+			if (!ex_token) {
+				return expected::unexpected(ex_token.error());
+			}
+			token = ex_token.value();
+		}
+		if (token == "") {
+			return expected::unexpected(
+				conf::MakeError(conf::InvalidOptionsError, "Need a tenant token"));
+		}
+		return make_shared<SetTenantTokenAction>(token);
+	}
+
 	if (start[0] == "bootstrap") {
 		return BootstrapAction::Create(config, passphrase, forcebootstrap);
 	} else if (start[0] == "daemon") {
@@ -17,6 +17,7 @@
 #include <string>
 #include <utility>
 
+#include <common/common.hpp>
 #include <common/log.hpp>
 #include <common/crypto.hpp>
 
@@ -27,6 +28,7 @@ namespace cli {
 
 using namespace std;
 
+namespace common = mender::common;
 namespace log = mender::common::log;
 
 namespace crypto = mender::common::crypto;
@@ -79,6 +81,11 @@ error::Error MenderKeyStore::Save() {
 		return MakeError(NoKeysError, "Need to load or generate a key before save");
 	}
 
+	if (InToken()) {
+		// Generated keys are stored in the token right away.
+		return error::NoError;
+	}
+
 	return key_->SaveToPEM(key_name_);
 }
 
@@ -87,7 +94,15 @@ error::Error MenderKeyStore::Generate() {
 		return MakeError(StaticKeyError, "A static key cannot be re-generated");
 	}
 
-	auto exp_key = crypto::PrivateKey::Generate();
+	if (InToken() && key_) {
+		// The token would hold both keys under the same URI.
+		return MakeError(
+			StaticKeyError,
+			"A key in a PKCS#11 token cannot be re-generated, remove it from the token first");
+	}
+
+	auto exp_key = InToken() ? crypto::PrivateKey::GenerateInToken(key_name_)
+							 : crypto::PrivateKey::Generate(key_type_);
 	if (!exp_key) {
 		return exp_key.error();
 	}
@@ -96,6 +111,10 @@ error::Error MenderKeyStore::Generate() {
 	return error::NoError;
 }
 
+bool MenderKeyStore::InToken() const {
+	return common::StartsWith<string>(key_name_, "pkcs11:");
+}
+
 } // namespace cli
 } // namespace auth
 } // namespace mender
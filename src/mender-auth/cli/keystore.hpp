@@ -56,11 +56,13 @@ public:
 		const string &key_name,
 		const string &ssl_engine,
 		StaticKey static_key,
-		const string &passphrase) :
+		const string &passphrase,
+		crypto::KeyType key_type = crypto::KeyType::Ed25519) :
 		key_name_ {key_name},
 		ssl_engine_ {ssl_engine},
 		static_key_ {static_key},
-		passphrase_ {passphrase} {};
+		passphrase_ {passphrase},
+		key_type_ {key_type} {};
 
 	error::Error Load();
 	error::Error Save();
@@ -75,12 +77,19 @@ public:
 	string PassPhrase() {
 		return passphrase_;
 	};
+	// The algorithm of generated keys, except in a PKCS#11 token, where they are always EC P-256.
+	crypto::KeyType KeyType() {
+		return key_type_;
+	};
+	// Whether the key is kept in a PKCS#11 token rather than in a file.
+	bool InToken() const;
 
 private:
 	string key_name_;
 	string ssl_engine_;
 	StaticKey static_key_;
 	string passphrase_;
+	crypto::KeyType key_type_;
 	std::unique_ptr<crypto::PrivateKey> key_;
 };
 
@@ -37,9 +37,9 @@ using namespace std;
 
 class ForwardObject {
 private:
-	ForwardObject(const http::ClientConfig &config, events::EventLoop &event_loop);
+	ForwardObject(unique_ptr<http::Client> client);
 
-	http::Client client_;
+	unique_ptr<http::Client> client_;
 
 	log::Logger logger_;
 
@@ -86,6 +86,9 @@ private:
 		http::IncomingResponsePtr resp_in,
 		http::OutgoingResponsePtr resp_out);
 
+	unique_ptr<http::Client> TakeClient();
+	void FinishConnection(http::IncomingRequestPtr req_in);
+
 	log::Logger logger_;
 	events::EventLoop &event_loop_;
 	http::Server server_;
@@ -94,6 +97,9 @@ private:
 	string target_url_;
 
 	unordered_map<http::IncomingRequestPtr, ForwardObjectPtr> connections_;
+	// Clients of finished requests, so that the next requests can use the connections they kept
+	// open to the target.
+	vector<unique_ptr<http::Client>> idle_clients_;
 
 	friend class ForwardObject;
 	friend class TestServer;
@@ -18,8 +18,11 @@ namespace mender {
 namespace auth {
 namespace http_forwarder {
 
-ForwardObject::ForwardObject(const http::ClientConfig &config, events::EventLoop &event_loop) :
-	client_(config, event_loop),
+// More concurrent requests than this don't get their own kept open connections.
+const size_t kMaxIdleClients = 4;
+
+ForwardObject::ForwardObject(unique_ptr<http::Client> client) :
+	client_(std::move(client)),
 	logger_("http_forwarder") {
 }
 
@@ -44,6 +47,7 @@ void Server::Cancel() {
 	*cancelled_ = true;
 	cancelled_ = make_shared<bool>(true);
 	connections_.clear();
+	idle_clients_.clear();
 	server_.Cancel();
 }
 
@@ -101,7 +105,7 @@ void Server::RequestHeaderHandler(http::ExpectedIncomingRequestPtr exp_req) {
 	}
 	auto &req_in = exp_req.value();
 
-	ForwardObjectPtr connection {new ForwardObject(client_config_, event_loop_)};
+	ForwardObjectPtr connection {new ForwardObject(TakeClient())};
 	connections_[req_in] = connection;
 	connection->logger_ = logger_.WithFields(log::LogField {"request", req_in->GetPath()});
 	connection->req_in_ = req_in;
@@ -113,6 +117,9 @@ void Server::RequestHeaderHandler(http::ExpectedIncomingRequestPtr exp_req) {
 	for (auto header : req_in->GetHeaders()) {
 		req_out->SetHeader(header.first, header.second);
 	}
+	for (const auto &header : client_config_.api_headers) {
+		req_out->SetHeader(header.first, header.second);
+	}
 	connection->req_out_ = req_out;
 
 	auto exp_body_reader = req_in->MakeBodyAsyncReader();
@@ -139,7 +146,7 @@ void Server::RequestHeaderHandler(http::ExpectedIncomingRequestPtr exp_req) {
 	} // else: if body is missing we don't need to do anything.
 
 	auto &cancelled = cancelled_;
-	auto err = connection->client_.AsyncCall(
+	auto err = connection->client_->AsyncCall(
 		req_out,
 		[this, cancelled, req_in](http::ExpectedIncomingResponsePtr exp_resp) {
 			if (!*cancelled) {
@@ -251,8 +258,7 @@ void Server::ResponseHeaderHandler(
 		auto &connection = connections_[req_in];
 		connection->incoming_request_finished_ = true;
 		if (connection->outgoing_request_finished_) {
-			// We are done, remove connection.
-			connections_.erase(req_in);
+			FinishConnection(req_in);
 		}
 	});
 	if (err != error::NoError) {
@@ -329,9 +335,26 @@ void Server::ResponseBodyHandler(
 
 	connection->outgoing_request_finished_ = true;
 	if (connection->incoming_request_finished_) {
-		// We are done, remove connection.
-		connections_.erase(req_in);
+		FinishConnection(req_in);
+	}
+}
+
+unique_ptr<http::Client> Server::TakeClient() {
+	if (idle_clients_.empty()) {
+		return make_unique<http::Client>(client_config_, event_loop_);
+	}
+	auto client = std::move(idle_clients_.back());
+	idle_clients_.pop_back();
+	return client;
+}
+
+void Server::FinishConnection(http::IncomingRequestPtr req_in) {
+	// We are done, remove connection, but keep its client for the next request.
+	auto &connection = connections_[req_in];
+	if (idle_clients_.size() < kMaxIdleClients) {
+		idle_clients_.push_back(std::move(connection->client_));
 	}
+	connections_.erase(req_in);
 }
 
 } // namespace http_forwarder
@@ -14,6 +14,8 @@
 
 #include <mender-auth/ipc/server.hpp>
 
+#include <algorithm>
+#include <chrono>
 #include <functional>
 #include <iostream>
 #include <string>
@@ -22,6 +24,8 @@
 #include <common/platform/dbus.hpp>
 #include <common/error.hpp>
 #include <common/expected.hpp>
+#include <common/json.hpp>
+#include <common/local_api.hpp>
 #include <common/log.hpp>
 
 namespace mender {
@@ -32,48 +36,235 @@ namespace crypto = mender::common::crypto;
 namespace dbus = mender::common::dbus;
 namespace error = mender::common::error;
 namespace expected = mender::common::expected;
+namespace identity_parser = mender::client_shared::identity_parser;
+namespace json = mender::common::json;
 
 
 using namespace std;
 
+// See Documentation/io.mender.Authentication1.xml.
+static const string kAuthenticationInterface {"io.mender.Authentication1"};
+
+// How long before the token expires it is renewed. At most a tenth of its remaining lifetime, for
+// tokens which are only valid for a short while.
+static const chrono::seconds kMaxRenewalMargin {chrono::minutes {5}};
+
 // Register DBus object handling auth methods and signals
 error::Error AuthenticatingForwarder::Listen(
 	const crypto::Args &args, const string &identity_script_path) {
 	// Cannot serve new tokens when not knowing where to fetch them from.
 	AssertOrReturnError(servers_.size() > 0);
 
+	auto fetch_jwt_token = [this, args, identity_script_path]() {
+		if (auth_in_progress_) {
+			// Already authenticating, nothing to do here.
+			return true;
+		}
+		auto err = auth_client::FetchJWTToken(
+			client_,
+			server_selector_,
+			args,
+			identity_parser::IdentitySource {
+				identity_script_path == "" ? default_identity_script_path_ : identity_script_path,
+				identity_providers_},
+			[this](auth_client::APIResponse resp) { FetchJwtTokenHandler(resp); },
+			tenant_token_,
+			device_tier_);
+		if (err != error::NoError) {
+			log::Error("Failed to trigger token fetching: " + err.String());
+			return false;
+		}
+		auth_in_progress_ = true;
+		return true;
+	};
+	fetch_jwt_token_ = fetch_jwt_token;
+
 	auto dbus_obj = make_shared<dbus::DBusObject>("/io/mender/AuthenticationManager");
 	dbus_obj->AddMethodHandler<dbus::ExpectedStringPair>(
-		"io.mender.Authentication1", "GetJwtToken", [this]() {
+		kAuthenticationInterface, "GetJwtToken", [this]() {
 			return dbus::StringPair {GetJWTToken(), GetServerURL()};
 		});
 	dbus_obj->AddMethodHandler<expected::ExpectedBool>(
-		"io.mender.Authentication1", "FetchJwtToken", [this, args, identity_script_path]() {
-			if (auth_in_progress_) {
-				// Already authenticating, nothing to do here.
-				return true;
-			}
-			auto err = auth_client::FetchJWTToken(
-				client_,
-				servers_,
-				args,
-				identity_script_path == "" ? default_identity_script_path_ : identity_script_path,
-				[this](auth_client::APIResponse resp) { FetchJwtTokenHandler(resp); },
-				tenant_token_,
-				device_tier_);
+		kAuthenticationInterface, "FetchJwtToken", fetch_jwt_token);
+	dbus_obj->AddMethodHandler<expected::ExpectedString>(
+		kAuthenticationInterface, "GetJwtTokenInfo", [this]() -> expected::ExpectedString {
+			return TokenInfoJson();
+		});
+	dbus_obj->AddMethodHandler<expected::ExpectedString>(
+		kAuthenticationInterface,
+		"SetTenantToken",
+		[this](const string &token) -> expected::ExpectedString {
+			auto err = SetTenantToken(token);
 			if (err != error::NoError) {
-				log::Error("Failed to trigger token fetching: " + err.String());
-				return false;
+				return expected::unexpected(err);
 			}
-			auth_in_progress_ = true;
-			return true;
+			return TokenInfoJson();
 		});
 
-	return dbus_server_.AdvertiseObject(dbus_obj);
+	dbus::AddManagementMethodHandlers(*dbus_obj);
+	if (!dbus_authorization_.rules.empty()) {
+		dbus_authorization_.ResolveIds();
+		dbus_obj->SetMethodAuthorizer([this](const dbus::MethodCaller &caller, const string &spec) {
+			return dbus_authorization_.Allows(spec, caller.uid, caller.gids);
+		});
+	}
+
+	// The same methods, for systems without a DBus daemon. There is no JwtTokenStateChange
+	// signal, so clients poll GetJwtToken after FetchJwtToken.
+	bool serving_local_api = false;
+	if (local_api_config_.enabled) {
+		local_api_server_.AddMethodHandler(
+			kAuthenticationInterface,
+			"GetJwtToken",
+			[this](const string &) -> expected::ExpectedString {
+				return R"({"token":")" + json::EscapeString(GetJWTToken()) + R"(","server_url":")"
+					   + json::EscapeString(GetServerURL()) + "\"}";
+			});
+		local_api_server_.AddMethodHandler(
+			kAuthenticationInterface,
+			"FetchJwtToken",
+			[fetch_jwt_token](const string &) -> expected::ExpectedString {
+				return fetch_jwt_token() ? "true" : "false";
+			});
+		local_api_server_.AddMethodHandler(
+			kAuthenticationInterface,
+			"GetJwtTokenInfo",
+			[this](const string &) -> expected::ExpectedString { return TokenInfoJson(); });
+		local_api_server_.AddMethodHandler(
+			kAuthenticationInterface,
+			"SetTenantToken",
+			[this](const string &token) -> expected::ExpectedString {
+				auto err = SetTenantToken(token);
+				if (err != error::NoError) {
+					return expected::unexpected(err);
+				}
+				return TokenInfoJson();
+			});
+		auto err = local_api_server_.Listen(local_api_config_.auth_socket_path);
+		if (err == error::NoError) {
+			serving_local_api = true;
+		} else {
+			log::Warning("Could not serve the local API: " + err.String());
+		}
+	}
+
+	auto err = dbus_server_.AdvertiseObject(dbus_obj);
+	if (err != error::NoError && serving_local_api) {
+		log::Warning(
+			"Could not advertise the interface on DBus, only on the local API: " + err.String());
+		return error::NoError;
+	}
+	return err;
+}
+
+void AuthenticatingForwarder::Cache(const string &token, const string &url) {
+	this->cached_jwt_token_ = token;
+	this->cached_server_url_ = url;
+	this->cached_expiry_.reset();
+	if (token == "") {
+		return;
+	}
+
+	auto exp_expiry = auth_client::JWTExpiry(token);
+	if (exp_expiry) {
+		this->cached_expiry_ = exp_expiry.value();
+	} else {
+		log::Debug(
+			"Not renewing the token before it expires, its expiry is unknown: "
+			+ exp_expiry.error().String());
+	}
+}
+
+string AuthenticatingForwarder::TokenInfoJson() {
+	string expires_at {"null"};
+	if (cached_expiry_) {
+		expires_at = to_string(
+			chrono::duration_cast<chrono::seconds>(cached_expiry_.value().time_since_epoch())
+				.count());
+	}
+	return R"({"token":")" + json::EscapeString(GetJWTToken()) + R"(","server_url":")"
+		   + json::EscapeString(GetServerURL()) + R"(","expires_at":)" + expires_at + "}";
+}
+
+void AuthenticatingForwarder::ScheduleRenewal() {
+	renewal_timer_.Cancel();
+	if (!cached_expiry_) {
+		return;
+	}
+
+	const auto remaining =
+		chrono::duration_cast<chrono::seconds>(cached_expiry_.value() - chrono::system_clock::now());
+	if (remaining < chrono::seconds {10}) {
+		// Too late, the clients get a new one once the server refuses this one.
+		return;
+	}
+	const auto renew_in = remaining - min(kMaxRenewalMargin, remaining / 10);
+	log::Debug("Renewing the token in " + to_string(renew_in.count()) + " seconds");
+	renewal_timer_.AsyncWait(renew_in, [this](error::Error err) {
+		if (err != error::NoError) {
+			return;
+		}
+		log::Info("Renewing the authentication token before it expires");
+		renewing_ = true;
+		if (!fetch_jwt_token_ || !fetch_jwt_token_()) {
+			renewing_ = false;
+		}
+	});
+}
+
+error::Error AuthenticatingForwarder::SetTenantToken(const string &token) {
+	auto err = conf::SaveTenantToken(data_store_, token);
+	if (err != error::NoError) {
+		return err.WithContext("Could not save the tenant token");
+	}
+	tenant_token_ = token;
+	log::Info("Tenant token replaced, authenticating again with the new one");
+
+	// The cached token is for the previous tenant, so it is neither served nor renewed anymore.
+	renewal_timer_.Cancel();
+	renewing_ = false;
+	ClearCache();
+
+	if (auth_in_progress_) {
+		tenant_token_changed_ = true;
+		return error::NoError;
+	}
+	if (fetch_jwt_token_ && !fetch_jwt_token_()) {
+		return error::Error(
+			make_error_condition(errc::io_error),
+			"The tenant token is saved, but the authentication could not be started");
+	}
+	return error::NoError;
 }
 
 void AuthenticatingForwarder::FetchJwtTokenHandler(auth_client::APIResponse &resp) {
 	auth_in_progress_ = false;
+	const bool renewing = renewing_;
+	renewing_ = false;
+
+	if (tenant_token_changed_) {
+		// Requested with the previous tenant token, whatever the outcome.
+		tenant_token_changed_ = false;
+		if (fetch_jwt_token_()) {
+			return;
+		}
+		forwarder_.Cancel();
+		ClearCache();
+		dbus_server_.EmitSignal<dbus::StringPair>(
+			"/io/mender/AuthenticationManager",
+			kAuthenticationInterface,
+			"JwtTokenStateChange",
+			dbus::StringPair {"", ""});
+		return;
+	}
+
+	if (!resp && renewing && cached_expiry_
+		&& chrono::system_clock::now() < cached_expiry_.value()) {
+		// The current token still works until then, so keep serving it, and try again later.
+		log::Warning("Failed to renew the token, keeping the current one: " + resp.error().String());
+		ScheduleRenewal();
+		return;
+	}
 
 	forwarder_.Cancel();
 
@@ -95,10 +286,11 @@ void AuthenticatingForwarder::FetchJwtTokenHandler(auth_client::APIResponse &res
 		ClearCache();
 		log::Error("Failed to fetch new token: " + resp.error().String());
 	}
+	ScheduleRenewal();
 	// Emit signal either with valid token and server url or with empty strings
 	dbus_server_.EmitSignal<dbus::StringPair>(
 		"/io/mender/AuthenticationManager",
-		"io.mender.Authentication1",
+		kAuthenticationInterface,
 		"JwtTokenStateChange",
 		dbus::StringPair {cached_jwt_token_, cached_server_url_});
 }
@@ -16,6 +16,7 @@
 #ifndef MENDER_AUTH_IPC_SERVER_HPP
 #define MENDER_AUTH_IPC_SERVER_HPP
 
+#include <chrono>
 #include <functional>
 #include <string>
 
@@ -24,6 +25,8 @@
 #include <common/error.hpp>
 #include <common/events.hpp>
 #include <common/http.hpp>
+#include <common/local_api.hpp>
+#include <common/optional.hpp>
 
 #include <api/api.hpp>
 
@@ -37,12 +40,14 @@ namespace ipc {
 
 using namespace std;
 
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace conf = mender::client_shared::conf;
 namespace crypto = mender::common::crypto;
 namespace dbus = mender::common::dbus;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace http = mender::common::http;
+namespace local_api = mender::common::local_api;
 namespace log = mender::common::log;
 
 namespace auth_client = mender::auth::api::auth;
@@ -53,12 +58,20 @@ class AuthenticatingForwarder {
 public:
 	AuthenticatingForwarder(events::EventLoop &loop, const conf::MenderConfig &config) :
 		servers_ {config.servers},
+		server_selector_ {
+			config.servers, chrono::seconds {config.server_failover.failback_interval_seconds}},
 		tenant_token_ {config.tenant_token},
+		data_store_ {config.paths.GetDataStore()},
 		device_tier_ {config.device_tier},
 		client_ {config.GetHttpClientConfig(), loop},
 		forwarder_ {http::ServerConfig {}, config.GetHttpClientConfig(), loop},
 		default_identity_script_path_ {config.paths.GetIdentityScript()},
-		dbus_server_ {loop, "io.mender.AuthenticationManager"} {};
+		identity_providers_ {config.identity_providers},
+		dbus_server_ {loop, "io.mender.AuthenticationManager"},
+		dbus_authorization_ {config.dbus_authorization},
+		local_api_config_ {config.local_api},
+		local_api_server_ {loop},
+		renewal_timer_ {loop} {};
 
 	error::Error Listen(const crypto::Args &args, const string &identity_script_path = "");
 
@@ -70,11 +83,16 @@ public:
 		return this->cached_jwt_token_;
 	}
 
-	void Cache(const string &token, const string &url) {
-		this->cached_jwt_token_ = token;
-		this->cached_server_url_ = url;
+	// When the cached token expires, if it tells.
+	optional<chrono::system_clock::time_point> GetJWTTokenExpiry() {
+		return this->cached_expiry_;
 	}
 
+	void Cache(const string &token, const string &url);
+
+	// Saves the new tenant token, drops the cached token, and authenticates again with it.
+	error::Error SetTenantToken(const string &token);
+
 	const http_forwarder::Server &GetForwarder() const {
 		return forwarder_;
 	}
@@ -85,18 +103,32 @@ private:
 	}
 
 	void FetchJwtTokenHandler(auth_client::APIResponse &resp);
+	void ScheduleRenewal();
+	string TokenInfoJson();
 
 	string cached_jwt_token_;
 	string cached_server_url_;
+	optional<chrono::system_clock::time_point> cached_expiry_;
 	bool auth_in_progress_ = false;
+	bool renewing_ = false;
+	// The tenant token changed while authenticating, so the response is for the old one.
+	bool tenant_token_changed_ = false;
+	function<bool()> fetch_jwt_token_;
 
 	const vector<string> &servers_;
-	const string tenant_token_;
+	auth_client::ServerSelector server_selector_;
+	string tenant_token_;
+	const string data_store_;
 	const string device_tier_;
 	http::Client client_;
 	http_forwarder::Server forwarder_;
 	string default_identity_script_path_;
+	const vector<string> identity_providers_;
 	dbus::DBusServer dbus_server_;
+	cfg_parser::DBusAuthorization dbus_authorization_;
+	const cfg_parser::LocalApi local_api_config_;
+	local_api::Server local_api_server_;
+	events::Timer renewal_timer_;
 };
 
 using Server = AuthenticatingForwarder;
@@ -0,0 +1,93 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_BENCHMARK_HPP
+#define MENDER_UPDATE_BENCHMARK_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/optional.hpp>
+
+namespace mender {
+namespace update {
+namespace benchmark {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+// In the data store, as `key=value` lines, for the `mender-inventory-benchmark` inventory script.
+const string kBenchmarkFile {"benchmark"};
+
+// How the payload is written to the inactive partition, like the rootfs-image Update Module can be
+// set to, see Documentation/rootfs-image-writes.md, so that the settings can be compared.
+struct WriterOptions {
+	// Bypass the page cache with O_DIRECT. The writes must then be aligned to kDirectAlignment.
+	bool direct {false};
+	// The size of every write.
+	size_t buffer_size {1024 * 1024};
+	// Flush what was written to the device every this many bytes. 0 flushes only at the end.
+	int64_t sync_interval {0};
+};
+
+// The alignment of the buffer, the size and the offset of every write with O_DIRECT, large enough
+// for devices with 4 KiB logical blocks.
+const size_t kDirectAlignment {4096};
+
+// What `mender-update benchmark` measured, see Documentation/benchmark.md.
+struct Results {
+	// When the benchmark was run, in seconds since the epoch.
+	int64_t time {0};
+	// The device the write throughput was measured on, empty if it wasn't.
+	string device;
+	WriterOptions write_options;
+	optional<double> write_bytes_per_second;
+	double checksum_bytes_per_second {0};
+	// Empty if there is no boot loader environment to write to.
+	optional<chrono::milliseconds> bootenv_write_latency;
+};
+
+// Writes `size` bytes of random data to the start of `device`, which is overwritten, and returns
+// how many bytes per second were written, including flushing them to the device. Mounted devices
+// are refused. With `options.direct`, `size` is rounded down to kDirectAlignment.
+expected::ExpectedDouble MeasureWriteThroughput(
+	const string &device, int64_t size, const WriterOptions &options = WriterOptions {});
+
+// Returns how many bytes per second the SHA-256 checksum, as verified for every Artifact payload,
+// can be computed at.
+expected::ExpectedDouble MeasureChecksumThroughput(int64_t size);
+
+// Returns how long a write of the boot loader environment takes, on average over `writes` writes
+// of a scratch variable, which is removed afterwards. Empty if neither grub-mender-grubenv-set
+// nor fw_setenv is installed.
+expected::expected<optional<chrono::milliseconds>, error::Error> MeasureBootEnvWriteLatency(
+	int writes);
+
+// For the terminal.
+string Report(const Results &results);
+
+// As stored in kBenchmarkFile.
+string ToKeyValues(const Results &results);
+
+} // namespace benchmark
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_BENCHMARK_HPP
@@ -0,0 +1,223 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/benchmark.hpp>
+
+#include <algorithm>
+#include <cstdlib>
+#include <iomanip>
+#include <random>
+#include <sstream>
+#include <vector>
+
+#include <common/common.hpp>
+#include <common/io.hpp>
+#include <common/path.hpp>
+#include <common/processes.hpp>
+
+#include <artifact/sha/sha.hpp>
+
+namespace mender {
+namespace update {
+namespace benchmark {
+
+namespace common = mender::common;
+namespace io = mender::common::io;
+namespace path = mender::common::path;
+namespace procs = mender::common::processes;
+namespace sha = mender::sha;
+
+static const size_t kBufferSize {1024 * 1024};
+static const string kBootEnvVariable {"mender_benchmark"};
+static const double kMiB {1024 * 1024};
+
+// Gives `size` bytes from the same buffer over and over, so that only the checksum is measured.
+class RepeatingReader : virtual public io::Reader {
+public:
+	RepeatingReader(const vector<uint8_t> &buffer, int64_t size) :
+		buffer_ {buffer},
+		remaining_ {size} {
+	}
+
+	expected::ExpectedSize Read(
+		vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) override {
+		size_t n = min(
+			{static_cast<size_t>(remaining_),
+			 static_cast<size_t>(end - start),
+			 buffer_.size() - offset_});
+		auto from = buffer_.begin() + static_cast<ptrdiff_t>(offset_);
+		copy(from, from + static_cast<ptrdiff_t>(n), start);
+		offset_ = (offset_ + n) % buffer_.size();
+		remaining_ -= static_cast<int64_t>(n);
+		return n;
+	}
+
+private:
+	const vector<uint8_t> &buffer_;
+	size_t offset_ {0};
+	int64_t remaining_;
+};
+
+expected::ExpectedDouble MeasureChecksumThroughput(int64_t size) {
+	// Random, like compressed payloads are.
+	vector<uint8_t> buffer(kBufferSize);
+	mt19937 generator;
+	generate(buffer.begin(), buffer.end(), [&generator]() {
+		return static_cast<uint8_t>(generator());
+	});
+
+	RepeatingReader data {buffer, size};
+	sha::Reader checksum {data};
+	io::Discard discard;
+	vector<uint8_t> copy_buffer(kBufferSize);
+
+	auto start = chrono::steady_clock::now();
+	auto err = io::Copy(discard, checksum, copy_buffer);
+	if (err != error::NoError) {
+		return expected::unexpected(err);
+	}
+	auto exp_sha = checksum.ShaSum();
+	if (!exp_sha) {
+		return expected::unexpected(exp_sha.error());
+	}
+	chrono::duration<double> elapsed = chrono::steady_clock::now() - start;
+	return static_cast<double>(size) / max(elapsed.count(), 1e-9);
+}
+
+// Same order of preference as the rootfs-image Update Module.
+static string FindBootEnvTool() {
+	const char *path_env = getenv("PATH");
+	const string search_path = path_env != nullptr ? path_env : "/usr/sbin:/usr/bin:/sbin:/bin";
+	for (const string tool : {"grub-mender-grubenv-set", "fw_setenv"}) {
+		for (const auto &dir : common::SplitString(search_path, ":")) {
+			if (dir == "") {
+				continue;
+			}
+			auto candidate = path::Join(dir, tool);
+			auto exp_executable = path::IsExecutable(candidate, false);
+			if (exp_executable && exp_executable.value()) {
+				return candidate;
+			}
+		}
+	}
+	return "";
+}
+
+expected::expected<optional<chrono::milliseconds>, error::Error> MeasureBootEnvWriteLatency(
+	int writes) {
+	const string tool = FindBootEnvTool();
+	if (tool == "" || writes <= 0) {
+		return optional<chrono::milliseconds> {};
+	}
+
+	chrono::steady_clock::duration total {0};
+	for (int i = 0; i < writes; i++) {
+		procs::Process proc({tool, kBootEnvVariable, to_string(i)});
+		auto start = chrono::steady_clock::now();
+		auto err = proc.Run();
+		if (err != error::NoError) {
+			return expected::unexpected(
+				err.WithContext("Could not write the boot loader environment with " + tool));
+		}
+		total += chrono::steady_clock::now() - start;
+	}
+
+	// Without a value, the variable is removed again.
+	procs::Process proc({tool, kBootEnvVariable});
+	auto err = proc.Run();
+	if (err != error::NoError) {
+		return expected::unexpected(err.WithContext(
+			"Could not remove " + kBootEnvVariable + " from the boot loader environment"));
+	}
+
+	return optional<chrono::milliseconds> {
+		chrono::duration_cast<chrono::milliseconds>(total / writes)};
+}
+
+static string MiBPerSecond(double bytes_per_second) {
+	stringstream str;
+	str << fixed << setprecision(1) << bytes_per_second / kMiB;
+	return str.str();
+}
+
+// Only what differs from the default writes.
+static string WriterOptionsDescription(const WriterOptions &options) {
+	const WriterOptions defaults;
+	vector<string> parts;
+	if (options.direct) {
+		parts.push_back("O_DIRECT");
+	}
+	if (options.buffer_size != defaults.buffer_size) {
+		parts.push_back(to_string(options.buffer_size / 1024) + " KiB writes");
+	}
+	if (options.sync_interval > 0) {
+		parts.push_back(
+			"flushed every " + to_string(options.sync_interval / (1024 * 1024)) + " MiB");
+	}
+	if (parts.empty()) {
+		return "";
+	}
+	return " (" + common::JoinStrings(parts, ", ") + ")";
+}
+
+string Report(const Results &results) {
+	string report;
+	if (results.write_bytes_per_second) {
+		report += "Write throughput to " + results.device
+				  + WriterOptionsDescription(results.write_options) + ": "
+				  + MiBPerSecond(results.write_bytes_per_second.value()) + " MiB/s\n";
+	} else {
+		report += "Write throughput: not measured, pass the inactive partition with --device\n";
+	}
+	report += "SHA-256 checksum throughput: " + MiBPerSecond(results.checksum_bytes_per_second)
+			  + " MiB/s\n";
+	if (results.bootenv_write_latency) {
+		report += "Boot loader environment write latency: "
+				  + to_string(results.bootenv_write_latency.value().count()) + " ms\n";
+	} else {
+		report += "Boot loader environment write latency: not measured, no fw_setenv or"
+				  " grub-mender-grubenv-set\n";
+	}
+
+	// The payload is checksummed while it is written, so the slower of the two is the limit.
+	if (results.write_bytes_per_second) {
+		double rate =
+			min(results.write_bytes_per_second.value(), results.checksum_bytes_per_second);
+		report += "Installing a 1 GiB payload takes at least "
+				  + to_string(static_cast<int64_t>(1024 * kMiB / max(rate, 1.0)))
+				  + " seconds, not counting the download\n";
+	}
+	return report;
+}
+
+string ToKeyValues(const Results &results) {
+	string key_values = "time=" + to_string(results.time) + "\n";
+	if (results.write_bytes_per_second) {
+		key_values += "write_device=" + results.device + "\n";
+		key_values +=
+			"write_mib_per_second=" + MiBPerSecond(results.write_bytes_per_second.value()) + "\n";
+	}
+	key_values +=
+		"checksum_mib_per_second=" + MiBPerSecond(results.checksum_bytes_per_second) + "\n";
+	if (results.bootenv_write_latency) {
+		key_values += "bootenv_write_ms="
+					  + to_string(results.bootenv_write_latency.value().count()) + "\n";
+	}
+	return key_values;
+}
+
+} // namespace benchmark
+} // namespace update
+} // namespace mender
@@ -0,0 +1,164 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/benchmark.hpp>
+
+#include <algorithm>
+#include <cerrno>
+#include <cstdlib>
+#include <fstream>
+#include <memory>
+#include <random>
+
+#include <fcntl.h>
+#include <sys/stat.h>
+#include <unistd.h>
+
+namespace mender {
+namespace update {
+namespace benchmark {
+
+static error::Error ErrnoError(int err, const string &msg) {
+	return error::Error(generic_category().default_error_condition(err), msg);
+}
+
+// Whether the root file system, or anything in /proc/mounts, is on the given block device.
+static bool IsMounted(dev_t device) {
+	struct stat root_stat;
+	if (stat("/", &root_stat) == 0 && root_stat.st_dev == device) {
+		return true;
+	}
+
+	ifstream mounts("/proc/mounts");
+	string source;
+	string rest;
+	while (mounts >> source && getline(mounts, rest)) {
+		if (source.empty() || source[0] != '/') {
+			continue;
+		}
+		struct stat source_stat;
+		if (stat(source.c_str(), &source_stat) == 0 && S_ISBLK(source_stat.st_mode)
+			&& source_stat.st_rdev == device) {
+			return true;
+		}
+	}
+	return false;
+}
+
+expected::ExpectedDouble MeasureWriteThroughput(
+	const string &device, int64_t size, const WriterOptions &options) {
+	if (options.buffer_size == 0 || options.sync_interval < 0) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"The write buffer size must be positive, and the sync interval not negative"));
+	}
+	if (options.direct && options.buffer_size % kDirectAlignment != 0) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"With O_DIRECT, the write buffer size must be a multiple of "
+				+ to_string(kDirectAlignment) + " bytes"));
+	}
+
+	struct stat device_stat;
+	if (stat(device.c_str(), &device_stat) != 0) {
+		return expected::unexpected(ErrnoError(errno, "Could not access " + device));
+	}
+	bool block_device = S_ISBLK(device_stat.st_mode);
+	if (block_device) {
+		if (IsMounted(device_stat.st_rdev)) {
+			return expected::unexpected(error::Error(
+				make_error_condition(errc::device_or_resource_busy),
+				device + " is mounted, refusing to overwrite it"));
+		}
+	} else if (!S_ISREG(device_stat.st_mode)) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			device + " is neither a block device nor a file"));
+	}
+
+	int flags = O_WRONLY | O_CLOEXEC;
+	if (options.direct) {
+		flags |= O_DIRECT;
+	}
+	int fd = open(device.c_str(), flags);
+	if (fd < 0) {
+		return expected::unexpected(ErrnoError(errno, "Could not open " + device));
+	}
+	if (block_device) {
+		off_t device_size = lseek(fd, 0, SEEK_END);
+		if (device_size > 0 && device_size < size) {
+			size = device_size;
+		}
+		lseek(fd, 0, SEEK_SET);
+	}
+	if (options.direct) {
+		size -= size % static_cast<int64_t>(kDirectAlignment);
+	}
+
+	// Aligned for O_DIRECT.
+	void *memory = nullptr;
+	int alloc_err = posix_memalign(&memory, kDirectAlignment, options.buffer_size);
+	if (alloc_err != 0) {
+		close(fd);
+		return expected::unexpected(ErrnoError(alloc_err, "Could not allocate the write buffer"));
+	}
+	unique_ptr<uint8_t, void (*)(void *)> buffer {static_cast<uint8_t *>(memory), free};
+
+	// Random, so that storage which compresses or deduplicates doesn't skew the result.
+	mt19937 generator;
+	generate(buffer.get(), buffer.get() + options.buffer_size, [&generator]() {
+		return static_cast<uint8_t>(generator());
+	});
+
+	auto start = chrono::steady_clock::now();
+	int64_t written = 0;
+	int64_t unsynced = 0;
+	while (written < size) {
+		auto n = min(options.buffer_size, static_cast<size_t>(size - written));
+		auto result = write(fd, buffer.get(), n);
+		if (result < 0) {
+			if (errno == EINTR) {
+				continue;
+			}
+			int err = errno;
+			close(fd);
+			return expected::unexpected(ErrnoError(err, "Could not write to " + device));
+		}
+		written += result;
+		unsynced += result;
+		if (options.sync_interval > 0 && unsynced >= options.sync_interval) {
+			if (fdatasync(fd) != 0) {
+				int err = errno;
+				close(fd);
+				return expected::unexpected(ErrnoError(err, "Could not flush " + device));
+			}
+			unsynced = 0;
+		}
+	}
+	// Until it is on the device, not only in the page cache.
+	if (fsync(fd) != 0) {
+		int err = errno;
+		close(fd);
+		return expected::unexpected(ErrnoError(err, "Could not flush " + device));
+	}
+	chrono::duration<double> elapsed = chrono::steady_clock::now() - start;
+	close(fd);
+
+	return static_cast<double>(written) / max(elapsed.count(), 1e-9);
+}
+
+} // namespace benchmark
+} // namespace update
+} // namespace mender
@@ -15,22 +15,42 @@
 #include <mender-update/cli/actions.hpp>
 
 #include <algorithm>
+#include <chrono>
 #include <iostream>
 #include <string>
 
+#include <artifact/artifact.hpp>
 #include <artifact/config.hpp>
 
+#include <client_shared/config_parser.hpp>
+#include <client_shared/config_schema.hpp>
+
 #include <common/common.hpp>
 #include <common/error.hpp>
 #include <common/events.hpp>
 #include <common/expected.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
 #include <common/key_value_database.hpp>
+#include <common/local_api.hpp>
 #include <common/log.hpp>
 #include <common/path.hpp>
 #include <common/processes.hpp>
+#ifdef MENDER_USE_DBUS
+#include <common/platform/dbus.hpp>
+#endif
 
+#include <mender-update/benchmark.hpp>
 #include <mender-update/cli/cli.hpp>
 #include <mender-update/daemon.hpp>
+#include <mender-update/daemon/artifact_inspection.hpp>
+#include <mender-update/daemon/control.hpp>
+#include <mender-update/daemon/chunked_download.hpp>
+#include <mender-update/daemon/device_freeze.hpp>
+#include <mender-update/daemon/metrics.hpp>
+#ifdef MENDER_DEBUG_CONSOLE
+#include <mender-update/daemon/debug_console.hpp>
+#endif
 #include <mender-update/standalone.hpp>
 
 #ifdef MENDER_EMBED_MENDER_AUTH
@@ -43,18 +63,418 @@ namespace update {
 namespace cli {
 
 namespace processes = mender::common::processes;
+namespace auth = mender::api::auth;
+namespace benchmark = mender::update::benchmark;
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace conf = mender::client_shared::conf;
+namespace config_schema = mender::client_shared::config_schema;
 namespace daemon = mender::update::daemon;
 namespace database = mender::common::key_value_database;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace expected = mender::common::expected;
 namespace http = mender::common::http;
+namespace inventory = mender::update::inventory;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
 namespace kv_db = mender::common::key_value_database;
+namespace local_api = mender::common::local_api;
 namespace log = mender::common::log;
 namespace path = mender::common::path;
 namespace standalone = mender::update::standalone;
 
+#ifdef MENDER_USE_DBUS
+namespace dbus = mender::common::dbus;
+#endif
+
+// See Documentation/io.mender.Update1.xml.
+static const string kUpdateInterface {"io.mender.Update1"};
+// See Documentation/io.mender.Control1.xml.
+static const string kControlInterface {"io.mender.Control1"};
+
+static expected::ExpectedString DeploymentHistoryJson(daemon::Context &ctx) {
+	auto exp_records = ctx.deployment_history.Load();
+	if (!exp_records) {
+		return expected::unexpected(exp_records.error());
+	}
+	return daemon::DeploymentHistory::ToJson(exp_records.value());
+}
+
+static expected::ExpectedString ArtifactTwinJson(daemon::Context &ctx) {
+	auto exp_provides = ctx.mender_context.LoadProvides();
+	if (!exp_provides) {
+		return expected::unexpected(exp_provides.error());
+	}
+	const auto &provides = exp_provides.value();
+	auto actual = provides.find("artifact_name");
+	return ctx.artifact_twin.ToJson(actual != provides.end() ? actual->second : "");
+}
+
+// The application which extended the grace period is recorded as the source of the pause.
+static expected::ExpectedString ExtendRebootGrace(
+	daemon::Context &ctx, const string &application) {
+	auto exp_reply = ctx.reboot_grace.Extend(application);
+	if (exp_reply && exp_reply.value() == daemon::RebootGrace::kReplyExtended
+		&& ctx.deployment.state_data) {
+		auto err = ctx.pause_record.Paused(
+			ctx.deployment.state_data->update_info.id,
+			"ArtifactReboot",
+			"Reboot grace period extended",
+			application);
+		if (err != error::NoError) {
+			log::Warning("Could not record the pause of the deployment: " + err.String());
+		}
+	}
+	return exp_reply;
+}
+
+static expected::ExpectedString EvaluateArtifactCompatibility(
+	daemon::Context &ctx, const string &header_json) {
+	auto exp_header = artifact::HeaderViewFromJson(header_json);
+	if (!exp_header) {
+		return expected::unexpected(exp_header.error());
+	}
+	auto exp_reasons = daemon::ArtifactRejectionReasons(ctx, exp_header.value());
+	if (!exp_reasons) {
+		return expected::unexpected(exp_reasons.error());
+	}
+	auto &reasons = exp_reasons.value();
+
+	string reply = R"({"compatible":)" + string(reasons.empty() ? "true" : "false");
+	reply += R"(,"reasons":[)";
+	string separator;
+	for (const auto &reason : reasons) {
+		reply += separator + "\"" + json::EscapeString(reason) + "\"";
+		separator = ",";
+	}
+	reply += "]}";
+	log::Debug(
+		"Compatibility of Artifact '" + exp_header.value().artifact_name + "' evaluated: " + reply);
+	return reply;
+}
+
+static expected::ExpectedString InspectArtifact(daemon::Context &ctx, const string &artifact_path) {
+	auto result = daemon::InspectArtifact(
+		artifact_path,
+		path::Join(ctx.mender_context.GetConfig().paths.GetDataStore(), "inspected-scripts"));
+	if (!result) {
+		log::Info("Could not inspect Artifact " + artifact_path + ": " + result.error().String());
+	}
+	return result;
+}
+
+#ifdef MENDER_USE_DBUS
+// Both would use the same Update Modules and the same partitions, so a standalone operation can
+// only start between deployments, and the daemon starts none while it runs, see
+// PollForDeploymentState.
+static expected::ExpectedString StartStandalone(
+	daemon::Context &ctx,
+	const daemon::StateMachine &state_machine,
+	daemon::StandaloneUpdate::Operation operation,
+	const string &src) {
+	if (state_machine.CurrentStatus().deployment_id != "") {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::device_or_resource_busy),
+			"Deployment " + state_machine.CurrentStatus().deployment_id + " is in progress"));
+	}
+	return ctx.standalone_update.Start(operation, src);
+}
+
+// See Documentation/io.mender.StateListener1.xml.
+static const string kStateListenerInterface {"io.mender.StateListener1"};
+
+static expected::ExpectedBool ToExpectedBool(error::Error err) {
+	if (err != error::NoError) {
+		return expected::unexpected(err);
+	}
+	return true;
+}
+
+static void AddStateListenerMethodHandlers(
+	dbus::DBusObject &obj, daemon::StateListeners &listeners) {
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kStateListenerInterface,
+		"RegisterStateListener",
+		[&listeners](const dbus::StringPair &args) -> expected::ExpectedBool {
+			return ToExpectedBool(listeners.Register(args.first, args.second));
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kStateListenerInterface,
+		"UnregisterStateListener",
+		[&listeners](const dbus::StringPair &args) -> expected::ExpectedBool {
+			return ToExpectedBool(listeners.Unregister(args.first, args.second));
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kStateListenerInterface,
+		"RespondToStateTransition",
+		[&listeners](const dbus::StringPair &args) -> expected::ExpectedBool {
+			return ToExpectedBool(listeners.Respond(args.first, args.second));
+		});
+}
+
+// See Documentation/io.mender.Progress1.xml.
+static const string kProgressInterface {"io.mender.Progress1"};
+
+static void AddUpdateMethodHandlers(
+	dbus::DBusObject &obj, daemon::Context &ctx, const daemon::StateMachine &state_machine) {
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface, "GetStatus", [&state_machine]() -> expected::ExpectedString {
+			return state_machine.StatusJson();
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface, "GetDeploymentHistory", [&ctx]() -> expected::ExpectedString {
+			return DeploymentHistoryJson(ctx);
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface, "GetArtifactTwin", [&ctx]() -> expected::ExpectedString {
+			return ArtifactTwinJson(ctx);
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface,
+		"EvaluateArtifactCompatibility",
+		[&ctx](const string &header_json) -> expected::ExpectedString {
+			return EvaluateArtifactCompatibility(ctx, header_json);
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface,
+		"InspectArtifact",
+		[&ctx](const string &artifact_path) -> expected::ExpectedString {
+			return InspectArtifact(ctx, artifact_path);
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface,
+		"ConfirmHealthy",
+		[&ctx](const string &application) -> expected::ExpectedString {
+			return ctx.commit_lease.ConfirmHealthy(application);
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface, "ConfirmCommit", [&ctx]() -> expected::ExpectedString {
+			return ctx.commit_confirmation.Confirm();
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface,
+		"ExtendRebootGrace",
+		[&ctx](const string &application) -> expected::ExpectedString {
+			return ExtendRebootGrace(ctx, application);
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface,
+		"ConfirmDeployment",
+		[&ctx](const string &deployment_id) -> expected::ExpectedString {
+			return daemon::ConfirmDeployment(ctx, deployment_id);
+		});
+
+	using Operation = daemon::StandaloneUpdate::Operation;
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface,
+		"Install",
+		[&ctx, &state_machine](const string &src) -> expected::ExpectedString {
+			return StartStandalone(ctx, state_machine, Operation::Install, src);
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface, "Commit", [&ctx, &state_machine]() -> expected::ExpectedString {
+			return StartStandalone(ctx, state_machine, Operation::Commit, "");
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kUpdateInterface, "Rollback", [&ctx, &state_machine]() -> expected::ExpectedString {
+			return StartStandalone(ctx, state_machine, Operation::Rollback, "");
+		});
+}
+
+static void AddUpdateProperties(dbus::DBusObject &obj, const daemon::StateMachine &state_machine) {
+	obj.AddProperty(kUpdateInterface, "CurrentState", [&state_machine]() {
+		return state_machine.CurrentStatus().state;
+	});
+	obj.AddProperty(kUpdateInterface, "CurrentDeploymentID", [&state_machine]() {
+		return state_machine.CurrentStatus().deployment_id;
+	});
+	obj.AddProperty(kUpdateInterface, "ArtifactName", [&state_machine]() {
+		return state_machine.CurrentStatus().artifact_name;
+	});
+	obj.AddProperty(kUpdateInterface, "LastError", [&state_machine]() {
+		return state_machine.CurrentStatus().last_error;
+	});
+}
+
+static vector<string> ChangedUpdateProperties(
+	const daemon::StateMachine::Status &previous, const daemon::StateMachine::Status &current) {
+	vector<string> changed;
+	if (current.state != previous.state) {
+		changed.push_back("CurrentState");
+	}
+	if (current.deployment_id != previous.deployment_id) {
+		changed.push_back("CurrentDeploymentID");
+	}
+	if (current.artifact_name != previous.artifact_name) {
+		changed.push_back("ArtifactName");
+	}
+	if (current.last_error != previous.last_error) {
+		changed.push_back("LastError");
+	}
+	return changed;
+}
+
+// See Documentation/io.mender.Inventory1.xml.
+static const string kInventoryInterface {"io.mender.Inventory1"};
+
+static void AddInventoryMethodHandlers(
+	dbus::DBusObject &obj,
+	inventory::RuntimeAttributes &attributes,
+	function<void()> force_resubmit) {
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kInventoryInterface,
+		"SetInventoryAttribute",
+		[&attributes](const dbus::StringPair &args) -> expected::ExpectedBool {
+			auto err = attributes.Set(args.first, args.second);
+			if (err != error::NoError) {
+				return expected::unexpected(err);
+			}
+			log::Debug("Inventory attribute " + args.first + " set over DBus");
+			return true;
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kInventoryInterface, "ClearInventoryAttributes", [&attributes]() -> expected::ExpectedBool {
+			attributes.Clear();
+			log::Debug("Inventory attributes cleared over DBus");
+			return true;
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kInventoryInterface,
+		"ForceInventoryResubmit",
+		[force_resubmit]() -> expected::ExpectedBool {
+			log::Info("Complete inventory submission requested over DBus");
+			force_resubmit();
+			return true;
+		});
+}
+
+// See Documentation/io.mender.Configure1.xml.
+static const string kConfigureInterface {"io.mender.Configure1"};
+
+static void AddConfigureMethodHandlers(dbus::DBusObject &obj, daemon::DeviceConfig &device_config) {
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kConfigureInterface, "GetConfiguration", [&device_config]() -> expected::ExpectedString {
+			return device_config.CurrentJson();
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kConfigureInterface, "CheckConfiguration", [&device_config]() -> expected::ExpectedBool {
+			if (!device_config.Enabled()) {
+				return expected::unexpected(error::Error(
+					make_error_condition(errc::operation_not_supported),
+					"Device configuration is not enabled"));
+			}
+			log::Info("Device configuration check requested over DBus");
+			device_config.Trigger();
+			return true;
+		});
+}
+static void AddControlMethodHandlers(dbus::DBusObject &obj, daemon::Control &control) {
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kControlInterface, "CheckUpdate", [&control]() -> expected::ExpectedBool {
+			log::Info("Update check requested over DBus");
+			control.CheckUpdate();
+			return true;
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kControlInterface, "SendInventory", [&control]() -> expected::ExpectedBool {
+			log::Info("Inventory update requested over DBus");
+			control.SendInventory();
+			return true;
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kControlInterface, "Reload", [&control]() -> expected::ExpectedBool {
+			auto err = control.Reload();
+			if (err != error::NoError) {
+				return expected::unexpected(err);
+			}
+			return true;
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kControlInterface, "DumpState", [&control]() -> expected::ExpectedString {
+			return control.DumpState();
+		});
+	obj.AddMethodHandler<expected::ExpectedString>(
+		kControlInterface, "Freeze", [&control](const string &until) -> expected::ExpectedString {
+			return control.Freeze(until);
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		kControlInterface, "Release", [&control]() -> expected::ExpectedBool {
+			auto err = control.Release();
+			if (err != error::NoError) {
+				return expected::unexpected(err);
+			}
+			return true;
+		});
+}
+#endif
+
+// The local API only returns JSON.
+static expected::ExpectedString ToJsonString(const expected::ExpectedString &exp_str) {
+	if (!exp_str) {
+		return exp_str;
+	}
+	return "\"" + json::EscapeString(exp_str.value()) + "\"";
+}
+
+// The same methods as AddUpdateMethodHandlers(), except for the standalone operations, whose
+// progress and outcome only come in signals, see Documentation/local-api.md.
+static void AddLocalUpdateMethodHandlers(
+	local_api::Server &server, daemon::Context &ctx, const daemon::StateMachine &state_machine) {
+	server.AddMethodHandler(
+		kUpdateInterface, "GetStatus", [&state_machine](const string &) -> expected::ExpectedString {
+			return state_machine.StatusJson();
+		});
+	server.AddMethodHandler(kUpdateInterface, "GetDeploymentHistory", [&ctx](const string &) {
+		return DeploymentHistoryJson(ctx);
+	});
+	server.AddMethodHandler(kUpdateInterface, "GetArtifactTwin", [&ctx](const string &) {
+		return ArtifactTwinJson(ctx);
+	});
+	server.AddMethodHandler(
+		kUpdateInterface, "EvaluateArtifactCompatibility", [&ctx](const string &header_json) {
+			return EvaluateArtifactCompatibility(ctx, header_json);
+		});
+	server.AddMethodHandler(
+		kUpdateInterface, "InspectArtifact", [&ctx](const string &artifact_path) {
+			return InspectArtifact(ctx, artifact_path);
+		});
+	server.AddMethodHandler(kUpdateInterface, "ConfirmHealthy", [&ctx](const string &application) {
+		return ToJsonString(ctx.commit_lease.ConfirmHealthy(application));
+	});
+	server.AddMethodHandler(kUpdateInterface, "ConfirmCommit", [&ctx](const string &) {
+		return ToJsonString(ctx.commit_confirmation.Confirm());
+	});
+	server.AddMethodHandler(
+		kUpdateInterface, "ExtendRebootGrace", [&ctx](const string &application) {
+			return ToJsonString(ExtendRebootGrace(ctx, application));
+		});
+	server.AddMethodHandler(
+		kUpdateInterface, "ConfirmDeployment", [&ctx](const string &deployment_id) {
+			return ToJsonString(daemon::ConfirmDeployment(ctx, deployment_id));
+		});
+}
+
+// The local API names the control commands like DBus does, but they all go through
+// Control::Run(), with the argument of `set-log-level` as `[MODULE=]LEVEL`.
+static void AddLocalControlMethodHandlers(local_api::Server &server, daemon::Control &control) {
+	const vector<pair<string, string>> methods {
+		{"CheckUpdate", "check-update"},
+		{"SendInventory", "send-inventory"},
+		{"Reload", "reload"},
+		{"DumpState", "dump-state"},
+		{"SetLogLevel", "set-log-level"},
+		{"Freeze", "freeze"},
+		{"Release", "release"},
+	};
+	for (const auto &method : methods) {
+		const string command = method.second;
+		server.AddMethodHandler(
+			kControlInterface, method.first, [&control, command](const string &argument) {
+				return control.Run(command, argument);
+			});
+	}
+}
+
 static error::Error DoMaybeInstallBootstrapArtifact(context::MenderContext &main_context) {
 	const string bootstrap_artifact_path {
 		main_context.GetConfig().paths.GetBootstrapArtifactFile()};
@@ -113,7 +533,146 @@ error::Error MaybeInstallBootstrapArtifact(context::MenderContext &main_context)
 	return err;
 }
 
+static error::Error ShowCachedHeader(
+	context::MenderContext &main_context, const string &artifact_name) {
+	const auto &config = main_context.GetConfig();
+	// Read directly, so that this also works when the daemon isn't running.
+	daemon::HeaderCache cache {
+		path::Join(config.paths.GetDataStore(), daemon::kArtifactHeaderCacheFile),
+		static_cast<size_t>(config.artifact_header_cache_size)};
+	auto exp_cached = cache.Find(artifact_name);
+	if (!exp_cached) {
+		return exp_cached.error();
+	}
+	if (!exp_cached.value()) {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"The header of Artifact " + artifact_name + " isn't cached");
+	}
+
+	cout << daemon::HeaderCache::ToJson(exp_cached.value().value()) << endl;
+	return error::NoError;
+}
+
+// Replaced in one go, so that whoever reads the file never sees a partial one.
+static error::Error ReplaceFile(const string &file_path, const string &content) {
+	const string tmp_path = file_path + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+	return path::Rename(tmp_path, file_path);
+}
+
+// How many times the boot loader environment is written, to average out the first slow write.
+static const int kBenchmarkBootEnvWrites {5};
+
+static error::Error RefuseIfDeploymentInProgress(context::MenderContext &main_context) {
+	auto &db = main_context.GetMenderStoreDB();
+	for (const auto &key :
+		 {context::MenderContext::state_data_key,
+		  context::MenderContext::state_data_key_uncommitted,
+		  context::MenderContext::standalone_state_key}) {
+		auto exp_data = db.Read(key);
+		if (exp_data) {
+			return error::Error(
+				make_error_condition(errc::device_or_resource_busy),
+				"A deployment is in progress, refusing to run the benchmark");
+		}
+		if (exp_data.error().code != kv_db::MakeError(kv_db::KeyError, "").code) {
+			return exp_data.error();
+		}
+	}
+	return error::NoError;
+}
+
+error::Error BenchmarkAction::Execute(context::MenderContext &main_context) {
+	// The inactive partition may be about to be written by the deployment.
+	auto err = RefuseIfDeploymentInProgress(main_context);
+	if (err != error::NoError) {
+		return err;
+	}
+
+	const int64_t size = static_cast<int64_t>(size_mib_) * 1024 * 1024;
+	benchmark::Results results;
+	results.time =
+		chrono::duration_cast<chrono::seconds>(chrono::system_clock::now().time_since_epoch())
+			.count();
+
+	if (device_ != "") {
+		log::Info("Measuring the write throughput to " + device_);
+		auto exp_write = benchmark::MeasureWriteThroughput(device_, size, write_options_);
+		if (!exp_write) {
+			return exp_write.error();
+		}
+		results.device = device_;
+		results.write_options = write_options_;
+		results.write_bytes_per_second = exp_write.value();
+	}
+
+	log::Info("Measuring the checksum throughput");
+	auto exp_checksum = benchmark::MeasureChecksumThroughput(size);
+	if (!exp_checksum) {
+		return exp_checksum.error();
+	}
+	results.checksum_bytes_per_second = exp_checksum.value();
+
+	log::Info("Measuring the boot loader environment write latency");
+	auto exp_bootenv = benchmark::MeasureBootEnvWriteLatency(kBenchmarkBootEnvWrites);
+	if (!exp_bootenv) {
+		return exp_bootenv.error();
+	}
+	results.bootenv_write_latency = exp_bootenv.value();
+
+	cout << benchmark::Report(results);
+
+	return ReplaceFile(
+		path::Join(main_context.GetConfig().paths.GetDataStore(), benchmark::kBenchmarkFile),
+		benchmark::ToKeyValues(results));
+}
+
+error::Error DeltaSeedAction::Execute(context::MenderContext &main_context) {
+	const auto &config = main_context.GetConfig();
+	const auto &seeds = seeds_.empty() ? config.chunked_download.seeds : seeds_;
+	if (seeds.empty()) {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"No seeds to index, give them with --seed or in ChunkedDownload.Seeds");
+	}
+
+	const string seed_index_dir = path::Join(config.paths.GetDataStore(), daemon::kSeedIndexDir);
+	auto err = path::CreateDirectories(seed_index_dir);
+	if (err != error::NoError) {
+		return err;
+	}
+	for (const auto &seed : seeds) {
+		log::Info("Computing the index of seed " + seed);
+		auto exp_index = daemon::ComputeSeedIndex(seed, chunk_size_);
+		if (!exp_index) {
+			return exp_index.error();
+		}
+		err = ReplaceFile(
+			daemon::SeedIndexPath(seed_index_dir, seed),
+			daemon::ChunkIndexToJson(exp_index.value()));
+		if (err != error::NoError) {
+			return err;
+		}
+		cout << seed << ": " << exp_index.value().chunks.size() << " chunks of " << chunk_size_
+			 << " bytes" << endl;
+	}
+	return error::NoError;
+}
+
 error::Error ShowArtifactAction::Execute(context::MenderContext &main_context) {
+	if (remote_ != "") {
+		return ShowCachedHeader(main_context, remote_);
+	}
+
 	error::Error err = MaybeInstallBootstrapArtifact(main_context);
 	if (err != error::NoError) {
 		return err;
@@ -125,11 +684,25 @@ error::Error ShowArtifactAction::Execute(context::MenderContext &main_context) {
 	}
 
 	auto &provides = exp_provides.value();
-	if (provides.count("artifact_name") == 0 || provides["artifact_name"] == "") {
-		cout << "unknown" << endl;
+	string artifact_name {"unknown"};
+	if (provides.count("artifact_name") != 0 && provides["artifact_name"] != "") {
+		artifact_name = provides["artifact_name"];
+	}
+	if (!json_) {
+		cout << artifact_name << endl;
+		return error::NoError;
+	}
+
+	string device_type {"null"};
+	auto exp_device_type = main_context.GetDeviceType();
+	if (exp_device_type) {
+		device_type = "\"" + json::EscapeString(exp_device_type.value()) + "\"";
 	} else {
-		cout << provides["artifact_name"] << endl;
+		log::Debug("Could not read the device type: " + exp_device_type.error().String());
 	}
+	cout << R"({"artifact_name":")" << json::EscapeString(artifact_name)
+		 << R"(","artifact_group":")" << json::EscapeString(provides["artifact_group"])
+		 << R"(","device_type":)" << device_type << "}" << endl;
 	return error::NoError;
 }
 
@@ -145,6 +718,14 @@ error::Error ShowProvidesAction::Execute(context::MenderContext &main_context) {
 	}
 
 	auto &provides = exp_provides.value();
+	if (json_) {
+		auto exp_json = json::Dump(provides);
+		if (!exp_json) {
+			return exp_json.error();
+		}
+		cout << exp_json.value() << endl;
+		return error::NoError;
+	}
 	for (const auto &elem : provides) {
 		cout << elem.first << "=" << elem.second << endl;
 	}
@@ -152,6 +733,98 @@ error::Error ShowProvidesAction::Execute(context::MenderContext &main_context) {
 	return error::NoError;
 }
 
+error::Error CheckConfigAction::Execute(context::MenderContext &main_context) {
+	if (schema_) {
+		cout << config_schema::JsonSchema() << endl;
+		return error::NoError;
+	}
+
+	const auto &config = main_context.GetConfig();
+	vector<config_schema::Finding> findings;
+	vector<json::Json> configs;
+	// Catches what the schema can't, such as an `MQTT.BrokerURL` without its scheme.
+	cfg_parser::MenderConfigFromFile parsed;
+	for (const auto &file : conf::ConfigFiles(config.paths)) {
+		if (!path::FileExists(file)) {
+			continue;
+		}
+		auto exp_json = json::LoadFromFile(file);
+		if (!exp_json) {
+			findings.push_back(
+				{config_schema::Severity::Error, file, "", exp_json.error().message});
+			continue;
+		}
+		auto file_findings = config_schema::CheckFile(exp_json.value(), file);
+		findings.insert(findings.end(), file_findings.begin(), file_findings.end());
+		if (!exp_json.value().IsObject()) {
+			continue;
+		}
+		configs.push_back(exp_json.value());
+
+		auto exp_loaded = parsed.LoadFile(file);
+		if (!exp_loaded) {
+			findings.push_back(
+				{config_schema::Severity::Error, file, "", exp_loaded.error().message});
+		}
+	}
+
+	auto exp_merged = config_schema::Merge(configs);
+	if (!exp_merged) {
+		return exp_merged.error();
+	}
+	auto conflicts =
+		config_schema::CheckConflicts(exp_merged.value(), config.paths.GetModulesPath());
+	findings.insert(findings.end(), conflicts.begin(), conflicts.end());
+
+	bool failed {false};
+	for (const auto &finding : findings) {
+		cerr << config_schema::FormatFinding(finding) << endl;
+		failed = failed || finding.severity == config_schema::Severity::Error || strict_;
+	}
+	cout << exp_merged.value().Dump(2) << endl;
+
+	if (failed) {
+		return error::MakeError(error::ExitWithFailureError, "");
+	}
+	return error::NoError;
+}
+
+error::Error ShowDeploymentHistoryAction::Execute(context::MenderContext &main_context) {
+	const auto &config = main_context.GetConfig();
+	// Read directly, so that this also works when the daemon isn't running.
+	daemon::DeploymentHistory history {
+		path::Join(config.paths.GetDataStore(), daemon::kDeploymentHistoryFile),
+		static_cast<size_t>(config.deployment_history_length)};
+	auto exp_records = history.Load();
+	if (!exp_records) {
+		return exp_records.error();
+	}
+
+	cout << daemon::DeploymentHistory::ToJson(exp_records.value()) << endl;
+	return error::NoError;
+}
+
+error::Error FreezeAction::Execute(context::MenderContext &main_context) {
+	// Written directly, so that this also works when the daemon isn't running. The daemon reads it
+	// before every step of a deployment it may hold back.
+	daemon::DeviceFreeze freeze {
+		path::Join(main_context.GetConfig().paths.GetDataStore(), daemon::kDeviceFreezeFile)};
+	if (release_) {
+		return freeze.Release();
+	}
+
+	auto exp_until = daemon::ParseFreezeUntil(until_);
+	if (!exp_until) {
+		return exp_until.error();
+	}
+	auto err = freeze.Freeze(exp_until.value());
+	if (err != error::NoError) {
+		return err;
+	}
+	cout << freeze.ToJson() << endl;
+	return error::NoError;
+}
+
 static error::Error ResultHandler(standalone::ResultAndError result) {
 	using Result = standalone::Result;
 
@@ -258,6 +931,13 @@ static error::Error ResultHandler(standalone::ResultAndError result) {
 }
 
 error::Error InstallAction::Execute(context::MenderContext &main_context) {
+	if (dry_run_) {
+		events::EventLoop loop;
+		standalone::Context ctx {main_context, loop};
+		ctx.artifact_checksum = checksum_;
+		return standalone::DryRun(ctx, src_);
+	}
+
 	error::Error err = MaybeInstallBootstrapArtifact(main_context);
 	if (err != error::NoError) {
 		return err;
@@ -265,6 +945,7 @@ error::Error InstallAction::Execute(context::MenderContext &main_context) {
 	events::EventLoop loop;
 	standalone::Context ctx {main_context, loop};
 	ctx.stop_before = std::move(stop_before_);
+	ctx.artifact_checksum = checksum_;
 	auto result = standalone::Install(ctx, src_);
 	err = ResultHandler(result);
 	if (!reboot_exit_code_
@@ -309,7 +990,36 @@ error::Error RollbackAction::Execute(context::MenderContext &main_context) {
 	return ResultHandler(result);
 }
 
+// The checks of the client itself, the others are the executables in the self-test directory.
+static void AddSelfTestChecks(daemon::Context &ctx) {
+	ctx.self_test.AddCheck(
+		"database", [&ctx](function<void(error::Error)> done) { done(ctx.CheckStore()); });
+	ctx.self_test.AddCheck("authentication", [&ctx](function<void(error::Error)> done) {
+		auto err = ctx.authenticator.WithToken([done](auth::ExpectedAuthData ex_auth_data) {
+			if (!ex_auth_data) {
+				done(ex_auth_data.error());
+			} else if (ex_auth_data.value().token == "") {
+				done(error::Error(
+					make_error_condition(errc::permission_denied), "Got no authentication token"));
+			} else {
+				done(error::NoError);
+			}
+		});
+		if (err != error::NoError) {
+			done(err);
+		}
+	});
+}
+
 error::Error DaemonAction::Execute(context::MenderContext &main_context) {
+#if not defined(MENDER_USE_DBUS) and defined(MENDER_EMBED_MENDER_AUTH)
+	// Authenticates by itself, so it must know the servers before setting up the clients.
+	auto discovery_err = main_context.GetConfig().DiscoverServers();
+	if (discovery_err != error::NoError) {
+		return discovery_err;
+	}
+#endif
+
 	events::EventLoop event_loop;
 	daemon::Context ctx(main_context, event_loop);
 	error::Error err;
@@ -326,7 +1036,9 @@ error::Error DaemonAction::Execute(context::MenderContext &main_context) {
 		log::Error("Got error loading the private key from the keystore: " + err.String());
 	}
 	if (err.code == mender::auth::cli::MakeError(mender::auth::cli::NoKeysError, "").code) {
-		log::Info("Generating new ED25519 key");
+		log::Info(
+			"Generating new " + mender::common::crypto::KeyTypeName(key_store->KeyType())
+			+ " key");
 		err = key_store->Generate();
 		if (err != error::NoError) {
 			log::Error("Failed to generate new key: " + err.String());
@@ -342,13 +1054,154 @@ error::Error DaemonAction::Execute(context::MenderContext &main_context) {
 		{key_store->KeyName(), key_store->PassPhrase(), key_store->SSLEngine()});
 #endif
 
+	AddSelfTestChecks(ctx);
+
 	daemon::StateMachine state_machine(ctx, event_loop);
+	if (run_once_) {
+		state_machine.RunOnce();
+	}
 	state_machine.LoadStateFromDb();
 	err = MaybeInstallBootstrapArtifact(main_context);
 	if (err != error::NoError) {
 		return err;
 	}
 
+	daemon::Control control {ctx, state_machine, event_loop};
+	err = control.RegisterSignalShims();
+	if (err != error::NoError) {
+		return err;
+	}
+
+#ifdef MENDER_USE_DBUS
+	dbus::DBusServer dbus_server {event_loop, "io.mender.UpdateManager"};
+	auto dbus_obj = make_shared<dbus::DBusObject>("/io/mender/UpdateManager");
+	dbus::AddManagementMethodHandlers(*dbus_obj);
+	AddStateListenerMethodHandlers(*dbus_obj, ctx.state_listeners);
+	AddUpdateMethodHandlers(*dbus_obj, ctx, state_machine);
+	AddUpdateProperties(*dbus_obj, state_machine);
+	AddInventoryMethodHandlers(
+		*dbus_obj, ctx.inventory_client->runtime_attributes, [&ctx, &state_machine]() {
+			ctx.inventory_client->ClearDataCache();
+			state_machine.PostEvent(daemon::StateEvent::InventoryPollingTriggered);
+		});
+	AddConfigureMethodHandlers(*dbus_obj, ctx.device_config);
+	AddControlMethodHandlers(*dbus_obj, control);
+	auto dbus_authorization = main_context.GetConfig().dbus_authorization;
+	if (!dbus_authorization.rules.empty()) {
+		dbus_authorization.ResolveIds();
+		dbus_obj->SetMethodAuthorizer(
+			[&dbus_authorization](const dbus::MethodCaller &caller, const string &spec) {
+				return dbus_authorization.Allows(spec, caller.uid, caller.gids);
+			});
+	}
+	ctx.state_listeners.SetEmitFunction(
+		[&dbus_server](const string &state, const string &action) {
+			return dbus_server.EmitSignal<dbus::StringPair>(
+				"/io/mender/UpdateManager",
+				kStateListenerInterface,
+				"StateTransition",
+				dbus::StringPair {state, action});
+		});
+	ctx.emit_module_progress = [&dbus_server](const string &state, const string &progress) {
+		return dbus_server.EmitSignal<dbus::StringPair>(
+			"/io/mender/UpdateManager",
+			kProgressInterface,
+			"UpdateModuleProgress",
+			dbus::StringPair {state, progress});
+	};
+	ctx.emit_download_progress = [&dbus_server](const string &id, const string &progress) {
+		return dbus_server.EmitSignal<dbus::StringPair>(
+			"/io/mender/UpdateManager",
+			kUpdateInterface,
+			"DownloadProgress",
+			dbus::StringPair {id, progress});
+	};
+	ctx.device_config.SetEmitFunction([&dbus_server](const string &configuration) {
+		return dbus_server.EmitSignal<string>(
+			"/io/mender/UpdateManager", kConfigureInterface, "ConfigurationApplied", configuration);
+	});
+	ctx.standalone_update.SetEmitFunctions(
+		[&dbus_server](const string &operation, const string &state) {
+			return dbus_server.EmitSignal<dbus::StringPair>(
+				"/io/mender/UpdateManager",
+				kUpdateInterface,
+				"StandaloneProgress",
+				dbus::StringPair {operation, state});
+		},
+		[&dbus_server](const string &operation, const string &result) {
+			return dbus_server.EmitSignal<dbus::StringPair>(
+				"/io/mender/UpdateManager",
+				kUpdateInterface,
+				"StandaloneFinished",
+				dbus::StringPair {operation, result});
+		});
+	ctx.reboot_grace.SetEmitFunction([&dbus_server](const string &id, const string &pending) {
+		return dbus_server.EmitSignal<dbus::StringPair>(
+			"/io/mender/UpdateManager",
+			kUpdateInterface,
+			"RebootPending",
+			dbus::StringPair {id, pending});
+	});
+	state_machine.SetStatusChangeCallback(
+		[&dbus_server](
+			const daemon::StateMachine::Status &previous,
+			const daemon::StateMachine::Status &current) {
+			auto err = dbus_server.EmitPropertiesChanged(
+				"/io/mender/UpdateManager",
+				kUpdateInterface,
+				ChangedUpdateProperties(previous, current));
+			if (err == error::NoError && current.state != previous.state) {
+				err = dbus_server.EmitSignal<dbus::StringPair>(
+					"/io/mender/UpdateManager",
+					kUpdateInterface,
+					"StateChanged",
+					dbus::StringPair {current.state, current.deployment_id});
+			}
+			if (err != error::NoError) {
+				log::Debug("Could not emit the state change on DBus: " + err.String());
+			}
+		});
+	err = dbus_server.AdvertiseObject(dbus_obj);
+	if (err != error::NoError) {
+		// Not fatal, the daemon can do its job without being manageable over DBus.
+		log::Warning("Could not advertise the management interface on DBus: " + err.String());
+	}
+	ctx.self_test.AddCheck("D-Bus", [err](function<void(error::Error)> done) { done(err); });
+#endif
+
+	const auto &local_api_config = main_context.GetConfig().local_api;
+	local_api::Server local_api_server {event_loop};
+	if (local_api_config.enabled) {
+		AddLocalUpdateMethodHandlers(local_api_server, ctx, state_machine);
+		AddLocalControlMethodHandlers(local_api_server, control);
+		err = local_api_server.Listen(local_api_config.update_socket_path);
+		if (err != error::NoError) {
+			// Not fatal either, like DBus.
+			log::Warning("Could not serve the local API: " + err.String());
+		}
+	}
+
+	const auto &metrics_config = main_context.GetConfig().metrics;
+	daemon::MetricsServer metrics_server {event_loop, [&ctx]() { return ctx.metrics.Render(); }};
+	if (metrics_config.listen != "") {
+		err = metrics_server.Listen(metrics_config.listen);
+		if (err != error::NoError) {
+			// Not fatal, like the local API.
+			log::Warning("Could not serve the metrics: " + err.String());
+		}
+	}
+
+#ifdef MENDER_DEBUG_CONSOLE
+	unique_ptr<daemon::DebugConsole> debug_console;
+	if (debug_console_) {
+		debug_console = make_unique<daemon::DebugConsole>(state_machine, ctx, event_loop);
+		err = debug_console->Start();
+		if (err != error::NoError) {
+			return err;
+		}
+	}
+#endif
+
 	event_loop.Post([]() {
 		log::Info("The update client daemon is now ready to handle incoming deployments");
 	});
@@ -382,7 +1235,9 @@ static expected::ExpectedString GetPID() {
 	if (PID == "" or PID == "0") {
 		return expected::unexpected(error::Error(
 			make_error_condition(errc::no_message),
-			"No PID found for mender-updated. The service is not running"));
+			"No PID found for mender-updated. The service is not running. Use "
+			"`mender-update daemon --run-once` to submit the inventory and check for updates "
+			"without it"));
 	}
 	return PID;
 }
@@ -415,6 +1270,66 @@ error::Error CheckUpdateAction::Execute(context::MenderContext &main_context) {
 	return SendSignal("SIGUSR1", pid.value()).WithContext("Failed to force an update check");
 }
 
+error::Error StatusAction::Execute(context::MenderContext &main_context) {
+#ifdef MENDER_USE_DBUS
+	events::EventLoop loop;
+	dbus::DBusClient client {loop};
+	error::Error call_err;
+	auto err = client.CallMethod<expected::ExpectedString>(
+		"io.mender.UpdateManager",
+		"/io/mender/UpdateManager",
+		kUpdateInterface,
+		"GetStatus",
+		[&loop, &call_err](expected::ExpectedString exp_status) {
+			if (exp_status) {
+				cout << exp_status.value() << endl;
+			} else {
+				call_err = exp_status.error();
+			}
+			loop.Stop();
+		});
+	if (err == error::NoError) {
+		loop.Run();
+		err = call_err;
+	}
+	return err.WithContext("Failed to get the status of the daemon");
+#else
+	return error::Error(
+		make_error_condition(errc::not_supported),
+		"The status of the daemon can only be queried over DBus");
+#endif // MENDER_USE_DBUS
+}
+
+error::Error ConfirmCommitAction::Execute(context::MenderContext &main_context) {
+#ifdef MENDER_USE_DBUS
+	events::EventLoop loop;
+	dbus::DBusClient client {loop};
+	error::Error call_err;
+	auto err = client.CallMethod<expected::ExpectedString>(
+		"io.mender.UpdateManager",
+		"/io/mender/UpdateManager",
+		kUpdateInterface,
+		"ConfirmCommit",
+		[&loop, &call_err](expected::ExpectedString exp_reply) {
+			if (exp_reply) {
+				cout << exp_reply.value() << endl;
+			} else {
+				call_err = exp_reply.error();
+			}
+			loop.Stop();
+		});
+	if (err == error::NoError) {
+		loop.Run();
+		err = call_err;
+	}
+	return err.WithContext("Failed to confirm the commit");
+#else
+	return error::Error(
+		make_error_condition(errc::not_supported),
+		"The commit can only be confirmed over DBus, or the local API");
+#endif // MENDER_USE_DBUS
+}
+
 } // namespace cli
 } // namespace update
 } // namespace mender
@@ -18,6 +18,7 @@
 #include <common/error.hpp>
 #include <common/expected.hpp>
 
+#include <mender-update/benchmark.hpp>
 #include <mender-update/context.hpp>
 
 namespace mender {
@@ -29,6 +30,7 @@ using namespace std;
 namespace error = mender::common::error;
 namespace expected = mender::common::expected;
 
+namespace benchmark = mender::update::benchmark;
 namespace context = mender::update::context;
 
 class Action {
@@ -36,18 +38,138 @@ public:
 	virtual ~Action() {};
 
 	virtual error::Error Execute(context::MenderContext &main_context) = 0;
+
+	// Whether the data store is opened before `Execute()`, which the actions that only read the
+	// configuration don't need.
+	virtual bool NeedsDataStore() const {
+		return true;
+	}
 };
 using ActionPtr = shared_ptr<Action>;
 using ExpectedActionPtr = expected::expected<ActionPtr, error::Error>;
 
+class BenchmarkAction : virtual public Action {
+public:
+	error::Error Execute(context::MenderContext &main_context) override;
+
+	// The inactive partition to measure the write throughput on, skipped if empty.
+	void SetDevice(const string &device) {
+		device_ = device;
+	}
+
+	void SetSizeMiB(int size_mib) {
+		size_mib_ = size_mib;
+	}
+
+	void SetDirect(bool direct) {
+		write_options_.direct = direct;
+	}
+
+	void SetBufferSizeKiB(int buffer_size_kib) {
+		write_options_.buffer_size = static_cast<size_t>(buffer_size_kib) * 1024;
+	}
+
+	void SetSyncIntervalMiB(int sync_interval_mib) {
+		write_options_.sync_interval = static_cast<int64_t>(sync_interval_mib) * 1024 * 1024;
+	}
+
+private:
+	string device_;
+	int size_mib_ {128};
+	benchmark::WriterOptions write_options_;
+};
+
+class CheckConfigAction : virtual public Action {
+public:
+	error::Error Execute(context::MenderContext &main_context) override;
+
+	bool NeedsDataStore() const override {
+		return false;
+	}
+
+	// Prints the JSON Schema of the configuration instead.
+	void SetSchema(bool schema) {
+		schema_ = schema;
+	}
+
+	// Fails on warnings too.
+	void SetStrict(bool strict) {
+		strict_ = strict;
+	}
+
+private:
+	bool schema_ {false};
+	bool strict_ {false};
+};
+
+class DeltaSeedAction : virtual public Action {
+public:
+	error::Error Execute(context::MenderContext &main_context) override;
+
+	// Instead of the seeds of the chunked downloads in the configuration.
+	void AddSeed(const string &seed) {
+		seeds_.push_back(seed);
+	}
+
+	void SetChunkSize(int64_t chunk_size) {
+		chunk_size_ = chunk_size;
+	}
+
+private:
+	vector<string> seeds_;
+	int64_t chunk_size_ {1024 * 1024};
+};
+
 class ShowArtifactAction : virtual public Action {
 public:
 	error::Error Execute(context::MenderContext &main_context) override;
+
+	// Shows the cached header of this Artifact instead of the current one.
+	void SetRemote(const string &artifact_name) {
+		remote_ = artifact_name;
+	}
+
+	// Also shows the group and the device type, as one JSON object.
+	void SetJson(bool json) {
+		json_ = json;
+	}
+
+private:
+	string remote_;
+	bool json_ {false};
 };
 
 class ShowProvidesAction : virtual public Action {
 public:
 	error::Error Execute(context::MenderContext &main_context) override;
+
+	void SetJson(bool json) {
+		json_ = json;
+	}
+
+private:
+	bool json_ {false};
+};
+
+class ShowDeploymentHistoryAction : virtual public Action {
+public:
+	error::Error Execute(context::MenderContext &main_context) override;
+};
+
+class FreezeAction : virtual public Action {
+public:
+	error::Error Execute(context::MenderContext &main_context) override;
+
+	void SetUntil(const string &until) {
+		until_ = until;
+	}
+	void SetRelease(bool release) {
+		release_ = release;
+	}
+
+private:
+	string until_;
+	bool release_ {false};
 };
 
 class BaseInstallAction : virtual public Action {
@@ -73,8 +195,18 @@ public:
 
 	error::Error Execute(context::MenderContext &main_context) override;
 
+	void SetChecksum(const string &val) {
+		checksum_ = val;
+	}
+
+	void SetDryRun(bool val) {
+		dry_run_ = val;
+	}
+
 private:
 	string src_;
+	string checksum_;
+	bool dry_run_ {false};
 };
 
 class ResumeAction : public BaseInstallAction {
@@ -95,6 +227,18 @@ public:
 class DaemonAction : virtual public Action {
 public:
 	error::Error Execute(context::MenderContext &main_context) override;
+
+	void SetDebugConsole(bool val) {
+		debug_console_ = val;
+	}
+
+	void SetRunOnce(bool val) {
+		run_once_ = val;
+	}
+
+private:
+	bool debug_console_ {false};
+	bool run_once_ {false};
 };
 
 class SendInventoryAction : virtual public Action {
@@ -107,6 +251,16 @@ public:
 	error::Error Execute(context::MenderContext &main_context) override;
 };
 
+class StatusAction : virtual public Action {
+public:
+	error::Error Execute(context::MenderContext &main_context) override;
+};
+
+class ConfirmCommitAction : virtual public Action {
+public:
+	error::Error Execute(context::MenderContext &main_context) override;
+};
+
 error::Error MaybeInstallBootstrapArtifact(context::MenderContext &main_context);
 
 } // namespace cli
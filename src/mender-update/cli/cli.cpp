@@ -18,9 +18,11 @@
 #include <mender-auth/cli/cli.hpp>
 #endif
 
+#include <cctype>
 #include <iostream>
 
 #include <client_shared/conf.hpp>
+#include <common/common.hpp>
 #include <common/error.hpp>
 #include <common/expected.hpp>
 
@@ -28,11 +30,13 @@ namespace mender {
 namespace update {
 namespace cli {
 
+namespace common = mender::common;
 namespace conf = mender::client_shared::conf;
 namespace error = mender::common::error;
 namespace expected = mender::common::expected;
 
 const int NoUpdateInProgressExitStatus = 2;
+const int NoUpdateAvailableExitStatus = 3;
 const int RebootExitStatus = 4;
 
 #ifdef MENDER_EMBED_MENDER_AUTH
@@ -42,6 +46,59 @@ const conf::CliCommand cmd_auth {
 };
 #endif
 
+const conf::CliCommand cmd_benchmark {
+	.name = "benchmark",
+	.description =
+		"Measure how fast this device can install updates, print a report and store the results for the inventory",
+	.options =
+		{
+			conf::CliOption {
+				.long_option = "device",
+				.description =
+					"Measure the write throughput to this inactive partition, which is overwritten. "
+					"Without it, only the checksum and boot loader environment are measured.",
+				.parameter = "DEVICE",
+			},
+			conf::CliOption {
+				.long_option = "size",
+				.description = "How many MiB to write and checksum. Default: 128",
+				.parameter = "MIB",
+			},
+			conf::CliOption {
+				.long_option = "direct",
+				.description = "Write with O_DIRECT, bypassing the page cache",
+			},
+			conf::CliOption {
+				.long_option = "buffer-size",
+				.description = "How many KiB to write at a time. Default: 1024",
+				.parameter = "KIB",
+			},
+			conf::CliOption {
+				.long_option = "sync-interval",
+				.description = "Flush the writes to the device every this many MiB. Default: 0, "
+							   "only at the end",
+				.parameter = "MIB",
+			},
+		},
+};
+
+const conf::CliCommand cmd_check_config {
+	.name = "check-config",
+	.description =
+		"Check the configuration files for unknown settings, settings of the wrong type and conflicting settings, and print the merged configuration as JSON",
+	.options =
+		{
+			conf::CliOption {
+				.long_option = "schema",
+				.description = "Print the JSON Schema of the configuration files instead",
+			},
+			conf::CliOption {
+				.long_option = "strict",
+				.description = "Fail on warnings too, not only on errors",
+			},
+		},
+};
+
 const conf::CliCommand cmd_check_update {
 	.name = "check-update",
 	.description = "Force update check",
@@ -72,9 +129,78 @@ const conf::CliCommand cmd_commit {
 		},
 };
 
+const conf::CliCommand cmd_confirm_commit {
+	.name = "confirm-commit",
+	.description =
+		"Confirm the commit which the running daemon waits for, with CommitRequiresConfirmation",
+};
+
 const conf::CliCommand cmd_daemon {
 	.name = "daemon",
 	.description = "Start the client as a background service",
+	.options =
+		{
+			conf::CliOption {
+				.long_option = "run-once",
+				.description =
+					"Submit the inventory and check for an update once, install it if there is one, "
+					"and exit. Returns (0) if the update was installed, (3) if there was no update "
+					"and (1) if the check or the update failed",
+			},
+#ifdef MENDER_DEBUG_CONSOLE
+			conf::CliOption {
+				.long_option = "debug-console",
+				.description =
+					"Show an interactive console with the current state and recent logs, which "
+					"allows pausing, resuming and aborting deployments. Must be run in a terminal. "
+					"Combine with `--log-file` to keep the full log.",
+			},
+#endif
+		},
+};
+
+const conf::CliCommand cmd_delta {
+	.name = "delta",
+	.description =
+		"Prepare for delta updates. `delta seed` stores an index of the seeds of chunked downloads, so that they don't need to be scanned while downloading",
+	.argument =
+		conf::CliArgument {
+			.name = "seed",
+			.mandatory = true,
+		},
+	.options =
+		{
+			conf::CliOption {
+				.long_option = "seed",
+				.description =
+					"File or block device to index, can be given more than once. Default: the Seeds of ChunkedDownload",
+				.parameter = "PATH",
+			},
+			conf::CliOption {
+				.long_option = "chunk-size",
+				.description =
+					"Size of the chunks, which must be the one the chunk indexes of the Artifacts use. Default: 1048576",
+				.parameter = "BYTES",
+			},
+		},
+};
+
+const conf::CliCommand cmd_freeze {
+	.name = "freeze",
+	.description = "Hold back all deployments until released, and print the freeze as JSON",
+	.options =
+		{
+			conf::CliOption {
+				.long_option = "until",
+				.description =
+					"Release the freeze by itself at the given time, an RFC 3339 timestamp such as 2026-11-01T00:00:00Z.",
+				.parameter = "TIME",
+			},
+			conf::CliOption {
+				.long_option = "release",
+				.description = "Release the freeze, so that the deployments go on.",
+			},
+		},
 };
 
 const conf::CliCommand cmd_install {
@@ -92,6 +218,17 @@ const conf::CliCommand cmd_install {
 				.description =
 					"Return exit code 4 if a manual reboot is required after the Artifact installation.",
 			},
+			conf::CliOption {
+				.long_option = "checksum",
+				.description =
+					"Expected SHA256 checksum of the Artifact, in hexadecimal. The Artifact is not installed if it doesn't match.",
+				.parameter = "SHA256",
+			},
+			conf::CliOption {
+				.long_option = "dry-run",
+				.description = "Check the Artifact and print what installing it would do, "
+							   "without installing it",
+			},
 			opt_stop_before,
 		},
 };
@@ -124,14 +261,45 @@ const conf::CliCommand cmd_send_inventory {
 	.description = "Force inventory update",
 };
 
+const conf::CliCommand cmd_status {
+	.name = "status",
+	.description = "Print the status of the running daemon, as JSON",
+};
+
 const conf::CliCommand cmd_show_artifact {
 	.name = "show-artifact",
 	.description = "Print the current artifact name to the command line and exit",
+	.options =
+		{
+			conf::CliOption {
+				.long_option = "json",
+				.description =
+					"Print the name, group and device type of the current Artifact, as JSON.",
+			},
+			conf::CliOption {
+				.long_option = "remote",
+				.description =
+					"Print the cached header of the given Artifact offered by the server, as JSON, instead.",
+				.parameter = "NAME",
+			},
+		},
+};
+
+const conf::CliCommand cmd_show_deployment_history {
+	.name = "show-deployment-history",
+	.description = "Print the latest deployments and their outcomes, as JSON, and exit",
 };
 
 const conf::CliCommand cmd_show_provides {
 	.name = "show-provides",
 	.description = "Print the current provides to the command line and exit",
+	.options =
+		{
+			conf::CliOption {
+				.long_option = "json",
+				.description = "Print the provides as a JSON object.",
+			},
+		},
 };
 
 const conf::CliApp cli_mender_update = {
@@ -145,23 +313,43 @@ const conf::CliApp cli_mender_update = {
 #ifdef MENDER_EMBED_MENDER_AUTH
 			cmd_auth,
 #endif
+			cmd_check_config,
 			cmd_check_update,
 			cmd_commit,
+			cmd_confirm_commit,
 			cmd_daemon,
+			cmd_delta,
+			cmd_freeze,
 			cmd_install,
 			cmd_resume,
 			cmd_rollback,
 			cmd_send_inventory,
 			cmd_show_artifact,
+			cmd_show_deployment_history,
 			cmd_show_provides,
+			cmd_status,
 		},
 };
 
+static bool IsSha256Hex(const string &str) {
+	if (str.size() != 64) {
+		return false;
+	}
+	for (auto c : str) {
+		if (!isxdigit(static_cast<unsigned char>(c))) {
+			return false;
+		}
+	}
+	return true;
+}
+
 static error::Error CommonInstallFlagsHandler(
 	conf::CmdlineOptionsIterator &iter,
 	string *filename,
 	bool *reboot_exit_code,
-	vector<string> *stop_before) {
+	vector<string> *stop_before,
+	string *checksum,
+	bool *dry_run = nullptr) {
 	while (true) {
 		auto arg = iter.Next();
 		if (!arg) {
@@ -179,6 +367,17 @@ static error::Error CommonInstallFlagsHandler(
 			}
 			stop_before->push_back(value.value);
 			continue;
+		} else if (checksum != nullptr and value.option == "--checksum") {
+			if (!IsSha256Hex(value.value)) {
+				return conf::MakeError(
+					conf::InvalidOptionsError,
+					"--checksum needs a SHA256 checksum, 64 hexadecimal digits");
+			}
+			*checksum = common::StringToLower(value.value);
+			continue;
+		} else if (dry_run != nullptr and value.option == "--dry-run") {
+			*dry_run = true;
+			continue;
 		} else if (value.option != "") {
 			return conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option);
 		}
@@ -214,22 +413,257 @@ ExpectedActionPtr ParseUpdateArguments(
 		return expected::unexpected(error::MakeError(error::ExitWithSuccessError, ""));
 	}
 
-	if (start[0] == "show-artifact") {
+	if (start[0] == "benchmark") {
+		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_benchmark.options);
+		auto benchmark_action = make_shared<BenchmarkAction>();
+		while (true) {
+			auto arg = iter.Next();
+			if (!arg) {
+				return expected::unexpected(arg.error());
+			}
+
+			auto value = arg.value();
+			if (value.option == "--device") {
+				if (value.value == "") {
+					return expected::unexpected(
+						conf::MakeError(conf::InvalidOptionsError, "--device needs an argument"));
+				}
+				benchmark_action->SetDevice(value.value);
+				continue;
+			}
+			if (value.option == "--size") {
+				auto exp_size = common::StringTo<int>(value.value);
+				if (!exp_size || exp_size.value() <= 0) {
+					return expected::unexpected(conf::MakeError(
+						conf::InvalidOptionsError, "--size needs a positive number of MiB"));
+				}
+				benchmark_action->SetSizeMiB(exp_size.value());
+				continue;
+			}
+			if (value.option == "--direct") {
+				benchmark_action->SetDirect(true);
+				continue;
+			}
+			if (value.option == "--buffer-size") {
+				auto exp_size = common::StringTo<int>(value.value);
+				if (!exp_size || exp_size.value() <= 0 || exp_size.value() % 4 != 0) {
+					return expected::unexpected(conf::MakeError(
+						conf::InvalidOptionsError,
+						"--buffer-size needs a positive multiple of 4 KiB"));
+				}
+				benchmark_action->SetBufferSizeKiB(exp_size.value());
+				continue;
+			}
+			if (value.option == "--sync-interval") {
+				auto exp_interval = common::StringTo<int>(value.value);
+				if (!exp_interval || exp_interval.value() < 0) {
+					return expected::unexpected(conf::MakeError(
+						conf::InvalidOptionsError, "--sync-interval needs a number of MiB"));
+				}
+				benchmark_action->SetSyncIntervalMiB(exp_interval.value());
+				continue;
+			}
+			if (value.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option));
+			}
+			if (value.value != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "Too many arguments: " + value.value));
+			}
+			break;
+		}
+
+		return benchmark_action;
+	} else if (start[0] == "check-config") {
+		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_check_config.options);
+		auto check_config_action = make_shared<CheckConfigAction>();
+		while (true) {
+			auto arg = iter.Next();
+			if (!arg) {
+				return expected::unexpected(arg.error());
+			}
+
+			auto value = arg.value();
+			if (value.option == "--schema") {
+				check_config_action->SetSchema(true);
+				continue;
+			}
+			if (value.option == "--strict") {
+				check_config_action->SetStrict(true);
+				continue;
+			}
+			if (value.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option));
+			}
+			if (value.value != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "Too many arguments: " + value.value));
+			}
+			break;
+		}
+
+		return check_config_action;
+	} else if (start[0] == "delta") {
+		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_delta.options);
+		iter.SetArgumentsMode(conf::ArgumentsMode::AcceptBareArguments);
+		auto delta_seed_action = make_shared<DeltaSeedAction>();
+		string delta_command;
+		while (true) {
+			auto arg = iter.Next();
+			if (!arg) {
+				return expected::unexpected(arg.error());
+			}
+
+			auto value = arg.value();
+			if (value.option == "--seed") {
+				if (value.value == "") {
+					return expected::unexpected(
+						conf::MakeError(conf::InvalidOptionsError, "--seed needs an argument"));
+				}
+				delta_seed_action->AddSeed(value.value);
+				continue;
+			}
+			if (value.option == "--chunk-size") {
+				auto exp_size = common::StringTo<int64_t>(value.value);
+				if (!exp_size || exp_size.value() <= 0) {
+					return expected::unexpected(conf::MakeError(
+						conf::InvalidOptionsError, "--chunk-size needs a positive number of bytes"));
+				}
+				delta_seed_action->SetChunkSize(exp_size.value());
+				continue;
+			}
+			if (value.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option));
+			}
+			if (value.value != "") {
+				if (delta_command != "") {
+					return expected::unexpected(conf::MakeError(
+						conf::InvalidOptionsError, "Too many arguments: " + value.value));
+				}
+				delta_command = value.value;
+				continue;
+			}
+			break;
+		}
+		if (delta_command != "seed") {
+			return expected::unexpected(
+				conf::MakeError(conf::InvalidOptionsError, "Need a delta command: seed"));
+		}
+
+		return delta_seed_action;
+	} else if (start[0] == "show-artifact") {
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_show_artifact.options);
-		auto arg = iter.Next();
-		if (!arg) {
-			return expected::unexpected(arg.error());
+		auto show_artifact_action = make_shared<ShowArtifactAction>();
+		while (true) {
+			auto arg = iter.Next();
+			if (!arg) {
+				return expected::unexpected(arg.error());
+			}
+
+			auto value = arg.value();
+			if (value.option == "--remote") {
+				if (value.value == "") {
+					return expected::unexpected(
+						conf::MakeError(conf::InvalidOptionsError, "--remote needs an argument"));
+				}
+				show_artifact_action->SetRemote(value.value);
+				continue;
+			}
+			if (value.option == "--json") {
+				show_artifact_action->SetJson(true);
+				continue;
+			}
+			if (value.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option));
+			}
+			if (value.value != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "Too many arguments: " + value.value));
+			}
+			break;
 		}
 
-		return make_shared<ShowArtifactAction>();
+		return show_artifact_action;
 	} else if (start[0] == "show-provides") {
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_show_provides.options);
+		auto show_provides_action = make_shared<ShowProvidesAction>();
+		while (true) {
+			auto arg = iter.Next();
+			if (!arg) {
+				return expected::unexpected(arg.error());
+			}
+
+			auto value = arg.value();
+			if (value.option == "--json") {
+				show_provides_action->SetJson(true);
+				continue;
+			}
+			if (value.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option));
+			}
+			if (value.value != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "Too many arguments: " + value.value));
+			}
+			break;
+		}
+
+		return show_provides_action;
+	} else if (start[0] == "show-deployment-history") {
+		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_show_deployment_history.options);
 		auto arg = iter.Next();
 		if (!arg) {
 			return expected::unexpected(arg.error());
 		}
 
-		return make_shared<ShowProvidesAction>();
+		return make_shared<ShowDeploymentHistoryAction>();
+	} else if (start[0] == "freeze") {
+		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_freeze.options);
+		auto freeze_action = make_shared<FreezeAction>();
+		bool until {false};
+		bool release {false};
+		while (true) {
+			auto arg = iter.Next();
+			if (!arg) {
+				return expected::unexpected(arg.error());
+			}
+
+			auto value = arg.value();
+			if (value.option == "--until") {
+				if (value.value == "") {
+					return expected::unexpected(
+						conf::MakeError(conf::InvalidOptionsError, "--until needs an argument"));
+				}
+				freeze_action->SetUntil(value.value);
+				until = true;
+				continue;
+			}
+			if (value.option == "--release") {
+				freeze_action->SetRelease(true);
+				release = true;
+				continue;
+			}
+			if (value.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option));
+			}
+			if (value.value != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "Too many arguments: " + value.value));
+			}
+			break;
+		}
+		if (until && release) {
+			return expected::unexpected(conf::MakeError(
+				conf::InvalidOptionsError, "--until and --release cannot be used together"));
+		}
+
+		return freeze_action;
 	} else if (start[0] == "install") {
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_install.options);
 		iter.SetArgumentsMode(conf::ArgumentsMode::AcceptBareArguments);
@@ -237,7 +671,10 @@ ExpectedActionPtr ParseUpdateArguments(
 		string filename;
 		bool reboot_exit_code = false;
 		vector<string> stop_before;
-		auto err = CommonInstallFlagsHandler(iter, &filename, &reboot_exit_code, &stop_before);
+		string checksum;
+		bool dry_run = false;
+		auto err = CommonInstallFlagsHandler(
+			iter, &filename, &reboot_exit_code, &stop_before, &checksum, &dry_run);
 		if (err != error::NoError) {
 			return expected::unexpected(err);
 		}
@@ -245,13 +682,16 @@ ExpectedActionPtr ParseUpdateArguments(
 		auto install_action = make_shared<InstallAction>(filename);
 		install_action->SetRebootExitCode(reboot_exit_code);
 		install_action->SetStopBefore(std::move(stop_before));
+		install_action->SetChecksum(checksum);
+		install_action->SetDryRun(dry_run);
 		return install_action;
 	} else if (start[0] == "resume") {
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_resume.options);
 
 		bool reboot_exit_code = false;
 		vector<string> stop_before;
-		auto err = CommonInstallFlagsHandler(iter, nullptr, &reboot_exit_code, &stop_before);
+		auto err =
+			CommonInstallFlagsHandler(iter, nullptr, &reboot_exit_code, &stop_before, nullptr);
 		if (err != error::NoError) {
 			return expected::unexpected(err);
 		}
@@ -264,7 +704,7 @@ ExpectedActionPtr ParseUpdateArguments(
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_commit.options);
 
 		vector<string> stop_before;
-		auto err = CommonInstallFlagsHandler(iter, nullptr, nullptr, &stop_before);
+		auto err = CommonInstallFlagsHandler(iter, nullptr, nullptr, &stop_before, nullptr);
 		if (err != error::NoError) {
 			return expected::unexpected(err);
 		}
@@ -276,7 +716,7 @@ ExpectedActionPtr ParseUpdateArguments(
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_rollback.options);
 
 		vector<string> stop_before;
-		auto err = CommonInstallFlagsHandler(iter, nullptr, nullptr, &stop_before);
+		auto err = CommonInstallFlagsHandler(iter, nullptr, nullptr, &stop_before, nullptr);
 		if (err != error::NoError) {
 			return expected::unexpected(err);
 		}
@@ -286,12 +726,36 @@ ExpectedActionPtr ParseUpdateArguments(
 		return rollback_action;
 	} else if (start[0] == "daemon") {
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_daemon.options);
-		auto arg = iter.Next();
-		if (!arg) {
-			return expected::unexpected(arg.error());
+		auto daemon_action = make_shared<DaemonAction>();
+		while (true) {
+			auto arg = iter.Next();
+			if (!arg) {
+				return expected::unexpected(arg.error());
+			}
+
+			auto value = arg.value();
+			if (value.option == "--run-once") {
+				daemon_action->SetRunOnce(true);
+				continue;
+			}
+#ifdef MENDER_DEBUG_CONSOLE
+			if (value.option == "--debug-console") {
+				daemon_action->SetDebugConsole(true);
+				continue;
+			}
+#endif
+			if (value.option != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "No such option: " + value.option));
+			}
+			if (value.value != "") {
+				return expected::unexpected(
+					conf::MakeError(conf::InvalidOptionsError, "Too many arguments: " + value.value));
+			}
+			break;
 		}
 
-		return make_shared<DaemonAction>();
+		return daemon_action;
 	} else if (start[0] == "send-inventory") {
 		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_send_inventory.options);
 		auto arg = iter.Next();
@@ -308,6 +772,22 @@ ExpectedActionPtr ParseUpdateArguments(
 		}
 
 		return make_shared<CheckUpdateAction>();
+	} else if (start[0] == "status") {
+		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_status.options);
+		auto arg = iter.Next();
+		if (!arg) {
+			return expected::unexpected(arg.error());
+		}
+
+		return make_shared<StatusAction>();
+	} else if (start[0] == "confirm-commit") {
+		conf::CmdlineOptionsIterator iter(start + 1, end, cmd_confirm_commit.options);
+		auto arg = iter.Next();
+		if (!arg) {
+			return expected::unexpected(arg.error());
+		}
+
+		return make_shared<ConfirmCommitAction>();
 	}
 #ifdef MENDER_EMBED_MENDER_AUTH
 	// We do not test for this here, because mender-auth has its own Main() function and
@@ -352,9 +832,11 @@ static error::Error DoMain(
 
 	test_hook(main_context);
 
-	auto err = main_context.Initialize();
-	if (error::NoError != err) {
-		return err;
+	if (action.value()->NeedsDataStore()) {
+		auto err = main_context.Initialize();
+		if (error::NoError != err) {
+			return err;
+		}
 	}
 
 	return action.value()->Execute(main_context);
@@ -374,6 +856,8 @@ int Main(
 
 	if (err.code == context::MakeError(context::NoUpdateInProgressError, "").code) {
 		return NoUpdateInProgressExitStatus;
+	} else if (err.code == context::MakeError(context::NoUpdateAvailableError, "").code) {
+		return NoUpdateAvailableExitStatus;
 	} else if (err.code == context::MakeError(context::RebootRequiredError, "").code) {
 		return RebootExitStatus;
 	} else if (err != error::NoError) {
@@ -15,6 +15,7 @@
 #ifndef MENDER_COMMON_CONTEXT_HPP
 #define MENDER_COMMON_CONTEXT_HPP
 
+#include <chrono>
 #include <string>
 #include <unordered_map>
 
@@ -23,6 +24,7 @@
 #include <common/error.hpp>
 #include <common/expected.hpp>
 #include <common/key_value_database.hpp>
+#include <common/key_value_database_encrypted.hpp>
 #include <common/optional.hpp>
 
 #ifdef MENDER_USE_LMDB
@@ -54,6 +56,9 @@ enum MenderContextErrorCode {
 	UnexpectedHttpResponse,
 	StateDataStoreCountExceededError,
 	WrongOperationError,
+	WorkDirQuotaExceededError,
+	ArtifactDependsNotSatisfiedError,
+	NoUpdateAvailableError,
 };
 
 class MenderContextErrorCategoryClass : public std::error_category {
@@ -80,11 +85,20 @@ public:
 	virtual kv_db::KeyValueDatabase &GetMenderStoreDB();
 	ExpectedProvidesData LoadProvides();
 	ExpectedProvidesData LoadProvides(kv_db::Transaction &txn);
+	// The first device type in the device type file, which the server is asked for deployments
+	// with.
 	expected::ExpectedString GetDeviceType();
+	// All the device types in the device type file, the one from GetDeviceType() first. The
+	// device can install the Artifacts for any of them, see
+	// Documentation/compatible-device-types.md.
+	expected::ExpectedStringVector GetDeviceTypes();
 #ifdef MENDER_USE_YAML_CPP
 	expected::ExpectedString GetSystemType();
 #endif // MENDER_USE_YAML_CPP
 	expected::ExpectedString GetCompatibleType(const string &payload_type = "");
+	// Like GetCompatibleType(), but with all the device types from GetDeviceTypes() instead of
+	// only the first one.
+	expected::ExpectedStringVector GetCompatibleTypes(const string &payload_type = "");
 	// Stores new artifact data, taking existing provides, and clears_provides, into account.
 	error::Error CommitArtifactData(
 		string artifact_name,
@@ -97,6 +111,12 @@ public:
 	}
 
 	expected::ExpectedBool MatchesArtifactDepends(const artifact::HeaderView &hdr_view);
+	// The depends of the Artifact which this device doesn't meet, one message for each. Empty if
+	// it meets them all.
+	expected::ExpectedStringVector UnmetArtifactDepends(const artifact::HeaderView &hdr_view);
+	// NoError if this device meets all the depends of the Artifact, otherwise an
+	// ArtifactDependsNotSatisfiedError listing the ones it doesn't meet.
+	error::Error CheckArtifactDepends(const artifact::HeaderView &hdr_view);
 
 	// Suffix used for updates that either can't roll back or fail their rollback.
 	static const string broken_artifact_name_suffix;
@@ -142,6 +162,10 @@ public:
 	// original schema again.
 	static const string state_data_key_uncommitted;
 
+	// The inventory which the server has last accepted, with `InventorySubmission.ChangesOnly`.
+	// JSON, with the attributes in the same format as they are submitted.
+	static const string submitted_inventory_key;
+
 	// ---------------------- NOT IN USE ANYMORE --------------------------
 	// Key used to store the auth token.
 	static const string auth_token_name;
@@ -156,19 +180,71 @@ public:
 	static const int standalone_data_version;
 
 private:
+	error::Error OpenEncryptedStore();
+	kv_db::KeyValueDatabase &Store();
+
 #ifdef MENDER_USE_LMDB
 	kv_db::KeyValueDatabaseLmdb mender_store_;
 #else
 	kv_db::KeyValueDatabaseBlobdb mender_store_;
 #endif // MENDER_USE_LMDB
+	// Wraps `mender_store_` with StoreEncryption, see Documentation/store-encryption.md.
+	unique_ptr<kv_db::KeyValueDatabaseEncrypted> encrypted_store_;
 	conf::MenderConfig &config_;
 };
 
-// Only here to make testing easier, use MenderContext::MatchesArtifactDepends().
+// Only here to make testing easier, use MenderContext::MatchesArtifactDepends(). The Artifact
+// matches if it is compatible with any of `compatible_types`.
 expected::ExpectedBool ArtifactMatchesContext(
 	const ProvidesData &provides,
 	const string &compatible_type,
 	const artifact::HeaderView &hdr_view);
+expected::ExpectedBool ArtifactMatchesContext(
+	const ProvidesData &provides,
+	const vector<string> &compatible_types,
+	const artifact::HeaderView &hdr_view);
+// Likewise, use MenderContext::UnmetArtifactDepends().
+expected::ExpectedStringVector ArtifactDependsNotMetByContext(
+	const ProvidesData &provides,
+	const string &compatible_type,
+	const artifact::HeaderView &hdr_view);
+expected::ExpectedStringVector ArtifactDependsNotMetByContext(
+	const ProvidesData &provides,
+	const vector<string> &compatible_types,
+	const artifact::HeaderView &hdr_view);
+// The ArtifactDependsNotSatisfiedError for the messages from ArtifactDependsNotMetByContext().
+error::Error MakeArtifactDependsError(const vector<string> &unmet);
+
+// When an Artifact may be installed, from `not-before` and `not-after` in its meta-data, see
+// Documentation/artifact-eligibility-window.md. Unset if not limited.
+struct EligibilityWindow {
+	optional<chrono::system_clock::time_point> not_before;
+	optional<chrono::system_clock::time_point> not_after;
+};
+using ExpectedEligibilityWindow = expected::expected<EligibilityWindow, error::Error>;
+
+// The times are RFC 3339 timestamps, such as `2026-11-01T00:00:00Z`, or seconds since the epoch.
+ExpectedEligibilityWindow ArtifactEligibilityWindow(const artifact::HeaderView &hdr_view);
+// In UTC, as an RFC 3339 timestamp.
+string FormatEligibilityTime(chrono::system_clock::time_point time);
+// An RFC 3339 timestamp, such as `2026-11-01T00:00:00Z`, with any fractions of a second left out.
+// Nothing if it isn't one.
+optional<chrono::system_clock::time_point> ParseRfc3339Time(const string &str);
+
+struct PayloadFile {
+	string name;
+	int64_t size;
+};
+using ExpectedPayloadFiles = expected::expected<vector<PayloadFile>, error::Error>;
+
+// Reads the payloads of the Artifact to their end without storing them, so that the checksums of
+// their files are checked, and through them the signature of the Artifact. The header must have
+// been read already, and nothing is left to read afterwards.
+ExpectedPayloadFiles ReadPayloads(artifact::Artifact &artifact);
+
+// Decrypts the payloads of encrypted Artifacts with the keys in `artifact_decryption_keys`.
+// Nothing if there are none.
+artifact::decryption::ProviderPtr ArtifactDecryptionProvider(const conf::MenderConfig &config);
 
 error::Error FilterProvides(
 	const ProvidesData &new_provides,
@@ -15,8 +15,12 @@
 #include <mender-update/context.hpp>
 
 #include <cctype>
+#include <cerrno>
+#include <cstring>
+#include <ctime>
 
 #include <algorithm>
+#include <iterator>
 #include <set>
 
 #include <artifact/artifact.hpp>
@@ -29,6 +33,7 @@
 #include <common/key_value_database.hpp>
 #include <common/log.hpp>
 #include <common/path.hpp>
+#include <common/processes.hpp>
 
 #ifdef MENDER_USE_YAML_CPP
 #include <common/yaml.hpp>
@@ -40,6 +45,7 @@ namespace context {
 
 using namespace std;
 namespace artifact = mender::artifact;
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace common = mender::common;
 namespace error = mender::common::error;
 namespace expected = mender::common::expected;
@@ -48,6 +54,7 @@ namespace json = mender::common::json;
 namespace kv_db = mender::common::key_value_database;
 namespace log = mender::common::log;
 namespace path = mender::common::path;
+namespace procs = mender::common::processes;
 namespace device_tier = mender::common::device_tier;
 
 #ifdef MENDER_USE_YAML_CPP
@@ -63,6 +70,7 @@ const string MenderContext::artifact_provides_key {"artifact-provides"};
 const string MenderContext::standalone_state_key {"standalone-state"};
 const string MenderContext::state_data_key {"state"};
 const string MenderContext::state_data_key_uncommitted {"state-uncommitted"};
+const string MenderContext::submitted_inventory_key {"submitted-inventory"};
 const string MenderContext::update_control_maps {"update-control-maps"};
 const string MenderContext::auth_token_name {"authtoken"};
 const string MenderContext::auth_token_cache_invalidator_name {"auth-token-cache-invalidator"};
@@ -97,6 +105,12 @@ string MenderContextErrorCategoryClass::message(int code) const {
 		return "State data store count exceeded";
 	case WrongOperationError:
 		return "Operation cannot be done in this state";
+	case WorkDirQuotaExceededError:
+		return "Update Module work directory quota exceeded";
+	case ArtifactDependsNotSatisfiedError:
+		return "Artifact depends not satisfied";
+	case NoUpdateAvailableError:
+		return "No update available";
 	}
 	assert(false);
 	return "Unknown";
@@ -111,13 +125,19 @@ error::Error MenderContext::Initialize() {
 	if (error::NoError != err) {
 		return err;
 	}
-	err = mender_store_.Remove(auth_token_name);
+	if (config_.store_encryption.Enabled()) {
+		err = OpenEncryptedStore();
+		if (error::NoError != err) {
+			return err;
+		}
+	}
+	err = Store().Remove(auth_token_name);
 	if (error::NoError != err) {
 		// key not existing in the DB is not treated as an error so this must be
 		// a real error
 		return err;
 	}
-	err = mender_store_.Remove(auth_token_cache_invalidator_name);
+	err = Store().Remove(auth_token_cache_invalidator_name);
 	if (error::NoError != err) {
 		// same as above -- a real error
 		return err;
@@ -126,13 +146,82 @@ error::Error MenderContext::Initialize() {
 	return error::NoError;
 }
 
-kv_db::KeyValueDatabase &MenderContext::GetMenderStoreDB() {
+static expected::ExpectedBytes LoadStoreEncryptionSecret(
+	const cfg_parser::StoreEncryption &config) {
+	if (config.key_file != "") {
+		auto exp_is = io::OpenIfstream(config.key_file);
+		if (!exp_is) {
+			return expected::unexpected(exp_is.error());
+		}
+		auto &is = exp_is.value();
+		vector<uint8_t> secret((istreambuf_iterator<char>(is)), istreambuf_iterator<char>());
+		if (is.bad()) {
+			return expected::unexpected(error::Error(
+				generic_category().default_error_condition(errno),
+				"Could not read " + config.key_file));
+		}
+		return secret;
+	}
+
+	string secret;
+	procs::Process proc({"tpm2_unseal", "-c", config.tpm_sealed_object});
+	auto err = proc.Start(
+		[&secret](const char *data, size_t size) { secret.append(data, size); },
+		procs::OutputHandler {"tpm2_unseal: "});
+	if (err == error::NoError) {
+		err = proc.Wait();
+	}
+	if (err != error::NoError) {
+		return expected::unexpected(
+			err.WithContext("Could not unseal " + config.tpm_sealed_object + " from the TPM"));
+	}
+	return common::ByteVectorFromString(secret);
+}
+
+error::Error MenderContext::OpenEncryptedStore() {
+	auto exp_secret = LoadStoreEncryptionSecret(config_.store_encryption);
+	if (!exp_secret) {
+		return exp_secret.error().WithContext("Could not load the StoreEncryption secret");
+	}
+
+	// Every key which may have been stored in cleartext, including the ones not in use anymore,
+	// so that nothing is left behind unencrypted.
+	const vector<string> keys {
+		artifact_name_key,
+		artifact_group_key,
+		artifact_provides_key,
+		standalone_state_key,
+		state_data_key,
+		state_data_key_uncommitted,
+		submitted_inventory_key,
+		auth_token_name,
+		auth_token_cache_invalidator_name,
+		update_control_maps,
+	};
+	encrypted_store_.reset(new kv_db::KeyValueDatabaseEncrypted(mender_store_));
+	auto err = encrypted_store_->Open(exp_secret.value(), keys);
+	fill(exp_secret.value().begin(), exp_secret.value().end(), 0);
+	if (err != error::NoError) {
+		encrypted_store_.reset();
+		return err;
+	}
+	return error::NoError;
+}
+
+kv_db::KeyValueDatabase &MenderContext::Store() {
+	if (encrypted_store_) {
+		return *encrypted_store_;
+	}
 	return mender_store_;
 }
 
+kv_db::KeyValueDatabase &MenderContext::GetMenderStoreDB() {
+	return Store();
+}
+
 ExpectedProvidesData MenderContext::LoadProvides() {
 	ExpectedProvidesData data;
-	auto err = mender_store_.ReadTransaction([this, &data](kv_db::Transaction &txn) {
+	auto err = Store().ReadTransaction([this, &data](kv_db::Transaction &txn) {
 		data = LoadProvides(txn);
 		if (!data) {
 			return data.error();
@@ -233,6 +322,14 @@ expected::ExpectedString MenderContext::GetSystemType() {
 #endif // MENDER_USE_YAML_CPP
 
 expected::ExpectedString MenderContext::GetDeviceType() {
+	auto ex_device_types = GetDeviceTypes();
+	if (!ex_device_types) {
+		return expected::unexpected(ex_device_types.error());
+	}
+	return ex_device_types.value().front();
+}
+
+expected::ExpectedStringVector MenderContext::GetDeviceTypes() {
 	string device_type_fpath;
 	if (config_.device_type_file != "") {
 		device_type_fpath = config_.device_type_file;
@@ -241,39 +338,46 @@ expected::ExpectedString MenderContext::GetDeviceType() {
 	}
 	auto ex_is = io::OpenIfstream(device_type_fpath);
 	if (!ex_is) {
-		return expected::ExpectedString(expected::unexpected(ex_is.error()));
+		return expected::unexpected(ex_is.error());
 	}
 
 	auto &is = ex_is.value();
+	const string key {"device_type="};
+	vector<string> device_types;
+	bool blank_line = false;
 	string line;
-	errno = 0;
-	getline(is, line);
-	if (is.bad()) {
-		int io_errno = errno;
-		error::Error err {
-			generic_category().default_error_condition(io_errno),
-			"Failed to read device type from '" + device_type_fpath + "'"};
-		return expected::ExpectedString(expected::unexpected(err));
-	}
-
-	const string::size_type eq_pos = 12;
-	if (line.substr(0, eq_pos) != "device_type=") {
-		auto err = MakeError(ParseError, "Failed to parse device_type data '" + line + "'");
-		return expected::ExpectedString(expected::unexpected(err));
-	}
-
-	string ret = line.substr(eq_pos, string::npos);
-
-	if (!is.eof()) {
+	while (true) {
 		errno = 0;
 		getline(is, line);
-		if ((line != "") || (!is.eof())) {
-			auto err = MakeError(ValueError, "Trailing device_type data");
-			return expected::ExpectedString(expected::unexpected(err));
+		if (is.bad()) {
+			int io_errno = errno;
+			return expected::unexpected(error::Error(
+				generic_category().default_error_condition(io_errno),
+				"Failed to read device type from '" + device_type_fpath + "'"));
+		}
+		if (is.fail() && device_types.size() > 0) {
+			break;
+		}
+
+		if (device_types.empty() && line.substr(0, key.size()) != key) {
+			return expected::unexpected(
+				MakeError(ParseError, "Failed to parse device_type data '" + line + "'"));
+		}
+		if (line == "") {
+			blank_line = true;
+		} else if (blank_line || line.substr(0, key.size()) != key) {
+			// Only more device types may follow the first one.
+			return expected::unexpected(MakeError(ValueError, "Trailing device_type data"));
+		} else if (!common::VectorContainsString(device_types, line.substr(key.size()))) {
+			device_types.push_back(line.substr(key.size()));
+		}
+
+		if (is.eof()) {
+			break;
 		}
 	}
 
-	return expected::ExpectedString(ret);
+	return device_types;
 }
 
 // This function determines whether we return the system_type from the topology
@@ -303,6 +407,19 @@ expected::ExpectedString MenderContext::GetCompatibleType(const string &payload_
 	return GetDeviceType();
 }
 
+expected::ExpectedStringVector MenderContext::GetCompatibleTypes(const string &payload_type) {
+	if (config_.device_tier == device_tier::kSystem) {
+		auto ex_compatible_type = GetCompatibleType(payload_type);
+		if (!ex_compatible_type) {
+			return expected::unexpected(ex_compatible_type.error());
+		}
+		if (payload_type == "" || payload_type == orchestrator_manifest_payload_type) {
+			return vector<string> {ex_compatible_type.value()};
+		}
+	}
+	return GetDeviceTypes();
+}
+
 bool CheckClearsMatch(const string &to_match, const string &clears_string) {
 	if (clears_string.empty()) {
 		return to_match.empty();
@@ -379,7 +496,7 @@ error::Error MenderContext::CommitArtifactData(
 	const optional<ProvidesData> &new_provides,
 	const optional<ClearsProvidesData> &clears_provides,
 	function<error::Error(kv_db::Transaction &)> txn_func) {
-	return mender_store_.WriteTransaction([&](kv_db::Transaction &txn) {
+	return Store().WriteTransaction([&](kv_db::Transaction &txn) {
 		auto exp_existing = LoadProvides(txn);
 		if (!exp_existing) {
 			return exp_existing.error();
@@ -468,35 +585,102 @@ error::Error MenderContext::CommitArtifactData(
 }
 
 expected::ExpectedBool MenderContext::MatchesArtifactDepends(const artifact::HeaderView &hdr_view) {
-	auto ex_compatible_type = GetCompatibleType(hdr_view.type_info.type);
-	if (!ex_compatible_type) {
-		return expected::unexpected(ex_compatible_type.error());
+	auto ex_compatible_types = GetCompatibleTypes(hdr_view.type_info.type);
+	if (!ex_compatible_types) {
+		return expected::unexpected(ex_compatible_types.error());
 	}
-	auto &compatible_type = ex_compatible_type.value();
+	auto &compatible_types = ex_compatible_types.value();
 
 	auto ex_provides = LoadProvides();
 	if (!ex_provides) {
 		return expected::unexpected(ex_provides.error());
 	}
 	auto &provides = ex_provides.value();
-	return ArtifactMatchesContext(provides, compatible_type, hdr_view);
+	return ArtifactMatchesContext(provides, compatible_types, hdr_view);
+}
+
+expected::ExpectedStringVector MenderContext::UnmetArtifactDepends(
+	const artifact::HeaderView &hdr_view) {
+	auto ex_compatible_types = GetCompatibleTypes(hdr_view.type_info.type);
+	if (!ex_compatible_types) {
+		return expected::unexpected(ex_compatible_types.error());
+	}
+
+	auto ex_provides = LoadProvides();
+	if (!ex_provides) {
+		return expected::unexpected(ex_provides.error());
+	}
+	return ArtifactDependsNotMetByContext(
+		ex_provides.value(), ex_compatible_types.value(), hdr_view);
+}
+
+error::Error MenderContext::CheckArtifactDepends(const artifact::HeaderView &hdr_view) {
+	auto ex_unmet = UnmetArtifactDepends(hdr_view);
+	if (!ex_unmet) {
+		return ex_unmet.error();
+	}
+	if (ex_unmet.value().empty()) {
+		return error::NoError;
+	}
+	return MakeArtifactDependsError(ex_unmet.value());
+}
+
+expected::ExpectedBool ArtifactMatchesContext(
+	const ProvidesData &provides,
+	const string &compatible_type,
+	const artifact::HeaderView &hdr_view) {
+	return ArtifactMatchesContext(provides, vector<string> {compatible_type}, hdr_view);
 }
 
 expected::ExpectedBool ArtifactMatchesContext(
+	const ProvidesData &provides,
+	const vector<string> &compatible_types,
+	const artifact::HeaderView &hdr_view) {
+	auto ex_unmet = ArtifactDependsNotMetByContext(provides, compatible_types, hdr_view);
+	if (!ex_unmet) {
+		return expected::unexpected(ex_unmet.error());
+	}
+	for (const auto &unmet : ex_unmet.value()) {
+		log::Error(unmet);
+	}
+	return ex_unmet.value().empty();
+}
+
+expected::ExpectedStringVector ArtifactDependsNotMetByContext(
 	const ProvidesData &provides,
 	const string &compatible_type,
 	const artifact::HeaderView &hdr_view) {
+	return ArtifactDependsNotMetByContext(provides, vector<string> {compatible_type}, hdr_view);
+}
+
+expected::ExpectedStringVector ArtifactDependsNotMetByContext(
+	const ProvidesData &provides,
+	const vector<string> &compatible_types,
+	const artifact::HeaderView &hdr_view) {
 	using common::MapContainsStringKey;
 	if (!MapContainsStringKey(provides, "artifact_name")) {
 		return expected::unexpected(
 			MakeError(ValueError, "Missing artifact_name value in provides"));
 	}
 
+	vector<string> unmet;
+
 	auto hdr_depends = hdr_view.GetDepends();
 	AssertOrReturnUnexpected(hdr_depends["device_type"].size() > 0);
-	if (!common::VectorContainsString(hdr_depends["device_type"], compatible_type)) {
-		log::Error("Artifact device type doesn't match");
-		return false;
+	const auto &depends_types = hdr_depends["device_type"];
+	if (none_of(compatible_types.begin(), compatible_types.end(), [&](const string &type) {
+			return common::VectorContainsString(depends_types, type);
+		})) {
+		if (compatible_types.size() == 1) {
+			unmet.push_back(
+				"Artifact device type doesn't match: '" + compatible_types[0] + "' is not one of ("
+				+ common::StringVectorToString(depends_types) + ")");
+		} else {
+			unmet.push_back(
+				"Artifact device type doesn't match: none of "
+				+ common::StringVectorToString(compatible_types) + " is one of ("
+				+ common::StringVectorToString(depends_types) + ")");
+		}
 	}
 	hdr_depends.erase("device_type");
 
@@ -510,19 +694,177 @@ expected::ExpectedBool ArtifactMatchesContext(
 
 	for (auto it : hdr_depends) {
 		if (!common::MapContainsStringKey(provides, it.first)) {
-			log::Error("Missing '" + it.first + "' in provides, required by artifact depends");
-			return false;
-		}
-		if (!common::VectorContainsString(hdr_depends[it.first], provides.at(it.first))) {
-			log::Error(
+			unmet.push_back("Missing '" + it.first + "' in provides, required by artifact depends");
+		} else if (!common::VectorContainsString(hdr_depends[it.first], provides.at(it.first))) {
+			unmet.push_back(
 				"Provides value '" + provides.at(it.first) + "' doesn't match any of the '"
 				+ it.first + "' artifact depends ("
 				+ common::StringVectorToString(hdr_depends[it.first]) + ")");
-			return false;
 		}
 	}
 
-	return true;
+	return unmet;
+}
+
+error::Error MakeArtifactDependsError(const vector<string> &unmet) {
+	return MakeError(ArtifactDependsNotSatisfiedError, common::JoinStrings(unmet, "; "));
+}
+
+// -1 if not two digits.
+static int TwoDigits(const char *str) {
+	if (!isdigit(static_cast<unsigned char>(str[0]))
+		|| !isdigit(static_cast<unsigned char>(str[1]))) {
+		return -1;
+	}
+	return (str[0] - '0') * 10 + (str[1] - '0');
+}
+
+optional<chrono::system_clock::time_point> ParseRfc3339Time(const string &str) {
+	struct tm tm_struct = {};
+	const char *rest = strptime(str.c_str(), "%Y-%m-%dT%H:%M:%S", &tm_struct);
+	if (rest == nullptr) {
+		return nullopt;
+	}
+	// Fractions of a second don't matter here.
+	if (*rest == '.') {
+		rest++;
+		if (!isdigit(static_cast<unsigned char>(*rest))) {
+			return nullopt;
+		}
+		while (isdigit(static_cast<unsigned char>(*rest))) {
+			rest++;
+		}
+	}
+
+	time_t offset {0};
+	if (*rest == 'Z' || *rest == 'z') {
+		rest++;
+	} else if ((*rest == '+' || *rest == '-') && strlen(rest) == 6 && rest[3] == ':') {
+		int hours = TwoDigits(rest + 1);
+		int minutes = TwoDigits(rest + 4);
+		if (hours < 0 || minutes < 0) {
+			return nullopt;
+		}
+		offset = (hours * 60 + minutes) * 60;
+		if (*rest == '-') {
+			offset = -offset;
+		}
+		rest += 6;
+	} else {
+		return nullopt;
+	}
+	if (*rest != '\0') {
+		return nullopt;
+	}
+
+	return chrono::system_clock::from_time_t(timegm(&tm_struct) - offset);
+}
+
+static expected::expected<chrono::system_clock::time_point, error::Error> EligibilityTimeFromJson(
+	const string &key, const json::Json &value) {
+	if (value.IsInt64()) {
+		return chrono::system_clock::from_time_t(value.GetInt64().value());
+	}
+	if (!value.IsString()) {
+		return expected::unexpected(MakeError(
+			ValueError, "'" + key + "' in the Artifact meta-data must be a timestamp or a number"));
+	}
+
+	auto str = value.GetString().value();
+	auto time = ParseRfc3339Time(str);
+	if (!time) {
+		return expected::unexpected(MakeError(
+			ValueError,
+			"Invalid '" + key + "' in the Artifact meta-data: '" + str
+				+ "', expected an RFC 3339 timestamp, such as 2026-11-01T00:00:00Z"));
+	}
+	return time.value();
+}
+
+ExpectedEligibilityWindow ArtifactEligibilityWindow(const artifact::HeaderView &hdr_view) {
+	EligibilityWindow window;
+	if (!hdr_view.meta_data.IsObject()) {
+		return window;
+	}
+
+	for (const auto &key : {"not-before", "not-after"}) {
+		auto exp_value = hdr_view.meta_data.Get(key);
+		if (!exp_value || exp_value.value().IsNull()) {
+			continue;
+		}
+		auto exp_time = EligibilityTimeFromJson(key, exp_value.value());
+		if (!exp_time) {
+			return expected::unexpected(exp_time.error());
+		}
+		if (string(key) == "not-before") {
+			window.not_before = exp_time.value();
+		} else {
+			window.not_after = exp_time.value();
+		}
+	}
+
+	if (window.not_before && window.not_after
+		&& window.not_after.value() < window.not_before.value()) {
+		return expected::unexpected(MakeError(
+			ValueError,
+			"'not-after' (" + FormatEligibilityTime(window.not_after.value())
+				+ ") is before 'not-before' (" + FormatEligibilityTime(window.not_before.value())
+				+ ") in the Artifact meta-data"));
+	}
+
+	return window;
+}
+
+string FormatEligibilityTime(chrono::system_clock::time_point time) {
+	time_t time_t_value = chrono::system_clock::to_time_t(time);
+	struct tm tm_struct = {};
+	gmtime_r(&time_t_value, &tm_struct);
+	char buf[32];
+	strftime(buf, sizeof(buf), "%Y-%m-%dT%H:%M:%SZ", &tm_struct);
+	return buf;
+}
+
+ExpectedPayloadFiles ReadPayloads(artifact::Artifact &artifact) {
+	vector<PayloadFile> files;
+	while (true) {
+		auto exp_payload = artifact.Next();
+		if (!exp_payload) {
+			if (exp_payload.error().code
+				== artifact::parser_error::MakeError(artifact::parser_error::EOFError, "").code) {
+				return files;
+			}
+			return expected::unexpected(exp_payload.error());
+		}
+		auto &payload = exp_payload.value();
+
+		while (true) {
+			auto exp_file = payload.Next();
+			if (!exp_file) {
+				if (exp_file.error().code
+					== artifact::parser_error::MakeError(
+						   artifact::parser_error::NoMorePayloadFilesError, "")
+						   .code) {
+					break;
+				}
+				return expected::unexpected(exp_file.error());
+			}
+			auto &file = exp_file.value();
+
+			io::Discard discard;
+			auto err = io::Copy(discard, file);
+			if (err != error::NoError) {
+				return expected::unexpected(err.WithContext("While reading " + file.Name()));
+			}
+			files.push_back({file.Name(), file.Size()});
+		}
+	}
+}
+
+artifact::decryption::ProviderPtr ArtifactDecryptionProvider(const conf::MenderConfig &config) {
+	if (config.artifact_decryption_keys.empty()) {
+		return nullptr;
+	}
+	return make_shared<artifact::decryption::FileKeyProvider>(config.artifact_decryption_keys);
 }
 
 } // namespace context
@@ -0,0 +1,42 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_ARTIFACT_INSPECTION_HPP
+#define MENDER_UPDATE_DAEMON_ARTIFACT_INSPECTION_HPP
+
+#include <string>
+
+#include <common/expected.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace expected = mender::common::expected;
+
+// Describes the Artifact at `artifact_path`, which must be absolute, as one JSON object with its
+// names, provides, depends, meta-data, state scripts and payload files, see
+// Documentation/artifact-inspection.md. Only the header and the tar entries of the payload are
+// read, so the signature and the checksums of the payload are not verified. The state scripts
+// are extracted to `scripts_path` while parsing, and removed again.
+expected::ExpectedString InspectArtifact(const string &artifact_path, const string &scripts_path);
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_ARTIFACT_INSPECTION_HPP
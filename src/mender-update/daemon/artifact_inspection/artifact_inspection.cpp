@@ -0,0 +1,169 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/artifact_inspection.hpp>
+
+#include <artifact/artifact.hpp>
+#include <artifact/error.hpp>
+#include <common/error.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace artifact = mender::artifact;
+namespace error = mender::common::error;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+namespace parser_error = mender::artifact::parser_error;
+
+static string JsonString(const string &str) {
+	return "\"" + json::EscapeString(str) + "\"";
+}
+
+static string JsonStringArray(const vector<string> &strs) {
+	string result {"["};
+	string separator;
+	for (const auto &str : strs) {
+		result += separator + JsonString(str);
+		separator = ",";
+	}
+	return result + "]";
+}
+
+// The files of the first payload, with their sizes from the tar entries.
+static expected::ExpectedString PayloadFilesJson(artifact::Artifact &parsed) {
+	auto exp_payload = parsed.Next();
+	if (!exp_payload) {
+		return expected::unexpected(exp_payload.error());
+	}
+	auto &payload = exp_payload.value();
+
+	string result {"["};
+	string separator;
+	while (true) {
+		auto exp_file = payload.Next();
+		if (!exp_file) {
+			if (exp_file.error().code
+				== parser_error::MakeError(parser_error::NoMorePayloadFilesError, "").code) {
+				break;
+			}
+			return expected::unexpected(exp_file.error());
+		}
+		auto &file = exp_file.value();
+		result += separator + R"({"name":)" + JsonString(file.Name())
+				  + R"(,"size":)" + to_string(file.Size()) + "}";
+		separator = ",";
+	}
+	return result + "]";
+}
+
+expected::ExpectedString InspectArtifact(const string &artifact_path, const string &scripts_path) {
+	if (!path::IsAbsolute(artifact_path)) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"The path of the Artifact must be absolute: '" + artifact_path + "'"));
+	}
+	auto exp_is = io::OpenIfstream(artifact_path);
+	if (!exp_is) {
+		return expected::unexpected(exp_is.error());
+	}
+	io::StreamReader reader {exp_is.value()};
+
+	auto delete_scripts = [&scripts_path]() {
+		auto err = path::DeleteRecursively(scripts_path);
+		if (err != error::NoError) {
+			log::Warning("Could not clean up the inspected state scripts: " + err.String());
+		}
+	};
+
+	artifact::config::ParserConfig config {
+		.artifact_scripts_filesystem_path = scripts_path,
+		.artifact_scripts_version = 3,
+		.artifact_verify_keys = {},
+		.verify_signature = artifact::config::Signature::Skip,
+	};
+	auto exp_parsed = artifact::Parse(reader, config);
+	delete_scripts();
+	if (!exp_parsed) {
+		return expected::unexpected(exp_parsed.error());
+	}
+	auto &parsed = exp_parsed.value();
+
+	auto exp_view = artifact::View(parsed, 0);
+	if (!exp_view) {
+		return expected::unexpected(exp_view.error());
+	}
+	const auto &header = exp_view.value().header;
+
+	auto exp_provides = json::Dump(header.GetProvides());
+	if (!exp_provides) {
+		return expected::unexpected(exp_provides.error());
+	}
+	auto exp_depends = json::Dump(header.GetDepends());
+	if (!exp_depends) {
+		return expected::unexpected(exp_depends.error());
+	}
+
+	vector<string> scripts;
+	if (parsed.header.artifactScripts) {
+		for (const auto &script : parsed.header.artifactScripts.value()) {
+			scripts.push_back(path::BaseName(script));
+		}
+	}
+
+	string result = R"({"artifact_name":)" + JsonString(header.artifact_name)
+					+ R"(,"artifact_group":)" + JsonString(header.artifact_group)
+					+ R"(,"format_version":)" + to_string(parsed.version.version)
+					+ R"(,"signed":)" + (parsed.manifest_signature ? "true" : "false")
+					+ R"(,"payload_type":)" + JsonString(header.payload_type)
+					+ R"(,"provides":)" + exp_provides.value() + R"(,"depends":)"
+					+ exp_depends.value();
+	if (header.type_info.clears_artifact_provides) {
+		result += R"(,"clears_provides":)"
+				  + JsonStringArray(header.type_info.clears_artifact_provides.value());
+	}
+	result += R"(,"scripts":)" + JsonStringArray(scripts);
+	if (header.meta_data.IsObject()) {
+		result += R"(,"meta_data":)" + header.meta_data.Dump(-1);
+	}
+
+	if (header.payload_type != "") {
+		auto exp_files = PayloadFilesJson(parsed);
+		if (!exp_files) {
+			return expected::unexpected(exp_files.error());
+		}
+		result += R"(,"files":)" + exp_files.value();
+	}
+
+	// The same as taken by EvaluateArtifactCompatibility.
+	result += R"(,"header":{"header-info":)" + header.header_info.verbatim.Dump(-1)
+			  + R"(,"type-info":)" + header.type_info.verbatim.Dump(-1);
+	if (header.meta_data.IsObject()) {
+		result += R"(,"meta-data":)" + header.meta_data.Dump(-1);
+	}
+	return result + "}}";
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,79 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_ARTIFACT_TWIN_HPP
+#define MENDER_UPDATE_DAEMON_ARTIFACT_TWIN_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/optional.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+// In the data store.
+const string kDesiredArtifactFile {"desired-artifact"};
+
+struct DesiredArtifact {
+	string artifact_name;
+	string deployment_id;
+	// In seconds since the epoch.
+	int64_t since {0};
+};
+using ExpectedOptionalDesiredArtifact =
+	expected::expected<optional<DesiredArtifact>, error::Error>;
+
+// The Artifact which the server wants on the device, from its latest deployment, next to the one
+// which is installed, so that devices which are out of sync with the fleet can be found. See
+// Documentation/artifact-twin.md. Kept in a file of its own, which the inventory script reads.
+class ArtifactTwin {
+public:
+	using Clock = chrono::system_clock;
+
+	ArtifactTwin(const string &path);
+
+	// Replaces the desired Artifact with the one of a new deployment.
+	error::Error SetDesired(
+		const string &deployment_id,
+		const string &artifact_name,
+		Clock::time_point now = Clock::now());
+	// Nothing if the device never had a deployment.
+	ExpectedOptionalDesiredArtifact Desired() const;
+
+	// Whether another Artifact than the desired one is installed. Never, if nothing is desired.
+	static bool Drift(const optional<DesiredArtifact> &desired, const string &actual);
+
+	// Both Artifacts and the drift as a JSON object, given the name of the installed Artifact.
+	string ToJson(const string &actual) const;
+
+private:
+	string path_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_ARTIFACT_TWIN_HPP
@@ -0,0 +1,111 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/artifact_twin.hpp>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+static string DesiredToJson(const DesiredArtifact &desired) {
+	return R"({"artifact_name":")" + json::EscapeString(desired.artifact_name)
+		   + R"(","deployment_id":")" + json::EscapeString(desired.deployment_id)
+		   + R"(","since":)" + to_string(desired.since) + "}";
+}
+
+ArtifactTwin::ArtifactTwin(const string &path) :
+	path_ {path} {
+}
+
+error::Error ArtifactTwin::SetDesired(
+	const string &deployment_id, const string &artifact_name, Clock::time_point now) {
+	DesiredArtifact desired;
+	desired.artifact_name = artifact_name;
+	desired.deployment_id = deployment_id;
+	desired.since = chrono::duration_cast<chrono::seconds>(now.time_since_epoch()).count();
+
+	// Replaced in one go, so that the inventory script never sees a partial file.
+	const string tmp_path = path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), DesiredToJson(desired) + "\n");
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, path_);
+}
+
+ExpectedOptionalDesiredArtifact ArtifactTwin::Desired() const {
+	if (!path::FileExists(path_)) {
+		return optional<DesiredArtifact> {};
+	}
+
+	auto exp_json = json::LoadFromFile(path_);
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+	const auto &desired_json = exp_json.value();
+
+	auto exp_name = desired_json.Get("artifact_name").and_then(json::ToString);
+	auto exp_id = desired_json.Get("deployment_id").and_then(json::ToString);
+	auto exp_since = desired_json.Get("since").and_then(json::ToInt64);
+	if (!exp_name || !exp_id || !exp_since) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"Invalid " + path_ + ": expected artifact_name, deployment_id and since"));
+	}
+
+	DesiredArtifact desired;
+	desired.artifact_name = exp_name.value();
+	desired.deployment_id = exp_id.value();
+	desired.since = exp_since.value();
+	return optional<DesiredArtifact> {desired};
+}
+
+bool ArtifactTwin::Drift(const optional<DesiredArtifact> &desired, const string &actual) {
+	return desired && desired.value().artifact_name != actual;
+}
+
+string ArtifactTwin::ToJson(const string &actual) const {
+	optional<DesiredArtifact> desired;
+	auto exp_desired = Desired();
+	if (exp_desired) {
+		desired = exp_desired.value();
+	} else {
+		log::Warning("Could not load the desired Artifact: " + exp_desired.error().String());
+	}
+
+	return R"({"desired":)" + (desired ? DesiredToJson(desired.value()) : "null")
+		   + R"(,"actual":")" + json::EscapeString(actual) + R"(","drift":)"
+		   + (Drift(desired, actual) ? "true" : "false") + "}";
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
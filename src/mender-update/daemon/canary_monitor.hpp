@@ -0,0 +1,79 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_CANARY_MONITOR_HPP
+#define MENDER_UPDATE_DAEMON_CANARY_MONITOR_HPP
+
+#include <chrono>
+#include <functional>
+#include <memory>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/processes.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace procs = mender::common::processes;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// Runs the health checks of CanaryMode over and over during the observation window, see
+// Documentation/canary-mode.md.
+class CanaryMonitor {
+public:
+	using HandlerFunction = function<void(error::Error)>;
+
+	CanaryMonitor(events::EventLoop &loop, const cfg_parser::CanaryMode &config);
+
+	bool Enabled() const {
+		return config_.Enabled();
+	}
+
+	// Runs the health checks right away, every interval, and once more at the end of the window.
+	// The handler receives no error if they all passed every time, or an error as soon as one of
+	// them fails. The handler is always called asynchronously.
+	void AsyncObserve(HandlerFunction handler);
+	// The same, for a window of the given length rather than the configured one.
+	void AsyncObserve(chrono::seconds window, HandlerFunction handler);
+
+private:
+	void RunRound();
+	void RunNextCheck();
+	void Finish(error::Error err);
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	cfg_parser::CanaryMode config_;
+
+	// The ongoing observation, if `handler_` is set.
+	chrono::steady_clock::time_point end_;
+	size_t next_check_ {0};
+	procs::ScriptRunner runner_ {"Health check output"};
+	HandlerFunction handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_CANARY_MONITOR_HPP
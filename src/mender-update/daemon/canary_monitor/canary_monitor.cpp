@@ -0,0 +1,105 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/canary_monitor.hpp>
+
+#include <algorithm>
+
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace log = mender::common::log;
+
+CanaryMonitor::CanaryMonitor(events::EventLoop &loop, const cfg_parser::CanaryMode &config) :
+	loop_ {loop},
+	timer_ {loop},
+	config_ {config} {
+}
+
+void CanaryMonitor::AsyncObserve(HandlerFunction handler) {
+	if (!Enabled()) {
+		loop_.Post([handler]() { handler(error::NoError); });
+		return;
+	}
+
+	log::Info(
+		"Observing the update for " + to_string(config_.window_seconds)
+		+ " seconds before committing it");
+	AsyncObserve(chrono::seconds {config_.window_seconds}, handler);
+}
+
+void CanaryMonitor::AsyncObserve(chrono::seconds window, HandlerFunction handler) {
+	end_ = chrono::steady_clock::now() + window;
+	handler_ = handler;
+	loop_.Post([this]() { RunRound(); });
+}
+
+void CanaryMonitor::RunRound() {
+	next_check_ = 0;
+	RunNextCheck();
+}
+
+void CanaryMonitor::RunNextCheck() {
+	if (next_check_ < config_.health_checks.size()) {
+		const string command = config_.health_checks[next_check_++];
+		log::Debug("Running health check `" + command + "`");
+
+		auto err = runner_.AsyncRun(
+			loop_,
+			{"/bin/sh", "-c", command},
+			chrono::seconds {config_.health_check_timeout_seconds},
+			[this, command](error::Error err, const string &first_line) {
+				if (err != error::NoError) {
+					Finish(err.WithContext("Health check `" + command + "` failed"));
+					return;
+				}
+				RunNextCheck();
+			});
+		if (err != error::NoError) {
+			Finish(err.WithContext("Could not run health check `" + command + "`"));
+		}
+		return;
+	}
+
+	auto now = chrono::steady_clock::now();
+	if (now >= end_) {
+		log::Info("The health checks passed during the whole observation window");
+		Finish(error::NoError);
+		return;
+	}
+
+	auto wait = min<chrono::steady_clock::duration>(
+		end_ - now, chrono::seconds {config_.interval_seconds});
+	timer_.AsyncWait(wait, [this](error::Error err) {
+		if (err != error::NoError || !handler_) {
+			return;
+		}
+		RunRound();
+	});
+}
+
+void CanaryMonitor::Finish(error::Error err) {
+	timer_.Cancel();
+	runner_.Cancel();
+	auto handler = handler_;
+	handler_ = nullptr;
+	handler(err);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
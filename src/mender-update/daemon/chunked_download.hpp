@@ -0,0 +1,213 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_CHUNKED_DOWNLOAD_HPP
+#define MENDER_UPDATE_DAEMON_CHUNKED_DOWNLOAD_HPP
+
+#include <cstdint>
+#include <fstream>
+#include <functional>
+#include <memory>
+#include <string>
+#include <unordered_map>
+#include <unordered_set>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+#include <common/http.hpp>
+#include <common/io.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+namespace http = mender::common::http;
+namespace io = mender::common::io;
+
+// Describes an Artifact as a list of fixed-size chunks, which are stored by their SHA256 checksum
+// in a chunk store. Only the last chunk may be shorter than `chunk_size`.
+struct ChunkIndex {
+	struct Chunk {
+		string sha256;
+		// See `RollingChecksum`. Used to find the chunk in the seeds.
+		uint32_t weak;
+	};
+
+	int64_t chunk_size;
+	int64_t size;
+	vector<Chunk> chunks;
+
+	int64_t ChunkSize(size_t index) const;
+};
+using ExpectedChunkIndex = expected::expected<ChunkIndex, error::Error>;
+
+// Chunks are kept in memory while they are passed on, so they can't be too big.
+const int64_t kMaxChunkSize = 16 * 1024 * 1024;
+
+ExpectedChunkIndex ParseChunkIndex(const string &data);
+
+// The inverse of ParseChunkIndex().
+string ChunkIndexToJson(const ChunkIndex &index);
+
+// The index of an Artifact is at `<store>/index/<device type>/<Artifact name>.json`, and each
+// chunk at `<store>/<first four characters of the checksum>/<checksum>.chunk`.
+string ChunkIndexURL(const string &store_url, const string &device_type, const string &name);
+string ChunkURL(const string &store_url, const string &sha256);
+
+// The rsync checksum, which can be moved forward one byte at a time, so that finding chunks at
+// any offset in a seed is cheap.
+class RollingChecksum {
+public:
+	void Reset(const uint8_t *data, size_t size);
+	void Roll(uint8_t out, uint8_t in);
+
+	uint32_t Value() const {
+		return (b_ << 16) | a_;
+	}
+
+private:
+	uint32_t a_ {0};
+	uint32_t b_ {0};
+	uint32_t size_ {0};
+};
+
+// Where `mender-update delta seed` stores the indexes of the seeds, in the data store, so that
+// they don't need to be scanned while downloading. Each one is named after its seed.
+const string kSeedIndexDir {"seed-indexes"};
+string SeedIndexPath(const string &dir, const string &seed);
+
+// Splits the seed into chunks of `chunk_size`, at multiples of it, as stored by `mender-update
+// delta seed`. Reads the whole seed.
+ExpectedChunkIndex ComputeSeedIndex(const string &seed, int64_t chunk_size);
+
+// Reassembles an Artifact from its chunks. Chunks which are found in one of the seeds, for
+// example in the currently running root filesystem, are read from there, the others are
+// downloaded. Every chunk is verified against its checksum before it is passed on. A seed which has
+// an index with the same chunk size in `seed_index_dir` isn't scanned, the chunks are looked up in
+// the index instead, which only finds them at multiples of the chunk size.
+class ChunkedDownloadReader : virtual public io::AsyncReader {
+public:
+	ChunkedDownloadReader(
+		events::EventLoop &loop,
+		const http::ClientConfig &config,
+		const string &store_url,
+		ChunkIndex index,
+		vector<string> seeds,
+		const string &seed_index_dir);
+	~ChunkedDownloadReader();
+
+	error::Error AsyncRead(
+		vector<uint8_t>::iterator start,
+		vector<uint8_t>::iterator end,
+		io::AsyncIoHandler handler) override;
+	void Cancel() override;
+
+private:
+	struct SeedLocation {
+		string seed;
+		int64_t offset;
+	};
+
+	void PostContinue();
+	void Continue();
+	bool ScanSeedStep();
+	bool RefillSeedBuffer();
+	bool MatchSeedWindow();
+	bool UseSeedIndex(const string &seed);
+	void NextSeed();
+	void FetchChunk();
+	void DownloadChunk();
+	void ChunkDownloadFailed(const error::Error &err);
+	error::Error VerifyChunk(const vector<uint8_t> &data);
+	void UseChunk(vector<uint8_t> data);
+	void CallHandler(io::ExpectedSize result);
+
+	events::EventLoop &loop_;
+	http::Client client_;
+	events::Timer retry_timer_;
+	string store_url_;
+	ChunkIndex index_;
+	int retry_count_;
+
+	vector<string> seeds_;
+	string seed_index_dir_;
+	bool seeds_scanned_ {false};
+	size_t seed_number_ {0};
+	unique_ptr<ifstream> seed_stream_;
+	bool seed_eof_ {false};
+	vector<uint8_t> seed_buffer_;
+	// Offset of `seed_buffer_` in the seed, and of the current window in `seed_buffer_`.
+	int64_t seed_buffer_offset_ {0};
+	size_t seed_window_ {0};
+	RollingChecksum checksum_;
+	bool checksum_valid_ {false};
+	// Checksums of the chunks which haven't been found in the seeds yet, by their weak checksum,
+	// and a filter to rule out most weak checksums without a lookup.
+	unordered_map<uint32_t, unordered_set<string>> wanted_;
+	vector<bool> wanted_filter_;
+	unordered_map<string, SeedLocation> found_;
+
+	size_t next_chunk_ {0};
+	vector<uint8_t> chunk_;
+	size_t chunk_pos_ {0};
+	int attempt_ {0};
+	int64_t downloaded_bytes_ {0};
+	int64_t seeded_bytes_ {0};
+
+	vector<uint8_t>::iterator read_start_;
+	vector<uint8_t>::iterator read_end_;
+	io::AsyncIoHandler handler_;
+	shared_ptr<bool> cancelled_;
+};
+
+// Fetches chunk indexes, and makes readers for them.
+class ChunkedDownload {
+public:
+	using IndexHandler = function<void(ExpectedChunkIndex)>;
+
+	ChunkedDownload(events::EventLoop &loop, const http::ClientConfig &config);
+
+	// Fetches the index at `url`. The handler is always called asynchronously.
+	error::Error AsyncFetchIndex(const string &url, IndexHandler handler);
+
+	io::AsyncReaderPtr MakeReader(
+		const string &store_url,
+		ChunkIndex index,
+		const vector<string> &seeds,
+		const string &seed_index_dir = "");
+
+	// Cancels both fetching the index, and the last reader.
+	void Cancel();
+
+private:
+	events::EventLoop &loop_;
+	http::ClientConfig config_;
+	http::Client client_;
+	// Incremented for each index fetch, so that results of cancelled ones are ignored.
+	uint64_t generation_ {0};
+	weak_ptr<ChunkedDownloadReader> reader_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_CHUNKED_DOWNLOAD_HPP
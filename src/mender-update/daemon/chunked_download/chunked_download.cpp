@@ -0,0 +1,700 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/chunked_download.hpp>
+
+#include <algorithm>
+#include <cerrno>
+#include <iterator>
+
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+#include <artifact/sha/sha.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+namespace sha = mender::sha;
+
+// How much of a seed to scan before letting the event loop run again.
+const int64_t kSeedScanStep = 4 * 1024 * 1024;
+// How much of a seed to read at a time.
+const size_t kSeedReadSize = 1024 * 1024;
+
+static size_t WantedFilterIndex(uint32_t weak) {
+	return (weak ^ (weak >> 16)) & 0xffff;
+}
+
+int64_t ChunkIndex::ChunkSize(size_t index) const {
+	if (index + 1 < chunks.size()) {
+		return chunk_size;
+	}
+	return size - chunk_size * static_cast<int64_t>(index);
+}
+
+ExpectedChunkIndex ParseChunkIndex(const string &data) {
+	auto invalid = [](const string &msg) {
+		return expected::unexpected(
+			error::Error(make_error_condition(errc::bad_message), "Invalid chunk index: " + msg));
+	};
+
+	auto exp_json = json::Load(data);
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+	auto &index_json = exp_json.value();
+
+	ChunkIndex index;
+	auto exp_int = json::Get<int64_t>(index_json, "chunk_size", json::MissingOk::No);
+	if (!exp_int) {
+		return expected::unexpected(exp_int.error());
+	}
+	index.chunk_size = exp_int.value();
+	if (index.chunk_size <= 0 || index.chunk_size > kMaxChunkSize) {
+		return invalid("chunk_size must be between 1 and " + to_string(kMaxChunkSize));
+	}
+
+	exp_int = json::Get<int64_t>(index_json, "size", json::MissingOk::No);
+	if (!exp_int) {
+		return expected::unexpected(exp_int.error());
+	}
+	index.size = exp_int.value();
+	if (index.size < 0) {
+		return invalid("size cannot be negative");
+	}
+
+	auto exp_chunks = index_json.Get("chunks");
+	if (!exp_chunks) {
+		return expected::unexpected(exp_chunks.error());
+	}
+	auto exp_count = exp_chunks.value().GetArraySize();
+	if (!exp_count) {
+		return expected::unexpected(exp_count.error());
+	}
+	auto count = exp_count.value();
+	if (static_cast<int64_t>(count) != (index.size + index.chunk_size - 1) / index.chunk_size) {
+		return invalid("the number of chunks does not match the size");
+	}
+
+	for (size_t i = 0; i < count; i++) {
+		auto exp_chunk = exp_chunks.value().Get(i);
+		if (!exp_chunk) {
+			return expected::unexpected(exp_chunk.error());
+		}
+		auto exp_sha = json::Get<string>(exp_chunk.value(), "sha256", json::MissingOk::No);
+		if (!exp_sha) {
+			return expected::unexpected(exp_sha.error());
+		}
+		auto &sha256 = exp_sha.value();
+		if (sha256.size() != 64
+			|| sha256.find_first_not_of("0123456789abcdef") != string::npos) {
+			return invalid("'" + sha256 + "' is not a SHA256 checksum");
+		}
+		auto exp_weak = json::Get<uint32_t>(exp_chunk.value(), "weak", json::MissingOk::No);
+		if (!exp_weak) {
+			return expected::unexpected(exp_weak.error());
+		}
+		index.chunks.push_back({sha256, exp_weak.value()});
+	}
+
+	return index;
+}
+
+string ChunkIndexToJson(const ChunkIndex &index) {
+	string index_json = R"({"chunk_size":)" + to_string(index.chunk_size)
+						+ R"(,"size":)" + to_string(index.size) + R"(,"chunks":[)";
+	string separator;
+	for (const auto &chunk : index.chunks) {
+		index_json += separator + R"({"sha256":")" + chunk.sha256 + R"(","weak":)"
+					  + to_string(chunk.weak) + "}";
+		separator = ",";
+	}
+	return index_json + "]}";
+}
+
+static string TrimmedStoreURL(const string &store_url) {
+	auto end = store_url.find_last_not_of('/');
+	return end == string::npos ? "" : store_url.substr(0, end + 1);
+}
+
+string ChunkIndexURL(const string &store_url, const string &device_type, const string &name) {
+	return TrimmedStoreURL(store_url) + "/index/" + http::URLEncode(device_type) + "/"
+		   + http::URLEncode(name) + ".json";
+}
+
+string ChunkURL(const string &store_url, const string &sha256) {
+	return TrimmedStoreURL(store_url) + "/" + sha256.substr(0, 4) + "/" + sha256 + ".chunk";
+}
+
+void RollingChecksum::Reset(const uint8_t *data, size_t size) {
+	// Overflows are harmless, only the lower 16 bits are kept.
+	a_ = 0;
+	b_ = 0;
+	for (size_t i = 0; i < size; i++) {
+		a_ += data[i];
+		b_ += a_;
+	}
+	a_ &= 0xffff;
+	b_ &= 0xffff;
+	size_ = static_cast<uint32_t>(size);
+}
+
+void RollingChecksum::Roll(uint8_t out, uint8_t in) {
+	a_ = (a_ - out + in) & 0xffff;
+	b_ = (b_ - size_ * out + a_) & 0xffff;
+}
+
+string SeedIndexPath(const string &dir, const string &seed) {
+	// Encoded, so that the path of the seed becomes one unambiguous file name.
+	return path::Join(dir, http::URLEncode(seed) + ".json");
+}
+
+ExpectedChunkIndex ComputeSeedIndex(const string &seed, int64_t chunk_size) {
+	if (chunk_size <= 0 || chunk_size > kMaxChunkSize) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"The chunk size must be between 1 and " + to_string(kMaxChunkSize)));
+	}
+
+	ifstream stream(seed, ios::binary);
+	if (!stream.good()) {
+		return expected::unexpected(error::Error(
+			generic_category().default_error_condition(errno), "Could not open seed " + seed));
+	}
+
+	ChunkIndex index {chunk_size, 0, {}};
+	vector<uint8_t> data(static_cast<size_t>(chunk_size));
+	while (true) {
+		stream.read(reinterpret_cast<char *>(data.data()), static_cast<streamsize>(chunk_size));
+		auto count = stream.gcount();
+		if (stream.bad()) {
+			return expected::unexpected(error::Error(
+				generic_category().default_error_condition(errno), "Could not read seed " + seed));
+		}
+		if (count == 0) {
+			break;
+		}
+		data.resize(static_cast<size_t>(count));
+
+		auto exp_sha = sha::Shasum(data);
+		if (!exp_sha) {
+			return expected::unexpected(exp_sha.error());
+		}
+		RollingChecksum weak;
+		weak.Reset(data.data(), data.size());
+		index.chunks.push_back({exp_sha.value().String(), weak.Value()});
+		index.size += count;
+
+		if (count < chunk_size) {
+			break;
+		}
+	}
+	return index;
+}
+
+ChunkedDownloadReader::ChunkedDownloadReader(
+	events::EventLoop &loop,
+	const http::ClientConfig &config,
+	const string &store_url,
+	ChunkIndex index,
+	vector<string> seeds,
+	const string &seed_index_dir) :
+	loop_ {loop},
+	client_ {config, loop, "chunked_download"},
+	retry_timer_ {loop},
+	store_url_ {store_url},
+	index_ {std::move(index)},
+	retry_count_ {config.retry_download_count},
+	seeds_ {std::move(seeds)},
+	seed_index_dir_ {seed_index_dir},
+	wanted_filter_(0x10000, false) {
+	for (size_t i = 0; i < index_.chunks.size(); i++) {
+		// A shorter last chunk could only be found at the very end of a seed, don't bother.
+		if (index_.ChunkSize(i) == index_.chunk_size) {
+			const auto &chunk = index_.chunks[i];
+			wanted_[chunk.weak].insert(chunk.sha256);
+			wanted_filter_[WantedFilterIndex(chunk.weak)] = true;
+		}
+	}
+}
+
+ChunkedDownloadReader::~ChunkedDownloadReader() {
+	Cancel();
+}
+
+error::Error ChunkedDownloadReader::AsyncRead(
+	vector<uint8_t>::iterator start, vector<uint8_t>::iterator end, io::AsyncIoHandler handler) {
+	if (handler_) {
+		return error::Error(
+			make_error_condition(errc::operation_in_progress), "Chunked read already ongoing");
+	}
+	cancelled_ = make_shared<bool>(false);
+	read_start_ = start;
+	read_end_ = end;
+	handler_ = handler;
+	PostContinue();
+	return error::NoError;
+}
+
+void ChunkedDownloadReader::Cancel() {
+	if (cancelled_) {
+		*cancelled_ = true;
+		cancelled_.reset();
+	}
+	handler_ = nullptr;
+	retry_timer_.Cancel();
+	client_.Cancel();
+}
+
+void ChunkedDownloadReader::PostContinue() {
+	auto cancelled = cancelled_;
+	loop_.Post([this, cancelled]() {
+		if (!*cancelled) {
+			Continue();
+		}
+	});
+}
+
+void ChunkedDownloadReader::Continue() {
+	if (!seeds_scanned_) {
+		seeds_scanned_ = ScanSeedStep();
+		if (seeds_scanned_) {
+			seed_stream_.reset();
+			seed_buffer_.clear();
+			seed_buffer_.shrink_to_fit();
+			if (!seeds_.empty()) {
+				log::Info(
+					"Found " + to_string(found_.size()) + " distinct chunks of the "
+					+ to_string(index_.chunks.size()) + " in the seeds");
+			}
+		}
+		PostContinue();
+		return;
+	}
+
+	if (chunk_pos_ < chunk_.size()) {
+		auto count = min(static_cast<size_t>(read_end_ - read_start_), chunk_.size() - chunk_pos_);
+		copy_n(chunk_.begin() + chunk_pos_, count, read_start_);
+		chunk_pos_ += count;
+		CallHandler(count);
+		return;
+	}
+
+	if (next_chunk_ >= index_.chunks.size()) {
+		if (!chunk_.empty()) {
+			log::Info(
+				"Chunked download finished, " + to_string(downloaded_bytes_)
+				+ " bytes downloaded and " + to_string(seeded_bytes_)
+				+ " bytes taken from the seeds");
+			chunk_.clear();
+			chunk_.shrink_to_fit();
+			chunk_pos_ = 0;
+		}
+		CallHandler(0);
+		return;
+	}
+
+	FetchChunk();
+}
+
+void ChunkedDownloadReader::CallHandler(io::ExpectedSize result) {
+	auto handler = handler_;
+	handler_ = nullptr;
+	handler(result);
+}
+
+bool ChunkedDownloadReader::ScanSeedStep() {
+	if (wanted_.empty() || seed_number_ >= seeds_.size()) {
+		return true;
+	}
+
+	if (!seed_stream_) {
+		const auto &seed = seeds_[seed_number_];
+		if (UseSeedIndex(seed)) {
+			NextSeed();
+			return false;
+		}
+		seed_stream_.reset(new ifstream(seed, ios::binary));
+		if (!seed_stream_->good()) {
+			log::Warning("Could not open seed " + seed + ", skipping it");
+			NextSeed();
+			return false;
+		}
+		log::Debug("Looking for Artifact chunks in " + seed);
+	}
+
+	const auto window_size = static_cast<size_t>(index_.chunk_size);
+	int64_t scanned = 0;
+	while (scanned < kSeedScanStep && !wanted_.empty()) {
+		auto available = seed_buffer_.size() - seed_window_;
+		// One byte more than the window is needed to move it forward.
+		if (available <= window_size && !seed_eof_) {
+			if (!RefillSeedBuffer()) {
+				return false;
+			}
+			continue;
+		}
+		if (available < window_size) {
+			NextSeed();
+			return false;
+		}
+
+		if (!checksum_valid_) {
+			checksum_.Reset(seed_buffer_.data() + seed_window_, window_size);
+			checksum_valid_ = true;
+		}
+		if (MatchSeedWindow()) {
+			// Chunks don't overlap, so continue after this one.
+			seed_window_ += window_size;
+			checksum_valid_ = false;
+			scanned += window_size;
+			continue;
+		}
+
+		if (available == window_size) {
+			NextSeed();
+			return false;
+		}
+		checksum_.Roll(seed_buffer_[seed_window_], seed_buffer_[seed_window_ + window_size]);
+		seed_window_++;
+		scanned++;
+	}
+	return wanted_.empty();
+}
+
+bool ChunkedDownloadReader::RefillSeedBuffer() {
+	seed_buffer_.erase(seed_buffer_.begin(), seed_buffer_.begin() + seed_window_);
+	seed_buffer_offset_ += seed_window_;
+	seed_window_ = 0;
+
+	auto old_size = seed_buffer_.size();
+	seed_buffer_.resize(old_size + kSeedReadSize);
+	seed_stream_->read(
+		reinterpret_cast<char *>(seed_buffer_.data() + old_size),
+		static_cast<streamsize>(kSeedReadSize));
+	auto count = seed_stream_->gcount();
+	seed_buffer_.resize(old_size + count);
+	if (seed_stream_->bad()) {
+		log::Warning("Could not read seed " + seeds_[seed_number_] + ", skipping the rest of it");
+		NextSeed();
+		return false;
+	}
+	if (count == 0) {
+		seed_eof_ = true;
+	}
+	return true;
+}
+
+bool ChunkedDownloadReader::MatchSeedWindow() {
+	auto weak = checksum_.Value();
+	if (!wanted_filter_[WantedFilterIndex(weak)]) {
+		return false;
+	}
+	auto entry = wanted_.find(weak);
+	if (entry == wanted_.end()) {
+		return false;
+	}
+
+	vector<uint8_t> window {
+		seed_buffer_.begin() + seed_window_,
+		seed_buffer_.begin() + seed_window_ + index_.chunk_size};
+	auto exp_sha = sha::Shasum(window);
+	if (!exp_sha) {
+		return false;
+	}
+	auto sha256 = exp_sha.value().String();
+	if (entry->second.erase(sha256) == 0) {
+		return false;
+	}
+	if (entry->second.empty()) {
+		wanted_.erase(entry);
+	}
+	auto offset = seed_buffer_offset_ + static_cast<int64_t>(seed_window_);
+	found_[sha256] = {seeds_[seed_number_], offset};
+	return true;
+}
+
+bool ChunkedDownloadReader::UseSeedIndex(const string &seed) {
+	if (seed_index_dir_ == "") {
+		return false;
+	}
+	const auto index_path = SeedIndexPath(seed_index_dir_, seed);
+	ifstream index_stream(index_path);
+	if (!index_stream.good()) {
+		return false;
+	}
+	string data {istreambuf_iterator<char>(index_stream), istreambuf_iterator<char>()};
+	auto exp_index = ParseChunkIndex(data);
+	if (!exp_index) {
+		log::Warning(
+			"Could not use the index of seed " + seed + ", scanning it instead: "
+			+ exp_index.error().String());
+		return false;
+	}
+	auto &seed_index = exp_index.value();
+	if (seed_index.chunk_size != index_.chunk_size) {
+		log::Debug(
+			"The index of seed " + seed + " has chunks of " + to_string(seed_index.chunk_size)
+			+ " bytes instead of " + to_string(index_.chunk_size) + ", scanning it instead");
+		return false;
+	}
+
+	// If the seed has changed since the index was made, the chunks fail verification when they
+	// are read, and are downloaded instead.
+	log::Debug("Looking up Artifact chunks in the index of " + seed);
+	for (size_t i = 0; i < seed_index.chunks.size() && !wanted_.empty(); i++) {
+		if (seed_index.ChunkSize(i) != index_.chunk_size) {
+			continue;
+		}
+		const auto &chunk = seed_index.chunks[i];
+		auto entry = wanted_.find(chunk.weak);
+		if (entry == wanted_.end() || entry->second.erase(chunk.sha256) == 0) {
+			continue;
+		}
+		if (entry->second.empty()) {
+			wanted_.erase(entry);
+		}
+		found_[chunk.sha256] = {seed, static_cast<int64_t>(i) * seed_index.chunk_size};
+	}
+	return true;
+}
+
+void ChunkedDownloadReader::NextSeed() {
+	seed_number_++;
+	seed_stream_.reset();
+	seed_eof_ = false;
+	seed_buffer_.clear();
+	seed_buffer_offset_ = 0;
+	seed_window_ = 0;
+	checksum_valid_ = false;
+}
+
+void ChunkedDownloadReader::FetchChunk() {
+	const auto &chunk = index_.chunks[next_chunk_];
+	auto location = found_.find(chunk.sha256);
+	if (location == found_.end()) {
+		DownloadChunk();
+		return;
+	}
+
+	// The seed is read again, since it may have changed since it was scanned.
+	vector<uint8_t> data(index_.ChunkSize(next_chunk_));
+	ifstream seed(location->second.seed, ios::binary);
+	seed.seekg(location->second.offset);
+	seed.read(reinterpret_cast<char *>(data.data()), static_cast<streamsize>(data.size()));
+	if (seed.good() && VerifyChunk(data) == error::NoError) {
+		seeded_bytes_ += data.size();
+		UseChunk(std::move(data));
+		return;
+	}
+
+	log::Warning(
+		"Chunk " + chunk.sha256 + " is no longer in " + location->second.seed
+		+ ", downloading it instead");
+	found_.erase(location);
+	DownloadChunk();
+}
+
+void ChunkedDownloadReader::DownloadChunk() {
+	const auto &sha256 = index_.chunks[next_chunk_].sha256;
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	auto err = req->SetAddress(ChunkURL(store_url_, sha256));
+	if (err != error::NoError) {
+		CallHandler(expected::unexpected(err));
+		return;
+	}
+
+	auto cancelled = cancelled_;
+	auto data = make_shared<vector<uint8_t>>(index_.ChunkSize(next_chunk_));
+	// Set by the header handler, and reported by the body handler.
+	auto status_err = make_shared<error::Error>();
+	err = client_.AsyncCall(
+		req,
+		[this, cancelled, data, status_err](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (*cancelled) {
+				return;
+			}
+			if (!exp_resp) {
+				ChunkDownloadFailed(exp_resp.error());
+				return;
+			}
+			auto &resp = exp_resp.value();
+			if (resp->GetStatusCode() != http::StatusOK) {
+				*status_err = error::Error(
+					make_error_condition(errc::protocol_error),
+					"Unexpected status code: " + resp->GetStatusMessage());
+				return;
+			}
+			resp->SetBodyWriter(make_shared<io::ByteWriter>(data));
+		},
+		[this, cancelled, data, status_err](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (*cancelled) {
+				return;
+			}
+			if (!exp_resp) {
+				ChunkDownloadFailed(exp_resp.error());
+				return;
+			}
+			if (*status_err != error::NoError) {
+				ChunkDownloadFailed(*status_err);
+				return;
+			}
+			auto err = VerifyChunk(*data);
+			if (err != error::NoError) {
+				ChunkDownloadFailed(err);
+				return;
+			}
+			downloaded_bytes_ += data->size();
+			UseChunk(std::move(*data));
+		});
+	if (err != error::NoError) {
+		ChunkDownloadFailed(err);
+	}
+}
+
+void ChunkedDownloadReader::ChunkDownloadFailed(const error::Error &err) {
+	const auto &sha256 = index_.chunks[next_chunk_].sha256;
+	if (attempt_ >= retry_count_) {
+		CallHandler(
+			expected::unexpected(err.WithContext("Could not download chunk " + sha256)));
+		return;
+	}
+
+	attempt_++;
+	log::Warning(
+		"Could not download chunk " + sha256 + ": " + err.String() + ", retrying in "
+		+ to_string(attempt_) + " seconds");
+	auto cancelled = cancelled_;
+	retry_timer_.AsyncWait(chrono::seconds {attempt_}, [this, cancelled](error::Error err) {
+		if (*cancelled) {
+			return;
+		}
+		if (err != error::NoError) {
+			CallHandler(expected::unexpected(err));
+			return;
+		}
+		DownloadChunk();
+	});
+}
+
+error::Error ChunkedDownloadReader::VerifyChunk(const vector<uint8_t> &data) {
+	const auto &expected_sha = index_.chunks[next_chunk_].sha256;
+	auto exp_sha = sha::Shasum(data);
+	if (!exp_sha) {
+		return exp_sha.error();
+	}
+	if (exp_sha.value() != expected_sha) {
+		return sha::MakeError(
+			sha::ShasumMismatchError,
+			"Chunk checksum mismatch, expected " + expected_sha + ", got "
+				+ exp_sha.value().String());
+	}
+	return error::NoError;
+}
+
+void ChunkedDownloadReader::UseChunk(vector<uint8_t> data) {
+	chunk_ = std::move(data);
+	chunk_pos_ = 0;
+	next_chunk_++;
+	attempt_ = 0;
+	Continue();
+}
+
+ChunkedDownload::ChunkedDownload(events::EventLoop &loop, const http::ClientConfig &config) :
+	loop_ {loop},
+	config_ {config},
+	client_ {config, loop, "chunked_download"} {
+}
+
+error::Error ChunkedDownload::AsyncFetchIndex(const string &url, IndexHandler handler) {
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	auto err = req->SetAddress(url);
+	if (err != error::NoError) {
+		return err;
+	}
+
+	auto body = make_shared<vector<uint8_t>>();
+	auto status_err = make_shared<error::Error>();
+	auto generation = ++generation_;
+	auto post_result = [this, handler, generation](ExpectedChunkIndex result) {
+		loop_.Post([this, handler, result, generation]() {
+			if (generation == generation_) {
+				handler(result);
+			}
+		});
+	};
+	return client_.AsyncCall(
+		req,
+		[body, status_err, post_result](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp) {
+				post_result(expected::unexpected(exp_resp.error()));
+				return;
+			}
+			auto &resp = exp_resp.value();
+			if (resp->GetStatusCode() != http::StatusOK) {
+				*status_err = error::Error(
+					make_error_condition(errc::protocol_error),
+					"Unexpected status code while fetching the chunk index: "
+						+ resp->GetStatusMessage());
+				return;
+			}
+			auto body_writer = make_shared<io::ByteWriter>(body);
+			body_writer->SetUnlimited(true);
+			resp->SetBodyWriter(body_writer);
+		},
+		[body, status_err, post_result](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp) {
+				post_result(expected::unexpected(exp_resp.error()));
+				return;
+			}
+			if (*status_err != error::NoError) {
+				post_result(expected::unexpected(*status_err));
+				return;
+			}
+			post_result(ParseChunkIndex(string {body->begin(), body->end()}));
+		});
+}
+
+io::AsyncReaderPtr ChunkedDownload::MakeReader(
+	const string &store_url,
+	ChunkIndex index,
+	const vector<string> &seeds,
+	const string &seed_index_dir) {
+	auto reader = make_shared<ChunkedDownloadReader>(
+		loop_, config_, store_url, std::move(index), seeds, seed_index_dir);
+	reader_ = reader;
+	return reader;
+}
+
+void ChunkedDownload::Cancel() {
+	// Don't call the index handler with the cancellation error.
+	generation_++;
+	client_.Cancel();
+	auto reader = reader_.lock();
+	if (reader) {
+		reader->Cancel();
+	}
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
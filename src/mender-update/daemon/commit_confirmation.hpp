@@ -0,0 +1,79 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_COMMIT_CONFIRMATION_HPP
+#define MENDER_UPDATE_DAEMON_COMMIT_CONFIRMATION_HPP
+
+#include <chrono>
+#include <functional>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+
+// Holds back the commit of an Artifact until an application confirms it, as the outcome of its
+// own acceptance tests. This is the in-process counterpart of the ConfirmCommit method of
+// io.mender.Update1, see Documentation/commit-confirmation.md.
+class CommitConfirmation {
+public:
+	using HandlerFunction = function<void(error::Error)>;
+
+	// Replies to ConfirmCommit.
+	static const string kReplyConfirmed;
+	static const string kReplyNoPendingCommit;
+
+	CommitConfirmation(events::EventLoop &loop, bool enabled, chrono::seconds timeout);
+
+	bool Enabled() const {
+		return enabled_;
+	}
+
+	// Starts waiting for the confirmation. The handler receives no error once the commit has been
+	// confirmed, or an error if it hasn't been within the timeout. The handler is always called
+	// asynchronously.
+	void AsyncWait(HandlerFunction handler);
+
+	// Returns `kReplyConfirmed` if a commit was waiting for the confirmation, and
+	// `kReplyNoPendingCommit` if there is none, in which case it is ignored. Fails if the
+	// confirmation isn't enabled.
+	expected::ExpectedString Confirm();
+
+private:
+	void Finish(error::Error err);
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	bool enabled_;
+	chrono::seconds timeout_;
+
+	// Waiting for the confirmation, if set.
+	HandlerFunction handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_COMMIT_CONFIRMATION_HPP
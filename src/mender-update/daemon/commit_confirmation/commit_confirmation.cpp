@@ -0,0 +1,87 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/commit_confirmation.hpp>
+
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace log = mender::common::log;
+
+const string CommitConfirmation::kReplyConfirmed {"confirmed"};
+const string CommitConfirmation::kReplyNoPendingCommit {"no-pending-commit"};
+
+CommitConfirmation::CommitConfirmation(
+	events::EventLoop &loop, bool enabled, chrono::seconds timeout) :
+	loop_ {loop},
+	timer_ {loop},
+	enabled_ {enabled},
+	timeout_ {timeout} {
+}
+
+void CommitConfirmation::AsyncWait(HandlerFunction handler) {
+	if (!Enabled()) {
+		loop_.Post([handler]() { handler(error::NoError); });
+		return;
+	}
+
+	log::Info(
+		"Waiting up to " + to_string(timeout_.count())
+		+ " seconds for the confirmation of the commit of the update");
+
+	handler_ = handler;
+	timer_.Cancel();
+	timer_.AsyncWait(timeout_, [this](error::Error err) {
+		if (err != error::NoError || !handler_) {
+			return;
+		}
+		Finish(error::Error(
+			make_error_condition(errc::timed_out),
+			"The commit was not confirmed within " + to_string(timeout_.count()) + " seconds"));
+	});
+}
+
+expected::ExpectedString CommitConfirmation::Confirm() {
+	if (!Enabled()) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::operation_not_supported),
+			"CommitRequiresConfirmation is not enabled"));
+	}
+	if (!handler_) {
+		return kReplyNoPendingCommit;
+	}
+
+	log::Info("The commit of the update was confirmed");
+	// Not from within the handler of the method call.
+	loop_.Post([this]() {
+		if (handler_) {
+			Finish(error::NoError);
+		}
+	});
+	return kReplyConfirmed;
+}
+
+void CommitConfirmation::Finish(error::Error err) {
+	timer_.Cancel();
+	auto handler = handler_;
+	handler_ = nullptr;
+	handler(err);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
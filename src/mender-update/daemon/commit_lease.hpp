@@ -0,0 +1,91 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_COMMIT_LEASE_HPP
+#define MENDER_UPDATE_DAEMON_COMMIT_LEASE_HPP
+
+#include <chrono>
+#include <functional>
+#include <string>
+#include <unordered_map>
+#include <unordered_set>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+
+// Holds back the commit of an Artifact until the configured applications have kept confirming that
+// they are healthy for the whole lease. This is the in-process counterpart of the ConfirmHealthy
+// method of io.mender.Update1, see Documentation/artifact-commit-lease.md.
+class CommitLease {
+public:
+	using HandlerFunction = function<void(error::Error)>;
+
+	// Replies to ConfirmHealthy.
+	static const string kReplyConfirmed;
+	static const string kReplyNoLease;
+
+	CommitLease(
+		events::EventLoop &loop,
+		const vector<string> &applications,
+		chrono::seconds duration,
+		chrono::seconds renewal);
+
+	bool Enabled() const {
+		return !applications_.empty() && duration_ > chrono::seconds::zero();
+	}
+
+	// Starts the lease. The handler receives no error once the whole lease has passed with every
+	// application confirming in time, or an error as soon as one of them misses a confirmation.
+	// The handler is always called asynchronously.
+	void AsyncHold(HandlerFunction handler);
+
+	// Returns `kReplyConfirmed` if the confirmation counted towards an ongoing lease, and
+	// `kReplyNoLease` if there is none, in which case it is ignored.
+	expected::ExpectedString ConfirmHealthy(const string &application);
+
+private:
+	void ArmTimer();
+	void Finish(error::Error err);
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	unordered_set<string> applications_;
+	chrono::seconds duration_;
+	chrono::seconds renewal_;
+
+	// The ongoing lease, if `handler_` is set.
+	chrono::steady_clock::time_point end_;
+	// Application -> when its next confirmation is due.
+	unordered_map<string, chrono::steady_clock::time_point> due_;
+	unordered_set<string> confirmed_;
+	HandlerFunction handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_COMMIT_LEASE_HPP
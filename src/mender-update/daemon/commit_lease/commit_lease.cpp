@@ -0,0 +1,139 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/commit_lease.hpp>
+
+#include <algorithm>
+
+#include <common/common.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace log = mender::common::log;
+
+const string CommitLease::kReplyConfirmed {"confirmed"};
+const string CommitLease::kReplyNoLease {"no-lease"};
+
+CommitLease::CommitLease(
+	events::EventLoop &loop,
+	const vector<string> &applications,
+	chrono::seconds duration,
+	chrono::seconds renewal) :
+	loop_ {loop},
+	timer_ {loop},
+	applications_ {applications.begin(), applications.end()},
+	duration_ {duration},
+	renewal_ {renewal} {
+}
+
+void CommitLease::AsyncHold(HandlerFunction handler) {
+	if (!Enabled()) {
+		loop_.Post([handler]() { handler(error::NoError); });
+		return;
+	}
+
+	vector<string> applications {applications_.begin(), applications_.end()};
+	sort(applications.begin(), applications.end());
+	log::Info(
+		"Waiting " + to_string(duration_.count()) + " seconds for "
+		+ common::JoinStrings(applications, ", ")
+		+ " to keep confirming that they are healthy before committing the update");
+
+	auto now = chrono::steady_clock::now();
+	end_ = now + duration_;
+	due_.clear();
+	for (const auto &application : applications_) {
+		due_[application] = now + renewal_;
+	}
+	confirmed_.clear();
+	handler_ = handler;
+	ArmTimer();
+}
+
+expected::ExpectedString CommitLease::ConfirmHealthy(const string &application) {
+	if (applications_.count(application) == 0) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"'" + application + "' is not in ArtifactCommitLeaseApplications"));
+	}
+	if (!handler_) {
+		return kReplyNoLease;
+	}
+
+	log::Debug(application + " confirmed that it is healthy");
+	due_[application] = chrono::steady_clock::now() + renewal_;
+	confirmed_.insert(application);
+	ArmTimer();
+	return kReplyConfirmed;
+}
+
+void CommitLease::ArmTimer() {
+	auto next = end_;
+	for (const auto &entry : due_) {
+		next = min(next, entry.second);
+	}
+
+	timer_.Cancel();
+	auto remaining = max(next - chrono::steady_clock::now(), chrono::steady_clock::duration {0});
+	timer_.AsyncWait(remaining, [this](error::Error err) {
+		if (err != error::NoError || !handler_) {
+			return;
+		}
+
+		auto now = chrono::steady_clock::now();
+		for (const auto &entry : due_) {
+			if (entry.second <= now) {
+				Finish(error::Error(
+					make_error_condition(errc::timed_out),
+					entry.first + " did not confirm that it is healthy within "
+						+ to_string(renewal_.count()) + " seconds"));
+				return;
+			}
+		}
+		if (now < end_) {
+			ArmTimer();
+			return;
+		}
+
+		// Also if the lease is shorter than the renewal interval, every application must have
+		// confirmed at least once.
+		for (const auto &application : applications_) {
+			if (confirmed_.count(application) == 0) {
+				Finish(error::Error(
+					make_error_condition(errc::timed_out),
+					application + " never confirmed that it is healthy"));
+				return;
+			}
+		}
+		log::Info("All applications stayed healthy during the commit lease");
+		Finish(error::NoError);
+	});
+}
+
+void CommitLease::Finish(error::Error err) {
+	timer_.Cancel();
+	auto handler = handler_;
+	handler_ = nullptr;
+	due_.clear();
+	confirmed_.clear();
+	handler(err);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
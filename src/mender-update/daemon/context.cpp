@@ -14,10 +14,15 @@
 
 #include <mender-update/daemon/context.hpp>
 
+#include <algorithm>
+#include <fstream>
+#include <sstream>
+
 #include <common/common.hpp>
 #include <client_shared/conf.hpp>
+#include <common/key_value_parser.hpp>
 #include <common/log.hpp>
-#include <common/http_resumer.hpp>
+#include <common/path.hpp>
 
 namespace mender {
 namespace update {
@@ -25,8 +30,9 @@ namespace daemon {
 
 namespace common = mender::common;
 namespace conf = mender::client_shared::conf;
+namespace key_value_parser = mender::common::key_value_parser;
 namespace log = mender::common::log;
-namespace http_resumer = mender::common::http::resumer;
+namespace path = mender::common::path;
 
 namespace main_context = mender::update::context;
 
@@ -36,6 +42,40 @@ const int kStateDataVersion = 2;
 // update will be forcefully aborted. This can happen if we are in a reboot loop, for example.
 const int kMaxStateDataStoreCount = 28;
 
+const string kDownloadFailuresFile = "download-failures";
+
+// Leaves out the link to the Artifact, which may be enough to download it.
+static string ServerDeploymentWithoutSource(const json::Json &json) {
+	auto exp_children = json.GetChildren();
+	if (!exp_children) {
+		return "";
+	}
+	string content {"{"};
+	string separator;
+	for (const auto &child : exp_children.value()) {
+		content += separator + "\"" + json::EscapeString(child.first) + "\":";
+		separator = ",";
+		auto exp_artifact_children = child.second.GetChildren();
+		if (common::StringToLower(child.first) != "artifact" || !exp_artifact_children) {
+			content += child.second.Dump(-1);
+			continue;
+		}
+		content += "{";
+		string artifact_separator;
+		for (const auto &artifact_child : exp_artifact_children.value()) {
+			if (common::StringToLower(artifact_child.first) == "source") {
+				continue;
+			}
+			content += artifact_separator + "\"" + json::EscapeString(artifact_child.first)
+					   + "\":" + artifact_child.second.Dump(-1);
+			artifact_separator = ",";
+		}
+		content += "}";
+	}
+	content += "}";
+	return content;
+}
+
 ExpectedStateData ApiResponseJsonToStateData(const json::Json &json) {
 	StateData data;
 
@@ -65,6 +105,17 @@ ExpectedStateData ApiResponseJsonToStateData(const json::Json &json) {
 		// If it's not available, we don't care.
 	}
 
+	str = json.Get("artifact")
+			  .and_then([](const json::Json &json) { return json.Get("artifact_name"); })
+			  .and_then(json::ToString);
+	if (str) {
+		// Replaced with the name from the artifact header once the download has started, this
+		// one is only used before that, for example to find the chunk index of the artifact.
+		data.update_info.artifact.artifact_name = str.value();
+	}
+
+	data.update_info.server_deployment = ServerDeploymentWithoutSource(json);
+
 	// For later: Update Control Maps should be handled here.
 
 	// Note: There is more information available in the response than we collect here, but we
@@ -74,6 +125,16 @@ ExpectedStateData ApiResponseJsonToStateData(const json::Json &json) {
 	return data;
 }
 
+update_module::DeploymentMetadata MakeDeploymentMetadata(const UpdateInfo &update_info) {
+	return {
+		.deployment_id = update_info.id,
+		.artifact_name = update_info.artifact.artifact_name,
+		.artifact_group = update_info.artifact.artifact_group,
+		.artifact_provides = update_info.artifact.type_info_provides,
+		.server_deployment = update_info.server_deployment,
+	};
+}
+
 // Database keys
 const string Context::kRollbackNotSupported = "rollback-not-supported";
 const string Context::kRollbackSupported = "rollback-supported";
@@ -159,10 +220,100 @@ Context::Context(
 	http_client(mender_context.GetConfig().GetHttpClientConfig(), event_loop, authenticator),
 	download_client(make_shared<http_resumer::DownloadResumerClient>(
 		mender_context.GetConfig().GetHttpClientConfig(), event_loop)),
-	deployment_client(make_shared<deployments::DeploymentClient>()),
-	inventory_client(make_shared<inventory::InventoryClient>()),
+	header_prefetch(event_loop, mender_context.GetConfig().GetHttpClientConfig()),
+	chunked_download(event_loop, mender_context.GetConfig().GetHttpClientConfig()),
+	deployment_client(make_shared<deployments::DeploymentClient>(
+		mender_context.GetConfig().deployment_logs.compress_upload)),
+	inventory_client(make_shared<inventory::InventoryClient>(
+		mender_context.GetMenderStoreDB(),
+		mender_context.GetConfig().inventory_submission.changes_only,
+		chrono::seconds {
+			mender_context.GetConfig().inventory_submission.full_resubmit_interval_seconds})),
 	deployment_timer(event_loop),
-	inventory_timer(event_loop) {
+	inventory_timer(event_loop),
+	download_progress_timer(event_loop),
+	abort_check_timer(event_loop),
+	preflight_checks(
+		event_loop,
+		mender_context.GetConfig().preflight_checks,
+		mender_context.GetConfig().paths.GetPreflightChecksDir()),
+	state_listeners(
+		event_loop,
+		chrono::seconds {mender_context.GetConfig().state_listener_timeout_seconds},
+		chrono::seconds {mender_context.GetConfig().state_listener_max_delay_seconds}),
+	commit_lease(
+		event_loop,
+		mender_context.GetConfig().artifact_commit_lease_applications,
+		chrono::seconds {mender_context.GetConfig().artifact_commit_lease_seconds},
+		chrono::seconds {mender_context.GetConfig().artifact_commit_lease_renewal_seconds}),
+	commit_confirmation(
+		event_loop,
+		mender_context.GetConfig().commit_requires_confirmation,
+		chrono::seconds {mender_context.GetConfig().commit_confirmation_timeout_seconds}),
+	canary_monitor(event_loop, mender_context.GetConfig().canary_mode),
+	pilot_soak(
+		event_loop,
+		mender_context.GetConfig().pilot_mode,
+		path::Join(mender_context.GetConfig().paths.GetDataStore(), kPilotSoakFile)),
+	user_notifier(event_loop, mender_context.GetConfig().user_notifications),
+	reboot_grace(
+		event_loop,
+		chrono::seconds {mender_context.GetConfig().reboot_grace_seconds},
+		mender_context.GetConfig().reboot_grace_applications,
+		chrono::seconds {mender_context.GetConfig().reboot_grace_extension_seconds},
+		mender_context.GetConfig().reboot_grace_wall,
+		mender_context.GetConfig().reboot_grace_hook),
+	telemetry_sinks(
+		event_loop,
+		mender_context.GetConfig().telemetry_sinks,
+		mender_context.GetConfig().GetHttpClientConfig()),
+	mqtt_bridge(event_loop, mender_context.GetConfig().mqtt),
+	startup_wait(event_loop, mender_context.GetConfig().startup_wait),
+	poll_splay(mender_context.GetConfig().poll_splay, PollSplaySeed(mender_context.GetConfig())),
+	status_update_limiter(
+		event_loop,
+		chrono::seconds {mender_context.GetConfig().status_update_min_interval_seconds}),
+	deployment_history(
+		path::Join(mender_context.GetConfig().paths.GetDataStore(), kDeploymentHistoryFile),
+		static_cast<size_t>(mender_context.GetConfig().deployment_history_length)),
+	pause_record(path::Join(mender_context.GetConfig().paths.GetDataStore(), kDeploymentPauseFile)),
+	device_freeze(path::Join(mender_context.GetConfig().paths.GetDataStore(), kDeviceFreezeFile)),
+	artifact_twin(
+		path::Join(mender_context.GetConfig().paths.GetDataStore(), kDesiredArtifactFile)),
+	self_test(
+		event_loop,
+		mender_context.GetConfig().self_test,
+		mender_context.GetConfig().paths.GetSelfTestDir(),
+		path::Join(mender_context.GetConfig().paths.GetDataStore(), kSelfTestFile)),
+	standalone_update(event_loop, mender_context),
+	outbound_queue(path::Join(mender_context.GetConfig().paths.GetDataStore(), kOutboundQueueDir)),
+	header_cache(
+		path::Join(mender_context.GetConfig().paths.GetDataStore(), kArtifactHeaderCacheFile),
+		static_cast<size_t>(mender_context.GetConfig().artifact_header_cache_size)),
+	device_config_http_client(
+		mender_context.GetConfig().GetHttpClientConfig(),
+		event_loop,
+		authenticator,
+		"device_config_http_client"),
+	device_config(
+		event_loop,
+		device_config_http_client,
+		mender_context.GetConfig().device_configuration,
+		mender_context.GetConfig().paths.GetDataStore()),
+	push_channel_http_client(
+		mender_context.GetConfig().GetHttpClientConfig(),
+		event_loop,
+		authenticator,
+		"push_channel_http_client"),
+	push_channel(event_loop, push_channel_http_client, mender_context.GetConfig().push_channel) {
+	http_client.SetServerFailover(mender_context.GetConfig().servers.size() > 1);
+	device_config_http_client.SetServerFailover(mender_context.GetConfig().servers.size() > 1);
+	push_channel_http_client.SetServerFailover(mender_context.GetConfig().servers.size() > 1);
+	download_client->SetAdaptiveLinkTuning(mender_context.GetConfig().link_tuning.adaptive);
+	download_client->SetAttemptFailureHandler(
+		[this](const http_resumer::DownloadAttemptFailure &failure) {
+			CountDownloadFailure(failure);
+		});
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////
@@ -312,6 +463,26 @@ static string GenerateStateDataJson(const StateData &state_data) {
 					<< string(update_info.has_db_schema_update ? "true," : "false,");
 			content << R"("AllRollbacksSuccessful":)"
 					<< string(update_info.all_rollbacks_successful ? "true" : "false");
+
+			const auto &checkpoint = update_info.shutdown_checkpoint;
+			if (checkpoint.state != "") {
+				content << R"(,"ShutdownCheckpoint":{)";
+				content << R"("State":")" << json::EscapeString(checkpoint.state) << R"(",)";
+				content << R"("BytesDownloaded":)" << to_string(checkpoint.bytes_downloaded)
+						<< R"(,)";
+				content << R"("ModuleProgress":")"
+						<< json::EscapeString(checkpoint.module_progress) << R"(")";
+				content << "}";
+			}
+
+			if (update_info.server_deployment != "") {
+				content << R"(,"ServerDeployment":)" << update_info.server_deployment;
+			}
+
+			if (update_info.failure_category != FailureCategory::None) {
+				content << R"(,"FailureCategory":")"
+						<< FailureCategoryString(update_info.failure_category) << R"(")";
+			}
 		}
 		content << "}";
 	}
@@ -525,12 +696,74 @@ static error::Error UnmarshalJsonStateData(const json::Json &json, StateData &st
 	exp_bool = json_update_info.Get("AllRollbacksSuccessful").and_then(json::ToBool);
 	DefaultOrSetOrReturnIfError(update_info.all_rollbacks_successful, exp_bool, false);
 
+	update_info.shutdown_checkpoint = {};
+	auto exp_checkpoint = json_update_info.Get("ShutdownCheckpoint");
+	if (exp_checkpoint) {
+		auto &checkpoint = update_info.shutdown_checkpoint;
+		exp_string = exp_checkpoint.value().Get("State").and_then(json::ToString);
+		SetOrReturnIfError(checkpoint.state, exp_string);
+		exp_int64 = exp_checkpoint.value().Get("BytesDownloaded").and_then(json::ToInt64);
+		DefaultOrSetOrReturnIfError(checkpoint.bytes_downloaded, exp_int64, 0);
+		exp_string = exp_checkpoint.value().Get("ModuleProgress").and_then(json::ToString);
+		DefaultOrSetOrReturnIfError(checkpoint.module_progress, exp_string, "");
+	}
+
+	auto exp_server_deployment = json_update_info.Get("ServerDeployment");
+	update_info.server_deployment =
+		exp_server_deployment ? exp_server_deployment.value().Dump(-1) : "";
+
+	auto exp_failure_category = json_update_info.Get("FailureCategory").and_then(json::ToString);
+	update_info.failure_category =
+		exp_failure_category ? FailureCategoryFromString(exp_failure_category.value())
+							 : FailureCategory::None;
+
 	return error::NoError;
 }
 
 #undef SetOrReturnIfError
 #undef EmptyOrSetOrReturnIfError
 
+error::Error Context::CheckStore() {
+	auto &db = mender_context.GetMenderStoreDB();
+	return db.ReadTransaction([this](kv_db::Transaction &txn) {
+		auto exp_provides = mender_context.LoadProvides(txn);
+		if (!exp_provides) {
+			return exp_provides.error().WithContext("Could not load the provides");
+		}
+
+		auto exp_content = txn.Read(mender_context.state_data_key);
+		if (!exp_content) {
+			if (exp_content.error().code == kv_db::MakeError(kv_db::KeyError, "").code) {
+				// No deployment in progress.
+				return error::NoError;
+			}
+			return exp_content.error().WithContext("Could not load state data");
+		}
+		auto exp_json = json::Load(common::StringFromByteVector(exp_content.value()));
+		if (!exp_json) {
+			return exp_json.error().WithContext("Could not load state data");
+		}
+		StateData state_data;
+		auto err = UnmarshalJsonStateData(exp_json.value(), state_data);
+		if (err.code != make_error_condition(errc::not_supported)) {
+			return err.WithContext("Failed to unmarshal the state data");
+		}
+
+		// Written by another version of the client, so LoadDeploymentStateData() falls back to
+		// the uncommitted data, which must be there.
+		exp_content = txn.Read(mender_context.state_data_key_uncommitted);
+		if (!exp_content) {
+			return exp_content.error().WithContext("Could not load the uncommitted state data");
+		}
+		exp_json = json::Load(common::StringFromByteVector(exp_content.value()));
+		if (!exp_json) {
+			return exp_json.error().WithContext("Could not load the uncommitted state data");
+		}
+		err = UnmarshalJsonStateData(exp_json.value(), state_data);
+		return err.WithContext("Failed to unmarshal the uncommitted state data");
+	});
+}
+
 expected::ExpectedBool Context::LoadDeploymentStateData(StateData &state_data) {
 	log::Trace("Loading the deployment state data");
 
@@ -665,9 +898,15 @@ expected::ExpectedBool Context::LoadDeploymentStateData(StateData &state_data) {
 }
 
 void Context::BeginDeploymentLogging() {
+	// Tag all the log output of the deployment, not only the deployment log.
+	log::SetGlobalField(log::LogField("deployment_id", deployment.state_data->update_info.id));
+	log::SetGlobalField(log::LogField(
+		"artifact_name", deployment.state_data->update_info.artifact.artifact_name));
+
 	deployment.logger.reset(new deployments::DeploymentLog(
 		mender_context.GetConfig().paths.GetUpdateLogPath(),
-		deployment.state_data->update_info.id));
+		deployment.state_data->update_info.id,
+		mender_context.GetConfig().deployment_logs));
 	auto err = deployment.logger->BeginLogging();
 	if (err != error::NoError) {
 		log::Error(
@@ -685,6 +924,111 @@ void Context::FinishDeploymentLogging() {
 			+ deployment.state_data->update_info.id + ": " + err.String());
 		// We need to continue regardless
 	}
+
+	log::RemoveGlobalField("deployment_id");
+	log::RemoveGlobalField("artifact_name");
+}
+
+static error::Error IncrementCounter(const string &counters_path, const string &name) {
+	vector<string> lines;
+	ifstream counters_file(counters_path);
+	string line;
+	while (getline(counters_file, line)) {
+		if (line != "") {
+			lines.push_back(line);
+		}
+	}
+	counters_file.close();
+
+	key_value_parser::KeyValueMap counters;
+	if (lines.size() > 0) {
+		auto exp_counters = key_value_parser::ParseKeyValueMap(lines);
+		if (!exp_counters) {
+			log::Warning(
+				"Starting over with the counters in " + counters_path + ": "
+				+ exp_counters.error().String());
+		} else {
+			counters = std::move(exp_counters.value());
+		}
+	}
+
+	long long count = 0;
+	if (counters.count(name) != 0) {
+		auto exp_count = common::StringToLongLong(counters[name]);
+		if (exp_count) {
+			count = exp_count.value();
+		}
+	}
+	counters[name] = to_string(count + 1);
+
+	vector<string> names;
+	for (const auto &counter : counters) {
+		names.push_back(counter.first);
+	}
+	sort(names.begin(), names.end());
+	stringstream content;
+	for (const auto &counter_name : names) {
+		content << counter_name << "=" << counters[counter_name] << "\n";
+	}
+
+	// Replaced in one go, so that the inventory script never sees a partial file.
+	const string tmp_path = counters_path + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content.str());
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, counters_path);
+}
+
+void Context::CountDownloadFailure(const http_resumer::DownloadAttemptFailure &failure) {
+	auto err = IncrementCounter(
+		path::Join(mender_context.GetConfig().paths.GetDataStore(), kDownloadFailuresFile),
+		http_resumer::DownloadFailureCauseToString(failure.cause));
+	if (err != error::NoError) {
+		log::Warning("Could not count the download failure: " + err.String());
+	}
+}
+
+void Context::RequestDeploymentAbort() {
+	deployment.abort_requested = true;
+	// Aborting calls into the download, which may replace or reset the pointer.
+	auto reader = deployment.download_reader;
+	if (reader) {
+		reader->Abort(deployments::MakeError(
+			deployments::DeploymentAbortedError, "The deployment was aborted during the download"));
+	}
+}
+
+void Context::StopDeploymentState(const error::Error &reason) {
+	deployment.stop_reason = reason;
+	auto reader = deployment.download_reader;
+	if (reader) {
+		reader->Abort(reason);
+	}
+	if (deployment.update_module) {
+		deployment.update_module->Terminate(reason);
+	}
+}
+
+void Context::RecordFailure(const error::Error &err, FailureCategory fallback) {
+	auto category = ClassifyError(err);
+	RecordFailure(category != FailureCategory::None ? category : fallback);
+}
+
+void Context::RecordFailure(FailureCategory category) {
+	if (!deployment.state_data || deployment.failed || category == FailureCategory::None
+		|| deployment.state_data->update_info.failure_category != FailureCategory::None) {
+		return;
+	}
+	deployment.state_data->update_info.failure_category = category;
+	// Also in the deployment log, for the servers which only keep the log.
+	log::Error("Deployment failure category: " + FailureCategoryString(category));
 }
 
 } // namespace daemon
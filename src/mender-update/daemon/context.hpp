@@ -15,15 +15,19 @@
 #ifndef MENDER_UPDATE_DAEMON_CONTEXT_HPP
 #define MENDER_UPDATE_DAEMON_CONTEXT_HPP
 
+#include <chrono>
 #include <memory>
 
 #include <common/error.hpp>
 #include <common/events.hpp>
+#include <common/events_io.hpp>
 #include <common/expected.hpp>
 #include <common/http.hpp>
+#include <common/http_resumer.hpp>
 #include <common/io.hpp>
 #include <common/json.hpp>
 #include <common/key_value_database.hpp>
+#include <common/optional.hpp>
 
 #include <artifact/artifact.hpp>
 
@@ -31,6 +35,35 @@
 #include <api/client.hpp>
 
 #include <mender-update/context.hpp>
+#include <mender-update/daemon/artifact_twin.hpp>
+#include <mender-update/daemon/canary_monitor.hpp>
+#include <mender-update/daemon/chunked_download.hpp>
+#include <mender-update/daemon/commit_confirmation.hpp>
+#include <mender-update/daemon/commit_lease.hpp>
+#include <mender-update/daemon/deployment_history.hpp>
+#include <mender-update/daemon/device_config.hpp>
+#include <mender-update/daemon/device_freeze.hpp>
+#include <mender-update/daemon/failure_category.hpp>
+#include <mender-update/daemon/header_cache.hpp>
+#include <mender-update/daemon/header_prefetch.hpp>
+#include <mender-update/daemon/loop_health.hpp>
+#include <mender-update/daemon/metrics.hpp>
+#include <mender-update/daemon/mqtt_bridge.hpp>
+#include <mender-update/daemon/outbound_queue.hpp>
+#include <mender-update/daemon/pause_record.hpp>
+#include <mender-update/daemon/pilot_soak.hpp>
+#include <mender-update/daemon/poll_splay.hpp>
+#include <mender-update/daemon/preflight_checks.hpp>
+#include <mender-update/daemon/push_channel.hpp>
+#include <mender-update/daemon/reboot_grace.hpp>
+#include <mender-update/daemon/self_test.hpp>
+#include <mender-update/daemon/service_notifier.hpp>
+#include <mender-update/daemon/standalone_update.hpp>
+#include <mender-update/daemon/startup_wait.hpp>
+#include <mender-update/daemon/state_listeners.hpp>
+#include <mender-update/daemon/status_update_limiter.hpp>
+#include <mender-update/daemon/telemetry_sinks.hpp>
+#include <mender-update/daemon/user_notifier.hpp>
 #include <mender-update/deployments.hpp>
 #include <mender-update/inventory.hpp>
 #include <mender-update/update_module/v3/update_module.hpp>
@@ -49,6 +82,7 @@ namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace expected = mender::common::expected;
 namespace http = mender::common::http;
+namespace http_resumer = mender::common::http::resumer;
 namespace io = mender::common::io;
 namespace json = mender::common::json;
 namespace kv_db = mender::common::key_value_database;
@@ -98,6 +132,17 @@ expected::ExpectedBool DbStringToSupportsRollback(const string &str);
 string NeedsRebootToDbString(update_module::RebootAction action);
 update_module::ExpectedRebootAction DbStringToNeedsReboot(const string &str);
 
+// Where a deployment was when the daemon was stopped in the middle of it by a termination signal,
+// see Documentation/graceful-shutdown.md.
+struct ShutdownCheckpoint {
+	// Download or ArtifactInstall. Empty if the deployment wasn't stopped.
+	string state;
+	// How much of the Artifact had been read.
+	int64_t bytes_downloaded {0};
+	// The last progress reported by the Update Module, if any.
+	string module_progress;
+};
+
 struct UpdateInfo {
 	ArtifactData artifact;
 	string id;
@@ -125,6 +170,19 @@ struct UpdateInfo {
 	// affect which deployment status you get at the end of the update, as well as the
 	// "INCONSISTENT" label on artifact_name.
 	bool all_rollbacks_successful {false};
+
+	// Added like `all_rollbacks_successful`, without bumping the schema. Cleared when the
+	// deployment is picked up again after the restart.
+	ShutdownCheckpoint shutdown_checkpoint;
+
+	// Added like `all_rollbacks_successful`, without bumping the schema. The deployment as the
+	// server sent it, for the Update Module and the state scripts, see
+	// `update_module::DeploymentMetadata`.
+	string server_deployment;
+
+	// Added like `all_rollbacks_successful`, without bumping the schema. Why the deployment
+	// failed, kept for the Failure status, which may only be sent after the rollback reboot.
+	FailureCategory failure_category {FailureCategory::None};
 };
 
 struct StateData {
@@ -141,6 +199,8 @@ using ExpectedStateData = expected::expected<StateData, error::Error>;
 
 ExpectedStateData ApiResponseJsonToStateData(const json::Json &json);
 
+update_module::DeploymentMetadata MakeDeploymentMetadata(const UpdateInfo &update_info);
+
 class Context {
 public:
 	Context(mender::update::context::MenderContext &mender_context, events::EventLoop &event_loop);
@@ -154,9 +214,31 @@ public:
 	// then the state_data is still filled in and valid.
 	expected::ExpectedBool LoadDeploymentStateData(StateData &state_data);
 
+	// Reads the provides and the deployment state data, as the daemon does on startup, without
+	// changing the database. For the self-test.
+	error::Error CheckStore();
+
 	void BeginDeploymentLogging();
 	void FinishDeploymentLogging();
 
+	// Counts a failed download attempt by cause, in `download-failures` in the data store, for the
+	// `mender-inventory-download-failures` inventory script.
+	void CountDownloadFailure(const http_resumer::DownloadAttemptFailure &failure);
+
+	// Marks the deployment in progress as aborted, and stops its download, if any. The states
+	// act on it as soon as they can, see Documentation/deployment-aborts.md.
+	void RequestDeploymentAbort();
+
+	// Stops the download and the Update Module of the state in progress, which then fails with
+	// `reason`. For the limits in `StateTimeouts`, see Documentation/state-timeouts.md.
+	void StopDeploymentState(const error::Error &reason);
+
+	// Records why the deployment in progress failed, unless that is already known, since the
+	// failures after the first one, in the rollback for example, usually follow from it.
+	// `fallback` is for the errors which don't tell by themselves, see ClassifyError.
+	void RecordFailure(const error::Error &err, FailureCategory fallback);
+	void RecordFailure(FailureCategory category);
+
 	mender::update::context::MenderContext &mender_context;
 	events::EventLoop &event_loop;
 
@@ -169,17 +251,112 @@ public:
 	// For polling, and for making status updates.
 	api::HTTPClient http_client;
 	// For the artifact download.
-	shared_ptr<http::ClientInterface> download_client;
+	shared_ptr<http_resumer::DownloadResumerClient> download_client;
+	// For checking the artifact header before the download.
+	HeaderPrefetch header_prefetch;
+	// For downloading the artifact chunk by chunk, if enabled.
+	ChunkedDownload chunked_download;
 
 	shared_ptr<deployments::DeploymentAPI> deployment_client;
 	shared_ptr<inventory::InventoryAPI> inventory_client;
 
 	events::Timer deployment_timer;
 	events::Timer inventory_timer;
+	// How the update checks and the inventory submissions have been doing, see
+	// `mender-update status`.
+	LoopHealth update_check_health;
+	LoopHealth inventory_health;
+	// Reports the progress of the Artifact download, see UpdateDownloadState.
+	events::Timer download_progress_timer;
+	// Sends a status update when there has been none for a while, to learn about an abort of the
+	// deployment on the server, see WatchForAbort.
+	events::Timer abort_check_timer;
+
+	// Checks whether the deployment can succeed, see UpdatePreflightChecksState.
+	PreflightChecks preflight_checks;
+
+	// External applications taking part in the state transitions, see StateScriptState.
+	StateListeners state_listeners;
+	// Applications which must stay healthy for a while before the commit, see
+	// UpdateCommitLeaseState.
+	CommitLease commit_lease;
+	// Acceptance of the update by an application before the commit, see
+	// UpdateCommitConfirmationState.
+	CommitConfirmation commit_confirmation;
+	// Health checks which must keep passing for a while before the commit, see
+	// UpdateCanaryState.
+	CanaryMonitor canary_monitor;
+	// Health checks which can still revert the update after the commit, see UpdatePilotState.
+	PilotSoak pilot_soak;
+
+	// Tells the people using the device about the installation and the reboots.
+	UserNotifier user_notifier;
+	// Holds back the reboot into an update for the work going on on the device, see
+	// UpdateRebootState.
+	RebootGrace reboot_grace;
+
+	// Forwards the deployment status updates to external applications, see
+	// SendStatusUpdateState.
+	TelemetrySinks telemetry_sinks;
+	// Publishes the state transitions, the deployment outcomes and the authorization changes to an
+	// MQTT broker.
+	MqttBridge mqtt_bridge;
+	// Tells systemd when the daemon is ready and what it is doing.
+	ServiceNotifier service_notifier;
+	// Holds back the first contact with the server, see StateMachine::Run().
+	StartupWait startup_wait;
+	// Random extra waits after the poll intervals, see ScheduleNextPollState.
+	PollSplay poll_splay;
+
+	// Keeps intermediate status updates to a bounded rate, see SendStatusUpdateState.
+	StatusUpdateLimiter status_update_limiter;
+
+	// The outcomes of the latest deployments, see EndOfDeploymentState.
+	DeploymentHistory deployment_history;
+	// Why the deployment was last paused, see UpdateWindowState and UpdateRebootState.
+	PauseRecord pause_record;
+	// Holds back the deployments while the device is frozen, see UpdateWindowState.
+	DeviceFreeze device_freeze;
+	// The Artifact of the latest deployment, see PollForDeploymentState.
+	ArtifactTwin artifact_twin;
+	// Checks the client after it has been upgraded, see StateMachine::Run().
+	SelfTest self_test;
+	// Standalone installations for local applications, see PollForDeploymentState.
+	StandaloneUpdate standalone_update;
+	// Counters and gauges for monitoring, served by the MetricsServer if enabled.
+	Metrics metrics;
+
+	// The final status updates and logs which couldn't be sent, see SendStatusUpdateState. Sent
+	// before the next update check.
+	OutboundQueue outbound_queue;
+
+	// The headers of the latest Artifacts, used instead of the pre-fetch, see
+	// UpdateCheckArtifactHeaderState.
+	HeaderCache header_cache;
+
+	// Fetches and applies the configuration of the device, with a client of its own, so that it
+	// neither waits for nor holds back the update checks and the deployments.
+	api::HTTPClient device_config_http_client;
+	DeviceConfig device_config;
+
+	// Keeps a connection open for the server to trigger the update checks and the inventory
+	// submissions, with a client of its own, since the connection is never over.
+	api::HTTPClient push_channel_http_client;
+	PushChannel push_channel;
+
+	// Announces the progress reported by the Update Module to local applications, see
+	// WatchUpdateModuleProgress. Without it, the progress is only logged and sent to the server.
+	function<error::Error(const string &state, const string &progress)> emit_module_progress;
+	// Likewise for the progress of the Artifact download, as in `DownloadProgressJson`.
+	function<error::Error(const string &deployment_id, const string &progress)>
+		emit_download_progress;
 
 	struct {
 		unique_ptr<StateData> state_data;
-		io::ReaderPtr artifact_reader;
+		// Counts the bytes, to tell where in the Artifact a checksum mismatch was found.
+		io::CountingReaderPtr artifact_reader;
+		// The Artifact download, stopped if the deployment is aborted in the meantime.
+		shared_ptr<events::io::AbortableAsyncReader> download_reader;
 		unique_ptr<artifact::Artifact> artifact_parser;
 		unique_ptr<artifact::Payload> artifact_payload;
 		unique_ptr<update_module::UpdateModule> update_module;
@@ -190,6 +367,41 @@ public:
 
 		bool download_with_sizes {false};
 
+		// The mirrors which the Artifact is still to be looked for on before the server, and the
+		// one it is being downloaded from, empty for the server. See ArtifactMirrors.
+		vector<string> artifact_mirrors;
+		string artifact_mirror;
+
+		// Set once the deployment has been confirmed, so that it no longer waits for the update
+		// window, see ConfirmDeployment.
+		bool confirmed {false};
+
+		// From the meta-data of the Artifact, once it has been accepted.
+		mender::update::context::EligibilityWindow eligibility;
+
+		// Set when the deployment is aborted, locally or on the server, see
+		// RequestDeploymentAbort. Cleared by the state which acts on it.
+		bool abort_requested {false};
+		// Set once the deployment has failed because it was aborted.
+		bool aborted {false};
+		// Set once the Artifact of a simulated deployment has been checked, see
+		// SimulateDeployments.
+		bool simulated {false};
+		// Set when the state in progress has been stopped, so that a download which only starts
+		// afterwards fails right away. Cleared when the next state is entered.
+		error::Error stop_reason;
+
+		// Reported along with the status updates, as set by the last state script which
+		// returned one.
+		string substate;
+
+		// The last progress of the Update Module, for the ShutdownCheckpoint.
+		string module_progress;
+
+		// When the progress of the Update Module, or of the download, was last sent to the
+		// server.
+		optional<chrono::steady_clock::time_point> progress_sent;
+
 		unique_ptr<deployments::DeploymentLog> logger;
 	} deployment;
 
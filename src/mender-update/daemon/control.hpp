@@ -0,0 +1,95 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_CONTROL_HPP
+#define MENDER_UPDATE_DAEMON_CONTROL_HPP
+
+#include <string>
+#include <vector>
+
+#include <client_shared/config_parser.hpp>
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+
+#include <mender-update/daemon/context.hpp>
+#include <mender-update/daemon/state_machine.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+
+// The control commands of the daemon, see Documentation/daemon-control.md. They are served over
+// DBus, as io.mender.Control1, apart from `set-log-level`, and over the local API. SIGUSR1 and
+// SIGUSR2 are only kept as shims for `check-update` and `send-inventory`, so that new commands
+// don't need signals of their own.
+class Control {
+public:
+	Control(Context &ctx, StateMachine &state_machine, events::EventLoop &event_loop);
+
+	void CheckUpdate();
+	void SendInventory();
+	// Reads the configuration files again, and applies the settings which can change without a
+	// restart: DaemonLogLevel and LogLevels right away, and the ones of
+	// `StateMachine::ReloadConfig()` once the daemon is idle.
+	error::Error Reload();
+	// What the daemon is doing, in more detail than its status, as a JSON object.
+	string DumpState() const;
+	// An empty `module` sets the level of the whole daemon, and an empty `level` removes the
+	// override of the module. Over DBus, io.mender.Management1.SetLogLevel does the same.
+	error::Error SetLogLevel(const string &module, const string &level);
+	// Freezes the device until `until`, an RFC 3339 timestamp, or until released if it is empty,
+	// and returns the freeze as a JSON object. See Documentation/device-freeze.md.
+	expected::ExpectedString Freeze(const string &until);
+	error::Error Release();
+
+	// The names of the commands, which `Run()` takes.
+	static const vector<string> kCommands;
+
+	// Runs a command by name, with its argument, and returns its result as JSON: the object of
+	// `dump-state` or `freeze`, or `true`. The argument of `set-log-level` is `[MODULE=]LEVEL`,
+	// and the one of `freeze` is the time until which to freeze, if any.
+	expected::ExpectedString Run(const string &command, const string &argument);
+
+	// Makes SIGUSR1 and SIGUSR2 run `check-update` and `send-inventory`, as they always have, and
+	// SIGHUP run `reload`, like for most daemons.
+	error::Error RegisterSignalShims();
+
+private:
+	error::Error ReloadConfig();
+	error::Error ReloadLogLevels(const cfg_parser::MenderConfigFromFile &config);
+
+	Context &ctx_;
+	StateMachine &state_machine_;
+	events::SignalHandler check_update_signal_;
+	events::SignalHandler send_inventory_signal_;
+	events::SignalHandler reload_signal_;
+
+	// The modules which have their level from LogLevels, for the next reload to reset the ones
+	// which are no longer there.
+	vector<string> configured_modules_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_CONTROL_HPP
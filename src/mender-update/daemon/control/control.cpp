@@ -0,0 +1,214 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/control.hpp>
+
+#include <algorithm>
+#include <cerrno>
+
+#include <client_shared/conf.hpp>
+#include <client_shared/config_parser.hpp>
+#include <common/common.hpp>
+#include <common/json.hpp>
+#include <common/key_value_database.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace cfg_parser = mender::client_shared::config_parser;
+namespace common = mender::common;
+namespace conf = mender::client_shared::conf;
+namespace json = mender::common::json;
+namespace kvdb = mender::common::key_value_database;
+namespace log = mender::common::log;
+
+const vector<string> Control::kCommands {
+	"check-update",
+	"send-inventory",
+	"reload",
+	"dump-state",
+	"set-log-level",
+	"freeze",
+	"release",
+};
+
+Control::Control(Context &ctx, StateMachine &state_machine, events::EventLoop &event_loop) :
+	ctx_ {ctx},
+	state_machine_ {state_machine},
+	check_update_signal_ {event_loop},
+	send_inventory_signal_ {event_loop},
+	reload_signal_ {event_loop} {
+	for (const auto &module_level : ctx.mender_context.GetConfig().log_levels) {
+		configured_modules_.push_back(module_level.first);
+	}
+}
+
+void Control::CheckUpdate() {
+	state_machine_.PostEvent(StateEvent::DeploymentPollingTriggered);
+}
+
+void Control::SendInventory() {
+	state_machine_.PostEvent(StateEvent::InventoryPollingTriggered);
+}
+
+error::Error Control::Reload() {
+	ctx_.service_notifier.Reloading();
+	auto err = ReloadConfig();
+	ctx_.service_notifier.Reloaded();
+	return err;
+}
+
+error::Error Control::ReloadConfig() {
+	const auto &paths = ctx_.mender_context.GetConfig().paths;
+	cfg_parser::MenderConfigFromFile config;
+	for (const auto &file : conf::ConfigFiles(paths)) {
+		auto exp_loaded = config.LoadFile(file);
+		if (!exp_loaded && !exp_loaded.error().IsErrno(ENOENT)) {
+			return exp_loaded.error().WithContext("Could not reload " + file);
+		}
+	}
+
+	auto err = ReloadLogLevels(config);
+	if (err != error::NoError) {
+		return err;
+	}
+	state_machine_.ReloadConfig(config);
+	return error::NoError;
+}
+
+error::Error Control::ReloadLogLevels(const cfg_parser::MenderConfigFromFile &config) {
+	// Validate all of them before applying any.
+	if (config.daemon_log_level != "") {
+		auto exp_level = log::StringToLogLevel(config.daemon_log_level);
+		if (!exp_level) {
+			return exp_level.error().WithContext("Invalid DaemonLogLevel");
+		}
+	}
+	for (const auto &module_level : config.log_levels) {
+		if (module_level.second == "") {
+			continue;
+		}
+		auto exp_level = log::StringToLogLevel(module_level.second);
+		if (!exp_level) {
+			return exp_level.error().WithContext(
+				"Invalid log level for module '" + module_level.first + "'");
+		}
+	}
+
+	if (config.daemon_log_level != "") {
+		log::SetModuleLevel("", config.daemon_log_level);
+	}
+	for (const auto &module : configured_modules_) {
+		if (config.log_levels.find(module) == config.log_levels.end()) {
+			log::ClearModuleLevel(module);
+		}
+	}
+	configured_modules_.clear();
+	for (const auto &module_level : config.log_levels) {
+		log::SetModuleLevel(module_level.first, module_level.second);
+		configured_modules_.push_back(module_level.first);
+	}
+
+	log::Info("Reloaded the log levels");
+	return error::NoError;
+}
+
+string Control::DumpState() const {
+	string state_data {"null"};
+	auto exp_data =
+		ctx_.mender_context.GetMenderStoreDB().Read(context::MenderContext::state_data_key);
+	if (exp_data) {
+		state_data = common::StringFromByteVector(exp_data.value());
+	} else if (exp_data.error().code != kvdb::MakeError(kvdb::KeyError, "").code) {
+		log::Warning("Could not read the state data: " + exp_data.error().String());
+	}
+
+	return R"({"state":")" + json::EscapeString(state_machine_.CurrentStateName())
+		   + R"(","paused":)" + (state_machine_.Paused() ? "true" : "false")
+		   + R"(,"status":)" + state_machine_.StatusJson() + R"(,"state_data":)" + state_data
+		   + "}";
+}
+
+error::Error Control::SetLogLevel(const string &module, const string &level) {
+	if (module == "" && level == "") {
+		return error::Error(
+			make_error_condition(errc::invalid_argument), "Need a log level for the daemon");
+	}
+	auto err = log::SetModuleLevel(module, level);
+	if (err != error::NoError) {
+		return err;
+	}
+	const string what = module == "" ? "Log level" : "Log level of module " + module;
+	log::Info(what + " set to " + (level == "" ? "the default" : level));
+	return error::NoError;
+}
+
+expected::ExpectedString Control::Freeze(const string &until) {
+	auto exp_until = ParseFreezeUntil(until);
+	if (!exp_until) {
+		return expected::unexpected(exp_until.error());
+	}
+	auto err = ctx_.device_freeze.Freeze(exp_until.value());
+	if (err != error::NoError) {
+		return expected::unexpected(err);
+	}
+	return ctx_.device_freeze.ToJson();
+}
+
+error::Error Control::Release() {
+	return ctx_.device_freeze.Release();
+}
+
+expected::ExpectedString Control::Run(const string &command, const string &argument) {
+	log::Info("Running control command " + command);
+	if (command == "check-update") {
+		CheckUpdate();
+	} else if (command == "send-inventory") {
+		SendInventory();
+	} else if (command == "reload") {
+		auto err = Reload();
+		if (err != error::NoError) {
+			return expected::unexpected(err);
+		}
+	} else if (command == "dump-state") {
+		return DumpState();
+	} else if (command == "set-log-level") {
+		auto equals = argument.find('=');
+		auto err = equals == string::npos
+					   ? SetLogLevel("", argument)
+					   : SetLogLevel(argument.substr(0, equals), argument.substr(equals + 1));
+		if (err != error::NoError) {
+			return expected::unexpected(err);
+		}
+	} else if (command == "freeze") {
+		return Freeze(argument);
+	} else if (command == "release") {
+		auto err = Release();
+		if (err != error::NoError) {
+			return expected::unexpected(err);
+		}
+	} else {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"No such control command: " + command + ", the commands are: "
+				+ common::JoinStrings(kCommands, ", ")));
+	}
+	return string {"true"};
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
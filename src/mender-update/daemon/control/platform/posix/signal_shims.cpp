@@ -0,0 +1,57 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <csignal>
+
+#include <mender-update/daemon/control.hpp>
+
+#include <common/error.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace error = mender::common::error;
+namespace log = mender::common::log;
+
+error::Error Control::RegisterSignalShims() {
+	auto err = check_update_signal_.RegisterHandler({SIGUSR1}, [this](events::SignalNumber signum) {
+		log::Info("SIGUSR1 received, triggering deployments check");
+		CheckUpdate();
+	});
+	if (err != error::NoError) {
+		return err;
+	}
+
+	err = send_inventory_signal_.RegisterHandler({SIGUSR2}, [this](events::SignalNumber signum) {
+		log::Info("SIGUSR2 received, triggering inventory update");
+		SendInventory();
+	});
+	if (err != error::NoError) {
+		return err;
+	}
+
+	return reload_signal_.RegisterHandler({SIGHUP}, [this](events::SignalNumber signum) {
+		log::Info("SIGHUP received, reloading the configuration");
+		auto err = Reload();
+		if (err != error::NoError) {
+			log::Error("Could not reload the configuration: " + err.String());
+		}
+	});
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,107 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_DEBUG_CONSOLE_HPP
+#define MENDER_UPDATE_DAEMON_DEBUG_CONSOLE_HPP
+
+#include <common/config.h>
+
+#include <termios.h>
+
+#include <deque>
+#include <memory>
+#include <mutex>
+#include <string>
+
+#ifdef MENDER_LOG_BOOST
+#include <boost/log/sinks/sink.hpp>
+#include <boost/smart_ptr/shared_ptr.hpp>
+#endif // MENDER_LOG_BOOST
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+
+#include <mender-update/daemon/context.hpp>
+#include <mender-update/daemon/state_machine.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+#ifdef MENDER_LOG_BOOST
+namespace sinks = boost::log::sinks;
+#endif // MENDER_LOG_BOOST
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+
+// Interactive terminal UI for the daemon, meant for bench bring-up. Shows the current state, the
+// ongoing deployment and the most recent log messages, and allows pausing, resuming and aborting
+// the state machine with single key presses.
+class DebugConsole : public events::EventLoopObject {
+public:
+	DebugConsole(StateMachine &state_machine, Context &ctx, events::EventLoop &event_loop);
+	~DebugConsole();
+
+	error::Error Start();
+	void Stop();
+
+	struct LogLines {
+		mutex lock;
+		deque<string> lines;
+	};
+
+	static const size_t kMaxLogLines;
+
+private:
+	void Redraw();
+	void HandleKey(char key);
+	void ScheduleRefresh();
+	void SetStatusMessage(const string &message);
+
+	// Platform specific.
+	error::Error SetupTerminal();
+	void RestoreTerminal();
+	void ReadInput();
+	void StartLogCapture();
+	void StopLogCapture();
+
+	StateMachine &state_machine_;
+	Context &ctx_;
+	events::EventLoop &event_loop_;
+	events::Timer refresh_timer_;
+
+	bool running_ {false};
+	string status_message_;
+	shared_ptr<LogLines> log_lines_;
+
+	struct termios saved_termios_;
+	bool termios_saved_ {false};
+#ifdef MENDER_USE_BOOST_ASIO
+	unique_ptr<events::asio::posix::stream_descriptor> input_;
+	char input_buf_[16];
+#endif // MENDER_USE_BOOST_ASIO
+
+#ifdef MENDER_LOG_BOOST
+	boost::shared_ptr<sinks::sink> log_sink_;
+#endif // MENDER_LOG_BOOST
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_DEBUG_CONSOLE_HPP
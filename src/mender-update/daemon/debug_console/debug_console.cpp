@@ -0,0 +1,202 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/debug_console.hpp>
+
+#include <iostream>
+#include <sstream>
+
+#include <client_shared/conf.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace conf = mender::client_shared::conf;
+namespace log = mender::common::log;
+
+const size_t DebugConsole::kMaxLogLines = 15;
+
+static const chrono::seconds kRefreshInterval {1};
+
+// ANSI escape sequences: clear the screen and move the cursor to the top left corner.
+static const string kClearScreen = "\033[2J\033[H";
+
+DebugConsole::DebugConsole(
+	StateMachine &state_machine, Context &ctx, events::EventLoop &event_loop) :
+	state_machine_ {state_machine},
+	ctx_ {ctx},
+	event_loop_ {event_loop},
+	refresh_timer_ {event_loop},
+	log_lines_ {make_shared<LogLines>()} {
+}
+
+DebugConsole::~DebugConsole() {
+	Stop();
+}
+
+error::Error DebugConsole::Start() {
+	auto err = SetupTerminal();
+	if (err != error::NoError) {
+		return err.WithContext("Could not start the debug console");
+	}
+
+	StartLogCapture();
+	running_ = true;
+
+	state_machine_.SetStateChangeCallback([this]() { Redraw(); });
+	ReadInput();
+	ScheduleRefresh();
+	Redraw();
+
+	return error::NoError;
+}
+
+void DebugConsole::Stop() {
+	if (!running_) {
+		return;
+	}
+	running_ = false;
+
+	state_machine_.SetStateChangeCallback(nullptr);
+	refresh_timer_.Cancel();
+	StopLogCapture();
+	RestoreTerminal();
+}
+
+void DebugConsole::ScheduleRefresh() {
+	refresh_timer_.AsyncWait(kRefreshInterval, [this](error::Error err) {
+		if (err != error::NoError || !running_) {
+			return;
+		}
+		Redraw();
+		ScheduleRefresh();
+	});
+}
+
+void DebugConsole::SetStatusMessage(const string &message) {
+	status_message_ = message;
+	Redraw();
+}
+
+void DebugConsole::HandleKey(char key) {
+	error::Error err;
+
+	switch (key) {
+	case 'p':
+		state_machine_.Pause();
+		if (ctx_.deployment.state_data) {
+			err = ctx_.pause_record.Paused(
+				ctx_.deployment.state_data->update_info.id,
+				state_machine_.CurrentStateName(),
+				"Paused by hand",
+				"debug console");
+			if (err != error::NoError) {
+				log::Warning("Could not record the pause of the deployment: " + err.String());
+			}
+		}
+		SetStatusMessage("Paused, will not leave the current state until resumed");
+		break;
+	case 'r':
+		state_machine_.Resume();
+		err = ctx_.pause_record.Resumed();
+		if (err != error::NoError) {
+			log::Warning("Could not record the resumption of the deployment: " + err.String());
+		}
+		SetStatusMessage("Resumed");
+		break;
+	case 'a':
+		err = state_machine_.AbortDeployment();
+		if (err != error::NoError) {
+			SetStatusMessage("Cannot abort: " + err.message);
+		} else {
+			SetStatusMessage("Deployment will be aborted as soon as possible");
+		}
+		break;
+	case 'c':
+		log::Info("Deployment check requested from the debug console");
+		state_machine_.PostEvent(StateEvent::DeploymentPollingTriggered);
+		SetStatusMessage("Deployment check triggered");
+		break;
+	case 'i':
+		log::Info("Inventory update requested from the debug console");
+		state_machine_.PostEvent(StateEvent::InventoryPollingTriggered);
+		SetStatusMessage("Inventory update triggered");
+		break;
+	case 'q':
+		log::Info("Exit requested from the debug console, shutting down gracefully");
+		Stop();
+		event_loop_.Stop();
+		break;
+	default:
+		break;
+	}
+}
+
+void DebugConsole::Redraw() {
+	if (!running_) {
+		return;
+	}
+
+	stringstream ss;
+	ss << kClearScreen;
+	ss << "mender-update " << conf::kMenderVersion << " - debug console\r\n\r\n";
+
+	ss << "State:      " << state_machine_.CurrentStateName();
+	if (state_machine_.Paused()) {
+		ss << " [PAUSED]";
+	}
+	ss << "\r\n";
+
+	if (ctx_.deployment.state_data) {
+		const auto &update_info = ctx_.deployment.state_data->update_info;
+		ss << "Deployment: " << update_info.id << "\r\n";
+		ss << "Artifact:   " << update_info.artifact.artifact_name << "\r\n";
+		ss << "Progress:   " << ctx_.deployment.state_data->state;
+		if (ctx_.deployment.failed) {
+			ss << " (failed";
+			if (ctx_.deployment.rollback_failed) {
+				ss << ", rollback failed";
+			}
+			ss << ")";
+		}
+		if (ctx_.deployment.abort_requested) {
+			ss << " (abort requested)";
+		}
+		ss << "\r\n";
+	} else {
+		ss << "Deployment: none\r\n";
+	}
+
+	ss << "\r\n---- Recent log messages ----\r\n";
+	{
+		lock_guard<mutex> guard(log_lines_->lock);
+		for (const auto &line : log_lines_->lines) {
+			ss << line << "\r\n";
+		}
+	}
+
+	ss << "\r\n";
+	if (status_message_ != "") {
+		ss << status_message_ << "\r\n";
+	}
+	ss << "[p]ause  [r]esume  [a]bort deployment  [c]heck update  [i]nventory update  [q]uit\r\n";
+
+	cout << ss.str() << flush;
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,77 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/debug_console.hpp>
+
+#include <boost/log/common.hpp>
+#include <boost/log/expressions.hpp>
+#include <boost/log/sinks.hpp>
+#include <boost/smart_ptr/make_shared.hpp>
+
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace logging = boost::log;
+namespace expr = boost::log::expressions;
+
+namespace mlog = mender::common::log;
+
+class LogLinesBackend : public sinks::basic_sink_backend<sinks::synchronized_feeding> {
+public:
+	LogLinesBackend(shared_ptr<DebugConsole::LogLines> log_lines) :
+		log_lines_ {log_lines} {
+	}
+
+	void consume(logging::record_view const &rec) {
+		string line;
+		auto level = logging::extract<mlog::LogLevel>("Severity", rec);
+		if (level) {
+			line = mlog::ToStringLogLevel(level.get()) + ": ";
+		}
+		auto msg = rec[expr::smessage];
+		if (msg) {
+			line += *msg;
+		}
+
+		lock_guard<mutex> guard(log_lines_->lock);
+		log_lines_->lines.push_back(std::move(line));
+		while (log_lines_->lines.size() > DebugConsole::kMaxLogLines) {
+			log_lines_->lines.pop_front();
+		}
+	}
+
+private:
+	shared_ptr<DebugConsole::LogLines> log_lines_;
+};
+
+void DebugConsole::StartLogCapture() {
+	using log_sink = sinks::synchronous_sink<LogLinesBackend>;
+	auto sink = boost::make_shared<log_sink>(boost::make_shared<LogLinesBackend>(log_lines_));
+	logging::core::get()->add_sink(sink);
+	log_sink_ = sink;
+}
+
+void DebugConsole::StopLogCapture() {
+	if (log_sink_) {
+		logging::core::get()->remove_sink(log_sink_);
+		log_sink_.reset();
+	}
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,112 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/debug_console.hpp>
+
+#include <cerrno>
+#include <iostream>
+
+#include <termios.h>
+#include <unistd.h>
+
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace asio = boost::asio;
+namespace log = mender::common::log;
+
+error::Error DebugConsole::SetupTerminal() {
+	if (!isatty(STDIN_FILENO) || !isatty(STDOUT_FILENO)) {
+		return error::Error(
+			make_error_condition(errc::inappropriate_io_control_operation),
+			"The debug console needs to be run in a terminal");
+	}
+
+	if (tcgetattr(STDIN_FILENO, &saved_termios_) != 0) {
+		int err = errno;
+		return error::Error(
+			generic_category().default_error_condition(err), "Could not get terminal attributes");
+	}
+	termios_saved_ = true;
+
+	// Read single key presses without waiting for a newline, and without echoing them.
+	struct termios raw = saved_termios_;
+	raw.c_lflag &= ~static_cast<tcflag_t>(ICANON | ECHO);
+	raw.c_cc[VMIN] = 1;
+	raw.c_cc[VTIME] = 0;
+	if (tcsetattr(STDIN_FILENO, TCSANOW, &raw) != 0) {
+		int err = errno;
+		return error::Error(
+			generic_category().default_error_condition(err), "Could not set terminal attributes");
+	}
+
+	// Duplicate the descriptor, since the stream_descriptor closes it when destroyed.
+	int fd = dup(STDIN_FILENO);
+	if (fd < 0) {
+		int err = errno;
+		RestoreTerminal();
+		return error::Error(
+			generic_category().default_error_condition(err), "Could not duplicate stdin");
+	}
+	input_.reset(new asio::posix::stream_descriptor(GetAsioIoContext(event_loop_), fd));
+
+	return error::NoError;
+}
+
+void DebugConsole::RestoreTerminal() {
+	if (input_) {
+		boost::system::error_code ec;
+		input_->cancel(ec);
+		input_.reset();
+	}
+
+	if (termios_saved_) {
+		tcsetattr(STDIN_FILENO, TCSANOW, &saved_termios_);
+		termios_saved_ = false;
+		cout << endl;
+	}
+}
+
+void DebugConsole::ReadInput() {
+	if (!input_) {
+		return;
+	}
+
+	input_->async_read_some(
+		asio::buffer(input_buf_, sizeof(input_buf_)),
+		[this](const boost::system::error_code &ec, size_t num_read) {
+			if (ec == asio::error::operation_aborted || !running_) {
+				return;
+			}
+			if (ec) {
+				log::Error("Error reading debug console input: " + ec.message());
+				return;
+			}
+
+			for (size_t i = 0; i < num_read; i++) {
+				HandleKey(input_buf_[i]);
+				if (!running_) {
+					return;
+				}
+			}
+			ReadInput();
+		});
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
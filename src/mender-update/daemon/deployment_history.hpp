@@ -0,0 +1,101 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_DEPLOYMENT_HISTORY_HPP
+#define MENDER_UPDATE_DAEMON_DEPLOYMENT_HISTORY_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <functional>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+// In the data store.
+const string kDeploymentHistoryFile {"deployment-history"};
+
+struct DeploymentRecord {
+	string id;
+	string artifact_name;
+	// In seconds since the epoch. 0 if unknown, or not finished yet.
+	int64_t started {0};
+	int64_t finished {0};
+	// One of the `DeploymentHistory::kOutcome*` values.
+	string outcome;
+	// Where a failed deployment failed, such as `download` or `install`. Empty otherwise.
+	string failure_class;
+	// What went wrong, as in the LastError property of io.mender.Update1. Empty otherwise.
+	string failure_reason;
+};
+using ExpectedDeploymentRecords = expected::expected<vector<DeploymentRecord>, error::Error>;
+
+// The latest deployments, kept in a file of their own, one JSON object per line, so that the
+// update history can be seen on the device without the server. See
+// Documentation/deployment-history.md.
+class DeploymentHistory {
+public:
+	using Clock = chrono::system_clock;
+
+	static const string kOutcomeInProgress;
+	static const string kOutcomeSuccess;
+	static const string kOutcomeFailure;
+	static const string kOutcomeAborted;
+
+	// Keeps the latest `length` deployments. 0 records nothing, and leaves the file alone.
+	DeploymentHistory(const string &path, size_t length);
+
+	// Adds the deployment, as in progress, and drops the oldest ones beyond the length.
+	error::Error Started(
+		const string &id, const string &artifact_name, Clock::time_point now = Clock::now());
+	// Only the first failure of a deployment is recorded, not those of the rollback which follows.
+	error::Error Failed(const string &id, const string &failure_class);
+	// Like `Failed`, for a deployment which fails because it was aborted. It is then recorded as
+	// aborted instead of failed, also while the rollback is still going on.
+	error::Error Aborted(const string &id, const string &failure_class);
+	// Like the failure class, only the first reason is recorded.
+	error::Error FailureReason(const string &id, const string &reason);
+	error::Error Finished(const string &id, bool success, Clock::time_point now = Clock::now());
+
+	// The oldest first. Lines which can't be parsed are skipped.
+	ExpectedDeploymentRecords Load() const;
+
+	// As a JSON array, the oldest first.
+	static string ToJson(const vector<DeploymentRecord> &records);
+
+private:
+	// Updates the record of the deployment, adding one if there is none, for example because the
+	// deployment started before the history was kept.
+	error::Error Update(const string &id, function<void(DeploymentRecord &)> update);
+	error::Error Save(const vector<DeploymentRecord> &records) const;
+
+	string path_;
+	size_t length_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_DEPLOYMENT_HISTORY_HPP
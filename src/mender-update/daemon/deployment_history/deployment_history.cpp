@@ -0,0 +1,282 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/deployment_history.hpp>
+
+#include <fstream>
+#include <utility>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+const string DeploymentHistory::kOutcomeInProgress {"in-progress"};
+const string DeploymentHistory::kOutcomeSuccess {"success"};
+const string DeploymentHistory::kOutcomeFailure {"failure"};
+const string DeploymentHistory::kOutcomeAborted {"aborted"};
+
+static int64_t ToSeconds(DeploymentHistory::Clock::time_point time) {
+	return chrono::duration_cast<chrono::seconds>(time.time_since_epoch()).count();
+}
+
+static string SecondsToJson(int64_t seconds) {
+	return seconds == 0 ? "null" : to_string(seconds);
+}
+
+static string RecordToJson(const DeploymentRecord &record) {
+	string duration = "null";
+	if (record.started != 0 && record.finished != 0) {
+		duration = to_string(record.finished - record.started);
+	}
+	return R"({"id":")" + json::EscapeString(record.id) + R"(","artifact_name":")"
+		   + json::EscapeString(record.artifact_name) + R"(","started":)"
+		   + SecondsToJson(record.started) + R"(,"finished":)" + SecondsToJson(record.finished)
+		   + R"(,"duration_seconds":)" + duration + R"(,"outcome":")"
+		   + json::EscapeString(record.outcome) + R"(","failure_class":")"
+		   + json::EscapeString(record.failure_class) + R"(","failure_reason":")"
+		   + json::EscapeString(record.failure_reason) + R"("})";
+}
+
+// Missing values are taken as 0 and empty, so that fields can be added later.
+static expected::expected<int64_t, error::Error> SecondsFromJson(
+	const json::Json &record_json, const string &key) {
+	auto exp_value = record_json.Get(key);
+	if (!exp_value || exp_value.value().IsNull()) {
+		return 0;
+	}
+	return exp_value.value().GetInt64();
+}
+
+static expected::ExpectedString StringFromJson(const json::Json &record_json, const string &key) {
+	auto exp_value = record_json.Get(key);
+	if (!exp_value || exp_value.value().IsNull()) {
+		return "";
+	}
+	return exp_value.value().GetString();
+}
+
+static expected::expected<DeploymentRecord, error::Error> RecordFromJson(const string &line) {
+	auto exp_json = json::Load(line);
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+	auto &record_json = exp_json.value();
+
+	DeploymentRecord record;
+	for (auto field : {
+			 make_pair("id", &record.id),
+			 make_pair("artifact_name", &record.artifact_name),
+			 make_pair("outcome", &record.outcome),
+			 make_pair("failure_class", &record.failure_class),
+			 make_pair("failure_reason", &record.failure_reason),
+		 }) {
+		auto exp_string = StringFromJson(record_json, field.first);
+		if (!exp_string) {
+			return expected::unexpected(exp_string.error());
+		}
+		*field.second = exp_string.value();
+	}
+	if (record.id == "" || record.outcome == "") {
+		return expected::unexpected(
+			json::MakeError(json::KeyError, "Missing the deployment ID or the outcome"));
+	}
+
+	for (auto field : {
+			 make_pair("started", &record.started),
+			 make_pair("finished", &record.finished),
+		 }) {
+		auto exp_seconds = SecondsFromJson(record_json, field.first);
+		if (!exp_seconds) {
+			return expected::unexpected(exp_seconds.error());
+		}
+		*field.second = exp_seconds.value();
+	}
+
+	return record;
+}
+
+DeploymentHistory::DeploymentHistory(const string &path, size_t length) :
+	path_ {path},
+	length_ {length} {
+}
+
+error::Error DeploymentHistory::Started(
+	const string &id, const string &artifact_name, Clock::time_point now) {
+	if (length_ == 0) {
+		return error::NoError;
+	}
+
+	auto exp_records = Load();
+	if (!exp_records) {
+		return exp_records.error();
+	}
+	auto &records = exp_records.value();
+
+	DeploymentRecord record;
+	record.id = id;
+	record.artifact_name = artifact_name;
+	record.started = ToSeconds(now);
+	record.outcome = kOutcomeInProgress;
+	records.push_back(record);
+	if (records.size() > length_) {
+		records.erase(records.begin(), records.end() - static_cast<ptrdiff_t>(length_));
+	}
+
+	return Save(records);
+}
+
+error::Error DeploymentHistory::Failed(const string &id, const string &failure_class) {
+	return Update(id, [&failure_class](DeploymentRecord &record) {
+		if (record.failure_class == "") {
+			record.failure_class = failure_class;
+		}
+	});
+}
+
+error::Error DeploymentHistory::Aborted(const string &id, const string &failure_class) {
+	return Update(id, [&failure_class](DeploymentRecord &record) {
+		record.outcome = kOutcomeAborted;
+		if (record.failure_class == "") {
+			record.failure_class = failure_class;
+		}
+	});
+}
+
+error::Error DeploymentHistory::FailureReason(const string &id, const string &reason) {
+	return Update(id, [&reason](DeploymentRecord &record) {
+		if (record.failure_reason == "") {
+			record.failure_reason = reason;
+		}
+	});
+}
+
+error::Error DeploymentHistory::Finished(const string &id, bool success, Clock::time_point now) {
+	return Update(id, [success, now](DeploymentRecord &record) {
+		record.finished = ToSeconds(now);
+		if (success) {
+			record.outcome = kOutcomeSuccess;
+		} else if (record.outcome != kOutcomeAborted) {
+			record.outcome = kOutcomeFailure;
+		}
+		if (success) {
+			record.failure_class = "";
+			record.failure_reason = "";
+		}
+	});
+}
+
+error::Error DeploymentHistory::Update(
+	const string &id, function<void(DeploymentRecord &)> update) {
+	if (length_ == 0) {
+		return error::NoError;
+	}
+
+	auto exp_records = Load();
+	if (!exp_records) {
+		return exp_records.error();
+	}
+	auto &records = exp_records.value();
+
+	auto found = records.rbegin();
+	for (; found != records.rend(); found++) {
+		if (found->id == id) {
+			break;
+		}
+	}
+	if (found == records.rend()) {
+		DeploymentRecord record;
+		record.id = id;
+		record.outcome = kOutcomeInProgress;
+		records.push_back(record);
+		if (records.size() > length_) {
+			records.erase(records.begin());
+		}
+		update(records.back());
+	} else {
+		update(*found);
+	}
+
+	return Save(records);
+}
+
+ExpectedDeploymentRecords DeploymentHistory::Load() const {
+	vector<DeploymentRecord> records;
+	if (!path::FileExists(path_)) {
+		return records;
+	}
+
+	auto exp_stream = io::OpenIfstream(path_);
+	if (!exp_stream) {
+		return expected::unexpected(exp_stream.error());
+	}
+	string line;
+	while (getline(exp_stream.value(), line)) {
+		if (line == "") {
+			continue;
+		}
+		auto exp_record = RecordFromJson(line);
+		if (!exp_record) {
+			log::Warning(
+				"Skipping an invalid record in " + path_ + ": " + exp_record.error().String());
+			continue;
+		}
+		records.push_back(exp_record.value());
+	}
+	return records;
+}
+
+error::Error DeploymentHistory::Save(const vector<DeploymentRecord> &records) const {
+	string content;
+	for (const auto &record : records) {
+		content += RecordToJson(record) + "\n";
+	}
+
+	// Replaced in one go, so that the inventory script never sees a partial file.
+	const string tmp_path = path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, path_);
+}
+
+string DeploymentHistory::ToJson(const vector<DeploymentRecord> &records) {
+	string result = "[";
+	string separator;
+	for (const auto &record : records) {
+		result += separator + RecordToJson(record);
+		separator = ",";
+	}
+	return result + "]";
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
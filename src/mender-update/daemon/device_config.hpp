@@ -0,0 +1,129 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_DEVICE_CONFIG_HPP
+#define MENDER_UPDATE_DAEMON_DEVICE_CONFIG_HPP
+
+#include <functional>
+#include <memory>
+#include <string>
+#include <vector>
+
+#include <api/client.hpp>
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/http.hpp>
+#include <common/processes.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace api = mender::api;
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace http = mender::common::http;
+namespace procs = mender::common::processes;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// In the data store. The configuration being applied is kept next to it, with a `.new` suffix.
+const string kDeviceConfigFile {"device-config.json"};
+
+// Polls the configuration of the device from the deviceconfig API of the server, applies it with
+// the scripts in DeviceConfiguration.ApplyScriptsDir, and reports the applied configuration back
+// to the server. A configuration which fails is rolled back, and not tried again until the server
+// has a different one. See Documentation/device-configuration.md.
+class DeviceConfig {
+public:
+	using HandlerFunction = function<void(error::Error)>;
+	// Receives the applied configuration, as a JSON object.
+	using EmitFunction = function<error::Error(const string &configuration)>;
+
+	DeviceConfig(
+		events::EventLoop &loop,
+		api::Client &client,
+		const cfg_parser::DeviceConfiguration &config,
+		const string &data_store_dir);
+
+	bool Enabled() const {
+		return config_.enabled;
+	}
+
+	// Checks for a new configuration right away, or right after the ongoing check, and then every
+	// poll interval.
+	void Trigger();
+
+	// Applies the given configuration, a JSON object, unless it is the same as the applied one.
+	// If one of the scripts fails, they are all run again with the previous configuration, and
+	// the handler receives the error. The handler is always called asynchronously.
+	void AsyncApply(const string &configuration, HandlerFunction handler);
+
+	// The applied configuration, as a JSON object. `{}` if none has been applied yet.
+	string CurrentJson() const;
+
+	// Announces the applied configurations, see Documentation/io.mender.Configure1.xml.
+	void SetEmitFunction(EmitFunction emit) {
+		emit_ = emit;
+	}
+
+private:
+	using APIResponseHandler =
+		function<void(http::ExpectedIncomingResponsePtr exp_resp, const vector<uint8_t> &body)>;
+
+	void Check();
+	void HandleConfiguration(const string &configuration);
+	void Report(const string &configuration);
+	void Finish();
+	error::Error CallAPI(http::Method method, const string &payload, APIResponseHandler handler);
+
+	void RunScripts(const string &config_path, HandlerFunction handler);
+	void RunNextScript();
+	void FinishScripts(error::Error err);
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	api::Client &client_;
+	cfg_parser::DeviceConfiguration config_;
+	const string path_;
+	EmitFunction emit_;
+
+	// Compact JSON, empty if there is none.
+	string current_;
+	string failed_;
+
+	bool checking_ {false};
+	bool triggered_again_ {false};
+	// The applied configuration is reported once after startup, even if it doesn't change.
+	bool reported_ {false};
+	bool unsupported_logged_ {false};
+
+	// The ongoing run of the scripts, if `scripts_handler_` is set.
+	vector<string> scripts_;
+	size_t next_script_ {0};
+	string script_config_path_;
+	procs::ScriptRunner runner_ {"Device configuration script output"};
+	HandlerFunction scripts_handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_DEVICE_CONFIG_HPP
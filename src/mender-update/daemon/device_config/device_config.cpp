@@ -0,0 +1,356 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/device_config.hpp>
+
+#include <algorithm>
+#include <chrono>
+#include <filesystem>
+
+#include <api/api.hpp>
+#include <common/common.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace fs = std::filesystem;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+static const string kDeviceConfigURI {"/api/devices/v1/deviceconfig/configuration"};
+
+static string UnexpectedResponse(const http::IncomingResponse &resp, const vector<uint8_t> &body) {
+	auto exp_msg = api::ErrorMsgFromErrorResponse(body);
+	return "Got unexpected response " + to_string(resp.GetStatusCode()) + ": "
+		   + (exp_msg ? exp_msg.value() : resp.GetStatusMessage());
+}
+
+static error::Error WriteConfiguration(const string &file, const string &configuration) {
+	auto exp_stream = io::OpenOfstream(file);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), configuration);
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+	return error::NoError;
+}
+
+DeviceConfig::DeviceConfig(
+	events::EventLoop &loop,
+	api::Client &client,
+	const cfg_parser::DeviceConfiguration &config,
+	const string &data_store_dir) :
+	loop_ {loop},
+	timer_ {loop},
+	client_ {client},
+	config_ {config},
+	path_ {path::Join(data_store_dir, kDeviceConfigFile)} {
+	if (!path::FileExists(path_)) {
+		return;
+	}
+	auto exp_json = json::LoadFromFile(path_);
+	if (!exp_json) {
+		log::Warning(
+			"Could not load the applied device configuration: " + exp_json.error().String());
+		return;
+	}
+	current_ = exp_json.value().Dump(-1);
+}
+
+string DeviceConfig::CurrentJson() const {
+	return current_ == "" ? "{}" : current_;
+}
+
+void DeviceConfig::Trigger() {
+	if (checking_) {
+		triggered_again_ = true;
+		return;
+	}
+	timer_.Cancel();
+	Check();
+}
+
+void DeviceConfig::Check() {
+	log::Debug("Checking for a new device configuration");
+	checking_ = true;
+
+	auto err = CallAPI(
+		http::Method::GET,
+		"",
+		[this](http::ExpectedIncomingResponsePtr exp_resp, const vector<uint8_t> &body) {
+			if (!exp_resp) {
+				log::Error(
+					"Could not fetch the device configuration: " + exp_resp.error().String());
+				Finish();
+				return;
+			}
+			auto &resp = *exp_resp.value();
+			if (resp.GetStatusCode() == http::StatusNotFound) {
+				if (!unsupported_logged_) {
+					log::Info("The server does not support device configuration");
+					unsupported_logged_ = true;
+				}
+				Finish();
+				return;
+			}
+			if (resp.GetStatusCode() != http::StatusOK) {
+				log::Error(
+					"Could not fetch the device configuration: " + UnexpectedResponse(resp, body));
+				Finish();
+				return;
+			}
+
+			auto exp_json = json::Load(common::StringFromByteVector(body));
+			if (!exp_json || !exp_json.value().IsObject()) {
+				log::Error("The server sent a device configuration which is not a JSON object");
+				Finish();
+				return;
+			}
+			HandleConfiguration(exp_json.value().Dump(-1));
+		});
+	if (err != error::NoError) {
+		log::Error("Could not fetch the device configuration: " + err.String());
+		Finish();
+	}
+}
+
+void DeviceConfig::HandleConfiguration(const string &configuration) {
+	if (configuration == CurrentJson()) {
+		if (reported_) {
+			Finish();
+		} else {
+			Report(configuration);
+		}
+		return;
+	}
+	if (configuration == failed_) {
+		log::Debug("Not applying the device configuration which failed before again");
+		Finish();
+		return;
+	}
+
+	log::Info("Applying a new device configuration");
+	AsyncApply(configuration, [this, configuration](error::Error err) {
+		if (err != error::NoError) {
+			log::Error("Could not apply the device configuration: " + err.String());
+			failed_ = configuration;
+		}
+		// Either way, the server learns which configuration the device has.
+		Report(CurrentJson());
+	});
+}
+
+void DeviceConfig::Report(const string &configuration) {
+	auto err = CallAPI(
+		http::Method::PUT,
+		configuration,
+		[this](http::ExpectedIncomingResponsePtr exp_resp, const vector<uint8_t> &body) {
+			if (!exp_resp) {
+				log::Error(
+					"Could not report the device configuration: " + exp_resp.error().String());
+			} else if (
+				exp_resp.value()->GetStatusCode() != http::StatusOK
+				&& exp_resp.value()->GetStatusCode() != http::StatusNoContent) {
+				log::Error(
+					"Could not report the device configuration: "
+					+ UnexpectedResponse(*exp_resp.value(), body));
+			} else {
+				log::Debug("Device configuration reported");
+				reported_ = true;
+			}
+			Finish();
+		});
+	if (err != error::NoError) {
+		log::Error("Could not report the device configuration: " + err.String());
+		Finish();
+	}
+}
+
+void DeviceConfig::Finish() {
+	checking_ = false;
+
+	if (triggered_again_) {
+		triggered_again_ = false;
+		// Not from within the handler of the check which just finished.
+		loop_.Post([this]() { Trigger(); });
+		return;
+	}
+
+	timer_.AsyncWait(chrono::seconds {config_.poll_interval_seconds}, [this](error::Error err) {
+		if (err != error::NoError) {
+			if (err.code != make_error_condition(errc::operation_canceled)) {
+				log::Error("Device configuration timer caused error: " + err.String());
+			}
+			return;
+		}
+		Check();
+	});
+}
+
+error::Error DeviceConfig::CallAPI(
+	http::Method method, const string &payload, APIResponseHandler handler) {
+	auto req = make_shared<api::APIRequest>();
+	req->SetPath(kDeviceConfigURI);
+	req->SetMethod(method);
+	req->SetHeader("Accept", "application/json");
+	if (method != http::Method::GET) {
+		req->SetHeader("Content-Type", "application/json");
+		req->SetHeader("Content-Length", to_string(payload.size()));
+		req->SetBodyGenerator([payload]() { return make_shared<io::StringReader>(payload); });
+	}
+
+	auto received_body = make_shared<vector<uint8_t>>();
+	return client_.AsyncCall(
+		req,
+		[received_body, handler](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp) {
+				handler(exp_resp, *received_body);
+				return;
+			}
+			auto body_writer = make_shared<io::ByteWriter>(received_body);
+			body_writer->SetUnlimited(true);
+			exp_resp.value()->SetBodyWriter(body_writer);
+		},
+		[received_body, handler](http::ExpectedIncomingResponsePtr exp_resp) {
+			handler(exp_resp, *received_body);
+		});
+}
+
+void DeviceConfig::AsyncApply(const string &configuration, HandlerFunction handler) {
+	if (configuration == CurrentJson()) {
+		loop_.Post([handler]() { handler(error::NoError); });
+		return;
+	}
+
+	const string new_path = path_ + ".new";
+	auto err = WriteConfiguration(new_path, configuration);
+	if (err != error::NoError) {
+		loop_.Post([handler, err]() {
+			handler(err.WithContext("Could not store the new device configuration"));
+		});
+		return;
+	}
+
+	RunScripts(new_path, [this, configuration, new_path, handler](error::Error err) {
+		if (err == error::NoError) {
+			err = path::Rename(new_path, path_);
+		}
+		if (err == error::NoError) {
+			current_ = configuration;
+			log::Info("Device configuration applied");
+			if (emit_) {
+				auto emit_err = emit_(configuration);
+				if (emit_err != error::NoError) {
+					log::Debug(
+						"Could not announce the applied device configuration: "
+						+ emit_err.String());
+				}
+			}
+			handler(error::NoError);
+			return;
+		}
+
+		path::FileDelete(new_path);
+		if (current_ == "") {
+			handler(err);
+			return;
+		}
+		log::Info("Restoring the previous device configuration");
+		RunScripts(path_, [handler, err](error::Error restore_err) {
+			if (restore_err != error::NoError) {
+				log::Error(
+					"Could not restore the previous device configuration: "
+					+ restore_err.String());
+			}
+			handler(err);
+		});
+	});
+}
+
+void DeviceConfig::RunScripts(const string &config_path, HandlerFunction handler) {
+	scripts_.clear();
+	next_script_ = 0;
+	script_config_path_ = config_path;
+	scripts_handler_ = handler;
+
+	error_code ec;
+	if (fs::is_directory(config_.apply_scripts_dir, ec)) {
+		for (const auto &entry : fs::directory_iterator(config_.apply_scripts_dir, ec)) {
+			error_code entry_ec;
+			if (!entry.is_regular_file(entry_ec)) {
+				continue;
+			}
+			auto exp_executable = path::IsExecutable(entry.path().string(), true);
+			if (exp_executable && exp_executable.value()) {
+				scripts_.push_back(entry.path().string());
+			}
+		}
+		sort(scripts_.begin(), scripts_.end());
+	}
+	if (scripts_.empty()) {
+		log::Warning(
+			"No scripts to apply the device configuration in " + config_.apply_scripts_dir);
+	}
+
+	// Always asynchronously, also when there are no scripts to run.
+	loop_.Post([this]() { RunNextScript(); });
+}
+
+void DeviceConfig::RunNextScript() {
+	if (next_script_ >= scripts_.size()) {
+		FinishScripts(error::NoError);
+		return;
+	}
+
+	const string script = scripts_[next_script_++];
+	log::Debug("Running " + script + " " + script_config_path_);
+
+	auto err = runner_.AsyncRun(
+		loop_,
+		{script, script_config_path_},
+		chrono::seconds {config_.apply_timeout_seconds},
+		[this, script](error::Error err, const string &first_line) {
+			if (err != error::NoError) {
+				FinishScripts(err.WithContext(script + " failed"));
+				return;
+			}
+			RunNextScript();
+		});
+	if (err != error::NoError) {
+		FinishScripts(err.WithContext("Could not run " + script));
+	}
+}
+
+void DeviceConfig::FinishScripts(error::Error err) {
+	runner_.Cancel();
+	auto handler = scripts_handler_;
+	scripts_handler_ = nullptr;
+	handler(err);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
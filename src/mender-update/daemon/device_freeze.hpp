@@ -0,0 +1,88 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_DEVICE_FREEZE_HPP
+#define MENDER_UPDATE_DAEMON_DEVICE_FREEZE_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/optional.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+// In the data store.
+const string kDeviceFreezeFile {"device-freeze"};
+
+struct FreezePeriod {
+	// In seconds since the epoch. `until` is 0 when the freeze lasts until it is released.
+	int64_t since {0};
+	int64_t until {0};
+};
+using ExpectedOptionalFreezePeriod = expected::expected<optional<FreezePeriod>, error::Error>;
+
+using ExpectedOptionalTimePoint =
+	expected::expected<optional<chrono::system_clock::time_point>, error::Error>;
+
+// The end of a freeze, as an RFC 3339 timestamp, or nothing for an empty string, which freezes
+// the device until it is released.
+ExpectedOptionalTimePoint ParseFreezeUntil(const string &until);
+
+// Holds back the deployments while the device must not change, until a given time or until
+// released, see Documentation/device-freeze.md. Kept in a file of its own, so that it is still in
+// effect after a restart, and so that `mender-update freeze` works without the daemon.
+class DeviceFreeze {
+public:
+	using Clock = chrono::system_clock;
+
+	DeviceFreeze(const string &path);
+
+	// Replaces any earlier freeze. Without `until`, the device stays frozen until released.
+	error::Error Freeze(optional<Clock::time_point> until, Clock::time_point now = Clock::now());
+	// Does nothing if the device isn't frozen.
+	error::Error Release();
+
+	// The freeze in effect at `now`. Nothing if there is none, or if it has ended.
+	ExpectedOptionalFreezePeriod Current(Clock::time_point now = Clock::now()) const;
+	// When the freeze can't be read, the device is taken to be frozen, since it may well be, and
+	// the error is logged.
+	bool Frozen(Clock::time_point now = Clock::now()) const;
+
+	// Why the deployments are held back, as reported to the server, such as "Frozen on the device
+	// until released".
+	static string Reason(const FreezePeriod &freeze);
+
+	// The freeze in effect as a JSON object, `null` if there is none.
+	string ToJson(Clock::time_point now = Clock::now()) const;
+
+private:
+	string path_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_DEVICE_FREEZE_HPP
@@ -0,0 +1,175 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/device_freeze.hpp>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+#include <mender-update/context.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+namespace main_context = mender::update::context;
+
+static int64_t ToSeconds(DeviceFreeze::Clock::time_point time) {
+	return chrono::duration_cast<chrono::seconds>(time.time_since_epoch()).count();
+}
+
+static string FreezeToJson(const FreezePeriod &freeze) {
+	return R"({"since":)" + to_string(freeze.since) + R"(,"until":)"
+		   + (freeze.until == 0 ? "null" : to_string(freeze.until)) + "}";
+}
+
+static expected::expected<FreezePeriod, error::Error> FreezeFromJson(
+	const json::Json &freeze_json) {
+	FreezePeriod freeze;
+	auto exp_since = freeze_json.Get("since").and_then(json::ToInt64);
+	if (!exp_since) {
+		return expected::unexpected(exp_since.error());
+	}
+	freeze.since = exp_since.value();
+
+	auto exp_until = freeze_json.Get("until");
+	if (exp_until && !exp_until.value().IsNull()) {
+		auto exp_seconds = exp_until.value().GetInt64();
+		if (!exp_seconds) {
+			return expected::unexpected(exp_seconds.error());
+		}
+		freeze.until = exp_seconds.value();
+	}
+
+	return freeze;
+}
+
+ExpectedOptionalTimePoint ParseFreezeUntil(const string &until) {
+	if (until == "") {
+		return optional<chrono::system_clock::time_point> {};
+	}
+	auto time = main_context::ParseRfc3339Time(until);
+	if (!time) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"Invalid time to freeze the device until: '" + until
+				+ "', expected an RFC 3339 timestamp, such as 2026-11-01T00:00:00Z"));
+	}
+	return time;
+}
+
+DeviceFreeze::DeviceFreeze(const string &path) :
+	path_ {path} {
+}
+
+error::Error DeviceFreeze::Freeze(optional<Clock::time_point> until, Clock::time_point now) {
+	if (until && until.value() <= now) {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"Cannot freeze the device until " + main_context::FormatEligibilityTime(until.value())
+				+ ", which has already passed");
+	}
+
+	FreezePeriod freeze;
+	freeze.since = ToSeconds(now);
+	if (until) {
+		freeze.until = ToSeconds(until.value());
+	}
+	log::Info("Device frozen, holding back the deployments: " + Reason(freeze));
+
+	// Replaced in one go, so that a restart never sees a partial file.
+	const string tmp_path = path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), FreezeToJson(freeze) + "\n");
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, path_);
+}
+
+error::Error DeviceFreeze::Release() {
+	if (!path::FileExists(path_)) {
+		return error::NoError;
+	}
+	log::Info("Device freeze released");
+	return path::FileDelete(path_);
+}
+
+ExpectedOptionalFreezePeriod DeviceFreeze::Current(Clock::time_point now) const {
+	if (!path::FileExists(path_)) {
+		return optional<FreezePeriod> {};
+	}
+
+	auto exp_json = json::LoadFromFile(path_);
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+	auto exp_freeze = FreezeFromJson(exp_json.value());
+	if (!exp_freeze) {
+		return expected::unexpected(exp_freeze.error().WithContext("Invalid " + path_));
+	}
+	const auto &freeze = exp_freeze.value();
+	if (freeze.until != 0 && freeze.until <= ToSeconds(now)) {
+		return optional<FreezePeriod> {};
+	}
+	return optional<FreezePeriod> {freeze};
+}
+
+bool DeviceFreeze::Frozen(Clock::time_point now) const {
+	auto exp_freeze = Current(now);
+	if (!exp_freeze) {
+		log::Error(
+			"Could not read the device freeze, taking the device to be frozen: "
+			+ exp_freeze.error().String());
+		return true;
+	}
+	return bool(exp_freeze.value());
+}
+
+string DeviceFreeze::Reason(const FreezePeriod &freeze) {
+	if (freeze.until == 0) {
+		return "Frozen on the device until released";
+	}
+	return "Frozen on the device until "
+		   + main_context::FormatEligibilityTime(Clock::from_time_t(static_cast<time_t>(freeze.until)));
+}
+
+string DeviceFreeze::ToJson(Clock::time_point now) const {
+	auto exp_freeze = Current(now);
+	if (!exp_freeze) {
+		log::Warning("Could not load the device freeze: " + exp_freeze.error().String());
+		return "null";
+	}
+	if (!exp_freeze.value()) {
+		return "null";
+	}
+	return FreezeToJson(exp_freeze.value().value());
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,59 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_FAILURE_CATEGORY_HPP
+#define MENDER_UPDATE_DAEMON_FAILURE_CATEGORY_HPP
+
+#include <string>
+
+#include <common/error.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+
+// Why a deployment failed, in the substate of its Failure status, so that the failures can be
+// counted on the server without reading the logs. See Documentation/failure-categories.md.
+enum class FailureCategory {
+	None = 0,
+	Network,
+	Signature,
+	Depends,
+	Storage,
+	Script,
+	Module,
+	Timeout,
+};
+
+string FailureCategoryString(FailureCategory category);
+// None for anything else than the strings above, for example from a newer client.
+FailureCategory FailureCategoryFromString(const string &str);
+
+// The category which the error tells by itself, or None. A process which exits with an error is a
+// script or an Update Module failure, depending on which process it was, which only the caller
+// knows.
+FailureCategory ClassifyError(const error::Error &err);
+
+// "[<category>] <substate>", or only the substate if there is no category.
+string FailureSubstate(FailureCategory category, const string &substate);
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_FAILURE_CATEGORY_HPP
@@ -0,0 +1,163 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/failure_category.hpp>
+
+#include <system_error>
+
+#include <api/auth.hpp>
+#include <artifact/error.hpp>
+#include <artifact/sha/sha.hpp>
+#include <artifact/v3/scripts/error.hpp>
+#include <common/http.hpp>
+#include <common/key_value_database.hpp>
+#include <mender-update/context.hpp>
+#include <mender-update/deployments.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace auth = mender::api::auth;
+namespace deployments = mender::update::deployments;
+namespace http = mender::common::http;
+namespace kv_db = mender::common::key_value_database;
+namespace main_context = mender::update::context;
+namespace parser_error = mender::artifact::parser_error;
+namespace script_executor = mender::artifact::scripts::executor;
+namespace sha = mender::sha;
+
+string FailureCategoryString(FailureCategory category) {
+	switch (category) {
+	case FailureCategory::None:
+		return "";
+	case FailureCategory::Network:
+		return "network";
+	case FailureCategory::Signature:
+		return "signature";
+	case FailureCategory::Depends:
+		return "depends";
+	case FailureCategory::Storage:
+		return "storage";
+	case FailureCategory::Script:
+		return "script";
+	case FailureCategory::Module:
+		return "module";
+	case FailureCategory::Timeout:
+		return "timeout";
+	}
+	// Should not happen.
+	return "";
+}
+
+FailureCategory FailureCategoryFromString(const string &str) {
+	for (auto category :
+		 {FailureCategory::Network,
+		  FailureCategory::Signature,
+		  FailureCategory::Depends,
+		  FailureCategory::Storage,
+		  FailureCategory::Script,
+		  FailureCategory::Module,
+		  FailureCategory::Timeout}) {
+		if (str == FailureCategoryString(category)) {
+			return category;
+		}
+	}
+	return FailureCategory::None;
+}
+
+static bool IsNetworkErrno(const error_condition &code) {
+	for (auto errc_value :
+		 {errc::connection_refused,
+		  errc::connection_reset,
+		  errc::connection_aborted,
+		  errc::network_down,
+		  errc::network_unreachable,
+		  errc::network_reset,
+		  errc::host_unreachable,
+		  errc::not_connected}) {
+		if (code == make_error_condition(errc_value)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+static bool IsStorageErrno(const error_condition &code) {
+	for (auto errc_value :
+		 {errc::no_space_on_device,
+		  errc::io_error,
+		  errc::read_only_file_system,
+		  errc::file_too_large}) {
+		if (code == make_error_condition(errc_value)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+FailureCategory ClassifyError(const error::Error &err) {
+	const auto &code = err.code;
+	if (code == make_error_condition(errc::timed_out)) {
+		return FailureCategory::Timeout;
+	}
+
+	if (code == parser_error::MakeError(parser_error::SignatureVerificationError, "").code
+		|| code == sha::MakeError(sha::ShasumMismatchError, "").code) {
+		return FailureCategory::Signature;
+	}
+
+	if (code
+		== main_context::MakeError(main_context::ArtifactDependsNotSatisfiedError, "").code) {
+		return FailureCategory::Depends;
+	}
+	if (code == main_context::MakeError(main_context::NoSuchUpdateModuleError, "").code) {
+		return FailureCategory::Module;
+	}
+	if (code == main_context::MakeError(main_context::WorkDirQuotaExceededError, "").code
+		|| code.category() == kv_db::KeyValueDatabaseErrorCategory || IsStorageErrno(code)) {
+		return FailureCategory::Storage;
+	}
+
+	if (code.category() == script_executor::ErrorCategory) {
+		return FailureCategory::Script;
+	}
+
+	// An abort isn't a failure of the device.
+	if (code == deployments::MakeError(deployments::DeploymentAbortedError, "").code) {
+		return FailureCategory::None;
+	}
+	if (code.category() == http::HttpErrorCategory
+		|| code.category() == deployments::DeploymentsErrorCategory
+		|| code.category() == auth::AuthenticatorErrorCategory || IsNetworkErrno(code)) {
+		return FailureCategory::Network;
+	}
+
+	return FailureCategory::None;
+}
+
+string FailureSubstate(FailureCategory category, const string &substate) {
+	if (category == FailureCategory::None) {
+		return substate;
+	}
+	string prefix = "[" + FailureCategoryString(category) + "]";
+	if (substate == "") {
+		return prefix;
+	}
+	return prefix + " " + substate;
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
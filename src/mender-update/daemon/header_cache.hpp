@@ -0,0 +1,97 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_HEADER_CACHE_HPP
+#define MENDER_UPDATE_DAEMON_HEADER_CACHE_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/optional.hpp>
+
+#include <artifact/artifact.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+namespace artifact = mender::artifact;
+
+// In the data store.
+const string kArtifactHeaderCacheFile {"artifact-header-cache"};
+
+struct CachedHeader {
+	string artifact_name;
+	// The checksum of `header.tar` in the manifest of the Artifact.
+	string checksum;
+	// In seconds since the epoch.
+	int64_t cached {0};
+	// `{"header-info": ..., "type-info": ..., "meta-data": ...}`, as taken by
+	// `artifact::HeaderViewFromJson()`.
+	string header_json;
+};
+using ExpectedCachedHeaders = expected::expected<vector<CachedHeader>, error::Error>;
+using ExpectedOptionalCachedHeader = expected::expected<optional<CachedHeader>, error::Error>;
+
+// The headers of the latest Artifacts which have been downloaded, by Artifact name, so that an
+// Artifact which is offered again, for example when a deployment is retried, can be checked
+// without pre-fetching its header. Kept in a file of their own, one JSON object per line. See
+// Documentation/artifact-header-cache.md.
+class HeaderCache {
+public:
+	using Clock = chrono::system_clock;
+
+	// Keeps the latest `size` headers. 0 caches nothing, and leaves the file alone.
+	HeaderCache(const string &path, size_t size);
+
+	// Replaces the header cached for the same Artifact name, if any, and drops the oldest ones
+	// beyond the size. `checksum` is the checksum of the header in the manifest, which has been
+	// verified along with the signature of the Artifact, if any.
+	error::Error Store(
+		const artifact::HeaderView &header,
+		const string &checksum,
+		Clock::time_point now = Clock::now());
+	error::Error Remove(const string &artifact_name);
+
+	// Empty if the Artifact isn't cached.
+	ExpectedOptionalCachedHeader Find(const string &artifact_name) const;
+
+	// The oldest first. Lines which can't be parsed are skipped.
+	ExpectedCachedHeaders Load() const;
+
+	// One JSON object, with the header as an object.
+	static string ToJson(const CachedHeader &cached);
+
+private:
+	error::Error Save(const vector<CachedHeader> &headers) const;
+
+	string path_;
+	size_t size_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_HEADER_CACHE_HPP
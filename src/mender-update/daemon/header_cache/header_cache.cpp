@@ -0,0 +1,220 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/header_cache.hpp>
+
+#include <algorithm>
+#include <fstream>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+static string HeaderToJson(const artifact::HeaderView &header) {
+	string result = R"({"header-info":)" + header.header_info.verbatim.Dump(-1)
+					+ R"(,"type-info":)" + header.type_info.verbatim.Dump(-1);
+	if (header.meta_data.IsObject()) {
+		result += R"(,"meta-data":)" + header.meta_data.Dump(-1);
+	}
+	return result + "}";
+}
+
+static expected::expected<CachedHeader, error::Error> CachedHeaderFromJson(const string &line) {
+	auto exp_json = json::Load(line);
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+	auto &cached_json = exp_json.value();
+
+	CachedHeader cached;
+	auto exp_string = cached_json.Get("artifact_name").and_then(json::ToString);
+	if (!exp_string) {
+		return expected::unexpected(exp_string.error());
+	}
+	cached.artifact_name = exp_string.value();
+
+	exp_string = cached_json.Get("checksum").and_then(json::ToString);
+	if (!exp_string) {
+		return expected::unexpected(exp_string.error());
+	}
+	cached.checksum = exp_string.value();
+
+	auto exp_cached = cached_json.Get("cached").and_then(json::ToInt64);
+	if (!exp_cached) {
+		return expected::unexpected(exp_cached.error());
+	}
+	cached.cached = exp_cached.value();
+
+	auto exp_header = cached_json.Get("header");
+	if (!exp_header) {
+		return expected::unexpected(exp_header.error());
+	}
+	if (!exp_header.value().IsObject()) {
+		return expected::unexpected(
+			json::MakeError(json::TypeError, "The cached header is not a JSON object"));
+	}
+	cached.header_json = exp_header.value().Dump(-1);
+
+	return cached;
+}
+
+HeaderCache::HeaderCache(const string &path, size_t size) :
+	path_ {path},
+	size_ {size} {
+}
+
+error::Error HeaderCache::Store(
+	const artifact::HeaderView &header, const string &checksum, Clock::time_point now) {
+	if (size_ == 0) {
+		return error::NoError;
+	}
+
+	auto exp_headers = Load();
+	if (!exp_headers) {
+		return exp_headers.error();
+	}
+	auto &headers = exp_headers.value();
+
+	for (auto it = headers.begin(); it != headers.end(); it++) {
+		if (it->artifact_name == header.artifact_name) {
+			if (it->checksum != checksum) {
+				log::Info(
+					"The header of Artifact " + header.artifact_name
+					+ " has changed since it was cached, replacing it");
+			}
+			headers.erase(it);
+			break;
+		}
+	}
+
+	CachedHeader cached;
+	cached.artifact_name = header.artifact_name;
+	cached.checksum = checksum;
+	cached.cached = chrono::duration_cast<chrono::seconds>(now.time_since_epoch()).count();
+	cached.header_json = HeaderToJson(header);
+	headers.push_back(cached);
+	if (headers.size() > size_) {
+		headers.erase(headers.begin(), headers.end() - static_cast<ptrdiff_t>(size_));
+	}
+
+	return Save(headers);
+}
+
+error::Error HeaderCache::Remove(const string &artifact_name) {
+	if (size_ == 0) {
+		return error::NoError;
+	}
+
+	auto exp_headers = Load();
+	if (!exp_headers) {
+		return exp_headers.error();
+	}
+	auto &headers = exp_headers.value();
+
+	auto size_before = headers.size();
+	headers.erase(
+		remove_if(
+			headers.begin(),
+			headers.end(),
+			[&artifact_name](const CachedHeader &cached) {
+				return cached.artifact_name == artifact_name;
+			}),
+		headers.end());
+	if (headers.size() == size_before) {
+		return error::NoError;
+	}
+
+	return Save(headers);
+}
+
+ExpectedOptionalCachedHeader HeaderCache::Find(const string &artifact_name) const {
+	auto exp_headers = Load();
+	if (!exp_headers) {
+		return expected::unexpected(exp_headers.error());
+	}
+	for (const auto &cached : exp_headers.value()) {
+		if (cached.artifact_name == artifact_name) {
+			return optional<CachedHeader> {cached};
+		}
+	}
+	return optional<CachedHeader> {};
+}
+
+ExpectedCachedHeaders HeaderCache::Load() const {
+	vector<CachedHeader> headers;
+	if (!path::FileExists(path_)) {
+		return headers;
+	}
+
+	auto exp_stream = io::OpenIfstream(path_);
+	if (!exp_stream) {
+		return expected::unexpected(exp_stream.error());
+	}
+	string line;
+	while (getline(exp_stream.value(), line)) {
+		if (line == "") {
+			continue;
+		}
+		auto exp_cached = CachedHeaderFromJson(line);
+		if (!exp_cached) {
+			log::Warning(
+				"Skipping an invalid header in " + path_ + ": " + exp_cached.error().String());
+			continue;
+		}
+		headers.push_back(exp_cached.value());
+	}
+	return headers;
+}
+
+error::Error HeaderCache::Save(const vector<CachedHeader> &headers) const {
+	string content;
+	for (const auto &cached : headers) {
+		content += ToJson(cached) + "\n";
+	}
+
+	// Replaced in one go, so that a crash never leaves a partial file behind.
+	const string tmp_path = path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, path_);
+}
+
+string HeaderCache::ToJson(const CachedHeader &cached) {
+	return R"({"artifact_name":")" + json::EscapeString(cached.artifact_name)
+		   + R"(","checksum":")" + json::EscapeString(cached.checksum) + R"(","cached":)"
+		   + to_string(cached.cached) + R"(,"header":)" + cached.header_json + "}";
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,108 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_HEADER_PREFETCH_HPP
+#define MENDER_UPDATE_DAEMON_HEADER_PREFETCH_HPP
+
+#include <cstdint>
+#include <functional>
+#include <memory>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+#include <common/http.hpp>
+#include <common/io.hpp>
+#include <common/optional.hpp>
+
+#include <artifact/artifact.hpp>
+#include <artifact/config.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+namespace http = mender::common::http;
+namespace io = mender::common::io;
+
+namespace artifact = mender::artifact;
+
+// Fetches the beginning of an Artifact with a ranged request, and parses its header, so that an
+// Artifact which cannot be installed is rejected before the whole of it is downloaded. This runs
+// in the background, while the deployment goes on with the states leading up to the download.
+class HeaderPrefetch {
+public:
+	struct Result {
+		artifact::PayloadHeaderView header;
+		// Name and size of the first payload file, if it was within the fetched range.
+		string payload_name;
+		optional<int64_t> payload_size;
+		// From the header cache rather than from the Artifact itself.
+		bool cached {false};
+	};
+	using ExpectedResult = expected::expected<Result, error::Error>;
+	using HandlerFunction = function<void(ExpectedResult)>;
+
+	HeaderPrefetch(events::EventLoop &loop, const http::ClientConfig &config);
+
+	// Starts fetching the first `max_bytes` of the Artifact at `uri`, cancelling any earlier
+	// pre-fetch. `config` is used to parse the header.
+	void Start(const string &uri, int64_t max_bytes, const artifact::config::ParserConfig &config);
+	// Like `Start()`, but with a result which is already known, cancelling any earlier pre-fetch.
+	void StartWithResult(const Result &result);
+
+	// True between `Start()` and the call to the handler of `AsyncWaitResult()`.
+	bool Started() const {
+		return started_;
+	}
+
+	// Calls the handler once the header has been parsed, or fetching or parsing it has failed.
+	// The handler is always called asynchronously.
+	void AsyncWaitResult(HandlerFunction handler);
+
+	void Cancel();
+
+private:
+	void ReadMore();
+	void Parse();
+	void Finish(ExpectedResult result);
+	void MaybeCallHandler();
+
+	events::EventLoop &loop_;
+	http::Client client_;
+
+	bool started_ {false};
+	// Incremented for each pre-fetch, so that late callbacks from an earlier one are ignored.
+	uint64_t generation_ {0};
+	artifact::config::ParserConfig parser_config_;
+	vector<uint8_t> buffer_;
+	size_t received_ {0};
+	io::AsyncReaderPtr body_reader_;
+
+	optional<ExpectedResult> result_;
+	HandlerFunction handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_HEADER_PREFETCH_HPP
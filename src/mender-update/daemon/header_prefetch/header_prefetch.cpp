@@ -0,0 +1,220 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/header_prefetch.hpp>
+
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+HeaderPrefetch::HeaderPrefetch(events::EventLoop &loop, const http::ClientConfig &config) :
+	loop_ {loop},
+	client_ {config, loop, "header_prefetch"} {
+}
+
+void HeaderPrefetch::Start(
+	const string &uri, int64_t max_bytes, const artifact::config::ParserConfig &config) {
+	Cancel();
+
+	started_ = true;
+	parser_config_ = config;
+	buffer_.resize(max_bytes);
+	received_ = 0;
+
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	auto err = req->SetAddress(uri);
+	if (err != error::NoError) {
+		Finish(expected::unexpected(err));
+		return;
+	}
+	// Servers which don't support ranges send the whole Artifact. In that case the connection is
+	// closed as soon as enough of it has been received.
+	req->SetHeader("Range", "bytes=0-" + to_string(max_bytes - 1));
+
+	log::Debug("Pre-fetching the first " + to_string(max_bytes) + " bytes of the Artifact");
+
+	auto generation = generation_;
+	err = client_.AsyncCall(
+		req,
+		[this, generation](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (generation != generation_) {
+				return;
+			}
+			if (!exp_resp) {
+				Finish(expected::unexpected(exp_resp.error()));
+				return;
+			}
+
+			auto &resp = exp_resp.value();
+			if (resp->GetStatusCode() != http::StatusOK
+				&& resp->GetStatusCode() != http::StatusPartialContent) {
+				Finish(expected::unexpected(error::Error(
+					make_error_condition(errc::protocol_error),
+					"Unexpected status code while pre-fetching the Artifact header: "
+						+ resp->GetStatusMessage())));
+				return;
+			}
+
+			auto exp_reader = client_.MakeBodyAsyncReader(resp);
+			if (!exp_reader) {
+				Finish(expected::unexpected(exp_reader.error()));
+				return;
+			}
+			body_reader_ = exp_reader.value();
+			ReadMore();
+		},
+		[this, generation](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (generation != generation_) {
+				return;
+			}
+			if (!exp_resp) {
+				Finish(expected::unexpected(exp_resp.error()));
+			}
+		});
+	if (err != error::NoError) {
+		Finish(expected::unexpected(err));
+	}
+}
+
+void HeaderPrefetch::StartWithResult(const Result &result) {
+	Cancel();
+
+	started_ = true;
+	Finish(result);
+}
+
+void HeaderPrefetch::ReadMore() {
+	auto generation = generation_;
+	auto err = body_reader_->AsyncRead(
+		buffer_.begin() + received_, buffer_.end(), [this, generation](io::ExpectedSize exp_read) {
+			if (generation != generation_) {
+				return;
+			}
+			if (!exp_read) {
+				Finish(expected::unexpected(exp_read.error()));
+				return;
+			}
+			received_ += exp_read.value();
+			if (exp_read.value() == 0 || received_ == buffer_.size()) {
+				Parse();
+				return;
+			}
+			ReadMore();
+		});
+	if (err != error::NoError) {
+		Finish(expected::unexpected(err));
+	}
+}
+
+void HeaderPrefetch::Parse() {
+	// The parser extracts the state scripts from the header, but the real ones are only
+	// extracted during the download.
+	const auto &scripts_path = parser_config_.artifact_scripts_filesystem_path;
+	auto delete_scripts = [&scripts_path]() {
+		auto err = path::DeleteRecursively(scripts_path);
+		if (err != error::NoError) {
+			log::Warning("Could not clean up pre-fetched state scripts: " + err.String());
+		}
+	};
+
+	buffer_.resize(received_);
+	io::ByteReader reader {buffer_};
+	auto exp_artifact = artifact::Parse(reader, parser_config_);
+	if (!exp_artifact) {
+		delete_scripts();
+		Finish(expected::unexpected(exp_artifact.error()));
+		return;
+	}
+	auto &parsed = exp_artifact.value();
+
+	auto exp_header = artifact::View(parsed, 0);
+	delete_scripts();
+	if (!exp_header) {
+		Finish(expected::unexpected(exp_header.error()));
+		return;
+	}
+
+	Result result {exp_header.value(), "", nullopt};
+	if (result.header.header.payload_type != "") {
+		// Only known if the start of the payload was also fetched, so errors are expected here.
+		auto exp_payload = parsed.Next();
+		if (exp_payload) {
+			auto exp_file = exp_payload.value().Next();
+			if (exp_file) {
+				result.payload_name = exp_file.value().Name();
+				result.payload_size = exp_file.value().Size();
+			}
+		}
+	}
+	Finish(result);
+}
+
+void HeaderPrefetch::Finish(ExpectedResult result) {
+	// Nothing more is expected from this pre-fetch, ignore what the cancellations below may cause.
+	generation_++;
+	result_ = result;
+	if (body_reader_) {
+		body_reader_->Cancel();
+		body_reader_.reset();
+	}
+	client_.Cancel();
+	buffer_.clear();
+	buffer_.shrink_to_fit();
+	MaybeCallHandler();
+}
+
+void HeaderPrefetch::AsyncWaitResult(HandlerFunction handler) {
+	handler_ = handler;
+	MaybeCallHandler();
+}
+
+void HeaderPrefetch::MaybeCallHandler() {
+	if (!result_ || !handler_) {
+		return;
+	}
+	auto handler = handler_;
+	auto result = result_.value();
+	auto generation = generation_;
+	handler_ = nullptr;
+	result_.reset();
+	started_ = false;
+	loop_.Post([this, handler, result, generation]() {
+		if (generation == generation_) {
+			handler(result);
+		}
+	});
+}
+
+void HeaderPrefetch::Cancel() {
+	generation_++;
+	started_ = false;
+	result_.reset();
+	handler_ = nullptr;
+	if (body_reader_) {
+		body_reader_->Cancel();
+		body_reader_.reset();
+	}
+	client_.Cancel();
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,91 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_INVENTORY_SCHEDULER_HPP
+#define MENDER_UPDATE_DAEMON_INVENTORY_SCHEDULER_HPP
+
+#include <chrono>
+#include <memory>
+#include <string>
+
+#include <api/client.hpp>
+#include <common/events.hpp>
+#include <common/http.hpp>
+
+#include <mender-update/daemon/loop_health.hpp>
+#include <mender-update/daemon/poll_splay.hpp>
+#include <mender-update/inventory.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace api = mender::api;
+namespace events = mender::common::events;
+namespace http = mender::common::http;
+namespace inventory = mender::update::inventory;
+
+// Submits the inventory on its own schedule, with InventorySubmission.Independent, instead of the
+// state machine doing it between the update checks. With a client of its own, a hanging inventory
+// script or a slow inventory API holds back neither the update checks nor the deployments, and
+// the other way around, see Documentation/inventory-submission.md.
+class InventoryScheduler {
+public:
+	InventoryScheduler(
+		events::EventLoop &loop,
+		api::Client &client,
+		shared_ptr<inventory::InventoryAPI> inventory,
+		LoopHealth &health,
+		const string &scripts_dir,
+		chrono::seconds interval,
+		PollSplay &splay,
+		chrono::seconds retry_interval,
+		int retry_count);
+
+	// Submits the inventory right away, or right after the ongoing submission, and then every
+	// interval. Failed submissions are retried with a backoff, or as the server asks.
+	void Trigger();
+
+	// Used from the next submission on.
+	void SetInterval(chrono::seconds interval) {
+		interval_ = interval;
+	}
+
+private:
+	void Submit();
+	void HandleResponse(inventory::APIResponse resp);
+	void ScheduleNext(chrono::milliseconds interval);
+	chrono::milliseconds RetryInterval(const inventory::APIResponse &resp);
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	api::Client &client_;
+	shared_ptr<inventory::InventoryAPI> inventory_;
+	LoopHealth &health_;
+	const string scripts_dir_;
+	chrono::seconds interval_;
+	PollSplay &splay_;
+	http::ExponentialBackoff backoff_;
+
+	bool submitting_ {false};
+	bool triggered_again_ {false};
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_INVENTORY_SCHEDULER_HPP
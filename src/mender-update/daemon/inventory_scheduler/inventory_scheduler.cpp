@@ -0,0 +1,141 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/inventory_scheduler.hpp>
+
+#include <common/error.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace error = mender::common::error;
+namespace log = mender::common::log;
+
+InventoryScheduler::InventoryScheduler(
+	events::EventLoop &loop,
+	api::Client &client,
+	shared_ptr<inventory::InventoryAPI> inventory,
+	LoopHealth &health,
+	const string &scripts_dir,
+	chrono::seconds interval,
+	PollSplay &splay,
+	chrono::seconds retry_interval,
+	int retry_count) :
+	loop_ {loop},
+	timer_ {loop},
+	client_ {client},
+	inventory_ {inventory},
+	health_ {health},
+	scripts_dir_ {scripts_dir},
+	interval_ {interval},
+	splay_ {splay},
+	backoff_ {retry_interval, retry_count} {
+	// Like in SubmitInventoryState, a retry interval shorter than the smallest interval of the
+	// backoff turns it into a fixed interval.
+	if (chrono::milliseconds {retry_interval} < backoff_.SmallestInterval()) {
+		backoff_.SetSmallestInterval(retry_interval);
+		backoff_.SetMaxInterval(retry_interval);
+	}
+}
+
+void InventoryScheduler::Trigger() {
+	if (submitting_) {
+		triggered_again_ = true;
+		return;
+	}
+	timer_.Cancel();
+	Submit();
+}
+
+void InventoryScheduler::Submit() {
+	log::Debug("Submitting inventory");
+	submitting_ = true;
+	health_.Started();
+
+	auto err = inventory_->PushData(
+		scripts_dir_, loop_, client_, [this](inventory::APIResponse resp) {
+			HandleResponse(resp);
+		});
+	if (err != error::NoError) {
+		// The handler isn't called for us then.
+		HandleResponse(inventory::APIResponse {nullopt, nullopt, err});
+	}
+}
+
+void InventoryScheduler::HandleResponse(inventory::APIResponse resp) {
+	submitting_ = false;
+
+	chrono::milliseconds next {splay_.Apply(interval_)};
+	if (resp.error != error::NoError) {
+		log::Error("Failed to submit inventory: " + resp.error.String());
+		health_.Failed(resp.error.String());
+		next = RetryInterval(resp);
+		log::Info(
+			"Retrying inventory submission in "
+			+ to_string(chrono::duration_cast<chrono::seconds>(next).count()) + " seconds");
+	} else {
+		backoff_.Reset();
+		inventory_->has_submitted_inventory = true;
+		health_.Succeeded();
+	}
+
+	if (triggered_again_) {
+		triggered_again_ = false;
+		// Not from within the handler of the submission which just finished.
+		loop_.Post([this]() { Trigger(); });
+		return;
+	}
+	ScheduleNext(next);
+}
+
+chrono::milliseconds InventoryScheduler::RetryInterval(const inventory::APIResponse &resp) {
+	if (resp.http_code.has_value() && resp.http_code.value() == http::StatusTooManyRequests
+		&& resp.http_headers.has_value()) {
+		auto retry_after_header = resp.http_headers.value().find("Retry-After");
+		if (retry_after_header != resp.http_headers.value().end()) {
+			auto exp_interval = http::GetRemainingTime(retry_after_header->second);
+			if (exp_interval) {
+				return exp_interval.value();
+			}
+			log::Debug("Could not get the Retry-After value from HTTP response");
+		}
+	}
+
+	auto exp_interval = backoff_.NextInterval();
+	if (!exp_interval) {
+		log::Debug(
+			"Not retrying with backoff, retrying InventoryPollIntervalSeconds: "
+			+ exp_interval.error().String());
+		return splay_.Apply(interval_);
+	}
+	return exp_interval.value();
+}
+
+void InventoryScheduler::ScheduleNext(chrono::milliseconds interval) {
+	timer_.AsyncWait(interval, [this](error::Error err) {
+		if (err != error::NoError) {
+			if (err.code != make_error_condition(errc::operation_canceled)) {
+				log::Error("Inventory submission timer caused error: " + err.String());
+			}
+			return;
+		}
+		Submit();
+	});
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
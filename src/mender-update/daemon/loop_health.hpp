@@ -0,0 +1,63 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_LOOP_HEALTH_HPP
+#define MENDER_UPDATE_DAEMON_LOOP_HEALTH_HPP
+
+#include <chrono>
+#include <string>
+
+#include <common/optional.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+// How a job which the daemon does over and over, such as the update check, has been doing, as
+// shown by `mender-update status`.
+class LoopHealth {
+public:
+	using Clock = chrono::system_clock;
+
+	void Started(Clock::time_point now = Clock::now());
+	void Succeeded(Clock::time_point now = Clock::now());
+	void Failed(const string &error, Clock::time_point now = Clock::now());
+
+	bool Running() const {
+		return running_since_.has_value();
+	}
+	// Successive failures, 0 if the last attempt succeeded.
+	int Failures() const {
+		return failures_;
+	}
+
+	// As a JSON object, with the times in seconds since the epoch, see
+	// Documentation/daemon-status.md.
+	string ToJson() const;
+
+private:
+	optional<Clock::time_point> running_since_;
+	optional<Clock::time_point> last_success_;
+	optional<Clock::time_point> last_failure_;
+	string last_error_;
+	int failures_ {0};
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_LOOP_HEALTH_HPP
@@ -0,0 +1,61 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/loop_health.hpp>
+
+#include <common/json.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace json = mender::common::json;
+
+void LoopHealth::Started(Clock::time_point now) {
+	running_since_ = now;
+}
+
+void LoopHealth::Succeeded(Clock::time_point now) {
+	running_since_.reset();
+	last_success_ = now;
+	last_error_ = "";
+	failures_ = 0;
+}
+
+void LoopHealth::Failed(const string &error, Clock::time_point now) {
+	running_since_.reset();
+	last_failure_ = now;
+	last_error_ = error;
+	failures_++;
+}
+
+static string TimeToJson(const optional<LoopHealth::Clock::time_point> &time) {
+	if (!time) {
+		return "null";
+	}
+	return to_string(
+		chrono::duration_cast<chrono::seconds>(time.value().time_since_epoch()).count());
+}
+
+string LoopHealth::ToJson() const {
+	return R"({"healthy":)" + string(failures_ == 0 ? "true" : "false")
+		   + R"(,"running_since":)" + TimeToJson(running_since_) + R"(,"last_success":)"
+		   + TimeToJson(last_success_) + R"(,"last_failure":)" + TimeToJson(last_failure_)
+		   + R"(,"last_error":")" + json::EscapeString(last_error_) + R"(","failures":)"
+		   + to_string(failures_) + "}";
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
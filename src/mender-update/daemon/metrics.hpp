@@ -0,0 +1,149 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_METRICS_HPP
+#define MENDER_UPDATE_DAEMON_METRICS_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <functional>
+#include <map>
+#include <memory>
+#include <string>
+#include <unordered_set>
+
+#include <common/config.h>
+
+#ifdef MENDER_USE_BOOST_BEAST
+#include <boost/asio.hpp>
+#endif // MENDER_USE_BOOST_BEAST
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/optional.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+#ifdef MENDER_USE_BOOST_BEAST
+namespace asio = boost::asio;
+#endif // MENDER_USE_BOOST_BEAST
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+
+// Counters and gauges of how the daemon is doing, for Prometheus and other monitoring systems
+// which scrape the OpenMetrics text format. See Documentation/metrics.md. Kept in memory only, so
+// the counters start from 0 whenever the daemon starts, as the scrapers expect.
+class Metrics {
+public:
+	using Clock = chrono::system_clock;
+
+	void DeploymentStarted();
+	void DeploymentFinished(bool success);
+
+	void StateEntered(const string &state);
+
+	void UpdateChecked(Clock::time_point now = Clock::now());
+	void InventorySubmitted(Clock::time_point now = Clock::now());
+
+	// The bytes read of the Artifact are counted into the total as the download goes. Finishing a
+	// download which is already finished changes nothing, so it can be done on every way out.
+	void DownloadStarted();
+	void DownloadProgress(int64_t bytes_read, chrono::seconds elapsed);
+	void DownloadFinished(int64_t bytes_read);
+
+	void AuthenticationFailed();
+
+	// `scripts` as in script_executor::Name(), for example "Download_Enter".
+	void StateScriptsRan(const string &scripts, chrono::milliseconds duration);
+
+	// In the OpenMetrics text format.
+	string Render() const;
+
+private:
+	struct Duration {
+		chrono::milliseconds sum {0};
+		uint64_t count {0};
+	};
+
+	uint64_t deployments_started_ {0};
+	uint64_t deployments_succeeded_ {0};
+	uint64_t deployments_failed_ {0};
+	string state_;
+	optional<Clock::time_point> last_update_check_;
+	optional<Clock::time_point> last_inventory_submission_;
+	uint64_t download_bytes_ {0};
+	bool downloading_ {false};
+	int64_t current_download_bytes_ {0};
+	int64_t download_rate_ {0};
+	uint64_t authentication_failures_ {0};
+	map<string, Duration> state_script_durations_;
+};
+
+class MetricsConnection;
+
+// Serves the metrics with `GET /metrics`, on a Unix socket or on a TCP port.
+class MetricsServer : public events::EventLoopObject {
+public:
+	using Renderer = function<string()>;
+
+	MetricsServer(events::EventLoop &loop, Renderer renderer);
+	~MetricsServer();
+
+	// `address` is "unix:" followed by the path of the socket, or a "host:port" with the host
+	// given as an IP address, as in the `Metrics.Listen` setting.
+	error::Error Listen(const string &address);
+	void Cancel();
+
+	struct Response {
+		unsigned status;
+		string content_type;
+		string body;
+	};
+	// Platform independent, the sockets are not.
+	Response HandleRequest(const string &method, const string &target) const;
+
+private:
+	Renderer renderer_;
+	string socket_path_;
+
+#ifdef MENDER_USE_BOOST_BEAST
+	error::Error ListenUnix(const string &socket_path);
+	error::Error ListenTcp(const string &address);
+	void AsyncAcceptUnix();
+	void AsyncAcceptTcp();
+	template <typename Socket>
+	void Accepted(Socket socket);
+
+	asio::local::stream_protocol::acceptor unix_acceptor_;
+	asio::ip::tcp::acceptor tcp_acceptor_;
+	unordered_set<shared_ptr<MetricsConnection>> connections_;
+	// Set when the server is cancelled, so that the callbacks it still gets are ignored.
+	shared_ptr<bool> cancelled_;
+
+	template <typename Socket>
+	friend class MetricsSocketConnection;
+#endif // MENDER_USE_BOOST_BEAST
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_METRICS_HPP
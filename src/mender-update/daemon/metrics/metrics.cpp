@@ -0,0 +1,196 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/metrics.hpp>
+
+#include <iomanip>
+#include <sstream>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+void Metrics::DeploymentStarted() {
+	deployments_started_++;
+}
+
+void Metrics::DeploymentFinished(bool success) {
+	if (success) {
+		deployments_succeeded_++;
+	} else {
+		deployments_failed_++;
+	}
+}
+
+void Metrics::StateEntered(const string &state) {
+	state_ = state;
+}
+
+void Metrics::UpdateChecked(Clock::time_point now) {
+	last_update_check_ = now;
+}
+
+void Metrics::InventorySubmitted(Clock::time_point now) {
+	last_inventory_submission_ = now;
+}
+
+void Metrics::DownloadStarted() {
+	downloading_ = true;
+	current_download_bytes_ = 0;
+	download_rate_ = 0;
+}
+
+void Metrics::DownloadProgress(int64_t bytes_read, chrono::seconds elapsed) {
+	if (!downloading_) {
+		return;
+	}
+	if (bytes_read > current_download_bytes_) {
+		download_bytes_ += static_cast<uint64_t>(bytes_read - current_download_bytes_);
+		current_download_bytes_ = bytes_read;
+	}
+	download_rate_ = elapsed.count() > 0 ? bytes_read / elapsed.count() : 0;
+}
+
+void Metrics::DownloadFinished(int64_t bytes_read) {
+	DownloadProgress(bytes_read, chrono::seconds::zero());
+	downloading_ = false;
+}
+
+void Metrics::AuthenticationFailed() {
+	authentication_failures_++;
+}
+
+void Metrics::StateScriptsRan(const string &scripts, chrono::milliseconds duration) {
+	auto &durations = state_script_durations_[scripts];
+	durations.sum += duration;
+	durations.count++;
+}
+
+static string EscapeLabelValue(const string &value) {
+	string escaped;
+	for (auto c : value) {
+		switch (c) {
+		case '\\':
+			escaped += "\\\\";
+			break;
+		case '"':
+			escaped += "\\\"";
+			break;
+		case '\n':
+			escaped += "\\n";
+			break;
+		default:
+			escaped += c;
+		}
+	}
+	return escaped;
+}
+
+static string Seconds(chrono::milliseconds duration) {
+	stringstream ss;
+	ss << duration.count() / 1000 << "." << setw(3) << setfill('0') << duration.count() % 1000;
+	return ss.str();
+}
+
+static string EpochSeconds(Metrics::Clock::time_point time) {
+	return to_string(chrono::duration_cast<chrono::seconds>(time.time_since_epoch()).count());
+}
+
+static void AddMetric(
+	stringstream &ss, const string &name, const string &type, const string &help) {
+	ss << "# HELP " << name << " " << help << "\n";
+	ss << "# TYPE " << name << " " << type << "\n";
+}
+
+string Metrics::Render() const {
+	stringstream ss;
+
+	AddMetric(ss, "mender_deployments_attempted", "counter", "Deployments started.");
+	ss << "mender_deployments_attempted_total " << deployments_started_ << "\n";
+	AddMetric(ss, "mender_deployments_succeeded", "counter", "Deployments which succeeded.");
+	ss << "mender_deployments_succeeded_total " << deployments_succeeded_ << "\n";
+	AddMetric(ss, "mender_deployments_failed", "counter", "Deployments which failed.");
+	ss << "mender_deployments_failed_total " << deployments_failed_ << "\n";
+
+	AddMetric(ss, "mender_state", "info", "The current state of the daemon.");
+	if (state_ != "") {
+		ss << "mender_state_info{state=\"" << EscapeLabelValue(state_) << "\"} 1\n";
+	}
+
+	AddMetric(
+		ss,
+		"mender_update_check_last_success_timestamp_seconds",
+		"gauge",
+		"When the server was last checked for a deployment.");
+	if (last_update_check_) {
+		ss << "mender_update_check_last_success_timestamp_seconds "
+		   << EpochSeconds(last_update_check_.value()) << "\n";
+	}
+	AddMetric(
+		ss,
+		"mender_inventory_submission_last_success_timestamp_seconds",
+		"gauge",
+		"When the inventory was last submitted.");
+	if (last_inventory_submission_) {
+		ss << "mender_inventory_submission_last_success_timestamp_seconds "
+		   << EpochSeconds(last_inventory_submission_.value()) << "\n";
+	}
+
+	AddMetric(ss, "mender_download_bytes", "counter", "Bytes of Artifacts downloaded.");
+	ss << "mender_download_bytes_total " << download_bytes_ << "\n";
+	AddMetric(
+		ss,
+		"mender_download_rate_bytes_per_second",
+		"gauge",
+		"Average rate of the ongoing Artifact download, 0 when there is none.");
+	ss << "mender_download_rate_bytes_per_second " << download_rate_ << "\n";
+
+	AddMetric(
+		ss, "mender_authentication_failures", "counter", "Failed attempts to authenticate.");
+	ss << "mender_authentication_failures_total " << authentication_failures_ << "\n";
+
+	AddMetric(
+		ss,
+		"mender_state_script_duration_seconds",
+		"summary",
+		"How long the State Scripts of each state and action took.");
+	for (const auto &durations : state_script_durations_) {
+		string labels {"{scripts=\"" + EscapeLabelValue(durations.first) + "\"}"};
+		ss << "mender_state_script_duration_seconds_sum" << labels << " "
+		   << Seconds(durations.second.sum) << "\n";
+		ss << "mender_state_script_duration_seconds_count" << labels << " "
+		   << durations.second.count << "\n";
+	}
+
+	ss << "# EOF\n";
+	return ss.str();
+}
+
+MetricsServer::Response MetricsServer::HandleRequest(
+	const string &method, const string &target) const {
+	// Scrapers may add parameters, which don't matter here.
+	if (target.substr(0, target.find('?')) != "/metrics") {
+		return Response {404, "text/plain", "Not found, the metrics are at /metrics\n"};
+	}
+	if (method != "GET") {
+		return Response {405, "text/plain", "The metrics must be fetched with GET\n"};
+	}
+	return Response {
+		200, "application/openmetrics-text; version=1.0.0; charset=utf-8", renderer_()};
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,303 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/metrics.hpp>
+
+#include <unistd.h>
+
+#include <boost/beast.hpp>
+
+#include <common/common.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace beast = boost::beast;
+namespace http = beast::http;
+namespace common = mender::common;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+using error_code = boost::system::error_code;
+using local = asio::local::stream_protocol;
+using tcp = asio::ip::tcp;
+
+const string kUnixAddressPrefix {"unix:"};
+
+static error::Error ErrorFromBoost(const error_code &ec, const string &context) {
+	return error::Error(ec.default_error_condition(), context + ": " + ec.message());
+}
+
+class MetricsConnection {
+public:
+	virtual ~MetricsConnection() {
+	}
+
+	virtual void Close() = 0;
+};
+
+// One connection, over either kind of socket. The requests have no body, a GET is all it takes.
+template <typename Socket>
+class MetricsSocketConnection :
+	public MetricsConnection,
+	public enable_shared_from_this<MetricsSocketConnection<Socket>> {
+public:
+	MetricsSocketConnection(MetricsServer &server, Socket socket) :
+		server_ {server},
+		cancelled_ {server.cancelled_},
+		socket_ {std::move(socket)} {
+	}
+
+	void ReadRequest() {
+		request_ = make_shared<http::request<http::empty_body>>();
+		auto self = this->shared_from_this();
+		http::async_read(socket_, buffer_, *request_, [self](const error_code &ec, size_t) {
+			self->RequestRead(ec);
+		});
+	}
+
+	void Close() override {
+		error_code ec;
+		socket_.close(ec);
+	}
+
+private:
+	void RequestRead(const error_code &ec) {
+		if (*cancelled_) {
+			return;
+		}
+		if (ec) {
+			if (ec != http::error::end_of_stream) {
+				log::Debug("Could not read a metrics request: " + ec.message());
+			}
+			Finish();
+			return;
+		}
+
+		auto response =
+			server_.HandleRequest(string {request_->method_string()}, string {request_->target()});
+		response_ = make_shared<http::response<http::string_body>>(
+			static_cast<http::status>(response.status), request_->version());
+		response_->set(http::field::content_type, response.content_type);
+		response_->keep_alive(request_->keep_alive());
+		response_->body() = response.body;
+		response_->prepare_payload();
+
+		auto self = this->shared_from_this();
+		http::async_write(socket_, *response_, [self](const error_code &ec, size_t) {
+			self->ResponseWritten(ec);
+		});
+	}
+
+	void ResponseWritten(const error_code &ec) {
+		if (*cancelled_) {
+			return;
+		}
+		if (ec) {
+			log::Debug("Could not write a metrics response: " + ec.message());
+			Finish();
+			return;
+		}
+		if (!response_->keep_alive()) {
+			Finish();
+			return;
+		}
+		ReadRequest();
+	}
+
+	void Finish() {
+		Close();
+		server_.connections_.erase(this->shared_from_this());
+	}
+
+	MetricsServer &server_;
+	shared_ptr<bool> cancelled_;
+	Socket socket_;
+	beast::flat_buffer buffer_;
+	shared_ptr<http::request<http::empty_body>> request_;
+	shared_ptr<http::response<http::string_body>> response_;
+};
+
+MetricsServer::MetricsServer(events::EventLoop &loop, Renderer renderer) :
+	renderer_ {renderer},
+	unix_acceptor_ {GetAsioIoContext(loop)},
+	tcp_acceptor_ {GetAsioIoContext(loop)},
+	cancelled_ {make_shared<bool>(false)} {
+}
+
+MetricsServer::~MetricsServer() {
+	Cancel();
+}
+
+error::Error MetricsServer::Listen(const string &address) {
+	auto err = common::StartsWith(address, kUnixAddressPrefix)
+				   ? ListenUnix(address.substr(kUnixAddressPrefix.size()))
+				   : ListenTcp(address);
+	if (err != error::NoError) {
+		Cancel();
+		return err;
+	}
+	*cancelled_ = false;
+	return error::NoError;
+}
+
+error::Error MetricsServer::ListenUnix(const string &socket_path) {
+	auto err = path::CreateDirectories(path::DirName(socket_path));
+	if (err != error::NoError) {
+		return err;
+	}
+	// Left behind if the daemon didn't exit cleanly, and binding fails as long as it is there.
+	::unlink(socket_path.c_str());
+
+	error_code ec;
+	local::endpoint endpoint {socket_path};
+	unix_acceptor_.open(endpoint.protocol(), ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not open the metrics socket");
+	}
+	unix_acceptor_.bind(endpoint, ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not bind the metrics socket to " + socket_path);
+	}
+	socket_path_ = socket_path;
+	// The metrics tell nothing secret, but the group is as far as they need to go, for a scraper
+	// running as a user of its own.
+	err = path::Permissions(
+		socket_path,
+		{path::Perms::Owner_read,
+		 path::Perms::Owner_write,
+		 path::Perms::Group_read,
+		 path::Perms::Group_write});
+	if (err != error::NoError) {
+		return err;
+	}
+	unix_acceptor_.listen(asio::socket_base::max_listen_connections, ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not listen on the metrics socket");
+	}
+
+	AsyncAcceptUnix();
+	return error::NoError;
+}
+
+error::Error MetricsServer::ListenTcp(const string &address) {
+	auto colon = address.rfind(':');
+	if (colon == string::npos) {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"Not a metrics address, expected \"unix:<path>\" or \"<host>:<port>\": " + address);
+	}
+	string host {address.substr(0, colon)};
+	if (host.size() >= 2 && host.front() == '[' && host.back() == ']') {
+		host = host.substr(1, host.size() - 2);
+	}
+	auto exp_port = common::StringTo<uint16_t>(address.substr(colon + 1));
+	if (!exp_port) {
+		return exp_port.error().WithContext("Invalid port of the metrics address " + address);
+	}
+
+	error_code ec;
+	auto ip = asio::ip::make_address(host, ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Invalid host of the metrics address " + address);
+	}
+	tcp::endpoint endpoint {ip, exp_port.value()};
+	tcp_acceptor_.open(endpoint.protocol(), ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not open the metrics socket");
+	}
+	tcp_acceptor_.set_option(tcp::acceptor::reuse_address(true), ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not set up the metrics socket");
+	}
+	tcp_acceptor_.bind(endpoint, ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not bind the metrics socket to " + address);
+	}
+	tcp_acceptor_.listen(asio::socket_base::max_listen_connections, ec);
+	if (ec) {
+		return ErrorFromBoost(ec, "Could not listen on the metrics socket");
+	}
+
+	AsyncAcceptTcp();
+	return error::NoError;
+}
+
+void MetricsServer::AsyncAcceptUnix() {
+	auto cancelled = cancelled_;
+	unix_acceptor_.async_accept([this, cancelled](const error_code &ec, local::socket socket) {
+		if (*cancelled) {
+			return;
+		}
+		if (ec) {
+			log::Error("Could not accept a metrics connection: " + ec.message());
+			return;
+		}
+		Accepted(std::move(socket));
+		AsyncAcceptUnix();
+	});
+}
+
+void MetricsServer::AsyncAcceptTcp() {
+	auto cancelled = cancelled_;
+	tcp_acceptor_.async_accept([this, cancelled](const error_code &ec, tcp::socket socket) {
+		if (*cancelled) {
+			return;
+		}
+		if (ec) {
+			log::Error("Could not accept a metrics connection: " + ec.message());
+			return;
+		}
+		Accepted(std::move(socket));
+		AsyncAcceptTcp();
+	});
+}
+
+template <typename Socket>
+void MetricsServer::Accepted(Socket socket) {
+	auto connection = make_shared<MetricsSocketConnection<Socket>>(*this, std::move(socket));
+	connections_.insert(connection);
+	connection->ReadRequest();
+}
+
+void MetricsServer::Cancel() {
+	*cancelled_ = true;
+	// A new one, so that callbacks of the cancelled connections keep seeing `true`.
+	cancelled_ = make_shared<bool>(true);
+
+	error_code ec;
+	if (unix_acceptor_.is_open()) {
+		unix_acceptor_.close(ec);
+	}
+	if (tcp_acceptor_.is_open()) {
+		tcp_acceptor_.close(ec);
+	}
+	for (auto &connection : connections_) {
+		connection->Close();
+	}
+	connections_.clear();
+
+	if (socket_path_ != "") {
+		::unlink(socket_path_.c_str());
+		socket_path_ = "";
+	}
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
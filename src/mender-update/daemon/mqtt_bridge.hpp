@@ -0,0 +1,82 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_MQTT_BRIDGE_HPP
+#define MENDER_UPDATE_DAEMON_MQTT_BRIDGE_HPP
+
+#include <cstdint>
+#include <deque>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/mqtt.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace mqtt = mender::common::mqtt;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// Publishes the state transitions, the deployment outcomes and the authorization changes to the
+// MQTT broker in MQTT, see Documentation/mqtt-bridge.md.
+//
+// Events are published in order, in batches of whatever has queued up while the previous session
+// was ongoing. Publishing is best effort: failures are only logged, and never hold up the daemon.
+class MqttBridge {
+public:
+	// How many events may wait to be published, after which the oldest ones are dropped.
+	static const size_t kMaxQueuedEvents;
+
+	MqttBridge(events::EventLoop &loop, const cfg_parser::Mqtt &config);
+
+	bool Enabled() const {
+		return config_.Enabled();
+	}
+
+	void StateChanged(const string &state, const string &deployment_id);
+	void DeploymentFinished(const string &deployment_id, const string &artifact_name, bool success);
+	void AuthorizationChanged(bool authorized);
+
+	// The JSON objects which are published.
+	static string StateJson(const string &state, const string &deployment_id, int64_t timestamp);
+	static string DeploymentJson(
+		const string &deployment_id, const string &artifact_name, bool success, int64_t timestamp);
+	static string AuthorizationJson(bool authorized, int64_t timestamp);
+
+private:
+	void Queue(const string &topic, const string &payload);
+	void PublishNext();
+
+	events::EventLoop &loop_;
+	cfg_parser::Mqtt config_;
+	mqtt::Publisher publisher_;
+
+	deque<mqtt::Message> queue_;
+	bool publishing_ {false};
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_MQTT_BRIDGE_HPP
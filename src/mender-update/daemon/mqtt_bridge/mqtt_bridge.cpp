@@ -0,0 +1,143 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/mqtt_bridge.hpp>
+
+#include <chrono>
+#include <vector>
+
+#include <common/json.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+
+const size_t MqttBridge::kMaxQueuedEvents {100};
+
+static mqtt::ClientConfig MakeClientConfig(const cfg_parser::Mqtt &config) {
+	mqtt::ClientConfig client_config;
+	client_config.broker_url = config.broker_url;
+	client_config.client_id = config.client_id;
+	client_config.username = config.username;
+	client_config.password = config.password;
+	client_config.server_cert_path = config.server_certificate;
+	client_config.client_cert_path = config.client_certificate;
+	client_config.client_cert_key_path = config.client_certificate_key;
+	client_config.timeout = chrono::seconds {config.timeout_seconds};
+	return client_config;
+}
+
+static int64_t Now() {
+	return chrono::duration_cast<chrono::seconds>(chrono::system_clock::now().time_since_epoch())
+		.count();
+}
+
+MqttBridge::MqttBridge(events::EventLoop &loop, const cfg_parser::Mqtt &config) :
+	loop_ {loop},
+	config_ {config},
+	publisher_ {loop, MakeClientConfig(config)} {
+}
+
+string MqttBridge::StateJson(const string &state, const string &deployment_id, int64_t timestamp) {
+	string json = R"({"state":")" + json::EscapeString(state) + "\"";
+	json += R"(,"timestamp":)" + to_string(timestamp);
+	if (deployment_id != "") {
+		json += R"(,"deployment_id":")" + json::EscapeString(deployment_id) + "\"";
+	}
+	json += "}";
+	return json;
+}
+
+string MqttBridge::DeploymentJson(
+	const string &deployment_id, const string &artifact_name, bool success, int64_t timestamp) {
+	string json = R"({"deployment_id":")" + json::EscapeString(deployment_id) + "\"";
+	json += R"(,"timestamp":)" + to_string(timestamp);
+	json += R"(,"artifact_name":")" + json::EscapeString(artifact_name) + "\"";
+	json += R"(,"status":")" + string(success ? "success" : "failure") + "\"";
+	json += "}";
+	return json;
+}
+
+string MqttBridge::AuthorizationJson(bool authorized, int64_t timestamp) {
+	string json = R"({"authorized":)" + string(authorized ? "true" : "false");
+	json += R"(,"timestamp":)" + to_string(timestamp);
+	json += "}";
+	return json;
+}
+
+void MqttBridge::StateChanged(const string &state, const string &deployment_id) {
+	Queue(config_.state_topic, StateJson(state, deployment_id, Now()));
+}
+
+void MqttBridge::DeploymentFinished(
+	const string &deployment_id, const string &artifact_name, bool success) {
+	Queue(config_.deployment_topic, DeploymentJson(deployment_id, artifact_name, success, Now()));
+}
+
+void MqttBridge::AuthorizationChanged(bool authorized) {
+	Queue(config_.authorization_topic, AuthorizationJson(authorized, Now()));
+}
+
+void MqttBridge::Queue(const string &topic, const string &payload) {
+	if (!Enabled() || topic == "") {
+		return;
+	}
+
+	if (queue_.size() >= kMaxQueuedEvents) {
+		log::Warning("Too many MQTT events waiting to be published, dropping the oldest one");
+		queue_.pop_front();
+	}
+	queue_.push_back({topic, payload, config_.qos, config_.retain});
+
+	if (!publishing_) {
+		// The events are often queued from within the state machine, publish them once it is done.
+		publishing_ = true;
+		loop_.Post([this]() { PublishNext(); });
+	}
+}
+
+void MqttBridge::PublishNext() {
+	if (queue_.empty()) {
+		publishing_ = false;
+		return;
+	}
+
+	vector<mqtt::Message> messages {queue_.begin(), queue_.end()};
+	queue_.clear();
+
+	auto count = messages.size();
+	auto err = publisher_.AsyncPublish(messages, [this, count](error::Error err) {
+		if (err != error::NoError) {
+			log::Warning(
+				"Could not publish " + to_string(count) + " event(s) to the MQTT broker "
+				+ config_.broker_url + ": " + err.String());
+		}
+		// Don't start the next session from within the handler of this one.
+		loop_.Post([this]() { PublishNext(); });
+	});
+	if (err != error::NoError) {
+		log::Warning(
+			"Could not publish " + to_string(count) + " event(s) to the MQTT broker "
+			+ config_.broker_url + ": " + err.String());
+		publishing_ = false;
+	}
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
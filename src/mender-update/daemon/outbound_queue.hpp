@@ -0,0 +1,121 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_OUTBOUND_QUEUE_HPP
+#define MENDER_UPDATE_DAEMON_OUTBOUND_QUEUE_HPP
+
+#include <cstdint>
+#include <functional>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+
+#include <api/client.hpp>
+
+#include <mender-update/deployments.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace api = mender::api;
+namespace deployments = mender::update::deployments;
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+// In the data store.
+const string kOutboundQueueDir {"outbound-queue"};
+
+struct OutboundQueueEntry {
+	// Increasing, tells the order in which the entries were queued.
+	uint64_t sequence {0};
+	string deployment_id;
+	deployments::DeploymentStatus status {deployments::DeploymentStatus::Failure};
+	string substate;
+	// Whether a copy of the deployment logs is queued along with the status.
+	bool logs {false};
+	// Whether the status has reached the server, and only the logs are left.
+	bool status_sent {false};
+};
+using ExpectedOutboundQueueEntries = expected::expected<vector<OutboundQueueEntry>, error::Error>;
+
+// The final status updates, and the logs, which could not be sent at the end of a deployment,
+// kept in the data store until the server can be reached again, so that they survive reboots.
+// The index is a file with one JSON object per line, the logs are copied next to it. See
+// Documentation/outbound-queue.md.
+class OutboundQueue {
+public:
+	// The oldest entries beyond this are dropped, with their logs.
+	static const size_t kMaxEntries;
+
+	OutboundQueue(const string &dir);
+
+	// `log_file` is copied, so that rotating the deployment logs doesn't lose it. Empty if there
+	// are no logs to send. If the copy fails, only the status is queued.
+	error::Error Add(
+		const string &deployment_id,
+		deployments::DeploymentStatus status,
+		const string &substate,
+		bool status_sent,
+		const string &log_file);
+
+	// The oldest first. Lines which can't be parsed are skipped.
+	ExpectedOutboundQueueEntries Load() const;
+	bool Empty() const;
+
+	string LogsPath(const OutboundQueueEntry &entry) const;
+
+	// Sends the entries, the oldest first, and removes each of them once it has been sent, or
+	// once the server has refused it for good. Stops at the first entry which can't be sent right
+	// now, leaving it, and those after it, for the next time, and returns the error.
+	void AsyncFlush(
+		deployments::DeploymentAPI &deployment_client,
+		api::Client &client,
+		function<void(error::Error)> handler);
+
+private:
+	error::Error Remove(uint64_t sequence);
+	error::Error SetStatusSent(uint64_t sequence);
+	error::Error Save(const vector<OutboundQueueEntry> &entries) const;
+
+	// Sends the logs of the entry, if it has any, then removes it and goes on with the next one.
+	void FlushLogs(
+		const OutboundQueueEntry &entry,
+		deployments::DeploymentAPI &deployment_client,
+		api::Client &client,
+		function<void(error::Error)> handler);
+	// Calls `next` if the entry got through. Otherwise stops, or drops the entry and goes on with
+	// the next one, depending on the response.
+	void FlushResponseHandler(
+		const OutboundQueueEntry &entry,
+		const deployments::APIResponseError &response,
+		deployments::DeploymentAPI &deployment_client,
+		api::Client &client,
+		function<void()> next,
+		function<void(error::Error)> handler);
+
+	string dir_;
+	string index_path_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_OUTBOUND_QUEUE_HPP
@@ -0,0 +1,410 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/outbound_queue.hpp>
+
+#include <fstream>
+#include <utility>
+
+#include <common/http.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/optional.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace http = mender::common::http;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+const size_t OutboundQueue::kMaxEntries {16};
+
+static const string kIndexFile {"index"};
+
+static string EntryToJson(const OutboundQueueEntry &entry) {
+	return R"({"sequence":)" + to_string(entry.sequence) + R"(,"deployment_id":")"
+		   + json::EscapeString(entry.deployment_id) + R"(","status":")"
+		   + json::EscapeString(deployments::DeploymentStatusString(entry.status))
+		   + R"(","substate":")" + json::EscapeString(entry.substate) + R"(","logs":)"
+		   + (entry.logs ? "true" : "false") + R"(,"status_sent":)"
+		   + (entry.status_sent ? "true" : "false") + "}";
+}
+
+static optional<deployments::DeploymentStatus> StatusFromString(const string &str) {
+	for (int i = 0; i < static_cast<int>(deployments::DeploymentStatus::End_); i++) {
+		auto status = static_cast<deployments::DeploymentStatus>(i);
+		if (deployments::DeploymentStatusString(status) == str) {
+			return status;
+		}
+	}
+	return nullopt;
+}
+
+// Missing values are taken as false and empty, so that fields can be added later.
+static expected::ExpectedBool BoolFromJson(const json::Json &entry_json, const string &key) {
+	auto exp_value = entry_json.Get(key);
+	if (!exp_value || exp_value.value().IsNull()) {
+		return false;
+	}
+	return exp_value.value().GetBool();
+}
+
+static expected::ExpectedString StringFromJson(const json::Json &entry_json, const string &key) {
+	auto exp_value = entry_json.Get(key);
+	if (!exp_value || exp_value.value().IsNull()) {
+		return "";
+	}
+	return exp_value.value().GetString();
+}
+
+static expected::expected<OutboundQueueEntry, error::Error> EntryFromJson(const string &line) {
+	auto exp_json = json::Load(line);
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+	auto &entry_json = exp_json.value();
+
+	OutboundQueueEntry entry;
+	auto exp_sequence = entry_json.Get("sequence").and_then(json::ToInt64);
+	if (!exp_sequence) {
+		return expected::unexpected(exp_sequence.error());
+	}
+	entry.sequence = static_cast<uint64_t>(exp_sequence.value());
+
+	string status;
+	for (auto field : {
+			 make_pair("deployment_id", &entry.deployment_id),
+			 make_pair("status", &status),
+			 make_pair("substate", &entry.substate),
+		 }) {
+		auto exp_string = StringFromJson(entry_json, field.first);
+		if (!exp_string) {
+			return expected::unexpected(exp_string.error());
+		}
+		*field.second = exp_string.value();
+	}
+	if (entry.deployment_id == "") {
+		return expected::unexpected(json::MakeError(json::KeyError, "Missing the deployment ID"));
+	}
+	auto parsed_status = StatusFromString(status);
+	if (!parsed_status) {
+		return expected::unexpected(
+			json::MakeError(json::TypeError, "Invalid deployment status: " + status));
+	}
+	entry.status = parsed_status.value();
+
+	for (auto field : {
+			 make_pair("logs", &entry.logs),
+			 make_pair("status_sent", &entry.status_sent),
+		 }) {
+		auto exp_bool = BoolFromJson(entry_json, field.first);
+		if (!exp_bool) {
+			return expected::unexpected(exp_bool.error());
+		}
+		*field.second = exp_bool.value();
+	}
+
+	return entry;
+}
+
+// Whether the entry may still get through later: the server couldn't be reached, or wasn't able
+// to take it right now. Anything else the server has refused for good, such as the status of a
+// deployment which has been aborted in the meantime.
+static bool MayGetThroughLater(const deployments::APIResponseError &response) {
+	if (!response.http_code) {
+		return true;
+	}
+	auto code = response.http_code.value();
+	return code == http::StatusUnauthorized || code == http::StatusTooManyRequests
+		   || code >= http::StatusInternalServerError;
+}
+
+OutboundQueue::OutboundQueue(const string &dir) :
+	dir_ {dir},
+	index_path_ {path::Join(dir, kIndexFile)} {
+}
+
+string OutboundQueue::LogsPath(const OutboundQueueEntry &entry) const {
+	return path::Join(dir_, to_string(entry.sequence) + ".log");
+}
+
+error::Error OutboundQueue::Add(
+	const string &deployment_id,
+	deployments::DeploymentStatus status,
+	const string &substate,
+	bool status_sent,
+	const string &log_file) {
+	auto err = path::CreateDirectories(dir_);
+	if (err != error::NoError) {
+		return err;
+	}
+
+	auto exp_entries = Load();
+	if (!exp_entries) {
+		return exp_entries.error();
+	}
+	auto &entries = exp_entries.value();
+
+	OutboundQueueEntry entry;
+	entry.sequence = entries.empty() ? 1 : entries.back().sequence + 1;
+	entry.deployment_id = deployment_id;
+	entry.status = status;
+	entry.substate = substate;
+	entry.status_sent = status_sent;
+	if (log_file != "") {
+		err = path::FileCopy(log_file, LogsPath(entry));
+		if (err != error::NoError) {
+			log::Warning(
+				"Could not queue the deployment logs, only the status is queued: " + err.String());
+		} else {
+			entry.logs = true;
+		}
+	}
+	entries.push_back(entry);
+
+	while (entries.size() > kMaxEntries) {
+		log::Warning(
+			"Too many queued status updates, dropping the one of deployment "
+			+ entries.front().deployment_id);
+		if (entries.front().logs) {
+			path::FileDelete(LogsPath(entries.front()));
+		}
+		entries.erase(entries.begin());
+	}
+
+	return Save(entries);
+}
+
+ExpectedOutboundQueueEntries OutboundQueue::Load() const {
+	vector<OutboundQueueEntry> entries;
+	if (!path::FileExists(index_path_)) {
+		return entries;
+	}
+
+	auto exp_stream = io::OpenIfstream(index_path_);
+	if (!exp_stream) {
+		return expected::unexpected(exp_stream.error());
+	}
+	string line;
+	while (getline(exp_stream.value(), line)) {
+		if (line == "") {
+			continue;
+		}
+		auto exp_entry = EntryFromJson(line);
+		if (!exp_entry) {
+			log::Warning(
+				"Skipping an invalid entry in " + index_path_ + ": " + exp_entry.error().String());
+			continue;
+		}
+		entries.push_back(exp_entry.value());
+	}
+	return entries;
+}
+
+bool OutboundQueue::Empty() const {
+	auto exp_entries = Load();
+	return !exp_entries || exp_entries.value().empty();
+}
+
+error::Error OutboundQueue::Remove(uint64_t sequence) {
+	auto exp_entries = Load();
+	if (!exp_entries) {
+		return exp_entries.error();
+	}
+	auto &entries = exp_entries.value();
+
+	for (auto entry = entries.begin(); entry != entries.end(); entry++) {
+		if (entry->sequence == sequence) {
+			if (entry->logs) {
+				path::FileDelete(LogsPath(*entry));
+			}
+			entries.erase(entry);
+			break;
+		}
+	}
+
+	return Save(entries);
+}
+
+error::Error OutboundQueue::SetStatusSent(uint64_t sequence) {
+	auto exp_entries = Load();
+	if (!exp_entries) {
+		return exp_entries.error();
+	}
+	auto &entries = exp_entries.value();
+
+	for (auto &entry : entries) {
+		if (entry.sequence == sequence) {
+			entry.status_sent = true;
+		}
+	}
+
+	return Save(entries);
+}
+
+error::Error OutboundQueue::Save(const vector<OutboundQueueEntry> &entries) const {
+	string content;
+	for (const auto &entry : entries) {
+		content += EntryToJson(entry) + "\n";
+	}
+
+	// Replaced in one go, so that a power loss leaves either the old or the new index.
+	const string tmp_path = index_path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, index_path_);
+}
+
+void OutboundQueue::AsyncFlush(
+	deployments::DeploymentAPI &deployment_client,
+	api::Client &client,
+	function<void(error::Error)> handler) {
+	auto exp_entries = Load();
+	if (!exp_entries) {
+		handler(exp_entries.error());
+		return;
+	}
+	if (exp_entries.value().empty()) {
+		handler(error::NoError);
+		return;
+	}
+	auto entry = exp_entries.value().front();
+
+	if (entry.status_sent) {
+		FlushLogs(entry, deployment_client, client, handler);
+		return;
+	}
+
+	log::Info(
+		"Sending the queued " + deployments::DeploymentStatusString(entry.status)
+		+ " status of deployment " + entry.deployment_id);
+	auto err = deployment_client.PushStatus(
+		entry.deployment_id,
+		entry.status,
+		entry.substate,
+		nullopt,
+		client,
+		[this, entry, &deployment_client, &client, handler](
+			deployments::StatusAPIResponse response) {
+			FlushResponseHandler(
+				entry,
+				response,
+				deployment_client,
+				client,
+				[this, entry, &deployment_client, &client, handler]() {
+					if (entry.logs) {
+						// So that the status isn't sent again if the logs don't get through.
+						auto err = SetStatusSent(entry.sequence);
+						if (err != error::NoError) {
+							handler(err);
+							return;
+						}
+					}
+					FlushLogs(entry, deployment_client, client, handler);
+				},
+				handler);
+		});
+	if (err != error::NoError) {
+		handler(err);
+	}
+}
+
+void OutboundQueue::FlushLogs(
+	const OutboundQueueEntry &entry,
+	deployments::DeploymentAPI &deployment_client,
+	api::Client &client,
+	function<void(error::Error)> handler) {
+	if (!entry.logs) {
+		auto err = Remove(entry.sequence);
+		if (err != error::NoError) {
+			handler(err);
+			return;
+		}
+		AsyncFlush(deployment_client, client, handler);
+		return;
+	}
+
+	log::Info("Sending the queued logs of deployment " + entry.deployment_id);
+	auto err = deployment_client.PushLogs(
+		entry.deployment_id,
+		LogsPath(entry),
+		client,
+		[this, entry, &deployment_client, &client, handler](
+			deployments::LogsAPIResponse response) {
+			FlushResponseHandler(
+				entry,
+				response,
+				deployment_client,
+				client,
+				[this, entry, &deployment_client, &client, handler]() {
+					auto err = Remove(entry.sequence);
+					if (err != error::NoError) {
+						handler(err);
+						return;
+					}
+					AsyncFlush(deployment_client, client, handler);
+				},
+				handler);
+		});
+	if (err != error::NoError) {
+		handler(err);
+	}
+}
+
+void OutboundQueue::FlushResponseHandler(
+	const OutboundQueueEntry &entry,
+	const deployments::APIResponseError &response,
+	deployments::DeploymentAPI &deployment_client,
+	api::Client &client,
+	function<void()> next,
+	function<void(error::Error)> handler) {
+	if (response.error == error::NoError) {
+		next();
+		return;
+	}
+
+	if (MayGetThroughLater(response)) {
+		handler(response.error);
+		return;
+	}
+
+	log::Warning(
+		"The server refused the queued update of deployment " + entry.deployment_id
+		+ ", dropping it: " + response.error.String());
+	auto err = Remove(entry.sequence);
+	if (err != error::NoError) {
+		handler(err);
+		return;
+	}
+	AsyncFlush(deployment_client, client, handler);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
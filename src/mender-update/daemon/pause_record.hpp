@@ -0,0 +1,88 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_PAUSE_RECORD_HPP
+#define MENDER_UPDATE_DAEMON_PAUSE_RECORD_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/optional.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+
+// In the data store.
+const string kDeploymentPauseFile {"deployment-pause"};
+
+struct DeploymentPause {
+	string deployment_id;
+	// The state which the deployment waits to enter, such as `ArtifactReboot`.
+	string state;
+	string reason;
+	// What paused the deployment: the setting, or the application which asked for it.
+	string source;
+	// In seconds since the epoch. `resumed` is 0 while the deployment is still paused.
+	int64_t paused {0};
+	int64_t resumed {0};
+};
+using ExpectedOptionalDeploymentPause = expected::expected<optional<DeploymentPause>, error::Error>;
+
+// Why the deployment was last paused, and when, kept in a file of its own so that it is still
+// known after a restart, and written to the deployment log. See
+// Documentation/deployment-pauses.md.
+class PauseRecord {
+public:
+	using Clock = chrono::system_clock;
+
+	PauseRecord(const string &path);
+
+	// Replaces the record. Pausing again for another reason while paused keeps the start of the
+	// pause.
+	error::Error Paused(
+		const string &deployment_id,
+		const string &state,
+		const string &reason,
+		const string &source,
+		Clock::time_point now = Clock::now());
+	// Does nothing if the deployment isn't paused.
+	error::Error Resumed(Clock::time_point now = Clock::now());
+
+	// Nothing if no deployment has been paused yet.
+	ExpectedOptionalDeploymentPause Load() const;
+
+	// The latest pause as a JSON object, `null` if there is none.
+	string ToJson() const;
+
+private:
+	error::Error Save(const DeploymentPause &pause) const;
+
+	string path_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_PAUSE_RECORD_HPP
@@ -0,0 +1,176 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/pause_record.hpp>
+
+#include <utility>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+static int64_t ToSeconds(PauseRecord::Clock::time_point time) {
+	return chrono::duration_cast<chrono::seconds>(time.time_since_epoch()).count();
+}
+
+static string PauseToJson(const DeploymentPause &pause) {
+	return R"({"deployment_id":")" + json::EscapeString(pause.deployment_id) + R"(","state":")"
+		   + json::EscapeString(pause.state) + R"(","reason":")"
+		   + json::EscapeString(pause.reason) + R"(","source":")"
+		   + json::EscapeString(pause.source) + R"(","paused":)" + to_string(pause.paused)
+		   + R"(,"resumed":)" + (pause.resumed == 0 ? "null" : to_string(pause.resumed)) + "}";
+}
+
+static expected::expected<DeploymentPause, error::Error> PauseFromJson(
+	const json::Json &pause_json) {
+	DeploymentPause pause;
+	for (auto field : {
+			 make_pair("deployment_id", &pause.deployment_id),
+			 make_pair("state", &pause.state),
+			 make_pair("reason", &pause.reason),
+			 make_pair("source", &pause.source),
+		 }) {
+		auto exp_string = pause_json.Get(field.first).and_then(json::ToString);
+		if (!exp_string) {
+			return expected::unexpected(exp_string.error());
+		}
+		*field.second = exp_string.value();
+	}
+
+	auto exp_paused = pause_json.Get("paused").and_then(json::ToInt64);
+	if (!exp_paused) {
+		return expected::unexpected(exp_paused.error());
+	}
+	pause.paused = exp_paused.value();
+
+	auto exp_resumed = pause_json.Get("resumed");
+	if (exp_resumed && !exp_resumed.value().IsNull()) {
+		auto exp_seconds = exp_resumed.value().GetInt64();
+		if (!exp_seconds) {
+			return expected::unexpected(exp_seconds.error());
+		}
+		pause.resumed = exp_seconds.value();
+	}
+
+	return pause;
+}
+
+PauseRecord::PauseRecord(const string &path) :
+	path_ {path} {
+}
+
+error::Error PauseRecord::Paused(
+	const string &deployment_id,
+	const string &state,
+	const string &reason,
+	const string &source,
+	Clock::time_point now) {
+	DeploymentPause pause;
+	pause.deployment_id = deployment_id;
+	pause.state = state;
+	pause.reason = reason;
+	pause.source = source;
+	pause.paused = ToSeconds(now);
+
+	auto exp_previous = Load();
+	if (exp_previous && exp_previous.value()) {
+		const auto &previous = exp_previous.value().value();
+		if (previous.resumed == 0 && previous.deployment_id == deployment_id
+			&& previous.state == state) {
+			pause.paused = previous.paused;
+		}
+	}
+
+	log::Info(
+		"Deployment " + deployment_id + " paused before the " + state + " state: " + reason
+		+ " (" + source + ")");
+	return Save(pause);
+}
+
+error::Error PauseRecord::Resumed(Clock::time_point now) {
+	auto exp_pause = Load();
+	if (!exp_pause) {
+		return exp_pause.error();
+	}
+	if (!exp_pause.value() || exp_pause.value().value().resumed != 0) {
+		return error::NoError;
+	}
+	auto pause = exp_pause.value().value();
+	pause.resumed = ToSeconds(now);
+
+	log::Info(
+		"Deployment " + pause.deployment_id + " resumed after "
+		+ to_string(pause.resumed - pause.paused) + " seconds, going on with the " + pause.state
+		+ " state");
+	return Save(pause);
+}
+
+ExpectedOptionalDeploymentPause PauseRecord::Load() const {
+	if (!path::FileExists(path_)) {
+		return optional<DeploymentPause> {};
+	}
+
+	auto exp_json = json::LoadFromFile(path_);
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+	auto exp_pause = PauseFromJson(exp_json.value());
+	if (!exp_pause) {
+		return expected::unexpected(exp_pause.error().WithContext("Invalid " + path_));
+	}
+	return optional<DeploymentPause> {exp_pause.value()};
+}
+
+string PauseRecord::ToJson() const {
+	auto exp_pause = Load();
+	if (!exp_pause) {
+		log::Warning("Could not load the deployment pause: " + exp_pause.error().String());
+		return "null";
+	}
+	if (!exp_pause.value()) {
+		return "null";
+	}
+	return PauseToJson(exp_pause.value().value());
+}
+
+error::Error PauseRecord::Save(const DeploymentPause &pause) const {
+	// Replaced in one go, so that a restart never sees a partial file.
+	const string tmp_path = path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error();
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), PauseToJson(pause) + "\n");
+	if (err != error::NoError) {
+		return err;
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, path_);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
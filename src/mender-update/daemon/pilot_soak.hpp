@@ -0,0 +1,91 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_PILOT_SOAK_HPP
+#define MENDER_UPDATE_DAEMON_PILOT_SOAK_HPP
+
+#include <chrono>
+#include <functional>
+#include <memory>
+#include <string>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+#include <common/processes.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+#include <mender-update/daemon/canary_monitor.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+namespace procs = mender::common::processes;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// In the data store, while an update is soaking.
+const string kPilotSoakFile {"pilot-soak"};
+
+// Keeps watching a committed update during the soak period of PilotMode, and goes back to the
+// previous software with the RevertCommand if a health check fails. See
+// Documentation/pilot-mode.md.
+class PilotSoak {
+public:
+	using Clock = chrono::system_clock;
+	using HandlerFunction = function<void(error::Error)>;
+
+	PilotSoak(events::EventLoop &loop, const cfg_parser::PilotMode &config, const string &path);
+
+	bool Enabled() const {
+		return config_.Enabled();
+	}
+
+	// How long the deployment still has to soak. The soak period starts with the first call for
+	// the deployment, and the start is kept in the data store, so that a restart or a reboot
+	// doesn't start it over.
+	expected::expected<chrono::seconds, error::Error> Remaining(
+		const string &deployment_id, Clock::time_point now = Clock::now());
+
+	// Runs the health checks for the given time. The handler receives no error if they all
+	// passed every time, or an error as soon as one of them fails.
+	void AsyncSoak(chrono::seconds remaining, HandlerFunction handler);
+
+	// Runs the RevertCommand, which may reboot the device, so the handler may never be called.
+	void AsyncRevert(HandlerFunction handler);
+
+	// Forgets the soak period, once the deployment is done with it.
+	error::Error Finish();
+
+private:
+	events::EventLoop &loop_;
+	cfg_parser::PilotMode config_;
+	string path_;
+	CanaryMonitor monitor_;
+	procs::ScriptRunner revert_runner_ {"Revert command output"};
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_PILOT_SOAK_HPP
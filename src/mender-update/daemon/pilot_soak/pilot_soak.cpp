@@ -0,0 +1,129 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/pilot_soak.hpp>
+
+#include <algorithm>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+// The health checks are run the same way as the ones of CanaryMode.
+static cfg_parser::CanaryMode HealthChecks(const cfg_parser::PilotMode &config) {
+	cfg_parser::CanaryMode checks;
+	checks.window_seconds = config.soak_seconds;
+	checks.interval_seconds = config.interval_seconds;
+	checks.health_checks = config.health_checks;
+	checks.health_check_timeout_seconds = config.health_check_timeout_seconds;
+	return checks;
+}
+
+static int64_t ToSeconds(PilotSoak::Clock::time_point time) {
+	return chrono::duration_cast<chrono::seconds>(time.time_since_epoch()).count();
+}
+
+PilotSoak::PilotSoak(
+	events::EventLoop &loop, const cfg_parser::PilotMode &config, const string &path) :
+	loop_ {loop},
+	config_ {config},
+	path_ {path},
+	monitor_ {loop, HealthChecks(config)} {
+}
+
+expected::expected<chrono::seconds, error::Error> PilotSoak::Remaining(
+	const string &deployment_id, Clock::time_point now) {
+	int64_t started = ToSeconds(now);
+	bool found = false;
+
+	if (path::FileExists(path_)) {
+		auto exp_json = json::LoadFromFile(path_);
+		if (!exp_json) {
+			log::Warning(
+				"Could not read " + path_ + ", starting the soak period over: "
+				+ exp_json.error().String());
+		} else {
+			auto exp_id = exp_json.value().Get("deployment_id").and_then(json::ToString);
+			auto exp_started = exp_json.value().Get("started").and_then(json::ToInt64);
+			// A file left over from an earlier deployment doesn't count.
+			if (exp_id && exp_started && exp_id.value() == deployment_id) {
+				started = exp_started.value();
+				found = true;
+			}
+		}
+	}
+
+	if (!found) {
+		const string tmp_path = path_ + ".tmp";
+		auto exp_stream = io::OpenOfstream(tmp_path);
+		if (!exp_stream) {
+			return expected::unexpected(exp_stream.error());
+		}
+		auto err = io::WriteStringIntoOfstream(
+			exp_stream.value(),
+			R"({"deployment_id":")" + json::EscapeString(deployment_id) + R"(","started":)"
+				+ to_string(started) + "}\n");
+		if (err != error::NoError) {
+			return expected::unexpected(err);
+		}
+		exp_stream.value().close();
+		err = path::Rename(tmp_path, path_);
+		if (err != error::NoError) {
+			return expected::unexpected(err);
+		}
+	}
+
+	auto remaining = started + config_.soak_seconds - ToSeconds(now);
+	return chrono::seconds {max<int64_t>(remaining, 0)};
+}
+
+void PilotSoak::AsyncSoak(chrono::seconds remaining, HandlerFunction handler) {
+	log::Info("Soaking the update for " + to_string(remaining.count()) + " more seconds");
+	monitor_.AsyncObserve(remaining, handler);
+}
+
+void PilotSoak::AsyncRevert(HandlerFunction handler) {
+	log::Info("Going back to the previous software with `" + config_.revert_command + "`");
+
+	auto err = revert_runner_.AsyncRun(
+		loop_,
+		{"/bin/sh", "-c", config_.revert_command},
+		chrono::nanoseconds::zero(),
+		[handler](error::Error err, const string &first_line) { handler(err); });
+	if (err != error::NoError) {
+		loop_.Post([handler, err]() { handler(err); });
+	}
+}
+
+error::Error PilotSoak::Finish() {
+	if (!path::FileExists(path_)) {
+		return error::NoError;
+	}
+	return path::FileDelete(path_);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,65 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_POLL_SPLAY_HPP
+#define MENDER_UPDATE_DAEMON_POLL_SPLAY_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <random>
+
+#include <client_shared/conf.hpp>
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+namespace conf = mender::client_shared::conf;
+
+// Lengthens the poll intervals by a random part of the splay, so that devices which were
+// provisioned or restarted at the same time drift apart instead of polling the server together.
+// See Documentation/poll-splay.md.
+class PollSplay {
+public:
+	PollSplay(const cfg_parser::PollSplay &config, uint64_t seed);
+
+	bool Enabled() const {
+		return config_.percent > 0 || config_.seconds > 0;
+	}
+
+	// The longest extra wait after `interval`.
+	chrono::seconds MaxSplay(chrono::seconds interval) const;
+
+	// `interval` and a random extra wait of up to `MaxSplay(interval)`.
+	chrono::seconds Apply(chrono::seconds interval);
+
+private:
+	cfg_parser::PollSplay config_;
+	mt19937_64 random_;
+};
+
+// A seed from the identity data of the device, so that every device gets its own extra waits,
+// the same ones after every restart. If the identity can't be read, a random one, since the seed
+// only needs to differ between the devices. Only reads the identity if the splay is enabled.
+uint64_t PollSplaySeed(const conf::MenderConfig &config);
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_POLL_SPLAY_HPP
@@ -0,0 +1,69 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/poll_splay.hpp>
+
+#include <functional>
+#include <string>
+
+#include <client_shared/identity_parser.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace identity_parser = mender::client_shared::identity_parser;
+namespace log = mender::common::log;
+
+PollSplay::PollSplay(const cfg_parser::PollSplay &config, uint64_t seed) :
+	config_ {config},
+	random_ {seed} {
+}
+
+chrono::seconds PollSplay::MaxSplay(chrono::seconds interval) const {
+	if (config_.seconds > 0) {
+		return chrono::seconds {config_.seconds};
+	}
+	return interval * config_.percent / 100;
+}
+
+chrono::seconds PollSplay::Apply(chrono::seconds interval) {
+	const auto max_splay = MaxSplay(interval);
+	if (max_splay <= chrono::seconds::zero()) {
+		return interval;
+	}
+	uniform_int_distribution<chrono::seconds::rep> distribution(0, max_splay.count());
+	return interval + chrono::seconds {distribution(random_)};
+}
+
+uint64_t PollSplaySeed(const conf::MenderConfig &config) {
+	if (config.poll_splay.percent == 0 && config.poll_splay.seconds == 0) {
+		return 0;
+	}
+
+	auto exp_identity = identity_parser::GetIdentityData(identity_parser::IdentitySource {
+		config.paths.GetIdentityScript(), config.identity_providers});
+	if (!exp_identity) {
+		log::Warning(
+			"Could not read the device identity for the poll splay, using a random seed: "
+			+ exp_identity.error().String());
+		return random_device {}();
+	}
+	return hash<string> {}(identity_parser::DumpIdentityData(exp_identity.value()));
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,81 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_PREFLIGHT_CHECKS_HPP
+#define MENDER_UPDATE_DAEMON_PREFLIGHT_CHECKS_HPP
+
+#include <functional>
+#include <memory>
+#include <string>
+#include <vector>
+
+#include <common/events.hpp>
+#include <common/processes.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace events = mender::common::events;
+namespace procs = mender::common::processes;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// Runs the checks in PreflightChecks, and the executables in the preflight checks directory, see
+// Documentation/preflight-checks.md.
+//
+// Only one run can be in progress at a time, which is always true for the state machine.
+class PreflightChecks {
+public:
+	// Receives one message for every check which failed, or nothing if all of them passed.
+	using HandlerFunction = function<void(const vector<string> &failures)>;
+
+	// Stages which the checks run before, passed to the executables as their first argument.
+	static const string kStageDownload;
+	static const string kStageArtifactInstall;
+
+	PreflightChecks(
+		events::EventLoop &loop, const cfg_parser::PreflightChecks &checks, const string &dir);
+
+	// The handler is always called asynchronously.
+	void AsyncRun(const string &stage, HandlerFunction handler);
+
+private:
+	void RunBuiltinChecks();
+	void CollectScripts();
+	void RunNextScript();
+	void Finish();
+
+	events::EventLoop &loop_;
+	cfg_parser::PreflightChecks checks_;
+	string dir_;
+
+	// The ongoing run.
+	string stage_;
+	vector<string> scripts_;
+	size_t next_script_ {0};
+	procs::ScriptRunner runner_ {"Preflight check output"};
+	vector<string> failures_;
+	HandlerFunction handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_PREFLIGHT_CHECKS_HPP
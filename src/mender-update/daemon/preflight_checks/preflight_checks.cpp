@@ -0,0 +1,155 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/preflight_checks.hpp>
+
+#include <algorithm>
+#include <filesystem>
+#include <fstream>
+
+#include <common/common.hpp>
+#include <common/io.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace fs = std::filesystem;
+namespace io = mender::common::io;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+const string PreflightChecks::kStageDownload {"Download"};
+const string PreflightChecks::kStageArtifactInstall {"ArtifactInstall"};
+
+static const string kUptimeFile {"/proc/uptime"};
+
+PreflightChecks::PreflightChecks(
+	events::EventLoop &loop, const cfg_parser::PreflightChecks &checks, const string &dir) :
+	loop_ {loop},
+	checks_ {checks},
+	dir_ {dir} {
+}
+
+void PreflightChecks::AsyncRun(const string &stage, HandlerFunction handler) {
+	stage_ = stage;
+	handler_ = handler;
+	failures_.clear();
+
+	RunBuiltinChecks();
+	CollectScripts();
+	next_script_ = 0;
+
+	// Always asynchronously, also when there are no executables to run.
+	loop_.Post([this]() { RunNextScript(); });
+}
+
+void PreflightChecks::RunBuiltinChecks() {
+	for (const auto &check : checks_.free_space) {
+		auto exp_space = io::GetAvailableSpace(check.path);
+		if (!exp_space) {
+			failures_.push_back(exp_space.error().String());
+			continue;
+		}
+		if (exp_space.value() < static_cast<uintmax_t>(check.min_bytes)) {
+			failures_.push_back(
+				"Only " + to_string(exp_space.value()) + " bytes are available in " + check.path
+				+ ", at least " + to_string(check.min_bytes) + " are needed");
+		}
+	}
+
+	if (checks_.min_uptime_seconds > 0) {
+		double uptime = 0;
+		ifstream uptime_file(kUptimeFile);
+		if (!(uptime_file >> uptime)) {
+			failures_.push_back("Could not read the uptime from " + kUptimeFile);
+		} else if (uptime < checks_.min_uptime_seconds) {
+			failures_.push_back(
+				"The device has only been running for " + to_string(static_cast<int>(uptime))
+				+ " seconds, at least " + to_string(checks_.min_uptime_seconds)
+				+ " are needed");
+		}
+	}
+}
+
+void PreflightChecks::CollectScripts() {
+	scripts_ = checks_.scripts;
+
+	error_code ec;
+	if (!fs::is_directory(dir_, ec)) {
+		return;
+	}
+	vector<string> drop_ins;
+	for (const auto &entry : fs::directory_iterator(dir_, ec)) {
+		error_code entry_ec;
+		if (!entry.is_regular_file(entry_ec)) {
+			continue;
+		}
+		auto exp_executable = path::IsExecutable(entry.path().string(), true);
+		if (exp_executable && exp_executable.value()) {
+			drop_ins.push_back(entry.path().string());
+		}
+	}
+	if (ec) {
+		failures_.push_back("Could not read the preflight checks in " + dir_ + ": " + ec.message());
+	}
+	sort(drop_ins.begin(), drop_ins.end());
+	scripts_.insert(scripts_.end(), drop_ins.begin(), drop_ins.end());
+}
+
+void PreflightChecks::RunNextScript() {
+	if (next_script_ >= scripts_.size()) {
+		Finish();
+		return;
+	}
+
+	const string script = scripts_[next_script_++];
+	log::Debug("Running preflight check " + script);
+
+	auto err = runner_.AsyncRun(
+		loop_,
+		{script, stage_},
+		chrono::seconds {checks_.script_timeout_seconds},
+		[this, script](error::Error err, const string &first_line) {
+			// The first line is the reason, if the check fails.
+			if (err != error::NoError) {
+				string failure = script + " failed";
+				if (first_line != "") {
+					failure += ": " + first_line;
+				} else {
+					failure += ": " + err.String();
+				}
+				failures_.push_back(failure);
+			}
+			RunNextScript();
+		});
+	if (err != error::NoError) {
+		failures_.push_back("Could not run " + script + ": " + err.String());
+		RunNextScript();
+	}
+}
+
+void PreflightChecks::Finish() {
+	runner_.Cancel();
+	auto handler = handler_;
+	handler_ = nullptr;
+	handler(failures_);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
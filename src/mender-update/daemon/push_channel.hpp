@@ -0,0 +1,114 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_PUSH_CHANNEL_HPP
+#define MENDER_UPDATE_DAEMON_PUSH_CHANNEL_HPP
+
+#include <cstdint>
+#include <functional>
+#include <memory>
+#include <string>
+
+#include <api/client.hpp>
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+#include <common/http.hpp>
+#include <common/websocket.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace api = mender::api;
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+namespace http = mender::common::http;
+namespace websocket = mender::common::websocket;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// The same endpoint as mender-connect uses.
+const string kPushChannelURI {"/api/devices/v1/deviceconnect/connect"};
+
+// The header of the messages of the deviceconnect protocol.
+struct PushMessageHeader {
+	uint16_t proto;
+	string type;
+};
+using ExpectedPushMessageHeader = expected::expected<PushMessageHeader, error::Error>;
+
+// Keeps a WebSocket connection open to the deviceconnect API of the server, over which the server
+// tells the device to check for a deployment, or to send its inventory, right away. If the
+// connection fails, it is opened again later. The periodic polling goes on regardless. See
+// Documentation/push-channel.md.
+class PushChannel {
+public:
+	// Receives `kCheckUpdate` or `kSendInventory`.
+	using CommandHandler = function<void(const string &command)>;
+
+	// The protocol of the messages for the client, the same as mender-connect forwards over D-Bus.
+	static const uint16_t kProtoMenderClient;
+	static const string kCheckUpdate;
+	static const string kSendInventory;
+
+	PushChannel(
+		events::EventLoop &loop, api::Client &client, const cfg_parser::PushChannel &config);
+	~PushChannel();
+
+	bool Enabled() const {
+		return config_.enabled;
+	}
+
+	void Start(CommandHandler handler);
+	void Stop();
+
+	// Reads the header of a message, which is a MessagePack map with the header in `hdr`.
+	static ExpectedPushMessageHeader ParseHeader(const string &message);
+
+private:
+	void Connect();
+	void StartConnection(io::AsyncReadWriterPtr socket);
+	void HandleMessage(const websocket::Message &message);
+	void Disconnect(const string &reason);
+	void RetryLater();
+	void Ping();
+
+	events::Timer retry_timer_;
+	events::Timer ping_timer_;
+	api::Client &client_;
+	cfg_parser::PushChannel config_;
+	http::ExponentialBackoff backoff_;
+	CommandHandler handler_;
+
+	bool running_ {false};
+	bool ping_sent_ {false};
+	unique_ptr<websocket::Connection> connection_;
+	// A connection can't be destroyed from within its own handlers, so it is kept here until the
+	// next one is opened.
+	unique_ptr<websocket::Connection> closed_connection_;
+	// Set in the destructor, since cancelling the request calls its handlers.
+	shared_ptr<bool> destroying_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_PUSH_CHANNEL_HPP
@@ -0,0 +1,455 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/push_channel.hpp>
+
+#include <algorithm>
+#include <chrono>
+
+#include <api/api.hpp>
+#include <common/io.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace log = mender::common::log;
+
+const uint16_t PushChannel::kProtoMenderClient {4};
+const string PushChannel::kCheckUpdate {"check-update"};
+const string PushChannel::kSendInventory {"send-inventory"};
+
+// Nested maps and arrays deeper than this are refused, rather than skipped.
+static const int kMaxSkipDepth {16};
+
+static error::Error InvalidMessage(const string &what) {
+	return error::Error(
+		make_error_condition(errc::bad_message), "Invalid message from the server: " + what);
+}
+
+// Reads just as much MessagePack as the headers of the messages need, and skips the rest.
+class MessagePackReader {
+public:
+	explicit MessagePackReader(const string &data) :
+		data_ {data} {
+	}
+
+	expected::ExpectedSize ReadMapSize() {
+		auto exp_byte = ReadBigEndian(1);
+		if (!exp_byte) {
+			return expected::unexpected(exp_byte.error());
+		}
+		auto byte = exp_byte.value();
+		if (byte >= 0x80 && byte <= 0x8f) {
+			return byte & 0x0f;
+		}
+		if (byte == 0xde || byte == 0xdf) {
+			return ToSize(ReadBigEndian(byte == 0xde ? 2 : 4));
+		}
+		return expected::unexpected(InvalidMessage("Expected a map"));
+	}
+
+	expected::ExpectedString ReadString() {
+		auto exp_byte = ReadBigEndian(1);
+		if (!exp_byte) {
+			return expected::unexpected(exp_byte.error());
+		}
+		auto byte = exp_byte.value();
+		expected::ExpectedSize exp_size;
+		if (byte >= 0xa0 && byte <= 0xbf) {
+			exp_size = byte & 0x1f;
+		} else if (byte >= 0xd9 && byte <= 0xdb) {
+			exp_size = ToSize(ReadBigEndian(size_t {1} << (byte - 0xd9)));
+		} else {
+			return expected::unexpected(InvalidMessage("Expected a string"));
+		}
+		if (!exp_size) {
+			return expected::unexpected(exp_size.error());
+		}
+		if (data_.size() - pos_ < exp_size.value()) {
+			return expected::unexpected(InvalidMessage("Truncated string"));
+		}
+		string str = data_.substr(pos_, exp_size.value());
+		pos_ += exp_size.value();
+		return str;
+	}
+
+	expected::Expected<uint64_t> ReadUint() {
+		auto exp_byte = ReadBigEndian(1);
+		if (!exp_byte) {
+			return expected::unexpected(exp_byte.error());
+		}
+		auto byte = exp_byte.value();
+		if (byte <= 0x7f) {
+			return byte;
+		}
+		if (byte >= 0xcc && byte <= 0xcf) {
+			return ReadBigEndian(size_t {1} << (byte - 0xcc));
+		}
+		return expected::unexpected(InvalidMessage("Expected an unsigned integer"));
+	}
+
+	error::Error Skip(int depth = 0) {
+		if (depth > kMaxSkipDepth) {
+			return InvalidMessage("Nested too deeply");
+		}
+		auto exp_byte = ReadBigEndian(1);
+		if (!exp_byte) {
+			return exp_byte.error();
+		}
+		auto byte = exp_byte.value();
+
+		// The number of bytes to skip, and of elements to skip after them.
+		expected::ExpectedSize exp_bytes {0};
+		size_t elements {0};
+		if (byte <= 0x7f || byte >= 0xe0 || byte == 0xc0 || byte == 0xc2 || byte == 0xc3) {
+			// Fixints, nil and bools are just the one byte.
+		} else if (byte <= 0x8f) {
+			elements = 2 * (byte & 0x0f);
+		} else if (byte <= 0x9f) {
+			elements = byte & 0x0f;
+		} else if (byte <= 0xbf) {
+			exp_bytes = byte & 0x1f;
+		} else if (byte >= 0xc4 && byte <= 0xc6) {
+			exp_bytes = ToSize(ReadBigEndian(size_t {1} << (byte - 0xc4)));
+		} else if (byte >= 0xc7 && byte <= 0xc9) {
+			// Followed by the type of the extension.
+			exp_bytes = ToSize(ReadBigEndian(size_t {1} << (byte - 0xc7)));
+			if (exp_bytes) {
+				exp_bytes = exp_bytes.value() + 1;
+			}
+		} else if (byte == 0xca || byte == 0xcb) {
+			exp_bytes = byte == 0xca ? 4 : 8;
+		} else if (byte >= 0xcc && byte <= 0xd3) {
+			exp_bytes = size_t {1} << ((byte - 0xcc) % 4);
+		} else if (byte >= 0xd4 && byte <= 0xd8) {
+			exp_bytes = (size_t {1} << (byte - 0xd4)) + 1;
+		} else if (byte >= 0xd9 && byte <= 0xdb) {
+			exp_bytes = ToSize(ReadBigEndian(size_t {1} << (byte - 0xd9)));
+		} else if (byte == 0xdc || byte == 0xdd) {
+			auto exp_count = ToSize(ReadBigEndian(byte == 0xdc ? 2 : 4));
+			if (!exp_count) {
+				return exp_count.error();
+			}
+			elements = exp_count.value();
+		} else if (byte == 0xde || byte == 0xdf) {
+			auto exp_count = ToSize(ReadBigEndian(byte == 0xde ? 2 : 4));
+			if (!exp_count) {
+				return exp_count.error();
+			}
+			elements = 2 * exp_count.value();
+		} else {
+			return InvalidMessage("Unknown type " + to_string(byte));
+		}
+
+		if (!exp_bytes) {
+			return exp_bytes.error();
+		}
+		if (data_.size() - pos_ < exp_bytes.value()) {
+			return InvalidMessage("Truncated value");
+		}
+		pos_ += exp_bytes.value();
+
+		for (size_t i = 0; i < elements; i++) {
+			auto err = Skip(depth + 1);
+			if (err != error::NoError) {
+				return err;
+			}
+		}
+		return error::NoError;
+	}
+
+private:
+	expected::Expected<uint64_t> ReadBigEndian(size_t bytes) {
+		if (data_.size() - pos_ < bytes) {
+			return expected::unexpected(InvalidMessage("Truncated message"));
+		}
+		uint64_t value {0};
+		for (size_t i = 0; i < bytes; i++) {
+			value = (value << 8) | static_cast<uint8_t>(data_[pos_ + i]);
+		}
+		pos_ += bytes;
+		return value;
+	}
+
+	static expected::ExpectedSize ToSize(const expected::Expected<uint64_t> &exp_value) {
+		if (!exp_value) {
+			return expected::unexpected(exp_value.error());
+		}
+		return static_cast<size_t>(exp_value.value());
+	}
+
+	const string &data_;
+	size_t pos_ {0};
+};
+
+ExpectedPushMessageHeader PushChannel::ParseHeader(const string &message) {
+	MessagePackReader reader {message};
+	auto exp_size = reader.ReadMapSize();
+	if (!exp_size) {
+		return expected::unexpected(exp_size.error());
+	}
+
+	for (size_t i = 0; i < exp_size.value(); i++) {
+		auto exp_key = reader.ReadString();
+		if (!exp_key) {
+			return expected::unexpected(exp_key.error());
+		}
+		if (exp_key.value() != "hdr") {
+			auto err = reader.Skip();
+			if (err != error::NoError) {
+				return expected::unexpected(err);
+			}
+			continue;
+		}
+
+		auto exp_hdr_size = reader.ReadMapSize();
+		if (!exp_hdr_size) {
+			return expected::unexpected(exp_hdr_size.error());
+		}
+		PushMessageHeader header {0, ""};
+		for (size_t j = 0; j < exp_hdr_size.value(); j++) {
+			auto exp_field = reader.ReadString();
+			if (!exp_field) {
+				return expected::unexpected(exp_field.error());
+			}
+			if (exp_field.value() == "proto") {
+				auto exp_proto = reader.ReadUint();
+				if (!exp_proto) {
+					return expected::unexpected(exp_proto.error());
+				}
+				if (exp_proto.value() > UINT16_MAX) {
+					return expected::unexpected(InvalidMessage("Protocol out of range"));
+				}
+				header.proto = static_cast<uint16_t>(exp_proto.value());
+			} else if (exp_field.value() == "typ") {
+				auto exp_type = reader.ReadString();
+				if (!exp_type) {
+					return expected::unexpected(exp_type.error());
+				}
+				header.type = exp_type.value();
+			} else {
+				auto err = reader.Skip();
+				if (err != error::NoError) {
+					return expected::unexpected(err);
+				}
+			}
+		}
+		return header;
+	}
+
+	return expected::unexpected(InvalidMessage("No header"));
+}
+
+PushChannel::PushChannel(
+	events::EventLoop &loop, api::Client &client, const cfg_parser::PushChannel &config) :
+	retry_timer_ {loop},
+	ping_timer_ {loop},
+	client_ {client},
+	config_ {config},
+	backoff_ {chrono::seconds {config.max_retry_interval_seconds}},
+	destroying_ {make_shared<bool>(false)} {
+	backoff_.SetSmallestInterval(
+		min(chrono::seconds {60}, chrono::seconds {config.max_retry_interval_seconds}));
+}
+
+PushChannel::~PushChannel() {
+	*destroying_ = true;
+	Stop();
+}
+
+void PushChannel::Start(CommandHandler handler) {
+	handler_ = handler;
+	if (running_) {
+		return;
+	}
+	running_ = true;
+	Connect();
+}
+
+void PushChannel::Stop() {
+	running_ = false;
+	retry_timer_.Cancel();
+	ping_timer_.Cancel();
+	if (connection_) {
+		connection_->Cancel();
+		connection_.reset();
+	}
+	closed_connection_.reset();
+}
+
+void PushChannel::Connect() {
+	closed_connection_.reset();
+
+	auto req = make_shared<api::APIRequest>();
+	req->SetPath(kPushChannelURI);
+	req->SetMethod(http::Method::GET);
+	req->SetHeader("Connection", "Upgrade");
+	req->SetHeader("Upgrade", "websocket");
+	req->SetHeader("Sec-WebSocket-Key", websocket::MakeKey());
+	req->SetHeader("Sec-WebSocket-Version", websocket::kVersion);
+
+	auto destroying = destroying_;
+	auto err = client_.AsyncCall(
+		req,
+		[this, destroying](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (*destroying) {
+				return;
+			}
+			if (!exp_resp) {
+				log::Warning("Could not connect to the push channel: " + exp_resp.error().String());
+				RetryLater();
+				return;
+			}
+			auto resp = exp_resp.value();
+			if (resp->GetStatusCode() != http::StatusSwitchingProtocols) {
+				log::Warning(
+					"Could not connect to the push channel: Got unexpected response "
+					+ to_string(resp->GetStatusCode()) + ": " + resp->GetStatusMessage());
+				resp->SetBodyWriter(make_shared<io::Discard>());
+				RetryLater();
+				return;
+			}
+			auto exp_socket = resp->SwitchProtocol();
+			if (!exp_socket) {
+				log::Warning(
+					"Could not connect to the push channel: " + exp_socket.error().String());
+				RetryLater();
+				return;
+			}
+			if (!running_) {
+				return;
+			}
+			StartConnection(exp_socket.value());
+		},
+		[](http::ExpectedIncomingResponsePtr) {
+			// Either the connection has been switched over, or the response is discarded.
+		});
+	if (err != error::NoError) {
+		log::Warning("Could not connect to the push channel: " + err.String());
+		RetryLater();
+	}
+}
+
+void PushChannel::StartConnection(io::AsyncReadWriterPtr socket) {
+	connection_ = make_unique<websocket::Connection>(socket);
+	auto err = connection_->AsyncStart(
+		[this](const websocket::Message &message) { HandleMessage(message); },
+		[this](error::Error err) {
+			if (err != error::NoError) {
+				Disconnect(err.String());
+			} else {
+				Disconnect("The server closed the connection");
+			}
+		});
+	if (err != error::NoError) {
+		connection_.reset();
+		log::Warning("Could not connect to the push channel: " + err.String());
+		RetryLater();
+		return;
+	}
+
+	log::Info("Connected to the push channel of the server");
+	backoff_.Reset();
+	ping_sent_ = false;
+	Ping();
+}
+
+void PushChannel::HandleMessage(const websocket::Message &message) {
+	if (message.opcode != websocket::kBinaryFrame) {
+		log::Debug("Ignoring a text message from the push channel");
+		return;
+	}
+	auto exp_header = ParseHeader(message.payload);
+	if (!exp_header) {
+		log::Warning(exp_header.error().String());
+		return;
+	}
+	auto &header = exp_header.value();
+	if (header.proto != kProtoMenderClient
+		|| (header.type != kCheckUpdate && header.type != kSendInventory)) {
+		log::Debug(
+			"Ignoring a message of type " + header.type + " and protocol "
+			+ to_string(header.proto) + " from the push channel");
+		return;
+	}
+
+	log::Info("The server asked for " + header.type + " over the push channel");
+	if (handler_) {
+		handler_(header.type);
+	}
+}
+
+void PushChannel::Disconnect(const string &reason) {
+	log::Warning("Disconnected from the push channel: " + reason);
+	ping_timer_.Cancel();
+	closed_connection_ = std::move(connection_);
+	RetryLater();
+}
+
+void PushChannel::RetryLater() {
+	if (!running_) {
+		return;
+	}
+	auto exp_interval = backoff_.NextInterval();
+	if (!exp_interval) {
+		// Without a try count, the backoff never runs out. Just in case.
+		backoff_.Reset();
+		exp_interval = backoff_.NextInterval();
+	}
+	auto interval = exp_interval ? exp_interval.value() : backoff_.SmallestInterval();
+	log::Info(
+		"Connecting to the push channel again in "
+		+ to_string(chrono::duration_cast<chrono::seconds>(interval).count()) + " seconds");
+	retry_timer_.AsyncWait(interval, [this](error::Error err) {
+		if (err != error::NoError) {
+			if (err.code != make_error_condition(errc::operation_canceled)) {
+				log::Error("Push channel timer caused error: " + err.String());
+			}
+			return;
+		}
+		Connect();
+	});
+}
+
+void PushChannel::Ping() {
+	if (ping_sent_ && !connection_->TakeActivity()) {
+		connection_->Cancel();
+		Disconnect("No answer from the server to the ping");
+		return;
+	}
+
+	ping_sent_ = true;
+	connection_->Send(websocket::kPingFrame, "");
+	if (!connection_) {
+		// Writing the ping failed, and the connection is over.
+		return;
+	}
+
+	ping_timer_.AsyncWait(chrono::seconds {config_.ping_interval_seconds}, [this](error::Error err) {
+		if (err != error::NoError) {
+			if (err.code != make_error_condition(errc::operation_canceled)) {
+				log::Error("Push channel timer caused error: " + err.String());
+			}
+			return;
+		}
+		Ping();
+	});
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,109 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_REBOOT_GRACE_HPP
+#define MENDER_UPDATE_DAEMON_REBOOT_GRACE_HPP
+
+#include <chrono>
+#include <deque>
+#include <functional>
+#include <memory>
+#include <string>
+#include <unordered_set>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+#include <common/processes.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+namespace procs = mender::common::processes;
+
+// Announces a reboot into an update for a while before it happens, so that the work going on on
+// the device can be finished, see Documentation/reboot-grace.md. The configured applications may
+// each extend the grace period once, with the ExtendRebootGrace method of io.mender.Update1.
+class RebootGrace {
+public:
+	using EmitFunction = function<error::Error(const string &deployment_id, const string &pending)>;
+
+	// Replies to ExtendRebootGrace.
+	static const string kReplyExtended;
+	static const string kReplyNoPendingReboot;
+
+	RebootGrace(
+		events::EventLoop &loop,
+		chrono::seconds grace,
+		const vector<string> &applications,
+		chrono::seconds extension,
+		bool wall,
+		const string &hook);
+
+	bool Enabled() const {
+		return grace_ > chrono::seconds::zero();
+	}
+
+	// Sets the function used to emit the RebootPending signal.
+	void SetEmitFunction(EmitFunction emit) {
+		emit_ = emit;
+	}
+
+	// Announces the reboot, and calls the handler once the grace period, with its extensions, is
+	// over. The handler is always called asynchronously.
+	void AsyncWait(const string &deployment_id, function<void()> handler);
+
+	// Returns `kReplyExtended` if the pending reboot was postponed, and `kReplyNoPendingReboot`
+	// if there is none. Every application can only extend a grace period once.
+	expected::ExpectedString Extend(const string &application);
+
+	// The announcement, as in the RebootPending signal.
+	static string PendingJson(chrono::seconds seconds_left);
+
+private:
+	void Announce();
+	void ArmTimer();
+	void RunNext();
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	chrono::seconds grace_;
+	unordered_set<string> applications_;
+	chrono::seconds extension_;
+	bool wall_;
+	string hook_;
+	EmitFunction emit_;
+
+	// The pending reboot, if `handler_` is set.
+	string deployment_id_;
+	chrono::steady_clock::time_point end_;
+	unordered_set<string> extended_;
+	function<void()> handler_;
+
+	deque<vector<string>> commands_;
+	procs::ScriptRunner runner_ {"Reboot grace output"};
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_REBOOT_GRACE_HPP
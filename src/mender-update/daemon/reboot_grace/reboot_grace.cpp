@@ -0,0 +1,160 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/reboot_grace.hpp>
+
+#include <algorithm>
+
+#include <common/common.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace log = mender::common::log;
+
+const string RebootGrace::kReplyExtended {"extended"};
+const string RebootGrace::kReplyNoPendingReboot {"no-pending-reboot"};
+
+static const chrono::seconds kCommandTimeout {30};
+
+RebootGrace::RebootGrace(
+	events::EventLoop &loop,
+	chrono::seconds grace,
+	const vector<string> &applications,
+	chrono::seconds extension,
+	bool wall,
+	const string &hook) :
+	loop_ {loop},
+	timer_ {loop},
+	grace_ {grace},
+	applications_ {applications.begin(), applications.end()},
+	extension_ {extension},
+	wall_ {wall},
+	hook_ {hook} {
+}
+
+string RebootGrace::PendingJson(chrono::seconds seconds_left) {
+	return R"({"seconds_left":)" + to_string(seconds_left.count()) + "}";
+}
+
+void RebootGrace::AsyncWait(const string &deployment_id, function<void()> handler) {
+	if (!Enabled()) {
+		loop_.Post(handler);
+		return;
+	}
+
+	deployment_id_ = deployment_id;
+	end_ = chrono::steady_clock::now() + grace_;
+	extended_.clear();
+	handler_ = handler;
+	Announce();
+	ArmTimer();
+}
+
+expected::ExpectedString RebootGrace::Extend(const string &application) {
+	if (applications_.count(application) == 0) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"'" + application + "' is not in RebootGraceApplications"));
+	}
+	if (!handler_) {
+		return kReplyNoPendingReboot;
+	}
+	if (extended_.count(application) != 0) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::operation_not_permitted),
+			"'" + application + "' has already extended the grace period of this reboot"));
+	}
+
+	log::Info(
+		application + " extended the grace period of the reboot by "
+		+ to_string(extension_.count()) + " seconds");
+	extended_.insert(application);
+	end_ += extension_;
+	Announce();
+	ArmTimer();
+	return kReplyExtended;
+}
+
+void RebootGrace::Announce() {
+	auto seconds_left = chrono::ceil<chrono::seconds>(end_ - chrono::steady_clock::now());
+	const string seconds_string = to_string(seconds_left.count());
+	log::Info("Rebooting in " + seconds_string + " seconds to finish installing the update");
+
+	if (emit_) {
+		auto err = emit_(deployment_id_, PendingJson(seconds_left));
+		if (err != error::NoError) {
+			log::Debug("Could not announce the pending reboot on DBus: " + err.String());
+		}
+	}
+	if (wall_) {
+		commands_.push_back(
+			{"wall",
+			 "Mender: The device will reboot in " + seconds_string
+				 + " seconds to finish installing an update."});
+	}
+	if (hook_ != "") {
+		commands_.push_back({hook_, deployment_id_, seconds_string});
+	}
+
+	if (!runner_.Running()) {
+		RunNext();
+	}
+}
+
+void RebootGrace::ArmTimer() {
+	timer_.Cancel();
+	auto remaining = max(end_ - chrono::steady_clock::now(), chrono::steady_clock::duration {0});
+	timer_.AsyncWait(remaining, [this](error::Error err) {
+		if (err != error::NoError || !handler_) {
+			return;
+		}
+		auto handler = handler_;
+		handler_ = nullptr;
+		extended_.clear();
+		handler();
+	});
+}
+
+void RebootGrace::RunNext() {
+	if (commands_.empty()) {
+		return;
+	}
+
+	auto command = commands_.front();
+	commands_.pop_front();
+	const string command_string = common::JoinStrings(command, " ");
+
+	auto err = runner_.AsyncRun(
+		loop_,
+		command,
+		kCommandTimeout,
+		[this, command_string](error::Error err, const string &first_line) {
+			if (err != error::NoError) {
+				log::Warning("`" + command_string + "` failed: " + err.String());
+			}
+			RunNext();
+		});
+	if (err != error::NoError) {
+		log::Warning("Could not run `" + command_string + "`: " + err.String());
+		RunNext();
+	}
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,113 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_SELF_TEST_HPP
+#define MENDER_UPDATE_DAEMON_SELF_TEST_HPP
+
+#include <functional>
+#include <memory>
+#include <string>
+#include <utility>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/processes.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace procs = mender::common::processes;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// In the data store.
+const string kSelfTestFile {"self-test"};
+
+// Checks that the client still works after it has been upgraded, before the daemon goes on with
+// its work, see Documentation/self-test.md. The outcome is kept in a file of its own, so that the
+// checks run again on every start until they pass, and for the inventory script.
+class SelfTest {
+public:
+	// A check calls `done` once, with an error if it failed, possibly before it returns.
+	using CheckFunction = function<void(function<void(error::Error)> done)>;
+	// Receives one message for every check which failed, or nothing if all of them passed.
+	using HandlerFunction = function<void(const vector<string> &failures)>;
+
+	SelfTest(
+		events::EventLoop &loop,
+		const cfg_parser::SelfTest &config,
+		const string &dir,
+		const string &path);
+
+	bool Enabled() const {
+		return config_.enabled;
+	}
+
+	// Whether the checks must run for this version of the client: another version ran last, or
+	// the checks failed. On the very first start, there is nothing to compare with, so `version`
+	// is only recorded as passed.
+	bool Due(const string &version);
+
+	// Checks which are run before the executables in the self-test directory, in order.
+	void AddCheck(const string &name, CheckFunction check);
+
+	// Records the outcome for `version`, and calls the handler with it. While the checks fail,
+	// they are run again every RetryIntervalSeconds, without calling the handler again. The
+	// handler is always called asynchronously.
+	void AsyncRun(const string &version, HandlerFunction handler);
+
+	// True from a run which failed until one passes.
+	bool Failed() const {
+		return failed_;
+	}
+
+private:
+	void RunNextCheck();
+	void RunNextScript();
+	void Finish();
+	void Record();
+
+	events::EventLoop &loop_;
+	cfg_parser::SelfTest config_;
+	string dir_;
+	string path_;
+	vector<pair<string, CheckFunction>> checks_;
+	events::Timer retry_timer_;
+
+	string version_;
+	bool failed_ {false};
+
+	// The ongoing run.
+	size_t next_check_ {0};
+	vector<string> scripts_;
+	size_t next_script_ {0};
+	procs::ScriptRunner runner_ {"Self-test check output"};
+	vector<string> failures_;
+	HandlerFunction handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_SELF_TEST_HPP
@@ -0,0 +1,221 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/self_test.hpp>
+
+#include <algorithm>
+#include <chrono>
+#include <filesystem>
+
+#include <common/common.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace fs = std::filesystem;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+SelfTest::SelfTest(
+	events::EventLoop &loop,
+	const cfg_parser::SelfTest &config,
+	const string &dir,
+	const string &path) :
+	loop_ {loop},
+	config_ {config},
+	dir_ {dir},
+	path_ {path},
+	retry_timer_ {loop} {
+}
+
+bool SelfTest::Due(const string &version) {
+	if (!path::FileExists(path_)) {
+		version_ = version;
+		Record();
+		return false;
+	}
+
+	auto exp_json = json::LoadFromFile(path_);
+	if (!exp_json) {
+		log::Warning(
+			"Could not load the outcome of the last self-test: " + exp_json.error().String());
+		return true;
+	}
+	auto exp_version = exp_json.value().Get("version").and_then(json::ToString);
+	auto exp_passed = exp_json.value().Get("passed").and_then(json::ToBool);
+	return !exp_version || exp_version.value() != version || !exp_passed || !exp_passed.value();
+}
+
+void SelfTest::AddCheck(const string &name, CheckFunction check) {
+	checks_.push_back({name, check});
+}
+
+void SelfTest::AsyncRun(const string &version, HandlerFunction handler) {
+	retry_timer_.Cancel();
+	version_ = version;
+	handler_ = handler;
+	failures_.clear();
+	next_check_ = 0;
+	next_script_ = 0;
+
+	log::Info("Running the self-test of mender-update " + version);
+
+	scripts_.clear();
+	error_code ec;
+	if (fs::is_directory(dir_, ec)) {
+		for (const auto &entry : fs::directory_iterator(dir_, ec)) {
+			error_code entry_ec;
+			if (!entry.is_regular_file(entry_ec)) {
+				continue;
+			}
+			auto exp_executable = path::IsExecutable(entry.path().string(), true);
+			if (exp_executable && exp_executable.value()) {
+				scripts_.push_back(entry.path().string());
+			}
+		}
+		if (ec) {
+			failures_.push_back("Could not read the checks in " + dir_ + ": " + ec.message());
+		}
+		sort(scripts_.begin(), scripts_.end());
+	}
+
+	// Always asynchronously, also when there is nothing to run.
+	loop_.Post([this]() { RunNextCheck(); });
+}
+
+void SelfTest::RunNextCheck() {
+	if (next_check_ >= checks_.size()) {
+		RunNextScript();
+		return;
+	}
+
+	const auto &check = checks_[next_check_++];
+	log::Debug("Running the " + check.first + " self-test check");
+	string name {check.first};
+	check.second([this, name](error::Error err) {
+		if (err != error::NoError) {
+			failures_.push_back(name + ": " + err.String());
+		}
+		// The check may well call this from within itself.
+		loop_.Post([this]() { RunNextCheck(); });
+	});
+}
+
+void SelfTest::RunNextScript() {
+	if (next_script_ >= scripts_.size()) {
+		Finish();
+		return;
+	}
+
+	const string script = scripts_[next_script_++];
+	log::Debug("Running the self-test check " + script);
+
+	auto err = runner_.AsyncRun(
+		loop_,
+		{script},
+		chrono::seconds {config_.script_timeout_seconds},
+		[this, script](error::Error err, const string &first_line) {
+			// The first line is the reason, if the check fails.
+			if (err != error::NoError) {
+				failures_.push_back(
+					path::BaseName(script) + ": " + (first_line != "" ? first_line : err.String()));
+			}
+			RunNextScript();
+		});
+	if (err != error::NoError) {
+		failures_.push_back("Could not run " + script + ": " + err.String());
+		RunNextScript();
+	}
+}
+
+void SelfTest::Finish() {
+	runner_.Cancel();
+
+	const bool was_failed = failed_;
+	failed_ = !failures_.empty();
+	if (failed_) {
+		for (const auto &failure : failures_) {
+			log::Error("Self-test failed: " + failure);
+		}
+		log::Error(
+			"mender-update " + version_
+			+ " failed its self-test, no deployments are started until it passes. Trying again in "
+			+ to_string(config_.retry_interval_seconds) + " seconds");
+	} else if (was_failed) {
+		log::Info("The self-test passes now, the deployments are resumed");
+	} else {
+		log::Info("Self-test passed");
+	}
+	Record();
+
+	if (failed_) {
+		retry_timer_.AsyncWait(
+			chrono::seconds {config_.retry_interval_seconds}, [this](error::Error err) {
+				if (err != error::NoError) {
+					// Cancelled.
+					return;
+				}
+				AsyncRun(version_, nullptr);
+			});
+	}
+
+	auto handler = handler_;
+	handler_ = nullptr;
+	if (handler) {
+		handler(failures_);
+	}
+}
+
+void SelfTest::Record() {
+	vector<string> failures;
+	for (const auto &failure : failures_) {
+		failures.push_back("\"" + json::EscapeString(failure) + "\"");
+	}
+	const auto now =
+		chrono::duration_cast<chrono::seconds>(chrono::system_clock::now().time_since_epoch());
+	const string content = R"({"version":")" + json::EscapeString(version_) + R"(","passed":)"
+						   + (failures_.empty() ? "true" : "false") + R"(,"failures":[)"
+						   + common::JoinStrings(failures, ",") + R"(],"time":)"
+						   + to_string(now.count()) + "}\n";
+
+	// Replaced in one go, so that the inventory script never sees a partial file.
+	const string tmp_path = path_ + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	error::Error err;
+	if (!exp_stream) {
+		err = exp_stream.error();
+	} else {
+		err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+		exp_stream.value().close();
+		if (err == error::NoError) {
+			err = path::Rename(tmp_path, path_);
+		}
+	}
+	if (err != error::NoError) {
+		log::Warning("Could not record the outcome of the self-test: " + err.String());
+	}
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,99 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_SERVICE_NOTIFIER_HPP
+#define MENDER_UPDATE_DAEMON_SERVICE_NOTIFIER_HPP
+
+#include <chrono>
+#include <string>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+// Tells systemd when the daemon is ready, and what it is doing, with the notification protocol of
+// sd_notify(3), see Documentation/systemd-integration.md. Does nothing unless systemd gave the
+// daemon a socket for that, in NOTIFY_SOCKET.
+//
+// Notifications are best effort: failures are only logged.
+class ServiceNotifier {
+public:
+	// Uses the socket in NOTIFY_SOCKET, and the watchdog interval in WATCHDOG_USEC, if
+	// WATCHDOG_PID is unset or this process.
+	ServiceNotifier();
+	ServiceNotifier(
+		const string &socket_path,
+		chrono::microseconds watchdog_interval = chrono::microseconds {0});
+
+	bool Enabled() const {
+		return socket_path_ != "";
+	}
+
+	// How often systemd expects a keep-alive, 0 if it doesn't.
+	chrono::microseconds WatchdogInterval() const {
+		return Enabled() ? watchdog_interval_ : chrono::microseconds {0};
+	}
+
+	// Tells that the daemon has started, before it waits for anything, see `WaitingFor()`. Only
+	// the first call is sent.
+	void Ready();
+	// Only the first call is sent.
+	void Stopping();
+	void KeepAlive();
+	// Around a reload of the configuration, once the daemon is ready. `Reloaded()` tells that it
+	// is ready again.
+	void Reloading();
+	void Reloaded();
+
+	// What the daemon waits for before contacting the server, such as the StartupWait conditions
+	// or the self-test, empty once it doesn't anymore.
+	void WaitingFor(const string &conditions);
+	void StateChanged(
+		const string &state, const string &deployment_id, const string &artifact_name);
+	void AuthorizationChanged(bool authorized);
+
+	// The status line shown by `systemctl status`, for the state of the daemon, such as
+	// "Authorizing" or "Idle".
+	static string StatusText(
+		const string &state,
+		const string &deployment_id,
+		const string &artifact_name,
+		bool authorized,
+		const string &waiting_for);
+
+private:
+	void UpdateStatus();
+	void Send(const string &message);
+
+	string socket_path_;
+	chrono::microseconds watchdog_interval_;
+	bool ready_ {false};
+	bool stopping_ {false};
+
+	string state_;
+	string deployment_id_;
+	string artifact_name_;
+	bool authorized_ {false};
+	string waiting_for_;
+	string status_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_SERVICE_NOTIFIER_HPP
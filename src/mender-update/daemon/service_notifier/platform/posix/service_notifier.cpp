@@ -0,0 +1,204 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/service_notifier.hpp>
+
+#include <cerrno>
+#include <cstddef>
+#include <cstdlib>
+#include <cstring>
+
+#include <sys/socket.h>
+#include <sys/un.h>
+#include <unistd.h>
+
+#include <common/common.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace log = mender::common::log;
+
+static string SocketFromEnvironment() {
+	auto socket_path = getenv("NOTIFY_SOCKET");
+	return socket_path != nullptr ? socket_path : "";
+}
+
+static chrono::microseconds WatchdogFromEnvironment() {
+	auto usec = getenv("WATCHDOG_USEC");
+	if (usec == nullptr) {
+		return chrono::microseconds {0};
+	}
+	auto pid = getenv("WATCHDOG_PID");
+	if (pid != nullptr) {
+		auto exp_pid = common::StringTo<int64_t>(pid);
+		if (!exp_pid || exp_pid.value() != getpid()) {
+			// Meant for another process.
+			return chrono::microseconds {0};
+		}
+	}
+	auto exp_usec = common::StringTo<int64_t>(usec);
+	if (!exp_usec || exp_usec.value() <= 0) {
+		log::Warning("Invalid WATCHDOG_USEC: " + string(usec) + ", not sending keep-alives");
+		return chrono::microseconds {0};
+	}
+	return chrono::microseconds {exp_usec.value()};
+}
+
+ServiceNotifier::ServiceNotifier() :
+	ServiceNotifier(SocketFromEnvironment(), WatchdogFromEnvironment()) {
+}
+
+ServiceNotifier::ServiceNotifier(
+	const string &socket_path, chrono::microseconds watchdog_interval) :
+	socket_path_ {socket_path},
+	watchdog_interval_ {watchdog_interval} {
+}
+
+void ServiceNotifier::Ready() {
+	if (ready_) {
+		return;
+	}
+	ready_ = true;
+	status_ = StatusText(state_, deployment_id_, artifact_name_, authorized_, waiting_for_);
+	Send("READY=1\nSTATUS=" + status_);
+}
+
+void ServiceNotifier::Stopping() {
+	if (stopping_) {
+		return;
+	}
+	stopping_ = true;
+	Send("STOPPING=1\nSTATUS=Stopping");
+}
+
+void ServiceNotifier::KeepAlive() {
+	Send("WATCHDOG=1");
+}
+
+void ServiceNotifier::Reloading() {
+	if (!ready_) {
+		// Still starting, and `Ready()` comes after the reload anyway.
+		return;
+	}
+	// With Type=notify-reload, systemd needs the time of the reload, on the monotonic clock.
+	auto now = chrono::duration_cast<chrono::microseconds>(
+		chrono::steady_clock::now().time_since_epoch());
+	Send(
+		"RELOADING=1\nMONOTONIC_USEC=" + to_string(now.count())
+		+ "\nSTATUS=Reloading the configuration");
+}
+
+void ServiceNotifier::Reloaded() {
+	if (!ready_) {
+		return;
+	}
+	status_ = StatusText(state_, deployment_id_, artifact_name_, authorized_, waiting_for_);
+	Send("READY=1\nSTATUS=" + status_);
+}
+
+void ServiceNotifier::WaitingFor(const string &conditions) {
+	waiting_for_ = conditions;
+	UpdateStatus();
+}
+
+void ServiceNotifier::StateChanged(
+	const string &state, const string &deployment_id, const string &artifact_name) {
+	state_ = state;
+	deployment_id_ = deployment_id;
+	artifact_name_ = artifact_name;
+	UpdateStatus();
+}
+
+void ServiceNotifier::AuthorizationChanged(bool authorized) {
+	authorized_ = authorized;
+	UpdateStatus();
+}
+
+string ServiceNotifier::StatusText(
+	const string &state,
+	const string &deployment_id,
+	const string &artifact_name,
+	bool authorized,
+	const string &waiting_for) {
+	if (deployment_id != "") {
+		return "Deploying " + artifact_name + " (deployment " + deployment_id + "): " + state;
+	}
+	if (waiting_for != "") {
+		return "Waiting for " + waiting_for;
+	}
+	if (state == "PollForDeploymentState" || state == "SubmitInventoryState") {
+		if (!authorized) {
+			return "Authorizing";
+		}
+		return state == "PollForDeploymentState" ? "Checking for updates" : "Submitting inventory";
+	}
+	return "Idle";
+}
+
+void ServiceNotifier::UpdateStatus() {
+	auto status = StatusText(state_, deployment_id_, artifact_name_, authorized_, waiting_for_);
+	if (status == status_) {
+		return;
+	}
+	status_ = status;
+	Send("STATUS=" + status_);
+}
+
+void ServiceNotifier::Send(const string &message) {
+	if (!Enabled()) {
+		return;
+	}
+
+	struct sockaddr_un addr {};
+	addr.sun_family = AF_UNIX;
+	if (socket_path_.size() >= sizeof(addr.sun_path)
+		|| (socket_path_[0] != '/' && socket_path_[0] != '@')) {
+		log::Warning("Invalid NOTIFY_SOCKET: " + socket_path_ + ", not notifying systemd");
+		socket_path_ = "";
+		return;
+	}
+	memcpy(addr.sun_path, socket_path_.data(), socket_path_.size());
+	if (addr.sun_path[0] == '@') {
+		// Abstract socket.
+		addr.sun_path[0] = '\0';
+	}
+	auto addr_len =
+		static_cast<socklen_t>(offsetof(struct sockaddr_un, sun_path) + socket_path_.size());
+
+	int fd = socket(AF_UNIX, SOCK_DGRAM | SOCK_CLOEXEC, 0);
+	if (fd < 0) {
+		log::Warning("Could not notify systemd: " + string(strerror(errno)));
+		return;
+	}
+	auto sent = sendto(
+		fd,
+		message.data(),
+		message.size(),
+		MSG_NOSIGNAL,
+		reinterpret_cast<const struct sockaddr *>(&addr),
+		addr_len);
+	if (sent < 0) {
+		log::Warning("Could not notify systemd: " + string(strerror(errno)));
+	}
+	close(fd);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,120 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_STANDALONE_UPDATE_HPP
+#define MENDER_UPDATE_DAEMON_STANDALONE_UPDATE_HPP
+
+#include <functional>
+#include <memory>
+#include <string>
+#include <thread>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+
+#include <mender-update/context.hpp>
+#include <mender-update/standalone.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+
+namespace context = mender::update::context;
+namespace standalone = mender::update::standalone;
+
+// Installs, commits and rolls back Artifacts in standalone mode on behalf of local applications,
+// with the Install, Commit and Rollback methods of io.mender.Update1, see
+// Documentation/standalone-over-dbus.md. The standalone state machine blocks until it is done, so
+// every operation runs in a thread of its own, with an event loop of its own, and reports back on
+// the event loop of the daemon.
+class StandaloneUpdate {
+public:
+	enum class Operation {
+		Install,
+		Commit,
+		Rollback,
+	};
+
+	using EmitFunction = function<error::Error(const string &operation, const string &data)>;
+
+	// Reply to the methods.
+	static const string kReplyStarted;
+
+	StandaloneUpdate(events::EventLoop &loop, context::MenderContext &main_context);
+	// Waits for the running operation, if any, to finish.
+	~StandaloneUpdate();
+
+	// Sets the functions used to emit the StandaloneProgress and StandaloneFinished signals.
+	void SetEmitFunctions(EmitFunction progress, EmitFunction finished) {
+		emit_progress_ = progress;
+		emit_finished_ = finished;
+	}
+
+	bool Running() const {
+		return running_;
+	}
+
+	// Whether an operation is running, or an installation waits for its commit or rollback. The
+	// daemon doesn't look for deployments meanwhile.
+	bool Busy();
+
+	// Starts the operation, and returns `kReplyStarted`. `src` is the path or the URL of the
+	// Artifact to install, and is ignored by the other operations. Fails if another operation is
+	// running, or if an installation is started while another one waits for its commit. The
+	// handler, if any, is called when the operation is over, after StandaloneFinished.
+	expected::ExpectedString Start(
+		Operation operation,
+		const string &src,
+		function<void(const standalone::ResultAndError &)> handler = nullptr);
+
+	// `install`, `commit` or `rollback`, as in the signals.
+	static string OperationName(Operation operation);
+
+	// The outcome, as in StandaloneFinished: The flags of the result, and the error, if any, for
+	// example `{"result":["Installed","RebootRequired"],"error":null}`.
+	static string ResultJson(const standalone::ResultAndError &result);
+
+private:
+	// In the thread.
+	standalone::ResultAndError Run(Operation operation, const string &src);
+	void Finish(
+		Operation operation,
+		const standalone::ResultAndError &result,
+		function<void(const standalone::ResultAndError &)> handler);
+
+	events::EventLoop &loop_;
+	context::MenderContext &main_context_;
+	EmitFunction emit_progress_;
+	EmitFunction emit_finished_;
+
+	bool running_ {false};
+	thread thread_;
+	// Set when this object is destroyed, for the events posted by the thread which are handled
+	// afterwards.
+	shared_ptr<bool> destroying_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_STANDALONE_UPDATE_HPP
@@ -0,0 +1,210 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/standalone_update.hpp>
+
+#include <utility>
+#include <vector>
+
+#include <common/json.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+
+namespace artifact = mender::artifact;
+
+using Result = standalone::Result;
+
+const string StandaloneUpdate::kReplyStarted {"started"};
+
+StandaloneUpdate::StandaloneUpdate(events::EventLoop &loop, context::MenderContext &main_context) :
+	loop_ {loop},
+	main_context_ {main_context},
+	destroying_ {make_shared<bool>(false)} {
+}
+
+StandaloneUpdate::~StandaloneUpdate() {
+	*destroying_ = true;
+	if (thread_.joinable()) {
+		log::Info("Waiting for the standalone operation to finish");
+		thread_.join();
+	}
+}
+
+bool StandaloneUpdate::Busy() {
+	if (running_) {
+		return true;
+	}
+	auto exp_data = standalone::LoadStateData(main_context_.GetMenderStoreDB());
+	if (!exp_data) {
+		log::Warning("Could not read the standalone state data: " + exp_data.error().String());
+		return false;
+	}
+	return exp_data.value().has_value();
+}
+
+expected::ExpectedString StandaloneUpdate::Start(
+	Operation operation,
+	const string &src,
+	function<void(const standalone::ResultAndError &)> handler) {
+	if (running_) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::device_or_resource_busy),
+			"Another standalone operation is running"));
+	}
+	if (operation == Operation::Install) {
+		auto exp_data = standalone::LoadStateData(main_context_.GetMenderStoreDB());
+		if (!exp_data) {
+			return expected::unexpected(exp_data.error());
+		}
+		if (exp_data.value()) {
+			return expected::unexpected(error::Error(
+				make_error_condition(errc::device_or_resource_busy),
+				"Artifact '" + exp_data.value()->artifact_name
+					+ "' is waiting to be committed or rolled back"));
+		}
+		log::Info("Standalone installation of " + src + " requested");
+	} else {
+		log::Info("Standalone " + OperationName(operation) + " requested");
+	}
+
+	// The thread of the previous operation, if any, has been joined in Finish().
+	running_ = true;
+	thread_ = thread([this, operation, src, handler]() {
+		auto result = Run(operation, src);
+		auto destroying = destroying_;
+		loop_.Post([this, destroying, operation, result, handler]() {
+			if (*destroying) {
+				return;
+			}
+			Finish(operation, result, handler);
+		});
+	});
+	return kReplyStarted;
+}
+
+standalone::ResultAndError StandaloneUpdate::Run(Operation operation, const string &src) {
+	events::EventLoop loop;
+	standalone::Context ctx {main_context_, loop};
+	const string name = OperationName(operation);
+	auto destroying = destroying_;
+	ctx.report_state = [this, destroying, name](const string &state) {
+		loop_.Post([this, destroying, name, state]() {
+			if (*destroying || !emit_progress_) {
+				return;
+			}
+			auto err = emit_progress_(name, state);
+			if (err != error::NoError) {
+				log::Debug("Could not emit the standalone progress: " + err.String());
+			}
+		});
+	};
+
+	switch (operation) {
+	case Operation::Install:
+		return standalone::Install(
+			ctx, src, artifact::config::Signature::Verify, standalone::InstallOptions::NoStdout);
+	case Operation::Commit:
+		return standalone::Commit(ctx);
+	case Operation::Rollback:
+		return standalone::Rollback(ctx);
+	}
+	// Unreachable, but some compilers don't know that.
+	return {Result::NoResult, error::MakeError(error::ProgrammingError, "Unknown operation")};
+}
+
+void StandaloneUpdate::Finish(
+	Operation operation,
+	const standalone::ResultAndError &result,
+	function<void(const standalone::ResultAndError &)> handler) {
+	thread_.join();
+	running_ = false;
+
+	const string name = OperationName(operation);
+	const string result_json = ResultJson(result);
+	if (result.err != error::NoError) {
+		log::Error("Standalone " + name + " failed: " + result.err.String());
+	} else {
+		log::Info("Standalone " + name + " finished: " + result_json);
+	}
+	if (emit_finished_) {
+		auto err = emit_finished_(name, result_json);
+		if (err != error::NoError) {
+			log::Debug("Could not emit the end of the standalone operation: " + err.String());
+		}
+	}
+	if (handler) {
+		handler(result);
+	}
+}
+
+string StandaloneUpdate::OperationName(Operation operation) {
+	switch (operation) {
+	case Operation::Install:
+		return "install";
+	case Operation::Commit:
+		return "commit";
+	case Operation::Rollback:
+		return "rollback";
+	}
+	return "unknown";
+}
+
+string StandaloneUpdate::ResultJson(const standalone::ResultAndError &result) {
+	const vector<pair<Result, string>> flags {
+		{Result::NoUpdateInProgress, "NoUpdateInProgress"},
+		{Result::Downloaded, "Downloaded"},
+		{Result::DownloadFailed, "DownloadFailed"},
+		{Result::Installed, "Installed"},
+		{Result::InstallFailed, "InstallFailed"},
+		{Result::RebootRequired, "RebootRequired"},
+		{Result::Committed, "Committed"},
+		{Result::CommitFailed, "CommitFailed"},
+		{Result::Failed, "Failed"},
+		{Result::FailedInPostCommit, "FailedInPostCommit"},
+		{Result::NoRollback, "NoRollback"},
+		{Result::RolledBack, "RolledBack"},
+		{Result::NoRollbackNecessary, "NoRollbackNecessary"},
+		{Result::RollbackFailed, "RollbackFailed"},
+		{Result::Cleaned, "Cleaned"},
+		{Result::CleanupFailed, "CleanupFailed"},
+		{Result::AutoCommitWanted, "AutoCommitWanted"},
+	};
+
+	string reply = R"({"result":[)";
+	string separator;
+	for (const auto &flag : flags) {
+		if (standalone::ResultContains(result.result, flag.first)) {
+			reply += separator + "\"" + flag.second + "\"";
+			separator = ",";
+		}
+	}
+	reply += R"(],"error":)";
+	if (result.err != error::NoError) {
+		reply += "\"" + json::EscapeString(result.err.String()) + "\"";
+	} else {
+		reply += "null";
+	}
+	return reply + "}";
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,90 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_DAEMON_STARTUP_WAIT_HPP
+#define MENDER_UPDATE_DAEMON_STARTUP_WAIT_HPP
+
+#include <chrono>
+#include <functional>
+#include <string>
+#include <vector>
+
+#include <common/events.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace events = mender::common::events;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// Holds back the first contact with the server until the clock is synchronized and the network
+// interfaces are up, as configured in StartupWait, see Documentation/systemd-integration.md.
+class StartupWait {
+public:
+	// Where the state of the network interfaces is, as `<interface>/operstate`.
+	static const string kNetDir;
+	// Created by systemd-timesyncd once the clock is synchronized.
+	static const string kTimesyncFile;
+	static const chrono::seconds kCheckInterval;
+
+	StartupWait(
+		events::EventLoop &loop,
+		const cfg_parser::StartupWait &config,
+		const string &net_dir = kNetDir,
+		const string &timesync_file = kTimesyncFile);
+
+	bool Enabled() const {
+		return config_.Enabled();
+	}
+
+	// The conditions which aren't met yet, such as "time synchronization" or "network interface
+	// eth0".
+	vector<string> Unmet() const;
+
+	using ProgressHandler = function<void(const vector<string> &unmet)>;
+
+	// Calls `progress` whenever the conditions which aren't met change, and `handler` once they
+	// are all met, or when StartupWait.TimeoutSeconds have passed. The handler is always called
+	// asynchronously.
+	void AsyncWait(ProgressHandler progress, function<void()> handler);
+
+private:
+	bool TimeSynchronized() const;
+	bool InterfaceUp(const string &interface) const;
+	void Check();
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	cfg_parser::StartupWait config_;
+	string net_dir_;
+	string timesync_file_;
+
+	chrono::steady_clock::time_point started_;
+	vector<string> unmet_;
+	ProgressHandler progress_;
+	function<void()> handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_STARTUP_WAIT_HPP
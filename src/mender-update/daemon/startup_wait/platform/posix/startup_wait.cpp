@@ -0,0 +1,128 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/daemon/startup_wait.hpp>
+
+#include <fstream>
+
+#include <sys/timex.h>
+
+#include <common/common.hpp>
+#include <common/error.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace error = mender::common::error;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+const string StartupWait::kNetDir {"/sys/class/net"};
+const string StartupWait::kTimesyncFile {"/run/systemd/timesync/synchronized"};
+const chrono::seconds StartupWait::kCheckInterval {1};
+
+StartupWait::StartupWait(
+	events::EventLoop &loop,
+	const cfg_parser::StartupWait &config,
+	const string &net_dir,
+	const string &timesync_file) :
+	loop_ {loop},
+	timer_ {loop},
+	config_ {config},
+	net_dir_ {net_dir},
+	timesync_file_ {timesync_file} {
+}
+
+bool StartupWait::TimeSynchronized() const {
+	if (path::FileExists(timesync_file_)) {
+		return true;
+	}
+	// Other NTP clients only tell the kernel.
+	struct timex tx {};
+	return ntp_adjtime(&tx) != TIME_ERROR;
+}
+
+bool StartupWait::InterfaceUp(const string &interface) const {
+	ifstream operstate(path::Join(net_dir_, interface, "operstate"));
+	string state;
+	if (!(operstate >> state)) {
+		return false;
+	}
+	// Some drivers don't report the state of the link, but the interface works.
+	return state == "up" || state == "unknown";
+}
+
+vector<string> StartupWait::Unmet() const {
+	vector<string> unmet;
+	if (config_.time_sync && !TimeSynchronized()) {
+		unmet.push_back("time synchronization");
+	}
+	for (const auto &interface : config_.interfaces) {
+		if (!InterfaceUp(interface)) {
+			unmet.push_back("network interface " + interface);
+		}
+	}
+	return unmet;
+}
+
+void StartupWait::AsyncWait(ProgressHandler progress, function<void()> handler) {
+	progress_ = progress;
+	handler_ = handler;
+	unmet_.clear();
+	started_ = chrono::steady_clock::now();
+	loop_.Post([this]() { Check(); });
+}
+
+void StartupWait::Check() {
+	auto unmet = Unmet();
+	if (unmet.empty()) {
+		if (!unmet_.empty()) {
+			log::Info("Done waiting for " + common::JoinStrings(unmet_, " and "));
+		}
+		handler_();
+		return;
+	}
+
+	if (unmet != unmet_) {
+		log::Info(
+			"Waiting for " + common::JoinStrings(unmet, " and ") + " before contacting the server");
+		unmet_ = unmet;
+		progress_(unmet_);
+	}
+
+	auto waited = chrono::steady_clock::now() - started_;
+	if (config_.timeout_seconds > 0 && waited >= chrono::seconds {config_.timeout_seconds}) {
+		log::Warning(
+			"Still waiting for " + common::JoinStrings(unmet, " and ") + " after "
+			+ to_string(config_.timeout_seconds) + " seconds, contacting the server anyway");
+		handler_();
+		return;
+	}
+
+	timer_.AsyncWait(kCheckInterval, [this](error::Error err) {
+		if (err != error::NoError) {
+			return;
+		}
+		Check();
+	});
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
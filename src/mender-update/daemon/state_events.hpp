@@ -33,6 +33,7 @@ enum class StateEvent {
 	DeploymentStarted,
 	DeploymentEnded,
 	RollbackStarted,
+	DeploymentSimulated,
 };
 
 inline std::string StateEventToString(const StateEvent &event) {
@@ -63,6 +64,8 @@ inline std::string StateEventToString(const StateEvent &event) {
 		return "DeploymentEnded";
 	case StateEvent::RollbackStarted:
 		return "RollbackStarted";
+	case StateEvent::DeploymentSimulated:
+		return "DeploymentSimulated";
 	}
 	assert(false);
 	return "MissingStateInSwitchStatement";
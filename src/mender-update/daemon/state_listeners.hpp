@@ -0,0 +1,105 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_STATE_LISTENERS_HPP
+#define MENDER_UPDATE_DAEMON_STATE_LISTENERS_HPP
+
+#include <chrono>
+#include <cstdint>
+#include <functional>
+#include <string>
+#include <unordered_map>
+#include <unordered_set>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+
+// Keeps track of external applications which have registered to be told about state transitions
+// of a deployment, and which may abort or delay them. This is the in-process counterpart of the
+// io.mender.StateListener1 DBus interface, see Documentation/io.mender.StateListener1.xml.
+//
+// Only one transition can be waited for at a time, which is always true for the state machine.
+class StateListeners {
+public:
+	using EmitFunction = function<error::Error(const string &state, const string &action)>;
+	using HandlerFunction = function<void(error::Error)>;
+
+	// The states that listeners can register for.
+	static const unordered_set<string> kSupportedStates;
+
+	static const string kVerdictContinue;
+	static const string kVerdictAbort;
+	static const string kVerdictDelayPrefix;
+
+	StateListeners(
+		events::EventLoop &loop, chrono::seconds response_timeout, chrono::seconds max_delay);
+
+	// Sets the function used to announce a transition to the listeners. Without it, transitions
+	// are never held up.
+	void SetEmitFunction(EmitFunction emit) {
+		emit_ = emit;
+	}
+
+	// `states` is a comma separated list of states, or empty for all supported states.
+	error::Error Register(const string &listener, const string &states);
+	// `states` is a comma separated list of states, or empty to unregister completely.
+	error::Error Unregister(const string &listener, const string &states);
+
+	// `verdict` is `continue`, `abort`, or `delay:<seconds>`.
+	error::Error Respond(const string &listener, const string &verdict);
+
+	// Announces the transition and calls the handler when every listener registered for the state
+	// has answered, or when the response timeout has passed. The handler receives an error if
+	// any of the listeners aborted the transition. The handler is always called asynchronously.
+	void AsyncNotify(const string &state, const string &action, HandlerFunction handler);
+
+private:
+	error::Error ParseStates(const string &states, unordered_set<string> &result);
+	void ArmTimer(chrono::steady_clock::time_point deadline);
+	void FinishLater(error::Error err);
+	void Finish(error::Error err);
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	chrono::seconds response_timeout_;
+	chrono::seconds max_delay_;
+
+	EmitFunction emit_;
+
+	// Listener ID -> states it is registered for.
+	unordered_map<string, unordered_set<string>> listeners_;
+
+	// The ongoing transition, if `handler_` is set.
+	string transition_;
+	uint64_t transition_number_ {0};
+	unordered_set<string> waiting_for_;
+	chrono::steady_clock::time_point started_;
+	chrono::steady_clock::time_point deadline_;
+	HandlerFunction handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_STATE_LISTENERS_HPP
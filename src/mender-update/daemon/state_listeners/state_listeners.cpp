@@ -0,0 +1,240 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/state_listeners.hpp>
+
+#include <algorithm>
+#include <vector>
+
+#include <common/common.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace log = mender::common::log;
+
+const unordered_set<string> StateListeners::kSupportedStates {
+	"Download",
+	"ArtifactInstall",
+	"ArtifactReboot",
+	"ArtifactCommit",
+};
+
+const string StateListeners::kVerdictContinue {"continue"};
+const string StateListeners::kVerdictAbort {"abort"};
+const string StateListeners::kVerdictDelayPrefix {"delay:"};
+
+StateListeners::StateListeners(
+	events::EventLoop &loop, chrono::seconds response_timeout, chrono::seconds max_delay) :
+	loop_ {loop},
+	timer_ {loop},
+	response_timeout_ {response_timeout},
+	max_delay_ {max_delay} {
+}
+
+error::Error StateListeners::ParseStates(const string &states, unordered_set<string> &result) {
+	if (states == "") {
+		result = kSupportedStates;
+		return error::NoError;
+	}
+	for (const auto &state : common::SplitString(states, ",")) {
+		if (kSupportedStates.count(state) == 0) {
+			return error::Error(
+				make_error_condition(errc::invalid_argument),
+				"Cannot listen to transitions of state '" + state + "'");
+		}
+		result.insert(state);
+	}
+	return error::NoError;
+}
+
+error::Error StateListeners::Register(const string &listener, const string &states) {
+	if (listener == "") {
+		return error::Error(
+			make_error_condition(errc::invalid_argument), "Listener ID cannot be empty");
+	}
+	unordered_set<string> parsed;
+	auto err = ParseStates(states, parsed);
+	if (err != error::NoError) {
+		return err;
+	}
+	listeners_[listener].insert(parsed.begin(), parsed.end());
+	log::Info("State listener " + listener + " registered");
+	return error::NoError;
+}
+
+error::Error StateListeners::Unregister(const string &listener, const string &states) {
+	auto entry = listeners_.find(listener);
+	if (entry == listeners_.end()) {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"No state listener with ID '" + listener + "'");
+	}
+
+	if (states == "") {
+		listeners_.erase(entry);
+	} else {
+		unordered_set<string> parsed;
+		auto err = ParseStates(states, parsed);
+		if (err != error::NoError) {
+			return err;
+		}
+		for (const auto &state : parsed) {
+			entry->second.erase(state);
+		}
+		if (entry->second.empty()) {
+			listeners_.erase(entry);
+		}
+	}
+	log::Info("State listener " + listener + " unregistered");
+
+	// Don't keep waiting for an answer that will never come.
+	if (handler_ && waiting_for_.erase(listener) > 0 && waiting_for_.empty()) {
+		FinishLater(error::NoError);
+	}
+	return error::NoError;
+}
+
+error::Error StateListeners::Respond(const string &listener, const string &verdict) {
+	if (!handler_ || waiting_for_.count(listener) == 0) {
+		return error::Error(
+			make_error_condition(errc::invalid_argument),
+			"Not waiting for a response from state listener '" + listener + "'");
+	}
+
+	if (verdict == kVerdictContinue) {
+		log::Debug("State listener " + listener + " allowed the " + transition_ + " transition");
+		waiting_for_.erase(listener);
+		if (waiting_for_.empty()) {
+			FinishLater(error::NoError);
+		}
+		return error::NoError;
+	}
+
+	if (verdict == kVerdictAbort) {
+		log::Info("State listener " + listener + " aborted the " + transition_ + " transition");
+		FinishLater(error::Error(
+			make_error_condition(errc::operation_canceled),
+			"State listener " + listener + " aborted the " + transition_ + " transition"));
+		return error::NoError;
+	}
+
+	if (common::StartsWith<string>(verdict, kVerdictDelayPrefix)) {
+		auto exp_seconds = common::StringTo<int>(verdict.substr(kVerdictDelayPrefix.size()));
+		if (!exp_seconds || exp_seconds.value() < 0) {
+			return error::Error(
+				make_error_condition(errc::invalid_argument),
+				"Invalid delay in state listener verdict '" + verdict + "'");
+		}
+		auto deadline = chrono::steady_clock::now() + chrono::seconds {exp_seconds.value()};
+		auto limit = started_ + max_delay_;
+		if (deadline > limit) {
+			log::Warning(
+				"State listener " + listener + " asked for a delay beyond the maximum of "
+				+ to_string(max_delay_.count()) + " seconds, limiting it");
+			deadline = limit;
+		}
+		if (deadline > deadline_) {
+			log::Info(
+				"State listener " + listener + " delayed the " + transition_ + " transition by "
+				+ to_string(exp_seconds.value()) + " seconds");
+			ArmTimer(deadline);
+		}
+		return error::NoError;
+	}
+
+	return error::Error(
+		make_error_condition(errc::invalid_argument),
+		"Invalid state listener verdict '" + verdict + "'");
+}
+
+void StateListeners::AsyncNotify(
+	const string &state, const string &action, HandlerFunction handler) {
+	unordered_set<string> interested;
+	for (const auto &listener : listeners_) {
+		if (listener.second.count(state) > 0) {
+			interested.insert(listener.first);
+		}
+	}
+
+	if (!emit_ || interested.empty()) {
+		loop_.Post([handler]() { handler(error::NoError); });
+		return;
+	}
+
+	auto err = emit_(state, action);
+	if (err != error::NoError) {
+		log::Warning(
+			"Could not notify state listeners about the " + state + action
+			+ " transition: " + err.String());
+		loop_.Post([handler]() { handler(error::NoError); });
+		return;
+	}
+
+	log::Debug(
+		"Waiting for " + to_string(interested.size()) + " state listener(s) to allow the " + state
+		+ action + " transition");
+	transition_ = state + action;
+	transition_number_++;
+	waiting_for_ = std::move(interested);
+	handler_ = handler;
+	started_ = chrono::steady_clock::now();
+	ArmTimer(started_ + response_timeout_);
+}
+
+void StateListeners::ArmTimer(chrono::steady_clock::time_point deadline) {
+	deadline_ = deadline;
+	timer_.Cancel();
+	auto remaining =
+		max(deadline - chrono::steady_clock::now(), chrono::steady_clock::duration {0});
+	timer_.AsyncWait(remaining, [this](error::Error err) {
+		if (err != error::NoError || !handler_) {
+			return;
+		}
+		vector<string> missing {waiting_for_.begin(), waiting_for_.end()};
+		sort(missing.begin(), missing.end());
+		// A listener which has gone away must not be able to block updates forever.
+		log::Warning(
+			"No response from state listener(s) " + common::JoinStrings(missing, ", ")
+			+ " in time, continuing with the " + transition_ + " transition");
+		Finish(error::NoError);
+	});
+}
+
+void StateListeners::FinishLater(error::Error err) {
+	// Finish from the event loop, so that the handler does not run while the DBus call of the
+	// listener is still being answered.
+	auto number = transition_number_;
+	loop_.Post([this, number, err]() {
+		if (handler_ && number == transition_number_) {
+			Finish(err);
+		}
+	});
+}
+
+void StateListeners::Finish(error::Error err) {
+	timer_.Cancel();
+	auto handler = handler_;
+	handler_ = nullptr;
+	waiting_for_.clear();
+	transition_.clear();
+	handler(err);
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -15,8 +15,14 @@
 #ifndef MENDER_UPDATE_STATE_MACHINE_HPP
 #define MENDER_UPDATE_STATE_MACHINE_HPP
 
+#include <optional>
+#include <string>
+#include <unordered_map>
+
+#include <client_shared/config_parser.hpp>
 #include <common/error.hpp>
 #include <common/events.hpp>
+#include <common/processes.hpp>
 #include <common/state_machine.hpp>
 
 #include <mender-update/context.hpp>
@@ -29,8 +35,10 @@ namespace mender {
 namespace update {
 namespace daemon {
 
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
+namespace procs = mender::common::processes;
 namespace sm = mender::common::state_machine;
 
 namespace context = mender::update::context;
@@ -52,15 +60,123 @@ public:
 	void StopAfterDeployments(int number);
 #endif
 
+	// Makes `Run()` return once the daemon has checked for a deployment, and installed it if there
+	// was one, instead of running until it is stopped. `Run()` then returns NoUpdateAvailableError
+	// if there was none, and ExitWithFailureError if the check or the deployment failed. See
+	// Documentation/run-once.md.
+	void RunOnce();
+
+	// Mainly for the debug console.
+	void Pause();
+	void Resume();
+	bool Paused() const;
+	void PostEvent(StateEvent event);
+	// Aborts the ongoing deployment at the next status update, the same way as if the
+	// deployment was aborted on the server.
+	error::Error AbortDeployment();
+	// The name of the main state, as in the status, the logs and the metrics.
+	string CurrentStateName() const;
+	void SetStateChangeCallback(function<void()> callback);
+
+	// What the daemon is doing, as exposed over DBus, see Documentation/io.mender.Update1.xml.
+	struct Status {
+		string state;
+		// Empty when there is no deployment in progress.
+		string deployment_id;
+		string artifact_name;
+		// Which state the last failed deployment failed in, along with its substate, if any.
+		// Kept until another deployment fails.
+		string last_error;
+
+		bool operator==(const Status &other) const {
+			return state == other.state && deployment_id == other.deployment_id
+				   && artifact_name == other.artifact_name && last_error == other.last_error;
+		}
+		bool operator!=(const Status &other) const {
+			return !(*this == other);
+		}
+	};
+	using StatusChangeCallback = function<void(const Status &previous, const Status &current)>;
+
+	const Status &CurrentStatus() const {
+		return status_;
+	}
+	// Called after the state transitions which change the status.
+	void SetStatusChangeCallback(StatusChangeCallback callback);
+
+	// The status, along with the health of the update check and inventory submission loops, as a
+	// JSON object. See Documentation/daemon-status.md.
+	string StatusJson() const;
+
+	// Applies the settings of a reloaded configuration which can change while the daemon runs,
+	// see Documentation/daemon-control.md: right away if the daemon is idle, otherwise once it
+	// gets back to idle, so that an ongoing deployment keeps the settings it started with.
+	void ReloadConfig(const cfg_parser::MenderConfigFromFile &config);
+	bool ReloadPending() const {
+		return pending_config_.has_value();
+	}
+
 private:
 	Context &ctx_;
 	events::EventLoop &event_loop_;
-	events::SignalHandler check_update_handler_;
-	events::SignalHandler inventory_update_handler_;
 	events::SignalHandler termination_handler_;
 
 	error::Error RegisterSignalHandlers();
 
+	// Fills `state_names_`, which doesn't depend on RTTI, unlike the type names of the states.
+	void NameStates();
+	void OnIteration();
+	// Records where the deployment is, if it is in the Download or ArtifactInstall state, and
+	// stops the Update Module, so that nothing is left running when the daemon is stopped.
+	void CheckpointDeployment();
+	// Rolls back the deployment which installed a client failing its self-test, if it hasn't been
+	// committed yet.
+	void FailDeploymentAfterSelfTest();
+	// Starts the timer of `StateTimeouts` when the main state machine enters a state which has a
+	// limit, and stops it when it leaves the state.
+	void WatchStateTimeout();
+	// Sends the keep-alives of the systemd watchdog from the event loop which runs the state
+	// machine, so that they stop when it is blocked, not only when the process is gone.
+	void KeepAlive();
+	// Runs the partition layout check of the rootfs-image Update Module, if it is installed, see
+	// Documentation/rootfs-image-layout.md.
+	void CheckPartitionLayout();
+	void ApplyPendingConfig();
+	// Added by `Run()`, since they depend on `RunOnce()`.
+	void AddInventorySubmissionTransitions();
+	void TrackRunOnce();
+	void MaybeExitRunOnce();
+
+	function<void()> state_change_callback_;
+	Status status_;
+	bool failure_recorded_ {false};
+	StatusChangeCallback status_change_callback_;
+
+	events::Timer state_timeout_timer_;
+	events::Timer watchdog_timer_;
+	procs::ScriptRunner layout_check_runner_ {"Partition layout check output"};
+	// The main state which the timer was started for, or last checked.
+	const sm::State<Context, StateEvent> *timed_state_ {nullptr};
+
+	// A reloaded configuration waiting for the daemon to be idle.
+	optional<cfg_parser::MenderConfigFromFile> pending_config_;
+
+	struct {
+		bool enabled {false};
+		// Between entering the update check and the state after it.
+		bool checking {false};
+		bool checked {false};
+		bool check_failed {false};
+		int deployments_succeeded {0};
+		int deployments_failed {0};
+	} run_once_;
+
+	// With InventorySubmission.Independent, the inventory is submitted by the scheduler, with a
+	// client of its own, and the inventory submission states only trigger it.
+	api::HTTPClient inventory_http_client_;
+	InventoryScheduler inventory_scheduler_;
+	TriggerInventorySubmissionState trigger_inventory_submission_state_;
+
 	///////////////////////////////////////////////////////////////////////////////////////////
 	// Main states
 	///////////////////////////////////////////////////////////////////////////////////////////
@@ -72,10 +188,15 @@ private:
 	ScheduleNextPollState schedule_poll_for_deployment_state_;
 	SubmitInventoryState submit_inventory_state_;
 	PollForDeploymentState poll_for_deployment_state_;
+	UpdateWindowState update_window_download_state_;
 	SendStatusUpdateState send_download_status_state_;
+	UpdateCheckArtifactHeaderState update_check_artifact_header_state_;
+	UpdatePreflightChecksState update_preflight_download_state_;
 	UpdateDownloadState update_download_state_;
 	UpdateDownloadCancelState update_download_cancel_state_;
+	UpdateWindowState update_window_install_state_;
 	SendStatusUpdateState send_install_status_state_;
+	UpdatePreflightChecksState update_preflight_install_state_;
 	UpdateInstallState update_install_state_;
 
 	// Currently used same state code for checking NeedsReboot both before normal reboot, and
@@ -84,13 +205,20 @@ private:
 	UpdateCheckRebootState update_check_reboot_state_;
 	UpdateCheckRebootState update_check_rollback_reboot_state_;
 
+	UpdateWindowState update_window_reboot_state_;
 	SendStatusUpdateState send_reboot_status_state_;
 	UpdateRebootState update_reboot_state_;
 	UpdateVerifyRebootState update_verify_reboot_state_;
 	SendStatusUpdateState send_commit_status_state_;
 	UpdateBeforeCommitState update_before_commit_state_;
+	UpdateCommitLeaseState update_commit_lease_state_;
+	UpdateCommitConfirmationState update_commit_confirmation_state_;
+	UpdateCanaryState update_canary_state_;
 	UpdateCommitState update_commit_state_;
+	UpdateReconcileCommitState update_reconcile_commit_state_;
 	UpdateAfterCommitState update_after_commit_state_;
+	UpdatePilotState update_pilot_state_;
+	UpdatePilotRevertState update_pilot_revert_state_;
 	UpdateCheckRollbackState update_check_rollback_state_;
 	UpdateRollbackState update_rollback_state_;
 	UpdateRollbackRebootState update_rollback_reboot_state_;
@@ -102,6 +230,7 @@ private:
 	UpdateCleanupState update_cleanup_state_;
 	SendStatusUpdateState send_final_status_state_;
 	ClearArtifactDataState clear_artifact_data_state_;
+	PostCommitCleanupState post_commit_cleanup_state_;
 
 	StateLoopState state_loop_state_;
 
@@ -110,6 +239,8 @@ private:
 	ExitState exit_state_;
 
 	sm::StateMachine<Context, StateEvent> main_states_;
+	// The names of the main states, after their classes, including the state script ones.
+	unordered_map<const sm::State<Context, StateEvent> *, string> state_names_;
 
 	class StateScripts {
 	public:
@@ -516,6 +647,7 @@ private:
 		EmptyState idle_state_;
 		deployment_tracking::NoFailuresState no_failures_state_;
 		deployment_tracking::FailureState failure_state_;
+		deployment_tracking::AbortedState aborted_state_;
 		deployment_tracking::RollbackAttemptedState rollback_attempted_state_;
 		deployment_tracking::RollbackFailedState rollback_failed_state_;
 
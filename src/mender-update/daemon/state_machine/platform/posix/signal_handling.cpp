@@ -26,34 +26,15 @@ namespace daemon {
 namespace error = mender::common::error;
 namespace log = mender::common::log;
 
+// SIGUSR1 and SIGUSR2 are shims for the control commands, see control.hpp.
 error::Error StateMachine::RegisterSignalHandlers() {
-	auto err =
-		check_update_handler_.RegisterHandler({SIGUSR1}, [this](events::SignalNumber signum) {
-			log::Info("SIGUSR1 received, triggering deployments check");
-			runner_.PostEvent(StateEvent::DeploymentPollingTriggered);
-		});
-	if (err != error::NoError) {
-		return err;
-	}
-
-	err = inventory_update_handler_.RegisterHandler({SIGUSR2}, [this](events::SignalNumber signum) {
-		log::Info("SIGUSR2 received, triggering inventory update");
-		runner_.PostEvent(StateEvent::InventoryPollingTriggered);
-	});
-	if (err != error::NoError) {
-		return err;
-	}
-
-	err = termination_handler_.RegisterHandler(
+	return termination_handler_.RegisterHandler(
 		{SIGTERM, SIGINT, SIGQUIT}, [this](events::SignalNumber signum) {
 			log::Info("Termination signal received, shutting down gracefully");
+			ctx_.service_notifier.Stopping();
+			CheckpointDeployment();
 			event_loop_.Stop();
 		});
-	if (err != error::NoError) {
-		return err;
-	}
-
-	return error::NoError;
 }
 
 } // namespace daemon
@@ -14,9 +14,14 @@
 
 #include <mender-update/daemon/state_machine.hpp>
 
+#include <algorithm>
+
 #include <client_shared/conf.hpp>
+#include <common/common.hpp>
+#include <common/json.hpp>
 #include <common/key_value_database.hpp>
 #include <common/log.hpp>
+#include <common/path.hpp>
 
 #include <mender-update/daemon/states.hpp>
 
@@ -25,15 +30,33 @@ namespace update {
 namespace daemon {
 
 namespace conf = mender::client_shared::conf;
+namespace json = mender::common::json;
 namespace kvdb = mender::common::key_value_database;
 namespace log = mender::common::log;
+namespace path = mender::common::path;
 
 StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	ctx_(ctx),
 	event_loop_(event_loop),
-	check_update_handler_(event_loop),
-	inventory_update_handler_(event_loop),
 	termination_handler_(event_loop),
+	state_timeout_timer_(event_loop),
+	watchdog_timer_(event_loop),
+	inventory_http_client_(
+		ctx.mender_context.GetConfig().GetHttpClientConfig(),
+		event_loop,
+		ctx.authenticator,
+		"inventory_http_client"),
+	inventory_scheduler_(
+		event_loop,
+		inventory_http_client_,
+		ctx.inventory_client,
+		ctx.inventory_health,
+		ctx.mender_context.GetConfig().paths.GetInventoryScriptsDir(),
+		chrono::seconds {ctx.mender_context.GetConfig().inventory_poll_interval_seconds},
+		ctx.poll_splay,
+		chrono::seconds {ctx.mender_context.GetConfig().retry_poll_interval_seconds},
+		ctx.mender_context.GetConfig().retry_poll_count),
+	trigger_inventory_submission_state_(inventory_scheduler_),
 	schedule_submit_inventory_state_(
 		ctx.inventory_timer,
 		"inventory submission",
@@ -50,8 +73,18 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	poll_for_deployment_state_(
 		ctx.mender_context.GetConfig().retry_poll_interval_seconds,
 		ctx.mender_context.GetConfig().retry_poll_count),
+	update_window_download_state_(event_loop, "Download", nullopt),
 	send_download_status_state_(deployments::DeploymentStatus::Downloading),
+	update_preflight_download_state_(PreflightChecks::kStageDownload),
+	update_window_install_state_(
+		event_loop,
+		"ArtifactInstall",
+		deployments::DeploymentStatus::PauseBeforeInstalling,
+		true),
 	send_install_status_state_(deployments::DeploymentStatus::Installing),
+	update_preflight_install_state_(PreflightChecks::kStageArtifactInstall),
+	update_window_reboot_state_(
+		event_loop, "ArtifactReboot", deployments::DeploymentStatus::PauseBeforeRebooting),
 	send_reboot_status_state_(deployments::DeploymentStatus::Rebooting),
 	send_commit_status_state_(
 		deployments::DeploymentStatus::Installing,
@@ -74,9 +107,30 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 		ctx_.mender_context.GetConfig().paths.GetArtScriptsPath(),
 		ctx_.mender_context.GetConfig().paths.GetRootfsScriptsPath()),
 	runner_(ctx) {
+	inventory_http_client_.SetServerFailover(ctx.mender_context.GetConfig().servers.size() > 1);
+	const auto &retry_policies = ctx.mender_context.GetConfig().retry_policies;
+	poll_for_deployment_state_.SetRetryPolicy(retry_policies.deployment_polling);
+	send_commit_status_state_.SetRetryPolicy(retry_policies.status_reporting);
+	send_commit_status_state_.SetLogUploadRetryPolicy(retry_policies.log_upload);
+	send_final_status_state_.SetRetryPolicy(retry_policies.status_reporting);
+	send_final_status_state_.SetLogUploadRetryPolicy(retry_policies.log_upload);
+	NameStates();
 	runner_.AddStateMachine(deployment_tracking_.states_);
 	runner_.AddStateMachine(main_states_);
 	runner_.AttachToEventLoop(event_loop_);
+	runner_.SetIterationCallback([this]() { OnIteration(); });
+	// Everything logged by a state carries its name.
+	runner_.SetEnterCallback([this]() {
+		log::SetGlobalField(log::LogField("state", CurrentStateName()));
+		ctx_.metrics.StateEntered(CurrentStateName());
+		WatchStateTimeout();
+		if (pending_config_) {
+			ApplyPendingConfig();
+		}
+		if (run_once_.enabled) {
+			TrackRunOnce();
+		}
+	});
 	ctx.authenticator.RegisterTokenReceivedCallback([&ctx]() {
 		if (ctx.inventory_client->has_submitted_inventory) {
 			log::Debug("Client has re-authenticated - clear inventory data cache");
@@ -84,6 +138,12 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 			ctx.inventory_client->has_submitted_inventory = false;
 		}
 	});
+	ctx.authenticator.RegisterAuthorizationChangedCallback([&ctx](bool authorized) {
+		ctx.mqtt_bridge.AuthorizationChanged(authorized);
+		ctx.service_notifier.AuthorizationChanged(authorized);
+	});
+	ctx.authenticator.RegisterAuthenticationFailedCallback(
+		[&ctx]() { ctx.metrics.AuthenticationFailed(); });
 
 	using se = StateEvent;
 	using tf = sm::TransitionFlag;
@@ -100,7 +160,7 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(ss.idle_enter_,                          se::Failure,                     idle_state_,                             tf::Immediate);
 
 	main_states_.AddTransition(idle_state_,                             se::DeploymentPollingTriggered,  schedule_poll_for_deployment_state_,     tf::Deferred);
-	main_states_.AddTransition(idle_state_,                             se::InventoryPollingTriggered,   schedule_submit_inventory_state_,        tf::Deferred);
+	// InventoryPollingTriggered from the idle state, see AddInventorySubmissionTransitions().
 
 	// The schedule states cannot fail
 	main_states_.AddTransition(schedule_poll_for_deployment_state_,     se::Success,                     ss.idle_leave_deploy_,                   tf::Immediate);
@@ -131,16 +191,28 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(ss.sync_leave_,                          se::Success,                     ss.idle_enter_,                          tf::Immediate);
 	main_states_.AddTransition(ss.sync_leave_,                          se::Failure,                     ss.sync_error_,                          tf::Immediate);
 
-	main_states_.AddTransition(ss.sync_leave_download_,                 se::Success,                     send_download_status_state_,             tf::Immediate);
+	main_states_.AddTransition(ss.sync_leave_download_,                 se::Success,                     update_window_download_state_,           tf::Immediate);
 	main_states_.AddTransition(ss.sync_leave_download_,                 se::Failure,                     ss.sync_error_download_,                 tf::Immediate);
 
+	// Nothing has been downloaded yet, and no Download scripts have run.
+	main_states_.AddTransition(update_window_download_state_,           se::Success,                     send_download_status_state_,             tf::Immediate);
+	main_states_.AddTransition(update_window_download_state_,           se::DeploymentAborted,           update_cleanup_state_,                   tf::Immediate);
+	main_states_.AddTransition(update_window_download_state_,           se::Failure,                     update_rollback_not_needed_state_,       tf::Immediate);
+
 	main_states_.AddTransition(ss.sync_error_download_,                 se::Success,                     end_of_deployment_state_,                tf::Immediate);
 	main_states_.AddTransition(ss.sync_error_download_,                 se::Failure,                     end_of_deployment_state_,                tf::Immediate);
 
 	// Fail the deployment if it's aborted. All other failures will be ignored due to FailureMode::Ignore
-	main_states_.AddTransition(send_download_status_state_,             se::Success,                     ss.download_enter_,                      tf::Immediate);
+	main_states_.AddTransition(send_download_status_state_,             se::Success,                     update_check_artifact_header_state_,     tf::Immediate);
 	main_states_.AddTransition(send_download_status_state_,             se::DeploymentAborted,           update_cleanup_state_,                   tf::Immediate);
 
+	// No Download scripts have run yet, so there are no Download_Error scripts to run either.
+	main_states_.AddTransition(update_check_artifact_header_state_,     se::Success,                     update_preflight_download_state_,        tf::Immediate);
+	main_states_.AddTransition(update_check_artifact_header_state_,     se::Failure,                     update_rollback_not_needed_state_,       tf::Immediate);
+
+	main_states_.AddTransition(update_preflight_download_state_,        se::Success,                     ss.download_enter_,                      tf::Immediate);
+	main_states_.AddTransition(update_preflight_download_state_,        se::Failure,                     update_rollback_not_needed_state_,       tf::Immediate);
+
 	main_states_.AddTransition(ss.download_enter_,                      se::Success,                     update_download_state_,                  tf::Immediate);
 	main_states_.AddTransition(ss.download_enter_,                      se::Failure,                     ss.download_error_,                      tf::Immediate);
 	main_states_.AddTransition(ss.download_enter_,                      se::StateLoopDetected,           state_loop_state_,                       tf::Immediate);
@@ -150,12 +222,14 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(update_download_state_,                  se::Success,                     ss.download_leave_,                      tf::Immediate);
 	main_states_.AddTransition(update_download_state_,                  se::StateLoopDetected,           state_loop_state_,                       tf::Immediate);
 	main_states_.AddTransition(update_download_state_,                  se::Failure,                     update_download_cancel_state_,           tf::Immediate);
+	main_states_.AddTransition(update_download_state_,                  se::DeploymentAborted,           update_download_cancel_state_,           tf::Immediate);
 	main_states_.AddTransition(update_download_state_,                  se::NothingToDo,                 ss.download_leave_save_provides,         tf::Immediate);
+	main_states_.AddTransition(update_download_state_,                  se::DeploymentSimulated,         update_cleanup_state_,                   tf::Immediate);
 
 	// Cannot fail because download cancellation is a void function as there's nothing to do if it fails, anyway.
 	main_states_.AddTransition(update_download_cancel_state_,           se::Success,                     ss.download_error_,                      tf::Immediate);
 
-	main_states_.AddTransition(ss.download_leave_,                      se::Success,                     send_install_status_state_,              tf::Immediate);
+	main_states_.AddTransition(ss.download_leave_,                      se::Success,                     update_window_install_state_,            tf::Immediate);
 	main_states_.AddTransition(ss.download_leave_,                      se::Failure,                     ss.download_error_,                      tf::Immediate);
 
 	main_states_.AddTransition(ss.download_leave_save_provides,         se::Success,                     update_save_provides_state_,             tf::Immediate);
@@ -164,12 +238,22 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(ss.install_enter_,                       se::Success,                     update_install_state_,                   tf::Immediate);
 	main_states_.AddTransition(ss.install_enter_,                       se::Failure,                     ss.install_error_rollback_,              tf::Immediate);
 
+	// Nothing has been installed yet, and no ArtifactInstall scripts have run.
+	main_states_.AddTransition(update_window_install_state_,            se::Success,                     send_install_status_state_,              tf::Immediate);
+	main_states_.AddTransition(update_window_install_state_,            se::DeploymentAborted,           update_cleanup_state_,                   tf::Immediate);
+	main_states_.AddTransition(update_window_install_state_,            se::Failure,                     update_rollback_not_needed_state_,       tf::Immediate);
+
 	// Fail the deployment if it's aborted. All other failures will be ignored due to FailureMode::Ignore
-	main_states_.AddTransition(send_install_status_state_,              se::Success,                     ss.install_enter_,                       tf::Immediate);
+	main_states_.AddTransition(send_install_status_state_,              se::Success,                     update_preflight_install_state_,         tf::Immediate);
 	main_states_.AddTransition(send_install_status_state_,              se::DeploymentAborted,           update_cleanup_state_,                   tf::Immediate);
 
+	// Nothing has been installed yet, and no ArtifactInstall scripts have run.
+	main_states_.AddTransition(update_preflight_install_state_,         se::Success,                     ss.install_enter_,                       tf::Immediate);
+	main_states_.AddTransition(update_preflight_install_state_,         se::Failure,                     update_rollback_not_needed_state_,       tf::Immediate);
+
 	main_states_.AddTransition(update_install_state_,                   se::Success,                     ss.install_leave_,                       tf::Immediate);
 	main_states_.AddTransition(update_install_state_,                   se::Failure,                     ss.install_error_rollback_,              tf::Immediate);
+	main_states_.AddTransition(update_install_state_,                   se::DeploymentAborted,           ss.install_error_rollback_,              tf::Immediate);
 	main_states_.AddTransition(update_install_state_,                   se::StateLoopDetected,           state_loop_state_,                       tf::Immediate);
 
 	main_states_.AddTransition(ss.install_leave_,                       se::Success,                     update_check_reboot_state_,              tf::Immediate);
@@ -182,11 +266,15 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(ss.failure_enter_,                       se::StateLoopDetected,           state_loop_state_,                       tf::Immediate);
 
 
-	main_states_.AddTransition(update_check_reboot_state_,              se::Success,                     send_reboot_status_state_,               tf::Immediate);
+	main_states_.AddTransition(update_check_reboot_state_,              se::Success,                     update_window_reboot_state_,             tf::Immediate);
 	main_states_.AddTransition(update_check_reboot_state_,              se::NothingToDo,                 update_before_commit_state_,             tf::Immediate);
 	main_states_.AddTransition(update_check_reboot_state_,              se::Failure,                     update_check_rollback_state_,            tf::Immediate);
 	main_states_.AddTransition(update_check_reboot_state_,              se::StateLoopDetected,           state_loop_state_,                       tf::Immediate);
 
+	main_states_.AddTransition(update_window_reboot_state_,             se::Success,                     send_reboot_status_state_,               tf::Immediate);
+	main_states_.AddTransition(update_window_reboot_state_,             se::DeploymentAborted,           update_check_rollback_state_,            tf::Immediate);
+	main_states_.AddTransition(update_window_reboot_state_,             se::Failure,                     update_check_rollback_state_,            tf::Immediate);
+
 	// Fail the deployment if it's aborted. All other failures will be ignored due to FailureMode::Ignore
 	main_states_.AddTransition(send_reboot_status_state_,               se::Success,                     ss.reboot_enter_,                        tf::Immediate);
 	main_states_.AddTransition(send_reboot_status_state_,               se::DeploymentAborted,           update_check_rollback_state_,            tf::Immediate);
@@ -209,7 +297,16 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(ss.reboot_leave_,                        se::Failure,                     ss.reboot_error_,                        tf::Immediate);
 
 	// Cannot fail.
-	main_states_.AddTransition(update_before_commit_state_,             se::Success,                     send_commit_status_state_,               tf::Immediate);
+	main_states_.AddTransition(update_before_commit_state_,             se::Success,                     update_commit_lease_state_,              tf::Immediate);
+
+	main_states_.AddTransition(update_commit_lease_state_,              se::Success,                     update_commit_confirmation_state_,       tf::Immediate);
+	main_states_.AddTransition(update_commit_lease_state_,              se::Failure,                     update_check_rollback_state_,            tf::Immediate);
+
+	main_states_.AddTransition(update_commit_confirmation_state_,       se::Success,                     update_canary_state_,                    tf::Immediate);
+	main_states_.AddTransition(update_commit_confirmation_state_,       se::Failure,                     update_check_rollback_state_,            tf::Immediate);
+
+	main_states_.AddTransition(update_canary_state_,                    se::Success,                     send_commit_status_state_,               tf::Immediate);
+	main_states_.AddTransition(update_canary_state_,                    se::Failure,                     update_check_rollback_state_,            tf::Immediate);
 
 	// From here on out we treat any failure (including DeploymentAborted) the same way
 	main_states_.AddTransition(send_commit_status_state_,               se::Success,                     ss.commit_enter_,                        tf::Immediate);
@@ -226,10 +323,19 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(update_commit_state_,                    se::Failure,                     ss.commit_error_,                        tf::Immediate);
 	main_states_.AddTransition(update_commit_state_,                    se::StateLoopDetected,           state_loop_state_,                       tf::Immediate);
 
-	main_states_.AddTransition(update_after_commit_state_,              se::Success,                     ss.commit_leave_,                        tf::Immediate);
+	main_states_.AddTransition(update_reconcile_commit_state_,          se::Success,                     ss.commit_enter_,                        tf::Immediate);
+	main_states_.AddTransition(update_reconcile_commit_state_,          se::Failure,                     update_check_rollback_state_,            tf::Immediate);
+
+	main_states_.AddTransition(update_after_commit_state_,              se::Success,                     update_pilot_state_,                     tf::Immediate);
 	main_states_.AddTransition(update_after_commit_state_,              se::Failure,                     ss.commit_error_save_provides_,          tf::Immediate);
 	main_states_.AddTransition(update_after_commit_state_,              se::StateLoopDetected,           state_loop_state_,                       tf::Immediate);
 
+	main_states_.AddTransition(update_pilot_state_,                     se::Success,                     ss.commit_leave_,                        tf::Immediate);
+	main_states_.AddTransition(update_pilot_state_,                     se::Failure,                     update_pilot_revert_state_,              tf::Immediate);
+
+	main_states_.AddTransition(update_pilot_revert_state_,              se::Success,                     update_rollback_successful_state_,       tf::Immediate);
+	main_states_.AddTransition(update_pilot_revert_state_,              se::Failure,                     ss.failure_enter_,                       tf::Immediate);
+
 	main_states_.AddTransition(ss.commit_leave_,                        se::Success,                     update_save_provides_state_,             tf::Immediate);
 	main_states_.AddTransition(ss.commit_leave_,                        se::Failure,                     ss.commit_error_save_provides_,          tf::Immediate);
 
@@ -303,9 +409,11 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	main_states_.AddTransition(send_final_status_state_,                se::Failure,                     clear_artifact_data_state_,              tf::Immediate);
 	main_states_.AddTransition(send_final_status_state_,                se::DeploymentAborted,           clear_artifact_data_state_,              tf::Immediate);
 
-	main_states_.AddTransition(clear_artifact_data_state_,              se::Success,                     end_of_deployment_state_,                tf::Immediate);
+	main_states_.AddTransition(clear_artifact_data_state_,              se::Success,                     post_commit_cleanup_state_,              tf::Immediate);
 	main_states_.AddTransition(clear_artifact_data_state_,              se::Failure,                     end_of_deployment_state_,                tf::Immediate);
 
+	main_states_.AddTransition(post_commit_cleanup_state_,              se::Success,                     end_of_deployment_state_,                tf::Immediate);
+
 	main_states_.AddTransition(end_of_deployment_state_,                se::Success,                     ss.idle_enter_,                          tf::Immediate);
 
 	auto &dt = deployment_tracking_;
@@ -313,12 +421,15 @@ StateMachine::StateMachine(Context &ctx, events::EventLoop &event_loop) :
 	dt.states_.AddTransition(dt.idle_state_,                            se::DeploymentStarted,           dt.no_failures_state_,                   tf::Immediate);
 
 	dt.states_.AddTransition(dt.no_failures_state_,                     se::Failure,                     dt.failure_state_,                       tf::Immediate);
-	dt.states_.AddTransition(dt.no_failures_state_,                     se::DeploymentAborted,           dt.failure_state_,                       tf::Immediate);
+	dt.states_.AddTransition(dt.no_failures_state_,                     se::DeploymentAborted,           dt.aborted_state_,                       tf::Immediate);
 	dt.states_.AddTransition(dt.no_failures_state_,                     se::DeploymentEnded,             dt.idle_state_,                          tf::Immediate);
 
 	dt.states_.AddTransition(dt.failure_state_,                         se::RollbackStarted,             dt.rollback_attempted_state_,            tf::Immediate);
 	dt.states_.AddTransition(dt.failure_state_,                         se::DeploymentEnded,             dt.idle_state_,                          tf::Immediate);
 
+	dt.states_.AddTransition(dt.aborted_state_,                         se::RollbackStarted,             dt.rollback_attempted_state_,            tf::Immediate);
+	dt.states_.AddTransition(dt.aborted_state_,                         se::DeploymentEnded,             dt.idle_state_,                          tf::Immediate);
+
 	dt.states_.AddTransition(dt.rollback_attempted_state_,              se::Failure,                     dt.rollback_failed_state_,               tf::Immediate);
 	dt.states_.AddTransition(dt.rollback_attempted_state_,              se::DeploymentEnded,             dt.idle_state_,                          tf::Immediate);
 
@@ -373,6 +484,11 @@ void StateMachine::LoadStateFromDb() {
 			// Nothing we can do about it.
 		}
 
+		err = update_module::RemoveLeftoverScratchSpace(ctx_.mender_context);
+		if (err != error::NoError) {
+			log::Error("Could not clean up after an earlier deployment: " + err.String());
+		}
+
 		return;
 	}
 
@@ -395,7 +511,27 @@ void StateMachine::LoadStateFromDb() {
 
 	auto &state = ctx_.deployment.state_data->state;
 
-	if (state == ctx_.kUpdateStateDownload) {
+	// Only acted on once, whatever happens next.
+	const auto checkpoint = ctx_.deployment.state_data->update_info.shutdown_checkpoint;
+	ctx_.deployment.state_data->update_info.shutdown_checkpoint = {};
+	if (checkpoint.state != "") {
+		string where = to_string(checkpoint.bytes_downloaded) + " bytes of the Artifact read";
+		if (checkpoint.module_progress != "") {
+			where += ", Update Module progress " + checkpoint.module_progress;
+		}
+		log::Info(
+			"The deployment was stopped by a shutdown during " + checkpoint.state + ", with "
+			+ where);
+	}
+
+	if (state == ctx_.kUpdateStateDownload && checkpoint.state != "") {
+		// Nothing has been installed, so the download starts over, and the Update Module can
+		// resume from its own checkpoint, if it keeps one.
+		log::Info("Starting the download again");
+		main_states_.SetState(send_download_status_state_);
+		deployment_tracking_.states_.SetState(deployment_tracking_.no_failures_state_);
+
+	} else if (state == ctx_.kUpdateStateDownload) {
 		main_states_.SetState(update_cleanup_state_);
 		// "rollback_attempted_state" because Download in its nature makes no system
 		// changes, so a rollback is a no-op.
@@ -451,8 +587,22 @@ void StateMachine::LoadStateFromDb() {
 			deployment_tracking_.states_.SetState(deployment_tracking_.failure_state_);
 		}
 
+	} else if (state == ctx_.kUpdateStateArtifactCommit) {
+		// Interrupted while committing, so the Update Module may or may not have committed, while
+		// the database still has the provides of the old Artifact. The precedence is:
+		// 1. If the update still passes ArtifactVerifyReboot, it is running and not committed,
+		//    and the commit is run again, which stores the provides of the new Artifact.
+		// 2. Otherwise, or if the update needs no reboot, so that it can't be verified again, the
+		//    database takes precedence, and the update is rolled back to match it.
+		main_states_.SetState(update_reconcile_commit_state_);
+		deployment_tracking_.states_.SetState(deployment_tracking_.no_failures_state_);
+
 	} else {
-		// All other states trigger a rollback.
+		// All other states trigger a rollback. The installation can't be resumed, since the
+		// Update Module may have stopped anywhere in it.
+		if (checkpoint.state != "") {
+			ctx_.deployment.substate = "Interrupted by a shutdown during " + checkpoint.state;
+		}
 		main_states_.SetState(update_check_rollback_state_);
 		deployment_tracking_.states_.SetState(deployment_tracking_.failure_state_);
 	}
@@ -472,12 +622,220 @@ void StateMachine::LoadStateFromDb() {
 		return;
 	}
 	ctx_.deployment.update_module = std::move(exp_update_module.value());
+	WatchUpdateModuleProgress(ctx_);
+	auto err = ctx_.deployment.update_module->SetDeploymentMetadata(
+		MakeDeploymentMetadata(ctx_.deployment.state_data->update_info));
+	if (err != error::NoError) {
+		log::Warning("Could not update the deployment metadata: " + err.String());
+	}
+}
+
+void StateMachine::CheckpointDeployment() {
+	if (!ctx_.deployment.state_data) {
+		return;
+	}
+	auto &state_data = *ctx_.deployment.state_data;
+	string state;
+	if (state_data.state == ctx_.kUpdateStateDownload) {
+		state = "Download";
+	} else if (state_data.state == ctx_.kUpdateStateArtifactInstall) {
+		state = "ArtifactInstall";
+	} else {
+		return;
+	}
+
+	auto &checkpoint = state_data.update_info.shutdown_checkpoint;
+	checkpoint.state = state;
+	checkpoint.bytes_downloaded =
+		ctx_.deployment.artifact_reader ? ctx_.deployment.artifact_reader->BytesRead() : 0;
+	checkpoint.module_progress = ctx_.deployment.module_progress;
+	log::Info(
+		"Stopping the deployment during " + state + ", after "
+		+ to_string(checkpoint.bytes_downloaded) + " bytes of the Artifact");
+
+	// Stored before the Update Module is stopped, in case the daemon is killed in the meantime.
+	auto err = ctx_.SaveDeploymentStateData(state_data);
+	if (err != error::NoError) {
+		log::Error("Could not store the state of the deployment: " + err.String());
+	}
+
+	// Waits for the Update Module to exit, for up to ModuleTerminationGracePeriodSeconds after
+	// SIGTERM, and then kills it.
+	ctx_.StopDeploymentState(
+		error::Error(make_error_condition(errc::operation_canceled), "The daemon is stopping"));
+}
+
+void StateMachine::FailDeploymentAfterSelfTest() {
+	if (!ctx_.deployment.state_data
+		|| ctx_.deployment.state_data->state != ctx_.kUpdateStateArtifactReboot) {
+		return;
+	}
+	log::Error(
+		"The deployment installed a client which failed its self-test. Rolling back, without "
+		"committing it");
+	main_states_.SetState(update_check_rollback_state_);
+	deployment_tracking_.states_.SetState(deployment_tracking_.failure_state_);
+}
+
+void StateMachine::WatchStateTimeout() {
+	const auto *state = &main_states_.GetCurrentState();
+	if (state == timed_state_) {
+		return;
+	}
+	timed_state_ = state;
+	state_timeout_timer_.Cancel();
+	ctx_.deployment.stop_reason = error::NoError;
+
+	const auto &timeouts = ctx_.mender_context.GetConfig().state_timeouts;
+	int seconds {0};
+	if (state == &update_download_state_) {
+		seconds = timeouts.download_seconds;
+	} else if (state == &update_install_state_) {
+		seconds = timeouts.install_seconds;
+	} else if (state == &update_reboot_state_ || state == &update_verify_reboot_state_) {
+		seconds = timeouts.reboot_seconds;
+	} else if (state == &update_commit_state_) {
+		seconds = timeouts.commit_seconds;
+	}
+	if (seconds == 0) {
+		return;
+	}
+
+	const string name = CurrentStateName();
+	state_timeout_timer_.AsyncWait(
+		chrono::seconds {seconds}, [this, name, seconds](error::Error err) {
+			if (err != error::NoError) {
+				if (err.code != make_error_condition(errc::operation_canceled)) {
+					log::Error("State timeout timer caused error: " + err.String());
+				}
+				return;
+			}
+			error::Error reason(
+				make_error_condition(errc::timed_out),
+				name + " timed out after " + to_string(seconds) + " seconds");
+			log::Error("Stopping the deployment: " + reason.String());
+			// Like for the preflight checks, the reason is visible on the server.
+			ctx_.deployment.substate = reason.message;
+			ctx_.RecordFailure(FailureCategory::Timeout);
+			ctx_.StopDeploymentState(reason);
+		});
+}
+
+void StateMachine::KeepAlive() {
+	ctx_.service_notifier.KeepAlive();
+	// Twice per interval, as sd_watchdog_enabled(3) recommends.
+	watchdog_timer_.AsyncWait(
+		ctx_.service_notifier.WatchdogInterval() / 2, [this](error::Error err) {
+			if (err != error::NoError) {
+				if (err.code != make_error_condition(errc::operation_canceled)) {
+					log::Error("Watchdog timer caused error: " + err.String());
+				}
+				return;
+			}
+			KeepAlive();
+		});
+}
+
+void StateMachine::ReloadConfig(const cfg_parser::MenderConfigFromFile &config) {
+	pending_config_ = config;
+	ApplyPendingConfig();
+	if (pending_config_) {
+		log::Info("The reloaded settings are applied once the daemon is idle again");
+	}
+}
+
+void StateMachine::ApplyPendingConfig() {
+	const auto &state = main_states_.GetCurrentState();
+	if (&state != &init_state_ && &state != &idle_state_) {
+		return;
+	}
+	const auto pending = std::move(pending_config_.value());
+	pending_config_.reset();
+
+	auto &config = ctx_.mender_context.GetConfig();
+	config.download_rate_limit = pending.download_rate_limit;
+
+	// Without servers of their own, the ones found with ServerDiscovery are kept.
+	if (any_of(pending.servers.cbegin(), pending.servers.cend(), [](const string &server) {
+			return server != "";
+		})) {
+		config.servers = pending.servers;
+		const bool failover = config.servers.size() > 1;
+		ctx_.http_client.SetServerFailover(failover);
+		ctx_.device_config_http_client.SetServerFailover(failover);
+		ctx_.push_channel_http_client.SetServerFailover(failover);
+		inventory_http_client_.SetServerFailover(failover);
+	}
+
+	// A new interval starts over with a check right away, rather than after the old interval.
+	if (pending.update_poll_interval_seconds != config.update_poll_interval_seconds) {
+		config.update_poll_interval_seconds = pending.update_poll_interval_seconds;
+		schedule_poll_for_deployment_state_.SetInterval(config.update_poll_interval_seconds);
+		if (&main_states_.GetCurrentState() == &idle_state_) {
+			PostEvent(StateEvent::DeploymentPollingTriggered);
+		}
+	}
+	if (pending.inventory_poll_interval_seconds != config.inventory_poll_interval_seconds) {
+		config.inventory_poll_interval_seconds = pending.inventory_poll_interval_seconds;
+		schedule_submit_inventory_state_.SetInterval(config.inventory_poll_interval_seconds);
+		inventory_scheduler_.SetInterval(chrono::seconds {config.inventory_poll_interval_seconds});
+		if (&main_states_.GetCurrentState() == &idle_state_) {
+			PostEvent(StateEvent::InventoryPollingTriggered);
+		}
+	}
+
+	log::Info("Applied the reloaded configuration");
 }
 
 error::Error StateMachine::Run() {
-	// Client is supposed to do one handling of each on startup.
-	runner_.PostEvent(StateEvent::InventoryPollingTriggered);
-	runner_.PostEvent(StateEvent::DeploymentPollingTriggered);
+	AddInventorySubmissionTransitions();
+
+	function<void()> start = [this]() {
+		// Client is supposed to do one handling of each on startup.
+		runner_.PostEvent(StateEvent::InventoryPollingTriggered);
+		runner_.PostEvent(StateEvent::DeploymentPollingTriggered);
+		// Nothing would wait for them before exiting, with RunOnce.
+		if (ctx_.device_config.Enabled() && !run_once_.enabled) {
+			event_loop_.Post([this]() { ctx_.device_config.Trigger(); });
+		}
+		if (ctx_.push_channel.Enabled() && !run_once_.enabled) {
+			ctx_.push_channel.Start([this](const string &command) {
+				if (command == PushChannel::kCheckUpdate) {
+					runner_.PostEvent(StateEvent::DeploymentPollingTriggered);
+				} else {
+					runner_.PostEvent(StateEvent::InventoryPollingTriggered);
+				}
+			});
+		}
+		ctx_.service_notifier.WaitingFor("");
+	};
+	if (ctx_.self_test.Enabled() && ctx_.self_test.Due(conf::kMenderVersion)) {
+		// Nothing runs until the self-test is over, not even a deployment which is resumed, so
+		// that one which installed a broken client can still be rolled back.
+		runner_.Pause();
+		auto after_self_test = start;
+		start = [this, after_self_test]() {
+			ctx_.service_notifier.WaitingFor("the self-test");
+			ctx_.self_test.AsyncRun(
+				conf::kMenderVersion, [this, after_self_test](const vector<string> &failures) {
+					if (!failures.empty()) {
+						FailDeploymentAfterSelfTest();
+					}
+					runner_.Resume();
+					after_self_test();
+				});
+		};
+	}
+	if (ctx_.startup_wait.Enabled()) {
+		ctx_.service_notifier.WaitingFor(common::JoinStrings(ctx_.startup_wait.Unmet(), " and "));
+		ctx_.startup_wait.AsyncWait(
+			[this](const vector<string> &unmet) {
+				ctx_.service_notifier.WaitingFor(common::JoinStrings(unmet, " and "));
+			},
+			start);
+	} else {
+		start();
+	}
 
 	auto err = RegisterSignalHandlers();
 	if (err != error::NoError) {
@@ -486,10 +844,55 @@ error::Error StateMachine::Run() {
 
 	log::Info("Running mender-update " + conf::kMenderVersion);
 
+	// Right away, not once the startup wait and the self-test are over, which may take longer than
+	// systemd waits for a service to start. What the daemon waits for is in the status instead.
+	ctx_.service_notifier.Ready();
+
+	if (ctx_.service_notifier.WatchdogInterval().count() > 0) {
+		KeepAlive();
+	}
+
+	if (!run_once_.enabled) {
+		CheckPartitionLayout();
+	}
+
 	event_loop_.Run();
+	ctx_.service_notifier.Stopping();
 	return exit_state_.exit_error;
 }
 
+void StateMachine::CheckPartitionLayout() {
+	const auto &paths = ctx_.mender_context.GetConfig().paths;
+	const string module = path::Join(paths.GetModulesPath(), "rootfs-image");
+	if (!path::FileExists(module)) {
+		return;
+	}
+
+	// A File Tree of its own, since the check runs alongside a deployment which is resumed.
+	const string files = path::Join(paths.GetDataStore(), "partition-layout-check");
+	auto err = path::CreateDirectories(path::Join(files, "tmp"));
+	if (err == error::NoError) {
+		// Records the layout on the first start, and logs when it has changed since. Only a
+		// warning, since the deployments fail the same check.
+		err = layout_check_runner_.AsyncRun(
+			event_loop_,
+			{module, "CheckPartitionLayout", files},
+			chrono::seconds {ctx_.mender_context.GetConfig().module_timeout_seconds},
+			[files](error::Error err, const string &first_line) {
+				if (err != error::NoError) {
+					log::Warning("The partition layout check failed: " + err.String());
+				}
+				err = path::DeleteRecursively(files);
+				if (err != error::NoError) {
+					log::Warning("Could not remove " + files + ": " + err.String());
+				}
+			});
+	}
+	if (err != error::NoError) {
+		log::Warning("Could not run the partition layout check: " + err.String());
+	}
+}
+
 void StateMachine::StopAfterDeployment() {
 	main_states_.AddTransition(
 		end_of_deployment_state_,
@@ -498,6 +901,282 @@ void StateMachine::StopAfterDeployment() {
 		sm::TransitionFlag::Immediate);
 }
 
+void StateMachine::RunOnce() {
+	run_once_.enabled = true;
+}
+
+void StateMachine::AddInventorySubmissionTransitions() {
+	const auto &config = ctx_.mender_context.GetConfig();
+	// The scheduler submits the inventory on its own, so that it isn't held up by the update
+	// checks and deployments, and without the Sync state scripts. Not with LowResource, which
+	// keeps to one operation at a time, and not with RunOnce, so that the daemon doesn't exit in
+	// the middle of a submission.
+	if (config.inventory_submission.independent && !config.low_resource.enabled
+		&& !run_once_.enabled) {
+		main_states_.AddTransition(
+			idle_state_,
+			StateEvent::InventoryPollingTriggered,
+			trigger_inventory_submission_state_,
+			sm::TransitionFlag::Deferred);
+		main_states_.AddTransition(
+			trigger_inventory_submission_state_,
+			StateEvent::Success,
+			idle_state_,
+			sm::TransitionFlag::Immediate);
+	} else {
+		main_states_.AddTransition(
+			idle_state_,
+			StateEvent::InventoryPollingTriggered,
+			schedule_submit_inventory_state_,
+			sm::TransitionFlag::Deferred);
+	}
+}
+
+void StateMachine::TrackRunOnce() {
+	const auto *state = &main_states_.GetCurrentState();
+	if (run_once_.checking) {
+		// The update check leads to the Sync_Leave scripts, with or without a deployment, or to
+		// the Sync_Error scripts.
+		run_once_.checking = false;
+		run_once_.checked = true;
+		run_once_.check_failed = state == &state_scripts_.sync_error_;
+	}
+	if (state == &poll_for_deployment_state_) {
+		run_once_.checking = true;
+	} else if (state == &end_of_deployment_state_) {
+		if (ctx_.deployment.failed || ctx_.deployment.aborted) {
+			run_once_.deployments_failed++;
+		} else {
+			run_once_.deployments_succeeded++;
+		}
+	}
+}
+
+void StateMachine::MaybeExitRunOnce() {
+	// Back in Idle with nothing left to do, also not the inventory submission which follows a
+	// deployment.
+	if (&main_states_.GetCurrentState() != &idle_state_ || !run_once_.checked
+		|| runner_.HasPendingEvents()) {
+		return;
+	}
+
+	if (run_once_.deployments_failed > 0) {
+		log::Error("The deployment failed, exiting");
+		exit_state_.exit_error = error::MakeError(error::ExitWithFailureError, "");
+	} else if (run_once_.deployments_succeeded > 0) {
+		log::Info("The deployment succeeded, exiting");
+		exit_state_.exit_error = error::NoError;
+	} else if (run_once_.check_failed) {
+		log::Error("Could not check for updates, exiting");
+		exit_state_.exit_error = error::MakeError(error::ExitWithFailureError, "");
+	} else {
+		log::Info("No update available, exiting");
+		exit_state_.exit_error =
+			context::MakeError(context::NoUpdateAvailableError, "No update available");
+	}
+	event_loop_.Stop();
+}
+
+void StateMachine::Pause() {
+	log::Info("Pausing the state machine");
+	runner_.Pause();
+}
+
+void StateMachine::Resume() {
+	log::Info("Resuming the state machine");
+	runner_.Resume();
+}
+
+bool StateMachine::Paused() const {
+	return runner_.Paused();
+}
+
+void StateMachine::PostEvent(StateEvent event) {
+	runner_.PostEvent(event);
+}
+
+error::Error StateMachine::AbortDeployment() {
+	if (!ctx_.deployment.state_data) {
+		return context::MakeError(context::NoUpdateInProgressError, "No deployment in progress");
+	}
+	// Once ArtifactCommit has started, or the deployment has failed, there is nothing left to
+	// abort, the deployment only finishes what it is doing.
+	const auto &state = ctx_.deployment.state_data->state;
+	if (ctx_.deployment.failed || state == Context::kUpdateStateArtifactCommit
+		|| state == Context::kUpdateStateAfterArtifactCommit
+		|| state == Context::kUpdateStateArtifactRollback
+		|| state == Context::kUpdateStateArtifactRollbackReboot
+		|| state == Context::kUpdateStateArtifactVerifyRollbackReboot
+		|| state == Context::kUpdateStateArtifactFailure
+		|| state == Context::kUpdateStateCleanup) {
+		return context::MakeError(
+			context::WrongOperationError,
+			"The deployment is past the point where it can be aborted");
+	}
+	log::Info("Deployment abort requested");
+	ctx_.RequestDeploymentAbort();
+	return error::NoError;
+}
+
+void StateMachine::NameStates() {
+	state_names_ = {
+		{&trigger_inventory_submission_state_, "TriggerInventorySubmissionState"},
+		{&init_state_, "InitState"},
+		{&idle_state_, "IdleState"},
+		{&schedule_submit_inventory_state_, "ScheduleNextPollState"},
+		{&schedule_poll_for_deployment_state_, "ScheduleNextPollState"},
+		{&submit_inventory_state_, "SubmitInventoryState"},
+		{&poll_for_deployment_state_, "PollForDeploymentState"},
+		{&update_window_download_state_, "UpdateWindowState"},
+		{&send_download_status_state_, "SendStatusUpdateState"},
+		{&update_check_artifact_header_state_, "UpdateCheckArtifactHeaderState"},
+		{&update_preflight_download_state_, "UpdatePreflightChecksState"},
+		{&update_download_state_, "UpdateDownloadState"},
+		{&update_download_cancel_state_, "UpdateDownloadCancelState"},
+		{&update_window_install_state_, "UpdateWindowState"},
+		{&send_install_status_state_, "SendStatusUpdateState"},
+		{&update_preflight_install_state_, "UpdatePreflightChecksState"},
+		{&update_install_state_, "UpdateInstallState"},
+		{&update_check_reboot_state_, "UpdateCheckRebootState"},
+		{&update_check_rollback_reboot_state_, "UpdateCheckRebootState"},
+		{&update_window_reboot_state_, "UpdateWindowState"},
+		{&send_reboot_status_state_, "SendStatusUpdateState"},
+		{&update_reboot_state_, "UpdateRebootState"},
+		{&update_verify_reboot_state_, "UpdateVerifyRebootState"},
+		{&send_commit_status_state_, "SendStatusUpdateState"},
+		{&update_before_commit_state_, "UpdateBeforeCommitState"},
+		{&update_commit_lease_state_, "UpdateCommitLeaseState"},
+		{&update_commit_confirmation_state_, "UpdateCommitConfirmationState"},
+		{&update_canary_state_, "UpdateCanaryState"},
+		{&update_commit_state_, "UpdateCommitState"},
+		{&update_reconcile_commit_state_, "UpdateReconcileCommitState"},
+		{&update_after_commit_state_, "UpdateAfterCommitState"},
+		{&update_pilot_state_, "UpdatePilotState"},
+		{&update_pilot_revert_state_, "UpdatePilotRevertState"},
+		{&update_check_rollback_state_, "UpdateCheckRollbackState"},
+		{&update_rollback_state_, "UpdateRollbackState"},
+		{&update_rollback_reboot_state_, "UpdateRollbackRebootState"},
+		{&update_verify_rollback_reboot_state_, "UpdateVerifyRollbackRebootState"},
+		{&update_rollback_successful_state_, "UpdateRollbackSuccessfulState"},
+		{&update_failure_state_, "UpdateFailureState"},
+		{&update_save_provides_state_, "UpdateSaveProvidesState"},
+		{&update_rollback_not_needed_state_, "UpdateRollbackSuccessfulState"},
+		{&update_cleanup_state_, "UpdateCleanupState"},
+		{&send_final_status_state_, "SendStatusUpdateState"},
+		{&clear_artifact_data_state_, "ClearArtifactDataState"},
+		{&post_commit_cleanup_state_, "PostCommitCleanupState"},
+		{&state_loop_state_, "StateLoopState"},
+		{&end_of_deployment_state_, "EndOfDeploymentState"},
+		{&exit_state_, "ExitState"},
+		{&state_scripts_.idle_enter_, "StateScriptState"},
+		{&state_scripts_.idle_leave_deploy_, "StateScriptState"},
+		{&state_scripts_.idle_leave_inv_, "StateScriptState"},
+		{&state_scripts_.sync_enter_deployment_, "StateScriptState"},
+		{&state_scripts_.sync_enter_inventory_, "StateScriptState"},
+		{&state_scripts_.sync_leave_, "StateScriptState"},
+		{&state_scripts_.sync_leave_download_, "StateScriptState"},
+		{&state_scripts_.sync_error_, "StateScriptState"},
+		{&state_scripts_.sync_error_download_, "StateScriptState"},
+		{&state_scripts_.download_enter_, "SaveStateScriptState"},
+		{&state_scripts_.download_leave_, "StateScriptState"},
+		{&state_scripts_.download_leave_save_provides, "StateScriptState"},
+		{&state_scripts_.download_error_, "StateScriptState"},
+		{&state_scripts_.install_enter_, "SaveStateScriptState"},
+		{&state_scripts_.install_leave_, "StateScriptState"},
+		{&state_scripts_.install_error_, "StateScriptState"},
+		{&state_scripts_.install_error_rollback_, "StateScriptState"},
+		{&state_scripts_.reboot_enter_, "SaveStateScriptState"},
+		{&state_scripts_.reboot_leave_, "StateScriptState"},
+		{&state_scripts_.reboot_error_, "StateScriptState"},
+		{&state_scripts_.rollback_enter_, "SaveStateScriptState"},
+		{&state_scripts_.rollback_leave_, "StateScriptState"},
+		{&state_scripts_.rollback_leave_error_, "StateScriptState"},
+		{&state_scripts_.commit_enter_, "SaveStateScriptState"},
+		{&state_scripts_.commit_leave_, "StateScriptState"},
+		{&state_scripts_.commit_error_, "StateScriptState"},
+		{&state_scripts_.commit_error_save_provides_, "StateScriptState"},
+		{&state_scripts_.failure_enter_, "SaveStateScriptState"},
+		{&state_scripts_.failure_leave_update_save_provides_, "StateScriptState"},
+		{&state_scripts_.failure_leave_state_loop_state_, "StateScriptState"},
+		{&state_scripts_.rollback_reboot_enter_, "SaveStateScriptState"},
+		{&state_scripts_.rollback_reboot_leave_, "StateScriptState"},
+		{&state_scripts_.rollback_reboot_error_, "StateScriptState"},
+	};
+}
+
+string StateMachine::CurrentStateName() const {
+	auto name = state_names_.find(&main_states_.GetCurrentState());
+	if (name == state_names_.end()) {
+		return "UnknownState";
+	}
+	return name->second;
+}
+
+void StateMachine::SetStateChangeCallback(function<void()> callback) {
+	state_change_callback_ = callback;
+}
+
+void StateMachine::SetStatusChangeCallback(StatusChangeCallback callback) {
+	status_change_callback_ = callback;
+}
+
+string StateMachine::StatusJson() const {
+	return R"({"state":")" + json::EscapeString(status_.state) + R"(","deployment_id":")"
+		   + json::EscapeString(status_.deployment_id) + R"(","loops":{"update_check":)"
+		   + ctx_.update_check_health.ToJson() + R"(,"inventory_submission":)"
+		   + ctx_.inventory_health.ToJson() + R"(},"pause":)" + ctx_.pause_record.ToJson()
+		   + R"(,"freeze":)" + ctx_.device_freeze.ToJson() + "}";
+}
+
+void StateMachine::OnIteration() {
+	if (state_change_callback_) {
+		state_change_callback_();
+	}
+	if (run_once_.enabled) {
+		MaybeExitRunOnce();
+	}
+
+	Status status;
+	status.state = CurrentStateName();
+	if (ctx_.deployment.state_data) {
+		status.deployment_id = ctx_.deployment.state_data->update_info.id;
+		status.artifact_name = ctx_.deployment.state_data->update_info.artifact.artifact_name;
+	}
+	status.last_error = status_.last_error;
+	if (ctx_.deployment.failed && !failure_recorded_) {
+		// The failure is tracked as soon as the failing state posts it, so the state before
+		// this iteration is the one which failed.
+		string failed_in = ctx_.deployment.aborted ? " aborted in " : " failed in ";
+		status.last_error = "Deployment " + status.deployment_id + failed_in + status_.state;
+		if (ctx_.deployment.substate != "") {
+			status.last_error += ": " + ctx_.deployment.substate;
+		}
+
+		if (ctx_.deployment.state_data) {
+			auto err =
+				ctx_.deployment_history.FailureReason(status.deployment_id, status.last_error);
+			if (err != error::NoError) {
+				log::Warning(
+					"Could not record the failure in the deployment history: " + err.String());
+			}
+		}
+	}
+	failure_recorded_ = ctx_.deployment.failed;
+
+	if (status == status_) {
+		return;
+	}
+	auto previous = status_;
+	status_ = status;
+	if (status.state != previous.state) {
+		ctx_.mqtt_bridge.StateChanged(status.state, status.deployment_id);
+	}
+	ctx_.service_notifier.StateChanged(status.state, status.deployment_id, status.artifact_name);
+	if (status_change_callback_) {
+		status_change_callback_(previous, status_);
+	}
+}
+
 #ifndef NDEBUG
 void StateMachine::StopAfterDeployments(int number) {
 	exit_state_.ExitAfter(number);
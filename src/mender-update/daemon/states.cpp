@@ -14,12 +14,20 @@
 
 #include <mender-update/daemon/states.hpp>
 
+#include <algorithm>
+#include <ctime>
+#include <filesystem>
+#include <map>
+
 #include <client_shared/conf.hpp>
+#include <common/common.hpp>
 #include <common/device_tier.hpp>
 #include <common/events_io.hpp>
 #include <common/log.hpp>
 #include <common/path.hpp>
 
+#include <artifact/sha/sha.hpp>
+
 #include <mender-update/daemon/context.hpp>
 #include <mender-update/inventory.hpp>
 
@@ -27,6 +35,7 @@ namespace mender {
 namespace update {
 namespace daemon {
 
+namespace common = mender::common;
 namespace conf = mender::client_shared::conf;
 namespace device_tier = mender::common::device_tier;
 namespace error = mender::common::error;
@@ -35,26 +44,36 @@ namespace kv_db = mender::common::key_value_database;
 namespace path = mender::common::path;
 namespace log = mender::common::log;
 
+namespace fs = std::filesystem;
+
+namespace sha = mender::sha;
+
 namespace main_context = mender::update::context;
 namespace inventory = mender::update::inventory;
 
+// For the calls into the Update Module, which is what a failure is blamed on if the error doesn't
+// tell otherwise.
 class DefaultStateHandler {
 public:
 	void operator()(const error::Error &err) {
 		if (err != error::NoError) {
 			log::Error(err.String());
+			ctx.RecordFailure(err, FailureCategory::Module);
 			poster.PostEvent(StateEvent::Failure);
 			return;
 		}
 		poster.PostEvent(StateEvent::Success);
 	}
 
+	Context &ctx;
 	sm::EventPoster<StateEvent> &poster;
 };
 
-static void DefaultAsyncErrorHandler(sm::EventPoster<StateEvent> &poster, const error::Error &err) {
+static void DefaultAsyncErrorHandler(
+	Context &ctx, sm::EventPoster<StateEvent> &poster, const error::Error &err) {
 	if (err != error::NoError) {
 		log::Error(err.String());
+		ctx.RecordFailure(err, FailureCategory::Module);
 		poster.PostEvent(StateEvent::Failure);
 	}
 }
@@ -68,22 +87,94 @@ void InitState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	poster.PostEvent(StateEvent::Started); // Start the state machine
 }
 
+// Returns the name of the state as used by the state listeners, or an empty string if listeners
+// are not told about this transition.
+static string StateListenerName(script_executor::State state, script_executor::Action action) {
+	if (action == script_executor::Action::Error) {
+		return "";
+	}
+	switch (state) {
+	case script_executor::State::Download:
+		return "Download";
+	case script_executor::State::ArtifactInstall:
+		return "ArtifactInstall";
+	case script_executor::State::ArtifactReboot:
+		return "ArtifactReboot";
+	case script_executor::State::ArtifactCommit:
+		return "ArtifactCommit";
+	default:
+		return "";
+	}
+}
+
 void StateScriptState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	string state_name {script_executor::Name(this->state_, this->action_)};
+	string listener_state {StateListenerName(this->state_, this->action_)};
+	string listener_action {this->action_ == script_executor::Action::Enter ? "Enter" : "Leave"};
+	map<string, string> script_context;
+	map<string, string> environment;
+	if (ctx.deployment.state_data) {
+		const auto &update_info = ctx.deployment.state_data->update_info;
+		script_context["deployment_id"] = update_info.id;
+		script_context["artifact_name"] = update_info.artifact.artifact_name;
+		script_context["artifact_group"] = update_info.artifact.artifact_group;
+		environment = update_module::DeploymentMetadataEnvironment(
+			MakeDeploymentMetadata(update_info),
+			ctx.deployment.update_module
+				? ctx.deployment.update_module->GetDeploymentMetadataFile()
+				: "");
+	}
+	this->script_.SetScriptContext(
+		ctx.mender_context.GetConfig().paths.GetDataStore(), script_context);
+	this->script_.SetEnvironment(environment);
+	this->script_.SetWasmRuntime(ctx.mender_context.GetConfig().state_script_wasm_runtime);
+	this->script_.SetOutputLimit(
+		static_cast<size_t>(max(0, ctx.mender_context.GetConfig().state_script_output_limit_bytes)));
+
 	log::Debug("Executing the  " + state_name + " State Scripts...");
+	auto started = chrono::steady_clock::now();
 	auto err = this->script_.AsyncRunScripts(
 		this->state_,
 		this->action_,
-		[state_name, &poster](error::Error err) {
+		[this, state_name, listener_state, listener_action, started, &ctx, &poster](
+			error::Error err) {
+			ctx.metrics.StateScriptsRan(
+				state_name,
+				chrono::duration_cast<chrono::milliseconds>(chrono::steady_clock::now() - started));
+			if (this->script_.Substatus() != "") {
+				ctx.deployment.substate = this->script_.Substatus();
+			}
 			if (err != error::NoError) {
 				log::Error(
 					"Received error: (" + err.String() + ") when running the State Script scripts "
 					+ state_name);
+				// Tell the server which of the scripts failed, unless it said why itself.
+				if (this->script_.Substatus() == "" && this->script_.Failure() != "") {
+					ctx.deployment.substate = "State script " + this->script_.Failure();
+				}
+				ctx.RecordFailure(err, FailureCategory::Script);
 				poster.PostEvent(StateEvent::Failure);
 				return;
 			}
 			log::Debug("Successfully ran the " + state_name + " State Scripts...");
-			poster.PostEvent(StateEvent::Success);
+			if (listener_state == "") {
+				poster.PostEvent(StateEvent::Success);
+				return;
+			}
+
+			// A veto from a state listener is handled like a failing state script.
+			ctx.state_listeners.AsyncNotify(
+				listener_state, listener_action, [state_name, &ctx, &poster](error::Error err) {
+					if (err != error::NoError) {
+						log::Error(
+							"The " + state_name
+							+ " transition was aborted by a state listener: " + err.String());
+						ctx.RecordFailure(err, FailureCategory::Script);
+						poster.PostEvent(StateEvent::Failure);
+						return;
+					}
+					poster.PostEvent(StateEvent::Success);
+				});
 		},
 		this->on_error_);
 
@@ -91,6 +182,7 @@ void StateScriptState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster
 		log::Error(
 			"Failed to schedule the state script execution for: " + state_name
 			+ " got error: " + err.String());
+		ctx.RecordFailure(err, FailureCategory::Script);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
@@ -114,8 +206,10 @@ ScheduleNextPollState::ScheduleNextPollState(
 }
 
 void ScheduleNextPollState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
-	log::Debug("Scheduling the next " + poll_action_ + " in: " + to_string(interval_) + " seconds");
-	timer_.AsyncWait(chrono::seconds(interval_), [this, &poster](error::Error err) {
+	const auto interval = ctx.poll_splay.Apply(chrono::seconds(interval_));
+	log::Debug(
+		"Scheduling the next " + poll_action_ + " in: " + to_string(interval.count()) + " seconds");
+	timer_.AsyncWait(interval, [this, &poster](error::Error err) {
 		if (err != error::NoError) {
 			if (err.code != make_error_condition(errc::operation_canceled)) {
 				log::Error("Timer caused error: " + err.String());
@@ -128,6 +222,23 @@ void ScheduleNextPollState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &p
 	poster.PostEvent(StateEvent::Success);
 }
 
+// Where the policy leaves a setting out, the one from RetryPollIntervalSeconds and RetryPollCount
+// stays.
+static void ApplyRetryPolicy(
+	http::ExponentialBackoff &backoff, const cfg_parser::RetryPolicy &policy) {
+	if (policy.max_attempts > 0) {
+		backoff.SetTryCount(policy.max_attempts);
+	}
+	if (policy.base_interval_seconds > 0) {
+		backoff.SetSmallestInterval(chrono::seconds(policy.base_interval_seconds));
+	}
+	if (policy.max_interval_seconds > 0) {
+		backoff.SetMaxInterval(chrono::seconds(policy.max_interval_seconds));
+	}
+	backoff.SetFactor(policy.factor);
+	backoff.SetJitter(policy.jitter);
+}
+
 SubmitInventoryState::SubmitInventoryState(int retry_interval_seconds, int retry_count) :
 	backoff_ {chrono::seconds(retry_interval_seconds), retry_count} {
 }
@@ -189,6 +300,7 @@ void SubmitInventoryState::HandlePollingError(
 
 void SubmitInventoryState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	log::Debug("Submitting inventory");
+	ctx.inventory_health.Started();
 
 	auto handler = [this, &ctx, &poster](inventory::APIResponse resp) {
 		this->PushDataHandler(ctx, poster, resp);
@@ -211,10 +323,16 @@ PollForDeploymentState::PollForDeploymentState(int retry_interval_seconds, int r
 	backoff_ {chrono::seconds(retry_interval_seconds), retry_count} {
 }
 
+void PollForDeploymentState::SetRetryPolicy(const cfg_parser::RetryPolicy &policy) {
+	ApplyRetryPolicy(backoff_, policy);
+	policy_intervals_ = policy.base_interval_seconds > 0 || policy.max_interval_seconds > 0;
+}
+
 void SubmitInventoryState::PushDataHandler(
 	Context &ctx, sm::EventPoster<StateEvent> &poster, inventory::APIResponse resp) {
 	if (resp.error != error::NoError) {
 		log::Error("Failed to submit inventory: " + resp.error.String());
+		ctx.inventory_health.Failed(resp.error.String());
 		// Replace the inventory poll timer with:
 		// - a backoff, or
 		// - if HTTP 429 Too Many Requests with  Retry-After header is provided - appropriate time
@@ -225,6 +343,8 @@ void SubmitInventoryState::PushDataHandler(
 	}
 	backoff_.Reset();
 	ctx.inventory_client->has_submitted_inventory = true;
+	ctx.inventory_health.Succeeded();
+	ctx.metrics.InventorySubmitted();
 	poster.PostEvent(StateEvent::Success);
 }
 
@@ -237,7 +357,7 @@ void PollForDeploymentState::HandlePollingError(
 	// converts the backoff to a fixed interval.
 	chrono::milliseconds max_interval =
 		chrono::seconds(ctx.mender_context.GetConfig().retry_poll_interval_seconds);
-	if (max_interval < backoff_.SmallestInterval()) {
+	if (!policy_intervals_ && max_interval < backoff_.SmallestInterval()) {
 		backoff_.SetSmallestInterval(max_interval);
 		backoff_.SetMaxInterval(max_interval);
 	}
@@ -287,12 +407,43 @@ void PollForDeploymentState::HandlePollingError(
 	});
 }
 
+// Cached headers were verified when they were stored, like the pre-fetched ones are.
+static bool StartWithCachedHeader(Context &ctx) {
+	const auto &artifact_name = ctx.deployment.state_data->update_info.artifact.artifact_name;
+	auto exp_cached = ctx.header_cache.Find(artifact_name);
+	if (!exp_cached) {
+		log::Warning("Could not read the Artifact header cache: " + exp_cached.error().String());
+		return false;
+	}
+	if (!exp_cached.value()) {
+		return false;
+	}
+
+	auto exp_header = artifact::HeaderViewFromJson(exp_cached.value()->header_json);
+	if (!exp_header) {
+		log::Warning(
+			"Ignoring the cached header of Artifact " + artifact_name + ": "
+			+ exp_header.error().String());
+		return false;
+	}
+
+	HeaderPrefetch::Result result {
+		artifact::PayloadHeaderView {.version = 3, .header = exp_header.value()},
+		"",
+		nullopt,
+		true,
+	};
+	ctx.header_prefetch.StartWithResult(result);
+	return true;
+}
+
 void PollForDeploymentState::CheckNewDeploymentsHandler(
 	Context &ctx,
 	sm::EventPoster<StateEvent> &poster,
 	deployments::CheckUpdatesAPIResponse response) {
 	if (!response) {
 		log::Error("Error while polling for deployment: " + response.error().error.String());
+		ctx.update_check_health.Failed(response.error().error.String());
 		// Replace the update poll timer with:
 		// - a backoff, or
 		// - if HTTP 429 Too Many Requests with  Retry-After header is provided - appropriate time
@@ -302,6 +453,8 @@ void PollForDeploymentState::CheckNewDeploymentsHandler(
 		return;
 	} else if (!response.value()) {
 		log::Info("No update available");
+		ctx.update_check_health.Succeeded();
+		ctx.metrics.UpdateChecked();
 		poster.PostEvent(StateEvent::NothingToDo);
 		if (not ctx.inventory_client->has_submitted_inventory) {
 			// If we have not submitted inventory successfully at least
@@ -318,13 +471,25 @@ void PollForDeploymentState::CheckNewDeploymentsHandler(
 	}
 	backoff_.Reset();
 
+	if (ctx.standalone_update.Busy()) {
+		// Started while the update check was on its way. The deployment stays pending on the
+		// server until the next one.
+		log::Info("A standalone update is in progress, leaving the deployment for later");
+		poster.PostEvent(StateEvent::NothingToDo);
+		return;
+	}
+
 	auto exp_data = ApiResponseJsonToStateData(response.value().value());
 	if (!exp_data) {
 		log::Error("Error in API response: " + exp_data.error().String());
+		ctx.update_check_health.Failed(exp_data.error().String());
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
 
+	ctx.update_check_health.Succeeded();
+	ctx.metrics.UpdateChecked();
+
 	// Make a new set of update data.
 	ctx.deployment.state_data.reset(new StateData(std::move(exp_data.value())));
 
@@ -335,12 +500,81 @@ void PollForDeploymentState::CheckNewDeploymentsHandler(
 	log::Info("Running mender-update " + conf::kMenderVersion);
 	log::Info("Deployment with ID " + ctx.deployment.state_data->update_info.id + " started.");
 
+	ctx.metrics.DeploymentStarted();
+	auto err = ctx.deployment_history.Started(
+		ctx.deployment.state_data->update_info.id,
+		ctx.deployment.state_data->update_info.artifact.artifact_name);
+	if (err != error::NoError) {
+		log::Warning("Could not add the deployment to the deployment history: " + err.String());
+	}
+	err = ctx.artifact_twin.SetDesired(
+		ctx.deployment.state_data->update_info.id,
+		ctx.deployment.state_data->update_info.artifact.artifact_name);
+	if (err != error::NoError) {
+		log::Warning("Could not record the desired Artifact: " + err.String());
+	}
+
+	// Check the header concurrently with the states before the download, see
+	// UpdateCheckArtifactHeaderState.
+	const auto &config = ctx.mender_context.GetConfig();
+	auto exp_verify_keys = config.GetArtifactVerifyKeys();
+	const auto prefetched_scripts_path =
+		path::Join(config.paths.GetDataStore(), "prefetched-scripts");
+	if (StartWithCachedHeader(ctx)) {
+		log::Debug("Checking the cached header of the Artifact instead of pre-fetching it");
+	} else if (
+		config.artifact_header_prefetch_bytes > 0 && !config.low_resource.enabled && exp_verify_keys
+		&& update_module::AddScratchPath(config, prefetched_scripts_path) == error::NoError) {
+		artifact::config::ParserConfig parser_config {
+			.artifact_scripts_filesystem_path = prefetched_scripts_path,
+			.artifact_scripts_version = 3,
+			.artifact_verify_keys = exp_verify_keys.value(),
+		};
+		ctx.header_prefetch.Start(
+			ctx.deployment.state_data->update_info.artifact.source.uri,
+			config.artifact_header_prefetch_bytes,
+			parser_config);
+	}
+
 	poster.PostEvent(StateEvent::DeploymentStarted);
 	poster.PostEvent(StateEvent::Success);
 }
 
 void PollForDeploymentState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (ctx.self_test.Failed()) {
+		// Installing on top of a client which doesn't work properly would only make it worse.
+		log::Warning("The self-test failed, not checking for new deployments until it passes");
+		poster.PostEvent(StateEvent::NothingToDo);
+		return;
+	}
+	if (ctx.standalone_update.Busy()) {
+		// Both would use the same Update Modules and the same partitions.
+		log::Info(
+			"A standalone update is in progress, not checking for new deployments until it is over");
+		poster.PostEvent(StateEvent::NothingToDo);
+		return;
+	}
+
+	if (ctx.outbound_queue.Empty()) {
+		CheckNewDeployments(ctx, poster);
+		return;
+	}
+
+	// What couldn't be sent at the end of the previous deployments goes first, in order. If the
+	// server still can't be reached, the update check fails too, and is retried as usual.
+	ctx.outbound_queue.AsyncFlush(
+		*ctx.deployment_client, ctx.http_client, [this, &ctx, &poster](error::Error err) {
+			if (err != error::NoError) {
+				log::Warning("Could not send the queued status updates: " + err.String());
+			}
+			CheckNewDeployments(ctx, poster);
+		});
+}
+
+void PollForDeploymentState::CheckNewDeployments(
+	Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	log::Debug("Polling for update");
+	ctx.update_check_health.Started();
 
 	auto err = ctx.deployment_client->CheckNewDeployments(
 		ctx.mender_context,
@@ -351,6 +585,7 @@ void PollForDeploymentState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &
 
 	if (err != error::NoError) {
 		log::Error("Error when trying to poll for deployment: " + err.String());
+		ctx.update_check_health.Failed(err.String());
 		// If we're here, no handler will be called, so we need to manually schedule the next
 		// deployment poll.
 		// Posting Failure correctly exits the PollForDeploymentState, but does not schedule the
@@ -364,6 +599,12 @@ void PollForDeploymentState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &
 	}
 }
 
+void TriggerInventorySubmissionState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	log::Debug("Triggering the inventory submission");
+	scheduler_.Trigger();
+	poster.PostEvent(StateEvent::Success);
+}
+
 void SaveState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	assert(ctx.deployment.state_data);
 
@@ -381,6 +622,7 @@ void SaveState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 		} else if (!IsFailureState()) {
 			// Non-failure states should be interrupted, but failure states should be
 			// allowed to do their work, even if a database error was detected.
+			ctx.RecordFailure(err, FailureCategory::Storage);
 			poster.PostEvent(StateEvent::Failure);
 			return;
 		}
@@ -389,14 +631,276 @@ void SaveState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	OnEnterSaveState(ctx, poster);
 }
 
+// Logs the reasons if the Artifact is not acceptable.
+expected::ExpectedStringVector ArtifactRejectionReasons(
+	Context &ctx, const artifact::HeaderView &header) {
+	// A System Device only accepts the orchestrator manifest; any other payload type is rejected.
+	if (ctx.mender_context.GetConfig().device_tier == device_tier::kSystem
+		&& header.payload_type != main_context::MenderContext::orchestrator_manifest_payload_type) {
+		return vector<string> {
+			"Refusing to install artifact '" + header.artifact_name + "': its payload type is '"
+			+ header.payload_type
+			+ "', but this is a System Device (DeviceTier=system) which only accepts '"
+			+ main_context::MenderContext::orchestrator_manifest_payload_type + "' artifacts"};
+	}
+
+	auto exp_reasons = ctx.mender_context.UnmetArtifactDepends(header);
+	if (!exp_reasons) {
+		return exp_reasons;
+	}
+	auto reasons = exp_reasons.value();
+
+	// Not valid yet is fine, the installation waits for it, see UpdateWindowState.
+	auto exp_window = main_context::ArtifactEligibilityWindow(header);
+	if (!exp_window) {
+		reasons.push_back(
+			"Refusing to install artifact '" + header.artifact_name
+			+ "': " + exp_window.error().message);
+	} else if (
+		exp_window.value().not_after
+		&& chrono::system_clock::now() > exp_window.value().not_after.value()) {
+		reasons.push_back(
+			"Refusing to install artifact '" + header.artifact_name + "': it was only valid until "
+			+ main_context::FormatEligibilityTime(exp_window.value().not_after.value()));
+	}
+
+	return reasons;
+}
+
+static bool IsArtifactAcceptable(Context &ctx, const artifact::PayloadHeaderView &header) {
+	auto exp_reasons = ArtifactRejectionReasons(ctx, header.header);
+	if (!exp_reasons) {
+		log::Error(exp_reasons.error().String());
+		return false;
+	}
+	for (const auto &reason : exp_reasons.value()) {
+		log::Error(reason);
+	}
+	return exp_reasons.value().empty();
+}
+
+void UpdateCheckArtifactHeaderState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (!ctx.header_prefetch.Started()) {
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+
+	log::Debug("Entering CheckArtifactHeader state");
+
+	ctx.header_prefetch.AsyncWaitResult([&ctx, &poster](HeaderPrefetch::ExpectedResult result) {
+		if (!result) {
+			if (result.error().code
+				== artifact::parser_error::MakeError(
+					   artifact::parser_error::SignatureVerificationError, "")
+					   .code) {
+				log::Error(result.error().String());
+				ctx.RecordFailure(FailureCategory::Signature);
+				poster.PostEvent(StateEvent::Failure);
+				return;
+			}
+			// For example a header which is larger than what was fetched, or a server which
+			// doesn't allow it. The same checks are done during the download anyway.
+			log::Warning(
+				"Could not check the Artifact header before the download: "
+				+ result.error().String());
+			poster.PostEvent(StateEvent::Success);
+			return;
+		}
+
+		auto &prefetched = result.value();
+		if (prefetched.cached) {
+			// The Artifact may have been replaced by another one with the same name since its
+			// header was cached, so only its own header can refuse it, during the download.
+			auto exp_reasons = ArtifactRejectionReasons(ctx, prefetched.header.header);
+			if (!exp_reasons || !exp_reasons.value().empty()) {
+				const auto &name = prefetched.header.header.artifact_name;
+				log::Info(
+					"The cached header of Artifact " + name
+					+ " doesn't fit this device, dropping it and checking the Artifact itself");
+				auto err = ctx.header_cache.Remove(name);
+				if (err != error::NoError) {
+					log::Warning("Could not update the Artifact header cache: " + err.String());
+				}
+				poster.PostEvent(StateEvent::Success);
+				return;
+			}
+		} else if (!IsArtifactAcceptable(ctx, prefetched.header)) {
+			ctx.RecordFailure(FailureCategory::Depends);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+
+		if (prefetched.payload_size) {
+			// Update Modules which stream the payload don't need any space for it, so this
+			// can only be a warning.
+			const auto work_path = ctx.mender_context.GetConfig().paths.GetModulesWorkPath();
+			auto exp_space = io::GetAvailableSpace(work_path);
+			if (exp_space
+				&& static_cast<uintmax_t>(prefetched.payload_size.value()) > exp_space.value()) {
+				log::Warning(
+					"Payload file " + prefetched.payload_name + " is "
+					+ to_string(prefetched.payload_size.value()) + " bytes, but only "
+					+ to_string(exp_space.value()) + " bytes are available in " + work_path
+					+ ". The update will fail unless the Update Module streams the payload.");
+			}
+		}
+
+		log::Debug("Artifact header checked, starting the download");
+		poster.PostEvent(StateEvent::Success);
+	});
+}
+
+void UpdatePreflightChecksState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	log::Debug("Running the preflight checks before the " + stage_ + " state");
+
+	ctx.preflight_checks.AsyncRun(stage_, [this, &ctx, &poster](const vector<string> &failures) {
+		if (failures.empty()) {
+			poster.PostEvent(StateEvent::Success);
+			return;
+		}
+
+		for (const auto &failure : failures) {
+			log::Error("Preflight check failed: " + failure);
+		}
+		// Reported along with the failure status, so that the reason is visible on the server
+		// without fetching the deployment log.
+		ctx.deployment.substate =
+			"Preflight checks before " + stage_ + " failed: " + common::JoinStrings(failures, "; ");
+		poster.PostEvent(StateEvent::Failure);
+	});
+}
+
+// How often the progress of the download is emitted over D-Bus.
+static const chrono::seconds kDownloadProgressCheckInterval {1};
+
+static void WatchForAbort(Context &ctx, deployments::DeploymentStatus status);
+
+static int CurrentMinuteOfDay() {
+	time_t now = time(nullptr);
+	struct tm local;
+	localtime_r(&now, &local);
+	return local.tm_hour * 60 + local.tm_min;
+}
+
 void UpdateDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	log::Debug("Entering Download state");
 
+	const auto &chunked = ctx.mender_context.GetConfig().chunked_download;
+	if (chunked.store_url == "") {
+		DownloadWholeArtifact(ctx, poster);
+		return;
+	}
+
+	auto exp_device_type = ctx.mender_context.GetDeviceType();
+	if (!exp_device_type) {
+		log::Warning(
+			"Could not get the device type, downloading the whole artifact: "
+			+ exp_device_type.error().String());
+		DownloadWholeArtifact(ctx, poster);
+		return;
+	}
+	auto index_url = ChunkIndexURL(
+		chunked.store_url,
+		exp_device_type.value(),
+		ctx.deployment.state_data->update_info.artifact.artifact_name);
+
+	auto err = ctx.chunked_download.AsyncFetchIndex(
+		index_url, [&ctx, &poster, &chunked](ExpectedChunkIndex exp_index) {
+			if (!exp_index) {
+				log::Warning(
+					"Could not fetch the chunk index, downloading the whole artifact: "
+					+ exp_index.error().String());
+				DownloadWholeArtifact(ctx, poster);
+				return;
+			}
+			log::Info(
+				"Downloading the artifact in " + to_string(exp_index.value().chunks.size())
+				+ " chunks");
+			auto artifact_size = exp_index.value().size;
+			ReadArtifactFrom(
+				ctx,
+				poster,
+				ctx.chunked_download.MakeReader(
+					chunked.store_url,
+					std::move(exp_index.value()),
+					chunked.seeds,
+					path::Join(
+						ctx.mender_context.GetConfig().paths.GetDataStore(), kSeedIndexDir)),
+				artifact_size);
+		});
+	if (err != error::NoError) {
+		log::Warning(
+			"Could not fetch the chunk index, downloading the whole artifact: " + err.String());
+		DownloadWholeArtifact(ctx, poster);
+	}
+}
+
+string ArtifactMirrorURL(
+	const string &mirror, const string &device_type, const string &artifact_name) {
+	auto end = mirror.find_last_not_of('/');
+	const string base = end == string::npos ? "" : mirror.substr(0, end + 1);
+	return base + "/" + http::URLEncode(device_type) + "/" + http::URLEncode(artifact_name)
+		   + ".mender";
+}
+
+// The mirrors to look for the Artifact on, in order, before the server.
+static vector<string> ArtifactMirrorURLs(Context &ctx) {
+	const auto &config = ctx.mender_context.GetConfig();
+	if (config.artifact_mirrors.empty()) {
+		return {};
+	}
+
+	// Only the signature tells that the Artifact on a mirror is the one the server offered.
+	auto exp_verify_keys = config.GetArtifactVerifyKeys();
+	if (!exp_verify_keys || exp_verify_keys.value().empty()) {
+		log::Warning(
+			"Not using the Artifact mirrors, since there are no Artifact verification keys");
+		return {};
+	}
+	auto exp_device_type = ctx.mender_context.GetDeviceType();
+	if (!exp_device_type) {
+		log::Warning(
+			"Could not get the device type, not using the Artifact mirrors: "
+			+ exp_device_type.error().String());
+		return {};
+	}
+
+	vector<string> urls;
+	for (const auto &mirror : config.artifact_mirrors) {
+		urls.push_back(ArtifactMirrorURL(
+			mirror,
+			exp_device_type.value(),
+			ctx.deployment.state_data->update_info.artifact.artifact_name));
+	}
+	return urls;
+}
+
+void UpdateDownloadState::DownloadWholeArtifact(
+	Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	ctx.deployment.artifact_mirrors = ArtifactMirrorURLs(ctx);
+	DownloadFromNextSource(ctx, poster);
+}
+
+void UpdateDownloadState::DownloadFromNextSource(
+	Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	string url = ctx.deployment.state_data->update_info.artifact.source.uri;
+	ctx.deployment.artifact_mirror = "";
+	if (!ctx.deployment.artifact_mirrors.empty()) {
+		url = ctx.deployment.artifact_mirrors.front();
+		ctx.deployment.artifact_mirrors.erase(ctx.deployment.artifact_mirrors.begin());
+		ctx.deployment.artifact_mirror = url;
+		log::Info("Downloading the artifact from the mirror " + url);
+	}
+
 	auto req = make_shared<http::OutgoingRequest>();
 	req->SetMethod(http::Method::GET);
-	auto err = req->SetAddress(ctx.deployment.state_data->update_info.artifact.source.uri);
+	auto err = req->SetAddress(url);
 	if (err != error::NoError) {
+		if (FallBackFromMirror(ctx, poster, err.String())) {
+			return;
+		}
 		log::Error(err.String());
+		ctx.RecordFailure(err, FailureCategory::Network);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
@@ -405,28 +909,48 @@ void UpdateDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &pos
 		req,
 		[&ctx, &poster](http::ExpectedIncomingResponsePtr exp_resp) {
 			if (!exp_resp) {
+				if (FallBackFromMirror(ctx, poster, exp_resp.error().String())) {
+					return;
+				}
 				log::Error("Unexpected error during download: " + exp_resp.error().String());
+				ctx.RecordFailure(exp_resp.error(), FailureCategory::Network);
 				poster.PostEvent(StateEvent::Failure);
 				return;
 			}
 
 			auto &resp = exp_resp.value();
 			if (resp->GetStatusCode() != http::StatusOK) {
+				if (FallBackFromMirror(ctx, poster, resp->GetStatusMessage())) {
+					return;
+				}
 				log::Error(
 					"Unexpected status code while fetching artifact: " + resp->GetStatusMessage());
+				ctx.RecordFailure(FailureCategory::Network);
 				poster.PostEvent(StateEvent::Failure);
 				return;
 			}
 
 			auto http_reader = resp->MakeBodyAsyncReader();
 			if (!http_reader) {
+				if (FallBackFromMirror(ctx, poster, http_reader.error().String())) {
+					return;
+				}
 				log::Error(http_reader.error().String());
+				ctx.RecordFailure(http_reader.error(), FailureCategory::Network);
 				poster.PostEvent(StateEvent::Failure);
 				return;
 			}
-			ctx.deployment.artifact_reader =
-				make_shared<events::io::ReaderFromAsyncReader>(ctx.event_loop, http_reader.value());
-			ParseArtifact(ctx, poster);
+
+			// Without it, the download progress has no percentage.
+			optional<int64_t> artifact_size;
+			auto content_length = resp->GetHeader("Content-Length");
+			if (content_length) {
+				auto exp_size = common::StringTo<int64_t>(content_length.value());
+				if (exp_size) {
+					artifact_size = exp_size.value();
+				}
+			}
+			ReadArtifactFrom(ctx, poster, http_reader.value(), artifact_size);
 		},
 		[](http::ExpectedIncomingResponsePtr exp_resp) {
 			if (!exp_resp) {
@@ -440,12 +964,70 @@ void UpdateDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &pos
 		});
 
 	if (err != error::NoError) {
+		if (FallBackFromMirror(ctx, poster, err.String())) {
+			return;
+		}
 		log::Error(err.String());
+		ctx.RecordFailure(err, FailureCategory::Network);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
 }
 
+// Until the header of the Artifact has been checked, a mirror which doesn't have the Artifact, or
+// has another one, only means trying the next mirror, and eventually the server. Returns false if
+// the Artifact wasn't being downloaded from a mirror.
+bool UpdateDownloadState::FallBackFromMirror(
+	Context &ctx, sm::EventPoster<StateEvent> &poster, const string &reason) {
+	if (ctx.deployment.artifact_mirror == "") {
+		return false;
+	}
+	log::Warning(
+		"Could not download the artifact from the mirror " + ctx.deployment.artifact_mirror
+		+ ": " + reason);
+
+	ctx.download_progress_timer.Cancel();
+	ctx.abort_check_timer.Cancel();
+	ctx.deployment.artifact_parser.reset();
+	ctx.deployment.download_reader.reset();
+	ctx.deployment.artifact_reader.reset();
+	ctx.download_client->Cancel();
+	// Not from within the handlers of the request which is being cancelled.
+	ctx.event_loop.Post([&ctx, &poster]() { DownloadFromNextSource(ctx, poster); });
+	return true;
+}
+
+void UpdateDownloadState::ReadArtifactFrom(
+	Context &ctx,
+	sm::EventPoster<StateEvent> &poster,
+	io::AsyncReaderPtr reader,
+	optional<int64_t> artifact_size) {
+	const auto &rate_limit = ctx.mender_context.GetConfig().download_rate_limit;
+	if (rate_limit.Enabled()) {
+		reader = make_shared<events::io::RateLimitedAsyncReader>(
+			ctx.event_loop, reader, [&rate_limit]() {
+				return rate_limit.BytesPerSecondAt(CurrentMinuteOfDay());
+			});
+	}
+	ctx.deployment.download_reader = make_shared<events::io::AbortableAsyncReader>(reader);
+	if (ctx.deployment.stop_reason != error::NoError) {
+		// The state timed out while the download was being set up.
+		ctx.deployment.download_reader->Abort(ctx.deployment.stop_reason);
+	}
+	ctx.deployment.artifact_reader = make_shared<io::CountingReader>(
+		make_shared<events::io::ReaderFromAsyncReader>(
+			ctx.event_loop, ctx.deployment.download_reader));
+
+	// The first progress update goes to the server after a full interval.
+	auto now = chrono::steady_clock::now();
+	ctx.deployment.progress_sent = now;
+	ctx.metrics.DownloadStarted();
+	ReportDownloadProgress(ctx, artifact_size, now);
+	WatchForAbort(ctx, deployments::DeploymentStatus::Downloading);
+
+	ParseArtifact(ctx, poster);
+}
+
 void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	string art_scripts_path = ctx.mender_context.GetConfig().paths.GetArtScriptsPath();
 
@@ -453,6 +1035,14 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 	auto err = path::DeleteRecursively(art_scripts_path);
 	if (err != error::NoError) {
 		log::Error("When preparing to parse artifact: " + err.String());
+		ctx.RecordFailure(err, FailureCategory::Storage);
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
+
+	auto exp_verify_keys = ctx.mender_context.GetConfig().GetArtifactVerifyKeys();
+	if (!exp_verify_keys) {
+		log::Error(exp_verify_keys.error().String());
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
@@ -460,11 +1050,17 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 	artifact::config::ParserConfig config {
 		.artifact_scripts_filesystem_path = art_scripts_path,
 		.artifact_scripts_version = 3,
-		.artifact_verify_keys = ctx.mender_context.GetConfig().artifact_verify_keys,
+		.artifact_verify_keys = exp_verify_keys.value(),
+		.decryption_provider =
+			main_context::ArtifactDecryptionProvider(ctx.mender_context.GetConfig()),
 	};
 	auto exp_parser = artifact::Parse(*ctx.deployment.artifact_reader, config);
 	if (!exp_parser) {
+		if (FallBackFromMirror(ctx, poster, exp_parser.error().String())) {
+			return;
+		}
 		log::Error(exp_parser.error().String());
+		ctx.RecordFailure(exp_parser.error(), FailureCategory::None);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
@@ -472,36 +1068,45 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 
 	auto exp_header = artifact::View(*ctx.deployment.artifact_parser, 0);
 	if (!exp_header) {
+		if (FallBackFromMirror(ctx, poster, exp_header.error().String())) {
+			return;
+		}
 		log::Error(exp_header.error().String());
+		ctx.RecordFailure(exp_header.error(), FailureCategory::None);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
 	auto &header = exp_header.value();
 
-	// A System Device only accepts the orchestrator manifest; any other payload type is rejected.
-	if (ctx.mender_context.GetConfig().device_tier == device_tier::kSystem
-		&& header.header.payload_type
-			   != main_context::MenderContext::orchestrator_manifest_payload_type) {
-		log::Error(
-			"Refusing to install artifact '" + header.header.artifact_name
-			+ "': its payload type is '" + header.header.payload_type
-			+ "', but this is a System Device (DeviceTier=system) which only accepts '"
-			+ main_context::MenderContext::orchestrator_manifest_payload_type + "' artifacts");
-		poster.PostEvent(StateEvent::Failure);
+	const auto &artifact_name = ctx.deployment.state_data->update_info.artifact.artifact_name;
+	if (ctx.deployment.artifact_mirror != "" && header.header.artifact_name != artifact_name) {
+		FallBackFromMirror(
+			ctx,
+			poster,
+			"it has the Artifact '" + header.header.artifact_name + "' instead of '"
+				+ artifact_name + "'");
 		return;
 	}
 
-	auto exp_matches = ctx.mender_context.MatchesArtifactDepends(header.header);
-	if (!exp_matches) {
-		log::Error(exp_matches.error().String());
+	if (!IsArtifactAcceptable(ctx, header)) {
+		ctx.RecordFailure(FailureCategory::Depends);
 		poster.PostEvent(StateEvent::Failure);
 		return;
-	} else if (!exp_matches.value()) {
-		// reasons already logged
-		poster.PostEvent(StateEvent::Failure);
+	}
+	// Can't fail, since the Artifact was accepted.
+	ctx.deployment.eligibility = main_context::ArtifactEligibilityWindow(header.header).value();
+
+	if (ctx.mender_context.GetConfig().simulate_deployments) {
+		SimulateDownload(ctx, poster, header.header);
 		return;
 	}
 
+	err = ctx.header_cache.Store(
+		header.header, ctx.deployment.artifact_parser->manifest.Get("header.tar"));
+	if (err != error::NoError) {
+		log::Warning("Could not update the Artifact header cache: " + err.String());
+	}
+
 	log::Info("Installing artifact...");
 
 	ctx.deployment.state_data->FillUpdateDataFromArtifact(header);
@@ -516,9 +1121,12 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 		log::Error(err.String());
 		if (err.code
 			== main_context::MakeError(main_context::StateDataStoreCountExceededError, "").code) {
+			ctx.download_progress_timer.Cancel();
+			ctx.abort_check_timer.Cancel();
 			poster.PostEvent(StateEvent::StateLoopDetected);
 			return;
 		} else {
+			ctx.RecordFailure(err, FailureCategory::Storage);
 			poster.PostEvent(StateEvent::Failure);
 			return;
 		}
@@ -526,6 +1134,8 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 
 	if (header.header.payload_type == "") {
 		// Empty-payload-artifact, aka "bootstrap artifact".
+		ctx.download_progress_timer.Cancel();
+		ctx.abort_check_timer.Cancel();
 		poster.PostEvent(StateEvent::NothingToDo);
 		return;
 	}
@@ -536,15 +1146,28 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 		log::Error(
 			"Error creating an Update Module when parsing artifact: "
 			+ exp_update_module.error().String());
+		ctx.RecordFailure(exp_update_module.error(), FailureCategory::Module);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
 	ctx.deployment.update_module = std::move(exp_update_module.value());
+	WatchUpdateModuleProgress(ctx);
+
+	// Written into the File Tree when it is prepared.
+	err = ctx.deployment.update_module->SetDeploymentMetadata(
+		MakeDeploymentMetadata(ctx.deployment.state_data->update_info));
+	if (err != error::NoError) {
+		log::Error(err.String());
+		ctx.RecordFailure(err, FailureCategory::Storage);
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
 
 	err = ctx.deployment.update_module->CleanAndPrepareFileTree(
 		ctx.deployment.update_module->GetUpdateModuleWorkDir(), header);
 	if (err != error::NoError) {
 		log::Error(err.String());
+		ctx.RecordFailure(err, FailureCategory::Storage);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
@@ -553,6 +1176,7 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 		ctx.event_loop, [&ctx, &poster](expected::ExpectedBool download_with_sizes) {
 			if (!download_with_sizes.has_value()) {
 				log::Error(download_with_sizes.error().String());
+				ctx.RecordFailure(download_with_sizes.error(), FailureCategory::Module);
 				poster.PostEvent(StateEvent::Failure);
 				return;
 			}
@@ -562,23 +1186,109 @@ void UpdateDownloadState::ParseArtifact(Context &ctx, sm::EventPoster<StateEvent
 
 	if (err != error::NoError) {
 		log::Error(err.String());
+		ctx.RecordFailure(err, FailureCategory::Module);
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
+}
+
+// Reads the rest of the Artifact, which checks its checksums and so its signature, and ends the
+// deployment there, without handing anything to the Update Module or running state scripts.
+void UpdateDownloadState::SimulateDownload(
+	Context &ctx, sm::EventPoster<StateEvent> &poster, const artifact::HeaderView &header) {
+	string module_path;
+	if (header.payload_type != "") {
+		auto exp_update_module =
+			update_module::UpdateModule::Create(ctx.mender_context, header.payload_type);
+		if (exp_update_module) {
+			module_path = exp_update_module.value()->GetUpdateModulePath();
+		}
+		if (!exp_update_module || !path::FileExists(module_path)) {
+			ctx.download_progress_timer.Cancel();
+			ctx.abort_check_timer.Cancel();
+			ctx.deployment.substate =
+				"No Update Module for the payload type '" + header.payload_type + "'";
+			log::Error(ctx.deployment.substate);
+			ctx.RecordFailure(FailureCategory::Module);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+	}
+
+	auto exp_files = main_context::ReadPayloads(*ctx.deployment.artifact_parser);
+	ctx.download_progress_timer.Cancel();
+	ctx.abort_check_timer.Cancel();
+	ctx.deployment.download_reader.reset();
+	ctx.metrics.DownloadFinished(ctx.deployment.artifact_reader->BytesRead());
+
+	if (ctx.deployment.abort_requested) {
+		ctx.deployment.abort_requested = false;
+		log::Error("Deployment aborted during the download");
+		poster.PostEvent(StateEvent::DeploymentAborted);
+		return;
+	}
+	if (!exp_files) {
+		log::Error(exp_files.error().String());
+		ctx.RecordFailure(exp_files.error(), FailureCategory::None);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
+
+	for (const auto &file : exp_files.value()) {
+		log::Info(
+			"Simulated deployment: " + file.name + ", " + to_string(file.size)
+			+ " bytes, checksum verified");
+	}
+	if (module_path != "") {
+		log::Info("Simulated deployment: the payload would be installed by " + module_path);
+	}
+
+	ctx.deployment.simulated = true;
+	ctx.deployment.substate = "Simulated, nothing was installed";
+	log::Info(ctx.deployment.substate);
+	poster.PostEvent(StateEvent::DeploymentSimulated);
 }
 
 void UpdateDownloadState::DoDownload(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	auto exp_payload = ctx.deployment.artifact_parser->Next();
 	if (!exp_payload) {
 		log::Error(exp_payload.error().String());
+		ctx.RecordFailure(exp_payload.error(), FailureCategory::None);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
 	ctx.deployment.artifact_payload.reset(new artifact::Payload(std::move(exp_payload.value())));
 
 	auto handler = [&poster, &ctx](error::Error err) {
+		ctx.download_progress_timer.Cancel();
+		ctx.abort_check_timer.Cancel();
+		ctx.deployment.download_reader.reset();
+		ctx.metrics.DownloadFinished(ctx.deployment.artifact_reader->BytesRead());
+
+		if (ctx.deployment.abort_requested) {
+			// Whatever the download ended with, the deployment won't go on.
+			ctx.deployment.abort_requested = false;
+			log::Error("Deployment aborted during the download");
+			poster.PostEvent(StateEvent::DeploymentAborted);
+			return;
+		}
+
 		if (err != error::NoError) {
-			log::Error(err.String());
+			if (err.code == sha::MakeError(sha::ShasumMismatchError, "").code) {
+				http_resumer::DownloadAttemptFailure failure {
+					.cause = http_resumer::DownloadFailureCause::ChecksumMismatch,
+					.offset = ctx.deployment.artifact_reader->BytesRead(),
+					.error = err,
+				};
+				log::Error(
+					"Download failed (checksum-mismatch) at offset " + to_string(failure.offset)
+					+ ": " + err.String());
+				ctx.CountDownloadFailure(failure);
+			} else {
+				log::Error(err.String());
+			}
+			// The Update Module reads the payload from the download, so its errors get here too.
+			ctx.RecordFailure(err, FailureCategory::Module);
 			poster.PostEvent(StateEvent::Failure);
 			return;
 		}
@@ -592,6 +1302,7 @@ void UpdateDownloadState::DoDownload(Context &ctx, sm::EventPoster<StateEvent> &
 			exp_payload.error().code
 			!= artifact::parser_error::MakeError(artifact::parser_error::EOFError, "").code) {
 			log::Error(exp_payload.error().String());
+			ctx.RecordFailure(exp_payload.error(), FailureCategory::None);
 			poster.PostEvent(StateEvent::Failure);
 			return;
 		}
@@ -610,7 +1321,14 @@ void UpdateDownloadState::DoDownload(Context &ctx, sm::EventPoster<StateEvent> &
 
 void UpdateDownloadCancelState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	log::Debug("Entering DownloadCancel state");
+	ctx.download_progress_timer.Cancel();
+	ctx.abort_check_timer.Cancel();
+	ctx.deployment.download_reader.reset();
+	if (ctx.deployment.artifact_reader) {
+		ctx.metrics.DownloadFinished(ctx.deployment.artifact_reader->BytesRead());
+	}
 	ctx.download_client->Cancel();
+	ctx.chunked_download.Cancel();
 	poster.PostEvent(StateEvent::Success);
 }
 
@@ -627,13 +1345,27 @@ SendStatusUpdateState::SendStatusUpdateState(
 	status_(status),
 	mode_(FailureMode::RetryThenFail),
 	retry_(Retry {
+		http::ExponentialBackoff(chrono::seconds(retry_interval_seconds), retry_count),
 		http::ExponentialBackoff(chrono::seconds(retry_interval_seconds), retry_count),
 		event_loop}) {
 }
 
+void SendStatusUpdateState::SetRetryPolicy(const cfg_parser::RetryPolicy &policy) {
+	if (retry_) {
+		ApplyRetryPolicy(retry_->backoff, policy);
+	}
+}
+
+void SendStatusUpdateState::SetLogUploadRetryPolicy(const cfg_parser::RetryPolicy &policy) {
+	if (retry_) {
+		ApplyRetryPolicy(retry_->logs_backoff, policy);
+	}
+}
+
 void SendStatusUpdateState::SetSmallestWaitInterval(chrono::milliseconds interval) {
 	if (retry_) {
 		retry_->backoff.SetSmallestInterval(interval);
+		retry_->logs_backoff.SetSmallestInterval(interval);
 	}
 }
 
@@ -641,20 +1373,202 @@ void SendStatusUpdateState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &p
 	// Reset this every time we enter the state, which means a new round of retries.
 	if (retry_) {
 		retry_->backoff.Reset();
+		retry_->logs_backoff.Reset();
 	}
+	status_emitted_ = false;
 
-	DoStatusUpdate(ctx, poster);
+	// Status updates never overlap, so wait for a deferred one which may be on its way.
+	ctx.status_update_limiter.AsyncWaitTurn(
+		[this, &ctx, &poster]() { DoStatusUpdate(ctx, poster); });
 }
 
-void SendStatusUpdateState::DoStatusUpdate(Context &ctx, sm::EventPoster<StateEvent> &poster) {
-	assert(ctx.deployment_client);
-	assert(ctx.deployment.state_data);
+// Sends the status later, see StatusUpdateLimiter. Intermediate statuses are only informative, so
+// failing to send one is only logged. If the server has aborted the deployment, the next status
+// update acts on it.
+static void DeferStatusUpdate(
+	Context &ctx,
+	deployments::DeploymentStatus status,
+	const string &substate,
+	const optional<deployments::DownloadProgress> &progress = nullopt) {
+	auto id = ctx.deployment.state_data->update_info.id;
+	ctx.status_update_limiter.Defer([&ctx, id, status, substate, progress](function<void()> done) {
+		log::Info("Sending deferred status update to server");
+		auto err = ctx.deployment_client->PushStatus(
+			id,
+			status,
+			substate,
+			progress,
+			ctx.http_client,
+			[&ctx, done](deployments::StatusAPIResponse response) {
+				if (response.error != error::NoError) {
+					log::Error(
+						"Could not send deferred deployment status: " + response.error.String());
+					if (response.error.code
+						== deployments::MakeError(deployments::DeploymentAbortedError, "").code) {
+						ctx.RequestDeploymentAbort();
+					}
+				}
+				done();
+			});
+		if (err != error::NoError) {
+			log::Error("Could not send deferred deployment status: " + err.String());
+			done();
+		}
+	});
+}
 
-	log::Info("Sending status update to server");
+// Re-sends the current status whenever no status update has gone to the server for
+// `DeploymentAbortCheckIntervalSeconds`, since the server only tells about an abort in the response
+// to one. Cancelled together with the state it watches.
+static void WatchForAbort(Context &ctx, deployments::DeploymentStatus status) {
+	chrono::seconds interval {
+		ctx.mender_context.GetConfig().deployment_abort_check_interval_seconds};
+	if (interval == chrono::seconds::zero()) {
+		return;
+	}
 
-	auto result_handler = [this, &ctx, &poster](deployments::APIResponseError error) {
-		this->DoStatusUpdateHandler(ctx, poster, error);
-	};
+	auto wait = interval;
+	if (ctx.deployment.progress_sent) {
+		auto since = chrono::duration_cast<chrono::seconds>(
+			chrono::steady_clock::now() - ctx.deployment.progress_sent.value());
+		wait = max(interval - since, chrono::seconds {1});
+	}
+	ctx.abort_check_timer.AsyncWait(wait, [&ctx, status, interval](error::Error err) {
+		if (err != error::NoError) {
+			// Cancelled.
+			return;
+		}
+		if (!ctx.deployment.state_data) {
+			return;
+		}
+
+		auto now = chrono::steady_clock::now();
+		if (!ctx.deployment.progress_sent
+			|| now - ctx.deployment.progress_sent.value() >= interval) {
+			log::Debug("Checking whether the deployment has been aborted");
+			ctx.deployment.progress_sent = now;
+			DeferStatusUpdate(ctx, status, ctx.deployment.substate);
+		}
+		WatchForAbort(ctx, status);
+	});
+}
+
+void WatchUpdateModuleProgress(Context &ctx) {
+	ctx.deployment.update_module->SetProgressHandler(
+		[&ctx](update_module::State state, const update_module::ModuleProgress &progress) {
+			string line = to_string(progress.percentage);
+			string substate = line + "%";
+			if (progress.description != "") {
+				line += " " + progress.description;
+				substate += " " + progress.description;
+			}
+			ctx.deployment.module_progress = line;
+
+			if (ctx.emit_module_progress) {
+				auto err = ctx.emit_module_progress(update_module::StateToString(state), line);
+				if (err != error::NoError) {
+					log::Warning("Could not announce the Update Module progress: " + err.String());
+				}
+			}
+
+			// Only the states which have a status of their own. The other ones are either over
+			// quickly, or followed by the final status.
+			deployments::DeploymentStatus status;
+			switch (state) {
+			case update_module::State::Download:
+			case update_module::State::DownloadWithFileSizes:
+				status = deployments::DeploymentStatus::Downloading;
+				break;
+			case update_module::State::ArtifactInstall:
+				status = deployments::DeploymentStatus::Installing;
+				break;
+			default:
+				return;
+			}
+
+			chrono::seconds interval {
+				ctx.mender_context.GetConfig().module_progress_interval_seconds};
+			auto now = chrono::steady_clock::now();
+			if (interval == chrono::seconds::zero() || !ctx.deployment.state_data
+				|| (ctx.deployment.progress_sent
+					&& now - ctx.deployment.progress_sent.value() < interval)) {
+				return;
+			}
+			ctx.deployment.progress_sent = now;
+
+			// Goes through the rate limit like the other intermediate statuses, and is dropped
+			// if the next status comes first.
+			DeferStatusUpdate(ctx, status, substate);
+		});
+}
+
+void UpdateDownloadState::ReportDownloadProgress(
+	Context &ctx, optional<int64_t> artifact_size, chrono::steady_clock::time_point started) {
+	ctx.download_progress_timer.AsyncWait(
+		kDownloadProgressCheckInterval, [&ctx, artifact_size, started](error::Error err) {
+			if (err != error::NoError) {
+				// Cancelled.
+				return;
+			}
+
+			auto now = chrono::steady_clock::now();
+			auto elapsed = chrono::duration_cast<chrono::seconds>(now - started);
+			auto progress = deployments::MakeDownloadProgress(
+				ctx.deployment.artifact_reader->BytesRead(), artifact_size, elapsed);
+			ctx.metrics.DownloadProgress(ctx.deployment.artifact_reader->BytesRead(), elapsed);
+
+			if (ctx.emit_download_progress) {
+				err = ctx.emit_download_progress(
+					ctx.deployment.state_data->update_info.id,
+					deployments::DownloadProgressJson(progress));
+				if (err != error::NoError) {
+					log::Warning("Could not announce the download progress: " + err.String());
+				}
+			}
+
+			// Shares the time of the last update with the progress of the Update Module, so that
+			// the two don't add up to more status updates.
+			chrono::seconds interval {
+				ctx.mender_context.GetConfig().download_progress_interval_seconds};
+			if (interval != chrono::seconds::zero()
+				&& (!ctx.deployment.progress_sent
+					|| now - ctx.deployment.progress_sent.value() >= interval)) {
+				ctx.deployment.progress_sent = now;
+				string substate = "Downloaded " + deployments::DownloadProgressString(progress);
+				log::Info(substate);
+				DeferStatusUpdate(
+					ctx, deployments::DeploymentStatus::Downloading, substate, progress);
+			}
+
+			ReportDownloadProgress(ctx, artifact_size, started);
+		});
+}
+
+// The Failure status starts with the category of the failure, for the server to count them by.
+static string StatusSubstate(Context &ctx, deployments::DeploymentStatus status) {
+	if (status != deployments::DeploymentStatus::Failure) {
+		return ctx.deployment.substate;
+	}
+	return FailureSubstate(
+		ctx.deployment.state_data->update_info.failure_category, ctx.deployment.substate);
+}
+
+void SendStatusUpdateState::DoStatusUpdate(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	assert(ctx.deployment_client);
+	assert(ctx.deployment.state_data);
+
+	if (ctx.deployment.abort_requested) {
+		// Treat a local abort the same way as a deployment aborted on the server. The flag is
+		// cleared so that the final failure status is still reported.
+		ctx.deployment.abort_requested = false;
+		if (status_) {
+			log::Error("Deployment aborted locally");
+			poster.PostEvent(StateEvent::DeploymentAborted);
+			return;
+		}
+		// The final status, which must reach the server whatever happened before.
+		log::Info("Ignoring the abort request, the deployment is already finishing");
+	}
 
 	deployments::DeploymentStatus status;
 	if (status_) {
@@ -668,14 +1582,46 @@ void SendStatusUpdateState::DoStatusUpdate(Context &ctx, sm::EventPoster<StateEv
 		}
 	}
 
+	const string substate = StatusSubstate(ctx, status);
+	if (!status_emitted_) {
+		status_emitted_ = true;
+		const auto &update_info = ctx.deployment.state_data->update_info;
+		ctx.telemetry_sinks.Emit({
+			TelemetrySinks::kEventDeploymentStatus,
+			update_info.id,
+			update_info.artifact.artifact_name,
+			DeploymentStatusString(status),
+			substate,
+		});
+	}
+
+	// Only the statuses which don't have to reach the server are subject to the rate limit.
+	if (mode_ == FailureMode::Ignore && !ctx.status_update_limiter.MaySendNow()) {
+		log::Debug(
+			"Deferring the " + DeploymentStatusString(status)
+			+ " status update, the previous one was sent too recently");
+		DeferStatusUpdate(ctx, status, substate);
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+	ctx.status_update_limiter.RecordSent();
+
+	log::Info("Sending status update to server");
+
+	auto result_handler = [this, &ctx, &poster](deployments::APIResponseError error) {
+		this->DoStatusUpdateHandler(ctx, poster, error);
+	};
+
 	// Push status.
 	log::Debug("Pushing deployment status: " + DeploymentStatusString(status));
+	pushing_logs_ = false;
 	auto err = ctx.deployment_client->PushStatus(
 		ctx.deployment.state_data->update_info.id,
 		status,
-		"",
+		substate,
+		nullopt,
 		ctx.http_client,
-		[result_handler, &ctx](deployments::StatusAPIResponse error) {
+		[this, result_handler, &ctx](deployments::StatusAPIResponse error) {
 			// If there is an error, we don't submit logs now, but call the handler,
 			// which may schedule a retry later. If there is no error, and the
 			// deployment as a whole was successful, then also call the handler here,
@@ -686,6 +1632,7 @@ void SendStatusUpdateState::DoStatusUpdate(Context &ctx, sm::EventPoster<StateEv
 			}
 
 			// Push logs.
+			pushing_logs_ = true;
 			auto err = ctx.deployment_client->PushLogs(
 				ctx.deployment.state_data->update_info.id,
 				ctx.deployment.logger->LogFilePath(),
@@ -704,6 +1651,24 @@ void SendStatusUpdateState::DoStatusUpdate(Context &ctx, sm::EventPoster<StateEv
 	// No action, wait for reply from status endpoint.
 }
 
+void SendStatusUpdateState::QueueFinalStatus(Context &ctx) {
+	const bool failed = ctx.deployment.failed;
+	auto status =
+		failed ? deployments::DeploymentStatus::Failure : deployments::DeploymentStatus::Success;
+	// If the logs are what didn't get through, the status has been sent already.
+	auto err = ctx.outbound_queue.Add(
+		ctx.deployment.state_data->update_info.id,
+		status,
+		StatusSubstate(ctx, status),
+		pushing_logs_,
+		failed ? ctx.deployment.logger->LogFilePath() : "");
+	if (err != error::NoError) {
+		log::Error("Could not queue the status update: " + err.String());
+		return;
+	}
+	log::Info("Queued the status update, to be sent once the server can be reached");
+}
+
 void SendStatusUpdateState::DoStatusUpdateHandler(
 	Context &ctx, sm::EventPoster<StateEvent> &poster, deployments::APIResponseError error) {
 	if (error.error != error::NoError) {
@@ -746,11 +1711,15 @@ void SendStatusUpdateState::DoStatusUpdateHandler(
 			}
 
 			if (!retry_after_defined) {
-				auto exp_interval = retry_->backoff.NextInterval();
+				auto &backoff = pushing_logs_ ? retry_->logs_backoff : retry_->backoff;
+				auto exp_interval = backoff.NextInterval();
 				if (!exp_interval) {
 					log::Error(
 						"Giving up on sending status updates to server: "
 						+ exp_interval.error().String());
+					if (!status_) {
+						QueueFinalStatus(ctx);
+					}
 					poster.PostEvent(StateEvent::Failure);
 					return;
 				}
@@ -783,22 +1752,219 @@ void SendStatusUpdateState::DoStatusUpdateHandler(
 	poster.PostEvent(StateEvent::Success);
 }
 
+// How often to check whether the update window has opened.
+static const chrono::seconds kUpdateWindowCheckInterval {60};
+
+// The record is only informative, so failing to write it doesn't hold up the deployment.
+static void RecordPause(
+	Context &ctx, const string &state, const string &reason, const string &source) {
+	auto err = ctx.pause_record.Paused(
+		ctx.deployment.state_data->update_info.id, state, reason, source);
+	if (err != error::NoError) {
+		log::Warning("Could not record the pause of the deployment: " + err.String());
+	}
+}
+
+static void RecordResume(Context &ctx) {
+	auto err = ctx.pause_record.Resumed();
+	if (err != error::NoError) {
+		log::Warning("Could not record the end of the pause of the deployment: " + err.String());
+	}
+}
+
+static bool InsideUpdateWindow(const cfg_parser::UpdateWindow &window) {
+	time_t now = time(nullptr);
+	struct tm now_tm;
+	if (window.local_time) {
+		localtime_r(&now, &now_tm);
+	} else {
+		now += window.utc_offset_minutes * 60;
+		gmtime_r(&now, &now_tm);
+	}
+	return window.Allows(now_tm.tm_wday, now_tm.tm_hour * 60 + now_tm.tm_min);
+}
+
+const string kReplyDeploymentConfirmed {"confirmed"};
+const string kReplyNoSuchDeployment {"no-such-deployment"};
+
+expected::ExpectedString ConfirmDeployment(Context &ctx, const string &deployment_id) {
+	if (!ctx.mender_context.GetConfig().update_window.confirmation) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::operation_not_supported),
+			"Confirmation of the deployments is not enabled in UpdateWindow"));
+	}
+	if (!ctx.deployment.state_data || ctx.deployment.state_data->update_info.id != deployment_id) {
+		return kReplyNoSuchDeployment;
+	}
+	if (!ctx.deployment.confirmed) {
+		log::Info("Deployment " + deployment_id + " confirmed, not waiting for the update window");
+		ctx.deployment.confirmed = true;
+	}
+	return kReplyDeploymentConfirmed;
+}
+
+// Whether `state` still waits for the update window, or for the confirmation of the deployment.
+static bool WaitsForUpdateWindow(Context &ctx, const string &state) {
+	const auto &window = ctx.mender_context.GetConfig().update_window;
+	return window.Restricts(state) && !InsideUpdateWindow(window) && !ctx.deployment.confirmed;
+}
+
+UpdateWindowState::UpdateWindowState(
+	events::EventLoop &event_loop,
+	const string &state,
+	optional<deployments::DeploymentStatus> pause_status,
+	bool eligibility_window) :
+	state_ {state},
+	pause_status_ {pause_status},
+	eligibility_window_ {eligibility_window},
+	timer_ {event_loop} {
+}
+
+bool UpdateWindowState::NotValidYet(Context &ctx) {
+	const auto &not_before = ctx.deployment.eligibility.not_before;
+	return eligibility_window_ && not_before
+		   && chrono::system_clock::now() < not_before.value();
+}
+
+bool UpdateWindowState::NoLongerValid(Context &ctx) {
+	const auto &not_after = ctx.deployment.eligibility.not_after;
+	if (!eligibility_window_ || !not_after || chrono::system_clock::now() <= not_after.value()) {
+		return false;
+	}
+	// Also reported along with the failure status.
+	ctx.deployment.substate = "Refusing to install the Artifact: it was only valid until "
+							  + main_context::FormatEligibilityTime(not_after.value());
+	log::Error(ctx.deployment.substate);
+	return true;
+}
+
+void UpdateWindowState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (NoLongerValid(ctx)) {
+		ctx.RecordFailure(FailureCategory::Depends);
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
+
+	string substate;
+	auto status = pause_status_;
+	const auto &window = ctx.mender_context.GetConfig().update_window;
+	if (ctx.device_freeze.Frozen()) {
+		auto exp_freeze = ctx.device_freeze.Current();
+		substate = exp_freeze && exp_freeze.value()
+					   ? DeviceFreeze::Reason(exp_freeze.value().value())
+					   : "Frozen on the device";
+		log::Info(substate + ", waiting before the " + state_ + " state");
+		RecordPause(ctx, state_, substate, "device freeze");
+		// Also reported before the download, so that the server can tell why the deployment
+		// doesn't start.
+		if (!status) {
+			status = deployments::DeploymentStatus::Downloading;
+		}
+	} else if (NotValidYet(ctx)) {
+		const auto not_before =
+			main_context::FormatEligibilityTime(ctx.deployment.eligibility.not_before.value());
+		log::Info(
+			"The Artifact is not valid before " + not_before + ", waiting for it before the "
+			+ state_ + " state");
+		substate = "Waiting until the Artifact is valid";
+		RecordPause(
+			ctx,
+			state_,
+			"The Artifact is not valid before " + not_before,
+			"eligibility window of the Artifact");
+	} else if (WaitsForUpdateWindow(ctx, state_) && window.ranges.empty()) {
+		log::Info("Waiting for the confirmation of the deployment before the " + state_ + " state");
+		substate = "Waiting for a confirmation";
+		RecordPause(ctx, state_, "Waiting for a confirmation", "UpdateWindow");
+	} else if (WaitsForUpdateWindow(ctx, state_)) {
+		log::Info("Outside of the update window, waiting for it before the " + state_ + " state");
+		substate = window.confirmation ? "Waiting for the update window or a confirmation"
+									   : "Waiting for the update window";
+		RecordPause(ctx, state_, "Outside of the update window", "UpdateWindow");
+	} else {
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+
+	if (status) {
+		DeferStatusUpdate(ctx, status.value(), substate);
+	}
+	WaitForWindow(ctx, poster);
+}
+
+void UpdateWindowState::WaitForWindow(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	timer_.AsyncWait(kUpdateWindowCheckInterval, [this, &ctx, &poster](error::Error err) {
+		if (err.code == make_error_condition(errc::operation_canceled)) {
+			return;
+		} else if (err != error::NoError) {
+			log::Error("Unexpected error in UpdateWindowState wait timer: " + err.String());
+			RecordResume(ctx);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+
+		if (ctx.deployment.abort_requested) {
+			// Cleared so that the final failure status is still reported, as in
+			// SendStatusUpdateState.
+			ctx.deployment.abort_requested = false;
+			log::Error("Deployment aborted while waiting for the update window");
+			RecordResume(ctx);
+			poster.PostEvent(StateEvent::DeploymentAborted);
+			return;
+		}
+
+		if (NoLongerValid(ctx)) {
+			RecordResume(ctx);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+
+		if (!ctx.device_freeze.Frozen() && !NotValidYet(ctx) && !WaitsForUpdateWindow(ctx, state_)) {
+			log::Info("Done waiting, going on with the " + state_ + " state");
+			RecordResume(ctx);
+			poster.PostEvent(StateEvent::Success);
+			return;
+		}
+		WaitForWindow(ctx, poster);
+	});
+}
+
 void UpdateInstallState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	log::Debug("Entering ArtifactInstall state");
 
-	DefaultAsyncErrorHandler(
-		poster,
-		ctx.deployment.update_module->AsyncArtifactInstall(
-			ctx.event_loop, DefaultStateHandler {poster}));
+	ctx.user_notifier.Notify(
+		"Installing an update",
+		"A software update is being installed. Please don't turn off the device.");
+
+	WatchForAbort(ctx, deployments::DeploymentStatus::Installing);
+	auto err = ctx.deployment.update_module->AsyncArtifactInstall(
+		ctx.event_loop, [&ctx, &poster](error::Error install_err) {
+			ctx.abort_check_timer.Cancel();
+			if (ctx.deployment.abort_requested) {
+				// The Update Module is left to finish, since stopping it halfway could leave
+				// the device in a worse state than the rollback does.
+				ctx.deployment.abort_requested = false;
+				log::Error("Deployment aborted during the installation");
+				poster.PostEvent(StateEvent::DeploymentAborted);
+				return;
+			}
+			DefaultStateHandler {ctx, poster}(install_err);
+		});
+	if (err != error::NoError) {
+		ctx.abort_check_timer.Cancel();
+	}
+	DefaultAsyncErrorHandler(ctx, poster, err);
 }
 
 void UpdateCheckRebootState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	DefaultAsyncErrorHandler(
+		ctx,
 		poster,
 		ctx.deployment.update_module->AsyncNeedsReboot(
 			ctx.event_loop, [&ctx, &poster](update_module::ExpectedRebootAction reboot_action) {
 				if (!reboot_action.has_value()) {
 					log::Error(reboot_action.error().String());
+					ctx.RecordFailure(reboot_action.error(), FailureCategory::Module);
 					poster.PostEvent(StateEvent::Failure);
 					return;
 				}
@@ -827,25 +1993,51 @@ void UpdateRebootState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poste
 	// Should always be true because we check it at load time.
 	assert(exp_reboot_mode);
 
-	switch (exp_reboot_mode.value()) {
-	case update_module::RebootAction::No:
+	if (exp_reboot_mode.value() == update_module::RebootAction::No) {
 		// Should not happen because then we don't enter this state.
 		assert(false);
 		poster.PostEvent(StateEvent::Failure);
-		break;
-	case update_module::RebootAction::Yes:
-		DefaultAsyncErrorHandler(
-			poster,
-			ctx.deployment.update_module->AsyncArtifactReboot(
-				ctx.event_loop, DefaultStateHandler {poster}));
-		break;
-	case update_module::RebootAction::Automatic:
-		DefaultAsyncErrorHandler(
-			poster,
-			ctx.deployment.update_module->AsyncSystemReboot(
-				ctx.event_loop, DefaultStateHandler {poster}));
-		break;
+		return;
 	}
+
+	auto reboot_mode = exp_reboot_mode.value();
+	auto reboot = [&ctx, &poster, reboot_mode]() {
+		switch (reboot_mode) {
+		case update_module::RebootAction::No:
+			// Handled above.
+			break;
+		case update_module::RebootAction::Yes:
+			DefaultAsyncErrorHandler(
+				ctx,
+				poster,
+				ctx.deployment.update_module->AsyncArtifactReboot(
+					ctx.event_loop, DefaultStateHandler {ctx, poster}));
+			break;
+		case update_module::RebootAction::Automatic:
+			DefaultAsyncErrorHandler(
+				ctx,
+				poster,
+				ctx.deployment.update_module->AsyncSystemReboot(
+					ctx.event_loop, DefaultStateHandler {ctx, poster}));
+			break;
+		}
+	};
+	const bool grace = ctx.reboot_grace.Enabled();
+	if (grace) {
+		RecordPause(
+			ctx,
+			"ArtifactReboot",
+			"Reboot grace period of "
+				+ to_string(ctx.mender_context.GetConfig().reboot_grace_seconds) + " seconds",
+			"RebootGraceSeconds");
+	}
+	ctx.reboot_grace.AsyncWait(ctx.deployment.state_data->update_info.id, [&ctx, reboot, grace]() {
+		if (grace) {
+			RecordResume(ctx);
+		}
+		ctx.user_notifier.AsyncWarnBeforeReboot(
+			"The device will reboot to finish installing the update.", reboot);
+	});
 }
 
 void UpdateVerifyRebootState::OnEnterSaveState(Context &ctx, sm::EventPoster<StateEvent> &poster) {
@@ -855,9 +2047,10 @@ void UpdateVerifyRebootState::OnEnterSaveState(Context &ctx, sm::EventPoster<Sta
 		ctx.deployment.update_module->GetUpdateModuleWorkDir());
 
 	DefaultAsyncErrorHandler(
+		ctx,
 		poster,
 		ctx.deployment.update_module->AsyncArtifactVerifyReboot(
-			ctx.event_loop, DefaultStateHandler {poster}));
+			ctx.event_loop, DefaultStateHandler {ctx, poster}));
 }
 
 void UpdateBeforeCommitState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
@@ -868,6 +2061,67 @@ void UpdateBeforeCommitState::OnEnter(Context &ctx, sm::EventPoster<StateEvent>
 	poster.PostEvent(StateEvent::Success);
 }
 
+void UpdateCommitLeaseState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (!ctx.commit_lease.Enabled()) {
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+
+	log::Debug("Entering ArtifactCommit lease state");
+
+	ctx.commit_lease.AsyncHold([&ctx, &poster](error::Error err) {
+		if (err != error::NoError) {
+			log::Error("Artifact commit lease broken: " + err.String());
+			ctx.RecordFailure(err, FailureCategory::None);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+		poster.PostEvent(StateEvent::Success);
+	});
+}
+
+void UpdateCommitConfirmationState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (!ctx.commit_confirmation.Enabled()) {
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+
+	log::Debug("Entering ArtifactCommit confirmation state");
+
+	ctx.commit_confirmation.AsyncWait([&ctx, &poster](error::Error err) {
+		if (err != error::NoError) {
+			// Also reported along with the failure status.
+			ctx.deployment.substate = "Commit not confirmed: " + err.String();
+			log::Error(ctx.deployment.substate);
+			ctx.RecordFailure(err, FailureCategory::None);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+		poster.PostEvent(StateEvent::Success);
+	});
+}
+
+void UpdateCanaryState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (!ctx.canary_monitor.Enabled()) {
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+
+	log::Debug("Entering canary observation state");
+
+	ctx.canary_monitor.AsyncObserve([&ctx, &poster](error::Error err) {
+		if (err != error::NoError) {
+			// Also reported along with the failure status.
+			ctx.deployment.substate = "Canary observation failed: " + err.String();
+			log::Error(ctx.deployment.substate);
+			ctx.RecordFailure(err, FailureCategory::None);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+		poster.PostEvent(StateEvent::Success);
+	});
+}
+
 void UpdateCommitState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	log::Debug("Entering ArtifactCommit state");
 
@@ -876,14 +2130,55 @@ void UpdateCommitState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poste
 		ctx.mender_context.GetConfig().paths.GetRootfsScriptsPath());
 	if (err != error::NoError) {
 		log::Error("Failed script compatibility check: " + err.String());
+		ctx.RecordFailure(err, FailureCategory::Script);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
 
 	DefaultAsyncErrorHandler(
+		ctx,
 		poster,
 		ctx.deployment.update_module->AsyncArtifactCommit(
-			ctx.event_loop, DefaultStateHandler {poster}));
+			ctx.event_loop, DefaultStateHandler {ctx, poster}));
+}
+
+void UpdateReconcileCommitState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	log::Debug("Entering ArtifactCommit reconciliation state");
+
+	// Without a reboot, the Update Module has nothing the update can be verified against again.
+	const auto &reboot_requested = ctx.deployment.state_data->update_info.reboot_requested;
+	if (reboot_requested.size() != 1
+		|| DbStringToNeedsReboot(reboot_requested[0]).value_or(update_module::RebootAction::No)
+			   == update_module::RebootAction::No) {
+		log::Warning(
+			"The deployment was interrupted during ArtifactCommit. Rolling back, to match the "
+			"Artifact data in the database");
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
+
+	ctx.deployment.update_module->EnsureRootfsImageFileTree(
+		ctx.deployment.update_module->GetUpdateModuleWorkDir());
+
+	DefaultAsyncErrorHandler(
+		ctx,
+		poster,
+		ctx.deployment.update_module->AsyncArtifactVerifyReboot(
+			ctx.event_loop, [&ctx, &poster](error::Error err) {
+				if (err != error::NoError) {
+					log::Warning(
+						"The update no longer verifies after the interrupted ArtifactCommit, "
+						"rolling it back: "
+						+ err.String());
+					ctx.RecordFailure(err, FailureCategory::Module);
+					poster.PostEvent(StateEvent::Failure);
+					return;
+				}
+				log::Info(
+					"The deployment was interrupted during ArtifactCommit, and the update still "
+					"verifies. Committing it again");
+				poster.PostEvent(StateEvent::Success);
+			}));
 }
 
 void UpdateAfterCommitState::OnEnterSaveState(Context &ctx, sm::EventPoster<StateEvent> &poster) {
@@ -895,6 +2190,7 @@ void UpdateAfterCommitState::OnEnterSaveState(Context &ctx, sm::EventPoster<Stat
 		auto err = ctx.SaveDeploymentStateData(state_data);
 		if (err != error::NoError) {
 			log::Error("Not able to commit schema update: " + err.String());
+			ctx.RecordFailure(err, FailureCategory::Storage);
 			poster.PostEvent(StateEvent::Failure);
 			return;
 		}
@@ -903,8 +2199,102 @@ void UpdateAfterCommitState::OnEnterSaveState(Context &ctx, sm::EventPoster<Stat
 	poster.PostEvent(StateEvent::Success);
 }
 
+void UpdatePilotState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (!ctx.pilot_soak.Enabled()) {
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+
+	log::Debug("Entering pilot soak state");
+
+	const auto &deployment_id = ctx.deployment.state_data->update_info.id;
+	chrono::seconds remaining {ctx.mender_context.GetConfig().pilot_mode.soak_seconds};
+	auto exp_remaining = ctx.pilot_soak.Remaining(deployment_id);
+	if (exp_remaining) {
+		remaining = exp_remaining.value();
+	} else {
+		// Then a restart starts the soak period over, which is better than not soaking at all.
+		log::Warning(
+			"Could not store the start of the soak period: " + exp_remaining.error().String());
+	}
+
+	// The deployment stays in progress on the server until the soak period is over.
+	ctx.deployment.substate =
+		"Pilot mode: soaking for " + to_string(remaining.count()) + " more seconds";
+	auto err = ctx.deployment_client->PushStatus(
+		deployment_id,
+		deployments::DeploymentStatus::Installing,
+		ctx.deployment.substate,
+		nullopt,
+		ctx.http_client,
+		[](deployments::StatusAPIResponse response) {
+			if (response.error != error::NoError) {
+				log::Warning("Could not report the soak period: " + response.error.String());
+			}
+		});
+	if (err != error::NoError) {
+		log::Warning("Could not report the soak period: " + err.String());
+	}
+
+	ctx.pilot_soak.AsyncSoak(remaining, [&ctx, &poster](error::Error err) {
+		if (err != error::NoError) {
+			// Also reported along with the failure status.
+			ctx.deployment.substate = "Pilot mode: reverted after the soak failed: " + err.String();
+			log::Error(ctx.deployment.substate);
+			ctx.RecordFailure(err, FailureCategory::None);
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+
+		err = ctx.pilot_soak.Finish();
+		if (err != error::NoError) {
+			log::Warning("Could not remove the start of the soak period: " + err.String());
+		}
+		ctx.deployment.substate = "Pilot mode: healthy for the whole soak period";
+		poster.PostEvent(StateEvent::Success);
+	});
+}
+
+void UpdatePilotRevertState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	log::Debug("Entering pilot revert state");
+	poster.PostEvent(StateEvent::RollbackStarted);
+
+	// If the RevertCommand reboots the device, the deployment is picked up again as a failed one
+	// which was rolled back.
+	auto &state_data = *ctx.deployment.state_data;
+	state_data.update_info.all_rollbacks_successful = true;
+	state_data.state = Context::kUpdateStateArtifactFailure;
+	auto err = ctx.SaveDeploymentStateData(state_data);
+	if (err != error::NoError) {
+		log::Error("Could not save the state before reverting the update: " + err.String());
+		state_data.update_info.all_rollbacks_successful = false;
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
+
+	ctx.user_notifier.Notify(
+		"Reverting an update",
+		"The update failed its health checks. The device goes back to the previous software.");
+
+	ctx.pilot_soak.AsyncRevert([&ctx, &poster](error::Error err) {
+		auto finish_err = ctx.pilot_soak.Finish();
+		if (finish_err != error::NoError) {
+			log::Warning("Could not remove the start of the soak period: " + finish_err.String());
+		}
+
+		if (err != error::NoError) {
+			log::Error("Could not go back to the previous software: " + err.String());
+			ctx.deployment.state_data->update_info.all_rollbacks_successful = false;
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+		poster.PostEvent(StateEvent::Success);
+	});
+}
+
 void UpdateCheckRollbackState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	DefaultAsyncErrorHandler(
+		ctx,
 		poster,
 		ctx.deployment.update_module->AsyncSupportsRollback(
 			ctx.event_loop, [&ctx, &poster](expected::ExpectedBool rollback_supported) {
@@ -929,9 +2319,10 @@ void UpdateRollbackState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &pos
 	log::Debug("Entering ArtifactRollback state");
 
 	DefaultAsyncErrorHandler(
+		ctx,
 		poster,
 		ctx.deployment.update_module->AsyncArtifactRollback(
-			ctx.event_loop, DefaultStateHandler {poster}));
+			ctx.event_loop, DefaultStateHandler {ctx, poster}));
 }
 
 void UpdateRollbackRebootState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
@@ -942,6 +2333,10 @@ void UpdateRollbackRebootState::OnEnter(Context &ctx, sm::EventPoster<StateEvent
 	// Should always be true because we check it at load time.
 	assert(exp_reboot_mode);
 
+	ctx.user_notifier.Notify(
+		"Rolling back an update",
+		"The update failed. The device will reboot to go back to the previous software.");
+
 	// We ignore errors in this state as long as the ArtifactVerifyRollbackReboot state
 	// succeeds.
 	auto handler = [&poster](error::Error err) {
@@ -966,7 +2361,8 @@ void UpdateRollbackRebootState::OnEnter(Context &ctx, sm::EventPoster<StateEvent
 		break;
 
 	case update_module::RebootAction::Automatic:
-		err = ctx.deployment.update_module->AsyncSystemReboot(ctx.event_loop, handler);
+		err = ctx.deployment.update_module->AsyncSystemReboot(
+			ctx.event_loop, handler, update_module::SystemRebootKind::Rollback);
 		break;
 	}
 
@@ -1006,9 +2402,10 @@ void UpdateFailureState::OnEnterSaveState(Context &ctx, sm::EventPoster<StateEve
 	log::Debug("Entering ArtifactFailure state");
 
 	DefaultAsyncErrorHandler(
+		ctx,
 		poster,
 		ctx.deployment.update_module->AsyncArtifactFailure(
-			ctx.event_loop, DefaultStateHandler {poster}));
+			ctx.event_loop, DefaultStateHandler {ctx, poster}));
 }
 
 static string AddInconsistentSuffix(const string &str) {
@@ -1068,6 +2465,7 @@ void UpdateSaveProvidesState::OnEnter(Context &ctx, sm::EventPoster<StateEvent>
 			poster.PostEvent(StateEvent::StateLoopDetected);
 			return;
 		}
+		ctx.RecordFailure(err, FailureCategory::Storage);
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
@@ -1086,9 +2484,19 @@ void UpdateCleanupState::OnEnterSaveState(Context &ctx, sm::EventPoster<StateEve
 		return;
 	}
 
+	if (!ctx.deployment.failed) {
+		// Nothing left to resume.
+		auto err = ctx.deployment.update_module->DeleteCheckpoints();
+		if (err != error::NoError) {
+			log::Warning(err.String());
+		}
+	}
+
 	DefaultAsyncErrorHandler(
+		ctx,
 		poster,
-		ctx.deployment.update_module->AsyncCleanup(ctx.event_loop, DefaultStateHandler {poster}));
+		ctx.deployment.update_module->AsyncCleanup(
+			ctx.event_loop, DefaultStateHandler {ctx, poster}));
 }
 
 void ClearArtifactDataState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
@@ -1109,6 +2517,156 @@ void ClearArtifactDataState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &
 	poster.PostEvent(StateEvent::Success);
 }
 
+// Removes the given file or directory tree, and adds its size to `removed_bytes`.
+static void RemoveAndCount(const fs::path &file_path, uintmax_t &removed_bytes) {
+	error_code ec;
+	uintmax_t size = 0;
+	if (fs::is_directory(file_path, ec)) {
+		for (auto it = fs::recursive_directory_iterator(file_path, ec);
+			 !ec && it != fs::recursive_directory_iterator();
+			 it.increment(ec)) {
+			if (it->is_regular_file(ec)) {
+				size += it->file_size(ec);
+			}
+		}
+	} else if (fs::is_regular_file(file_path, ec)) {
+		size = fs::file_size(file_path, ec);
+	}
+
+	fs::remove_all(file_path, ec);
+	if (ec) {
+		log::Warning(
+			"Post-commit cleanup: Could not remove " + file_path.string() + ": " + ec.message());
+		return;
+	}
+	log::Debug("Post-commit cleanup: Removed " + file_path.string());
+	removed_bytes += size;
+}
+
+void PostCommitCleanupState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	const auto &config = ctx.mender_context.GetConfig();
+	const auto &cleanup = config.post_commit_cleanup;
+
+	if (!ctx.deployment.state_data || ctx.deployment.failed || ctx.deployment.simulated
+		|| (!cleanup.remove_cached_artifacts && !cleanup.prune_deployment_logs
+			&& cleanup.fstrim.empty() && cleanup.hooks.empty())) {
+		poster.PostEvent(StateEvent::Success);
+		return;
+	}
+
+	log::Info("Running post-commit cleanup");
+
+	error_code ec;
+	auto space = fs::space(config.paths.GetDataStore(), ec);
+	if (!ec) {
+		available_before_ = space.available;
+	} else {
+		available_before_.reset();
+	}
+	removed_bytes_ = 0;
+
+	RemoveFiles(ctx);
+
+	commands_.clear();
+	for (const auto &mount_point : cleanup.fstrim) {
+		commands_.push_back({"fstrim", "-v", mount_point});
+	}
+	for (const auto &hook : cleanup.hooks) {
+		commands_.push_back({"/bin/sh", "-c", hook});
+	}
+	next_command_ = 0;
+
+	RunNextCommand(ctx, poster);
+}
+
+void PostCommitCleanupState::RemoveFiles(Context &ctx) {
+	const auto &config = ctx.mender_context.GetConfig();
+	const auto &cleanup = config.post_commit_cleanup;
+	error_code ec;
+
+	if (cleanup.remove_cached_artifacts) {
+		// The Update Module of this deployment has already cleaned up after itself, so anything
+		// left here is from earlier, interrupted deployments.
+		fs::path work_path {config.paths.GetModulesWorkPath()};
+		if (fs::is_directory(work_path, ec)) {
+			vector<fs::path> leftovers;
+			for (auto &entry : fs::directory_iterator(work_path, ec)) {
+				leftovers.push_back(entry.path());
+			}
+			for (const auto &leftover : leftovers) {
+				RemoveAndCount(leftover, removed_bytes_);
+			}
+		}
+		fs::path bootstrap_artifact {config.paths.GetBootstrapArtifactFile()};
+		if (fs::exists(bootstrap_artifact, ec)) {
+			RemoveAndCount(bootstrap_artifact, removed_bytes_);
+		}
+	}
+
+	if (cleanup.prune_deployment_logs) {
+		string current_log = ctx.deployment.logger ? ctx.deployment.logger->LogFileName() : "";
+		fs::path log_path {config.paths.GetUpdateLogPath()};
+		if (fs::is_directory(log_path, ec)) {
+			vector<fs::path> old_logs;
+			for (auto &entry : fs::directory_iterator(log_path, ec)) {
+				auto file_name = entry.path().filename().string();
+				auto extension = entry.path().extension();
+				// Rotated and compressed logs end with ".log.1" and ".log.gz".
+				if (file_name != current_log && file_name != current_log + ".1"
+					&& file_name.find("deployments.") == 0
+					&& (extension == ".log" || extension == ".1" || extension == ".gz")) {
+					old_logs.push_back(entry.path());
+				}
+			}
+			for (const auto &old_log : old_logs) {
+				RemoveAndCount(old_log, removed_bytes_);
+			}
+		}
+	}
+}
+
+void PostCommitCleanupState::RunNextCommand(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (next_command_ >= commands_.size()) {
+		Finish(ctx, poster);
+		return;
+	}
+
+	const auto &command = commands_[next_command_++];
+	const string command_string = common::JoinStrings(command, " ");
+	log::Info("Post-commit cleanup: Running `" + command_string + "`");
+
+	auto err = runner_.AsyncRun(
+		ctx.event_loop,
+		command,
+		chrono::seconds(ctx.mender_context.GetConfig().state_script_timeout_seconds),
+		[this, &ctx, &poster, command_string](error::Error err, const string &first_line) {
+			if (err != error::NoError) {
+				log::Error("Post-commit cleanup: `" + command_string + "` failed: " + err.String());
+			}
+			RunNextCommand(ctx, poster);
+		});
+	if (err != error::NoError) {
+		log::Error("Post-commit cleanup: Could not run `" + command_string + "`: " + err.String());
+		RunNextCommand(ctx, poster);
+	}
+}
+
+void PostCommitCleanupState::Finish(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	runner_.Cancel();
+
+	string reclaimed = "Post-commit cleanup finished, removed " + to_string(removed_bytes_)
+					   + " bytes of files";
+	error_code ec;
+	auto space = fs::space(ctx.mender_context.GetConfig().paths.GetDataStore(), ec);
+	if (!ec && available_before_ && space.available > available_before_.value()) {
+		reclaimed += ", and " + to_string(space.available - available_before_.value())
+					 + " bytes of space were reclaimed on the data partition";
+	}
+	log::Info(reclaimed);
+
+	poster.PostEvent(StateEvent::Success);
+}
+
 void StateLoopState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	assert(ctx.deployment.state_data);
 	auto &artifact = ctx.deployment.state_data->update_info.artifact;
@@ -1132,12 +2690,37 @@ void StateLoopState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster)
 }
 
 void EndOfDeploymentState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	string outcome = "Success";
+	if (ctx.deployment.aborted) {
+		outcome = "Aborted";
+	} else if (ctx.deployment.failed) {
+		outcome = "Failure";
+	} else if (ctx.deployment.simulated) {
+		outcome = "Simulated";
+	}
 	log::Info(
 		"Deployment with ID " + ctx.deployment.state_data->update_info.id
-		+ " finished with status: " + string(ctx.deployment.failed ? "Failure" : "Success"));
+		+ " finished with status: " + outcome);
+
+	ctx.mqtt_bridge.DeploymentFinished(
+		ctx.deployment.state_data->update_info.id,
+		ctx.deployment.state_data->update_info.artifact.artifact_name,
+		!ctx.deployment.failed);
 
 	ctx.FinishDeploymentLogging();
 
+	ctx.metrics.DeploymentFinished(!ctx.deployment.failed);
+	auto err = ctx.deployment_history.Finished(
+		ctx.deployment.state_data->update_info.id, !ctx.deployment.failed);
+	if (err != error::NoError) {
+		log::Warning("Could not record the outcome in the deployment history: " + err.String());
+	}
+
+	err = update_module::RemoveScratchSpace(ctx.mender_context.GetConfig());
+	if (err != error::NoError) {
+		log::Error("Could not clean up after the deployment: " + err.String());
+	}
+
 	ctx.deployment = {};
 	poster.PostEvent(
 		StateEvent::InventoryPollingTriggered); // Submit the inventory right after an update
@@ -1166,11 +2749,57 @@ namespace deployment_tracking {
 void NoFailuresState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	ctx.deployment.failed = false;
 	ctx.deployment.rollback_failed = false;
+	ctx.deployment.aborted = false;
+	ctx.deployment.module_progress = "";
+}
+
+// Where the deployment failed, by the last state saved in the database.
+static string FailureClass(const string &database_state) {
+	if (database_state == "" || database_state == Context::kUpdateStateDownload) {
+		return "download";
+	} else if (database_state == Context::kUpdateStateArtifactInstall) {
+		return "install";
+	} else if (
+		database_state == Context::kUpdateStateArtifactReboot
+		|| database_state == Context::kUpdateStateArtifactVerifyReboot) {
+		return "reboot";
+	} else if (
+		database_state == Context::kUpdateStateArtifactCommit
+		|| database_state == Context::kUpdateStateAfterArtifactCommit) {
+		return "commit";
+	} else {
+		return "other";
+	}
 }
 
 void FailureState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	ctx.deployment.failed = true;
 	ctx.deployment.rollback_failed = true;
+
+	if (ctx.deployment.state_data) {
+		auto err = ctx.deployment_history.Failed(
+			ctx.deployment.state_data->update_info.id,
+			FailureClass(ctx.deployment.state_data->state));
+		if (err != error::NoError) {
+			log::Warning(
+				"Could not record the failure in the deployment history: " + err.String());
+		}
+	}
+}
+
+void AbortedState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	ctx.deployment.failed = true;
+	ctx.deployment.rollback_failed = true;
+	ctx.deployment.aborted = true;
+
+	if (ctx.deployment.state_data) {
+		auto err = ctx.deployment_history.Aborted(
+			ctx.deployment.state_data->update_info.id,
+			FailureClass(ctx.deployment.state_data->state));
+		if (err != error::NoError) {
+			log::Warning("Could not record the abort in the deployment history: " + err.String());
+		}
+	}
 }
 
 void RollbackAttemptedState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
@@ -17,11 +17,13 @@
 
 #include <common/io.hpp>
 #include <common/optional.hpp>
+#include <common/processes.hpp>
 #include <common/state_machine.hpp>
 
 #include <artifact/artifact.hpp>
 
 #include <mender-update/daemon/context.hpp>
+#include <mender-update/daemon/inventory_scheduler.hpp>
 #include <mender-update/daemon/state_events.hpp>
 
 #include <artifact/v3/scripts/executor.hpp>
@@ -38,6 +40,7 @@ namespace daemon {
 using namespace std;
 
 namespace io = mender::common::io;
+namespace procs = mender::common::processes;
 namespace sm = mender::common::state_machine;
 
 namespace artifact = mender::artifact;
@@ -46,6 +49,28 @@ namespace script_executor = ::mender::artifact::scripts::executor;
 
 using StateType = sm::State<Context, StateEvent>;
 
+// Forwards the progress which the Update Module of the deployment reports to the server and to
+// local applications. Call it whenever the Update Module has been created.
+void WatchUpdateModuleProgress(Context &ctx);
+
+// Why the daemon would refuse to install the Artifact, one message for each reason. Empty if it
+// would install it.
+expected::ExpectedStringVector ArtifactRejectionReasons(
+	Context &ctx, const artifact::HeaderView &header);
+
+// Replies to ConfirmDeployment.
+extern const string kReplyDeploymentConfirmed;
+extern const string kReplyNoSuchDeployment;
+
+// Lets the states of the given deployment which wait for the update window go on outside of the
+// windows, see Documentation/update-windows.md. Returns `kReplyNoSuchDeployment` if it isn't the
+// current one, and fails if UpdateWindow doesn't take confirmations.
+expected::ExpectedString ConfirmDeployment(Context &ctx, const string &deployment_id);
+
+// Where the Artifact is looked for on a mirror, see ArtifactMirrors.
+string ArtifactMirrorURL(
+	const string &mirror, const string &device_type, const string &artifact_name);
+
 class EmptyState : virtual public StateType {
 public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
@@ -68,6 +93,11 @@ public:
 
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
 
+	// Used from the next time the poll is scheduled on.
+	void SetInterval(int interval) {
+		interval_ = interval;
+	}
+
 private:
 	events::Timer &timer_;
 	const string poll_action_;
@@ -81,8 +111,12 @@ public:
 
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
 
+	// Overrides the retry interval and count given to the constructor, where the policy sets them.
+	void SetRetryPolicy(const cfg_parser::RetryPolicy &policy);
+
 private:
 	friend class PollForDeploymentStateTests;
+	void CheckNewDeployments(Context &ctx, sm::EventPoster<StateEvent> &poster);
 	void CheckNewDeploymentsHandler(
 		Context &ctx,
 		sm::EventPoster<StateEvent> &poster,
@@ -92,6 +126,8 @@ private:
 		sm::EventPoster<StateEvent> &poster,
 		deployments::CheckUpdatesAPIResponseError error);
 	http::ExponentialBackoff backoff_;
+	// Whether the intervals come from a retry policy, instead of RetryPollIntervalSeconds.
+	bool policy_intervals_ {false};
 };
 
 class SubmitInventoryState : virtual public StateType {
@@ -108,6 +144,20 @@ private:
 	http::ExponentialBackoff backoff_;
 };
 
+// Takes the place of the inventory submission states with InventorySubmission.Independent, and
+// only asks the scheduler to submit the inventory right away.
+class TriggerInventorySubmissionState : virtual public StateType {
+public:
+	TriggerInventorySubmissionState(InventoryScheduler &scheduler) :
+		scheduler_ {scheduler} {
+	}
+
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+
+private:
+	InventoryScheduler &scheduler_;
+};
+
 class SaveState : virtual public StateType {
 public:
 	// Sub states should implement OnEnterSaveState instead, since we do state saving in
@@ -121,6 +171,53 @@ public:
 	virtual bool IsFailureState() const = 0;
 };
 
+// Waits for the Artifact header pre-fetched by PollForDeploymentState, and rejects the deployment
+// if the Artifact cannot be installed, before the download starts.
+class UpdateCheckArtifactHeaderState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
+// Runs the preflight checks before the given stage, and fails, so that the deployment fails
+// before that stage starts, if any of them doesn't pass.
+class UpdatePreflightChecksState : virtual public StateType {
+public:
+	UpdatePreflightChecksState(const string &stage) :
+		stage_ {stage} {
+	}
+
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+
+private:
+	string stage_;
+};
+
+// Waits for the UpdateWindow before `state`, if the window restricts it, and while the device is
+// frozen, and reports `pause_status` to the server while waiting. A freeze is reported before the
+// download too.
+class UpdateWindowState : virtual public StateType {
+public:
+	// With `eligibility_window`, also waits until the Artifact is valid, and fails once it no
+	// longer is, see Documentation/artifact-eligibility-window.md.
+	UpdateWindowState(
+		events::EventLoop &event_loop,
+		const string &state,
+		optional<deployments::DeploymentStatus> pause_status,
+		bool eligibility_window = false);
+
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+
+private:
+	void WaitForWindow(Context &ctx, sm::EventPoster<StateEvent> &poster);
+	bool NotValidYet(Context &ctx);
+	bool NoLongerValid(Context &ctx);
+
+	string state_;
+	optional<deployments::DeploymentStatus> pause_status_;
+	bool eligibility_window_;
+	events::Timer timer_;
+};
+
 class UpdateDownloadState : virtual public StateType {
 public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
@@ -128,8 +225,21 @@ public:
 private:
 	// `static` since they only need the arguments, but are still strongly tied to
 	// OnEnterSaveState.
+	static void DownloadWholeArtifact(Context &ctx, sm::EventPoster<StateEvent> &poster);
+	static void DownloadFromNextSource(Context &ctx, sm::EventPoster<StateEvent> &poster);
+	static bool FallBackFromMirror(
+		Context &ctx, sm::EventPoster<StateEvent> &poster, const string &reason);
+	static void ReadArtifactFrom(
+		Context &ctx,
+		sm::EventPoster<StateEvent> &poster,
+		io::AsyncReaderPtr reader,
+		optional<int64_t> artifact_size);
 	static void ParseArtifact(Context &ctx, sm::EventPoster<StateEvent> &poster);
+	static void SimulateDownload(
+		Context &ctx, sm::EventPoster<StateEvent> &poster, const artifact::HeaderView &header);
 	static void DoDownload(Context &ctx, sm::EventPoster<StateEvent> &poster);
+	static void ReportDownloadProgress(
+		Context &ctx, optional<int64_t> artifact_size, chrono::steady_clock::time_point started);
 };
 
 class UpdateDownloadCancelState : virtual public StateType {
@@ -149,6 +259,11 @@ public:
 		int retry_count);
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
 
+	// Override the retry interval and count given to the constructor, where the policy sets them.
+	// Retries after failing to upload the logs of a failed deployment use the second one.
+	void SetRetryPolicy(const cfg_parser::RetryPolicy &policy);
+	void SetLogUploadRetryPolicy(const cfg_parser::RetryPolicy &policy);
+
 	// For tests.
 	void SetSmallestWaitInterval(chrono::milliseconds interval);
 
@@ -157,6 +272,9 @@ private:
 	void DoStatusUpdate(Context &ctx, sm::EventPoster<StateEvent> &poster);
 	void DoStatusUpdateHandler(
 		Context &ctx, sm::EventPoster<StateEvent> &poster, deployments::APIResponseError error);
+	// Keeps the final status, and the logs of a failed deployment, in the outbound queue, once
+	// the retries are used up.
+	void QueueFinalStatus(Context &ctx);
 
 	enum class FailureMode {
 		Ignore,
@@ -165,8 +283,14 @@ private:
 
 	optional<deployments::DeploymentStatus> status_;
 	FailureMode mode_;
+	// Whether the status has been forwarded to the telemetry sinks, which is only done once per
+	// entry, not for every retry.
+	bool status_emitted_ {false};
+	// Whether the last failure was in uploading the logs, rather than the status.
+	bool pushing_logs_ {false};
 	struct Retry {
 		http::ExponentialBackoff backoff;
+		http::ExponentialBackoff logs_backoff;
 		events::Timer wait_timer;
 	};
 	optional<Retry> retry_;
@@ -203,11 +327,39 @@ public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
 };
 
+// Waits for the applications in ArtifactCommitLeaseApplications to stay healthy for the whole
+// lease, and fails, so that the update is rolled back, if one of them stops confirming.
+class UpdateCommitLeaseState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
+// Waits for an application to confirm the commit, with CommitRequiresConfirmation, and fails, so
+// that the update is rolled back, if none does in time.
+class UpdateCommitConfirmationState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
+// Runs the health checks of CanaryMode during the observation window, and fails, so that the
+// update is rolled back, if one of them fails.
+class UpdateCanaryState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
 class UpdateCommitState : virtual public StateType {
 public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
 };
 
+// Decides how a deployment which was interrupted during ArtifactCommit goes on, since the Update
+// Module may or may not have finished its commit. See `LoadStateFromDb` for the precedence.
+class UpdateReconcileCommitState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
 class UpdateAfterCommitState : virtual public SaveState {
 public:
 	void OnEnterSaveState(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
@@ -219,6 +371,20 @@ public:
 	}
 };
 
+// Runs the health checks of PilotMode during the soak period after the commit, and fails if one of
+// them fails, for UpdatePilotRevertState to go back to the previous software.
+class UpdatePilotState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
+// Takes the place of the rollback for an update which failed during the soak period, since the
+// Update Module can't roll back a committed update.
+class UpdatePilotRevertState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
 class UpdateCheckRollbackState : virtual public StateType {
 public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
@@ -284,6 +450,24 @@ public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
 };
 
+// Runs the configured `PostCommitCleanup` steps after a successful deployment. Errors are logged,
+// but never fail the deployment, which has already been committed at this point.
+class PostCommitCleanupState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+
+private:
+	void RemoveFiles(Context &ctx);
+	void RunNextCommand(Context &ctx, sm::EventPoster<StateEvent> &poster);
+	void Finish(Context &ctx, sm::EventPoster<StateEvent> &poster);
+
+	vector<vector<string>> commands_;
+	size_t next_command_ {0};
+	procs::ScriptRunner runner_ {"Post-commit cleanup output"};
+	uintmax_t removed_bytes_ {0};
+	optional<uintmax_t> available_before_;
+};
+
 class StateLoopState : virtual public StateType {
 public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
@@ -415,6 +599,12 @@ public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
 };
 
+// Like FailureState, when the deployment fails because it was aborted.
+class AbortedState : virtual public StateType {
+public:
+	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
+};
+
 class RollbackAttemptedState : virtual public StateType {
 public:
 	void OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) override;
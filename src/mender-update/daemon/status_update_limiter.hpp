@@ -0,0 +1,72 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_STATUS_UPDATE_LIMITER_HPP
+#define MENDER_UPDATE_DAEMON_STATUS_UPDATE_LIMITER_HPP
+
+#include <chrono>
+#include <functional>
+
+#include <common/events.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace events = mender::common::events;
+
+// Limits how often intermediate deployment statuses are sent to the server. An update which comes
+// too soon after the previous one is deferred until the interval has passed, and is dropped if
+// another one comes before that, since only the latest status matters. Updates are never sent at
+// the same time, so a deferred one which is on its way holds up the next one.
+class StatusUpdateLimiter {
+public:
+	// Sends a deferred update, and calls `done` when it has finished, successfully or not.
+	using PushFunction = function<void(function<void()> done)>;
+
+	StatusUpdateLimiter(events::EventLoop &loop, chrono::milliseconds min_interval);
+
+	// Calls `handler` as soon as no deferred update is on its way. A deferred update which hasn't
+	// been sent yet is dropped, since the caller has a newer one.
+	void AsyncWaitTurn(function<void()> handler);
+
+	// Whether an update can be sent now without going over the rate.
+	bool MaySendNow() const;
+	// Records that an update is being sent now.
+	void RecordSent();
+
+	// Sends the update with `push` once the interval has passed, unless another update comes
+	// first.
+	void Defer(PushFunction push);
+
+private:
+	void SendDeferred();
+
+	events::Timer timer_;
+	chrono::milliseconds min_interval_;
+
+	bool sent_any_ {false};
+	chrono::steady_clock::time_point last_sent_;
+	PushFunction deferred_;
+	bool in_flight_ {false};
+	function<void()> turn_handler_;
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_STATUS_UPDATE_LIMITER_HPP
@@ -0,0 +1,86 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/status_update_limiter.hpp>
+
+#include <common/error.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace error = mender::common::error;
+namespace log = mender::common::log;
+
+StatusUpdateLimiter::StatusUpdateLimiter(
+	events::EventLoop &loop, chrono::milliseconds min_interval) :
+	timer_ {loop},
+	min_interval_ {min_interval} {
+}
+
+void StatusUpdateLimiter::AsyncWaitTurn(function<void()> handler) {
+	if (deferred_) {
+		log::Debug("Dropping the deferred status update, a newer one is coming");
+		deferred_ = nullptr;
+		timer_.Cancel();
+	}
+
+	if (in_flight_) {
+		turn_handler_ = handler;
+		return;
+	}
+	handler();
+}
+
+bool StatusUpdateLimiter::MaySendNow() const {
+	return !sent_any_ || chrono::steady_clock::now() - last_sent_ >= min_interval_;
+}
+
+void StatusUpdateLimiter::RecordSent() {
+	sent_any_ = true;
+	last_sent_ = chrono::steady_clock::now();
+}
+
+void StatusUpdateLimiter::Defer(PushFunction push) {
+	deferred_ = push;
+	auto remaining = chrono::duration_cast<chrono::milliseconds>(
+		last_sent_ + min_interval_ - chrono::steady_clock::now());
+	timer_.AsyncWait(remaining, [this](error::Error err) {
+		if (err != error::NoError || !deferred_) {
+			// Cancelled, because a newer update came along.
+			return;
+		}
+		SendDeferred();
+	});
+}
+
+void StatusUpdateLimiter::SendDeferred() {
+	auto push = deferred_;
+	deferred_ = nullptr;
+	in_flight_ = true;
+	RecordSent();
+	push([this]() {
+		in_flight_ = false;
+		if (turn_handler_) {
+			auto handler = turn_handler_;
+			turn_handler_ = nullptr;
+			handler();
+		}
+	});
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
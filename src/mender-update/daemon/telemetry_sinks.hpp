@@ -0,0 +1,107 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_TELEMETRY_SINKS_HPP
+#define MENDER_UPDATE_DAEMON_TELEMETRY_SINKS_HPP
+
+#include <cstdint>
+#include <deque>
+#include <memory>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/http.hpp>
+#include <common/processes.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace http = mender::common::http;
+namespace procs = mender::common::processes;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// Forwards deployment events to the sinks in TelemetrySinks, external executables and webhooks,
+// see Documentation/telemetry-sinks.md.
+//
+// Events are delivered one at a time, in order. Delivery is best effort: failures are only logged,
+// and never hold up the deployment.
+class TelemetrySinks {
+public:
+	struct Event {
+		string type;
+		string deployment_id;
+		string artifact_name;
+		string status;
+		string substate;
+	};
+
+	static const string kEventDeploymentStatus;
+
+	// How many events may wait for delivery, after which the oldest ones are dropped.
+	static const size_t kMaxQueuedEvents;
+
+	TelemetrySinks(
+		events::EventLoop &loop,
+		const vector<cfg_parser::TelemetrySink> &sinks,
+		const http::ClientConfig &config);
+
+	bool Enabled() const {
+		return !sinks_.empty();
+	}
+
+	void Emit(const Event &event);
+
+	// The JSON object which the sinks receive.
+	static string EventJson(const Event &event, int64_t timestamp);
+
+private:
+	struct Delivery {
+		size_t sink;
+		string payload;
+	};
+
+	void DeliverNext();
+	void DeliverExec(const cfg_parser::TelemetrySink &sink, const string &payload);
+	void DeliverWebhook(const cfg_parser::TelemetrySink &sink, const string &payload);
+	void Finish(error::Error err);
+
+	events::EventLoop &loop_;
+	vector<cfg_parser::TelemetrySink> sinks_;
+	http::Client client_;
+	events::Timer timer_;
+
+	deque<Delivery> queue_;
+	// The ongoing delivery, if `delivering_` is set.
+	bool delivering_ {false};
+	string target_;
+	procs::ScriptRunner runner_ {"Telemetry sink output"};
+	// Incremented for each delivery, so that late callbacks from an earlier one are ignored.
+	uint64_t generation_ {0};
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_TELEMETRY_SINKS_HPP
@@ -0,0 +1,188 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/telemetry_sinks.hpp>
+
+#include <chrono>
+
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+
+const string TelemetrySinks::kEventDeploymentStatus {"deployment_status"};
+
+const size_t TelemetrySinks::kMaxQueuedEvents {100};
+
+TelemetrySinks::TelemetrySinks(
+	events::EventLoop &loop,
+	const vector<cfg_parser::TelemetrySink> &sinks,
+	const http::ClientConfig &config) :
+	loop_ {loop},
+	sinks_ {sinks},
+	client_ {config, loop, "telemetry_sinks"},
+	timer_ {loop} {
+}
+
+string TelemetrySinks::EventJson(const Event &event, int64_t timestamp) {
+	string json = R"({"event":")" + json::EscapeString(event.type) + "\"";
+	json += R"(,"timestamp":)" + to_string(timestamp);
+	json += R"(,"deployment_id":")" + json::EscapeString(event.deployment_id) + "\"";
+	json += R"(,"artifact_name":")" + json::EscapeString(event.artifact_name) + "\"";
+	json += R"(,"status":")" + json::EscapeString(event.status) + "\"";
+	if (event.substate != "") {
+		json += R"(,"substate":")" + json::EscapeString(event.substate) + "\"";
+	}
+	json += "}";
+	return json;
+}
+
+void TelemetrySinks::Emit(const Event &event) {
+	if (!Enabled()) {
+		return;
+	}
+
+	auto timestamp =
+		chrono::duration_cast<chrono::seconds>(chrono::system_clock::now().time_since_epoch())
+			.count();
+	auto payload = EventJson(event, timestamp);
+	for (size_t i = 0; i < sinks_.size(); i++) {
+		if (queue_.size() >= kMaxQueuedEvents) {
+			log::Warning("Too many telemetry events waiting for delivery, dropping the oldest one");
+			queue_.pop_front();
+		}
+		queue_.push_back({i, payload});
+	}
+
+	if (!delivering_) {
+		DeliverNext();
+	}
+}
+
+void TelemetrySinks::DeliverNext() {
+	if (queue_.empty()) {
+		return;
+	}
+
+	auto delivery = queue_.front();
+	queue_.pop_front();
+	delivering_ = true;
+	generation_++;
+
+	const auto &sink = sinks_[delivery.sink];
+	if (sink.type == "exec") {
+		target_ = "`" + sink.command + "`";
+		DeliverExec(sink, delivery.payload);
+	} else {
+		target_ = sink.url;
+		DeliverWebhook(sink, delivery.payload);
+	}
+}
+
+void TelemetrySinks::DeliverExec(const cfg_parser::TelemetrySink &sink, const string &payload) {
+	auto err = runner_.AsyncRun(
+		loop_,
+		{sink.command, payload},
+		chrono::seconds {sink.timeout_seconds},
+		[this](error::Error err, const string &first_line) { Finish(err); });
+	if (err != error::NoError) {
+		Finish(err);
+	}
+}
+
+void TelemetrySinks::DeliverWebhook(const cfg_parser::TelemetrySink &sink, const string &payload) {
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::POST);
+	auto err = req->SetAddress(sink.url);
+	if (err != error::NoError) {
+		Finish(err);
+		return;
+	}
+	req->SetHeader("Content-Type", "application/json");
+	req->SetHeader("Content-Length", to_string(payload.size()));
+	req->SetBodyGenerator([payload]() { return make_shared<io::StringReader>(payload); });
+
+	auto generation = generation_;
+	auto status = make_shared<unsigned>(0);
+	err = client_.AsyncCall(
+		req,
+		[this, generation, status](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (generation != generation_) {
+				return;
+			}
+			if (!exp_resp) {
+				Finish(exp_resp.error());
+				return;
+			}
+			*status = exp_resp.value()->GetStatusCode();
+			exp_resp.value()->SetBodyWriter(make_shared<io::Discard>());
+		},
+		[this, generation, status](http::ExpectedIncomingResponsePtr exp_resp) {
+			if (generation != generation_) {
+				return;
+			}
+			if (!exp_resp) {
+				Finish(exp_resp.error());
+				return;
+			}
+			if (*status < 200 || *status >= 300) {
+				Finish(error::Error(
+					make_error_condition(errc::protocol_error),
+					"Unexpected status code " + to_string(*status)));
+				return;
+			}
+			Finish(error::NoError);
+		});
+	if (err != error::NoError) {
+		Finish(err);
+		return;
+	}
+
+	timer_.AsyncWait(chrono::seconds {sink.timeout_seconds}, [this, generation](error::Error err) {
+		if (err != error::NoError || generation != generation_) {
+			return;
+		}
+		Finish(error::Error(make_error_condition(errc::timed_out), "Timed out"));
+	});
+}
+
+void TelemetrySinks::Finish(error::Error err) {
+	if (err != error::NoError) {
+		log::Warning("Could not deliver a telemetry event to " + target_ + ": " + err.String());
+	}
+
+	// Nothing more is expected from this delivery, ignore what the cancellations below may cause.
+	generation_++;
+	timer_.Cancel();
+	client_.Cancel();
+	runner_.Cancel();
+	delivering_ = false;
+	// Don't destroy the HTTP request from within its own handlers.
+	loop_.Post([this]() {
+		if (!delivering_) {
+			DeliverNext();
+		}
+	});
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -0,0 +1,77 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#ifndef MENDER_UPDATE_DAEMON_USER_NOTIFIER_HPP
+#define MENDER_UPDATE_DAEMON_USER_NOTIFIER_HPP
+
+#include <deque>
+#include <functional>
+#include <memory>
+#include <string>
+#include <vector>
+
+#include <common/events.hpp>
+#include <common/processes.hpp>
+
+#include <client_shared/config_parser.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+using namespace std;
+
+namespace events = mender::common::events;
+namespace procs = mender::common::processes;
+
+namespace cfg_parser = mender::client_shared::config_parser;
+
+// Tells the people using the device about the update, with desktop notifications in the graphical
+// sessions and messages on the terminals, see Documentation/user-notifications.md.
+class UserNotifier {
+public:
+	// Where the session buses of logged in users are, as `<uid>/bus`.
+	static const string kSessionsDir;
+
+	UserNotifier(
+		events::EventLoop &loop,
+		const cfg_parser::UserNotifications &config,
+		const string &sessions_dir = kSessionsDir);
+
+	// Doesn't wait for the notifications to be delivered, and failures are only logged, since no
+	// one may be there to see them anyway.
+	void Notify(const string &summary, const string &body);
+
+	// Notifies that the device is about to reboot, and calls the handler after
+	// RebootWarningSeconds. The handler is always called asynchronously.
+	void AsyncWarnBeforeReboot(const string &body, function<void()> handler);
+
+private:
+	void AddDesktopCommands(const string &summary, const string &body);
+	void RunNext();
+
+	events::EventLoop &loop_;
+	events::Timer timer_;
+	cfg_parser::UserNotifications config_;
+	string sessions_dir_;
+
+	deque<vector<string>> commands_;
+	procs::ScriptRunner runner_ {"User notification output"};
+};
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_DAEMON_USER_NOTIFIER_HPP
@@ -0,0 +1,162 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/daemon/user_notifier.hpp>
+
+#include <filesystem>
+
+#include <pwd.h>
+
+#include <common/common.hpp>
+#include <common/error.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace daemon {
+
+namespace common = mender::common;
+namespace error = mender::common::error;
+namespace fs = std::filesystem;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+const string UserNotifier::kSessionsDir {"/run/user"};
+
+static const string kAppName {"Mender"};
+static const chrono::seconds kNotificationTimeout {10};
+
+UserNotifier::UserNotifier(
+	events::EventLoop &loop,
+	const cfg_parser::UserNotifications &config,
+	const string &sessions_dir) :
+	loop_ {loop},
+	timer_ {loop},
+	config_ {config},
+	sessions_dir_ {sessions_dir} {
+}
+
+void UserNotifier::Notify(const string &summary, const string &body) {
+	if (!config_.Enabled()) {
+		return;
+	}
+
+	log::Info("Notifying the users of the device: " + summary + ": " + body);
+	if (config_.desktop) {
+		AddDesktopCommands(summary, body);
+	}
+	if (config_.wall) {
+		commands_.push_back({"wall", kAppName + ": " + summary + ". " + body});
+	}
+
+	if (!runner_.Running()) {
+		RunNext();
+	}
+}
+
+void UserNotifier::AsyncWarnBeforeReboot(const string &body, function<void()> handler) {
+	if (!config_.Enabled() || config_.reboot_warning_seconds == 0) {
+		Notify("Rebooting", body);
+		loop_.Post(handler);
+		return;
+	}
+
+	Notify(
+		"Rebooting in " + to_string(config_.reboot_warning_seconds) + " seconds",
+		body + " Please save your work.");
+	timer_.AsyncWait(chrono::seconds {config_.reboot_warning_seconds}, [handler](error::Error) {
+		handler();
+	});
+}
+
+void UserNotifier::AddDesktopCommands(const string &summary, const string &body) {
+	error_code ec;
+	if (!fs::is_directory(sessions_dir_, ec)) {
+		log::Debug("No user sessions in " + sessions_dir_);
+		return;
+	}
+
+	for (const auto &entry : fs::directory_iterator(sessions_dir_, ec)) {
+		const string uid_string = entry.path().filename().string();
+		auto exp_uid = common::StringTo<int>(uid_string);
+		const string bus = path::Join(entry.path().string(), "bus");
+		error_code bus_ec;
+		if (!exp_uid || !fs::is_socket(bus, bus_ec)) {
+			continue;
+		}
+
+		const struct passwd *user = getpwuid(static_cast<uid_t>(exp_uid.value()));
+		if (user == nullptr) {
+			continue;
+		}
+
+		// Session buses only accept their own user, so the notification is sent as that user.
+		// Sessions without a notification server, such as SSH logins, just make the call fail.
+		commands_.push_back({
+			"setpriv",
+			"--reuid=" + uid_string,
+			"--regid=" + to_string(user->pw_gid),
+			"--init-groups",
+			"env",
+			"DBUS_SESSION_BUS_ADDRESS=unix:path=" + bus,
+			"gdbus",
+			"call",
+			"--session",
+			"--dest=org.freedesktop.Notifications",
+			"--object-path=/org/freedesktop/Notifications",
+			"--method=org.freedesktop.Notifications.Notify",
+			kAppName,
+			"0",
+			"system-software-update",
+			summary,
+			body,
+			"[]",
+			"{}",
+			"-1",
+		});
+	}
+	if (ec) {
+		log::Warning("Could not list the user sessions in " + sessions_dir_ + ": " + ec.message());
+	}
+}
+
+void UserNotifier::RunNext() {
+	if (commands_.empty()) {
+		return;
+	}
+
+	auto command = commands_.front();
+	commands_.pop_front();
+	const string command_string = common::JoinStrings(command, " ");
+
+	auto err = runner_.AsyncRun(
+		loop_,
+		command,
+		kNotificationTimeout,
+		[this, command_string](error::Error err, const string &first_line) {
+			if (err != error::NoError) {
+				log::Debug("`" + command_string + "` failed: " + err.String());
+			}
+			RunNext();
+		});
+	if (err != error::NoError) {
+		log::Debug("Could not run `" + command_string + "`: " + err.String());
+		RunNext();
+	}
+}
+
+} // namespace daemon
+} // namespace update
+} // namespace mender
@@ -18,15 +18,16 @@
 #include <common/config.h>
 
 #ifdef MENDER_LOG_BOOST
-#include <boost/log/sinks/sync_frontend.hpp>
-#include <boost/log/sinks/text_ostream_backend.hpp>
+#include <boost/log/sinks/sink.hpp>
 #include <boost/smart_ptr/shared_ptr.hpp>
 #endif // MENDER_LOG_BOOST
 
+#include <chrono>
 #include <string>
 #include <vector>
 
 #include <api/client.hpp>
+#include <client_shared/config_parser.hpp>
 #include <common/error.hpp>
 #include <common/events.hpp>
 #include <common/expected.hpp>
@@ -49,6 +50,7 @@ namespace sinks = boost::log::sinks;
 #endif // MENDER_LOG_BOOST
 
 namespace api = mender::api;
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace context = mender::update::context;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
@@ -104,6 +106,23 @@ enum class DeploymentStatus {
 
 string DeploymentStatusString(DeploymentStatus status);
 
+// How far the download of the Artifact has got, sent along with the Downloading status.
+struct DownloadProgress {
+	int64_t bytes_downloaded {0};
+	// Only known if the server tells the size of the Artifact.
+	optional<int64_t> bytes_total;
+	optional<int> percentage;
+	// From the average speed so far.
+	optional<int64_t> eta_seconds;
+};
+
+DownloadProgress MakeDownloadProgress(
+	int64_t bytes_downloaded, optional<int64_t> bytes_total, chrono::seconds elapsed);
+// The `download_progress` object of the status update.
+string DownloadProgressJson(const DownloadProgress &progress);
+// For the substate and the log, for example "45% (1048576 of 2330000 bytes), 120 s left".
+string DownloadProgressString(const DownloadProgress &progress);
+
 using StatusAPIResponse = struct APIResponseError; // there's no data, we care only about errors
 using StatusAPIResponseHandler = function<void(StatusAPIResponse)>;
 
@@ -123,6 +142,7 @@ public:
 		const string &deployment_id,
 		DeploymentStatus status,
 		const string &substate,
+		const optional<DownloadProgress> &progress,
 		api::Client &client,
 		StatusAPIResponseHandler api_handler) = 0;
 	virtual error::Error PushLogs(
@@ -134,6 +154,13 @@ public:
 
 class DeploymentClient : virtual public DeploymentAPI {
 public:
+	DeploymentClient() = default;
+	// With `compress_logs`, the logs are sent compressed with gzip, unless the server has refused
+	// that before.
+	explicit DeploymentClient(bool compress_logs) :
+		compress_logs_ {make_shared<bool>(compress_logs)} {
+	}
+
 	error::Error CheckNewDeployments(
 		context::MenderContext &ctx,
 		api::Client &client,
@@ -142,6 +169,7 @@ public:
 		const string &deployment_id,
 		DeploymentStatus status,
 		const string &substate,
+		const optional<DownloadProgress> &progress,
 		api::Client &client,
 		StatusAPIResponseHandler api_handler) override;
 	error::Error PushLogs(
@@ -150,8 +178,25 @@ public:
 		api::Client &client,
 		LogsAPIResponseHandler api_handler) override;
 
+	// How many checks for new deployments to do with the v1 API, after the server has turned out
+	// not to support v2, before trying v2 again in case the server was upgraded.
+	static const int kV2ReprobeInterval;
+
 private:
 	friend class ::DeploymentsTests;
+
+	// Whether the server supports the v2 version of the API for checking new deployments. Unknown
+	// until the first check, and then cached, so that older servers do not get a failing v2
+	// request on every check. Shared with the response handlers, which may outlive this object.
+	struct V2CheckSupport {
+		optional<bool> supported;
+		int checks_since_probe {0};
+	};
+	shared_ptr<V2CheckSupport> v2_check_support_ {make_shared<V2CheckSupport>()};
+	// Turned off for good when the server refuses compressed logs. Shared with the response
+	// handlers for the same reason.
+	shared_ptr<bool> compress_logs_ {make_shared<bool>(false)};
+
 	void HeaderHandler(
 		shared_ptr<vector<uint8_t>> received_body,
 		CheckUpdatesAPIResponseHandler api_handler,
@@ -195,11 +240,21 @@ public:
 	int64_t TotalDataSize();
 
 private:
+	expected::ExpectedSize ReadRawData(
+		io::FileReader &reader,
+		int64_t &remaining,
+		vector<uint8_t>::iterator start,
+		vector<uint8_t>::iterator end);
+
 	const string log_fpath_;
 	string sanitized_fpath_;
 	unique_ptr<io::FileReader> reader_;
 	int64_t raw_data_size_;
 	int64_t rem_raw_data_size_;
+	// With too large logs, the beginning of the logs is kept as well as the end.
+	unique_ptr<io::FileReader> head_reader_;
+	int64_t head_data_size_ {0};
+	int64_t rem_head_data_size_ {0};
 	static const vector<uint8_t> header_;
 	static const vector<uint8_t> closing_;
 	static const string default_tstamp_;
@@ -213,6 +268,7 @@ private:
 	io::Vsize too_much_data_msg_rem_;
 	bool clean_logs_;
 	const int32_t maximum_log_size_ = 1000 * 1000 - 256; // 1MB - some room for request headers etc.
+	const int32_t maximum_head_log_size_ = maximum_log_size_ / 4;
 	bool large_logs_ = false;
 
 	friend class ::DeploymentsTests;
@@ -220,9 +276,13 @@ private:
 
 class DeploymentLog {
 public:
-	DeploymentLog(const string &data_store_dir, const string &deployment_id) :
+	DeploymentLog(
+		const string &data_store_dir,
+		const string &deployment_id,
+		const cfg_parser::DeploymentLogs &limits = {}) :
 		data_store_dir_ {data_store_dir},
-		id_ {deployment_id} {};
+		id_ {deployment_id},
+		limits_ {limits} {};
 	error::Error BeginLogging();
 	error::Error FinishLogging();
 	~DeploymentLog() {
@@ -237,9 +297,9 @@ public:
 private:
 	const string data_store_dir_;
 	const string id_;
+	const cfg_parser::DeploymentLogs limits_;
 #ifdef MENDER_LOG_BOOST
-	typedef sinks::synchronous_sink<sinks::text_ostream_backend> text_sink;
-	boost::shared_ptr<text_sink> sink_;
+	boost::shared_ptr<sinks::sink> sink_;
 #endif // MENDER_LOG_BOOST
 	error::Error PrepareLogDirectory();
 	error::Error DoPrepareLogDirectory();
@@ -24,6 +24,7 @@
 #include <common/error.hpp>
 #include <common/events.hpp>
 #include <common/expected.hpp>
+#include <common/gzip.hpp>
 #include <common/http.hpp>
 #include <common/io.hpp>
 #include <common/json.hpp>
@@ -44,6 +45,7 @@ namespace context = mender::update::context;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace expected = mender::common::expected;
+namespace gzip = mender::common::gzip;
 namespace http = mender::common::http;
 namespace io = mender::common::io;
 namespace json = mender::common::json;
@@ -84,6 +86,8 @@ error::Error MakeError(DeploymentsErrorCode code, const string &msg) {
 static const string check_updates_v1_uri = "/api/devices/v1/deployments/device/deployments/next";
 static const string check_updates_v2_uri = "/api/devices/v2/deployments/device/deployments/next";
 
+const int DeploymentClient::kV2ReprobeInterval = 10;
+
 error::Error DeploymentClient::CheckNewDeployments(
 	context::MenderContext &ctx, api::Client &client, CheckUpdatesAPIResponseHandler api_handler) {
 	auto ex_compatible_type = ctx.GetCompatibleType();
@@ -199,7 +203,9 @@ error::Error DeploymentClient::CheckNewDeployments(
 			}
 		};
 
-	http::ResponseHandler v2_body_handler = [received_body,
+	auto v2_check_support = v2_check_support_;
+	http::ResponseHandler v2_body_handler = [v2_check_support,
+											 received_body,
 											 v1_req,
 											 header_handler,
 											 v1_body_handler,
@@ -220,10 +226,17 @@ error::Error DeploymentClient::CheckNewDeployments(
 		assert(status != http::StatusTooManyRequests);
 
 		if ((status == http::StatusOK) || (status == http::StatusNoContent)) {
+			v2_check_support->supported = true;
 			handle_data(status);
 		} else if (status == http::StatusNotFound) {
 			log::Debug(
 				"POST request to v2 version of the deployments API failed, falling back to v1 version and GET");
+			if (!v2_check_support->supported || v2_check_support->supported.value()) {
+				log::Info(
+					"The server does not support the v2 version of the deployments API, using v1 from now on");
+			}
+			v2_check_support->supported = false;
+			v2_check_support->checks_since_probe = 0;
 			auto err = client.AsyncCall(v1_req, header_handler, v1_body_handler);
 			if (err != error::NoError) {
 				api_handler(expected::unexpected(CheckUpdatesAPIResponseError {
@@ -246,6 +259,10 @@ error::Error DeploymentClient::CheckNewDeployments(
 		}
 	};
 
+	if (v2_check_support->supported && !v2_check_support->supported.value()
+		&& ++v2_check_support->checks_since_probe < kV2ReprobeInterval) {
+		return client.AsyncCall(v1_req, header_handler, v1_body_handler);
+	}
 	return client.AsyncCall(v2_req, header_handler, v2_body_handler);
 }
 
@@ -292,20 +309,67 @@ string DeploymentStatusString(DeploymentStatus status) {
 	return deployment_status_strings[static_cast<int>(status)];
 }
 
+DownloadProgress MakeDownloadProgress(
+	int64_t bytes_downloaded, optional<int64_t> bytes_total, chrono::seconds elapsed) {
+	DownloadProgress progress;
+	progress.bytes_downloaded = bytes_downloaded;
+	if (!bytes_total || bytes_total.value() <= 0) {
+		return progress;
+	}
+	auto total = bytes_total.value();
+	progress.bytes_total = total;
+	progress.percentage = static_cast<int>(min(bytes_downloaded, total) * 100 / total);
+	if (bytes_downloaded > 0 && elapsed.count() > 0) {
+		auto remaining = max(total - bytes_downloaded, int64_t {0});
+		progress.eta_seconds = remaining * elapsed.count() / bytes_downloaded;
+	}
+	return progress;
+}
+
+string DownloadProgressJson(const DownloadProgress &progress) {
+	string json = R"({"bytes_downloaded":)" + to_string(progress.bytes_downloaded);
+	if (progress.bytes_total) {
+		json += R"(,"bytes_total":)" + to_string(progress.bytes_total.value());
+	}
+	if (progress.percentage) {
+		json += R"(,"percentage":)" + to_string(progress.percentage.value());
+	}
+	if (progress.eta_seconds) {
+		json += R"(,"eta_seconds":)" + to_string(progress.eta_seconds.value());
+	}
+	return json + "}";
+}
+
+string DownloadProgressString(const DownloadProgress &progress) {
+	if (!progress.bytes_total) {
+		return to_string(progress.bytes_downloaded) + " bytes";
+	}
+	string str = to_string(progress.percentage.value()) + "% (";
+	str += to_string(progress.bytes_downloaded) + " of " + to_string(progress.bytes_total.value());
+	str += " bytes)";
+	if (progress.eta_seconds) {
+		str += ", " + to_string(progress.eta_seconds.value()) + " s left";
+	}
+	return str;
+}
+
 error::Error DeploymentClient::PushStatus(
 	const string &deployment_id,
 	DeploymentStatus status,
 	const string &substate,
+	const optional<DownloadProgress> &progress,
 	api::Client &client,
 	StatusAPIResponseHandler api_handler) {
 	// Cannot push a status update without a deployment ID
 	AssertOrReturnError(deployment_id != "");
 	string payload = R"({"status":")" + DeploymentStatusString(status) + "\"";
 	if (substate != "") {
-		payload += R"(,"substate":")" + json::EscapeString(substate) + "\"}";
-	} else {
-		payload += "}";
+		payload += R"(,"substate":")" + json::EscapeString(substate) + "\"";
 	}
+	if (progress) {
+		payload += R"(,"download_progress":)" + DownloadProgressJson(progress.value());
+	}
+	payload += "}";
 	http::BodyGenerator payload_gen = [payload]() {
 		return make_shared<io::StringReader>(payload);
 	};
@@ -494,12 +558,16 @@ JsonLogMessagesReader::~JsonLogMessagesReader() {
 }
 
 static error::Error DoSanitizeLogs(
-	const string &orig_path, const string &new_path, bool &all_valid, string &first_tstamp) {
+	const string &orig_path,
+	const string &new_path,
+	bool append,
+	bool &all_valid,
+	string &first_tstamp) {
 	auto ex_ifs = io::OpenIfstream(orig_path);
 	if (!ex_ifs) {
 		return ex_ifs.error();
 	}
-	auto ex_ofs = io::OpenOfstream(new_path);
+	auto ex_ofs = io::OpenOfstream(new_path, append);
 	if (!ex_ofs) {
 		return ex_ofs.error();
 	}
@@ -598,7 +666,23 @@ error::Error JsonLogMessagesReader::SanitizeLogs() {
 
 	string prep_fpath = log_fpath_ + ".sanitized";
 	string first_tstamp = default_tstamp_;
-	auto err = DoSanitizeLogs(log_fpath_, prep_fpath, clean_logs_, first_tstamp);
+	error::Error err;
+	// If the log has been rotated, the older part next to it goes first.
+	const string rotated_fpath = log_fpath_ + ".1";
+	if (path::FileExists(rotated_fpath)) {
+		err = DoSanitizeLogs(rotated_fpath, prep_fpath, false, clean_logs_, first_tstamp);
+		if (err == error::NoError) {
+			bool all_valid;
+			string tstamp = first_tstamp.empty() ? default_tstamp_ : first_tstamp;
+			err = DoSanitizeLogs(log_fpath_, prep_fpath, true, all_valid, tstamp);
+			clean_logs_ = clean_logs_ && all_valid;
+			if (first_tstamp.empty()) {
+				first_tstamp = tstamp;
+			}
+		}
+	} else {
+		err = DoSanitizeLogs(log_fpath_, prep_fpath, false, clean_logs_, first_tstamp);
+	}
 	if (err != error::NoError) {
 		if (path::FileExists(prep_fpath)) {
 			auto del_err = path::FileDelete(prep_fpath);
@@ -615,23 +699,43 @@ error::Error JsonLogMessagesReader::SanitizeLogs() {
 		}
 
 		raw_data_size_ = ex_sz.value();
+		head_data_size_ = 0;
 		if (raw_data_size_ > maximum_log_size_) {
 			large_logs_ = true;
+			// Keep the beginning of the logs, which tells what the deployment was doing, as
+			// well as the end, which usually tells what went wrong.
+			auto ex_head_end = FindNextMsgAfter(sanitized_fpath_, maximum_head_log_size_);
+			if (!ex_head_end) {
+				return ex_head_end.error().WithContext(
+					"Failed to determine end offset of the beginning of too large deployment logs");
+			}
+			head_data_size_ = ex_head_end.value();
+			if (head_data_size_ > maximum_log_size_ / 2) {
+				// The first messages are huge, not worth keeping.
+				head_data_size_ = 0;
+			}
+
 			// Make sure we end up with less data than the limit with all the
 			// potential extra messages added in JsonLogMessagesReader::Read()
 			// below.
 			auto ex_off = FindNextMsgAfter(
 				sanitized_fpath_,
-				(raw_data_size_ + too_much_data_msg_tmpl_.size() + bad_data_msg_tmpl_.size()
-				 - maximum_log_size_));
+				(raw_data_size_ + head_data_size_ + too_much_data_msg_tmpl_.size()
+				 + bad_data_msg_tmpl_.size() - maximum_log_size_));
 			if (!ex_off) {
 				return ex_off.error().WithContext(
 					"Failed to determine start offset in too large deployment logs");
 			}
-			reader_ = make_unique<io::FileReader>(sanitized_fpath_, ex_off.value());
-			raw_data_size_ -= ex_off.value();
+			auto tail_offset =
+				max(ex_off.value(), static_cast<ifstream::off_type>(head_data_size_));
+			if (head_data_size_ > 0) {
+				head_reader_ = make_unique<io::FileReader>(sanitized_fpath_);
+			}
+			reader_ = make_unique<io::FileReader>(sanitized_fpath_, tail_offset);
+			raw_data_size_ -= tail_offset;
 		}
 		rem_raw_data_size_ = raw_data_size_;
+		rem_head_data_size_ = head_data_size_;
 		if (!clean_logs_) {
 			ReplaceTimestampInMsgData(bad_data_msg_, first_tstamp, default_tstamp_.size());
 		}
@@ -652,6 +756,7 @@ error::Error JsonLogMessagesReader::Rewind() {
 	// release/close the file first so that the FileDelete() below can actually
 	// delete it and free space up
 	reader_.reset();
+	head_reader_.reset();
 	auto del_err = path::FileDelete(sanitized_fpath_);
 	if (del_err != error::NoError) {
 		log::Error("Failed to delete auxiliary logs file: " + del_err.String());
@@ -663,7 +768,7 @@ error::Error JsonLogMessagesReader::Rewind() {
 int64_t JsonLogMessagesReader::TotalDataSize() {
 	assert(!sanitized_fpath_.empty());
 
-	auto ret = raw_data_size_ + header_.size() + closing_.size();
+	auto ret = raw_data_size_ + head_data_size_ + header_.size() + closing_.size();
 	if (!clean_logs_) {
 		ret += bad_data_msg_.size();
 	}
@@ -673,6 +778,32 @@ int64_t JsonLogMessagesReader::TotalDataSize() {
 	return ret;
 }
 
+ExpectedSize JsonLogMessagesReader::ReadRawData(
+	io::FileReader &reader,
+	int64_t &remaining,
+	vector<uint8_t>::iterator start,
+	vector<uint8_t>::iterator end) {
+	if (end - start > remaining) {
+		end = start + static_cast<size_t>(remaining);
+	}
+	auto ex_sz = reader.Read(start, end);
+	if (!ex_sz) {
+		return ex_sz;
+	}
+	auto n_read = ex_sz.value();
+	remaining -= n_read;
+
+	// We control how much we read from the file so we should never read
+	// 0 bytes (meaning EOF reached). If we do, it means the file is
+	// smaller than what we were told.
+	assert(n_read > 0);
+	if (n_read == 0) {
+		return expected::unexpected(
+			MakeError(InvalidDataError, "Unexpected EOF when reading logs file"));
+	}
+	return n_read;
+}
+
 ExpectedSize JsonLogMessagesReader::Read(
 	vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) {
 	AssertOrReturnUnexpected(!sanitized_fpath_.empty());
@@ -684,44 +815,28 @@ ExpectedSize JsonLogMessagesReader::Read(
 		auto n_copied = copy_end - start;
 		header_rem_ -= n_copied;
 		return static_cast<size_t>(n_copied);
-	} else if (large_logs_ && (too_much_data_msg_rem_ > 0)) {
+	} else if (!clean_logs_ && (bad_data_msg_rem_ > 0)) {
 		io::Vsize target_size = end - start;
 		auto copy_end = copy_n(
-			too_much_data_msg_.begin() + (too_much_data_msg_.size() - too_much_data_msg_rem_),
-			min(too_much_data_msg_rem_, target_size),
+			bad_data_msg_.begin() + (bad_data_msg_.size() - bad_data_msg_rem_),
+			min(bad_data_msg_rem_, target_size),
 			start);
 		auto n_copied = copy_end - start;
-		too_much_data_msg_rem_ -= n_copied;
+		bad_data_msg_rem_ -= n_copied;
 		return static_cast<size_t>(n_copied);
-	} else if (!clean_logs_ && (bad_data_msg_rem_ > 0)) {
+	} else if (rem_head_data_size_ > 0) {
+		return ReadRawData(*head_reader_, rem_head_data_size_, start, end);
+	} else if (large_logs_ && (too_much_data_msg_rem_ > 0)) {
 		io::Vsize target_size = end - start;
 		auto copy_end = copy_n(
-			bad_data_msg_.begin() + (bad_data_msg_.size() - bad_data_msg_rem_),
-			min(bad_data_msg_rem_, target_size),
+			too_much_data_msg_.begin() + (too_much_data_msg_.size() - too_much_data_msg_rem_),
+			min(too_much_data_msg_rem_, target_size),
 			start);
 		auto n_copied = copy_end - start;
-		bad_data_msg_rem_ -= n_copied;
+		too_much_data_msg_rem_ -= n_copied;
 		return static_cast<size_t>(n_copied);
 	} else if (rem_raw_data_size_ > 0) {
-		if (end - start > rem_raw_data_size_) {
-			end = start + static_cast<size_t>(rem_raw_data_size_);
-		}
-		auto ex_sz = reader_->Read(start, end);
-		if (!ex_sz) {
-			return ex_sz;
-		}
-		auto n_read = ex_sz.value();
-		rem_raw_data_size_ -= n_read;
-
-		// We control how much we read from the file so we should never read
-		// 0 bytes (meaning EOF reached). If we do, it means the file is
-		// smaller than what we were told.
-		assert(n_read > 0);
-		if (n_read == 0) {
-			return expected::unexpected(
-				MakeError(InvalidDataError, "Unexpected EOF when reading logs file"));
-		}
-		return n_read;
+		return ReadRawData(*reader_, rem_raw_data_size_, start, end);
 	} else if (closing_rem_ > 0) {
 		io::Vsize target_size = end - start;
 		auto copy_end = copy_n(
@@ -761,45 +876,91 @@ error::Error DeploymentClient::PushLogs(
 	});
 
 	auto received_body = make_shared<vector<uint8_t>>();
-	return client.AsyncCall(
-		req,
+	http::ResponseHandler header_handler =
 		[this, received_body, api_handler](http::ExpectedIncomingResponsePtr exp_resp) {
 			this->PushLogsHeaderHandler(received_body, api_handler, exp_resp);
-		},
-		[received_body, api_handler](http::ExpectedIncomingResponsePtr exp_resp) {
-			if (!exp_resp) {
-				log::Error("Request to push logs data failed: " + exp_resp.error().message);
-				api_handler(LogsAPIResponse {nullopt, nullopt, exp_resp.error()});
-				return;
-			}
+		};
+	http::ResponseHandler body_handler = [received_body,
+										  api_handler](http::ExpectedIncomingResponsePtr exp_resp) {
+		if (!exp_resp) {
+			log::Error("Request to push logs data failed: " + exp_resp.error().message);
+			api_handler(LogsAPIResponse {nullopt, nullopt, exp_resp.error()});
+			return;
+		}
 
-			auto resp = exp_resp.value();
-			auto status = resp->GetStatusCode();
+		auto resp = exp_resp.value();
+		auto status = resp->GetStatusCode();
 
-			// StatusTooManyRequests must have been handled in PushLogsHeaderHandler already
-			assert(status != http::StatusTooManyRequests);
-			// StatusRequestBodyTooLarge must have been handled in PushLogsHeaderHandler already
-			assert(status != http::StatusRequestBodyTooLarge);
+		// StatusTooManyRequests must have been handled in PushLogsHeaderHandler already
+		assert(status != http::StatusTooManyRequests);
+		// StatusRequestBodyTooLarge must have been handled in PushLogsHeaderHandler already
+		assert(status != http::StatusRequestBodyTooLarge);
 
-			if (status == http::StatusNoContent) {
-				api_handler(LogsAPIResponse {status, nullopt, error::NoError});
+		if (status == http::StatusNoContent) {
+			api_handler(LogsAPIResponse {status, nullopt, error::NoError});
+		} else {
+			auto ex_err_msg = api::ErrorMsgFromErrorResponse(*received_body);
+			string err_str;
+			if (ex_err_msg) {
+				err_str = ex_err_msg.value();
 			} else {
-				auto ex_err_msg = api::ErrorMsgFromErrorResponse(*received_body);
-				string err_str;
-				if (ex_err_msg) {
-					err_str = ex_err_msg.value();
-				} else {
-					err_str = resp->GetStatusMessage();
-				}
+				err_str = resp->GetStatusMessage();
+			}
+			api_handler(LogsAPIResponse {
+				status,
+				nullopt,
+				MakeError(
+					BadResponseError,
+					"Got unexpected response " + to_string(status)
+						+ " from logs API: " + err_str)});
+		}
+	};
+
+	if (!*compress_logs_) {
+		return client.AsyncCall(req, header_handler, body_handler);
+	}
+
+	// The logs sent are limited to about 1 MB, so they can be compressed in memory.
+	stringstream compressed;
+	io::StreamWriter compressed_writer {compressed};
+	err = gzip::Compress(*logs_reader, compressed_writer);
+	if (err != error::NoError) {
+		log::Warning("Could not compress the deployment logs, sending them as is: " + err.String());
+		return client.AsyncCall(req, header_handler, body_handler);
+	}
+	auto compressed_body = make_shared<string>(compressed.str());
+
+	auto gzip_req = make_shared<api::APIRequest>();
+	gzip_req->SetPath(http::JoinUrl(deployments_uri_prefix, deployment_id, logs_uri_suffix));
+	gzip_req->SetMethod(http::Method::PUT);
+	gzip_req->SetHeader("Content-Type", "application/json");
+	gzip_req->SetHeader("Content-Encoding", "gzip");
+	gzip_req->SetHeader("Content-Length", to_string(compressed_body->size()));
+	gzip_req->SetHeader("Accept", "application/json");
+	gzip_req->SetBodyGenerator(
+		[compressed_body]() { return make_shared<io::StringReader>(*compressed_body); });
+
+	auto compress_logs = compress_logs_;
+	http::ResponseHandler gzip_body_handler =
+		[compress_logs, req, header_handler, body_handler, api_handler, &client](
+			http::ExpectedIncomingResponsePtr exp_resp) {
+			if (!exp_resp || exp_resp.value()->GetStatusCode() != http::StatusUnsupportedMediaType) {
+				body_handler(exp_resp);
+				return;
+			}
+
+			log::Info(
+				"The server does not accept compressed deployment logs, sending them uncompressed from now on");
+			*compress_logs = false;
+			auto err = client.AsyncCall(req, header_handler, body_handler);
+			if (err != error::NoError) {
 				api_handler(LogsAPIResponse {
-					status,
+					http::StatusUnsupportedMediaType,
 					nullopt,
-					MakeError(
-						BadResponseError,
-						"Got unexpected response " + to_string(status)
-							+ " from logs API: " + err_str)});
+					err.WithContext("While sending uncompressed logs")});
 			}
-		});
+		};
+	return client.AsyncCall(gzip_req, header_handler, gzip_body_handler);
 }
 
 void DeploymentClient::PushLogsHeaderHandler(
@@ -17,6 +17,7 @@
 #include <algorithm>
 #include <cctype>
 #include <filesystem>
+#include <map>
 #include <string>
 
 #include <boost/date_time/posix_time/posix_time.hpp>
@@ -26,6 +27,7 @@
 #include <boost/smart_ptr/shared_ptr.hpp>
 
 #include <common/error.hpp>
+#include <common/gzip.hpp>
 #include <common/io.hpp>
 #include <common/json.hpp>
 #include <common/log.hpp>
@@ -44,6 +46,7 @@ namespace sinks = boost::log::sinks;
 namespace fs = std::filesystem;
 
 namespace error = mender::common::error;
+namespace gzip = mender::common::gzip;
 namespace io = mender::common::io;
 namespace json = mender::common::json;
 namespace mlog = mender::common::log;
@@ -68,9 +71,96 @@ static void JsonLogFormatter(logging::record_view const &rec, logging::formattin
 	strm << R"("message":")" << json::EscapeString(*rec[expr::smessage]) << "\"}";
 }
 
+// Writes the formatted records to the log file, one per line, and moves the file aside to
+// `<log>.1` when it reaches the rotation size, replacing the part rotated before.
+class RotatingLogBackend :
+	public sinks::basic_formatted_sink_backend<char, sinks::synchronized_feeding> {
+public:
+	RotatingLogBackend(const string &path, int64_t rotate_size_bytes) :
+		path_ {path},
+		rotate_size_bytes_ {rotate_size_bytes} {
+	}
+
+	error::Error Open() {
+		auto ex_ofstr = io::OpenOfstream(path_, true);
+		if (!ex_ofstr) {
+			return ex_ofstr.error();
+		}
+		stream_ = std::move(ex_ofstr.value());
+		// The log may be reused, after a restart in the middle of the deployment.
+		auto ex_size = io::FileSize(path_);
+		size_ = ex_size ? static_cast<int64_t>(ex_size.value()) : 0;
+		return error::NoError;
+	}
+
+	void consume(logging::record_view const &, string_type const &formatted) {
+		if (!stream_.is_open()) {
+			return;
+		}
+		stream_ << formatted << '\n';
+		stream_.flush();
+		size_ += static_cast<int64_t>(formatted.size() + 1);
+		if (rotate_size_bytes_ > 0 && size_ >= rotate_size_bytes_) {
+			Rotate();
+		}
+	}
+
+private:
+	void Rotate() {
+		// Anything logged from here would come back to this sink, so the errors can't be
+		// reported. If the log can't be moved aside, it keeps growing, and this is tried again
+		// after another `rotate_size_bytes_`. If it can't be reopened, the rest of the log is lost.
+		stream_.close();
+		error_code ec;
+		fs::rename(path_, path_ + ".1", ec);
+		auto ex_ofstr = io::OpenOfstream(path_, static_cast<bool>(ec));
+		if (ex_ofstr) {
+			stream_ = std::move(ex_ofstr.value());
+		}
+		size_ = 0;
+	}
+
+	const string path_;
+	const int64_t rotate_size_bytes_;
+	ofstream stream_;
+	int64_t size_ {0};
+};
+
 static const size_t kMaxExistingLogs = 5;
 static const uintmax_t kLogsFreeSpaceRequired = 100 * 1024; // 100 KiB
 
+static const string kLogSuffix {".log"};
+static const string kRotatedLogSuffix {".log.1"};
+static const string kCompressedLogSuffix {".log.gz"};
+
+// The files of the log of an earlier deployment: the log itself, the part of it rotated before,
+// and the compressed log, which replaces the other two.
+struct OldLog {
+	bool plain {false};
+	bool rotated {false};
+	bool compressed {false};
+	uintmax_t size {0};
+
+	vector<string> Suffixes() const {
+		vector<string> suffixes;
+		if (rotated) {
+			suffixes.push_back(kRotatedLogSuffix);
+		}
+		if (plain) {
+			suffixes.push_back(kLogSuffix);
+		}
+		if (compressed) {
+			suffixes.push_back(kCompressedLogSuffix);
+		}
+		return suffixes;
+	}
+};
+
+static bool EndsWith(const string &str, const string &suffix) {
+	return (str.size() >= suffix.size())
+		   && (str.compare(str.size() - suffix.size(), suffix.size(), suffix) == 0);
+}
+
 error::Error DeploymentLog::PrepareLogDirectory() {
 	try {
 		return DoPrepareLogDirectory();
@@ -92,7 +182,8 @@ error::Error DeploymentLog::DoPrepareLogDirectory() {
 		return error::NoError;
 	}
 
-	vector<string> old_logs;
+	// Keyed by the file name without the suffix, deployments.NNNN.ID, which sorts by the index.
+	map<string, OldLog> old_logs;
 	for (auto const &entry : fs::directory_iterator {dir_path}) {
 		fs::path file_path = entry.path();
 		if (!fs::is_regular_file(file_path)) {
@@ -100,35 +191,85 @@ error::Error DeploymentLog::DoPrepareLogDirectory() {
 		}
 
 		string file_name = file_path.filename().string();
+		if (file_name.find("deployments.") != 0) {
+			continue;
+		}
 
-		if (file_name == LogFileName()) {
-			// this log file will be (re)used, leave it alone
+		string suffix;
+		for (const auto &known_suffix : {kLogSuffix, kRotatedLogSuffix, kCompressedLogSuffix}) {
+			if (EndsWith(file_name, known_suffix)) {
+				suffix = known_suffix;
+			}
+		}
+		if (suffix.empty()) {
 			continue;
 		}
+		string stem = file_name.substr(0, file_name.size() - suffix.size());
 
-		if ((file_name.find("deployments.") != 0)
-			|| (file_name.substr(file_name.size() - 4) != ".log")) {
+		if (stem + kLogSuffix == LogFileName()) {
+			// this log file will be (re)used, leave it alone
 			continue;
 		}
 
 		// expected file name: deployments.NNNN.ID.log
 		// "deployments.".size() == 12
-		auto second_dot_pos = file_name.find('.', 12);
-		auto last_dot_pos = file_name.find_last_of('.');
-		if ((second_dot_pos == string::npos) || (last_dot_pos == string::npos)
-			|| (second_dot_pos == last_dot_pos) || (second_dot_pos != 16)
-			|| any_of(file_name.cbegin() + 12, file_name.cbegin() + second_dot_pos, [](char c) {
+		auto second_dot_pos = stem.find('.', 12);
+		if ((second_dot_pos == string::npos) || (second_dot_pos != 16)
+			|| (second_dot_pos == stem.size() - 1)
+			|| any_of(stem.cbegin() + 12, stem.cbegin() + second_dot_pos, [](char c) {
 				   return !isdigit(c);
 			   })) {
 			mlog::Warning("Old deployment log with a malformed file name found: " + file_name);
 			continue;
 		}
 
-		old_logs.push_back(file_name);
+		auto &old_log = old_logs[stem];
+		if (suffix == kLogSuffix) {
+			old_log.plain = true;
+		} else if (suffix == kRotatedLogSuffix) {
+			old_log.rotated = true;
+		} else {
+			old_log.compressed = true;
+		}
+		old_log.size += fs::file_size(file_path);
 	}
-	std::sort(old_logs.begin(), old_logs.end());
 
 	error_code ec;
+	if (limits_.compress) {
+		for (auto &[stem, old_log] : old_logs) {
+			if (!old_log.plain && !old_log.rotated) {
+				continue;
+			}
+			vector<string> src_paths;
+			for (const auto &suffix : old_log.Suffixes()) {
+				if (suffix != kCompressedLogSuffix) {
+					src_paths.push_back((dir_path / (stem + suffix)).string());
+				}
+			}
+			const auto compressed_path = dir_path / (stem + kCompressedLogSuffix);
+			auto err = gzip::CompressFiles(src_paths, compressed_path.string());
+			if (err != error::NoError) {
+				mlog::Warning("Could not compress old deployment log " + stem + ": " + err.String());
+				continue;
+			}
+			for (const auto &src_path : src_paths) {
+				if (!fs::remove(src_path, ec) && ec) {
+					mlog::Warning("Failed to remove compressed old log file '" + src_path + "'");
+				}
+			}
+			old_log.plain = false;
+			old_log.rotated = false;
+			old_log.compressed = true;
+			old_log.size = fs::file_size(compressed_path);
+		}
+	}
+
+	uintmax_t total_size = 0;
+	for (const auto &old_log : old_logs) {
+		total_size += old_log.second.size;
+	}
+	const uintmax_t max_total_size = static_cast<uintmax_t>(limits_.max_total_size_bytes);
+
 	fs::space_info space_info = fs::space(dir_path, ec);
 	if (ec) {
 		return error::Error(
@@ -137,14 +278,19 @@ error::Error DeploymentLog::DoPrepareLogDirectory() {
 
 	while ((old_logs.size() > 0)
 		   && ((space_info.available < kLogsFreeSpaceRequired)
-			   || (old_logs.size() > (kMaxExistingLogs - 1)))) {
-		auto last_log_file = old_logs[old_logs.size() - 1];
-		old_logs.pop_back();
-		if (!fs::remove(dir_path / last_log_file, ec) && ec) {
-			return error::Error(
-				ec.default_error_condition(),
-				"Failed to remove old log file '" + last_log_file + "'");
+			   || (old_logs.size() > (kMaxExistingLogs - 1))
+			   || ((max_total_size > 0) && (total_size > max_total_size)))) {
+		auto last_log = prev(old_logs.end());
+		for (const auto &suffix : last_log->second.Suffixes()) {
+			auto last_log_file = last_log->first + suffix;
+			if (!fs::remove(dir_path / last_log_file, ec) && ec) {
+				return error::Error(
+					ec.default_error_condition(),
+					"Failed to remove old log file '" + last_log_file + "'");
+			}
 		}
+		total_size -= last_log->second.size;
+		old_logs.erase(last_log);
 		if (space_info.available < kLogsFreeSpaceRequired) {
 			space_info = fs::space(dir_path, ec);
 			if (ec) {
@@ -155,36 +301,31 @@ error::Error DeploymentLog::DoPrepareLogDirectory() {
 	}
 
 	// now let's make sure old logs have an increasing index starting with 0001
-	for (ssize_t i = old_logs.size() - 1; i >= 0; i--) {
-		// "deployments.".size() == 12
-		auto second_dot_pos = old_logs[i].find('.', 12);
-		auto last_dot_pos = old_logs[i].find_last_of('.');
-
-		// should never happen due the filter above when populating old_logs and
-		// due to how these files are named
+	ssize_t i = old_logs.size() - 1;
+	for (auto it = old_logs.rbegin(); it != old_logs.rend(); it++, i--) {
+		// should never happen due the filter above when populating old_logs
+		auto second_dot_pos = it->first.find('.', 12);
 		assert(second_dot_pos != string::npos);
-		assert(last_dot_pos != string::npos);
-		assert(second_dot_pos != last_dot_pos);
 
 		string deployment_id;
-		if ((second_dot_pos == string::npos) || (last_dot_pos == string::npos)) {
+		if (second_dot_pos == string::npos) {
 			deployment_id = "unknown_deployment";
 		} else {
-			deployment_id =
-				old_logs[i].substr(second_dot_pos + 1, (last_dot_pos - second_dot_pos - 1));
+			deployment_id = it->first.substr(second_dot_pos + 1);
 		}
 		stringstream ss;
 		ss << "deployments.";
 		ss << setfill('0') << setw(4) << to_string(i + 1);
 		ss << "." + deployment_id;
-		ss << ".log";
 
-		string new_name = ss.str();
-		fs::rename(dir_path / old_logs[i], dir_path / new_name, ec);
-		if (ec) {
-			return error::Error(
-				ec.default_error_condition(),
-				"Failed to rename old log file '" + old_logs[i] + "'");
+		string new_stem = ss.str();
+		for (const auto &suffix : it->second.Suffixes()) {
+			fs::rename(dir_path / (it->first + suffix), dir_path / (new_stem + suffix), ec);
+			if (ec) {
+				return error::Error(
+					ec.default_error_condition(),
+					"Failed to rename old log file '" + it->first + suffix + "'");
+			}
 		}
 	}
 
@@ -197,16 +338,16 @@ error::Error DeploymentLog::BeginLogging() {
 		return err;
 	}
 
-	auto ex_ofstr = io::OpenOfstream(LogFilePath(), true);
-	if (!ex_ofstr) {
-		return ex_ofstr.error();
+	auto backend =
+		boost::make_shared<RotatingLogBackend>(LogFilePath(), limits_.rotate_size_bytes);
+	err = backend->Open();
+	if (err != error::NoError) {
+		return err;
 	}
 
-	auto log_stream = boost::make_shared<std::ofstream>(std::move(ex_ofstr.value()));
-	sink_ = boost::make_shared<text_sink>();
-	sink_->set_formatter(&JsonLogFormatter);
-	sink_->locked_backend()->add_stream(log_stream);
-	sink_->locked_backend()->auto_flush(true);
+	auto sink = boost::make_shared<sinks::synchronous_sink<RotatingLogBackend>>(backend);
+	sink->set_formatter(&JsonLogFormatter);
+	sink_ = sink;
 
 	logging::core::get()->add_sink(sink_);
 
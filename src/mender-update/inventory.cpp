@@ -28,7 +28,10 @@
 #include <client_shared/inventory_parser.hpp>
 #include <common/io.hpp>
 #include <common/json.hpp>
+#include <common/key_value_parser.hpp>
 #include <common/log.hpp>
+#include <common/processes.hpp>
+#include <mender-update/context.hpp>
 
 namespace mender {
 namespace update {
@@ -39,6 +42,7 @@ using namespace std;
 namespace api = mender::api;
 namespace common = mender::common;
 namespace conf = mender::client_shared::conf;
+namespace context = mender::update::context;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace expected = mender::common::expected;
@@ -46,7 +50,9 @@ namespace http = mender::common::http;
 namespace inv_parser = mender::client_shared::inventory_parser;
 namespace io = mender::common::io;
 namespace json = mender::common::json;
+namespace kvp = mender::common::key_value_parser;
 namespace log = mender::common::log;
+namespace procs = mender::common::processes;
 
 const InventoryErrorCategoryClass InventoryErrorCategory;
 
@@ -62,6 +68,8 @@ string InventoryErrorCategoryClass::message(int code) const {
 		return "Bad response error";
 	case TooManyRequestsError:
 		return "Too many requests";
+	case InvalidAttributeError:
+		return "Invalid inventory attribute";
 	}
 	assert(false);
 	return "Unknown";
@@ -73,17 +81,43 @@ error::Error MakeError(InventoryErrorCode code, const string &msg) {
 
 const string uri = "/api/devices/v1/inventory/device/attributes";
 
-error::Error InventoryClient::PushInventoryData(
-	const string &inventory_generators_dir,
-	events::EventLoop &loop,
-	api::Client &client,
-	size_t &last_data_hash,
-	APIResponseHandler api_handler) {
-	auto ex_inv_data = inv_parser::GetInventoryData(inventory_generators_dir);
-	if (!ex_inv_data) {
-		return ex_inv_data.error();
+const size_t RuntimeAttributes::kMaxAttributes = 100;
+
+error::Error RuntimeAttributes::Set(const string &name, const string &value) {
+	if (name == "") {
+		return MakeError(InvalidAttributeError, "The attribute name cannot be empty");
+	}
+	// Attributes which the client and the server interpret themselves, such as
+	// `mender_client_version`, are left to the client and the inventory scripts.
+	if (common::StartsWith<string>(name, "mender_")) {
+		return MakeError(
+			InvalidAttributeError, "Attribute names starting with 'mender_' are reserved: " + name);
+	}
+
+	if (value == "") {
+		attributes_.erase(name);
+		return error::NoError;
+	}
+
+	if (attributes_.count(name) == 0 and attributes_.size() >= kMaxAttributes) {
+		return MakeError(
+			InvalidAttributeError,
+			"Cannot set " + name + ", there are already " + to_string(kMaxAttributes)
+				+ " runtime attributes");
+	}
+	attributes_[name] = value;
+	return error::NoError;
+}
+
+// Adds the attributes set at runtime, and the attributes that the client adds itself, to the
+// output of the inventory scripts.
+static void AddClientAttributes(
+	kvp::KeyValuesMap &inv_data, const RuntimeAttributes &runtime_attributes, api::Client &client) {
+	// Like the values of an attribute which several scripts give, the value set at runtime is added
+	// to those from the scripts.
+	for (const auto &attr : runtime_attributes.Get()) {
+		inv_data[attr.first].push_back(attr.second);
 	}
-	auto &inv_data = ex_inv_data.value();
 
 	// The Mender Client version attribute is owned by
 	// mender-client-version-inventory-script; mender-update adds the built-in
@@ -96,20 +130,54 @@ error::Error InventoryClient::PushInventoryData(
 		inv_data["mender_client_version_provider"] = {"internal"};
 	}
 
-	stringstream top_ss;
-	top_ss << "[";
+	auto announcements = client.GetServerAnnouncements();
+	if (announcements.size() > 0) {
+		inv_data["mender_server_announcements"] = announcements;
+	}
+}
+
+// Collects everything that is submitted: the output of the inventory scripts, the attributes set
+// at runtime, and the attributes that the client adds itself. The scripts run without blocking the
+// event loop, so that a hanging one only holds back the inventory.
+static error::Error AsyncCollectInventoryData(
+	const string &inventory_generators_dir,
+	const RuntimeAttributes &runtime_attributes,
+	events::EventLoop &loop,
+	api::Client &client,
+	inv_parser::InventoryDataHandler handler) {
+	return inv_parser::AsyncGetInventoryData(
+		inventory_generators_dir,
+		loop,
+		procs::DEFAULT_GENERATE_LINE_DATA_TIMEOUT,
+		[&runtime_attributes, &client, handler](kvp::ExpectedKeyValuesMap ex_inv_data) {
+			if (ex_inv_data) {
+				AddClientAttributes(ex_inv_data.value(), runtime_attributes, client);
+			}
+			handler(ex_inv_data);
+		});
+}
+
+static vector<string> SortedKeys(const kvp::KeyValuesMap &inv_data) {
 	auto key_vector = common::GetMapKeyVector(inv_data);
 	std::sort(key_vector.begin(), key_vector.end());
-	for (const auto &key : key_vector) {
+	return key_vector;
+}
+
+// The attributes in `keys`, in the format of the inventory API.
+static string MakePayload(const kvp::KeyValuesMap &inv_data, const vector<string> &keys) {
+	stringstream top_ss;
+	top_ss << "[";
+	for (const auto &key : keys) {
+		const auto &values = inv_data.at(key);
 		top_ss << R"({"name":")";
 		top_ss << json::EscapeString(key);
 		top_ss << R"(","value":)";
-		if (inv_data[key].size() == 1) {
-			top_ss << "\"" + json::EscapeString(inv_data[key][0]) + "\"";
+		if (values.size() == 1) {
+			top_ss << "\"" + json::EscapeString(values[0]) + "\"";
 		} else {
 			stringstream items_ss;
 			items_ss << "[";
-			for (const auto &str : inv_data[key]) {
+			for (const auto &str : values) {
 				items_ss << "\"" + json::EscapeString(str) + "\",";
 			}
 			auto items_str = items_ss.str();
@@ -125,6 +193,115 @@ error::Error InventoryClient::PushInventoryData(
 		payload.pop_back();
 	}
 	payload.push_back(']');
+	return payload;
+}
+
+struct SubmittedInventory {
+	kvp::KeyValuesMap attributes;
+	// Seconds since the epoch.
+	int64_t full_submission_time;
+};
+
+static int64_t SecondsSinceEpoch() {
+	return chrono::duration_cast<chrono::seconds>(chrono::system_clock::now().time_since_epoch())
+		.count();
+}
+
+static expected::expected<SubmittedInventory, error::Error> LoadSubmittedInventory(
+	kv_db::KeyValueDatabase &db) {
+	auto exp_bytes = db.Read(context::MenderContext::submitted_inventory_key);
+	if (!exp_bytes) {
+		return expected::unexpected(exp_bytes.error());
+	}
+	auto exp_json = json::Load(common::StringFromByteVector(exp_bytes.value()));
+	if (!exp_json) {
+		return expected::unexpected(exp_json.error());
+	}
+
+	SubmittedInventory submitted;
+	auto exp_time = exp_json.value().Get("full_submission_time").and_then(json::ToInt64);
+	if (!exp_time) {
+		return expected::unexpected(exp_time.error());
+	}
+	submitted.full_submission_time = exp_time.value();
+
+	// The attributes are an array, like in the payload, rather than an object, since the keys of
+	// JSON objects are case insensitive for us.
+	auto exp_attributes = exp_json.value().Get("attributes");
+	if (!exp_attributes) {
+		return expected::unexpected(exp_attributes.error());
+	}
+	auto exp_size = exp_attributes.value().GetArraySize();
+	if (!exp_size) {
+		return expected::unexpected(exp_size.error());
+	}
+	for (size_t i = 0; i < exp_size.value(); i++) {
+		auto exp_attr = exp_attributes.value().Get(i);
+		if (!exp_attr) {
+			return expected::unexpected(exp_attr.error());
+		}
+		auto exp_name = exp_attr.value().Get("name").and_then(json::ToString);
+		if (!exp_name) {
+			return expected::unexpected(exp_name.error());
+		}
+		auto exp_value = exp_attr.value().Get("value");
+		if (!exp_value) {
+			return expected::unexpected(exp_value.error());
+		}
+		if (exp_value.value().IsString()) {
+			submitted.attributes[exp_name.value()] = {exp_value.value().GetString().value()};
+			continue;
+		}
+		auto exp_values = json::ToStringVector(exp_value.value());
+		if (!exp_values) {
+			return expected::unexpected(exp_values.error());
+		}
+		submitted.attributes[exp_name.value()] = exp_values.value();
+	}
+	return submitted;
+}
+
+static error::Error SaveSubmittedInventory(
+	kv_db::KeyValueDatabase &db, const string &payload, int64_t full_submission_time) {
+	const string record = R"({"full_submission_time":)" + to_string(full_submission_time)
+						  + R"(,"attributes":)" + payload + "}";
+	return db.Write(
+		context::MenderContext::submitted_inventory_key, common::ByteVectorFromString(record));
+}
+
+error::Error InventoryClient::PushInventoryData(
+	const string &inventory_generators_dir,
+	const RuntimeAttributes &runtime_attributes,
+	events::EventLoop &loop,
+	api::Client &client,
+	size_t &last_data_hash,
+	APIResponseHandler api_handler) {
+	return AsyncCollectInventoryData(
+		inventory_generators_dir,
+		runtime_attributes,
+		loop,
+		client,
+		[this, &loop, &client, &last_data_hash, api_handler](
+			kvp::ExpectedKeyValuesMap ex_inv_data) {
+			if (!ex_inv_data) {
+				api_handler(APIResponse {nullopt, nullopt, ex_inv_data.error()});
+				return;
+			}
+			auto err = SubmitInventoryData(
+				ex_inv_data.value(), loop, client, last_data_hash, api_handler);
+			if (err != error::NoError) {
+				api_handler(APIResponse {nullopt, nullopt, err});
+			}
+		});
+}
+
+error::Error InventoryClient::SubmitInventoryData(
+	const kvp::KeyValuesMap &inv_data,
+	events::EventLoop &loop,
+	api::Client &client,
+	size_t &last_data_hash,
+	APIResponseHandler api_handler) {
+	auto payload = MakePayload(inv_data, SortedKeys(inv_data));
 
 	size_t payload_hash = std::hash<string> {}(payload);
 	if (payload_hash == last_data_hash) {
@@ -133,13 +310,128 @@ error::Error InventoryClient::PushInventoryData(
 		return error::NoError;
 	}
 
+	return SubmitPayload(
+		client,
+		http::Method::PUT,
+		payload,
+		[this, payload_hash, &last_data_hash]() {
+			last_data_hash = payload_hash;
+			ForgetSubmittedInventory();
+		},
+		api_handler);
+}
+
+error::Error InventoryClient::PushInventoryChanges(
+	const string &inventory_generators_dir,
+	const RuntimeAttributes &runtime_attributes,
+	events::EventLoop &loop,
+	api::Client &client,
+	APIResponseHandler api_handler) {
+	return AsyncCollectInventoryData(
+		inventory_generators_dir,
+		runtime_attributes,
+		loop,
+		client,
+		[this, &loop, &client, api_handler](kvp::ExpectedKeyValuesMap ex_inv_data) {
+			if (!ex_inv_data) {
+				api_handler(APIResponse {nullopt, nullopt, ex_inv_data.error()});
+				return;
+			}
+			auto err = SubmitInventoryChanges(ex_inv_data.value(), loop, client, api_handler);
+			if (err != error::NoError) {
+				api_handler(APIResponse {nullopt, nullopt, err});
+			}
+		});
+}
+
+error::Error InventoryClient::SubmitInventoryChanges(
+	const kvp::KeyValuesMap &inv_data,
+	events::EventLoop &loop,
+	api::Client &client,
+	APIResponseHandler api_handler) {
+	const auto keys = SortedKeys(inv_data);
+	const string full_payload = MakePayload(inv_data, keys);
+
+	const int64_t now = SecondsSinceEpoch();
+	auto method = http::Method::PUT;
+	string payload = full_payload;
+	int64_t full_submission_time = now;
+
+	auto exp_submitted = LoadSubmittedInventory(*db_);
+	if (!exp_submitted) {
+		if (exp_submitted.error().code != kv_db::MakeError(kv_db::KeyError, "").code) {
+			log::Warning(
+				"Could not load the last submitted inventory, submitting all of it: "
+				+ exp_submitted.error().String());
+		}
+	} else if (
+		full_resubmit_interval_.count() > 0
+		and now - exp_submitted.value().full_submission_time >= full_resubmit_interval_.count()) {
+		log::Debug("Submitting the complete inventory again");
+	} else {
+		const auto &submitted = exp_submitted.value().attributes;
+		vector<string> changed;
+		for (const auto &key : keys) {
+			auto found = submitted.find(key);
+			if (found == submitted.end() or found->second != inv_data.at(key)) {
+				changed.push_back(key);
+			}
+		}
+		bool removed = false;
+		for (const auto &attr : submitted) {
+			if (inv_data.count(attr.first) == 0) {
+				removed = true;
+				break;
+			}
+		}
+
+		if (removed) {
+			// Only a complete submission removes attributes on the server.
+			log::Debug("Inventory attributes have been removed, submitting all of them");
+		} else if (changed.empty()) {
+			log::Info("Inventory data unchanged, not submitting");
+			loop.Post(
+				[api_handler]() { api_handler(APIResponse {nullopt, nullopt, error::NoError}); });
+			return error::NoError;
+		} else {
+			log::Debug(
+				"Submitting the " + to_string(changed.size()) + " changed inventory attributes");
+			method = http::Method::PATCH;
+			payload = MakePayload(inv_data, changed);
+			full_submission_time = exp_submitted.value().full_submission_time;
+		}
+	}
+
+	return SubmitPayload(
+		client,
+		method,
+		payload,
+		[this, full_payload, full_submission_time]() {
+			auto err = SaveSubmittedInventory(*db_, full_payload, full_submission_time);
+			if (err != error::NoError) {
+				// A stale record would hide changes from the next submission.
+				log::Warning(
+					"Could not save the submitted inventory, the next submission will be complete: "
+					+ err.String());
+				ForgetSubmittedInventory();
+			}
+		},
+		api_handler);
+}
+
+error::Error InventoryClient::SubmitPayload(
+	api::Client &client,
+	http::Method method,
+	const string &payload,
+	function<void()> on_accepted,
+	APIResponseHandler api_handler) {
 	http::BodyGenerator payload_gen = [payload]() {
 		return make_shared<io::StringReader>(payload);
 	};
 
 	auto req = make_shared<api::APIRequest>();
 	req->SetPath(uri);
-	req->SetMethod(http::Method::PUT);
+	req->SetMethod(method);
 	req->SetHeader("Content-Type", "application/json");
 	req->SetHeader("Content-Length", to_string(payload.size()));
 	req->SetHeader("Accept", "application/json");
@@ -151,8 +443,7 @@ error::Error InventoryClient::PushInventoryData(
 		[this, received_body, api_handler](http::ExpectedIncomingResponsePtr exp_resp) {
 			this->HeaderHandler(received_body, api_handler, exp_resp);
 		},
-		[received_body, api_handler, payload_hash, &last_data_hash](
-			http::ExpectedIncomingResponsePtr exp_resp) {
+		[received_body, api_handler, on_accepted](http::ExpectedIncomingResponsePtr exp_resp) {
 			if (!exp_resp) {
 				log::Error("Request to push inventory data failed: " + exp_resp.error().message);
 				api_handler(APIResponse {nullopt, nullopt, exp_resp.error()});
@@ -167,7 +458,7 @@ error::Error InventoryClient::PushInventoryData(
 
 			if (status == http::StatusOK) {
 				log::Info("Inventory data submitted successfully");
-				last_data_hash = payload_hash;
+				on_accepted();
 				api_handler(APIResponse {status, nullopt, error::NoError});
 			} else {
 				auto ex_err_msg = api::ErrorMsgFromErrorResponse(*received_body);
@@ -188,6 +479,21 @@ error::Error InventoryClient::PushInventoryData(
 		});
 }
 
+void InventoryClient::ClearDataCache() {
+	last_data_hash_ = 0;
+	ForgetSubmittedInventory();
+}
+
+void InventoryClient::ForgetSubmittedInventory() {
+	if (db_ == nullptr) {
+		return;
+	}
+	auto err = db_->Remove(context::MenderContext::submitted_inventory_key);
+	if (err != error::NoError) {
+		log::Error("Could not remove the record of the submitted inventory: " + err.String());
+	}
+}
+
 void InventoryClient::HeaderHandler(
 	shared_ptr<vector<uint8_t>> received_body,
 	APIResponseHandler api_handler,
@@ -15,7 +15,9 @@
 #ifndef MENDER_UPDATE_INVENTORY_HPP
 #define MENDER_UPDATE_INVENTORY_HPP
 
+#include <chrono>
 #include <string>
+#include <unordered_map>
 
 #include <api/client.hpp>
 #include <common/error.hpp>
@@ -23,6 +25,8 @@
 #include <common/expected.hpp>
 #include <common/http.hpp>
 #include <common/json.hpp>
+#include <common/key_value_database.hpp>
+#include <common/key_value_parser.hpp>
 #include <common/optional.hpp>
 
 // For friend declaration below, used in tests.
@@ -39,11 +43,14 @@ namespace events = mender::common::events;
 namespace expected = mender::common::expected;
 namespace http = mender::common::http;
 namespace json = mender::common::json;
+namespace kv_db = mender::common::key_value_database;
+namespace kvp = mender::common::key_value_parser;
 
 enum InventoryErrorCode {
 	NoError = 0,
 	BadResponseError,
 	TooManyRequestsError,
+	InvalidAttributeError,
 };
 class InventoryErrorCategoryClass : public std::error_category {
 public:
@@ -63,6 +70,28 @@ struct APIResponse {
 using APIResponse = struct APIResponse;
 using APIResponseHandler = function<void(APIResponse)>;
 
+// Inventory attributes set by local applications at runtime, see
+// Documentation/io.mender.Inventory1.xml. They are merged with the output of the inventory scripts
+// on every submission, and are lost when the daemon restarts.
+class RuntimeAttributes {
+public:
+	// Upper bound, so that a misbehaving application can't grow the inventory without limit.
+	static const size_t kMaxAttributes;
+
+	// An empty value removes the attribute.
+	error::Error Set(const string &name, const string &value);
+	void Clear() {
+		attributes_.clear();
+	}
+
+	const unordered_map<string, string> &Get() const {
+		return attributes_;
+	}
+
+private:
+	unordered_map<string, string> attributes_;
+};
+
 class InventoryAPI {
 public:
 	virtual ~InventoryAPI() {
@@ -77,37 +106,86 @@ public:
 	virtual void ClearDataCache() = 0;
 
 	bool has_submitted_inventory {false};
+	RuntimeAttributes runtime_attributes;
 };
 
 class InventoryClient : public InventoryAPI {
 public:
+	InventoryClient() = default;
+	// With `changes_only`, keeps the submitted inventory in `db`, and then submits only the
+	// attributes which have changed, see `InventorySubmission` in the configuration. Otherwise
+	// removes the record, since the server may get changes which it doesn't reflect. 0 as
+	// `full_resubmit_interval` means never.
+	InventoryClient(
+		kv_db::KeyValueDatabase &db, bool changes_only, chrono::seconds full_resubmit_interval) :
+		db_ {&db},
+		changes_only_ {changes_only},
+		full_resubmit_interval_ {full_resubmit_interval} {
+	}
+
 	error::Error PushData(
 		const string &inventory_generators_dir,
 		events::EventLoop &loop,
 		api::Client &client,
 		APIResponseHandler api_handler) override {
+		if (changes_only_) {
+			return PushInventoryChanges(
+				inventory_generators_dir, runtime_attributes, loop, client, api_handler);
+		}
 		return PushInventoryData(
-			inventory_generators_dir, loop, client, last_data_hash_, api_handler);
+			inventory_generators_dir,
+			runtime_attributes,
+			loop,
+			client,
+			last_data_hash_,
+			api_handler);
 	};
 
-	void ClearDataCache() override {
-		last_data_hash_ = 0;
-	}
+	void ClearDataCache() override;
 
 private:
 	friend class ::InventoryAPITests;
 	error::Error PushInventoryData(
 		const string &inventory_generators_dir,
+		const RuntimeAttributes &runtime_attributes,
+		events::EventLoop &loop,
+		api::Client &client,
+		size_t &last_data_hash,
+		APIResponseHandler api_handler);
+	error::Error SubmitInventoryData(
+		const kvp::KeyValuesMap &inv_data,
 		events::EventLoop &loop,
 		api::Client &client,
 		size_t &last_data_hash,
 		APIResponseHandler api_handler);
+	error::Error PushInventoryChanges(
+		const string &inventory_generators_dir,
+		const RuntimeAttributes &runtime_attributes,
+		events::EventLoop &loop,
+		api::Client &client,
+		APIResponseHandler api_handler);
+	error::Error SubmitInventoryChanges(
+		const kvp::KeyValuesMap &inv_data,
+		events::EventLoop &loop,
+		api::Client &client,
+		APIResponseHandler api_handler);
+	error::Error SubmitPayload(
+		api::Client &client,
+		http::Method method,
+		const string &payload,
+		function<void()> on_accepted,
+		APIResponseHandler api_handler);
+	void ForgetSubmittedInventory();
 	void HeaderHandler(
 		shared_ptr<vector<uint8_t>> received_body,
 		APIResponseHandler api_handler,
 		http::ExpectedIncomingResponsePtr exp_resp);
 
 	size_t last_data_hash_ {0};
+
+	kv_db::KeyValueDatabase *db_ {nullptr};
+	bool changes_only_ {false};
+	chrono::seconds full_resubmit_interval_ {0};
 };
 
 } // namespace inventory
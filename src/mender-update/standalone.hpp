@@ -128,6 +128,14 @@ ResultAndError Install(
 	artifact::config::Signature verify_signature = artifact::config::Signature::Verify,
 	InstallOptions options = InstallOptions::None);
 
+// Goes through the same checks as `Install()`, including the signature, the depends and the
+// checksums of the payload, and prints what the installation would do, without installing
+// anything or running any state scripts. See Documentation/dry-run.md.
+error::Error DryRun(
+	standalone::Context &ctx,
+	const string &src,
+	artifact::config::Signature verify_signature = artifact::config::Signature::Verify);
+
 ResultAndError Resume(Context &ctx);
 ResultAndError Commit(Context &ctx);
 ResultAndError Rollback(Context &ctx);
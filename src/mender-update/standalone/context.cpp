@@ -38,6 +38,14 @@ const string StateData::kInStateArtifactRollback_Enter {"ArtifactRollback_Enter"
 const string StateData::kInStateArtifactFailure_Enter {"ArtifactFailure_Enter"};
 const string StateData::kInStateCleanup {"Cleanup"};
 
+update_module::DeploymentMetadata MakeDeploymentMetadata(const StateData &data) {
+	update_module::DeploymentMetadata metadata;
+	metadata.artifact_name = data.artifact_name;
+	metadata.artifact_group = data.artifact_group;
+	metadata.artifact_provides = data.artifact_provides.value_or(unordered_map<string, string> {});
+	return metadata;
+}
+
 } // namespace standalone
 } // namespace update
 } // namespace mender
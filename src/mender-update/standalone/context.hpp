@@ -15,6 +15,7 @@
 #ifndef MENDER_UPDATE_STANDALONE_CONTEXT_HPP
 #define MENDER_UPDATE_STANDALONE_CONTEXT_HPP
 
+#include <functional>
 #include <unordered_map>
 
 #include <common/error.hpp>
@@ -24,6 +25,7 @@
 #include <common/io.hpp>
 #include <common/optional.hpp>
 
+#include <artifact/sha/sha.hpp>
 #include <artifact/v3/scripts/executor.hpp>
 
 #include <mender-update/update_module/v3/update_module.hpp>
@@ -88,6 +90,9 @@ struct StateData {
 };
 using ExpectedOptionalStateData = expected::expected<optional<StateData>, error::Error>;
 
+// There is no deployment, and so no deployment ID, only the Artifact.
+update_module::DeploymentMetadata MakeDeploymentMetadata(const StateData &data);
+
 enum class Result {
 	NoResult = 0x0,
 
@@ -155,17 +160,26 @@ struct Context {
 	vector<string> stop_before;
 
 	string artifact_src;
+	// Expected SHA256 checksum of the whole Artifact, or empty if it shouldn't be checked.
+	string artifact_checksum;
 
 	unique_ptr<update_module::UpdateModule> update_module;
 	unique_ptr<executor::ScriptRunner> script_runner;
 
-	http::ClientPtr http_client;
+	// One for each URL the Artifact is read from, a split Artifact may have several.
+	vector<shared_ptr<http::ClientInterface>> http_clients;
 	io::ReaderPtr artifact_reader;
+	// Wraps `artifact_reader` when `artifact_checksum` is set.
+	unique_ptr<sha::Reader> checksum_reader;
 	unique_ptr<artifact::Artifact> parser;
 
 	artifact::config::Signature verify_signature;
 	InstallOptions options;
 
+	// Called with the name of every script state which is entered, such as
+	// `ArtifactInstall_Enter`, if set.
+	function<void(const string &state)> report_state;
+
 	ResultAndError result_and_error;
 };
 
@@ -0,0 +1,178 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/standalone/split_artifact.hpp>
+
+#include <common/common.hpp>
+#include <common/json.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+#include <mender-update/context.hpp>
+
+namespace mender {
+namespace update {
+namespace standalone {
+
+namespace common = mender::common;
+namespace json = mender::common::json;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+namespace context = mender::update::context;
+
+static bool IsUrl(const string &src) {
+	return src.find("http://") == 0 || src.find("https://") == 0;
+}
+
+bool IsSplitManifest(const string &src) {
+	// Leave out the query of a URL.
+	return common::EndsWith(src.substr(0, src.find('?')), kSplitManifestSuffix);
+}
+
+static string ResolvePart(const string &name, const string &manifest_src) {
+	if (IsUrl(manifest_src)) {
+		if (IsUrl(name)) {
+			return name;
+		}
+		auto dir_end = manifest_src.rfind('/', manifest_src.find('?'));
+		return manifest_src.substr(0, dir_end + 1) + name;
+	}
+	if (path::IsAbsolute(name)) {
+		return name;
+	}
+	return path::Join(path::DirName(manifest_src), name);
+}
+
+ExpectedSplitParts ParseSplitManifest(io::Reader &manifest, const string &manifest_src) {
+	auto exp_json = json::Load(manifest);
+	if (!exp_json) {
+		return expected::unexpected(
+			exp_json.error().WithContext("While parsing the split Artifact manifest"));
+	}
+
+	auto exp_parts = exp_json.value().Get("parts");
+	if (!exp_parts || !exp_parts.value().IsArray()) {
+		return expected::unexpected(context::MakeError(
+			context::ParseError, "Split Artifact manifest has no \"parts\" list"));
+	}
+	auto &parts_json = exp_parts.value();
+	auto exp_count = parts_json.GetArraySize();
+	if (!exp_count) {
+		return expected::unexpected(exp_count.error());
+	}
+	if (exp_count.value() == 0) {
+		return expected::unexpected(
+			context::MakeError(context::ParseError, "Split Artifact manifest lists no parts"));
+	}
+
+	vector<SplitPart> parts;
+	for (size_t i = 0; i < exp_count.value(); i++) {
+		auto exp_part = parts_json.Get(i);
+		if (!exp_part) {
+			return expected::unexpected(exp_part.error());
+		}
+		auto &part_json = exp_part.value();
+
+		auto exp_name = part_json.Get("name").and_then(json::ToString);
+		auto exp_size = part_json.Get("size").and_then(json::ToInt64);
+		auto exp_sha = part_json.Get("sha256sum").and_then(json::ToString);
+		if (!exp_name || !exp_size || !exp_sha || exp_name.value() == ""
+			|| exp_size.value() <= 0 || exp_sha.value().size() != 64) {
+			return expected::unexpected(context::MakeError(
+				context::ParseError,
+				"Part " + to_string(i + 1)
+					+ " of the split Artifact manifest needs a \"name\", a positive \"size\""
+					+ " and a SHA256 \"sha256sum\""));
+		}
+
+		parts.push_back(SplitPart {
+			.location = ResolvePart(exp_name.value(), manifest_src),
+			.size = exp_size.value(),
+			.sha256sum = exp_sha.value(),
+		});
+	}
+	return parts;
+}
+
+SplitArtifactReader::SplitArtifactReader(vector<SplitPart> parts, PartOpener opener) :
+	parts_ {std::move(parts)},
+	opener_ {opener} {
+}
+
+error::Error SplitArtifactReader::OpenNextPart() {
+	const auto &part = parts_[next_part_];
+	log::Info(
+		"Reading part " + to_string(next_part_ + 1) + " of " + to_string(parts_.size())
+		+ " of the Artifact: " + part.location);
+
+	auto exp_reader = opener_(part.location);
+	if (!exp_reader) {
+		return exp_reader.error().WithContext("While opening Artifact part " + part.location);
+	}
+	part_reader_ = exp_reader.value();
+	part_sha_reader_.reset(new sha::Reader(*part_reader_, part.sha256sum));
+	part_bytes_read_ = 0;
+	next_part_++;
+	return error::NoError;
+}
+
+expected::ExpectedSize SplitArtifactReader::Read(
+	vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) {
+	while (true) {
+		if (!part_sha_reader_) {
+			if (next_part_ >= parts_.size()) {
+				return 0;
+			}
+			auto err = OpenNextPart();
+			if (err != error::NoError) {
+				return expected::unexpected(err);
+			}
+		}
+
+		const auto &part = parts_[next_part_ - 1];
+
+		auto result = part_sha_reader_->Read(start, end);
+		if (!result) {
+			return expected::unexpected(
+				result.error().WithContext("While reading Artifact part " + part.location));
+		}
+
+		if (result.value() > 0) {
+			part_bytes_read_ += static_cast<int64_t>(result.value());
+			if (part_bytes_read_ > part.size) {
+				return expected::unexpected(context::MakeError(
+					context::ValueError,
+					"Artifact part " + part.location + " is larger than the "
+						+ to_string(part.size) + " bytes in the manifest"));
+			}
+			return result;
+		}
+
+		// End of the part, and its checksum matched.
+		if (part_bytes_read_ != part.size) {
+			return expected::unexpected(context::MakeError(
+				context::ValueError,
+				"Artifact part " + part.location + " is " + to_string(part_bytes_read_)
+					+ " bytes, expected " + to_string(part.size) + " bytes from the manifest"));
+		}
+		part_sha_reader_.reset();
+		part_reader_.reset();
+	}
+}
+
+} // namespace standalone
+} // namespace update
+} // namespace mender
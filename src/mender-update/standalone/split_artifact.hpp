@@ -0,0 +1,91 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#ifndef MENDER_UPDATE_STANDALONE_SPLIT_ARTIFACT_HPP
+#define MENDER_UPDATE_STANDALONE_SPLIT_ARTIFACT_HPP
+
+#include <functional>
+#include <memory>
+#include <string>
+#include <vector>
+
+#include <common/error.hpp>
+#include <common/expected.hpp>
+#include <common/io.hpp>
+
+#include <artifact/sha/sha.hpp>
+
+namespace mender {
+namespace update {
+namespace standalone {
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace expected = mender::common::expected;
+namespace io = mender::common::io;
+
+namespace sha = mender::sha;
+
+// An Artifact which is split into several files is installed from a manifest listing the parts, in
+// the order they make up the Artifact. The manifest is recognized by this suffix.
+const string kSplitManifestSuffix {".parts.json"};
+
+struct SplitPart {
+	// Path or URL of the part, already resolved against the location of the manifest.
+	string location;
+	int64_t size;
+	string sha256sum;
+};
+
+using ExpectedSplitParts = expected::expected<vector<SplitPart>, error::Error>;
+
+// True if the path or URL `src` is the manifest of a split Artifact.
+bool IsSplitManifest(const string &src);
+
+// Parses the manifest read from `manifest_src`. Relative part names are resolved against the
+// directory of the manifest, or against its URL, if it is one.
+ExpectedSplitParts ParseSplitManifest(io::Reader &manifest, const string &manifest_src);
+
+// Reads the parts one after the other, as one Artifact. Each part is only opened when the one
+// before has been read, and its size and checksum are checked when it has been read to the end,
+// so a broken part fails the installation at that point.
+class SplitArtifactReader : virtual public io::Reader {
+public:
+	using PartOpener = function<io::ExpectedReaderPtr(const string &location)>;
+
+	SplitArtifactReader(vector<SplitPart> parts, PartOpener opener);
+
+	expected::ExpectedSize Read(
+		vector<uint8_t>::iterator start, vector<uint8_t>::iterator end) override;
+
+private:
+	error::Error OpenNextPart();
+
+	vector<SplitPart> parts_;
+	PartOpener opener_;
+
+	size_t next_part_ {0};
+	int64_t part_bytes_read_ {0};
+	io::ReaderPtr part_reader_;
+	// Wraps `part_reader_`, so must be destroyed before it.
+	unique_ptr<sha::Reader> part_sha_reader_;
+};
+
+} // namespace standalone
+} // namespace update
+} // namespace mender
+
+#endif // MENDER_UPDATE_STANDALONE_SPLIT_ARTIFACT_HPP
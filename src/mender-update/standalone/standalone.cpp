@@ -14,6 +14,9 @@
 
 #include <mender-update/standalone.hpp>
 
+#include <algorithm>
+#include <iostream>
+
 #include <common/common.hpp>
 #include <common/events_io.hpp>
 #include <common/http.hpp>
@@ -516,6 +519,9 @@ error::Error PrepareContext(Context &ctx) {
 		chrono::seconds {conf.state_script_retry_timeout_seconds},
 		paths.GetArtScriptsPath(),
 		paths.GetRootfsScriptsPath()));
+	ctx.script_runner->SetWasmRuntime(conf.state_script_wasm_runtime);
+	ctx.script_runner->SetOutputLimit(
+		static_cast<size_t>(max(0, conf.state_script_output_limit_bytes)));
 
 	return error::NoError;
 }
@@ -528,9 +534,14 @@ error::Error PrepareContextFromStateData(Context &ctx, const StateData &data) {
 	}
 	ctx.update_module = std::move(exp_update_module.value());
 
+	auto err = ctx.update_module->SetDeploymentMetadata(MakeDeploymentMetadata(data));
+	if (err != error::NoError) {
+		return err;
+	}
+
 	if (data.payload_types[0] == "rootfs-image") {
 		// Special case for rootfs-image upgrades. See comments inside the function.
-		auto err = ctx.update_module->EnsureRootfsImageFileTree(
+		err = ctx.update_module->EnsureRootfsImageFileTree(
 			ctx.update_module->GetUpdateModuleWorkDir());
 		if (err != error::NoError) {
 			return err;
@@ -567,7 +578,12 @@ ResultAndError Install(
 				"Update already in progress. Please commit or roll back first")};
 	}
 
-	auto err = PrepareContext(ctx);
+	auto err = update_module::RemoveLeftoverScratchSpace(ctx.main_context);
+	if (err != error::NoError) {
+		log::Error("Could not clean up after an earlier installation: " + err.String());
+	}
+
+	err = PrepareContext(ctx);
 	if (err != error::NoError) {
 		return {Result::Failed, err};
 	}
@@ -590,6 +606,144 @@ ResultAndError Install(
 	return ctx.result_and_error;
 }
 
+error::Error DryRun(
+	standalone::Context &ctx, const string &src, artifact::config::Signature verify_signature) {
+	auto exp_in_progress = LoadStateData(ctx.main_context.GetMenderStoreDB());
+	if (!exp_in_progress) {
+		return exp_in_progress.error();
+	}
+	if (exp_in_progress.value()) {
+		return error::Error(
+			make_error_condition(errc::operation_in_progress),
+			"Update already in progress. Please commit or roll back first");
+	}
+
+	ctx.artifact_src = src;
+	auto err = OpenArtifact(ctx);
+	if (err != error::NoError) {
+		return err;
+	}
+	io::Reader &reader = ctx.checksum_reader ? *ctx.checksum_reader : *ctx.artifact_reader;
+
+	const auto &config = ctx.main_context.GetConfig();
+	auto exp_verify_keys = config.GetArtifactVerifyKeys();
+	if (!exp_verify_keys) {
+		return exp_verify_keys.error();
+	}
+
+	// The state scripts are only listed, so they go to a directory of their own, which doesn't
+	// touch the ones of an installation.
+	const string scripts_path = path::Join(config.paths.GetDataStore(), "dry-run-scripts");
+	artifact::config::ParserConfig parser_config {
+		.artifact_scripts_filesystem_path = scripts_path,
+		.artifact_scripts_version = 3,
+		.artifact_verify_keys = exp_verify_keys.value(),
+		.verify_signature = verify_signature,
+		.decryption_provider = context::ArtifactDecryptionProvider(config),
+	};
+	auto exp_parser = artifact::Parse(reader, parser_config);
+	err = path::DeleteRecursively(scripts_path);
+	if (err != error::NoError) {
+		log::Warning("Could not clean up the state scripts of the dry run: " + err.String());
+	}
+	if (!exp_parser) {
+		return exp_parser.error();
+	}
+	auto &parser = exp_parser.value();
+
+	auto exp_header = artifact::View(parser, 0);
+	if (!exp_header) {
+		return exp_header.error();
+	}
+	const auto &header = exp_header.value().header;
+
+	err = ctx.main_context.CheckArtifactDepends(header);
+	if (err != error::NoError) {
+		return err;
+	}
+	err = CheckEligibilityWindow(header);
+	if (err != error::NoError) {
+		return err;
+	}
+
+	string module_path;
+	if (header.payload_type != "") {
+		auto exp_update_module =
+			update_module::UpdateModule::Create(ctx.main_context, header.payload_type);
+		if (!exp_update_module) {
+			return exp_update_module.error();
+		}
+		module_path = exp_update_module.value()->GetUpdateModulePath();
+		if (!path::FileExists(module_path)) {
+			return context::MakeError(
+				context::NoSuchUpdateModuleError,
+				"No Update Module for the payload type '" + header.payload_type + "' in "
+					+ config.paths.GetModulesPath());
+		}
+	}
+
+	auto exp_files = context::ReadPayloads(parser);
+	if (!exp_files) {
+		return exp_files.error();
+	}
+	err = VerifyArtifactChecksum(ctx);
+	if (err != error::NoError) {
+		return err;
+	}
+
+	cout << "Dry run, nothing was installed" << endl;
+	cout << "Artifact: " << header.artifact_name << endl;
+	if (!parser.manifest_signature) {
+		cout << "Signature: none" << endl;
+	} else if (
+		verify_signature == artifact::config::Signature::Verify
+		&& !exp_verify_keys.value().empty()) {
+		cout << "Signature: verified" << endl;
+	} else {
+		cout << "Signature: not verified, no verification key configured" << endl;
+	}
+
+	if (header.payload_type == "") {
+		cout << "Payload: none, the provides of the Artifact would be committed right away"
+			 << endl;
+	} else {
+		cout << "Payload: " << header.payload_type << ", installed by " << module_path << endl;
+	}
+	int64_t payload_size {0};
+	for (const auto &file : exp_files.value()) {
+		cout << "  " << file.name << ": " << file.size << " bytes, checksum verified" << endl;
+		payload_size += file.size;
+	}
+
+	if (header.payload_type != "") {
+		// Update Modules which stream the payload don't need any space for it, so this can only
+		// be a warning, like before a deployment.
+		const auto work_path = config.paths.GetModulesWorkPath();
+		auto exp_space = io::GetAvailableSpace(work_path);
+		if (!exp_space) {
+			cout << "Free space: unknown, " << exp_space.error().String() << endl;
+		} else if (static_cast<uintmax_t>(payload_size) > exp_space.value()) {
+			cout << "Free space: only " << exp_space.value() << " bytes in " << work_path
+				 << ", the installation fails unless the Update Module streams the payload"
+				 << endl;
+		} else {
+			cout << "Free space: " << exp_space.value() << " bytes in " << work_path << endl;
+		}
+	}
+
+	vector<string> scripts;
+	if (parser.header.artifactScripts) {
+		for (const auto &script : parser.header.artifactScripts.value()) {
+			scripts.push_back(path::BaseName(script));
+		}
+	}
+	sort(scripts.begin(), scripts.end());
+	cout << "State scripts in the Artifact, not run: "
+		 << (scripts.empty() ? "none" : common::JoinStrings(scripts, ", ")) << endl;
+
+	return error::NoError;
+}
+
 ResultAndError Resume(Context &ctx) {
 	auto exp_in_progress = LoadStateData(ctx.main_context.GetMenderStoreDB());
 	if (!exp_in_progress) {
@@ -14,7 +14,10 @@
 
 #include <mender-update/standalone/states.hpp>
 
+#include <ctime>
+
 #include <common/http.hpp>
+#include <common/http_resumer.hpp>
 #include <common/events_io.hpp>
 #include <common/io.hpp>
 #include <common/key_value_database.hpp>
@@ -22,14 +25,17 @@
 #include <common/path.hpp>
 
 #include <mender-update/standalone.hpp>
+#include <mender-update/standalone/split_artifact.hpp>
 
 namespace mender {
 namespace update {
 namespace standalone {
 
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace database = mender::common::key_value_database;
 namespace events = mender::common::events;
 namespace http = mender::common::http;
+namespace http_resumer = mender::common::http::resumer;
 namespace io = mender::common::io;
 namespace log = mender::common::log;
 namespace path = mender::common::path;
@@ -77,6 +83,20 @@ void JustSaveState::OnEnterSaveState(Context &ctx, sm::EventPoster<StateEvent> &
 	poster.PostEvent(StateEvent::Success);
 }
 
+error::Error VerifyArtifactChecksum(Context &ctx) {
+	if (!ctx.checksum_reader && !IsSplitManifest(ctx.artifact_src)) {
+		return error::NoError;
+	}
+	io::Reader &reader = ctx.checksum_reader ? *ctx.checksum_reader : *ctx.artifact_reader;
+
+	io::Discard discard;
+	auto err = io::Copy(discard, reader);
+	if (err != error::NoError) {
+		return err.WithContext("While verifying the Artifact checksum");
+	}
+	return error::NoError;
+}
+
 error::Error DoEmptyPayloadArtifact(Context &ctx) {
 	if (ctx.options != InstallOptions::NoStdout) {
 		cout << "Installing artifact..." << endl;
@@ -92,8 +112,18 @@ error::Error DoEmptyPayloadArtifact(Context &ctx) {
 		[](database::Transaction &txn) { return error::NoError; });
 }
 
+static int CurrentMinuteOfDay() {
+	time_t now = time(nullptr);
+	struct tm local;
+	localtime_r(&now, &local);
+	return local.tm_hour * 60 + local.tm_min;
+}
+
 static io::ExpectedReaderPtr ReaderFromUrl(
-	events::EventLoop &loop, http::Client &http_client, const string &src) {
+	events::EventLoop &loop,
+	http::ClientInterface &http_client,
+	const cfg_parser::DownloadRateLimit &rate_limit,
+	const string &src) {
 	auto req = make_shared<http::OutgoingRequest>();
 	req->SetMethod(http::Method::GET);
 	auto err = req->SetAddress(src);
@@ -156,6 +186,12 @@ static io::ExpectedReaderPtr ReaderFromUrl(
 	// Should not happen since we have checked both `err` and `inner_err`, but just to be safe.
 	AssertOrReturnUnexpected(reader != nullptr);
 
+	if (rate_limit.Enabled()) {
+		reader = make_shared<events::io::RateLimitedAsyncReader>(loop, reader, [&rate_limit]() {
+			return rate_limit.BytesPerSecondAt(CurrentMinuteOfDay());
+		});
+	}
+
 	return make_shared<events::io::ReaderFromAsyncReader>(loop, reader);
 }
 
@@ -171,40 +207,87 @@ StateData StateDataFromPayloadHeaderView(const artifact::PayloadHeaderView &head
 	return dst;
 }
 
+error::Error CheckEligibilityWindow(const artifact::HeaderView &header) {
+	auto exp_window = context::ArtifactEligibilityWindow(header);
+	if (!exp_window) {
+		return exp_window.error();
+	}
+	const auto &window = exp_window.value();
+	const auto now = chrono::system_clock::now();
+	if (window.not_before && now < window.not_before.value()) {
+		return context::MakeError(
+			context::ValueError,
+			"Refusing to install artifact '" + header.artifact_name + "': it is not valid before "
+				+ context::FormatEligibilityTime(window.not_before.value()));
+	}
+	if (window.not_after && now > window.not_after.value()) {
+		return context::MakeError(
+			context::ValueError,
+			"Refusing to install artifact '" + header.artifact_name + "': it was only valid until "
+				+ context::FormatEligibilityTime(window.not_after.value()));
+	}
+	return error::NoError;
+}
+
+static io::ExpectedReaderPtr OpenArtifactSource(Context &ctx, const string &src) {
+	auto &config = ctx.main_context.GetConfig();
+	if (src.find("http://") == 0 || src.find("https://") == 0) {
+		// Same client as in managed mode, which retries and resumes interrupted downloads.
+		auto http_client =
+			make_shared<http_resumer::DownloadResumerClient>(config.GetHttpClientConfig(), ctx.loop);
+		ctx.http_clients.push_back(http_client);
+		return ReaderFromUrl(ctx.loop, *http_client, config.download_rate_limit, src);
+	}
+
+	auto stream = io::OpenIfstream(src);
+	if (!stream) {
+		return expected::unexpected(stream.error());
+	}
+	auto file_stream = make_shared<ifstream>(std::move(stream.value()));
+	return make_shared<io::StreamReader>(file_stream);
+}
+
+error::Error OpenArtifact(Context &ctx) {
+	auto reader = OpenArtifactSource(ctx, ctx.artifact_src);
+	if (reader && IsSplitManifest(ctx.artifact_src)) {
+		auto parts = ParseSplitManifest(*reader.value(), ctx.artifact_src);
+		if (parts) {
+			reader = make_shared<SplitArtifactReader>(
+				std::move(parts.value()),
+				[&ctx](const string &location) { return OpenArtifactSource(ctx, location); });
+		} else {
+			reader = expected::unexpected(parts.error());
+		}
+	}
+	if (!reader) {
+		return reader.error();
+	}
+	ctx.artifact_reader = reader.value();
+
+	if (ctx.artifact_checksum != "") {
+		ctx.checksum_reader.reset(new sha::Reader(*ctx.artifact_reader, ctx.artifact_checksum));
+	}
+	return error::NoError;
+}
+
 void PrepareDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 	auto &main_context = ctx.main_context;
 
-	if (ctx.artifact_src.find("http://") == 0 || ctx.artifact_src.find("https://") == 0) {
-		ctx.http_client =
-			make_shared<http::Client>(main_context.GetConfig().GetHttpClientConfig(), ctx.loop);
-		auto reader = ReaderFromUrl(ctx.loop, *ctx.http_client, ctx.artifact_src);
-		if (!reader) {
-			UpdateResult(
-				ctx.result_and_error,
-				{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary,
-				 reader.error()});
-			poster.PostEvent(StateEvent::Failure);
-			return;
-		}
-		ctx.artifact_reader = reader.value();
-	} else {
-		auto stream = io::OpenIfstream(ctx.artifact_src);
-		if (!stream) {
-			UpdateResult(
-				ctx.result_and_error,
-				{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary,
-				 stream.error()});
-			poster.PostEvent(StateEvent::Failure);
-			return;
-		}
-		auto file_stream = make_shared<ifstream>(std::move(stream.value()));
-		ctx.artifact_reader = make_shared<io::StreamReader>(file_stream);
+	auto err = OpenArtifact(ctx);
+	if (err != error::NoError) {
+		UpdateResult(
+			ctx.result_and_error,
+			{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary, err});
+		poster.PostEvent(StateEvent::Failure);
+		return;
 	}
+	io::Reader *artifact_reader =
+		ctx.checksum_reader ? ctx.checksum_reader.get() : ctx.artifact_reader.get();
 
 	string art_scripts_path = main_context.GetConfig().paths.GetArtScriptsPath();
 
 	// Clear the artifact scripts directory so we don't risk old scripts lingering.
-	auto err = path::DeleteRecursively(art_scripts_path);
+	err = path::DeleteRecursively(art_scripts_path);
 	if (err != error::NoError) {
 		UpdateResult(
 			ctx.result_and_error,
@@ -214,14 +297,25 @@ void PrepareDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &po
 		return;
 	}
 
+	auto exp_verify_keys = main_context.GetConfig().GetArtifactVerifyKeys();
+	if (!exp_verify_keys) {
+		UpdateResult(
+			ctx.result_and_error,
+			{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary,
+			 exp_verify_keys.error()});
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
+
 	artifact::config::ParserConfig config {
 		.artifact_scripts_filesystem_path = main_context.GetConfig().paths.GetArtScriptsPath(),
 		.artifact_scripts_version = 3,
-		.artifact_verify_keys = main_context.GetConfig().artifact_verify_keys,
+		.artifact_verify_keys = exp_verify_keys.value(),
 		.verify_signature = ctx.verify_signature,
+		.decryption_provider = context::ArtifactDecryptionProvider(main_context.GetConfig()),
 	};
 
-	auto exp_parser = artifact::Parse(*ctx.artifact_reader, config);
+	auto exp_parser = artifact::Parse(*artifact_reader, config);
 	if (!exp_parser) {
 		UpdateResult(
 			ctx.result_and_error,
@@ -246,6 +340,15 @@ void PrepareDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &po
 	ctx.state_data = StateDataFromPayloadHeaderView(header);
 
 	if (header.header.payload_type == "") {
+		err = VerifyArtifactChecksum(ctx);
+		if (err != error::NoError) {
+			UpdateResult(
+				ctx.result_and_error,
+				{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary, err});
+			poster.PostEvent(StateEvent::Failure);
+			return;
+		}
+
 		err = DoEmptyPayloadArtifact(ctx);
 		if (err != error::NoError) {
 			UpdateResult(
@@ -273,6 +376,15 @@ void PrepareDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &po
 	}
 	ctx.update_module = std::move(exp_update_module.value());
 
+	err = ctx.update_module->SetDeploymentMetadata(MakeDeploymentMetadata(ctx.state_data));
+	if (err != error::NoError) {
+		UpdateResult(
+			ctx.result_and_error,
+			{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary, err});
+		poster.PostEvent(StateEvent::Failure);
+		return;
+	}
+
 	err = ctx.update_module->CleanAndPrepareFileTree(
 		ctx.update_module->GetUpdateModuleWorkDir(), header);
 	if (err != error::NoError) {
@@ -287,20 +399,22 @@ void PrepareDownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &po
 		cout << "Installing artifact..." << endl;
 	}
 
-	auto exp_matches = main_context.MatchesArtifactDepends(header.header);
-	if (!exp_matches) {
+	err = main_context.CheckArtifactDepends(header.header);
+	if (err != error::NoError) {
 		UpdateResult(
 			ctx.result_and_error,
-			{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary,
-			 exp_matches.error()});
+			{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary, err});
 		poster.PostEvent(StateEvent::Failure);
 		return;
-	} else if (!exp_matches.value()) {
-		// reasons already logged
+	}
+
+	// There is nothing to wait with here, so an Artifact which isn't valid yet is refused, as
+	// well as one which is no longer valid.
+	err = CheckEligibilityWindow(header.header);
+	if (err != error::NoError) {
 		UpdateResult(
 			ctx.result_and_error,
-			{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary,
-			 error::NoError});
+			{Result::DownloadFailed | Result::Failed | Result::NoRollbackNecessary, err});
 		poster.PostEvent(StateEvent::Failure);
 		return;
 	}
@@ -345,7 +459,7 @@ error::Error DoDownloadState(Context &ctx) {
 		return err;
 	}
 
-	return error::NoError;
+	return VerifyArtifactChecksum(ctx);
 }
 
 void DownloadState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
@@ -489,6 +603,14 @@ void CleanupState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 			data.failed = true;
 			// Fall through so that we update the DB.
 		}
+
+		if (!data.failed && !data.rolled_back) {
+			// Nothing left to resume.
+			err = ctx.update_module->DeleteCheckpoints();
+			if (err != error::NoError) {
+				log::Warning(err.String());
+			}
+		}
 	}
 
 	error::Error err;
@@ -522,11 +644,29 @@ void CleanupState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
 		return;
 	}
 
+	err = update_module::RemoveScratchSpace(ctx.main_context.GetConfig());
+	if (err != error::NoError) {
+		log::Error("Could not clean up after the installation: " + err.String());
+	}
+
 	UpdateResult(ctx.result_and_error, {Result::Cleaned, error::NoError});
 	poster.PostEvent(final_event);
 }
 
 void ScriptRunnerState::OnEnter(Context &ctx, sm::EventPoster<StateEvent> &poster) {
+	if (ctx.report_state) {
+		ctx.report_state(executor::Name(state_, action_));
+	}
+
+	ctx.script_runner->SetScriptContext(
+		ctx.main_context.GetConfig().paths.GetDataStore(),
+		{
+			{"artifact_name", ctx.state_data.artifact_name},
+			{"artifact_group", ctx.state_data.artifact_group},
+		});
+	ctx.script_runner->SetEnvironment(update_module::DeploymentMetadataEnvironment(
+		MakeDeploymentMetadata(ctx.state_data),
+		ctx.update_module ? ctx.update_module->GetDeploymentMetadataFile() : ""));
 	auto err = ctx.script_runner->RunScripts(state_, action_, on_error_);
 	if (err != error::NoError) {
 		log::Error("Error executing script: " + err.String());
@@ -30,6 +30,15 @@ namespace sm = mender::common::state_machine;
 
 using StateType = sm::State<Context, StateEvent>;
 
+// Opens `ctx.artifact_src`, a file, a URL or the manifest of a split Artifact, as
+// `ctx.artifact_reader`, and `ctx.checksum_reader` on top of it if `ctx.artifact_checksum` is set.
+error::Error OpenArtifact(Context &ctx);
+// Reads what is left of the Artifact, so that its checksum covers all of it, and checks the
+// checksum. The same goes for the checksums of the parts of a split Artifact.
+error::Error VerifyArtifactChecksum(Context &ctx);
+// Whether the Artifact may be installed now, see Documentation/artifact-eligibility-window.md.
+error::Error CheckEligibilityWindow(const artifact::HeaderView &header);
+
 class SaveState : virtual public StateType {
 public:
 	SaveState(const string &state) :
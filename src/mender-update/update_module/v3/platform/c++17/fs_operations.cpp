@@ -14,7 +14,9 @@
 
 #include <mender-update/update_module/v3/update_module.hpp>
 
+#include <cctype>
 #include <cerrno>
+#include <cstdio>
 #include <fstream>
 
 #include <unistd.h>
@@ -76,8 +78,18 @@ error::Error UpdateModule::PrepareFileTreeDeviceParts(const string &path) {
 
 	const fs::path file_tree_path {path};
 
+	auto err = AddScratchPath(ctx_.GetConfig(), path);
+	if (err != error::NoError) {
+		return err;
+	}
+
 	const fs::path tmp_subdir_path = file_tree_path / "tmp";
-	auto err = path::CreateDirectories(tmp_subdir_path.string());
+	err = path::CreateDirectories(tmp_subdir_path.string());
+	if (err != error::NoError) {
+		return err;
+	}
+
+	err = WriteDeploymentMetadata(path);
 	if (err != error::NoError) {
 		return err;
 	}
@@ -174,11 +186,91 @@ error::Error UpdateModule::CleanAndPrepareFileTree(
 		return err;
 	}
 
+	err = PrepareCheckpoint(path, payload_meta_data.header.artifact_name);
+	if (err != error::NoError) {
+		return err;
+	}
+
 	// Make sure all changes are permanent, even across spontaneous reboots. We don't want to
 	// have half a tree when trying to recover from that.
 	return path::DataSyncRecursively(path);
 }
 
+// Makes a directory name out of the Artifact name. Other characters than letters, digits, '-' and
+// '.' are written as '_' and their hex code, and so is a leading '.', so that different Artifact
+// names never share a checkpoint.
+static string CheckpointName(const string &artifact_name) {
+	string name;
+	for (auto c : artifact_name) {
+		auto uc = static_cast<unsigned char>(c);
+		if (isalnum(uc) || c == '-' || (c == '.' && !name.empty())) {
+			name += c;
+		} else {
+			char hex[4];
+			snprintf(hex, sizeof(hex), "_%02X", uc);
+			name += hex;
+		}
+	}
+	if (name.empty()) {
+		name = "_";
+	}
+	return name;
+}
+
+error::Error UpdateModule::PrepareCheckpoint(const string &path, const string &artifact_name) {
+	const fs::path checkpoints_path {GetCheckpointsPath()};
+	const string name = CheckpointName(artifact_name);
+
+	std::error_code ec;
+	if (fs::exists(checkpoints_path, ec)) {
+		// Only the checkpoint of the Artifact being downloaded is of any use.
+		for (const auto &entry : fs::directory_iterator {checkpoints_path, ec}) {
+			if (entry.path().filename() == name) {
+				continue;
+			}
+			log::Info("Removing the Update Module checkpoint " + entry.path().string());
+			fs::remove_all(entry.path(), ec);
+			if (ec) {
+				return error::Error(
+					ec.default_error_condition(),
+					"Could not remove Update Module checkpoint " + entry.path().string());
+			}
+		}
+		if (ec) {
+			return error::Error(
+				ec.default_error_condition(), "Could not list Update Module checkpoints");
+		}
+	}
+
+	const fs::path checkpoint_path = checkpoints_path / name;
+	auto err = path::CreateDirectories(checkpoint_path.string());
+	if (err != error::NoError) {
+		return err;
+	}
+	if (!fs::is_empty(checkpoint_path, ec)) {
+		log::Info(
+			"Keeping the Update Module checkpoint from an earlier download of '" + artifact_name
+			+ "'");
+	}
+
+	fs::create_directory_symlink(checkpoint_path, fs::path {path} / "checkpoint", ec);
+	if (ec) {
+		return error::Error(
+			ec.default_error_condition(), "Could not link Update Module checkpoint into File Tree");
+	}
+	return error::NoError;
+}
+
+error::Error UpdateModule::DeleteCheckpoints() {
+	std::error_code ec;
+	fs::remove_all(fs::path {GetCheckpointsPath()}, ec);
+	if (ec) {
+		return error::Error(
+			ec.default_error_condition(), "Could not remove Update Module checkpoints");
+	}
+	return error::NoError;
+}
+
 error::Error UpdateModule::EnsureRootfsImageFileTree(const string &path) {
 	// Historical note: Versions of the client prior to 4.0 had the rootfs-image module built
 	// in. Because of this it has no Update Module File Tree. So if we are upgrading, we might
@@ -0,0 +1,142 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/update_module/v3/update_module.hpp>
+
+#include <filesystem>
+#include <fstream>
+#include <iterator>
+
+#include <common/common.hpp>
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace update_module {
+namespace v3 {
+
+namespace common = mender::common;
+namespace fs = std::filesystem;
+namespace log = mender::common::log;
+
+static const chrono::seconds kProgressCheckInterval {1};
+// Only the last line matters, so don't read all of a file which keeps growing.
+static const streamoff kMaxProgressRead {4096};
+
+ExpectedModuleProgress ParseModuleProgress(const string &line) {
+	auto space = line.find(' ');
+	auto exp_percentage = common::StringTo<int>(line.substr(0, space));
+	if (!exp_percentage) {
+		return expected::unexpected(
+			exp_percentage.error().WithContext("Invalid progress line '" + line + "'"));
+	}
+	if (exp_percentage.value() < 0 || exp_percentage.value() > 100) {
+		return expected::unexpected(error::Error(
+			make_error_condition(errc::invalid_argument),
+			"Progress percentage out of range in '" + line + "'"));
+	}
+
+	ModuleProgress progress;
+	progress.percentage = exp_percentage.value();
+	if (space != string::npos) {
+		progress.description = line.substr(space + 1);
+	}
+	return progress;
+}
+
+ProgressWatcher::ProgressWatcher(events::EventLoop &loop, const string &path, Handler handler) :
+	timer_ {loop},
+	path_ {path},
+	handler_ {handler} {
+}
+
+void ProgressWatcher::Start() {
+	error_code ec;
+	fs::remove(path_, ec);
+	if (ec) {
+		log::Warning("Could not remove " + path_ + ": " + ec.message());
+	}
+	last_line_.clear();
+
+	ScheduleCheck();
+}
+
+void ProgressWatcher::Stop() {
+	timer_.Cancel();
+	Check();
+}
+
+void ProgressWatcher::ScheduleCheck() {
+	timer_.AsyncWait(kProgressCheckInterval, [this](error::Error err) {
+		if (err != error::NoError) {
+			// Cancelled.
+			return;
+		}
+		Check();
+		ScheduleCheck();
+	});
+}
+
+void ProgressWatcher::Check() {
+	ifstream file(path_);
+	if (!file) {
+		// Nothing reported yet.
+		return;
+	}
+
+	file.seekg(0, ios::end);
+	streamoff size = file.tellg();
+	streamoff offset = size > kMaxProgressRead ? size - kMaxProgressRead : 0;
+	file.seekg(offset);
+	string content {istreambuf_iterator<char>(file), istreambuf_iterator<char>()};
+
+	// Only complete lines, the Update Module may be in the middle of writing the next one.
+	auto end = content.rfind('\n');
+	if (end == string::npos) {
+		return;
+	}
+	content.resize(end);
+	auto start = content.rfind('\n');
+	if (start == string::npos && offset > 0) {
+		// Too long to be a progress line.
+		return;
+	}
+	string line = start == string::npos ? content : content.substr(start + 1);
+
+	if (line == last_line_) {
+		return;
+	}
+	last_line_ = line;
+	if (line == "") {
+		return;
+	}
+
+	auto exp_progress = ParseModuleProgress(line);
+	if (!exp_progress) {
+		log::Warning(
+			"Ignoring the progress reported by the Update Module: "
+			+ exp_progress.error().String());
+		return;
+	}
+	auto &progress = exp_progress.value();
+	log::Info(
+		"Update Module progress: " + to_string(progress.percentage) + "%"
+		+ (progress.description != "" ? " " + progress.description : ""));
+	handler_(progress);
+}
+
+} // namespace v3
+} // namespace update_module
+} // namespace update
+} // namespace mender
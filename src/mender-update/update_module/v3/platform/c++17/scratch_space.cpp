@@ -0,0 +1,164 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/update_module/v3/update_module.hpp>
+
+#include <algorithm>
+#include <filesystem>
+#include <fstream>
+
+#include <common/io.hpp>
+#include <common/key_value_database.hpp>
+#include <common/log.hpp>
+#include <common/path.hpp>
+
+namespace mender {
+namespace update {
+namespace update_module {
+namespace v3 {
+
+namespace fs = std::filesystem;
+namespace kv_db = mender::common::key_value_database;
+namespace log = mender::common::log;
+namespace path = mender::common::path;
+
+static const string kScratchManifestFile {"deployment-scratch-paths"};
+
+static string ManifestPath(const conf::MenderConfig &config) {
+	return path::Join(config.paths.GetDataStore(), kScratchManifestFile);
+}
+
+static ExpectedStringVector ReadManifest(const string &manifest_path) {
+	vector<string> paths;
+	ifstream manifest(manifest_path);
+	if (!manifest) {
+		if (path::FileExists(manifest_path)) {
+			return expected::unexpected(error::Error(
+				make_error_condition(errc::io_error), "Could not read " + manifest_path));
+		}
+		return paths;
+	}
+
+	string line;
+	while (getline(manifest, line)) {
+		if (line != "") {
+			paths.push_back(line);
+		}
+	}
+	return paths;
+}
+
+// Only paths which are inside the data store, or the work directory of the Update Modules, and
+// not those directories themselves, so that a damaged manifest can't make us remove anything else.
+static bool IsScratchPath(const conf::MenderConfig &config, const string &scratch_path) {
+	for (const auto &root : {config.paths.GetDataStore(), config.paths.GetModulesWorkPath()}) {
+		auto exp_within = path::IsWithinOrEqual(scratch_path, root);
+		auto exp_contains = path::IsWithinOrEqual(root, scratch_path);
+		if (exp_within && exp_within.value() && exp_contains && !exp_contains.value()) {
+			return true;
+		}
+	}
+	return false;
+}
+
+error::Error AddScratchPath(const conf::MenderConfig &config, const string &scratch_path) {
+	const string manifest_path = ManifestPath(config);
+	auto exp_paths = ReadManifest(manifest_path);
+	if (!exp_paths) {
+		return exp_paths.error();
+	}
+	auto &paths = exp_paths.value();
+	if (find(paths.begin(), paths.end(), scratch_path) != paths.end()) {
+		return error::NoError;
+	}
+	paths.push_back(scratch_path);
+
+	string content;
+	for (const auto &p : paths) {
+		content += p + "\n";
+	}
+
+	// Replaced in one go, so that an interruption never leaves a partial manifest.
+	const string tmp_path = manifest_path + ".tmp";
+	auto exp_stream = io::OpenOfstream(tmp_path);
+	if (!exp_stream) {
+		return exp_stream.error().WithContext("Could not record the deployment scratch space");
+	}
+	auto err = io::WriteStringIntoOfstream(exp_stream.value(), content);
+	if (err != error::NoError) {
+		return err.WithContext("Could not record the deployment scratch space");
+	}
+	exp_stream.value().close();
+
+	return path::Rename(tmp_path, manifest_path);
+}
+
+error::Error RemoveScratchSpace(const conf::MenderConfig &config) {
+	const string manifest_path = ManifestPath(config);
+	auto exp_paths = ReadManifest(manifest_path);
+	if (!exp_paths) {
+		return exp_paths.error();
+	}
+
+	for (const auto &scratch_path : exp_paths.value()) {
+		if (!IsScratchPath(config, scratch_path)) {
+			log::Warning(
+				"Not removing " + scratch_path
+				+ ", it is not in the data store or the Update Module work directory");
+			continue;
+		}
+
+		error_code ec;
+		auto removed = fs::remove_all(scratch_path, ec);
+		if (ec) {
+			return error::Error(
+				ec.default_error_condition(),
+				"Could not remove the deployment scratch space " + scratch_path);
+		}
+		if (removed > 0) {
+			log::Info("Removed the deployment scratch space " + scratch_path);
+		}
+	}
+
+	error_code ec;
+	fs::remove(manifest_path, ec);
+	if (ec) {
+		return error::Error(ec.default_error_condition(), "Could not remove " + manifest_path);
+	}
+	return error::NoError;
+}
+
+error::Error RemoveLeftoverScratchSpace(MenderContext &ctx) {
+	auto &db = ctx.GetMenderStoreDB();
+	for (const auto &key :
+		 {MenderContext::state_data_key,
+		  MenderContext::state_data_key_uncommitted,
+		  MenderContext::standalone_state_key}) {
+		auto exp_data = db.Read(key);
+		if (exp_data) {
+			// Still in progress, the deployment cleans up when it ends.
+			return error::NoError;
+		}
+		if (exp_data.error().code != kv_db::MakeError(kv_db::KeyError, "").code) {
+			return exp_data.error();
+		}
+	}
+
+	return RemoveScratchSpace(ctx.GetConfig());
+}
+
+} // namespace v3
+} // namespace update_module
+} // namespace update
+} // namespace mender
@@ -22,6 +22,7 @@
 #include <common/common.hpp>
 #include <common/events.hpp>
 #include <common/log.hpp>
+#include <common/path.hpp>
 #include <common/processes.hpp>
 
 namespace mender {
@@ -32,6 +33,7 @@ namespace v3 {
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace log = mender::common::log;
+namespace path = mender::common::path;
 namespace fs = std::filesystem;
 namespace processes = mender::common::processes;
 
@@ -40,11 +42,28 @@ UpdateModule::StateRunner::StateRunner(
 	events::EventLoop &loop,
 	State state,
 	const string &module_path,
-	const string &module_work_path) :
+	const string &module_work_path,
+	ProgressHandler progress_handler,
+	unique_ptr<WorkDirQuota> quota,
+	chrono::seconds termination_grace_period,
+	const procs::SchedulingPriority &priority,
+	const map<string, string> &environment) :
 	loop(loop),
 	module_work_path(module_work_path),
-	proc({module_path, StateToString(state), module_work_path}) {
+	proc({module_path, StateToString(state), module_work_path}),
+	quota(std::move(quota)) {
 	proc.SetWorkDir(module_work_path);
+	proc.SetMaxTerminationTime(termination_grace_period);
+	proc.SetSchedulingPriority(priority);
+	proc.SetEnvironment(environment);
+	progress_watcher.reset(new ProgressWatcher(
+		loop,
+		path::Join(module_work_path, "progress"),
+		[progress_handler, state](const ModuleProgress &progress) {
+			if (progress_handler) {
+				progress_handler(state, progress);
+			}
+		}));
 }
 
 error::Error UpdateModule::StateRunner::AsyncCallState(
@@ -68,6 +87,16 @@ error::Error UpdateModule::StateRunner::AsyncCallState(
 		}
 	}
 
+	if (quota) {
+		auto err = quota->Check();
+		if (err != error::NoError) {
+			return err.WithContext(state_string);
+		}
+	}
+
+	// Before starting, so that the Update Module's first report is not removed.
+	progress_watcher->Start();
+
 	processes::OutputHandler stderr_handler {"Update Module output (stderr): "};
 
 	error::Error processStart;
@@ -99,6 +128,7 @@ error::Error UpdateModule::StateRunner::AsyncCallState(
 			processes::OutputHandler {"Update Module output (stdout): "}, stderr_handler);
 	}
 	if (processStart != error::NoError) {
+		progress_watcher->Stop();
 		return GetProcessError(processStart).WithContext(state_string);
 	}
 
@@ -114,11 +144,39 @@ error::Error UpdateModule::StateRunner::AsyncCallState(
 			ProcessFinishedHandler(state, err);
 		},
 		timeout_seconds);
+	if (err != error::NoError) {
+		progress_watcher->Stop();
+		return err;
+	}
+
+	if (quota) {
+		quota->AsyncWatch([this](error::Error err) {
+			stop_error = err;
+			proc.EnsureTerminated();
+		});
+	}
+
+	return error::NoError;
+}
 
-	return err;
+void UpdateModule::StateRunner::Terminate(const error::Error &reason) {
+	if (finished) {
+		return;
+	}
+	stop_error = reason;
+	proc.EnsureTerminated();
 }
 
 void UpdateModule::StateRunner::ProcessFinishedHandler(State state, error::Error err) {
+	finished = true;
+	progress_watcher->Stop();
+	if (quota) {
+		quota->Cancel();
+	}
+	if (stop_error != error::NoError) {
+		err = stop_error.WithContext(StateToString(state));
+	}
+
 	if (state == State::Cleanup) {
 		std::error_code ec;
 		// False is returned if the directory doesn't exist, and `ec` is only set to an
@@ -143,39 +201,57 @@ void UpdateModule::StateRunner::ProcessFinishedHandler(State state, error::Error
 	}
 }
 
+static vector<string> SystemRebootCommand(const conf::MenderConfig &config, SystemRebootKind kind) {
+	if (kind == SystemRebootKind::Rollback && !config.rollback_reboot_command.empty()) {
+		return config.rollback_reboot_command;
+	}
+	if (!config.reboot_command.empty()) {
+		return config.reboot_command;
+	}
+	return {"reboot"};
+}
+
 error::Error UpdateModule::AsyncSystemReboot(
-	events::EventLoop &event_loop, StateFinishedHandler handler) {
-	if (!system_reboot_) {
-		system_reboot_.reset(new SystemRebootRunner {vector<string> {"reboot"}, event_loop});
+	events::EventLoop &event_loop, StateFinishedHandler handler, SystemRebootKind kind) {
+	const auto &config = ctx_.GetConfig();
+	const auto command = SystemRebootCommand(config, kind);
+	// A rollback after a failed reboot into the update needs the other command.
+	if (!system_reboot_ || system_reboot_kind_ != kind) {
+		system_reboot_.reset(new SystemRebootRunner {command, event_loop});
+		system_reboot_kind_ = kind;
 	}
 
-	log::Info("Calling `reboot` command and waiting for system to restart.");
+	const string command_string = common::JoinStrings(command, " ");
+	log::Info("Calling `" + command_string + "` command and waiting for system to restart.");
 	auto err = system_reboot_->proc.Start();
 	if (err != error::NoError) {
 		return err.WithContext("Unable to call system reboot command");
 	}
 
-	err = system_reboot_->proc.AsyncWait(event_loop, [](error::Error err) {
-		// Even if it returns, give the reboot ten minutes to kill us. `handler` will only
-		// be called from the timeout handler.
+	err = system_reboot_->proc.AsyncWait(event_loop, [command_string](error::Error err) {
+		// Even if it returns, give the reboot `RebootTimeoutSeconds` to kill us. `handler`
+		// will only be called from the timeout handler. A reboot through a supervisor or a
+		// power controller typically returns right away.
 		if (err != error::NoError) {
-			log::Warning("`reboot` command returned error: " + err.String());
+			log::Warning("`" + command_string + "` command returned error: " + err.String());
 		}
 	});
 	if (err != error::NoError) {
 		return err.WithContext("Unable to wait for system reboot command");
 	}
 
-	system_reboot_->timeout.AsyncWait(chrono::minutes(10), [handler](error::Error err) {
-		if (err != error::NoError) {
-			handler(err.WithContext("UpdateModule::AsyncSystemReboot"));
-			return;
-		}
+	system_reboot_->timeout.AsyncWait(
+		chrono::seconds(config.reboot_timeout_seconds),
+		[handler, command_string](error::Error err) {
+			if (err != error::NoError) {
+				handler(err.WithContext("UpdateModule::AsyncSystemReboot"));
+				return;
+			}
 
-		handler(error::Error(
-			make_error_condition(errc::timed_out),
-			"`reboot` command did not kill us; rebooting failed"));
-	});
+			handler(error::Error(
+				make_error_condition(errc::timed_out),
+				"`" + command_string + "` command did not kill us; rebooting failed"));
+		});
 
 	return error::NoError;
 }
@@ -0,0 +1,117 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/update_module/v3/update_module.hpp>
+
+#include <filesystem>
+
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace update_module {
+namespace v3 {
+
+namespace fs = std::filesystem;
+namespace log = mender::common::log;
+
+static const chrono::seconds kQuotaCheckInterval {5};
+
+// Symbolic links are not followed, the checkpoint is counted on its own.
+static expected::ExpectedInt64 DiskUsage(const string &path) {
+	error_code ec;
+	if (!fs::exists(fs::symlink_status(path, ec))) {
+		return 0;
+	}
+
+	int64_t usage = 0;
+	for (const auto &entry : fs::recursive_directory_iterator {path, ec}) {
+		error_code entry_ec;
+		if (!fs::is_regular_file(entry.symlink_status(entry_ec))) {
+			continue;
+		}
+		auto size = entry.file_size(entry_ec);
+		if (!entry_ec) {
+			usage += static_cast<int64_t>(size);
+		}
+	}
+	if (ec) {
+		return expected::unexpected(error::Error(
+			ec.default_error_condition(), "Could not determine the disk usage of " + path));
+	}
+	return usage;
+}
+
+WorkDirQuota::WorkDirQuota(events::EventLoop &loop, const vector<string> &paths, int64_t limit) :
+	timer_ {loop},
+	paths_ {paths},
+	limit_ {limit} {
+}
+
+error::Error WorkDirQuota::Check(int64_t more) const {
+	int64_t used = 0;
+	for (const auto &path : paths_) {
+		auto exp_usage = DiskUsage(path);
+		if (!exp_usage) {
+			return exp_usage.error();
+		}
+		used += exp_usage.value();
+	}
+
+	if (used + more <= limit_) {
+		return error::NoError;
+	}
+
+	string message = "The File Tree takes up " + to_string(used) + " bytes";
+	if (more > 0) {
+		message += ", and needs " + to_string(more) + " more";
+	}
+	return context::MakeError(
+		context::WorkDirQuotaExceededError,
+		message + ", which exceeds the quota of " + to_string(limit_)
+			+ " bytes set by ModuleWorkDirQuotaBytes");
+}
+
+void WorkDirQuota::AsyncWatch(function<void(error::Error)> handler) {
+	handler_ = handler;
+	ScheduleCheck();
+}
+
+void WorkDirQuota::Cancel() {
+	timer_.Cancel();
+}
+
+void WorkDirQuota::ScheduleCheck() {
+	timer_.AsyncWait(kQuotaCheckInterval, [this](error::Error err) {
+		if (err != error::NoError) {
+			// Cancelled.
+			return;
+		}
+
+		err = Check();
+		if (err.code == context::MakeError(context::WorkDirQuotaExceededError, "").code) {
+			log::Error("Stopping the Update Module: " + err.String());
+			handler_(err);
+			return;
+		} else if (err != error::NoError) {
+			log::Warning(err.String());
+		}
+		ScheduleCheck();
+	});
+}
+
+} // namespace v3
+} // namespace update_module
+} // namespace update
+} // namespace mender
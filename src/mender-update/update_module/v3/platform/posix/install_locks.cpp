@@ -0,0 +1,155 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <mender-update/update_module/v3/update_module.hpp>
+
+#include <cerrno>
+#include <cstring>
+
+#include <fcntl.h>
+#include <unistd.h>
+
+#include <common/log.hpp>
+
+namespace mender {
+namespace update {
+namespace update_module {
+namespace v3 {
+
+namespace log = mender::common::log;
+
+static const chrono::seconds kLockRetryInterval {1};
+
+InstallLocks::InstallLocks(
+	events::EventLoop &loop, const vector<string> &paths, chrono::seconds timeout) :
+	retry_timer_ {loop},
+	paths_ {paths},
+	timeout_ {timeout} {
+}
+
+InstallLocks::~InstallLocks() {
+	Release();
+}
+
+error::Error InstallLocks::AsyncAcquire(function<void(error::Error)> handler) {
+	deadline_ = chrono::steady_clock::now() + timeout_;
+	handler_ = handler;
+	waiting_for_.clear();
+
+	// Always try from the event loop, so that the handler is never called before we return.
+	ScheduleAcquire(chrono::seconds::zero());
+	return error::NoError;
+}
+
+void InstallLocks::ScheduleAcquire(chrono::seconds delay) {
+	retry_timer_.AsyncWait(delay, [this](error::Error err) {
+		if (err != error::NoError) {
+			CallHandler(err);
+			return;
+		}
+		TryAcquireOrRetry();
+	});
+}
+
+void InstallLocks::TryAcquireOrRetry() {
+	bool was_waiting = waiting_for_ != "";
+
+	bool busy;
+	auto err = TryAcquire(busy);
+	if (err != error::NoError) {
+		CallHandler(err);
+		return;
+	}
+	if (!busy) {
+		if (was_waiting) {
+			log::Info("Package manager locks released, continuing with the installation");
+		}
+		CallHandler(error::NoError);
+		return;
+	}
+
+	if (chrono::steady_clock::now() >= deadline_) {
+		CallHandler(error::Error(
+			make_error_condition(errc::timed_out),
+			"Timed out waiting for " + waiting_for_ + " to be released"));
+		return;
+	}
+
+	if (!was_waiting) {
+		log::Info(
+			"Waiting for " + waiting_for_
+			+ " to be released by another package manager before installing the update");
+	}
+	ScheduleAcquire(kLockRetryInterval);
+}
+
+void InstallLocks::CallHandler(error::Error err) {
+	// The handler may destroy this object, so don't touch any members after calling it.
+	auto handler = handler_;
+	handler(err);
+}
+
+error::Error InstallLocks::TryAcquire(bool &busy) {
+	busy = false;
+
+	for (const auto &path : paths_) {
+		int fd = open(path.c_str(), O_RDWR | O_CREAT | O_CLOEXEC, 0640);
+		if (fd < 0) {
+			int err = errno;
+			if (err == ENOENT) {
+				// The directory does not exist, so this package manager isn't installed.
+				log::Trace("Skipping lock " + path + ": " + strerror(err));
+				continue;
+			}
+			Release();
+			return error::Error(
+				generic_category().default_error_condition(err), "Could not open lock " + path);
+		}
+
+		struct flock lock {};
+		lock.l_type = F_WRLCK;
+		lock.l_whence = SEEK_SET;
+		lock.l_start = 0;
+		lock.l_len = 0;
+		if (fcntl(fd, F_SETLK, &lock) != 0) {
+			int err = errno;
+			close(fd);
+			Release();
+			if (err == EACCES || err == EAGAIN) {
+				busy = true;
+				waiting_for_ = path;
+				return error::NoError;
+			}
+			return error::Error(
+				generic_category().default_error_condition(err), "Could not take lock " + path);
+		}
+
+		fds_.push_back(fd);
+	}
+
+	return error::NoError;
+}
+
+void InstallLocks::Release() {
+	for (auto fd : fds_) {
+		// Closing the descriptor releases the lock.
+		close(fd);
+	}
+	fds_.clear();
+}
+
+} // namespace v3
+} // namespace update_module
+} // namespace update
+} // namespace mender
@@ -14,9 +14,14 @@
 
 #include <mender-update/update_module/v3/update_module.hpp>
 
+#include <algorithm>
+#include <fstream>
+#include <sstream>
+
 #include <common/events.hpp>
 #include <common/error.hpp>
 #include <common/expected.hpp>
+#include <common/json.hpp>
 #include <common/path.hpp>
 
 namespace mender {
@@ -26,6 +31,7 @@ namespace v3 {
 
 namespace error = mender::common::error;
 namespace expected = mender::common::expected;
+namespace json = mender::common::json;
 namespace path = mender::common::path;
 
 static std::string StateString[] = {
@@ -78,10 +84,17 @@ UpdateModule::UpdateModule(
 }
 
 UpdateModule::DownloadData::DownloadData(
-	events::EventLoop &event_loop, artifact::Payload &payload) :
+	events::EventLoop &event_loop, artifact::Payload &payload, size_t buffer_size) :
 	payload_ {payload},
 	event_loop_ {event_loop} {
-	buffer_.resize(MENDER_BUFSIZE);
+	buffer_.resize(buffer_size);
+}
+
+static size_t DownloadBufferSize(const conf::MenderConfig &config) {
+	if (config.low_resource.enabled) {
+		return min(static_cast<size_t>(config.low_resource.buffer_size), size_t {MENDER_BUFSIZE});
+	}
+	return MENDER_BUFSIZE;
 }
 
 static expected::ExpectedBool HandleProvidePayloadFileSizesOutput(
@@ -127,7 +140,8 @@ void UpdateModule::AsyncDownload(
 	events::EventLoop &event_loop,
 	artifact::Payload &payload,
 	UpdateModule::StateFinishedHandler handler) {
-	download_ = make_unique<DownloadData>(event_loop, payload);
+	download_ =
+		make_unique<DownloadData>(event_loop, payload, DownloadBufferSize(ctx_.GetConfig()));
 
 	download_->download_finished_handler_ = [this, handler](error::Error err) {
 		handler(err);
@@ -152,7 +166,8 @@ void UpdateModule::AsyncDownloadWithFileSizes(
 	events::EventLoop &event_loop,
 	artifact::Payload &payload,
 	UpdateModule::StateFinishedHandler handler) {
-	download_ = make_unique<DownloadData>(event_loop, payload);
+	download_ =
+		make_unique<DownloadData>(event_loop, payload, DownloadBufferSize(ctx_.GetConfig()));
 	download_->downloading_with_sizes_ = true;
 
 	download_->download_finished_handler_ = [this, handler](error::Error err) {
@@ -164,12 +179,54 @@ void UpdateModule::AsyncDownloadWithFileSizes(
 }
 
 error::Error UpdateModule::ArtifactInstall() {
-	return CallStateNoCapture(State::ArtifactInstall);
+	if (ctx_.GetConfig().install_locks.empty()) {
+		return CallStateNoCapture(State::ArtifactInstall);
+	}
+
+	events::EventLoop loop;
+	error::Error err;
+	err = AsyncArtifactInstall(loop, [&err, &loop](error::Error inner_err) {
+		err = inner_err;
+		loop.Stop();
+	});
+
+	if (err != error::NoError) {
+		return err;
+	}
+
+	loop.Run();
+
+	state_runner_.reset();
+
+	return err;
 }
 
 error::Error UpdateModule::AsyncArtifactInstall(
 	events::EventLoop &event_loop, StateFinishedHandler handler) {
-	return AsyncCallStateNoCapture(event_loop, State::ArtifactInstall, handler);
+	const auto &config = ctx_.GetConfig();
+	if (config.install_locks.empty()) {
+		return AsyncCallStateNoCapture(event_loop, State::ArtifactInstall, handler);
+	}
+
+	install_locks_.reset(new InstallLocks(
+		event_loop, config.install_locks, chrono::seconds(config.install_lock_timeout_seconds)));
+	return install_locks_->AsyncAcquire([this, &event_loop, handler](error::Error err) {
+		if (err != error::NoError) {
+			install_locks_.reset();
+			handler(err.WithContext(StateToString(State::ArtifactInstall)));
+			return;
+		}
+
+		err = AsyncCallStateNoCapture(
+			event_loop, State::ArtifactInstall, [this, handler](error::Error err) {
+				install_locks_.reset();
+				handler(err);
+			});
+		if (err != error::NoError) {
+			install_locks_.reset();
+			handler(err);
+		}
+	});
 }
 
 static ExpectedRebootAction HandleNeedsRebootOutput(const expected::ExpectedString &exp_output) {
@@ -309,6 +366,125 @@ string UpdateModule::GetModulesWorkPath() const {
 	return update_module_workdir_;
 }
 
+string UpdateModule::GetCheckpointsPath() const {
+	return path::Join(ctx_.GetConfig().paths.GetModulesWorkPath(), "checkpoints");
+}
+
+unique_ptr<WorkDirQuota> UpdateModule::MakeWorkDirQuota(
+	events::EventLoop &loop, State state) const {
+	auto limit = ctx_.GetConfig().module_work_dir_quota_bytes;
+	// Only the states which fill the File Tree. The later ones must be able to finish, so that the
+	// deployment can be rolled back and cleaned up.
+	if (limit == 0
+		|| (state != State::Download && state != State::DownloadWithFileSizes
+			&& state != State::ArtifactInstall)) {
+		return nullptr;
+	}
+	return make_unique<WorkDirQuota>(
+		loop, vector<string> {update_module_workdir_, GetCheckpointsPath()}, limit);
+}
+
+procs::SchedulingPriority UpdateModule::InstallPriority(State state) const {
+	const auto &low_resource = ctx_.GetConfig().low_resource;
+	if (!low_resource.enabled
+		|| (state != State::Download && state != State::DownloadWithFileSizes
+			&& state != State::ArtifactInstall)) {
+		return {};
+	}
+	procs::SchedulingPriority priority {.niceness = low_resource.install_niceness};
+	if (low_resource.install_io_class == "best-effort") {
+		priority.io_class = procs::IoSchedulingClass::BestEffort;
+	} else if (low_resource.install_io_class == "idle") {
+		priority.io_class = procs::IoSchedulingClass::Idle;
+	}
+	return priority;
+}
+
+string DeploymentMetadataJson(const DeploymentMetadata &metadata) {
+	stringstream content;
+	content << R"({"deployment_id":")" << json::EscapeString(metadata.deployment_id) << R"(")";
+	content << R"(,"artifact_name":")" << json::EscapeString(metadata.artifact_name) << R"(")";
+	content << R"(,"artifact_group":")" << json::EscapeString(metadata.artifact_group) << R"(")";
+	content << R"(,"artifact_provides":{)";
+	// Sorted, so that the file only changes with the content.
+	map<string, string> provides {
+		metadata.artifact_provides.begin(), metadata.artifact_provides.end()};
+	for (auto entry = provides.begin(); entry != provides.end(); entry++) {
+		if (entry != provides.begin()) {
+			content << ",";
+		}
+		content << R"(")" << json::EscapeString(entry->first) << R"(":")"
+				<< json::EscapeString(entry->second) << R"(")";
+	}
+	content << "}";
+	if (metadata.server_deployment != "") {
+		content << R"(,"server_deployment":)" << metadata.server_deployment;
+	}
+	content << "}";
+	return content.str();
+}
+
+map<string, string> DeploymentMetadataEnvironment(
+	const DeploymentMetadata &metadata, const string &metadata_file) {
+	map<string, string> environment;
+	if (metadata.deployment_id != "") {
+		environment["MENDER_DEPLOYMENT_ID"] = metadata.deployment_id;
+	}
+	if (metadata.artifact_name != "") {
+		environment["MENDER_ARTIFACT_NAME"] = metadata.artifact_name;
+	}
+	if (metadata.artifact_group != "") {
+		environment["MENDER_ARTIFACT_GROUP"] = metadata.artifact_group;
+	}
+	if (metadata_file != "") {
+		environment["MENDER_DEPLOYMENT_METADATA"] = metadata_file;
+	}
+	return environment;
+}
+
+error::Error UpdateModule::SetDeploymentMetadata(const DeploymentMetadata &metadata) {
+	deployment_metadata_ = metadata;
+	if (!path::FileExists(path::Join(update_module_workdir_, "tmp"))) {
+		// Written when the File Tree is prepared.
+		return error::NoError;
+	}
+	return WriteDeploymentMetadata(update_module_workdir_);
+}
+
+error::Error UpdateModule::WriteDeploymentMetadata(const string &path) const {
+	if (!deployment_metadata_) {
+		return error::NoError;
+	}
+	const string file = path::Join(path, "tmp", deployment_metadata_file);
+	const string tmp_file = file + ".tmp";
+	{
+		ofstream f {tmp_file, ios::trunc};
+		f << DeploymentMetadataJson(deployment_metadata_.value());
+		if (!f) {
+			auto errnum {errno};
+			return error::Error(
+				generic_category().default_error_condition(errnum),
+				"Could not write the deployment metadata to " + tmp_file);
+		}
+	}
+	return path::Rename(tmp_file, file);
+}
+
+string UpdateModule::GetDeploymentMetadataFile() const {
+	const string file = path::Join(update_module_workdir_, "tmp", deployment_metadata_file);
+	if (!deployment_metadata_ || !path::FileExists(file)) {
+		return "";
+	}
+	return file;
+}
+
+map<string, string> UpdateModule::ModuleEnvironment() const {
+	if (!deployment_metadata_) {
+		return {};
+	}
+	return DeploymentMetadataEnvironment(deployment_metadata_.value(), GetDeploymentMetadataFile());
+}
+
 error::Error UpdateModule::GetProcessError(const error::Error &err) {
 	if (err.code == make_error_condition(errc::no_such_file_or_directory)) {
 		return context::MakeError(context::NoSuchUpdateModuleError, err.message);
@@ -318,7 +494,16 @@ error::Error UpdateModule::GetProcessError(const error::Error &err) {
 
 error::Error UpdateModule::AsyncCallStateCapture(
 	events::EventLoop &loop, State state, function<void(expected::ExpectedString)> handler) {
-	state_runner_.reset(new StateRunner(loop, state, GetModulePath(), GetModulesWorkPath()));
+	state_runner_.reset(new StateRunner(
+		loop,
+		state,
+		GetModulePath(),
+		GetModulesWorkPath(),
+		progress_handler_,
+		MakeWorkDirQuota(loop, state),
+		chrono::seconds(ctx_.GetConfig().module_termination_grace_period_seconds),
+		InstallPriority(state),
+		ModuleEnvironment()));
 
 	return state_runner_->AsyncCallState(
 		state,
@@ -355,7 +540,16 @@ expected::ExpectedString UpdateModule::CallStateCapture(State state) {
 
 error::Error UpdateModule::AsyncCallStateNoCapture(
 	events::EventLoop &loop, State state, function<void(error::Error)> handler) {
-	state_runner_.reset(new StateRunner(loop, state, GetModulePath(), GetModulesWorkPath()));
+	state_runner_.reset(new StateRunner(
+		loop,
+		state,
+		GetModulePath(),
+		GetModulesWorkPath(),
+		progress_handler_,
+		MakeWorkDirQuota(loop, state),
+		chrono::seconds(ctx_.GetConfig().module_termination_grace_period_seconds),
+		InstallPriority(state),
+		ModuleEnvironment()));
 
 	return state_runner_->AsyncCallState(
 		state,
@@ -390,8 +584,20 @@ error::Error UpdateModule::CallStateNoCapture(State state) {
 	return err;
 }
 
-void UpdateModule::SetSystemRebootRunner(unique_ptr<SystemRebootRunner> &&system_reboot_runner) {
+void UpdateModule::SetSystemRebootRunner(
+	unique_ptr<SystemRebootRunner> &&system_reboot_runner, SystemRebootKind kind) {
 	system_reboot_ = std::move(system_reboot_runner);
+	system_reboot_kind_ = kind;
+}
+
+void UpdateModule::Terminate(const error::Error &reason) {
+	if (state_runner_) {
+		state_runner_->Terminate(reason);
+	}
+	if (download_ && download_->proc_ && !download_->process_ended_) {
+		download_->stop_error_ = reason.WithContext("Download");
+		download_->proc_->EnsureTerminated();
+	}
 }
 
 } // namespace v3
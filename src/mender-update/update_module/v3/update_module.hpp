@@ -15,11 +15,15 @@
 #ifndef MENDER_UPDATE_UPDATE_MODULE_HPP
 #define MENDER_UPDATE_UPDATE_MODULE_HPP
 
-#include <vector>
+#include <chrono>
+#include <map>
 #include <string>
+#include <unordered_map>
+#include <vector>
 
 #include <client_shared/conf.hpp>
 #include <common/error.hpp>
+#include <common/events.hpp>
 #include <common/expected.hpp>
 #include <common/optional.hpp>
 #include <common/processes.hpp>
@@ -72,6 +76,98 @@ enum class State {
 
 std::string StateToString(State state);
 
+// Progress reported by the Update Module while it runs a state, see `progress` in
+// Documentation/update-modules-v3-file-api.md.
+struct ModuleProgress {
+	int percentage {0};
+	string description;
+};
+using ExpectedModuleProgress = expected::expected<ModuleProgress, error::Error>;
+using ProgressHandler = function<void(State state, const ModuleProgress &progress)>;
+
+// Parses a line of the `progress` file: a percentage, optionally followed by a space and a
+// description.
+ExpectedModuleProgress ParseModuleProgress(const string &line);
+
+// What the Update Module and the state scripts are told about the deployment in progress, see
+// Documentation/deployment-metadata.md.
+struct DeploymentMetadata {
+	// Empty for standalone installs.
+	string deployment_id;
+	string artifact_name;
+	string artifact_group;
+	unordered_map<string, string> artifact_provides;
+	// The deployment as the server sent it, as JSON, without the link to the Artifact. Empty for
+	// standalone installs.
+	string server_deployment;
+};
+
+// In the `tmp` directory of the File Tree.
+const string deployment_metadata_file {"deployment-metadata.json"};
+
+string DeploymentMetadataJson(const DeploymentMetadata &metadata);
+// The environment variables with the metadata. `MENDER_DEPLOYMENT_METADATA`, the path of the
+// metadata file, is left out if `metadata_file` is empty.
+map<string, string> DeploymentMetadataEnvironment(
+	const DeploymentMetadata &metadata, const string &metadata_file);
+
+// Follows the `progress` file while the Update Module runs, and logs the progress and calls the
+// handler whenever a new line has been written to it.
+class ProgressWatcher {
+public:
+	using Handler = function<void(const ModuleProgress &progress)>;
+
+	ProgressWatcher(events::EventLoop &loop, const string &path, Handler handler);
+
+	// Removes what an earlier state left in the file, and starts watching it.
+	void Start();
+	// Reports a line which was written since the last check, and stops watching.
+	void Stop();
+
+private:
+	void ScheduleCheck();
+	void Check();
+
+	events::Timer timer_;
+	string path_;
+	Handler handler_;
+	string last_line_;
+};
+
+// Keeps the File Tree of a deployment, and the checkpoint of the Update Module, within
+// `ModuleWorkDirQuotaBytes`.
+class WorkDirQuota {
+public:
+	WorkDirQuota(events::EventLoop &loop, const vector<string> &paths, int64_t limit);
+
+	// Returns an error if storing `more` bytes would exceed the quota.
+	error::Error Check(int64_t more = 0) const;
+
+	// Checks regularly while the Update Module runs, and calls the handler once if the quota has
+	// been exceeded.
+	void AsyncWatch(function<void(error::Error)> handler);
+	void Cancel();
+
+private:
+	void ScheduleCheck();
+
+	events::Timer timer_;
+	vector<string> paths_;
+	int64_t limit_;
+	function<void(error::Error)> handler_;
+};
+
+// The scratch space of a deployment, such as the File Tree, is recorded in a manifest before it is
+// created, so that it can be removed when the deployment ends, even if the client was interrupted
+// in the middle of it. The checkpoints are not scratch space, since they are meant to outlive
+// failed deployments.
+error::Error AddScratchPath(const conf::MenderConfig &config, const string &path);
+// Removes the recorded scratch space, and the manifest. Call it when a deployment has ended.
+error::Error RemoveScratchSpace(const conf::MenderConfig &config);
+// Removes the scratch space left behind by a deployment which never ended, unless a deployment,
+// by the daemon or standalone, is still in progress. Call it at startup.
+error::Error RemoveLeftoverScratchSpace(MenderContext &ctx);
+
 using ExpectedRebootAction = expected::expected<RebootAction, error::Error>;
 
 using ExpectedWriterHandler = function<void(io::ExpectedAsyncWriterPtr)>;
@@ -81,6 +177,12 @@ struct SystemRebootRunner {
 	events::Timer timeout;
 };
 
+// Which of `RebootCommand` and `RollbackRebootCommand` reboots the device.
+enum class SystemRebootKind {
+	Update,
+	Rollback,
+};
+
 class UpdateModule {
 public:
 	static expected::Expected<std::unique_ptr<UpdateModule>> Create(
@@ -104,6 +206,10 @@ public:
 		const string &path, artifact::PayloadHeaderView &payload_meta_data);
 	error::Error EnsureRootfsImageFileTree(const string &path);
 	error::Error DeleteFileTree(const string &path);
+	// Removes the `checkpoint` directories, which survive the File Tree so that the Update
+	// Module can resume when the same Artifact is downloaded again. Call it when the deployment
+	// has succeeded.
+	error::Error DeleteCheckpoints();
 
 	using ProvidePayloadFileSizesFinishedHandler = function<void(ExpectedBool)>;
 	using StateFinishedHandler = function<void(error::Error)>;
@@ -148,11 +254,31 @@ public:
 	error::Error Cleanup();
 	error::Error AsyncCleanup(events::EventLoop &event_loop, StateFinishedHandler handler);
 
-	error::Error AsyncSystemReboot(events::EventLoop &event_loop, StateFinishedHandler handler);
+	error::Error AsyncSystemReboot(
+		events::EventLoop &event_loop,
+		StateFinishedHandler handler,
+		SystemRebootKind kind = SystemRebootKind::Update);
 
 	static error::Error GetProcessError(const error::Error &err);
 
-	void SetSystemRebootRunner(unique_ptr<SystemRebootRunner> &&system_reboot_runner);
+	void SetSystemRebootRunner(
+		unique_ptr<SystemRebootRunner> &&system_reboot_runner,
+		SystemRebootKind kind = SystemRebootKind::Update);
+
+	// Called whenever the Update Module reports new progress, in any state.
+	void SetProgressHandler(ProgressHandler handler) {
+		progress_handler_ = handler;
+	}
+
+	// Stops the Update Module, if it is running a state or the download, which then fails with
+	// `reason`. The handler of the state is called as usual.
+	void Terminate(const error::Error &reason);
+
+	// Passed to the Update Module in every state from now on, in its environment and in the File
+	// Tree, which is updated right away if it exists.
+	error::Error SetDeploymentMetadata(const DeploymentMetadata &metadata);
+	// The path of the metadata file, if metadata has been set and the File Tree exists, or empty.
+	string GetDeploymentMetadataFile() const;
 
 private:
 	UpdateModule(MenderContext &ctx, const string &payload_type, string update_module_path);
@@ -166,6 +292,14 @@ private:
 
 	string GetModulePath() const;
 	string GetModulesWorkPath() const;
+	string GetCheckpointsPath() const;
+	// Null if there is no quota, or if it doesn't apply to the state.
+	unique_ptr<WorkDirQuota> MakeWorkDirQuota(events::EventLoop &loop, State state) const;
+	// The LowResource priority of the states which download and install the payload.
+	procs::SchedulingPriority InstallPriority(State state) const;
+	map<string, string> ModuleEnvironment() const;
+	error::Error WriteDeploymentMetadata(const string &path) const;
+	error::Error PrepareCheckpoint(const string &path, const string &artifact_name);
 
 	error::Error PrepareStreamNextPipe();
 	error::Error OpenStreamNextPipe(ExpectedWriterHandler open_handler);
@@ -195,9 +329,12 @@ private:
 	context::MenderContext &ctx_;
 	string update_module_path_;
 	string update_module_workdir_;
+	ProgressHandler progress_handler_;
+	optional<DeploymentMetadata> deployment_metadata_;
 
 	struct DownloadData {
-		DownloadData(events::EventLoop &event_loop, artifact::Payload &payload);
+		DownloadData(
+			events::EventLoop &event_loop, artifact::Payload &payload, size_t buffer_size);
 
 		artifact::Payload &payload_;
 		events::EventLoop &event_loop_;
@@ -205,6 +342,11 @@ private:
 		vector<uint8_t> buffer_;
 
 		shared_ptr<procs::Process> proc_;
+		unique_ptr<ProgressWatcher> progress_watcher_;
+		unique_ptr<WorkDirQuota> quota_;
+		// Why the Update Module was stopped, by the quota or by `Terminate()`.
+		error::Error stop_error_;
+		bool process_ended_ {false};
 
 		string stream_next_path_;
 		shared_ptr<io::Canceller> stream_next_opener_;
@@ -231,13 +373,20 @@ private:
 			events::EventLoop &loop,
 			State state,
 			const string &module_path,
-			const string &module_work_path);
+			const string &module_work_path,
+			ProgressHandler progress_handler,
+			unique_ptr<WorkDirQuota> quota,
+			chrono::seconds termination_grace_period,
+			const procs::SchedulingPriority &priority,
+			const map<string, string> &environment);
 
 		using HandlerFunction = function<void(expected::expected<optional<string>, error::Error>)>;
 
 		error::Error AsyncCallState(
 			State state, bool procOut, chrono::seconds timeout_seconds, HandlerFunction handler);
 
+		void Terminate(const error::Error &reason);
+
 	private:
 		void ProcessFinishedHandler(State state, error::Error err);
 
@@ -248,16 +397,55 @@ private:
 		procs::Process proc;
 		optional<string> output;
 		HandlerFunction handler;
+		unique_ptr<ProgressWatcher> progress_watcher;
+		unique_ptr<WorkDirQuota> quota;
+		// Why the Update Module was stopped, by the quota or by `Terminate()`.
+		error::Error stop_error;
+		bool finished {false};
 	};
 	unique_ptr<StateRunner> state_runner_;
 
+	unique_ptr<InstallLocks> install_locks_;
+
 	unique_ptr<SystemRebootRunner> system_reboot_;
+	// The kind of reboot `system_reboot_` runs the command of.
+	SystemRebootKind system_reboot_kind_ {SystemRebootKind::Update};
 
 	friend class ::UpdateModuleTests;
 };
 
 ExpectedStringVector DiscoverUpdateModules(const conf::MenderConfig &config);
 
+// Lock files of package managers, held while the Update Module installs the payload, so that they
+// cannot make conflicting changes to the system at the same time. See `install_locks` in the
+// configuration. Lock files whose directory does not exist are skipped, since the corresponding
+// package manager is then not installed.
+class InstallLocks {
+public:
+	InstallLocks(events::EventLoop &loop, const vector<string> &paths, chrono::seconds timeout);
+	~InstallLocks();
+
+	// Calls the handler when all the locks have been taken, or with an error if they could not
+	// all be taken within the timeout. The locks are released when the object is destroyed.
+	error::Error AsyncAcquire(function<void(error::Error)> handler);
+
+private:
+	void ScheduleAcquire(chrono::seconds delay);
+	void TryAcquireOrRetry();
+	// Either takes all the locks, or none of them. Sets `busy` if a lock is held by someone else.
+	error::Error TryAcquire(bool &busy);
+	void Release();
+	void CallHandler(error::Error err);
+
+	events::Timer retry_timer_;
+	vector<string> paths_;
+	chrono::seconds timeout_;
+	chrono::steady_clock::time_point deadline_;
+	vector<int> fds_;
+	string waiting_for_;
+	function<void(error::Error)> handler_;
+};
+
 class AsyncFifoOpener : virtual public io::Canceller {
 public:
 	AsyncFifoOpener(events::EventLoop &loop);
@@ -130,6 +130,10 @@ void UpdateModule::StartDownloadProcess() {
 		vector<string> {update_module_path_, download_command, update_module_workdir_});
 
 	download_->proc_->SetWorkDir(update_module_workdir_);
+	download_->proc_->SetMaxTerminationTime(
+		chrono::seconds(ctx_.GetConfig().module_termination_grace_period_seconds));
+	download_->proc_->SetSchedulingPriority(InstallPriority(State::Download));
+	download_->proc_->SetEnvironment(ModuleEnvironment());
 
 	auto err = PrepareStreamNextPipe();
 	if (err != error::NoError) {
@@ -137,6 +141,30 @@ void UpdateModule::StartDownloadProcess() {
 		return;
 	}
 
+	State state = State::Download;
+	if (download_->downloading_with_sizes_) {
+		state = State::DownloadWithFileSizes;
+	}
+
+	download_->quota_ = MakeWorkDirQuota(download_->event_loop_, state);
+	if (download_->quota_) {
+		err = download_->quota_->Check();
+		if (err != error::NoError) {
+			DownloadErrorHandler(err.WithContext(download_command));
+			return;
+		}
+	}
+
+	download_->progress_watcher_.reset(new ProgressWatcher(
+		download_->event_loop_,
+		path::Join(update_module_workdir_, "progress"),
+		[this, state](const ModuleProgress &progress) {
+			if (progress_handler_) {
+				progress_handler_(state, progress);
+			}
+		}));
+	download_->progress_watcher_->Start();
+
 	processes::OutputHandler stdout_handler {"Update Module output (stdout): "};
 	processes::OutputHandler stderr_handler {"Update Module output (stderr): "};
 
@@ -161,6 +189,14 @@ void UpdateModule::StartDownloadProcess() {
 		return;
 	}
 
+	if (download_->quota_) {
+		download_->quota_->AsyncWatch([this, download_command](error::Error err) {
+			// Reported when the process has ended, see EndDownloadLoop.
+			download_->stop_error_ = err.WithContext(download_command);
+			download_->proc_->EnsureTerminated();
+		});
+	}
+
 	DownloadErrorHandler(OpenStreamNextPipe(
 		[this](io::ExpectedAsyncWriterPtr writer) { StreamNextOpenHandler(writer); }));
 }
@@ -189,6 +225,14 @@ void UpdateModule::StreamNextOpenHandler(io::ExpectedAsyncWriterPtr writer) {
 		return;
 	}
 	auto payload_reader = make_shared<artifact::Reader>(std::move(reader.value()));
+	if (download_->quota_) {
+		// Fail before storing anything, if we already know that it will not fit.
+		auto err = download_->quota_->Check(payload_reader->Size());
+		if (err != error::NoError) {
+			DownloadErrorHandler(err.WithContext("Storing " + payload_reader->Name()));
+			return;
+		}
+	}
 
 	auto progress_reader = make_shared<progress::Reader>(payload_reader, payload_reader->Size());
 
@@ -344,16 +388,32 @@ void UpdateModule::DownloadErrorHandler(const error::Error &err) {
 }
 
 void UpdateModule::EndDownloadLoop(const error::Error &err) {
+	if (download_->quota_) {
+		download_->quota_->Cancel();
+	}
+	if (err != error::NoError && download_->stop_error_ != error::NoError) {
+		// Whatever went wrong after the Update Module was stopped, that is the cause.
+		download_->download_finished_handler_(download_->stop_error_);
+		return;
+	}
 	download_->download_finished_handler_(err);
 }
 
 void UpdateModule::DownloadTimeoutHandler() {
 	download_->proc_->EnsureTerminated();
+	download_->progress_watcher_->Stop();
 	EndDownloadLoop(error::Error(
 		make_error_condition(errc::timed_out), "Update Module Download process timed out"));
 }
 
 void UpdateModule::ProcessEndedHandler(error::Error err) {
+	download_->process_ended_ = true;
+	download_->progress_watcher_->Stop();
+	if (download_->quota_) {
+		// Files stored by us from here on are checked before storing them.
+		download_->quota_->Cancel();
+	}
+
 	if (err != error::NoError) {
 		err = GetProcessError(err);
 		DownloadErrorHandler(error::Error(
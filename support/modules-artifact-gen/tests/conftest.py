@@ -26,6 +26,16 @@ def single_file_artifact_gen_path(request):
     return os.path.join(MODULES_ARTIFACT_GEN_PATH, "single-file-artifact-gen")
 
 
+@pytest.fixture(scope="session")
+def docker_compose_artifact_gen_path(request):
+    return os.path.join(MODULES_ARTIFACT_GEN_PATH, "docker-compose-artifact-gen")
+
+
+@pytest.fixture(scope="session")
+def mender_client_artifact_gen_path(request):
+    return os.path.join(MODULES_ARTIFACT_GEN_PATH, "mender-client-artifact-gen")
+
+
 def pytest_configure(config):
     verify_sane_test_environment()
 
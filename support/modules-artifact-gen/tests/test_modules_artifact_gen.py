@@ -316,3 +316,122 @@ class TestModulesArtifactGen:
             assert "name: update-file3" not in output, output
         finally:
             shutil.rmtree(file_tree)
+
+    def test_docker_compose_update_module_gen(self, docker_compose_artifact_gen_path):
+        file_tree = tempfile.mkdtemp()
+        try:
+            compose_file = os.path.join(file_tree, "compose.yml")
+            with open(compose_file, "w") as fd:
+                fd.write("services:\n  web:\n    image: nginx:1.27\n")
+            images_file = os.path.join(file_tree, "web.tar.gz")
+            with open(images_file, "w") as fd:
+                fd.write("my-images")
+
+            artifact_file = os.path.join(file_tree, "my-artifact.mender")
+
+            cmd_args = [docker_compose_artifact_gen_path,
+                        "-n", "artifact-name",
+                        "-t", "device-type",
+                        "-p", "web-app",
+                        "-i", images_file,
+                        "--health-timeout", "30",
+                        "--prune-previous-images",
+                        "-o", artifact_file,
+                        compose_file,
+                        ]
+
+            # Execute the command
+            logger.info("Executing: %s ", cmd_args)
+            subprocess.check_call(cmd_args)
+
+            # Read back with mender-artifact
+            cmd = ["mender-artifact", "read", artifact_file]
+            logger.info("Executing: %s ", cmd)
+            output = subprocess.check_output(cmd).decode().strip()
+            assert "Name: artifact-name" in output, output
+            assert "Type: docker-compose" in output, output
+            assert "name: project_name" in output, output
+            assert "name: docker-compose.yml" in output, output
+            assert "name: health_timeout_seconds" in output, output
+            assert "name: prune_previous_images" in output, output
+            # The compression suffix is kept for docker load
+            assert "name: images-0.tar.gz" in output, output
+
+            # Check file contents
+            cmd = "tar -C %s -xf %s data/0000.tar.gz" % (file_tree, artifact_file)
+            logger.info("Executing: %s ", cmd)
+            subprocess.check_call(cmd, shell=True)
+            cmd = "tar -C %s -xzf %s/data/0000.tar.gz" % (file_tree, file_tree)
+            logger.info("Executing: %s ", cmd)
+            subprocess.check_call(cmd, shell=True)
+            with open(os.path.join(file_tree, "project_name")) as fd:
+                assert "web-app" == fd.read().strip()
+            with open(os.path.join(file_tree, "docker-compose.yml")) as fd:
+                assert "image: nginx:1.27" in fd.read()
+            with open(os.path.join(file_tree, "health_timeout_seconds")) as fd:
+                assert "30" == fd.read().strip()
+            with open(os.path.join(file_tree, "images-0.tar.gz")) as fd:
+                assert "my-images" == fd.read().strip()
+
+            # Project names which Docker Compose doesn't accept are refused
+            with pytest.raises(subprocess.CalledProcessError):
+                subprocess.check_call(
+                    [docker_compose_artifact_gen_path, "-n", "artifact-name", "-t", "device-type",
+                     "-p", "Web App", "-o", artifact_file, compose_file])
+        finally:
+            shutil.rmtree(file_tree)
+
+    def test_mender_client_update_module_gen(self, mender_client_artifact_gen_path):
+        file_tree = tempfile.mkdtemp()
+        try:
+            update_binary = os.path.join(file_tree, "new-mender-update")
+            with open(update_binary, "w") as fd:
+                fd.write("my-mender-update")
+            config_file = os.path.join(file_tree, "new-mender.conf")
+            with open(config_file, "w") as fd:
+                fd.write('{"UpdatePollIntervalSeconds": 600}')
+
+            artifact_file = os.path.join(file_tree, "my-artifact.mender")
+
+            cmd_args = [mender_client_artifact_gen_path,
+                        "-n", "artifact-name",
+                        "-t", "device-type",
+                        "--mender-update", update_binary,
+                        "--config", config_file,
+                        "-o", artifact_file,
+                        ]
+
+            # Execute the command
+            logger.info("Executing: %s ", cmd_args)
+            subprocess.check_call(cmd_args)
+
+            # Read back with mender-artifact
+            cmd = ["mender-artifact", "read", artifact_file]
+            logger.info("Executing: %s ", cmd)
+            output = subprocess.check_output(cmd).decode().strip()
+            assert "Name: artifact-name" in output, output
+            assert "Type: mender-client" in output, output
+            # The files are named as the Update Module expects them.
+            assert "name: mender-update" in output, output
+            assert "name: mender.conf" in output, output
+            assert "name: mender-auth" not in output, output
+
+            # Check file contents
+            cmd = "tar -C %s -xf %s data/0000.tar.gz" % (file_tree, artifact_file)
+            logger.info("Executing: %s ", cmd)
+            subprocess.check_call(cmd, shell=True)
+            cmd = "tar -C %s -xzf %s/data/0000.tar.gz" % (file_tree, file_tree)
+            logger.info("Executing: %s ", cmd)
+            subprocess.check_call(cmd, shell=True)
+            with open(os.path.join(file_tree, "mender-update")) as fd:
+                assert "my-mender-update" == fd.read().strip()
+            with open(os.path.join(file_tree, "mender.conf")) as fd:
+                assert "UpdatePollIntervalSeconds" in fd.read()
+
+            # An Artifact without any of the files is refused
+            with pytest.raises(subprocess.CalledProcessError):
+                subprocess.check_call(
+                    [mender_client_artifact_gen_path, "-n", "artifact-name", "-t", "device-type",
+                     "-o", artifact_file])
+        finally:
+            shutil.rmtree(file_tree)
@@ -0,0 +1,292 @@
+# Copyright 2026 Northern.tech AS
+#
+#    Licensed under the Apache License, Version 2.0 (the "License");
+#    you may not use this file except in compliance with the License.
+#    You may obtain a copy of the License at
+#
+#        http://www.apache.org/licenses/LICENSE-2.0
+#
+#    Unless required by applicable law or agreed to in writing, software
+#    distributed under the License is distributed on an "AS IS" BASIS,
+#    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#    See the License for the specific language governing permissions and
+#    limitations under the License.
+
+import json
+import os
+import pathlib
+import re
+import shutil
+import subprocess
+import threading
+
+import pytest
+
+MODULES_PATH = pathlib.Path(__file__).parent.parent.absolute()
+
+
+@pytest.fixture(scope="session")
+def rootfs_image_module_path(request):
+    return os.path.join(MODULES_PATH, "rootfs-image")
+
+
+@pytest.fixture(scope="session")
+def partition_table_module_path(request):
+    return os.path.join(MODULES_PATH, "partition-table")
+
+
+class FileTree:
+    """The File Tree of an Update Module, see Documentation/update-modules-v3-file-api.md, with
+    the data store and the configuration directory of the client, and a directory of commands
+    which come before the system ones in PATH, to stand in for the tools which need real
+    hardware."""
+
+    def __init__(self, root):
+        self.root = str(root)
+        self.files = os.path.join(self.root, "files")
+        self.datastore = os.path.join(self.root, "datastore")
+        self.conf_dir = os.path.join(self.root, "conf")
+        self.bin = os.path.join(self.root, "bin")
+        for path in ["header", "tmp", "streams"]:
+            os.makedirs(os.path.join(self.files, path))
+        for path in [self.datastore, self.conf_dir, self.bin]:
+            os.makedirs(path)
+        # Runs the module, like `unshare`, when set.
+        self.wrapper = []
+
+    def configure(self, **conf):
+        with open(os.path.join(self.conf_dir, "mender.conf"), "w") as fd:
+            json.dump(conf, fd)
+
+    def stub(self, name, script):
+        """Adds a command to PATH, as a shell script."""
+        path = os.path.join(self.bin, name)
+        with open(path, "w") as fd:
+            fd.write("#!/bin/sh\n" + script)
+        os.chmod(path, 0o755)
+
+    def set_meta_data(self, meta_data):
+        with open(os.path.join(self.files, "header", "meta-data"), "w") as fd:
+            json.dump(meta_data, fd)
+
+    def env(self):
+        env = dict(os.environ)
+        env["PATH"] = self.bin + ":" + env.get("PATH", "/usr/sbin:/usr/bin:/sbin:/bin")
+        env["MENDER_DATASTORE_DIR"] = self.datastore
+        env["MENDER_CONF_DIR"] = self.conf_dir
+        return env
+
+    def run(self, module, state, streams=None, expect_fail=False):
+        """Runs a state of the module. `streams` is a list of the names and contents of the
+        payload files, which are given to it through `stream-next`, like the client does."""
+
+        feeder = None
+        if streams is not None:
+            feeder = StreamFeeder(self.files, streams)
+            feeder.start()
+
+        try:
+            result = subprocess.run(
+                self.wrapper + [module, state, self.files],
+                cwd=self.files,
+                env=self.env(),
+                stdout=subprocess.PIPE,
+                stderr=subprocess.PIPE,
+            )
+        finally:
+            if feeder is not None:
+                feeder.stop()
+        output = result.stdout.decode() + result.stderr.decode()
+        if expect_fail:
+            assert result.returncode != 0, output
+        else:
+            assert result.returncode == 0, output
+        return result
+
+    def bootenv(self):
+        """The variables of `BootEnv` `file`."""
+        env = {}
+        path = os.path.join(self.datastore, "rootfs-image-bootenv")
+        if os.path.exists(path):
+            with open(path) as fd:
+                for line in fd:
+                    name, _, value = line.rstrip("\n").partition("=")
+                    env[name] = value
+        return env
+
+
+class StreamFeeder(threading.Thread):
+    """Gives the payload files to the module like the client does: `stream-next`, and every
+    payload file, are FIFOs, and `stream-next` is only opened for the next file once the module has
+    read the previous one, so that it doesn't go to a read of `stream-next` which hasn't ended."""
+
+    def __init__(self, files, streams):
+        super().__init__(daemon=True)
+        self.stream_next = os.path.join(files, "stream-next")
+        self.streams = []
+        for name, content in streams:
+            self.streams.append((os.path.join(files, "streams", name), name, content))
+        self.fifos = [self.stream_next] + [path for path, _, _ in self.streams]
+        for path in self.fifos:
+            if os.path.exists(path):
+                os.unlink(path)
+            os.mkfifo(path)
+        self.stopped = False
+
+    def write(self, path, content):
+        if self.stopped:
+            return False
+        try:
+            with open(path, "wb") as fd:
+                if self.stopped:
+                    return False
+                fd.write(content)
+        except BrokenPipeError:
+            return False
+        return True
+
+    def run(self):
+        for path, name, content in self.streams:
+            line = "streams/%s %d\n" % (name, len(content))
+            if not self.write(self.stream_next, line.encode()) or not self.write(path, content):
+                return
+        # An empty read marks the end of the streams.
+        self.write(self.stream_next, b"")
+
+    def stop(self):
+        self.stopped = True
+        # Lets a write which still waits for the module go, after the module has exited.
+        while self.is_alive():
+            for path in self.fifos:
+                try:
+                    os.close(os.open(path, os.O_RDONLY | os.O_NONBLOCK))
+                except OSError:
+                    pass
+            self.join(timeout=0.1)
+
+
+@pytest.fixture
+def file_tree(tmp_path):
+    return FileTree(tmp_path)
+
+
+def can_use_loop_devices():
+    return os.geteuid() == 0 and shutil.which("losetup") is not None
+
+
+def can_use_device_mapper():
+    return (
+        can_use_loop_devices()
+        and shutil.which("dmsetup") is not None
+        and subprocess.run(
+            ["dmsetup", "targets"], stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL
+        ).returncode
+        == 0
+    )
+
+
+class LoopDevices:
+    """Loop devices on image files, and device-mapper devices on them, all removed at the end of
+    the test."""
+
+    def __init__(self, root):
+        self.root = str(root)
+        self.devices = []
+        self.mapped = []
+
+    def create(self, name, size, partitions=False):
+        image = os.path.join(self.root, name)
+        with open(image, "wb") as fd:
+            fd.truncate(size)
+        args = ["losetup", "--find", "--show"]
+        if partitions:
+            args.append("--partscan")
+        device = subprocess.check_output(args + [image]).decode().strip()
+        self.devices.append(device)
+        return device
+
+    def map_linear(self, name, device, offset_sectors, sectors):
+        """A device-mapper device on part of `device`, like dm-crypt is on the partition after
+        its LUKS header."""
+        subprocess.check_call(
+            [
+                "dmsetup",
+                "create",
+                name,
+                "--table",
+                "0 %d linear %s %d" % (sectors, device, offset_sectors),
+            ]
+        )
+        self.mapped.append(name)
+        return "/dev/mapper/" + name
+
+    def cleanup(self):
+        for name in reversed(self.mapped):
+            subprocess.call(["dmsetup", "remove", name])
+        for device in reversed(self.devices):
+            subprocess.call(["losetup", "--detach", device])
+
+
+@pytest.fixture
+def loop_devices(tmp_path):
+    if not can_use_loop_devices():
+        pytest.skip("loop devices need root and losetup")
+    devices = LoopDevices(tmp_path)
+    yield devices
+    devices.cleanup()
+
+
+def can_use_ubi():
+    return os.geteuid() == 0 and all(
+        shutil.which(tool) is not None
+        for tool in ["modprobe", "rmmod", "ubiattach", "ubidetach", "ubimkvol", "ubiupdatevol"]
+    )
+
+
+class UbiDevice:
+    """A UBI device on NAND flash simulated by the nandsim kernel module."""
+
+    def __init__(self, mtd, number):
+        self.mtd = mtd
+        self.number = number
+
+    def create_volume(self, name, size):
+        """Returns the ID of the new volume."""
+        output = subprocess.check_output(
+            ["ubimkvol", "/dev/ubi%d" % self.number, "-N", name, "-s", str(size)]
+        ).decode()
+        return int(re.search("Volume ID ([0-9]+)", output).group(1))
+
+
+def simulated_nand():
+    """The number of the MTD device of nandsim, or None if there is none."""
+    for name in sorted(os.listdir("/sys/class/mtd")):
+        if not re.match("mtd[0-9]+$", name):
+            continue
+        with open(os.path.join("/sys/class/mtd", name, "name")) as fd:
+            if fd.read().startswith("NAND simulator"):
+                return int(name[len("mtd") :])
+    return None
+
+
+@pytest.fixture
+def ubi_device():
+    if not can_use_ubi():
+        pytest.skip("UBI needs root and mtd-utils")
+    for module in ["nandsim", "ubi"]:
+        if subprocess.call(["modprobe", module], stderr=subprocess.DEVNULL) != 0:
+            pytest.skip("UBI needs the nandsim and ubi kernel modules")
+    mtd = simulated_nand()
+    if mtd is None:
+        pytest.skip("nandsim has no MTD device")
+    output = subprocess.check_output(["ubiattach", "-m", str(mtd)]).decode()
+    number = int(re.search("UBI device number ([0-9]+)", output).group(1))
+    yield UbiDevice(mtd, number)
+    subprocess.call(["ubidetach", "-m", str(mtd)])
+    subprocess.call(["rmmod", "nandsim"])
+
+
+def read_at(path, offset, size):
+    with open(path, "rb") as fd:
+        fd.seek(offset)
+        return fd.read(size)
@@ -0,0 +1,149 @@
+# Copyright 2026 Northern.tech AS
+#
+#    Licensed under the Apache License, Version 2.0 (the "License");
+#    you may not use this file except in compliance with the License.
+#    You may obtain a copy of the License at
+#
+#        http://www.apache.org/licenses/LICENSE-2.0
+#
+#    Unless required by applicable law or agreed to in writing, software
+#    distributed under the License is distributed on an "AS IS" BASIS,
+#    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#    See the License for the specific language governing permissions and
+#    limitations under the License.
+
+import os
+import re
+import shutil
+import subprocess
+
+import pytest
+
+MiB = 1024 * 1024
+
+# Two partitions of 4 MiB, with room to grow the second one.
+INITIAL_LAYOUT = """label: dos
+unit: sectors
+
+start=2048, size=8192, type=83
+start=10240, size=8192, type=83
+"""
+
+
+def make_layout(*partitions):
+    return "label: dos\nunit: sectors\n\n" + "".join(
+        "start=%d, size=%d, type=83\n" % partition for partition in partitions
+    )
+
+
+def partitions(device):
+    """The start and size of every partition on the disk, in sectors."""
+    dump = subprocess.check_output(["sfdisk", "--dump", device]).decode()
+    return [
+        (int(start), int(size))
+        for start, size in re.findall(r"start= *([0-9]+), *size= *([0-9]+)", dump)
+    ]
+
+
+@pytest.fixture
+def disk(loop_devices):
+    if shutil.which("sfdisk") is None:
+        pytest.skip("needs sfdisk")
+    device = loop_devices.create("disk.img", 32 * MiB, partitions=True)
+    subprocess.run(["sfdisk", "--no-reread", device], input=INITIAL_LAYOUT.encode(), check=True)
+    subprocess.check_call(["partx", "--update", device])
+    return device
+
+
+@pytest.fixture
+def mounted_partition(disk, tmp_path):
+    """The first partition of the disk, with a filesystem which is mounted."""
+    part = disk + "p1"
+    mount_point = os.path.join(str(tmp_path), "mnt")
+    os.makedirs(mount_point)
+    subprocess.check_call(["mkfs.ext4", "-q", part])
+    subprocess.check_call(["mount", part, mount_point])
+    yield part
+    subprocess.call(["umount", mount_point])
+
+
+def set_payload(file_tree, device, layout):
+    payload = os.path.join(file_tree.files, "files")
+    os.makedirs(payload, exist_ok=True)
+    with open(os.path.join(payload, "device"), "w") as fd:
+        fd.write(device)
+    with open(os.path.join(payload, "layout"), "w") as fd:
+        fd.write(layout)
+
+
+class TestPartitionTable:
+    def test_grows_partition(self, partition_table_module_path, file_tree, disk):
+        layout = make_layout((2048, 8192), (10240, 40960))
+        set_payload(file_tree, disk, layout)
+        with open(os.path.join(file_tree.datastore, "rootfs-image-layout"), "w") as fd:
+            fd.write("recorded layout\n")
+
+        file_tree.run(partition_table_module_path, "ArtifactInstall")
+        assert partitions(disk) == [(2048, 8192), (10240, 40960)]
+        file_tree.run(partition_table_module_path, "ArtifactVerifyReboot")
+        file_tree.run(partition_table_module_path, "ArtifactCommit")
+
+        # So that the next check of rootfs-image records the new layout.
+        assert not os.path.exists(os.path.join(file_tree.datastore, "rootfs-image-layout"))
+
+    def test_verify_reboot_fails_on_other_table(self, partition_table_module_path, file_tree, disk):
+        set_payload(file_tree, disk, make_layout((2048, 8192), (10240, 40960)))
+
+        # As if the new table had not been written.
+        file_tree.run(partition_table_module_path, "ArtifactVerifyReboot", expect_fail=True)
+
+    @pytest.mark.skipif(shutil.which("mkfs.ext4") is None, reason="needs mkfs.ext4")
+    def test_refuses_to_shrink_in_use_partition(
+        self, partition_table_module_path, file_tree, disk, mounted_partition
+    ):
+        set_payload(file_tree, disk, make_layout((2048, 4096), (10240, 8192)))
+
+        result = file_tree.run(partition_table_module_path, "ArtifactInstall", expect_fail=True)
+
+        assert "its size shrinks from 8192 to 4096 sectors" in result.stderr.decode()
+        assert partitions(disk) == [(2048, 8192), (10240, 8192)]
+        assert not os.path.exists(os.path.join(file_tree.files, "tmp", "partition-table.backup"))
+
+    @pytest.mark.skipif(shutil.which("mkfs.ext4") is None, reason="needs mkfs.ext4")
+    def test_refuses_to_move_in_use_partition(
+        self, partition_table_module_path, file_tree, disk, mounted_partition
+    ):
+        set_payload(file_tree, disk, make_layout((4096, 8192), (12288, 8192)))
+
+        result = file_tree.run(partition_table_module_path, "ArtifactInstall", expect_fail=True)
+
+        assert "its start moves from sector 2048 to 4096" in result.stderr.decode()
+        assert partitions(disk) == [(2048, 8192), (10240, 8192)]
+
+    @pytest.mark.skipif(shutil.which("mkfs.ext4") is None, reason="needs mkfs.ext4")
+    def test_grows_in_use_partition(
+        self, partition_table_module_path, file_tree, disk, mounted_partition
+    ):
+        # Only the partition which isn't in use moves.
+        set_payload(file_tree, disk, make_layout((2048, 16384), (18432, 8192)))
+
+        file_tree.run(partition_table_module_path, "ArtifactInstall")
+
+        assert partitions(disk) == [(2048, 16384), (18432, 8192)]
+
+    def test_rollback_restores_backup(self, partition_table_module_path, file_tree, disk):
+        set_payload(file_tree, disk, make_layout((2048, 16384), (18432, 8192)))
+
+        file_tree.run(partition_table_module_path, "ArtifactInstall")
+        assert partitions(disk) == [(2048, 16384), (18432, 8192)]
+        file_tree.run(partition_table_module_path, "ArtifactRollback")
+
+        assert partitions(disk) == [(2048, 8192), (10240, 8192)]
+
+    def test_rollback_without_backup(self, partition_table_module_path, file_tree, disk):
+        # A deployment which failed before the table was written leaves it alone.
+        set_payload(file_tree, disk, make_layout((2048, 16384), (18432, 8192)))
+
+        file_tree.run(partition_table_module_path, "ArtifactRollback")
+
+        assert partitions(disk) == [(2048, 8192), (10240, 8192)]
@@ -0,0 +1,826 @@
+# Copyright 2026 Northern.tech AS
+#
+#    Licensed under the Apache License, Version 2.0 (the "License");
+#    you may not use this file except in compliance with the License.
+#    You may obtain a copy of the License at
+#
+#        http://www.apache.org/licenses/LICENSE-2.0
+#
+#    Unless required by applicable law or agreed to in writing, software
+#    distributed under the License is distributed on an "AS IS" BASIS,
+#    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#    See the License for the specific language governing permissions and
+#    limitations under the License.
+
+import hashlib
+import os
+import re
+import shutil
+import subprocess
+
+import pytest
+
+from conftest import can_use_device_mapper, read_at
+
+MiB = 1024 * 1024
+
+
+def partition_number(device):
+    return re.search("[0-9]+$", device).group(0)
+
+
+class TestRootfsImageBlockDevices:
+    def test_writes_inactive_partition(self, rootfs_image_module_path, file_tree, loop_devices):
+        part_a = loop_devices.create("a.img", 4 * MiB)
+        part_b = loop_devices.create("b.img", 4 * MiB)
+        file_tree.configure(RootfsPartA=part_a, RootfsPartB=part_b, BootEnv="file")
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert read_at(part_b, 0, MiB) == payload
+        assert read_at(part_a, 0, MiB) == bytes(MiB)
+        env = file_tree.bootenv()
+        assert env["mender_boot_part"] == partition_number(part_b)
+        assert env["upgrade_available"] == "1"
+
+    @pytest.mark.skipif(not can_use_device_mapper(), reason="needs device-mapper")
+    def test_writes_device_mapper_device(self, rootfs_image_module_path, file_tree, loop_devices):
+        # The device-mapper device of slot B starts 1 MiB into its partition, where dm-crypt would
+        # leave room for the LUKS header. The slot is still selected by the partition number.
+        part_a = loop_devices.create("a.img", 4 * MiB)
+        part_b = loop_devices.create("b.img", 4 * MiB)
+        header = os.urandom(MiB)
+        with open(part_b, "wb") as fd:
+            fd.write(header)
+        mapped_b = loop_devices.map_linear("mender-test-rootfs-b", part_b, 2048, 6144)
+        file_tree.configure(RootfsPartA=part_a, RootfsPartB=mapped_b, BootEnv="file")
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert read_at(part_b, 0, MiB) == header
+        assert read_at(part_b, MiB, MiB) == payload
+        assert read_at(mapped_b, 0, MiB) == payload
+        env = file_tree.bootenv()
+        assert env["mender_boot_part"] == partition_number(part_b)
+        assert env["upgrade_available"] == "1"
+
+
+@pytest.fixture
+def image_slots(file_tree):
+    """Image files as the partitions of the two slots, with `BootEnv` `file`."""
+    slots = []
+    for name in ["rootfs-a.img", "rootfs-b.img"]:
+        path = os.path.join(file_tree.root, name)
+        with open(path, "wb") as fd:
+            fd.truncate(4 * MiB)
+        slots.append(path)
+    file_tree.configure(RootfsPartA=slots[0], RootfsPartB=slots[1], BootEnv="file")
+    return slots
+
+
+class TestRootfsImageWriteJournal:
+    def journal(self, file_tree):
+        return os.path.join(file_tree.files, "tmp", "write-journal")
+
+    def interrupt(self, file_tree, size):
+        # What a power cut during the write leaves behind.
+        with open(self.journal(file_tree), "w") as fd:
+            fd.write("journal_state=writing\njournal_size=%d\n" % size)
+
+    def test_records_written_payload(self, rootfs_image_module_path, file_tree, image_slots):
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+
+        with open(self.journal(file_tree)) as fd:
+            assert fd.read() == (
+                "journal_state=written\njournal_size=%d\njournal_sha256=%s\n"
+                % (len(payload), hashlib.sha256(payload).hexdigest())
+            )
+
+    def test_refuses_interrupted_write(self, rootfs_image_module_path, file_tree, image_slots):
+        payload = os.urandom(MiB)
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        self.interrupt(file_tree, len(payload))
+
+        result = file_tree.run(rootfs_image_module_path, "ArtifactInstall", expect_fail=True)
+
+        assert "was interrupted" in result.stderr.decode()
+        assert "upgrade_available" not in file_tree.bootenv()
+
+    def test_resumes_after_interrupted_write(
+        self, rootfs_image_module_path, file_tree, image_slots
+    ):
+        # The client downloads the payload again when the deployment is resumed.
+        self.interrupt(file_tree, MiB)
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert read_at(image_slots[1], 0, MiB) == payload
+        assert file_tree.bootenv()["upgrade_available"] == "1"
+
+    def test_refuses_changed_partition(self, rootfs_image_module_path, file_tree, image_slots):
+        payload = os.urandom(MiB)
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        with open(image_slots[1], "r+b") as fd:
+            fd.seek(MiB // 2)
+            fd.write(b"changed")
+
+        result = file_tree.run(rootfs_image_module_path, "ArtifactInstall", expect_fail=True)
+
+        assert "do not match the payload" in result.stderr.decode()
+        assert "upgrade_available" not in file_tree.bootenv()
+
+    @pytest.mark.parametrize(
+        "journal",
+        [
+            "journal_state=written\njournal_size=1048576\n$(touch %(marker)s)\n",
+            "journal_state=$(touch %(marker)s)\njournal_size=1048576\n",
+            "journal_state=done\njournal_size=1048576\n",
+            "journal_state=written\njournal_size=1M\n",
+            "journal_state=written\n",
+            "journal_state=written\njournal_size=1048576\njournal_sha256=4d0bc00a\n",
+        ],
+    )
+    def test_refuses_corrupt_journal(
+        self, rootfs_image_module_path, file_tree, image_slots, journal
+    ):
+        file_tree.run(
+            rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", os.urandom(MiB))]
+        )
+        marker = os.path.join(file_tree.root, "marker")
+        with open(self.journal(file_tree), "w") as fd:
+            fd.write(journal % {"marker": marker})
+
+        result = file_tree.run(rootfs_image_module_path, "ArtifactInstall", expect_fail=True)
+
+        assert "is corrupt" in result.stderr.decode()
+        # Read as data, never run.
+        assert not os.path.exists(marker)
+
+    def test_refuses_corrupt_orig_part(self, rootfs_image_module_path, file_tree, image_slots):
+        marker = os.path.join(file_tree.root, "marker")
+        with open(os.path.join(file_tree.files, "tmp", "orig-part"), "w") as fd:
+            fd.write("orig_part_num=$(touch %s)\norig_part_num_hex=1\n" % marker)
+
+        result = file_tree.run(rootfs_image_module_path, "ArtifactRollback", expect_fail=True)
+
+        assert "Cannot parse" in result.stderr.decode()
+        assert not os.path.exists(marker)
+        assert file_tree.bootenv() == {}
+
+
+class TestRootfsImagePartitionTags:
+    def test_resolves_tags(self, rootfs_image_module_path, file_tree, loop_devices):
+        part_a = loop_devices.create("a.img", 4 * MiB)
+        part_b = loop_devices.create("b.img", 4 * MiB)
+        # Stands for the tags of a real disk.
+        file_tree.stub(
+            "findfs",
+            'case "$1" in\n'
+            "    PARTUUID=0001-02) echo %s ;;\n"
+            "    PARTLABEL=rootfs-b) echo %s ;;\n"
+            "    *) exit 1 ;;\n"
+            "esac\n" % (part_a, part_b),
+        )
+        file_tree.configure(
+            RootfsPartA="PARTUUID=0001-02", RootfsPartB="PARTLABEL=rootfs-b", BootEnv="file"
+        )
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert read_at(part_b, 0, MiB) == payload
+        assert file_tree.bootenv()["mender_boot_part"] == partition_number(part_b)
+
+    def test_fails_on_unknown_tag(self, rootfs_image_module_path, file_tree, image_slots):
+        file_tree.stub("findfs", "exit 1\n")
+        file_tree.configure(RootfsPartA=image_slots[0], RootfsPartB="UUID=missing", BootEnv="file")
+
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("rootfs.img", os.urandom(MiB))],
+            expect_fail=True,
+        )
+
+        assert "Cannot resolve UUID=missing to a device!" in result.stderr.decode()
+
+
+class TestRootfsImageDiscard:
+    def stub_blkdiscard(self, file_tree, status=0):
+        log = os.path.join(file_tree.root, "blkdiscard.log")
+        file_tree.stub("blkdiscard", 'echo "$@" >> %s\nexit %d\n' % (log, status))
+        return log
+
+    def calls(self, log):
+        if not os.path.exists(log):
+            return []
+        with open(log) as fd:
+            return fd.read().splitlines()
+
+    @pytest.mark.parametrize("discard", [True, False])
+    def test_discards_inactive_partition(
+        self, rootfs_image_module_path, file_tree, loop_devices, discard
+    ):
+        part_a = loop_devices.create("a.img", 4 * MiB)
+        part_b = loop_devices.create("b.img", 4 * MiB)
+        log = self.stub_blkdiscard(file_tree)
+        file_tree.configure(
+            RootfsPartA=part_a, RootfsPartB=part_b, BootEnv="file", DiscardInactivePartition=discard
+        )
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+
+        assert self.calls(log) == (["-f " + part_b] if discard else [])
+        assert read_at(part_b, 0, MiB) == payload
+
+    def test_failed_discard_is_not_fatal(self, rootfs_image_module_path, file_tree, loop_devices):
+        part_a = loop_devices.create("a.img", 4 * MiB)
+        part_b = loop_devices.create("b.img", 4 * MiB)
+        log = self.stub_blkdiscard(file_tree, status=1)
+        file_tree.configure(
+            RootfsPartA=part_a, RootfsPartB=part_b, BootEnv="file", DiscardInactivePartition=True
+        )
+        payload = os.urandom(MiB)
+
+        result = file_tree.run(
+            rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)]
+        )
+
+        assert self.calls(log) == ["-f " + part_b]
+        assert "could not discard" in result.stderr.decode()
+        assert read_at(part_b, 0, MiB) == payload
+
+    def test_image_files_are_not_discarded(self, rootfs_image_module_path, file_tree, image_slots):
+        log = self.stub_blkdiscard(file_tree)
+        file_tree.configure(
+            RootfsPartA=image_slots[0],
+            RootfsPartB=image_slots[1],
+            BootEnv="file",
+            DiscardInactivePartition=True,
+        )
+
+        file_tree.run(
+            rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", os.urandom(MiB))]
+        )
+
+        assert self.calls(log) == []
+
+
+@pytest.mark.skipif(shutil.which("xdelta3") is None, reason="needs xdelta3")
+class TestRootfsImageDelta:
+    def make_delta(self, file_tree, old, new):
+        paths = []
+        for name, content in [("old.img", old), ("new.img", new)]:
+            path = os.path.join(file_tree.root, name)
+            with open(path, "wb") as fd:
+                fd.write(content)
+            paths.append(path)
+        return subprocess.check_output(["xdelta3", "-e", "-c", "-s"] + paths)
+
+    def test_applies_delta_to_active_image(self, rootfs_image_module_path, file_tree, image_slots):
+        old = os.urandom(MiB)
+        new = old[: MiB // 2] + os.urandom(MiB // 2)
+        with open(image_slots[0], "r+b") as fd:
+            fd.write(old)
+        file_tree.set_meta_data(
+            {"rootfs_image_size": len(new), "rootfs_image_sha256": hashlib.sha256(new).hexdigest()}
+        )
+        delta = self.make_delta(file_tree, old, new)
+
+        file_tree.run(
+            rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img.vcdiff", delta)]
+        )
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert read_at(image_slots[1], 0, MiB) == new
+        assert file_tree.bootenv()["mender_boot_part"] == "2"
+
+    def test_refuses_delta_against_other_image(
+        self, rootfs_image_module_path, file_tree, image_slots
+    ):
+        # The active partition has another image than the one the delta was made against.
+        old = os.urandom(MiB)
+        new = old[: MiB // 2] + os.urandom(MiB // 2)
+        with open(image_slots[0], "r+b") as fd:
+            fd.write(os.urandom(MiB))
+        file_tree.set_meta_data(
+            {"rootfs_image_size": len(new), "rootfs_image_sha256": hashlib.sha256(new).hexdigest()}
+        )
+        delta = self.make_delta(file_tree, old, new)
+
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("rootfs.img.vcdiff", delta)],
+            expect_fail=True,
+        )
+
+        assert "does not match rootfs_image_sha256" in result.stderr.decode()
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall", expect_fail=True)
+
+    def test_needs_size_and_checksum(self, rootfs_image_module_path, file_tree, image_slots):
+        delta = self.make_delta(file_tree, bytes(MiB), os.urandom(MiB))
+
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("rootfs.img.vcdiff", delta)],
+            expect_fail=True,
+        )
+
+        assert "need rootfs_image_size and rootfs_image_sha256" in result.stderr.decode()
+
+
+class TestRootfsImageBootPartitions:
+    def configure_slots(self, file_tree, loop_devices):
+        slots = [
+            loop_devices.create("a.img", 4 * MiB),
+            loop_devices.create("b.img", 4 * MiB),
+            loop_devices.create("boot-a.img", MiB),
+            loop_devices.create("boot-b.img", MiB),
+        ]
+        file_tree.configure(
+            RootfsPartA=slots[0],
+            RootfsPartB=slots[1],
+            BootPartA=slots[2],
+            BootPartB=slots[3],
+            BootEnv="file",
+        )
+        return slots
+
+    def test_writes_and_switches_boot_partition(
+        self, rootfs_image_module_path, file_tree, loop_devices
+    ):
+        part_a, part_b, boot_a, boot_b = self.configure_slots(file_tree, loop_devices)
+        bootfs = os.urandom(MiB // 2)
+        rootfs = os.urandom(MiB)
+
+        file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("bootfs.img", bootfs), ("rootfs.img", rootfs)],
+        )
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert read_at(boot_b, 0, MiB // 2) == bootfs
+        assert read_at(boot_a, 0, MiB // 2) == bytes(MiB // 2)
+        assert read_at(part_b, 0, MiB) == rootfs
+        env = file_tree.bootenv()
+        assert env["mender_boot_part"] == partition_number(part_b)
+        assert env["mender_bootfs_part"] == partition_number(boot_b)
+
+        file_tree.run(rootfs_image_module_path, "ArtifactRollback")
+
+        env = file_tree.bootenv()
+        assert env["mender_boot_part"] == partition_number(part_a)
+        assert env["mender_bootfs_part"] == partition_number(boot_a)
+        assert env["upgrade_available"] == "0"
+
+    def test_refuses_boot_image_without_boot_partitions(
+        self, rootfs_image_module_path, file_tree, image_slots
+    ):
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("bootfs.img", os.urandom(MiB // 2)), ("rootfs.img", os.urandom(MiB))],
+            expect_fail=True,
+        )
+
+        assert "but BootPartA/B are not set" in result.stderr.decode()
+
+    def test_refuses_boot_image_without_rootfs_image(
+        self, rootfs_image_module_path, file_tree, loop_devices
+    ):
+        self.configure_slots(file_tree, loop_devices)
+
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("bootfs.img", os.urandom(MiB // 2))],
+            expect_fail=True,
+        )
+
+        assert "no rootfs image after the boot partition image" in result.stderr.decode()
+
+
+class TestRootfsImageUbi:
+    @pytest.mark.parametrize("by_name", [True, False])
+    def test_writes_ubi_volume(self, rootfs_image_module_path, file_tree, ubi_device, by_name):
+        volumes = [ubi_device.create_volume(name, 4 * MiB) for name in ["rootfsa", "rootfsb"]]
+        if by_name:
+            slots = ["ubi%d:%s" % (ubi_device.number, name) for name in ["rootfsa", "rootfsb"]]
+        else:
+            slots = ["ubi%d_%d" % (ubi_device.number, volume) for volume in volumes]
+        file_tree.configure(RootfsPartA=slots[0], RootfsPartB=slots[1], BootEnv="file")
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert read_at("/dev/ubi%d_%d" % (ubi_device.number, volumes[1]), 0, MiB) == payload
+        # The volume ID, also of a volume given by name.
+        assert file_tree.bootenv()["mender_boot_part"] == str(volumes[1])
+
+    def test_refuses_payload_larger_than_volume(
+        self, rootfs_image_module_path, file_tree, ubi_device
+    ):
+        for name in ["rootfsa", "rootfsb"]:
+            ubi_device.create_volume(name, MiB)
+        file_tree.configure(
+            RootfsPartA="ubi%d:rootfsa" % ubi_device.number,
+            RootfsPartB="ubi%d:rootfsb" % ubi_device.number,
+            BootEnv="file",
+        )
+
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("rootfs.img", os.urandom(2 * MiB))],
+            expect_fail=True,
+        )
+
+        assert "does not fit in inactive rootfs partition" in result.stderr.decode()
+
+    def test_fails_on_unknown_volume_name(self, rootfs_image_module_path, file_tree, image_slots):
+        file_tree.configure(RootfsPartA=image_slots[0], RootfsPartB="ubi9:missing", BootEnv="file")
+
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("rootfs.img", os.urandom(MiB))],
+            expect_fail=True,
+        )
+
+        assert "Cannot find UBI volume missing on ubi9!" in result.stderr.decode()
+
+
+class TestRootfsImageSkipIdentical:
+    block = 64 * 1024
+
+    def test_writes_only_changed_blocks(self, rootfs_image_module_path, file_tree, image_slots):
+        file_tree.configure(
+            RootfsPartA=image_slots[0],
+            RootfsPartB=image_slots[1],
+            BootEnv="file",
+            RootfsWriteSkipIdentical=True,
+            RootfsWriteBufferBytes=self.block,
+        )
+        old = os.urandom(MiB)
+        with open(image_slots[1], "r+b") as fd:
+            fd.write(old)
+        # Two changed blocks, and a partial one at the end.
+        payload = bytearray(old + os.urandom(1000))
+        for index in [3, 10]:
+            payload[index * self.block] ^= 0xFF
+        payload = bytes(payload)
+
+        result = file_tree.run(
+            rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)]
+        )
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        assert (
+            "Wrote 3 and skipped 14 identical blocks of %d bytes, out of 17" % self.block
+            in result.stderr.decode()
+        )
+        assert read_at(image_slots[1], 0, len(payload)) == payload
+
+    def test_keeps_content_instead_of_discarding(
+        self, rootfs_image_module_path, file_tree, loop_devices
+    ):
+        part_a = loop_devices.create("a.img", 4 * MiB)
+        part_b = loop_devices.create("b.img", 4 * MiB)
+        log = os.path.join(file_tree.root, "blkdiscard.log")
+        file_tree.stub("blkdiscard", 'echo "$@" >> %s\n' % log)
+        file_tree.configure(
+            RootfsPartA=part_a,
+            RootfsPartB=part_b,
+            BootEnv="file",
+            RootfsWriteSkipIdentical=True,
+            DiscardInactivePartition=True,
+        )
+        payload = os.urandom(MiB)
+        with open(part_b, "wb") as fd:
+            fd.write(payload)
+
+        result = file_tree.run(
+            rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)]
+        )
+
+        assert not os.path.exists(log)
+        assert "Wrote 0 and skipped 1 identical blocks" in result.stderr.decode()
+        assert read_at(part_b, 0, MiB) == payload
+
+
+def can_mount_namespace():
+    return (
+        os.geteuid() == 0 and shutil.which("unshare") is not None and os.path.isdir("/sys/firmware")
+    )
+
+
+class Firmware:
+    """Stands for the firmware of a device which boots the slots with `tryboot` or `efi-bootnext`:
+    the module is run in a mount namespace with a tmpfs over /sys/firmware, with what the firmware
+    puts there, and findfs tells it which slot is the running root. `reboot()` does what the
+    firmware does at a reboot."""
+
+    def __init__(self, file_tree, root):
+        self.file_tree = file_tree
+        self.state = os.path.join(file_tree.root, "firmware")
+        os.makedirs(self.state)
+        self.set("root", root)
+        file_tree.stub("findfs", "cat %s\n" % os.path.join(self.state, "root"))
+        # The firmware directories are created from the files under it.
+        file_tree.wrapper = [
+            "unshare",
+            "--mount",
+            "sh",
+            "-c",
+            "mount -t tmpfs none /sys/firmware && cp -R %s/sys/. /sys/firmware/ && exec \"$@\""
+            % self.state,
+            "sh",
+        ]
+        os.makedirs(os.path.join(self.state, "sys"))
+
+    def set(self, name, value):
+        path = os.path.join(self.state, name)
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        with open(path, "wb" if isinstance(value, bytes) else "w") as fd:
+            fd.write(value)
+
+    def get(self, name):
+        path = os.path.join(self.state, name)
+        if not os.path.exists(path):
+            return ""
+        with open(path) as fd:
+            return fd.read()
+
+    def new_boot(self, root):
+        self.set("root", root)
+        # The module tells a reboot by the boot ID, which the real one doesn't change here.
+        state = os.path.join(self.file_tree.datastore, "rootfs-image-bootswitch")
+        with open(state) as fd:
+            lines = fd.read().splitlines()
+        with open(state, "w") as fd:
+            for line in lines:
+                if line.startswith("bootswitch_boot_id="):
+                    line = "bootswitch_boot_id=before-the-reboot"
+                fd.write(line + "\n")
+
+
+class EfiBootManager(Firmware):
+    """BootCurrent, BootNext and BootOrder, which an efibootmgr stub reads and sets."""
+
+    def __init__(self, file_tree, root, order, current):
+        super().__init__(file_tree, root)
+        os.makedirs(os.path.join(self.state, "sys", "efi"))
+        self.set("order", order)
+        self.set("current", current)
+        self.set("next", "")
+        file_tree.stub(
+            "efibootmgr",
+            "cd %s\n" % self.state
+            + 'case "$*" in\n'
+            '    "")\n'
+            '        echo "BootCurrent: $(cat current)"\n'
+            '        if [ -s next ]; then echo "BootNext: $(cat next)"; fi\n'
+            '        echo "BootOrder: $(cat order)"\n'
+            "        ;;\n"
+            '    "-q -n "*) echo "$3" > next ;;\n'
+            '    "-q -o "*) echo "$3" > order ;;\n'
+            '    "-q -N") test -s next && : > next ;;\n'
+            "    *) exit 1 ;;\n"
+            "esac\n",
+        )
+
+    def reboot(self, root):
+        order = self.get("order").strip()
+        self.set("current", self.get("next").strip() or order.split(",")[0])
+        self.set("next", "")
+        self.new_boot(root)
+
+
+@pytest.mark.skipif(not can_mount_namespace(), reason="needs root and unshare")
+class TestRootfsImageEfiBootNext:
+    def install(self, module, file_tree, loop_devices):
+        part_a = loop_devices.create("a.img", 4 * MiB)
+        part_b = loop_devices.create("b.img", 4 * MiB)
+        file_tree.configure(
+            RootfsPartA=part_a,
+            RootfsPartB=part_b,
+            BootEnv="efi-bootnext",
+            BootEfiEntryA="0001",
+            BootEfiEntryB="0002",
+        )
+        firmware = EfiBootManager(file_tree, part_a, "0001,0002,0003", "0001")
+        payload = os.urandom(MiB)
+
+        file_tree.run(module, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(module, "ArtifactInstall")
+
+        assert read_at(part_b, 0, MiB) == payload
+        # Tried once, at the next boot.
+        assert firmware.get("next").strip() == "0002"
+        assert firmware.get("order").strip() == "0001,0002,0003"
+        return part_a, part_b, firmware
+
+    def test_commits_tried_slot(self, rootfs_image_module_path, file_tree, loop_devices):
+        part_a, part_b, firmware = self.install(rootfs_image_module_path, file_tree, loop_devices)
+        firmware.reboot(part_b)
+
+        file_tree.run(rootfs_image_module_path, "ArtifactVerifyReboot")
+        file_tree.run(rootfs_image_module_path, "ArtifactCommit")
+
+        assert firmware.get("order").strip() == "0002,0001,0003"
+        assert firmware.get("next").strip() == ""
+
+    def test_rolls_back_after_failed_boot(self, rootfs_image_module_path, file_tree, loop_devices):
+        part_a, part_b, firmware = self.install(rootfs_image_module_path, file_tree, loop_devices)
+        # The tried slot didn't come up, and the firmware booted the default one again.
+        firmware.set("next", "")
+        firmware.reboot(part_a)
+
+        file_tree.run(rootfs_image_module_path, "ArtifactVerifyReboot", expect_fail=True)
+        file_tree.run(rootfs_image_module_path, "ArtifactRollback")
+        file_tree.run(rootfs_image_module_path, "ArtifactVerifyRollbackReboot")
+
+        assert firmware.get("order").strip() == "0001,0002,0003"
+        assert firmware.get("next").strip() == ""
+
+    def test_rolls_back_before_reboot(self, rootfs_image_module_path, file_tree, loop_devices):
+        part_a, part_b, firmware = self.install(rootfs_image_module_path, file_tree, loop_devices)
+
+        file_tree.run(rootfs_image_module_path, "ArtifactRollback")
+
+        assert firmware.get("order").strip() == "0001,0002,0003"
+        assert firmware.get("next").strip() == ""
+
+
+class RaspberryPiFirmware(Firmware):
+    """The tryboot flag which the firmware puts in the device tree, which /proc/device-tree links
+    to under /sys/firmware."""
+
+    flag = "sys/devicetree/base/chosen/bootloader/tryboot"
+
+    def __init__(self, file_tree, root, autoboot):
+        super().__init__(file_tree, root)
+        self.autoboot = autoboot
+        self.set(self.flag, bytes(4))
+
+    def reboot(self, root, tryboot):
+        self.set(self.flag, b"\x00\x00\x00\x01" if tryboot else bytes(4))
+        self.new_boot(root)
+
+
+@pytest.mark.skipif(
+    not can_mount_namespace() or not os.path.islink("/proc/device-tree"),
+    reason="needs root, unshare and a device tree",
+)
+class TestRootfsImageTryboot:
+    def install(self, module, file_tree, loop_devices):
+        slots = [
+            loop_devices.create("a.img", 4 * MiB),
+            loop_devices.create("b.img", 4 * MiB),
+            loop_devices.create("boot-a.img", MiB),
+            loop_devices.create("boot-b.img", MiB),
+        ]
+        autoboot = os.path.join(file_tree.root, "autoboot.txt")
+        with open(autoboot, "w") as fd:
+            fd.write("[all]\ntryboot_a_b=1\nboot_partition=%s\n" % partition_number(slots[2]))
+        file_tree.configure(
+            RootfsPartA=slots[0],
+            RootfsPartB=slots[1],
+            BootPartA=slots[2],
+            BootPartB=slots[3],
+            BootEnv="tryboot",
+            BootEnvFile=autoboot,
+        )
+        firmware = RaspberryPiFirmware(file_tree, slots[0], autoboot)
+        payload = os.urandom(MiB)
+
+        file_tree.run(module, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(module, "ArtifactInstall")
+        result = file_tree.run(module, "NeedsArtifactReboot")
+
+        # Only a reboot with the tryboot flag boots the slot to try.
+        assert result.stdout.decode().strip() == "Yes"
+        assert read_at(slots[1], 0, MiB) == payload
+        assert self.autoboot(firmware) == (
+            "[all]\ntryboot_a_b=1\nboot_partition=%s\n[tryboot]\nboot_partition=%s\n"
+            % (partition_number(slots[2]), partition_number(slots[3]))
+        )
+        return slots, firmware
+
+    def autoboot(self, firmware):
+        with open(firmware.autoboot) as fd:
+            return fd.read()
+
+    def test_commits_tried_slot(self, rootfs_image_module_path, file_tree, loop_devices):
+        slots, firmware = self.install(rootfs_image_module_path, file_tree, loop_devices)
+        firmware.reboot(slots[1], tryboot=True)
+
+        file_tree.run(rootfs_image_module_path, "ArtifactVerifyReboot")
+        file_tree.run(rootfs_image_module_path, "ArtifactCommit")
+
+        assert self.autoboot(firmware) == (
+            "[all]\ntryboot_a_b=1\nboot_partition=%s\n" % partition_number(slots[3])
+        )
+
+    def test_rolls_back_after_failed_boot(self, rootfs_image_module_path, file_tree, loop_devices):
+        slots, firmware = self.install(rootfs_image_module_path, file_tree, loop_devices)
+        # The tried slot didn't come up, and the device was reset without the tryboot flag.
+        firmware.reboot(slots[0], tryboot=False)
+
+        file_tree.run(rootfs_image_module_path, "ArtifactVerifyReboot", expect_fail=True)
+        file_tree.run(rootfs_image_module_path, "ArtifactRollback")
+        file_tree.run(rootfs_image_module_path, "ArtifactVerifyRollbackReboot")
+
+        assert self.autoboot(firmware) == (
+            "[all]\ntryboot_a_b=1\nboot_partition=%s\n" % partition_number(slots[2])
+        )
+
+
+class TestRootfsImageFileBootEnv:
+    def test_update_cycle(self, rootfs_image_module_path, file_tree, image_slots):
+        for active, passive in [("1", image_slots[1]), ("2", image_slots[0])]:
+            payload = os.urandom(MiB)
+
+            file_tree.run(
+                rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)]
+            )
+            file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+            assert read_at(passive, 0, MiB) == payload
+            # Nothing boots from the image files, so the slot to try is the one which runs.
+            file_tree.run(rootfs_image_module_path, "ArtifactVerifyReboot")
+            file_tree.run(rootfs_image_module_path, "ArtifactCommit")
+
+            env = file_tree.bootenv()
+            assert env["mender_boot_part"] != active
+            assert env["upgrade_available"] == "0"
+
+    def test_rollback(self, rootfs_image_module_path, file_tree, image_slots):
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+        file_tree.run(rootfs_image_module_path, "ArtifactRollback")
+        file_tree.run(rootfs_image_module_path, "ArtifactVerifyRollbackReboot")
+
+        env = file_tree.bootenv()
+        assert env["mender_boot_part"] == "1"
+        assert env["upgrade_available"] == "0"
+        file_tree.run(rootfs_image_module_path, "ArtifactCommit", expect_fail=True)
+
+    def test_keeps_other_variables(self, rootfs_image_module_path, file_tree, image_slots):
+        bootenv = os.path.join(file_tree.root, "bootenv.txt")
+        with open(bootenv, "w") as fd:
+            fd.write("console=ttyS0\nmender_boot_part=1\nupgrade_available=0\n")
+        file_tree.configure(
+            RootfsPartA=image_slots[0],
+            RootfsPartB=image_slots[1],
+            BootEnv="file",
+            BootEnvFile=bootenv,
+        )
+
+        payload = os.urandom(MiB)
+
+        file_tree.run(rootfs_image_module_path, "DownloadWithFileSizes", [("rootfs.img", payload)])
+        file_tree.run(rootfs_image_module_path, "ArtifactInstall")
+
+        with open(bootenv) as fd:
+            env = fd.read().splitlines()
+        assert env[0] == "console=ttyS0"
+        assert "mender_boot_part=2" in env
+        assert "upgrade_available=1" in env
+        assert len([line for line in env if line.startswith("mender_boot_part=")]) == 1
+        assert file_tree.bootenv() == {}
+
+    def test_refuses_image_files_with_boot_loader(
+        self, rootfs_image_module_path, file_tree, image_slots
+    ):
+        file_tree.stub("grub-editenv", 'printf "mender_boot_part=1\\nupgrade_available=0\\n"\n')
+        # Image files have no partition numbers, so slot B reads as the running one.
+        file_tree.stub("findfs", "echo %s\n" % image_slots[1])
+        file_tree.configure(
+            RootfsPartA=image_slots[0], RootfsPartB=image_slots[1], BootEnv="grub-editenv"
+        )
+
+        result = file_tree.run(
+            rootfs_image_module_path,
+            "DownloadWithFileSizes",
+            [("rootfs.img", bytes(MiB))],
+            expect_fail=True,
+        )
+
+        assert "is not a block device" in result.stderr.decode()
+        assert read_at(image_slots[0], 0, MiB) == bytes(MiB)
@@ -180,6 +180,81 @@ TEST_F(APIClientTests, ClientBasicTest) {
 #endif // MENDER_USE_DBUS
 }
 
+TEST_F(APIClientTests, ClientApiHeadersTest) {
+#ifndef MENDER_USE_DBUS
+	GTEST_SKIP();
+#else
+	const string JWT_TOKEN = "FOOBARJWTTOKEN";
+	const string SERVER_URL = "http://127.0.0.1:" + TEST_PORT;
+
+	TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::Server server(server_config, loop);
+	server.AsyncServeUrl(
+		SERVER_URL,
+		[JWT_TOKEN](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+
+			auto ex_site = req->GetHeader("X-Site");
+			ASSERT_TRUE(ex_site);
+			EXPECT_EQ(ex_site.value(), "plant-7");
+			auto ex_auth = req->GetHeader("Authorization");
+			ASSERT_TRUE(ex_auth);
+			EXPECT_EQ(ex_auth.value(), "Bearer " + JWT_TOKEN);
+
+			req->SetBodyWriter(make_shared<io::Discard>());
+		},
+		[](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+
+			auto result = exp_req.value()->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetStatusCodeAndMessage(204, "No Content");
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	dbus::DBusServer dbus_server {loop, "io.mender.AuthenticationManager"};
+	auto dbus_obj = make_shared<dbus::DBusObject>("/io/mender/AuthenticationManager");
+	dbus_obj->AddMethodHandler<dbus::ExpectedStringPair>(
+		"io.mender.Authentication1", "GetJwtToken", [JWT_TOKEN, SERVER_URL]() {
+			return dbus::StringPair {JWT_TOKEN, SERVER_URL};
+		});
+	dbus_server.AdvertiseObject(dbus_obj);
+
+	auth::AuthenticatorDBus authenticator {loop, chrono::seconds {2}};
+
+	http::ClientConfig client_config {""};
+	client_config.api_headers = {{"X-Site", "plant-7"}};
+	api::HTTPClient client {client_config, loop, authenticator};
+
+	auto req = make_shared<api::APIRequest>();
+	req->SetMethod(http::Method::GET);
+	req->SetPath("/test/uri");
+
+	bool body_handler_called = false;
+	auto err = client.AsyncCall(
+		req,
+		[](http::ExpectedIncomingResponsePtr exp_resp) {
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+			EXPECT_EQ(exp_resp.value()->GetStatusCode(), http::StatusNoContent);
+		},
+		[&body_handler_called, &loop](http::ExpectedIncomingResponsePtr exp_resp) {
+			body_handler_called = true;
+			EXPECT_TRUE(exp_resp);
+			loop.Stop();
+		});
+
+	EXPECT_EQ(err, error::NoError) << "Unexpected error: " << err.message;
+	loop.Run();
+
+	EXPECT_TRUE(body_handler_called);
+#endif // MENDER_USE_DBUS
+}
+
 TEST_F(APIClientTests, TwoClientsTest) {
 #ifndef MENDER_USE_DBUS
 	GTEST_SKIP();
@@ -894,3 +969,43 @@ TEST_F(APIClientTests, ClientReauthenticationFailureTest) {
 	EXPECT_FALSE(body_handler_called2);
 #endif // MENDER_USE_DBUS
 }
+
+class TestResponse : public http::Response {
+public:
+	void SetHeader(const string &name, const string &value) {
+		headers_[name] = value;
+	}
+};
+
+TEST(ServerAnnouncementsTests, RecordAnnouncements) {
+	api::ServerAnnouncements announcements;
+
+	TestResponse plain;
+	announcements.Record("/api/devices/v1/inventory/device/attributes", plain);
+	EXPECT_EQ(announcements.Get().size(), 0);
+
+	TestResponse deprecated;
+	deprecated.SetHeader("Deprecation", "@1767225600");
+	deprecated.SetHeader("Sunset", "Thu, 31 Dec 2026 23:59:59 GMT");
+	announcements.Record("/api/devices/v1/deployments/device/deployments/next", deprecated);
+	announcements.Record("/api/devices/v1/deployments/device/deployments/abc/status", deprecated);
+	ASSERT_EQ(announcements.Get().size(), 1);
+	EXPECT_EQ(
+		announcements.Get()[0],
+		"The server API /api/devices/v1/deployments is deprecated and will be removed after "
+		"Thu, 31 Dec 2026 23:59:59 GMT");
+
+	TestResponse maintenance;
+	maintenance.SetHeader("X-MEN-Announcement", "Scheduled maintenance on Saturday");
+	announcements.Record("/api/devices/v1/inventory/device/attributes", maintenance);
+	ASSERT_EQ(announcements.Get().size(), 2);
+	EXPECT_EQ(announcements.Get()[1], "Scheduled maintenance on Saturday");
+
+	for (size_t i = 0; i < api::ServerAnnouncements::kMaxAnnouncements; i++) {
+		TestResponse other;
+		other.SetHeader("X-MEN-Announcement", "Announcement " + to_string(i));
+		announcements.Record("/api/devices/v1/inventory/device/attributes", other);
+	}
+	ASSERT_EQ(announcements.Get().size(), api::ServerAnnouncements::kMaxAnnouncements);
+	EXPECT_EQ(announcements.Get()[0], "Announcement 0");
+}
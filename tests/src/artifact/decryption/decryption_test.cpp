@@ -0,0 +1,265 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <artifact/decryption/decryption.hpp>
+
+#include <fstream>
+#include <string>
+#include <vector>
+
+#include <gtest/gtest.h>
+
+#include <openssl/evp.h>
+
+#include <artifact/error.hpp>
+#include <artifact/parser.hpp>
+#include <common/io.hpp>
+#include <common/json.hpp>
+#include <common/path.hpp>
+#include <common/processes.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace decryption = mender::artifact::decryption;
+namespace error = mender::common::error;
+namespace io = mender::common::io;
+namespace json = mender::common::json;
+namespace mendertesting = mender::common::testing;
+namespace parser = mender::artifact::parser;
+namespace parser_error = mender::artifact::parser_error;
+namespace path = mender::common::path;
+namespace processes = mender::common::processes;
+
+const vector<uint8_t> kKey(decryption::kAes256GcmKeySize, 0x42);
+
+vector<uint8_t> Encrypt(const string &plain_text, const vector<uint8_t> &key) {
+	vector<uint8_t> nonce(decryption::kAes256GcmNonceSize, 0x24);
+	vector<uint8_t> out {nonce};
+	out.resize(nonce.size() + plain_text.size() + decryption::kAes256GcmTagSize);
+
+	auto ctx = EVP_CIPHER_CTX_new();
+	EVP_EncryptInit_ex(ctx, EVP_aes_256_gcm(), nullptr, key.data(), nonce.data());
+	int size {0};
+	EVP_EncryptUpdate(
+		ctx,
+		out.data() + nonce.size(),
+		&size,
+		reinterpret_cast<const uint8_t *>(plain_text.data()),
+		static_cast<int>(plain_text.size()));
+	int final_size {0};
+	EVP_EncryptFinal_ex(ctx, out.data() + nonce.size() + size, &final_size);
+	EVP_CIPHER_CTX_ctrl(
+		ctx,
+		EVP_CTRL_GCM_GET_TAG,
+		static_cast<int>(decryption::kAes256GcmTagSize),
+		out.data() + nonce.size() + plain_text.size());
+	EVP_CIPHER_CTX_free(ctx);
+	return out;
+}
+
+error::Error Decrypt(const vector<uint8_t> &encrypted, string &plain_text) {
+	decryption::Aes256GcmReader reader {
+		make_shared<io::ByteReader>(make_shared<vector<uint8_t>>(encrypted)), kKey};
+	vector<uint8_t> out;
+	io::ByteWriter writer {out};
+	writer.SetUnlimited(true);
+	auto err = io::Copy(writer, reader);
+	plain_text = string(out.begin(), out.end());
+	return err;
+}
+
+TEST(DecryptionTest, Aes256GcmRoundTrip) {
+	// Longer than the buffer of io::Copy, so that the tag is read in a later read than the
+	// nonce.
+	string plain_text;
+	for (int i = 0; i < 10000; i++) {
+		plain_text += "payload " + to_string(i) + "\n";
+	}
+
+	string decrypted;
+	auto err = Decrypt(Encrypt(plain_text, kKey), decrypted);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(decrypted, plain_text);
+
+	err = Decrypt(Encrypt("", kKey), decrypted);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(decrypted, "");
+}
+
+TEST(DecryptionTest, Aes256GcmTampered) {
+	auto encrypted = Encrypt("foobar", kKey);
+	encrypted[decryption::kAes256GcmNonceSize] ^= 1;
+
+	string decrypted;
+	auto err = Decrypt(encrypted, decrypted);
+	EXPECT_EQ(err.code, parser_error::MakeError(parser_error::DecryptionError, "").code);
+	EXPECT_NE(err.message.find("could not be authenticated"), string::npos) << err.message;
+
+	string decrypted_other_key;
+	err = Decrypt(Encrypt("foobar", vector<uint8_t>(kKey.size(), 0x43)), decrypted_other_key);
+	EXPECT_EQ(err.code, parser_error::MakeError(parser_error::DecryptionError, "").code);
+}
+
+TEST(DecryptionTest, Aes256GcmTruncated) {
+	auto encrypted = Encrypt("foobar", kKey);
+
+	string decrypted;
+	auto err = Decrypt(
+		vector<uint8_t>(encrypted.begin(), encrypted.begin() + decryption::kAes256GcmNonceSize + 3),
+		decrypted);
+	EXPECT_EQ(err.code, parser_error::MakeError(parser_error::DecryptionError, "").code);
+	EXPECT_NE(err.message.find("truncated"), string::npos) << err.message;
+
+	err = Decrypt(vector<uint8_t>(encrypted.begin(), encrypted.begin() + 5), decrypted);
+	EXPECT_EQ(err.code, parser_error::MakeError(parser_error::DecryptionError, "").code);
+	EXPECT_NE(err.message.find("truncated"), string::npos) << err.message;
+}
+
+TEST(DecryptionTest, ParametersFromMetaData) {
+	auto exp_json = json::Load(R"({"foo": "bar"})");
+	ASSERT_TRUE(exp_json);
+	auto exp_parameters = decryption::ParametersFromMetaData(exp_json.value());
+	ASSERT_TRUE(exp_parameters);
+	EXPECT_FALSE(exp_parameters.value());
+
+	exp_json = json::Load(
+		R"({"payload_encryption": {"algorithm": "AES-256-GCM", "key_id": "fleet-2026"}})");
+	ASSERT_TRUE(exp_json);
+	exp_parameters = decryption::ParametersFromMetaData(exp_json.value());
+	ASSERT_TRUE(exp_parameters) << exp_parameters.error().String();
+	ASSERT_TRUE(exp_parameters.value());
+	EXPECT_EQ(exp_parameters.value()->algorithm, "AES-256-GCM");
+	EXPECT_EQ(exp_parameters.value()->key_id, "fleet-2026");
+	EXPECT_EQ(decryption::PlainTextSize(exp_parameters.value().value(), 34), 6);
+
+	exp_json = json::Load(
+		R"({"payload_encryption": {"algorithm": "AES-128-CBC", "key_id": "fleet-2026"}})");
+	ASSERT_TRUE(exp_json);
+	exp_parameters = decryption::ParametersFromMetaData(exp_json.value());
+	ASSERT_FALSE(exp_parameters);
+	EXPECT_NE(exp_parameters.error().message.find("AES-128-CBC"), string::npos);
+
+	exp_json = json::Load(R"({"payload_encryption": {"algorithm": "AES-256-GCM"}})");
+	ASSERT_TRUE(exp_json);
+	exp_parameters = decryption::ParametersFromMetaData(exp_json.value());
+	ASSERT_FALSE(exp_parameters);
+	EXPECT_NE(exp_parameters.error().message.find("key_id"), string::npos);
+}
+
+TEST(DecryptionTest, FileKeyProvider) {
+	mendertesting::TemporaryDirectory tmpdir;
+	const string key_path = path::Join(tmpdir.Path(), "key");
+	const string short_key_path = path::Join(tmpdir.Path(), "short-key");
+	{
+		ofstream key(key_path);
+		key.write(reinterpret_cast<const char *>(kKey.data()), kKey.size());
+		ofstream short_key(short_key_path);
+		short_key << "too short";
+	}
+
+	decryption::FileKeyProvider provider {{
+		{"fleet-2026", key_path},
+		{"short", short_key_path},
+		{"missing", path::Join(tmpdir.Path(), "missing")},
+	}};
+	auto encrypted = make_shared<vector<uint8_t>>(Encrypt("foobar", kKey));
+
+	auto exp_reader = provider.Decrypt(
+		{decryption::kAlgorithmAes256Gcm, "fleet-2026"}, make_shared<io::ByteReader>(encrypted));
+	ASSERT_TRUE(exp_reader) << exp_reader.error().String();
+	vector<uint8_t> out;
+	io::ByteWriter writer {out};
+	writer.SetUnlimited(true);
+	auto err = io::Copy(writer, *exp_reader.value());
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(string(out.begin(), out.end()), "foobar");
+
+	exp_reader = provider.Decrypt(
+		{decryption::kAlgorithmAes256Gcm, "unknown"}, make_shared<io::ByteReader>(encrypted));
+	ASSERT_FALSE(exp_reader);
+	EXPECT_NE(exp_reader.error().message.find("unknown"), string::npos);
+
+	exp_reader = provider.Decrypt(
+		{decryption::kAlgorithmAes256Gcm, "short"}, make_shared<io::ByteReader>(encrypted));
+	ASSERT_FALSE(exp_reader);
+	EXPECT_NE(exp_reader.error().message.find("32 bytes"), string::npos);
+
+	exp_reader = provider.Decrypt(
+		{decryption::kAlgorithmAes256Gcm, "missing"}, make_shared<io::ByteReader>(encrypted));
+	ASSERT_FALSE(exp_reader);
+}
+
+TEST(DecryptionTest, ParseEncryptedArtifact) {
+	mendertesting::TemporaryDirectory tmpdir;
+	const string key_path = path::Join(tmpdir.Path(), "key");
+	{
+		ofstream key(key_path);
+		key.write(reinterpret_cast<const char *>(kKey.data()), kKey.size());
+		auto encrypted = Encrypt("foobar\n", kKey);
+		ofstream payload(path::Join(tmpdir.Path(), "rootfs.ext4"));
+		payload.write(reinterpret_cast<const char *>(encrypted.data()), encrypted.size());
+		ofstream meta_data(path::Join(tmpdir.Path(), "meta-data.json"));
+		meta_data
+			<< R"({"payload_encryption": {"algorithm": "AES-256-GCM", "key_id": "fleet-2026"}})";
+	}
+
+	string script = R"(#! /bin/sh
+cd )" + tmpdir.Path() + R"( || exit 1
+mender-artifact --compression none write rootfs-image --no-progress -c test-device -n encrypted \
+    -f rootfs.ext4 --meta-data meta-data.json -o encrypted.mender || exit 1
+)";
+	const string script_path = path::Join(tmpdir.Path(), "write.sh");
+	{
+		ofstream script_file(script_path);
+		script_file << script;
+	}
+	processes::Process proc({"/bin/sh", script_path});
+	auto err = proc.Run();
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	// Without keys the header can still be read, but not the payload.
+	{
+		ifstream artifact_stream(path::Join(tmpdir.Path(), "encrypted.mender"));
+		io::StreamReader reader {artifact_stream};
+		auto exp_artifact = parser::Parse(reader);
+		ASSERT_TRUE(exp_artifact) << exp_artifact.error().String();
+		auto exp_payload = exp_artifact.value().Next();
+		ASSERT_FALSE(exp_payload);
+		EXPECT_EQ(
+			exp_payload.error().code,
+			parser_error::MakeError(parser_error::DecryptionError, "").code);
+	}
+
+	ifstream artifact_stream(path::Join(tmpdir.Path(), "encrypted.mender"));
+	io::StreamReader reader {artifact_stream};
+	auto exp_artifact = parser::Parse(
+		reader,
+		{.decryption_provider = make_shared<decryption::FileKeyProvider>(
+			 unordered_map<string, string> {{"fleet-2026", key_path}})});
+	ASSERT_TRUE(exp_artifact) << exp_artifact.error().String();
+	auto exp_payload = exp_artifact.value().Next();
+	ASSERT_TRUE(exp_payload) << exp_payload.error().String();
+	auto exp_file = exp_payload.value().Next();
+	ASSERT_TRUE(exp_file) << exp_file.error().String();
+	EXPECT_EQ(exp_file.value().Name(), "rootfs.ext4");
+	EXPECT_EQ(exp_file.value().Size(), 7);
+
+	vector<uint8_t> out;
+	io::ByteWriter writer {out};
+	writer.SetUnlimited(true);
+	err = io::Copy(writer, exp_file.value());
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(string(out.begin(), out.end()), "foobar\n");
+}
@@ -12,11 +12,14 @@
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
 
+#include <mutex>
+
 #include <gtest/gtest.h>
 #include <gmock/gmock.h>
 
 #include <common/expected.hpp>
 #include <common/error.hpp>
+#include <common/json.hpp>
 #include <common/path.hpp>
 #include <common/testing.hpp>
 #include <common/processes.hpp>
@@ -29,6 +32,7 @@ using namespace std;
 namespace error = mender::common::error;
 namespace executor = mender::artifact::scripts::executor;
 namespace expected = mender::common::expected;
+namespace json = mender::common::json;
 namespace mtesting = mender::common::testing;
 namespace path = mender::common::path;
 namespace processes = mender::common::processes;
@@ -572,6 +576,34 @@ TEST_F(ArtifactScriptTestEnv, TestRetryAndNextScript) {
 	EXPECT_THAT(err.message, testing::HasSubstr("error code: 42")) << err.String();
 }
 
+TEST_F(ArtifactScriptTestEnv, TestRetryAfterFromScript) {
+	const string marker {path::Join(tmpdir.Path(), "retried")};
+	CreateScript(
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_test"),
+		R"(#! /bin/sh
+if [ -f )" + marker + R"( ]; then
+	exit 0
+fi
+touch )" + marker + R"(
+echo )" + executor::script_retry_after_prefix
+			+ R"(0
+exit 21
+)");
+
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::seconds {10}, /* script timeout */
+		chrono::seconds {10}, /* retry interval */
+		chrono::seconds {2},  /* retry timeout */
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts")};
+	// With the global interval, the retry timeout would expire first.
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	EXPECT_EQ(err, error::NoError) << err.String();
+	EXPECT_TRUE(path::FileExists(marker));
+}
+
 TEST_F(ArtifactScriptTestEnv, TestScriptTimeoutSingleScript) {
 	CreateRetryScript(tmpdir.Path(), "42", "sleep 0.5");
 	mtesting::TestEventLoop loop;
@@ -586,3 +618,243 @@ TEST_F(ArtifactScriptTestEnv, TestScriptTimeoutSingleScript) {
 	EXPECT_NE(err, error::NoError) << err.String();
 	EXPECT_EQ(err.code, make_error_condition(errc::timed_out)) << err.String();
 }
+
+TEST_F(ArtifactScriptTestEnv, TestScriptTimeoutFile) {
+	const string script {path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_test")};
+	CreateScript(script, R"(#! /bin/sh
+sleep 0.5
+exit 0
+)");
+	{
+		ofstream timeout_file {script + executor::script_timeout_file_suffix};
+		timeout_file << "5\n";
+		ASSERT_TRUE(timeout_file);
+	}
+
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::milliseconds {100}, /* script timeout */
+		chrono::milliseconds {100}, /* retry interval */
+		chrono::seconds {2},        /* retry timeout */
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts")};
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	EXPECT_EQ(err, error::NoError) << err.String();
+}
+
+TEST_F(ArtifactScriptTestEnv, TestScriptTimeoutHeader) {
+	CreateScript(
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_test"),
+		R"(#! /bin/sh
+# )" + executor::script_timeout_header
+			+ R"( 5
+sleep 0.5
+exit 0
+)");
+
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::milliseconds {100}, /* script timeout */
+		chrono::milliseconds {100}, /* retry interval */
+		chrono::seconds {2},        /* retry timeout */
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts")};
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	EXPECT_EQ(err, error::NoError) << err.String();
+}
+
+TEST_F(ArtifactScriptTestEnv, OutputLimitAndFailure) {
+	CreateScript(
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_test"),
+		R"(#! /bin/sh
+echo "0123456789"
+echo "0123456789" 1>&2
+echo "0123456789"
+exit 3
+)");
+
+	// Called from the threads reading stdout and stderr.
+	mutex output_mutex;
+	string output;
+	auto collect = [&output_mutex, &output](const char *data, size_t size) {
+		lock_guard<mutex> lock(output_mutex);
+		output += string(data, size);
+	};
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::seconds {10},       /* script timeout */
+		chrono::milliseconds {100}, /* retry interval */
+		chrono::seconds {1},        /* retry timeout */
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts"),
+		collect,
+		collect};
+	runner.SetOutputLimit(15);
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	EXPECT_EQ(err.code, executor::MakeError(executor::NonZeroExitStatusError, "").code)
+		<< err.String();
+	EXPECT_THAT(err.message, testing::HasSubstr("from state script ArtifactInstall_Enter_01_test"));
+	EXPECT_EQ(runner.Failure(), "ArtifactInstall_Enter_01_test exited with status 3");
+	EXPECT_EQ(output.size(), 15);
+}
+
+TEST_F(ArtifactScriptTestEnv, TestScriptTimeoutKeepAlive) {
+	CreateScript(
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_test"),
+		R"(#! /bin/sh
+for i in 1 2 3 4 5 6 7 8 9 10; do
+	echo )" + executor::script_keepalive_message
+			+ R"(
+	sleep 0.1
+done
+exit 0
+)");
+	CreateScript(
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_02_test"),
+		R"(#! /bin/sh
+sleep 1
+exit 0
+)");
+
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::milliseconds {300}, /* script timeout */
+		chrono::milliseconds {100}, /* retry interval */
+		chrono::seconds {2},        /* retry timeout */
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts")};
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	// The first script runs for longer than the timeout, but keeps it alive. The second one
+	// doesn't.
+	EXPECT_EQ(err.code, make_error_condition(errc::timed_out)) << err.String();
+	EXPECT_THAT(err.String(), testing::HasSubstr("ArtifactInstall_Enter_02_test"));
+}
+
+TEST_F(ArtifactScriptTestEnv, JsonApiContextAndResult) {
+	{
+		ofstream version_file {path::Join(tmpdir.Path(), "scripts", "version")};
+		version_file << executor::json_state_script_version;
+		ASSERT_TRUE(version_file);
+	}
+	const string context_copy {path::Join(tmpdir.Path(), "context-copy.json")};
+	CreateScript(
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_test"),
+		R"(#! /bin/sh
+cp "$1" )" + context_copy
+			+ R"(
+result_file="$(sed -e 's/.*"result_file":"\([^"]*\)".*/\1/' "$1")"
+echo '{"message":"Hello from the script","substatus":"Waiting for the user"}' > "$result_file"
+exit 0
+)");
+
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::seconds {10},
+		chrono::seconds {1},
+		chrono::seconds {2},
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts")};
+	runner.SetScriptContext(tmpdir.Path(), {{"artifact_name", "my-artifact"}});
+
+	testing::internal::CaptureStderr();
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	auto output = testing::internal::GetCapturedStderr();
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	EXPECT_THAT(output, testing::HasSubstr("Hello from the script"));
+	EXPECT_EQ(runner.Substatus(), "Waiting for the user");
+
+	auto exp_context = json::LoadFromFile(context_copy);
+	ASSERT_TRUE(exp_context) << exp_context.error().String();
+	const auto &context = exp_context.value();
+	EXPECT_EQ(context.Get("api_version").and_then(json::ToInt64).value(), 4);
+	EXPECT_EQ(context.Get("state").and_then(json::ToString).value(), "ArtifactInstall");
+	EXPECT_EQ(context.Get("action").and_then(json::ToString).value(), "Enter");
+	EXPECT_EQ(context.Get("artifact_name").and_then(json::ToString).value(), "my-artifact");
+}
+
+TEST_F(ArtifactScriptTestEnv, JsonApiRetryAfter) {
+	{
+		ofstream version_file {path::Join(tmpdir.Path(), "scripts", "version")};
+		version_file << executor::json_state_script_version;
+		ASSERT_TRUE(version_file);
+	}
+	const string count_file {path::Join(tmpdir.Path(), "counter")};
+	CreateScript(
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_test"),
+		R"(#! /bin/sh
+result_file="$(sed -e 's/.*"result_file":"\([^"]*\)".*/\1/' "$1")"
+echo x >> )" + count_file
+			+ R"(
+if [ "$(wc -l < )"
+			+ count_file + R"()" -lt 3 ]; then
+	echo '{"retry_after":0}' > "$result_file"
+fi
+exit 0
+)");
+
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::seconds {10},
+		chrono::seconds {10},
+		chrono::seconds {5},
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts")};
+	runner.SetScriptContext(tmpdir.Path(), {});
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	ifstream counter {count_file};
+	string line;
+	int runs {0};
+	while (getline(counter, line)) {
+		runs++;
+	}
+	// The retry interval from the result is used instead of the configured one.
+	EXPECT_EQ(runs, 3);
+}
+
+TEST_F(ArtifactScriptTestEnv, WasmScriptsRunByRuntime) {
+	const string script {
+		path::Join(tmpdir.Path(), "scripts", "ArtifactInstall_Enter_01_policy.wasm")};
+	{
+		// Not executable, only the runtime needs to read it.
+		ofstream wasm {script};
+		wasm << "not a real module";
+		ASSERT_TRUE(wasm);
+	}
+	const string runtime {path::Join(tmpdir.Path(), "runtime")};
+	const string args_file {path::Join(tmpdir.Path(), "runtime-args")};
+	CreateScript(runtime, R"(#! /bin/sh
+echo "$@" > )" + args_file + R"(
+exit 0
+)");
+
+	mtesting::TestEventLoop loop;
+	executor::ScriptRunner runner {
+		loop,
+		chrono::seconds {10},
+		chrono::seconds {1},
+		chrono::seconds {2},
+		path::Join(tmpdir.Path(), "scripts"),
+		path::Join(tmpdir.Path(), "scripts")};
+
+	auto err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	EXPECT_EQ(err.code, executor::MakeError(executor::SetupError, "").code) << err.String();
+	EXPECT_FALSE(path::FileExists(args_file));
+
+	runner.SetWasmRuntime({runtime, "--sandboxed"});
+	err = runner.RunScripts(executor::State::ArtifactInstall, executor::Action::Enter);
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	ifstream args {args_file};
+	string line;
+	ASSERT_TRUE(getline(args, line));
+	EXPECT_EQ(line, "--sandboxed " + script);
+}
@@ -19,6 +19,7 @@
 #include <gtest/gtest.h>
 #include <gmock/gmock.h>
 
+#include <cstdlib>
 #include <fstream>
 
 namespace config_parser = mender::client_shared::config_parser;
@@ -37,7 +38,9 @@ const string complete_config = R"({
   "UpdateLogPath": "UpdateLogPath_value",
   "TenantToken": "TenantToken_value",
   "DaemonLogLevel": "DaemonLogLevel_value",
+  "LogFormat": "json",
   "DeviceTier": "standard",
+  "IdentityProviders": ["machine-id", "mac"],
 
   "SkipVerify": true,
   "DBus": { "Enabled": true },
@@ -48,21 +51,62 @@ const string complete_config = R"({
   "InventoryPollIntervalSeconds": 4,
   "RetryPollIntervalSeconds": 5,
   "RetryPollCount": 6,
+  "RetryPolicies": {
+    "DeploymentPolling": {
+      "MaxAttempts": 20,
+      "BaseIntervalSeconds": 600,
+      "Factor": 1.5,
+      "Jitter": 0.2,
+      "MaxIntervalSeconds": 7200
+    },
+    "LogUpload": {"BaseIntervalSeconds": 5, "Factor": 1}
+  },
   "StateScriptTimeoutSeconds": 7,
   "StateScriptRetryTimeoutSeconds": 8,
   "StateScriptRetryIntervalSeconds": 9,
+  "StateScriptOutputLimitBytes": 1024,
+  "StateScriptWasmRuntime": ["iwasm", "--dir=/var/lib/mender"],
+  "StateListenerTimeoutSeconds": 11,
+  "StateListenerMaxDelaySeconds": 12,
+  "ArtifactCommitLeaseApplications": ["app1", "app2"],
+  "ArtifactCommitLeaseSeconds": 600,
+  "ArtifactCommitLeaseRenewalSeconds": 30,
+  "CommitRequiresConfirmation": true,
+  "CommitConfirmationTimeoutSeconds": 900,
+  "RebootGraceSeconds": 120,
+  "RebootGraceApplications": ["kiosk"],
+  "RebootGraceExtensionSeconds": 600,
+  "RebootGraceWall": true,
+  "RebootGraceHook": "/usr/bin/reboot-pending",
+  "RebootCommand": ["systemctl", "kexec"],
+  "RollbackRebootCommand": ["/usr/bin/supervisor-reboot", "--rollback"],
+  "RebootTimeoutSeconds": 120,
+  "StatusUpdateMinIntervalSeconds": 13,
+  "DeploymentHistoryLength": 5,
   "ModuleTimeoutSeconds": 10,
+  "ModuleTerminationGracePeriodSeconds": 45,
+  "ModuleProgressIntervalSeconds": 14,
+  "ModuleWorkDirQuotaBytes": 1073741824,
 
   "ArtifactVerifyKeys": [
     "key1",
     "key2",
     "key3"
   ],
+  "ArtifactVerifyKeysDirectory": "/etc/mender/artifact-verify-keys",
 
   "Servers": [
    {"ServerURL": "server1"},
    {"ServerURL": "server2"}
   ],
+  "ServerFailover": {
+    "FailbackIntervalSeconds": 600
+  },
+  "ServerDiscovery": {
+    "BootstrapURL": "https://bootstrap.example.com/mender-servers.json",
+    "SRVRecord": "_mender._tcp.example.com",
+    "RefreshIntervalSeconds": 3600
+  },
 
   "HttpsClient": {
     "Certificate": "Certificate_value",
@@ -75,12 +119,204 @@ const string complete_config = R"({
     "SSLEngine": "SecuritySSLEngine_value"
   },
 
+  "PostCommitCleanup": {
+    "RemoveCachedArtifacts": true,
+    "PruneDeploymentLogs": true,
+    "Fstrim": ["/mnt/inactive"],
+    "Hooks": ["hook1", "hook2"]
+  },
+
+  "PreflightChecks": {
+    "FreeSpace": [{"Path": "/var/lib/mender", "MinBytes": 104857600}],
+    "MinUptimeSeconds": 300,
+    "Scripts": ["/usr/bin/check-battery"],
+    "ScriptTimeoutSeconds": 20
+  },
+
+  "CanaryMode": {
+    "WindowSeconds": 900,
+    "IntervalSeconds": 60,
+    "HealthChecks": ["systemctl is-active my-app", "curl -sf http://localhost:8080/health"],
+    "HealthCheckTimeoutSeconds": 10
+  },
+
+  "PilotMode": {
+    "SoakSeconds": 86400,
+    "IntervalSeconds": 300,
+    "HealthChecks": ["systemctl is-active my-app"],
+    "HealthCheckTimeoutSeconds": 20,
+    "RevertCommand": "/usr/bin/switch-boot-slot --previous"
+  },
+
+  "UserNotifications": {
+    "Desktop": true,
+    "Wall": true,
+    "RebootWarningSeconds": 120
+  },
+
+  "TelemetrySinks": [
+    {
+      "Type": "exec",
+      "Command": "/usr/bin/forward-to-mqtt"
+    },
+    {
+      "Type": "webhook",
+      "URL": "http://localhost:1880/mender",
+      "TimeoutSeconds": 5
+    }
+  ],
+
+  "MQTT": {
+    "BrokerURL": "mqtts://broker.example.com",
+    "ClientID": "device-1",
+    "Username": "device-1",
+    "Password": "secret",
+    "ServerCertificate": "/etc/mender/mqtt-ca.crt",
+    "QoS": 0,
+    "Retain": true,
+    "Topics": {
+      "State": "fleet/device-1/state",
+      "Authorization": ""
+    },
+    "TimeoutSeconds": 10
+  },
+
+  "StoreEncryption": {
+    "KeyFile": "/etc/mender/store.key"
+  },
+
+  "CertificatePinning": {
+    "Hosts": {
+      "Hosted.Mender.io": [
+        "GzfKBR7gdXjjq5K2e6qDeZ7vcv9391Y9E1MzD6kd0eA=",
+        "1sRnZwjDRyKFnLIQssP5bkNL0NfhqAK3Zu1ChREH5Q0="
+      ]
+    },
+    "Exceptions": [
+      {
+        "SSIDs": ["Factory-WLAN"],
+        "Interfaces": ["eth1"],
+        "TrustedCertificate": "/etc/mender/factory-ca.crt"
+      }
+    ]
+  },
+
+  "DeviceConfiguration": {
+    "Enabled": true,
+    "PollIntervalSeconds": 600,
+    "ApplyScriptsDir": "/etc/mender/apply-device-config.d",
+    "ApplyTimeoutSeconds": 120
+  },
+
+  "PushChannel": {
+    "Enabled": true,
+    "PingIntervalSeconds": 30,
+    "MaxRetryIntervalSeconds": 300
+  },
+
+  "LocalApi": {
+    "Enabled": true,
+    "UpdateSocketPath": "/run/mender-update.sock",
+    "AuthSocketPath": "/run/mender-auth.sock"
+  },
+
+  "SelfTest": {
+    "Enabled": false,
+    "ScriptTimeoutSeconds": 30,
+    "RetryIntervalSeconds": 600
+  },
+
+  "StateTimeouts": {
+    "DownloadSeconds": 3600,
+    "InstallSeconds": 1800,
+    "RebootSeconds": 600,
+    "CommitSeconds": 300
+  },
+
+  "Metrics": {
+    "Listen": "127.0.0.1:9464"
+  },
+
+  "UpdateWindow": {
+    "Windows": [
+      {"Days": ["Sat", "sunday"], "Start": "22:00", "End": "04:00"},
+      {"Start": "12:00", "End": "13:00"}
+    ],
+    "TimeZone": "UTC+02:00",
+    "States": ["Download", "ArtifactReboot"]
+  },
+
+  "DownloadRateLimit": {
+    "BytesPerSecond": 100000,
+    "Schedule": [
+      {"Start": "08:00", "End": "18:30", "BytesPerSecond": 20000},
+      {"Start": "22:00", "End": "06:00", "BytesPerSecond": 0}
+    ]
+  },
+
   "Connectivity": {
     "DisableKeepAlive": true,
     "IdleConnTimeoutSeconds": 11
   },
 
+  "ArtifactHeaderPrefetchBytes": 65536,
+  "ArtifactHeaderCacheSize": 3,
+  "DownloadProgressIntervalSeconds": 15,
+  "DeploymentAbortCheckIntervalSeconds": 30,
+  "ChunkedDownload": {
+    "StoreURL": "https://chunks.example.com/store",
+    "Seeds": ["/dev/mmcblk0p2"]
+  },
+  "ArtifactMirrors": ["http://cache.local/mender", "http://10.0.0.2:8080"],
+  "SimulateDeployments": true,
+  "ArtifactDecryptionKeys": {"fleet-2026": "/var/lib/mender/artifact-key-2026"},
   "RetryDownloadCount" : 15,
+  "PollSplay": {
+    "Percent": 20
+  },
+  "InventorySubmission": {
+    "ChangesOnly": true,
+    "FullResubmitIntervalSeconds": 86400,
+    "Independent": true
+  },
+  "ProxyAutoConfig": {
+    "URL": "http://wpad.example.com/wpad.dat",
+    "DHCP": true,
+    "Evaluator": "/usr/local/bin/pactester"
+  },
+  "LinkTuning": {
+    "TCPMaxSegmentSize": 1200,
+    "TLSMaxFragmentLength": 2048,
+    "ReadBufferSize": 8192,
+    "StallTimeoutSeconds": 45,
+    "Adaptive": true
+  },
+  "ConnectionDiagnostics": {
+    "Enabled": true,
+    "MaxRecords": 100,
+    "MaxRecordsPerMinute": 5
+  },
+  "KeepAlive": {
+    "Enabled": false,
+    "IdleTimeoutSeconds": 20
+  },
+  "DeploymentLogs": {
+    "RotateSizeBytes": 262144,
+    "Compress": true,
+    "MaxTotalSizeBytes": 1048576,
+    "CompressUpload": true
+  },
+  "StartupWait": {
+    "TimeSync": true,
+    "Interfaces": ["eth0", "wlan0"],
+    "TimeoutSeconds": 60
+  },
+  "LowResource": {
+    "Enabled": true,
+    "BufferSize": 2048,
+    "InstallNiceness": 10,
+    "InstallIOClass": "idle"
+  },
 
   "extra": ["this", "should", "be", "ignored"]
 })";
@@ -102,7 +338,9 @@ TEST(ConfigParserDefaultsTests, ConfigParserDefaults) {
 	EXPECT_EQ(mc.update_log_path, "");
 	EXPECT_EQ(mc.tenant_token, "");
 	EXPECT_EQ(mc.daemon_log_level, "");
+	EXPECT_EQ(mc.log_format, "");
 	EXPECT_EQ(mc.device_tier, device_tier::kStandard);
+	EXPECT_EQ(mc.identity_providers.size(), 0);
 
 	EXPECT_FALSE(mc.skip_verify);
 
@@ -110,12 +348,42 @@ TEST(ConfigParserDefaultsTests, ConfigParserDefaults) {
 	EXPECT_EQ(mc.inventory_poll_interval_seconds, 28800);
 	EXPECT_EQ(mc.retry_poll_interval_seconds, 300);
 	EXPECT_EQ(mc.retry_poll_count, 0);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.max_attempts, 0);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.base_interval_seconds, 0);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.factor, 2.0);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.jitter, 0.0);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.max_interval_seconds, 0);
 	EXPECT_EQ(mc.state_script_timeout_seconds, 3600);
 	EXPECT_EQ(mc.state_script_retry_timeout_seconds, 1800);
 	EXPECT_EQ(mc.state_script_retry_interval_seconds, 60);
+	EXPECT_EQ(mc.state_script_output_limit_bytes, 65536);
+	EXPECT_EQ(mc.state_script_wasm_runtime.size(), 0);
+	EXPECT_EQ(mc.state_listener_timeout_seconds, 60);
+	EXPECT_EQ(mc.state_listener_max_delay_seconds, 3600);
+	EXPECT_EQ(mc.artifact_commit_lease_applications.size(), 0);
+	EXPECT_EQ(mc.artifact_commit_lease_seconds, 300);
+	EXPECT_EQ(mc.artifact_commit_lease_renewal_seconds, 60);
+	EXPECT_FALSE(mc.commit_requires_confirmation);
+	EXPECT_EQ(mc.commit_confirmation_timeout_seconds, 600);
+	EXPECT_EQ(mc.reboot_grace_seconds, 0);
+	EXPECT_EQ(mc.reboot_grace_applications.size(), 0);
+	EXPECT_EQ(mc.reboot_grace_extension_seconds, 300);
+	EXPECT_FALSE(mc.reboot_grace_wall);
+	EXPECT_EQ(mc.reboot_grace_hook, "");
+	EXPECT_EQ(mc.reboot_command.size(), 0);
+	EXPECT_EQ(mc.rollback_reboot_command.size(), 0);
+	EXPECT_EQ(mc.reboot_timeout_seconds, 600);
+	EXPECT_EQ(mc.status_update_min_interval_seconds, 0);
+	EXPECT_EQ(mc.deployment_history_length, 20);
 	EXPECT_EQ(mc.module_timeout_seconds, 14400);
+	EXPECT_EQ(mc.module_termination_grace_period_seconds, 10);
+	EXPECT_EQ(mc.install_locks.size(), 0);
+	EXPECT_EQ(mc.install_lock_timeout_seconds, 300);
+	EXPECT_EQ(mc.module_progress_interval_seconds, 60);
+	EXPECT_EQ(mc.module_work_dir_quota_bytes, 0);
 
 	EXPECT_EQ(mc.artifact_verify_keys.size(), 0);
+	EXPECT_EQ(mc.artifact_verify_keys_dir, "");
 
 	EXPECT_EQ(mc.servers.size(), 0);
 
@@ -125,7 +393,106 @@ TEST(ConfigParserDefaultsTests, ConfigParserDefaults) {
 
 	EXPECT_EQ(mc.security.auth_private_key, "");
 	EXPECT_EQ(mc.security.ssl_engine, "");
+	EXPECT_EQ(mc.security.auth_mode, config_parser::AuthMode::KeyPair);
+	EXPECT_EQ(mc.security.security_key, "");
+
+	EXPECT_FALSE(mc.post_commit_cleanup.remove_cached_artifacts);
+	EXPECT_FALSE(mc.post_commit_cleanup.prune_deployment_logs);
+	EXPECT_EQ(mc.post_commit_cleanup.fstrim.size(), 0);
+	EXPECT_EQ(mc.post_commit_cleanup.hooks.size(), 0);
+	EXPECT_EQ(mc.preflight_checks.free_space.size(), 0);
+	EXPECT_EQ(mc.preflight_checks.min_uptime_seconds, 0);
+	EXPECT_EQ(mc.preflight_checks.scripts.size(), 0);
+	EXPECT_EQ(mc.preflight_checks.script_timeout_seconds, 60);
+	EXPECT_FALSE(mc.canary_mode.Enabled());
+	EXPECT_EQ(mc.canary_mode.window_seconds, 0);
+	EXPECT_EQ(mc.canary_mode.interval_seconds, 30);
+	EXPECT_EQ(mc.canary_mode.health_checks.size(), 0);
+	EXPECT_EQ(mc.canary_mode.health_check_timeout_seconds, 30);
+	EXPECT_FALSE(mc.pilot_mode.Enabled());
+	EXPECT_EQ(mc.pilot_mode.soak_seconds, 0);
+	EXPECT_EQ(mc.pilot_mode.interval_seconds, 60);
+	EXPECT_EQ(mc.pilot_mode.health_check_timeout_seconds, 30);
+	EXPECT_EQ(mc.pilot_mode.revert_command, "");
+	EXPECT_FALSE(mc.user_notifications.Enabled());
+	EXPECT_EQ(mc.user_notifications.reboot_warning_seconds, 0);
+	EXPECT_EQ(mc.telemetry_sinks.size(), 0);
+	EXPECT_FALSE(mc.mqtt.Enabled());
+	EXPECT_EQ(mc.mqtt.qos, 1);
+	EXPECT_FALSE(mc.mqtt.retain);
+	EXPECT_EQ(mc.mqtt.state_topic, "mender/state");
+	EXPECT_EQ(mc.mqtt.deployment_topic, "mender/deployment");
+	EXPECT_EQ(mc.mqtt.authorization_topic, "mender/authorization");
+	EXPECT_EQ(mc.mqtt.timeout_seconds, 30);
+	EXPECT_FALSE(mc.store_encryption.Enabled());
+	EXPECT_FALSE(mc.certificate_pinning.Enabled());
+	EXPECT_FALSE(mc.device_configuration.enabled);
+	EXPECT_EQ(mc.device_configuration.poll_interval_seconds, 3600);
+	EXPECT_EQ(
+		mc.device_configuration.apply_scripts_dir,
+		"/usr/lib/mender-configure/apply-device-config.d");
+	EXPECT_EQ(mc.device_configuration.apply_timeout_seconds, 600);
+	EXPECT_FALSE(mc.push_channel.enabled);
+	EXPECT_EQ(mc.push_channel.ping_interval_seconds, 60);
+	EXPECT_EQ(mc.push_channel.max_retry_interval_seconds, 600);
+	EXPECT_FALSE(mc.local_api.enabled);
+	EXPECT_EQ(mc.local_api.update_socket_path, "/run/mender/update.sock");
+	EXPECT_EQ(mc.local_api.auth_socket_path, "/run/mender/auth.sock");
+	EXPECT_TRUE(mc.self_test.enabled);
+	EXPECT_EQ(mc.self_test.script_timeout_seconds, 60);
+	EXPECT_EQ(mc.self_test.retry_interval_seconds, 300);
+	EXPECT_EQ(mc.state_timeouts.download_seconds, 0);
+	EXPECT_EQ(mc.state_timeouts.install_seconds, 0);
+	EXPECT_EQ(mc.state_timeouts.reboot_seconds, 0);
+	EXPECT_EQ(mc.state_timeouts.commit_seconds, 0);
+	EXPECT_EQ(mc.metrics.listen, "");
+	EXPECT_FALSE(mc.update_window.Enabled());
+	EXPECT_FALSE(mc.update_window.Restricts("ArtifactInstall"));
+	EXPECT_TRUE(mc.update_window.local_time);
+	EXPECT_FALSE(mc.download_rate_limit.Enabled());
+	EXPECT_EQ(mc.artifact_header_prefetch_bytes, 1024 * 1024);
+	EXPECT_EQ(mc.artifact_header_cache_size, 8);
+	EXPECT_EQ(mc.download_progress_interval_seconds, 60);
+	EXPECT_EQ(mc.deployment_abort_check_interval_seconds, 60);
+	EXPECT_EQ(mc.chunked_download.store_url, "");
+	EXPECT_EQ(mc.chunked_download.seeds.size(), 0);
+	EXPECT_EQ(mc.artifact_mirrors.size(), 0);
+	EXPECT_FALSE(mc.simulate_deployments);
+	EXPECT_EQ(mc.artifact_decryption_keys.size(), 0);
+	EXPECT_EQ(mc.http_headers.size(), 0);
 	EXPECT_EQ(mc.retry_download_count, 10);
+	EXPECT_FALSE(mc.proxy_auto_config.Enabled());
+	EXPECT_EQ(mc.proxy_auto_config.evaluator, "pactester");
+	EXPECT_FALSE(mc.inventory_submission.changes_only);
+	EXPECT_EQ(mc.inventory_submission.full_resubmit_interval_seconds, 0);
+	EXPECT_FALSE(mc.inventory_submission.independent);
+	EXPECT_EQ(mc.poll_splay.percent, 0);
+	EXPECT_EQ(mc.poll_splay.seconds, 0);
+	EXPECT_EQ(mc.link_tuning.tcp_max_segment_size, 0);
+	EXPECT_EQ(mc.link_tuning.tls_max_fragment_length, 0);
+	EXPECT_EQ(mc.link_tuning.read_buffer_size, 0);
+	EXPECT_EQ(mc.link_tuning.stall_timeout_seconds, 0);
+	EXPECT_FALSE(mc.link_tuning.adaptive);
+	EXPECT_FALSE(mc.connection_diagnostics.enabled);
+	EXPECT_EQ(mc.connection_diagnostics.max_records, 500);
+	EXPECT_EQ(mc.connection_diagnostics.max_records_per_minute, 20);
+	EXPECT_TRUE(mc.keep_alive.enabled);
+	EXPECT_EQ(mc.keep_alive.idle_timeout_seconds, 60);
+	EXPECT_EQ(mc.deployment_logs.rotate_size_bytes, 0);
+	EXPECT_FALSE(mc.deployment_logs.compress);
+	EXPECT_EQ(mc.deployment_logs.max_total_size_bytes, 0);
+	EXPECT_FALSE(mc.deployment_logs.compress_upload);
+	EXPECT_FALSE(mc.startup_wait.time_sync);
+	EXPECT_TRUE(mc.startup_wait.interfaces.empty());
+	EXPECT_EQ(mc.startup_wait.timeout_seconds, 300);
+	EXPECT_FALSE(mc.startup_wait.Enabled());
+	EXPECT_FALSE(mc.low_resource.enabled);
+	EXPECT_EQ(mc.low_resource.buffer_size, 4096);
+	EXPECT_EQ(mc.low_resource.install_niceness, 0);
+	EXPECT_EQ(mc.low_resource.install_io_class, "");
+	EXPECT_EQ(mc.server_failover.failback_interval_seconds, 3600);
+	EXPECT_FALSE(mc.server_discovery.Enabled());
+	EXPECT_EQ(mc.server_discovery.refresh_interval_seconds, 86400);
 }
 
 TEST_F(ConfigParserTests, LoadComplete) {
@@ -143,7 +510,9 @@ TEST_F(ConfigParserTests, LoadComplete) {
 	EXPECT_EQ(mc.update_log_path, "UpdateLogPath_value");
 	EXPECT_EQ(mc.tenant_token, "TenantToken_value");
 	EXPECT_EQ(mc.daemon_log_level, "DaemonLogLevel_value");
+	EXPECT_EQ(mc.log_format, "json");
 	EXPECT_EQ(mc.device_tier, device_tier::kStandard);
+	EXPECT_THAT(mc.identity_providers, testing::ElementsAre("machine-id", "mac"));
 
 	EXPECT_TRUE(mc.skip_verify);
 
@@ -151,15 +520,50 @@ TEST_F(ConfigParserTests, LoadComplete) {
 	EXPECT_EQ(mc.inventory_poll_interval_seconds, 4);
 	EXPECT_EQ(mc.retry_poll_interval_seconds, 5);
 	EXPECT_EQ(mc.retry_poll_count, 6);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.max_attempts, 20);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.base_interval_seconds, 600);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.factor, 1.5);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.jitter, 0.2);
+	EXPECT_EQ(mc.retry_policies.deployment_polling.max_interval_seconds, 7200);
+	EXPECT_EQ(mc.retry_policies.status_reporting.base_interval_seconds, 0);
+	EXPECT_EQ(mc.retry_policies.status_reporting.factor, 2.0);
+	EXPECT_EQ(mc.retry_policies.log_upload.base_interval_seconds, 5);
+	EXPECT_EQ(mc.retry_policies.log_upload.factor, 1.0);
 	EXPECT_EQ(mc.state_script_timeout_seconds, 7);
 	EXPECT_EQ(mc.state_script_retry_timeout_seconds, 8);
 	EXPECT_EQ(mc.state_script_retry_interval_seconds, 9);
+	EXPECT_EQ(mc.state_script_output_limit_bytes, 1024);
+	EXPECT_THAT(
+		mc.state_script_wasm_runtime, testing::ElementsAre("iwasm", "--dir=/var/lib/mender"));
+	EXPECT_EQ(mc.state_listener_timeout_seconds, 11);
+	EXPECT_EQ(mc.state_listener_max_delay_seconds, 12);
+	EXPECT_THAT(mc.artifact_commit_lease_applications, testing::ElementsAre("app1", "app2"));
+	EXPECT_EQ(mc.artifact_commit_lease_seconds, 600);
+	EXPECT_EQ(mc.artifact_commit_lease_renewal_seconds, 30);
+	EXPECT_TRUE(mc.commit_requires_confirmation);
+	EXPECT_EQ(mc.commit_confirmation_timeout_seconds, 900);
+	EXPECT_EQ(mc.reboot_grace_seconds, 120);
+	EXPECT_THAT(mc.reboot_grace_applications, testing::ElementsAre("kiosk"));
+	EXPECT_EQ(mc.reboot_grace_extension_seconds, 600);
+	EXPECT_TRUE(mc.reboot_grace_wall);
+	EXPECT_EQ(mc.reboot_grace_hook, "/usr/bin/reboot-pending");
+	EXPECT_THAT(mc.reboot_command, testing::ElementsAre("systemctl", "kexec"));
+	EXPECT_THAT(
+		mc.rollback_reboot_command,
+		testing::ElementsAre("/usr/bin/supervisor-reboot", "--rollback"));
+	EXPECT_EQ(mc.reboot_timeout_seconds, 120);
+	EXPECT_EQ(mc.status_update_min_interval_seconds, 13);
+	EXPECT_EQ(mc.deployment_history_length, 5);
 	EXPECT_EQ(mc.module_timeout_seconds, 10);
+	EXPECT_EQ(mc.module_termination_grace_period_seconds, 45);
+	EXPECT_EQ(mc.module_progress_interval_seconds, 14);
+	EXPECT_EQ(mc.module_work_dir_quota_bytes, 1073741824);
 
 	EXPECT_EQ(mc.artifact_verify_keys.size(), 3);
 	EXPECT_EQ(mc.artifact_verify_keys[0], "key1");
 	EXPECT_EQ(mc.artifact_verify_keys[1], "key2");
 	EXPECT_EQ(mc.artifact_verify_keys[2], "key3");
+	EXPECT_EQ(mc.artifact_verify_keys_dir, "/etc/mender/artifact-verify-keys");
 
 	EXPECT_EQ(mc.servers.size(), 2);
 	EXPECT_EQ(mc.servers[0], "server1");
@@ -172,7 +576,178 @@ TEST_F(ConfigParserTests, LoadComplete) {
 	EXPECT_EQ(mc.security.auth_private_key, "AuthPrivateKey_value");
 	EXPECT_EQ(mc.security.ssl_engine, "SecuritySSLEngine_value");
 
+	EXPECT_TRUE(mc.post_commit_cleanup.remove_cached_artifacts);
+	EXPECT_TRUE(mc.post_commit_cleanup.prune_deployment_logs);
+	EXPECT_THAT(mc.post_commit_cleanup.fstrim, testing::ElementsAre("/mnt/inactive"));
+	EXPECT_THAT(mc.post_commit_cleanup.hooks, testing::ElementsAre("hook1", "hook2"));
+
+	ASSERT_EQ(mc.preflight_checks.free_space.size(), 1);
+	EXPECT_EQ(mc.preflight_checks.free_space[0].path, "/var/lib/mender");
+	EXPECT_EQ(mc.preflight_checks.free_space[0].min_bytes, 104857600);
+	EXPECT_EQ(mc.preflight_checks.min_uptime_seconds, 300);
+	EXPECT_THAT(mc.preflight_checks.scripts, testing::ElementsAre("/usr/bin/check-battery"));
+	EXPECT_EQ(mc.preflight_checks.script_timeout_seconds, 20);
+
+	EXPECT_TRUE(mc.canary_mode.Enabled());
+	EXPECT_EQ(mc.canary_mode.window_seconds, 900);
+	EXPECT_EQ(mc.canary_mode.interval_seconds, 60);
+	EXPECT_THAT(
+		mc.canary_mode.health_checks,
+		testing::ElementsAre(
+			"systemctl is-active my-app", "curl -sf http://localhost:8080/health"));
+	EXPECT_EQ(mc.canary_mode.health_check_timeout_seconds, 10);
+
+	EXPECT_TRUE(mc.pilot_mode.Enabled());
+	EXPECT_EQ(mc.pilot_mode.soak_seconds, 86400);
+	EXPECT_EQ(mc.pilot_mode.interval_seconds, 300);
+	EXPECT_THAT(mc.pilot_mode.health_checks, testing::ElementsAre("systemctl is-active my-app"));
+	EXPECT_EQ(mc.pilot_mode.health_check_timeout_seconds, 20);
+	EXPECT_EQ(mc.pilot_mode.revert_command, "/usr/bin/switch-boot-slot --previous");
+
+	EXPECT_TRUE(mc.user_notifications.desktop);
+	EXPECT_TRUE(mc.user_notifications.wall);
+	EXPECT_EQ(mc.user_notifications.reboot_warning_seconds, 120);
+
+	ASSERT_EQ(mc.telemetry_sinks.size(), 2);
+	EXPECT_EQ(mc.telemetry_sinks[0].type, "exec");
+	EXPECT_EQ(mc.telemetry_sinks[0].command, "/usr/bin/forward-to-mqtt");
+	EXPECT_EQ(mc.telemetry_sinks[0].timeout_seconds, 30);
+	EXPECT_EQ(mc.telemetry_sinks[1].type, "webhook");
+	EXPECT_EQ(mc.telemetry_sinks[1].url, "http://localhost:1880/mender");
+	EXPECT_EQ(mc.telemetry_sinks[1].timeout_seconds, 5);
+
+	ASSERT_TRUE(mc.mqtt.Enabled());
+	EXPECT_EQ(mc.mqtt.broker_url, "mqtts://broker.example.com");
+	EXPECT_EQ(mc.mqtt.client_id, "device-1");
+	EXPECT_EQ(mc.mqtt.username, "device-1");
+	EXPECT_EQ(mc.mqtt.password, "secret");
+	EXPECT_EQ(mc.mqtt.server_certificate, "/etc/mender/mqtt-ca.crt");
+	EXPECT_EQ(mc.mqtt.client_certificate, "");
+	EXPECT_EQ(mc.mqtt.qos, 0);
+	EXPECT_TRUE(mc.mqtt.retain);
+	EXPECT_EQ(mc.mqtt.state_topic, "fleet/device-1/state");
+	EXPECT_EQ(mc.mqtt.deployment_topic, "mender/deployment");
+	EXPECT_EQ(mc.mqtt.authorization_topic, "");
+	EXPECT_EQ(mc.mqtt.timeout_seconds, 10);
+	EXPECT_TRUE(mc.store_encryption.Enabled());
+	EXPECT_EQ(mc.store_encryption.key_file, "/etc/mender/store.key");
+	EXPECT_EQ(mc.store_encryption.tpm_sealed_object, "");
+
+	ASSERT_EQ(mc.certificate_pinning.hosts.size(), 1);
+	EXPECT_THAT(
+		mc.certificate_pinning.hosts["hosted.mender.io"],
+		testing::ElementsAre(
+			"GzfKBR7gdXjjq5K2e6qDeZ7vcv9391Y9E1MzD6kd0eA=",
+			"1sRnZwjDRyKFnLIQssP5bkNL0NfhqAK3Zu1ChREH5Q0="));
+	ASSERT_EQ(mc.certificate_pinning.exceptions.size(), 1);
+	EXPECT_THAT(mc.certificate_pinning.exceptions[0].interfaces, testing::ElementsAre("eth1"));
+	EXPECT_THAT(mc.certificate_pinning.exceptions[0].ssids, testing::ElementsAre("Factory-WLAN"));
+	EXPECT_EQ(
+		mc.certificate_pinning.exceptions[0].trusted_certificate, "/etc/mender/factory-ca.crt");
+
+	EXPECT_TRUE(mc.device_configuration.enabled);
+	EXPECT_EQ(mc.device_configuration.poll_interval_seconds, 600);
+	EXPECT_EQ(mc.device_configuration.apply_scripts_dir, "/etc/mender/apply-device-config.d");
+	EXPECT_EQ(mc.device_configuration.apply_timeout_seconds, 120);
+	EXPECT_TRUE(mc.push_channel.enabled);
+	EXPECT_EQ(mc.push_channel.ping_interval_seconds, 30);
+	EXPECT_EQ(mc.push_channel.max_retry_interval_seconds, 300);
+
+	EXPECT_TRUE(mc.local_api.enabled);
+	EXPECT_EQ(mc.local_api.update_socket_path, "/run/mender-update.sock");
+	EXPECT_EQ(mc.local_api.auth_socket_path, "/run/mender-auth.sock");
+	EXPECT_FALSE(mc.self_test.enabled);
+	EXPECT_EQ(mc.self_test.script_timeout_seconds, 30);
+	EXPECT_EQ(mc.self_test.retry_interval_seconds, 600);
+	EXPECT_EQ(mc.state_timeouts.download_seconds, 3600);
+	EXPECT_EQ(mc.state_timeouts.install_seconds, 1800);
+	EXPECT_EQ(mc.state_timeouts.reboot_seconds, 600);
+	EXPECT_EQ(mc.state_timeouts.commit_seconds, 300);
+	EXPECT_EQ(mc.metrics.listen, "127.0.0.1:9464");
+
+	ASSERT_TRUE(mc.update_window.Enabled());
+	ASSERT_EQ(mc.update_window.ranges.size(), 2);
+	EXPECT_EQ(mc.update_window.ranges[0].weekdays, 0x41u);
+	EXPECT_EQ(mc.update_window.ranges[0].start_minute, 22 * 60);
+	EXPECT_EQ(mc.update_window.ranges[0].end_minute, 4 * 60);
+	EXPECT_EQ(mc.update_window.ranges[1].weekdays, 0x7fu);
+	EXPECT_FALSE(mc.update_window.local_time);
+	EXPECT_EQ(mc.update_window.utc_offset_minutes, 120);
+	EXPECT_TRUE(mc.update_window.Restricts("Download"));
+	EXPECT_FALSE(mc.update_window.Restricts("ArtifactInstall"));
+	EXPECT_TRUE(mc.update_window.Restricts("ArtifactReboot"));
+
+	EXPECT_TRUE(mc.download_rate_limit.Enabled());
+	EXPECT_EQ(mc.download_rate_limit.bytes_per_second, 100000);
+	ASSERT_EQ(mc.download_rate_limit.windows.size(), 2);
+	EXPECT_EQ(mc.download_rate_limit.BytesPerSecondAt(7 * 60 + 59), 100000);
+	EXPECT_EQ(mc.download_rate_limit.BytesPerSecondAt(8 * 60), 20000);
+	EXPECT_EQ(mc.download_rate_limit.BytesPerSecondAt(18 * 60 + 29), 20000);
+	EXPECT_EQ(mc.download_rate_limit.BytesPerSecondAt(18 * 60 + 30), 100000);
+	EXPECT_EQ(mc.download_rate_limit.BytesPerSecondAt(23 * 60), 0);
+	EXPECT_EQ(mc.download_rate_limit.BytesPerSecondAt(5 * 60), 0);
+
+	EXPECT_EQ(mc.artifact_header_prefetch_bytes, 65536);
+	EXPECT_EQ(mc.artifact_header_cache_size, 3);
+	EXPECT_EQ(mc.download_progress_interval_seconds, 15);
+	EXPECT_EQ(mc.deployment_abort_check_interval_seconds, 30);
+
+	EXPECT_EQ(mc.chunked_download.store_url, "https://chunks.example.com/store");
+	EXPECT_THAT(mc.chunked_download.seeds, testing::ElementsAre("/dev/mmcblk0p2"));
+	EXPECT_THAT(
+		mc.artifact_mirrors,
+		testing::ElementsAre("http://cache.local/mender", "http://10.0.0.2:8080"));
+	EXPECT_TRUE(mc.simulate_deployments);
+	EXPECT_EQ(mc.artifact_decryption_keys.size(), 1);
+	EXPECT_EQ(
+		mc.artifact_decryption_keys.at("fleet-2026"), "/var/lib/mender/artifact-key-2026");
+
 	EXPECT_EQ(mc.retry_download_count, 15);
+
+	EXPECT_TRUE(mc.proxy_auto_config.Enabled());
+	EXPECT_EQ(mc.proxy_auto_config.url, "http://wpad.example.com/wpad.dat");
+	EXPECT_TRUE(mc.proxy_auto_config.dhcp);
+	EXPECT_EQ(mc.proxy_auto_config.evaluator, "/usr/local/bin/pactester");
+
+	EXPECT_TRUE(mc.inventory_submission.changes_only);
+	EXPECT_EQ(mc.inventory_submission.full_resubmit_interval_seconds, 86400);
+	EXPECT_TRUE(mc.inventory_submission.independent);
+	EXPECT_EQ(mc.poll_splay.percent, 20);
+	EXPECT_EQ(mc.poll_splay.seconds, 0);
+
+	EXPECT_EQ(mc.link_tuning.tcp_max_segment_size, 1200);
+	EXPECT_EQ(mc.link_tuning.tls_max_fragment_length, 2048);
+	EXPECT_EQ(mc.link_tuning.read_buffer_size, 8192);
+	EXPECT_EQ(mc.link_tuning.stall_timeout_seconds, 45);
+	EXPECT_TRUE(mc.link_tuning.adaptive);
+
+	EXPECT_TRUE(mc.connection_diagnostics.enabled);
+	EXPECT_EQ(mc.connection_diagnostics.max_records, 100);
+	EXPECT_EQ(mc.connection_diagnostics.max_records_per_minute, 5);
+
+	EXPECT_FALSE(mc.keep_alive.enabled);
+	EXPECT_EQ(mc.keep_alive.idle_timeout_seconds, 20);
+
+	EXPECT_EQ(mc.deployment_logs.rotate_size_bytes, 262144);
+	EXPECT_TRUE(mc.deployment_logs.compress);
+	EXPECT_EQ(mc.deployment_logs.max_total_size_bytes, 1048576);
+	EXPECT_TRUE(mc.deployment_logs.compress_upload);
+
+	EXPECT_TRUE(mc.startup_wait.time_sync);
+	EXPECT_THAT(mc.startup_wait.interfaces, testing::ElementsAre("eth0", "wlan0"));
+	EXPECT_EQ(mc.startup_wait.timeout_seconds, 60);
+	EXPECT_TRUE(mc.startup_wait.Enabled());
+	EXPECT_TRUE(mc.low_resource.enabled);
+	EXPECT_EQ(mc.low_resource.buffer_size, 2048);
+	EXPECT_EQ(mc.low_resource.install_niceness, 10);
+	EXPECT_EQ(mc.low_resource.install_io_class, "idle");
+
+	EXPECT_EQ(mc.server_failover.failback_interval_seconds, 600);
+	EXPECT_TRUE(mc.server_discovery.Enabled());
+	EXPECT_EQ(
+		mc.server_discovery.bootstrap_url, "https://bootstrap.example.com/mender-servers.json");
+	EXPECT_EQ(mc.server_discovery.srv_record, "_mender._tcp.example.com");
+	EXPECT_EQ(mc.server_discovery.refresh_interval_seconds, 3600);
 }
 
 TEST_F(ConfigParserTests, LoadPartial) {
@@ -571,6 +1146,44 @@ TEST_F(ConfigParserTests, LoadAndReset) {
 	EXPECT_EQ(mc.retry_download_count, 10);
 }
 
+TEST_F(ConfigParserTests, SecretReferences) {
+	const string secret_file = "test-secret";
+	{
+		ofstream secret(secret_file);
+		secret << "tenant-secret\n";
+	}
+	setenv("MENDER_TEST_PROXY_PASSWORD", "proxy \"secret\"", 1);
+	unsetenv("MENDER_TEST_UNSET");
+
+	ofstream os(test_config_fname);
+	os << R"({
+  "TenantToken": "@file:test-secret",
+  "ProxyUsername": "@env:MENDER_TEST_UNSET",
+  "ProxyPassword": "@env:MENDER_TEST_PROXY_PASSWORD",
+  "ServerCertificate": "@@file:literal",
+  "UpdateLogPath": "@other",
+  "RebootCommand": ["reboot", "@file:test-missing-secret", "@env:MENDER_TEST_PROXY_PASSWORD"],
+  "HttpHeaders": {"X-Site": "@file:test-secret"}
+})";
+	os.close();
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	remove(secret_file.c_str());
+	unsetenv("MENDER_TEST_PROXY_PASSWORD");
+	ASSERT_TRUE(ret) << ret.error().String();
+	EXPECT_TRUE(ret.value());
+
+	EXPECT_EQ(mc.tenant_token, "tenant-secret");
+	// Left out, since it can't be resolved.
+	EXPECT_EQ(mc.proxy_username, "");
+	EXPECT_EQ(mc.proxy_password, "proxy \"secret\"");
+	EXPECT_EQ(mc.server_certificate, "@file:literal");
+	EXPECT_EQ(mc.update_log_path, "@other");
+	EXPECT_THAT(mc.reboot_command, testing::ElementsAre("reboot", "proxy \"secret\""));
+	EXPECT_EQ(mc.http_headers["X-Site"], "tenant-secret");
+}
+
 TEST_F(ConfigParserTests, ArtifactVerifyKeyNameCollision) {
 	ofstream os(test_config_fname);
 	os << R"({
@@ -592,6 +1205,90 @@ TEST_F(ConfigParserTests, ArtifactVerifyKeyNameCollision) {
 		<< ret.error().String();
 }
 
+TEST_F(ConfigParserTests, InvalidTLSMaxFragmentLength) {
+	ofstream os(test_config_fname);
+	os << R"({
+  "LinkTuning": {
+    "TLSMaxFragmentLength": 1500
+  }
+})";
+	os.close();
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(ret.error().code, config_parser::MakeError(config_parser::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("TLSMaxFragmentLength"));
+}
+
+TEST_F(ConfigParserTests, InvalidConnectionDiagnostics) {
+	ofstream os(test_config_fname);
+	os << R"({
+  "ConnectionDiagnostics": {
+    "Enabled": true,
+    "MaxRecordsPerMinute": 0
+  }
+})";
+	os.close();
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(ret.error().code, config_parser::MakeError(config_parser::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("MaxRecordsPerMinute"));
+}
+
+TEST_F(ConfigParserTests, InvalidDeploymentLogs) {
+	ofstream os(test_config_fname);
+	os << R"({
+  "DeploymentLogs": {
+    "Compress": true,
+    "MaxTotalSizeBytes": -1
+  }
+})";
+	os.close();
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(ret.error().code, config_parser::MakeError(config_parser::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("MaxTotalSizeBytes"));
+}
+
+TEST_F(ConfigParserTests, InvalidPollSplay) {
+	ofstream os(test_config_fname);
+	os << R"({
+  "PollSplay": {
+    "Percent": 10,
+    "Seconds": 300
+  }
+})";
+	os.close();
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(ret.error().code, config_parser::MakeError(config_parser::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("PollSplay"));
+}
+
+TEST_F(ConfigParserTests, InvalidLowResource) {
+	ofstream os(test_config_fname);
+	os << R"({
+  "LowResource": {
+    "Enabled": true,
+    "InstallIOClass": "realtime"
+  }
+})";
+	os.close();
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(ret.error().code, config_parser::MakeError(config_parser::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("InstallIOClass"));
+}
+
 TEST_F(ConfigParserTests, ValidateServerConfig) {
 	ofstream os(test_config_fname);
 	os << R"({
@@ -728,3 +1425,601 @@ TEST_F(ConfigParserTests, DeviceTierInvalidConfiguration) {
 	EXPECT_EQ(ret.error().code, config_parser::MakeError(config_parser::DeviceTierError, "").code);
 	EXPECT_THAT(ret.error().String(), testing::HasSubstr("Invalid DeviceTier: foobar"));
 }
+
+TEST_F(ConfigParserTests, AuthMode) {
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "Security": {
+    "AuthMode": "mtls"
+  }
+})";
+	}
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_TRUE(ret) << ret.error().String();
+	EXPECT_EQ(mc.security.auth_mode, config_parser::AuthMode::MTLS);
+
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "Security": {
+    "AuthMode": "token"
+  }
+})";
+	}
+
+	mc.Reset();
+	ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(
+		ret.error().code,
+		config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("Invalid Security.AuthMode 'token'"));
+}
+
+TEST_F(ConfigParserTests, KeyType) {
+	config_parser::MenderConfigFromFile mc;
+	EXPECT_EQ(mc.security.key_type, config_parser::KeyType::Ed25519);
+
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "Security": {
+    "KeyType": "ecdsa-p256"
+  }
+})";
+	}
+
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_TRUE(ret) << ret.error().String();
+	EXPECT_EQ(mc.security.key_type, config_parser::KeyType::EcdsaP256);
+
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "Security": {
+    "KeyType": "rsa"
+  }
+})";
+	}
+
+	mc.Reset();
+	ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(
+		ret.error().code,
+		config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("Invalid Security.KeyType 'rsa'"));
+}
+
+TEST_F(ConfigParserTests, SecurityKey) {
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "Security": {
+    "SecurityKey": "pkcs11:token=mender;object=device"
+  }
+})";
+	}
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_TRUE(ret) << ret.error().String();
+	EXPECT_EQ(mc.security.security_key, "pkcs11:token=mender;object=device");
+
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "Security": {
+    "SecurityKey": "/data/mender/device.key"
+  }
+})";
+	}
+
+	mc.Reset();
+	ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(
+		ret.error().code,
+		config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "").code);
+	EXPECT_THAT(ret.error().String(), testing::HasSubstr("expected a PKCS#11 URI"));
+}
+
+TEST_F(ConfigParserTests, HttpHeaders) {
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "HttpHeaders": {
+    "X-Site": "plant-7",
+    "x-routing-key": "eu-west; canary"
+  }
+})";
+	}
+
+	config_parser::MenderConfigFromFile mc;
+	config_parser::ExpectedBool ret = mc.LoadFile(test_config_fname);
+	ASSERT_TRUE(ret) << ret.error().String();
+	EXPECT_EQ(mc.http_headers.size(), 2);
+	EXPECT_EQ(mc.http_headers["X-Site"], "plant-7");
+	EXPECT_EQ(mc.http_headers["x-routing-key"], "eu-west; canary");
+
+	const vector<string> invalid_headers {
+		R"("Authorization": "Bearer token")",
+		R"("Host": "example.com")",
+		R"("X-MEN-Signature": "abc")",
+		R"("X-": "abc")",
+		R"("X-Site Name": "abc")",
+		R"("X-Site": "line\r\nHost: example.com")",
+	};
+	for (const auto &header : invalid_headers) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"HttpHeaders\": {" << header << "}}";
+		}
+
+		mc.Reset();
+		ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << header;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< header;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidTelemetrySinks) {
+	const vector<string> invalid_sinks {
+		R"({"Command": "/usr/bin/forward"})",
+		R"({"Type": "mqtt", "URL": "mqtt://localhost"})",
+		R"({"Type": "exec"})",
+		R"({"Type": "webhook", "Command": "/usr/bin/forward"})",
+		R"({"Type": "exec", "Command": "/usr/bin/forward", "TimeoutSeconds": 0})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &sink : invalid_sinks) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"TelemetrySinks\": [" << sink << "]}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << sink;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< sink;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidMqtt) {
+	const vector<string> invalid_mqtt {
+		R"({"BrokerURL": "tcp://broker.example.com"})",
+		R"({"BrokerURL": "mqtt://broker.example.com", "Password": "secret"})",
+		R"({"BrokerURL": "mqtt://broker.example.com", "QoS": 2})",
+		R"({"BrokerURL": "mqtt://broker.example.com", "TimeoutSeconds": 0})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &mqtt : invalid_mqtt) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"MQTT\": " << mqtt << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << mqtt;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< mqtt;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidStoreEncryption) {
+	{
+		ofstream os(test_config_fname);
+		os << R"({"StoreEncryption": {)"
+		   << R"("KeyFile": "/etc/mender/store.key", "TPMSealedObject": "0x81010001"}})";
+	}
+
+	config_parser::MenderConfigFromFile mc;
+	auto ret = mc.LoadFile(test_config_fname);
+	ASSERT_FALSE(ret);
+	EXPECT_EQ(
+		ret.error().code,
+		config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "").code);
+}
+
+TEST_F(ConfigParserTests, InvalidCertificatePinning) {
+	const vector<string> invalid_pinning {
+		R"({"Hosts": {"hosted.mender.io": []}})",
+		R"({"Hosts": {"hosted.mender.io": ["0123456789abcdef"]}})",
+		R"({"Hosts": {"hosted.mender.io": "GzfKBR7gdXjjq5K2e6qDeZ7vcv9391Y9E1MzD6kd0eA="}})",
+		R"({"Exceptions": [{"Interfaces": ["eth1"]}]})",
+		R"({"Exceptions": [{"TrustedCertificate": "/etc/mender/factory-ca.crt"}]})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &pinning : invalid_pinning) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"CertificatePinning\": " << pinning << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << pinning;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< pinning;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidDeviceConfiguration) {
+	const vector<string> invalid_configurations {
+		R"({"PollIntervalSeconds": 0})",
+		R"({"ApplyScriptsDir": ""})",
+		R"({"ApplyTimeoutSeconds": -1})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"DeviceConfiguration\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidPushChannel) {
+	const vector<string> invalid_configurations {
+		R"({"PingIntervalSeconds": 0})",
+		R"({"MaxRetryIntervalSeconds": -1})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"PushChannel\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidLocalApi) {
+	const vector<string> invalid_configurations {
+		R"({"UpdateSocketPath": ""})",
+		R"({"AuthSocketPath": "auth.sock"})",
+		R"({"UpdateSocketPath": "/run/mender.sock", "AuthSocketPath": "/run/mender.sock"})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"LocalApi\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, DBusAuthorization) {
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "DBusAuthorization": {
+    "Rules": [
+      {
+        "Methods": ["io.mender.Authentication1.GetJwtToken", "io.mender.Update1.*"],
+        "Users": ["mender-connect"],
+        "Groups": ["mender"]
+      },
+      {
+        "Methods": ["io.mender.Authentication1.SetTenantToken"]
+      }
+    ]
+  }
+})";
+	}
+
+	config_parser::MenderConfigFromFile mc;
+	auto ret = mc.LoadFile(test_config_fname);
+	ASSERT_TRUE(ret) << ret.error().String();
+	auto authorization = mc.dbus_authorization;
+	ASSERT_EQ(authorization.rules.size(), 2);
+	EXPECT_THAT(authorization.rules[0].users, testing::ElementsAre("mender-connect"));
+	EXPECT_THAT(authorization.rules[0].groups, testing::ElementsAre("mender"));
+	EXPECT_TRUE(authorization.rules[1].users.empty());
+	// Only resolved by the daemons, see DBusAuthorizationTests.
+	EXPECT_TRUE(authorization.rules[0].uids.empty());
+	// As if mender-connect were 1000, and mender 2000.
+	authorization.rules[0].uids = {1000};
+	authorization.rules[0].gids = {2000};
+
+	const string token_method {"io.mender.Authentication1.GetJwtToken"};
+	EXPECT_TRUE(authorization.Allows(token_method, 1000, {}));
+	EXPECT_TRUE(authorization.Allows(token_method, 1001, {100, 2000}));
+	EXPECT_TRUE(authorization.Allows(token_method, 0, {}));
+	EXPECT_FALSE(authorization.Allows(token_method, 1001, {100}));
+
+	EXPECT_TRUE(authorization.Allows("io.mender.Update1.Install", 1000, {}));
+	EXPECT_FALSE(authorization.Allows("io.mender.Update1.Install", 1001, {}));
+	// Only the methods of the interface itself.
+	EXPECT_TRUE(authorization.Allows("io.mender.Update1.Sub.Method", 1001, {}));
+
+	EXPECT_TRUE(authorization.Allows("io.mender.Authentication1.SetTenantToken", 0, {}));
+	EXPECT_FALSE(authorization.Allows("io.mender.Authentication1.SetTenantToken", 1000, {}));
+
+	// Not listed by any rule.
+	EXPECT_TRUE(authorization.Allows("io.mender.Authentication1.FetchJwtToken", 1001, {}));
+	EXPECT_TRUE(config_parser::DBusAuthorization {}.Allows(token_method, 1001, {}));
+}
+
+TEST(DBusAuthorizationTests, ResolveIds) {
+	config_parser::DBusAuthorization authorization;
+	config_parser::DBusAuthorizationRule rule;
+	rule.methods = {"io.mender.Authentication1.GetJwtToken"};
+	// root is in every user database, the other ones in none.
+	rule.users = {"root", "no-such-user-for-mender-tests"};
+	rule.groups = {"root", "no-such-group-for-mender-tests"};
+	authorization.rules.push_back(rule);
+
+	EXPECT_THAT(
+		authorization.ResolveIds(),
+		testing::ElementsAre("no-such-user-for-mender-tests", "no-such-group-for-mender-tests"));
+	EXPECT_THAT(authorization.rules[0].uids, testing::ElementsAre(0));
+	EXPECT_THAT(authorization.rules[0].gids, testing::ElementsAre(0));
+
+	// The IDs are compared, not the names: a member of the group of root is allowed.
+	EXPECT_TRUE(authorization.Allows("io.mender.Authentication1.GetJwtToken", 1001, {100, 0}));
+	EXPECT_FALSE(authorization.Allows("io.mender.Authentication1.GetJwtToken", 1001, {100}));
+}
+
+TEST_F(ConfigParserTests, InvalidDBusAuthorization) {
+	const vector<string> invalid_configurations {
+		R"({"Rules": [{"Users": ["mender-connect"]}]})",
+		R"({"Rules": [{"Methods": ["GetJwtToken"]}]})",
+		R"({"Rules": [{"Methods": ["io.mender.Update1."]}]})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"DBusAuthorization\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidSelfTest) {
+	const vector<string> invalid_configurations {
+		R"({"ScriptTimeoutSeconds": 0})",
+		R"({"RetryIntervalSeconds": -60})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"SelfTest\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidStateTimeouts) {
+	const vector<string> invalid_configurations {
+		R"({"DownloadSeconds": -1})",
+		R"({"CommitSeconds": -300})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"StateTimeouts\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidMetrics) {
+	const vector<string> invalid_configurations {
+		R"({"Listen": "unix:metrics.sock"})",
+		R"({"Listen": "127.0.0.1"})",
+		R"({"Listen": ":9464"})",
+		R"({"Listen": "127.0.0.1:0"})",
+		R"({"Listen": "127.0.0.1:65536"})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"Metrics\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidPilotMode) {
+	const vector<string> invalid_configurations {
+		R"({"SoakSeconds": -1})",
+		R"({"IntervalSeconds": 0})",
+		R"({"HealthCheckTimeoutSeconds": -5})",
+		R"({"SoakSeconds": 3600, "HealthChecks": ["true"]})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"PilotMode\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, InvalidRetryPolicies) {
+	const vector<string> invalid_configurations {
+		R"({"DeploymentPolling": {"MaxAttempts": -1}})",
+		R"({"StatusReporting": {"BaseIntervalSeconds": 600, "MaxIntervalSeconds": 60}})",
+		R"({"LogUpload": {"Factor": 0.5}})",
+		R"({"DeploymentPolling": {"Jitter": 1.5}})",
+	};
+	config_parser::MenderConfigFromFile mc;
+	for (const auto &configuration : invalid_configurations) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"RetryPolicies\": " << configuration << "}";
+		}
+
+		mc.Reset();
+		auto ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << configuration;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< configuration;
+	}
+}
+
+TEST_F(ConfigParserTests, UpdateWindow) {
+	{
+		ofstream os(test_config_fname);
+		os << R"({
+  "UpdateWindow": {
+    "Windows": [
+      {"Days": ["Fri"], "Start": "22:00", "End": "04:00"},
+      {"Days": ["Wed"], "Start": "10:00", "End": "11:00"}
+    ],
+    "TimeZone": "UTC-5"
+  }
+})";
+	}
+
+	config_parser::MenderConfigFromFile mc;
+	auto ret = mc.LoadFile(test_config_fname);
+	ASSERT_TRUE(ret) << ret.error().String();
+	EXPECT_EQ(mc.update_window.utc_offset_minutes, -5 * 60);
+
+	const int friday = 5;
+	const int saturday = 6;
+	EXPECT_FALSE(mc.update_window.Allows(friday, 21 * 60 + 59));
+	EXPECT_TRUE(mc.update_window.Allows(friday, 22 * 60));
+	EXPECT_TRUE(mc.update_window.Allows(saturday, 3 * 60 + 59));
+	EXPECT_FALSE(mc.update_window.Allows(saturday, 4 * 60));
+	EXPECT_FALSE(mc.update_window.Allows(saturday, 22 * 60));
+	// Only the night from Friday to Saturday.
+	EXPECT_FALSE(mc.update_window.Allows(0, 2 * 60));
+
+	const int wednesday = 3;
+	EXPECT_TRUE(mc.update_window.Allows(wednesday, 10 * 60 + 30));
+	EXPECT_FALSE(mc.update_window.Allows(wednesday + 1, 10 * 60 + 30));
+	EXPECT_FALSE(mc.update_window.confirmation);
+
+	{
+		ofstream os(test_config_fname);
+		os << R"({"UpdateWindow": {"Confirmation": true}})";
+	}
+
+	// Without windows, only the confirmation lets the states go on.
+	mc.Reset();
+	ret = mc.LoadFile(test_config_fname);
+	ASSERT_TRUE(ret) << ret.error().String();
+	EXPECT_TRUE(mc.update_window.Enabled());
+	EXPECT_TRUE(mc.update_window.Restricts("ArtifactInstall"));
+	EXPECT_FALSE(mc.update_window.Restricts("Download"));
+	EXPECT_FALSE(mc.update_window.Allows(wednesday, 10 * 60 + 30));
+
+	const vector<string> invalid_windows {
+		R"("Windows": [{"Start": "22:00"}])",
+		R"("Windows": [{"Start": "25:00", "End": "04:00"}])",
+		R"("Windows": [{"Days": ["Funday"], "Start": "22:00", "End": "04:00"}])",
+		R"("TimeZone": "Europe/Oslo")",
+		R"("TimeZone": "UTC+2:75")",
+		R"("States": ["Commit"])",
+	};
+	for (const auto &window : invalid_windows) {
+		{
+			ofstream os(test_config_fname);
+			os << "{\"UpdateWindow\": {" << window << "}}";
+		}
+
+		mc.Reset();
+		ret = mc.LoadFile(test_config_fname);
+		ASSERT_FALSE(ret) << window;
+		EXPECT_EQ(
+			ret.error().code,
+			config_parser::MakeError(config_parser::ConfigParserErrorCode::ValidationError, "")
+				.code)
+			<< window;
+	}
+}
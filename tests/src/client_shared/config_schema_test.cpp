@@ -0,0 +1,208 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <client_shared/config_schema.hpp>
+
+#include <gtest/gtest.h>
+
+#include <fstream>
+
+#include <common/json.hpp>
+#include <common/path.hpp>
+#include <common/testing.hpp>
+
+namespace config_schema = mender::client_shared::config_schema;
+namespace json = mender::common::json;
+namespace mtesting = mender::common::testing;
+namespace path = mender::common::path;
+
+using namespace std;
+
+static vector<string> Format(const vector<config_schema::Finding> &findings) {
+	vector<string> formatted;
+	for (const auto &finding : findings) {
+		formatted.push_back(config_schema::FormatFinding(finding));
+	}
+	return formatted;
+}
+
+TEST(ConfigSchemaTests, ValidFile) {
+	auto config = json::Load(R"({
+  "ServerURL": "https://hosted.mender.io",
+  "updatepollintervalseconds": 1800,
+  "HttpsClient": {"Certificate": "/data/cert.pem"},
+  "Servers": [{"ServerURL": "https://a.example.com"}],
+  "LogLevels": {"http": "debug"},
+  "RetryPolicies": {"DeploymentPolling": {"Factor": 1.5, "MaxAttempts": 3}},
+  "DownloadRateLimit": 1000,
+  "RootfsPartA": "/dev/mmcblk0p2"
+})");
+	ASSERT_TRUE(config) << config.error().String();
+
+	EXPECT_EQ(Format(config_schema::CheckFile(config.value(), "/etc/mender/mender.conf")),
+			  vector<string> {});
+}
+
+TEST(ConfigSchemaTests, Findings) {
+	auto config = json::Load(R"({
+  "UpdatePollIntervalSecond": 1800,
+  "InventoryPollIntervalSeconds": "3600",
+  "HttpsClient": {"Certificat": "/data/cert.pem"},
+  "Servers": [{"ServerURL": "https://a.example.com"}, {"ServerURL": 1}, "b"],
+  "LogLevels": {"http": 1},
+  "DBus": {"Enabled": true},
+  "SomethingElse": true
+})");
+	ASSERT_TRUE(config) << config.error().String();
+
+	EXPECT_EQ(
+		Format(config_schema::CheckFile(config.value(), "mender.conf")),
+		(vector<string> {
+			"warning: mender.conf: DBus: No longer used, and ignored",
+			"warning: mender.conf: HttpsClient.Certificat: Unknown setting, ignored, did you mean "
+			"HttpsClient.Certificate?",
+			"error: mender.conf: InventoryPollIntervalSeconds: Must be an integer, is ignored",
+			"error: mender.conf: LogLevels.http: Must be a string",
+			"error: mender.conf: Servers[1].ServerURL: Must be a string, is ignored",
+			"error: mender.conf: Servers[2]: Must be an object",
+			"warning: mender.conf: SomethingElse: Unknown setting, ignored",
+			"warning: mender.conf: UpdatePollIntervalSecond: Unknown setting, ignored, did you mean "
+			"UpdatePollIntervalSeconds?",
+		}));
+
+	auto not_object = json::Load(R"(["ServerURL"])");
+	ASSERT_TRUE(not_object);
+	EXPECT_EQ(
+		Format(config_schema::CheckFile(not_object.value(), "mender.conf")),
+		vector<string> {"error: mender.conf: Must be a JSON object"});
+}
+
+TEST(ConfigSchemaTests, Merge) {
+	auto first = json::Load(R"({
+  "ServerURL": "https://a.example.com",
+  "HttpsClient": {"Certificate": "/data/cert.pem", "Key": "/data/key.pem"},
+  "MQTT": {"BrokerURL": "mqtts://broker", "QoS": 1},
+  "LogLevels": {"http": "debug"}
+})");
+	ASSERT_TRUE(first);
+	auto second = json::Load(R"({
+  "serverurl": "https://b.example.com",
+  "HttpsClient": {"key": "/data/other-key.pem"},
+  "MQTT": {"BrokerURL": "mqtts://other-broker"},
+  "UpdatePollIntervalSeconds": 60
+})");
+	ASSERT_TRUE(second);
+
+	auto merged = config_schema::Merge({first.value(), second.value()});
+	ASSERT_TRUE(merged) << merged.error().String();
+	EXPECT_EQ(
+		merged.value().Dump(-1),
+		R"({"HttpsClient":{"Certificate":"/data/cert.pem","key":"/data/other-key.pem"},)"
+		R"("LogLevels":{"http":"debug"},)"
+		R"("MQTT":{"BrokerURL":"mqtts://other-broker"},)"
+		R"("serverurl":"https://b.example.com",)"
+		R"("UpdatePollIntervalSeconds":60})");
+}
+
+TEST(ConfigSchemaTests, Conflicts) {
+	mtesting::TemporaryDirectory modules;
+
+	auto config = json::Load(R"({
+  "RootfsPartA": "/dev/mmcblk0p2",
+  "BootPartA": "/dev/mmcblk0p1",
+  "BootPartB": "/dev/mmcblk0p1",
+  "Servers": [{"ServerURL": "https://a.example.com"}],
+  "ServerDiscovery": {"SRVRecord": "_mender._tcp.example.com"}
+})");
+	ASSERT_TRUE(config);
+
+	EXPECT_EQ(
+		Format(config_schema::CheckConflicts(config.value(), modules.Path())),
+		(vector<string> {
+			"error: RootfsPartB: Missing, RootfsPartA is set, and needs it as well",
+			"error: BootPartB: The same partition as BootPartA",
+			"warning: RootfsPartA: Set, but there is no "
+				+ path::Join(modules.Path(), "rootfs-image")
+				+ " Update Module to switch between the partitions",
+			"warning: ServerDiscovery: Not used, since Servers or ServerURL is set",
+		}));
+
+	ofstream(path::Join(modules.Path(), "rootfs-image")) << "#!/bin/sh\n";
+	auto rootfs = json::Load(R"({
+  "RootfsPartA": "/dev/mmcblk0p2",
+  "RootfsPartB": "/dev/mmcblk0p3"
+})");
+	ASSERT_TRUE(rootfs);
+	EXPECT_EQ(
+		Format(config_schema::CheckConflicts(rootfs.value(), modules.Path())), vector<string> {});
+
+	auto tryboot = json::Load(R"({
+  "RootfsPartA": "/dev/mmcblk0p2",
+  "RootfsPartB": "/dev/mmcblk0p3",
+  "BootEnv": "tryboot"
+})");
+	ASSERT_TRUE(tryboot);
+	EXPECT_EQ(
+		Format(config_schema::CheckConflicts(tryboot.value(), modules.Path())),
+		(vector<string> {
+			"error: BootPartA: Missing, BootEnv tryboot needs BootPartA/B",
+			"error: BootEnvFile: Missing, BootEnv tryboot needs the path of the autoboot.txt",
+		}));
+
+	auto efi_bootnext = json::Load(R"({
+  "RootfsPartA": "/dev/sda2",
+  "RootfsPartB": "/dev/sda3",
+  "BootEnv": "efi-bootnext",
+  "BootEfiEntryA": "Boot0001"
+})");
+	ASSERT_TRUE(efi_bootnext);
+	EXPECT_EQ(
+		Format(config_schema::CheckConflicts(efi_bootnext.value(), modules.Path())),
+		(vector<string> {
+			"error: BootEfiEntryA: Not a boot entry, it must be four hexadecimal digits, as in "
+			"Boot0001",
+			"error: BootEfiEntryB: Missing, BootEnv efi-bootnext needs BootEfiEntryA/B",
+		}));
+}
+
+TEST(ConfigSchemaTests, JsonSchema) {
+	auto schema = json::Load(config_schema::JsonSchema());
+	ASSERT_TRUE(schema) << schema.error().String();
+
+	EXPECT_EQ(schema.value().Get("title").and_then(json::ToString).value_or(""), "mender.conf");
+	auto properties = schema.value().Get("properties");
+	ASSERT_TRUE(properties);
+	EXPECT_EQ(
+		properties.value()
+			.Get("UpdatePollIntervalSeconds")
+			.and_then([](const json::Json &setting) { return setting.Get("type"); })
+			.and_then(json::ToString)
+			.value_or(""),
+		"integer");
+	EXPECT_EQ(
+		properties.value()
+			.Get("DownloadRateLimit")
+			.and_then([](const json::Json &setting) { return setting.Get("type"); })
+			.and_then([](const json::Json &types) { return types.GetArraySize(); })
+			.value_or(0),
+		2u);
+	EXPECT_EQ(
+		properties.value()
+			.Get("HttpsClient")
+			.and_then([](const json::Json &setting) { return setting.Get("additionalProperties"); })
+			.and_then(json::ToBool)
+			.value_or(true),
+		false);
+}
@@ -16,12 +16,17 @@
 
 #include <sys/stat.h>
 #include <gtest/gtest.h>
+#include <filesystem>
 #include <fstream>
 
 #include <common/key_value_parser.hpp>
+#include <common/path.hpp>
+#include <common/testing.hpp>
 
 namespace id_p = mender::client_shared::identity_parser;
 namespace kv_p = mender::common::key_value_parser;
+namespace path = mender::common::path;
+namespace mtesting = mender::common::testing;
 
 using namespace std;
 
@@ -208,3 +213,82 @@ exit 0
 		R"({"foo":["baz","bar"],"key":"value=23","mac":"de:ad:be:ef:00:01","some value":"bar"})",
 		json_str);
 }
+
+class IdentityProviderTests : public IdentityParserTests {
+protected:
+	mtesting::TemporaryDirectory tmpdir;
+
+	void WriteFile(const string &file, const string &content) {
+		filesystem::create_directories(path::DirName(file));
+		ofstream os(file);
+		os << content;
+	}
+
+	void AddInterface(
+		const string &name, const string &type, const string &index, const string &address) {
+		const string dir = path::Join(tmpdir.Path(), "class", "net", name);
+		WriteFile(path::Join(dir, "type"), type + "\n");
+		WriteFile(path::Join(dir, "ifindex"), index + "\n");
+		WriteFile(path::Join(dir, "address"), address + "\n");
+	}
+
+	id_p::IdentitySource Source(const vector<string> &providers) {
+		id_p::IdentitySource source {test_script_fname, providers};
+		source.sys_dir = tmpdir.Path();
+		source.machine_id_file = path::Join(tmpdir.Path(), "machine-id");
+		return source;
+	}
+};
+
+TEST_F(IdentityProviderTests, NoProvidersRunsTheScript) {
+	auto ret = PrepareTestScript(R"(#!/bin/sh
+echo "key1=value1"
+)");
+	ASSERT_TRUE(ret);
+
+	auto ex_data = id_p::GetIdentityData(Source({}));
+	ASSERT_TRUE(ex_data) << ex_data.error().String();
+	EXPECT_EQ(id_p::DumpIdentityData(ex_data.value()), R"({"key1":"value1"})");
+}
+
+TEST_F(IdentityProviderTests, Providers) {
+	auto ret = PrepareTestScript(R"(#!/bin/sh
+echo "mac=02:00:00:00:00:02"
+echo "site=lab"
+)");
+	ASSERT_TRUE(ret);
+
+	AddInterface("lo", "772", "1", "00:00:00:00:00:00");
+	AddInterface("dummy0", "1", "2", "aa:aa:aa:aa:aa:aa");
+	AddInterface("eth1", "1", "4", "02:00:00:00:00:04");
+	AddInterface("eth0", "1", "3", "02:00:00:00:00:02");
+	WriteFile(
+		path::Join(tmpdir.Path(), "class", "dmi", "id", "product_serial"), "  SN-1234  \n");
+	WriteFile(path::Join(tmpdir.Path(), "machine-id"), "0123456789abcdef0123456789abcdef\n");
+
+	auto ex_data = id_p::GetIdentityData(Source({"machine-id", "dmi-serial", "mac", "script"}));
+	ASSERT_TRUE(ex_data) << ex_data.error().String();
+	EXPECT_EQ(
+		id_p::DumpIdentityData(ex_data.value()),
+		R"({"dmi_serial":"SN-1234","mac":"02:00:00:00:00:02",)"
+		R"("machine_id":"0123456789abcdef0123456789abcdef","site":"lab"})");
+}
+
+TEST_F(IdentityProviderTests, FailingProvider) {
+	WriteFile(path::Join(tmpdir.Path(), "machine-id"), "uninitialized\n");
+	auto ex_data = id_p::GetIdentityData(Source({"machine-id"}));
+	EXPECT_FALSE(ex_data);
+
+	WriteFile(path::Join(tmpdir.Path(), "machine-id"), "0123456789abcdef0123456789abcdef\n");
+	ex_data = id_p::GetIdentityData(Source({"machine-id"}));
+	EXPECT_TRUE(ex_data);
+
+	// No network interfaces, and no DMI data.
+	ex_data = id_p::GetIdentityData(Source({"machine-id", "mac"}));
+	EXPECT_FALSE(ex_data);
+	ex_data = id_p::GetIdentityData(Source({"dmi-serial"}));
+	EXPECT_FALSE(ex_data);
+
+	ex_data = id_p::GetIdentityData(Source({"machine-id", "serial-number"}));
+	EXPECT_FALSE(ex_data);
+}
@@ -16,12 +16,17 @@
 
 #include <sys/stat.h>
 #include <gtest/gtest.h>
+#include <chrono>
 #include <fstream>
 
+#include <common/error.hpp>
+#include <common/events.hpp>
 #include <common/key_value_parser.hpp>
 #include <common/log.hpp>
 #include <common/testing.hpp>
 
+namespace error = mender::common::error;
+namespace events = mender::common::events;
 namespace ivp = mender::client_shared::inventory_parser;
 namespace kvp = mender::common::key_value_parser;
 
@@ -181,3 +186,93 @@ echo "keyval"
 	kvp::ExpectedKeyValuesMap ex_data = ivp::GetInventoryData(test_scripts_dir.Path());
 	ASSERT_FALSE(ex_data);
 }
+
+TEST_F(InventoryParserTests, AsyncGetInventoryDataTest) {
+	string script = R"(#!/bin/sh
+echo "key1=value1"
+echo "key2=value2"
+)";
+	auto ret = PrepareTestScript("mender-inventory-script1", script);
+	ASSERT_TRUE(ret);
+
+	script = R"(#!/bin/sh
+echo "key1=value12"
+printf "key3=value3"
+)";
+	ret = PrepareTestScript("mender-inventory-script2", script);
+	ASSERT_TRUE(ret);
+
+	script = R"(#!/bin/sh
+echo "keyval"
+)";
+	ret = PrepareTestScript("mender-inventory-script3", script);
+	ASSERT_TRUE(ret);
+
+	TestEventLoop loop;
+	bool handler_called = false;
+	auto err = ivp::AsyncGetInventoryData(
+		test_scripts_dir.Path(),
+		loop,
+		chrono::seconds {5},
+		[&handler_called, &loop](kvp::ExpectedKeyValuesMap ex_data) {
+			handler_called = true;
+			loop.Stop();
+
+			ASSERT_TRUE(ex_data) << ex_data.error().String();
+			auto &key_values_map = ex_data.value();
+			EXPECT_EQ(key_values_map.size(), 3);
+			EXPECT_EQ(key_values_map["key1"], (vector<string> {"value1", "value12"}));
+			EXPECT_EQ(key_values_map["key2"], (vector<string> {"value2"}));
+			EXPECT_EQ(key_values_map["key3"], (vector<string> {"value3"}));
+		});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_FALSE(handler_called);
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+}
+
+TEST_F(InventoryParserTests, AsyncGetInventoryDataTimeoutTest) {
+	string script = R"(#!/bin/sh
+exec sleep 10
+echo "key1=value1"
+)";
+	auto ret = PrepareTestScript("mender-inventory-script1", script);
+	ASSERT_TRUE(ret);
+
+	script = R"(#!/bin/sh
+echo "key2=value2"
+)";
+	ret = PrepareTestScript("mender-inventory-script2", script);
+	ASSERT_TRUE(ret);
+
+	// The hanging script is killed, and the loop keeps running in the meantime.
+	TestEventLoop loop;
+	events::Timer timer {loop};
+	bool timer_fired = false;
+	timer.AsyncWait(chrono::milliseconds {100}, [&timer_fired](error::Error err) {
+		timer_fired = true;
+	});
+
+	bool handler_called = false;
+	auto start = chrono::steady_clock::now();
+	auto err = ivp::AsyncGetInventoryData(
+		test_scripts_dir.Path(),
+		loop,
+		chrono::seconds {1},
+		[&handler_called, &loop](kvp::ExpectedKeyValuesMap ex_data) {
+			handler_called = true;
+			loop.Stop();
+
+			ASSERT_TRUE(ex_data) << ex_data.error().String();
+			auto &key_values_map = ex_data.value();
+			EXPECT_EQ(key_values_map.size(), 1);
+			EXPECT_EQ(key_values_map["key2"], (vector<string> {"value2"}));
+		});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+	EXPECT_TRUE(timer_fired);
+	EXPECT_LT(chrono::steady_clock::now() - start, chrono::seconds {5});
+}
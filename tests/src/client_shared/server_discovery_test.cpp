@@ -0,0 +1,70 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <client_shared/server_discovery.hpp>
+
+#include <string>
+#include <vector>
+
+#include <gtest/gtest.h>
+#include <gmock/gmock.h>
+
+#include <common/error.hpp>
+
+namespace error = mender::common::error;
+namespace server_discovery = mender::client_shared::server_discovery;
+
+using namespace std;
+
+TEST(ServerDiscoveryTests, ParseBootstrapDocument) {
+	auto exp_discovered = server_discovery::ParseBootstrapDocument(
+		R"({"servers": ["https://eu.example.com", "https://us.example.com:8443"]})");
+	ASSERT_TRUE(exp_discovered) << exp_discovered.error().String();
+	EXPECT_THAT(
+		exp_discovered.value().servers,
+		testing::ElementsAre("https://eu.example.com", "https://us.example.com:8443"));
+	EXPECT_EQ(exp_discovered.value().ca_certificate, "");
+
+	exp_discovered = server_discovery::ParseBootstrapDocument(
+		R"({"servers": ["https://eu.example.com"], "ca_certificate": "-----BEGIN CERTIFICATE-----"})");
+	ASSERT_TRUE(exp_discovered) << exp_discovered.error().String();
+	EXPECT_EQ(exp_discovered.value().ca_certificate, "-----BEGIN CERTIFICATE-----");
+
+	for (const string &invalid : {
+			 R"({})",
+			 R"({"servers": []})",
+			 R"({"servers": "https://eu.example.com"})",
+			 R"({"servers": ["eu.example.com"]})",
+			 R"({"servers": ["https://eu.example.com"], "ca_certificate": 1})",
+			 R"(not JSON)",
+		 }) {
+		EXPECT_FALSE(server_discovery::ParseBootstrapDocument(invalid)) << invalid;
+	}
+}
+
+TEST(ServerDiscoveryTests, ServersFromSrvRecords) {
+	auto servers = server_discovery::ServersFromSrvRecords({
+		{20, 0, 443, "backup.example.com."},
+		{10, 10, 443, "small.example.com."},
+		{10, 90, 8443, "big.example.com."},
+		{30, 0, 443, "."},
+	});
+	EXPECT_THAT(
+		servers,
+		testing::ElementsAre(
+			"https://big.example.com:8443",
+			"https://small.example.com",
+			"https://backup.example.com"));
+}
@@ -240,6 +240,41 @@ TEST(CryptoTest, TestPrivateKeyGenerate) {
 	EXPECT_TRUE(expected_private_key) << "Unexpected: " << expected_private_key.error();
 }
 
+TEST(CryptoTest, TestPrivateKeyGenerateKeyTypes) {
+	string data_ {"foobar"};
+	vector<uint8_t> testdata {data_.begin(), data_.end()};
+	auto expected_shasum = mender::sha::Shasum(testdata);
+	ASSERT_TRUE(expected_shasum) << "Unexpected: " << expected_shasum.error();
+
+	for (auto key_type : {KeyType::EcdsaP256, KeyType::Rsa3072}) {
+		SCOPED_TRACE(KeyTypeName(key_type));
+		auto expected_private_key = PrivateKey::Generate(key_type);
+		ASSERT_TRUE(expected_private_key) << "Unexpected: " << expected_private_key.error();
+
+		mtesting::TemporaryDirectory tmpdir;
+		string private_key_file = path::Join(tmpdir.Path(), "private.key");
+		auto err = expected_private_key.value()->SaveToPEM(private_key_file);
+		ASSERT_EQ(error::NoError, err);
+
+		auto expected_public_key = crypto::ExtractPublicKey({private_key_file});
+		ASSERT_TRUE(expected_public_key) << "Unexpected: " << expected_public_key.error();
+		string public_key_file = path::Join(tmpdir.Path(), "public.key");
+		{
+			ofstream os(public_key_file);
+			os << expected_public_key.value();
+		}
+
+		// Signed like the authentication requests, and verified like the server does.
+		auto expected_signature = crypto::Sign({private_key_file}, testdata);
+		ASSERT_TRUE(expected_signature) << "Unexpected: " << expected_signature.error();
+		auto expected_verify_signature = crypto::VerifySign(
+			public_key_file, expected_shasum.value(), expected_signature.value());
+		ASSERT_TRUE(expected_verify_signature)
+			<< "Unexpected: " << expected_verify_signature.error();
+		EXPECT_TRUE(expected_verify_signature.value());
+	}
+}
+
 TEST(CryptoTest, TestPrivateKeySaveToPEM) {
 	string private_key_file = "./private-key.ed25519.pem";
 	auto expected_private_key = PrivateKey::Load({private_key_file});
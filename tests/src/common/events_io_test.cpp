@@ -14,6 +14,7 @@
 
 #include <common/events_io.hpp>
 
+#include <chrono>
 #include <vector>
 #include <fstream>
 
@@ -991,3 +992,76 @@ TEST(EventsIo, TeeReaderCancel) {
 	EXPECT_EQ(buffer, (vector<uint8_t> {'a', 'b', 0, 0, 0, 0, 0, 0, 0, 0, 0}));
 	EXPECT_TRUE(reader->cancelled_called);
 }
+
+TEST(EventsIo, RateLimitedRead) {
+	TestEventLoop loop;
+
+	string data(2500, 'x');
+	auto string_reader = make_shared<io::StringReader>(data);
+	auto rate_limited = make_shared<events::io::RateLimitedAsyncReader>(
+		loop, make_shared<events::io::AsyncReaderFromReader>(loop, string_reader), []() {
+			return 1000;
+		});
+
+	vector<uint8_t> buf(4096);
+	size_t total {0};
+	auto start = chrono::steady_clock::now();
+	rate_limited->RepeatedAsyncRead(
+		buf.begin(), buf.end(), [&loop, &total](io::ExpectedSize result) {
+			EXPECT_TRUE(result) << result.error().String();
+			if (!result || result.value() == 0) {
+				loop.Stop();
+				return io::Repeat::No;
+			}
+			// Never more than one second worth of data at a time.
+			EXPECT_LE(result.value(), 1000);
+			total += result.value();
+			return io::Repeat::Yes;
+		});
+	loop.Run();
+	auto elapsed = chrono::steady_clock::now() - start;
+
+	EXPECT_EQ(total, data.size());
+	EXPECT_GE(elapsed, chrono::seconds {2});
+	EXPECT_LT(elapsed, chrono::seconds {4});
+}
+
+TEST(EventsIo, AbortableRead) {
+	TestEventLoop loop;
+
+	int fds[2];
+	ASSERT_EQ(pipe(fds), 0);
+
+	// Nothing is ever written, so the read only completes when aborted.
+	auto abortable = make_shared<events::io::AbortableAsyncReader>(
+		make_shared<events::io::AsyncFileDescriptorReader>(loop, fds[0]));
+	events::io::AsyncFileDescriptorWriter writer(loop, fds[1]);
+
+	auto abort_error = error::Error(make_error_condition(errc::operation_canceled), "Aborted");
+
+	vector<uint8_t> buf(10);
+	bool handler_called {false};
+	auto err = abortable->AsyncRead(
+		buf.begin(), buf.end(), [&loop, &handler_called](io::ExpectedSize result) {
+			handler_called = true;
+			ASSERT_FALSE(result);
+			EXPECT_EQ(result.error().message, "Aborted");
+			loop.Stop();
+		});
+	ASSERT_EQ(err, error::NoError);
+
+	events::Timer timer(loop);
+	timer.AsyncWait(chrono::milliseconds(10), [&abortable, &abort_error](error::Error err) {
+		ASSERT_EQ(err, error::NoError);
+		abortable->Abort(abort_error);
+	});
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+
+	// Every read after the abort fails right away.
+	err = abortable->AsyncRead(buf.begin(), buf.end(), [](io::ExpectedSize) {
+		FAIL() << "Should not be called";
+	});
+	EXPECT_EQ(err.message, "Aborted");
+}
@@ -0,0 +1,119 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <common/gzip.hpp>
+
+#include <fstream>
+#include <sstream>
+#include <string>
+#include <vector>
+
+#include <gmock/gmock.h>
+#include <gtest/gtest.h>
+
+#include <common/error.hpp>
+#include <common/io.hpp>
+#include <common/path.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace gzip = mender::common::gzip;
+namespace io = mender::common::io;
+namespace mtesting = mender::common::testing;
+namespace path = mender::common::path;
+
+static string Decompress(const string &data, error::Error &err) {
+	io::StringReader reader {data};
+	stringstream decompressed;
+	io::StreamWriter writer {decompressed};
+	err = gzip::Decompress(reader, writer);
+	return decompressed.str();
+}
+
+TEST(GzipTests, CompressAndDecompress) {
+	string data;
+	for (int i = 0; i < 10000; i++) {
+		data += "Line " + to_string(i) + " of the data\n";
+	}
+
+	io::StringReader reader {data};
+	stringstream compressed;
+	io::StreamWriter writer {compressed};
+	auto err = gzip::Compress(reader, writer);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	// gzip magic number
+	EXPECT_EQ(compressed.str().substr(0, 2), "\x1f\x8b");
+	EXPECT_LT(compressed.str().size(), data.size() / 4);
+
+	EXPECT_EQ(Decompress(compressed.str(), err), data);
+	EXPECT_EQ(err, error::NoError) << err.String();
+}
+
+TEST(GzipTests, Empty) {
+	io::StringReader reader {""};
+	stringstream compressed;
+	io::StreamWriter writer {compressed};
+	auto err = gzip::Compress(reader, writer);
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	EXPECT_EQ(Decompress(compressed.str(), err), "");
+	EXPECT_EQ(err, error::NoError) << err.String();
+}
+
+TEST(GzipTests, InvalidData) {
+	io::StringReader reader {"Some data"};
+	stringstream compressed;
+	io::StreamWriter writer {compressed};
+	auto err = gzip::Compress(reader, writer);
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	auto truncated = compressed.str();
+	truncated.resize(truncated.size() - 4);
+	Decompress(truncated, err);
+	EXPECT_NE(err, error::NoError);
+
+	Decompress("Not gzip data", err);
+	EXPECT_NE(err, error::NoError);
+}
+
+TEST(GzipTests, CompressFiles) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto first = path::Join(tmpdir.Path(), "first");
+	auto second = path::Join(tmpdir.Path(), "second");
+	ofstream os {first};
+	os << "First file\n";
+	os.close();
+	os.open(second);
+	os << "Second file\n";
+	os.close();
+
+	auto dst = path::Join(tmpdir.Path(), "both.gz");
+	auto err = gzip::CompressFiles({first, second}, dst);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_FALSE(path::FileExists(dst + ".tmp"));
+
+	ifstream is {dst};
+	string compressed {istreambuf_iterator<char>(is), istreambuf_iterator<char>()};
+	EXPECT_EQ(Decompress(compressed, err), "First file\nSecond file\n");
+	EXPECT_EQ(err, error::NoError) << err.String();
+
+	// Nothing is left behind when a file is missing.
+	err = gzip::CompressFiles({first, path::Join(tmpdir.Path(), "missing")}, dst + "2");
+	EXPECT_NE(err, error::NoError);
+	EXPECT_FALSE(path::FileExists(dst + "2"));
+	EXPECT_FALSE(path::FileExists(dst + "2.tmp"));
+}
@@ -0,0 +1,140 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/http_diagnostics.hpp>
+
+#include <fstream>
+#include <string>
+#include <vector>
+
+#include <gmock/gmock.h>
+#include <gtest/gtest.h>
+
+#include <common/path.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace diagnostics = mender::common::http::diagnostics;
+namespace http = mender::common::http;
+namespace path = mender::common::path;
+namespace mtesting = mender::common::testing;
+
+class HttpDiagnosticsTest : public testing::Test {
+protected:
+	string RecordsFile() {
+		return path::Join(tmpdir_.Path(), "connection-diagnostics");
+	}
+
+	vector<string> Records() {
+		vector<string> records;
+		ifstream is(RecordsFile());
+		string line;
+		while (getline(is, line)) {
+			records.push_back(line);
+		}
+		return records;
+	}
+
+	http::ConnectionRecord Record(int port) {
+		http::ConnectionRecord record;
+		record.method = "GET";
+		record.host = "example.com";
+		record.port = port;
+		return record;
+	}
+
+	mtesting::TemporaryDirectory tmpdir_;
+};
+
+TEST_F(HttpDiagnosticsTest, RecordJson) {
+	http::ConnectionRecord record;
+	record.timestamp = 1700000000;
+	record.method = "GET";
+	record.host = "s3.example.com";
+	record.port = 443;
+	record.proxy = true;
+	record.address = "192.0.2.1";
+	record.resolved_ms = 5;
+	record.connected_ms = 40;
+	record.tls_handshake_ms = 120;
+	record.response_ms = 200;
+	record.total_ms = 5000;
+	record.tls_version = "TLSv1.3";
+	record.tls_cipher = "TLS_AES_256_GCM_SHA384";
+	record.bytes_sent = 300;
+	record.bytes_received = 1048576;
+	record.status_code = 200;
+	record.error = "Connection reset by \"peer\"";
+	record.has_tcp_info = true;
+	record.rtt_us = 35000;
+	record.rtt_var_us = 2000;
+	record.retransmits = 1;
+	record.total_retransmits = 12;
+	record.lost = 2;
+	record.send_congestion_window = 10;
+	record.send_mss = 1448;
+	record.path_mtu = 1500;
+
+	EXPECT_EQ(
+		diagnostics::RecordJson(record, 3),
+		R"({"timestamp":1700000000,"method":"GET","host":"s3.example.com","port":443,)"
+		R"("proxy":true,"address":"192.0.2.1","resolved_ms":5,"connected_ms":40,)"
+		R"("tls_handshake_ms":120,"response_ms":200,"total_ms":5000,"tls_version":"TLSv1.3",)"
+		R"("tls_cipher":"TLS_AES_256_GCM_SHA384","bytes_sent":300,"bytes_received":1048576,)"
+		R"("status_code":200,"error":"Connection reset by \"peer\"","tcp":{"rtt_us":35000,)"
+		R"("rtt_var_us":2000,"retransmits":1,"total_retransmits":12,"lost":2,)"
+		R"("send_congestion_window":10,"send_mss":1448,"path_mtu":1500},"skipped":3})");
+
+	// What is not known is left out.
+	EXPECT_EQ(
+		diagnostics::RecordJson(Record(80), 0),
+		R"({"timestamp":0,"method":"GET","host":"example.com","port":80,"proxy":false,)"
+		R"("address":"","resolved_ms":-1,"connected_ms":-1,"tls_handshake_ms":-1,)"
+		R"("response_ms":-1,"total_ms":-1,"bytes_sent":0,"bytes_received":0,"status_code":0})");
+}
+
+TEST_F(HttpDiagnosticsTest, KeepsTheLatestRecords) {
+	{
+		diagnostics::Recorder recorder {RecordsFile(), 3, 100};
+		for (int port = 1; port <= 2; port++) {
+			recorder.Add(Record(port));
+		}
+	}
+	EXPECT_EQ(Records().size(), 2);
+
+	// A new recorder, like after a restart, carries on with the same file.
+	diagnostics::Recorder recorder {RecordsFile(), 3, 100};
+	for (int port = 3; port <= 5; port++) {
+		recorder.Add(Record(port));
+	}
+
+	auto records = Records();
+	ASSERT_EQ(records.size(), 3);
+	EXPECT_THAT(records[0], testing::HasSubstr(R"("port":3,)"));
+	EXPECT_THAT(records[2], testing::HasSubstr(R"("port":5,)"));
+}
+
+TEST_F(HttpDiagnosticsTest, RateLimit) {
+	diagnostics::Recorder recorder {RecordsFile(), 100, 2};
+	for (int port = 1; port <= 5; port++) {
+		recorder.Add(Record(port));
+	}
+
+	// The rest of the minute is only counted, and the count goes with the next record.
+	auto records = Records();
+	ASSERT_EQ(records.size(), 2);
+	EXPECT_THAT(records[1], testing::HasSubstr(R"("port":2,)"));
+	EXPECT_THAT(records[1], testing::Not(testing::HasSubstr("skipped")));
+}
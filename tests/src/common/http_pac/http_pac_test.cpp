@@ -0,0 +1,193 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/http_pac.hpp>
+
+#include <fstream>
+
+#include <sys/stat.h>
+
+#include <gmock/gmock.h>
+#include <gtest/gtest.h>
+
+#include <common/path.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace http = mender::common::http;
+namespace pac = mender::common::http::pac;
+namespace path = mender::common::path;
+namespace mtesting = mender::common::testing;
+
+class HttpPacTest : public testing::Test {
+protected:
+	void SetUp() override {
+		// Prints the proxy for the URL, and records every call, so that the tests can check the
+		// caching.
+		evaluator_ = path::Join(tmpdir_.Path(), "evaluator");
+		{
+			ofstream os(evaluator_);
+			os << R"(#!/bin/sh
+test "$1" = "-p" -a -f "$2" -a "$3" = "-u" || exit 1
+echo "$4" >> ")"
+			   << CallsFile() << R"("
+case "$4" in
+    http://internal.example.com:*) echo "DIRECT" ;;
+    https://*) echo "SOCKS socks.example.com:1080; PROXY proxy.example.com:3128" ;;
+    *) echo "HTTPS secure-proxy.example.com:3129" ;;
+esac
+)";
+		}
+		ASSERT_EQ(chmod(evaluator_.c_str(), S_IRUSR | S_IWUSR | S_IXUSR), 0);
+
+		pac_file_ = path::Join(tmpdir_.Path(), "proxy.pac");
+		ofstream os(pac_file_);
+		os << "function FindProxyForURL(url, host) { return \"DIRECT\"; }\n";
+	}
+
+	string CallsFile() {
+		return path::Join(tmpdir_.Path(), "calls");
+	}
+
+	vector<string> Calls() {
+		vector<string> calls;
+		ifstream is(CallsFile());
+		string line;
+		while (getline(is, line)) {
+			calls.push_back(line);
+		}
+		return calls;
+	}
+
+	pac::ResolverConfig Config() {
+		return pac::ResolverConfig {
+			.url = "",
+			.dhcp_url_file = path::Join(tmpdir_.Path(), "wpad.url"),
+			.evaluator = evaluator_,
+			.download_path = path::Join(tmpdir_.Path(), "downloaded.pac"),
+		};
+	}
+
+	mtesting::TemporaryDirectory tmpdir_;
+	string evaluator_;
+	string pac_file_;
+};
+
+TEST(HttpPacResultTest, ProxyFromPacResult) {
+	auto exp_proxy = pac::ProxyFromPacResult("DIRECT");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "");
+
+	exp_proxy = pac::ProxyFromPacResult("");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "");
+
+	exp_proxy = pac::ProxyFromPacResult("PROXY proxy.example.com:8080; DIRECT");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "http://proxy.example.com:8080");
+
+	exp_proxy = pac::ProxyFromPacResult("  HTTPS proxy.example.com:443  ");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "https://proxy.example.com:443");
+
+	exp_proxy = pac::ProxyFromPacResult("SOCKS5 socks.example.com:1080;DIRECT");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "");
+
+	exp_proxy = pac::ProxyFromPacResult("SOCKS socks.example.com:1080");
+	ASSERT_FALSE(exp_proxy);
+	EXPECT_THAT(exp_proxy.error().String(), testing::HasSubstr("No supported proxy"));
+
+	exp_proxy = pac::ProxyFromPacResult("PROXY");
+	ASSERT_FALSE(exp_proxy);
+}
+
+TEST_F(HttpPacTest, ResolveWithLocalFile) {
+	auto config = Config();
+	config.url = "file://" + pac_file_;
+	pac::Resolver resolver {config, http::ClientConfig {}};
+
+	auto exp_proxy = resolver.Resolve("https://hosted.mender.io/api/devices/v1/inventory");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "http://proxy.example.com:3128");
+
+	exp_proxy = resolver.Resolve("https://hosted.mender.io/api/devices/v2/deployments");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "http://proxy.example.com:3128");
+
+	exp_proxy = resolver.Resolve("http://internal.example.com/artifact.mender");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "");
+
+	exp_proxy = resolver.Resolve("http://external.example.com:8080/artifact.mender");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "https://secure-proxy.example.com:3129");
+
+	// Only the origin is evaluated, and only once.
+	EXPECT_THAT(
+		Calls(),
+		testing::ElementsAre(
+			"https://hosted.mender.io:443/",
+			"http://internal.example.com:80/",
+			"http://external.example.com:8080/"));
+	EXPECT_FALSE(path::FileExists(config.download_path));
+}
+
+TEST_F(HttpPacTest, ResolveWithDownloadedFile) {
+	mtesting::HttpFileServer server(tmpdir_.Path());
+
+	auto config = Config();
+	config.url = http::JoinUrl(server.GetBaseUrl(), "proxy.pac");
+	pac::Resolver resolver {config, http::ClientConfig {}};
+
+	auto exp_proxy = resolver.Resolve("https://hosted.mender.io/api/devices/v1/inventory");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "http://proxy.example.com:3128");
+
+	EXPECT_TRUE(mtesting::FilesEqual(config.download_path, pac_file_));
+}
+
+TEST_F(HttpPacTest, ResolveWithUrlFromDhcp) {
+	auto config = Config();
+	pac::Resolver resolver {config, http::ClientConfig {}};
+
+	auto exp_proxy = resolver.Resolve("https://hosted.mender.io/");
+	ASSERT_FALSE(exp_proxy);
+	EXPECT_THAT(exp_proxy.error().String(), testing::HasSubstr("No PAC file URL from DHCP"));
+
+	{
+		ofstream os(config.dhcp_url_file);
+		os << "file://" << pac_file_ << "\n";
+	}
+
+	// Not retried right away.
+	exp_proxy = resolver.Resolve("https://hosted.mender.io/");
+	ASSERT_FALSE(exp_proxy);
+
+	pac::Resolver new_resolver {config, http::ClientConfig {}};
+	exp_proxy = new_resolver.Resolve("https://hosted.mender.io/");
+	ASSERT_TRUE(exp_proxy) << exp_proxy.error().String();
+	EXPECT_EQ(exp_proxy.value(), "http://proxy.example.com:3128");
+}
+
+TEST_F(HttpPacTest, FailingEvaluator) {
+	auto config = Config();
+	config.url = "file://" + pac_file_;
+	config.evaluator = "/bin/false";
+	pac::Resolver resolver {config, http::ClientConfig {}};
+
+	auto exp_proxy = resolver.Resolve("https://hosted.mender.io/");
+	EXPECT_FALSE(exp_proxy);
+}
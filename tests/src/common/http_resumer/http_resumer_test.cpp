@@ -748,6 +748,12 @@ TEST_F(DownloadResumerTest, ServerDownWhileReadingBodyReportsError) {
 	// down by the time we retry, and the retries are then exhausted quickly.
 	client->SetSmallestWaitInterval(chrono::milliseconds(200));
 
+	vector<http_resumer::DownloadAttemptFailure> attempt_failures;
+	client->SetAttemptFailureHandler(
+		[&attempt_failures](const http_resumer::DownloadAttemptFailure &failure) {
+			attempt_failures.push_back(failure);
+		});
+
 	auto req = make_shared<http::OutgoingRequest>();
 	req->SetMethod(http::Method::GET);
 	req->SetAddress("http://127.0.0.1:" TEST_PORT);
@@ -795,6 +801,34 @@ TEST_F(DownloadResumerTest, ServerDownWhileReadingBodyReportsError) {
 		<< "resumer gave up but the reader never reported an error (the daemon would hang here)";
 	EXPECT_EQ(read_error.code, http::MakeError(http::DownloadResumerError, "").code)
 		<< "unexpected error: " << read_error.String();
+
+	// The first attempt is cut short, and the following ones can't connect at all.
+	ASSERT_GE(attempt_failures.size(), 2);
+	EXPECT_EQ(attempt_failures.back().cause, http_resumer::DownloadFailureCause::Connect)
+		<< attempt_failures.back().error.String();
+	EXPECT_GT(attempt_failures.back().offset, 0);
+	EXPECT_LE(attempt_failures.back().offset, 5000);
+}
+
+TEST(DownloadResumerFailureTest, ClassifyDownloadError) {
+	using Cause = http_resumer::DownloadFailureCause;
+	auto classify = [](errc code) {
+		return http_resumer::ClassifyDownloadError(error::Error(make_error_condition(code), ""));
+	};
+
+	EXPECT_EQ(classify(errc::timed_out), Cause::Timeout);
+	EXPECT_EQ(classify(errc::connection_reset), Cause::Reset);
+	EXPECT_EQ(classify(errc::broken_pipe), Cause::Reset);
+	EXPECT_EQ(classify(errc::connection_refused), Cause::Connect);
+	EXPECT_EQ(classify(errc::network_unreachable), Cause::Connect);
+	EXPECT_EQ(
+		http_resumer::ClassifyDownloadError(
+			http::MakeError(http::DownloadResumerError, "Size of artifact changed")),
+		Cause::Other);
+
+	EXPECT_EQ(
+		http_resumer::DownloadFailureCauseToString(Cause::ChecksumMismatch), "checksum-mismatch");
+	EXPECT_EQ(http_resumer::DownloadFailureCauseToString(Cause::Tls), "tls");
 }
 
 TEST_F(DownloadResumerTest, TwoRangesClientReuse) {
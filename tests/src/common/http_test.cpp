@@ -15,14 +15,19 @@
 #include <common/http.hpp>
 
 #include <chrono>
+#include <filesystem>
+#include <fstream>
 #include <thread>
 
+#include <boost/asio.hpp>
+
 #include <gmock/gmock.h>
 #include <gtest/gtest.h>
 
 #include <common/events.hpp>
 #include <common/events_io.hpp>
 #include <common/http_test_helpers.hpp>
+#include <common/path.hpp>
 #include <common/testing.hpp>
 #include <common/processes.hpp>
 
@@ -36,13 +41,90 @@ namespace expected = mender::common::expected;
 namespace http = mender::common::http;
 namespace io = mender::common::io;
 namespace mlog = mender::common::log;
+namespace path = mender::common::path;
 namespace processes = mender::common::processes;
 namespace mendertesting = mender::common::testing;
 
+namespace fs = std::filesystem;
+
 #define TEST_PORT "8001"
 
 using TestEventLoop = mender::common::testing::TestEventLoop;
 
+namespace asio = boost::asio;
+using tcp = asio::ip::tcp;
+
+// Answers every request with "ok", and keeps the connections open, unlike `http::Server`.
+class KeepAliveServer : public events::EventLoopObject {
+public:
+	KeepAliveServer(events::EventLoop &loop) :
+		loop_ {loop},
+		acceptor_ {GetAsioIoContext(loop), tcp::endpoint(asio::ip::make_address("127.0.0.1"), 0)} {
+		Accept();
+	}
+
+	string Url() {
+		return "http://127.0.0.1:" + to_string(acceptor_.local_endpoint().port());
+	}
+
+	int connections {0};
+	vector<string> requests;
+
+private:
+	struct Connection {
+		Connection(asio::io_context &io_context) :
+			socket {io_context} {
+		}
+
+		tcp::socket socket;
+		char read_buffer[1024];
+		string incoming;
+		string reply {"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"};
+	};
+
+	void Accept() {
+		auto connection = make_shared<Connection>(GetAsioIoContext(loop_));
+		acceptor_.async_accept(
+			connection->socket, [this, connection](const boost::system::error_code &ec) {
+				if (ec) {
+					return;
+				}
+				connections++;
+				Read(connection);
+				Accept();
+			});
+	}
+
+	void Read(shared_ptr<Connection> connection) {
+		connection->socket.async_read_some(
+			asio::buffer(connection->read_buffer),
+			[this, connection](const boost::system::error_code &ec, size_t n) {
+				if (ec) {
+					return;
+				}
+				connection->incoming.append(connection->read_buffer, n);
+				auto end = connection->incoming.find("\r\n\r\n");
+				if (end == string::npos) {
+					Read(connection);
+					return;
+				}
+				requests.push_back(connection->incoming.substr(0, end));
+				connection->incoming.erase(0, end + 4);
+				asio::async_write(
+					connection->socket,
+					asio::buffer(connection->reply),
+					[this, connection](const boost::system::error_code &ec, size_t) {
+						if (!ec) {
+							Read(connection);
+						}
+					});
+			});
+	}
+
+	events::EventLoop &loop_;
+	tcp::acceptor acceptor_;
+};
+
 namespace mender {
 namespace common {
 namespace http {
@@ -498,6 +580,195 @@ TEST(HttpTest, TestHeadersWithDebugLogs) {
 	mlog::SetLevel(level);
 }
 
+TEST(HttpTest, CustomUserAgent) {
+	TestEventLoop loop;
+
+	bool server_hit_header = false;
+
+	http::ServerConfig server_config;
+	http::TestServer server(server_config, loop);
+	server.AsyncServeUrl(
+		"http://127.0.0.1:" TEST_PORT,
+		[&server_hit_header](http::ExpectedIncomingRequestPtr exp_req) {
+			server_hit_header = true;
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+
+			ASSERT_TRUE(req->GetHeader("User-Agent"));
+			EXPECT_EQ(
+				req->GetHeader("User-Agent").value(),
+				"Mender/" MENDER_VERSION " (device_type=test; Linux 6.1.0; aarch64)");
+		},
+		[](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto exp_resp = exp_req.value()->MakeResponse();
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+			auto resp = exp_resp.value();
+
+			resp->SetStatusCodeAndMessage(200, "Success");
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	http::ClientConfig client_config;
+	client_config.user_agent = "Mender/" MENDER_VERSION " (device_type=test; Linux 6.1.0; aarch64)";
+	http::Client client(client_config, loop);
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	req->SetAddress("http://127.0.0.1:" TEST_PORT);
+	client.AsyncCall(
+		req,
+		[](http::ExpectedIncomingResponsePtr exp_resp) {
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+		},
+		[&loop](http::ExpectedIncomingResponsePtr exp_resp) {
+			loop.Stop();
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+		});
+
+	loop.Run();
+
+	EXPECT_TRUE(server_hit_header);
+}
+
+TEST(HttpTest, ConnectionRecorder) {
+	TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::TestServer server(server_config, loop);
+	server.AsyncServeUrl(
+		"http://127.0.0.1:" TEST_PORT,
+		[](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+		},
+		[](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto exp_resp = exp_req.value()->MakeResponse();
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+			auto resp = exp_resp.value();
+
+			resp->SetStatusCodeAndMessage(204, "No Content");
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	vector<http::ConnectionRecord> records;
+	http::ClientConfig client_config;
+	client_config.connection_recorder = [&records](const http::ConnectionRecord &record) {
+		records.push_back(record);
+	};
+	http::Client client(client_config, loop);
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	req->SetAddress("http://127.0.0.1:" TEST_PORT "/path?secret=1");
+	client.AsyncCall(
+		req,
+		[](http::ExpectedIncomingResponsePtr exp_resp) {
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+		},
+		[&loop](http::ExpectedIncomingResponsePtr exp_resp) {
+			loop.Stop();
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+		});
+
+	loop.Run();
+
+	ASSERT_EQ(records.size(), 1);
+	const auto &record = records[0];
+	EXPECT_EQ(record.method, "GET");
+	EXPECT_EQ(record.host, "127.0.0.1");
+	EXPECT_EQ(record.port, 8001);
+	EXPECT_FALSE(record.proxy);
+	EXPECT_EQ(record.address, "127.0.0.1");
+	EXPECT_GE(record.resolved_ms, 0);
+	EXPECT_GE(record.connected_ms, record.resolved_ms);
+	EXPECT_EQ(record.tls_handshake_ms, -1);
+	EXPECT_GE(record.response_ms, record.connected_ms);
+	EXPECT_GE(record.total_ms, record.response_ms);
+	EXPECT_EQ(record.tls_version, "");
+	EXPECT_GT(record.bytes_sent, 0);
+	EXPECT_GT(record.bytes_received, 0);
+	EXPECT_EQ(record.status_code, 204);
+	EXPECT_EQ(record.error, "");
+#ifdef __linux__
+	EXPECT_TRUE(record.has_tcp_info);
+#endif
+
+	// Failed requests are recorded too.
+	req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	req->SetAddress("http://127.0.0.1:1");
+	client.AsyncCall(
+		req,
+		[&loop](http::ExpectedIncomingResponsePtr exp_resp) {
+			loop.Stop();
+			EXPECT_FALSE(exp_resp);
+		},
+		[](http::ExpectedIncomingResponsePtr exp_resp) { FAIL(); });
+
+	loop.Run();
+
+	ASSERT_EQ(records.size(), 2);
+	EXPECT_EQ(records[1].port, 1);
+	EXPECT_EQ(records[1].connected_ms, -1);
+	EXPECT_EQ(records[1].status_code, 0);
+	EXPECT_NE(records[1].error, "");
+}
+
+TEST(HttpTest, KeepAlive) {
+	for (bool enabled : {true, false}) {
+		TestEventLoop loop;
+		KeepAliveServer server(loop);
+
+		http::ClientConfig client_config;
+		client_config.keep_alive.enabled = enabled;
+		http::Client client(client_config, loop);
+
+		int responses = 0;
+		vector<uint8_t> received_body;
+		io::AsyncReaderPtr reader;
+		function<void()> call = [&]() {
+			auto req = make_shared<http::OutgoingRequest>();
+			req->SetMethod(http::Method::GET);
+			req->SetAddress(server.Url() + "/" + to_string(responses));
+			auto err = client.AsyncCall(
+				req,
+				[&received_body, &reader](http::ExpectedIncomingResponsePtr exp_resp) {
+					ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+					received_body.clear();
+					auto body_writer = make_shared<io::ByteWriter>(received_body);
+					body_writer->SetUnlimited(true);
+					auto exp_reader = exp_resp.value()->MakeBodyAsyncReader();
+					ASSERT_TRUE(exp_reader) << exp_reader.error().String();
+					reader = exp_reader.value();
+					io::AsyncCopy(body_writer, reader, [](error::Error err) {
+						EXPECT_EQ(err, error::NoError) << err.String();
+					});
+				},
+				[&](http::ExpectedIncomingResponsePtr exp_resp) {
+					ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+					EXPECT_EQ(string(received_body.begin(), received_body.end()), "ok");
+					if (++responses < 3) {
+						call();
+					} else {
+						loop.Stop();
+					}
+				});
+			ASSERT_EQ(err, error::NoError);
+		};
+		call();
+
+		loop.Run();
+
+		EXPECT_EQ(responses, 3);
+		ASSERT_EQ(server.requests.size(), 3);
+		EXPECT_EQ(server.connections, enabled ? 1 : 3);
+		EXPECT_EQ(
+			server.requests[0].find("Connection: close") != string::npos
+				|| server.requests[0].find("Connection: Close") != string::npos,
+			!enabled)
+			<< server.requests[0];
+	}
+}
+
 TEST(HttpTest, TestMultipleSimultaneousConnections) {
 	// Start one request, and when it has been received, start a second one and finish it
 	// completely before completing the first one.
@@ -853,6 +1124,98 @@ TEST(HttpTest, TestResponseBody) {
 	loop.Run();
 }
 
+TEST(HttpTest, TestResponseBodyWithLinkTuning) {
+	int count = 0;
+
+	TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::TestServer server(server_config, loop);
+	vector<uint8_t> received_body;
+	server.AsyncServeUrl(
+		"http://127.0.0.1:" TEST_PORT,
+		[](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+		},
+		[&loop, &count](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+
+			auto result = exp_req.value()->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetHeader("Content-Length", to_string(BodyOfXes::TARGET_BODY_SIZE));
+			resp->SetBodyReader(make_shared<BodyOfXes>());
+			resp->SetStatusCodeAndMessage(200, "Success");
+			resp->AsyncReply([&loop, &count](error::Error err) {
+				ASSERT_EQ(error::NoError, err);
+				if (++count >= 2) {
+					loop.Stop();
+				}
+			});
+		});
+
+	http::ClientConfig client_config;
+	client_config.link_tuning = http::LinkTuning {
+		.tcp_max_segment_size = 536,
+		.tls_max_fragment_length = 0,
+		.read_buffer_size = 1000,
+		.stall_timeout = chrono::seconds {10},
+	};
+	http::Client client(client_config, loop);
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	req->SetAddress("http://127.0.0.1:" TEST_PORT);
+	client.AsyncCall(
+		req,
+		[&received_body](http::ExpectedIncomingResponsePtr exp_resp) {
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+			auto resp = exp_resp.value();
+
+			auto content_length = resp->GetHeader("Content-Length");
+			ASSERT_TRUE(content_length);
+			ASSERT_EQ(content_length.value(), to_string(BodyOfXes::TARGET_BODY_SIZE));
+
+			auto body_writer = make_shared<io::ByteWriter>(received_body);
+			body_writer->SetUnlimited(true);
+			resp->SetBodyWriter(body_writer);
+		},
+		[&received_body, &loop, &count](http::ExpectedIncomingResponsePtr exp_resp) {
+			ASSERT_TRUE(exp_resp) << exp_resp.error().String();
+
+			vector<uint8_t> expected_body;
+			io::ByteWriter expected_writer(expected_body);
+			expected_writer.SetUnlimited(true);
+			io::Copy(expected_writer, *make_shared<BodyOfXes>());
+
+			ASSERT_EQ(received_body.size(), expected_body.size());
+			EXPECT_EQ(received_body, expected_body)
+				<< "Body not received correctly. Difference at index "
+					   + to_string(
+						   mismatch(
+							   received_body.begin(), received_body.end(), expected_body.begin())
+							   .first
+						   - received_body.begin());
+			if (++count >= 2) {
+				loop.Stop();
+			}
+		});
+
+	loop.Run();
+}
+
+TEST(HttpTest, LinkTuningToString) {
+	EXPECT_EQ(http::LinkTuningToString(http::LinkTuning {}), "default settings");
+	EXPECT_EQ(
+		http::LinkTuningToString(http::LinkTuning {
+			.tcp_max_segment_size = 536,
+			.tls_max_fragment_length = 1024,
+			.read_buffer_size = 4096,
+			.stall_timeout = chrono::seconds {60},
+		}),
+		"TCP MSS 536, TLS max fragment length 1024, read buffer 4096, stall timeout 60s");
+}
+
 TEST(HttpTest, TestChunkedResponseBody) {
 	int count = 0;
 
@@ -2199,6 +2562,77 @@ TEST(HttpsTest, NoCertificateError) {
 	EXPECT_FALSE(client_hit_body);
 }
 
+TEST(HttpsTest, CertificatePinning) {
+	mendertesting::TemporaryDirectory tmpdir;
+	string script = R"(#! /bin/sh
+	  exec openssl s_server -www )";
+	script += " -key server.localhost.key";
+	script += " -cert server.localhost.crt";
+	script += " -accept " TEST_PORT;
+
+	const string script_fname = tmpdir.Path() + "/test-script.sh";
+	{
+		std::ofstream os(script_fname.c_str(), std::ios::out);
+		os << script;
+	}
+	int ret = chmod(script_fname.c_str(), S_IRUSR | S_IWUSR | S_IXUSR);
+	ASSERT_EQ(ret, 0);
+	processes::Process server({script_fname});
+	auto err = server.Start();
+	ASSERT_EQ(err, error::NoError);
+	std::this_thread::sleep_for(std::chrono::seconds {1}); // Give the server a little time to setup
+
+	// The keys of server.localhost.crt and server.wrong.crt.
+	const string localhost_pin {"GzfKBR7gdXjjq5K2e6qDeZ7vcv9391Y9E1MzD6kd0eA="};
+	const string wrong_pin {"1sRnZwjDRyKFnLIQssP5bkNL0NfhqAK3Zu1ChREH5Q0="};
+
+	auto request_succeeds = [](const http::ClientConfig &client_config) {
+		TestEventLoop loop;
+		http::Client client(client_config, loop);
+		auto req = make_shared<http::OutgoingRequest>();
+		req->SetMethod(http::Method::GET);
+		req->SetAddress("https://localhost:" TEST_PORT "/index.html");
+		bool success {false};
+		auto err = client.AsyncCall(
+			req,
+			[&success, &loop](http::ExpectedIncomingResponsePtr exp_resp) {
+				success = exp_resp.has_value();
+				if (!exp_resp) {
+					loop.Stop();
+				}
+			},
+			[&loop](http::ExpectedIncomingResponsePtr exp_resp) { loop.Stop(); });
+		EXPECT_EQ(error::NoError, err);
+		loop.Run();
+		return success;
+	};
+
+	http::ClientConfig client_config {"server.localhost.crt"};
+	client_config.certificate_pinning.hosts["localhost"] = {wrong_pin, localhost_pin};
+	EXPECT_TRUE(request_succeeds(client_config));
+
+	client_config.certificate_pinning.hosts["localhost"] = {wrong_pin};
+	EXPECT_FALSE(request_succeeds(client_config));
+
+	// Other hosts aren't affected.
+	client_config.certificate_pinning.hosts.clear();
+	client_config.certificate_pinning.hosts["hosted.mender.io"] = {wrong_pin};
+	EXPECT_TRUE(request_succeeds(client_config));
+
+	// On the loopback interface, the certificate is only trusted through the exception, which
+	// also stands in for the pins.
+	client_config.server_cert_path = "server.wrong.crt";
+	client_config.certificate_pinning.hosts["localhost"] = {wrong_pin};
+	EXPECT_FALSE(request_succeeds(client_config));
+	client_config.certificate_pinning.exceptions = {{{"lo"}, {}, "server.localhost.crt"}};
+	EXPECT_TRUE(request_succeeds(client_config));
+
+	// But not on other networks.
+	client_config.certificate_pinning.exceptions = {
+		{{"eth-factory"}, {"Factory-WLAN"}, "server.localhost.crt"}};
+	EXPECT_FALSE(request_succeeds(client_config));
+}
+
 TEST(HttpsTest, CorrectDefaultCertificateStoreVerification) {
 	TestEventLoop loop(chrono::seconds(30));
 
@@ -2428,6 +2862,55 @@ TEST(HttpTest, ExponentialBackoff) {
 	}
 }
 
+TEST(HttpTest, ExponentialBackoffFactorAndJitter) {
+	http::ExponentialBackoff::ExpectedInterval exp_interval;
+
+	auto duration_fmt = [](chrono::milliseconds ms) { return to_string(ms.count()) + "ms"; };
+
+	{
+		http::ExponentialBackoff backoff(chrono::minutes(10), 9);
+		backoff.SetFactor(1.5);
+		const vector<chrono::milliseconds> expected_intervals {
+			chrono::seconds(60),
+			chrono::seconds(60),
+			chrono::seconds(60),
+			chrono::seconds(90),
+			chrono::seconds(90),
+			chrono::seconds(90),
+			chrono::seconds(135),
+			chrono::seconds(135),
+			chrono::seconds(135),
+		};
+		for (const auto &expected_interval : expected_intervals) {
+			exp_interval = backoff.NextInterval();
+			ASSERT_TRUE(exp_interval) << exp_interval.error().String();
+			EXPECT_EQ(exp_interval.value(), expected_interval) << duration_fmt(exp_interval.value());
+		}
+		exp_interval = backoff.NextInterval();
+		ASSERT_FALSE(exp_interval);
+		EXPECT_EQ(exp_interval.error().code, http::MakeError(http::MaxRetryError, "").code);
+	}
+
+	{
+		http::ExponentialBackoff backoff(chrono::minutes(2), 30);
+		backoff.SetJitter(0.25);
+		for (int attempt = 0; attempt < 30; attempt++) {
+			exp_interval = backoff.NextInterval();
+			ASSERT_TRUE(exp_interval) << exp_interval.error().String();
+			// The max interval is a hard ceiling.
+			if (attempt < 3) {
+				EXPECT_GE(exp_interval.value(), chrono::seconds(45))
+					<< duration_fmt(exp_interval.value());
+			} else {
+				EXPECT_GE(exp_interval.value(), chrono::seconds(90))
+					<< duration_fmt(exp_interval.value());
+			}
+			EXPECT_LE(exp_interval.value(), chrono::minutes(2))
+				<< duration_fmt(exp_interval.value());
+		}
+	}
+}
+
 TEST(HttpsTest, MtlsFailureNoClientCertificate) {
 	TestEventLoop loop;
 
@@ -2592,3 +3075,104 @@ TEST(HttpsTest, CertsAndKeysLoadFailures) {
 		EXPECT_NE(err, error::NoError);
 	}
 }
+
+TEST(HttpsTest, ClientCertificateReloadedWhenChanged) {
+	TestEventLoop loop(chrono::seconds(30));
+	mendertesting::TemporaryDirectory tmpdir;
+
+	auto handler = [](http::ExpectedIncomingResponsePtr exp_resp) {};
+
+	auto req = make_shared<http::OutgoingRequest>();
+	req->SetMethod(http::Method::GET);
+	ASSERT_EQ(req->SetAddress("https://mender.io"), error::NoError);
+
+	auto cert = path::Join(tmpdir.Path(), "client.crt");
+	auto key = path::Join(tmpdir.Path(), "client.key");
+	ASSERT_EQ(path::FileCopy("client.localhost.crt", cert), error::NoError);
+	ASSERT_EQ(path::FileCopy("client.localhost.key", key), error::NoError);
+
+	http::ClientConfig config {
+		.client_cert_path = cert,
+		.client_cert_key_path = key,
+	};
+	http::Client client(config, loop);
+	auto err = client.AsyncCall(req, handler, handler);
+	EXPECT_EQ(err, error::NoError);
+	client.Cancel();
+
+	// Change the modification time explicitly, since the file system may not have a fine
+	// enough resolution for the rewrite to be noticed.
+	auto bump_write_time = [](const string &file) {
+		auto time = fs::last_write_time(file);
+		fs::last_write_time(file, time + chrono::seconds {1});
+	};
+
+	{
+		ofstream f(cert);
+		f << "not a certificate";
+	}
+	bump_write_time(cert);
+	err = client.AsyncCall(req, handler, handler);
+	EXPECT_NE(err, error::NoError);
+
+	ASSERT_EQ(path::FileCopy("client.localhost.crt", cert), error::NoError);
+	bump_write_time(cert);
+	err = client.AsyncCall(req, handler, handler);
+	EXPECT_EQ(err, error::NoError);
+	client.Cancel();
+}
+
+TEST(HttpsTest, ServerCertificateReloadedWhenChanged) {
+	mendertesting::TemporaryDirectory tmpdir;
+	string script = R"(#! /bin/sh
+	  exec openssl s_server -www )";
+	script += " -key server.localhost.key";
+	script += " -cert server.localhost.crt";
+	script += " -accept " TEST_PORT;
+
+	const string script_fname = tmpdir.Path() + "/test-script.sh";
+	{
+		std::ofstream os(script_fname.c_str(), std::ios::out);
+		os << script;
+	}
+	int ret = chmod(script_fname.c_str(), S_IRUSR | S_IWUSR | S_IXUSR);
+	ASSERT_EQ(ret, 0);
+	processes::Process server({script_fname});
+	auto err = server.Start();
+	ASSERT_EQ(err, error::NoError);
+	std::this_thread::sleep_for(std::chrono::seconds {1}); // Give the server a little time to setup
+
+	auto cert = path::Join(tmpdir.Path(), "server.crt");
+	ASSERT_EQ(path::FileCopy("server.wrong.crt", cert), error::NoError);
+
+	TestEventLoop loop;
+	http::ClientConfig client_config {cert};
+	http::Client client(client_config, loop);
+	auto request_succeeds = [&client, &loop]() {
+		auto req = make_shared<http::OutgoingRequest>();
+		req->SetMethod(http::Method::GET);
+		req->SetAddress("https://localhost:" TEST_PORT "/index.html");
+		bool success {false};
+		auto err = client.AsyncCall(
+			req,
+			[&success, &loop](http::ExpectedIncomingResponsePtr exp_resp) {
+				success = exp_resp.has_value();
+				if (!exp_resp) {
+					loop.Stop();
+				}
+			},
+			[&loop](http::ExpectedIncomingResponsePtr exp_resp) { loop.Stop(); });
+		EXPECT_EQ(error::NoError, err);
+		loop.Run();
+		return success;
+	};
+
+	EXPECT_FALSE(request_succeeds());
+
+	// The same client trusts the server once the certificate has been replaced. Change the
+	// modification time explicitly, since the file system may not have a fine enough resolution
+	// for the rewrite to be noticed.
+	ASSERT_EQ(path::FileCopy("server.localhost.crt", cert), error::NoError);
+	fs::last_write_time(cert, fs::last_write_time(cert) + chrono::seconds {1});
+	EXPECT_TRUE(request_succeeds());
+}
@@ -536,3 +536,22 @@ TEST(IO, TestBufferedReaderDiscard) {
 	ex_bytes_rewind = buffered_reader2.Rewind();
 	ASSERT_FALSE(ex_bytes_rewind.has_value()) << ex_bytes_rewind.value();
 }
+
+TEST(IO, TestCountingReader) {
+	vector<uint8_t> vec_read {1, 2, 3, 4, 5, 6, 7, 14};
+	io::CountingReader counting_reader {make_shared<io::ByteReader>(vec_read)};
+	EXPECT_EQ(counting_reader.BytesRead(), 0);
+
+	vector<uint8_t> vec_write_partial(3);
+	auto ex_bytes_read = counting_reader.Read(vec_write_partial.begin(), vec_write_partial.end());
+	ASSERT_TRUE(ex_bytes_read.has_value()) << ex_bytes_read.error().String();
+	EXPECT_EQ(counting_reader.BytesRead(), 3);
+
+	vector<uint8_t> vec_write {};
+	auto byte_writer = io::ByteWriter(vec_write);
+	byte_writer.SetUnlimited(true);
+	auto err = Copy(byte_writer, counting_reader);
+	ASSERT_EQ(error::NoError, err);
+	EXPECT_EQ(vec_write, (vector<uint8_t> {4, 5, 6, 7, 14}));
+	EXPECT_EQ(counting_reader.BytesRead(), 8);
+}
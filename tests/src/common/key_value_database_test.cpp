@@ -16,6 +16,7 @@
 
 #include <common/common.hpp>
 #include <common/config.h>
+#include <common/key_value_database_encrypted.hpp>
 
 #ifdef MENDER_USE_LMDB
 #include <common/key_value_database_lmdb.hpp>
@@ -44,9 +45,17 @@ struct KeyValueDatabaseSetup {
 	string name;
 	// Order is important here: db should be destroyed before tmpdir.
 	shared_ptr<mender::common::testing::TemporaryDirectory> tmpdir;
+	// Only for the databases which wrap another one.
+	shared_ptr<kvdb::KeyValueDatabase> inner_db;
 	shared_ptr<kvdb::KeyValueDatabase> db;
 };
 
+#ifdef MENDER_USE_LMDB
+using BackendDatabase = kvdb::KeyValueDatabaseLmdb;
+#else
+using BackendDatabase = kvdb::KeyValueDatabaseBlobdb;
+#endif
+
 class KeyValueDatabaseTest : public testing::TestWithParam<KeyValueDatabaseSetup> {};
 
 static vector<KeyValueDatabaseSetup> GenerateDatabaseSetups() {
@@ -71,6 +80,19 @@ static vector<KeyValueDatabaseSetup> GenerateDatabaseSetups() {
 	ret.push_back(elem);
 #endif
 
+	elem = {};
+	elem.name = "Encrypted";
+	elem.tmpdir = std::make_shared<mender::common::testing::TemporaryDirectory>();
+	auto inner_db = std::make_shared<BackendDatabase>();
+	err = inner_db->Open(path::Join(elem.tmpdir->Path(), "mender-store"));
+	assert(err == error::NoError);
+	auto encrypted_db = std::make_shared<kvdb::KeyValueDatabaseEncrypted>(*inner_db);
+	err = encrypted_db->Open(vector<uint8_t>(32, 's'), {});
+	assert(err == error::NoError);
+	elem.inner_db = inner_db;
+	elem.db = encrypted_db;
+	ret.push_back(elem);
+
 	return ret;
 }
 
@@ -262,3 +284,108 @@ TEST(KeyValueDatabaseLmdbTest, CorruptedDatabaseRecovery) {
 	EXPECT_THAT(err.String(), testing::HasSubstr("Is a directory"));
 }
 #endif // MENDER_USE_LMDB
+
+TEST(KeyValueDatabaseEncryptedTest, EncryptsCleartextValues) {
+	mtesting::TemporaryDirectory tmpdir;
+	BackendDatabase inner_db;
+	auto err = inner_db.Open(path::Join(tmpdir.Path(), "db"));
+	ASSERT_EQ(error::NoError, err);
+	ASSERT_EQ(error::NoError, inner_db.Write("name", common::ByteVectorFromString("release-1")));
+	ASSERT_EQ(error::NoError, inner_db.Write("other", common::ByteVectorFromString("other")));
+
+	const vector<uint8_t> secret(40, 's');
+	vector<uint8_t> encrypted_value;
+	{
+		kvdb::KeyValueDatabaseEncrypted db {inner_db};
+		err = db.Open(secret, {"name", "missing"});
+		ASSERT_EQ(error::NoError, err) << err.String();
+
+		auto exp_value = db.Read("name");
+		ASSERT_TRUE(exp_value) << exp_value.error().String();
+		EXPECT_EQ(common::StringFromByteVector(exp_value.value()), "release-1");
+
+		// Only the given keys are encrypted.
+		exp_value = db.Read("other");
+		ASSERT_FALSE(exp_value);
+		EXPECT_EQ(exp_value.error().code, kvdb::MakeError(kvdb::EncryptionError, "").code);
+		exp_value = db.Read("missing");
+		ASSERT_FALSE(exp_value);
+		EXPECT_EQ(exp_value.error().code, kvdb::MakeError(kvdb::KeyError, "").code);
+	}
+
+	auto exp_raw = inner_db.Read("name");
+	ASSERT_TRUE(exp_raw);
+	EXPECT_TRUE(kvdb::IsEncryptedValue(exp_raw.value()));
+	EXPECT_THAT(
+		common::StringFromByteVector(exp_raw.value()),
+		testing::Not(testing::HasSubstr("release-1")));
+	encrypted_value = exp_raw.value();
+
+	{
+		// Already encrypted, so nothing is encrypted again.
+		kvdb::KeyValueDatabaseEncrypted db {inner_db};
+		err = db.Open(secret, {"name"});
+		ASSERT_EQ(error::NoError, err) << err.String();
+		exp_raw = inner_db.Read("name");
+		ASSERT_TRUE(exp_raw);
+		EXPECT_EQ(exp_raw.value(), encrypted_value);
+	}
+
+	{
+		kvdb::KeyValueDatabaseEncrypted db {inner_db};
+		err = db.Open(vector<uint8_t>(40, 'x'), {"name"});
+		ASSERT_NE(error::NoError, err);
+		EXPECT_EQ(err.code, kvdb::MakeError(kvdb::EncryptionError, "").code);
+		EXPECT_THAT(err.String(), testing::HasSubstr("another secret"));
+	}
+}
+
+TEST(KeyValueDatabaseEncryptedTest, RejectsModifiedValues) {
+	mtesting::TemporaryDirectory tmpdir;
+	BackendDatabase inner_db;
+	auto err = inner_db.Open(path::Join(tmpdir.Path(), "db"));
+	ASSERT_EQ(error::NoError, err);
+
+	kvdb::KeyValueDatabaseEncrypted db {inner_db};
+	err = db.Open(vector<uint8_t>(32, 's'), {});
+	ASSERT_EQ(error::NoError, err) << err.String();
+	ASSERT_EQ(error::NoError, db.Write("name", common::ByteVectorFromString("release-1")));
+
+	auto exp_raw = inner_db.Read("name");
+	ASSERT_TRUE(exp_raw);
+
+	// Values can't be moved to another key.
+	ASSERT_EQ(error::NoError, inner_db.Write("moved", exp_raw.value()));
+	auto exp_value = db.Read("moved");
+	ASSERT_FALSE(exp_value);
+	EXPECT_EQ(exp_value.error().code, kvdb::MakeError(kvdb::EncryptionError, "").code);
+
+	auto modified = exp_raw.value();
+	modified.back() ^= 0x01;
+	ASSERT_EQ(error::NoError, inner_db.Write("name", modified));
+	exp_value = db.Read("name");
+	ASSERT_FALSE(exp_value);
+	EXPECT_EQ(exp_value.error().code, kvdb::MakeError(kvdb::EncryptionError, "").code);
+
+	ASSERT_EQ(error::NoError, inner_db.Write("name", common::ByteVectorFromString("release-2")));
+	exp_value = db.Read("name");
+	ASSERT_FALSE(exp_value);
+	EXPECT_EQ(exp_value.error().code, kvdb::MakeError(kvdb::EncryptionError, "").code);
+}
+
+TEST(KeyValueDatabaseEncryptedTest, ShortSecret) {
+	mtesting::TemporaryDirectory tmpdir;
+	BackendDatabase inner_db;
+	auto err = inner_db.Open(path::Join(tmpdir.Path(), "db"));
+	ASSERT_EQ(error::NoError, err);
+
+	kvdb::KeyValueDatabaseEncrypted db {inner_db};
+	err = db.Open(vector<uint8_t>(31, 's'), {});
+	ASSERT_NE(error::NoError, err);
+	EXPECT_EQ(err.code, kvdb::MakeError(kvdb::EncryptionError, "").code);
+
+	// Nothing was written.
+	auto exp_marker = inner_db.Read(kvdb::KeyValueDatabaseEncrypted::kMarkerKey);
+	ASSERT_FALSE(exp_marker);
+	EXPECT_EQ(exp_marker.error().code, kvdb::MakeError(kvdb::KeyError, "").code);
+}
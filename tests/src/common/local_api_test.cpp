@@ -0,0 +1,151 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <common/local_api.hpp>
+
+#include <fstream>
+#include <functional>
+#include <string>
+
+#include <boost/asio.hpp>
+
+#include <gtest/gtest.h>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/expected.hpp>
+#include <common/path.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace asio = boost::asio;
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace expected = mender::common::expected;
+namespace local_api = mender::common::local_api;
+namespace mtesting = mender::common::testing;
+namespace path = mender::common::path;
+
+using local = asio::local::stream_protocol;
+
+// Sends one request, and reads the response until the server closes the connection.
+class TestClient : public events::EventLoopObject {
+public:
+	TestClient(events::EventLoop &loop) :
+		socket_ {GetAsioIoContext(loop)} {
+	}
+
+	void Request(const string &socket_path, const string &request, function<void()> done) {
+		request_ = request;
+		done_ = done;
+		socket_.async_connect(
+			local::endpoint {socket_path}, [this](const boost::system::error_code &ec) {
+				ASSERT_FALSE(ec) << ec.message();
+				asio::async_write(
+					socket_,
+					asio::buffer(request_),
+					[this](const boost::system::error_code &ec, size_t) {
+						ASSERT_FALSE(ec) << ec.message();
+						Read();
+					});
+			});
+	}
+
+	string response;
+
+private:
+	void Read() {
+		socket_.async_read_some(
+			asio::buffer(read_buffer_), [this](const boost::system::error_code &ec, size_t n) {
+				if (ec) {
+					done_();
+					return;
+				}
+				response.append(read_buffer_, n);
+				Read();
+			});
+	}
+
+	local::socket socket_;
+	string request_;
+	function<void()> done_;
+	char read_buffer_[1024];
+};
+
+TEST(LocalApiTests, HandleRequest) {
+	mtesting::TestEventLoop loop;
+	local_api::Server server {loop};
+	server.AddMethodHandler(
+		"io.mender.Test1", "Echo", [](const string &argument) -> expected::ExpectedString {
+			if (argument == "") {
+				return expected::unexpected(error::Error(
+					make_error_condition(errc::invalid_argument), "Nothing to \"echo\""));
+			}
+			return "\"" + argument + "\"";
+		});
+
+	auto response = server.HandleRequest("POST", "/io.mender.Test1/Echo", "hello");
+	EXPECT_EQ(response.status, 200);
+	EXPECT_EQ(response.body, "\"hello\"");
+
+	response = server.HandleRequest("POST", "/io.mender.Test1/Echo", "");
+	EXPECT_EQ(response.status, 400);
+	EXPECT_NE(response.body.find(R"(Nothing to \"echo\")"), string::npos) << response.body;
+
+	response = server.HandleRequest("GET", "/io.mender.Test1/Echo", "");
+	EXPECT_EQ(response.status, 405);
+
+	response = server.HandleRequest("POST", "/io.mender.Test1/Missing", "");
+	EXPECT_EQ(response.status, 404);
+	EXPECT_EQ(response.body, R"({"error":"No such method: /io.mender.Test1/Missing"})");
+}
+
+TEST(LocalApiTests, ServeOverSocket) {
+	mtesting::TemporaryDirectory tmpdir;
+	// A leftover from a previous run.
+	auto socket_path = path::Join(tmpdir.Path(), "run", "update.sock");
+	ASSERT_EQ(path::CreateDirectories(path::DirName(socket_path)), error::NoError);
+	{
+		ofstream leftover(socket_path);
+	}
+
+	mtesting::TestEventLoop loop;
+	local_api::Server server {loop};
+	server.AddMethodHandler(
+		"io.mender.Update1", "GetStatus", [](const string &) -> expected::ExpectedString {
+			return R"({"state":"idle"})";
+		});
+	auto err = server.Listen(socket_path);
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	TestClient client {loop};
+	client.Request(
+		socket_path,
+		"POST /io.mender.Update1/GetStatus HTTP/1.1\r\n"
+		"Host: localhost\r\n"
+		"Content-Length: 0\r\n"
+		"Connection: close\r\n"
+		"\r\n",
+		[&loop]() { loop.Stop(); });
+	loop.Run();
+
+	EXPECT_EQ(client.response.rfind("HTTP/1.1 200 OK\r\n", 0), 0) << client.response;
+	EXPECT_NE(client.response.find("Content-Type: application/json\r\n"), string::npos);
+	EXPECT_NE(client.response.find("\r\n\r\n{\"state\":\"idle\"}"), string::npos);
+
+	server.Cancel();
+	EXPECT_FALSE(path::FileExists(socket_path));
+}
@@ -31,6 +31,7 @@ protected:
 	void SetUp() override {
 		namespace log = mender::common::log;
 		log::SetLevel(log::LogLevel::Info);
+		log::SetFormat(log::LogFormat::Logfmt);
 	}
 };
 
@@ -134,6 +135,112 @@ TEST_F(LogTestEnv, LoggerLevelFilters) {
 	EXPECT_THAT(output, testing::HasSubstr("Foobar"));
 }
 
+TEST_F(LogTestEnv, ModuleLevelOverride) {
+	namespace log = mender::common::log;
+	ASSERT_EQ(log::Level(), log::LogLevel::Info);
+
+	auto module_logger = log::Logger("TestModule:reader");
+	auto other_logger = log::Logger("OtherModule");
+
+	log::SetModuleLevel("TestModule", log::LogLevel::Debug);
+	auto later_logger = log::Logger("TestModule:writer").WithFields(log::LogField("foo", "bar"));
+
+	testing::internal::CaptureStderr();
+	module_logger.Debug("FromExisting");
+	later_logger.Debug("FromLater");
+	other_logger.Debug("FromOther");
+	log::Debug("FromGlobal");
+	auto output = testing::internal::GetCapturedStderr();
+	EXPECT_THAT(output, testing::HasSubstr("FromExisting"));
+	EXPECT_THAT(output, testing::HasSubstr("FromLater"));
+	EXPECT_THAT(output, testing::Not(testing::HasSubstr("FromOther")));
+	EXPECT_THAT(output, testing::Not(testing::HasSubstr("FromGlobal")));
+
+	log::ClearModuleLevel("TestModule");
+
+	testing::internal::CaptureStderr();
+	module_logger.Debug("AfterClear");
+	output = testing::internal::GetCapturedStderr();
+	EXPECT_EQ(output.size(), 0) << "Output is: " << output;
+}
+
+TEST_F(LogTestEnv, ModuleLevelFromString) {
+	namespace log = mender::common::log;
+
+	auto logger = log::Logger("TestModule");
+
+	EXPECT_EQ(log::SetModuleLevel("TestModule", "trace"), error::NoError);
+	EXPECT_EQ(logger.Level(), log::LogLevel::Trace);
+
+	EXPECT_EQ(log::SetModuleLevel("TestModule", ""), error::NoError);
+	EXPECT_EQ(logger.Level(), log::LogLevel::Info);
+
+	EXPECT_NE(log::SetModuleLevel("TestModule", "loud"), error::NoError);
+	EXPECT_EQ(logger.Level(), log::LogLevel::Info);
+
+	EXPECT_EQ(log::SetModuleLevel("", "warning"), error::NoError);
+	EXPECT_EQ(log::Level(), log::LogLevel::Warning);
+}
+
+TEST_F(LogTestEnv, JsonFormat) {
+	namespace log = mender::common::log;
+	auto logger = log::Logger("TestLogger", log::LogLevel::Info);
+
+	log::SetFormat(log::LogFormat::Json);
+	testing::internal::CaptureStderr();
+	logger.WithFields(log::LogField("foo", "bar")).Info("Say \"hello\"\n");
+	auto output = testing::internal::GetCapturedStderr();
+	log::SetFormat(log::LogFormat::Logfmt);
+
+	EXPECT_THAT(output, testing::StartsWith(R"({"timestamp":")"));
+	EXPECT_THAT(output, testing::HasSubstr(R"("level":"info",)"));
+	EXPECT_THAT(output, testing::HasSubstr(R"("module":"TestLogger",)"));
+	EXPECT_THAT(output, testing::HasSubstr(R"("foo":"bar",)"));
+	EXPECT_THAT(output, testing::HasSubstr(R"(,"message":"Say \"hello\"\n"})"));
+}
+
+TEST_F(LogTestEnv, LogFormatFromString) {
+	namespace log = mender::common::log;
+
+	auto ex_format = log::StringToLogFormat("json");
+	ASSERT_TRUE(ex_format);
+	EXPECT_EQ(ex_format.value(), log::LogFormat::Json);
+
+	ex_format = log::StringToLogFormat("logfmt");
+	ASSERT_TRUE(ex_format);
+	EXPECT_EQ(ex_format.value(), log::LogFormat::Logfmt);
+
+	ex_format = log::StringToLogFormat("xml");
+	ASSERT_FALSE(ex_format);
+	EXPECT_EQ(
+		ex_format.error().code,
+		log::MakeError(log::LogErrorCode::InvalidLogFormatError, "").code);
+}
+
+TEST_F(LogTestEnv, GlobalFields) {
+	namespace log = mender::common::log;
+	auto logger = log::Logger("TestLogger", log::LogLevel::Info);
+
+	log::SetGlobalField(log::LogField("deployment_id", "abc"));
+	log::SetGlobalField(log::LogField("deployment_id", "def"));
+	testing::internal::CaptureStderr();
+	logger.Info("Tagged");
+	log::Info("Tagged too");
+	auto output = testing::internal::GetCapturedStderr();
+	EXPECT_THAT(output, testing::Not(testing::HasSubstr(R"(deployment_id="abc")")));
+	EXPECT_THAT(output, testing::ContainsRegex(R"(deployment_id="def".*msg="Tagged")"));
+	EXPECT_THAT(output, testing::ContainsRegex(R"(deployment_id="def".*msg="Tagged too")"));
+
+	log::RemoveGlobalField("deployment_id");
+	// Removing a field which isn't set is fine.
+	log::RemoveGlobalField("deployment_id");
+	testing::internal::CaptureStderr();
+	logger.Info("Untagged");
+	output = testing::internal::GetCapturedStderr();
+	EXPECT_THAT(output, testing::HasSubstr(R"(msg="Untagged")"));
+	EXPECT_THAT(output, testing::Not(testing::HasSubstr("deployment_id")));
+}
+
 class FileLogTestEnv : public LogTestEnv {
 protected:
 	mender::common::testing::TemporaryDirectory logs_dir;
@@ -0,0 +1,274 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/mqtt.hpp>
+
+#include <functional>
+#include <string>
+#include <vector>
+
+#include <boost/asio.hpp>
+
+#include <gtest/gtest.h>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace asio = boost::asio;
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace mqtt = mender::common::mqtt;
+namespace mtesting = mender::common::testing;
+
+using tcp = asio::ip::tcp;
+
+// Accepts one connection, and acknowledges what a publisher sends.
+class FakeBroker : public events::EventLoopObject {
+public:
+	FakeBroker(events::EventLoop &loop, uint8_t connack_return_code = 0) :
+		acceptor_ {GetAsioIoContext(loop), tcp::endpoint(asio::ip::make_address("127.0.0.1"), 0)},
+		socket_ {GetAsioIoContext(loop)},
+		connack_return_code_ {connack_return_code} {
+		acceptor_.async_accept(socket_, [this](const boost::system::error_code &ec) {
+			if (!ec) {
+				Read();
+			}
+		});
+	}
+
+	string Url() {
+		return "mqtt://127.0.0.1:" + to_string(acceptor_.local_endpoint().port());
+	}
+
+	vector<mqtt::Packet> packets;
+	function<void()> on_disconnect;
+
+private:
+	void Read() {
+		socket_.async_read_some(
+			asio::buffer(read_buffer_), [this](const boost::system::error_code &ec, size_t n) {
+				if (ec) {
+					return;
+				}
+				incoming_.append(read_buffer_, n);
+				while (true) {
+					auto exp_packet = mqtt::TakePacket(incoming_);
+					ASSERT_TRUE(exp_packet) << exp_packet.error().String();
+					if (!exp_packet.value()) {
+						break;
+					}
+					Handle(exp_packet.value().value());
+				}
+				Read();
+			});
+	}
+
+	void Handle(const mqtt::Packet &packet) {
+		packets.push_back(packet);
+		if (packet.type == 1) {
+			Write({0x20, 0x02, 0x00, static_cast<char>(connack_return_code_)});
+		} else if (packet.type == 3 && (packet.flags & 0x06) == 0x02) {
+			// The packet ID follows the topic.
+			size_t topic_length = (static_cast<uint8_t>(packet.body[0]) << 8)
+								  | static_cast<uint8_t>(packet.body[1]);
+			Write(string {0x40, 0x02} + packet.body.substr(2 + topic_length, 2));
+		} else if (packet.type == 14 && on_disconnect) {
+			on_disconnect();
+		}
+	}
+
+	void Write(const string &data) {
+		pending_ += data;
+		if (!writing_) {
+			WritePending();
+		}
+	}
+
+	void WritePending() {
+		if (pending_.empty()) {
+			return;
+		}
+		writing_ = true;
+		outgoing_ = pending_;
+		pending_.clear();
+		asio::async_write(
+			socket_, asio::buffer(outgoing_), [this](const boost::system::error_code &ec, size_t) {
+				writing_ = false;
+				if (!ec) {
+					WritePending();
+				}
+			});
+	}
+
+	tcp::acceptor acceptor_;
+	tcp::socket socket_;
+	uint8_t connack_return_code_;
+	char read_buffer_[1024];
+	string incoming_;
+	string outgoing_;
+	string pending_;
+	bool writing_ {false};
+};
+
+TEST(MqttTests, BreakDownBrokerUrl) {
+	mqtt::Broker broker;
+	auto err = mqtt::BreakDownBrokerUrl("mqtt://broker.example.com", broker);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_FALSE(broker.tls);
+	EXPECT_EQ(broker.host, "broker.example.com");
+	EXPECT_EQ(broker.port, 1883);
+
+	err = mqtt::BreakDownBrokerUrl("mqtts://broker.example.com:8884/", broker);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_TRUE(broker.tls);
+	EXPECT_EQ(broker.host, "broker.example.com");
+	EXPECT_EQ(broker.port, 8884);
+
+	for (const auto &url : {
+			 "https://broker.example.com",
+			 "mqtt://",
+			 "mqtt://broker.example.com:port",
+			 "mqtt://broker.example.com:70000",
+			 "mqtt://broker.example.com/topic",
+		 }) {
+		err = mqtt::BreakDownBrokerUrl(url, broker);
+		EXPECT_EQ(err.code, mqtt::MakeError(mqtt::InvalidUrlError, "").code) << url;
+	}
+}
+
+TEST(MqttTests, Packets) {
+	mqtt::ClientConfig config;
+	config.client_id = "dev";
+	config.username = "user";
+	config.password = "pw";
+	EXPECT_EQ(
+		mqtt::ConnectPacket(config),
+		string("\x10\x19\x00\x04MQTT\x04\xc2\x00\x3c\x00\x03" "dev\x00\x04user\x00\x02pw", 27));
+
+	// A password is only sent along with a username.
+	config.username = "";
+	EXPECT_EQ(
+		mqtt::ConnectPacket(config),
+		string("\x10\x0f\x00\x04MQTT\x04\x02\x00\x3c\x00\x03" "dev", 17));
+
+	EXPECT_EQ(
+		mqtt::PublishPacket({"a/b", "{}", 0, false}, 0), string("\x30\x07\x00\x03" "a/b{}", 9));
+	EXPECT_EQ(
+		mqtt::PublishPacket({"a/b", "{}", 1, true}, 258),
+		string("\x33\x09\x00\x03" "a/b\x01\x02{}", 11));
+	EXPECT_EQ(mqtt::DisconnectPacket(), string("\xe0\x00", 2));
+
+	// Lengths over 127 take more than one byte.
+	auto packet = mqtt::PublishPacket({"t", string(200, 'x'), 0, false}, 0);
+	EXPECT_EQ(packet.substr(0, 3), "\x30\xcb\x01");
+	EXPECT_EQ(packet.size(), 206);
+}
+
+TEST(MqttTests, TakePacket) {
+	string buffer {"\x20\x02\x00", 3};
+	auto exp_packet = mqtt::TakePacket(buffer);
+	ASSERT_TRUE(exp_packet);
+	EXPECT_FALSE(exp_packet.value());
+	EXPECT_EQ(buffer.size(), 3);
+
+	buffer += string {"\x00\x40\x02\x00\x01\x40", 6};
+	exp_packet = mqtt::TakePacket(buffer);
+	ASSERT_TRUE(exp_packet);
+	ASSERT_TRUE(exp_packet.value());
+	EXPECT_EQ(exp_packet.value()->type, mqtt::kConnackPacket);
+	EXPECT_EQ(exp_packet.value()->body, string("\x00\x00", 2));
+
+	exp_packet = mqtt::TakePacket(buffer);
+	ASSERT_TRUE(exp_packet);
+	ASSERT_TRUE(exp_packet.value());
+	EXPECT_EQ(exp_packet.value()->type, mqtt::kPubackPacket);
+	EXPECT_EQ(exp_packet.value()->body, string("\x00\x01", 2));
+	EXPECT_EQ(buffer, "\x40");
+
+	buffer = "\x30\xff\xff\xff\xff\x01";
+	exp_packet = mqtt::TakePacket(buffer);
+	EXPECT_FALSE(exp_packet);
+}
+
+TEST(MqttTests, Publish) {
+	mtesting::TestEventLoop loop;
+	FakeBroker broker {loop};
+
+	mqtt::ClientConfig config;
+	config.broker_url = broker.Url();
+	config.client_id = "test-device";
+	mqtt::Publisher publisher {loop, config};
+
+	// Wait for both the publisher and the broker to be done.
+	bool handler_called {false};
+	bool disconnected {false};
+	broker.on_disconnect = [&]() {
+		disconnected = true;
+		if (handler_called) {
+			loop.Stop();
+		}
+	};
+	auto err = publisher.AsyncPublish(
+		{
+			{"mender/state", "first", 1, false},
+			{"mender/state", "second", 0, false},
+			{"mender/deployment", "third", 1, true},
+		},
+		[&](error::Error err) {
+			EXPECT_EQ(err, error::NoError) << err.String();
+			handler_called = true;
+			if (disconnected) {
+				loop.Stop();
+			}
+		});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+	EXPECT_TRUE(disconnected);
+
+	ASSERT_EQ(broker.packets.size(), 5);
+	EXPECT_EQ(broker.packets[0].type, 1);
+	EXPECT_EQ(broker.packets[1].type, 3);
+	EXPECT_EQ(broker.packets[1].flags, 0x02);
+	EXPECT_EQ(broker.packets[1].body, string("\x00\x0cmender/state\x00\x01" "first", 21));
+	EXPECT_EQ(broker.packets[2].flags, 0x00);
+	EXPECT_EQ(broker.packets[3].flags, 0x03);
+	EXPECT_EQ(broker.packets[4].type, 14);
+}
+
+TEST(MqttTests, ConnectionRefused) {
+	mtesting::TestEventLoop loop;
+	FakeBroker broker {loop, 5};
+
+	mqtt::ClientConfig config;
+	config.broker_url = broker.Url();
+	mqtt::Publisher publisher {loop, config};
+
+	bool handler_called {false};
+	auto err = publisher.AsyncPublish(
+		{{"mender/state", "first", 1, false}}, [&handler_called, &loop](error::Error err) {
+			EXPECT_EQ(err.code, mqtt::MakeError(mqtt::ConnectionRefusedError, "").code);
+			EXPECT_NE(err.String().find("Not authorized"), string::npos) << err.String();
+			handler_called = true;
+			loop.Stop();
+		});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+}
@@ -16,10 +16,16 @@
 #include <common/error.hpp>
 #include <common/path.hpp>
 #include <common/expected.hpp>
+#include <common/testing.hpp>
+
+#include <atomic>
+#include <chrono>
+#include <thread>
 
 namespace error = mender::common::error;
 namespace path = mender::common::path;
 namespace expected = mender::common::expected;
+namespace mtesting = mender::common::testing;
 using namespace std;
 
 
@@ -74,4 +80,29 @@ TEST(Path, IsWithinOrEqual) {
 
 	EXPECT_FALSE_NO_ERROR(path::IsWithinOrEqual("/completely/different/path/", "/path/to/dir"));
 	EXPECT_FALSE_NO_ERROR(path::IsWithinOrEqual("/completely/different/path/", "/path/to/dir/"));
-}
\ No newline at end of file
+}
+
+TEST(Path, LockFile) {
+	mtesting::TemporaryDirectory tmpdir;
+	const string lock_path = path::Join(tmpdir.Path(), "test.lock");
+
+	auto exp_lock = path::LockFile(lock_path);
+	ASSERT_TRUE(exp_lock) << exp_lock.error().String();
+	EXPECT_TRUE(path::FileExists(lock_path));
+
+	atomic<bool> locked {false};
+	thread other([&lock_path, &locked]() {
+		auto exp_other_lock = path::LockFile(lock_path);
+		EXPECT_TRUE(exp_other_lock) << exp_other_lock.error().String();
+		locked = true;
+	});
+
+	this_thread::sleep_for(chrono::milliseconds {200});
+	EXPECT_FALSE(locked);
+
+	exp_lock.value().reset();
+	other.join();
+	EXPECT_TRUE(locked);
+
+	EXPECT_FALSE(path::LockFile(path::Join(tmpdir.Path(), "missing", "test.lock")));
+}
@@ -16,6 +16,7 @@
 
 // setenv() does not exist in <cstdlib>
 #include <stdlib.h>
+#include <unistd.h>
 
 #include <gtest/gtest.h>
 #include <gmock/gmock.h>
@@ -261,6 +262,71 @@ TEST_F(DBusServerTests, DBusServerBoolMethodHandlingTest) {
 	EXPECT_TRUE(reply_handler_called);
 }
 
+TEST_F(DBusServerTests, DBusServerMethodAuthorizationTest) {
+	mtesting::TestEventLoop loop;
+
+	int allowed_calls {0};
+	dbus::DBusObject obj {"/io/mender/Test/Obj"};
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		"io.mender.Test.TestIface", "AllowedMethod", [&allowed_calls]() {
+			allowed_calls++;
+			return true;
+		});
+	obj.AddMethodHandler<expected::ExpectedBool>(
+		"io.mender.Test.TestIface", "RefusedMethod", []() -> expected::ExpectedBool {
+			ADD_FAILURE() << "Refused method called";
+			return true;
+		});
+	vector<dbus::MethodCaller> callers;
+	obj.SetMethodAuthorizer([&callers](const dbus::MethodCaller &caller, const string &spec) {
+		callers.push_back(caller);
+		return spec != "io.mender.Test.TestIface.RefusedMethod";
+	});
+
+	dbus::DBusServer server {loop, "io.mender.Test"};
+	auto err = server.AdvertiseObject(obj);
+	EXPECT_EQ(err, error::NoError);
+
+	dbus::DBusClient client {loop};
+	err = client.CallMethod<expected::ExpectedBool>(
+		"io.mender.Test",
+		"/io/mender/Test/Obj",
+		"io.mender.Test.TestIface",
+		"AllowedMethod",
+		[&loop](expected::ExpectedBool reply) {
+			ASSERT_TRUE(reply);
+			EXPECT_TRUE(reply.value());
+			loop.Stop();
+		});
+	EXPECT_EQ(err, error::NoError);
+	loop.Run();
+	EXPECT_EQ(allowed_calls, 1);
+
+	bool reply_handler_called {false};
+	err = client.CallMethod<expected::ExpectedBool>(
+		"io.mender.Test",
+		"/io/mender/Test/Obj",
+		"io.mender.Test.TestIface",
+		"RefusedMethod",
+		[&loop, &reply_handler_called](expected::ExpectedBool reply) {
+			ASSERT_FALSE(reply);
+			EXPECT_THAT(reply.error().String(), ::testing::HasSubstr("Not authorized"));
+			reply_handler_called = true;
+			loop.Stop();
+		});
+	EXPECT_EQ(err, error::NoError);
+	loop.Run();
+	EXPECT_TRUE(reply_handler_called);
+
+	ASSERT_EQ(callers.size(), 2);
+	for (const auto &caller : callers) {
+		EXPECT_EQ(caller.uid, getuid());
+		if (caller.user != "") {
+			EXPECT_THAT(caller.gids, ::testing::Contains(getgid()));
+		}
+	}
+}
+
 TEST_F(DBusServerTests, DBusServerBasicSignalTest) {
 	mtesting::TestEventLoop loop;
 
@@ -289,3 +355,102 @@ TEST_F(DBusServerTests, DBusServerBasicSignalTest) {
 	loop.Run();
 	EXPECT_TRUE(signal_handler_called);
 }
+
+// Calls a method of the test object with dbus-send, which doesn't block the loop the server needs.
+static error::Error CallWithDBusSend(
+	mtesting::TestEventLoop &loop, const vector<string> &method_args, string &output) {
+	vector<string> args {
+		"dbus-send", "--system", "--print-reply", "--dest=io.mender.Test", "/io/mender/Test/Obj"};
+	args.insert(args.end(), method_args.begin(), method_args.end());
+	procs::Process proc {args};
+
+	output.clear();
+	error::Error result;
+	auto err = proc.Start([&output](const char *data, size_t size) { output.append(data, size); });
+	if (err != error::NoError) {
+		return err;
+	}
+	err = proc.AsyncWait(loop, [&loop, &result](error::Error err) {
+		result = err;
+		loop.Stop();
+	});
+	if (err != error::NoError) {
+		return err;
+	}
+	loop.Run();
+	return result;
+}
+
+TEST_F(DBusServerTests, DBusServerPropertiesTest) {
+	mtesting::TestEventLoop loop;
+
+	string value {"test property value"};
+	dbus::DBusObject obj {"/io/mender/Test/Obj"};
+	obj.AddProperty("io.mender.Test.TestIface", "TestProperty", [&value]() { return value; });
+	obj.AddProperty("io.mender.Test.TestIface", "OtherProperty", []() { return "other value"; });
+
+	dbus::DBusServer server {loop, "io.mender.Test"};
+	auto err = server.AdvertiseObject(obj);
+	ASSERT_EQ(err, error::NoError);
+
+	string output;
+	err = CallWithDBusSend(
+		loop,
+		{"org.freedesktop.DBus.Properties.Get",
+		 "string:io.mender.Test.TestIface",
+		 "string:TestProperty"},
+		output);
+	ASSERT_EQ(err, error::NoError) << output;
+	EXPECT_THAT(output, ::testing::HasSubstr("variant"));
+	EXPECT_THAT(output, ::testing::HasSubstr(R"(string "test property value")"));
+
+	value = "changed value";
+	err = CallWithDBusSend(
+		loop, {"org.freedesktop.DBus.Properties.GetAll", "string:io.mender.Test.TestIface"}, output);
+	ASSERT_EQ(err, error::NoError) << output;
+	EXPECT_THAT(output, ::testing::HasSubstr(R"(string "TestProperty")"));
+	EXPECT_THAT(output, ::testing::HasSubstr(R"(string "changed value")"));
+	EXPECT_THAT(output, ::testing::HasSubstr(R"(string "OtherProperty")"));
+	EXPECT_THAT(output, ::testing::HasSubstr(R"(string "other value")"));
+
+	err = CallWithDBusSend(
+		loop,
+		{"org.freedesktop.DBus.Properties.Get",
+		 "string:io.mender.Test.TestIface",
+		 "string:NoSuchProperty"},
+		output);
+	EXPECT_NE(err, error::NoError);
+
+	err = CallWithDBusSend(
+		loop,
+		{"org.freedesktop.DBus.Properties.Set",
+		 "string:io.mender.Test.TestIface",
+		 "string:TestProperty",
+		 "variant:string:new value"},
+		output);
+	EXPECT_NE(err, error::NoError);
+	EXPECT_EQ(value, "changed value");
+}
+
+TEST_F(DBusServerTests, DBusServerPropertiesChangedTest) {
+	mtesting::TestEventLoop loop;
+
+	dbus::DBusObject obj {"/io/mender/Test/Obj"};
+	obj.AddProperty("io.mender.Test.TestIface", "TestProperty", []() { return "value"; });
+
+	dbus::DBusServer server {loop, "io.mender.Test"};
+	auto err = server.AdvertiseObject(obj);
+	ASSERT_EQ(err, error::NoError);
+
+	err = server.EmitPropertiesChanged(
+		"/io/mender/Test/Obj", "io.mender.Test.TestIface", {"TestProperty"});
+	EXPECT_EQ(err, error::NoError);
+
+	err = server.EmitPropertiesChanged(
+		"/io/mender/Test/Obj", "io.mender.Test.TestIface", {"NoSuchProperty"});
+	EXPECT_NE(err, error::NoError);
+
+	err = server.EmitPropertiesChanged(
+		"/io/mender/Test/NoSuchObj", "io.mender.Test.TestIface", {"TestProperty"});
+	EXPECT_NE(err, error::NoError);
+}
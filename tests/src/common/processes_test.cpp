@@ -190,6 +190,58 @@ exit 0
 	EXPECT_EQ(exit_status, 0);
 }
 
+TEST_F(ProcessesTests, SchedulingPriority) {
+	mtesting::TemporaryDirectory tmpdir;
+
+	string startedfile = path::Join(tmpdir.Path(), "started");
+	string outputfile = path::Join(tmpdir.Path(), "output");
+
+	// The niceness is applied once Start() returns, so wait until then.
+	string script = R"(#!/bin/sh
+while [ ! -e )" + startedfile
+					+ R"( ]; do
+    :
+done
+nice > )" + outputfile
+					+ R"(
+)";
+	auto ret = PrepareTestScript(script);
+	ASSERT_TRUE(ret);
+
+	procs::Process proc({TestScriptPath()});
+	proc.SetSchedulingPriority({.niceness = 5});
+	auto err = proc.Start();
+	ASSERT_EQ(err, error::NoError);
+	ofstream(startedfile).close();
+
+	err = proc.Wait();
+	ASSERT_EQ(err, error::NoError);
+	ifstream output(outputfile);
+	int niceness {0};
+	output >> niceness;
+	// Or the niceness of the test itself, if it is higher, since it can't be lowered without
+	// privileges.
+	EXPECT_GE(niceness, 5);
+}
+
+TEST_F(ProcessesTests, Environment) {
+	string script = R"(#!/bin/sh
+echo "$MENDER_TEST_VARIABLE"
+if [ -n "$PATH" ]; then
+    echo "PATH is inherited"
+fi
+)";
+	auto ret = PrepareTestScript(script);
+	ASSERT_TRUE(ret);
+
+	procs::Process proc({TestScriptPath()});
+	proc.SetEnvironment({{"MENDER_TEST_VARIABLE", "some value"}});
+	auto ex_line_data = proc.GenerateLineData();
+	ASSERT_TRUE(ex_line_data);
+	EXPECT_EQ(proc.GetExitStatus(), 0);
+	EXPECT_EQ(ex_line_data.value(), (vector<string> {"some value", "PATH is inherited"}));
+}
+
 TEST_F(ProcessesTests, Terminate) {
 	auto ld_preload = conf::GetEnv("LD_PRELOAD", "");
 	if (ld_preload.find("/valgrind/") != string::npos) {
@@ -530,3 +582,110 @@ exit 1
 
 	EXPECT_TRUE(hit_handler);
 }
+
+TEST_F(ProcessesTests, ScriptRunnerKeepsTheFirstLine) {
+	mtesting::TestEventLoop loop;
+
+	string script = R"(#!/bin/sh
+printf "The disk "
+sleep 0.1
+echo "is full"
+echo "More details"
+echo "On stderr" 1>&2
+exit 1
+)";
+	auto ret = PrepareTestScript(script);
+	ASSERT_TRUE(ret);
+
+	procs::ScriptRunner runner {"Test script output"};
+	bool hit_handler {false};
+	auto err = runner.AsyncRun(
+		loop,
+		{TestScriptPath()},
+		chrono::seconds {5},
+		[&](error::Error err, const string &first_line) {
+			EXPECT_EQ(err.code, procs::MakeError(procs::NonZeroExitStatusError, "").code);
+			EXPECT_EQ(first_line, "The disk is full");
+			EXPECT_FALSE(runner.Running());
+			hit_handler = true;
+			loop.Stop();
+		});
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_TRUE(runner.Running());
+
+	loop.Run();
+
+	EXPECT_TRUE(hit_handler);
+}
+
+TEST_F(ProcessesTests, ScriptRunnerTimesOut) {
+	mtesting::TestEventLoop loop;
+
+	string script = R"(#!/bin/sh
+sleep 10
+exit 0
+)";
+	auto ret = PrepareTestScript(script);
+	ASSERT_TRUE(ret);
+
+	procs::ScriptRunner runner {"Test script output"};
+	bool hit_handler {false};
+	auto err = runner.AsyncRun(
+		loop,
+		{TestScriptPath()},
+		chrono::milliseconds {100},
+		[&](error::Error err, const string &first_line) {
+			EXPECT_EQ(err.code, make_error_condition(errc::timed_out));
+			EXPECT_EQ(first_line, "");
+			hit_handler = true;
+			loop.Stop();
+		});
+	ASSERT_EQ(err, error::NoError);
+
+	loop.Run();
+
+	EXPECT_TRUE(hit_handler);
+}
+
+TEST_F(ProcessesTests, ScriptRunnerCancel) {
+	mtesting::TestEventLoop loop;
+
+	string script = R"(#!/bin/sh
+sleep 10
+exit 0
+)";
+	auto ret = PrepareTestScript(script);
+	ASSERT_TRUE(ret);
+
+	procs::ScriptRunner runner {"Test script output"};
+	bool hit_handler {false};
+	auto err = runner.AsyncRun(
+		loop,
+		{TestScriptPath()},
+		chrono::seconds {5},
+		[&hit_handler](error::Error err, const string &first_line) { hit_handler = true; });
+	ASSERT_EQ(err, error::NoError);
+
+	runner.Cancel();
+	EXPECT_FALSE(runner.Running());
+
+	mender::common::events::Timer timer {loop};
+	timer.AsyncWait(chrono::milliseconds {500}, [&loop](error::Error err) { loop.Stop(); });
+	loop.Run();
+
+	// Cancelling terminates the script, without calling the handler.
+	EXPECT_FALSE(hit_handler);
+}
+
+TEST_F(ProcessesTests, ScriptRunnerStartError) {
+	mtesting::TestEventLoop loop;
+
+	procs::ScriptRunner runner {"Test script output"};
+	auto err = runner.AsyncRun(
+		loop,
+		{path::Join(tmpdir_->Path(), "does-not-exist")},
+		chrono::seconds {5},
+		[](error::Error err, const string &first_line) { FAIL() << "Unexpected handler call"; });
+	EXPECT_NE(err, error::NoError);
+	EXPECT_FALSE(runner.Running());
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+#include <common/state_machine.hpp>
+
+#include <functional>
+#include <string>
+#include <vector>
+
+#include <gtest/gtest.h>
+
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace mtesting = mender::common::testing;
+namespace sm = mender::common::state_machine;
+
+enum class TestEvent {
+	Go,
+};
+
+string StateEventToString(const TestEvent &event) {
+	switch (event) {
+	case TestEvent::Go:
+		return "Go";
+	}
+	return "Unknown";
+}
+
+struct TestContext {
+	vector<string> entered;
+};
+
+using TestPoster = sm::EventPoster<TestEvent>;
+
+class TestState : public sm::State<TestContext, TestEvent> {
+public:
+	using Action = function<void(TestPoster &poster)>;
+
+	TestState(const string &name, Action action = nullptr) :
+		name_(name),
+		action_(action) {
+	}
+
+	void OnEnter(TestContext &ctx, TestPoster &poster) override {
+		ctx.entered.push_back(name_);
+		if (action_) {
+			action_(poster);
+		}
+	}
+
+private:
+	string name_;
+	Action action_;
+};
+
+using TestMachine = sm::StateMachine<TestContext, TestEvent>;
+using TestRunner = sm::StateMachineRunner<TestContext, TestEvent>;
+
+TEST(StateMachineTests, EventsWaitWhilePaused) {
+	mtesting::TestEventLoop loop;
+	TestContext ctx;
+
+	TestState start {"start"};
+	TestState next {"next", [&loop](TestPoster &poster) { loop.Stop(); }};
+
+	TestMachine machine {start};
+	machine.AddTransition(start, TestEvent::Go, next, sm::TransitionFlag::Immediate);
+
+	TestRunner runner {ctx};
+	runner.AddStateMachine(machine);
+	runner.AttachToEventLoop(loop);
+
+	runner.Pause();
+	EXPECT_TRUE(runner.Paused());
+	runner.PostEvent(TestEvent::Go);
+
+	loop.Post([&]() {
+		// Not even the start state is entered while paused, and the event stays queued.
+		EXPECT_TRUE(ctx.entered.empty());
+		EXPECT_TRUE(runner.HasPendingEvents());
+		EXPECT_EQ(&machine.GetCurrentState(), &start);
+
+		runner.Resume();
+		EXPECT_FALSE(runner.Paused());
+	});
+
+	loop.Run();
+
+	EXPECT_EQ(ctx.entered, (vector<string> {"start", "next"}));
+	EXPECT_EQ(&machine.GetCurrentState(), &next);
+	EXPECT_FALSE(runner.HasPendingEvents());
+}
+
+TEST(StateMachineTests, EventsPostedByAStateWaitWhilePaused) {
+	mtesting::TestEventLoop loop;
+	TestContext ctx;
+
+	TestRunner runner {ctx};
+
+	// The state pauses the runner itself, like the debug console may do while it is running.
+	TestState start {"start", [&](TestPoster &poster) {
+						 runner.Pause();
+						 poster.PostEvent(TestEvent::Go);
+						 loop.Post([&]() {
+							 EXPECT_EQ(ctx.entered, vector<string> {"start"});
+							 EXPECT_TRUE(runner.HasPendingEvents());
+							 runner.Resume();
+						 });
+					 }};
+	TestState next {"next", [&loop](TestPoster &poster) { loop.Stop(); }};
+
+	TestMachine machine {start};
+	machine.AddTransition(start, TestEvent::Go, next, sm::TransitionFlag::Immediate);
+
+	runner.AddStateMachine(machine);
+	runner.AttachToEventLoop(loop);
+
+	loop.Run();
+
+	EXPECT_EQ(ctx.entered, (vector<string> {"start", "next"}));
+	EXPECT_FALSE(runner.HasPendingEvents());
+}
+
+TEST(StateMachineTests, IterationCallbackOncePerIteration) {
+	mtesting::TestEventLoop loop;
+	TestContext ctx;
+
+	auto post_go = [](TestPoster &poster) { poster.PostEvent(TestEvent::Go); };
+	TestState start {"start", post_go};
+	TestState middle {"middle", post_go};
+	TestState end {"end", [&loop](TestPoster &poster) { loop.Stop(); }};
+
+	TestMachine machine {start};
+	machine.AddTransition(start, TestEvent::Go, middle, sm::TransitionFlag::Immediate);
+	machine.AddTransition(middle, TestEvent::Go, end, sm::TransitionFlag::Immediate);
+
+	// A second machine, which enters its states in the same iterations as the first one, until
+	// it has no transition for the event.
+	TestState other_start {"other_start"};
+	TestState other_next {"other_next"};
+	TestMachine other {other_start};
+	other.AddTransition(other_start, TestEvent::Go, other_next, sm::TransitionFlag::Immediate);
+
+	TestRunner runner {ctx};
+	runner.AddStateMachine(machine);
+	runner.AddStateMachine(other);
+
+	// How many states had been entered at each call.
+	vector<size_t> entered_at_iteration;
+	runner.SetIterationCallback([&]() { entered_at_iteration.push_back(ctx.entered.size()); });
+
+	runner.AttachToEventLoop(loop);
+	loop.Run();
+
+	EXPECT_EQ(entered_at_iteration, (vector<size_t> {2, 4, 5}));
+	EXPECT_EQ(&machine.GetCurrentState(), &end);
+	EXPECT_EQ(&other.GetCurrentState(), &other_next);
+}
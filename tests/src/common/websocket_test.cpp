@@ -0,0 +1,196 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <common/websocket.hpp>
+
+#include <string>
+#include <vector>
+
+#include <unistd.h>
+
+#include <gtest/gtest.h>
+
+#include <common/error.hpp>
+#include <common/events.hpp>
+#include <common/events_io.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace error = mender::common::error;
+namespace events = mender::common::events;
+namespace io = mender::common::io;
+namespace mtesting = mender::common::testing;
+namespace websocket = mender::common::websocket;
+
+using TestEventLoop = mtesting::TestEventLoop;
+
+// What the server sends, which isn't masked.
+static string ServerFrame(bool fin, uint8_t opcode, const string &payload) {
+	string frame;
+	frame += static_cast<char>((fin ? 0x80 : 0) | opcode);
+	frame += static_cast<char>(payload.size());
+	return frame + payload;
+}
+
+TEST(WebSocketTests, Frames) {
+	auto frame = websocket::ClientFrame(websocket::kTextFrame, "Hello", 0x37fa213d);
+	// The example of a masked frame in RFC 6455, section 5.7.
+	EXPECT_EQ(frame, string("\x81\x85\x37\xfa\x21\x3d\x7f\x9f\x4d\x51\x58", 11));
+
+	// A lone first byte is not a frame yet.
+	string buffer = frame.substr(0, 1);
+	auto exp_frame = websocket::TakeFrame(buffer);
+	ASSERT_TRUE(exp_frame) << exp_frame.error().String();
+	EXPECT_FALSE(exp_frame.value());
+
+	buffer = frame + ServerFrame(false, websocket::kBinaryFrame, "abc");
+	exp_frame = websocket::TakeFrame(buffer);
+	ASSERT_TRUE(exp_frame) << exp_frame.error().String();
+	ASSERT_TRUE(exp_frame.value());
+	EXPECT_TRUE(exp_frame.value()->fin);
+	EXPECT_EQ(exp_frame.value()->opcode, websocket::kTextFrame);
+	EXPECT_EQ(exp_frame.value()->payload, "Hello");
+
+	exp_frame = websocket::TakeFrame(buffer);
+	ASSERT_TRUE(exp_frame) << exp_frame.error().String();
+	ASSERT_TRUE(exp_frame.value());
+	EXPECT_FALSE(exp_frame.value()->fin);
+	EXPECT_EQ(exp_frame.value()->opcode, websocket::kBinaryFrame);
+	EXPECT_EQ(exp_frame.value()->payload, "abc");
+	EXPECT_EQ(buffer, "");
+
+	// 16 bit length.
+	string large(300, 'x');
+	buffer = websocket::ClientFrame(websocket::kBinaryFrame, large, 0);
+	EXPECT_EQ(buffer.size(), 2 + 2 + 4 + large.size());
+	exp_frame = websocket::TakeFrame(buffer);
+	ASSERT_TRUE(exp_frame) << exp_frame.error().String();
+	ASSERT_TRUE(exp_frame.value());
+	EXPECT_EQ(exp_frame.value()->payload, large);
+
+	// Control frames can't be fragmented.
+	buffer = ServerFrame(false, websocket::kPingFrame, "");
+	exp_frame = websocket::TakeFrame(buffer);
+	EXPECT_FALSE(exp_frame);
+
+	auto key = websocket::MakeKey();
+	EXPECT_EQ(key.size(), 24);
+	EXPECT_EQ(key.substr(22), "==");
+	EXPECT_NE(key, websocket::MakeKey());
+}
+
+// Reads from one pipe, and writes to another one.
+class PipeSocket : virtual public io::AsyncReadWriter {
+public:
+	PipeSocket(events::EventLoop &loop, int read_fd, int write_fd) :
+		reader_ {loop, read_fd},
+		writer_ {loop, write_fd} {
+	}
+
+	error::Error AsyncRead(
+		vector<uint8_t>::iterator start,
+		vector<uint8_t>::iterator end,
+		io::AsyncIoHandler handler) override {
+		return reader_.AsyncRead(start, end, handler);
+	}
+
+	error::Error AsyncWrite(
+		vector<uint8_t>::const_iterator start,
+		vector<uint8_t>::const_iterator end,
+		io::AsyncIoHandler handler) override {
+		return writer_.AsyncWrite(start, end, handler);
+	}
+
+	void Cancel() override {
+		reader_.Cancel();
+		writer_.Cancel();
+	}
+
+private:
+	events::io::AsyncFileDescriptorReader reader_;
+	events::io::AsyncFileDescriptorWriter writer_;
+};
+
+TEST(WebSocketTests, Connection) {
+	TestEventLoop loop;
+
+	int to_client[2];
+	ASSERT_EQ(pipe(to_client), 0);
+	int to_server[2];
+	ASSERT_EQ(pipe(to_server), 0);
+
+	websocket::Connection connection {
+		make_shared<PipeSocket>(loop, to_client[0], to_server[1])};
+	events::io::AsyncFileDescriptorWriter server_writer {loop, to_client[1]};
+	events::io::AsyncFileDescriptorReader server_reader {loop, to_server[0]};
+
+	vector<string> messages;
+	bool closed {false};
+	auto err = connection.AsyncStart(
+		[&messages](const websocket::Message &message) { messages.push_back(message.payload); },
+		[&loop, &closed](error::Error err) {
+			EXPECT_EQ(err, error::NoError) << err.String();
+			closed = true;
+			loop.Stop();
+		});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	string server_data = ServerFrame(true, websocket::kPingFrame, "p")
+						 + ServerFrame(false, websocket::kTextFrame, "Hel")
+						 + ServerFrame(true, websocket::kContinuationFrame, "lo")
+						 + ServerFrame(true, websocket::kCloseFrame, string {"\x03\xe8", 2});
+	vector<uint8_t> to_send(server_data.begin(), server_data.end());
+	err = server_writer.AsyncWrite(to_send.begin(), to_send.end(), [](io::ExpectedSize result) {
+		EXPECT_TRUE(result);
+	});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	loop.Run();
+
+	EXPECT_TRUE(closed);
+	EXPECT_EQ(messages, vector<string> {"Hello"});
+	EXPECT_TRUE(connection.TakeActivity());
+	EXPECT_FALSE(connection.TakeActivity());
+
+	// The client answered the ping, and echoed the close.
+	vector<uint8_t> buf(100);
+	string client_data;
+	server_reader.RepeatedAsyncRead(
+		buf.begin(), buf.end(), [&loop, &buf, &client_data](io::ExpectedSize result) {
+			EXPECT_TRUE(result) << result.error().String();
+			if (result) {
+				client_data.append(buf.begin(), buf.begin() + result.value());
+			}
+			// The two frames, with a 1 and a 2 byte payload.
+			if (!result || client_data.size() >= 2 * 6 + 3) {
+				loop.Stop();
+				return io::Repeat::No;
+			}
+			return io::Repeat::Yes;
+		});
+	loop.Run();
+
+	auto exp_frame = websocket::TakeFrame(client_data);
+	ASSERT_TRUE(exp_frame) << exp_frame.error().String();
+	ASSERT_TRUE(exp_frame.value());
+	EXPECT_EQ(exp_frame.value()->opcode, websocket::kPongFrame);
+	EXPECT_EQ(exp_frame.value()->payload, "p");
+	exp_frame = websocket::TakeFrame(client_data);
+	ASSERT_TRUE(exp_frame) << exp_frame.error().String();
+	ASSERT_TRUE(exp_frame.value());
+	EXPECT_EQ(exp_frame.value()->opcode, websocket::kCloseFrame);
+	EXPECT_EQ(exp_frame.value()->payload, string("\x03\xe8", 2));
+}
@@ -170,6 +170,18 @@ echo ID=ABC
 	server_loop_thread.join();
 }
 
+TEST(CliTest, SetTenantTokenWithoutDaemon) {
+	mtesting::TemporaryDirectory tmpdir;
+
+	vector<string> args = {"--datastore", tmpdir.Path(), "set-tenant-token", "new-tenant-token"};
+	EXPECT_EQ(cli::Main(args), 0);
+	EXPECT_TRUE(
+		mtesting::FileContains(path::Join(tmpdir.Path(), "tenant-token"), "new-tenant-token\n"));
+
+	args = {"--datastore", tmpdir.Path(), "set-tenant-token"};
+	EXPECT_EQ(cli::Main(args), 1);
+}
+
 TEST(CliTest, Version) {
 	{
 		vector<string> args {"--version"};
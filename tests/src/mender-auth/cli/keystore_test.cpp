@@ -98,3 +98,16 @@ TEST(CliTest, KeyStoreSaveNonExistingPath) {
 	EXPECT_THAT(err.message, testing::StartsWith("Failed to create file"));
 	EXPECT_THAT(err.message, testing::HasSubstr("No such file or directory"));
 }
+
+TEST(CliTest, KeyStoreInToken) {
+	cli::MenderKeyStore store_file("/data/mender/mender-agent.pem", "", cli::StaticKey::No, "");
+	EXPECT_FALSE(store_file.InToken());
+
+	cli::MenderKeyStore store_token(
+		"pkcs11:token=mender;object=device", "", cli::StaticKey::No, "");
+	EXPECT_TRUE(store_token.InToken());
+
+	// Nothing to write, the key is stored in the token when it is generated.
+	auto err = store_token.Save();
+	EXPECT_EQ(cli::MakeError(cli::NoKeysError, "").code, err.code);
+}
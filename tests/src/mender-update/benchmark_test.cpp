@@ -0,0 +1,125 @@
+// Copyright 2026 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+
+#include <mender-update/benchmark.hpp>
+
+#include <fstream>
+#include <string>
+
+#include <gtest/gtest.h>
+
+#include <common/path.hpp>
+#include <common/testing.hpp>
+
+using namespace std;
+
+namespace benchmark = mender::update::benchmark;
+namespace mtesting = mender::common::testing;
+namespace path = mender::common::path;
+
+TEST(BenchmarkTests, WriteThroughputToFile) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto file = path::Join(tmpdir.Path(), "partition");
+	{
+		ofstream f(file);
+	}
+
+	auto exp_write = benchmark::MeasureWriteThroughput(file, 3 * 1024 * 1024 + 10);
+	ASSERT_TRUE(exp_write) << exp_write.error().String();
+	EXPECT_GT(exp_write.value(), 0);
+
+	ifstream f(file, ios::ate | ios::binary);
+	EXPECT_EQ(f.tellg(), 3 * 1024 * 1024 + 10);
+}
+
+TEST(BenchmarkTests, WriteThroughputWithWriterOptions) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto file = path::Join(tmpdir.Path(), "partition");
+	{
+		ofstream f(file);
+	}
+
+	benchmark::WriterOptions options;
+	options.buffer_size = 64 * 1024;
+	options.sync_interval = 1024 * 1024;
+	auto exp_write = benchmark::MeasureWriteThroughput(file, 3 * 1024 * 1024 + 10, options);
+	ASSERT_TRUE(exp_write) << exp_write.error().String();
+	EXPECT_GT(exp_write.value(), 0);
+
+	ifstream f(file, ios::ate | ios::binary);
+	EXPECT_EQ(f.tellg(), 3 * 1024 * 1024 + 10);
+
+	// O_DIRECT needs aligned writes.
+	options.direct = true;
+	options.buffer_size = 1000;
+	exp_write = benchmark::MeasureWriteThroughput(file, 1024 * 1024, options);
+	EXPECT_FALSE(exp_write);
+}
+
+TEST(BenchmarkTests, WriteThroughputRefusesOtherFiles) {
+	mtesting::TemporaryDirectory tmpdir;
+
+	auto exp_write = benchmark::MeasureWriteThroughput(tmpdir.Path(), 1024);
+	EXPECT_FALSE(exp_write);
+
+	exp_write = benchmark::MeasureWriteThroughput(path::Join(tmpdir.Path(), "missing"), 1024);
+	EXPECT_FALSE(exp_write);
+}
+
+TEST(BenchmarkTests, ChecksumThroughput) {
+	auto exp_checksum = benchmark::MeasureChecksumThroughput(8 * 1024 * 1024);
+	ASSERT_TRUE(exp_checksum) << exp_checksum.error().String();
+	EXPECT_GT(exp_checksum.value(), 0);
+}
+
+TEST(BenchmarkTests, KeyValuesAndReport) {
+	benchmark::Results results;
+	results.time = 1700000000;
+	results.checksum_bytes_per_second = 200 * 1024 * 1024;
+
+	EXPECT_EQ(
+		benchmark::ToKeyValues(results),
+		"time=1700000000\n"
+		"checksum_mib_per_second=200.0\n");
+	EXPECT_NE(benchmark::Report(results).find("pass the inactive partition"), string::npos);
+
+	results.device = "/dev/mmcblk0p3";
+	results.write_bytes_per_second = 10.5 * 1024 * 1024;
+	results.bootenv_write_latency = chrono::milliseconds {42};
+
+	EXPECT_EQ(
+		benchmark::ToKeyValues(results),
+		"time=1700000000\n"
+		"write_device=/dev/mmcblk0p3\n"
+		"write_mib_per_second=10.5\n"
+		"checksum_mib_per_second=200.0\n"
+		"bootenv_write_ms=42\n");
+	// Limited by the write throughput: 1024 / 10.5.
+	EXPECT_NE(
+		benchmark::Report(results).find("Installing a 1 GiB payload takes at least 97 seconds"),
+		string::npos);
+
+	EXPECT_NE(
+		benchmark::Report(results).find("Write throughput to /dev/mmcblk0p3: 10.5"), string::npos);
+
+	results.write_options.direct = true;
+	results.write_options.buffer_size = 64 * 1024;
+	results.write_options.sync_interval = 16 * 1024 * 1024;
+	EXPECT_NE(
+		benchmark::Report(results).find(
+			"Write throughput to /dev/mmcblk0p3 (O_DIRECT, 64 KiB writes, flushed every 16 MiB): "
+			"10.5 MiB/s"),
+		string::npos);
+}
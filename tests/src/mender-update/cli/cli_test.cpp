@@ -20,6 +20,7 @@
 #include <gtest/gtest.h>
 #include <gmock/gmock.h>
 
+#include <artifact/sha/sha.hpp>
 #include <common/common.hpp>
 #include <client_shared/conf.hpp>
 #include <common/error.hpp>
@@ -38,6 +39,7 @@ namespace error = mender::common::error;
 namespace mtesting = mender::common::testing;
 namespace path = mender::common::path;
 namespace processes = mender::common::processes;
+namespace sha = mender::sha;
 
 using namespace std;
 
@@ -108,6 +110,32 @@ TEST(CliTest, ShowArtifact) {
 		EXPECT_EQ(cli::Main(args), 0);
 		EXPECT_EQ(redirect_output.GetCout(), "my-name\n");
 	}
+
+	{
+		mtesting::RedirectStreamOutputs redirect_output;
+		vector<string> args {"--datastore", tmpdir.Path(), "show-artifact", "--json"};
+		EXPECT_EQ(cli::Main(args), 0);
+		EXPECT_EQ(
+			redirect_output.GetCout(),
+			R"({"artifact_name":"my-name","artifact_group":"","device_type":null})"
+			"\n");
+	}
+
+	{
+		ofstream f(path::Join(tmpdir.Path(), "device_type"));
+		f << "device_type=my-device\n";
+		ASSERT_TRUE(f.good());
+	}
+
+	{
+		mtesting::RedirectStreamOutputs redirect_output;
+		vector<string> args {"--datastore", tmpdir.Path(), "show-artifact", "--json"};
+		EXPECT_EQ(cli::Main(args), 0);
+		EXPECT_EQ(
+			redirect_output.GetCout(),
+			R"({"artifact_name":"my-name","artifact_group":"","device_type":"my-device"})"
+			"\n");
+	}
 }
 
 TEST(CliTest, ShowArtifactErrors) {
@@ -205,6 +233,16 @@ TEST(CliTest, ShowProvides) {
 		verify("rootfs-image.checksum=abc\nartifact_name=my-name\n");
 	}
 
+	{
+		mtesting::RedirectStreamOutputs redirect_output;
+		vector<string> args {"--datastore", tmpdir.Path(), "show-provides", "--json"};
+		EXPECT_EQ(cli::Main(args), 0);
+		EXPECT_EQ(
+			redirect_output.GetCout(),
+			R"({"artifact_name":"my-name","rootfs-image.checksum":"abc"})"
+			"\n");
+	}
+
 	{
 		SCOPED_TRACE("Line number");
 		write(R"({"artifact_name":"this-one", "rootfs-image.checksum":"abc"})", "not-this-one", "");
@@ -264,6 +302,52 @@ TEST(CliTest, ShowProvidesErrors) {
 	}
 }
 
+TEST(CliTest, Freeze) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto freeze_file = path::Join(tmpdir.Path(), "device-freeze");
+
+	{
+		mtesting::RedirectStreamOutputs redirect_output;
+		vector<string> args {
+			"--datastore", tmpdir.Path(), "freeze", "--until", "2099-01-01T00:00:00Z"};
+		EXPECT_EQ(cli::Main(args), 0);
+		EXPECT_THAT(redirect_output.GetCout(), testing::EndsWith(R"(,"until":4070908800}
+)"));
+	}
+	EXPECT_TRUE(path::FileExists(freeze_file));
+
+	{
+		mtesting::RedirectStreamOutputs redirect_output;
+		vector<string> args {"--datastore", tmpdir.Path(), "freeze", "--release"};
+		EXPECT_EQ(cli::Main(args), 0);
+		EXPECT_EQ(redirect_output.GetCout(), "");
+	}
+	EXPECT_FALSE(path::FileExists(freeze_file));
+
+	{
+		mtesting::RedirectStreamOutputs redirect_output;
+		vector<string> args {"--datastore", tmpdir.Path(), "freeze", "--until", "tomorrow"};
+		EXPECT_EQ(cli::Main(args), 1);
+		EXPECT_THAT(redirect_output.GetCerr(), testing::HasSubstr("RFC 3339"));
+	}
+
+	{
+		mtesting::RedirectStreamOutputs redirect_output;
+		vector<string> args {
+			"--datastore",
+			tmpdir.Path(),
+			"freeze",
+			"--until",
+			"2099-01-01T00:00:00Z",
+			"--release"};
+		EXPECT_EQ(cli::Main(args), 1);
+		EXPECT_THAT(
+			redirect_output.GetCerr(),
+			testing::HasSubstr("--until and --release cannot be used together"));
+	}
+	EXPECT_FALSE(path::FileExists(freeze_file));
+}
+
 void SetTestDir(const string &dir, context::MenderContext &ctx) {
 	ctx.GetConfig().paths.SetModulesPath(dir);
 	ctx.GetConfig().paths.SetModulesWorkPath(dir);
@@ -490,6 +574,67 @@ artifact_name=test
 )"));
 }
 
+TEST(CliTest, InstallDryRun) {
+	mtesting::TemporaryDirectory tmpdir;
+	string artifact = path::Join(tmpdir.Path(), "artifact.mender");
+	ASSERT_TRUE(PrepareSimpleArtifact(tmpdir.Path(), artifact));
+
+	string update_module = path::Join(tmpdir.Path(), "rootfs-image");
+
+	ASSERT_TRUE(PrepareUpdateModule(update_module, R"(#!/bin/bash
+
+TEST_DIR=")" + tmpdir.Path() + R"("
+
+echo "$1" >> $TEST_DIR/call.log
+exit 0
+)"));
+
+	{
+		vector<string> args {
+			"--datastore",
+			tmpdir.Path(),
+			"install",
+			"--dry-run",
+			artifact,
+		};
+
+		mtesting::RedirectStreamOutputs output;
+		int exit_status = cli::Main(
+			args, [&tmpdir](context::MenderContext &ctx) { SetTestDir(tmpdir.Path(), ctx); });
+		EXPECT_EQ(exit_status, 0) << exit_status;
+
+		auto out = output.GetCout();
+		EXPECT_THAT(out, testing::StartsWith(R"(Dry run, nothing was installed
+Artifact: test
+Signature: none
+Payload: rootfs-image, installed by )" + update_module + R"(
+  payload: 5 bytes, checksum verified
+Free space: )"));
+		EXPECT_THAT(out, testing::EndsWith("State scripts in the Artifact, not run: none\n"));
+		EXPECT_EQ(output.GetCerr(), "");
+	}
+
+	// The Update Module isn't called, and nothing is recorded.
+	EXPECT_FALSE(path::FileExists(path::Join(tmpdir.Path(), "call.log")));
+	EXPECT_TRUE(VerifyProvides(tmpdir.Path(), ""));
+
+	{
+		vector<string> args {
+			"--datastore",
+			tmpdir.Path(),
+			"install",
+			"--dry-run",
+			path::Join(tmpdir.Path(), "missing.mender"),
+		};
+
+		mtesting::RedirectStreamOutputs output;
+		int exit_status = cli::Main(
+			args, [&tmpdir](context::MenderContext &ctx) { SetTestDir(tmpdir.Path(), ctx); });
+		EXPECT_NE(exit_status, 0);
+		EXPECT_EQ(output.GetCout(), "");
+	}
+}
+
 TEST(CliTest, InstallAndCommitArtifactCheckProvidesDepends) {
 	/* Install two Artifacts. One to install some provides, and the second one to
 	 verify the depends
@@ -581,7 +726,7 @@ System not modified.
 		EXPECT_THAT(
 			output.GetCerr(),
 			testing::HasSubstr(
-				"Provides value 'f2ca1bb6c7e907d06dafe4687e579fce76b37e4e93b7605022da52e6ccc26fd2' doesn't match any of the 'rootfs-image.checksum' artifact depends"));
+				"Artifact depends not satisfied: Provides value 'f2ca1bb6c7e907d06dafe4687e579fce76b37e4e93b7605022da52e6ccc26fd2' doesn't match any of the 'rootfs-image.checksum' artifact depends"));
 	}
 }
 
@@ -1770,6 +1915,18 @@ TEST(CliTest, InvalidInstallArguments) {
 
 		EXPECT_THAT(output.GetCerr(), testing::EndsWith("Unrecognized option '--bogus'\n"));
 	}
+
+	{
+		vector<string> args {"install", "--checksum", "abc123", "artifact"};
+
+		mtesting::RedirectStreamOutputs output;
+		int exit_status = cli::Main(args);
+		EXPECT_EQ(exit_status, 1) << exit_status;
+
+		EXPECT_THAT(
+			output.GetCerr(),
+			testing::EndsWith("--checksum needs a SHA256 checksum, 64 hexadecimal digits\n"));
+	}
 }
 
 TEST(CliTest, InstallAndThenCommitLegacyArtifact) {
@@ -2143,6 +2300,209 @@ artifact_name=test
 )"));
 }
 
+TEST(CliTest, InstallArtifactFromNetworkWithChecksum) {
+	mtesting::TemporaryDirectory tmpdir;
+
+	ASSERT_TRUE(InitDefaultProvides(tmpdir.Path()));
+
+	string artifact = path::Join(tmpdir.Path(), "artifact.mender");
+	ASSERT_TRUE(PrepareSimpleArtifact(tmpdir.Path(), artifact));
+
+	ifstream artifact_stream(artifact, ios::binary);
+	vector<uint8_t> artifact_data {istreambuf_iterator<char>(artifact_stream), {}};
+	auto shasum = sha::Shasum(artifact_data);
+	ASSERT_TRUE(shasum) << shasum.error().String();
+
+	string update_module = path::Join(tmpdir.Path(), "rootfs-image");
+
+	ASSERT_TRUE(PrepareUpdateModule(update_module, R"(#!/bin/bash
+
+TEST_DIR=")" + tmpdir.Path() + R"("
+
+case "$1" in
+    NeedsArtifactReboot|SupportsRollback)
+        :
+        ;;
+    *)
+        echo "$1" >> $TEST_DIR/call.log
+        ;;
+esac
+
+exit 0
+)"));
+
+	mtesting::HttpFileServer file_server(tmpdir.Path());
+
+	{
+		vector<string> args {
+			"--datastore",
+			tmpdir.Path(),
+			"install",
+			"--checksum",
+			string(64, '0'),
+			file_server.GetBaseUrl() + "/" + path::BaseName(artifact),
+		};
+
+		mtesting::RedirectStreamOutputs output;
+		int exit_status = cli::Main(
+			args, [&tmpdir](context::MenderContext &ctx) { SetTestDir(tmpdir.Path(), ctx); });
+		EXPECT_EQ(exit_status, 1) << exit_status;
+
+		EXPECT_EQ(output.GetCout(), R"(Installing artifact...
+Streaming failed.
+System not modified.
+)");
+		EXPECT_THAT(
+			output.GetCerr(),
+			testing::HasSubstr("does not match the expected checksum, (expected): "
+							   + string(64, '0') + " (calculated): " + shasum.value().String()));
+	}
+
+	EXPECT_TRUE(VerifyProvides(tmpdir.Path(), R"(rootfs-image.version=previous
+rootfs-image.checksum=46ca895be3a18fb50c1c6b5a3bd2e97fb637b35a22924c2f3dea3cf09e9e2e74
+artifact_name=previous
+)"));
+
+	{
+		vector<string> args {
+			"--datastore",
+			tmpdir.Path(),
+			"install",
+			"--checksum",
+			shasum.value().String(),
+			file_server.GetBaseUrl() + "/" + path::BaseName(artifact),
+		};
+
+		mtesting::RedirectStreamOutputs output;
+		int exit_status = cli::Main(
+			args, [&tmpdir](context::MenderContext &ctx) { SetTestDir(tmpdir.Path(), ctx); });
+		EXPECT_EQ(exit_status, 0) << exit_status;
+
+		EXPECT_EQ(output.GetCout(), R"(Installing artifact...
+Update Module doesn't support rollback. Committing immediately.
+Installed and committed.
+)");
+		EXPECT_EQ(output.GetCerr(), "");
+	}
+
+	EXPECT_TRUE(mtesting::FileContainsExactly(
+		path::Join(tmpdir.Path(), "call.log"), R"(ProvidePayloadFileSizes
+Download
+Cleanup
+ProvidePayloadFileSizes
+Download
+ArtifactInstall
+ArtifactCommit
+Cleanup
+)"));
+
+	EXPECT_TRUE(VerifyProvides(tmpdir.Path(), R"(rootfs-image.version=test
+rootfs-image.checksum=f2ca1bb6c7e907d06dafe4687e579fce76b37e4e93b7605022da52e6ccc26fd2
+artifact_name=test
+)"));
+}
+
+// Splits the Artifact into three parts, next to it, and writes the manifest of them. With
+// `broken_part`, the checksum of that part in the manifest is wrong.
+bool PrepareSplitArtifact(const string &artifact, const string &manifest, int broken_part = 0) {
+	ifstream artifact_stream(artifact, ios::binary);
+	vector<uint8_t> artifact_data {istreambuf_iterator<char>(artifact_stream), {}};
+	EXPECT_GT(artifact_data.size(), 3);
+
+	string parts_json;
+	const size_t part_size = artifact_data.size() / 3 + 1;
+	for (size_t i = 0; i < 3; i++) {
+		auto part_start = artifact_data.begin() + static_cast<ptrdiff_t>(i * part_size);
+		auto part_end =
+			i == 2 ? artifact_data.end() : part_start + static_cast<ptrdiff_t>(part_size);
+		vector<uint8_t> part_data {part_start, part_end};
+
+		string name = path::BaseName(artifact) + ".part" + to_string(i + 1);
+		ofstream part(path::Join(path::DirName(artifact), name), ios::binary);
+		part.write(
+			reinterpret_cast<const char *>(part_data.data()),
+			static_cast<streamsize>(part_data.size()));
+		EXPECT_TRUE(part.good());
+
+		auto shasum = sha::Shasum(part_data);
+		EXPECT_TRUE(shasum) << shasum.error().String();
+		string sha256sum =
+			static_cast<int>(i + 1) == broken_part ? string(64, '0') : shasum.value().String();
+		parts_json += string(i > 0 ? "," : "") + R"({"name":")" + name + R"(","size":)"
+					  + to_string(part_data.size()) + R"(,"sha256sum":")" + sha256sum + R"("})";
+	}
+
+	ofstream f(manifest);
+	f << R"({"parts":[)" << parts_json << "]}";
+	EXPECT_TRUE(f.good());
+
+	return !::testing::Test::HasFailure();
+}
+
+TEST(CliTest, InstallSplitArtifact) {
+	mtesting::TemporaryDirectory tmpdir;
+
+	ASSERT_TRUE(InitDefaultProvides(tmpdir.Path()));
+
+	string artifact = path::Join(tmpdir.Path(), "artifact.mender");
+	ASSERT_TRUE(PrepareSimpleArtifact(tmpdir.Path(), artifact));
+
+	string manifest = path::Join(tmpdir.Path(), "artifact.mender.parts.json");
+	ASSERT_TRUE(PrepareSplitArtifact(artifact, manifest));
+	string broken_manifest = path::Join(tmpdir.Path(), "broken.mender.parts.json");
+	ASSERT_TRUE(PrepareSplitArtifact(artifact, broken_manifest, 3));
+	// Only the parts are used.
+	ASSERT_EQ(path::FileDelete(artifact), error::NoError);
+
+	{
+		vector<string> args {
+			"--datastore",
+			tmpdir.Path(),
+			"install",
+			broken_manifest,
+		};
+
+		mtesting::RedirectStreamOutputs output;
+		int exit_status = cli::Main(
+			args, [&tmpdir](context::MenderContext &ctx) { SetTestDir(tmpdir.Path(), ctx); });
+		EXPECT_EQ(exit_status, 1) << exit_status;
+
+		EXPECT_THAT(output.GetCout(), testing::HasSubstr("System not modified."));
+		string part3 = path::Join(tmpdir.Path(), "artifact.mender.part3");
+		EXPECT_THAT(output.GetCerr(), testing::HasSubstr("While reading Artifact part " + part3));
+		EXPECT_THAT(output.GetCerr(), testing::HasSubstr("does not match the expected checksum"));
+	}
+
+	EXPECT_TRUE(VerifyProvides(tmpdir.Path(), R"(rootfs-image.version=previous
+rootfs-image.checksum=46ca895be3a18fb50c1c6b5a3bd2e97fb637b35a22924c2f3dea3cf09e9e2e74
+artifact_name=previous
+)"));
+
+	{
+		vector<string> args {
+			"--datastore",
+			tmpdir.Path(),
+			"install",
+			manifest,
+		};
+
+		mtesting::RedirectStreamOutputs output;
+		int exit_status = cli::Main(
+			args, [&tmpdir](context::MenderContext &ctx) { SetTestDir(tmpdir.Path(), ctx); });
+		EXPECT_EQ(exit_status, 0) << exit_status;
+
+		EXPECT_EQ(output.GetCout(), R"(Installing artifact...
+Update Module doesn't support rollback. Committing immediately.
+Installed and committed.
+)");
+	}
+
+	EXPECT_TRUE(VerifyProvides(tmpdir.Path(), R"(rootfs-image.version=test
+rootfs-image.checksum=f2ca1bb6c7e907d06dafe4687e579fce76b37e4e93b7605022da52e6ccc26fd2
+artifact_name=test
+)"));
+}
+
 TEST(CliTest, StopBeforeArtifactInstallThenResume) {
 	mtesting::TemporaryDirectory tmpdir;
 
@@ -22,6 +22,7 @@
 #include <common/common.hpp>
 #include <common/device_tier.hpp>
 #include <client_shared/conf.hpp>
+#include <common/key_value_database_encrypted.hpp>
 #include <common/key_value_database_lmdb.hpp>
 #include <common/json.hpp>
 #include <common/path.hpp>
@@ -230,6 +231,57 @@ TEST_F(ContextTests, LoadProvidesClosedDB) {
 #endif // NDEBUG
 }
 
+TEST_F(ContextTests, StoreEncryption) {
+	conf::MenderConfig cfg;
+	cfg.paths.SetDataStore(test_state_dir.Path());
+
+	{
+		// Stored in cleartext first.
+		context::MenderContext ctx(cfg);
+		auto err = ctx.Initialize();
+		ASSERT_EQ(err, error::NoError);
+		err = ctx.GetMenderStoreDB().Write(
+			"artifact-name", common::ByteVectorFromString("artifact-name value"));
+		ASSERT_EQ(err, error::NoError);
+	}
+
+	string key_file = path::Join(test_state_dir.Path(), "store.key");
+	{
+		ofstream f(key_file);
+		f << "0123456789abcdef0123456789abcdef";
+		ASSERT_TRUE(f.good());
+	}
+	cfg.store_encryption.key_file = key_file;
+
+	{
+		context::MenderContext ctx(cfg);
+		auto err = ctx.Initialize();
+		ASSERT_EQ(err, error::NoError) << err.String();
+		auto ex_data = ctx.GetMenderStoreDB().Read("artifact-name");
+		ASSERT_TRUE(ex_data) << ex_data.error().String();
+		EXPECT_EQ(common::StringFromByteVector(ex_data.value()), "artifact-name value");
+	}
+
+	{
+		kv_db::KeyValueDatabaseLmdb db;
+		auto err = db.Open(path::Join(test_state_dir.Path(), "mender-store"));
+		ASSERT_EQ(err, error::NoError);
+		auto ex_data = db.Read("artifact-name");
+		ASSERT_TRUE(ex_data);
+		EXPECT_TRUE(kv_db::IsEncryptedValue(ex_data.value()));
+	}
+
+	{
+		ofstream f(key_file);
+		f << "another secret, which is long enough";
+		ASSERT_TRUE(f.good());
+	}
+	context::MenderContext ctx(cfg);
+	auto err = ctx.Initialize();
+	ASSERT_NE(err, error::NoError);
+	EXPECT_EQ(err.code, kv_db::MakeError(kv_db::EncryptionError, "").code);
+}
+
 TEST_F(ContextTests, CommitArtifactDataValid) {
 	conf::MenderConfig cfg;
 	cfg.paths.SetDataStore(test_state_dir.Path());
@@ -576,6 +628,47 @@ TEST_F(ContextTests, GetDeviceTypeTrailingData) {
 	EXPECT_EQ(ex_s.error().code, context::MakeError(context::ValueError, "").code);
 }
 
+TEST_F(ContextTests, GetDeviceTypes) {
+	conf::MenderConfig cfg;
+	cfg.paths.SetDataStore(test_state_dir.Path());
+
+	context::MenderContext ctx(cfg);
+	auto err = ctx.Initialize();
+	ASSERT_EQ(err, error::NoError);
+
+	ofstream os(cfg.paths.GetDataStore() + "/device_type");
+	ASSERT_TRUE(os);
+	os << "device_type=raspberrypi4" << endl;
+	os << "device_type=raspberrypi4-rev1.4" << endl;
+	os << "device_type=raspberrypi4" << endl;
+	os << "device_type=raspberrypi4-rev1.5";
+	os.close();
+
+	auto ex_types = ctx.GetDeviceTypes();
+	ASSERT_TRUE(ex_types) << ex_types.error().String();
+	const vector<string> expected_types {
+		"raspberrypi4", "raspberrypi4-rev1.4", "raspberrypi4-rev1.5"};
+	EXPECT_EQ(ex_types.value(), expected_types);
+
+	auto ex_type = ctx.GetDeviceType();
+	ASSERT_TRUE(ex_type) << ex_type.error().String();
+	EXPECT_EQ(ex_type.value(), "raspberrypi4");
+
+	auto ex_compatible_types = ctx.GetCompatibleTypes("rootfs-image");
+	ASSERT_TRUE(ex_compatible_types) << ex_compatible_types.error().String();
+	EXPECT_EQ(ex_compatible_types.value(), ex_types.value());
+
+	os.open(cfg.paths.GetDataStore() + "/device_type");
+	ASSERT_TRUE(os);
+	os << "device_type=raspberrypi4" << endl;
+	os << "revision=1.4" << endl;
+	os.close();
+
+	ex_types = ctx.GetDeviceTypes();
+	ASSERT_FALSE(ex_types);
+	EXPECT_EQ(ex_types.error().code, context::MakeError(context::ValueError, "").code);
+}
+
 TEST(ContextArtifactTests, ArtifactMatchesContextTest) {
 	context::ProvidesData provides = {
 		{"artifact_name", "artifact_name"}, {"artifact_group", "artifact_group"}};
@@ -697,6 +790,133 @@ TEST(ContextArtifactTests, ArtifactMatchesContextTest) {
 	EXPECT_FALSE(ex_match.value());
 }
 
+TEST(ContextArtifactTests, ArtifactDependsNotMetByContextTest) {
+	auto exp_hdr = artifact::HeaderViewFromJson(R"({
+  "header-info": {
+    "payloads": [{"type": "rootfs-image"}],
+    "artifact_provides": {"artifact_name": "release-2"},
+    "artifact_depends": {"device_type": ["other_device_type"], "artifact_name": ["release-1"]}
+  },
+  "type-info": {
+    "type": "rootfs-image",
+    "artifact_depends": {"rootfs-image.checksum": "abc"}
+  }
+})");
+	ASSERT_TRUE(exp_hdr) << exp_hdr.error().String();
+	auto &hdr = exp_hdr.value();
+	EXPECT_EQ(hdr.artifact_name, "release-2");
+	EXPECT_EQ(hdr.payload_type, "rootfs-image");
+
+	context::ProvidesData provides = {
+		{"artifact_name", "release-1"}, {"rootfs-image.checksum", "def"}};
+	auto ex_unmet = context::ArtifactDependsNotMetByContext(provides, "device_type", hdr);
+	ASSERT_TRUE(ex_unmet) << ex_unmet.error().String();
+	// All of them, not only the first one.
+	ASSERT_EQ(ex_unmet.value().size(), 2);
+	EXPECT_EQ(
+		ex_unmet.value()[0],
+		R"(Artifact device type doesn't match: 'device_type' is not one of )"
+		R"(({"other_device_type"}))");
+	EXPECT_EQ(
+		ex_unmet.value()[1],
+		R"(Provides value 'def' doesn't match any of the 'rootfs-image.checksum' artifact depends )"
+		R"(({"abc"}))");
+
+	ex_unmet = context::ArtifactDependsNotMetByContext(provides, "other_device_type", hdr);
+	ASSERT_TRUE(ex_unmet) << ex_unmet.error().String();
+	ASSERT_EQ(ex_unmet.value().size(), 1);
+
+	auto err = context::MakeArtifactDependsError(ex_unmet.value());
+	EXPECT_EQ(err.code, context::MakeError(context::ArtifactDependsNotSatisfiedError, "").code);
+	EXPECT_EQ(
+		err.String(),
+		"Artifact depends not satisfied: Provides value 'def' doesn't match any of the "
+		R"('rootfs-image.checksum' artifact depends ({"abc"}))");
+
+	provides["rootfs-image.checksum"] = "abc";
+	ex_unmet = context::ArtifactDependsNotMetByContext(provides, "other_device_type", hdr);
+	ASSERT_TRUE(ex_unmet) << ex_unmet.error().String();
+	EXPECT_EQ(ex_unmet.value().size(), 0);
+
+	// Any of the device types of the device will do.
+	const vector<string> device_types {"device_type", "other_device_type"};
+	ex_unmet = context::ArtifactDependsNotMetByContext(provides, device_types, hdr);
+	ASSERT_TRUE(ex_unmet) << ex_unmet.error().String();
+	EXPECT_EQ(ex_unmet.value().size(), 0);
+
+	ex_unmet = context::ArtifactDependsNotMetByContext(
+		provides, vector<string> {"device_type", "third_device_type"}, hdr);
+	ASSERT_TRUE(ex_unmet) << ex_unmet.error().String();
+	ASSERT_EQ(ex_unmet.value().size(), 1);
+	EXPECT_EQ(
+		ex_unmet.value()[0],
+		R"(Artifact device type doesn't match: none of {"device_type","third_device_type"} is )"
+		R"(one of ({"other_device_type"}))");
+
+	EXPECT_FALSE(artifact::HeaderViewFromJson(R"({"header-info": {}})"));
+	EXPECT_FALSE(artifact::HeaderViewFromJson("not JSON"));
+}
+
+TEST(ContextArtifactTests, ArtifactEligibilityWindowTest) {
+	auto header_with_meta_data = [](const string &meta_data) {
+		return artifact::HeaderViewFromJson(R"({
+  "header-info": {
+    "payloads": [{"type": "rootfs-image"}],
+    "artifact_provides": {"artifact_name": "release-1"},
+    "artifact_depends": {"device_type": ["device_type"]}
+  },
+  "type-info": {"type": "rootfs-image"},
+  "meta-data": )" + meta_data + "}");
+	};
+
+	auto exp_hdr = header_with_meta_data(R"({"not-before": "2026-11-01T00:00:00Z"})");
+	ASSERT_TRUE(exp_hdr) << exp_hdr.error().String();
+	auto exp_window = context::ArtifactEligibilityWindow(exp_hdr.value());
+	ASSERT_TRUE(exp_window) << exp_window.error().String();
+	ASSERT_TRUE(exp_window.value().not_before);
+	EXPECT_EQ(chrono::system_clock::to_time_t(exp_window.value().not_before.value()), 1793491200);
+	EXPECT_FALSE(exp_window.value().not_after);
+	EXPECT_EQ(
+		context::FormatEligibilityTime(exp_window.value().not_before.value()),
+		"2026-11-01T00:00:00Z");
+
+	// Offsets, fractions of a second and seconds since the epoch.
+	exp_hdr = header_with_meta_data(
+		R"({"not-before": "2026-11-01T02:00:00.5+02:00", "not-after": 1793577600})");
+	ASSERT_TRUE(exp_hdr) << exp_hdr.error().String();
+	exp_window = context::ArtifactEligibilityWindow(exp_hdr.value());
+	ASSERT_TRUE(exp_window) << exp_window.error().String();
+	ASSERT_TRUE(exp_window.value().not_before);
+	EXPECT_EQ(chrono::system_clock::to_time_t(exp_window.value().not_before.value()), 1793491200);
+	ASSERT_TRUE(exp_window.value().not_after);
+	EXPECT_EQ(
+		context::FormatEligibilityTime(exp_window.value().not_after.value()),
+		"2026-11-02T00:00:00Z");
+
+	// No limits without the keys, or without meta-data at all.
+	exp_hdr = header_with_meta_data(R"({"other": "value"})");
+	ASSERT_TRUE(exp_hdr) << exp_hdr.error().String();
+	exp_window = context::ArtifactEligibilityWindow(exp_hdr.value());
+	ASSERT_TRUE(exp_window) << exp_window.error().String();
+	EXPECT_FALSE(exp_window.value().not_before);
+	EXPECT_FALSE(exp_window.value().not_after);
+
+	for (const auto &meta_data : {
+			 R"({"not-before": "2026-11-01"})",
+			 R"({"not-before": "2026-11-01T00:00:00"})",
+			 R"({"not-before": "2026-11-01T00:00:00Zjunk"})",
+			 R"({"not-before": "2026-11-01T00:00:00+2:00"})",
+			 R"({"not-after": true})",
+			 R"({"not-before": 1793577600, "not-after": 1793491200})",
+		 }) {
+		exp_hdr = header_with_meta_data(meta_data);
+		ASSERT_TRUE(exp_hdr) << exp_hdr.error().String();
+		exp_window = context::ArtifactEligibilityWindow(exp_hdr.value());
+		ASSERT_FALSE(exp_window) << meta_data;
+		EXPECT_EQ(exp_window.error().code, context::MakeError(context::ValueError, "").code);
+	}
+}
+
 struct TestWildCard {
 	std::string to_match;
 	std::string pattern;
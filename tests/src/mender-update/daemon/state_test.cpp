@@ -16,9 +16,14 @@
 #include <cstdlib>
 #include <filesystem>
 #include <fstream>
+#include <limits>
 #include <string>
 #include <vector>
 
+#include <sys/socket.h>
+#include <sys/un.h>
+#include <unistd.h>
+
 #include <gtest/gtest.h>
 #include <gmock/gmock.h>
 
@@ -28,15 +33,51 @@
 #include <common/device_tier.hpp>
 #include <common/error.hpp>
 #include <common/events.hpp>
+#include <common/events_io.hpp>
+#include <common/http.hpp>
 #include <common/key_value_database.hpp>
 #include <common/path.hpp>
 #include <common/processes.hpp>
 #include <common/testing.hpp>
 
+#include <artifact/error.hpp>
+#include <artifact/sha/sha.hpp>
+#include <artifact/v3/scripts/error.hpp>
+
 #include <mender-update/context.hpp>
 #include <mender-update/inventory.hpp>
+#include <mender-update/daemon/artifact_inspection.hpp>
+#include <mender-update/daemon/artifact_twin.hpp>
+#include <mender-update/daemon/canary_monitor.hpp>
+#include <mender-update/daemon/chunked_download.hpp>
+#include <mender-update/daemon/commit_confirmation.hpp>
+#include <mender-update/daemon/commit_lease.hpp>
 #include <mender-update/daemon/context.hpp>
+#include <mender-update/daemon/control.hpp>
+#include <mender-update/daemon/deployment_history.hpp>
+#include <mender-update/daemon/device_config.hpp>
+#include <mender-update/daemon/device_freeze.hpp>
+#include <mender-update/daemon/failure_category.hpp>
+#include <mender-update/daemon/header_cache.hpp>
+#include <mender-update/daemon/inventory_scheduler.hpp>
+#include <mender-update/daemon/loop_health.hpp>
+#include <mender-update/daemon/metrics.hpp>
+#include <mender-update/daemon/mqtt_bridge.hpp>
+#include <mender-update/daemon/outbound_queue.hpp>
+#include <mender-update/daemon/pause_record.hpp>
+#include <mender-update/daemon/pilot_soak.hpp>
+#include <mender-update/daemon/preflight_checks.hpp>
+#include <mender-update/daemon/push_channel.hpp>
+#include <mender-update/daemon/reboot_grace.hpp>
+#include <mender-update/daemon/self_test.hpp>
+#include <mender-update/daemon/service_notifier.hpp>
+#include <mender-update/daemon/standalone_update.hpp>
+#include <mender-update/daemon/startup_wait.hpp>
+#include <mender-update/daemon/state_listeners.hpp>
 #include <mender-update/daemon/state_machine.hpp>
+#include <mender-update/daemon/status_update_limiter.hpp>
+#include <mender-update/daemon/telemetry_sinks.hpp>
+#include <mender-update/daemon/user_notifier.hpp>
 
 #define DEPLOYMENT_ID "w81s4fae-7dec-11d0-a765-00a0c91e6bf6"
 
@@ -53,6 +94,7 @@ namespace device_tier = mender::common::device_tier;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace kvdb = mender::common::key_value_database;
+namespace log = mender::common::log;
 namespace path = mender::common::path;
 namespace processes = mender::common::processes;
 
@@ -100,6 +142,9 @@ struct StateTransitionsTestCase {
 	bool error_forever;
 	vector<string> spont_reboot_states;
 	bool spont_reboot_forever;
+	// Fail in these states once the client has been killed, like an Update Module which had
+	// finished the state it was killed in.
+	vector<string> error_after_spont_reboot_states;
 	vector<string> hang_states;
 	bool rollback_disabled;
 	bool reboot_disabled;
@@ -1335,6 +1380,44 @@ vector<StateTransitionsTestCase> GenerateStateTransitionsTestCases() {
 					"ArtifactReboot_Leave_00",
 					"ArtifactCommit_Enter_00",
 					"ArtifactCommit",
+					// Still verifies, so it is committed again.
+					"ArtifactVerifyReboot",
+					"ArtifactCommit_Enter_00",
+					"ArtifactCommit",
+					"ArtifactCommit_Leave_00",
+					"Cleanup",
+				},
+			.status_log =
+				{
+					"downloading",
+					"installing",
+					"rebooting",
+					"installing",
+					"success",
+				},
+			.install_outcome = InstallOutcome::SuccessfulInstall,
+			.spont_reboot_states = {"ArtifactCommit"},
+		},
+
+		StateTransitionsTestCase {
+			.case_name = "Killed_in_ArtifactCommit__after_the_commit",
+			.state_chain =
+				{
+					"Download_Enter_00",
+					"ProvidePayloadFileSizes",
+					"Download",
+					"Download_Leave_00",
+					"ArtifactInstall_Enter_00",
+					"ArtifactInstall",
+					"ArtifactInstall_Leave_00",
+					"ArtifactReboot_Enter_00",
+					"ArtifactReboot",
+					"ArtifactVerifyReboot",
+					"ArtifactReboot_Leave_00",
+					"ArtifactCommit_Enter_00",
+					"ArtifactCommit",
+					// The Update Module had committed, so the database takes precedence.
+					"ArtifactVerifyReboot",
 					"ArtifactRollback_Enter_00",
 					"ArtifactRollback",
 					"ArtifactRollback_Leave_00",
@@ -1357,6 +1440,7 @@ vector<StateTransitionsTestCase> GenerateStateTransitionsTestCases() {
 				},
 			.install_outcome = InstallOutcome::SuccessfulRollback,
 			.spont_reboot_states = {"ArtifactCommit"},
+			.error_after_spont_reboot_states = {"ArtifactVerifyReboot"},
 		},
 
 		StateTransitionsTestCase {
@@ -1938,16 +2022,11 @@ vector<StateTransitionsTestCase> GenerateStateTransitionsTestCases() {
 					"ArtifactVerifyReboot",
 					"ArtifactReboot_Leave_00",
 					"ArtifactCommit_Enter_00",
-					"ArtifactRollback_Enter_00",
-					"ArtifactRollback",
-					"ArtifactRollback_Leave_00",
-					"ArtifactRollbackReboot_Enter_00",
-					"ArtifactRollbackReboot",
-					"ArtifactVerifyRollbackReboot",
-					"ArtifactRollbackReboot_Leave_00",
-					"ArtifactFailure_Enter_00",
-					"ArtifactFailure",
-					"ArtifactFailure_Leave_00",
+					// Still verifies, so it is committed again.
+					"ArtifactVerifyReboot",
+					"ArtifactCommit_Enter_00",
+					"ArtifactCommit",
+					"ArtifactCommit_Leave_00",
 					"Cleanup",
 				},
 			.status_log =
@@ -1956,9 +2035,9 @@ vector<StateTransitionsTestCase> GenerateStateTransitionsTestCases() {
 					"installing",
 					"rebooting",
 					"installing",
-					"failure",
+					"success",
 				},
-			.install_outcome = InstallOutcome::SuccessfulRollback,
+			.install_outcome = InstallOutcome::SuccessfulInstall,
 			.spont_reboot_states = {"ArtifactCommit_Enter_00"},
 		},
 
@@ -3354,6 +3433,15 @@ fi
 )";
 	}
 
+	for (auto &state : test_case.error_after_spont_reboot_states) {
+		f << R"(
+if [ "$1" = ")"
+		  << state << R"(" ] && ls "$2"/tmp/*.already-killed > /dev/null 2>&1; then
+    exit 1
+fi
+)";
+	}
+
 	// Hang in specified state
 	for (auto &state : test_case.hang_states) {
 		f << R"(
@@ -3509,6 +3597,7 @@ public:
 		const string &deployment_id,
 		deployments::DeploymentStatus status,
 		const string &substate,
+		const optional<deployments::DownloadProgress> &progress,
 		api::Client &client,
 		deployments::StatusAPIResponseHandler api_handler) override {
 		api_handler(deployments::StatusAPIResponse {nullopt, nullopt, error::NoError});
@@ -3569,6 +3658,7 @@ public:
 		const string &deployment_id,
 		deployments::DeploymentStatus status,
 		const string &substate,
+		const optional<deployments::DownloadProgress> &progress,
 		api::Client &client,
 		deployments::StatusAPIResponseHandler api_handler) override {
 		event_loop_.Post([this, status, api_handler]() {
@@ -4020,6 +4110,18 @@ TEST_F(StateTestWithArtifact, DeploymentLogging) {
 	auto no_such_deployment_log =
 		path::Join(tmpdir.Path(), "deployments.0002." DEPLOYMENT_ID ".log");
 	EXPECT_FALSE(mtesting::FileContains(no_such_deployment_log, "Running mender-update"));
+
+	auto exp_records = ctx.deployment_history.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	auto &records = exp_records.value();
+	ASSERT_EQ(records.size(), 2);
+	EXPECT_EQ(records[0].id, DEPLOYMENT_ID);
+	EXPECT_EQ(records[1].id, new_id);
+	for (const auto &record : records) {
+		EXPECT_NE(record.outcome, DeploymentHistory::kOutcomeInProgress);
+		EXPECT_NE(record.started, 0);
+		EXPECT_GE(record.finished, record.started);
+	}
 }
 
 static void WriteNoopUpdateModule(const string &modules_path, const string &payload_type) {
@@ -4104,6 +4206,54 @@ TEST_F(StateTestWithArtifact, SystemTierInstallsManifestArtifact) {
 }
 #endif // MENDER_USE_YAML_CPP
 
+TEST_F(StateTestWithArtifact, IncompatibleArtifactRejectedBeforeDownload) {
+	mtesting::TemporaryDirectory tmpdir;
+	{
+		ofstream f(path::Join(tmpdir.Path(), "device_type"));
+		f << "device_type=other-type\n";
+	}
+
+	// Records whether the deployment got as far as the download.
+	const string scripts_path = path::Join(tmpdir.Path(), "scripts");
+	const string marker = path::Join(tmpdir.Path(), "download-entered");
+	ASSERT_EQ(path::CreateDirectories(scripts_path), error::NoError);
+	{
+		auto script = path::Join(scripts_path, "Download_Enter_00");
+		ofstream f(script);
+		f << "#!/bin/sh\ntouch " << marker << "\n";
+		f.close();
+		chmod(script.c_str(), S_IRUSR | S_IWUSR | S_IXUSR);
+	}
+
+	conf::MenderConfig config;
+	config.paths.SetDataStore(tmpdir.Path());
+	config.paths.SetModulesPath(tmpdir.Path());
+	config.paths.SetModulesWorkPath(tmpdir.Path());
+	config.paths.SetRootfsScriptsPath(scripts_path);
+
+	context::MenderContext main_context(config);
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	WriteNoopUpdateModule(tmpdir.Path(), "test-module");
+
+	mtesting::TestEventLoop event_loop;
+	Context ctx(main_context, event_loop);
+
+	mtesting::HttpFileServer server(path::DirName(ArtifactPath()));
+	auto artifact_url = http::JoinUrl(server.GetBaseUrl(), path::BaseName(ArtifactPath()));
+	auto status_log = path::Join(tmpdir.Path(), "status.log");
+	ctx.deployment_client = make_shared<TestDeploymentClient>(event_loop, artifact_url, status_log);
+	ctx.inventory_client = make_shared<NoopInventoryClient>();
+
+	StateMachine state_machine(ctx, event_loop);
+	state_machine.StopAfterDeployment();
+	err = state_machine.Run();
+	ASSERT_EQ(err, error::NoError);
+
+	EXPECT_TRUE(mtesting::FileContains(status_log, "failure"));
+	EXPECT_FALSE(path::FileExists(marker));
+}
+
 class StateTests : public testing::Test {
 public:
 	StateTests() :
@@ -4289,6 +4439,202 @@ TEST(SignalHandlingTests, SigquitHandlingTest) {
 	// test as timing out and thus failing.
 }
 
+class UnreachableDeploymentClient : public NoopDeploymentClient {
+public:
+	error::Error CheckNewDeployments(
+		context::MenderContext &ctx,
+		api::Client &client,
+		deployments::CheckUpdatesAPIResponseHandler api_handler) override {
+		api_handler(expected::unexpected(deployments::CheckUpdatesAPIResponseError {
+			nullopt,
+			nullopt,
+			error::Error(make_error_condition(errc::host_unreachable), "No connection")}));
+		return error::NoError;
+	}
+};
+
+TEST(RunOnceTests, NoUpdate) {
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	mtesting::TestEventLoop event_loop;
+	Context ctx {main_context, event_loop};
+
+	ctx.deployment_client = make_shared<NoopDeploymentClient>();
+	ctx.inventory_client = make_shared<NoopInventoryClient>();
+
+	StateMachine state_machine {ctx, event_loop};
+	state_machine.RunOnce();
+	err = state_machine.Run();
+	EXPECT_EQ(err.code, context::MakeError(context::NoUpdateAvailableError, "").code)
+		<< err.String();
+	EXPECT_TRUE(ctx.inventory_client->has_submitted_inventory);
+}
+
+TEST(RunOnceTests, CheckFails) {
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	mtesting::TestEventLoop event_loop;
+	Context ctx {main_context, event_loop};
+
+	ctx.deployment_client = make_shared<UnreachableDeploymentClient>();
+	ctx.inventory_client = make_shared<NoopInventoryClient>();
+
+	// The daemon doesn't wait for the retries.
+	StateMachine state_machine {ctx, event_loop};
+	state_machine.RunOnce();
+	err = state_machine.Run();
+	EXPECT_EQ(err.code, error::MakeError(error::ExitWithFailureError, "").code) << err.String();
+}
+
+TEST(AbortDeploymentTests, RefusedPastThePointOfNoReturn) {
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	mtesting::TestEventLoop event_loop;
+	Context ctx {main_context, event_loop};
+
+	StateMachine state_machine {ctx, event_loop};
+	err = state_machine.AbortDeployment();
+	EXPECT_EQ(err.code, context::MakeError(context::NoUpdateInProgressError, "").code);
+
+	ctx.deployment.state_data.reset(new StateData);
+	ctx.deployment.state_data->state = Context::kUpdateStateArtifactInstall;
+	err = state_machine.AbortDeployment();
+	EXPECT_EQ(err, error::NoError) << err.String();
+	EXPECT_TRUE(ctx.deployment.abort_requested);
+
+	ctx.deployment.abort_requested = false;
+	for (auto &state : vector<string> {
+			 Context::kUpdateStateArtifactCommit,
+			 Context::kUpdateStateAfterArtifactCommit,
+			 Context::kUpdateStateArtifactRollback,
+			 Context::kUpdateStateArtifactFailure,
+		 }) {
+		ctx.deployment.state_data->state = state;
+		err = state_machine.AbortDeployment();
+		EXPECT_EQ(err.code, context::MakeError(context::WrongOperationError, "").code) << state;
+		EXPECT_FALSE(ctx.deployment.abort_requested) << state;
+	}
+
+	ctx.deployment.state_data->state = Context::kUpdateStateArtifactInstall;
+	ctx.deployment.failed = true;
+	err = state_machine.AbortDeployment();
+	EXPECT_EQ(err.code, context::MakeError(context::WrongOperationError, "").code);
+}
+
+TEST(ControlTests, Commands) {
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+	config.paths.SetConfFile(path::Join(tmpdir.Path(), "mender.conf"));
+	config.paths.SetFallbackConfFile(path::Join(tmpdir.Path(), "mender-fallback.conf"));
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	mtesting::TestEventLoop event_loop;
+	Context ctx {main_context, event_loop};
+
+	StateMachine state_machine {ctx, event_loop};
+	Control control {ctx, state_machine, event_loop};
+
+	auto previous_level = log::Level();
+	log::Logger logger {"control_test"};
+
+	auto exp_result = control.Run("set-log-level", "control_test=trace");
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	EXPECT_EQ(exp_result.value(), "true");
+	EXPECT_EQ(logger.Level(), log::LogLevel::Trace);
+
+	exp_result = control.Run("set-log-level", "control_test=");
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	EXPECT_NE(logger.Level(), log::LogLevel::Trace);
+
+	exp_result = control.Run("set-log-level", "loud");
+	EXPECT_FALSE(exp_result);
+
+	{
+		ofstream f(config.paths.GetConfFile());
+		f << R"({
+  "LogLevels": {"control_test": "error"},
+  "UpdatePollIntervalSeconds": 60,
+  "InventoryPollIntervalSeconds": 120,
+  "DownloadRateLimit": 1000,
+  "Servers": [{"ServerURL": "https://a.example.com"}, {"ServerURL": "https://b.example.com"}]
+})";
+	}
+	exp_result = control.Run("reload", "");
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	EXPECT_EQ(logger.Level(), log::LogLevel::Error);
+	// The daemon isn't running any state, so nothing holds the other settings back.
+	EXPECT_FALSE(state_machine.ReloadPending());
+	EXPECT_EQ(config.update_poll_interval_seconds, 60);
+	EXPECT_EQ(config.inventory_poll_interval_seconds, 120);
+	EXPECT_EQ(config.download_rate_limit.bytes_per_second, 1000);
+	EXPECT_THAT(
+		config.servers, testing::ElementsAre("https://a.example.com", "https://b.example.com"));
+
+	// A module which is no longer in the configuration gets its own level back.
+	{
+		ofstream f(config.paths.GetConfFile());
+		f << R"({"LogLevels": {}})";
+	}
+	exp_result = control.Run("reload", "");
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	EXPECT_NE(logger.Level(), log::LogLevel::Error);
+
+	// Nothing is applied from an invalid configuration.
+	{
+		ofstream f(config.paths.GetConfFile());
+		f << R"({"LogLevels": {"control_test": "error", "other": "loud"}})";
+	}
+	exp_result = control.Run("reload", "");
+	EXPECT_FALSE(exp_result);
+	EXPECT_NE(logger.Level(), log::LogLevel::Error);
+
+	exp_result = control.Run("dump-state", "");
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	auto exp_json = json::Load(exp_result.value());
+	ASSERT_TRUE(exp_json) << exp_json.error().String();
+	auto exp_paused = exp_json.value().Get("paused").and_then(json::ToBool);
+	ASSERT_TRUE(exp_paused);
+	EXPECT_FALSE(exp_paused.value());
+	EXPECT_TRUE(exp_json.value().Get("status").value().IsObject());
+	EXPECT_TRUE(exp_json.value().Get("state_data").value().IsNull());
+
+	exp_result = control.Run("freeze", "2099-01-01T00:00:00Z");
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	EXPECT_THAT(exp_result.value(), testing::HasSubstr(R"("until":4070908800})"));
+	EXPECT_TRUE(ctx.device_freeze.Frozen());
+	EXPECT_THAT(state_machine.StatusJson(), testing::HasSubstr(R"("freeze":{"since":)"));
+	exp_result = control.Run("freeze", "tomorrow");
+	EXPECT_FALSE(exp_result);
+	exp_result = control.Run("release", "");
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	EXPECT_FALSE(ctx.device_freeze.Frozen());
+	EXPECT_THAT(state_machine.StatusJson(), testing::HasSubstr(R"("freeze":null)"));
+
+	exp_result = control.Run("self-destruct", "");
+	ASSERT_FALSE(exp_result);
+	EXPECT_EQ(exp_result.error().code, make_error_condition(errc::invalid_argument));
+
+	log::SetLevel(previous_level);
+}
+
 TEST(SubmitInventoryTests, SubmitInventoryStateTest) {
 	mtesting::TestEventLoop loop;
 
@@ -4370,6 +4716,70 @@ TEST(StateTest, UpdateControlCleanup) {
 }
 
 
+TEST(StateTest, ShutdownCheckpoint) {
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+
+	mtesting::TestEventLoop event_loop;
+	Context ctx {main_context, event_loop};
+
+	StateData state_data;
+	state_data.state = Context::kUpdateStateDownload;
+	state_data.update_info.id = "deployment-1";
+	state_data.update_info.artifact.artifact_name = "artifact-1";
+	state_data.update_info.artifact.payload_types = {"rootfs-image"};
+	state_data.update_info.shutdown_checkpoint = {"Download", 1048576, "40% Writing"};
+	err = ctx.SaveDeploymentStateData(state_data);
+	ASSERT_EQ(err, error::NoError);
+
+	StateData loaded;
+	auto exp_loaded = ctx.LoadDeploymentStateData(loaded);
+	ASSERT_TRUE(exp_loaded) << exp_loaded.error().String();
+	ASSERT_TRUE(exp_loaded.value());
+	EXPECT_EQ(loaded.update_info.shutdown_checkpoint.state, "Download");
+	EXPECT_EQ(loaded.update_info.shutdown_checkpoint.bytes_downloaded, 1048576);
+	EXPECT_EQ(loaded.update_info.shutdown_checkpoint.module_progress, "40% Writing");
+
+	// An interrupted download starts over, from the status update before it.
+	{
+		StateMachine state_machine {ctx, event_loop};
+		state_machine.LoadStateFromDb();
+		EXPECT_EQ(state_machine.CurrentStateName(), "SendStatusUpdateState");
+		ASSERT_TRUE(ctx.deployment.state_data);
+		EXPECT_EQ(ctx.deployment.state_data->update_info.shutdown_checkpoint.state, "");
+		EXPECT_EQ(ctx.deployment.substate, "");
+	}
+
+	// An interrupted installation is rolled back.
+	state_data.state = Context::kUpdateStateArtifactInstall;
+	state_data.update_info.shutdown_checkpoint = {"ArtifactInstall", 1048576, ""};
+	err = ctx.SaveDeploymentStateData(state_data);
+	ASSERT_EQ(err, error::NoError);
+	{
+		StateMachine state_machine {ctx, event_loop};
+		state_machine.LoadStateFromDb();
+		EXPECT_EQ(state_machine.CurrentStateName(), "UpdateCheckRollbackState");
+		EXPECT_EQ(ctx.deployment.substate, "Interrupted by a shutdown during ArtifactInstall");
+	}
+
+	// Without a checkpoint, a download which was interrupted otherwise fails, as before.
+	ctx.deployment.substate = "";
+	state_data.state = Context::kUpdateStateDownload;
+	state_data.update_info.shutdown_checkpoint = {};
+	err = ctx.SaveDeploymentStateData(state_data);
+	ASSERT_EQ(err, error::NoError);
+	{
+		StateMachine state_machine {ctx, event_loop};
+		state_machine.LoadStateFromDb();
+		EXPECT_EQ(state_machine.CurrentStateName(), "UpdateCleanupState");
+	}
+}
+
 TEST(DBSchemaMigrationTest, TestFromVersion1To2) {
 	// Setup
 	mtesting::TemporaryDirectory tmpdir;
@@ -4663,6 +5073,2347 @@ TEST_F(SendStatusUpdateStateTests, TooManyRequests_NoRetryAfterHeader) {
 		});
 }
 
+TEST(StateListenersTests, NoListeners) {
+	mtesting::TestEventLoop loop;
+	StateListeners listeners {loop, chrono::seconds {60}, chrono::seconds {60}};
+	bool emitted {false};
+	listeners.SetEmitFunction([&emitted](const string &, const string &) {
+		emitted = true;
+		return error::NoError;
+	});
+
+	bool called {false};
+	listeners.AsyncNotify("ArtifactInstall", "Enter", [&](error::Error err) {
+		EXPECT_EQ(err, error::NoError);
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+	EXPECT_FALSE(emitted);
+}
+
+TEST(StateListenersTests, ContinueAndAbort) {
+	mtesting::TestEventLoop loop;
+	StateListeners listeners {loop, chrono::seconds {60}, chrono::seconds {60}};
+	vector<string> emitted;
+	listeners.SetEmitFunction([&emitted](const string &state, const string &action) {
+		emitted.push_back(state + action);
+		return error::NoError;
+	});
+
+	EXPECT_NE(listeners.Register("app", "Idle"), error::NoError);
+	ASSERT_EQ(listeners.Register("app", "ArtifactInstall,ArtifactCommit"), error::NoError);
+	ASSERT_EQ(listeners.Register("other", "ArtifactInstall"), error::NoError);
+	EXPECT_NE(listeners.Respond("app", "continue"), error::NoError);
+
+	// Not registered for Download.
+	listeners.AsyncNotify("Download", "Enter", [&](error::Error err) {
+		EXPECT_EQ(err, error::NoError);
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(emitted.empty());
+
+	listeners.AsyncNotify("ArtifactInstall", "Enter", [&](error::Error err) {
+		EXPECT_EQ(err, error::NoError);
+		loop.Stop();
+	});
+	EXPECT_EQ(listeners.Respond("app", "continue"), error::NoError);
+	EXPECT_NE(listeners.Respond("app", "continue"), error::NoError);
+	EXPECT_NE(listeners.Respond("other", "maybe"), error::NoError);
+	EXPECT_EQ(listeners.Respond("other", "delay:5"), error::NoError);
+	EXPECT_EQ(listeners.Respond("other", "continue"), error::NoError);
+	loop.Run();
+
+	listeners.AsyncNotify("ArtifactCommit", "Leave", [&](error::Error err) {
+		EXPECT_NE(err, error::NoError);
+		EXPECT_THAT(err.String(), testing::HasSubstr("app aborted the ArtifactCommitLeave"));
+		loop.Stop();
+	});
+	EXPECT_EQ(listeners.Respond("app", "abort"), error::NoError);
+	loop.Run();
+
+	EXPECT_EQ(emitted, (vector<string> {"ArtifactInstallEnter", "ArtifactCommitLeave"}));
+}
+
+TEST(StateListenersTests, NoResponse) {
+	mtesting::TestEventLoop loop;
+	StateListeners listeners {loop, chrono::seconds {1}, chrono::seconds {60}};
+	listeners.SetEmitFunction([](const string &, const string &) { return error::NoError; });
+	ASSERT_EQ(listeners.Register("app", ""), error::NoError);
+
+	bool called {false};
+	listeners.AsyncNotify("ArtifactReboot", "Enter", [&](error::Error err) {
+		// Listeners which don't answer don't block the transition.
+		EXPECT_EQ(err, error::NoError);
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+}
+
+TEST(CommitLeaseTests, Disabled) {
+	mtesting::TestEventLoop loop;
+	CommitLease lease {loop, {}, chrono::seconds {60}, chrono::seconds {10}};
+	EXPECT_FALSE(lease.Enabled());
+	EXPECT_FALSE(lease.ConfirmHealthy("app"));
+
+	bool called {false};
+	lease.AsyncHold([&](error::Error err) {
+		EXPECT_EQ(err, error::NoError);
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+}
+
+TEST(CommitLeaseTests, KeptHealthy) {
+	mtesting::TestEventLoop loop;
+	CommitLease lease {loop, {"app"}, chrono::seconds {2}, chrono::seconds {1}};
+	ASSERT_TRUE(lease.Enabled());
+	EXPECT_FALSE(lease.ConfirmHealthy("other"));
+	auto exp_reply = lease.ConfirmHealthy("app");
+	ASSERT_TRUE(exp_reply);
+	EXPECT_EQ(exp_reply.value(), CommitLease::kReplyNoLease);
+
+	events::Timer confirm_timer {loop};
+	function<void()> confirm_periodically = [&]() {
+		confirm_timer.AsyncWait(chrono::milliseconds {300}, [&](error::Error err) {
+			if (err != error::NoError) {
+				return;
+			}
+			auto exp_confirmed = lease.ConfirmHealthy("app");
+			ASSERT_TRUE(exp_confirmed);
+			EXPECT_EQ(exp_confirmed.value(), CommitLease::kReplyConfirmed);
+			confirm_periodically();
+		});
+	};
+	confirm_periodically();
+
+	bool called {false};
+	lease.AsyncHold([&](error::Error err) {
+		EXPECT_EQ(err, error::NoError) << err.String();
+		called = true;
+		confirm_timer.Cancel();
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+}
+
+TEST(CommitLeaseTests, MissedConfirmation) {
+	mtesting::TestEventLoop loop;
+	CommitLease lease {loop, {"app"}, chrono::seconds {60}, chrono::seconds {1}};
+
+	bool called {false};
+	auto started = chrono::steady_clock::now();
+	lease.AsyncHold([&](error::Error err) {
+		EXPECT_NE(err, error::NoError);
+		EXPECT_THAT(err.String(), testing::HasSubstr("app did not confirm"));
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+	// Rolled back right away, not at the end of the lease.
+	EXPECT_LT(chrono::steady_clock::now() - started, chrono::seconds {10});
+}
+
+TEST(CommitConfirmationTests, Disabled) {
+	mtesting::TestEventLoop loop;
+	CommitConfirmation confirmation {loop, false, chrono::seconds {60}};
+	EXPECT_FALSE(confirmation.Enabled());
+	EXPECT_FALSE(confirmation.Confirm());
+
+	bool called {false};
+	confirmation.AsyncWait([&](error::Error err) {
+		EXPECT_EQ(err, error::NoError);
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+}
+
+TEST(CommitConfirmationTests, Confirmed) {
+	mtesting::TestEventLoop loop;
+	CommitConfirmation confirmation {loop, true, chrono::seconds {60}};
+	ASSERT_TRUE(confirmation.Enabled());
+	auto exp_reply = confirmation.Confirm();
+	ASSERT_TRUE(exp_reply);
+	EXPECT_EQ(exp_reply.value(), CommitConfirmation::kReplyNoPendingCommit);
+
+	bool called {false};
+	confirmation.AsyncWait([&](error::Error err) {
+		EXPECT_EQ(err, error::NoError) << err.String();
+		called = true;
+		loop.Stop();
+	});
+
+	events::Timer confirm_timer {loop};
+	confirm_timer.AsyncWait(chrono::milliseconds {100}, [&](error::Error err) {
+		ASSERT_EQ(err, error::NoError);
+		auto exp_confirmed = confirmation.Confirm();
+		ASSERT_TRUE(exp_confirmed);
+		EXPECT_EQ(exp_confirmed.value(), CommitConfirmation::kReplyConfirmed);
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+
+	// Nothing is waiting for it any longer.
+	exp_reply = confirmation.Confirm();
+	ASSERT_TRUE(exp_reply);
+	EXPECT_EQ(exp_reply.value(), CommitConfirmation::kReplyNoPendingCommit);
+}
+
+TEST(CommitConfirmationTests, NotConfirmed) {
+	mtesting::TestEventLoop loop;
+	CommitConfirmation confirmation {loop, true, chrono::seconds {1}};
+
+	bool called {false};
+	confirmation.AsyncWait([&](error::Error err) {
+		EXPECT_NE(err, error::NoError);
+		EXPECT_THAT(err.String(), testing::HasSubstr("not confirmed within 1 seconds"));
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+}
+
+TEST(RebootGraceTests, Disabled) {
+	mtesting::TestEventLoop loop;
+	RebootGrace grace {loop, chrono::seconds {0}, {"app"}, chrono::seconds {60}, false, ""};
+	EXPECT_FALSE(grace.Enabled());
+	EXPECT_FALSE(grace.Extend("other"));
+	auto exp_reply = grace.Extend("app");
+	ASSERT_TRUE(exp_reply);
+	EXPECT_EQ(exp_reply.value(), RebootGrace::kReplyNoPendingReboot);
+
+	bool called {false};
+	grace.AsyncWait(DEPLOYMENT_ID, [&]() {
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+}
+
+TEST(RebootGraceTests, ExtendedOnce) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const string hook = path::Join(tmpdir.Path(), "hook");
+	const string announcements = path::Join(tmpdir.Path(), "announcements");
+	{
+		ofstream f(hook);
+		f << "#!/bin/sh\necho \"$1 $2\" >> " << announcements << "\n";
+	}
+	ASSERT_EQ(chmod(hook.c_str(), S_IRUSR | S_IWUSR | S_IXUSR), 0);
+
+	RebootGrace grace {loop, chrono::seconds {1}, {"app"}, chrono::seconds {1}, false, hook};
+	ASSERT_TRUE(grace.Enabled());
+	vector<string> signals;
+	grace.SetEmitFunction([&](const string &deployment_id, const string &pending) {
+		EXPECT_EQ(deployment_id, DEPLOYMENT_ID);
+		signals.push_back(pending);
+		return error::NoError;
+	});
+
+	events::Timer extend_timer {loop};
+	extend_timer.AsyncWait(chrono::milliseconds {300}, [&](error::Error err) {
+		ASSERT_EQ(err, error::NoError);
+		auto exp_reply = grace.Extend("app");
+		ASSERT_TRUE(exp_reply) << exp_reply.error().String();
+		EXPECT_EQ(exp_reply.value(), RebootGrace::kReplyExtended);
+		EXPECT_FALSE(grace.Extend("app"));
+		EXPECT_FALSE(grace.Extend("other"));
+	});
+
+	bool called {false};
+	auto started = chrono::steady_clock::now();
+	grace.AsyncWait(DEPLOYMENT_ID, [&]() {
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+	EXPECT_GE(chrono::steady_clock::now() - started, chrono::milliseconds {1900});
+
+	EXPECT_THAT(
+		signals,
+		testing::ElementsAre(
+			RebootGrace::PendingJson(chrono::seconds {1}),
+			RebootGrace::PendingJson(chrono::seconds {2})));
+	ifstream f(announcements);
+	string first, second;
+	ASSERT_TRUE(getline(f, first));
+	ASSERT_TRUE(getline(f, second));
+	EXPECT_EQ(first, DEPLOYMENT_ID " 1");
+	EXPECT_EQ(second, DEPLOYMENT_ID " 2");
+
+	// Over, so there is nothing to extend anymore.
+	auto exp_reply = grace.Extend("app");
+	ASSERT_TRUE(exp_reply);
+	EXPECT_EQ(exp_reply.value(), RebootGrace::kReplyNoPendingReboot);
+}
+
+TEST(CanaryMonitorTests, HealthyForTheWholeWindow) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const string runs = path::Join(tmpdir.Path(), "runs");
+
+	cfg_parser::CanaryMode config;
+	config.window_seconds = 2;
+	config.interval_seconds = 1;
+	config.health_checks = {"echo run >> " + runs, "true"};
+	CanaryMonitor monitor {loop, config};
+	ASSERT_TRUE(monitor.Enabled());
+
+	bool called {false};
+	monitor.AsyncObserve([&](error::Error err) {
+		EXPECT_EQ(err, error::NoError) << err.String();
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+
+	// Right away, after one second, and at the end of the window.
+	ifstream f(runs);
+	int count = 0;
+	string line;
+	while (getline(f, line)) {
+		count++;
+	}
+	EXPECT_EQ(count, 3);
+}
+
+TEST(CanaryMonitorTests, FailingHealthCheck) {
+	mtesting::TestEventLoop loop;
+
+	cfg_parser::CanaryMode config;
+	config.window_seconds = 60;
+	config.interval_seconds = 1;
+	config.health_checks = {"true", "exit 3"};
+	CanaryMonitor monitor {loop, config};
+
+	bool called {false};
+	auto started = chrono::steady_clock::now();
+	monitor.AsyncObserve([&](error::Error err) {
+		EXPECT_NE(err, error::NoError);
+		EXPECT_THAT(err.String(), testing::HasSubstr("Health check `exit 3` failed"));
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+	// Rolled back right away, not at the end of the window.
+	EXPECT_LT(chrono::steady_clock::now() - started, chrono::seconds {10});
+}
+
+TEST(PilotSoakTests, SoakPeriodSurvivesRestarts) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const auto soak_path = path::Join(tmpdir.Path(), kPilotSoakFile);
+
+	cfg_parser::PilotMode config;
+	config.soak_seconds = 3600;
+	config.health_checks = {"true"};
+	config.revert_command = "true";
+
+	PilotSoak::Clock::time_point start {chrono::seconds {100000}};
+	{
+		PilotSoak soak {loop, config, soak_path};
+		ASSERT_TRUE(soak.Enabled());
+		auto exp_remaining = soak.Remaining("id1", start);
+		ASSERT_TRUE(exp_remaining) << exp_remaining.error().String();
+		EXPECT_EQ(exp_remaining.value(), chrono::seconds {3600});
+	}
+
+	PilotSoak soak {loop, config, soak_path};
+	auto exp_remaining = soak.Remaining("id1", start + chrono::seconds {600});
+	ASSERT_TRUE(exp_remaining) << exp_remaining.error().String();
+	EXPECT_EQ(exp_remaining.value(), chrono::seconds {3000});
+	exp_remaining = soak.Remaining("id1", start + chrono::seconds {7200});
+	ASSERT_TRUE(exp_remaining) << exp_remaining.error().String();
+	EXPECT_EQ(exp_remaining.value(), chrono::seconds {0});
+
+	// Another deployment starts over.
+	exp_remaining = soak.Remaining("id2", start + chrono::seconds {7200});
+	ASSERT_TRUE(exp_remaining) << exp_remaining.error().String();
+	EXPECT_EQ(exp_remaining.value(), chrono::seconds {3600});
+
+	ASSERT_EQ(soak.Finish(), error::NoError);
+	EXPECT_FALSE(path::FileExists(soak_path));
+}
+
+TEST(PilotSoakTests, FailingHealthCheckAndRevert) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const string reverted = path::Join(tmpdir.Path(), "reverted");
+
+	cfg_parser::PilotMode config;
+	config.soak_seconds = 60;
+	config.interval_seconds = 1;
+	config.health_checks = {"true", "exit 3"};
+	config.revert_command = "touch " + reverted;
+	PilotSoak soak {loop, config, path::Join(tmpdir.Path(), kPilotSoakFile)};
+
+	error::Error soak_err;
+	soak.AsyncSoak(chrono::seconds {60}, [&](error::Error err) {
+		soak_err = err;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_THAT(soak_err.String(), testing::HasSubstr("Health check `exit 3` failed"));
+
+	error::Error revert_err = error::MakeError(error::ProgrammingError, "Not called");
+	soak.AsyncRevert([&](error::Error err) {
+		revert_err = err;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_EQ(revert_err, error::NoError) << revert_err.String();
+	EXPECT_TRUE(path::FileExists(reverted));
+}
+
+TEST(PreflightChecksTests, NoChecks) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	PreflightChecks checks {loop, {}, path::Join(tmpdir.Path(), "preflight.d")};
+
+	bool called {false};
+	checks.AsyncRun(PreflightChecks::kStageDownload, [&](const vector<string> &failures) {
+		EXPECT_TRUE(failures.empty());
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+}
+
+TEST(PreflightChecksTests, FreeSpaceAndScripts) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const string dir = path::Join(tmpdir.Path(), "preflight.d");
+	fs::create_directory(dir);
+	const string stage_log = path::Join(tmpdir.Path(), "stages");
+
+	auto make_script = [](const string &path, const string &content) {
+		ofstream f(path);
+		f << "#!/bin/sh\n" << content;
+		f.close();
+		fs::permissions(path, fs::perms::owner_all);
+	};
+	make_script(path::Join(dir, "10-pass"), "echo \"$1\" >> " + stage_log + "\nexit 0\n");
+	make_script(path::Join(dir, "20-battery"), "echo 'Battery at 12%, needs 30%'\nexit 1\n");
+	// Not executable, so not a check.
+	ofstream readme(path::Join(dir, "README"));
+	readme << "Drop-in preflight checks\n";
+	readme.close();
+
+	cfg_parser::PreflightChecks config;
+	config.free_space.push_back({tmpdir.Path(), 0});
+	config.free_space.push_back({tmpdir.Path(), numeric_limits<int64_t>::max()});
+	PreflightChecks checks {loop, config, dir};
+
+	vector<string> result;
+	checks.AsyncRun(PreflightChecks::kStageArtifactInstall, [&](const vector<string> &failures) {
+		result = failures;
+		loop.Stop();
+	});
+	loop.Run();
+
+	ASSERT_EQ(result.size(), 2);
+	EXPECT_THAT(result[0], testing::HasSubstr("bytes are available in " + tmpdir.Path()));
+	EXPECT_THAT(result[1], testing::HasSubstr("20-battery failed: Battery at 12%, needs 30%"));
+
+	ifstream stages(stage_log);
+	string stage;
+	getline(stages, stage);
+	EXPECT_EQ(stage, "ArtifactInstall");
+}
+
+
+TEST(TelemetrySinksTests, EventJson) {
+	TelemetrySinks::Event event {
+		TelemetrySinks::kEventDeploymentStatus,
+		"abc-123",
+		"release-\"2\"",
+		"failure",
+		"Battery too low",
+	};
+	EXPECT_EQ(
+		TelemetrySinks::EventJson(event, 1700000000),
+		R"({"event":"deployment_status","timestamp":1700000000,"deployment_id":"abc-123",)"
+		R"("artifact_name":"release-\"2\"","status":"failure","substate":"Battery too low"})");
+
+	event.substate = "";
+	auto exp_json = json::Load(TelemetrySinks::EventJson(event, 1700000000));
+	ASSERT_TRUE(exp_json) << exp_json.error().String();
+	EXPECT_FALSE(exp_json.value().Get("substate"));
+}
+
+TEST(TelemetrySinksTests, ExecSinks) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const string received = path::Join(tmpdir.Path(), "received");
+	const string script = path::Join(tmpdir.Path(), "sink");
+	{
+		ofstream f(script);
+		f << "#!/bin/sh\necho \"$1\" >> " << received << "\n";
+	}
+	fs::permissions(script, fs::perms::owner_all);
+
+	vector<cfg_parser::TelemetrySink> sinks(2);
+	// A failing sink doesn't keep the events from the others.
+	sinks[0].type = "exec";
+	sinks[0].command = path::Join(tmpdir.Path(), "does-not-exist");
+	sinks[1].type = "exec";
+	sinks[1].command = script;
+	TelemetrySinks telemetry {loop, sinks, http::ClientConfig {}};
+	ASSERT_TRUE(telemetry.Enabled());
+
+	telemetry.Emit({TelemetrySinks::kEventDeploymentStatus, "abc-123", "release-2", "downloading"});
+	telemetry.Emit({TelemetrySinks::kEventDeploymentStatus, "abc-123", "release-2", "success"});
+
+	vector<string> lines;
+	events::Timer timer {loop};
+	auto started = chrono::steady_clock::now();
+	function<void(error::Error)> poll = [&](error::Error) {
+		lines.clear();
+		ifstream f(received);
+		string line;
+		while (getline(f, line)) {
+			lines.push_back(line);
+		}
+		if (lines.size() == 2 || chrono::steady_clock::now() - started > chrono::seconds {10}) {
+			loop.Stop();
+			return;
+		}
+		timer.AsyncWait(chrono::milliseconds {100}, poll);
+	};
+	timer.AsyncWait(chrono::milliseconds {100}, poll);
+	loop.Run();
+
+	ASSERT_EQ(lines.size(), 2);
+	EXPECT_THAT(lines[0], testing::HasSubstr(R"("status":"downloading")"));
+	EXPECT_THAT(lines[1], testing::HasSubstr(R"("status":"success")"));
+	EXPECT_THAT(lines[1], testing::HasSubstr(R"("deployment_id":"abc-123")"));
+}
+
+TEST(UserNotifierTests, DisabledRebootsRightAway) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	UserNotifier notifier {loop, {}, tmpdir.Path()};
+
+	bool called {false};
+	auto started = chrono::steady_clock::now();
+	notifier.AsyncWarnBeforeReboot("Rebooting for the test.", [&]() {
+		called = true;
+		loop.Stop();
+	});
+	EXPECT_FALSE(called);
+	loop.Run();
+	EXPECT_TRUE(called);
+	EXPECT_LT(chrono::steady_clock::now() - started, chrono::seconds {1});
+}
+
+TEST(UserNotifierTests, WarnsBeforeRebooting) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+
+	cfg_parser::UserNotifications config;
+	// No sessions in the temporary directory, so nothing is sent.
+	config.desktop = true;
+	config.reboot_warning_seconds = 1;
+	UserNotifier notifier {loop, config, tmpdir.Path()};
+
+	bool called {false};
+	auto started = chrono::steady_clock::now();
+	notifier.AsyncWarnBeforeReboot("Rebooting for the test.", [&]() {
+		called = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(called);
+	EXPECT_GE(chrono::steady_clock::now() - started, chrono::seconds {1});
+}
+
+TEST(MqttBridgeTests, EventJson) {
+	EXPECT_EQ(
+		MqttBridge::StateJson("UpdateDownloadState", "abc-123", 1700000000),
+		R"({"state":"UpdateDownloadState","timestamp":1700000000,"deployment_id":"abc-123"})");
+	EXPECT_EQ(
+		MqttBridge::StateJson("IdleState", "", 1700000000),
+		R"({"state":"IdleState","timestamp":1700000000})");
+
+	EXPECT_EQ(
+		MqttBridge::DeploymentJson("abc-123", "release-\"2\"", false, 1700000000),
+		R"({"deployment_id":"abc-123","timestamp":1700000000,"artifact_name":"release-\"2\"",)"
+		R"("status":"failure"})");
+	auto exp_json = json::Load(MqttBridge::DeploymentJson("abc-123", "release-2", true, 0));
+	ASSERT_TRUE(exp_json) << exp_json.error().String();
+	auto exp_status = exp_json.value().Get("status").and_then(json::ToString);
+	ASSERT_TRUE(exp_status);
+	EXPECT_EQ(exp_status.value(), "success");
+
+	EXPECT_EQ(
+		MqttBridge::AuthorizationJson(true, 1700000000),
+		R"({"authorized":true,"timestamp":1700000000})");
+	EXPECT_EQ(
+		MqttBridge::AuthorizationJson(false, 1700000000),
+		R"({"authorized":false,"timestamp":1700000000})");
+}
+
+TEST(MqttBridgeTests, Disabled) {
+	mtesting::TestEventLoop loop;
+	MqttBridge bridge {loop, cfg_parser::Mqtt {}};
+	EXPECT_FALSE(bridge.Enabled());
+
+	// Nothing is queued, so nothing is posted to the loop either.
+	bridge.StateChanged("IdleState", "");
+	bridge.AuthorizationChanged(true);
+	bool posted {false};
+	loop.Post([&]() {
+		posted = true;
+		loop.Stop();
+	});
+	loop.Run();
+	EXPECT_TRUE(posted);
+}
+
+TEST(ServiceNotifierTests, StatusText) {
+	EXPECT_EQ(ServiceNotifier::StatusText("IdleState", "", "", false, ""), "Idle");
+	EXPECT_EQ(
+		ServiceNotifier::StatusText("IdleState", "", "", false, "network interface eth0"),
+		"Waiting for network interface eth0");
+	EXPECT_EQ(
+		ServiceNotifier::StatusText("PollForDeploymentState", "", "", false, ""), "Authorizing");
+	EXPECT_EQ(
+		ServiceNotifier::StatusText("PollForDeploymentState", "", "", true, ""),
+		"Checking for updates");
+	EXPECT_EQ(
+		ServiceNotifier::StatusText("SubmitInventoryState", "", "", true, ""),
+		"Submitting inventory");
+	EXPECT_EQ(
+		ServiceNotifier::StatusText("UpdateDownloadState", "abc-123", "release-2", true, ""),
+		"Deploying release-2 (deployment abc-123): UpdateDownloadState");
+}
+
+TEST(ServiceNotifierTests, SendsToSocket) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto socket_path = path::Join(tmpdir.Path(), "notify");
+
+	int fd = socket(AF_UNIX, SOCK_DGRAM, 0);
+	ASSERT_GE(fd, 0);
+	struct sockaddr_un addr {};
+	addr.sun_family = AF_UNIX;
+	ASSERT_LT(socket_path.size(), sizeof(addr.sun_path));
+	socket_path.copy(addr.sun_path, socket_path.size());
+	ASSERT_EQ(bind(fd, reinterpret_cast<struct sockaddr *>(&addr), sizeof(addr)), 0);
+
+	auto receive = [fd]() {
+		char buf[256];
+		auto n = recv(fd, buf, sizeof(buf), MSG_DONTWAIT);
+		return n < 0 ? string {} : string(buf, static_cast<size_t>(n));
+	};
+
+	ServiceNotifier notifier {socket_path};
+	EXPECT_TRUE(notifier.Enabled());
+
+	notifier.WaitingFor("time synchronization");
+	EXPECT_EQ(receive(), "STATUS=Waiting for time synchronization");
+	notifier.WaitingFor("");
+	notifier.Ready();
+	EXPECT_EQ(receive(), "STATUS=Idle");
+	EXPECT_EQ(receive(), "READY=1\nSTATUS=Idle");
+	notifier.Ready();
+	notifier.StateChanged("IdleState", "", "");
+	// Neither a second READY nor an unchanged status is sent again.
+	EXPECT_EQ(receive(), "");
+
+	notifier.StateChanged("PollForDeploymentState", "", "");
+	EXPECT_EQ(receive(), "STATUS=Authorizing");
+	notifier.AuthorizationChanged(true);
+	EXPECT_EQ(receive(), "STATUS=Checking for updates");
+
+	notifier.Stopping();
+	EXPECT_EQ(receive(), "STOPPING=1\nSTATUS=Stopping");
+
+	close(fd);
+}
+
+TEST(ServiceNotifierTests, WatchdogAndReload) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto socket_path = path::Join(tmpdir.Path(), "notify");
+
+	int fd = socket(AF_UNIX, SOCK_DGRAM, 0);
+	ASSERT_GE(fd, 0);
+	struct sockaddr_un addr {};
+	addr.sun_family = AF_UNIX;
+	ASSERT_LT(socket_path.size(), sizeof(addr.sun_path));
+	socket_path.copy(addr.sun_path, socket_path.size());
+	ASSERT_EQ(bind(fd, reinterpret_cast<struct sockaddr *>(&addr), sizeof(addr)), 0);
+
+	auto receive = [fd]() {
+		char buf[256];
+		auto n = recv(fd, buf, sizeof(buf), MSG_DONTWAIT);
+		return n < 0 ? string {} : string(buf, static_cast<size_t>(n));
+	};
+
+	ServiceNotifier notifier {socket_path, chrono::seconds {10}};
+	EXPECT_EQ(notifier.WatchdogInterval(), chrono::seconds {10});
+
+	notifier.KeepAlive();
+	EXPECT_EQ(receive(), "WATCHDOG=1");
+
+	// Not ready yet, so there is nothing to tell about a reload.
+	notifier.Reloading();
+	notifier.Reloaded();
+	EXPECT_EQ(receive(), "");
+
+	notifier.Ready();
+	EXPECT_EQ(receive(), "READY=1\nSTATUS=Idle");
+
+	notifier.Reloading();
+	auto reloading = receive();
+	EXPECT_THAT(reloading, testing::StartsWith("RELOADING=1\nMONOTONIC_USEC="));
+	EXPECT_THAT(reloading, testing::EndsWith("\nSTATUS=Reloading the configuration"));
+	notifier.Reloaded();
+	EXPECT_EQ(receive(), "READY=1\nSTATUS=Idle");
+
+	notifier.Stopping();
+	EXPECT_EQ(receive(), "STOPPING=1\nSTATUS=Stopping");
+	notifier.Stopping();
+	EXPECT_EQ(receive(), "");
+
+	close(fd);
+}
+
+TEST(ServiceNotifierTests, Disabled) {
+	ServiceNotifier notifier {"", chrono::seconds {10}};
+	EXPECT_FALSE(notifier.Enabled());
+	// No keep-alives either, since they would go nowhere.
+	EXPECT_EQ(notifier.WatchdogInterval(), chrono::microseconds {0});
+	// Nothing to send to, which isn't an error.
+	notifier.Ready();
+	notifier.StateChanged("IdleState", "", "");
+	notifier.KeepAlive();
+}
+
+TEST(StartupWaitTests, WaitsForInterfaces) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	fs::create_directories(path::Join(tmpdir.Path(), "eth0"));
+	auto operstate = path::Join(tmpdir.Path(), "eth0", "operstate");
+	{
+		ofstream f(operstate);
+		f << "down\n";
+	}
+
+	cfg_parser::StartupWait config;
+	config.interfaces = {"eth0", "lo"};
+	StartupWait wait {loop, config, tmpdir.Path()};
+	EXPECT_TRUE(wait.Enabled());
+	EXPECT_THAT(
+		wait.Unmet(), testing::ElementsAre("network interface eth0", "network interface lo"));
+
+	fs::create_directories(path::Join(tmpdir.Path(), "lo"));
+	{
+		ofstream f(path::Join(tmpdir.Path(), "lo", "operstate"));
+		f << "unknown\n";
+	}
+
+	vector<vector<string>> progress;
+	bool done {false};
+	wait.AsyncWait(
+		[&](const vector<string> &unmet) {
+			progress.push_back(unmet);
+			ofstream f(operstate);
+			f << "up\n";
+		},
+		[&]() {
+			done = true;
+			loop.Stop();
+		});
+	EXPECT_FALSE(done);
+	loop.Run();
+	EXPECT_TRUE(done);
+	ASSERT_EQ(progress.size(), 1);
+	EXPECT_THAT(progress[0], testing::ElementsAre("network interface eth0"));
+	EXPECT_TRUE(wait.Unmet().empty());
+}
+
+TEST(StartupWaitTests, TimesOut) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+
+	cfg_parser::StartupWait config;
+	config.interfaces = {"eth0"};
+	config.timeout_seconds = 1;
+	StartupWait wait {loop, config, tmpdir.Path()};
+
+	bool done {false};
+	auto started = chrono::steady_clock::now();
+	wait.AsyncWait(
+		[](const vector<string> &) {},
+		[&]() {
+			done = true;
+			loop.Stop();
+		});
+	loop.Run();
+	EXPECT_TRUE(done);
+	EXPECT_GE(chrono::steady_clock::now() - started, chrono::seconds {1});
+	EXPECT_THAT(wait.Unmet(), testing::ElementsAre("network interface eth0"));
+}
+
+TEST(StartupWaitTests, ReadyBeforeAWaitLongerThanTheStartTimeout) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto socket_path = path::Join(tmpdir.Path(), "notify");
+
+	int fd = socket(AF_UNIX, SOCK_DGRAM, 0);
+	ASSERT_GE(fd, 0);
+	struct sockaddr_un addr {};
+	addr.sun_family = AF_UNIX;
+	ASSERT_LT(socket_path.size(), sizeof(addr.sun_path));
+	socket_path.copy(addr.sun_path, socket_path.size());
+	ASSERT_EQ(bind(fd, reinterpret_cast<struct sockaddr *>(&addr), sizeof(addr)), 0);
+
+	auto receive_all = [fd]() {
+		vector<string> messages;
+		char buf[256];
+		ssize_t n;
+		while ((n = recv(fd, buf, sizeof(buf), MSG_DONTWAIT)) >= 0) {
+			messages.push_back(string(buf, static_cast<size_t>(n)));
+		}
+		return messages;
+	};
+
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+	// Never up, and waited for as long as it takes.
+	config.startup_wait.interfaces = {"missing0"};
+	config.startup_wait.timeout_seconds = 0;
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	mtesting::TestEventLoop event_loop;
+
+	setenv("NOTIFY_SOCKET", socket_path.c_str(), 1);
+	Context ctx {main_context, event_loop};
+	unsetenv("NOTIFY_SOCKET");
+
+	ctx.deployment_client = make_shared<NoopDeploymentClient>();
+	ctx.inventory_client = make_shared<NoopInventoryClient>();
+
+	// Stands for the start timeout of systemd, which the wait outlasts.
+	const chrono::seconds start_timeout {1};
+	vector<string> messages;
+	events::Timer start_timer {event_loop};
+	start_timer.AsyncWait(start_timeout, [&](error::Error err) {
+		messages = receive_all();
+		event_loop.Stop();
+	});
+
+	StateMachine state_machine {ctx, event_loop};
+	err = state_machine.Run();
+	ASSERT_EQ(err, error::NoError);
+	close(fd);
+
+	const string ready {"READY=1\nSTATUS=Waiting for network interface missing0"};
+	EXPECT_THAT(messages, testing::Contains(ready));
+	// Still waiting, the server has not been contacted.
+	EXPECT_FALSE(ctx.inventory_client->has_submitted_inventory);
+}
+
+TEST(PartitionLayoutCheckTests, RunsWhenTheDaemonStarts) {
+	mtesting::TemporaryDirectory tmpdir;
+	const string data_store = path::Join(tmpdir.Path(), "store");
+	const string modules = path::Join(tmpdir.Path(), "modules", "v3");
+	fs::create_directories(data_store);
+	fs::create_directories(modules);
+	const string args = path::Join(tmpdir.Path(), "args");
+	const string module = path::Join(modules, "rootfs-image");
+	{
+		ofstream f(module);
+		f << "#!/bin/sh\n";
+		f << "echo \"$@\" > " << args << "\n";
+		f << "test -d \"$2/tmp\" || exit 1\n";
+	}
+	fs::permissions(module, fs::perms::owner_all);
+
+	conf::MenderConfig config {};
+	config.paths.SetPathDataDir(tmpdir.Path());
+	config.paths.SetDataStore(data_store);
+	// Keeps the daemon at the startup wait, so that nothing else runs.
+	config.startup_wait.interfaces = {"missing0"};
+	config.startup_wait.timeout_seconds = 0;
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	mtesting::TestEventLoop event_loop;
+
+	Context ctx {main_context, event_loop};
+	ctx.deployment_client = make_shared<NoopDeploymentClient>();
+	ctx.inventory_client = make_shared<NoopInventoryClient>();
+
+	const string files = path::Join(data_store, "partition-layout-check");
+	events::Timer stop_timer {event_loop};
+	function<void(error::Error)> poll = [&](error::Error) {
+		if (path::FileExists(args) && !path::FileExists(files)) {
+			event_loop.Stop();
+			return;
+		}
+		stop_timer.AsyncWait(chrono::milliseconds {10}, poll);
+	};
+	stop_timer.AsyncWait(chrono::milliseconds {10}, poll);
+
+	StateMachine state_machine {ctx, event_loop};
+	err = state_machine.Run();
+	ASSERT_EQ(err, error::NoError);
+
+	ifstream f(args);
+	string line;
+	ASSERT_TRUE(getline(f, line));
+	// A File Tree of its own in the data store, which is removed afterwards.
+	EXPECT_EQ(line, "CheckPartitionLayout " + files);
+	EXPECT_FALSE(path::FileExists(files));
+}
+
+TEST(StatusUpdateLimiterTests, NoLimit) {
+	mtesting::TestEventLoop loop;
+	StatusUpdateLimiter limiter {loop, chrono::milliseconds {0}};
+	EXPECT_TRUE(limiter.MaySendNow());
+	limiter.RecordSent();
+	EXPECT_TRUE(limiter.MaySendNow());
+}
+
+TEST(StatusUpdateLimiterTests, DefersAndDropsSupersededUpdates) {
+	mtesting::TestEventLoop loop;
+	StatusUpdateLimiter limiter {loop, chrono::milliseconds {200}};
+	EXPECT_TRUE(limiter.MaySendNow());
+	limiter.RecordSent();
+	EXPECT_FALSE(limiter.MaySendNow());
+
+	vector<string> sent;
+	limiter.Defer([&sent](function<void()> done) {
+		sent.push_back("installing");
+		done();
+	});
+
+	// A newer update replaces the deferred one.
+	bool turn {false};
+	limiter.AsyncWaitTurn([&turn]() { turn = true; });
+	EXPECT_TRUE(turn);
+	limiter.Defer([&sent, &loop](function<void()> done) {
+		sent.push_back("rebooting");
+		done();
+		loop.Stop();
+	});
+
+	loop.Run();
+	EXPECT_THAT(sent, testing::ElementsAre("rebooting"));
+	EXPECT_FALSE(limiter.MaySendNow());
+}
+
+TEST(StatusUpdateLimiterTests, WaitsForDeferredUpdateOnItsWay) {
+	mtesting::TestEventLoop loop;
+	StatusUpdateLimiter limiter {loop, chrono::milliseconds {100}};
+	limiter.RecordSent();
+
+	function<void()> finish_push;
+	limiter.Defer([&finish_push, &loop](function<void()> done) {
+		finish_push = done;
+		loop.Stop();
+	});
+	loop.Run();
+	ASSERT_TRUE(finish_push);
+
+	bool turn {false};
+	limiter.AsyncWaitTurn([&turn]() { turn = true; });
+	EXPECT_FALSE(turn);
+	finish_push();
+	EXPECT_TRUE(turn);
+}
+
+TEST(UpdateWindowTests, ConfirmDeployment) {
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+	mtesting::TestEventLoop event_loop;
+	Context ctx {main_context, event_loop};
+
+	// Only with Confirmation.
+	auto exp_reply = ConfirmDeployment(ctx, "1234");
+	EXPECT_FALSE(exp_reply);
+
+	config.update_window.confirmation = true;
+	exp_reply = ConfirmDeployment(ctx, "1234");
+	ASSERT_TRUE(exp_reply) << exp_reply.error().String();
+	EXPECT_EQ(exp_reply.value(), kReplyNoSuchDeployment);
+
+	ctx.deployment.state_data.reset(new StateData);
+	ctx.deployment.state_data->update_info.id = "1234";
+	exp_reply = ConfirmDeployment(ctx, "5678");
+	ASSERT_TRUE(exp_reply) << exp_reply.error().String();
+	EXPECT_EQ(exp_reply.value(), kReplyNoSuchDeployment);
+	EXPECT_FALSE(ctx.deployment.confirmed);
+
+	exp_reply = ConfirmDeployment(ctx, "1234");
+	ASSERT_TRUE(exp_reply) << exp_reply.error().String();
+	EXPECT_EQ(exp_reply.value(), kReplyDeploymentConfirmed);
+	EXPECT_TRUE(ctx.deployment.confirmed);
+}
+
+TEST(ArtifactMirrorsTests, MirrorURL) {
+	EXPECT_EQ(
+		ArtifactMirrorURL("http://cache.local/mender/", "raspberrypi4", "release 2"),
+		"http://cache.local/mender/raspberrypi4/release%202.mender");
+	EXPECT_EQ(
+		ArtifactMirrorURL("http://10.0.0.2:8080", "qemux86-64", "release-2"),
+		"http://10.0.0.2:8080/qemux86-64/release-2.mender");
+}
+
+TEST(ChunkedDownloadTests, RollingChecksum) {
+	vector<uint8_t> data(1000);
+	for (size_t i = 0; i < data.size(); i++) {
+		data[i] = static_cast<uint8_t>(i * 7 + i / 13);
+	}
+
+	const size_t window = 64;
+	RollingChecksum rolling;
+	rolling.Reset(data.data(), window);
+	for (size_t i = 1; i + window <= data.size(); i++) {
+		rolling.Roll(data[i - 1], data[i + window - 1]);
+		RollingChecksum fresh;
+		fresh.Reset(data.data() + i, window);
+		ASSERT_EQ(rolling.Value(), fresh.Value()) << "At offset " << i;
+	}
+}
+
+TEST(ChunkedDownloadTests, ParseChunkIndex) {
+	const string sha_a(64, 'a');
+	const string sha_b(64, 'b');
+	auto index_json = [](int size, const string &first, const string &second) {
+		return R"({"chunk_size": 4, "size": )" + to_string(size) + R"(, "chunks": [)"
+			   + R"({"sha256": ")" + first + R"(", "weak": 1}, )" + R"({"sha256": ")" + second
+			   + R"(", "weak": 2}]})";
+	};
+
+	auto exp_index = ParseChunkIndex(index_json(6, sha_a, sha_b));
+	ASSERT_TRUE(exp_index) << exp_index.error().String();
+	auto &index = exp_index.value();
+	EXPECT_EQ(index.chunk_size, 4);
+	EXPECT_EQ(index.size, 6);
+	ASSERT_EQ(index.chunks.size(), 2);
+	EXPECT_EQ(index.chunks[0].sha256, sha_a);
+	EXPECT_EQ(index.chunks[1].weak, 2);
+	EXPECT_EQ(index.ChunkSize(0), 4);
+	EXPECT_EQ(index.ChunkSize(1), 2);
+
+	// Three chunks would be needed.
+	EXPECT_FALSE(ParseChunkIndex(index_json(9, sha_a, sha_b)));
+	EXPECT_FALSE(ParseChunkIndex(index_json(6, sha_a, "not-a-checksum")));
+	EXPECT_FALSE(ParseChunkIndex(R"({"chunk_size": 0, "size": 0, "chunks": []})"));
+}
+
+TEST(ChunkedDownloadTests, ReassemblesFromStoreAndSeed) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto store = path::Join(tmpdir.Path(), "store");
+
+	const int64_t chunk_size = 4096;
+	vector<uint8_t> artifact(chunk_size * 3 + 1000);
+	for (size_t i = 0; i < artifact.size(); i++) {
+		artifact[i] = static_cast<uint8_t>((i * 2654435761u) >> 13);
+	}
+
+	ChunkIndex index {chunk_size, static_cast<int64_t>(artifact.size()), {}};
+	for (int64_t offset = 0; offset < index.size; offset += chunk_size) {
+		vector<uint8_t> chunk {
+			artifact.begin() + offset,
+			artifact.begin() + min(offset + chunk_size, index.size)};
+		auto sha256 = mender::sha::Shasum(chunk).value().String();
+		RollingChecksum weak;
+		weak.Reset(chunk.data(), chunk.size());
+		index.chunks.push_back({sha256, weak.Value()});
+
+		// The URL of a chunk in the store is also its path relative to the store.
+		auto chunk_path = ChunkURL(store, sha256);
+		ASSERT_EQ(path::CreateDirectories(path::DirName(chunk_path)), error::NoError);
+		ofstream f(chunk_path, ios::binary);
+		f.write(reinterpret_cast<const char *>(chunk.data()), chunk.size());
+		ASSERT_TRUE(f.good());
+	}
+
+	// The second chunk is only in the seed, and not at a multiple of the chunk size.
+	auto seed = path::Join(tmpdir.Path(), "seed");
+	{
+		ofstream f(seed, ios::binary);
+		string padding(100, 'x');
+		f << padding;
+		f.write(reinterpret_cast<const char *>(artifact.data() + chunk_size), chunk_size);
+		f << padding;
+		ASSERT_TRUE(f.good());
+	}
+	ASSERT_EQ(path::FileDelete(ChunkURL(store, index.chunks[1].sha256)), error::NoError);
+
+	mtesting::HttpFileServer server(store);
+	mtesting::TestEventLoop loop;
+	ChunkedDownload chunked_download {loop, http::ClientConfig {}};
+	auto reader = chunked_download.MakeReader(
+		server.GetBaseUrl(), index, {path::Join(tmpdir.Path(), "no-such-seed"), seed});
+
+	events::io::ReaderFromAsyncReader sync_reader {loop, reader};
+	vector<uint8_t> result;
+	io::ByteWriter writer {result};
+	writer.SetUnlimited(true);
+	auto err = io::Copy(writer, sync_reader);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(result, artifact);
+
+	// A corrupted chunk is rejected.
+	{
+		auto chunk_path = ChunkURL(store, index.chunks[2].sha256);
+		ofstream f(chunk_path, ios::binary | ios::in | ios::out);
+		f << "corrupted";
+	}
+	mtesting::TestEventLoop loop2;
+	ChunkedDownload chunked_download2 {loop2, http::ClientConfig {.retry_download_count = 0}};
+	reader = chunked_download2.MakeReader(server.GetBaseUrl(), index, {seed});
+	events::io::ReaderFromAsyncReader sync_reader2 {loop2, reader};
+	result.clear();
+	io::ByteWriter writer2 {result};
+	writer2.SetUnlimited(true);
+	err = io::Copy(writer2, sync_reader2);
+	ASSERT_NE(err, error::NoError);
+	EXPECT_THAT(err.String(), testing::HasSubstr("checksum mismatch"));
+}
+
+TEST(ChunkedDownloadTests, UsesSeedIndex) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto store = path::Join(tmpdir.Path(), "store");
+
+	const int64_t chunk_size = 4096;
+	vector<uint8_t> artifact(chunk_size * 2 + 1000);
+	for (size_t i = 0; i < artifact.size(); i++) {
+		artifact[i] = static_cast<uint8_t>((i * 2654435761u) >> 13);
+	}
+	auto seed = path::Join(tmpdir.Path(), "seed");
+	{
+		ofstream f(seed, ios::binary);
+		f.write(reinterpret_cast<const char *>(artifact.data()), artifact.size());
+		ASSERT_TRUE(f.good());
+	}
+
+	// The seed holds the whole Artifact, so its index is the one of the Artifact.
+	auto exp_index = ComputeSeedIndex(seed, chunk_size);
+	ASSERT_TRUE(exp_index) << exp_index.error().String();
+	auto &index = exp_index.value();
+	EXPECT_EQ(index.size, artifact.size());
+	ASSERT_EQ(index.chunks.size(), 3);
+	EXPECT_EQ(index.ChunkSize(2), 1000);
+	auto exp_parsed = ParseChunkIndex(ChunkIndexToJson(index));
+	ASSERT_TRUE(exp_parsed) << exp_parsed.error().String();
+	EXPECT_EQ(exp_parsed.value().chunks[1].sha256, index.chunks[1].sha256);
+	EXPECT_EQ(exp_parsed.value().chunks[1].weak, index.chunks[1].weak);
+
+	auto seed_index_dir = path::Join(tmpdir.Path(), "seed-indexes");
+	EXPECT_EQ(
+		SeedIndexPath(seed_index_dir, "/dev/mmcblk0p2"),
+		path::Join(seed_index_dir, "%2Fdev%2Fmmcblk0p2.json"));
+	ASSERT_EQ(path::CreateDirectories(seed_index_dir), error::NoError);
+	{
+		ofstream f(SeedIndexPath(seed_index_dir, seed));
+		f << ChunkIndexToJson(index);
+	}
+
+	// Only the shorter last chunk is in the store, the others must come from the seed.
+	vector<uint8_t> last {artifact.begin() + 2 * chunk_size, artifact.end()};
+	auto chunk_path = ChunkURL(store, index.chunks[2].sha256);
+	ASSERT_EQ(path::CreateDirectories(path::DirName(chunk_path)), error::NoError);
+	{
+		ofstream f(chunk_path, ios::binary);
+		f.write(reinterpret_cast<const char *>(last.data()), last.size());
+		ASSERT_TRUE(f.good());
+	}
+
+	mtesting::HttpFileServer server(store);
+	mtesting::TestEventLoop loop;
+	ChunkedDownload chunked_download {loop, http::ClientConfig {}};
+	auto reader = chunked_download.MakeReader(server.GetBaseUrl(), index, {seed}, seed_index_dir);
+
+	events::io::ReaderFromAsyncReader sync_reader {loop, reader};
+	vector<uint8_t> result;
+	io::ByteWriter writer {result};
+	writer.SetUnlimited(true);
+	auto err = io::Copy(writer, sync_reader);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(result, artifact);
+
+	EXPECT_FALSE(ComputeSeedIndex(path::Join(tmpdir.Path(), "no-such-seed"), chunk_size));
+	EXPECT_FALSE(ComputeSeedIndex(seed, 0));
+}
+
+TEST(LoopHealthTests, ToJson) {
+	LoopHealth health;
+	EXPECT_EQ(
+		health.ToJson(),
+		R"({"healthy":true,"running_since":null,"last_success":null,"last_failure":null,)"
+		R"("last_error":"","failures":0})");
+
+	LoopHealth::Clock::time_point start {chrono::seconds {1000}};
+	health.Started(start);
+	EXPECT_TRUE(health.Running());
+	health.Failed("Server said \"no\"", start + chrono::seconds {5});
+	EXPECT_FALSE(health.Running());
+	health.Started(start + chrono::seconds {10});
+	health.Failed("Server said \"no\"", start + chrono::seconds {15});
+	EXPECT_EQ(health.Failures(), 2);
+	EXPECT_EQ(
+		health.ToJson(),
+		R"({"healthy":false,"running_since":null,"last_success":null,"last_failure":1015,)"
+		R"("last_error":"Server said \"no\"","failures":2})");
+
+	health.Started(start + chrono::seconds {20});
+	EXPECT_EQ(
+		health.ToJson(),
+		R"({"healthy":false,"running_since":1020,"last_success":null,"last_failure":1015,)"
+		R"("last_error":"Server said \"no\"","failures":2})");
+	health.Succeeded(start + chrono::seconds {25});
+	EXPECT_EQ(
+		health.ToJson(),
+		R"({"healthy":true,"running_since":null,"last_success":1025,"last_failure":1015,)"
+		R"("last_error":"","failures":0})");
+}
+
+class NoCallClient : public api::Client {
+public:
+	error::Error AsyncCall(
+		api::APIRequestPtr req,
+		http::ResponseHandler header_handler,
+		http::ResponseHandler body_handler) override {
+		ADD_FAILURE() << "Unexpected API call";
+		return error::MakeError(error::ProgrammingError, "Unexpected API call");
+	}
+};
+
+class RecordingInventoryClient : public inventory::InventoryAPI {
+public:
+	error::Error PushData(
+		const string &inventory_generators_dir,
+		events::EventLoop &loop,
+		api::Client &client,
+		inventory::APIResponseHandler api_handler) override {
+		EXPECT_EQ(inventory_generators_dir, "/scripts");
+		handlers.push_back(api_handler);
+		if (on_push) {
+			on_push();
+		}
+		return error::NoError;
+	}
+
+	void ClearDataCache() override {
+	}
+
+	vector<inventory::APIResponseHandler> handlers;
+	function<void()> on_push;
+};
+
+TEST(InventorySchedulerTests, RetriesOnItsOwn) {
+	mtesting::TestEventLoop loop;
+	NoCallClient client;
+	auto inventory_client = make_shared<RecordingInventoryClient>();
+	LoopHealth health;
+	PollSplay splay {{}, 0};
+	InventoryScheduler scheduler {
+		loop,
+		client,
+		inventory_client,
+		health,
+		"/scripts",
+		chrono::seconds {3600},
+		splay,
+		chrono::seconds {1},
+		2,
+	};
+
+	inventory_client->on_push = [&]() {
+		auto handler = inventory_client->handlers.back();
+		if (inventory_client->handlers.size() == 1) {
+			EXPECT_TRUE(health.Running());
+			handler(inventory::APIResponse {
+				nullopt,
+				nullopt,
+				inventory::MakeError(inventory::BadResponseError, "Got 500")});
+			EXPECT_FALSE(health.Running());
+			EXPECT_EQ(health.Failures(), 1);
+			EXPECT_FALSE(inventory_client->has_submitted_inventory);
+		} else {
+			handler(inventory::APIResponse {nullopt, nullopt, error::NoError});
+			loop.Stop();
+		}
+	};
+
+	scheduler.Trigger();
+	loop.Run();
+
+	EXPECT_EQ(inventory_client->handlers.size(), 2);
+	EXPECT_EQ(health.Failures(), 0);
+	EXPECT_TRUE(inventory_client->has_submitted_inventory);
+}
+
+TEST(InventorySchedulerTests, TriggerDuringSubmission) {
+	mtesting::TestEventLoop loop;
+	NoCallClient client;
+	auto inventory_client = make_shared<RecordingInventoryClient>();
+	LoopHealth health;
+	PollSplay splay {{}, 0};
+	InventoryScheduler scheduler {
+		loop,
+		client,
+		inventory_client,
+		health,
+		"/scripts",
+		chrono::seconds {3600},
+		splay,
+		chrono::seconds {3600},
+		2,
+	};
+
+	scheduler.Trigger();
+	ASSERT_EQ(inventory_client->handlers.size(), 1);
+
+	// Submitted again once the ongoing submission is done, not alongside it.
+	scheduler.Trigger();
+	EXPECT_EQ(inventory_client->handlers.size(), 1);
+
+	inventory_client->on_push = [&]() {
+		inventory_client->handlers.back()(
+			inventory::APIResponse {nullopt, nullopt, error::NoError});
+		loop.Stop();
+	};
+	inventory_client->handlers[0](inventory::APIResponse {nullopt, nullopt, error::NoError});
+	EXPECT_EQ(inventory_client->handlers.size(), 1);
+
+	loop.Run();
+	EXPECT_EQ(inventory_client->handlers.size(), 2);
+	EXPECT_FALSE(health.Running());
+}
+
+TEST(PollSplayTests, AddsUpToTheSplay) {
+	PollSplay disabled {{}, 1};
+	EXPECT_FALSE(disabled.Enabled());
+	EXPECT_EQ(disabled.Apply(chrono::seconds {1800}), chrono::seconds {1800});
+
+	PollSplay percent {{.percent = 10}, 1};
+	EXPECT_TRUE(percent.Enabled());
+	EXPECT_EQ(percent.MaxSplay(chrono::seconds {1800}), chrono::seconds {180});
+	PollSplay seconds {{.seconds = 300}, 1};
+	EXPECT_EQ(seconds.MaxSplay(chrono::seconds {1800}), chrono::seconds {300});
+
+	bool any_splay {false};
+	for (int i = 0; i < 100; i++) {
+		auto interval = percent.Apply(chrono::seconds {1800});
+		EXPECT_GE(interval, chrono::seconds {1800});
+		EXPECT_LE(interval, chrono::seconds {1980});
+		any_splay = any_splay || interval != chrono::seconds {1800};
+	}
+	EXPECT_TRUE(any_splay);
+}
+
+TEST(PollSplayTests, SameSeedSameSplay) {
+	PollSplay first {{.seconds = 3600}, 42};
+	PollSplay again {{.seconds = 3600}, 42};
+	PollSplay other {{.seconds = 3600}, 43};
+
+	vector<chrono::seconds> first_intervals;
+	vector<chrono::seconds> again_intervals;
+	vector<chrono::seconds> other_intervals;
+	for (int i = 0; i < 10; i++) {
+		first_intervals.push_back(first.Apply(chrono::seconds {60}));
+		again_intervals.push_back(again.Apply(chrono::seconds {60}));
+		other_intervals.push_back(other.Apply(chrono::seconds {60}));
+	}
+	EXPECT_EQ(first_intervals, again_intervals);
+	EXPECT_NE(first_intervals, other_intervals);
+}
+
+TEST(PollSplayTests, SeedFromIdentity) {
+	mtesting::TemporaryDirectory tmpdir;
+	auto script_path = path::Join(tmpdir.Path(), "identity");
+	{
+		ofstream script(script_path);
+		script << "#!/bin/sh\necho mac=02:00:00:00:00:01\n";
+	}
+	ASSERT_EQ(chmod(script_path.c_str(), S_IRUSR | S_IWUSR | S_IXUSR), 0);
+
+	conf::MenderConfig config;
+	config.paths.SetIdentityScript(script_path);
+	// Without a splay, the identity isn't read.
+	EXPECT_EQ(PollSplaySeed(config), uint64_t {0});
+
+	config.poll_splay.percent = 10;
+	auto seed = PollSplaySeed(config);
+	EXPECT_NE(seed, uint64_t {0});
+	EXPECT_EQ(PollSplaySeed(config), seed);
+
+	{
+		ofstream script(script_path);
+		script << "#!/bin/sh\necho mac=02:00:00:00:00:02\n";
+	}
+	EXPECT_NE(PollSplaySeed(config), seed);
+}
+
+TEST(DeploymentHistoryTests, RecordsOutcomes) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto history_path = path::Join(tmpdir.Path(), kDeploymentHistoryFile);
+	DeploymentHistory history {history_path, 2};
+
+	auto exp_records = history.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	EXPECT_EQ(exp_records.value().size(), 0);
+
+	DeploymentHistory::Clock::time_point start {chrono::seconds {1000}};
+	auto err = history.Started("id1", "artifact1", start);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = history.Failed("id1", "install");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = history.FailureReason("id1", "Deployment id1 failed in UpdateInstallState");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	// The rollback failing as well doesn't change where the deployment failed.
+	err = history.Failed("id1", "other");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = history.FailureReason("id1", "Deployment id1 failed in UpdateRollbackState");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = history.Finished("id1", false, start + chrono::seconds {30});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	err = history.Started("id2", "artifact \"2\"", start + chrono::seconds {100});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	exp_records = history.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	EXPECT_EQ(
+		DeploymentHistory::ToJson(exp_records.value()),
+		R"([{"id":"id1","artifact_name":"artifact1","started":1000,"finished":1030,)"
+		R"("duration_seconds":30,"outcome":"failure","failure_class":"install",)"
+		R"("failure_reason":"Deployment id1 failed in UpdateInstallState"},)"
+		R"({"id":"id2","artifact_name":"artifact \"2\"","started":1100,"finished":null,)"
+		R"("duration_seconds":null,"outcome":"in-progress","failure_class":"",)"
+		R"("failure_reason":""}])");
+
+	// Survives a restart, and only the latest deployments are kept.
+	DeploymentHistory restarted {history_path, 2};
+	err = restarted.Finished("id2", true, start + chrono::seconds {150});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = restarted.Started("id3", "artifact3", start + chrono::seconds {200});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	exp_records = restarted.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	auto &records = exp_records.value();
+	ASSERT_EQ(records.size(), 2);
+	EXPECT_EQ(records[0].id, "id2");
+	EXPECT_EQ(records[0].artifact_name, "artifact \"2\"");
+	EXPECT_EQ(records[0].outcome, DeploymentHistory::kOutcomeSuccess);
+	EXPECT_EQ(records[0].finished - records[0].started, 50);
+	EXPECT_EQ(records[1].id, "id3");
+	EXPECT_EQ(records[1].outcome, DeploymentHistory::kOutcomeInProgress);
+	EXPECT_EQ(records[1].finished, 0);
+}
+
+TEST(DeploymentHistoryTests, RecordsAborts) {
+	mtesting::TemporaryDirectory tmpdir;
+	DeploymentHistory history {path::Join(tmpdir.Path(), kDeploymentHistoryFile), 5};
+
+	DeploymentHistory::Clock::time_point start {chrono::seconds {1000}};
+	auto err = history.Started("id1", "artifact1", start);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = history.Aborted("id1", "install");
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	// Already aborted while it is rolled back.
+	auto exp_records = history.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	ASSERT_EQ(exp_records.value().size(), 1);
+	EXPECT_EQ(exp_records.value()[0].outcome, DeploymentHistory::kOutcomeAborted);
+	EXPECT_EQ(exp_records.value()[0].finished, 0);
+
+	// A failing rollback doesn't make it a failure.
+	err = history.Failed("id1", "other");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = history.Finished("id1", false, start + chrono::seconds {30});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	exp_records = history.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	EXPECT_EQ(
+		DeploymentHistory::ToJson(exp_records.value()),
+		R"([{"id":"id1","artifact_name":"artifact1","started":1000,"finished":1030,)"
+		R"("duration_seconds":30,"outcome":"aborted","failure_class":"install",)"
+		R"("failure_reason":""}])");
+}
+
+TEST(DeploymentHistoryTests, UnknownAndInvalidRecords) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto history_path = path::Join(tmpdir.Path(), kDeploymentHistoryFile);
+	{
+		ofstream f(history_path);
+		f << "garbage\n";
+		f << R"({"id":"id1","artifact_name":"artifact1","started":1000,"finished":null,)"
+		  << R"("outcome":"in-progress"})" << "\n";
+	}
+
+	DeploymentHistory history {history_path, 5};
+	// A deployment which started before the history was kept.
+	auto err = history.Finished("id0", true);
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	auto exp_records = history.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	auto &records = exp_records.value();
+	ASSERT_EQ(records.size(), 2);
+	EXPECT_EQ(records[0].id, "id1");
+	EXPECT_EQ(records[0].failure_class, "");
+	EXPECT_EQ(records[0].failure_reason, "");
+	EXPECT_EQ(records[1].id, "id0");
+	EXPECT_EQ(records[1].started, 0);
+	EXPECT_EQ(records[1].outcome, DeploymentHistory::kOutcomeSuccess);
+	EXPECT_NE(
+		DeploymentHistory::ToJson(records).find(R"("id":"id0","artifact_name":"","started":null,)"),
+		string::npos);
+
+	// Nothing is recorded when disabled.
+	DeploymentHistory disabled {history_path, 0};
+	err = disabled.Started("id2", "artifact2");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	exp_records = disabled.Load();
+	ASSERT_TRUE(exp_records) << exp_records.error().String();
+	EXPECT_EQ(exp_records.value().size(), 2);
+}
+
+TEST(FailureCategoryTests, ClassifiesErrors) {
+	namespace parser_error = mender::artifact::parser_error;
+	namespace script_executor = mender::artifact::scripts::executor;
+
+	EXPECT_EQ(
+		ClassifyError(error::Error(make_error_condition(errc::timed_out), "")),
+		FailureCategory::Timeout);
+	EXPECT_EQ(
+		ClassifyError(http::MakeError(http::MaxRetryError, "")), FailureCategory::Network);
+	EXPECT_EQ(
+		ClassifyError(error::Error(make_error_condition(errc::connection_refused), "")),
+		FailureCategory::Network);
+	EXPECT_EQ(
+		ClassifyError(deployments::MakeError(deployments::BadResponseError, "")),
+		FailureCategory::Network);
+	EXPECT_EQ(
+		ClassifyError(parser_error::MakeError(parser_error::SignatureVerificationError, "")),
+		FailureCategory::Signature);
+	EXPECT_EQ(
+		ClassifyError(mender::sha::MakeError(mender::sha::ShasumMismatchError, "")),
+		FailureCategory::Signature);
+	EXPECT_EQ(
+		ClassifyError(context::MakeError(context::ArtifactDependsNotSatisfiedError, "")),
+		FailureCategory::Depends);
+	EXPECT_EQ(ClassifyError(kvdb::MakeError(kvdb::KeyError, "")), FailureCategory::Storage);
+	EXPECT_EQ(
+		ClassifyError(error::Error(make_error_condition(errc::no_space_on_device), "")),
+		FailureCategory::Storage);
+	EXPECT_EQ(
+		ClassifyError(script_executor::MakeError(script_executor::NonZeroExitStatusError, "")),
+		FailureCategory::Script);
+	EXPECT_EQ(
+		ClassifyError(context::MakeError(context::NoSuchUpdateModuleError, "")),
+		FailureCategory::Module);
+
+	// Up to the caller.
+	EXPECT_EQ(
+		ClassifyError(processes::MakeError(processes::NonZeroExitStatusError, "")),
+		FailureCategory::None);
+	EXPECT_EQ(
+		ClassifyError(deployments::MakeError(deployments::DeploymentAbortedError, "")),
+		FailureCategory::None);
+
+	EXPECT_EQ(FailureCategoryString(FailureCategory::Depends), "depends");
+	EXPECT_EQ(FailureCategoryFromString("depends"), FailureCategory::Depends);
+	EXPECT_EQ(FailureCategoryFromString("cosmic-rays"), FailureCategory::None);
+
+	EXPECT_EQ(
+		FailureSubstate(FailureCategory::Script, "State script ArtifactInstall_Enter_01 failed"),
+		"[script] State script ArtifactInstall_Enter_01 failed");
+	EXPECT_EQ(FailureSubstate(FailureCategory::Module, ""), "[module]");
+	EXPECT_EQ(FailureSubstate(FailureCategory::None, "Battery too low"), "Battery too low");
+}
+
+TEST(FailureCategoryTests, RecordsTheFirstFailure) {
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError);
+
+	mtesting::TestEventLoop event_loop;
+	Context ctx {main_context, event_loop};
+
+	// Nothing to record it in outside of a deployment.
+	ctx.RecordFailure(FailureCategory::Network);
+
+	ctx.deployment.state_data.reset(new StateData);
+	auto &state_data = *ctx.deployment.state_data;
+	state_data.state = Context::kUpdateStateArtifactInstall;
+	state_data.update_info.id = "deployment-1";
+	state_data.update_info.artifact.artifact_name = "artifact-1";
+	state_data.update_info.artifact.payload_types = {"rootfs-image"};
+
+	// The error doesn't tell, so the fallback is used.
+	ctx.RecordFailure(
+		processes::MakeError(processes::NonZeroExitStatusError, ""), FailureCategory::Module);
+	EXPECT_EQ(state_data.update_info.failure_category, FailureCategory::Module);
+	// The first failure is kept.
+	ctx.RecordFailure(
+		error::Error(make_error_condition(errc::timed_out), ""), FailureCategory::Script);
+	EXPECT_EQ(state_data.update_info.failure_category, FailureCategory::Module);
+
+	// Kept for the Failure status after the rollback reboot.
+	err = ctx.SaveDeploymentStateData(state_data);
+	ASSERT_EQ(err, error::NoError);
+	StateData loaded;
+	auto exp_loaded = ctx.LoadDeploymentStateData(loaded);
+	ASSERT_TRUE(exp_loaded) << exp_loaded.error().String();
+	ASSERT_TRUE(exp_loaded.value());
+	EXPECT_EQ(loaded.update_info.failure_category, FailureCategory::Module);
+
+	// A failure during the rollback doesn't replace a failure without a category either.
+	state_data.update_info.failure_category = FailureCategory::None;
+	ctx.deployment.failed = true;
+	ctx.RecordFailure(FailureCategory::Storage);
+	EXPECT_EQ(state_data.update_info.failure_category, FailureCategory::None);
+}
+
+TEST(PauseRecordTests, PausesAndResumes) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto pause_path = path::Join(tmpdir.Path(), kDeploymentPauseFile);
+	PauseRecord record {pause_path};
+
+	EXPECT_EQ(record.ToJson(), "null");
+	// Nothing to resume.
+	auto err = record.Resumed();
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_FALSE(path::FileExists(pause_path));
+
+	PauseRecord::Clock::time_point start {chrono::seconds {1000}};
+	err = record.Paused(
+		"id1", "ArtifactReboot", "Reboot grace period of 120 seconds", "RebootGraceSeconds", start);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	// Extending keeps the start of the pause.
+	err = record.Paused(
+		"id1",
+		"ArtifactReboot",
+		"Reboot grace period extended",
+		"my \"app\"",
+		start + chrono::seconds {60});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(
+		record.ToJson(),
+		R"({"deployment_id":"id1","state":"ArtifactReboot","reason":"Reboot grace period extended",)"
+		R"("source":"my \"app\"","paused":1000,"resumed":null})");
+
+	// Survives a restart.
+	PauseRecord restarted {pause_path};
+	err = restarted.Resumed(start + chrono::seconds {400});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	auto exp_pause = restarted.Load();
+	ASSERT_TRUE(exp_pause) << exp_pause.error().String();
+	ASSERT_TRUE(exp_pause.value());
+	auto pause = exp_pause.value().value();
+	EXPECT_EQ(pause.source, "my \"app\"");
+	EXPECT_EQ(pause.paused, 1000);
+	EXPECT_EQ(pause.resumed, 1400);
+
+	// Resuming again changes nothing, pausing again starts a new pause.
+	err = restarted.Resumed(start + chrono::seconds {500});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = restarted.Paused(
+		"id1", "ArtifactReboot", "Paused by hand", "debug console", start + chrono::seconds {600});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	exp_pause = restarted.Load();
+	ASSERT_TRUE(exp_pause) << exp_pause.error().String();
+	ASSERT_TRUE(exp_pause.value());
+	EXPECT_EQ(exp_pause.value().value().paused, 1600);
+	EXPECT_EQ(exp_pause.value().value().resumed, 0);
+}
+
+TEST(DeviceFreezeTests, FreezesAndReleases) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto freeze_path = path::Join(tmpdir.Path(), kDeviceFreezeFile);
+	DeviceFreeze freeze {freeze_path};
+
+	DeviceFreeze::Clock::time_point start {chrono::seconds {1000}};
+	EXPECT_FALSE(freeze.Frozen(start));
+	EXPECT_EQ(freeze.ToJson(start), "null");
+	// Nothing to release.
+	auto err = freeze.Release();
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	err = freeze.Freeze(nullopt, start);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_TRUE(freeze.Frozen(start + chrono::hours {24 * 365}));
+	EXPECT_EQ(freeze.ToJson(start), R"({"since":1000,"until":null})");
+
+	// Replaces the earlier one, and ends by itself.
+	err = freeze.Freeze(start + chrono::seconds {600}, start + chrono::seconds {100});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	DeviceFreeze restarted {freeze_path};
+	EXPECT_EQ(restarted.ToJson(start + chrono::seconds {200}), R"({"since":1100,"until":1600})");
+	auto exp_freeze = restarted.Current(start + chrono::seconds {200});
+	ASSERT_TRUE(exp_freeze) << exp_freeze.error().String();
+	ASSERT_TRUE(exp_freeze.value());
+	EXPECT_EQ(
+		DeviceFreeze::Reason(exp_freeze.value().value()),
+		"Frozen on the device until 1970-01-01T00:26:40Z");
+	EXPECT_TRUE(restarted.Frozen(start + chrono::seconds {599}));
+	EXPECT_FALSE(restarted.Frozen(start + chrono::seconds {600}));
+
+	// Not into the past.
+	err = freeze.Freeze(start, start + chrono::seconds {700});
+	EXPECT_EQ(err.code, make_error_condition(errc::invalid_argument));
+
+	err = freeze.Freeze(nullopt, start);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = freeze.Release();
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_FALSE(freeze.Frozen(start));
+	EXPECT_FALSE(path::FileExists(freeze_path));
+
+	// Frozen when in doubt.
+	{
+		ofstream f(freeze_path);
+		f << "{";
+	}
+	EXPECT_TRUE(freeze.Frozen(start));
+
+	auto exp_until = ParseFreezeUntil("2026-11-01T00:00:00Z");
+	ASSERT_TRUE(exp_until) << exp_until.error().String();
+	ASSERT_TRUE(exp_until.value());
+	EXPECT_EQ(chrono::system_clock::to_time_t(exp_until.value().value()), 1793491200);
+	exp_until = ParseFreezeUntil("");
+	ASSERT_TRUE(exp_until) << exp_until.error().String();
+	EXPECT_FALSE(exp_until.value());
+	EXPECT_FALSE(ParseFreezeUntil("next week"));
+}
+
+TEST(ArtifactTwinTests, TracksDesiredArtifact) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto desired_path = path::Join(tmpdir.Path(), kDesiredArtifactFile);
+	ArtifactTwin twin {desired_path};
+
+	// Nothing desired before the first deployment, so no drift either.
+	EXPECT_EQ(twin.ToJson("release-1"), R"({"desired":null,"actual":"release-1","drift":false})");
+
+	auto err = twin.SetDesired("deployment-1", "release-2", ArtifactTwin::Clock::time_point {});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(
+		twin.ToJson("release-1"),
+		R"({"desired":{"artifact_name":"release-2","deployment_id":"deployment-1","since":0},)"
+		R"("actual":"release-1","drift":true})");
+
+	err = twin.SetDesired(
+		"deployment-2", "release-3", ArtifactTwin::Clock::time_point {chrono::seconds {1000}});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	ArtifactTwin restarted {desired_path};
+	auto exp_desired = restarted.Desired();
+	ASSERT_TRUE(exp_desired) << exp_desired.error().String();
+	ASSERT_TRUE(exp_desired.value());
+	EXPECT_EQ(exp_desired.value()->artifact_name, "release-3");
+	EXPECT_EQ(exp_desired.value()->deployment_id, "deployment-2");
+	EXPECT_EQ(exp_desired.value()->since, 1000);
+	EXPECT_FALSE(ArtifactTwin::Drift(exp_desired.value(), "release-3"));
+	EXPECT_TRUE(ArtifactTwin::Drift(exp_desired.value(), "release-2"));
+
+	{
+		ofstream f(desired_path);
+		f << R"({"artifact_name":"release-3"})";
+	}
+	EXPECT_FALSE(restarted.Desired());
+}
+
+TEST(MetricsTests, RendersOpenMetrics) {
+	Metrics metrics;
+	metrics.StateEntered("IdleState");
+	metrics.UpdateChecked(Metrics::Clock::time_point {chrono::seconds {1000}});
+	metrics.DeploymentStarted();
+	metrics.DeploymentFinished(false);
+	metrics.DeploymentStarted();
+	metrics.DeploymentFinished(true);
+	metrics.AuthenticationFailed();
+	metrics.StateScriptsRan("Download_Enter", chrono::milliseconds {1500});
+	metrics.StateScriptsRan("Download_Enter", chrono::milliseconds {25});
+
+	metrics.DownloadStarted();
+	metrics.DownloadProgress(1000, chrono::seconds {2});
+	metrics.DownloadProgress(3000, chrono::seconds {3});
+	// Finishing twice, as a download cancelled after its failure is, counts the bytes once.
+	metrics.DownloadFinished(3500);
+	metrics.DownloadFinished(3500);
+	metrics.DownloadStarted();
+	metrics.DownloadProgress(400, chrono::seconds {1});
+
+	EXPECT_EQ(
+		metrics.Render(),
+		R"(# HELP mender_deployments_attempted Deployments started.
+# TYPE mender_deployments_attempted counter
+mender_deployments_attempted_total 2
+# HELP mender_deployments_succeeded Deployments which succeeded.
+# TYPE mender_deployments_succeeded counter
+mender_deployments_succeeded_total 1
+# HELP mender_deployments_failed Deployments which failed.
+# TYPE mender_deployments_failed counter
+mender_deployments_failed_total 1
+# HELP mender_state The current state of the daemon.
+# TYPE mender_state info
+mender_state_info{state="IdleState"} 1
+# HELP mender_update_check_last_success_timestamp_seconds When the server was last checked for a deployment.
+# TYPE mender_update_check_last_success_timestamp_seconds gauge
+mender_update_check_last_success_timestamp_seconds 1000
+# HELP mender_inventory_submission_last_success_timestamp_seconds When the inventory was last submitted.
+# TYPE mender_inventory_submission_last_success_timestamp_seconds gauge
+# HELP mender_download_bytes Bytes of Artifacts downloaded.
+# TYPE mender_download_bytes counter
+mender_download_bytes_total 3900
+# HELP mender_download_rate_bytes_per_second Average rate of the ongoing Artifact download, 0 when there is none.
+# TYPE mender_download_rate_bytes_per_second gauge
+mender_download_rate_bytes_per_second 400
+# HELP mender_authentication_failures Failed attempts to authenticate.
+# TYPE mender_authentication_failures counter
+mender_authentication_failures_total 1
+# HELP mender_state_script_duration_seconds How long the State Scripts of each state and action took.
+# TYPE mender_state_script_duration_seconds summary
+mender_state_script_duration_seconds_sum{scripts="Download_Enter"} 1.525
+mender_state_script_duration_seconds_count{scripts="Download_Enter"} 2
+# EOF
+)");
+
+	events::EventLoop loop;
+	MetricsServer server {loop, [&metrics]() { return metrics.Render(); }};
+	auto response = server.HandleRequest("GET", "/metrics");
+	EXPECT_EQ(response.status, 200);
+	EXPECT_EQ(response.content_type, "application/openmetrics-text; version=1.0.0; charset=utf-8");
+	EXPECT_EQ(response.body, metrics.Render());
+	EXPECT_EQ(server.HandleRequest("GET", "/metrics?format=openmetrics").status, 200);
+	EXPECT_EQ(server.HandleRequest("POST", "/metrics").status, 405);
+	EXPECT_EQ(server.HandleRequest("GET", "/").status, 404);
+}
+
+// Answers at once, with the responses given in `responses`, and no error once they run out.
+class RecordingDeploymentClient : public NoopDeploymentClient {
+public:
+	error::Error PushStatus(
+		const string &deployment_id,
+		deployments::DeploymentStatus status,
+		const string &substate,
+		const optional<deployments::DownloadProgress> &progress,
+		api::Client &client,
+		deployments::StatusAPIResponseHandler api_handler) override {
+		calls.push_back(deployment_id + " " + deployments::DeploymentStatusString(status));
+		api_handler(NextResponse());
+		return error::NoError;
+	}
+
+	error::Error PushLogs(
+		const string &deployment_id,
+		const string &log_file_path,
+		api::Client &client,
+		deployments::LogsAPIResponseHandler api_handler) override {
+		EXPECT_TRUE(mtesting::FileContainsExactly(log_file_path, "install failed\n"));
+		calls.push_back(deployment_id + " logs");
+		api_handler(NextResponse());
+		return error::NoError;
+	}
+
+	vector<string> calls;
+	vector<deployments::APIResponseError> responses;
+
+private:
+	deployments::APIResponseError NextResponse() {
+		if (responses.empty()) {
+			return {nullopt, nullopt, error::NoError};
+		}
+		auto response = responses.front();
+		responses.erase(responses.begin());
+		return response;
+	}
+};
+
+TEST(OutboundQueueTests, FlushesInOrderAcrossRestarts) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto queue_dir = path::Join(tmpdir.Path(), kOutboundQueueDir);
+	const auto log_file = path::Join(tmpdir.Path(), "deployments.0001.id1.log");
+	{
+		ofstream f(log_file);
+		f << "install failed\n";
+	}
+
+	{
+		OutboundQueue queue {queue_dir};
+		EXPECT_TRUE(queue.Empty());
+		auto err = queue.Add("id1", deployments::DeploymentStatus::Failure, "", false, log_file);
+		ASSERT_EQ(err, error::NoError) << err.String();
+		err = queue.Add("id2", deployments::DeploymentStatus::Success, "substate", false, "");
+		ASSERT_EQ(err, error::NoError) << err.String();
+		err = queue.Add("id3", deployments::DeploymentStatus::Failure, "", true, log_file);
+		ASSERT_EQ(err, error::NoError) << err.String();
+	}
+	// The logs are a copy, the original can go away.
+	ASSERT_EQ(path::FileDelete(log_file), error::NoError);
+
+	OutboundQueue queue {queue_dir};
+	ASSERT_FALSE(queue.Empty());
+	NoCallClient client;
+	RecordingDeploymentClient deployment_client;
+
+	// The logs of the first one don't get through: it stays, but its status isn't sent again.
+	deployment_client.responses.push_back({nullopt, nullopt, error::NoError});
+	deployment_client.responses.push_back(
+		{nullopt,
+		 nullopt,
+		 error::Error(make_error_condition(errc::host_unreachable), "No connection")});
+	error::Error flush_err;
+	queue.AsyncFlush(deployment_client, client, [&](error::Error err) { flush_err = err; });
+	EXPECT_EQ(flush_err.code, make_error_condition(errc::host_unreachable));
+	EXPECT_EQ(deployment_client.calls, (vector<string> {"id1 failure", "id1 logs"}));
+
+	auto exp_entries = queue.Load();
+	ASSERT_TRUE(exp_entries) << exp_entries.error().String();
+	ASSERT_EQ(exp_entries.value().size(), 3);
+	EXPECT_TRUE(exp_entries.value()[0].status_sent);
+
+	// The server refuses the second one for good, since the deployment was aborted meanwhile.
+	deployment_client.calls.clear();
+	deployment_client.responses.push_back({nullopt, nullopt, error::NoError});
+	deployment_client.responses.push_back(
+		{http::StatusConflict,
+		 nullopt,
+		 deployments::MakeError(deployments::DeploymentAbortedError, "Aborted")});
+	queue.AsyncFlush(deployment_client, client, [&](error::Error err) { flush_err = err; });
+	EXPECT_EQ(flush_err, error::NoError) << flush_err.String();
+	EXPECT_EQ(deployment_client.calls, (vector<string> {"id1 logs", "id2 success", "id3 logs"}));
+	EXPECT_TRUE(queue.Empty());
+	EXPECT_EQ(path::ListFiles(queue_dir, [](const string &) { return true; }).value().size(), 1);
+}
+
+TEST(OutboundQueueTests, KeepsTheLatestEntries) {
+	mtesting::TemporaryDirectory tmpdir;
+	OutboundQueue queue {path::Join(tmpdir.Path(), kOutboundQueueDir)};
+	for (size_t i = 0; i < OutboundQueue::kMaxEntries + 2; i++) {
+		auto err = queue.Add(
+			"id" + to_string(i), deployments::DeploymentStatus::Success, "", false, "");
+		ASSERT_EQ(err, error::NoError) << err.String();
+	}
+
+	auto exp_entries = queue.Load();
+	ASSERT_TRUE(exp_entries) << exp_entries.error().String();
+	ASSERT_EQ(exp_entries.value().size(), OutboundQueue::kMaxEntries);
+	EXPECT_EQ(exp_entries.value().front().deployment_id, "id2");
+	EXPECT_EQ(exp_entries.value().front().sequence, 3);
+}
+
+TEST(HeaderCacheTests, StoresLatestHeaders) {
+	auto header_named = [](const string &name) {
+		auto exp_header = artifact::HeaderViewFromJson(R"({
+  "header-info": {
+    "payloads": [{"type": "rootfs-image"}],
+    "artifact_provides": {"artifact_name": ")" + name + R"("},
+    "artifact_depends": {"device_type": ["test-device"]}
+  },
+  "type-info": {"type": "rootfs-image", "artifact_provides": {"rootfs-image.version": "1"}},
+  "meta-data": {"not-before": "2026-11-01T00:00:00Z"}
+})");
+		EXPECT_TRUE(exp_header) << exp_header.error().String();
+		return exp_header.value();
+	};
+
+	mtesting::TemporaryDirectory tmpdir;
+	const auto cache_path = path::Join(tmpdir.Path(), kArtifactHeaderCacheFile);
+	HeaderCache cache {cache_path, 2};
+
+	auto exp_cached = cache.Find("artifact1");
+	ASSERT_TRUE(exp_cached) << exp_cached.error().String();
+	EXPECT_FALSE(exp_cached.value());
+
+	HeaderCache::Clock::time_point now {chrono::seconds {1000}};
+	auto err = cache.Store(header_named("artifact1"), "checksum1", now);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = cache.Store(header_named("artifact2"), "checksum2", now);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	// Storing it again makes it the latest one, so that artifact2 is dropped below.
+	err = cache.Store(header_named("artifact1"), "checksum3", now + chrono::seconds {10});
+	ASSERT_EQ(err, error::NoError) << err.String();
+	err = cache.Store(header_named("artifact3"), "checksum4", now);
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	// Survives a restart.
+	HeaderCache restarted {cache_path, 2};
+	auto exp_headers = restarted.Load();
+	ASSERT_TRUE(exp_headers) << exp_headers.error().String();
+	ASSERT_EQ(exp_headers.value().size(), 2);
+	EXPECT_EQ(exp_headers.value()[0].artifact_name, "artifact1");
+	EXPECT_EQ(exp_headers.value()[1].artifact_name, "artifact3");
+
+	exp_cached = restarted.Find("artifact1");
+	ASSERT_TRUE(exp_cached) << exp_cached.error().String();
+	ASSERT_TRUE(exp_cached.value());
+	auto &cached = exp_cached.value().value();
+	EXPECT_EQ(cached.checksum, "checksum3");
+	EXPECT_EQ(cached.cached, 1010);
+
+	// The header comes back as it was.
+	auto exp_header = artifact::HeaderViewFromJson(cached.header_json);
+	ASSERT_TRUE(exp_header) << exp_header.error().String();
+	EXPECT_EQ(exp_header.value().artifact_name, "artifact1");
+	EXPECT_EQ(exp_header.value().header_info.depends.device_type, vector<string> {"test-device"});
+	EXPECT_EQ(exp_header.value().GetProvides()["rootfs-image.version"], "1");
+	EXPECT_EQ(
+		exp_header.value().meta_data.Get("not-before").value().GetString().value(),
+		"2026-11-01T00:00:00Z");
+	auto cached_json = HeaderCache::ToJson(cached);
+	EXPECT_EQ(
+		cached_json.rfind(
+			R"({"artifact_name":"artifact1","checksum":"checksum3","cached":1010,"header":{)", 0),
+		0)
+		<< cached_json;
+
+	exp_cached = restarted.Find("artifact2");
+	ASSERT_TRUE(exp_cached) << exp_cached.error().String();
+	EXPECT_FALSE(exp_cached.value());
+
+	err = restarted.Remove("artifact1");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	exp_headers = restarted.Load();
+	ASSERT_TRUE(exp_headers) << exp_headers.error().String();
+	ASSERT_EQ(exp_headers.value().size(), 1);
+	EXPECT_EQ(exp_headers.value()[0].artifact_name, "artifact3");
+
+	// Nothing is cached with a size of 0.
+	const auto disabled_path = path::Join(tmpdir.Path(), "disabled");
+	HeaderCache disabled {disabled_path, 0};
+	err = disabled.Store(header_named("artifact1"), "checksum1", now);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_FALSE(path::FileExists(disabled_path));
+}
+
+TEST(ArtifactInspectionTests, DescribesArtifact) {
+	mtesting::TemporaryDirectory tmpdir;
+	const auto payload = path::Join(tmpdir.Path(), "payload");
+	{
+		ofstream f {payload};
+		f << "abc\n";
+		ASSERT_TRUE(f);
+	}
+	const auto script = path::Join(tmpdir.Path(), "ArtifactInstall_Enter_01_test");
+	{
+		ofstream f {script};
+		f << "#!/bin/sh\nexit 0\n";
+		ASSERT_TRUE(f);
+	}
+	const auto artifact_path = path::Join(tmpdir.Path(), "artifact.mender");
+	processes::Process proc({
+		"mender-artifact",
+		"write",
+		"module-image",
+		"--type",
+		"test-module",
+		"--compatible-types",
+		"test-type",
+		"--artifact-name",
+		"inspected",
+		"--provides",
+		"rootfs-image.test.version:2",
+		"--depends",
+		"rootfs-image.test.version:1",
+		"--file",
+		payload,
+		"--script",
+		script,
+		"--output-path",
+		artifact_path,
+	});
+	auto err = proc.Run();
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	const auto scripts_path = path::Join(tmpdir.Path(), "inspected-scripts");
+	auto exp_result = InspectArtifact(artifact_path, scripts_path);
+	ASSERT_TRUE(exp_result) << exp_result.error().String();
+	EXPECT_FALSE(path::FileExists(scripts_path));
+
+	auto exp_json = json::Load(exp_result.value());
+	ASSERT_TRUE(exp_json) << exp_json.error().String() << ": " << exp_result.value();
+	const auto &result = exp_json.value();
+	EXPECT_EQ(result.Get("artifact_name").and_then(json::ToString).value(), "inspected");
+	EXPECT_EQ(result.Get("payload_type").and_then(json::ToString).value(), "test-module");
+	EXPECT_FALSE(result.Get("signed").and_then(json::ToBool).value());
+	auto provides = result.Get("provides").value();
+	EXPECT_EQ(provides.Get("rootfs-image.test.version").and_then(json::ToString).value(), "2");
+	auto depends = result.Get("depends").value();
+	EXPECT_THAT(
+		depends.Get("device_type").and_then(json::ToStringVector).value(),
+		testing::ElementsAre("test-type"));
+	EXPECT_THAT(
+		depends.Get("rootfs-image.test.version").and_then(json::ToStringVector).value(),
+		testing::ElementsAre("1"));
+	EXPECT_THAT(
+		result.Get("scripts").and_then(json::ToStringVector).value(),
+		testing::ElementsAre("ArtifactInstall_Enter_01_test"));
+
+	auto exp_files = result.Get("files");
+	ASSERT_TRUE(exp_files) << exp_files.error().String();
+	ASSERT_EQ(exp_files.value().GetArraySize().value(), 1);
+	auto file = exp_files.value().Get(size_t {0}).value();
+	EXPECT_EQ(file.Get("name").and_then(json::ToString).value(), "payload");
+	EXPECT_EQ(file.Get("size").and_then(json::ToInt64).value(), 4);
+
+	// The header can be given to EvaluateArtifactCompatibility as it is.
+	auto exp_header = artifact::HeaderViewFromJson(result.Get("header").value().Dump());
+	ASSERT_TRUE(exp_header) << exp_header.error().String();
+	EXPECT_EQ(exp_header.value().artifact_name, "inspected");
+
+	EXPECT_FALSE(InspectArtifact("artifact.mender", scripts_path));
+	EXPECT_FALSE(InspectArtifact(path::Join(tmpdir.Path(), "missing.mender"), scripts_path));
+}
+
+TEST(DeviceConfigTests, AppliesAndRollsBack) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const string dir = path::Join(tmpdir.Path(), "apply-device-config.d");
+	fs::create_directory(dir);
+	const string applied_log = path::Join(tmpdir.Path(), "applied");
+
+	auto make_script = [](const string &path, const string &content) {
+		ofstream f(path);
+		f << "#!/bin/sh\n" << content;
+		f.close();
+		fs::permissions(path, fs::perms::owner_all);
+	};
+	make_script(
+		path::Join(dir, "10-record"),
+		"cat \"$1\" >> " + applied_log + "\necho >> " + applied_log + "\n");
+	make_script(path::Join(dir, "20-check"), "! grep -q bad \"$1\"\n");
+
+	cfg_parser::DeviceConfiguration config;
+	config.enabled = true;
+	config.apply_scripts_dir = dir;
+	NoCallClient client;
+	DeviceConfig device_config {loop, client, config, tmpdir.Path()};
+	EXPECT_EQ(device_config.CurrentJson(), "{}");
+
+	vector<string> emitted;
+	device_config.SetEmitFunction([&emitted](const string &configuration) {
+		emitted.push_back(configuration);
+		return error::NoError;
+	});
+
+	auto apply = [&](const string &configuration) {
+		error::Error result;
+		device_config.AsyncApply(configuration, [&](error::Error err) {
+			result = err;
+			loop.Stop();
+		});
+		loop.Run();
+		return result;
+	};
+
+	auto err = apply(R"({"timezone":"Europe/Oslo"})");
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(device_config.CurrentJson(), R"({"timezone":"Europe/Oslo"})");
+	EXPECT_THAT(emitted, testing::ElementsAre(R"({"timezone":"Europe/Oslo"})"));
+
+	// The first scripts have run with the failed configuration, so they all run again with the
+	// previous one.
+	err = apply(R"({"timezone":"bad"})");
+	ASSERT_NE(err, error::NoError);
+	EXPECT_THAT(err.String(), testing::HasSubstr("20-check failed"));
+	EXPECT_EQ(device_config.CurrentJson(), R"({"timezone":"Europe/Oslo"})");
+	EXPECT_EQ(emitted.size(), 1);
+	EXPECT_FALSE(path::FileExists(path::Join(tmpdir.Path(), kDeviceConfigFile + ".new")));
+
+	ifstream f(applied_log);
+	vector<string> applied;
+	string line;
+	while (getline(f, line)) {
+		applied.push_back(line);
+	}
+	EXPECT_THAT(
+		applied,
+		testing::ElementsAre(
+			R"({"timezone":"Europe/Oslo"})",
+			R"({"timezone":"bad"})",
+			R"({"timezone":"Europe/Oslo"})"));
+
+	// The applied configuration is kept across restarts.
+	DeviceConfig restarted {loop, client, config, tmpdir.Path()};
+	EXPECT_EQ(restarted.CurrentJson(), R"({"timezone":"Europe/Oslo"})");
+}
+
+TEST(SelfTestTests, RunsAfterUpgrade) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	const string dir = path::Join(tmpdir.Path(), "self-test");
+	fs::create_directory(dir);
+	const string record_path = path::Join(tmpdir.Path(), kSelfTestFile);
+	SelfTest self_test {loop, {}, dir, record_path};
+
+	// The very first start has nothing to compare with.
+	EXPECT_FALSE(self_test.Due("4.0.0"));
+	EXPECT_FALSE(self_test.Due("4.0.0"));
+	EXPECT_TRUE(self_test.Due("4.1.0"));
+
+	bool store_ok {false};
+	self_test.AddCheck("database", [&store_ok](function<void(error::Error)> done) {
+		if (store_ok) {
+			done(error::NoError);
+		} else {
+			done(error::Error(make_error_condition(errc::io_error), "Corrupt store"));
+		}
+	});
+	const string script = path::Join(dir, "10-bootenv");
+	{
+		ofstream f(script);
+		f << "#!/bin/sh\necho 'Cannot read the boot environment'\nexit 1\n";
+	}
+	fs::permissions(script, fs::perms::owner_all);
+
+	vector<string> result;
+	self_test.AsyncRun("4.1.0", [&](const vector<string> &failures) {
+		result = failures;
+		loop.Stop();
+	});
+	loop.Run();
+
+	ASSERT_EQ(result.size(), 2);
+	EXPECT_THAT(result[0], testing::HasSubstr("database: "));
+	EXPECT_THAT(result[0], testing::HasSubstr("Corrupt store"));
+	EXPECT_EQ(result[1], "10-bootenv: Cannot read the boot environment");
+	EXPECT_TRUE(self_test.Failed());
+	EXPECT_TRUE(self_test.Due("4.1.0"));
+
+	string record;
+	{
+		ifstream f(record_path);
+		getline(f, record);
+	}
+	EXPECT_THAT(record, testing::HasSubstr(R"("version":"4.1.0","passed":false,"failures":[)"));
+
+	store_ok = true;
+	fs::remove(script);
+	self_test.AsyncRun("4.1.0", [&](const vector<string> &failures) {
+		result = failures;
+		loop.Stop();
+	});
+	loop.Run();
+
+	EXPECT_TRUE(result.empty());
+	EXPECT_FALSE(self_test.Failed());
+	EXPECT_FALSE(self_test.Due("4.1.0"));
+}
+
+TEST(StandaloneUpdateTests, ReportsAndRefuses) {
+	mtesting::TestEventLoop loop;
+	mtesting::TemporaryDirectory tmpdir;
+	conf::MenderConfig config {};
+	config.paths.SetDataStore(tmpdir.Path());
+	context::MenderContext main_context {config};
+	auto err = main_context.Initialize();
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	StandaloneUpdate update {loop, main_context};
+	vector<string> finished;
+	update.SetEmitFunctions(
+		[](const string &, const string &) { return error::NoError; },
+		[&finished](const string &operation, const string &result) {
+			finished.push_back(operation + " " + result);
+			return error::NoError;
+		});
+
+	EXPECT_FALSE(update.Busy());
+	auto exp_reply = update.Start(
+		StandaloneUpdate::Operation::Commit, "", [&loop](const standalone::ResultAndError &) {
+			loop.Stop();
+		});
+	ASSERT_TRUE(exp_reply) << exp_reply.error().String();
+	EXPECT_EQ(exp_reply.value(), StandaloneUpdate::kReplyStarted);
+	EXPECT_TRUE(update.Running());
+	EXPECT_FALSE(update.Start(StandaloneUpdate::Operation::Rollback, ""));
+	loop.Run();
+
+	EXPECT_FALSE(update.Running());
+	ASSERT_EQ(finished.size(), 1);
+	EXPECT_THAT(finished[0], testing::StartsWith(R"(commit {"result":["NoUpdateInProgress"],)"));
+	EXPECT_THAT(finished[0], testing::HasSubstr("Cannot commit"));
+
+	// An installation which waits for its commit holds back the deployments and the other
+	// installations.
+	standalone::StateData data;
+	data.version = context::MenderContext::standalone_data_version;
+	data.artifact_name = "pending";
+	data.payload_types = {"rootfs-image"};
+	data.in_state = standalone::StateData::kBeforeStateArtifactCommit_Enter;
+	err = standalone::SaveStateData(main_context.GetMenderStoreDB(), data);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_TRUE(update.Busy());
+	exp_reply = update.Start(StandaloneUpdate::Operation::Install, "/data/release-2.mender");
+	ASSERT_FALSE(exp_reply);
+	EXPECT_THAT(exp_reply.error().String(), testing::HasSubstr("'pending'"));
+
+	EXPECT_EQ(
+		StandaloneUpdate::ResultJson(
+			{standalone::Result::Installed | standalone::Result::RebootRequired, error::NoError}),
+		R"({"result":["Installed","RebootRequired"],"error":null})");
+}
+
+static string MsgPackString(const string &str) {
+	return static_cast<char>(0xa0 + str.size()) + str;
+}
+
+TEST(PushChannelTests, ParsesHeaders) {
+	// {"body":<bin "hi">,"hdr":{"proto":4,"typ":"check-update","sid":"abc","props":{"x":[1,2]}}}
+	string message = "\x82" + MsgPackString("body") + string {"\xc4\x02hi"} + MsgPackString("hdr")
+					 + "\x84" + MsgPackString("proto") + "\x04" + MsgPackString("typ")
+					 + MsgPackString("check-update") + MsgPackString("sid") + MsgPackString("abc")
+					 + MsgPackString("props") + "\x81" + MsgPackString("x") + "\x92\x01\x02";
+	auto exp_header = PushChannel::ParseHeader(message);
+	ASSERT_TRUE(exp_header) << exp_header.error().String();
+	EXPECT_EQ(exp_header.value().proto, PushChannel::kProtoMenderClient);
+	EXPECT_EQ(exp_header.value().type, PushChannel::kCheckUpdate);
+
+	// The protocol as a uint16.
+	message = "\x81" + MsgPackString("hdr") + "\x82" + MsgPackString("proto")
+			  + string {"\xcd\x00\x01", 3} + MsgPackString("typ") + MsgPackString("shell");
+	exp_header = PushChannel::ParseHeader(message);
+	ASSERT_TRUE(exp_header) << exp_header.error().String();
+	EXPECT_EQ(exp_header.value().proto, 1);
+	EXPECT_EQ(exp_header.value().type, "shell");
+
+	// No header.
+	EXPECT_FALSE(PushChannel::ParseHeader("\x80"));
+	// Not a map.
+	EXPECT_FALSE(PushChannel::ParseHeader(MsgPackString("hdr")));
+	// Truncated.
+	EXPECT_FALSE(PushChannel::ParseHeader("\x81" + MsgPackString("hdr") + "\x81\xa5pro"));
+	// Unknown type.
+	EXPECT_FALSE(PushChannel::ParseHeader("\x81" + MsgPackString("body") + "\xc1"));
+}
 
 } // namespace daemon
 } // namespace update
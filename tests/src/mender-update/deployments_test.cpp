@@ -23,6 +23,7 @@
 #include <common/common.hpp>
 #include <client_shared/conf.hpp>
 #include <common/events.hpp>
+#include <common/gzip.hpp>
 #include <common/http.hpp>
 #include <common/io.hpp>
 #include <common/json.hpp>
@@ -37,6 +38,7 @@ using mender::nullopt;
 using mender::optional;
 
 namespace api = mender::api;
+namespace cfg_parser = mender::client_shared::config_parser;
 namespace common = mender::common;
 namespace conf = mender::client_shared::conf;
 namespace context = mender::update::context;
@@ -44,6 +46,7 @@ namespace deps = mender::update::deployments;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace expected = mender::common::expected;
+namespace gzip = mender::common::gzip;
 namespace http = mender::common::http;
 namespace io = mender::common::io;
 namespace json = mender::common::json;
@@ -592,6 +595,97 @@ TEST_F(DeploymentsTests, TestV1APIFallbackWithNoNextDeployment) {
 	EXPECT_TRUE(handler_called);
 }
 
+TEST_F(DeploymentsTests, TestV1APIFallbackIsCached) {
+	conf::MenderConfig cfg;
+	cfg.paths.SetDataStore(test_state_dir.Path());
+
+	context::MenderContext ctx(cfg);
+	auto err = ctx.Initialize();
+	ASSERT_EQ(err, error::NoError);
+
+	auto &db = ctx.GetMenderStoreDB();
+	err = db.Write("artifact-name", common::ByteVectorFromString("artifact-name value"));
+	ASSERT_EQ(err, error::NoError);
+
+	ofstream os(cfg.paths.GetDataStore() + "/device_type");
+	ASSERT_TRUE(os);
+	os << "device_type=Some device type" << endl;
+	os.close();
+
+	TestEventLoop loop(chrono::seconds(3600));
+
+	http::ServerConfig server_config;
+	http::Server server(server_config, loop);
+
+	http::ClientConfig client_config;
+	NoAuthHTTPClient client {client_config, loop};
+
+	vector<string> requested_paths;
+	server.AsyncServeUrl(
+		TEST_SERVER,
+		[](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			exp_req.value()->SetBodyWriter(make_shared<io::Discard>());
+		},
+		[&requested_paths](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+			auto path = req->GetPath();
+			requested_paths.push_back(path.substr(0, path.find('?')));
+
+			auto result = req->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetHeader("Content-Length", "0");
+			resp->SetBodyReader(make_shared<io::StringReader>(""));
+			if (req->GetMethod() == http::Method::POST) {
+				resp->SetStatusCodeAndMessage(http::StatusNotFound, "Not found");
+			} else {
+				resp->SetStatusCodeAndMessage(http::StatusNoContent, "No content");
+			}
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	const string v1_path = "/api/devices/v1/deployments/device/deployments/next";
+	const string v2_path = "/api/devices/v2/deployments/device/deployments/next";
+
+	deps::DeploymentClient deployment_client;
+	int handler_calls = 0;
+	auto handler = [&handler_calls, &loop](deps::CheckUpdatesAPIResponse resp) {
+		handler_calls++;
+		ASSERT_TRUE(resp);
+		EXPECT_EQ(resp.value(), nullopt);
+		loop.Stop();
+	};
+
+	err = deployment_client.CheckNewDeployments(ctx, client, handler);
+	ASSERT_EQ(err, error::NoError);
+	loop.Run();
+	EXPECT_EQ(requested_paths, (vector<string> {v2_path, v1_path}));
+
+	// The server is known not to support v2 now, so it should go straight to v1.
+	requested_paths.clear();
+	err = deployment_client.CheckNewDeployments(ctx, client, handler);
+	ASSERT_EQ(err, error::NoError);
+	loop.Run();
+	EXPECT_EQ(requested_paths, (vector<string> {v1_path}));
+
+	// Until it is time to check whether the server has been upgraded.
+	for (int i = 2; i < deps::DeploymentClient::kV2ReprobeInterval; i++) {
+		err = deployment_client.CheckNewDeployments(ctx, client, handler);
+		ASSERT_EQ(err, error::NoError);
+		loop.Run();
+	}
+	requested_paths.clear();
+	err = deployment_client.CheckNewDeployments(ctx, client, handler);
+	ASSERT_EQ(err, error::NoError);
+	loop.Run();
+	EXPECT_EQ(requested_paths, (vector<string> {v2_path, v1_path}));
+
+	EXPECT_EQ(handler_calls, deps::DeploymentClient::kV2ReprobeInterval + 1);
+}
+
 TEST_F(DeploymentsTests, TestV1APIFallbackWithError) {
 	conf::MenderConfig cfg;
 	cfg.paths.SetDataStore(test_state_dir.Path());
@@ -761,6 +855,7 @@ TEST_F(DeploymentsTests, PushStatusTest) {
 		deployment_id,
 		status,
 		substatus,
+		nullopt,
 		client,
 		[&handler_called, &loop](deps::StatusAPIResponse resp) {
 			handler_called = true;
@@ -832,6 +927,83 @@ TEST_F(DeploymentsTests, PushStatusNoSubstatusTest) {
 		deployment_id,
 		status,
 		substatus,
+		nullopt,
+		client,
+		[&handler_called, &loop](deps::StatusAPIResponse resp) {
+			handler_called = true;
+			EXPECT_EQ(resp.error, error::NoError);
+			loop.Stop();
+		});
+	EXPECT_EQ(err, error::NoError);
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+}
+
+TEST_F(DeploymentsTests, PushStatusDownloadProgressTest) {
+	TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::Server server(server_config, loop);
+
+	http::ClientConfig client_config;
+	NoAuthHTTPClient client {client_config, loop};
+
+	auto status {deps::DeploymentStatus::Downloading};
+	string deployment_id = "2";
+	string substatus = "Downloaded 50% (1000 of 2000 bytes), 10 s left";
+	auto progress = deps::MakeDownloadProgress(1000, 2000, chrono::seconds {10});
+	string expected_request_data =
+		R"({"status":"downloading","substate":")" + substatus
+		+ R"(","download_progress":{"bytes_downloaded":1000,"bytes_total":2000,)"
+		+ R"("percentage":50,"eta_seconds":10}})";
+
+	const string response_data = "";
+
+	vector<uint8_t> received_body;
+	server.AsyncServeUrl(
+		TEST_SERVER,
+		[&received_body, &expected_request_data](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+
+			auto content_length = req->GetHeader("Content-Length");
+			ASSERT_TRUE(content_length);
+			EXPECT_EQ(content_length.value(), to_string(expected_request_data.size()));
+			auto ex_len = common::StringToLongLong(content_length.value());
+			ASSERT_TRUE(ex_len);
+
+			auto body_writer = make_shared<io::ByteWriter>(received_body);
+			received_body.resize(ex_len.value());
+			req->SetBodyWriter(body_writer);
+		},
+		[&received_body, &expected_request_data, &response_data, deployment_id](
+			http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+
+			auto req = exp_req.value();
+			EXPECT_EQ(
+				req->GetPath(),
+				"/api/devices/v1/deployments/device/deployments/" + deployment_id + "/status");
+			EXPECT_EQ(req->GetMethod(), http::Method::PUT);
+			EXPECT_EQ(common::StringFromByteVector(received_body), expected_request_data);
+
+			auto result = req->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetHeader("Content-Length", to_string(response_data.size()));
+			resp->SetBodyReader(make_shared<io::StringReader>(response_data));
+			resp->SetStatusCodeAndMessage(204, "No content");
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	bool handler_called = false;
+	auto err = deps::DeploymentClient().PushStatus(
+		deployment_id,
+		status,
+		substatus,
+		progress,
 		client,
 		[&handler_called, &loop](deps::StatusAPIResponse resp) {
 			handler_called = true;
@@ -844,6 +1016,35 @@ TEST_F(DeploymentsTests, PushStatusNoSubstatusTest) {
 	EXPECT_TRUE(handler_called);
 }
 
+TEST(DownloadProgressTests, MakeDownloadProgress) {
+	auto progress = deps::MakeDownloadProgress(1000, 4000, chrono::seconds {10});
+	EXPECT_EQ(progress.bytes_downloaded, 1000);
+	EXPECT_EQ(progress.bytes_total.value(), 4000);
+	EXPECT_EQ(progress.percentage.value(), 25);
+	EXPECT_EQ(progress.eta_seconds.value(), 30);
+	EXPECT_EQ(
+		deps::DownloadProgressJson(progress),
+		R"({"bytes_downloaded":1000,"bytes_total":4000,"percentage":25,"eta_seconds":30})");
+	EXPECT_EQ(deps::DownloadProgressString(progress), "25% (1000 of 4000 bytes), 30 s left");
+
+	// Nothing to estimate the time left from yet.
+	progress = deps::MakeDownloadProgress(0, 4000, chrono::seconds {0});
+	EXPECT_EQ(progress.percentage.value(), 0);
+	EXPECT_FALSE(progress.eta_seconds);
+	EXPECT_EQ(
+		deps::DownloadProgressJson(progress),
+		R"({"bytes_downloaded":0,"bytes_total":4000,"percentage":0})");
+	EXPECT_EQ(deps::DownloadProgressString(progress), "0% (0 of 4000 bytes)");
+
+	// The server didn't tell the size.
+	progress = deps::MakeDownloadProgress(1000, nullopt, chrono::seconds {10});
+	EXPECT_FALSE(progress.bytes_total);
+	EXPECT_FALSE(progress.percentage);
+	EXPECT_FALSE(progress.eta_seconds);
+	EXPECT_EQ(deps::DownloadProgressJson(progress), R"({"bytes_downloaded":1000})");
+	EXPECT_EQ(deps::DownloadProgressString(progress), "1000 bytes");
+}
+
 TEST_F(DeploymentsTests, PushStatusFailureTest) {
 	TestEventLoop loop;
 
@@ -916,6 +1117,7 @@ TEST_F(DeploymentsTests, PushStatusFailureTest) {
 		deployment_id,
 		status,
 		substatus,
+		nullopt,
 		client,
 		[&handler_called, &loop](deps::StatusAPIResponse resp) {
 			handler_called = true;
@@ -939,6 +1141,7 @@ TEST_F(DeploymentsTests, PushStatusFailureTest) {
 		deployment_id,
 		status,
 		substatus,
+		nullopt,
 		client,
 		[&handler_called, &loop](deps::StatusAPIResponse resp) {
 			handler_called = true;
@@ -1459,8 +1662,11 @@ TEST_F(DeploymentsTests, JsonLogMessageReaderLargeLogsTest) {
 	}
 	os.close();
 
+	// The beginning of the logs is preserved, as well as the end.
 	string expected_data_start =
-		R"d({"messages":[{"timestamp": "2016-03-11T13:03:17.063493443Z", "level": "WARNING", "message": "(THE ORIGINAL LOGS WERE TOO BIG, THIS LOG IS TRUNCATED. The full log can be found on the device)"},{"timestamp": "2016-03-11T13:05:17.063493443Z", "level": "INFO", "message": "excessive log data"})d";
+		R"d({"messages":[{"timestamp": "2016-03-11T13:03:17.063493443Z", "level": "INFO", "message": "OK"},{"timestamp": "2020-03-11T13:03:17.063493443Z", "level": "WARNING", "message": "Warnings appeared"},)d";
+	string expected_truncation =
+		R"d(},{"timestamp": "2016-03-11T13:03:17.063493443Z", "level": "WARNING", "message": "(THE ORIGINAL LOGS WERE TOO BIG, THIS LOG IS TRUNCATED. The full log can be found on the device)"},{"timestamp": "2016-03-11T13:05:17.063493443Z", "level": "INFO", "message": "excessive log data"})d";
 	string expected_data_end =
 		R"d({"timestamp": "2016-03-11T13:05:17.063493443Z", "level": "INFO", "message": "excessive log data"}]})d";
 
@@ -1481,8 +1687,13 @@ TEST_F(DeploymentsTests, JsonLogMessageReaderLargeLogsTest) {
 		}
 	} while (n_read > 0);
 	EXPECT_EQ(ss.str().substr(0, expected_data_start.size()), expected_data_start);
+	auto truncation_pos = ss.str().find(expected_truncation);
+	EXPECT_NE(truncation_pos, string::npos);
+	EXPECT_GT(truncation_pos, expected_data_start.size());
+	EXPECT_LT(truncation_pos, ss.str().size() - expected_data_end.size());
 	EXPECT_EQ(ss.str().substr(ss.str().size() - expected_data_end.size()), expected_data_end);
 	EXPECT_EQ(ss.str().size(), total_size);
+	EXPECT_TRUE(json::Load(ss.str()));
 }
 
 TEST_F(DeploymentsTests, PushLogsTest) {
@@ -1753,6 +1964,165 @@ TEST_F(DeploymentsTests, PushLogsFailureTest) {
 	EXPECT_TRUE(handler_called);
 }
 
+TEST_F(DeploymentsTests, PushLogsCompressedTest) {
+	TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::Server server(server_config, loop);
+
+	http::ClientConfig client_config;
+	NoAuthHTTPClient client {client_config, loop};
+
+	const string messages =
+		R"({"timestamp": "2016-03-11T13:03:17.063493443Z", "level": "INFO", "message": "OK"}
+{"timestamp": "2020-03-11T13:03:17.063493443Z", "level": "WARNING", "message": "Warnings appeared"}
+)";
+	const string test_log_file_path = test_state_dir.Path() + "/test.log";
+	ofstream os {test_log_file_path};
+	auto err = io::WriteStringIntoOfstream(os, messages);
+	ASSERT_EQ(err, error::NoError);
+	os.close();
+
+	string expected_request_data =
+		R"({"messages":[{"timestamp": "2016-03-11T13:03:17.063493443Z", "level": "INFO", "message": "OK"},{"timestamp": "2020-03-11T13:03:17.063493443Z", "level": "WARNING", "message": "Warnings appeared"}]})";
+
+	vector<uint8_t> received_body;
+	string content_encoding;
+	server.AsyncServeUrl(
+		TEST_SERVER,
+		[&received_body, &content_encoding](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+
+			auto ex_encoding = req->GetHeader("Content-Encoding");
+			ASSERT_TRUE(ex_encoding);
+			content_encoding = ex_encoding.value();
+
+			auto content_length = req->GetHeader("Content-Length");
+			ASSERT_TRUE(content_length);
+			auto ex_len = common::StringToLongLong(content_length.value());
+			ASSERT_TRUE(ex_len);
+
+			auto body_writer = make_shared<io::ByteWriter>(received_body);
+			received_body.resize(ex_len.value());
+			req->SetBodyWriter(body_writer);
+		},
+		[](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+
+			auto result = exp_req.value()->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetHeader("Content-Length", "0");
+			resp->SetBodyReader(make_shared<io::StringReader>(""));
+			resp->SetStatusCodeAndMessage(204, "No content");
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	bool handler_called = false;
+	deps::DeploymentClient deployment_client {true};
+	err = deployment_client.PushLogs(
+		"2", test_log_file_path, client, [&handler_called, &loop](deps::StatusAPIResponse resp) {
+			handler_called = true;
+			EXPECT_EQ(resp.error, error::NoError);
+			loop.Stop();
+		});
+	EXPECT_EQ(err, error::NoError);
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+
+	EXPECT_EQ(content_encoding, "gzip");
+	io::ByteReader compressed {received_body};
+	stringstream decompressed;
+	io::StreamWriter decompressed_writer {decompressed};
+	err = gzip::Decompress(compressed, decompressed_writer);
+	ASSERT_EQ(err, error::NoError) << err.String();
+	EXPECT_EQ(decompressed.str(), expected_request_data);
+}
+
+TEST_F(DeploymentsTests, PushLogsCompressionUnsupportedTest) {
+	TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::Server server(server_config, loop);
+
+	http::ClientConfig client_config;
+	NoAuthHTTPClient client {client_config, loop};
+
+	const string messages =
+		R"({"timestamp": "2016-03-11T13:03:17.063493443Z", "level": "INFO", "message": "OK"}
+)";
+	const string test_log_file_path = test_state_dir.Path() + "/test.log";
+	ofstream os {test_log_file_path};
+	auto err = io::WriteStringIntoOfstream(os, messages);
+	ASSERT_EQ(err, error::NoError);
+	os.close();
+
+	string expected_request_data =
+		R"({"messages":[{"timestamp": "2016-03-11T13:03:17.063493443Z", "level": "INFO", "message": "OK"}]})";
+
+	// Whether each request was compressed.
+	vector<bool> compressed_requests;
+	vector<uint8_t> received_body;
+	server.AsyncServeUrl(
+		TEST_SERVER,
+		[&received_body, &compressed_requests](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+
+			compressed_requests.push_back(static_cast<bool>(req->GetHeader("Content-Encoding")));
+
+			auto content_length = req->GetHeader("Content-Length");
+			ASSERT_TRUE(content_length);
+			auto ex_len = common::StringToLongLong(content_length.value());
+			ASSERT_TRUE(ex_len);
+
+			auto body_writer = make_shared<io::ByteWriter>(received_body);
+			received_body.resize(ex_len.value());
+			req->SetBodyWriter(body_writer);
+		},
+		[&compressed_requests](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+
+			auto result = exp_req.value()->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetHeader("Content-Length", "0");
+			resp->SetBodyReader(make_shared<io::StringReader>(""));
+			if (compressed_requests.back()) {
+				resp->SetStatusCodeAndMessage(415, "Unsupported Media Type");
+			} else {
+				resp->SetStatusCodeAndMessage(204, "No content");
+			}
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	deps::DeploymentClient deployment_client {true};
+	for (int i = 0; i < 2; i++) {
+		bool handler_called = false;
+		err = deployment_client.PushLogs(
+			"2",
+			test_log_file_path,
+			client,
+			[&handler_called, &loop](deps::StatusAPIResponse resp) {
+				handler_called = true;
+				EXPECT_EQ(resp.error, error::NoError);
+				loop.Stop();
+			});
+		EXPECT_EQ(err, error::NoError);
+
+		loop.Run();
+		EXPECT_TRUE(handler_called);
+		EXPECT_EQ(common::StringFromByteVector(received_body), expected_request_data);
+	}
+
+	// After the refusal, the logs are sent uncompressed right away.
+	EXPECT_THAT(compressed_requests, testing::ElementsAre(true, false, false));
+}
+
 TEST_F(DeploymentsTests, DeploymentLogTest) {
 	deps::DeploymentLog dlog {test_state_dir.Path(), "1"};
 	dlog.BeginLogging();
@@ -1977,6 +2347,135 @@ TEST_F(DeploymentsTests, DeploymentLogRenameAndCleanPreviousLogsTest) {
 		"Test content in malformed file name 3\n");
 }
 
+string GetGzipFileContent(const string &path) {
+	io::FileReader reader {path};
+	stringstream content;
+	io::StreamWriter writer {content};
+	auto err = gzip::Decompress(reader, writer);
+	if (err != error::NoError) {
+		return "";
+	}
+	return content.str();
+}
+
+TEST_F(DeploymentsTests, DeploymentLogRotationTest) {
+	cfg_parser::DeploymentLogs limits;
+	limits.rotate_size_bytes = 1024;
+	deps::DeploymentLog dlog {test_state_dir.Path(), "1", limits};
+	dlog.BeginLogging();
+	for (int i = 0; i < 30; i++) {
+		mlog::Info("Testing rotation of the deployment log, message " + to_string(i));
+	}
+	dlog.FinishLogging();
+
+	auto log_path = path::Join(test_state_dir.Path(), "deployments.0000.1.log");
+	auto ex_size = io::FileSize(log_path);
+	ASSERT_TRUE(ex_size);
+	EXPECT_LT(ex_size.value(), 1024);
+	auto ex_rotated_size = io::FileSize(log_path + ".1");
+	ASSERT_TRUE(ex_rotated_size);
+	EXPECT_GE(ex_rotated_size.value(), 1024);
+	EXPECT_LT(ex_rotated_size.value(), 2048);
+
+	// The logs sent to the server hold both parts, the rotated one first, so the latest messages
+	// come last, in order.
+	deps::JsonLogMessagesReader logs_reader {log_path};
+	ASSERT_EQ(logs_reader.SanitizeLogs(), error::NoError);
+	stringstream data;
+	io::StreamWriter data_writer {data};
+	ASSERT_EQ(io::Copy(data_writer, logs_reader), error::NoError);
+
+	auto ex_j = json::Load(data.str());
+	ASSERT_TRUE(ex_j) << data.str();
+	auto ex_messages = ex_j.value().Get("messages");
+	ASSERT_TRUE(ex_messages);
+	auto ex_count = ex_messages.value().GetArraySize();
+	ASSERT_TRUE(ex_count);
+	auto count = ex_count.value();
+	ASSERT_GT(count, 0);
+	ASSERT_LT(count, 30);
+	for (size_t i = 0; i < count; i++) {
+		auto ex_msg = ex_messages.value()[i].and_then(
+			[](const json::Json &msg) { return msg.Get("message"); });
+		ASSERT_TRUE(ex_msg);
+		EXPECT_EQ(
+			ex_msg.value().GetString().value(),
+			"Testing rotation of the deployment log, message " + to_string(30 - count + i));
+	}
+}
+
+TEST_F(DeploymentsTests, DeploymentLogCompressPreviousLogsTest) {
+	ofstream os;
+	os.open(path::Join(test_state_dir.Path(), "deployments.0000.10.log.1"));
+	os << "Rotated content 0\n";
+	os.close();
+	os.open(path::Join(test_state_dir.Path(), "deployments.0000.10.log"));
+	os << "Test content 0 here\n";
+	os.close();
+
+	const string tmp_log = path::Join(test_state_dir.Path(), "tmp-log");
+	os.open(tmp_log);
+	os << "Test content 1 here\n";
+	os.close();
+	ASSERT_EQ(
+		gzip::CompressFiles(
+			{tmp_log}, path::Join(test_state_dir.Path(), "deployments.0001.11.log.gz")),
+		error::NoError);
+
+	cfg_parser::DeploymentLogs limits;
+	limits.compress = true;
+	deps::DeploymentLog dlog {test_state_dir.Path(), "21", limits};
+	dlog.BeginLogging();
+	mlog::Info("Testing info deployment logging");
+	dlog.FinishLogging();
+
+	EXPECT_EQ(
+		GetGzipFileContent(path::Join(test_state_dir.Path(), "deployments.0001.10.log.gz")),
+		"Rotated content 0\nTest content 0 here\n");
+	EXPECT_EQ(
+		GetGzipFileContent(path::Join(test_state_dir.Path(), "deployments.0002.11.log.gz")),
+		"Test content 1 here\n");
+	for (const auto &name :
+		 {"deployments.0000.10.log",
+		  "deployments.0000.10.log.1",
+		  "deployments.0001.10.log",
+		  "deployments.0001.10.log.1",
+		  "deployments.0001.11.log.gz"}) {
+		EXPECT_FALSE(path::FileExists(path::Join(test_state_dir.Path(), name))) << name;
+	}
+
+	// The ongoing log is not compressed.
+	EXPECT_THAT(
+		GetFileContent(path::Join(test_state_dir.Path(), "deployments.0000.21.log")),
+		testing::HasSubstr("Testing info deployment logging"));
+}
+
+TEST_F(DeploymentsTests, DeploymentLogLimitTotalSizeTest) {
+	ofstream os;
+	for (int i : {0, 1, 2}) {
+		string file_name = "deployments.000" + to_string(i) + ".1" + to_string(i) + ".log";
+		os.open(path::Join(test_state_dir.Path(), file_name));
+		os << string(99, static_cast<char>('a' + i)) << "\n";
+		os.close();
+	}
+
+	cfg_parser::DeploymentLogs limits;
+	limits.max_total_size_bytes = 250;
+	deps::DeploymentLog dlog {test_state_dir.Path(), "21", limits};
+	dlog.BeginLogging();
+	dlog.FinishLogging();
+
+	EXPECT_EQ(
+		GetFileContent(path::Join(test_state_dir.Path(), "deployments.0001.10.log")),
+		string(99, 'a') + "\n");
+	EXPECT_EQ(
+		GetFileContent(path::Join(test_state_dir.Path(), "deployments.0002.11.log")),
+		string(99, 'b') + "\n");
+	// the oldest log doesn't fit anymore
+	EXPECT_FALSE(path::FileExists(path::Join(test_state_dir.Path(), "deployments.0002.12.log")));
+	EXPECT_FALSE(path::FileExists(path::Join(test_state_dir.Path(), "deployments.0003.12.log")));
+}
+
 TEST_F(DeploymentsTests, TestTooManyRequestsWithRetryAfterHeader_HeaderHandler) {
 	TestEventLoop loop;
 	http::ClientConfig client_config;
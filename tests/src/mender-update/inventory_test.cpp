@@ -28,6 +28,7 @@
 #include <common/http.hpp>
 #include <common/io.hpp>
 #include <common/testing.hpp>
+#include <mender-update/context.hpp>
 
 #define TEST_SERVER "http://127.0.0.1:8002"
 
@@ -36,6 +37,7 @@ using namespace std;
 namespace api = mender::api;
 namespace common = mender::common;
 namespace conf = mender::client_shared::conf;
+namespace context = mender::update::context;
 namespace error = mender::common::error;
 namespace events = mender::common::events;
 namespace http = mender::common::http;
@@ -86,9 +88,15 @@ protected:
 		events::EventLoop &loop,
 		api::Client &client,
 		size_t &last_data_hash,
-		inv::APIResponseHandler api_handler) {
+		inv::APIResponseHandler api_handler,
+		const inv::RuntimeAttributes &runtime_attributes = {}) {
 		return inv::InventoryClient().PushInventoryData(
-			inventory_generators_dir, loop, client, last_data_hash, api_handler);
+			inventory_generators_dir,
+			runtime_attributes,
+			loop,
+			client,
+			last_data_hash,
+			api_handler);
 	}
 
 
@@ -479,6 +487,261 @@ exit 0
 	EXPECT_EQ(last_hash, last_hash_orig);
 }
 
+TEST_F(InventoryAPITests, PushInventoryDataWithRuntimeAttributes) {
+	string script = R"(#!/bin/sh
+echo "key1=value1"
+echo "key2=value2"
+exit 0
+)";
+	auto ret = PrepareTestScript("mender-inventory-script1", script);
+	ASSERT_TRUE(ret);
+
+	inv::RuntimeAttributes runtime_attributes;
+	ASSERT_EQ(runtime_attributes.Set("key2", "value22"), error::NoError);
+	ASSERT_EQ(runtime_attributes.Set("app_version", "1.2.3"), error::NoError);
+
+	mtesting::TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::Server server(server_config, loop);
+
+	http::ClientConfig client_config;
+	NoAuthHTTPClient client {client_config, loop};
+
+	const string expected_request_data =
+		R"([{"name":"app_version","value":"1.2.3"},{"name":"key1","value":"value1"},{"name":"key2","value":["value2","value22"]},{"name":"mender_client_version","value":")"
+		+ conf::kMenderVersion
+		+ R"("},{"name":"mender_client_version_provider","value":"internal"}])";
+
+	vector<uint8_t> received_body;
+	server.AsyncServeUrl(
+		TEST_SERVER,
+		[&received_body](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+
+			auto content_length = req->GetHeader("Content-Length");
+			ASSERT_TRUE(content_length);
+			auto ex_len = common::StringToLongLong(content_length.value());
+			ASSERT_TRUE(ex_len);
+
+			auto body_writer = make_shared<io::ByteWriter>(received_body);
+			received_body.resize(ex_len.value());
+			req->SetBodyWriter(body_writer);
+		},
+		[&received_body, &expected_request_data](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+
+			auto req = exp_req.value();
+			EXPECT_EQ(common::StringFromByteVector(received_body), expected_request_data);
+
+			auto result = req->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetHeader("Content-Length", "0");
+			resp->SetStatusCodeAndMessage(200, "Success");
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	bool handler_called = false;
+	size_t last_hash = 0;
+	auto err = CallPushInventoryData(
+		test_scripts_dir.Path(),
+		loop,
+		client,
+		last_hash,
+		[&handler_called, &loop](inv::APIResponse resp) {
+			handler_called = true;
+			ASSERT_EQ(resp.error, error::NoError);
+			loop.Stop();
+		},
+		runtime_attributes);
+	EXPECT_EQ(err, error::NoError);
+
+	loop.Run();
+	EXPECT_TRUE(handler_called);
+	EXPECT_EQ(last_hash, std::hash<string> {}(expected_request_data));
+}
+
+TEST_F(InventoryAPITests, PushInventoryChangesTest) {
+	mtesting::TemporaryDirectory datastore;
+	conf::MenderConfig config;
+	config.paths.SetDataStore(datastore.Path());
+	context::MenderContext main_context {config};
+	ASSERT_EQ(main_context.Initialize(), error::NoError);
+
+	mtesting::TestEventLoop loop;
+
+	http::ServerConfig server_config;
+	http::Server server(server_config, loop);
+
+	http::ClientConfig client_config;
+	NoAuthHTTPClient client {client_config, loop};
+
+	vector<http::Method> methods;
+	vector<string> bodies;
+	vector<uint8_t> received_body;
+	server.AsyncServeUrl(
+		TEST_SERVER,
+		[&received_body](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+			auto req = exp_req.value();
+
+			auto content_length = req->GetHeader("Content-Length");
+			ASSERT_TRUE(content_length);
+			auto ex_len = common::StringToLongLong(content_length.value());
+			ASSERT_TRUE(ex_len);
+
+			received_body.clear();
+			auto body_writer = make_shared<io::ByteWriter>(received_body);
+			received_body.resize(ex_len.value());
+			req->SetBodyWriter(body_writer);
+		},
+		[&received_body, &methods, &bodies](http::ExpectedIncomingRequestPtr exp_req) {
+			ASSERT_TRUE(exp_req) << exp_req.error().String();
+
+			auto req = exp_req.value();
+			EXPECT_EQ(req->GetPath(), "/api/devices/v1/inventory/device/attributes");
+			methods.push_back(req->GetMethod());
+			bodies.push_back(common::StringFromByteVector(received_body));
+
+			auto result = req->MakeResponse();
+			ASSERT_TRUE(result);
+			auto resp = result.value();
+
+			resp->SetHeader("Content-Length", "0");
+			resp->SetStatusCodeAndMessage(200, "Success");
+			resp->AsyncReply([](error::Error err) { ASSERT_EQ(error::NoError, err); });
+		});
+
+	auto push = [this, &loop, &client](inv::InventoryClient &inventory_client) {
+		bool handler_called = false;
+		auto err = inventory_client.PushData(
+			test_scripts_dir.Path(), loop, client, [&handler_called, &loop](inv::APIResponse resp) {
+				handler_called = true;
+				EXPECT_EQ(resp.error, error::NoError);
+				loop.Stop();
+			});
+		EXPECT_EQ(err, error::NoError);
+		loop.Run();
+		EXPECT_TRUE(handler_called);
+	};
+
+	const string version_attributes =
+		R"({"name":"mender_client_version","value":")" + conf::kMenderVersion
+		+ R"("},{"name":"mender_client_version_provider","value":"internal"})";
+
+	ASSERT_TRUE(PrepareTestScript("mender-inventory-script1", R"(#!/bin/sh
+echo "key1=value1"
+echo "key2=value2"
+echo "key3=value3"
+)"));
+	inv::InventoryClient inventory_client {
+		main_context.GetMenderStoreDB(), true, chrono::seconds {0}};
+
+	// Nothing submitted before, so everything is.
+	push(inventory_client);
+	ASSERT_EQ(methods.size(), 1);
+	EXPECT_EQ(methods[0], http::Method::PUT);
+	EXPECT_EQ(
+		bodies[0],
+		R"([{"name":"key1","value":"value1"},{"name":"key2","value":"value2"},{"name":"key3","value":"value3"},)"
+			+ version_attributes + "]");
+
+	// Unchanged, also after a restart.
+	push(inventory_client);
+	inv::InventoryClient restarted_client {
+		main_context.GetMenderStoreDB(), true, chrono::seconds {0}};
+	push(restarted_client);
+	EXPECT_EQ(methods.size(), 1);
+
+	ASSERT_TRUE(PrepareTestScript("mender-inventory-script1", R"(#!/bin/sh
+echo "key1=value1"
+echo "key2=value22"
+echo "key2=value23"
+echo "key3=value3"
+echo "key4=value4"
+)"));
+	push(restarted_client);
+	ASSERT_EQ(methods.size(), 2);
+	EXPECT_EQ(methods[1], http::Method::PATCH);
+	EXPECT_EQ(
+		bodies[1],
+		R"([{"name":"key2","value":["value22","value23"]},{"name":"key4","value":"value4"}])");
+
+	ASSERT_TRUE(PrepareTestScript("mender-inventory-script1", R"(#!/bin/sh
+echo "key1=value1"
+echo "key4=value4"
+)"));
+	push(restarted_client);
+	ASSERT_EQ(methods.size(), 3);
+	EXPECT_EQ(methods[2], http::Method::PUT);
+	EXPECT_EQ(
+		bodies[2],
+		R"([{"name":"key1","value":"value1"},{"name":"key4","value":"value4"},)"
+			+ version_attributes + "]");
+
+	// For example after re-authentication, or when forced over DBus.
+	restarted_client.ClearDataCache();
+	push(restarted_client);
+	ASSERT_EQ(methods.size(), 4);
+	EXPECT_EQ(methods[3], http::Method::PUT);
+	EXPECT_EQ(bodies[3], bodies[2]);
+
+	// Leaves no record behind when changes aren't tracked.
+	inv::InventoryClient full_client {
+		main_context.GetMenderStoreDB(), false, chrono::seconds {0}};
+	ASSERT_TRUE(PrepareTestScript("mender-inventory-script1", R"(#!/bin/sh
+echo "key1=value1"
+)"));
+	push(full_client);
+	ASSERT_EQ(methods.size(), 5);
+	EXPECT_EQ(methods[4], http::Method::PUT);
+	auto exp_record =
+		main_context.GetMenderStoreDB().Read(context::MenderContext::submitted_inventory_key);
+	EXPECT_FALSE(exp_record);
+}
+
+TEST(InventoryRuntimeAttributesTests, SetAndRemove) {
+	inv::RuntimeAttributes attributes;
+
+	EXPECT_EQ(attributes.Set("app_version", "1.2.3"), error::NoError);
+	EXPECT_EQ(attributes.Set("app_version", "1.2.4"), error::NoError);
+	EXPECT_EQ(attributes.Set("calibration", "0.97"), error::NoError);
+	EXPECT_EQ(attributes.Get().size(), 2);
+	EXPECT_EQ(attributes.Get().at("app_version"), "1.2.4");
+
+	EXPECT_EQ(attributes.Set("app_version", ""), error::NoError);
+	EXPECT_EQ(attributes.Get().count("app_version"), 0);
+	// Removing an attribute which isn't there is fine.
+	EXPECT_EQ(attributes.Set("app_version", ""), error::NoError);
+
+	auto err = attributes.Set("", "value");
+	EXPECT_EQ(err.code, inv::MakeError(inv::InvalidAttributeError, "").code);
+	err = attributes.Set("mender_client_version", "1.0.0");
+	EXPECT_EQ(err.code, inv::MakeError(inv::InvalidAttributeError, "").code);
+	EXPECT_EQ(attributes.Get().size(), 1);
+
+	attributes.Clear();
+	EXPECT_EQ(attributes.Get().size(), 0);
+}
+
+TEST(InventoryRuntimeAttributesTests, Limit) {
+	inv::RuntimeAttributes attributes;
+
+	for (size_t i = 0; i < inv::RuntimeAttributes::kMaxAttributes; i++) {
+		ASSERT_EQ(attributes.Set("attr" + to_string(i), "value"), error::NoError);
+	}
+
+	auto err = attributes.Set("one_too_many", "value");
+	EXPECT_EQ(err.code, inv::MakeError(inv::InvalidAttributeError, "").code);
+
+	// Existing attributes can still be changed.
+	EXPECT_EQ(attributes.Set("attr0", "other value"), error::NoError);
+	EXPECT_EQ(attributes.Get().size(), inv::RuntimeAttributes::kMaxAttributes);
+}
+
 TEST_F(InventoryAPITests, TestTooManyRequestsWithRetryAfterHeader) {
 	TestEventLoop loop;
 	http::ClientConfig client_config;
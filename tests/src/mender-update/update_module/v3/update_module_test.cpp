@@ -14,7 +14,11 @@
 
 #include <mender-update/update_module/v3/update_module.hpp>
 
+#include <fcntl.h>
+#include <signal.h>
 #include <sys/stat.h>
+#include <sys/wait.h>
+#include <unistd.h>
 
 #include <algorithm>
 #include <string>
@@ -512,6 +516,166 @@ TEST_F(UpdateModuleFileTreeTests, FileTreeTestHeader) {
 	ASSERT_EQ(err, error::NoError);
 }
 
+TEST_F(UpdateModuleFileTreeTests, FileTreeCheckpoint) {
+	auto exp_update_module =
+		update_module::UpdateModule::Create(*ctx, update_payload_header->header.payload_type);
+	ASSERT_TRUE(exp_update_module.has_value());
+	auto up_mod = std::move(exp_update_module.value());
+
+	const string checkpoints_path = path::Join(cfg.paths.GetModulesWorkPath(), "checkpoints");
+	const string stale_checkpoint = path::Join(checkpoints_path, "other-artifact");
+	ASSERT_EQ(path::CreateDirectories(stale_checkpoint), error::NoError);
+
+	const string tree_path = test_tree_dir.Path();
+	auto err = up_mod->CleanAndPrepareFileTree(tree_path, *update_payload_header);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_FALSE(path::FileExists(stale_checkpoint));
+
+	{
+		ofstream os(path::Join(tree_path, "checkpoint", "offset"));
+		os << "1234\n";
+		ASSERT_TRUE(os.good());
+	}
+
+	// A new attempt to download the same Artifact keeps the checkpoint.
+	err = up_mod->CleanAndPrepareFileTree(tree_path, *update_payload_header);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_TRUE(FileContainsExactly(path::Join(tree_path, "checkpoint", "offset"), "1234\n"));
+	EXPECT_TRUE(
+		FileContainsExactly(path::Join(checkpoints_path, "test-artifact", "offset"), "1234\n"));
+
+	err = up_mod->DeleteCheckpoints();
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_FALSE(path::FileExists(checkpoints_path));
+
+	err = up_mod->DeleteFileTree(tree_path);
+	ASSERT_EQ(err, error::NoError);
+}
+
+TEST_F(UpdateModuleFileTreeTests, FileTreeDeploymentMetadata) {
+	auto exp_update_module =
+		update_module::UpdateModule::Create(*ctx, update_payload_header->header.payload_type);
+	ASSERT_TRUE(exp_update_module.has_value());
+	auto up_mod = std::move(exp_update_module.value());
+
+	update_module::DeploymentMetadata metadata {
+		.deployment_id = "deployment-1",
+		.artifact_name = "test-artifact",
+		.artifact_group = "",
+		.artifact_provides = {{"rootfs-image.version", "test-artifact"}, {"a", "\"b\""}},
+		.server_deployment = R"({"id":"deployment-1","artifact":{"artifact_name":"test-artifact"}})",
+	};
+	auto err = up_mod->SetDeploymentMetadata(metadata);
+	ASSERT_EQ(err, error::NoError);
+
+	const string tree_path = test_tree_dir.Path();
+	err = up_mod->CleanAndPrepareFileTree(tree_path, *update_payload_header);
+	ASSERT_EQ(err, error::NoError);
+
+	EXPECT_TRUE(FileJsonEquals(
+		path::Join(tree_path, "tmp", update_module::deployment_metadata_file),
+		R"({
+		  "deployment_id": "deployment-1",
+		  "artifact_name": "test-artifact",
+		  "artifact_group": "",
+		  "artifact_provides": {
+		    "a": "\"b\"",
+		    "rootfs-image.version": "test-artifact"
+		  },
+		  "server_deployment": {
+		    "id": "deployment-1",
+		    "artifact": {
+		      "artifact_name": "test-artifact"
+		    }
+		  }
+		})"));
+
+	auto environment = update_module::DeploymentMetadataEnvironment(metadata, "/some/file");
+	EXPECT_EQ(
+		environment,
+		(map<string, string> {
+			{"MENDER_DEPLOYMENT_ID", "deployment-1"},
+			{"MENDER_ARTIFACT_NAME", "test-artifact"},
+			{"MENDER_DEPLOYMENT_METADATA", "/some/file"},
+		}));
+
+	err = up_mod->DeleteFileTree(tree_path);
+	ASSERT_EQ(err, error::NoError);
+}
+
+TEST_F(UpdateModuleFileTreeTests, RemoveScratchSpace) {
+	const string scratch_path = path::Join(cfg.paths.GetDataStore(), "scripts-prefetch");
+	ASSERT_EQ(path::CreateDirectories(scratch_path), error::NoError);
+	auto err = update_module::AddScratchPath(cfg, scratch_path);
+	ASSERT_EQ(err, error::NoError);
+	// Recording a path twice is fine.
+	err = update_module::AddScratchPath(cfg, scratch_path);
+	ASSERT_EQ(err, error::NoError);
+
+	// Never removed, since it isn't in the data store.
+	const string outside_path = path::Join(temp_dir.Path(), "outside");
+	ASSERT_EQ(path::CreateDirectories(outside_path), error::NoError);
+	err = update_module::AddScratchPath(cfg, outside_path);
+	ASSERT_EQ(err, error::NoError);
+
+	// Not while a deployment is in progress.
+	auto &db = ctx->GetMenderStoreDB();
+	err = db.Write(context::MenderContext::state_data_key, common::ByteVectorFromString("{}"));
+	ASSERT_EQ(err, error::NoError);
+	err = update_module::RemoveLeftoverScratchSpace(*ctx);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_TRUE(path::FileExists(scratch_path));
+
+	err = db.Remove(context::MenderContext::state_data_key);
+	ASSERT_EQ(err, error::NoError);
+	err = update_module::RemoveLeftoverScratchSpace(*ctx);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_FALSE(path::FileExists(scratch_path));
+	EXPECT_TRUE(path::FileExists(outside_path));
+	EXPECT_FALSE(path::FileExists(path::Join(test_state_dir.Path(), "deployment-scratch-paths")));
+
+	// Nothing left to remove.
+	err = update_module::RemoveScratchSpace(cfg);
+	ASSERT_EQ(err, error::NoError);
+}
+
+TEST_F(UpdateModuleFileTreeTests, FileTreeCheckpointNames) {
+	auto exp_update_module =
+		update_module::UpdateModule::Create(*ctx, update_payload_header->header.payload_type);
+	ASSERT_TRUE(exp_update_module.has_value());
+	auto up_mod = std::move(exp_update_module.value());
+
+	const string checkpoints_path = path::Join(cfg.paths.GetModulesWorkPath(), "checkpoints");
+	const string tree_path = test_tree_dir.Path();
+	auto payload_header = *update_payload_header;
+
+	payload_header.header.artifact_name = "release 1";
+	auto err = up_mod->CleanAndPrepareFileTree(tree_path, payload_header);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_TRUE(path::FileExists(path::Join(checkpoints_path, "release_201")));
+	{
+		ofstream os(path::Join(tree_path, "checkpoint", "offset"));
+		os << "1234\n";
+		ASSERT_TRUE(os.good());
+	}
+
+	// Would have the same checkpoint as "release 1" if the characters were only replaced.
+	payload_header.header.artifact_name = "release_1";
+	err = up_mod->CleanAndPrepareFileTree(tree_path, payload_header);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_TRUE(path::FileExists(path::Join(checkpoints_path, "release_5F1")));
+	EXPECT_FALSE(path::FileExists(path::Join(checkpoints_path, "release_201")));
+	EXPECT_FALSE(path::FileExists(path::Join(tree_path, "checkpoint", "offset")));
+
+	payload_header.header.artifact_name = "..";
+	err = up_mod->CleanAndPrepareFileTree(tree_path, payload_header);
+	ASSERT_EQ(err, error::NoError);
+	EXPECT_TRUE(path::FileExists(path::Join(checkpoints_path, "_2E.")));
+
+	err = up_mod->DeleteFileTree(tree_path);
+	ASSERT_EQ(err, error::NoError);
+}
+
 TEST_F(UpdateModuleTests, CallProvidePayloadFileSizes) {
 	UpdateModuleTestWithDefaultArtifact update_module_test(*this);
 	ASSERT_FALSE(HasFailure());
@@ -858,6 +1022,28 @@ exit 0
 	EXPECT_EQ(err.code, make_error_condition(errc::is_a_directory)) << err.String();
 }
 
+TEST_F(UpdateModuleTests, DownloadProcessStoreFilesExceedsWorkDirQuota) {
+	UpdateModuleTestWithDefaultArtifact art(*this);
+
+	auto maybe_script = PrepareUpdateModuleScript(*art.update_module);
+	ASSERT_TRUE(maybe_script) << maybe_script.error();
+	auto script_path = maybe_script.value();
+	{
+		ofstream um_script(script_path);
+		um_script << R"delim(#!/bin/bash
+exit 0
+)delim";
+	}
+
+	// The payload is 1 MiB, so it doesn't fit.
+	art.config.module_work_dir_quota_bytes = 1000;
+
+	auto err = art.update_module->Download(*art.payload);
+	EXPECT_EQ(err.code, context::MakeError(context::WorkDirQuotaExceededError, "").code)
+		<< err.String();
+	EXPECT_FALSE(path::FileExists(path::Join(work_dir_, "files/rootfs")));
+}
+
 TEST_F(UpdateModuleTests, DownloadProcessTimesOut) {
 	UpdateModuleTestWithDefaultArtifact art(*this);
 
@@ -905,6 +1091,189 @@ exit 1
 	ASSERT_EQ(error::NoError, ret);
 }
 
+TEST_F(UpdateModuleTests, CallArtifactInstallWithInstallLocks) {
+	UpdateModuleTestWithDefaultArtifact update_module_test(*this);
+	ASSERT_FALSE(HasFailure());
+
+	string installScript = R"(#!/bin/sh
+exit 0
+)";
+
+	auto ok = PrepareUpdateModuleScript(*update_module_test.update_module, installScript);
+	ASSERT_TRUE(ok);
+
+	auto lock = path::Join(temp_dir_.Path(), "lock");
+	// The directory of the second lock doesn't exist, so it should be skipped.
+	update_module_test.config.install_locks = {lock, path::Join(temp_dir_.Path(), "none", "lock")};
+
+	auto ret = update_module_test.update_module->ArtifactInstall();
+	ASSERT_EQ(error::NoError, ret) << ret.String();
+	EXPECT_TRUE(path::FileExists(lock));
+}
+
+TEST_F(UpdateModuleTests, CallArtifactInstallInstallLockTimeout) {
+	UpdateModuleTestWithDefaultArtifact update_module_test(*this);
+	ASSERT_FALSE(HasFailure());
+
+	auto installed = path::Join(temp_dir_.Path(), "installed");
+	string installScript = "#!/bin/sh\ntouch " + installed + "\nexit 0\n";
+
+	auto ok = PrepareUpdateModuleScript(*update_module_test.update_module, installScript);
+	ASSERT_TRUE(ok);
+
+	auto lock = path::Join(temp_dir_.Path(), "lock");
+	update_module_test.config.install_locks = {lock};
+	update_module_test.config.install_lock_timeout_seconds = 1;
+
+	// fcntl locks don't conflict within the same process, so hold the lock in a child.
+	int pipe_fds[2];
+	ASSERT_EQ(pipe(pipe_fds), 0);
+	pid_t child = fork();
+	ASSERT_GE(child, 0);
+	if (child == 0) {
+		int fd = open(lock.c_str(), O_RDWR | O_CREAT, 0640);
+		struct flock fl {};
+		fl.l_type = F_WRLCK;
+		fl.l_whence = SEEK_SET;
+		fcntl(fd, F_SETLKW, &fl);
+		char c = 'x';
+		(void)write(pipe_fds[1], &c, 1);
+		pause();
+		_exit(0);
+	}
+	char c;
+	ASSERT_EQ(read(pipe_fds[0], &c, 1), 1);
+
+	auto ret = update_module_test.update_module->ArtifactInstall();
+	kill(child, SIGKILL);
+	waitpid(child, nullptr, 0);
+	close(pipe_fds[0]);
+	close(pipe_fds[1]);
+
+	ASSERT_NE(error::NoError, ret);
+	EXPECT_EQ(ret.code, make_error_condition(errc::timed_out)) << ret.String();
+	EXPECT_FALSE(path::FileExists(installed));
+}
+
+TEST_F(UpdateModuleTests, CallArtifactInstallReportsProgress) {
+	UpdateModuleTestWithDefaultArtifact update_module_test(*this);
+	ASSERT_FALSE(HasFailure());
+
+	// Left over from an earlier state, should not be reported.
+	{
+		ofstream progress(path::Join(GetUpdateModuleWorkDir(), "progress"));
+		progress << "50 Old\n";
+	}
+
+	string installScript = R"(#!/bin/sh
+echo "10 Preparing" >> "$2/progress"
+sleep 2
+echo "120 Invalid" >> "$2/progress"
+sleep 2
+echo "100" >> "$2/progress"
+printf "99 Incomplete" >> "$2/progress"
+exit 0
+)";
+
+	auto ok = PrepareUpdateModuleScript(*update_module_test.update_module, installScript);
+	ASSERT_TRUE(ok);
+
+	vector<pair<update_module::State, update_module::ModuleProgress>> reported;
+	update_module_test.update_module->SetProgressHandler(
+		[&reported](update_module::State state, const update_module::ModuleProgress &progress) {
+			reported.push_back({state, progress});
+		});
+
+	auto ret = update_module_test.update_module->ArtifactInstall();
+	ASSERT_EQ(error::NoError, ret) << ret.String();
+
+	ASSERT_EQ(reported.size(), 2);
+	EXPECT_EQ(reported[0].first, update_module::State::ArtifactInstall);
+	EXPECT_EQ(reported[0].second.percentage, 10);
+	EXPECT_EQ(reported[0].second.description, "Preparing");
+	EXPECT_EQ(reported[1].first, update_module::State::ArtifactInstall);
+	EXPECT_EQ(reported[1].second.percentage, 100);
+	EXPECT_EQ(reported[1].second.description, "");
+}
+
+TEST_F(UpdateModuleTests, CallArtifactInstallExceedsWorkDirQuota) {
+	UpdateModuleTestWithDefaultArtifact update_module_test(*this);
+	ASSERT_FALSE(HasFailure());
+
+	string installScript = R"(#!/bin/sh
+mkdir -p "$2/tmp"
+dd if=/dev/zero of="$2/tmp/image" bs=1024 count=2048
+sleep 30
+exit 0
+)";
+
+	auto ok = PrepareUpdateModuleScript(*update_module_test.update_module, installScript);
+	ASSERT_TRUE(ok);
+
+	update_module_test.config.module_work_dir_quota_bytes = 1024 * 1024;
+
+	auto start = chrono::steady_clock::now();
+	auto ret = update_module_test.update_module->ArtifactInstall();
+	EXPECT_EQ(ret.code, context::MakeError(context::WorkDirQuotaExceededError, "").code)
+		<< ret.String();
+	// Stopped by the quota, not when the script finished.
+	EXPECT_LT(chrono::steady_clock::now() - start, chrono::seconds(20));
+}
+
+TEST_F(UpdateModuleTests, TerminateArtifactInstall) {
+	TestEventLoop loop;
+	UpdateModuleTestWithDefaultArtifact update_module_test(*this);
+	ASSERT_FALSE(HasFailure());
+
+	string installScript = R"(#!/bin/sh
+sleep 30
+exit 0
+)";
+
+	auto ok = PrepareUpdateModuleScript(*update_module_test.update_module, installScript);
+	ASSERT_TRUE(ok);
+
+	auto start = chrono::steady_clock::now();
+	error::Error install_err;
+	auto err = update_module_test.update_module->AsyncArtifactInstall(
+		loop, [&install_err, &loop](error::Error err) {
+			install_err = err;
+			loop.Stop();
+		});
+	ASSERT_EQ(err, error::NoError) << err.String();
+
+	auto &update_module = *update_module_test.update_module;
+	events::Timer terminate_timer(loop);
+	terminate_timer.AsyncWait(chrono::milliseconds {200}, [&update_module](error::Error err) {
+		ASSERT_EQ(err, error::NoError);
+		update_module.Terminate(
+			error::Error(make_error_condition(errc::timed_out), "Took too long"));
+	});
+
+	loop.Run();
+
+	EXPECT_EQ(install_err.code, make_error_condition(errc::timed_out)) << install_err.String();
+	EXPECT_THAT(install_err.String(), testing::HasSubstr("Took too long"));
+	// Stopped, not when the script finished.
+	EXPECT_LT(chrono::steady_clock::now() - start, chrono::seconds(20));
+}
+
+TEST(UpdateModuleProgressTests, ParseModuleProgress) {
+	auto exp_progress = update_module::ParseModuleProgress("45 Writing image");
+	ASSERT_TRUE(exp_progress) << exp_progress.error().String();
+	EXPECT_EQ(exp_progress.value().percentage, 45);
+	EXPECT_EQ(exp_progress.value().description, "Writing image");
+
+	exp_progress = update_module::ParseModuleProgress("0");
+	ASSERT_TRUE(exp_progress) << exp_progress.error().String();
+	EXPECT_EQ(exp_progress.value().percentage, 0);
+	EXPECT_EQ(exp_progress.value().description, "");
+
+	EXPECT_FALSE(update_module::ParseModuleProgress("Writing image"));
+	EXPECT_FALSE(update_module::ParseModuleProgress("101 Too far"));
+	EXPECT_FALSE(update_module::ParseModuleProgress("-1 Not started"));
+}
+
 TEST_F(UpdateModuleTests, DownloadWithFileSizesProcess) {
 	UpdateModuleTestWithDefaultArtifact art(*this);
 
@@ -1347,6 +1716,39 @@ TEST_F(UpdateModuleTests, SystemReboot) {
 	EXPECT_THAT(err.String(), testing::HasSubstr("Unable to call system reboot command"));
 }
 
+TEST_F(UpdateModuleTests, ConfiguredSystemRebootCommands) {
+	TestEventLoop loop;
+	UpdateModuleTestWithDefaultArtifact update_module_test(*this);
+	auto &update_module = *update_module_test.update_module;
+
+	const string reboots_file = path::Join(temp_dir_.Path(), "reboots");
+	update_module_test.config.reboot_command = {"sh", "-c", "echo kexec >> " + reboots_file};
+	update_module_test.config.rollback_reboot_command = {
+		"sh", "-c", "echo rollback >> " + reboots_file};
+	update_module_test.config.reboot_timeout_seconds = 1;
+
+	// The commands return without rebooting, so both time out.
+	for (auto kind :
+		 {update_module::SystemRebootKind::Update, update_module::SystemRebootKind::Rollback}) {
+		bool reboot_returned {false};
+		auto err = update_module.AsyncSystemReboot(
+			loop,
+			[&reboot_returned, &loop](error::Error err) {
+				EXPECT_EQ(err.code, make_error_condition(errc::timed_out)) << err.String();
+				reboot_returned = true;
+				loop.Stop();
+			},
+			kind);
+		ASSERT_EQ(err, error::NoError) << err.String();
+
+		loop.Run();
+
+		EXPECT_TRUE(reboot_returned);
+	}
+
+	EXPECT_TRUE(FileContainsExactly(reboots_file, "kexec\nrollback\n"));
+}
+
 TEST_F(UpdateModuleTests, IllegalPayloadFilePath) {
 	UpdateModuleTestWithArtifactContainingIllegalPayloadFile art(*this);
 